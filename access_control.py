@@ -0,0 +1,480 @@
+"""
+TerraFusion Platform - Access Control
+
+This module provides county-scoped role-based access control for the API.
+A user's access is a set of role bindings, each granting one role in one
+county (or every county, "*") and optionally only some of its datasets
+(sync pairs):
+
+    {"username": "jdoe", "role": "operator", "county_id": "benton_wa",
+     "datasets": ["benton_wa_pacs_staging"]}
+
+Roles and the actions they allow (see ACCESS_ROLES):
+
+- viewer: read
+- assessor: read, export, review (resolve conflicts, review topology issues,
+  reprocess dead letters and quarantined records)
+- operator: read, export, run (start, pause and cancel syncs, schedules and
+  CDC listeners, push records, import spreadsheets, publish datasets)
+- admin: all of the above, and manage (role bindings, webhooks, API keys,
+  watermark resets, snapshot removal, configuration reloads)
+
+Users without bindings keep the access of their RBAC role in their county
+(see LEGACY_ROLES; RBAC admins in every county), so existing accounts work
+unchanged until an admin binds them. Users of other roles without a county
+have no access until then.
+
+The gateway middleware works out each request's action from its route (see
+route_action) and the counties and sync pairs it touches from its path,
+query and body, and from the stored record of the job, snapshot, conflict
+or other resource it names. A request the caller has no binding for is
+refused with 403; a write that names no county needs the action in every
+county. Listings are scoped the same way: visible() drops the items of
+counties and sync pairs the caller may not read, and the state store and
+export directories hold an authorized request to its caller's counties
+(see tenancy). Scoped API keys (see
+api_keys) are limited by their scopes and, when they have one, their county.
+Anonymous requests are let through unless ACCESS_CONTROL_REQUIRE_AUTH is
+true, so deployments can turn authentication on once their integrations
+carry tokens or keys.
+"""
+
+import os
+import re
+import time
+import uuid
+import logging
+import threading
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Iterable, Tuple
+
+from sync_store import DocumentStore, sync_state_store
+from audit_log import AuditLog, audit_log
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection
+BINDINGS_COLLECTION = "role_bindings"
+
+# Actions, from least to most privileged
+ACTIONS = ["read", "export", "review", "run", "manage"]
+
+# Roles and the actions they allow
+ACCESS_ROLES = {
+    "viewer": {"description": "Read county data, jobs and reports", "actions": ["read"]},
+    "assessor": {"description": "Read and export county data, and review conflicts, topology issues and rejected "
+                                "records",
+                 "actions": ["read", "export", "review"]},
+    "operator": {"description": "Read and export county data, and run syncs, schedules and record pushes",
+                 "actions": ["read", "export", "run"]},
+    "admin": {"description": "Everything, including role bindings, webhooks and API keys", "actions": list(ACTIONS)},
+}
+
+# Access role of an RBAC role (rbac_manager.RBAC_ROLES), for users without bindings
+LEGACY_ROLES = {
+    "admin": "admin",
+    "manager": "operator",
+    "auditor": "viewer",
+    "viewer": "viewer",
+    "ai_analyst": "viewer",
+    "gis_specialist": "viewer",
+}
+
+ALL = "*"
+
+# Endpoints anyone may call, and the sign-in endpoints that check their callers themselves
+PUBLIC_ENDPOINTS = {
+    "health_check", "list_api_versions", "get_openapi_spec", "rbac_login", "rbac_sso_login", "rbac_sso_callback",
+    "get_event_bus_health", "ai_health_check", "exemption_seer_health", "ai_demo", "rbac_directory_health",
+    "district_lookup_info", "lookup_district_by_coordinates", "lookup_district_by_address", "list_districts",
+    "get_district_info", "list_access_roles", "get_my_access", "rbac_mfa_status", "rbac_mfa_enroll", "rbac_mfa_confirm",
+    "rbac_mfa_verify", "rbac_mfa_backup_codes", "rbac_refresh_token", "rbac_logout", "readiness_check",
+}
+
+# Actions of endpoints that differ from their method's (GET is read, other methods run)
+ROUTE_ACTIONS = {
+    "create_export_job": "export",
+    "cancel_export_job": "export",
+    "deliver_export_job": "export",
+    "query_sync_graphql": "read",
+    "ai_analyze_gis_export": "read",
+    "ai_analyze_sync_operation": "read",
+    "ai_analyze_exemption": "read",
+    "check_topology": "read",
+    "standardize_address": "read",
+    "resolve_sync_conflict": "review",
+    "review_topology_issue": "review",
+    "review_permit_worklist_item": "review",
+    "review_sync_anomaly": "review",
+    "review_exemption_audit_item": "review",
+    "discard_dead_letter": "review",
+    "reprocess_dead_letters": "review",
+    "revalidate_quarantined_records": "review",
+    "reset_sync_watermarks": "manage",
+    "sync_snapshot.DELETE": "manage",
+    "restore_sync_snapshot": "manage",
+    "roll_over_sync_pair": "manage",
+    "list_webhooks": "manage",
+    "create_webhook": "manage",
+    "get_webhook": "manage",
+    "update_webhook": "manage",
+    "delete_webhook": "manage",
+    "rotate_webhook_secret": "manage",
+    "list_webhook_deliveries": "manage",
+    "get_webhook_delivery": "manage",
+    "redeliver_webhook": "manage",
+    "list_api_keys": "manage",
+    "create_api_key": "manage",
+    "get_api_key": "manage",
+    "revoke_api_key": "manage",
+    "rotate_api_key": "manage",
+    "rbac_list_users": "manage",
+    "rbac_mfa_reset": "manage",
+    "rbac_revoke_sessions": "manage",
+    "list_role_bindings": "manage",
+    "create_role_binding": "manage",
+    "delete_role_binding": "manage",
+    "reload_configuration": "manage",
+    "get_configuration_reload": "manage",
+    "get_county_overrides": "manage",
+    "update_county_overrides": "manage",
+    "delete_county_overrides": "manage",
+    "set_county_feature": "manage",
+}
+
+# Reads that list every county's data and are not narrowed by visible(); without a county they need read everywhere
+UNSCOPED_READ_ENDPOINTS = {"stream_sync_job_events", "stream_system_events", "export_dead_letters", "get_sync_queue"}
+
+# Refuse anonymous API requests
+REQUIRE_AUTH = os.environ.get("ACCESS_CONTROL_REQUIRE_AUTH", "false").lower() == "true"
+
+# Seconds a gateway trusts its cached bindings; changes on other gateways apply within this
+CACHE_SECONDS = float(os.environ.get("ACCESS_CONTROL_CACHE_SECONDS", "30"))
+
+_NAME = re.compile(r"^[\w.@\\-]+$")
+
+
+class AccessDenied(PermissionError):
+    """Raised when a caller may not perform a request; status is 401 without a caller, else 403."""
+
+    def __init__(self, message: str, status: int = 403):
+        super().__init__(message)
+        self.status = status
+
+
+def route_action(endpoint: Optional[str], method: str) -> Optional[str]:
+    """The action a route performs; None for public routes and routes outside the API."""
+    if not endpoint or endpoint in PUBLIC_ENDPOINTS:
+        return None
+    action = ROUTE_ACTIONS.get(f"{endpoint}.{method}") or ROUTE_ACTIONS.get(endpoint)
+    if action:
+        return action
+    return "read" if method in ("GET", "HEAD") else "run"
+
+
+def resources_of(value: Any) -> List[Tuple[Optional[str], Optional[str]]]:
+    """
+    The (county_id, sync_pair_id) pairs a request body or stored record names:
+    its own, and those of the job specs of a batch ("jobs" with "defaults", or "items").
+    """
+    if not isinstance(value, dict):
+        return []
+    found = []
+    if value.get("county_id") or value.get("sync_pair_id"):
+        found.append((value.get("county_id"), value.get("sync_pair_id")))
+    defaults = value.get("defaults") if isinstance(value.get("defaults"), dict) else {}
+    jobs = value.get("jobs") if isinstance(value.get("jobs"), list) else []
+    for spec in jobs:
+        if isinstance(spec, dict):
+            found.extend(resources_of(dict(defaults, **spec)))
+    items = value.get("items") if isinstance(value.get("items"), list) else []
+    for item in items:
+        if isinstance(item, dict):
+            found.extend(resources_of(item.get("spec")))
+    return found
+
+
+class Principal:
+    """A caller and its role bindings."""
+
+    def __init__(self, name: str, kind: str, bindings: List[Dict[str, Any]], registry=None):
+        self.name = name
+        self.kind = kind  # "user" or "service"
+        self.bindings = bindings
+        self.registry = registry
+
+    def county_of(self, sync_pair_id: Optional[str]) -> Optional[str]:
+        if not sync_pair_id or self.registry is None:
+            return None
+        try:
+            return self.registry.get(sync_pair_id).county_id
+        except KeyError:
+            return None
+
+    def can(self, action: str, county_id: Optional[str] = None, sync_pair_id: Optional[str] = None) -> bool:
+        """
+        Whether a binding allows an action on a county's data, or on one sync pair's.
+
+        With neither, the action must be allowed in every county. A sync pair
+        is in its configured county; naming it with another is never allowed.
+        """
+        registered = self.county_of(sync_pair_id)
+        if registered:
+            if county_id and county_id != registered:
+                return False
+            county_id = registered
+        for binding in self.bindings:
+            if action not in ACCESS_ROLES[binding["role"]]["actions"]:
+                continue
+            if binding["county_id"] != ALL and binding["county_id"] != county_id:
+                continue
+            datasets = binding.get("datasets") or [ALL]
+            if ALL in datasets or (sync_pair_id and sync_pair_id in datasets):
+                return True
+        return False
+
+    def role_in(self, county_id: Optional[str]) -> Optional[str]:
+        """The most privileged role a binding gives in a county (see ACCESS_ROLES); None without one."""
+        roles = [b["role"] for b in self.bindings if b["county_id"] in (ALL, county_id)]
+        return max(roles, key=list(ACCESS_ROLES).index) if roles else None
+
+    def can_anywhere(self, action: str) -> bool:
+        return any(action in ACCESS_ROLES[b["role"]]["actions"] for b in self.bindings)
+
+    def can_see(self, item: Dict[str, Any], action: str = "read") -> bool:
+        """Whether an item of a listing belongs to a county and sync pair the caller may act on."""
+        county_id, sync_pair_id = item.get("county_id"), item.get("sync_pair_id")
+        if not county_id and not sync_pair_id:
+            details = item.get("details") if isinstance(item.get("details"), dict) else {}
+            county_id, sync_pair_id = details.get("county_id"), details.get("sync_pair_id")
+        if not county_id and not sync_pair_id and item.get("username") == self.name:
+            # Unscoped records (batches, system audit events) are their creator's and global readers'
+            return True
+        return self.can(action, county_id, sync_pair_id)
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {
+            "name": self.name,
+            "kind": self.kind,
+            "bindings": self.bindings,
+            "actions": {action: sorted({b["county_id"] for b in self.bindings
+                                        if action in ACCESS_ROLES[b["role"]]["actions"]}) for action in ACTIONS},
+        }
+
+
+class AccessControl:
+    """
+    Service class for role bindings and the access checks of the gateway middleware.
+    """
+
+    def __init__(self, registry=None, store: Optional[DocumentStore] = None, audit: Optional[AuditLog] = None,
+                 cache_seconds: float = CACHE_SECONDS):
+        """
+        Initialize the service.
+
+        Args:
+            registry: Sync pair registry, for the county of each sync pair
+            store: Document store for the bindings
+            audit: Audit log for binding changes
+            cache_seconds: Seconds the bindings are cached between reads
+        """
+        self.registry = registry
+        self.store = store or sync_state_store
+        self.audit = audit or audit_log
+        self.cache_seconds = cache_seconds
+        self._lock = threading.Lock()
+        self._cache: Optional[Tuple[float, List[Dict[str, Any]]]] = None
+
+    # Bindings ---------------------------------------------------------------
+
+    def bind(self, username: str, role: str, county_id: str, created_by: str,
+             datasets: Optional[List[str]] = None) -> Dict[str, Any]:
+        """
+        Grant a user a role in a county, or in some of its sync pairs.
+
+        Args:
+            username: User granted the role
+            role: Role (see ACCESS_ROLES)
+            county_id: County, or "*" for every county
+            created_by: Admin granting it
+            datasets: Sync pairs of the county the role is limited to; all when omitted
+
+        Returns:
+            The binding
+
+        Raises:
+            ValueError: If the role, county or a dataset is invalid
+        """
+        if not isinstance(username, str) or not _NAME.match(username):
+            raise ValueError("username is required and may only contain letters, digits and . _ - @ \\")
+        if role not in ACCESS_ROLES:
+            raise ValueError(f"Unknown role {role}; choose from {', '.join(ACCESS_ROLES)}")
+        if not isinstance(county_id, str) or not county_id:
+            raise ValueError("county_id is required; use \"*\" for every county")
+        datasets = self._check_datasets(county_id, datasets)
+        duplicate = [b for b in self._bindings() if b["username"].lower() == username.lower() and b["role"] == role
+                     and b["county_id"] == county_id and (b.get("datasets") or []) == datasets]
+        if duplicate:
+            raise ValueError(f"{username} already has {role} in {county_id} (binding {duplicate[0]['binding_id']})")
+        binding = {
+            "binding_id": str(uuid.uuid4()),
+            "username": username,
+            "role": role,
+            "county_id": county_id,
+            "datasets": datasets,
+            "created_by": created_by,
+            "created_at": datetime.utcnow().isoformat(),
+        }
+        self.store.save(BINDINGS_COLLECTION, binding["binding_id"], binding)
+        self._invalidate()
+        self.audit.record("role_binding.created", created_by, "role_binding", binding["binding_id"],
+                          {"username": username, "role": role, "datasets": datasets},
+                          None if county_id == ALL else county_id)
+        logger.info(f"Granted {role} in {county_id} to {username}")
+        return binding
+
+    def get(self, binding_id: str) -> Dict[str, Any]:
+        """
+        Raises:
+            FileNotFoundError: If the binding does not exist
+        """
+        return self.store.load(BINDINGS_COLLECTION, binding_id)
+
+    def unbind(self, binding_id: str, removed_by: str) -> Dict[str, Any]:
+        """
+        Remove a binding.
+
+        Raises:
+            FileNotFoundError: If the binding does not exist
+        """
+        binding = self.store.load(BINDINGS_COLLECTION, binding_id)
+        self.store.delete(BINDINGS_COLLECTION, binding_id)
+        self._invalidate()
+        self.audit.record("role_binding.deleted", removed_by, "role_binding", binding_id,
+                          {"username": binding["username"], "role": binding["role"]},
+                          None if binding["county_id"] == ALL else binding["county_id"])
+        logger.info(f"Removed {binding['role']} in {binding['county_id']} from {binding['username']}")
+        return binding
+
+    def list_bindings(self, username: Optional[str] = None, county_id: Optional[str] = None,
+                      role: Optional[str] = None) -> List[Dict[str, Any]]:
+        """Bindings, by username then county."""
+        bindings = [b for b in self._bindings()
+                    if (not username or b["username"].lower() == username.lower())
+                    and (not county_id or b["county_id"] in (county_id, ALL))
+                    and (not role or b["role"] == role)]
+        return sorted(bindings, key=lambda b: (b["username"].lower(), b["county_id"], b["role"]))
+
+    # Principals -------------------------------------------------------------
+
+    def principal_for_user(self, user: Dict[str, Any]) -> Principal:
+        """
+        The principal of an RBAC user: its bindings, or without any, its RBAC
+        role in its county. Users of other roles without a county get no access
+        until an admin binds them.
+        """
+        username = user.get("username") or "unknown"
+        bindings = self.list_bindings(username=username)
+        if not bindings:
+            # RBAC admins managed every county before bindings; the other roles keep to their county
+            role = LEGACY_ROLES.get(user.get("role"), "viewer")
+            county_id = ALL if role == "admin" else user.get("county_id")
+            if county_id:
+                bindings = [{"binding_id": None, "username": username, "role": role, "county_id": county_id,
+                             "datasets": [], "legacy": True}]
+        return Principal(username, "user", bindings, self.registry)
+
+    def principal_for_key(self, key: Dict[str, Any]) -> Principal:
+        """
+        The principal of a scoped API key. Its scopes already limit its routes,
+        so it acts as admin within its county, or everywhere without one;
+        an admin-scoped key is no exception.
+        """
+        county_id = key.get("county_id") or ALL
+        return Principal(f"service:{key['service']}", "service",
+                         [{"binding_id": None, "username": key["service"], "role": "admin", "county_id": county_id,
+                           "datasets": []}], self.registry)
+
+    # Checks -----------------------------------------------------------------
+
+    def authorize(self, principal: Optional[Principal], action: Optional[str],
+                  resources: Iterable[Tuple[Optional[str], Optional[str]]], narrowed: bool = True) -> None:
+        """
+        Check a request, for the gateway middleware.
+
+        Args:
+            principal: The caller; None for an anonymous request
+            action: The route's action (see route_action); None for public routes
+            resources: (county_id, sync_pair_id) of everything the request names
+            narrowed: Whether the response is narrowed by visible(), so reads naming no county are allowed
+
+        Raises:
+            AccessDenied: 401 for an anonymous caller when authentication is required,
+                403 when the caller's bindings do not allow the action or a sync pair
+                is named with a county other than its own
+        """
+        if action is None:
+            return
+        if principal is None:
+            if REQUIRE_AUTH:
+                raise AccessDenied("Authentication required", 401)
+            return
+        resources = [(c, p) for c, p in resources if c or p]
+        if not resources:
+            # Reads of unscoped resources are narrowed by visible(); other actions need every county
+            if action == "read" and narrowed and principal.can_anywhere("read"):
+                return
+            if not principal.can(action):
+                raise AccessDenied(f"{principal.name} may not {action} across counties")
+            return
+        for county_id, sync_pair_id in resources:
+            registered = principal.county_of(sync_pair_id)
+            if county_id and registered and county_id != registered:
+                raise AccessDenied(f"Sync pair {sync_pair_id} is in county {registered}, not {county_id}")
+            if not principal.can(action, county_id, sync_pair_id):
+                where = f"sync pair {sync_pair_id}" if sync_pair_id else f"county {county_id}"
+                raise AccessDenied(f"{principal.name} may not {action} in {where}")
+
+    def visible(self, principal: Optional[Principal], items: List[Dict[str, Any]],
+                action: str = "read") -> List[Dict[str, Any]]:
+        """The items of a listing the caller may see; all of them for anonymous callers with auth off."""
+        if principal is None:
+            return items
+        return [item for item in items if principal.can_see(item, action)]
+
+    # Internals --------------------------------------------------------------
+
+    def _check_datasets(self, county_id: str, datasets: Any) -> List[str]:
+        if datasets is None:
+            return []
+        if not isinstance(datasets, list) or any(not isinstance(d, str) for d in datasets):
+            raise ValueError("datasets must be a list of sync pair IDs")
+        if county_id == ALL:
+            if datasets:
+                raise ValueError("datasets can only be given for one county")
+            return []
+        if self.registry is not None:
+            for sync_pair_id in datasets:
+                try:
+                    pair = self.registry.get(sync_pair_id)
+                except KeyError:
+                    raise ValueError(f"Unknown sync pair {sync_pair_id}")
+                if pair.county_id != county_id:
+                    raise ValueError(f"Sync pair {sync_pair_id} belongs to {pair.county_id}, not {county_id}")
+        return sorted(set(datasets))
+
+    def _bindings(self) -> List[Dict[str, Any]]:
+        now = time.monotonic()
+        with self._lock:
+            if self._cache and now - self._cache[0] < self.cache_seconds:
+                return self._cache[1]
+        bindings = self.store.list(BINDINGS_COLLECTION)
+        with self._lock:
+            self._cache = (now, bindings)
+        return bindings
+
+    def _invalidate(self) -> None:
+        with self._lock:
+            self._cache = None
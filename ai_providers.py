@@ -0,0 +1,797 @@
+"""
+TerraFusion Platform - AI Providers
+
+This module provides the AI providers behind the NarratorAI summaries, so
+the model vendor is chosen in configuration rather than code. A county
+selects its provider in the "ai" block of its configuration; counties
+without one use the service's AI_PROVIDER (and AI_MODEL_NAME, AI_BASE_URL,
+AI_TIMEOUT_SECONDS, AI_MAX_TOKENS, AI_TEMPERATURE and AI_CONTEXT_TOKENS):
+
+    "ai": {
+        "provider": "openai",
+        "model": "gpt-4o-mini",
+        "api_key_env_var": "OPENAI_API_KEY",
+        "timeout_seconds": 30,
+        "max_output_tokens": 1024,
+        "redaction": ["public"],
+        "redact_patterns": ["\\b\\d{3}-\\d{2}-\\d{4}\\b"]
+    }
+
+Providers:
+
+    openai: The chat completions and embeddings APIs of OpenAI and of the
+        services compatible with them (Azure OpenAI, vLLM, LiteLLM), at
+        base_url (https://api.openai.com/v1 by default)
+    anthropic: Anthropic's Messages API, at base_url
+        (https://api.anthropic.com by default); it has no embeddings
+    ollama: A model served on the county's own network, by Ollama's chat API
+        at base_url (http://localhost:11434 by default) or, with "api":
+        "openai", by any OpenAI-compatible local server (llama.cpp, vLLM,
+        LM Studio); no API key is needed and prompts are cut to fit the
+        model's context_tokens
+    stub: Text and vectors derived from the prompt alone, the same for the
+        same prompt, for tests and installs that must not call out
+
+API keys are read from api_key directly, via api_key_env_var (OPENAI_API_KEY
+or ANTHROPIC_API_KEY by default) or from a secrets provider via api_key_secret
+(see secret_providers).
+
+Calls go through an AIClient. Before a prompt leaves the service the client
+applies its redaction hooks: the county's redaction policies named in
+"redaction" (see redaction) are applied to the data the prompt carries, the
+"redact_patterns" regular expressions are masked in the prompt text, and
+callers may add hooks of their own. A call gives up after timeout_seconds.
+The tokens each call uses, as the provider reports them (estimated at four
+characters a token otherwise), are counted in the ai_tokens_total metric and
+in the usage totals the AI health check reports.
+
+A local model that cannot be reached, or has not been pulled, is left alone
+for UNAVAILABLE_RETRY_SECONDS; its calls fail at once meanwhile, so callers
+fall back to their summaries without AI instead of each waiting out the
+timeout.
+"""
+
+import os
+import re
+import json
+import time
+import hashlib
+import logging
+import threading
+from datetime import datetime
+from typing import Callable, Dict, List, Any, Optional, Iterable
+
+import requests
+
+from county_overrides import load_county_config, config_version, county_config_path
+from redaction import Redactor, redaction_policies, DEFAULT_MASK
+from sync_connectors import _env_setting
+from metrics import AI_REQUESTS, AI_TOKENS, AI_REQUEST_DURATION
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Seconds to wait for a provider's answer
+DEFAULT_TIMEOUT = 30
+
+# Most tokens a completion may generate unless the caller asks for fewer or more
+DEFAULT_MAX_OUTPUT_TOKENS = 1024
+
+# Sampling temperature of completions; summaries of facts want little invention
+DEFAULT_TEMPERATURE = 0.2
+
+# Characters per token when a provider does not report its token counts
+CHARS_PER_TOKEN = 4
+
+# API key environment variables of the providers that need one
+DEFAULT_API_KEY_ENV_VARS = {"openai": "OPENAI_API_KEY", "anthropic": "ANTHROPIC_API_KEY"}
+
+# Anthropic API version sent with each request
+ANTHROPIC_VERSION = "2023-06-01"
+
+# Dimensions of the stub provider's vectors
+STUB_DIMENSIONS = 8
+
+# Where a local Ollama server listens, and its OpenAI-compatible API
+DEFAULT_OLLAMA_URL = "http://localhost:11434"
+
+# APIs a local provider may speak
+LOCAL_APIS = ("ollama", "openai")
+
+# Context window of a local model, in tokens, unless its block says otherwise
+DEFAULT_CONTEXT_TOKENS = 4096
+
+# Seconds a local model that could not be reached is skipped before it is tried again
+UNAVAILABLE_RETRY_SECONDS = 60
+
+# Appended to a prompt cut to fit a model's context window
+TRUNCATION_NOTE = "\n\n[The rest of this prompt was cut to fit the model's context window.]"
+
+# Settings of an "ai" block
+AI_SETTINGS = ("provider", "model", "embedding_model", "base_url", "api_key", "api_key_env_var", "api_key_secret",
+               "headers", "timeout_seconds", "max_output_tokens", "temperature", "redaction", "redact_patterns",
+               "dimensions", "api", "context_tokens")
+
+
+class AIProviderError(Exception):
+    """Raised when a provider cannot answer a request."""
+
+
+class AIUnavailableError(AIProviderError):
+    """Raised when a provider cannot be reached or does not have the model."""
+
+
+class AITimeoutError(AIUnavailableError):
+    """Raised when a provider does not answer within its timeout."""
+
+
+def estimate_tokens(text: str) -> int:
+    """Rough token count of a text, for providers that do not report one."""
+    return max(1, (len(text) + CHARS_PER_TOKEN - 1) // CHARS_PER_TOKEN) if text else 0
+
+
+class Completion:
+    """A provider's answer to a prompt, with the tokens it took."""
+
+    def __init__(self, text: str, provider: str, model: Optional[str], input_tokens: int, output_tokens: int,
+                 estimated: bool = False, stop_reason: Optional[str] = None):
+        self.text = text
+        self.provider = provider
+        self.model = model
+        self.input_tokens = input_tokens
+        self.output_tokens = output_tokens
+        self.estimated = estimated
+        self.stop_reason = stop_reason
+        self.duration_ms = 0
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {
+            "text": self.text,
+            "provider": self.provider,
+            "model": self.model,
+            "input_tokens": self.input_tokens,
+            "output_tokens": self.output_tokens,
+            "tokens_estimated": self.estimated,
+            "stop_reason": self.stop_reason,
+            "duration_ms": self.duration_ms,
+        }
+
+
+class Embeddings:
+    """A provider's vectors of some texts, in their order."""
+
+    def __init__(self, vectors: List[List[float]], provider: str, model: Optional[str], input_tokens: int,
+                 estimated: bool = False):
+        self.vectors = vectors
+        self.provider = provider
+        self.model = model
+        self.input_tokens = input_tokens
+        self.estimated = estimated
+        self.duration_ms = 0
+
+
+class AIProvider:
+    """
+    Base class for AI providers.
+
+    Subclasses implement complete() and, when their vendor has them,
+    embed(). A provider is created from a county's "ai" block.
+    """
+
+    provider_type = "base"
+
+    def __init__(self, config: Dict[str, Any]):
+        """
+        Args:
+            config: The "ai" block
+
+        Raises:
+            ValueError: If the block is invalid
+        """
+        self.config = config
+        self.model = config.get("model")
+        self.embedding_model = config.get("embedding_model") or self.model
+        self.timeout = float(config.get("timeout_seconds") or DEFAULT_TIMEOUT)
+        self.max_output_tokens = int(config.get("max_output_tokens") or DEFAULT_MAX_OUTPUT_TOKENS)
+        temperature = config.get("temperature")
+        self.temperature = float(DEFAULT_TEMPERATURE if temperature is None else temperature)
+        if self.timeout <= 0 or self.max_output_tokens < 1:
+            raise ValueError(f"AI provider {self.provider_type}: timeout_seconds and max_output_tokens "
+                             f"must be positive")
+
+    def complete(self, prompt: str, system: Optional[str] = None, max_tokens: Optional[int] = None,
+                 temperature: Optional[float] = None) -> Completion:
+        """
+        Answer a prompt.
+
+        Raises:
+            AIProviderError: If the provider cannot answer (AITimeoutError when it takes too long)
+        """
+        raise NotImplementedError
+
+    def embed(self, texts: List[str]) -> Embeddings:
+        """
+        Vectors of texts, for similarity search.
+
+        Raises:
+            AIProviderError: If the provider cannot embed them, or has no embeddings
+        """
+        raise AIProviderError(f"{self.provider_type} AI provider does not support embeddings")
+
+    def health_check(self) -> Dict[str, Any]:
+        """The provider's settings and whether it is configured; makes no request."""
+        return {"provider": self.provider_type, "model": self.model, "status": "configured"}
+
+    def _post(self, url: str, headers: Dict[str, str], body: Dict[str, Any]) -> Dict[str, Any]:
+        """POST a JSON request and return the JSON answer."""
+        try:
+            response = requests.post(url, headers=headers, json=body, timeout=self.timeout)
+        except requests.exceptions.Timeout:
+            raise AITimeoutError(f"{self.provider_type} AI provider did not answer within {self.timeout:g} seconds")
+        except requests.exceptions.RequestException as e:
+            raise AIUnavailableError(f"Cannot reach {self.provider_type} AI provider: {e}")
+        if response.status_code >= 400:
+            try:
+                error = response.json().get("error")
+                message = error.get("message") if isinstance(error, dict) else error
+            except ValueError:
+                message = None
+            # A 404 names a model the provider does not have
+            error_class = AIUnavailableError if response.status_code == 404 else AIProviderError
+            raise error_class(f"{self.provider_type} AI provider answered {response.status_code}"
+                              + (f": {message}" if message else ""))
+        try:
+            return response.json()
+        except ValueError:
+            raise AIProviderError(f"{self.provider_type} AI provider answered with a body that is not JSON")
+
+    def _api_key(self) -> str:
+        config = dict(self.config)
+        if not any(config.get(k) for k in ("api_key", "api_key_env_var", "api_key_secret")):
+            config["api_key_env_var"] = DEFAULT_API_KEY_ENV_VARS.get(self.provider_type)
+        key = _env_setting(config, "api_key")
+        if not key:
+            raise AIProviderError(f"{self.provider_type} AI provider has no API key configured")
+        return key
+
+
+class OpenAICompatibleProvider(AIProvider):
+    """OpenAI's chat completions and embeddings APIs, or a service compatible with them."""
+
+    provider_type = "openai"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        if not self.model:
+            raise ValueError(f"AI provider {self.provider_type} needs a model")
+        self.base_url = (config.get("base_url") or "https://api.openai.com/v1").rstrip("/")
+
+    def _headers(self) -> Dict[str, str]:
+        headers = {"Content-Type": "application/json", "Authorization": f"Bearer {self._api_key()}"}
+        headers.update(self.config.get("headers") or {})
+        return headers
+
+    def complete(self, prompt: str, system: Optional[str] = None, max_tokens: Optional[int] = None,
+                 temperature: Optional[float] = None) -> Completion:
+        messages = ([{"role": "system", "content": system}] if system else []) + [{"role": "user", "content": prompt}]
+        body = self._post(f"{self.base_url}/chat/completions", self._headers(), {
+            "model": self.model,
+            "messages": messages,
+            "max_tokens": max_tokens or self.max_output_tokens,
+            "temperature": self.temperature if temperature is None else temperature,
+        })
+        try:
+            choice = body["choices"][0]
+            text = choice["message"]["content"] or ""
+        except (KeyError, IndexError, TypeError):
+            raise AIProviderError(f"{self.provider_type} AI provider answered without a choice")
+        usage = body.get("usage") or {}
+        if "prompt_tokens" in usage:
+            return Completion(text, self.provider_type, body.get("model", self.model), usage["prompt_tokens"],
+                              usage.get("completion_tokens", 0), stop_reason=choice.get("finish_reason"))
+        return Completion(text, self.provider_type, body.get("model", self.model),
+                          estimate_tokens((system or "") + prompt), estimate_tokens(text), estimated=True,
+                          stop_reason=choice.get("finish_reason"))
+
+    def embed(self, texts: List[str]) -> Embeddings:
+        body = self._post(f"{self.base_url}/embeddings", self._headers(),
+                          {"model": self.embedding_model, "input": list(texts)})
+        try:
+            vectors = [item["embedding"] for item in sorted(body["data"], key=lambda item: item.get("index", 0))]
+        except (KeyError, TypeError):
+            raise AIProviderError(f"{self.provider_type} AI provider answered without embeddings")
+        usage = body.get("usage") or {}
+        if "prompt_tokens" in usage:
+            return Embeddings(vectors, self.provider_type, self.embedding_model, usage["prompt_tokens"])
+        return Embeddings(vectors, self.provider_type, self.embedding_model,
+                          sum(estimate_tokens(t) for t in texts), estimated=True)
+
+
+class AnthropicProvider(AIProvider):
+    """Anthropic's Messages API."""
+
+    provider_type = "anthropic"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        if not self.model:
+            raise ValueError(f"AI provider {self.provider_type} needs a model")
+        self.base_url = (config.get("base_url") or "https://api.anthropic.com").rstrip("/")
+
+    def complete(self, prompt: str, system: Optional[str] = None, max_tokens: Optional[int] = None,
+                 temperature: Optional[float] = None) -> Completion:
+        request = {
+            "model": self.model,
+            "max_tokens": max_tokens or self.max_output_tokens,
+            "temperature": self.temperature if temperature is None else temperature,
+            "messages": [{"role": "user", "content": prompt}],
+        }
+        if system:
+            request["system"] = system
+        headers = {"Content-Type": "application/json", "x-api-key": self._api_key(),
+                   "anthropic-version": ANTHROPIC_VERSION}
+        headers.update(self.config.get("headers") or {})
+        body = self._post(f"{self.base_url}/v1/messages", headers, request)
+        blocks = body.get("content")
+        if not isinstance(blocks, list):
+            raise AIProviderError(f"{self.provider_type} AI provider answered without content")
+        text = "".join(block.get("text", "") for block in blocks if block.get("type") == "text")
+        usage = body.get("usage") or {}
+        if "input_tokens" in usage:
+            return Completion(text, self.provider_type, body.get("model", self.model), usage["input_tokens"],
+                              usage.get("output_tokens", 0), stop_reason=body.get("stop_reason"))
+        return Completion(text, self.provider_type, body.get("model", self.model),
+                          estimate_tokens((system or "") + prompt), estimate_tokens(text), estimated=True,
+                          stop_reason=body.get("stop_reason"))
+
+
+class LocalProvider(OpenAICompatibleProvider):
+    """
+    A model served on the county's own network: Ollama's chat API, or an
+    OpenAI-compatible local server when the block's "api" is "openai".
+
+    Prompts longer than the context window leaves room for, after the
+    system prompt and the completion, are cut to fit. While the server is
+    unreachable or lacks the model, calls fail at once with
+    AIUnavailableError for UNAVAILABLE_RETRY_SECONDS.
+    """
+
+    provider_type = "ollama"
+
+    def __init__(self, config: Dict[str, Any]):
+        AIProvider.__init__(self, config)
+        if not self.model:
+            raise ValueError(f"AI provider {self.provider_type} needs a model")
+        self.api = config.get("api") or "ollama"
+        if self.api not in LOCAL_APIS:
+            raise ValueError(f"AI provider {self.provider_type}: api must be one of {', '.join(LOCAL_APIS)}")
+        default_url = DEFAULT_OLLAMA_URL if self.api == "ollama" else f"{DEFAULT_OLLAMA_URL}/v1"
+        self.base_url = (config.get("base_url") or default_url).rstrip("/")
+        self.context_tokens = int(config.get("context_tokens") or DEFAULT_CONTEXT_TOKENS)
+        if self.context_tokens <= self.max_output_tokens:
+            raise ValueError(f"AI provider {self.provider_type}: context_tokens must be more than "
+                             f"max_output_tokens ({self.max_output_tokens})")
+        self._unavailable_until = 0.0
+        self._unavailable_reason: Optional[str] = None
+
+    def _headers(self) -> Dict[str, str]:
+        headers = {"Content-Type": "application/json"}
+        # Local servers seldom want a key, but a proxy in front of one may
+        key = _env_setting(self.config, "api_key")
+        if key:
+            headers["Authorization"] = f"Bearer {key}"
+        headers.update(self.config.get("headers") or {})
+        return headers
+
+    def fit(self, prompt: str, system: Optional[str], max_tokens: int) -> str:
+        """
+        The prompt, cut to what the context window leaves room for.
+
+        Raises:
+            AIProviderError: If the system prompt and completion alone fill the window
+        """
+        room = self.context_tokens - max_tokens - estimate_tokens(system or "")
+        if estimate_tokens(prompt) <= room:
+            return prompt
+        keep = (room - estimate_tokens(TRUNCATION_NOTE)) * CHARS_PER_TOKEN
+        if keep <= 0:
+            raise AIProviderError(f"{self.provider_type} AI provider: the system prompt and {max_tokens} "
+                                  f"completion tokens do not fit in {self.context_tokens} context tokens")
+        logger.warning(f"Prompt of about {estimate_tokens(prompt)} tokens cut to fit the "
+                       f"{self.context_tokens} token context of {self.model}")
+        return prompt[:keep] + TRUNCATION_NOTE
+
+    def complete(self, prompt: str, system: Optional[str] = None, max_tokens: Optional[int] = None,
+                 temperature: Optional[float] = None) -> Completion:
+        max_tokens = min(max_tokens or self.max_output_tokens, self.context_tokens - 1)
+        prompt = self.fit(prompt, system, max_tokens)
+        if self.api == "openai":
+            return super().complete(prompt, system, max_tokens, temperature)
+        messages = ([{"role": "system", "content": system}] if system else []) + [{"role": "user", "content": prompt}]
+        body = self._post(f"{self.base_url}/api/chat", self._headers(), {
+            "model": self.model,
+            "messages": messages,
+            "stream": False,
+            "options": {
+                "num_ctx": self.context_tokens,
+                "num_predict": max_tokens,
+                "temperature": self.temperature if temperature is None else temperature,
+            },
+        })
+        message = body.get("message")
+        if not isinstance(message, dict):
+            raise AIProviderError(f"{self.provider_type} AI provider answered without a message")
+        text = message.get("content") or ""
+        if "prompt_eval_count" in body:
+            return Completion(text, self.provider_type, body.get("model", self.model), body["prompt_eval_count"],
+                              body.get("eval_count", 0), stop_reason=body.get("done_reason"))
+        return Completion(text, self.provider_type, body.get("model", self.model),
+                          estimate_tokens((system or "") + prompt), estimate_tokens(text), estimated=True,
+                          stop_reason=body.get("done_reason"))
+
+    def embed(self, texts: List[str]) -> Embeddings:
+        if self.api == "openai":
+            return super().embed(texts)
+        body = self._post(f"{self.base_url}/api/embed", self._headers(),
+                          {"model": self.embedding_model, "input": list(texts)})
+        vectors = body.get("embeddings")
+        if not isinstance(vectors, list):
+            raise AIProviderError(f"{self.provider_type} AI provider answered without embeddings")
+        if "prompt_eval_count" in body:
+            return Embeddings(vectors, self.provider_type, self.embedding_model, body["prompt_eval_count"])
+        return Embeddings(vectors, self.provider_type, self.embedding_model,
+                          sum(estimate_tokens(t) for t in texts), estimated=True)
+
+    def _post(self, url: str, headers: Dict[str, str], body: Dict[str, Any]) -> Dict[str, Any]:
+        wait = self._unavailable_until - time.monotonic()
+        if wait > 0:
+            raise AIUnavailableError(f"{self._unavailable_reason} (retrying in {wait:.0f} seconds)")
+        try:
+            return super()._post(url, headers, body)
+        except AIUnavailableError as e:
+            self._unavailable_until = time.monotonic() + UNAVAILABLE_RETRY_SECONDS
+            self._unavailable_reason = str(e)
+            logger.warning(f"Local AI model {self.model} is unavailable; skipping it for "
+                           f"{UNAVAILABLE_RETRY_SECONDS} seconds: {e}")
+            raise
+
+    def available(self) -> bool:
+        """Whether the server answers and has the model; asks it, nothing of the county's is sent."""
+        url = f"{self.base_url}/api/tags" if self.api == "ollama" else f"{self.base_url}/models"
+        try:
+            response = requests.get(url, headers=self._headers(), timeout=min(self.timeout, 5))
+            response.raise_for_status()
+            listed = response.json().get("models" if self.api == "ollama" else "data") or []
+        except (requests.exceptions.RequestException, ValueError, AttributeError):
+            return False
+        names = {entry.get("name") or entry.get("model") or entry.get("id") for entry in listed
+                 if isinstance(entry, dict)}
+        # Ollama lists "llama3.1" as "llama3.1:latest"
+        return self.model in names or f"{self.model}:latest" in names
+
+    def health_check(self) -> Dict[str, Any]:
+        """The provider's settings and whether the model can be reached."""
+        available = self.available()
+        if available:
+            self._unavailable_until = 0.0
+        return {"provider": self.provider_type, "model": self.model, "api": self.api, "base_url": self.base_url,
+                "context_tokens": self.context_tokens, "status": "available" if available else "unavailable"}
+
+
+class StubProvider(AIProvider):
+    """
+    Answers without a model: the completion names the prompt's first line and
+    digest, and vectors come from each text's SHA-256, so tests can assert on
+    them.
+    """
+
+    provider_type = "stub"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.model = self.model or "stub"
+        self.embedding_model = self.model
+        self.dimensions = int(config.get("dimensions", STUB_DIMENSIONS))
+
+    def complete(self, prompt: str, system: Optional[str] = None, max_tokens: Optional[int] = None,
+                 temperature: Optional[float] = None) -> Completion:
+        first_line = next((line.strip() for line in prompt.splitlines() if line.strip()), "")
+        digest = hashlib.sha256(((system or "") + prompt).encode("utf-8")).hexdigest()[:12]
+        text = f"Summary of: {first_line[:200]} [stub {digest}]"
+        words = text.split()[:max_tokens or self.max_output_tokens]
+        text = " ".join(words)
+        return Completion(text, self.provider_type, self.model, estimate_tokens((system or "") + prompt),
+                          estimate_tokens(text), estimated=True, stop_reason="end_turn")
+
+    def embed(self, texts: List[str]) -> Embeddings:
+        vectors = []
+        for text in texts:
+            digest = hashlib.sha256(text.encode("utf-8")).digest()
+            vectors.append([round(digest[i % len(digest)] / 255.0, 6) for i in range(self.dimensions)])
+        return Embeddings(vectors, self.provider_type, self.model, sum(estimate_tokens(t) for t in texts),
+                          estimated=True)
+
+
+# Provider classes by the "provider" of an "ai" block
+AI_PROVIDER_TYPES = {
+    OpenAICompatibleProvider.provider_type: OpenAICompatibleProvider,
+    AnthropicProvider.provider_type: AnthropicProvider,
+    LocalProvider.provider_type: LocalProvider,
+    StubProvider.provider_type: StubProvider,
+}
+
+
+def create_provider(config: Dict[str, Any]) -> AIProvider:
+    """
+    Create the provider an "ai" block selects.
+
+    Raises:
+        ValueError: If the provider is not supported or the block is invalid
+    """
+    provider_type = config.get("provider")
+    if provider_type not in AI_PROVIDER_TYPES:
+        raise ValueError(f"Unsupported AI provider: {provider_type}. "
+                         f"Supported providers: {', '.join(AI_PROVIDER_TYPES)}")
+    return AI_PROVIDER_TYPES[provider_type](config)
+
+
+def pattern_hook(pattern: str, mask: str = DEFAULT_MASK) -> Callable[[str], str]:
+    """
+    A redaction hook masking every match of a regular expression.
+
+    Raises:
+        ValueError: If the pattern does not compile
+    """
+    try:
+        compiled = re.compile(pattern)
+    except re.error as e:
+        raise ValueError(f"AI redact_patterns entry {pattern!r} is not a regular expression: {e}")
+    return lambda text: compiled.sub(mask, text)
+
+
+class TokenLedger:
+    """Totals of the requests and tokens of AI calls, by county, provider, model and feature."""
+
+    def __init__(self):
+        self._totals: Dict[tuple, Dict[str, Any]] = {}
+        self._lock = threading.Lock()
+
+    def record(self, county_id: Optional[str], provider: str, model: Optional[str], feature: str,
+               input_tokens: int, output_tokens: int, estimated: bool) -> None:
+        key = (county_id or "", provider, model or "", feature)
+        with self._lock:
+            totals = self._totals.setdefault(key, {
+                "county_id": county_id, "provider": provider, "model": model, "feature": feature,
+                "requests": 0, "input_tokens": 0, "output_tokens": 0, "estimated_requests": 0,
+            })
+            totals["requests"] += 1
+            totals["input_tokens"] += input_tokens
+            totals["output_tokens"] += output_tokens
+            totals["estimated_requests"] += 1 if estimated else 0
+            totals["last_used_at"] = datetime.utcnow().isoformat()
+        AI_TOKENS.inc(input_tokens, provider=provider, model=model or "", feature=feature, kind="input")
+        AI_TOKENS.inc(output_tokens, provider=provider, model=model or "", feature=feature, kind="output")
+
+    def usage(self, county_id: Optional[str] = None) -> List[Dict[str, Any]]:
+        """The totals since the service started, of a county or of every one."""
+        with self._lock:
+            return [dict(totals) for key, totals in sorted(self._totals.items())
+                    if county_id is None or key[0] == county_id]
+
+
+# Token totals of every client of this process
+token_ledger = TokenLedger()
+
+
+class AIClient:
+    """
+    A provider with its county's redaction hooks and token accounting.
+
+    Hooks are functions of a prompt's text returning the text to send; they
+    run in the order added, on the prompt, the system prompt and every
+    text embedded.
+    """
+
+    def __init__(self, provider: AIProvider, county_id: Optional[str] = None, redactor: Optional[Redactor] = None,
+                 hooks: Iterable[Callable[[str], str]] = (), ledger: Optional[TokenLedger] = None):
+        self.provider = provider
+        self.county_id = county_id
+        self.redactor = redactor or Redactor()
+        self.hooks: List[Callable[[str], str]] = list(hooks)
+        self.ledger = ledger or token_ledger
+
+    def add_redaction_hook(self, hook: Callable[[str], str]) -> "AIClient":
+        self.hooks.append(hook)
+        return self
+
+    def redact(self, data: Any) -> Any:
+        """Data with the fields of the county's redaction policies redacted, to build prompts from."""
+        return self.redactor.body(data)
+
+    def prepare(self, text: str, data: Any = None) -> str:
+        """The text a prompt is sent as: with its data appended as JSON, redacted, and the hooks applied."""
+        if data is not None:
+            text = f"{text}\n\n{json.dumps(self.redact(data), indent=2, default=str)}"
+        for hook in self.hooks:
+            text = hook(text)
+        return text
+
+    def complete(self, prompt: str, data: Any = None, system: Optional[str] = None, feature: str = "general",
+                 max_tokens: Optional[int] = None, temperature: Optional[float] = None) -> Completion:
+        """
+        Answer a prompt, with data carried as JSON after it.
+
+        Raises:
+            AIProviderError: If the provider cannot answer
+        """
+        text = self.prepare(prompt, data)
+        system = self.prepare(system) if system else None
+        started = time.monotonic()
+        try:
+            completion = self.provider.complete(text, system, max_tokens, temperature)
+        except AIProviderError as e:
+            self._observe("complete", "timeout" if isinstance(e, AITimeoutError) else "error", started)
+            raise
+        completion.duration_ms = self._observe("complete", "success", started)
+        self.ledger.record(self.county_id, self.provider.provider_type, completion.model, feature,
+                           completion.input_tokens, completion.output_tokens, completion.estimated)
+        return completion
+
+    def embed(self, texts: List[str], feature: str = "general") -> Embeddings:
+        """
+        Vectors of texts.
+
+        Raises:
+            AIProviderError: If the provider cannot embed them
+        """
+        prepared = [self.prepare(text) for text in texts]
+        started = time.monotonic()
+        try:
+            embeddings = self.provider.embed(prepared)
+        except AIProviderError as e:
+            self._observe("embed", "timeout" if isinstance(e, AITimeoutError) else "error", started)
+            raise
+        embeddings.duration_ms = self._observe("embed", "success", started)
+        self.ledger.record(self.county_id, self.provider.provider_type, embeddings.model, feature,
+                           embeddings.input_tokens, 0, embeddings.estimated)
+        return embeddings
+
+    def _observe(self, operation: str, outcome: str, started: float) -> int:
+        elapsed = time.monotonic() - started
+        AI_REQUESTS.inc(provider=self.provider.provider_type, operation=operation, outcome=outcome)
+        AI_REQUEST_DURATION.observe(elapsed, provider=self.provider.provider_type, operation=operation)
+        return int(elapsed * 1000)
+
+
+class AISettings:
+    """The parsed "ai" block of one county, or the service default."""
+
+    def __init__(self, county_id: Optional[str], definition: Optional[Dict[str, Any]]):
+        """
+        Raises:
+            ValueError: If the block is invalid
+        """
+        self.county_id = county_id
+        self.definition = dict(definition) if definition else None
+        self.provider: Optional[AIProvider] = None
+        self.policies: List[str] = []
+        self.hooks: List[Callable[[str], str]] = []
+        if not self.definition:
+            return
+        label = f"County {county_id}: ai" if county_id else "AI_PROVIDER"
+        unknown = [name for name in self.definition if name not in AI_SETTINGS]
+        if unknown:
+            raise ValueError(f"{label}: unknown settings {', '.join(unknown)}")
+        policies = self.definition.get("redaction") or []
+        self.policies = [policies] if isinstance(policies, str) else list(policies)
+        patterns = self.definition.get("redact_patterns") or []
+        if not isinstance(patterns, list) or not all(isinstance(p, str) for p in patterns):
+            raise ValueError(f"{label}.redact_patterns must be a list of regular expressions")
+        self.hooks = [pattern_hook(pattern) for pattern in patterns]
+        try:
+            self.provider = create_provider(self.definition)
+        except ValueError as e:
+            raise ValueError(f"{label}: {e}")
+
+    def client(self) -> Optional[AIClient]:
+        """
+        A client of the provider; None when no provider is configured.
+
+        Raises:
+            ValueError: If a redaction policy is not configured for the county
+        """
+        if self.provider is None:
+            return None
+        redactor = redaction_policies.named(self.county_id, self.policies) if self.policies and self.county_id \
+            else Redactor()
+        return AIClient(self.provider, self.county_id, redactor, self.hooks)
+
+    def to_dict(self) -> Dict[str, Any]:
+        if self.provider is None:
+            return {"county_id": self.county_id, "provider": None}
+        return {
+            "county_id": self.county_id,
+            "provider": self.provider.provider_type,
+            "model": self.provider.model,
+            "timeout_seconds": self.provider.timeout,
+            "max_output_tokens": self.provider.max_output_tokens,
+            "redaction": list(self.policies),
+            "redact_patterns": len(self.hooks),
+        }
+
+
+def default_block() -> Optional[Dict[str, Any]]:
+    """The service's AI provider from the environment; None when AI_PROVIDER is unset."""
+    provider = os.environ.get("AI_PROVIDER")
+    if not provider:
+        return None
+    block = {"provider": provider}
+    for name, variable in (("model", "AI_MODEL_NAME"), ("base_url", "AI_BASE_URL"),
+                           ("timeout_seconds", "AI_TIMEOUT_SECONDS"), ("max_output_tokens", "AI_MAX_TOKENS"),
+                           ("temperature", "AI_TEMPERATURE"), ("context_tokens", "AI_CONTEXT_TOKENS")):
+        if os.environ.get(variable):
+            block[name] = os.environ[variable]
+    return block
+
+
+class AIProviders:
+    """
+    Service class for the counties' AI providers.
+
+    Settings are read from the county configuration files and reloaded when
+    a file changes.
+    """
+
+    def __init__(self, config_dir: str = "county_configs"):
+        self.config_dir = config_dir
+        self._settings: Dict[str, Any] = {}
+        self._lock = threading.Lock()
+
+    def settings(self, county_id: Optional[str] = None) -> AISettings:
+        """
+        The AI settings of a county, or the service default for counties without an "ai" block.
+
+        Raises:
+            ValueError: If the block is invalid
+        """
+        path = county_config_path(self.config_dir, county_id) if county_id else None
+        version = config_version(path) if path else None
+        block = default_block()
+        cache_key = path or ""
+        with self._lock:
+            cached = self._settings.get(cache_key)
+        if cached is not None and cached[0] == (version, block):
+            return cached[1]
+        county_block = load_county_config(path).get("ai") if path else None
+        if county_block:
+            settings = AISettings(county_id, county_block)
+        else:
+            settings = AISettings(county_id if path else None, block)
+        with self._lock:
+            self._settings[cache_key] = ((version, block), settings)
+        return settings
+
+    def client(self, county_id: Optional[str] = None) -> Optional[AIClient]:
+        """
+        The AI client of a county; None when neither it nor the service has a provider.
+
+        Raises:
+            ValueError: If its settings are invalid
+        """
+        return self.settings(county_id).client()
+
+    def health(self, county_id: Optional[str] = None) -> Dict[str, Any]:
+        """A county's (or the service's) provider settings and the tokens used."""
+        try:
+            parsed = self.settings(county_id)
+            settings = parsed.to_dict()
+            if parsed.provider is not None:
+                settings["status"] = parsed.provider.health_check()["status"]
+        except ValueError as e:
+            settings = {"county_id": county_id, "provider": None, "error": str(e)}
+        return dict(settings, usage=token_ledger.usage(county_id))
+
+
+# Create a singleton instance
+ai_providers = AIProviders()
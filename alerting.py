@@ -0,0 +1,772 @@
+"""
+TerraFusion Platform - Alerting
+
+This module provides alert rules and the notifiers that tell a county's
+staff when its data pipeline needs attention. Each county lists them in the
+"alerting" block of its configuration:
+
+    "alerting": {
+        "notifiers": {
+            "gis-ops": {"type": "smtp", "to": ["gis-ops@co.benton.wa.us"]},
+            "ops-channel": {"type": "slack", "webhook_url_env_var": "BENTON_SLACK_WEBHOOK_URL"},
+            "on-call": {"type": "pagerduty", "routing_key_secret": "vault:secret/terrafusion/pagerduty#benton"}
+        },
+        "rules": [
+            {"name": "sync-failed", "type": "job_failure", "notify": ["ops-channel", "on-call"],
+             "severity": "critical"},
+            {"name": "quarantine-rate", "type": "validation_failure_rate", "threshold": 0.02,
+             "min_records": 500, "notify": ["gis-ops"]},
+            {"name": "pacs-down", "type": "connector_down", "for_minutes": 10, "notify": ["on-call"]},
+            {"name": "parcels-stale", "type": "stale_data", "max_age_minutes": 240,
+             "sync_pair_id": "benton_wa_pacs_staging", "notify": ["gis-ops"]},
+            {"name": "parcels-slo", "type": "freshness_slo", "notify": ["gis-ops", "on-call"]},
+            {"name": "value-swings", "type": "sync_anomalies", "min_anomalies": 10, "notify": ["gis-ops"]}
+        ]
+    }
+
+Rule types:
+
+- job_failure: a sync job (or, with "jobs": ["sync", "export"], a GIS export
+  job) failed; resolved when the next job of the sync pair completes
+- validation_failure_rate: a finished sync job quarantined at least
+  "threshold" (a fraction) of the records it read, once it read
+  "min_records"; resolved when a later job stays under it
+- connector_down: a sync pair's source or target has been unavailable for
+  "for_minutes", as announced by the connector health monitor
+  (CONNECTOR_HEALTH_MONITOR_ENABLED on one instance); resolved when it is
+  healthy again
+- stale_data: a table's source was last synced more than "max_age_minutes"
+  ago (see SyncEngine.source_freshness); resolved by the next sync
+- freshness_slo: a table breached its sync pair's freshness objective, as
+  announced by the freshness monitor (FRESHNESS_MONITOR_ENABLED on one
+  instance, see sync_freshness); resolved when the breach ends
+- sync_anomalies: a completed sync job flagged at least "min_anomalies"
+  (default 1) anomalies, of the "kinds" listed or any (see sync_anomalies);
+  resolved when a later job flags fewer
+
+Any rule can be narrowed with "sync_pair_id", carries a "severity"
+(critical, error, warning or info) and can repeat its notification every
+"repeat_minutes" while it fires. An alert notifies each of its rule's
+notifiers when it fires and when it resolves; PagerDuty incidents are
+resolved through the same dedup key. Notifier secrets are read directly,
+via *_env_var or from a secrets provider via *_secret (see
+secret_providers). SMTP notifiers use ALERT_SMTP_* unless they set their own
+host, port, username, password, sender and starttls.
+
+Notifier types are plugins: subclass Notifier and decorate it with
+register_notifier("type"). Alerts are kept in the state store and listed
+at GET /api/v1/alerts. Rules are evaluated by the instance with
+ALERTING_ENABLED (run it on exactly one instance).
+"""
+
+import os
+import uuid
+import smtplib
+import logging
+import threading
+from email.message import EmailMessage
+from datetime import datetime, timedelta
+from typing import Dict, List, Any, Optional, Callable
+
+import requests
+
+from sync_store import DocumentStore, sync_state_store
+from county_overrides import load_county_config, config_version, county_config_path
+from secret_providers import secret_resolver
+from event_bus import EventBus, EventBusError, event_bus, SUBJECT_SYNC_JOB, SUBJECT_EXPORT_JOB, SUBJECT_SYSTEM
+from tracing import tracer
+from sync_anomalies import ANOMALY_KINDS
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection
+ALERTS_COLLECTION = "alerts"
+
+ALERT_RULE_TYPES = ["job_failure", "validation_failure_rate", "connector_down", "stale_data", "freshness_slo",
+                    "sync_anomalies"]
+
+ALERT_SEVERITIES = ["critical", "error", "warning", "info"]
+
+# PENDING: a connector is down but not yet for the rule's for_minutes
+ALERT_STATUSES = ["PENDING", "FIRING", "RESOLVED"]
+
+# Job kinds a job_failure rule can watch
+ALERT_JOB_KINDS = ["sync", "export"]
+
+# Seconds between evaluations of the connector_down and stale_data rules
+CHECK_SECONDS = int(os.environ.get("ALERT_CHECK_SECONDS", "60"))
+
+# Base URL of the gateway, for links in notifications
+BASE_URL = os.environ.get("ALERT_BASE_URL", "").rstrip("/")
+
+# Default SMTP relay of email notifiers
+SMTP_HOST = os.environ.get("ALERT_SMTP_HOST", "localhost")
+SMTP_PORT = int(os.environ.get("ALERT_SMTP_PORT", "25"))
+SMTP_USERNAME = os.environ.get("ALERT_SMTP_USERNAME")
+SMTP_PASSWORD = os.environ.get("ALERT_SMTP_PASSWORD")
+SMTP_FROM = os.environ.get("ALERT_SMTP_FROM", "terrafusion-alerts@localhost")
+SMTP_STARTTLS = os.environ.get("ALERT_SMTP_STARTTLS", "false").lower() == "true"
+
+PAGERDUTY_EVENTS_URL = "https://events.pagerduty.com/v2/enqueue"
+
+# Attempts at each notification before it is recorded as failed
+NOTIFY_ATTEMPTS = 3
+
+# Seconds a notifier's server has to answer
+REQUEST_TIMEOUT = 10
+
+# Notifications kept on each alert
+NOTIFICATION_HISTORY = 20
+
+# Bus consumer group, so one alerting instance handles each event
+QUEUE_GROUP = "alerting"
+
+# Default minutes a connector must be down before connector_down fires
+DEFAULT_DOWN_MINUTES = 5
+
+# PagerDuty severities of alert severities
+_PAGERDUTY_SEVERITIES = {"critical": "critical", "error": "error", "warning": "warning", "info": "info"}
+
+_SLACK_COLORS = {"critical": "#b71c1c", "error": "#e65100", "warning": "#f9a825", "info": "#1565c0",
+                 "resolved": "#2e7d32"}
+
+
+class NotifierError(Exception):
+    """Raised when a notifier cannot send a notification."""
+
+
+def _setting(config: Dict[str, Any], key: str, default: Optional[str] = None) -> Optional[str]:
+    """Read a notifier setting directly, from a secrets provider via *_secret, or via its *_env_var indirection."""
+    if config.get(key) is not None:
+        return str(config[key])
+    if config.get(f"{key}_secret"):
+        return secret_resolver.resolve(config[f"{key}_secret"])
+    env_var = config.get(f"{key}_env_var")
+    if env_var:
+        return os.environ.get(env_var, default)
+    return default
+
+
+def _has_setting(config: Dict[str, Any], key: str) -> bool:
+    return any(config.get(name) for name in (key, f"{key}_secret", f"{key}_env_var"))
+
+
+class Notifier:
+    """
+    Base class for notifiers.
+
+    Subclasses check their configuration in __init__ (raising ValueError)
+    and implement send, which raises NotifierError when the notification
+    cannot be sent; resolved alerts are sent with action "resolve".
+    """
+
+    notifier_type = "base"
+
+    def __init__(self, name: str, config: Dict[str, Any]):
+        self.name = name
+        self.config = config
+
+    def send(self, alert: Dict[str, Any], action: str) -> None:
+        raise NotImplementedError
+
+
+# Registered notifier types
+NOTIFIER_TYPES: Dict[str, type] = {}
+
+
+def register_notifier(notifier_type: str) -> Callable[[type], type]:
+    """Class decorator that registers a Notifier subclass under a type name."""
+    def decorator(cls: type) -> type:
+        if not issubclass(cls, Notifier):
+            raise TypeError(f"{cls.__name__} must subclass Notifier")
+        cls.notifier_type = notifier_type
+        NOTIFIER_TYPES[notifier_type] = cls
+        return cls
+    return decorator
+
+
+def alert_title(alert: Dict[str, Any], action: str = "trigger") -> str:
+    prefix = "RESOLVED" if action == "resolve" else alert["severity"].upper()
+    return f"[{prefix}] {alert['county_id']}: {alert['summary']}"
+
+
+def alert_lines(alert: Dict[str, Any]) -> List[str]:
+    """The details of an alert as "name: value" lines."""
+    lines = [f"Rule: {alert['rule']} ({alert['rule_type']})", f"Since: {alert['fired_at'] or alert['since']}"]
+    lines += [f"{name}: {value}" for name, value in (alert.get("details") or {}).items() if value is not None]
+    if alert.get("link"):
+        lines.append(f"Link: {alert['link']}")
+    return lines
+
+
+@register_notifier("smtp")
+class SmtpNotifier(Notifier):
+    """Emails alerts through an SMTP relay."""
+
+    def __init__(self, name: str, config: Dict[str, Any]):
+        super().__init__(name, config)
+        recipients = config.get("to")
+        if not isinstance(recipients, list) or not recipients:
+            raise ValueError(f"SMTP notifier {name} must list its recipients in to")
+
+    def send(self, alert: Dict[str, Any], action: str) -> None:
+        message = EmailMessage()
+        message["Subject"] = alert_title(alert, action)
+        message["From"] = _setting(self.config, "from", SMTP_FROM)
+        message["To"] = ", ".join(self.config["to"])
+        message.set_content("\n".join(alert_lines(alert)) + "\n")
+        starttls = self.config.get("starttls", SMTP_STARTTLS)
+        username = _setting(self.config, "username", SMTP_USERNAME)
+        try:
+            with smtplib.SMTP(_setting(self.config, "host", SMTP_HOST), int(_setting(self.config, "port", SMTP_PORT)),
+                              timeout=REQUEST_TIMEOUT) as smtp:
+                if starttls:
+                    smtp.starttls()
+                if username:
+                    smtp.login(username, _setting(self.config, "password", SMTP_PASSWORD) or "")
+                smtp.send_message(message)
+        except (smtplib.SMTPException, OSError) as e:
+            raise NotifierError(f"Cannot send email: {e}")
+
+
+class _HttpNotifier(Notifier):
+    """Notifier that posts JSON to a URL."""
+
+    def __init__(self, name: str, config: Dict[str, Any], session: Optional[requests.Session] = None):
+        super().__init__(name, config)
+        self.session = session or tracer.traced_session(requests.Session())
+
+    def post(self, url: str, body: Dict[str, Any]) -> None:
+        try:
+            response = self.session.post(url, json=body, timeout=REQUEST_TIMEOUT)
+        except requests.RequestException as e:
+            raise NotifierError(str(e))
+        if not 200 <= response.status_code < 300:
+            raise NotifierError(f"HTTP {response.status_code}: {response.text[:200]}")
+
+
+@register_notifier("slack")
+class SlackNotifier(_HttpNotifier):
+    """Posts alerts to a Slack incoming webhook."""
+
+    def __init__(self, name: str, config: Dict[str, Any], session: Optional[requests.Session] = None):
+        super().__init__(name, config, session)
+        if not _has_setting(config, "webhook_url"):
+            raise ValueError(f"Slack notifier {name} needs webhook_url (or webhook_url_env_var or webhook_url_secret)")
+
+    def send(self, alert: Dict[str, Any], action: str) -> None:
+        color = _SLACK_COLORS["resolved" if action == "resolve" else alert["severity"]]
+        body = {"text": alert_title(alert, action),
+                "attachments": [{"color": color, "text": "\n".join(alert_lines(alert))}]}
+        if self.config.get("channel"):
+            body["channel"] = self.config["channel"]
+        self.post(_setting(self.config, "webhook_url"), body)
+
+
+@register_notifier("pagerduty")
+class PagerDutyNotifier(_HttpNotifier):
+    """Triggers and resolves PagerDuty incidents through the Events API v2."""
+
+    def __init__(self, name: str, config: Dict[str, Any], session: Optional[requests.Session] = None):
+        super().__init__(name, config, session)
+        if not _has_setting(config, "routing_key"):
+            raise ValueError(f"PagerDuty notifier {name} needs routing_key "
+                             f"(or routing_key_env_var or routing_key_secret)")
+
+    def send(self, alert: Dict[str, Any], action: str) -> None:
+        body = {"routing_key": _setting(self.config, "routing_key"), "event_action": action,
+                "dedup_key": alert["alert_id"]}
+        if action == "trigger":
+            body["payload"] = {
+                "summary": alert_title(alert)[:1024],
+                "source": alert.get("sync_pair_id") or alert["county_id"],
+                "severity": _PAGERDUTY_SEVERITIES[alert["severity"]],
+                "component": alert["rule_type"],
+                "group": alert["county_id"],
+                "custom_details": dict(alert.get("details") or {}, rule=alert["rule"]),
+            }
+            if alert.get("link"):
+                body["links"] = [{"href": alert["link"], "text": "TerraFusion"}]
+        self.post(self.config.get("events_url", PAGERDUTY_EVENTS_URL), body)
+
+
+def create_notifier(name: str, config: Dict[str, Any]) -> Notifier:
+    """
+    Create a notifier from its configuration.
+
+    Raises:
+        ValueError: If the type is unknown or the configuration is invalid
+    """
+    notifier_class = NOTIFIER_TYPES.get(config.get("type"))
+    if notifier_class is None:
+        raise ValueError(f"Notifier {name} has unknown type {config.get('type')}. "
+                         f"Types: {', '.join(sorted(NOTIFIER_TYPES))}")
+    return notifier_class(name, config)
+
+
+def _positive(rule: Dict[str, Any], key: str, label: str, default: Any = None, fraction: bool = False) -> Any:
+    value = rule.get(key, default)
+    if value is None:
+        raise ValueError(f"{label} needs {key}")
+    if not isinstance(value, (int, float)) or isinstance(value, bool) or value <= 0 or (fraction and value > 1):
+        raise ValueError(f"{label} {key} must be a {'fraction between 0 and 1' if fraction else 'positive number'}")
+    return value
+
+
+class CountyAlerting:
+    """The parsed "alerting" block of one county."""
+
+    def __init__(self, county_id: str, definition: Optional[Dict[str, Any]]):
+        """
+        Raises:
+            ValueError: If the block is invalid
+        """
+        definition = definition or {}
+        self.county_id = county_id
+        label = f"County {county_id} alerting"
+        if not isinstance(definition.get("notifiers", {}), dict):
+            raise ValueError(f"{label}.notifiers must map names to notifier settings")
+        self.notifiers = {name: create_notifier(name, config)
+                          for name, config in (definition.get("notifiers") or {}).items()}
+        self.rules: List[Dict[str, Any]] = []
+        for number, rule in enumerate(definition.get("rules") or [], 1):
+            self.rules.append(self._parse_rule(rule, f"{label} rule {rule.get('name') or number}"))
+        names = [rule["name"] for rule in self.rules]
+        duplicates = sorted({name for name in names if names.count(name) > 1})
+        if duplicates:
+            raise ValueError(f"{label} has more than one rule named {', '.join(duplicates)}")
+
+    def _parse_rule(self, rule: Dict[str, Any], label: str) -> Dict[str, Any]:
+        if not isinstance(rule, dict) or not rule.get("name"):
+            raise ValueError(f"{label} must be an object with a name")
+        if rule.get("type") not in ALERT_RULE_TYPES:
+            raise ValueError(f"{label} has unknown type {rule.get('type')}. Types: {', '.join(ALERT_RULE_TYPES)}")
+        notify = rule.get("notify")
+        if not isinstance(notify, list) or not notify:
+            raise ValueError(f"{label} must list the notifiers to notify")
+        unknown = [name for name in notify if name not in self.notifiers]
+        if unknown:
+            raise ValueError(f"{label} notifies unknown notifiers {', '.join(map(str, unknown))}")
+        severity = rule.get("severity", "error")
+        if severity not in ALERT_SEVERITIES:
+            raise ValueError(f"{label} has unknown severity {severity}. Severities: {', '.join(ALERT_SEVERITIES)}")
+        parsed = {"name": rule["name"], "type": rule["type"], "notify": list(notify), "severity": severity,
+                  "sync_pair_id": rule.get("sync_pair_id"),
+                  "repeat_minutes": _positive(rule, "repeat_minutes", label) if rule.get("repeat_minutes") else None}
+        if rule["type"] == "job_failure":
+            jobs = rule.get("jobs", ["sync"])
+            if not isinstance(jobs, list) or not jobs or any(kind not in ALERT_JOB_KINDS for kind in jobs):
+                raise ValueError(f"{label} jobs must list job kinds of: {', '.join(ALERT_JOB_KINDS)}")
+            parsed["jobs"] = jobs
+        elif rule["type"] == "validation_failure_rate":
+            parsed["threshold"] = _positive(rule, "threshold", label, fraction=True)
+            parsed["min_records"] = int(_positive(rule, "min_records", label, default=1))
+        elif rule["type"] == "connector_down":
+            parsed["for_minutes"] = _positive(rule, "for_minutes", label, default=DEFAULT_DOWN_MINUTES)
+        elif rule["type"] == "stale_data":
+            parsed["max_age_minutes"] = _positive(rule, "max_age_minutes", label)
+            parsed["tables"] = rule.get("tables")
+        elif rule["type"] == "freshness_slo":
+            parsed["tables"] = rule.get("tables")
+        elif rule["type"] == "sync_anomalies":
+            parsed["min_anomalies"] = int(_positive(rule, "min_anomalies", label, default=1))
+            kinds = rule.get("kinds")
+            if kinds is not None and (not isinstance(kinds, list) or not kinds
+                                      or any(kind not in ANOMALY_KINDS for kind in kinds)):
+                raise ValueError(f"{label} kinds must list anomaly kinds of: {', '.join(ANOMALY_KINDS)}")
+            parsed["kinds"] = kinds
+        return parsed
+
+    def rules_of(self, rule_type: str, sync_pair_id: Optional[str] = None) -> List[Dict[str, Any]]:
+        """The rules of a type that cover a sync pair (or the county, when None)."""
+        return [rule for rule in self.rules
+                if rule["type"] == rule_type and rule["sync_pair_id"] in (None, sync_pair_id)]
+
+
+class AlertService:
+    """
+    Service class that evaluates the alert rules of every county and sends
+    their notifications.
+
+    Job rules are evaluated as the job events arrive on the event bus; the
+    connector_down and stale_data rules every ALERT_CHECK_SECONDS.
+    """
+
+    def __init__(self, engine=None, store: Optional[DocumentStore] = None, bus: Optional[EventBus] = None,
+                 config_dir: str = "county_configs"):
+        """
+        Initialize the service.
+
+        Args:
+            engine: Sync engine, to read finished jobs and source freshness
+            store: Document store alerts are kept in
+            bus: Event bus the job and connector health events are announced on
+            config_dir: Directory containing county configuration folders
+        """
+        self.engine = engine
+        self.store = store or sync_state_store
+        self.bus = bus or event_bus
+        self.config_dir = config_dir
+        self._configs: Dict[str, Any] = {}
+        self._lock = threading.RLock()
+        self._subscriptions = []
+        self._stop_event = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+
+    # Configuration ----------------------------------------------------------
+
+    def alerting(self, county_id: str) -> CountyAlerting:
+        """
+        The alerting configuration of a county; no rules when it has none.
+
+        Raises:
+            ValueError: If its alerting block is invalid
+        """
+        path = county_config_path(self.config_dir, county_id)
+        if path is None:
+            return CountyAlerting(county_id, None)
+        version = config_version(path)
+        with self._lock:
+            cached = self._configs.get(path)
+        if cached is not None and cached[0] == version:
+            return cached[1]
+        alerting = CountyAlerting(county_id, load_county_config(path).get("alerting"))
+        with self._lock:
+            self._configs[path] = (version, alerting)
+        return alerting
+
+    def _counties(self) -> List[str]:
+        if not os.path.isdir(self.config_dir):
+            return []
+        return [name for name in sorted(os.listdir(self.config_dir))
+                if os.path.exists(os.path.join(self.config_dir, name, f"{name}_config.json"))]
+
+    def _county_alerting(self, county_id: Optional[str]) -> Optional[CountyAlerting]:
+        if not county_id:
+            return None
+        try:
+            return self.alerting(county_id)
+        except ValueError as e:
+            logger.error(f"Alert rules of county {county_id} are not evaluated: {e}")
+            return None
+
+    # Alerts -----------------------------------------------------------------
+
+    def list(self, county_id: Optional[str] = None, status: Optional[str] = None) -> List[Dict[str, Any]]:
+        """Alerts, most recently changed first."""
+        if status and status not in ALERT_STATUSES:
+            raise ValueError(f"Invalid alert status {status}; choose from {', '.join(ALERT_STATUSES)}")
+        alerts = [a for a in self.store.list(ALERTS_COLLECTION)
+                  if (not county_id or a["county_id"] == county_id) and (not status or a["status"] == status)]
+        alerts.sort(key=lambda a: a.get("updated_at", ""), reverse=True)
+        return alerts
+
+    def get(self, alert_id: str) -> Dict[str, Any]:
+        """
+        Raises:
+            FileNotFoundError: If the alert does not exist
+        """
+        return self.store.load(ALERTS_COLLECTION, alert_id)
+
+    def evaluate(self, alerting: CountyAlerting, rule: Dict[str, Any], subject: str, firing: bool,
+                 summary: str, details: Optional[Dict[str, Any]] = None, sync_pair_id: Optional[str] = None,
+                 link: Optional[str] = None, since: Optional[str] = None, pending: bool = False
+                 ) -> Optional[Dict[str, Any]]:
+        """
+        Apply one observation of a rule's condition on a subject (a sync pair, connector or table).
+
+        A firing observation fires the subject's alert, notifying the rule's
+        notifiers unless it already fires (and is not due to repeat); with
+        pending, the alert waits as PENDING from since instead. A clear
+        observation resolves a firing alert and notifies its resolution.
+
+        Returns:
+            The alert, or None when the subject has none
+        """
+        alert_id = str(uuid.uuid5(uuid.NAMESPACE_URL, f"alert/{alerting.county_id}/{rule['name']}/{subject}"))
+        now = datetime.utcnow()
+        with self._lock:
+            try:
+                alert = self.store.load(ALERTS_COLLECTION, alert_id)
+            except FileNotFoundError:
+                alert = None
+            if not firing:
+                if alert is None or alert["status"] == "RESOLVED":
+                    return alert
+                was_firing = alert["status"] == "FIRING"
+                alert.update(status="RESOLVED", resolved_at=now.isoformat(), updated_at=now.isoformat())
+                self.store.save(ALERTS_COLLECTION, alert_id, alert)
+                if not was_firing:
+                    return alert
+                action = "resolve"
+            else:
+                active = alert is not None and alert["status"] != "RESOLVED"
+                if not active:
+                    alert = {"alert_id": alert_id, "county_id": alerting.county_id, "rule": rule["name"],
+                             "rule_type": rule["type"], "severity": rule["severity"], "subject": subject,
+                             "sync_pair_id": sync_pair_id, "status": "PENDING", "since": since or now.isoformat(),
+                             "fired_at": None, "resolved_at": None, "last_notified_at": None, "occurrences": 0,
+                             "notifications": (alert or {}).get("notifications", [])}
+                alert.update(summary=summary, details=details or {}, link=link, updated_at=now.isoformat(),
+                             occurrences=alert["occurrences"] + 1)
+                repeat = rule.get("repeat_minutes")
+                due = alert["status"] == "FIRING" and repeat and alert["last_notified_at"] and \
+                    datetime.fromisoformat(alert["last_notified_at"]) + timedelta(minutes=repeat) <= now
+                if pending or (alert["status"] == "FIRING" and not due):
+                    self.store.save(ALERTS_COLLECTION, alert_id, alert)
+                    return alert
+                if alert["status"] != "FIRING":
+                    alert.update(status="FIRING", fired_at=now.isoformat())
+                    logger.warning(f"Alert {alert_title(alert)}")
+                self.store.save(ALERTS_COLLECTION, alert_id, alert)
+                action = "trigger"
+        self._notify(alerting, rule, alert, action)
+        return alert
+
+    def _notify(self, alerting: CountyAlerting, rule: Dict[str, Any], alert: Dict[str, Any], action: str) -> None:
+        outcomes = []
+        for name in rule["notify"]:
+            notifier = alerting.notifiers[name]
+            outcome = {"notifier": name, "action": action, "sent_at": datetime.utcnow().isoformat(), "error": None}
+            for attempt in range(1, NOTIFY_ATTEMPTS + 1):
+                try:
+                    notifier.send(alert, action)
+                    outcome["error"] = None
+                    break
+                except Exception as e:
+                    outcome["error"] = str(e)
+                    if attempt < NOTIFY_ATTEMPTS:
+                        self._stop_event.wait(attempt)
+            if outcome["error"]:
+                logger.error(f"Cannot notify {name} ({notifier.notifier_type}) of alert {alert['alert_id']}: "
+                             f"{outcome['error']}")
+            outcomes.append(outcome)
+        with self._lock:
+            try:
+                current = self.store.load(ALERTS_COLLECTION, alert["alert_id"])
+            except FileNotFoundError:
+                return
+            current["notifications"] = (current.get("notifications") or []) + outcomes
+            current["notifications"] = current["notifications"][-NOTIFICATION_HISTORY:]
+            current["last_notified_at"] = outcomes[-1]["sent_at"] if outcomes else current.get("last_notified_at")
+            self.store.save(ALERTS_COLLECTION, alert["alert_id"], current)
+            alert.update(notifications=current["notifications"], last_notified_at=current["last_notified_at"])
+
+    def send_test(self, county_id: str, notifier_name: str) -> None:
+        """
+        Send a test notification through one of a county's notifiers.
+
+        Raises:
+            KeyError: If the county has no such notifier
+            ValueError: If its alerting block is invalid
+            NotifierError: If the notification cannot be sent
+        """
+        alerting = self.alerting(county_id)
+        if notifier_name not in alerting.notifiers:
+            raise KeyError(f"County {county_id} has no notifier {notifier_name}")
+        now = datetime.utcnow().isoformat()
+        alerting.notifiers[notifier_name].send({
+            "alert_id": str(uuid.uuid4()), "county_id": county_id, "rule": "test", "rule_type": "test",
+            "severity": "info", "summary": f"Test notification from TerraFusion through {notifier_name}",
+            "subject": "test", "sync_pair_id": None, "since": now, "fired_at": now, "details": {}, "link": None,
+        }, "trigger")
+
+    # Rules ------------------------------------------------------------------
+
+    @staticmethod
+    def _job_link(kind: str, job_id: str) -> Optional[str]:
+        if not BASE_URL:
+            return None
+        return f"{BASE_URL}/api/v1/{'sync' if kind == 'sync' else 'gis-export'}/jobs/{job_id}"
+
+    def on_job_event(self, kind: str, envelope: Dict[str, Any]) -> None:
+        """Evaluate the job rules on a sync or export job event."""
+        event = envelope.get("subject", "").rsplit(".", 1)[-1]
+        if event not in ("completed", "failed"):
+            return
+        data = envelope.get("data") or {}
+        alerting = self._county_alerting(data.get("county_id"))
+        if alerting is None:
+            return
+        sync_pair_id = data.get("sync_pair_id") if kind == "sync" else None
+        subject = sync_pair_id or f"{kind}-jobs"
+        for rule in alerting.rules_of("job_failure", sync_pair_id):
+            if kind not in rule["jobs"]:
+                continue
+            label = f"{'Sync' if kind == 'sync' else 'Export'} job {data.get('job_id')}"
+            self.evaluate(alerting, rule, subject, event == "failed",
+                          f"{label} failed" + (f" ({sync_pair_id})" if sync_pair_id else ""),
+                          {"job_id": data.get("job_id"), "message": data.get("message"), "mode": data.get("mode"),
+                           "export_format": data.get("export_format")},
+                          sync_pair_id, self._job_link(kind, data.get("job_id")))
+        rate_rules = alerting.rules_of("validation_failure_rate", sync_pair_id) if kind == "sync" else []
+        anomaly_rules = alerting.rules_of("sync_anomalies", sync_pair_id) if kind == "sync" else []
+        if not (rate_rules or anomaly_rules) or self.engine is None:
+            return
+        try:
+            job = self.engine.get_job_status(data["job_id"])
+        except FileNotFoundError:
+            return
+        if rate_rules:
+            results = (job.get("table_results") or {}).values()
+            read = sum(result.get("records_read", 0) for result in results)
+            quarantined = sum(result.get("records_quarantined", 0) for result in results)
+            rate = quarantined / read if read else 0.0
+            for rule in rate_rules:
+                firing = read >= rule["min_records"] and rate >= rule["threshold"]
+                self.evaluate(alerting, rule, subject, firing,
+                              f"Sync job {data['job_id']} quarantined {rate:.1%} of {read} records ({sync_pair_id})",
+                              {"job_id": data["job_id"], "records_read": read, "records_quarantined": quarantined,
+                               "threshold": f"{rule['threshold']:.1%}"},
+                              sync_pair_id, self._job_link("sync", data["job_id"]))
+        found = job.get("anomalies")
+        if event != "completed" or not found:
+            return
+        for rule in anomaly_rules:
+            by_kind = found.get("by_kind") or {}
+            flagged = sum(count for name, count in by_kind.items() if not rule["kinds"] or name in rule["kinds"])
+            self.evaluate(alerting, rule, subject, flagged >= rule["min_anomalies"],
+                          f"Sync job {data['job_id']} flagged {flagged} anomalies for review ({sync_pair_id})",
+                          {"job_id": data["job_id"], "anomalies": flagged, "by_kind": by_kind,
+                           "tables": found.get("tables")},
+                          sync_pair_id, self._job_link("sync", data["job_id"]))
+
+    @staticmethod
+    def _down_summary(details: Dict[str, Any], minutes: Optional[float] = None) -> str:
+        summary = f"{(details.get('side') or 'connector').capitalize()} of {details.get('sync_pair_id')} " \
+                  f"({details.get('connector_type')}) is unavailable"
+        return summary if minutes is None else f"{summary} for {minutes:.0f} minutes"
+
+    def on_connector_health(self, envelope: Dict[str, Any]) -> None:
+        """Start or resolve connector_down alerts on a connector health change."""
+        data = envelope.get("data") or {}
+        alerting = self._county_alerting(data.get("county_id"))
+        if alerting is None:
+            return
+        subject = f"{data.get('sync_pair_id')}/{data.get('side')}"
+        details = {name: data.get(name) for name in ("sync_pair_id", "side", "connector_type", "error", "checked_at")}
+        for rule in alerting.rules_of("connector_down", data.get("sync_pair_id")):
+            down = data.get("status") == "unavailable"
+            self.evaluate(alerting, rule, subject, down, self._down_summary(details), details,
+                          data.get("sync_pair_id"), since=data.get("checked_at"), pending=down)
+
+    def on_freshness_slo(self, envelope: Dict[str, Any]) -> None:
+        """Fire or resolve freshness_slo alerts as a table's freshness breach starts or ends."""
+        data = envelope.get("data") or {}
+        alerting = self._county_alerting(data.get("county_id"))
+        if alerting is None:
+            return
+        breached = data.get("status") == "breached"
+        slo_hours = (data.get("slo_seconds") or 0) / 3600
+        if data.get("age_seconds") is None:
+            summary = f"{data.get('table')} of {data.get('sync_pair_id')} has never been synced " \
+                      f"(objective {slo_hours:g} hours)"
+        else:
+            summary = f"{data.get('table')} of {data.get('sync_pair_id')} is {data['age_seconds'] / 3600:.1f} " \
+                      f"hours old, past its objective of {slo_hours:g} hours"
+        details = {name: data.get(name) for name in ("table", "age_seconds", "slo_seconds", "synced_at", "breach_id")}
+        for rule in alerting.rules_of("freshness_slo", data.get("sync_pair_id")):
+            if rule["tables"] and data.get("table") not in rule["tables"]:
+                continue
+            self.evaluate(alerting, rule, f"{data.get('sync_pair_id')}/{data.get('table')}", breached, summary,
+                          details, data.get("sync_pair_id"))
+
+    def check_conditions(self) -> None:
+        """Fire (or repeat) connector_down alerts down their for_minutes, and evaluate the stale_data rules."""
+        now = datetime.utcnow()
+        for alert in self.list(status="PENDING") + self.list(status="FIRING"):
+            if alert["rule_type"] != "connector_down":
+                continue
+            alerting = self._county_alerting(alert["county_id"])
+            rule = next((r for r in alerting.rules if r["name"] == alert["rule"]), None) if alerting else None
+            if rule is None or rule["type"] != "connector_down":
+                continue
+            down_minutes = (now - datetime.fromisoformat(alert["since"])).total_seconds() / 60
+            if down_minutes >= rule["for_minutes"]:
+                summary = self._down_summary(alert["details"], down_minutes)
+                self.evaluate(alerting, rule, alert["subject"], True, summary, alert["details"],
+                              alert.get("sync_pair_id"), since=alert["since"])
+
+        if self.engine is None:
+            return
+        for county_id in self._counties():
+            alerting = self._county_alerting(county_id)
+            if alerting is None or not any(rule["type"] == "stale_data" for rule in alerting.rules):
+                continue
+            for pair in self.engine.registry.list(alerting.county_id):
+                rules = alerting.rules_of("stale_data", pair.sync_pair_id)
+                if not rules:
+                    continue
+                for table in self.engine.source_freshness(pair.sync_pair_id)["tables"]:
+                    for rule in rules:
+                        # Tables never synced have no age; the first sync's failure is job_failure's to report
+                        if (rule["tables"] and table["table"] not in rule["tables"]) or table["age_seconds"] is None:
+                            continue
+                        age_minutes = table["age_seconds"] / 60
+                        self.evaluate(alerting, rule, f"{pair.sync_pair_id}/{table['table']}",
+                                      age_minutes > rule["max_age_minutes"],
+                                      f"{table['table']} of {pair.sync_pair_id} was last synced "
+                                      f"{age_minutes:.0f} minutes ago",
+                                      {"table": table["table"], "max_age_minutes": rule["max_age_minutes"],
+                                       "synced_at": min(source["synced_at"] for source in table["sources"])},
+                                      pair.sync_pair_id)
+
+    def _safely(self, handler):
+        def handle(envelope: Dict[str, Any]) -> None:
+            try:
+                handler(envelope)
+            except Exception as e:
+                logger.error(f"Cannot evaluate alert rules on {envelope.get('subject')}: {e}", exc_info=True)
+        return handle
+
+    # Worker -----------------------------------------------------------------
+
+    def start(self) -> None:
+        """Subscribe to job, connector health and freshness events and start checking conditions."""
+        if self._thread is not None and self._thread.is_alive():
+            return
+        try:
+            self._subscriptions = [
+                self.bus.subscribe(SUBJECT_SYNC_JOB.format(job_id="*", event="*"),
+                                   self._safely(lambda envelope: self.on_job_event("sync", envelope)), QUEUE_GROUP),
+                self.bus.subscribe(SUBJECT_EXPORT_JOB.format(job_id="*", event="*"),
+                                   self._safely(lambda envelope: self.on_job_event("export", envelope)), QUEUE_GROUP),
+                self.bus.subscribe(SUBJECT_SYSTEM.format(event="connector_health"),
+                                   self._safely(self.on_connector_health), QUEUE_GROUP),
+                self.bus.subscribe(SUBJECT_SYSTEM.format(event="freshness_slo"),
+                                   self._safely(self.on_freshness_slo), QUEUE_GROUP),
+            ]
+        except EventBusError as e:
+            logger.error(f"Cannot subscribe alerting to job events: {e}")
+        self._stop_event.clear()
+        self._thread = threading.Thread(target=self._loop, name="alerting", daemon=True)
+        self._thread.start()
+        logger.info(f"Alerting started (checking conditions every {CHECK_SECONDS}s)")
+
+    def stop(self) -> None:
+        """Unsubscribe and stop checking conditions."""
+        for subscription in self._subscriptions:
+            subscription.unsubscribe()
+        self._subscriptions = []
+        self._stop_event.set()
+        if self._thread is not None:
+            self._thread.join(timeout=5)
+            self._thread = None
+        logger.info("Alerting stopped")
+
+    def status(self) -> Dict[str, Any]:
+        """Whether the worker runs, and the alerts by status."""
+        counts = {status: 0 for status in ALERT_STATUSES}
+        for alert in self.store.list(ALERTS_COLLECTION):
+            counts[alert["status"]] = counts.get(alert["status"], 0) + 1
+        return {"running": self._thread is not None and self._thread.is_alive(), "alerts": counts}
+
+    def _loop(self) -> None:
+        while not self._stop_event.is_set():
+            try:
+                self.check_conditions()
+            except Exception as e:
+                logger.error(f"Error checking alert conditions: {e}", exc_info=True)
+            self._stop_event.wait(CHECK_SECONDS)
@@ -0,0 +1,467 @@
+"""
+TerraFusion Platform - API Keys
+
+This module provides the API keys machine integrations (county GIS
+servers, vendor portals, monitoring) authenticate with instead of sharing a
+user's JWT. A key belongs to a named service and carries:
+
+- scopes (see API_KEY_SCOPES): exports:read for read-only export access,
+  jobs:submit to submit and follow sync and export jobs, batches and record
+  pushes, admin for every route including key management
+- a rate limit in requests per minute, enforced per key by each gateway
+- an optional expiry, and its last use (time, address and path)
+- optional allowed_ips, the addresses and CIDR networks it may be used from
+  (checked by the gateway's network policies, see network_policy)
+
+Keys are sent in the X-API-Key header and look like tfk_<key_id>_<secret>.
+Only a SHA-256 hash of the secret is stored, so a key is shown once, when it
+is created or rotated. Rotating a key issues a new one with the same settings
+and lets the old one keep working for a grace period, so an integration can
+switch over without downtime; revoking a key stops it at once on the gateway
+that revoked it and within API_KEY_CACHE_SECONDS on the others.
+
+The gateway middleware (authenticate) checks every /api/ request that
+carries a key: unknown, expired and revoked keys get 401, a route outside
+the key's scopes 403, and a key over its rate limit 429 with Retry-After.
+Requests without a key are left to the route's own authentication.
+"""
+
+import os
+import re
+import time
+import hashlib
+import logging
+import secrets
+import threading
+from datetime import datetime, timedelta
+from typing import Dict, List, Any, Optional, Tuple
+
+from sync_store import DocumentStore, sync_state_store
+from audit_log import AuditLog, audit_log
+from network_policy import parse_networks
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection
+API_KEYS_COLLECTION = "api_keys"
+
+HEADER_NAME = "X-API-Key"
+
+KEY_PREFIX = "tfk"
+
+# Scopes a key can be granted
+API_KEY_SCOPES = {
+    "exports:read": "Read export jobs, parcel reports and open data datasets, and download export artifacts",
+    "jobs:submit": "Submit and follow sync and export jobs and batches, and push records",
+    "admin": "Every API route, including API key management",
+}
+
+# Routes each scope allows, as (methods, path pattern) on the path without its /api/vN prefix
+SCOPE_ROUTES: Dict[str, List[Tuple[Tuple[str, ...], str]]] = {
+    "exports:read": [
+        (("GET",), r"/gis-export/(jobs|download)(/.*)?"),
+        (("GET",), r"/reports/.*"),
+        (("GET",), r"/open-data/datasets(/.*)?"),
+    ],
+    "jobs:submit": [
+        (("GET", "POST"), r"/gis-export/jobs"),
+        (("GET",), r"/gis-export/jobs/[^/]+"),
+        (("GET", "POST"), r"/sync/jobs"),
+        (("GET",), r"/sync/jobs/[^/]+(/events|/loads)?"),
+        (("GET",), r"/sync/queue"),
+        (("GET", "POST"), r"/batches"),
+        (("GET",), r"/batches/[^/]+"),
+        (("POST",), r"/sync/pairs/[^/]+/tables/[^/]+/records"),
+    ],
+}
+
+# Routes every key may call
+PUBLIC_ROUTES = [(("GET",), r"/versions"), (("GET",), r"/openapi\.json")]
+
+KEY_STATUSES = ["active", "expired", "revoked"]
+
+# Requests per minute of a key created without a rate limit
+DEFAULT_RATE_LIMIT = int(os.environ.get("API_KEY_DEFAULT_RATE_LIMIT", "600"))
+
+# Highest rate limit a key can be given
+MAX_RATE_LIMIT = 100_000
+
+# Seconds a gateway trusts its cached copy of a key; revocations on other gateways apply within this
+CACHE_SECONDS = float(os.environ.get("API_KEY_CACHE_SECONDS", "30"))
+
+# Seconds between writes of a key's last use
+LAST_USED_WRITE_SECONDS = 60
+
+# Hours a rotated key keeps working by default
+DEFAULT_ROTATION_GRACE_HOURS = 24
+
+_KEY_PATTERN = re.compile(rf"^{KEY_PREFIX}_([0-9a-f]{{16}})_([\w-]{{20,}})$")
+_VERSION_PREFIX = re.compile(r"^/api(/v\d+)?(?=/)")
+
+
+class ApiKeyError(Exception):
+    """Raised when a request's API key is refused; status is the HTTP status to answer with."""
+
+    def __init__(self, message: str, status: int, headers: Optional[Dict[str, str]] = None):
+        super().__init__(message)
+        self.status = status
+        self.headers = headers or {}
+
+
+def _hash(secret: str) -> str:
+    return hashlib.sha256(secret.encode("utf-8")).hexdigest()
+
+
+def _check_scopes(scopes: Any) -> List[str]:
+    if not isinstance(scopes, list) or not scopes:
+        raise ValueError(f"scopes must be a non-empty list of: {', '.join(API_KEY_SCOPES)}")
+    unknown = [s for s in scopes if s not in API_KEY_SCOPES]
+    if unknown:
+        raise ValueError(f"Unknown scope {unknown[0]}; choose from {', '.join(API_KEY_SCOPES)}")
+    return sorted(set(scopes))
+
+
+def _check_rate_limit(rate_limit: Any) -> int:
+    if rate_limit is None:
+        return DEFAULT_RATE_LIMIT
+    if not isinstance(rate_limit, int) or isinstance(rate_limit, bool) or not 1 <= rate_limit <= MAX_RATE_LIMIT:
+        raise ValueError(f"rate_limit_per_minute must be an integer from 1 to {MAX_RATE_LIMIT}")
+    return rate_limit
+
+
+def _check_expiry(expires_at: Any) -> Optional[str]:
+    if expires_at is None:
+        return None
+    try:
+        expiry = datetime.fromisoformat(str(expires_at).replace("Z", "+00:00")).replace(tzinfo=None)
+    except ValueError:
+        raise ValueError(f"expires_at must be an ISO timestamp, got {expires_at}")
+    if expiry <= datetime.utcnow():
+        raise ValueError("expires_at must be in the future")
+    return expiry.isoformat()
+
+
+def api_path(path: str) -> str:
+    """A request path without its /api or /api/vN prefix."""
+    return _VERSION_PREFIX.sub("", path, count=1)
+
+
+def scope_allows(scopes: List[str], method: str, path: str) -> bool:
+    """Whether a key with these scopes may call a route."""
+    if "admin" in scopes:
+        return True
+    method = "GET" if method == "HEAD" else method
+    route = api_path(path)
+    rules = PUBLIC_ROUTES + [rule for scope in scopes for rule in SCOPE_ROUTES.get(scope, [])]
+    return any(method in methods and re.fullmatch(pattern, route) for methods, pattern in rules)
+
+
+def key_status(key: Dict[str, Any], now: Optional[datetime] = None) -> str:
+    """A key's status: active, expired or revoked."""
+    if key.get("revoked_at"):
+        return "revoked"
+    if key.get("expires_at") and datetime.fromisoformat(key["expires_at"]) <= (now or datetime.utcnow()):
+        return "expired"
+    return "active"
+
+
+class _RateLimiter:
+    """A token bucket of one key: rate_limit requests per minute, with bursts up to the same number."""
+
+    def __init__(self, rate_limit: int):
+        self.rate_limit = rate_limit
+        self.tokens = float(rate_limit)
+        self.updated = time.monotonic()
+
+    def take(self) -> Tuple[bool, int, float]:
+        """Take a request's token; returns (allowed, tokens left, seconds until the next token)."""
+        now = time.monotonic()
+        self.tokens = min(float(self.rate_limit), self.tokens + (now - self.updated) * self.rate_limit / 60.0)
+        self.updated = now
+        if self.tokens >= 1:
+            self.tokens -= 1
+            return True, int(self.tokens), 0.0
+        return False, 0, (1 - self.tokens) * 60.0 / self.rate_limit
+
+
+class ApiKeyService:
+    """
+    Service class for creating, rotating and revoking API keys and checking the keys requests carry.
+    """
+
+    def __init__(self, store: Optional[DocumentStore] = None, audit: Optional[AuditLog] = None,
+                 cache_seconds: float = CACHE_SECONDS):
+        """
+        Initialize the service.
+
+        Args:
+            store: Document store for the keys
+            audit: Audit log for key changes
+            cache_seconds: Seconds a looked-up key is trusted before it is read again
+        """
+        self.store = store or sync_state_store
+        self.audit = audit or audit_log
+        self.cache_seconds = cache_seconds
+        self._lock = threading.Lock()
+        self._cache: Dict[str, Tuple[float, Dict[str, Any]]] = {}
+        self._limiters: Dict[str, _RateLimiter] = {}
+        self._last_written: Dict[str, float] = {}
+
+    # Management -------------------------------------------------------------
+
+    def create(self, name: str, service: str, scopes: List[str], username: str,
+               rate_limit_per_minute: Optional[int] = None, expires_at: Optional[str] = None,
+               county_id: Optional[str] = None, description: Optional[str] = None,
+               allowed_ips: Optional[List[str]] = None) -> Dict[str, Any]:
+        """
+        Create a key.
+
+        Args:
+            name: Label of the key, e.g. "ArcGIS Server nightly pull"
+            service: Service the key authenticates as; push jobs record it as service:<name>
+            scopes: Granted scopes (see API_KEY_SCOPES)
+            username: User creating the key
+            rate_limit_per_minute: Requests per minute (DEFAULT_RATE_LIMIT when omitted)
+            expires_at: ISO timestamp after which the key stops working
+            county_id: County the integration belongs to
+            description: Free text
+            allowed_ips: Addresses and CIDR networks the key may be used from; any when omitted
+
+        Returns:
+            The key, including its secret "api_key", which is not shown again
+
+        Raises:
+            ValueError: If a setting is invalid
+        """
+        for label, value in (("name", name), ("service", service)):
+            if not isinstance(value, str) or not value.strip():
+                raise ValueError(f"{label} is required")
+        if not re.fullmatch(r"[\w.-]+", service):
+            raise ValueError("service may only contain letters, digits, '.', '_' and '-'")
+        if allowed_ips is not None:
+            allowed_ips = [str(network) for network in parse_networks(allowed_ips, "allowed_ips")]
+        key = {
+            "name": name.strip(),
+            "service": service,
+            "scopes": _check_scopes(scopes),
+            "rate_limit_per_minute": _check_rate_limit(rate_limit_per_minute),
+            "expires_at": _check_expiry(expires_at),
+            "county_id": county_id,
+            "description": description,
+            "allowed_ips": allowed_ips or None,
+            "created_by": username,
+        }
+        issued = self._issue(key)
+        self.audit.record("api_key.created", username, "api_key", issued["key_id"],
+                          {"name": key["name"], "service": service, "scopes": key["scopes"]}, county_id)
+        logger.info(f"Created API key {issued['key_id']} for service {service} ({', '.join(key['scopes'])})")
+        return issued
+
+    def get(self, key_id: str) -> Dict[str, Any]:
+        """
+        A key, without its secret.
+
+        Raises:
+            FileNotFoundError: If the key does not exist
+        """
+        return self._public(self.store.load(API_KEYS_COLLECTION, key_id))
+
+    def list(self, service: Optional[str] = None, status: Optional[str] = None,
+             county_id: Optional[str] = None) -> List[Dict[str, Any]]:
+        """Keys without their secrets, newest first."""
+        if status and status not in KEY_STATUSES:
+            raise ValueError(f"Unknown key status {status}; choose from {', '.join(KEY_STATUSES)}")
+        keys = [self._public(k) for k in self.store.list(API_KEYS_COLLECTION)]
+        keys = [k for k in keys if (not service or k["service"] == service) and (not status or k["status"] == status)
+                and (not county_id or k.get("county_id") == county_id)]
+        return sorted(keys, key=lambda k: (k["created_at"], k["key_id"]), reverse=True)
+
+    def revoke(self, key_id: str, username: str, reason: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Revoke a key; it stops working at once on this gateway.
+
+        Raises:
+            FileNotFoundError: If the key does not exist
+            ValueError: If the key is already revoked
+        """
+        key = self.store.load(API_KEYS_COLLECTION, key_id)
+        if key.get("revoked_at"):
+            raise ValueError(f"API key {key_id} was already revoked at {key['revoked_at']}")
+        key.update(revoked_at=datetime.utcnow().isoformat(), revoked_by=username, revoked_reason=reason)
+        self.store.save(API_KEYS_COLLECTION, key_id, key)
+        self._forget(key_id)
+        self.audit.record("api_key.revoked", username, "api_key", key_id,
+                          {"name": key["name"], "service": key["service"], "reason": reason}, key.get("county_id"))
+        logger.info(f"Revoked API key {key_id} of service {key['service']}")
+        return self._public(key)
+
+    def rotate(self, key_id: str, username: str,
+               grace_hours: float = DEFAULT_ROTATION_GRACE_HOURS) -> Dict[str, Any]:
+        """
+        Replace a key with a new one with the same settings.
+
+        The old key keeps working for grace_hours (0 revokes it at once).
+
+        Returns:
+            The new key, including its secret "api_key"
+
+        Raises:
+            FileNotFoundError: If the key does not exist
+            ValueError: If the key is not active or the grace period is invalid
+        """
+        if not isinstance(grace_hours, (int, float)) or isinstance(grace_hours, bool) or not 0 <= grace_hours <= 24 * 30:
+            raise ValueError("grace_hours must be a number from 0 to 720")
+        old = self.store.load(API_KEYS_COLLECTION, key_id)
+        if key_status(old) != "active":
+            raise ValueError(f"API key {key_id} is {key_status(old)} and cannot be rotated")
+        settings = {name: old.get(name) for name in ("name", "service", "scopes", "rate_limit_per_minute",
+                                                     "expires_at", "county_id", "description", "allowed_ips")}
+        issued = self._issue(dict(settings, created_by=username, replaces=key_id))
+        now = datetime.utcnow()
+        if grace_hours:
+            grace_end = now + timedelta(hours=grace_hours)
+            if not old.get("expires_at") or datetime.fromisoformat(old["expires_at"]) > grace_end:
+                old["expires_at"] = grace_end.isoformat()
+        else:
+            old.update(revoked_at=now.isoformat(), revoked_by=username, revoked_reason="rotated")
+        old["replaced_by"] = issued["key_id"]
+        self.store.save(API_KEYS_COLLECTION, key_id, old)
+        self._forget(key_id)
+        self.audit.record("api_key.rotated", username, "api_key", key_id,
+                          {"replaced_by": issued["key_id"], "grace_hours": grace_hours}, old.get("county_id"))
+        logger.info(f"Rotated API key {key_id} of service {old['service']} to {issued['key_id']}")
+        return issued
+
+    # Gateway ----------------------------------------------------------------
+
+    def allowed_ips(self, api_key: str) -> Optional[List[str]]:
+        """
+        The allowed_ips of the key a request carries, for the network checks made before
+        authentication; the secret is not checked, so this decides nothing about the key's validity.
+        """
+        match = _KEY_PATTERN.match(api_key.strip())
+        key = self._lookup(match.group(1)) if match else None
+        return key.get("allowed_ips") if key else None
+
+    def authenticate(self, api_key: str, method: str, path: str,
+                     remote_addr: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Check the key a request carries, for the gateway middleware.
+
+        Args:
+            api_key: The X-API-Key header
+            method: Request method
+            path: Request path
+            remote_addr: Client address, recorded as the key's last use
+
+        Returns:
+            The key without its secret, with "rate_limit_remaining"
+
+        Raises:
+            ApiKeyError: 401 for an unknown, expired or revoked key, 403 for a route
+                outside its scopes, 429 when it is over its rate limit
+        """
+        match = _KEY_PATTERN.match(api_key.strip())
+        key = self._lookup(match.group(1)) if match else None
+        if key is None or not secrets.compare_digest(key["secret_hash"], _hash(match.group(2))):
+            raise ApiKeyError("Invalid API key", 401)
+        status = key_status(key)
+        if status != "active":
+            raise ApiKeyError(f"API key {key['key_id']} is {status}", 401)
+        if not scope_allows(key["scopes"], method, path):
+            raise ApiKeyError(f"API key {key['key_id']} ({', '.join(key['scopes'])}) may not call {method} {path}", 403)
+
+        with self._lock:
+            limiter = self._limiters.get(key["key_id"])
+            if limiter is None or limiter.rate_limit != key["rate_limit_per_minute"]:
+                limiter = self._limiters[key["key_id"]] = _RateLimiter(key["rate_limit_per_minute"])
+            allowed, remaining, wait = limiter.take()
+        limit_headers = {"X-RateLimit-Limit": str(key["rate_limit_per_minute"]), "X-RateLimit-Remaining": str(remaining)}
+        if not allowed:
+            raise ApiKeyError(f"API key {key['key_id']} is over its limit of {key['rate_limit_per_minute']} requests per minute",
+                              429, dict(limit_headers, **{"Retry-After": str(max(1, int(wait + 0.999)))}))
+        self._record_use(key, remote_addr, path)
+        return dict(self._public(key), rate_limit_remaining=remaining)
+
+    # Internals --------------------------------------------------------------
+
+    def _issue(self, settings: Dict[str, Any]) -> Dict[str, Any]:
+        key_id = secrets.token_hex(8)
+        secret = secrets.token_urlsafe(32)
+        api_key = f"{KEY_PREFIX}_{key_id}_{secret}"
+        key = dict(settings, key_id=key_id, prefix=api_key[:len(KEY_PREFIX) + 9], secret_hash=_hash(secret),
+                   created_at=datetime.utcnow().isoformat(), revoked_at=None, revoked_by=None,
+                   last_used_at=None, last_used_ip=None, last_used_path=None)
+        self.store.save(API_KEYS_COLLECTION, key_id, key)
+        return dict(self._public(key), api_key=api_key)
+
+    def _lookup(self, key_id: str) -> Optional[Dict[str, Any]]:
+        now = time.monotonic()
+        with self._lock:
+            cached = self._cache.get(key_id)
+            if cached and now - cached[0] < self.cache_seconds:
+                return cached[1]
+        try:
+            key = self.store.load(API_KEYS_COLLECTION, key_id)
+        except FileNotFoundError:
+            key = None
+        with self._lock:
+            if key is not None and cached and cached[1] and \
+                    (cached[1].get("last_used_at") or "") > (key.get("last_used_at") or ""):
+                # Keep the last use this gateway has not written yet
+                for name in ("last_used_at", "last_used_ip", "last_used_path"):
+                    key[name] = cached[1].get(name)
+            self._cache[key_id] = (now, key)
+        return key
+
+    def _forget(self, key_id: str) -> None:
+        with self._lock:
+            self._cache.pop(key_id, None)
+            self._limiters.pop(key_id, None)
+
+    def _record_use(self, key: Dict[str, Any], remote_addr: Optional[str], path: str) -> None:
+        """Note a key's last use; it is written to the store at most once per LAST_USED_WRITE_SECONDS."""
+        now = time.monotonic()
+        key.update(last_used_at=datetime.utcnow().isoformat(), last_used_ip=remote_addr, last_used_path=path)
+        with self._lock:
+            if now - self._last_written.get(key["key_id"], float("-inf")) < LAST_USED_WRITE_SECONDS:
+                return
+            self._last_written[key["key_id"]] = now
+        try:
+            stored = self.store.load(API_KEYS_COLLECTION, key["key_id"])
+            stored.update(last_used_at=key["last_used_at"], last_used_ip=remote_addr, last_used_path=path)
+            self.store.save(API_KEYS_COLLECTION, key["key_id"], stored)
+        except Exception as e:
+            # Tracking never fails the request
+            logger.warning(f"Cannot record the use of API key {key['key_id']}: {e}")
+
+    @staticmethod
+    def _public(key: Dict[str, Any]) -> Dict[str, Any]:
+        public = {name: value for name, value in key.items() if name != "secret_hash"}
+        public["status"] = key_status(key)
+        return public
+
+
+def main() -> None:
+    """Create a key from the command line, e.g. the first admin key of a new installation."""
+    import argparse
+    parser = argparse.ArgumentParser(description="Create a TerraFusion API key")
+    parser.add_argument("--name", required=True)
+    parser.add_argument("--service", required=True)
+    parser.add_argument("--scopes", default="admin", help=f"Comma-separated: {', '.join(API_KEY_SCOPES)}")
+    parser.add_argument("--rate-limit", type=int, default=None, help="Requests per minute")
+    parser.add_argument("--allowed-ips", default=None, help="Comma-separated addresses and CIDR networks")
+    parser.add_argument("--username", default=os.environ.get("USER", "cli"))
+    args = parser.parse_args()
+    allowed_ips = [s.strip() for s in args.allowed_ips.split(",") if s.strip()] if args.allowed_ips else None
+    key = ApiKeyService().create(args.name, args.service, [s.strip() for s in args.scopes.split(",") if s.strip()],
+                                 args.username, rate_limit_per_minute=args.rate_limit, allowed_ips=allowed_ips)
+    print(f"Created API key {key['key_id']} for {key['service']} ({', '.join(key['scopes'])})")
+    print(f"{HEADER_NAME}: {key['api_key']}")
+    print("Store it now; it is not shown again.")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,214 @@
+"""
+TerraFusion Platform - API Versioning
+
+This module lets the gateway evolve response schemas without breaking the
+county integrations written against older ones. Every API route is served
+under each version in API_VERSIONS, chosen by path or by header:
+
+    GET /api/v2/sync/jobs
+    GET /api/sync/jobs         with  API-Version: 2   (DEFAULT_VERSION without the header)
+
+Handlers produce the newest version's bodies. An older version is served
+through compatibility shims (RESPONSE_SHIMS) that turn the newest body back
+into the shape that version promised, so /api/v1 answers exactly as it did
+before v2 existed. Every API response names its version in API-Version; an
+endpoint deprecated in the requested version also carries Deprecation
+(RFC 9745), Sunset (RFC 8594) and a Link to its successor, and
+GET /api/versions lists the versions and their deprecations.
+
+Changes in v2:
+- Export job, sync job and sync pair listings return an object like every
+  other listing ({"jobs": [...], "count": 2, "next_cursor": ...}) instead of
+  a bare array, so they can grow fields without breaking clients.
+"""
+
+import os
+import re
+import json
+import logging
+from datetime import datetime, timezone
+from email.utils import format_datetime
+from typing import Dict, Any, Optional, Callable, Mapping, NamedTuple
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Supported versions, oldest first
+API_VERSIONS = ["v1", "v2"]
+
+LATEST_VERSION = API_VERSIONS[-1]
+
+# Version of unversioned /api/ paths sent without an API-Version header; v1
+# until county integrations have moved to versioned paths
+DEFAULT_VERSION = os.environ.get("API_DEFAULT_VERSION", "v1")
+
+VERSION_HEADER = "API-Version"
+
+# Paths served only unversioned
+UNVERSIONED_PATHS = ["/api/versions"]
+
+_VERSIONED_PATH = re.compile(r"^/api/(v\d+)(?=/)")
+_HEADER_VERSION = re.compile(r"^v?(\d+)(?:\.0)?$")
+
+
+class Deprecation(NamedTuple):
+    """The deprecation of an endpoint in one version."""
+    since: str      # Date (YYYY-MM-DD) the endpoint was deprecated
+    sunset: str     # Date after which it may be removed
+    successor: str  # Version serving its replacement
+    note: str
+
+
+# Endpoints deprecated in a version, by version and endpoint
+DEPRECATIONS: Dict[str, Dict[str, Deprecation]] = {
+    "v1": {
+        "list_export_jobs": Deprecation("2026-10-14", "2027-10-01", "v2",
+                                        "v2 returns {\"jobs\": [...], \"count\": n, \"next_cursor\": ...}"),
+        "list_sync_jobs": Deprecation("2026-10-14", "2027-10-01", "v2",
+                                      "v2 returns {\"jobs\": [...], \"count\": n, \"next_cursor\": ...}"),
+        "list_sync_pairs": Deprecation("2026-10-14", "2027-10-01", "v2",
+                                       "v2 returns {\"sync_pairs\": [...], \"count\": n}"),
+    },
+}
+
+
+def _unwrap(key: str) -> Callable[[Any], Any]:
+    """A shim returning a listing object's items as the bare array older versions returned."""
+    return lambda body: body.get(key, []) if isinstance(body, dict) else body
+
+
+# Compatibility shims from the newest body to an older version's, by version and endpoint
+RESPONSE_SHIMS: Dict[str, Dict[str, Callable[[Any], Any]]] = {
+    "v1": {
+        "list_export_jobs": _unwrap("jobs"),
+        "list_sync_jobs": _unwrap("jobs"),
+        "list_sync_pairs": _unwrap("sync_pairs"),
+    },
+}
+
+
+class UnsupportedVersionError(ValueError):
+    """Raised for a request naming a version the gateway does not serve."""
+
+
+def request_version(path: str, headers: Mapping[str, str]) -> Optional[str]:
+    """
+    The API version a request asks for: the path's (/api/v2/...), else the
+    API-Version header's, else DEFAULT_VERSION. None outside /api/.
+
+    Raises:
+        UnsupportedVersionError: If the version is unknown, or the header contradicts the path
+    """
+    if not path.startswith("/api/"):
+        return None
+    header = (headers.get(VERSION_HEADER) or "").strip()
+    header_version = None
+    if header:
+        match = _HEADER_VERSION.match(header)
+        header_version = f"v{match.group(1)}" if match else None
+        if header_version not in API_VERSIONS:
+            raise UnsupportedVersionError(f"Unsupported {VERSION_HEADER} {header}; supported: {', '.join(API_VERSIONS)}")
+    match = _VERSIONED_PATH.match(path)
+    if match:
+        if match.group(1) not in API_VERSIONS:
+            raise UnsupportedVersionError(f"Unsupported API version {match.group(1)}; supported: {', '.join(API_VERSIONS)}")
+        if header_version and header_version != match.group(1):
+            raise UnsupportedVersionError(f"{VERSION_HEADER} {header} contradicts the path's version {match.group(1)}")
+        return match.group(1)
+    if path in UNVERSIONED_PATHS:
+        return header_version or LATEST_VERSION
+    return header_version or DEFAULT_VERSION
+
+
+def versioned_path(path: str, version: str) -> str:
+    """A path of the API moved to another version."""
+    match = _VERSIONED_PATH.match(path)
+    rest = path[match.end():] if match else path[len("/api"):]
+    return f"/api/{version}{rest}"
+
+
+def shim_body(version: str, endpoint: Optional[str], body: Any) -> Any:
+    """The newest version's body of an endpoint as the requested version returns it."""
+    shim = RESPONSE_SHIMS.get(version, {}).get(endpoint or "")
+    return shim(body) if shim else body
+
+
+def needs_shim(version: str, endpoint: Optional[str]) -> bool:
+    return (endpoint or "") in RESPONSE_SHIMS.get(version, {})
+
+
+def deprecation(version: str, endpoint: Optional[str]) -> Optional[Deprecation]:
+    return DEPRECATIONS.get(version, {}).get(endpoint or "")
+
+
+def response_headers(version: str, endpoint: Optional[str], path: str) -> Dict[str, str]:
+    """The version and deprecation headers of a response."""
+    headers = {VERSION_HEADER: version}
+    deprecated = deprecation(version, endpoint)
+    if deprecated:
+        since = datetime.strptime(deprecated.since, "%Y-%m-%d").replace(tzinfo=timezone.utc)
+        sunset = datetime.strptime(deprecated.sunset, "%Y-%m-%d").replace(tzinfo=timezone.utc)
+        headers["Deprecation"] = f"@{int(since.timestamp())}"
+        headers["Sunset"] = format_datetime(sunset, usegmt=True)
+        headers["Link"] = f'<{versioned_path(path, deprecated.successor)}>; rel="successor-version"'
+    return headers
+
+
+def describe_versions() -> Dict[str, Any]:
+    """The versions the gateway serves and the endpoints deprecated in each (GET /api/versions)."""
+    return {
+        "versions": [{
+            "version": version,
+            "path": f"/api/{version}/",
+            "latest": version == LATEST_VERSION,
+            "default": version == DEFAULT_VERSION,
+            "deprecated_endpoints": [dict(d._asdict(), endpoint=endpoint)
+                                     for endpoint, d in sorted(DEPRECATIONS.get(version, {}).items())],
+            "shimmed_endpoints": sorted(RESPONSE_SHIMS.get(version, {})),
+        } for version in API_VERSIONS],
+        "latest": LATEST_VERSION,
+        "default": DEFAULT_VERSION,
+        "header": VERSION_HEADER,
+    }
+
+
+def register_versions(flask_app) -> int:
+    """
+    Serve every /api/v1/ route under each other version's path and unversioned
+    (/api/...), with the same view. Call once, after all routes are defined.
+
+    Returns:
+        Number of rules added
+    """
+    if DEFAULT_VERSION not in API_VERSIONS:
+        raise ValueError(f"API_DEFAULT_VERSION {DEFAULT_VERSION} is not one of {', '.join(API_VERSIONS)}")
+    rules = [rule for rule in flask_app.url_map.iter_rules() if rule.rule.startswith("/api/v1/")]
+    added = 0
+    for rule in rules:
+        methods = sorted(rule.methods - {"HEAD", "OPTIONS"})
+        view = flask_app.view_functions[rule.endpoint]
+        for path in [versioned_path(rule.rule, v) for v in API_VERSIONS if v != "v1"] + ["/api" + rule.rule[len("/api/v1"):]]:
+            flask_app.add_url_rule(path, endpoint=rule.endpoint, view_func=view, methods=methods)
+            added += 1
+    logger.info(f"Serving API versions {', '.join(API_VERSIONS)} (default {DEFAULT_VERSION}): {added} versioned routes added")
+    return added
+
+
+def finish_response(version: Optional[str], endpoint: Optional[str], path: str, response) -> Any:
+    """
+    Shim a response's JSON body to the requested version and add the version
+    and deprecation headers; for the gateway's after_request hook.
+    """
+    if version is None:
+        return response
+    if needs_shim(version, endpoint) and 200 <= response.status_code < 300 and response.is_json:
+        body = shim_body(version, endpoint, response.get_json())
+        response.set_data(json.dumps(body))
+    for key, value in response_headers(version, endpoint, path).items():
+        if key == "Link" and response.headers.get("Link"):
+            response.headers["Link"] = f"{response.headers['Link']}, {value}"
+        elif key not in response.headers:
+            # Offset paging sets its own Deprecation
+            response.headers[key] = value
+    return response
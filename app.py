@@ -1,176 +1,2848 @@
 import os
+import re
+import hmac
+import json
+import time
+import uuid
 import logging
-from datetime import datetime
-from flask import Flask, render_template, redirect, url_for, request, jsonify, send_file, abort
+from contextlib import nullcontext
+from datetime import datetime, timedelta
+from flask import Flask, render_template, redirect, url_for, request, jsonify, send_file, abort, Response, stream_with_context, session, g
 from flask_sqlalchemy import SQLAlchemy
+from sqlalchemy import event, text
 from sqlalchemy.orm import DeclarativeBase
 from werkzeug.middleware.proxy_fix import ProxyFix
 
+from logging_config import configure_structured_logging, bind_log_context, reset_log_context
+from http_compression import CompressionMiddleware, BodyDecodingError
+
 class Base(DeclarativeBase):
     pass
 
-db = SQLAlchemy(model_class=Base)
+db = SQLAlchemy(model_class=Base)
+
+configure_structured_logging(logging.DEBUG)
+logger = logging.getLogger(__name__)
+
+app = Flask(__name__)
+app.secret_key = os.environ.get("SESSION_SECRET")
+app.wsgi_app = ProxyFix(app.wsgi_app, x_proto=1, x_host=1)
+# Outermost, so bodies are compressed after every other layer is done with them (see http_compression)
+app.wsgi_app = CompressionMiddleware(app.wsgi_app)
+
+app.config["SQLALCHEMY_DATABASE_URI"] = os.environ.get("DATABASE_URL")
+app.config["SQLALCHEMY_ENGINE_OPTIONS"] = {
+    "pool_recycle": 300,
+    "pool_pre_ping": True,
+}
+
+db.init_app(app)
+
+from gis_export import gis_export_service
+from benton_district_lookup import BentonDistrictLookup
+from narrator_ai_plugin import analyze_gis_export_data, analyze_sync_data, get_ai_health
+from sync_engine import sync_engine
+from sync_control import RUNNING_STATUSES
+from sync_scheduler import sync_scheduler
+from sync_cdc import cdc_listener
+from sync_queue import sync_job_queue
+from load_shedding import load_shedder, OverloadedError
+from tenancy import enter_scope, exit_scope, tenants_for
+from tenant_quotas import tenant_quotas, QuotaExceeded
+from county_overrides import county_overrides, feature_of, FeatureDisabled
+from audit_log import audit_log
+from sync_pairs import sync_pair_registry
+from sync_throttle import source_throttle
+from sync_odata import ODataService, ODATA_VERSION
+from sync_streams import RecordStreamService, StreamLimitError, NDJSON_CONTENT_TYPE
+from sync_graphql import GraphQLService, GraphQLError
+from sync_ingest import IngestionService
+from sync_import import SpreadsheetImportService, ImportStateError
+from sync_valuation import ValuationComparisonService
+from sync_districts import DistrictAssignmentService
+from sync_permits import PermitWorklistService
+from sync_anomalies import AnomalyService
+from run_summaries import RunSummaryService
+from sync_exemption_audit import ExemptionAuditService
+from security_config import API_KEY_CONFIG, get_service_for_api_key
+from api_keys import (ApiKeyService, ApiKeyError, HEADER_NAME as API_KEY_HEADER, KEY_PREFIX as API_KEY_PREFIX,
+                      DEFAULT_ROTATION_GRACE_HOURS)
+from sync_open_data import OpenDataPublisher, OpenDataError
+from event_bus import event_bus, EventBusError
+from gis_tiles import TileServer
+from sync_grpc import GrpcGateway
+from webhooks import WebhookService
+from job_batches import JobBatchService
+from pagination import paginate_args, sort_key, page_size
+from history_query import search, JOB_TEXT_FIELDS, AUDIT_TEXT_FIELDS
+from access_control import (AccessControl, AccessDenied, ACCESS_ROLES, UNSCOPED_READ_ENDPOINTS, route_action,
+                            resources_of, ALL)
+from redaction import redaction_policies
+from metrics import (metrics_registry, CONTENT_TYPE as METRICS_CONTENT_TYPE, TOKEN as METRICS_TOKEN, HTTP_REQUESTS,
+                     HTTP_REQUEST_DURATION, DB_POOL_CONNECTIONS, DB_POOL_SIZE, ERRORS)
+from network_policy import network_policies, client_address, NetworkPolicyDenied
+from openapi_spec import build_spec
+from api_versions import (request_version, finish_response, register_versions, describe_versions,
+                          UnsupportedVersionError)
+from sync_progress import JobProgressService, ProgressStreamLimitError, EVENT_STREAM_CONTENT_TYPE
+from system_events import SystemEventService, SystemEventLimitError, ConnectorHealthMonitor
+from tracing import tracer, TRACE_ID_HEADER
+from health_checks import HealthChecks
+from alerting import AlertService
+from job_retention import JobRetention
+from sync_freshness import FreshnessMonitor
+from config_reload import config_reloader
+from staging_migrations import startup_check as check_staging_migrations
+from runtime_debug import (runtime_stats, thread_dump, format_thread_dump, cpu_profile, format_folded, heap_profiler,
+                           ProfileInProgressError, DEFAULT_SAMPLE_INTERVAL_MS, DEFAULT_TOP, DEFAULT_HEAP_FRAMES)
+
+try:
+    from exemption_seer_ai import analyze_exemption_data, get_exemption_seer_health
+    EXEMPTION_SEER_AVAILABLE = True
+except ImportError:
+    EXEMPTION_SEER_AVAILABLE = False
+
+try:
+    from rbac_manager import rbac_manager, require_role
+    RBAC_AVAILABLE = True
+except ImportError:
+    RBAC_AVAILABLE = False
+
+os.makedirs("exports", exist_ok=True)
+district_lookup = BentonDistrictLookup()
+odata_service = ODataService(sync_pair_registry)
+record_stream_service = RecordStreamService(sync_pair_registry)
+graphql_service = GraphQLService(sync_pair_registry)
+ingestion_service = IngestionService(sync_engine, sync_pair_registry)
+spreadsheet_import_service = SpreadsheetImportService(sync_engine, sync_pair_registry)
+valuation_comparison_service = ValuationComparisonService(sync_pair_registry)
+district_assignment_service = DistrictAssignmentService(sync_pair_registry)
+permit_worklist_service = PermitWorklistService(sync_pair_registry)
+anomaly_service = AnomalyService(sync_pair_registry)
+exemption_audit_service = ExemptionAuditService(sync_pair_registry)
+run_summary_service = RunSummaryService(sync_engine, gis_export_service)
+api_key_service = ApiKeyService()
+access_control = AccessControl(sync_pair_registry)
+open_data_publisher = OpenDataPublisher(sync_pair_registry)
+tile_server = TileServer(gis_export_service.config_dir, sync_pair_registry)
+job_progress_service = JobProgressService(sync_engine, event_bus)
+system_event_service = SystemEventService(event_bus)
+connector_health_monitor = ConnectorHealthMonitor(sync_pair_registry, event_bus)
+health_checks = HealthChecks(sync_engine.store, sync_pair_registry, event_bus, gis_export_service.storage_path)
+webhook_service = WebhookService(sync_engine)
+alert_service = AlertService(sync_engine, config_dir=gis_export_service.config_dir)
+job_retention = JobRetention(sync_engine, gis_export_service, gis_export_service.config_dir)
+freshness_monitor = FreshnessMonitor(sync_engine)
+job_batch_service = JobBatchService(gis_export_service, sync_engine, sync_job_queue)
+grpc_gateway = GrpcGateway(sync_engine, sync_pair_registry, gis_export_service, record_stream_service, sync_job_queue)
+
+# Background services this process started, stopped in reverse order by the service host (see service_host)
+background_services = []
+
+
+def _start_background_service(service) -> None:
+    service.start()
+    background_services.append(service)
+
+
+# Bring the staging store's schema up to date before jobs write to it (STAGING_MIGRATIONS=check or off to opt out)
+check_staging_migrations()
+
+# Run queued sync jobs on worker threads in this process; enable it on exactly one instance
+if os.environ.get("SYNC_QUEUE_ENABLED", "false").lower() == "true":
+    _start_background_service(sync_job_queue)
+
+# Run the sync scheduler in this process; enable it on exactly one instance
+if os.environ.get("SYNC_SCHEDULER_ENABLED", "false").lower() == "true":
+    _start_background_service(sync_scheduler)
+
+# Run the CDC change listener in this process; enable it on exactly one instance
+if os.environ.get("SYNC_CDC_ENABLED", "false").lower() == "true":
+    _start_background_service(cdc_listener)
+
+# Publish scheduled open data datasets from this process; enable it on exactly one instance
+if os.environ.get("OPEN_DATA_PUBLISHING_ENABLED", "false").lower() == "true":
+    _start_background_service(open_data_publisher)
+
+# Send webhook deliveries from this process; enable it on exactly one instance
+if os.environ.get("WEBHOOKS_ENABLED", "false").lower() == "true":
+    _start_background_service(webhook_service)
+
+# Check sync pair connectors and announce health changes from this process; enable it on exactly one instance
+if os.environ.get("CONNECTOR_HEALTH_MONITOR_ENABLED", "false").lower() == "true":
+    _start_background_service(connector_health_monitor)
+
+# Evaluate alert rules and send their notifications from this process; enable it on exactly one instance
+if os.environ.get("ALERTING_ENABLED", "false").lower() == "true":
+    _start_background_service(alert_service)
+
+# Check data freshness objectives and record their breaches from this process; enable it on exactly one instance
+if os.environ.get("FRESHNESS_MONITOR_ENABLED", "false").lower() == "true":
+    _start_background_service(freshness_monitor)
+
+# Archive and delete job history past its retention from this process; enable it on exactly one instance
+if os.environ.get("JOB_RETENTION_ENABLED", "false").lower() == "true":
+    _start_background_service(job_retention)
+
+# Serve the gRPC API (sync_grpc) next to these endpoints, on GRPC_PORT
+if os.environ.get("GRPC_ENABLED", "false").lower() == "true":
+    _start_background_service(grpc_gateway)
+
+# Apply configuration changes deferred by a reload (see config_reload) once their sync pairs' jobs finish
+_start_background_service(config_reloader)
+
+# Share this process's metrics with the other workers through METRICS_MULTIPROCESS_DIR (see metrics)
+metrics_registry.start()
+
+@metrics_registry.collector
+def _collect_gateway_pool():
+    # The SQLAlchemy pool of this gateway process
+    if not app.config.get("SQLALCHEMY_DATABASE_URI"):
+        return
+    with app.app_context():
+        pool = db.engine.pool
+    if hasattr(pool, "checkedout"):
+        DB_POOL_CONNECTIONS.set(pool.checkedout(), pool="gateway", state="in_use")
+        DB_POOL_CONNECTIONS.set(pool.checkedin(), pool="gateway", state="idle")
+        DB_POOL_SIZE.set(pool.size() + max(getattr(pool, "_max_overflow", 0), 0), pool="gateway")
+
+def _comment_gateway_sql(conn, cursor, statement, parameters, context, executemany):
+    # The gateway's own queries carry the request's traceparent too (see tracing)
+    return tracer.comment_sql(statement), parameters
+
+if app.config.get("SQLALCHEMY_DATABASE_URI"):
+    @health_checks.check("database")
+    def _check_gateway_database():
+        # Job history, audit events and dashboards are read from here
+        with app.app_context():
+            db.session.execute(text("SELECT 1"))
+        return {"status": "healthy", "dialect": db.engine.dialect.name}
+
+if app.config.get("SQLALCHEMY_DATABASE_URI") and tracer.enabled:
+    with app.app_context():
+        event.listen(db.engine, "before_cursor_execute", _comment_gateway_sql, retval=True)
+
+with app.app_context():
+    try:
+        import models
+        db.create_all()
+    except ImportError:
+        pass
+
+def _paged(page, body):
+    # The next page's cursor also goes in X-Next-Cursor and Link, for v1 list endpoints whose body is a bare array
+    return jsonify(body), 200, page.headers(request.base_url, request.args)
+
+@app.before_request
+def start_request_timer():
+    g.request_started = time.monotonic()
+
+# Header carrying a request's ID; a caller's own ID is kept when it is a plain token
+REQUEST_ID_HEADER = "X-Request-Id"
+_REQUEST_ID = re.compile(r"^[A-Za-z0-9._:-]{1,128}$")
+
+@app.before_request
+def bind_request_log_context():
+    # Structured logging (logging_config): the request's ID on every line logged while handling it
+    g.log_context = None
+    if request.path.startswith(('/api/', '/odata/')):
+        request_id = request.headers.get(REQUEST_ID_HEADER, '')
+        g.request_id = request_id if _REQUEST_ID.match(request_id) else uuid.uuid4().hex
+        g.log_context = bind_log_context(request_id=g.request_id, method=request.method, path=request.path)
+
+@app.before_request
+def start_request_span():
+    # Distributed tracing (tracing): a server span per request, continuing the caller's traceparent
+    g.request_span = None
+    if request.path.startswith(('/api/', '/odata/')):
+        route = request.url_rule.rule if request.url_rule else request.path
+        g.request_span = tracer.start_request(f"{request.method} {route}", request.headers,
+                                              {"http.method": request.method, "http.route": route,
+                                               "http.target": request.path})
+
+@app.before_request
+def check_network_policy():
+    # Network policies (network_policy): address allowlists and write hours, checked before any authentication
+    if not request.path.startswith(('/api/', '/odata/', '/debug/')):
+        return None
+    address = client_address(request.remote_addr, request.headers.get('X-Forwarded-For'))
+    api_key = request.headers.get(API_KEY_HEADER, '')
+    try:
+        key_allow = api_key_service.allowed_ips(api_key) if api_key.startswith(API_KEY_PREFIX + '_') else None
+        network_policies.check(address, request.method, _resource_counties(_request_resources()), key_allow)
+    except NetworkPolicyDenied as e:
+        # Scanners hit these all day; not worth more than a debug line
+        logger.debug(f"Refused {request.method} {request.path} from {address}: {e}")
+        return jsonify({"error": str(e)}), e.status
+    except ValueError as e:
+        logger.error(f"Refusing {request.path}: {e}")
+        return jsonify({"error": f"Network policy settings are invalid: {e}"}), 500
+
+@app.before_request
+def check_api_version():
+    try:
+        request_version(request.path, request.headers)
+    except UnsupportedVersionError as e:
+        return jsonify({"error": str(e), "versions": describe_versions()["versions"]}), 400
+
+@app.before_request
+def authenticate_api_key():
+    # Scoped keys (tfk_...) are checked here; other keys are left to the services in API_KEY_CONFIG
+    g.api_key = None
+    api_key = request.headers.get(API_KEY_HEADER, '')
+    if not request.path.startswith('/api/') or not api_key.startswith(API_KEY_PREFIX + '_'):
+        return None
+    try:
+        g.api_key = api_key_service.authenticate(api_key, request.method, request.path, request.remote_addr)
+    except ApiKeyError as e:
+        return jsonify({"error": str(e)}), e.status, e.headers
+
+# Endpoints whose job_id is an export job's; the others' are sync jobs'
+_EXPORT_JOB_ENDPOINTS = {"get_export_job", "get_export_job_summary", "cancel_export_job", "deliver_export_job",
+                         "download_export"}
+
+def _webhook_of_delivery(delivery_id):
+    return webhook_service.get(webhook_service.get_delivery(delivery_id)["webhook_id"])
+
+# Loaders of the records path parameters name, for their county and sync pair
+_RESOURCE_LOADERS = {
+    "snapshot_id": lambda value: sync_engine.snapshots.get(value),
+    "dead_letter_id": lambda value: sync_engine.dead_letters.get(value),
+    "conflict_id": lambda value: sync_engine.conflicts.get(value),
+    "issue_id": lambda value: sync_engine.topology_issues.get(value),
+    "schedule_id": lambda value: sync_scheduler.get_schedule(value),
+    "batch_id": lambda value: job_batch_service.get(value),
+    "webhook_id": lambda value: webhook_service.get(value),
+    "alert_id": lambda value: alert_service.get(value),
+    "delivery_id": _webhook_of_delivery,
+    "binding_id": lambda value: access_control.get(value),
+    "import_id": lambda value: spreadsheet_import_service.get(value),
+    "key_id": lambda value: api_key_service.get(value),
+}
+
+def _request_resources():
+    """The (county_id, sync_pair_id) of everything a request names, for authorize_request."""
+    resources = []
+    view_args = request.view_args or {}
+    if view_args.get('county_id') or view_args.get('sync_pair_id'):
+        resources.append((view_args.get('county_id'), view_args.get('sync_pair_id')))
+    for name, value in view_args.items():
+        loader = _RESOURCE_LOADERS.get(name)
+        if name == 'job_id':
+            loader = gis_export_service.get_job_status if request.endpoint in _EXPORT_JOB_ENDPOINTS \
+                else sync_engine.get_job_status
+        if loader is None:
+            continue
+        try:
+            resources.extend(resources_of(loader(value)))
+        except (KeyError, FileNotFoundError, ValueError):
+            # Missing records are the handler's 404; writes to them need access in every county
+            pass
+    resources.extend(resources_of(request.args.to_dict()))
+    if request.method not in ('GET', 'HEAD'):
+        resources.extend(resources_of(request.get_json(silent=True)))
+    return resources
+
+def _resource_counties(resources):
+    """The counties of (county_id, sync_pair_id) resources; a configured sync pair's own when one is named."""
+    counties = []
+    for resource_county, sync_pair_id in resources:
+        if sync_pair_id:
+            try:
+                resource_county = sync_pair_registry.get(sync_pair_id).county_id
+            except KeyError:
+                pass
+        counties.append(resource_county)
+    return counties
+
+@app.before_request
+def authorize_request():
+    # County access (access_control): who the caller is, and whether their bindings allow the request
+    g.user = None
+    g.principal = None
+    if not request.path.startswith(('/api/', '/odata/')):
+        return None
+    if g.api_key is not None:
+        g.principal = access_control.principal_for_key(g.api_key)
+    else:
+        g.user = _request_user()
+        if g.user is not None:
+            g.principal = access_control.principal_for_user(g.user)
+    try:
+        action = route_action(request.endpoint, request.method)
+        g.resources = _request_resources() if action else []
+        counties = dict.fromkeys(c for c in _resource_counties(g.resources) if c)
+        bind_log_context(user=g.principal.name if g.principal else None, county_id=",".join(counties) or None)
+        access_control.authorize(g.principal, action, g.resources,
+                                 narrowed=request.endpoint not in UNSCOPED_READ_ENDPOINTS)
+    except AccessDenied as e:
+        return jsonify({"error": str(e)}), e.status
+    if g.principal is not None and not counties:
+        # A request naming no county reaches every county the caller is bound to, so each one's allowlist applies
+        bound = [binding["county_id"] for binding in g.principal.bindings]
+        address = client_address(request.remote_addr, request.headers.get('X-Forwarded-For'))
+        try:
+            network_policies.check_reach(address, network_policies.counties() if ALL in bound else bound)
+        except NetworkPolicyDenied as e:
+            logger.debug(f"Refused {request.method} {request.path} from {address}: {e}")
+            return jsonify({"error": str(e)}), e.status
+        except ValueError as e:
+            logger.error(f"Refusing {request.path}: {e}")
+            return jsonify({"error": f"Network policy settings are invalid: {e}"}), 500
+    # Tenancy (tenancy): the rest of the request sees only the caller's counties in the state store and exports
+    g.tenant_scope = enter_scope(tenants_for(g.principal))
+    try:
+        tenant_quotas.check_request(counties)
+    except QuotaExceeded as e:
+        return jsonify({"error": str(e)}), 429, {"Retry-After": str(e.retry_after)}
+    except ValueError as e:
+        logger.error(f"Refusing {request.path}: {e}")
+        return jsonify({"error": f"Tenant quota settings are invalid: {e}"}), 500
+
+@app.before_request
+def check_county_features():
+    # Feature flags (county_overrides): a module a county has turned off answers 403 for that county
+    feature = feature_of(request.endpoint)
+    if feature is None:
+        return None
+    try:
+        county_overrides.check(feature, _resource_counties(g.get('resources') or []))
+    except FeatureDisabled as e:
+        return jsonify({"error": str(e), "feature": e.feature, "county_id": e.county_id}), 403
+    except ValueError as e:
+        logger.error(f"Refusing {request.path}: {e}")
+        return jsonify({"error": f"County configuration is invalid: {e}"}), 500
+
+@app.teardown_request
+def end_tenant_scope(error=None):
+    token = g.pop('tenant_scope', None)
+    if token is not None:
+        exit_scope(token)
+
+# Serve the /debug/ endpoints (runtime_debug); they show stacks and heap contents, so admins only
+DEBUG_ENDPOINTS_ENABLED = os.environ.get("DEBUG_ENDPOINTS_ENABLED", "false").lower() == "true"
+
+@app.before_request
+def authorize_debug_request():
+    # Unlike the API, never open to anonymous callers, whatever ACCESS_CONTROL_REQUIRE_AUTH says
+    if not request.path.startswith('/debug/'):
+        return None
+    if not DEBUG_ENDPOINTS_ENABLED:
+        return jsonify({"error": "Not found"}), 404
+    user = _request_user()
+    if user is None:
+        return jsonify({"error": "Authentication required"}), 401
+    principal = access_control.principal_for_user(user)
+    if not principal.can("manage"):
+        return jsonify({"error": f"{principal.name} may not use the debug endpoints"}), 403
+    audit_log.record(f"debug.{request.endpoint}", principal.name, "runtime", str(os.getpid()),
+                     {"path": request.path, "args": request.args.to_dict(), "method": request.method})
+
+def _visible(items):
+    """The items of a listing the caller's county access covers."""
+    return access_control.visible(g.get('principal'), items)
+
+def _redactor(county_id=None):
+    """The caller's redaction (see redaction) in a county, or in the counties the request names."""
+    if county_id:
+        return redaction_policies.for_principal(g.get('principal'), [county_id])
+    return redaction_policies.for_principal(g.get('principal'), _resource_counties(g.get('resources') or []))
+
+@app.after_request
+def name_request_trace(response):
+    # Registered before record_request_metrics, so it runs after every other hook
+    if g.get('request_span') is not None:
+        g.request_status = response.status_code
+        trace_id = tracer.trace_id()
+        if trace_id:
+            response.headers[TRACE_ID_HEADER] = trace_id
+    return response
+
+@app.teardown_request
+def end_request_span(error=None):
+    tracer.finish_request(g.pop('request_span', None), g.get('request_status'), error)
+
+@app.after_request
+def apply_request_id(response):
+    if g.get('request_id'):
+        response.headers[REQUEST_ID_HEADER] = g.request_id
+    return response
+
+@app.teardown_request
+def unbind_request_log_context(error=None):
+    token = g.pop('log_context', None)
+    if token is not None:
+        reset_log_context(token)
+
+@app.after_request
+def record_request_metrics(response):
+    # Registered early so it runs after the other hooks settled the status
+    if request.path.startswith(('/api/', '/odata/')):
+        endpoint = request.endpoint or "unmatched"
+        HTTP_REQUESTS.inc(method=request.method, endpoint=endpoint, status=response.status_code)
+        HTTP_REQUEST_DURATION.observe(time.monotonic() - g.get('request_started', time.monotonic()),
+                                      method=request.method, endpoint=endpoint)
+        if response.status_code >= 500:
+            ERRORS.inc(component="http", type=str(response.status_code))
+    return response
+
+@app.after_request
+def apply_api_key_limits(response):
+    key = getattr(g, 'api_key', None)
+    if key is not None:
+        response.headers["X-RateLimit-Limit"] = str(key["rate_limit_per_minute"])
+        response.headers["X-RateLimit-Remaining"] = str(key["rate_limit_remaining"])
+    return response
+
+@app.after_request
+def apply_redaction(response):
+    # Field redaction (redaction): JSON bodies lose the fields the caller's policy redacts
+    if not request.path.startswith(('/api/', '/odata/')) or not 200 <= response.status_code < 300 \
+            or not response.is_json or response.direct_passthrough:
+        return response
+    try:
+        redactor = _redactor()
+    except ValueError as e:
+        logger.error(f"Withholding response of {request.path}: {e}")
+        response = jsonify({"error": f"Redaction settings are invalid: {e}"})
+        response.status_code = 500
+        return response
+    if redactor.active:
+        response.set_data(json.dumps(redactor.body(response.get_json())))
+    return response
+
+@app.after_request
+def apply_api_version(response):
+    # Handlers answer in the latest version; older versions get their shapes back here
+    try:
+        version = request_version(request.path, request.headers)
+    except UnsupportedVersionError:
+        return response
+    return finish_response(version, request.endpoint, request.path, response)
+
+@app.route('/')
+def index():
+    return redirect(url_for('dashboard'))
+
+@app.route('/dashboard')
+def dashboard():
+    return render_template('dashboard.html')
+
+@app.route('/gis/dashboard')
+def gis_dashboard():
+    recent_jobs = gis_export_service.list_jobs(limit=10)
+    return render_template('dashboard.html', gis_exports=recent_jobs)
+
+@app.route('/district-lookup')
+def district_lookup_dashboard():
+    return render_template('district_lookup_dashboard.html')
+
+@app.route('/ai-analysis')
+def ai_analysis_dashboard():
+    return render_template('ai_analysis_dashboard.html')
+
+@app.route('/metrics')
+def prometheus_metrics():
+    # Prometheus scrapes (see metrics); with METRICS_TOKEN set they must send it as a bearer token
+    if METRICS_TOKEN and not hmac.compare_digest(request.headers.get('Authorization', ''), f"Bearer {METRICS_TOKEN}"):
+        return Response("Unauthorized\n", status=401, mimetype="text/plain")
+    return Response(metrics_registry.render(), content_type=METRICS_CONTENT_TYPE)
+
+@app.route('/health')
+def health_check():
+    # Liveness: the process serves requests; /health/ready checks its dependencies
+    return {"status": "healthy", "service": "TerraFusion Platform", "version": "2.0.0"}
+
+@app.route('/health/ready')
+def readiness_check():
+    # Load balancers route to instances answering 200; a degraded instance still serves what it can
+    try:
+        report = health_checks.report()
+        return jsonify(report), 503 if report["status"] == "unavailable" else 200
+    except Exception as e:
+        logger.error(f"Error checking readiness: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/debug/runtime', methods=['GET'])
+def debug_runtime():
+    try:
+        return jsonify(runtime_stats(int(request.args.get('objects', 0))))
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+
+@app.route('/debug/threads', methods=['GET'])
+def debug_threads():
+    threads = thread_dump()
+    if request.args.get('format') == 'text':
+        return Response(format_thread_dump(threads), mimetype="text/plain")
+    return jsonify({"threads": threads, "count": len(threads)})
+
+@app.route('/debug/profile', methods=['GET'])
+def debug_cpu_profile():
+    try:
+        profile = cpu_profile(float(request.args.get('seconds', 10)),
+                              float(request.args.get('interval_ms', DEFAULT_SAMPLE_INTERVAL_MS)),
+                              int(request.args.get('top', DEFAULT_TOP)))
+        if request.args.get('format') == 'folded':
+            return Response(format_folded(profile), mimetype="text/plain")
+        return jsonify(profile)
+    except ProfileInProgressError as e:
+        return jsonify({"error": str(e)}), 409
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+
+@app.route('/debug/heap', methods=['GET'])
+def debug_heap():
+    try:
+        return jsonify(heap_profiler.snapshot(request.args.get('group_by', 'lineno'),
+                                              int(request.args.get('top', DEFAULT_TOP))))
+    except ValueError as e:
+        return jsonify({"error": str(e), **heap_profiler.status()}), 400
+
+@app.route('/debug/heap', methods=['POST'])
+def debug_heap_tracing():
+    try:
+        data = request.get_json(silent=True) or {}
+        if 'tracing' not in data:
+            return jsonify({"error": "Missing required field: tracing"}), 400
+        if not data['tracing']:
+            return jsonify(heap_profiler.stop())
+        return jsonify(heap_profiler.start(int(data.get('frames', DEFAULT_HEAP_FRAMES))))
+    except (TypeError, ValueError) as e:
+        return jsonify({"error": str(e)}), 400
+
+@app.route('/api/versions', methods=['GET'])
+def list_api_versions():
+    return jsonify(describe_versions())
+
+@app.route('/api/v1/openapi.json', methods=['GET'])
+def get_openapi_spec():
+    try:
+        # Generated from the routes themselves; see openapi_spec.py for the checked-in copy and the Go client
+        version = request_version(request.path, request.headers)
+        return jsonify(build_spec(app, version=version, server_url=request.host_url.rstrip('/')))
+    except Exception as e:
+        logger.error(f"Error generating OpenAPI spec: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/gis-export/jobs', methods=['GET'])
+def list_export_jobs():
+    county_id = request.args.get('county_id')
+    status = request.args.get('status')
+    username = request.args.get('username')
+    
+    try:
+        jobs = gis_export_service.list_jobs(
+            county_id=county_id, 
+            status=status, 
+            username=username, 
+            limit=None
+        )
+        jobs = search(_visible(jobs), request.args.get('q'), JOB_TEXT_FIELDS)
+        page = paginate_args(jobs, sort_key("created_at", "job_id"), "gis_export_jobs", request.args)
+        return _paged(page, {"jobs": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing GIS export jobs: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/gis-export/jobs', methods=['POST'])
+def create_export_job():
+    try:
+        data = request.json
+        
+        required_fields = ['county_id', 'username', 'export_format', 'area_of_interest', 'layers']
+        if data is not None:
+            for field in required_fields:
+                if field not in data:
+                    return jsonify({"error": f"Missing required field: {field}"}), 400
+        else:
+            return jsonify({"error": "Missing request body"}), 400
+        
+        # The slot is taken first, so a refused export leaves no job behind
+        with load_shedder.slot("export", data.get('priority', 'normal')):
+            job = gis_export_service.create_export_job(
+                county_id=data['county_id'],
+                username=data['username'],
+                export_format=data['export_format'],
+                area_of_interest=data['area_of_interest'],
+                layers=data['layers'],
+                parameters=data.get('parameters'),
+                redaction=_redactor(data['county_id']).names
+            )
+
+            processed_job = gis_export_service.process_job(job['job_id'])
+        return jsonify(processed_job), 201
+    except OverloadedError as e:
+        return jsonify({"error": str(e)}), 429, {"Retry-After": str(e.retry_after)}
+    except ValueError as e:
+        logger.error(f"Validation error creating GIS export job: {str(e)}")
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error creating GIS export job: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/gis-export/jobs/<job_id>', methods=['GET'])
+def get_export_job(job_id):
+    try:
+        job = gis_export_service.get_job_status(job_id)
+        return jsonify(job)
+    except FileNotFoundError:
+        return jsonify({"error": f"Export job {job_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting GIS export job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/gis-export/jobs/<job_id>/summary', methods=['GET'])
+def get_export_job_summary(job_id):
+    try:
+        refresh = request.args.get('refresh', 'false').lower() == 'true'
+        return jsonify(run_summary_service.summarize("export", job_id, refresh))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error summarizing GIS export job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/gis-export/jobs/<job_id>/cancel', methods=['POST'])
+def cancel_export_job(job_id):
+    try:
+        job = gis_export_service.cancel_job(job_id)
+        return jsonify(job)
+    except FileNotFoundError:
+        return jsonify({"error": f"Export job {job_id} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error cancelling GIS export job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/gis-export/jobs/<job_id>/deliver', methods=['POST'])
+def deliver_export_job(job_id):
+    try:
+        data = request.get_json(silent=True) or {}
+        job = gis_export_service.deliver_job(job_id, data.get('deliveries'))
+        return jsonify(job)
+    except FileNotFoundError as e:
+        return jsonify({"error": str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error delivering GIS export job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/gis-export/download/<job_id>', methods=['GET'])
+def download_export(job_id):
+    try:
+        download = gis_export_service.open_download(job_id)
+        
+        if "url" in download:
+            return redirect(download["url"])
+        if "stream" in download:
+            return Response(
+                stream_with_context(download["stream"]),
+                mimetype=download["content_type"] or "application/octet-stream",
+                headers={"Content-Disposition": f'attachment; filename="{download["filename"]}"'}
+            )
+        # send_file answers Range requests, which FlatGeobuf clients use to read only the features in view
+        return send_file(download["path"], mimetype=download["content_type"], as_attachment=True,
+                         download_name=download["filename"])
+    except FileNotFoundError as e:
+        return jsonify({"error": str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error downloading GIS export for job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/reports/parcels/<county_id>/<parcel_id>', methods=['GET'])
+def get_parcel_report(county_id, parcel_id):
+    try:
+        pdf = gis_export_service.parcel_report(county_id, parcel_id, _redactor(county_id))
+        disposition = "attachment" if request.args.get('download', 'false').lower() == 'true' else "inline"
+        return Response(pdf, mimetype="application/pdf",
+                        headers={"Content-Disposition": f'{disposition}; filename="parcel_{parcel_id}.pdf"'})
+    except FileNotFoundError as e:
+        return jsonify({"error": str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error rendering parcel report {county_id}/{parcel_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs', methods=['GET'])
+def list_sync_pairs():
+    county_id = request.args.get('county_id')
+    try:
+        pairs = _visible([pair.to_dict() for pair in sync_pair_registry.list(county_id=county_id)])
+        return jsonify({"sync_pairs": pairs, "count": len(pairs)})
+    except Exception as e:
+        logger.error(f"Error listing sync pairs: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/watermarks', methods=['GET'])
+def get_sync_watermarks(sync_pair_id):
+    try:
+        sync_pair_registry.get(sync_pair_id)
+        return jsonify({
+            "sync_pair_id": sync_pair_id,
+            "watermarks": sync_engine.watermarks.list(sync_pair_id)
+        })
+    except KeyError:
+        return jsonify({"error": f"Sync pair {sync_pair_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting watermarks for {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/watermarks', methods=['DELETE'])
+def reset_sync_watermarks(sync_pair_id):
+    try:
+        sync_pair_registry.get(sync_pair_id)
+        table = request.args.get('table')
+        sync_engine.watermarks.reset(sync_pair_id, table)
+        return jsonify({
+            "sync_pair_id": sync_pair_id,
+            "reset": table or "all",
+            "message": "Watermarks cleared; the next incremental sync will re-read in full."
+        })
+    except KeyError:
+        return jsonify({"error": f"Sync pair {sync_pair_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error resetting watermarks for {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/throttle', methods=['GET'])
+def get_sync_throttle(sync_pair_id):
+    try:
+        pair = sync_pair_registry.get(sync_pair_id)
+        throttle = source_throttle(pair.source.get("throttle"), pair.sync_pair_id)
+        return jsonify({
+            "sync_pair_id": sync_pair_id,
+            "throttle": throttle.status() if throttle else None
+        })
+    except KeyError:
+        return jsonify({"error": f"Sync pair {sync_pair_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting throttle for {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/lineage', methods=['GET'])
+def get_sync_lineage(sync_pair_id):
+    try:
+        table_name = request.args.get('table')
+        if not table_name:
+            return jsonify({"error": "table parameter is required"}), 400
+        job_id = request.args.get('job_id')
+        limit = int(request.args.get('limit', 100))
+        # Remaining parameters are key columns, e.g. ?table=dbo.property&prop_id=12345
+        key = {name: value for name, value in request.args.items() if name not in ('table', 'job_id', 'limit')}
+
+        return jsonify(sync_engine.record_lineage(sync_pair_id, table_name, key or None, job_id, limit))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error getting lineage for {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/freshness', methods=['GET'])
+def get_sync_freshness(sync_pair_id):
+    try:
+        return jsonify(sync_engine.source_freshness(sync_pair_id))
+    except KeyError:
+        return jsonify({"error": f"Sync pair {sync_pair_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting source freshness for {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/schema', methods=['GET'])
+def get_sync_source_schema(sync_pair_id):
+    try:
+        return jsonify(sync_engine.describe_source(sync_pair_id, request.args.get('table')))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error describing source tables for {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/roll-years', methods=['GET'])
+def list_roll_years(sync_pair_id):
+    try:
+        return jsonify(sync_engine.roll_years.describe(sync_pair_registry.get(sync_pair_id)))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error listing roll years of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/roll-years/rollover', methods=['POST'])
+def roll_over_sync_pair(sync_pair_id):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        if 'username' not in data:
+            return jsonify({"error": "Missing required field: username"}), 400
+
+        return jsonify(sync_engine.roll_over(sync_pair_id, data['username'], data.get('to_year'), data.get('reason')))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error rolling over {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/valuation-runs', methods=['GET'])
+def list_valuation_runs(sync_pair_id):
+    try:
+        runs = valuation_comparison_service.list_runs(sync_pair_id)
+        page = paginate_args(runs, sort_key("run_at", "run_id"), "valuation_runs", request.args)
+        return _paged(page, {"runs": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing valuation model runs of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/valuation-runs/<run_id>', methods=['GET'])
+def get_valuation_run(sync_pair_id, run_id):
+    try:
+        return jsonify(valuation_comparison_service.get_run(sync_pair_id, run_id))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error getting valuation model run {run_id} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/valuation-runs/<run_id>/comparison', methods=['GET'])
+def compare_valuation_run(sync_pair_id, run_id):
+    try:
+        run, page = valuation_comparison_service.compare(
+            sync_pair_id, run_id, request.args.get('flag') or None,
+            page_size(request.args.get('limit', 100)), request.args.get('cursor') or None,
+        )
+        return _paged(page, dict(run, parcels=page.items, count=len(page.items), next_cursor=page.next_cursor))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error comparing valuation model run {run_id} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/district-assignments/runs', methods=['GET'])
+def list_district_assignment_runs(sync_pair_id):
+    try:
+        runs = district_assignment_service.list_runs(sync_pair_id)
+        page = paginate_args(runs, sort_key("started_at", "run_id"), "district_assignment_runs", request.args)
+        return _paged(page, {"runs": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing district assignment runs of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/district-assignments/runs/<run_id>/changes', methods=['GET'])
+def list_district_assignment_changes(sync_pair_id, run_id):
+    try:
+        run, changes = district_assignment_service.get_changes(sync_pair_id, run_id,
+                                                               request.args.get('district_id') or None)
+        page = paginate_args(changes, lambda change: (change["parcel_id"],), "district_assignment_changes",
+                             request.args, descending=False)
+        return _paged(page, dict(run, changes=page.items, count=len(page.items), next_cursor=page.next_cursor))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing district assignment changes of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/district-assignments/runs/<run_id>/changes/export', methods=['GET'])
+def export_district_assignment_changes(sync_pair_id, run_id):
+    try:
+        export_format = request.args.get('format', 'csv')
+        run, changes = district_assignment_service.get_changes(sync_pair_id, run_id,
+                                                               request.args.get('district_id') or None)
+        content = district_assignment_service.export_changes(changes, export_format)
+        filename = f"district_changes_{sync_pair_id}_{run['run_id']}.{export_format}"
+        return Response(
+            content,
+            mimetype="text/csv" if export_format == "csv" else "application/json",
+            headers={"Content-Disposition": f"attachment; filename={filename}"}
+        )
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error exporting district assignment changes of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/district-assignments/reassign', methods=['POST'])
+def reassign_districts(sync_pair_id):
+    try:
+        return jsonify(district_assignment_service.reassign(sync_pair_id))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error reassigning the districts of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/district-assignments/parcels/<parcel_id>', methods=['GET'])
+def get_parcel_districts(sync_pair_id, parcel_id):
+    try:
+        return jsonify(district_assignment_service.parcel_districts(sync_pair_id, parcel_id,
+                                                                    request.args.get('tax_year') or None))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error getting the districts of parcel {parcel_id} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/permit-worklist', methods=['GET'])
+def list_permit_worklist(sync_pair_id):
+    try:
+        items = permit_worklist_service.list_items(sync_pair_id, request.args.get('kind') or None,
+                                                   request.args.get('status') or None,
+                                                   request.args.get('work_class') or None)
+        page = paginate_args(items, sort_key("updated_at", "item_id"), "permit_worklist", request.args)
+        return _paged(page, {"items": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing the permit worklist of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/permit-worklist/<item_id>', methods=['GET'])
+def get_permit_worklist_item(sync_pair_id, item_id):
+    try:
+        return jsonify(permit_worklist_service.get_item(sync_pair_id, item_id))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error getting permit worklist item {item_id} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/permit-worklist/<item_id>/review', methods=['POST'])
+def review_permit_worklist_item(sync_pair_id, item_id):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ['status', 'username']:
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+
+        item = permit_worklist_service.review_item(sync_pair_id, item_id, data['status'], data['username'],
+                                                   data.get('note'))
+        return jsonify(item)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error reviewing permit worklist item {item_id} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/anomalies', methods=['GET'])
+def list_sync_anomalies(sync_pair_id):
+    try:
+        anomalies = anomaly_service.list_anomalies(sync_pair_id, request.args.get('table') or None,
+                                                   request.args.get('kind') or None,
+                                                   request.args.get('status') or None,
+                                                   request.args.get('job_id') or None)
+        page = paginate_args(anomalies, sort_key("found_at", "anomaly_id"), "sync_anomalies", request.args)
+        return _paged(page, {"anomalies": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing the anomalies of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/anomalies/export', methods=['GET'])
+def export_sync_anomalies(sync_pair_id):
+    try:
+        export_format = request.args.get('format', 'csv')
+        anomalies = anomaly_service.list_anomalies(sync_pair_id, request.args.get('table') or None,
+                                                   request.args.get('kind') or None,
+                                                   request.args.get('status') or None,
+                                                   request.args.get('job_id') or None)
+        anomalies.sort(key=lambda anomaly: (anomaly["found_at"], anomaly["anomaly_id"]))
+        content = anomaly_service.export_anomalies(anomalies, export_format)
+        filename = f"anomalies_{sync_pair_id}_{datetime.utcnow().strftime('%Y%m%d%H%M%S')}.{export_format}"
+        return Response(
+            content,
+            mimetype="text/csv" if export_format == "csv" else "application/json",
+            headers={"Content-Disposition": f"attachment; filename={filename}"}
+        )
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error exporting the anomalies of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/anomalies/<anomaly_id>', methods=['GET'])
+def get_sync_anomaly(sync_pair_id, anomaly_id):
+    try:
+        return jsonify(anomaly_service.get_anomaly(sync_pair_id, anomaly_id))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error getting anomaly {anomaly_id} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/anomalies/<anomaly_id>/review', methods=['POST'])
+def review_sync_anomaly(sync_pair_id, anomaly_id):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ['status', 'username']:
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+
+        anomaly = anomaly_service.review_anomaly(sync_pair_id, anomaly_id, data['status'], data['username'],
+                                                 data.get('note'))
+        return jsonify(anomaly)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error reviewing anomaly {anomaly_id} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/exemption-audit', methods=['GET'])
+def list_exemption_audit(sync_pair_id):
+    try:
+        min_score = float(request.args['min_score']) if request.args.get('min_score') else None
+        items = exemption_audit_service.list_items(sync_pair_id, request.args.get('rule') or None,
+                                                   request.args.get('status') or None, min_score)
+        # Ranked: highest score first
+        page = paginate_args(items, lambda item: (f"{item['score']:06.2f}", item["item_id"]), "exemption_audit",
+                             request.args)
+        return _paged(page, {"items": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing the exemption audit worklist of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/exemption-audit/score', methods=['POST'])
+def score_exemption_audit(sync_pair_id):
+    try:
+        return jsonify(exemption_audit_service.score(sync_pair_id))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error scoring the exemptions of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/exemption-audit/<item_id>', methods=['GET'])
+def get_exemption_audit_item(sync_pair_id, item_id):
+    try:
+        return jsonify(exemption_audit_service.get_item(sync_pair_id, item_id))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error getting exemption audit item {item_id} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/exemption-audit/<item_id>/review', methods=['POST'])
+def review_exemption_audit_item(sync_pair_id, item_id):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ['status', 'username']:
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+
+        item = exemption_audit_service.review_item(sync_pair_id, item_id, data['status'], data['username'],
+                                                   data.get('note'))
+        return jsonify(item)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error reviewing exemption audit item {item_id} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/jobs', methods=['GET'])
+def list_sync_jobs():
+    county_id = request.args.get('county_id')
+    sync_pair_id = request.args.get('sync_pair_id')
+    status = request.args.get('status')
+
+    try:
+        jobs = sync_engine.list_jobs(
+            county_id=county_id,
+            sync_pair_id=sync_pair_id,
+            status=status,
+            limit=None
+        )
+        jobs = search(_visible(jobs), request.args.get('q'), JOB_TEXT_FIELDS)
+        page = paginate_args(jobs, sort_key("created_at", "job_id"), "sync_jobs", request.args)
+        return _paged(page, {"jobs": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing sync jobs: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/jobs', methods=['POST'])
+def create_sync_job():
+    try:
+        data = request.json
+
+        required_fields = ['sync_pair_id', 'username']
+        if data is not None:
+            for field in required_fields:
+                if field not in data:
+                    return jsonify({"error": f"Missing required field: {field}"}), 400
+        else:
+            return jsonify({"error": "Missing request body"}), 400
+
+        priority = data.get('priority', 'normal')
+        queued = sync_job_queue.is_running() or sync_job_queue.can_dispatch()
+        if sync_job_queue.is_running():
+            sync_job_queue.check_capacity(priority)
+
+        # A job run here holds a slot while it runs, taken before the job is created
+        with nullcontext() if queued else load_shedder.slot("sync", priority):
+            job = sync_engine.create_sync_job(
+                sync_pair_id=data['sync_pair_id'],
+                username=data['username'],
+                mode=data.get('mode'),
+                tables=data.get('tables'),
+                parameters=data.get('parameters'),
+                dry_run=bool(data.get('dry_run', False)),
+                priority=priority
+            )
+
+            if sync_job_queue.is_running():
+                queued_job = sync_job_queue.submit(job['job_id'], express=bool(data.get('express', False)))
+                return jsonify(queued_job), 202
+            if sync_job_queue.can_dispatch():
+                queued_job = sync_job_queue.dispatch(job['job_id'], express=bool(data.get('express', False)))
+                return jsonify(queued_job), 202
+
+            processed_job = sync_engine.process_job(job['job_id'])
+        return jsonify(processed_job), 201
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except OverloadedError as e:
+        return jsonify({"error": str(e)}), 429, {"Retry-After": str(e.retry_after)}
+    except ValueError as e:
+        logger.error(f"Validation error creating sync job: {str(e)}")
+        return jsonify({"error": str(e)}), 400
+    except EventBusError as e:
+        # The job stays queued in the state store and starts when a queue next recovers it
+        logger.error(f"Error dispatching sync job: {str(e)}")
+        return jsonify({"error": str(e)}), 503
+    except Exception as e:
+        logger.error(f"Error creating sync job: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/queue', methods=['GET'])
+def get_sync_queue():
+    try:
+        return jsonify(sync_job_queue.status())
+    except Exception as e:
+        logger.error(f"Error getting sync job queue: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/load', methods=['GET'])
+def get_load():
+    try:
+        return jsonify(dict(load_shedder.status(), sync_queue=sync_job_queue.depth(),
+                            sync_queue_max_waiting=sync_job_queue.max_waiting))
+    except Exception as e:
+        logger.error(f"Error getting load: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/tenants/<county_id>', methods=['GET'])
+def get_tenant(county_id):
+    try:
+        jobs = sync_engine.list_jobs(county_id=county_id, limit=1_000_000)
+        usage = dict(gis_export_service.usage(county_id),
+                     max_queued_sync_jobs=sum(1 for job in jobs if job["status"] in ["PENDING"] + RUNNING_STATUSES),
+                     max_running_sync_jobs=sum(1 for job in jobs if job["status"] in RUNNING_STATUSES))
+        return jsonify(tenant_quotas.report(county_id, usage))
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error getting tenant {county_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/counties/<county_id>/features', methods=['GET'])
+def list_county_features(county_id):
+    try:
+        return jsonify({"county_id": county_id, "features": county_overrides.features(county_id)})
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing the features of county {county_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+def _apply_county_overrides(county_id, previous, username):
+    """Reload the configuration with a county's new overrides; put the previous ones back if it is refused."""
+    result = config_reloader.reload(username)
+    if result["status"] != "applied":
+        county_overrides.restore(county_id, previous)
+        config_reloader.reload(username)
+        return jsonify({"error": "The configuration reload refused these overrides", "reload": result}), 422
+    return jsonify(dict(county_overrides.get(county_id), reload=result))
+
+@app.route('/api/v1/admin/counties/<county_id>/overrides', methods=['GET'])
+def get_county_overrides(county_id):
+    try:
+        return jsonify(county_overrides.get(county_id))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error getting the overrides of county {county_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/admin/counties/<county_id>/overrides', methods=['PUT'])
+def update_county_overrides(county_id):
+    try:
+        data = request.get_json(silent=True)
+        if not isinstance(data, dict):
+            return jsonify({"error": "Request body must be a JSON object with overrides and features"}), 400
+        username = g.principal.name if g.get('principal') else "anonymous"
+        previous = county_overrides.save(county_id, data.get("overrides"), data.get("features"), username)
+        return _apply_county_overrides(county_id, previous, username)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error updating the overrides of county {county_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/admin/counties/<county_id>/overrides', methods=['DELETE'])
+def delete_county_overrides(county_id):
+    try:
+        username = g.principal.name if g.get('principal') else "anonymous"
+        previous = county_overrides.delete(county_id, username)
+        return _apply_county_overrides(county_id, previous, username)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error deleting the overrides of county {county_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/admin/counties/<county_id>/features/<feature>', methods=['PUT'])
+def set_county_feature(county_id, feature):
+    try:
+        data = request.get_json(silent=True)
+        if not isinstance(data, dict) or "enabled" not in data:
+            return jsonify({"error": "Request body must be a JSON object with enabled (true, false or null)"}), 400
+        username = g.principal.name if g.get('principal') else "anonymous"
+        county_overrides.set_feature(county_id, feature, data["enabled"], username)
+        return jsonify({"county_id": county_id, "features": county_overrides.features(county_id)})
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error setting feature {feature} of county {county_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/admin/config/reload', methods=['POST'])
+def reload_configuration():
+    try:
+        result = config_reloader.reload(g.principal.name if g.get('principal') else "anonymous")
+        return jsonify(result), 200 if result["status"] == "applied" else 422
+    except Exception as e:
+        logger.error(f"Error reloading the configuration: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/admin/config/reload', methods=['GET'])
+def get_configuration_reload():
+    try:
+        return jsonify(config_reloader.status())
+    except Exception as e:
+        logger.error(f"Error getting the configuration reload status: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/events/bus/health', methods=['GET'])
+def get_event_bus_health():
+    try:
+        status = event_bus.health_check()
+        return jsonify(status), 200 if status["status"] == "healthy" else 503
+    except Exception as e:
+        logger.error(f"Error checking event bus health: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/jobs/<job_id>', methods=['GET'])
+def get_sync_job(job_id):
+    try:
+        job = sync_engine.get_job_status(job_id)
+        return jsonify(job)
+    except FileNotFoundError:
+        return jsonify({"error": f"Sync job {job_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting sync job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/jobs/<job_id>/summary', methods=['GET'])
+def get_sync_job_summary(job_id):
+    try:
+        refresh = request.args.get('refresh', 'false').lower() == 'true'
+        return jsonify(run_summary_service.summarize("sync", job_id, refresh))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error summarizing sync job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+def _job_event_stream(stream):
+    # The stream is the body itself so the server closes it, unsubscribing it, when the client goes away
+    return Response(stream, mimetype=EVENT_STREAM_CONTENT_TYPE,
+                    headers={"Cache-Control": "no-store", "X-Accel-Buffering": "no"})
+
+@app.route('/api/v1/sync/jobs/events', methods=['GET'])
+def stream_sync_job_events():
+    try:
+        events = [e.strip() for e in request.args.get("events", "").split(",") if e.strip()]
+        return _job_event_stream(job_progress_service.open(county_id=request.args.get("county_id"),
+                                                           sync_pair_id=request.args.get("sync_pair_id"),
+                                                           events=events))
+    except ProgressStreamLimitError as e:
+        return jsonify({"error": str(e)}), 503, {"Retry-After": "30"}
+    except EventBusError as e:
+        return jsonify({"error": str(e)}), 503
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error streaming sync job events: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/jobs/<job_id>/events', methods=['GET'])
+def stream_sync_job_progress(job_id):
+    try:
+        events = [e.strip() for e in request.args.get("events", "").split(",") if e.strip()]
+        return _job_event_stream(job_progress_service.open(job_id=job_id, events=events))
+    except FileNotFoundError:
+        return jsonify({"error": f"Sync job {job_id} not found"}), 404
+    except ProgressStreamLimitError as e:
+        return jsonify({"error": str(e)}), 503, {"Retry-After": "30"}
+    except EventBusError as e:
+        return jsonify({"error": str(e)}), 503
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error streaming events of sync job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/events/system', methods=['GET'])
+def stream_system_events():
+    try:
+        types = [t.strip() for t in request.args.get("types", "").split(",") if t.strip()]
+        # Per-type filters are the type.field parameters (sync_job.status=FAILED)
+        filters = {key: value for key, value in request.args.items() if "." in key}
+        return _job_event_stream(system_event_service.open(types=types, county_id=request.args.get("county_id"),
+                                                           filters=filters))
+    except SystemEventLimitError as e:
+        return jsonify({"error": str(e)}), 503, {"Retry-After": "30"}
+    except EventBusError as e:
+        return jsonify({"error": str(e)}), 503
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error streaming system events: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/jobs/<job_id>/loads', methods=['GET'])
+def get_sync_job_loads(job_id):
+    try:
+        return jsonify(sync_engine.reconcile_loads(job_id))
+    except FileNotFoundError:
+        return jsonify({"error": f"Sync job {job_id} not found"}), 404
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error reconciling loads of sync job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/jobs/<job_id>/pause', methods=['POST'])
+def pause_sync_job(job_id):
+    try:
+        data = request.get_json(silent=True) or {}
+        job = sync_engine.pause_job(job_id, data.get('username'))
+        return jsonify(job), 202 if job['status'] == 'PAUSING' else 200
+    except FileNotFoundError:
+        return jsonify({"error": f"Sync job {job_id} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error pausing sync job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/jobs/<job_id>/cancel', methods=['POST'])
+def cancel_sync_job(job_id):
+    try:
+        data = request.get_json(silent=True) or {}
+        job = sync_engine.cancel_job(job_id, data.get('username'))
+        return jsonify(job), 202 if job['status'] == 'CANCELLING' else 200
+    except FileNotFoundError:
+        return jsonify({"error": f"Sync job {job_id} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error cancelling sync job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/jobs/<job_id>/resume', methods=['POST'])
+def resume_sync_job(job_id):
+    try:
+        job = sync_engine.resume_job(job_id)
+        if sync_job_queue.is_running():
+            return jsonify(sync_job_queue.submit(job_id, express=bool(job.get('express', False)))), 202
+        if sync_job_queue.can_dispatch():
+            return jsonify(sync_job_queue.dispatch(job_id, express=bool(job.get('express', False)))), 202
+        job = sync_engine.process_job(job_id)
+        return jsonify(job)
+    except FileNotFoundError:
+        return jsonify({"error": f"Sync job {job_id} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except EventBusError as e:
+        logger.error(f"Error dispatching sync job {job_id}: {str(e)}")
+        return jsonify({"error": str(e)}), 503
+    except Exception as e:
+        logger.error(f"Error resuming sync job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/jobs/<job_id>/rollback', methods=['POST'])
+def rollback_sync_job(job_id):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        if 'username' not in data:
+            return jsonify({"error": "Missing required field: username"}), 400
+
+        job = sync_engine.rollback_job(job_id, data['username'])
+        return jsonify(job)
+    except FileNotFoundError as e:
+        return jsonify({"error": str(e)}), 404
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error rolling back sync job {job_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/snapshots', methods=['GET'])
+def list_sync_snapshots():
+    try:
+        sync_pair_id = request.args.get('sync_pair_id')
+        status = request.args.get('status')
+        snapshots = _visible(sync_engine.snapshots.list(sync_pair_id, status, None))
+        page = paginate_args(snapshots, sort_key("created_at", "snapshot_id"), "sync_snapshots", request.args)
+        return _paged(page, {"snapshots": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing sync snapshots: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/snapshots/<snapshot_id>', methods=['GET', 'DELETE'])
+def sync_snapshot(snapshot_id):
+    try:
+        if request.method == 'DELETE':
+            return jsonify(sync_engine.snapshots.discard(snapshot_id))
+        return jsonify(sync_engine.snapshots.get(snapshot_id))
+    except FileNotFoundError:
+        return jsonify({"error": f"Snapshot {snapshot_id} not found"}), 404
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error handling sync snapshot {snapshot_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/snapshots/<snapshot_id>/restore', methods=['POST'])
+def restore_sync_snapshot(snapshot_id):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        if 'username' not in data:
+            return jsonify({"error": "Missing required field: username"}), 400
+
+        snapshot = sync_engine.snapshots.restore(snapshot_id, data['username'], data.get('reason'))
+        return jsonify(snapshot)
+    except FileNotFoundError:
+        return jsonify({"error": f"Snapshot {snapshot_id} not found"}), 404
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error restoring sync snapshot {snapshot_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/dead-letters', methods=['GET'])
+def list_dead_letters():
+    try:
+        sync_pair_id = request.args.get('sync_pair_id')
+        table_name = request.args.get('table')
+        status = request.args.get('status', 'PENDING')
+        letters = _visible(sync_engine.dead_letters.list(sync_pair_id, table_name, status or None, None))
+        page = paginate_args(letters, sort_key("last_failed_at", "dead_letter_id"), "dead_letters", request.args)
+        return _paged(page, {"dead_letters": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing dead letters: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/dead-letters/export', methods=['GET'])
+def export_dead_letters():
+    try:
+        export_format = request.args.get('format', 'json')
+        sync_pair_id = request.args.get('sync_pair_id')
+        table_name = request.args.get('table')
+        status = request.args.get('status', 'PENDING')
+
+        letters = sync_engine.dead_letters.list(sync_pair_id, table_name, status or None, limit=1_000_000)
+        content = sync_engine.dead_letters.export(letters, export_format)
+        filename = f"dead_letters_{sync_pair_id or 'all'}_{datetime.utcnow().strftime('%Y%m%d%H%M%S')}.{export_format}"
+        return Response(
+            content,
+            mimetype="text/csv" if export_format == "csv" else "application/json",
+            headers={"Content-Disposition": f"attachment; filename={filename}"}
+        )
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error exporting dead letters: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/dead-letters/reprocess', methods=['POST'])
+def reprocess_dead_letters():
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ['sync_pair_id', 'username']:
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+
+        summary = sync_engine.reprocess_dead_letters(
+            data['sync_pair_id'], data['username'], data.get('table'), data.get('dead_letter_ids')
+        )
+        return jsonify(summary)
+    except FileNotFoundError as e:
+        return jsonify({"error": str(e)}), 404
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error reprocessing dead letters: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/quarantine', methods=['GET'])
+def list_quarantined_records():
+    try:
+        sync_pair_id = request.args.get('sync_pair_id')
+        if not sync_pair_id:
+            return jsonify({"error": "sync_pair_id parameter is required"}), 400
+        table_name = request.args.get('table')
+        limit = int(request.args.get('limit', 100))
+
+        records = sync_engine.list_quarantined(sync_pair_id, table_name, limit)
+        return jsonify({"quarantined": records, "count": len(records)})
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing quarantined records: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/quarantine/revalidate', methods=['POST'])
+def revalidate_quarantined_records():
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ['sync_pair_id', 'username']:
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+
+        summary = sync_engine.revalidate_quarantine(data['sync_pair_id'], data['username'], data.get('table'))
+        return jsonify(summary)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error revalidating quarantined records: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/topology/issues', methods=['GET'])
+def list_topology_issues():
+    try:
+        sync_pair_id = request.args.get('sync_pair_id')
+        table_name = request.args.get('table')
+        kind = request.args.get('kind')
+        status = request.args.get('status', 'OPEN')
+        limit = int(request.args.get('limit', 100))
+        output_format = request.args.get('format', 'json')
+        if output_format not in ('json', 'geojson'):
+            return jsonify({"error": f"Unsupported format: {output_format}. Supported formats: json, geojson"}), 400
+
+        issues = _visible(sync_engine.topology_issues.list(sync_pair_id, table_name, kind, status or None, limit))
+        if output_format == 'geojson':
+            return Response(json.dumps(sync_engine.topology_issues.geojson(issues)), mimetype="application/geo+json")
+        return jsonify({"issues": issues, "count": len(issues)})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing topology issues: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/topology/issues/<issue_id>', methods=['GET'])
+def get_topology_issue(issue_id):
+    try:
+        return jsonify(sync_engine.topology_issues.get(issue_id))
+    except FileNotFoundError:
+        return jsonify({"error": f"Topology issue {issue_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting topology issue {issue_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/topology/issues/<issue_id>/review', methods=['POST'])
+def review_topology_issue(issue_id):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ['status', 'username']:
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+
+        issue = sync_engine.review_topology_issue(issue_id, data['status'], data['username'], data.get('note'))
+        return jsonify(issue)
+    except FileNotFoundError as e:
+        return jsonify({"error": str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error reviewing topology issue {issue_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/topology/check', methods=['POST'])
+def check_topology():
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ['sync_pair_id', 'username']:
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+
+        summary = sync_engine.run_topology_qa(data['sync_pair_id'], data.get('table'), username=data['username'])
+        return jsonify(summary)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error running topology QA: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/addresses/standardize', methods=['POST'])
+def standardize_address():
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ['sync_pair_id', 'table', 'address']:
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+
+        return jsonify(sync_engine.standardize_address(data['sync_pair_id'], data['table'], data['address']))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error standardizing address: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/dead-letters/<dead_letter_id>', methods=['GET'])
+def get_dead_letter(dead_letter_id):
+    try:
+        return jsonify(sync_engine.dead_letters.get(dead_letter_id))
+    except FileNotFoundError:
+        return jsonify({"error": f"Dead letter {dead_letter_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting dead letter {dead_letter_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/dead-letters/<dead_letter_id>/discard', methods=['POST'])
+def discard_dead_letter(dead_letter_id):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        if 'username' not in data:
+            return jsonify({"error": "Missing required field: username"}), 400
+
+        letter = sync_engine.discard_dead_letter(dead_letter_id, data['username'], data.get('reason'))
+        return jsonify(letter)
+    except FileNotFoundError:
+        return jsonify({"error": f"Dead letter {dead_letter_id} not found"}), 404
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error discarding dead letter {dead_letter_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/schedules', methods=['GET'])
+def list_sync_schedules():
+    try:
+        sync_pair_id = request.args.get('sync_pair_id')
+        status = request.args.get('status')
+
+        schedules = _visible(sync_scheduler.list_schedules(sync_pair_id, status))
+        return jsonify({"schedules": schedules, "count": len(schedules)})
+    except Exception as e:
+        logger.error(f"Error listing sync schedules: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/schedules', methods=['POST'])
+def create_sync_schedule():
+    try:
+        data = request.json
+
+        required_fields = ['sync_pair_id', 'cron', 'username']
+        if data is not None:
+            for field in required_fields:
+                if field not in data:
+                    return jsonify({"error": f"Missing required field: {field}"}), 400
+        else:
+            return jsonify({"error": "Missing request body"}), 400
+
+        schedule = sync_scheduler.create_schedule(
+            sync_pair_id=data['sync_pair_id'],
+            cron=data['cron'],
+            username=data['username'],
+            timezone_name=data.get('timezone', 'UTC'),
+            mode=data.get('mode'),
+            tables=data.get('tables'),
+            catch_up=data.get('catch_up', 'latest'),
+            parameters=data.get('parameters')
+        )
+        return jsonify(schedule), 201
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        logger.error(f"Validation error creating sync schedule: {str(e)}")
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error creating sync schedule: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/schedules/<schedule_id>', methods=['GET'])
+def get_sync_schedule(schedule_id):
+    try:
+        schedule = sync_scheduler.get_schedule(schedule_id)
+        return jsonify(schedule)
+    except FileNotFoundError:
+        return jsonify({"error": f"Schedule {schedule_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting sync schedule {schedule_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/schedules/<schedule_id>', methods=['DELETE'])
+def delete_sync_schedule(schedule_id):
+    try:
+        sync_scheduler.delete_schedule(schedule_id)
+        return jsonify({"schedule_id": schedule_id, "deleted": True})
+    except FileNotFoundError:
+        return jsonify({"error": f"Schedule {schedule_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error deleting sync schedule {schedule_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/schedules/<schedule_id>/pause', methods=['POST'])
+def pause_sync_schedule(schedule_id):
+    try:
+        schedule = sync_scheduler.pause_schedule(schedule_id)
+        return jsonify(schedule)
+    except FileNotFoundError:
+        return jsonify({"error": f"Schedule {schedule_id} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error pausing sync schedule {schedule_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/schedules/<schedule_id>/resume', methods=['POST'])
+def resume_sync_schedule(schedule_id):
+    try:
+        schedule = sync_scheduler.resume_schedule(schedule_id)
+        return jsonify(schedule)
+    except FileNotFoundError:
+        return jsonify({"error": f"Schedule {schedule_id} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error resuming sync schedule {schedule_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/cdc', methods=['GET'])
+def list_cdc_listeners():
+    try:
+        return jsonify({"listeners": _visible(cdc_listener.list_status())})
+    except Exception as e:
+        logger.error(f"Error listing CDC listeners: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/cdc/<sync_pair_id>/pause', methods=['POST'])
+def pause_cdc_listener(sync_pair_id):
+    try:
+        return jsonify(cdc_listener.pause(sync_pair_id))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error pausing CDC listener for {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/cdc/<sync_pair_id>/resume', methods=['POST'])
+def resume_cdc_listener(sync_pair_id):
+    try:
+        return jsonify(cdc_listener.resume(sync_pair_id))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error resuming CDC listener for {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/conflicts', methods=['GET'])
+def list_sync_conflicts():
+    try:
+        sync_pair_id = request.args.get('sync_pair_id')
+        table_name = request.args.get('table')
+        key = request.args.get('record_key')
+        status = request.args.get('status')
+        conflicts = _visible(sync_engine.conflicts.list(sync_pair_id, table_name, key, status, None))
+        page = paginate_args(conflicts, sort_key("detected_at", "conflict_id"), "sync_conflicts", request.args)
+        return _paged(page, {"conflicts": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing sync conflicts: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/conflicts/<conflict_id>', methods=['GET'])
+def get_sync_conflict(conflict_id):
+    try:
+        conflict = sync_engine.get_conflict_diff(conflict_id)
+        return jsonify(conflict)
+    except FileNotFoundError:
+        return jsonify({"error": f"Conflict {conflict_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting sync conflict {conflict_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/conflicts/<conflict_id>/resolve', methods=['POST'])
+def resolve_sync_conflict(conflict_id):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+
+        for field in ['resolution', 'username']:
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+
+        conflict = sync_engine.resolve_conflict(
+            conflict_id, data['resolution'], data['username'], data.get('field_choices')
+        )
+        return jsonify(conflict)
+    except FileNotFoundError:
+        return jsonify({"error": f"Conflict {conflict_id} not found"}), 404
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error resolving sync conflict {conflict_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+def _odata_response(payload, status=200, headers=None, mimetype="application/json"):
+    """An OData response: JSON payloads use the OData error and version conventions."""
+    body = payload if isinstance(payload, str) else json.dumps(payload, default=str)
+    response = Response(body, status=status, mimetype=mimetype)
+    response.headers["OData-Version"] = ODATA_VERSION
+    for name, value in (headers or {}).items():
+        response.headers[name] = value
+    return response
+
+def _odata_error(status, message):
+    return _odata_response({"error": {"code": str(status), "message": message}}, status)
+
+@app.route('/odata/v4/<sync_pair_id>/', methods=['GET'])
+def get_odata_service_document(sync_pair_id):
+    try:
+        return _odata_response(odata_service.service_document(sync_pair_id, request.base_url))
+    except KeyError as e:
+        return _odata_error(404, e.args[0] if e.args else str(e))
+    except Exception as e:
+        logger.error(f"Error building OData service document for {sync_pair_id}: {str(e)}", exc_info=True)
+        return _odata_error(500, str(e))
+
+@app.route('/odata/v4/<sync_pair_id>/<path:resource>', methods=['GET'])
+def get_odata_resource(sync_pair_id, resource):
+    try:
+        service_root = url_for('get_odata_service_document', sync_pair_id=sync_pair_id, _external=True)
+        if resource == '$metadata':
+            return _odata_response(odata_service.metadata(sync_pair_id), mimetype="application/xml")
+
+        payload, headers = odata_service.read(
+            sync_pair_id, resource, request.args.to_dict(), service_root, request.headers.get('Prefer')
+        )
+        if isinstance(payload, int):
+            return _odata_response(str(payload), headers=headers, mimetype="text/plain")
+        return _odata_response(payload, headers=headers)
+    except KeyError as e:
+        return _odata_error(404, e.args[0] if e.args else str(e))
+    except ValueError as e:
+        return _odata_error(400, str(e))
+    except Exception as e:
+        logger.error(f"Error reading OData resource {resource} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return _odata_error(500, str(e))
+
+def _request_user():
+    """The RBAC user of a request, from its bearer token or the session; None when not signed in."""
+    if g.get('user') is not None:
+        return g.user
+    auth_header = request.headers.get('Authorization', '')
+    if auth_header.startswith('Bearer '):
+        token = auth_header.split(' ', 1)[1]
+    else:
+        token = session.get('jwt_token')
+    if not token or not RBAC_AVAILABLE:
+        return None
+    user = rbac_manager.verify_token(token)
+    if user is None and not auth_header.startswith('Bearer ') and session.get('refresh_token'):
+        # Browser sessions renew their short-lived access token themselves
+        renewed = rbac_manager.refresh_session(session['refresh_token'])
+        if not renewed['success']:
+            session.pop('jwt_token', None)
+            session.pop('refresh_token', None)
+            return None
+        session['jwt_token'] = renewed['token']
+        session['refresh_token'] = renewed['refresh_token']
+        user = rbac_manager.verify_token(renewed['token'])
+    return user
+
+def _graphql_error(status, message):
+    return jsonify({"errors": [{"message": message}]}), status
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/graphql', methods=['GET', 'POST'])
+def query_sync_graphql(sync_pair_id):
+    try:
+        user = _request_user()
+        if user is None:
+            return _graphql_error(401, "Authentication required")
+        if request.method == 'POST':
+            data = request.get_json(silent=True) or {}
+            variables = data.get('variables')
+        else:
+            data = request.args
+            variables = json.loads(data['variables']) if data.get('variables') else None
+        if not data.get('query'):
+            return _graphql_error(400, "Missing required field: query")
+
+        return jsonify(graphql_service.execute(sync_pair_id, data['query'], user, variables, data.get('operationName')))
+    except GraphQLError as e:
+        return jsonify({"errors": e.errors}), 400
+    except KeyError as e:
+        return _graphql_error(404, e.args[0] if e.args else str(e))
+    except PermissionError as e:
+        return _graphql_error(403, str(e))
+    except ValueError as e:
+        return _graphql_error(400, str(e))
+    except Exception as e:
+        logger.error(f"Error answering GraphQL query on {sync_pair_id}: {str(e)}", exc_info=True)
+        return _graphql_error(500, str(e))
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/graphql/schema', methods=['GET'])
+def get_sync_graphql_schema(sync_pair_id):
+    try:
+        user = _request_user()
+        if user is None:
+            return _graphql_error(401, "Authentication required")
+        return Response(graphql_service.schema(sync_pair_id, user), mimetype="text/plain")
+    except KeyError as e:
+        return _graphql_error(404, e.args[0] if e.args else str(e))
+    except PermissionError as e:
+        return _graphql_error(403, str(e))
+    except Exception as e:
+        logger.error(f"Error building GraphQL schema of {sync_pair_id}: {str(e)}", exc_info=True)
+        return _graphql_error(500, str(e))
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/streams/<entity_set>', methods=['GET'])
+def stream_records(sync_pair_id, entity_set):
+    try:
+        stream = record_stream_service.open(sync_pair_id, entity_set, request.args.to_dict())
+        # The stream is the body itself so the server closes it, freeing its slot, when the client goes away
+        return Response(stream, mimetype=NDJSON_CONTENT_TYPE,
+                        headers={"Cache-Control": "no-store", "X-Accel-Buffering": "no"})
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except StreamLimitError as e:
+        return jsonify({"error": str(e)}), 503, {"Retry-After": "30"}
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error streaming {entity_set} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/tables/<table_name>/records', methods=['POST'])
+def ingest_sync_records(sync_pair_id, table_name):
+    try:
+        if g.api_key is not None:
+            service = g.api_key["service"]
+        else:
+            api_key = request.headers.get(API_KEY_CONFIG["header_name"])
+            service = get_service_for_api_key(api_key) if api_key else None
+        user = _request_user()
+        if user is None and service is None:
+            return jsonify({"error": "Authentication required"}), 401
+        username = ingestion_service.authorize(sync_pair_id, table_name, user, service)
+        result = ingestion_service.ingest(
+            sync_pair_id, table_name, request.stream, request.content_type, username,
+            dry_run=request.args.get('dry_run', 'false').lower() == 'true',
+            errors_only=request.args.get('report', 'all') == 'errors',
+        )
+        if result["job"]["status"] == "FAILED":
+            # The records before the failure stay loaded; the report says which
+            return jsonify(dict(result, error=result["job"]["message"])), 413 if result["report"]["limit_exceeded"] else 500
+        return jsonify(result)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except PermissionError as e:
+        return jsonify({"error": str(e)}), 403
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error ingesting records into {table_name} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+def _import_username(given):
+    """Who uploads, previews or commits an import: the signed-in user, else the username given."""
+    user = _request_user()
+    return (user or {}).get('username') or given
+
+@app.route('/api/v1/sync/pairs/<sync_pair_id>/tables/<table_name>/imports', methods=['POST'])
+def create_sync_import(sync_pair_id, table_name):
+    try:
+        upload = request.files.get('file')
+        if upload is None or not upload.filename:
+            return jsonify({"error": "Missing required file: file"}), 400
+        username = _import_username(request.form.get('username'))
+        if not username:
+            return jsonify({"error": "Missing required field: username"}), 400
+        mapping = json.loads(request.form['mapping']) if request.form.get('mapping') else None
+        record = spreadsheet_import_service.create(sync_pair_id, table_name, upload.filename, upload.read(), username,
+                                                   sheet=request.form.get('sheet') or None, mapping=mapping)
+        return jsonify(record), 201
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error importing a spreadsheet into {table_name} of {sync_pair_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/imports', methods=['GET'])
+def list_sync_imports():
+    try:
+        sync_pair_id = request.args.get('sync_pair_id')
+        status = request.args.get('status')
+        imports = _visible(spreadsheet_import_service.list(sync_pair_id, status))
+        page = paginate_args(imports, sort_key("created_at", "import_id"), "sync_imports", request.args)
+        return _paged(page, {"imports": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing spreadsheet imports: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/imports/<import_id>', methods=['GET', 'DELETE'])
+def sync_import(import_id):
+    try:
+        if request.method == 'DELETE':
+            username = _import_username(request.args.get('username')) or "unknown"
+            return jsonify(spreadsheet_import_service.discard(import_id, username))
+        return jsonify(spreadsheet_import_service.get(import_id))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error handling spreadsheet import {import_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/imports/<import_id>/preview', methods=['POST'])
+def preview_sync_import(import_id):
+    try:
+        data = request.get_json(silent=True) or {}
+        username = _import_username(data.get('username'))
+        if not username:
+            return jsonify({"error": "Missing required field: username"}), 400
+        return jsonify(spreadsheet_import_service.preview(import_id, username, data.get('mapping'), data.get('sheet')))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ImportStateError as e:
+        return jsonify({"error": str(e)}), 409
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error previewing spreadsheet import {import_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/sync/imports/<import_id>/commit', methods=['POST'])
+def commit_sync_import(import_id):
+    try:
+        data = request.get_json(silent=True) or {}
+        username = _import_username(data.get('username'))
+        if not username:
+            return jsonify({"error": "Missing required field: username"}), 400
+        record = spreadsheet_import_service.commit(import_id, username, bool(data.get('allow_errors')))
+        if record["status"] == "FAILED":
+            # The rows before the failure stay loaded; the result says which
+            return jsonify(dict(record, error=record["message"])), 500
+        return jsonify(record)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ImportStateError as e:
+        return jsonify({"error": str(e)}), 409
+    except Exception as e:
+        logger.error(f"Error committing spreadsheet import {import_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/open-data/datasets', methods=['GET'])
+def list_open_data_datasets():
+    try:
+        datasets = _visible(open_data_publisher.list_datasets(request.args.get('sync_pair_id')))
+        return jsonify({"datasets": datasets, "count": len(datasets)})
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error listing open data datasets: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/open-data/datasets/<sync_pair_id>/<name>', methods=['GET'])
+def get_open_data_dataset(sync_pair_id, name):
+    try:
+        return jsonify(open_data_publisher.get_dataset(sync_pair_id, name))
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except Exception as e:
+        logger.error(f"Error getting open data dataset {sync_pair_id}/{name}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/open-data/datasets/<sync_pair_id>/<name>/publish', methods=['POST'])
+def publish_open_data_dataset(sync_pair_id, name):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        if 'username' not in data:
+            return jsonify({"error": "Missing required field: username"}), 400
+
+        dataset = open_data_publisher.publish(sync_pair_id, name, data['username'], bool(data.get('force')))
+        return jsonify(dataset)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except OpenDataError as e:
+        return jsonify({"error": str(e)}), 502
+    except Exception as e:
+        logger.error(f"Error publishing open data dataset {sync_pair_id}/{name}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/batches', methods=['POST'])
+def submit_job_batch():
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        if 'jobs' not in data:
+            return jsonify({"error": "Missing required field: jobs"}), 400
+
+        batch = job_batch_service.submit(data['jobs'], username=data.get('username'),
+                                         defaults=data.get('defaults'), name=data.get('name'),
+                                         redaction=lambda county_id: _redactor(county_id).names)
+        # Nothing was accepted when every job was rejected
+        return jsonify(batch), 202 if batch['counts'].get('REJECTED', 0) < batch['counts']['total'] else 400
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error submitting job batch: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/batches', methods=['GET'])
+def list_job_batches():
+    try:
+        batches = job_batch_service.list(
+            username=request.args.get('username'),
+            status=request.args.get('status'),
+            limit=None
+        )
+        batches = _visible(batches)
+        page = paginate_args(batches, sort_key("created_at", "batch_id"), "job_batches", request.args)
+        return _paged(page, {"batches": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing job batches: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/batches/<batch_id>', methods=['GET'])
+def get_job_batch(batch_id):
+    try:
+        return jsonify(job_batch_service.get(batch_id))
+    except FileNotFoundError:
+        return jsonify({"error": f"Batch {batch_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting job batch {batch_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/batches/<batch_id>/cancel', methods=['POST'])
+def cancel_job_batch(batch_id):
+    try:
+        data = request.get_json(silent=True) or {}
+        return jsonify(job_batch_service.cancel(batch_id, data.get('username')))
+    except FileNotFoundError:
+        return jsonify({"error": f"Batch {batch_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error cancelling job batch {batch_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/batches/<batch_id>/retry', methods=['POST'])
+def retry_job_batch(batch_id):
+    try:
+        return jsonify(job_batch_service.retry(batch_id)), 202
+    except FileNotFoundError:
+        return jsonify({"error": f"Batch {batch_id} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 409
+    except Exception as e:
+        logger.error(f"Error retrying job batch {batch_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/alerts', methods=['GET'])
+def list_alerts():
+    try:
+        alerts = _visible(alert_service.list(request.args.get('county_id'), request.args.get('status')))
+        page = paginate_args(alerts, sort_key("updated_at", "alert_id"), "alerts", request.args)
+        return _paged(page, {"alerts": page.items, "count": len(page.items), "next_cursor": page.next_cursor,
+                             "worker": alert_service.status()})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing alerts: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/alerts/<alert_id>', methods=['GET'])
+def get_alert(alert_id):
+    try:
+        return jsonify(alert_service.get(alert_id))
+    except FileNotFoundError:
+        return jsonify({"error": f"Alert {alert_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting alert {alert_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/freshness', methods=['GET'])
+def get_freshness_report():
+    try:
+        days = float(request.args['days']) if request.args.get('days') else None
+        report = freshness_monitor.report(request.args.get('county_id'), request.args.get('sync_pair_id'), days)
+        report["datasets"] = _visible(report["datasets"])
+        return jsonify(report)
+    except KeyError:
+        return jsonify({"error": f"Sync pair {request.args.get('sync_pair_id')} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error reporting data freshness: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/freshness/breaches', methods=['GET'])
+def list_freshness_breaches():
+    try:
+        days = float(request.args['days']) if request.args.get('days') else None
+        since = datetime.utcnow() - timedelta(days=days) if days else None
+        breaches = _visible(freshness_monitor.breaches(request.args.get('county_id'),
+                                                       request.args.get('sync_pair_id'), since))
+        page = paginate_args(breaches, sort_key("started_at", "breach_id"), "breaches", request.args)
+        return _paged(page, {"breaches": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing freshness breaches: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/webhooks', methods=['GET'])
+def list_webhooks():
+    try:
+        webhooks = _visible(webhook_service.list(request.args.get('county_id')))
+        return jsonify({"webhooks": webhooks, "count": len(webhooks), "worker": webhook_service.status()})
+    except Exception as e:
+        logger.error(f"Error listing webhooks: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-logging.basicConfig(level=logging.DEBUG)
-logger = logging.getLogger(__name__)
+@app.route('/api/v1/webhooks', methods=['POST'])
+def create_webhook():
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ('url', 'events', 'username'):
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
 
-app = Flask(__name__)
-app.secret_key = os.environ.get("SESSION_SECRET")
-app.wsgi_app = ProxyFix(app.wsgi_app, x_proto=1, x_host=1)
+        webhook = webhook_service.create(
+            data['url'], data['events'], data['username'],
+            county_id=data.get('county_id'),
+            sync_pair_id=data.get('sync_pair_id'),
+            secret=data.get('secret'),
+            min_validation_failures=data.get('min_validation_failures', 1),
+            description=data.get('description'),
+            appeal_statuses=data.get('appeal_statuses')
+        )
+        return jsonify(webhook), 201
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error creating webhook: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-app.config["SQLALCHEMY_DATABASE_URI"] = os.environ.get("DATABASE_URL")
-app.config["SQLALCHEMY_ENGINE_OPTIONS"] = {
-    "pool_recycle": 300,
-    "pool_pre_ping": True,
-}
+@app.route('/api/v1/webhooks/<webhook_id>', methods=['GET'])
+def get_webhook(webhook_id):
+    try:
+        return jsonify(webhook_service.get(webhook_id))
+    except FileNotFoundError:
+        return jsonify({"error": f"Webhook {webhook_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting webhook {webhook_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-db.init_app(app)
+@app.route('/api/v1/webhooks/<webhook_id>', methods=['PATCH'])
+def update_webhook(webhook_id):
+    try:
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        if 'username' not in data:
+            return jsonify({"error": "Missing required field: username"}), 400
 
-from gis_export import gis_export_service
-from benton_district_lookup import BentonDistrictLookup
-from narrator_ai_plugin import analyze_gis_export_data, analyze_sync_data, get_ai_health
+        changes = {k: v for k, v in data.items() if k != 'username'}
+        return jsonify(webhook_service.update(webhook_id, changes, data['username']))
+    except FileNotFoundError:
+        return jsonify({"error": f"Webhook {webhook_id} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error updating webhook {webhook_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-try:
-    from exemption_seer_ai import analyze_exemption_data, get_exemption_seer_health
-    EXEMPTION_SEER_AVAILABLE = True
-except ImportError:
-    EXEMPTION_SEER_AVAILABLE = False
+@app.route('/api/v1/webhooks/<webhook_id>', methods=['DELETE'])
+def delete_webhook(webhook_id):
+    try:
+        webhook_service.delete(webhook_id, request.args.get('username', 'system'))
+        return jsonify({"webhook_id": webhook_id, "deleted": True})
+    except FileNotFoundError:
+        return jsonify({"error": f"Webhook {webhook_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error deleting webhook {webhook_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-try:
-    from rbac_manager import rbac_manager, require_role
-    RBAC_AVAILABLE = True
-except ImportError:
-    RBAC_AVAILABLE = False
+@app.route('/api/v1/webhooks/<webhook_id>/rotate-secret', methods=['POST'])
+def rotate_webhook_secret(webhook_id):
+    try:
+        data = request.get_json(silent=True) or {}
+        return jsonify(webhook_service.rotate_secret(webhook_id, data.get('username', 'system')))
+    except FileNotFoundError:
+        return jsonify({"error": f"Webhook {webhook_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error rotating secret of webhook {webhook_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-os.makedirs("exports", exist_ok=True)
-district_lookup = BentonDistrictLookup()
+@app.route('/api/v1/webhooks/deliveries', methods=['GET'])
+def list_webhook_deliveries():
+    try:
+        deliveries = webhook_service.list_deliveries(
+            webhook_id=request.args.get('webhook_id'),
+            status=request.args.get('status'),
+            limit=None
+        )
+        if g.get('principal') is not None:
+            # Deliveries are visible with their webhook
+            webhook_ids = {webhook["webhook_id"] for webhook in _visible(webhook_service.list())}
+            deliveries = [delivery for delivery in deliveries if delivery["webhook_id"] in webhook_ids]
+        page = paginate_args(deliveries, sort_key("created_at", "delivery_id"), "webhook_deliveries", request.args)
+        return _paged(page, {"deliveries": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing webhook deliveries: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-with app.app_context():
+@app.route('/api/v1/webhooks/deliveries/<delivery_id>', methods=['GET'])
+def get_webhook_delivery(delivery_id):
     try:
-        import models
-        db.create_all()
-    except ImportError:
-        pass
+        return jsonify(webhook_service.get_delivery(delivery_id))
+    except FileNotFoundError:
+        return jsonify({"error": f"Webhook delivery {delivery_id} not found"}), 404
+    except Exception as e:
+        logger.error(f"Error getting webhook delivery {delivery_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-@app.route('/')
-def index():
-    return redirect(url_for('dashboard'))
+@app.route('/api/v1/webhooks/deliveries/<delivery_id>/redeliver', methods=['POST'])
+def redeliver_webhook(delivery_id):
+    try:
+        data = request.get_json(silent=True) or {}
+        return jsonify(webhook_service.redeliver(delivery_id, data.get('username', 'system'))), 202
+    except FileNotFoundError:
+        return jsonify({"error": f"Webhook delivery {delivery_id} or its webhook not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 409
+    except Exception as e:
+        logger.error(f"Error redelivering webhook delivery {delivery_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-@app.route('/dashboard')
-def dashboard():
-    return render_template('dashboard.html')
+def _api_key_admin():
+    """Who is managing API keys: an admin-scoped key (the middleware checked its scope) or an RBAC admin."""
+    if g.api_key is not None:
+        return f"service:{g.api_key['service']}"
+    user = _request_user()
+    if user is None:
+        raise ApiKeyError("Authentication required", 401)
+    if 'admin' not in (user.get('permissions') or []):
+        raise ApiKeyError("Managing API keys needs the admin permission", 403)
+    return user.get('username') or 'unknown'
 
-@app.route('/gis/dashboard')
-def gis_dashboard():
-    recent_jobs = gis_export_service.list_jobs(limit=10)
-    return render_template('dashboard.html', gis_exports=recent_jobs)
+def _check_key_county(county_id):
+    """Refuse to create or change a key of a county the caller may not manage; one without a county needs them all."""
+    if g.principal is not None and not g.principal.can("manage", county_id):
+        where = f"county {county_id}" if county_id else "every county"
+        raise ApiKeyError(f"{g.principal.name} may not manage API keys of {where}", 403)
 
-@app.route('/district-lookup')
-def district_lookup_dashboard():
-    return render_template('district_lookup_dashboard.html')
+@app.route('/api/v1/api-keys', methods=['GET'])
+def list_api_keys():
+    try:
+        _api_key_admin()
+        keys = api_key_service.list(service=request.args.get('service'), status=request.args.get('status'),
+                                    county_id=request.args.get('county_id'))
+        return jsonify({"api_keys": keys, "count": len(keys)})
+    except ApiKeyError as e:
+        return jsonify({"error": str(e)}), e.status
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing API keys: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-@app.route('/ai-analysis')
-def ai_analysis_dashboard():
-    return render_template('ai_analysis_dashboard.html')
+@app.route('/api/v1/api-keys', methods=['POST'])
+def create_api_key():
+    try:
+        username = _api_key_admin()
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ('name', 'service', 'scopes'):
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+        _check_key_county(data.get('county_id'))
 
-@app.route('/health')
-def health_check():
-    return {"status": "healthy", "service": "TerraFusion Platform", "version": "2.0.0"}
+        key = api_key_service.create(
+            data['name'], data['service'], data['scopes'], username,
+            rate_limit_per_minute=data.get('rate_limit_per_minute'),
+            expires_at=data.get('expires_at'),
+            county_id=data.get('county_id'),
+            description=data.get('description'),
+            allowed_ips=data.get('allowed_ips')
+        )
+        return jsonify(key), 201
+    except ApiKeyError as e:
+        return jsonify({"error": str(e)}), e.status
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error creating API key: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
 
-@app.route('/api/v1/gis-export/jobs', methods=['GET'])
-def list_export_jobs():
-    county_id = request.args.get('county_id')
-    status = request.args.get('status')
-    username = request.args.get('username')
-    limit = request.args.get('limit', 100, type=int)
-    
+@app.route('/api/v1/api-keys/<key_id>', methods=['GET'])
+def get_api_key(key_id):
     try:
-        jobs = gis_export_service.list_jobs(
-            county_id=county_id, 
-            status=status, 
-            username=username, 
-            limit=limit
-        )
-        return jsonify(jobs)
+        _api_key_admin()
+        return jsonify(api_key_service.get(key_id))
+    except ApiKeyError as e:
+        return jsonify({"error": str(e)}), e.status
+    except FileNotFoundError:
+        return jsonify({"error": f"API key {key_id} not found"}), 404
     except Exception as e:
-        logger.error(f"Error listing GIS export jobs: {str(e)}", exc_info=True)
+        logger.error(f"Error getting API key {key_id}: {str(e)}", exc_info=True)
         return jsonify({"error": str(e)}), 500
 
-@app.route('/api/v1/gis-export/jobs', methods=['POST'])
-def create_export_job():
+@app.route('/api/v1/api-keys/<key_id>/revoke', methods=['POST'])
+def revoke_api_key(key_id):
     try:
-        data = request.json
-        
-        required_fields = ['county_id', 'username', 'export_format', 'area_of_interest', 'layers']
-        if data is not None:
-            for field in required_fields:
-                if field not in data:
-                    return jsonify({"error": f"Missing required field: {field}"}), 400
-        else:
-            return jsonify({"error": "Missing request body"}), 400
-        
-        job = gis_export_service.create_export_job(
-            county_id=data['county_id'],
-            username=data['username'],
-            export_format=data['export_format'],
-            area_of_interest=data['area_of_interest'],
-            layers=data['layers'],
-            parameters=data.get('parameters')
+        username = _api_key_admin()
+        _check_key_county(api_key_service.get(key_id).get('county_id'))
+        data = request.get_json(silent=True) or {}
+        return jsonify(api_key_service.revoke(key_id, username, reason=data.get('reason')))
+    except ApiKeyError as e:
+        return jsonify({"error": str(e)}), e.status
+    except FileNotFoundError:
+        return jsonify({"error": f"API key {key_id} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 409
+    except Exception as e:
+        logger.error(f"Error revoking API key {key_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/api-keys/<key_id>/rotate', methods=['POST'])
+def rotate_api_key(key_id):
+    try:
+        username = _api_key_admin()
+        _check_key_county(api_key_service.get(key_id).get('county_id'))
+        data = request.get_json(silent=True) or {}
+        key = api_key_service.rotate(key_id, username, grace_hours=data.get("grace_hours", DEFAULT_ROTATION_GRACE_HOURS))
+        return jsonify(key), 201
+    except ApiKeyError as e:
+        return jsonify({"error": str(e)}), e.status
+    except FileNotFoundError:
+        return jsonify({"error": f"API key {key_id} not found"}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error rotating API key {key_id}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+def _access_admin():
+    """Who is changing role bindings; authorize_request checked they may manage the binding's county."""
+    if g.principal is None:
+        raise AccessDenied("Authentication required", 401)
+    return g.principal.name
+
+@app.route('/api/v1/access/roles', methods=['GET'])
+def list_access_roles():
+    return jsonify({"roles": [dict(role=name, **role) for name, role in ACCESS_ROLES.items()]})
+
+@app.route('/api/v1/access/me', methods=['GET'])
+def get_my_access():
+    if g.principal is None:
+        return jsonify({"error": "Authentication required"}), 401
+    return jsonify(g.principal.to_dict())
+
+@app.route('/api/v1/access/bindings', methods=['GET'])
+def list_role_bindings():
+    try:
+        _access_admin()
+        bindings = access_control.list_bindings(
+            username=request.args.get('username'),
+            county_id=request.args.get('county_id'),
+            role=request.args.get('role')
         )
-        
-        processed_job = gis_export_service.process_job(job['job_id'])
-        return jsonify(processed_job), 201
+        bindings = access_control.visible(g.principal, bindings, action="manage")
+        return jsonify({"bindings": bindings, "count": len(bindings)})
+    except AccessDenied as e:
+        return jsonify({"error": str(e)}), e.status
+    except Exception as e:
+        logger.error(f"Error listing role bindings: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/access/bindings', methods=['POST'])
+def create_role_binding():
+    try:
+        username = _access_admin()
+        data = request.get_json()
+        if not data:
+            return jsonify({"error": "No JSON data provided"}), 400
+        for field in ('username', 'role', 'county_id'):
+            if field not in data:
+                return jsonify({"error": f"Missing required field: {field}"}), 400
+
+        binding = access_control.bind(data['username'], data['role'], data['county_id'], username,
+                                      datasets=data.get('datasets'))
+        return jsonify(binding), 201
+    except AccessDenied as e:
+        return jsonify({"error": str(e)}), e.status
     except ValueError as e:
-        logger.error(f"Validation error creating GIS export job: {str(e)}")
         return jsonify({"error": str(e)}), 400
     except Exception as e:
-        logger.error(f"Error creating GIS export job: {str(e)}", exc_info=True)
+        logger.error(f"Error creating role binding: {str(e)}", exc_info=True)
         return jsonify({"error": str(e)}), 500
 
-@app.route('/api/v1/gis-export/jobs/<job_id>', methods=['GET'])
-def get_export_job(job_id):
+@app.route('/api/v1/access/bindings/<binding_id>', methods=['DELETE'])
+def delete_role_binding(binding_id):
     try:
-        job = gis_export_service.get_job_status(job_id)
-        return jsonify(job)
+        username = _access_admin()
+        return jsonify(access_control.unbind(binding_id, username))
+    except AccessDenied as e:
+        return jsonify({"error": str(e)}), e.status
     except FileNotFoundError:
-        return jsonify({"error": f"Export job {job_id} not found"}), 404
+        return jsonify({"error": f"Role binding {binding_id} not found"}), 404
     except Exception as e:
-        logger.error(f"Error getting GIS export job {job_id}: {str(e)}", exc_info=True)
+        logger.error(f"Error deleting role binding {binding_id}: {str(e)}", exc_info=True)
         return jsonify({"error": str(e)}), 500
 
-@app.route('/api/v1/gis-export/jobs/<job_id>/cancel', methods=['POST'])
-def cancel_export_job(job_id):
+@app.route('/api/v1/access/redaction', methods=['GET'])
+def get_redaction_policies():
     try:
-        job = gis_export_service.cancel_job(job_id)
-        return jsonify(job)
-    except FileNotFoundError:
-        return jsonify({"error": f"Export job {job_id} not found"}), 404
+        county_id = request.args.get('county_id')
+        if not county_id:
+            return jsonify({"error": "county_id is required"}), 400
+        settings = redaction_policies.settings(county_id).to_dict()
+        settings["applied"] = _redactor(county_id).names
+        return jsonify(settings)
     except ValueError as e:
         return jsonify({"error": str(e)}), 400
     except Exception as e:
-        logger.error(f"Error cancelling GIS export job {job_id}: {str(e)}", exc_info=True)
+        logger.error(f"Error reading the redaction policies of {county_id}: {str(e)}", exc_info=True)
         return jsonify({"error": str(e)}), 500
 
-@app.route('/api/v1/gis-export/download/<job_id>', methods=['GET'])
-def download_export(job_id):
+@app.route('/api/v1/tiles/<county_id>/<layer_name>/<int:z>/<int:x>/<tile>', methods=['GET'])
+def get_map_tile(county_id, layer_name, z, x, tile):
     try:
-        result = gis_export_service.get_job_result(job_id)
-        file_path = result.get('file_path')
-        
-        if not file_path or not os.path.exists(file_path):
-            return jsonify({"error": "Export file not found"}), 404
-        
-        county_id = result.get('county_id', 'unknown')
-        export_format = result.get('export_format', 'unknown')
-        filename = f"{county_id}_export.{export_format}"
-        
-        return send_file(file_path, as_attachment=True, download_name=filename)
-    except FileNotFoundError:
-        return jsonify({"error": f"Export job {job_id} not found"}), 404
+        y, _, tile_format = tile.partition('.')
+        if tile_format == 'pbf':
+            tile_format = 'mvt'
+        if not y.isdigit():
+            return jsonify({"error": f"No tile {z}/{x}/{tile}"}), 400
+
+        result = tile_server.tile(county_id, layer_name, z, x, int(y), tile_format, _redactor(county_id))
+        headers = {"ETag": result["etag"], "Cache-Control": "public, max-age=60, must-revalidate",
+                   "Access-Control-Allow-Origin": "*"}
+        if redaction_policies.settings(county_id).policies:
+            # Callers see different properties; shared caches must not hand one caller's tile to another
+            headers["Cache-Control"] = "private, max-age=60, must-revalidate"
+            headers["Vary"] = f"Authorization, {API_KEY_HEADER}, Cookie"
+        if request.headers.get('If-None-Match') == result["etag"]:
+            return Response(status=304, headers=headers)
+        if not result["content"]:
+            return Response(status=204, headers=headers)
+        return Response(result["content"], mimetype=result["content_type"], headers=headers)
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
     except ValueError as e:
         return jsonify({"error": str(e)}), 400
     except Exception as e:
-        logger.error(f"Error downloading GIS export for job {job_id}: {str(e)}", exc_info=True)
+        logger.error(f"Error rendering tile {z}/{x}/{tile} of {county_id}/{layer_name}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/tiles/<county_id>/<layer_name>.json', methods=['GET'])
+def get_tilejson(county_id, layer_name):
+    try:
+        tiles_url = request.url_root.rstrip('/') + f"/api/v1/tiles/{county_id}/{layer_name}"
+        response = jsonify(tile_server.tilejson(county_id, layer_name, tiles_url))
+        response.headers["Access-Control-Allow-Origin"] = "*"
+        return response
+    except KeyError as e:
+        return jsonify({"error": e.args[0] if e.args else str(e)}), 404
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error describing tile layer {county_id}/{layer_name}: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/tiles/status', methods=['GET'])
+def get_tile_server_status():
+    try:
+        return jsonify(tile_server.status())
+    except Exception as e:
+        logger.error(f"Error getting tile server status: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/tiles/invalidate', methods=['POST'])
+def invalidate_tiles():
+    try:
+        data = request.get_json(silent=True) or {}
+        dropped = tile_server.invalidate(county_id=data.get('county_id'), layer_name=data.get('layer'))
+        return jsonify({"invalidated": dropped, "count": len(dropped)})
+    except Exception as e:
+        logger.error(f"Error invalidating tiles: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/audit/events', methods=['GET'])
+def list_audit_events():
+    try:
+        events = audit_log.list(
+            resource_type=request.args.get('resource_type'),
+            resource_id=request.args.get('resource_id'),
+            username=request.args.get('username'),
+            action=request.args.get('action'),
+            county_id=request.args.get('county_id'),
+            limit=None
+        )
+        events = search(_visible(events), request.args.get('q'), AUDIT_TEXT_FIELDS)
+        page = paginate_args(events, sort_key("created_at", "event_id"), "audit_events", request.args)
+        return _paged(page, {"events": page.items, "count": len(page.items), "next_cursor": page.next_cursor})
+    except ValueError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        logger.error(f"Error listing audit events: {str(e)}", exc_info=True)
+        return jsonify({"error": str(e)}), 500
+
+@app.route('/api/v1/audit/verify', methods=['GET'])
+def verify_audit_chain():
+    try:
+        report = audit_log.verify()
+        return jsonify(report)
+    except Exception as e:
+        logger.error(f"Error verifying audit chain: {str(e)}", exc_info=True)
         return jsonify({"error": str(e)}), 500
 
 @app.route('/api/v1/district-lookup/coordinates', methods=['GET'])
@@ -413,10 +3085,191 @@ if RBAC_AVAILABLE:
             logger.error(f"Error during login: {str(e)}", exc_info=True)
             return jsonify({"error": str(e)}), 500
 
+    @app.route('/api/v1/rbac/token/refresh', methods=['POST'])
+    def rbac_refresh_token():
+        try:
+            data = request.get_json() or {}
+            if not data.get('refresh_token'):
+                return jsonify({"error": "refresh_token required"}), 400
+            result = rbac_manager.refresh_session(data['refresh_token'])
+            return jsonify(result), 200 if result['success'] else 401
+        except Exception as e:
+            logger.error(f"Error refreshing token: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    @app.route('/api/v1/rbac/logout', methods=['POST'])
+    def rbac_logout():
+        try:
+            auth_header = request.headers.get('Authorization', '')
+            token = auth_header.split(' ', 1)[1] if auth_header.startswith('Bearer ') else session.get('jwt_token')
+            session.pop('jwt_token', None)
+            session.pop('refresh_token', None)
+            if not token:
+                return jsonify({"error": "Authentication required"}), 401
+            result = rbac_manager.logout(token)
+            return jsonify(result), 200 if result['success'] else 401
+        except Exception as e:
+            logger.error(f"Error during logout: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    @app.route('/api/v1/rbac/users/<int:user_id>/sessions', methods=['DELETE'])
+    def rbac_revoke_sessions(user_id):
+        try:
+            admin = _request_user()
+            if admin is None:
+                return jsonify({"error": "Authentication required"}), 401
+            if 'admin' not in (admin.get('permissions') or []):
+                return jsonify({"error": "Ending sessions needs the admin permission"}), 403
+            result = rbac_manager.revoke_user_sessions(user_id, admin_user_id=admin['id'])
+            return jsonify(result), 200 if result['success'] else 404
+        except Exception as e:
+            logger.error(f"Error ending the sessions of user {user_id}: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    def _mfa_user(data):
+        """Who is managing a second factor: the signed-in user, or a login's mfa_token holder (enrollment at login)."""
+        if data.get('mfa_token'):
+            return rbac_manager.mfa_challenge_user(data['mfa_token']), True
+        return _request_user(), False
+
+    @app.route('/api/v1/rbac/mfa', methods=['GET'])
+    def rbac_mfa_status():
+        try:
+            user = _request_user()
+            if user is None:
+                return jsonify({"error": "Authentication required"}), 401
+            return jsonify(rbac_manager.mfa_status(user))
+        except Exception as e:
+            logger.error(f"Error getting MFA status: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    @app.route('/api/v1/rbac/mfa/enroll', methods=['POST'])
+    def rbac_mfa_enroll():
+        try:
+            user, at_login = _mfa_user(request.get_json(silent=True) or {})
+            if user is None:
+                return jsonify({"error": "Authentication required"}), 401
+            result = rbac_manager.enroll_mfa(user, at_login=at_login)
+            return jsonify(result), 200 if result['success'] else 409
+        except Exception as e:
+            logger.error(f"Error starting MFA enrollment: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    @app.route('/api/v1/rbac/mfa/confirm', methods=['POST'])
+    def rbac_mfa_confirm():
+        try:
+            data = request.get_json(silent=True) or {}
+            if not data.get('code'):
+                return jsonify({"error": "Missing required field: code"}), 400
+            user, at_login = _mfa_user(data)
+            if user is None:
+                return jsonify({"error": "Authentication required"}), 401
+            result = rbac_manager.confirm_mfa(user, data['code'], current_code=data.get('current_code'),
+                                              start_session=at_login)
+            return jsonify(result), 200 if result['success'] else 400
+        except Exception as e:
+            logger.error(f"Error confirming MFA enrollment: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    @app.route('/api/v1/rbac/mfa/verify', methods=['POST'])
+    def rbac_mfa_verify():
+        try:
+            data = request.get_json(silent=True) or {}
+            for field in ('mfa_token', 'code'):
+                if not data.get(field):
+                    return jsonify({"error": f"Missing required field: {field}"}), 400
+            result = rbac_manager.verify_mfa(data['mfa_token'], data['code'])
+            return jsonify(result), 200 if result['success'] else 401
+        except Exception as e:
+            logger.error(f"Error verifying second factor: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    @app.route('/api/v1/rbac/mfa/backup-codes', methods=['POST'])
+    def rbac_mfa_backup_codes():
+        try:
+            data = request.get_json(silent=True) or {}
+            if not data.get('code'):
+                return jsonify({"error": "Missing required field: code"}), 400
+            user = _request_user()
+            if user is None:
+                return jsonify({"error": "Authentication required"}), 401
+            result = rbac_manager.regenerate_backup_codes(user, data['code'])
+            return jsonify(result), 200 if result['success'] else 400
+        except Exception as e:
+            logger.error(f"Error regenerating backup codes: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    @app.route('/api/v1/rbac/users/<int:user_id>/mfa', methods=['DELETE'])
+    def rbac_mfa_reset(user_id):
+        try:
+            admin = _request_user()
+            if admin is None:
+                return jsonify({"error": "Authentication required"}), 401
+            if 'admin' not in (admin.get('permissions') or []):
+                return jsonify({"error": "Resetting a second factor needs the admin permission"}), 403
+            result = rbac_manager.reset_mfa(user_id, admin_user_id=admin['id'])
+            return jsonify(result), 200 if result['success'] else 404
+        except Exception as e:
+            logger.error(f"Error resetting the second factor of user {user_id}: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    @app.route('/api/v1/rbac/sso/login', methods=['GET'])
+    def rbac_sso_login():
+        try:
+            result = rbac_manager.begin_sso_login(request.args.get('return_to'))
+            if not result['success']:
+                return jsonify({"error": result['error']}), 503 if rbac_manager.oidc is not None else 404
+            # The state, nonce and PKCE verifier stay with this browser until the provider sends it back
+            session['oidc_login'] = result['pending']
+            return redirect(result['authorization_url'])
+        except Exception as e:
+            logger.error(f"Error starting SSO login: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    @app.route('/api/v1/rbac/sso/callback', methods=['GET'])
+    def rbac_sso_callback():
+        try:
+            pending = session.pop('oidc_login', None)
+            if request.args.get('error'):
+                return jsonify({"error": request.args.get('error_description') or request.args['error']}), 401
+            result = rbac_manager.complete_sso_login(pending, request.args.get('code'), request.args.get('state'))
+            if not result['success']:
+                status = 503 if result['error'] == 'Identity provider unavailable' else 401
+                return jsonify({"error": result['error']}), status
+            session['jwt_token'] = result['token']
+            session['refresh_token'] = result['refresh_token']
+            return redirect(result['return_to'] or url_for('dashboard'))
+        except Exception as e:
+            logger.error(f"Error completing SSO login: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+    @app.route('/api/v1/rbac/directory/health', methods=['GET'])
+    def rbac_directory_health():
+        try:
+            from rbac_manager import rbac_manager
+            directory = rbac_manager.ldap or rbac_manager.oidc
+            if directory is None:
+                return jsonify({"auth_backend": rbac_manager.auth_backend, "status": "not_configured"})
+            health = directory.health_check()
+            health["auth_backend"] = rbac_manager.auth_backend
+            health["break_glass_configured"] = bool(rbac_manager.break_glass_username)
+            return jsonify(health), 200 if health["status"] == "healthy" else 503
+        except Exception as e:
+            logger.error(f"Error checking directory health: {str(e)}", exc_info=True)
+            return jsonify({"error": str(e)}), 500
+
+# Serve every route under /api/v2/ and unversioned /api/ too; keep this after the last route
+register_versions(app)
+
 @app.errorhandler(404)
 def not_found(error):
     return jsonify({"error": "Endpoint not found"}), 404
 
+@app.errorhandler(BodyDecodingError)
+def undecodable_body(error):
+    # Raised while a compressed request body is read, wherever that happens
+    return jsonify({"error": str(error)}), error.status
+
 @app.errorhandler(500)
 def internal_error(error):
     logger.error(f"Internal server error: {str(error)}")
@@ -0,0 +1,379 @@
+"""
+TerraFusion SyncService - Audit Log
+
+This module provides the audit log for user decisions that change county data
+outside the normal sync flow, such as conflict resolutions. Each event records
+who did what to which resource and when, and is kept in the sync state store
+so it survives restarts and can be reviewed through the API.
+
+Events form a hash chain so edits to the trail can be detected: each one
+carries its sequence number, the hash of the event before it and its own
+hash (SHA-256 of the event's canonical JSON). Every AUDIT_ANCHOR_INTERVAL
+events, or when the last anchor is AUDIT_ANCHOR_MINUTES old, the head of the
+chain is written down as an anchor checkpoint, signed with AUDIT_ANCHOR_KEY
+when one is set and also appended to AUDIT_ANCHOR_FILE (a file on storage the
+service cannot rewrite, such as a WORM bucket mount). Anyone rewriting the
+chain from some event on must also forge every later anchor. Verify it with:
+
+    python audit_log.py verify
+
+which reports missing, duplicated, modified and unlinked events, a truncated
+end, and events that no longer match their anchors. Events recorded before
+chaining was added have no sequence and are counted, not checked.
+
+Events belong to the county of their resource (see tenancy), so a county's
+users list only its events; the chain itself spans every county.
+"""
+
+import os
+import sys
+import hmac
+import json
+import uuid
+import hashlib
+import logging
+from datetime import datetime, timedelta
+from typing import Dict, List, Any, Optional
+
+from sync_store import DocumentStore, sync_state_store
+from tenancy import current_tenants, tenant_of, unrestricted
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection for audit events
+AUDIT_COLLECTION = "audit_events"
+
+# Collection of the chain head ("head") and of the anchor checkpoints
+CHAIN_COLLECTION = "audit_chain"
+ANCHOR_COLLECTION = "audit_anchors"
+
+# previous_hash of the first chained event
+GENESIS_HASH = "0" * 64
+
+# Events between anchor checkpoints, and the longest time between them
+ANCHOR_INTERVAL = int(os.environ.get("AUDIT_ANCHOR_INTERVAL", "100"))
+ANCHOR_MINUTES = int(os.environ.get("AUDIT_ANCHOR_MINUTES", "60"))
+
+# Key anchors are signed with (HMAC-SHA256); keep it outside the state store
+ANCHOR_KEY = os.environ.get("AUDIT_ANCHOR_KEY", "")
+
+# File anchors are also appended to, one JSON object per line
+ANCHOR_FILE = os.environ.get("AUDIT_ANCHOR_FILE")
+
+# Problems listed in a verification report; the count covers them all
+MAX_REPORTED_PROBLEMS = 1000
+
+
+def event_hash(event: Dict[str, Any]) -> str:
+    """The hash of an event: SHA-256 of its canonical JSON without the hash itself."""
+    content = {k: v for k, v in event.items() if k != "hash"}
+    canonical = json.dumps(content, sort_keys=True, separators=(",", ":"), default=str)
+    return hashlib.sha256(canonical.encode()).hexdigest()
+
+
+def anchor_signature(anchor: Dict[str, Any], key: Optional[str] = None) -> Optional[str]:
+    """The HMAC of an anchor's sequence, hash and time; None without a key (AUDIT_ANCHOR_KEY by default)."""
+    key = ANCHOR_KEY if key is None else key
+    if not key:
+        return None
+    message = f"{anchor['sequence']}:{anchor['hash']}:{anchor['created_at']}".encode()
+    return hmac.new(key.encode(), message, hashlib.sha256).hexdigest()
+
+
+class AuditLog:
+    """Service class for recording and querying audit events."""
+
+    def __init__(self, store: Optional[DocumentStore] = None, anchor_file: Optional[str] = ANCHOR_FILE,
+                 anchor_interval: int = ANCHOR_INTERVAL, anchor_minutes: int = ANCHOR_MINUTES):
+        """
+        Initialize the audit log.
+
+        Args:
+            store: Document store for audit events
+            anchor_file: File anchors are also appended to (optional)
+            anchor_interval: Events between anchor checkpoints
+            anchor_minutes: Longest time between anchor checkpoints
+        """
+        self.store = store or sync_state_store
+        self.anchor_file = anchor_file
+        self.anchor_interval = anchor_interval
+        self.anchor_minutes = anchor_minutes
+
+    def record(self,
+               action: str,
+               username: str,
+               resource_type: str,
+               resource_id: str,
+               details: Optional[Dict[str, Any]] = None,
+               county_id: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Record an audit event at the end of the chain.
+
+        Args:
+            action: What happened, e.g. "sync_conflict.resolved"
+            username: User who performed the action
+            resource_type: Kind of resource acted on, e.g. "sync_conflict"
+            resource_id: ID of the resource
+            details: Additional JSON-serializable context
+            county_id: County the resource belongs to; by default the county
+                or sync pair the details name, else the one county of the
+                request (see tenancy)
+
+        Returns:
+            The audit event
+        """
+        tenants = current_tenants()
+        county_id = county_id or tenant_of({"details": details or {}}) or \
+            (next(iter(tenants)) if tenants is not None and len(tenants) == 1 else None)
+        event = {
+            "event_id": str(uuid.uuid4()),
+            "action": action,
+            "username": username,
+            "resource_type": resource_type,
+            "resource_id": resource_id,
+            "county_id": county_id,
+            "details": details or {},
+            "created_at": datetime.utcnow().isoformat(),
+        }
+        # Round-trip the details so the hash covers what is stored, not what the caller passed
+        event = json.loads(json.dumps(event, default=str))
+        with self.store.lock(CHAIN_COLLECTION):
+            head = self._head()
+            event["sequence"] = head["sequence"] + 1
+            event["previous_hash"] = head["hash"]
+            event["hash"] = event_hash(event)
+            self.store.save(AUDIT_COLLECTION, event["event_id"], event)
+            head.update(sequence=event["sequence"], hash=event["hash"], event_id=event["event_id"])
+            if self._anchor_due(head):
+                self._anchor(head)
+            self._save_head(head)
+        logger.info(f"Audit: {username} {action} {resource_type} {resource_id}")
+        return event
+
+    def _head(self) -> Dict[str, Any]:
+        """The chain head; rebuilt from the events if it is missing."""
+        # The chain runs through every county's events, whatever the caller's
+        with unrestricted():
+            try:
+                return self.store.load(CHAIN_COLLECTION, "head")
+            except FileNotFoundError:
+                pass
+            events = self.store.list(AUDIT_COLLECTION)
+        chained = [e for e in events if isinstance(e.get("sequence"), int)]
+        if not chained:
+            return {"sequence": 0, "hash": GENESIS_HASH, "event_id": None}
+        last = max(chained, key=lambda e: e["sequence"])
+        logger.warning(f"Audit chain head is missing; continuing from event {last['sequence']}")
+        return {"sequence": last["sequence"], "hash": last["hash"], "event_id": last["event_id"]}
+
+    def _save_head(self, head: Dict[str, Any]) -> None:
+        with unrestricted():
+            self.store.save(CHAIN_COLLECTION, "head", head)
+
+    def _anchor_due(self, head: Dict[str, Any]) -> bool:
+        if self.anchor_interval and head["sequence"] % self.anchor_interval == 0:
+            return True
+        anchored_at = head.get("anchored_at")
+        if anchored_at is None:
+            return head["sequence"] == 1
+        return datetime.fromisoformat(anchored_at) <= datetime.utcnow() - timedelta(minutes=self.anchor_minutes)
+
+    def _anchor(self, head: Dict[str, Any]) -> Dict[str, Any]:
+        """Write a checkpoint of the head (and mark it on the head, which the caller saves)."""
+        anchor = {
+            "sequence": head["sequence"],
+            "hash": head["hash"],
+            "event_id": head["event_id"],
+            "created_at": datetime.utcnow().isoformat(),
+        }
+        anchor["signature"] = anchor_signature(anchor)
+        with unrestricted():
+            self.store.save(ANCHOR_COLLECTION, f"{anchor['sequence']:012d}", anchor)
+        if self.anchor_file:
+            try:
+                with open(self.anchor_file, "a") as f:
+                    f.write(json.dumps(anchor, sort_keys=True) + "\n")
+            except OSError as e:
+                logger.error(f"Cannot append audit anchor {anchor['sequence']} to {self.anchor_file}: {e}")
+        head["anchored_at"] = anchor["created_at"]
+        logger.info(f"Audit chain anchored at event {anchor['sequence']}: {anchor['hash']}")
+        return anchor
+
+    def anchor(self) -> Optional[Dict[str, Any]]:
+        """Write an anchor checkpoint of the current head now; None while the chain is empty."""
+        with self.store.lock(CHAIN_COLLECTION):
+            head = self._head()
+            if head["sequence"] == 0:
+                return None
+            anchor = self._anchor(head)
+            self._save_head(head)
+        return anchor
+
+    def anchors(self) -> List[Dict[str, Any]]:
+        """The anchor checkpoints of the state store, oldest first."""
+        with unrestricted():
+            anchors = self.store.list(ANCHOR_COLLECTION)
+        return sorted(anchors, key=lambda a: a.get("sequence", 0))
+
+    def verify(self, anchor_file: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Check the chain for edits.
+
+        Args:
+            anchor_file: Anchor file to check the chain against as well
+                (the configured AUDIT_ANCHOR_FILE by default)
+
+        Returns:
+            Report with "valid", the number of chained and unchained "entries",
+            the sequence range, "anchors_checked" and the "problems" found,
+            each with a sequence, a problem kind and a detail
+        """
+        problems: List[Dict[str, Any]] = []
+        problem_count = 0
+
+        def problem(sequence: Optional[int], kind: str, detail: str, event_id: Optional[str] = None) -> None:
+            nonlocal problem_count
+            problem_count += 1
+            if len(problems) < MAX_REPORTED_PROBLEMS:
+                problems.append({"sequence": sequence, "problem": kind, "detail": detail, "event_id": event_id})
+
+        # The chain runs through every county's events, whatever the caller's
+        with unrestricted():
+            events = self.store.list(AUDIT_COLLECTION)
+        by_sequence: Dict[int, List[Dict[str, Any]]] = {}
+        unchained = 0
+        for event in events:
+            if isinstance(event.get("sequence"), int):
+                by_sequence.setdefault(event["sequence"], []).append(event)
+            else:
+                unchained += 1
+
+        expected_sequence, expected_previous = 1, GENESIS_HASH
+        for sequence in sorted(by_sequence):
+            entries = by_sequence[sequence]
+            if len(entries) > 1:
+                problem(sequence, "duplicate", f"{len(entries)} events have sequence {sequence}",
+                        ", ".join(e.get("event_id", "?") for e in entries))
+            if sequence > expected_sequence:
+                missing = f"{expected_sequence}" if sequence == expected_sequence + 1 \
+                    else f"{expected_sequence} to {sequence - 1}"
+                problem(expected_sequence, "missing", f"Events {missing} are missing")
+                expected_previous = None
+            for entry in entries:
+                if event_hash(entry) != entry.get("hash"):
+                    problem(sequence, "modified", "Event does not match its hash", entry.get("event_id"))
+                elif expected_previous is not None and entry.get("previous_hash") != expected_previous:
+                    problem(sequence, "unlinked", f"previous_hash does not match event {sequence - 1}",
+                            entry.get("event_id"))
+            expected_sequence, expected_previous = sequence + 1, entries[-1].get("hash")
+
+        last_sequence = expected_sequence - 1
+        try:
+            head = self.store.load(CHAIN_COLLECTION, "head")
+        except FileNotFoundError:
+            head = None
+            if by_sequence:
+                problem(None, "head_missing", "The chain head is missing")
+        if head is not None:
+            if head.get("sequence", 0) > last_sequence:
+                problem(last_sequence + 1, "truncated",
+                        f"The head is at event {head['sequence']} but the last event is {last_sequence}")
+            elif head.get("sequence") == last_sequence and last_sequence and head.get("hash") != expected_previous:
+                problem(last_sequence, "head_mismatch", "The head's hash does not match the last event")
+
+        anchors = [(a, "store") for a in self.anchors()]
+        anchor_file = anchor_file or self.anchor_file
+        if anchor_file and os.path.exists(anchor_file):
+            with open(anchor_file, "r") as f:
+                for number, line in enumerate(f, 1):
+                    try:
+                        anchors.append((json.loads(line), anchor_file))
+                    except ValueError:
+                        problem(None, "anchor_unreadable", f"Line {number} of {anchor_file} is not an anchor")
+        for anchor, source in anchors:
+            sequence = anchor.get("sequence")
+            if ANCHOR_KEY and not hmac.compare_digest(str(anchor.get("signature")), str(anchor_signature(anchor))):
+                problem(sequence, "anchor_forged", f"Anchor in {source} does not carry a valid signature")
+                continue
+            entries = by_sequence.get(sequence)
+            if not entries:
+                problem(sequence, "anchor_missing_event", f"Event anchored in {source} is missing")
+            elif all(e.get("hash") != anchor.get("hash") for e in entries):
+                problem(sequence, "anchor_mismatch", f"Event differs from its anchor in {source}",
+                        entries[0].get("event_id"))
+
+        return {
+            "valid": problem_count == 0,
+            "entries": sum(len(entries) for entries in by_sequence.values()),
+            "unchained_entries": unchained,
+            "first_sequence": min(by_sequence) if by_sequence else None,
+            "last_sequence": last_sequence or None,
+            "anchors_checked": len(anchors),
+            "problem_count": problem_count,
+            "problems": problems,
+            "verified_at": datetime.utcnow().isoformat(),
+        }
+
+    def get(self, event_id: str) -> Dict[str, Any]:
+        """
+        Get an audit event.
+
+        Raises:
+            FileNotFoundError: If the event does not exist
+        """
+        try:
+            return self.store.load(AUDIT_COLLECTION, event_id)
+        except FileNotFoundError:
+            raise FileNotFoundError(f"Audit event {event_id} not found")
+
+    def list(self,
+             resource_type: Optional[str] = None,
+             resource_id: Optional[str] = None,
+             username: Optional[str] = None,
+             action: Optional[str] = None,
+             county_id: Optional[str] = None,
+             limit: int = 100) -> List[Dict[str, Any]]:
+        """List audit events with optional filtering, newest first."""
+        events = []
+        for event in self.store.list(AUDIT_COLLECTION):
+            if resource_type and event.get("resource_type") != resource_type:
+                continue
+            if resource_id and event.get("resource_id") != resource_id:
+                continue
+            if username and event.get("username") != username:
+                continue
+            if action and event.get("action") != action:
+                continue
+            if county_id and event.get("county_id") != county_id:
+                continue
+            events.append(event)
+        events.sort(key=lambda e: e.get("created_at", ""), reverse=True)
+        return events[:limit]
+
+
+# Create a singleton instance
+audit_log = AuditLog()
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    """Command-line entry point for checking and anchoring the audit chain."""
+    import argparse
+    parser = argparse.ArgumentParser(description="TerraFusion Audit Log")
+    commands = parser.add_subparsers(dest="command", required=True)
+    verify = commands.add_parser("verify", help="Check the audit chain for gaps and edits; exits 1 when it fails")
+    verify.add_argument("--anchor-file", help="Anchor file to check against (AUDIT_ANCHOR_FILE by default)")
+    commands.add_parser("anchor", help="Write an anchor checkpoint of the chain head now")
+
+    args = parser.parse_args(argv)
+    if args.command == "anchor":
+        print(json.dumps(audit_log.anchor(), indent=2))
+        return 0
+    report = audit_log.verify(args.anchor_file)
+    print(json.dumps(report, indent=2))
+    return 0 if report["valid"] else 1
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,161 @@
+"""
+TerraFusion Platform - Shell Completion
+
+This module writes the tab completion scripts of the `terrafusion` command
+for bash, zsh and PowerShell. The scripts are generated from the command's
+own argument parser, so they always list the commands, options and option
+values (such as --output table, json or csv) of the release that wrote them:
+
+    terrafusion completion bash > /etc/bash_completion.d/terrafusion
+    source <(terrafusion completion zsh)                 # in ~/.zshrc, after compinit
+    terrafusion completion powershell | Out-String | Invoke-Expression   # in $PROFILE
+
+Commands and options complete from the words typed so far; option values
+complete from their choices. Options that take a free value (a sync pair,
+a county) and positional arguments fall back to the shell's file name
+completion, which is what file and directory arguments need.
+"""
+
+import argparse
+from typing import Dict, List, Any
+
+# Shells a script can be written for
+SHELLS = ["bash", "zsh", "powershell"]
+
+# Name the completion is registered for
+COMMAND = "terrafusion"
+
+
+def command_tree(parser: argparse.ArgumentParser) -> Dict[str, Dict[str, Any]]:
+    """
+    The commands of a parser and its subcommands, by path ("" for the
+    top level, then "sync", "sync run" and so on).
+
+    Returns:
+        For each path: its words (subcommands, then options), the choices
+        of its options that have them, and its options taking a free value
+    """
+    tree: Dict[str, Dict[str, Any]] = {}
+
+    def walk(current: argparse.ArgumentParser, path: str) -> None:
+        entry = {"words": [], "choices": {}, "valued": []}
+        tree[path] = entry
+        options = []
+        for action in current._actions:
+            if isinstance(action, argparse._SubParsersAction):
+                for name, subparser in action.choices.items():
+                    entry["words"].append(name)
+                    walk(subparser, f"{path} {name}".strip())
+            elif action.option_strings and action.help != argparse.SUPPRESS:
+                names = [name for name in action.option_strings if name.startswith("--")] or action.option_strings
+                options.extend(names)
+                if action.choices:
+                    entry["choices"].update({name: [str(choice) for choice in action.choices] for name in names})
+                elif action.nargs != 0:
+                    entry["valued"].extend(names)
+        entry["words"].extend(options)
+
+    walk(parser, "")
+    return tree
+
+
+def render(shell: str, parser: argparse.ArgumentParser) -> str:
+    """
+    The completion script of a shell.
+
+    Raises:
+        ValueError: If the shell is not one of SHELLS
+    """
+    if shell not in SHELLS:
+        raise ValueError(f"Unsupported shell {shell}; choose one of {', '.join(SHELLS)}")
+    tree = command_tree(parser)
+    if shell == "powershell":
+        return render_powershell(tree)
+    script = render_bash(tree)
+    if shell == "zsh":
+        # zsh runs the bash completion function through its bash compatibility layer
+        return "autoload -U +X bashcompinit && bashcompinit\n" + script
+    return script
+
+
+def render_bash(tree: Dict[str, Dict[str, Any]]) -> str:
+    paths = "|".join(path for path in tree if path)
+    value_cases = []
+    for path, entry in tree.items():
+        for option, choices in entry["choices"].items():
+            value_cases.append(f'        "{path}:{option}") values="{" ".join(choices)}" ;;')
+        for option in entry["valued"]:
+            value_cases.append(f'        "{path}:{option}") return ;;')
+    word_cases = [f'        "{path}") values="{" ".join(entry["words"])}" ;;' for path, entry in tree.items()]
+    lines = [
+        f"# {COMMAND} completion for bash; generated by `{COMMAND} completion bash`",
+        f'_{COMMAND}_paths="|{paths}|"',
+        "",
+        f"_{COMMAND}_complete() {{",
+        '    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" path="" values="" word i',
+        "    COMPREPLY=()",
+        "    for ((i = 1; i < COMP_CWORD; i++)); do",
+        '        word="${COMP_WORDS[i]}"',
+        f'        case "${{_{COMMAND}_paths}}" in',
+        '            *"|${path:+$path }$word|"*) path="${path:+$path }$word" ;;',
+        "        esac",
+        "    done",
+        '    case "$path:$prev" in',
+        *value_cases,
+        "    esac",
+        '    if [[ -z "$values" ]]; then',
+        '        case "$path" in',
+        *["    " + case for case in word_cases],
+        "        esac",
+        "    fi",
+        '    COMPREPLY=($(compgen -W "$values" -- "$cur"))',
+        "}",
+        f"complete -o default -F _{COMMAND}_complete {COMMAND}",
+    ]
+    return "\n".join(lines) + "\n"
+
+
+def render_powershell(tree: Dict[str, Dict[str, Any]]) -> str:
+    def array(words: List[str]) -> str:
+        return "@(" + ", ".join(f"'{word}'" for word in words) + ")"
+
+    commands = [f"        '{path}' = {array(entry['words'])}" for path, entry in tree.items()]
+    choices = [f"        '{path}:{option}' = {array(values)}"
+               for path, entry in tree.items() for option, values in entry["choices"].items()]
+    valued = [f"'{path}:{option}'" for path, entry in tree.items() for option in entry["valued"]]
+    lines = [
+        f"# {COMMAND} completion for PowerShell; generated by `{COMMAND} completion powershell`",
+        f"Register-ArgumentCompleter -Native -CommandName {COMMAND}, {COMMAND}.exe -ScriptBlock {{",
+        "    param($wordToComplete, $commandAst, $cursorPosition)",
+        "    $commands = @{",
+        *commands,
+        "    }",
+        "    $choices = @{",
+        *choices,
+        "    }",
+        f"    $valued = @({', '.join(valued)})",
+        "    $words = @($commandAst.CommandElements | Select-Object -Skip 1 | ForEach-Object { $_.ToString() })",
+        "    if ($wordToComplete -and $words.Count -gt 0) {",
+        "        $words = @($words | Select-Object -First ($words.Count - 1))",
+        "    }",
+        "    $path = ''",
+        "    $prev = ''",
+        "    foreach ($word in $words) {",
+        "        $next = if ($path) { \"$path $word\" } else { $word }",
+        "        if ($commands.ContainsKey($next)) { $path = $next }",
+        "        $prev = $word",
+        "    }",
+        "    $key = \"${path}:$prev\"",
+        "    if ($choices.ContainsKey($key)) {",
+        "        $candidates = $choices[$key]",
+        "    } elseif ($valued -contains $key) {",
+        "        return",
+        "    } else {",
+        "        $candidates = $commands[$path]",
+        "    }",
+        "    $candidates | Where-Object { $_ -like \"$wordToComplete*\" } | ForEach-Object {",
+        "        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)",
+        "    }",
+        "}",
+    ]
+    return "\n".join(lines) + "\n"
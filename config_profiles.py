@@ -0,0 +1,307 @@
+"""
+TerraFusion Platform - Configuration Profiles
+
+This module layers an instance's environment settings from named profiles,
+so development, staging and production (or each county's deployment) run
+from one set of files instead of several hand-kept copies of an
+environment file:
+
+    profiles/base.env           # shared by every profile
+    profiles/prod.env           # LOG_LEVEL=WARNING, SYNC_MAX_WORKERS=8, ...
+    profiles/benton_wa.env      # TERRAFUSION_PROFILE_EXTENDS=prod, then Benton County's settings
+
+    terrafusion --profile staging doctor
+    terrafusion --profile prod --set LOG_LEVEL=DEBUG service run --env-file /etc/terrafusion/terrafusion.env
+    terrafusion config diff staging prod
+    terrafusion config profiles
+
+Profile files are KEY=VALUE lines, as python-dotenv reads them, in
+TERRAFUSION_PROFILE_DIR (profiles by default). A profile may extend another
+with TERRAFUSION_PROFILE_EXTENDS; the profile it extends is read first and
+its settings overridden. Each setting takes its value from the first of,
+highest precedence first:
+
+    1. a --set KEY=VALUE flag
+    2. the process environment (variables already set when it starts)
+    3. the environment file (--env-file, or TERRAFUSION_ENV_FILE)
+    4. the profile, then the profiles it extends, nearest first
+    5. profiles/base.env
+    6. the setting's built-in default
+
+The profile is the one --profile names, or TERRAFUSION_PROFILE in the
+environment, then in the environment file; the service host, the gateway
+started by gunicorn (main.py) and the terrafusion command all apply it
+before the gateway's modules read their settings. The chosen profile and
+environment file are kept in TERRAFUSION_PROFILE and TERRAFUSION_ENV_FILE,
+where a configuration reload reads the logging settings again (see
+config_reload), and `terrafusion config explain` names the layer each
+setting came from.
+
+County configuration files stay shared between profiles: the connection
+settings they name as *_env_var references (see secret_providers) are the
+per-environment part, and come from the profile layers like any other
+setting. A diff of two profiles compares their file layers only (the
+environment and flags apply to both alike); the values of passwords,
+secrets, tokens, keys and DSNs are masked, with a short fingerprint so a
+changed secret still shows as changed.
+"""
+
+import os
+import hashlib
+import logging
+from typing import Dict, List, Any, Optional, Tuple
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Directory of the profile files
+PROFILE_DIR = os.environ.get("TERRAFUSION_PROFILE_DIR", "profiles")
+
+# Extension of a profile file
+PROFILE_SUFFIX = ".env"
+
+# Profile read under every other profile
+BASE_PROFILE = "base"
+
+# Settings that select the profile, name the profile a profile extends, and hold the environment file
+PROFILE_SETTING = "TERRAFUSION_PROFILE"
+EXTENDS_SETTING = "TERRAFUSION_PROFILE_EXTENDS"
+ENV_FILE_SETTING = "TERRAFUSION_ENV_FILE"
+
+# Parts of a setting name whose values are masked in a diff
+SENSITIVE_PARTS = ["PASSWORD", "SECRET", "TOKEN", "KEY", "DSN", "DATABASE_URL"]
+
+# Replaces a sensitive value, before its fingerprint
+MASK = "****"
+
+# Settings apply_profile set, with their source, so applying again (the CLI, then the service host) keeps the layers
+_applied: Dict[str, Dict[str, str]] = {}
+
+
+class ProfileError(ValueError):
+    """A profile that does not exist, extends itself, or a malformed --set flag."""
+
+
+def profile_path(name: str, profile_dir: Optional[str] = None) -> str:
+    return os.path.join(profile_dir or PROFILE_DIR, f"{name}{PROFILE_SUFFIX}")
+
+
+def profile_names(profile_dir: Optional[str] = None) -> List[str]:
+    """The profiles with a file in the profile directory, base included."""
+    directory = profile_dir or PROFILE_DIR
+    if not os.path.isdir(directory):
+        return []
+    return sorted(name[:-len(PROFILE_SUFFIX)] for name in os.listdir(directory) if name.endswith(PROFILE_SUFFIX))
+
+
+def read_settings(path: str) -> Dict[str, str]:
+    """The settings of a KEY=VALUE file; a key without a value is an empty setting."""
+    from dotenv import dotenv_values
+    return {key: "" if value is None else value for key, value in dotenv_values(path).items()}
+
+
+def profile_chain(name: str, profile_dir: Optional[str] = None) -> List[str]:
+    """
+    A profile and the profiles it extends, the furthest first, after base.
+
+    Raises:
+        ProfileError: If a profile of the chain has no file, or the chain loops
+    """
+    chain: List[str] = []
+    current: Optional[str] = name
+    while current:
+        if current in chain:
+            raise ProfileError(f"Profile {name} extends itself through {' -> '.join(chain + [current])}")
+        path = profile_path(current, profile_dir)
+        if not os.path.exists(path):
+            detail = f" (extended by {chain[-1]})" if chain else ""
+            raise ProfileError(f"Profile {current}{detail} has no file {path}")
+        chain.append(current)
+        current = read_settings(path).get(EXTENDS_SETTING) or None
+    chain.reverse()
+    if name != BASE_PROFILE and os.path.exists(profile_path(BASE_PROFILE, profile_dir)) \
+            and BASE_PROFILE not in chain:
+        chain.insert(0, BASE_PROFILE)
+    return chain
+
+
+def file_layers(profile: Optional[str] = None, env_file: Optional[str] = None,
+                profile_dir: Optional[str] = None) -> List[Tuple[str, Dict[str, str]]]:
+    """
+    The file layers of a profile, lowest precedence first, as (source, settings):
+    base, the profiles of its chain, then the environment file.
+    """
+    layers = []
+    if profile:
+        names = profile_chain(profile, profile_dir)
+    else:
+        names = [BASE_PROFILE] if os.path.exists(profile_path(BASE_PROFILE, profile_dir)) else []
+    for name in names:
+        settings = read_settings(profile_path(name, profile_dir))
+        settings.pop(EXTENDS_SETTING, None)
+        layers.append((f"profile {name}", settings))
+    if env_file and os.path.exists(env_file):
+        layers.append((f"env_file {os.path.abspath(env_file)}", read_settings(env_file)))
+    return layers
+
+
+def file_settings(profile: Optional[str] = None, env_file: Optional[str] = None,
+                  profile_dir: Optional[str] = None) -> Dict[str, str]:
+    """The settings a profile's file layers give, the higher layers' values winning."""
+    settings: Dict[str, str] = {}
+    for _, layer in file_layers(profile, env_file, profile_dir):
+        settings.update(layer)
+    return settings
+
+
+def parse_overrides(pairs: Optional[List[str]]) -> Dict[str, str]:
+    """--set KEY=VALUE flags as settings."""
+    overrides = {}
+    for pair in pairs or []:
+        key, separator, value = pair.partition("=")
+        if not separator or not key.strip():
+            raise ProfileError(f"--set {pair} must be KEY=VALUE")
+        overrides[key.strip()] = value
+    return overrides
+
+
+def resolve(profile: Optional[str] = None, env_file: Optional[str] = None,
+            overrides: Optional[Dict[str, str]] = None, environ: Optional[Dict[str, str]] = None,
+            profile_dir: Optional[str] = None) -> Dict[str, Any]:
+    """
+    The settings the layers give, with the source of each.
+
+    Args:
+        profile: Profile to apply; TERRAFUSION_PROFILE of the environment, then of the env file, otherwise
+        env_file: Environment file layered over the profile
+        overrides: Settings of --set flags
+        environ: Process environment; os.environ by default
+        profile_dir: Directory of the profile files
+
+    Returns:
+        Dictionary with the profile, env_file and settings: each file or flag setting's value and source
+        (flag, environment, env_file PATH or profile NAME)
+
+    Raises:
+        ProfileError: If the profile or one it extends does not exist
+    """
+    environ = os.environ if environ is None else environ
+    if env_file is None:
+        env_file = environ.get(ENV_FILE_SETTING) or None
+    if profile is None:
+        profile = environ.get(PROFILE_SETTING) or (
+            read_settings(env_file).get(PROFILE_SETTING) if env_file and os.path.exists(env_file) else None) or None
+    settings: Dict[str, Dict[str, str]] = {}
+    for source, layer in file_layers(profile, env_file, profile_dir):
+        settings.update({key: {"value": value, "source": source} for key, value in layer.items()})
+    for key in settings:
+        if key in environ:
+            settings[key] = {"value": environ[key], "source": "environment"}
+    for key, value in (overrides or {}).items():
+        settings[key] = {"value": value, "source": "flag"}
+    return {"profile": profile, "env_file": os.path.abspath(env_file) if env_file else None, "settings": settings}
+
+
+def apply_profile(profile: Optional[str] = None, env_file: Optional[str] = None,
+                  overrides: Optional[Dict[str, str]] = None, profile_dir: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Set the environment variables the profile layers give, under those
+    already set and over them for --set flags. Applying again (with an
+    environment file the first call did not have) re-layers the settings
+    the first call set, and keeps its flags.
+
+    Returns:
+        The resolved settings (see resolve)
+
+    Raises:
+        ProfileError: If the profile or one it extends does not exist
+    """
+    # Variables an earlier call set are layers, not the environment, unless changed since
+    environ = {key: value for key, value in os.environ.items()
+               if key not in _applied or _applied[key]["value"] != value}
+    flags = {key: entry["value"] for key, entry in _applied.items()
+             if entry["source"] == "flag" and os.environ.get(key) == entry["value"]}
+    resolved = resolve(profile, env_file, dict(flags, **(overrides or {})), environ, profile_dir)
+    for key, entry in resolved["settings"].items():
+        if entry["source"] != "environment":
+            os.environ[key] = entry["value"]
+            _applied[key] = entry
+    for key, value in ((PROFILE_SETTING, resolved["profile"]), (ENV_FILE_SETTING, resolved["env_file"])):
+        if value:
+            os.environ[key] = value
+    if resolved["profile"]:
+        logger.debug(f"Applied configuration profile {resolved['profile']}")
+    return resolved
+
+
+def setting_source(key: str) -> str:
+    """Where the current value of an environment setting came from: a profile layer, a flag, or the environment."""
+    entry = _applied.get(key)
+    if entry and os.environ.get(key) == entry["value"]:
+        return entry["source"]
+    return "environment"
+
+
+def mask_setting(key: str, value: Optional[str]) -> Optional[str]:
+    """A setting's value as a diff prints it; sensitive values as a mask and a fingerprint."""
+    if value is None or not any(part in key.upper() for part in SENSITIVE_PARTS):
+        return value
+    return f"{MASK} ({hashlib.sha256(value.encode()).hexdigest()[:8]})"
+
+
+def list_profiles(profile_dir: Optional[str] = None) -> List[Dict[str, Any]]:
+    """Each profile with the profile it extends, its file, its number of settings and any error of its chain."""
+    profiles = []
+    for name in profile_names(profile_dir):
+        path = profile_path(name, profile_dir)
+        settings = read_settings(path)
+        entry = {"profile": name, "extends": settings.pop(EXTENDS_SETTING, None), "path": path,
+                 "settings": len(settings), "error": None}
+        try:
+            profile_chain(name, profile_dir)
+        except ProfileError as e:
+            entry["error"] = str(e)
+        profiles.append(entry)
+    return profiles
+
+
+def diff_profiles(left: str, right: str, profile_dir: Optional[str] = None) -> Dict[str, Any]:
+    """
+    The settings two profiles' file layers give differently.
+
+    Returns:
+        Dictionary with left, right, differences (setting, each side's value and source; a setting one side
+        does not have is None) and the number of settings that are the same
+
+    Raises:
+        ProfileError: If either profile or one it extends does not exist
+    """
+    sides = []
+    for name in (left, right):
+        settings: Dict[str, Tuple[str, str]] = {}
+        for source, layer in file_layers(name, None, profile_dir):
+            settings.update({key: (value, source) for key, value in layer.items()})
+        sides.append(settings)
+    differences, same = [], 0
+    for key in sorted(set(sides[0]) | set(sides[1])):
+        (left_value, left_source), (right_value, right_source) = (side.get(key, (None, None)) for side in sides)
+        if left_value == right_value:
+            same += 1
+            continue
+        differences.append({"setting": key, "left": mask_setting(key, left_value),
+                            "right": mask_setting(key, right_value), "left_source": left_source,
+                            "right_source": right_source})
+    return {"left": left, "right": right, "differences": differences, "same": same}
+
+
+def format_diff(diff: Dict[str, Any]) -> str:
+    """A profile diff as one line per setting that differs, then a summary."""
+    lines = [f"--- {diff['left']}", f"+++ {diff['right']}"]
+    for entry in diff["differences"]:
+        if entry["left"] is not None:
+            lines.append(f"- {entry['setting']}={entry['left']}  ({entry['left_source']})")
+        if entry["right"] is not None:
+            lines.append(f"+ {entry['setting']}={entry['right']}  ({entry['right_source']})")
+    lines.append(f"{len(diff['differences'])} setting(s) differ, {diff['same']} the same")
+    return "\n".join(lines)
@@ -0,0 +1,268 @@
+"""
+TerraFusion Platform - Configuration Reload
+
+This module applies configuration changes to a running service without a
+restart, so editing a mapping or adding a schedule does not kill the sync
+jobs in flight:
+
+    kill -HUP <pid>                                    # the service host (see service_host)
+    systemctl reload terrafusion
+    curl -X POST https://gateway/api/v1/admin/config/reload
+
+A reload reads every county configuration file, with its overrides (see
+county_overrides), and the mapping files its sync pairs name, and the logging settings (LOG_LEVEL, LOG_LEVELS and
+LOG_FORMAT) of the environment file the service was started with
+(TERRAFUSION_ENV_FILE) and its configuration profile (see config_profiles),
+or of the environment. Everything is checked before
+anything is applied: a county file that no longer loads, a configured
+schedule whose cron expression does not parse or an unknown log level
+refuses the whole reload, and the service keeps running on the
+configuration it had.
+
+Changes are then applied at once, as one new set of sync pairs (connectors,
+tables, mappings, hooks and the rest), the configured schedules (see
+SyncScheduler.sync_configured) and the logging settings. A sync pair that
+changed or was removed while one of its jobs is running or paused is left
+as it was, and its change deferred: the job finishes on the configuration
+it started with, and the change is applied as soon as the sync pair has no
+job running (queued jobs start on whichever configuration is current when
+they start). Other environment settings still need a restart; the reload
+reports the ones that changed in the environment file since startup.
+
+A reload applies to the process that runs it; run the sync job queue and the
+scheduler in the service host so that process is the one reloaded.
+"""
+
+import os
+import uuid
+import logging
+import threading
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+from audit_log import AuditLog, audit_log
+from logging_config import reconfigure_logging, parse_logger_levels, LOG_FORMAT
+from sync_control import RUNNING_STATUSES
+from sync_engine import SyncEngine, sync_engine
+from sync_scheduler import SyncScheduler, sync_scheduler, check_configured
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Environment settings a reload applies; the others are read once, at startup
+LOGGING_SETTINGS = ["LOG_LEVEL", "LOG_LEVELS", "LOG_FORMAT"]
+
+# Statuses of a job that still uses the configuration its sync pair had when it started
+ACTIVE_STATUSES = RUNNING_STATUSES + ["PAUSED"]
+
+# Seconds between checks of whether deferred changes can be applied
+DEFERRED_POLL_SECONDS = float(os.environ.get("CONFIG_RELOAD_DEFERRED_POLL_SECONDS", "10"))
+
+# Reloads kept in the history status() reports
+HISTORY_SIZE = 20
+
+
+class ConfigReloader:
+    """
+    Service class for reloading the configuration of this process.
+
+    reload() applies what it can at once and defers sync pair changes that
+    affect running jobs; a background thread (start/stop) applies the
+    deferred changes when those jobs are done.
+    """
+
+    def __init__(self, engine: Optional[SyncEngine] = None, scheduler: Optional[SyncScheduler] = None,
+                 audit: Optional[AuditLog] = None):
+        """
+        Initialize the reloader.
+
+        Args:
+            engine: Sync engine whose registry and jobs are reloaded; defaults to the sync_engine singleton
+            scheduler: Scheduler whose configured schedules are kept in line; defaults to the sync_scheduler singleton
+            audit: Audit log reloads are recorded in
+        """
+        self.engine = engine or sync_engine
+        self.registry = self.engine.registry
+        self.scheduler = scheduler or sync_scheduler
+        self.audit_log = audit or audit_log
+        # New definition (None when removed) of each sync pair whose change waits for its jobs
+        self.deferred: Dict[str, Any] = {}
+        self.history: List[Dict[str, Any]] = []
+        # The environment file and profile as the service read them at startup
+        self._started_environment = _environment_file()
+        self._lock = threading.RLock()
+        self._stop_event = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+
+    def reload(self, requested_by: str = "system") -> Dict[str, Any]:
+        """
+        Check and apply the current configuration.
+
+        Args:
+            requested_by: User (or signal) that asked for the reload, for the audit log
+
+        Returns:
+            The reload: status ("applied" or "refused"), the errors that
+            refused it, the sync pairs added, changed and removed, the
+            changes deferred, the schedules stored and the environment
+            settings that need a restart
+        """
+        with self._lock:
+            result = {
+                "reload_id": str(uuid.uuid4()),
+                "requested_by": requested_by,
+                "requested_at": datetime.utcnow().isoformat(),
+                "errors": [],
+            }
+            environment = _environment_file()
+            settings = {name: environment.get(name, os.environ.get(name)) for name in LOGGING_SETTINGS}
+            try:
+                logger_levels = parse_logger_levels(settings["LOG_LEVELS"] or "")
+            except ValueError as e:
+                logger_levels = {}
+                result["errors"].append(f"LOG_LEVELS: {e}")
+
+            sync_pairs, load_errors = self.registry.read()
+            for path, error in load_errors.items():
+                # A file that was already broken stays skipped, as it was at startup
+                if self.registry.load_errors.get(path) != error:
+                    result["errors"].append(f"{path}: {error}")
+            for pair in sync_pairs.values():
+                result["errors"].extend(check_configured(pair))
+
+            if not result["errors"]:
+                try:
+                    reconfigure_logging(settings["LOG_LEVEL"] or logging.getLevelName(logging.getLogger().level),
+                                        settings["LOG_FORMAT"] or LOG_FORMAT, logger_levels)
+                except ValueError as e:
+                    result["errors"].append(str(e))
+            if result["errors"]:
+                result["status"] = "refused"
+                logger.error(f"Configuration reload refused: {'; '.join(result['errors'])}")
+                return self._finish(result)
+
+            for name in LOGGING_SETTINGS:
+                if settings[name] is not None:
+                    os.environ[name] = settings[name]
+            result["logging"] = {"level": logging.getLevelName(logging.getLogger().level),
+                                 "logger_levels": logger_levels,
+                                 "format": (settings["LOG_FORMAT"] or LOG_FORMAT).lower()}
+            result["restart_required"] = sorted(
+                name for name in set(environment) | set(self._started_environment)
+                if name not in LOGGING_SETTINGS and environment.get(name) != self._started_environment.get(name)
+            )
+
+            current = self.registry.sync_pairs
+            result["added"] = sorted(set(sync_pairs) - set(current))
+            result["removed"] = sorted(set(current) - set(sync_pairs))
+            result["changed"] = sorted(
+                pair_id for pair_id in set(sync_pairs) & set(current)
+                if sync_pairs[pair_id].fingerprint != current[pair_id].fingerprint
+            )
+            active = self._active_jobs(result["changed"] + result["removed"])
+            applied = dict(sync_pairs)
+            self.deferred = {}
+            for pair_id, job_ids in active.items():
+                # The running jobs keep the sync pair they started with until they are done
+                self.deferred[pair_id] = sync_pairs.get(pair_id)
+                applied[pair_id] = current[pair_id]
+            result["deferred"] = [
+                {"sync_pair_id": pair_id, "change": "removed" if self.deferred[pair_id] is None else "changed",
+                 "jobs": job_ids}
+                for pair_id, job_ids in sorted(active.items())
+            ]
+
+            self.registry.replace(applied, load_errors)
+            result["schedules"] = self.scheduler.sync_configured(self.registry.list())
+            result["status"] = "applied"
+            logger.info(
+                f"Configuration reloaded: {len(result['added'])} sync pairs added, {len(result['changed'])} changed, "
+                f"{len(result['removed'])} removed, {len(result['deferred'])} deferred until their jobs finish"
+            )
+            return self._finish(result)
+
+    def apply_deferred(self) -> List[str]:
+        """Apply the deferred changes of sync pairs that no longer have a job running; returns their IDs."""
+        with self._lock:
+            if not self.deferred:
+                return []
+            active = self._active_jobs(list(self.deferred))
+            ready = [pair_id for pair_id in self.deferred if pair_id not in active]
+            if not ready:
+                return []
+            applied = dict(self.registry.sync_pairs)
+            for pair_id in ready:
+                pair = self.deferred.pop(pair_id)
+                if pair is None:
+                    applied.pop(pair_id, None)
+                else:
+                    applied[pair_id] = pair
+            self.registry.replace(applied, self.registry.load_errors)
+            self.scheduler.sync_configured(self.registry.list())
+        logger.info(f"Applied the deferred configuration of sync pairs {', '.join(ready)}")
+        self.audit_log.record("configuration.deferred_applied", "system", "configuration", ",".join(ready),
+                              {"sync_pair_ids": ready})
+        return ready
+
+    def status(self) -> Dict[str, Any]:
+        """The changes still deferred, and the recent reloads, newest first."""
+        with self._lock:
+            return {
+                "deferred": [{"sync_pair_id": pair_id, "change": "removed" if pair is None else "changed"}
+                             for pair_id, pair in sorted(self.deferred.items())],
+                "reloads": list(reversed(self.history)),
+            }
+
+    def start(self) -> None:
+        """Start the thread that applies deferred changes."""
+        if self._thread is not None and self._thread.is_alive():
+            return
+        self._stop_event.clear()
+        self._thread = threading.Thread(target=self._loop, name="config-reload", daemon=True)
+        self._thread.start()
+
+    def stop(self) -> None:
+        """Stop the deferred change thread; changes still deferred are dropped with the process."""
+        self._stop_event.set()
+        if self._thread is not None:
+            self._thread.join(timeout=5)
+            self._thread = None
+
+    def _loop(self) -> None:
+        while not self._stop_event.wait(DEFERRED_POLL_SECONDS):
+            try:
+                self.apply_deferred()
+            except Exception as e:
+                logger.error(f"Error applying deferred configuration changes: {e}", exc_info=True)
+
+    def _active_jobs(self, sync_pair_ids: List[str]) -> Dict[str, List[str]]:
+        """The running and paused jobs of sync pairs, by sync pair; pairs without any are left out."""
+        active: Dict[str, List[str]] = {}
+        for pair_id in sync_pair_ids:
+            job_ids = [job["job_id"] for job in self.engine.list_jobs(sync_pair_id=pair_id, limit=1000)
+                       if job.get("status") in ACTIVE_STATUSES]
+            if job_ids:
+                active[pair_id] = job_ids
+        return active
+
+    def _finish(self, result: Dict[str, Any]) -> Dict[str, Any]:
+        self.history = (self.history + [result])[-HISTORY_SIZE:]
+        self.audit_log.record(f"configuration.reload_{result['status']}", result["requested_by"], "configuration",
+                              result["reload_id"], {name: value for name, value in result.items()
+                                                    if name not in ("reload_id", "requested_by", "requested_at")})
+        return result
+
+
+def _environment_file() -> Dict[str, Optional[str]]:
+    """The settings of the environment file and profile the service was started with; empty without them."""
+    from config_profiles import file_settings, ProfileError, PROFILE_SETTING, ENV_FILE_SETTING
+    try:
+        return dict(file_settings(os.environ.get(PROFILE_SETTING), os.environ.get(ENV_FILE_SETTING)))
+    except ProfileError as e:
+        logger.warning(f"Cannot read the configuration profile: {e}")
+        return {}
+
+
+# Create a singleton instance
+config_reloader = ConfigReloader()
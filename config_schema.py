@@ -0,0 +1,806 @@
+"""
+TerraFusion Platform - Configuration Schema
+
+This module checks an instance's whole configuration before it is deployed
+and explains the configuration the instance would run with.
+
+`terrafusion config validate` reads the environment settings, the
+configuration profiles (see config_profiles), the authentication backend,
+each county configuration file and the field mapping files its sync pairs
+name, and the stored sync schedules. Files are checked against a schema
+first, so a misspelt key ("primary_keys", "hostt") or a value of the wrong
+type, which the services would otherwise ignore or trip over at the first
+sync, is reported with its file, line and column:
+
+    county_configs/benton_wa/benton_wa_config.json:41:9: error: Unknown key hostt in
+        sync_pairs[0].source; did you mean host? (sync_pairs[0].source.hostt)
+
+A county's overrides file (see county_overrides) is checked the same way,
+and laid over the county file for everything after. Each sync pair, network
+policy, alerting, retention, redaction, quota and AI block is then loaded the
+way the services load it, and what they refuse (a table dependency cycle, a
+filter that does not parse, a missing mapping file) is reported at the block
+it came from. Feature blocks the schema leaves open (merge, validation,
+events and the like) are checked by that load only. Connector settings may
+be given directly, or as *_env_var and *_secret references (see
+secret_providers); REST sources also accept the settings their header and
+parameter templates name.
+
+`terrafusion config explain` prints the configuration as the services see
+it: the environment settings with their defaults (or the profile, file, flag
+or environment each came from; see config_profiles), the authentication
+backend and, for each county with its overrides applied, its sync pairs with
+every default filled in, the source settings inherited from
+data_ingestion_settings, vendor tables expanded, the effective job retention
+and the stored schedules. Passwords, tokens and DSNs are masked.
+"""
+
+import os
+import re
+import json
+import difflib
+import logging
+import dataclasses
+from bisect import bisect_right
+from json.decoder import scanstring
+from typing import Dict, List, Any, Optional, Iterator, Tuple
+from zoneinfo import ZoneInfo, ZoneInfoNotFoundError
+
+from sync_connectors import CHANGE_TRACKING_METHODS, CONNECTOR_TYPES
+from sync_conflicts import CONFLICT_STRATEGIES
+from sync_filters import EXCLUDE_ACTIONS
+from sync_mapping import FIELD_TYPES
+from county_overrides import FEATURES, apply_overrides, load_county_config, overrides_path
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Severities of an issue, worst first
+ERROR, WARNING = "error", "warning"
+
+# Setting names whose values are never printed by explain
+SENSITIVE_SETTINGS = ["password", "token", "dsn", "client_secret", "bind_password", "private_key_passphrase",
+                      "api_key", "secret_key", "session_secret"]
+
+MASK = "********"
+
+_NUMBER = re.compile(r"-?(?:0|[1-9]\d*)(?:\.\d+)?(?:[eE][-+]?\d+)?")
+_WHITESPACE = re.compile(r"[ \t\n\r]*")
+_DSN_PASSWORD = re.compile(r"(://[^:/@]+:)[^@]+@")
+
+Path = Tuple[Any, ...]
+
+
+def locate(text: str) -> Dict[Path, Tuple[int, int]]:
+    """
+    The line and column of every value of a JSON document, by path (a tuple
+    of keys and indexes); object members are located at their key.
+
+    The document must be valid JSON.
+    """
+    starts = [0] + [match.end() for match in re.finditer("\n", text)]
+    positions: Dict[Path, Tuple[int, int]] = {}
+
+    def position(index: int) -> Tuple[int, int]:
+        line = bisect_right(starts, index)
+        return line, index - starts[line - 1] + 1
+
+    def skip(index: int) -> int:
+        return _WHITESPACE.match(text, index).end()
+
+    def value(index: int, path: Path) -> int:
+        index = skip(index)
+        positions.setdefault(path, position(index))
+        char = text[index]
+        if char in "{[":
+            closing, number = "}" if char == "{" else "]", 0
+            index = skip(index + 1)
+            while text[index] != closing:
+                if char == "{":
+                    key, end = scanstring(text, index + 1)
+                    positions[path + (key,)] = position(index)
+                    index = value(skip(end) + 1, path + (key,))
+                else:
+                    index = value(index, path + (number,))
+                    number += 1
+                index = skip(index)
+                if text[index] == ",":
+                    index = skip(index + 1)
+            return index + 1
+        if char == '"':
+            return scanstring(text, index + 1)[1]
+        for literal in ("true", "false", "null"):
+            if text.startswith(literal, index):
+                return index + len(literal)
+        return _NUMBER.match(text, index).end()
+
+    value(0, ())
+    return positions
+
+
+def format_path(path: Path) -> str:
+    """A path as it reads in messages: sync_pairs[0].source.host."""
+    text = ""
+    for part in path:
+        text += f"[{part}]" if isinstance(part, int) else (f".{part}" if text else str(part))
+    return text
+
+
+# Schema -------------------------------------------------------------------
+#
+# Schemas are a small subset of JSON Schema: "type" (a name or a list of
+# names), "enum", "minimum", "properties", "required", "additionalProperties"
+# (false for closed objects, or the schema of every other member), "items" and
+# "format" (one of _FORMATS). "variants" picks an object's schema by the value
+# of its "type" member.
+
+STRING = {"type": "string"}
+INTEGER = {"type": "integer"}
+NUMBER = {"type": "number"}
+BOOLEAN = {"type": "boolean"}
+OPEN = {"type": "object"}
+STRINGS = {"type": "array", "items": STRING}
+
+
+def _object(properties: Dict[str, Any], required: Tuple[str, ...] = (), additional: Any = False) -> Dict[str, Any]:
+    return {"type": "object", "properties": properties, "required": list(required),
+            "additionalProperties": additional}
+
+
+def _map(values: Dict[str, Any]) -> Dict[str, Any]:
+    return {"type": "object", "additionalProperties": values}
+
+
+def _settings(*names: str) -> Dict[str, Any]:
+    """Connector settings read directly, or through their *_env_var and *_secret references."""
+    properties = {}
+    for name in names:
+        properties.update({name: {"type": ["string", "integer"]}, f"{name}_env_var": STRING,
+                           f"{name}_secret": STRING})
+    return properties
+
+
+def _cron(value: str) -> Optional[str]:
+    from sync_scheduler import CronExpression
+    try:
+        CronExpression(value)
+    except ValueError as e:
+        return str(e)
+    return None
+
+
+def _timezone(value: str) -> Optional[str]:
+    try:
+        ZoneInfo(value)
+    except (ZoneInfoNotFoundError, ValueError):
+        return f"Unknown time zone: {value}"
+    return None
+
+
+_FORMATS = {"cron": _cron, "timezone": _timezone}
+
+# Settings every connector reads (see sync_pools, sync_resilience, sync_throttle, sync_bulk, encryption)
+_CONNECTOR_COMMON = {
+    "type": {"type": "string", "enum": list(CONNECTOR_TYPES)},
+    "system_id": STRING,
+    "max_workers": {"type": "integer", "minimum": 1},
+    "pool": OPEN,
+    "pool_size": {"type": "integer", "minimum": 1},
+    "pool_timeout_seconds": {"type": "number", "minimum": 0},
+    "resilience": OPEN,
+    "throttle": OPEN,
+    "bulk_load": {"type": ["boolean", "object"]},
+    "encryption": OPEN,
+}
+
+_POSTGRES_TARGET = dict(_settings("dsn"), schema=STRING, idempotency_column=STRING, lineage_column=STRING)
+_ARCGIS = dict(_settings("url", "username", "password", "token", "token_url", "referer"),
+               timeout_seconds=NUMBER, token_minutes=INTEGER, srid=INTEGER, geometry_field=STRING,
+               geometry_format=STRING, verify_ssl=BOOLEAN)
+_WAREHOUSE = {"stage": OPEN, "manifest_table": STRING, "schema_evolution": BOOLEAN, "idempotency_column": STRING,
+              "lineage_column": STRING}
+
+# Settings of each connector type, besides the common ones
+CONNECTOR_SETTINGS = {
+    "sqlserver": dict(_settings("host", "port", "database", "user", "password"), driver=STRING,
+                      trust_server_certificate=BOOLEAN),
+    "oracle": dict(_settings("dsn", "host", "port", "service_name", "user", "password"), schema=STRING,
+                   lowercase_columns=BOOLEAN),
+    "postgres": dict(_settings("dsn"), schema=STRING),
+    "postgis": dict(_settings("dsn"), schema=STRING, srid=INTEGER),
+    "postgres_staging": _POSTGRES_TARGET,
+    "postgis_target": dict(_POSTGRES_TARGET, default_srid=INTEGER),
+    "sqlite_staging": dict(_settings("path"), idempotency_column=STRING, lineage_column=STRING),
+    "arcgis": _ARCGIS,
+    "arcgis_target": _ARCGIS,
+    "filegdb": dict(_settings("path"), srid=INTEGER, geometry_field=STRING),
+    "rest": dict(_settings("base_url", "username", "password"), headers=_map(STRING), params=OPEN, resources=OPEN,
+                 page_size={"type": "integer", "minimum": 1}, rate_limit=OPEN, timeout_seconds=NUMBER,
+                 clock_skew_seconds=NUMBER, health_path=STRING, verify_ssl=BOOLEAN),
+    "file_drop": dict(_settings("path"), resources=OPEN, settle_seconds=NUMBER),
+    "snowflake": dict(_WAREHOUSE, **_settings("account", "user", "password", "private_key_path",
+                                              "private_key_passphrase"),
+                      database=STRING, schema=STRING, stage_name=STRING, warehouse=STRING, role=STRING),
+    "bigquery": dict(_WAREHOUSE, **_settings("project", "credentials_path"), dataset=STRING, location=STRING),
+}
+
+CONNECTOR_SCHEMA = {
+    "type": "object",
+    "required": ["type"],
+    "variants": {
+        # REST header and parameter templates may name any further setting
+        name: _object(dict(_CONNECTOR_COMMON, **settings), additional=(
+            {"type": ["string", "integer"]} if name == "rest" else False))
+        for name, settings in CONNECTOR_SETTINGS.items()
+    },
+}
+
+TABLE_SCHEMA = _object({
+    "name": STRING,
+    "primary_key": {"type": ["string", "array"], "items": STRING},
+    "target_table": STRING,
+    "change_tracking": {"type": ["string", "null"], "enum": CHANGE_TRACKING_METHODS + [None]},
+    "rowversion_column": STRING,
+    "change_column": STRING,
+    "capture_instance": STRING,
+    "timestamp_column": STRING,
+    "target_change_column": STRING,
+    "depends_on": STRINGS,
+    "bulk_load": BOOLEAN,
+    "push_only": BOOLEAN,
+}, required=("name", "primary_key"))
+
+SYNC_PAIR_SCHEMA = _object({
+    "sync_pair_id": STRING,
+    "name": STRING,
+    "description": STRING,
+    "vendor": _object({"type": STRING}, required=("type",), additional=True),
+    "entities": _map(_object({"template": {"type": ["string", "null"]}, "tables": _map(OPEN),
+                              "parcels": _object({"table": STRING, "fields": STRINGS}, required=("table",)),
+                              "unmapped_columns": {"type": "string", "enum": ["drop", "keep"]}},
+                             required=("parcels",), additional=True)),
+    "source": CONNECTOR_SCHEMA,
+    "target": CONNECTOR_SCHEMA,
+    "tables": {"type": "array", "items": TABLE_SCHEMA},
+    "batch_size": {"type": "integer", "minimum": 1},
+    "default_mode": {"type": "string", "enum": ["full", "incremental"]},
+    "direction": {"type": "string", "enum": ["source_to_target", "bidirectional"]},
+    "conflict_strategy": {"type": "string", "enum": list(CONFLICT_STRATEGIES)},
+    "field_mapping": STRING,
+    "hooks": {"type": "array", "items": _object({"type": STRING, "tables": STRINGS, "options": OPEN},
+                                                required=("type",))},
+    "filters": {"type": "array", "items": _object({"expression": STRING, "tables": STRINGS,
+                                                   "on_exclude": {"type": "string", "enum": EXCLUDE_ACTIONS}},
+                                                  required=("expression",))},
+    "cdc": _object({"enabled": BOOLEAN, "poll_seconds": {"type": "number", "minimum": 0}, "tables": STRINGS}),
+    "snapshot": _object({"enabled": BOOLEAN, "keep": {"type": "integer", "minimum": 1},
+                         "validations": {"type": "array", "items": _object({"type": STRING}, ("type",), True)}}),
+    "merge": _object({"sources": {"type": "array", "items": _object({
+        "name": STRING, "connector": CONNECTOR_SCHEMA, "tables": {"type": "array", "items": OPEN},
+    }, required=("name", "connector", "tables"))}}),
+    "validation": OPEN,
+    "geometry_repair": OPEN,
+    "address_standardization": OPEN,
+    "topology_qa": OPEN,
+    "anomalies": OPEN,
+    "events": OPEN,
+    "odata": OPEN,
+    "graphql": OPEN,
+    "open_data": OPEN,
+    "ingestion": OPEN,
+    "freshness_slo": OPEN,
+    "roll_years": _object({"current_year": {"type": "integer", "minimum": 1900}, "tables": STRINGS,
+                           "year_table": STRING}, required=("current_year",)),
+    "schedules": {"type": "array", "items": _object({
+        "name": STRING, "cron": {"type": "string", "format": "cron"},
+        "timezone": {"type": "string", "format": "timezone"}, "mode": {"type": "string", "enum": ["full", "incremental"]}, "tables": STRINGS,
+        "catch_up": {"type": "string", "enum": ["latest", "all", "skip"]}, "parameters": OPEN,
+    }, required=("cron",))},
+}, required=("sync_pair_id", "source", "target"))
+
+_WINDOW = _object({"days": STRINGS, "start": STRING, "end": STRING})
+
+COUNTY_SCHEMA = _object({
+    "county_id": STRING,
+    "county_friendly_name": STRING,
+    "legacy_system_type": STRING,
+    "timezone": {"type": "string", "format": "timezone"},
+    "configuration_version": STRING,
+    "last_updated": STRING,
+    "contact": OPEN,
+    "data_ingestion_settings": _object({
+        "pacs_db_host_env_var": STRING, "pacs_db_port_env_var": STRING, "pacs_db_name_env_var": STRING,
+        "pacs_db_user_env_var": STRING, "pacs_db_password_env_var": STRING, "mapping_file_path": STRING,
+        "sync_schedule_cron": {"type": "string", "format": "cron"}, "enable_cdc": BOOLEAN,
+    }),
+    "sync_pairs": {"type": "array", "items": SYNC_PAIR_SCHEMA},
+    "rbac_settings": _object({
+        "user_definitions_path": STRING,
+        "roles": _map(_object({"description": STRING, "permissions": STRINGS})),
+    }),
+    "network_policy": _object({
+        "allow": STRINGS,
+        "write_hours": _object({"timezone": {"type": "string", "format": "timezone"},
+                                "windows": {"type": "array", "items": _WINDOW}}),
+    }),
+    "alerting": _object({
+        "notifiers": _map(_object({"type": STRING}, required=("type",), additional=True)),
+        "rules": {"type": "array", "items": _object({"name": STRING, "type": STRING}, ("name", "type"), True)},
+    }),
+    "job_retention": _object({
+        "keep_days": {"type": "number", "minimum": 0},
+        "failed_keep_days": {"type": "number", "minimum": 0},
+        "keep_last": {"type": "integer", "minimum": 0},
+        "archive": {"type": ["boolean", "object"]},
+    }),
+    "redaction": _object({
+        "policies": _map(_object({"fields": {"type": ["array", "object"]}, "mode": STRING, "mask": STRING})),
+        "roles": _map(STRING),
+        "services": _map(STRING),
+    }),
+    # Provider settings vary by provider; the load checks them
+    "ai": _object({"provider": STRING, "redaction": {"type": ["string", "array"], "items": STRING},
+                   "redact_patterns": STRINGS}, required=("provider",), additional=True),
+    "features": _map(BOOLEAN),
+    "tenant_quotas": _object({name: {"type": "integer", "minimum": 0} for name in (
+        "max_queued_sync_jobs", "max_running_sync_jobs", "max_running_exports", "export_storage_mb",
+        "requests_per_minute")}),
+    # Plugins and the dashboard own their settings
+    "plugin_settings": OPEN,
+    "ui_settings": OPEN,
+}, required=("county_id",))
+
+# A county's overrides file (see county_overrides); its overrides are checked laid over the county file
+OVERRIDES_SCHEMA = _object({"overrides": OPEN, "features": _map(BOOLEAN), "updated_at": STRING, "updated_by": STRING})
+
+MAPPING_SCHEMA = _object({
+    "lookups": _map(OPEN),
+    "reference_lookups": _map(OPEN),
+    "tables": _map(_object({
+        "unmapped_columns": {"type": "string", "enum": ["drop", "keep"]},
+        "fields": {"type": "array", "items": _object({
+            "source": STRING, "path": STRING, "target": STRING,
+            "type": {"type": "string", "enum": FIELD_TYPES},
+            "lookup": STRING, "default": {}, "format": STRING, "description": STRING,
+        }, required=("target",))},
+    })),
+})
+
+_TYPE_NAMES = {dict: "object", list: "array", str: "string", bool: "boolean", int: "integer", float: "number",
+               type(None): "null"}
+
+
+def _is_type(value: Any, name: str) -> bool:
+    actual = _TYPE_NAMES.get(type(value))
+    return actual == name or (name == "number" and actual == "integer")
+
+
+def check_schema(value: Any, schema: Dict[str, Any], path: Path = ()) -> Iterator[Tuple[Path, str]]:
+    """The (path, message) of every way a document differs from a schema."""
+    label = format_path(path) or "the document"
+    expected = schema.get("type")
+    if expected is not None:
+        names = [expected] if isinstance(expected, str) else expected
+        if not any(_is_type(value, name) for name in names):
+            yield path, f"{label} must be {' or '.join(names)}, not {_TYPE_NAMES.get(type(value), 'unknown')}"
+            return
+    if "enum" in schema and value not in schema["enum"]:
+        choices = ", ".join(str(choice) for choice in schema["enum"] if choice is not None)
+        yield path, f"{label} must be one of {choices}, not {value!r}"
+        return
+    if "minimum" in schema and isinstance(value, (int, float)) and not isinstance(value, bool) \
+            and value < schema["minimum"]:
+        yield path, f"{label} must be at least {schema['minimum']}"
+    if "format" in schema and isinstance(value, str):
+        message = _FORMATS[schema["format"]](value)
+        if message:
+            yield path, f"{label}: {message}"
+    if isinstance(value, dict):
+        if "variants" in schema:
+            if value.get("type") not in schema["variants"]:
+                yield path + ("type",), (f"{label}.type must be one of {', '.join(schema['variants'])}, "
+                                         f"not {value.get('type')!r}")
+                return
+            schema = dict(schema["variants"][value["type"]], required=schema.get("required", []))
+        properties = schema.get("properties", {})
+        for name in schema.get("required", []):
+            if name not in value:
+                yield path, f"{label} is missing required key {name}"
+        additional = schema.get("additionalProperties", True)
+        for name, member in value.items():
+            if name in properties:
+                yield from check_schema(member, properties[name], path + (name,))
+            elif additional is False:
+                close = difflib.get_close_matches(name, list(properties), n=1)
+                hint = f"; did you mean {close[0]}?" if close else ""
+                yield path + (name,), f"Unknown key {name} in {label}{hint}"
+            elif isinstance(additional, dict):
+                yield from check_schema(member, additional, path + (name,))
+    if isinstance(value, list) and "items" in schema:
+        for index, item in enumerate(value):
+            yield from check_schema(item, schema["items"], path + (index,))
+
+
+# Validation ---------------------------------------------------------------
+
+class ConfigReport:
+    """The issues found in a configuration, each with the file and position it was found at."""
+
+    def __init__(self):
+        self.issues: List[Dict[str, Any]] = []
+        self.files: List[str] = []
+
+    def add(self, level: str, file: str, message: str, path: Path = (),
+            positions: Optional[Dict[Path, Tuple[int, int]]] = None, line: Optional[int] = None,
+            column: Optional[int] = None) -> None:
+        """Record an issue; its line and column are those of the nearest located part of its path."""
+        if positions is not None and line is None:
+            located = path
+            while located not in positions and located:
+                located = located[:-1]
+            line, column = positions.get(located, (None, None))
+        self.issues.append({"level": level, "file": file, "line": line, "column": column,
+                            "path": format_path(path) or None, "message": message})
+
+    def to_dict(self) -> Dict[str, Any]:
+        errors = sum(1 for issue in self.issues if issue["level"] == ERROR)
+        return {"valid": errors == 0, "files": self.files, "errors": errors,
+                "warnings": len(self.issues) - errors, "issues": self.issues}
+
+
+def _read_json(report: ConfigReport, path: str) -> Tuple[Optional[Any], Dict[Path, Tuple[int, int]]]:
+    """A JSON file and the positions of its values; (None, {}) after reporting why it cannot be read."""
+    report.files.append(path)
+    try:
+        with open(path, "r") as f:
+            text = f.read()
+        return json.loads(text), locate(text)
+    except json.JSONDecodeError as e:
+        report.add(ERROR, path, f"Invalid JSON: {e.msg}", line=e.lineno, column=e.colno)
+    except OSError as e:
+        report.add(ERROR, path, f"Cannot read the file: {e}")
+    return None, {}
+
+
+def validate_configuration(config_dir: str = "county_configs", county_id: Optional[str] = None,
+                           schedules: bool = True) -> Dict[str, Any]:
+    """
+    Check the environment, authentication, county configuration files, their
+    mapping files and the stored schedules.
+
+    Args:
+        config_dir: Directory containing county configuration folders
+        county_id: Only check this county's file (and the environment)
+        schedules: Whether to check the schedules in the sync state store
+
+    Returns:
+        Dictionary with valid, files, errors, warnings and the issues found
+    """
+    from sync_pairs import SyncPairRegistry
+    report = ConfigReport()
+    check_environment(report)
+    check_profiles(report)
+    check_auth(report)
+    registry = SyncPairRegistry(config_dir)
+    pairs: Dict[str, str] = {}
+    if not os.path.isdir(config_dir):
+        report.add(ERROR, config_dir, "County configuration directory does not exist")
+    else:
+        for name in sorted(os.listdir(config_dir)):
+            path = os.path.join(config_dir, name, f"{name}_config.json")
+            if os.path.exists(path) and county_id in (None, name):
+                check_county_file(report, registry, name, path, pairs)
+    if schedules:
+        check_schedules(report, registry, county_id)
+    return report.to_dict()
+
+
+def check_environment(report: ConfigReport) -> None:
+    from config_validator import TerraFusionConfigValidator
+    result = TerraFusionConfigValidator().validate_configuration()
+    for error in result.errors:
+        report.add(ERROR, "environment", error)
+    for warning in result.warnings:
+        report.add(WARNING, "environment", warning)
+
+
+def check_profiles(report: ConfigReport) -> None:
+    """Each configuration profile's chain: the profiles it extends exist and do not loop."""
+    from config_profiles import list_profiles
+    for profile in list_profiles():
+        if profile["error"]:
+            report.add(ERROR, profile["path"], profile["error"])
+
+
+def check_auth(report: ConfigReport) -> None:
+    """The authentication backend's settings, and the roles they map users to."""
+    from rbac_manager import AUTH_BACKENDS, RBAC_ROLES
+    from mfa import MFA_REQUIRED_ROLES
+    backend = os.environ.get("AUTH_BACKEND", "local").lower()
+    if backend not in AUTH_BACKENDS:
+        report.add(ERROR, "environment", f"AUTH_BACKEND must be one of {', '.join(AUTH_BACKENDS)}, not {backend}")
+        return
+    for role in MFA_REQUIRED_ROLES:
+        if role not in RBAC_ROLES:
+            report.add(WARNING, "environment", f"MFA_REQUIRED_ROLES names unknown role {role}")
+    if backend == "local":
+        return
+    prefix = backend.upper()
+    try:
+        if backend == "ldap":
+            from ldap_auth import LDAPAuthenticator
+            authenticator, needed = LDAPAuthenticator(), "LDAP_URL and LDAP_USER_BASE_DN"
+        else:
+            from oidc_auth import OIDCAuthenticator
+            authenticator, needed = OIDCAuthenticator(), "OIDC_ISSUER, OIDC_CLIENT_ID and OIDC_REDIRECT_URI"
+    except ValueError as e:
+        # Includes a group role map that is not JSON
+        report.add(ERROR, "environment", f"AUTH_BACKEND={backend}: {e}")
+        return
+    if not authenticator.configured:
+        report.add(ERROR, "environment", f"AUTH_BACKEND={backend} needs {needed}")
+    if not authenticator.group_roles:
+        report.add(WARNING, "environment", f"{prefix}_GROUP_ROLE_MAP is empty, so no {backend} user can sign in")
+    for group, role in authenticator.group_roles.items():
+        if role not in RBAC_ROLES:
+            report.add(ERROR, "environment", f"{prefix}_GROUP_ROLE_MAP maps {group} to unknown role {role}")
+
+
+def check_county_file(report: ConfigReport, registry, name: str, path: str, pairs: Dict[str, str]) -> None:
+    """
+    A county configuration file against the schema, then its blocks as the
+    services load them.
+
+    Args:
+        registry: Sync pair registry of the configuration directory
+        pairs: Files of the sync pair IDs seen so far, to report IDs used twice
+    """
+    config, positions = _read_json(report, path)
+    if config is None:
+        return
+    for issue_path, message in check_schema(config, COUNTY_SCHEMA):
+        report.add(ERROR, path, message, issue_path, positions)
+    if not isinstance(config, dict):
+        return
+    if config.get("county_id") not in (None, name):
+        report.add(ERROR, path, f"county_id {config['county_id']} differs from its folder {name}", ("county_id",),
+                   positions)
+    config = check_overrides_file(report, path, config)
+    unknown = [feature for feature in config.get("features") or {} if feature not in FEATURES]
+    if unknown:
+        report.add(ERROR, path, f"Unknown features {', '.join(unknown)}; features: {', '.join(FEATURES)}",
+                   ("features",), positions)
+
+    config_dir = registry.config_dir
+    county_dir = os.path.join(config_dir, name)
+    definitions = config.get("sync_pairs") if isinstance(config.get("sync_pairs"), list) else []
+    for index, definition in enumerate(definitions):
+        if not isinstance(definition, dict):
+            continue
+        where = ("sync_pairs", index)
+        sync_pair_id = definition.get("sync_pair_id")
+        if sync_pair_id in pairs:
+            elsewhere = "earlier in the file" if pairs[sync_pair_id] == path else f"in {pairs[sync_pair_id]}"
+            report.add(ERROR, path, f"Sync pair {sync_pair_id} is also defined {elsewhere}",
+                       where + ("sync_pair_id",), positions)
+        elif sync_pair_id:
+            pairs[sync_pair_id] = path
+        if isinstance(definition.get("field_mapping"), str):
+            check_mapping_file(report, os.path.join(county_dir, definition["field_mapping"]))
+        try:
+            registry.parse_sync_pair(dict(config, county_id=name), definition, county_dir)
+        except Exception as e:
+            report.add(ERROR, path, f"Sync pair {sync_pair_id}: {e}", where, positions)
+
+    from network_policy import CountyNetworkPolicy
+    from alerting import CountyAlerting
+    from redaction import RedactionSettings
+    from job_retention import JobRetention
+    from tenant_quotas import parse_quotas
+    from ai_providers import AISettings
+    loaders = {
+        "network_policy": lambda block: CountyNetworkPolicy(name, block),
+        "alerting": lambda block: CountyAlerting(name, block),
+        "redaction": lambda block: RedactionSettings(name, block),
+        "job_retention": lambda block: JobRetention(None, None, config_dir).policy(name),
+        "tenant_quotas": lambda block: parse_quotas(name, block),
+        "ai": lambda block: AISettings(name, block),
+    }
+    for block, load in loaders.items():
+        if config.get(block) is None:
+            continue
+        try:
+            load(config[block])
+        except (ValueError, TypeError, KeyError) as e:
+            report.add(ERROR, path, str(e), (block,), positions)
+
+
+def check_overrides_file(report: ConfigReport, path: str, config: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    The overrides file of a county file, if it has one, against its schema,
+    and the county file with the overrides laid over it against the county
+    schema. Returns the county configuration the services will load.
+    """
+    overrides_file = overrides_path(path)
+    if not os.path.exists(overrides_file):
+        return config
+    overlay, positions = _read_json(report, overrides_file)
+    if overlay is None:
+        return config
+    problems = list(check_schema(overlay, OVERRIDES_SCHEMA))
+    for issue_path, message in problems:
+        report.add(ERROR, overrides_file, message, issue_path, positions)
+    if problems:
+        return config
+    try:
+        merged = apply_overrides(config, overlay)
+    except ValueError as e:
+        report.add(ERROR, overrides_file, str(e), ("overrides",), positions)
+        return config
+    for issue_path, message in check_schema(merged, COUNTY_SCHEMA):
+        report.add(ERROR, overrides_file, f"With the overrides, {message[0].lower()}{message[1:]}",
+                   ("overrides",) + issue_path, positions)
+    return merged
+
+
+def check_mapping_file(report: ConfigReport, path: str) -> None:
+    """A JSON field mapping file against the schema; YAML files and its contents are checked as sync pairs load."""
+    if path in report.files or not path.endswith(".json") or not os.path.exists(path):
+        return
+    mapping, positions = _read_json(report, path)
+    if mapping is None:
+        return
+    for issue_path, message in check_schema(mapping, MAPPING_SCHEMA):
+        report.add(ERROR, path, message, issue_path, positions)
+
+
+def check_schedules(report: ConfigReport, registry, county_id: Optional[str] = None) -> None:
+    """Stored schedules whose sync pair, tables, cron expression or time zone no longer hold."""
+    from sync_scheduler import SCHEDULES_COLLECTION, CATCH_UP_POLICIES
+    from sync_store import sync_state_store
+    try:
+        schedules = sync_state_store.list(SCHEDULES_COLLECTION)
+    except Exception as e:
+        report.add(WARNING, "schedules", f"Cannot read the stored schedules: {e}")
+        return
+    for schedule in schedules:
+        if county_id not in (None, schedule.get("county_id")) or schedule.get("status") == "DELETED":
+            continue
+        subject = f"schedule {schedule['schedule_id']}"
+        problems = []
+        try:
+            pair = registry.get(schedule["sync_pair_id"])
+            for table in schedule.get("tables") or []:
+                pair.get_table(table)
+        except KeyError as e:
+            problems.append(str(e.args[0]))
+        message = _cron(schedule.get("cron", "")) or _timezone(schedule.get("timezone", "UTC"))
+        if message:
+            problems.append(message)
+        if schedule.get("catch_up", "latest") not in CATCH_UP_POLICIES:
+            problems.append(f"Unsupported catch_up policy: {schedule['catch_up']}")
+        for problem in problems:
+            report.add(ERROR, subject, f"{schedule['sync_pair_id']} ({schedule.get('cron')}): {problem}")
+
+
+def format_report(report: Dict[str, Any]) -> str:
+    """A validation report as compiler-style lines, then a summary."""
+    lines = []
+    for issue in report["issues"]:
+        where = issue["file"]
+        if issue["line"] is not None:
+            where += f":{issue['line']}:{issue['column']}"
+        suffix = f" ({issue['path']})" if issue["path"] and issue["path"] not in issue["message"] else ""
+        lines.append(f"{where}: {issue['level']}: {issue['message']}{suffix}")
+    outcome = "valid" if report["valid"] else "invalid"
+    lines.append(f"Configuration is {outcome}: {len(report['files'])} file(s), {report['errors']} error(s), "
+                 f"{report['warnings']} warning(s)")
+    return "\n".join(lines)
+
+
+# Explain ------------------------------------------------------------------
+
+def mask(value: Any) -> Any:
+    """A configuration with the values of sensitive settings masked; *_env_var and *_secret references are kept."""
+    if isinstance(value, dict):
+        masked = {}
+        for name, member in value.items():
+            if isinstance(member, str) and name.lower() in SENSITIVE_SETTINGS:
+                masked[name] = _DSN_PASSWORD.sub(rf"\1{MASK}@", member) if name.lower() == "dsn" else MASK
+            else:
+                masked[name] = mask(member)
+        return masked
+    if isinstance(value, list):
+        return [mask(item) for item in value]
+    return value
+
+
+def explain_configuration(config_dir: str = "county_configs", county_id: Optional[str] = None,
+                          sync_pair_id: Optional[str] = None) -> Dict[str, Any]:
+    """
+    The configuration as the services load it, with defaults filled in.
+
+    Args:
+        config_dir: Directory containing county configuration folders
+        county_id: Only this county
+        sync_pair_id: Only this sync pair (and its county)
+
+    Raises:
+        KeyError: If the county or sync pair is not configured
+    """
+    from config_validator import TerraFusionConfigValidator
+    from sync_pairs import SyncPairRegistry
+    from job_retention import JobRetention
+    from config_profiles import setting_source, PROFILE_SETTING
+    validator = TerraFusionConfigValidator()
+    result = validator.validate_configuration()
+    specs = dict(validator.required_configs, **validator.optional_configs)
+    environment = {
+        key: {"value": validator._mask_sensitive_value(key, str(value)) if value is not None else None,
+              "source": setting_source(key) if os.environ.get(key) else "default"}
+        for key, value in result.config.items() if key in specs
+    }
+
+    registry = SyncPairRegistry(config_dir)
+    if sync_pair_id is not None:
+        county_id = registry.get(sync_pair_id).county_id
+    schedules = _stored_schedules()
+    counties = {}
+    for name in sorted(os.listdir(config_dir)) if os.path.isdir(config_dir) else []:
+        path = os.path.join(config_dir, name, f"{name}_config.json")
+        if not os.path.exists(path) or county_id not in (None, name):
+            continue
+        config = load_county_config(path)
+        county = {key: value for key, value in config.items() if key not in ("sync_pairs", "job_retention")}
+        county["file"] = path
+        if os.path.exists(overrides_path(path)):
+            county["overrides_file"] = overrides_path(path)
+        county.setdefault("timezone", "UTC")
+        try:
+            county["job_retention"] = JobRetention(None, None, config_dir).policy(name)
+        except ValueError as e:
+            county["job_retention"] = {"error": str(e)}
+        county["sync_pairs"] = {}
+        for pair in registry.list(name):
+            if sync_pair_id in (None, pair.sync_pair_id):
+                effective = dataclasses.asdict(pair)
+                effective["schedules"] = schedules.get(pair.sync_pair_id, [])
+                county["sync_pairs"][pair.sync_pair_id] = effective
+        if path in registry.load_errors:
+            county["load_error"] = registry.load_errors[path]
+        counties[name] = mask(county)
+    if county_id is not None and county_id not in counties:
+        raise KeyError(f"County {county_id} is not configured in {config_dir}")
+    return {"profile": os.environ.get(PROFILE_SETTING), "environment": environment, "auth": _auth_settings(),
+            "counties": counties}
+
+
+def _stored_schedules() -> Dict[str, List[Dict[str, Any]]]:
+    """The stored schedules of each sync pair, as explain prints them."""
+    from sync_scheduler import SCHEDULES_COLLECTION
+    from sync_store import sync_state_store
+    schedules: Dict[str, List[Dict[str, Any]]] = {}
+    try:
+        stored = sync_state_store.list(SCHEDULES_COLLECTION)
+    except Exception as e:
+        logger.warning(f"Cannot read the stored schedules: {e}")
+        return schedules
+    for schedule in stored:
+        schedules.setdefault(schedule["sync_pair_id"], []).append({
+            name: schedule.get(name) for name in ("schedule_id", "cron", "timezone", "mode", "tables", "catch_up",
+                                                  "status", "next_run_at")
+        })
+    return schedules
+
+
+def _auth_settings() -> Dict[str, Any]:
+    """The authentication backend and its settings."""
+    backend = os.environ.get("AUTH_BACKEND", "local").lower()
+    settings = {"backend": backend,
+                "mfa_required_roles": os.environ.get("MFA_REQUIRED_ROLES", "admin,manager").split(",")}
+    prefix = f"{backend.upper()}_"
+    if backend in ("ldap", "oidc"):
+        settings.update({key[len(prefix):].lower(): value for key, value in sorted(os.environ.items())
+                         if key.startswith(prefix)})
+    return mask(settings)
@@ -0,0 +1,422 @@
+"""
+TerraFusion Platform - County Overrides and Feature Flags
+
+This module lets an instance hosting several counties (see tenancy) change
+one county's configuration, and turn its modules on and off, at runtime and
+through the admin API rather than by editing and shipping its county file.
+
+A county's overrides are kept next to its configuration file, in
+county_configs/<county>/<county>_overrides.json, and laid over the file
+wherever the file is read (sync pairs, exports, network policy, redaction,
+alerting, retention and quotas):
+
+    {
+      "overrides": {
+        "timezone": "America/Los_Angeles",
+        "sync_pairs": {
+          "benton_wa_pacs_staging": {"field_mapping": "mappings/benton_wa_2026.json",
+                                     "schedules": [{"name": "nightly", "cron": "0 3 * * *"}]}
+        },
+        "plugin_settings": {"gis_export": {"default_srid": 2927}}
+      },
+      "features": {"gis_export": false},
+      "updated_at": "...", "updated_by": "..."
+    }
+
+Overrides are a JSON merge patch (RFC 7386) of the county file: objects
+merge, other values replace, and null removes a key. "sync_pairs" is an
+object of patches by sync pair ID instead of the file's list, so one sync
+pair's mapping or schedules change without repeating the others.
+
+Feature flags (see FEATURES) switch API modules on or off per county; a
+request naming a county with a module off is refused with 403, and
+scheduled syncs and CDC polls of a county with scheduled_sync or cdc off are
+skipped. A flag is on unless the county's overrides, then the "features"
+block of its file, turn it off, or it is listed in DISABLED_FEATURES (off in
+every county that does not turn it on):
+
+    DISABLED_FEATURES=gis_export     # then "features": {"gis_export": true} in one county
+
+Admins manage both under /api/v1/admin/counties/<county_id>/overrides and
+/api/v1/admin/counties/<county_id>/features/<feature>; GET
+/api/v1/counties/<county_id>/features lists a county's flags for anyone who
+may read it. Saved overrides are checked against the county file schema
+and applied with a configuration reload (see config_reload); overrides the
+reload refuses are put back as they were.
+"""
+
+import os
+import copy
+import json
+import logging
+import threading
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Iterable, Tuple
+
+from audit_log import AuditLog, audit_log
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Name of a county's overrides file, after its county ID
+OVERRIDES_SUFFIX = "_overrides.json"
+
+# Modules a county can turn on or off, and the API endpoints of each
+FEATURES = {
+    "gis_export": {"description": "GIS exports and parcel reports",
+                   "endpoints": ["list_export_jobs", "create_export_job", "get_export_job", "get_export_job_summary",
+                                 "cancel_export_job", "deliver_export_job", "download_export", "get_parcel_report"]},
+    "map_tiles": {"description": "Vector map tiles", "endpoints": ["get_map_tile", "get_tilejson", "invalidate_tiles"]},
+    "scheduled_sync": {"description": "Sync schedules and their runs",
+                       "endpoints": ["list_sync_schedules", "create_sync_schedule", "get_sync_schedule",
+                                     "delete_sync_schedule", "pause_sync_schedule", "resume_sync_schedule"]},
+    "cdc": {"description": "Change data capture listeners",
+            "endpoints": ["list_cdc_listeners", "pause_cdc_listener", "resume_cdc_listener"]},
+    "spreadsheet_import": {"description": "Spreadsheet imports",
+                           "endpoints": ["create_sync_import", "list_sync_imports", "sync_import",
+                                         "preview_sync_import", "commit_sync_import"]},
+    "open_data": {"description": "Open data publishing",
+                  "endpoints": ["list_open_data_datasets", "get_open_data_dataset", "publish_open_data_dataset"]},
+    "odata": {"description": "OData feeds", "endpoints": ["get_odata_service_document", "get_odata_resource"]},
+    "graphql": {"description": "GraphQL queries", "endpoints": ["query_sync_graphql", "get_sync_graphql_schema"]},
+    "record_streams": {"description": "Record streams", "endpoints": ["stream_records"]},
+    "record_ingest": {"description": "Record pushes", "endpoints": ["ingest_sync_records"]},
+    "webhooks": {"description": "Webhooks",
+                 "endpoints": ["list_webhooks", "create_webhook", "get_webhook", "update_webhook", "delete_webhook",
+                               "rotate_webhook_secret", "list_webhook_deliveries", "get_webhook_delivery",
+                               "redeliver_webhook"]},
+    "ai_analysis": {"description": "NarratorAI analysis",
+                    "endpoints": ["ai_analyze_gis_export", "ai_analyze_sync_operation"]},
+}
+
+# Features off in every county that does not turn them on
+DISABLED_FEATURES = [name.strip() for name in os.environ.get("DISABLED_FEATURES", "").split(",") if name.strip()]
+
+# Feature of each endpoint
+_ENDPOINT_FEATURES = {endpoint: name for name, feature in FEATURES.items() for endpoint in feature["endpoints"]}
+
+
+class FeatureDisabled(PermissionError):
+    """Raised when a county has a feature off."""
+
+    def __init__(self, county_id: str, feature: str):
+        super().__init__(f"{FEATURES[feature]['description']} ({feature}) are not enabled for county {county_id}")
+        self.county_id = county_id
+        self.feature = feature
+
+
+def feature_of(endpoint: Optional[str]) -> Optional[str]:
+    """The feature an API endpoint belongs to; None for endpoints every county has."""
+    return _ENDPOINT_FEATURES.get(endpoint or "")
+
+
+def overrides_path(config_path: str) -> str:
+    """The overrides file of a county configuration file."""
+    return config_path[:-len("_config.json")] + OVERRIDES_SUFFIX if config_path.endswith("_config.json") \
+        else config_path + OVERRIDES_SUFFIX
+
+
+def merge_patch(target: Any, patch: Any) -> Any:
+    """A JSON merge patch (RFC 7386) applied to a copy of a document."""
+    if not isinstance(patch, dict):
+        return copy.deepcopy(patch)
+    merged = copy.deepcopy(target) if isinstance(target, dict) else {}
+    for key, value in patch.items():
+        if value is None:
+            merged.pop(key, None)
+        else:
+            merged[key] = merge_patch(merged.get(key), value)
+    return merged
+
+
+def apply_overrides(config: Dict[str, Any], overlay: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    A county configuration with an overrides document laid over it.
+
+    Raises:
+        ValueError: If the overrides patch a sync pair the file does not
+            declare, or change the county ID
+    """
+    overrides = dict(overlay.get("overrides") or {})
+    if overrides.get("county_id") not in (None, config.get("county_id")):
+        raise ValueError("Overrides cannot change the county_id")
+    pair_patches = overrides.pop("sync_pairs", None)
+    merged = merge_patch(config, overrides)
+    if isinstance(pair_patches, dict):
+        definitions = merged.get("sync_pairs") if isinstance(merged.get("sync_pairs"), list) else []
+        declared = [d.get("sync_pair_id") for d in definitions if isinstance(d, dict)]
+        unknown = [sync_pair_id for sync_pair_id in pair_patches if sync_pair_id not in declared]
+        if unknown:
+            raise ValueError(f"Overrides name sync pairs the county file does not declare: {', '.join(unknown)}")
+        merged["sync_pairs"] = [merge_patch(d, pair_patches[d["sync_pair_id"]])
+                                if isinstance(d, dict) and d.get("sync_pair_id") in pair_patches else d
+                                for d in definitions]
+    elif pair_patches is not None:
+        merged["sync_pairs"] = copy.deepcopy(pair_patches)
+    if overlay.get("features"):
+        merged["features"] = dict(merged.get("features") or {}, **overlay["features"])
+    return merged
+
+
+def read_overrides(config_path: str) -> Dict[str, Any]:
+    """The overrides document of a county configuration file; empty without one."""
+    path = overrides_path(config_path)
+    if not os.path.exists(path):
+        return {}
+    with open(path, "r") as f:
+        return json.load(f)
+
+
+def load_county_config(config_path: str) -> Dict[str, Any]:
+    """
+    A county configuration file with its overrides laid over it, as the
+    services read it.
+
+    Raises:
+        ValueError: If the file or its overrides are not valid JSON, or the
+            overrides do not apply
+    """
+    with open(config_path, "r") as f:
+        config = json.load(f)
+    overlay = read_overrides(config_path)
+    return apply_overrides(config, overlay) if overlay else config
+
+
+def county_config_path(config_dir: str, county_id: str) -> Optional[str]:
+    """The configuration file of a county in config_dir; None when it has none."""
+    # Requests may name the county "benton-wa" for the benton_wa configuration
+    for name in dict.fromkeys([county_id, county_id.replace("-", "_")]):
+        if os.path.basename(name) != name or name.startswith("."):
+            continue
+        path = os.path.join(config_dir, name, f"{name}_config.json")
+        if os.path.exists(path):
+            return path
+    return None
+
+
+def config_version(config_path: str) -> Tuple[float, Optional[float]]:
+    """What a cache of a county configuration is kept by: the times its file and its overrides last changed."""
+    path = overrides_path(config_path)
+    return os.path.getmtime(config_path), os.path.getmtime(path) if os.path.exists(path) else None
+
+
+class CountyOverrides:
+    """
+    Service class for county overrides and feature flags.
+
+    Overrides files are read when they change; saves replace them
+    atomically, so readers see either the old overrides or the new ones.
+    """
+
+    def __init__(self, config_dir: str = "county_configs", audit: Optional[AuditLog] = None):
+        self.config_dir = config_dir
+        self.audit_log = audit or audit_log
+        self._features: Dict[str, Any] = {}
+        self._lock = threading.Lock()
+
+    def config_path(self, county_id: str) -> str:
+        """
+        The configuration file of a county.
+
+        Raises:
+            KeyError: If the county is not configured
+        """
+        path = county_config_path(self.config_dir, county_id)
+        if path is None:
+            raise KeyError(f"County {county_id} is not configured in {self.config_dir}")
+        return path
+
+    def get(self, county_id: str) -> Dict[str, Any]:
+        """
+        A county's overrides document, and its configuration with them applied.
+
+        Raises:
+            KeyError: If the county is not configured
+            ValueError: If the overrides do not apply
+        """
+        from config_schema import mask
+        path = self.config_path(county_id)
+        overlay = read_overrides(path)
+        return {
+            "county_id": county_id,
+            "file": overrides_path(path),
+            "overrides": overlay.get("overrides") or {},
+            "features": overlay.get("features") or {},
+            "updated_at": overlay.get("updated_at"),
+            "updated_by": overlay.get("updated_by"),
+            "effective": mask(load_county_config(path)),
+        }
+
+    def features(self, county_id: str) -> Dict[str, Dict[str, Any]]:
+        """
+        Whether each feature is on in a county, and what decided it: the
+        county's "override", its "config" file, or the instance "default".
+
+        Raises:
+            KeyError: If the county is not configured
+            ValueError: If its file or overrides are not valid
+        """
+        path = self.config_path(county_id)
+        version = config_version(path)
+        with self._lock:
+            cached = self._features.get(path)
+        if cached is not None and cached[0] == version:
+            return cached[1]
+        with open(path, "r") as f:
+            configured = json.load(f).get("features") or {}
+        overridden = read_overrides(path).get("features") or {}
+        flags = {}
+        for name, feature in FEATURES.items():
+            if name in overridden:
+                enabled, source = overridden[name], "override"
+            elif name in configured:
+                enabled, source = configured[name], "config"
+            else:
+                enabled, source = name not in DISABLED_FEATURES, "default"
+            flags[name] = {"enabled": bool(enabled), "source": source, "description": feature["description"]}
+        with self._lock:
+            self._features[path] = (version, flags)
+        return flags
+
+    def enabled(self, county_id: Optional[str], feature: str) -> bool:
+        """Whether a county has a feature on; counties without a configuration file have the instance defaults."""
+        if not county_id:
+            return True
+        try:
+            return self.features(county_id)[feature]["enabled"]
+        except KeyError:
+            return feature not in DISABLED_FEATURES
+
+    def check(self, feature: Optional[str], county_ids: Iterable[Optional[str]]) -> None:
+        """
+        Refuse work of a feature in counties that have it off.
+
+        Raises:
+            FeatureDisabled: If one of the counties has the feature off
+            ValueError: If a county's file or overrides are not valid
+        """
+        if feature is None:
+            return
+        for county_id in dict.fromkeys(c for c in county_ids if c):
+            if not self.enabled(county_id, feature):
+                raise FeatureDisabled(county_id, feature)
+
+    def save(self, county_id: str, overrides: Optional[Dict[str, Any]] = None,
+             features: Optional[Dict[str, Any]] = None, username: str = "system") -> Dict[str, Any]:
+        """
+        Replace a county's overrides and feature flags.
+
+        Returns:
+            The previous overrides document, to restore() if the new one is refused
+
+        Raises:
+            KeyError: If the county is not configured
+            ValueError: If the overrides or flags are invalid, or the county
+                file with the overrides does not match its schema
+        """
+        from config_schema import COUNTY_SCHEMA, check_schema
+        if overrides is not None and not isinstance(overrides, dict):
+            raise ValueError("overrides must be an object (a merge patch of the county file)")
+        if features is not None and not isinstance(features, dict):
+            raise ValueError("features must be an object of feature names and true or false")
+        unknown = [name for name in features or {} if name not in FEATURES]
+        if unknown:
+            raise ValueError(f"Unknown features: {', '.join(unknown)}. Features: {', '.join(FEATURES)}")
+        if any(not isinstance(value, bool) for value in (features or {}).values()):
+            raise ValueError("Feature flags must be true or false")
+        path = self.config_path(county_id)
+        overlay = {"overrides": overrides or {}, "features": features or {}}
+        with open(path, "r") as f:
+            merged = apply_overrides(json.load(f), overlay)
+        problems = [message for _, message in check_schema(merged, COUNTY_SCHEMA)]
+        if problems:
+            raise ValueError(f"The county file with these overrides is invalid: {'; '.join(problems[:5])}")
+
+        previous = read_overrides(path)
+        overlay.update(updated_at=datetime.utcnow().isoformat(), updated_by=username)
+        self._write(path, overlay if overlay["overrides"] or overlay["features"] else None)
+        self.audit_log.record("county_overrides.updated", username, "county", county_id,
+                              {"overrides": sorted(overlay["overrides"]), "features": overlay["features"]},
+                              county_id=county_id)
+        logger.info(f"{username} updated the overrides of county {county_id}")
+        return previous
+
+    def set_feature(self, county_id: str, feature: str, enabled: Optional[bool],
+                    username: str = "system") -> Dict[str, Dict[str, Any]]:
+        """
+        Turn a feature on or off in a county, or back to its file and
+        instance default with None.
+
+        Returns:
+            The county's feature flags
+
+        Raises:
+            KeyError: If the county is not configured or the feature is unknown
+            ValueError: If enabled is not true, false or None
+        """
+        if feature not in FEATURES:
+            raise KeyError(f"Feature {feature} not found")
+        if enabled is not None and not isinstance(enabled, bool):
+            raise ValueError("enabled must be true, false or null")
+        overlay = read_overrides(self.config_path(county_id))
+        flags = dict(overlay.get("features") or {})
+        if enabled is None:
+            flags.pop(feature, None)
+        else:
+            flags[feature] = enabled
+        self.save(county_id, overlay.get("overrides"), flags, username)
+        return self.features(county_id)
+
+    def delete(self, county_id: str, username: str = "system") -> Dict[str, Any]:
+        """
+        Remove a county's overrides and feature flags.
+
+        Returns:
+            The removed overrides document
+
+        Raises:
+            KeyError: If the county is not configured or has no overrides
+        """
+        path = self.config_path(county_id)
+        previous = read_overrides(path)
+        if not previous:
+            raise KeyError(f"County {county_id} has no overrides")
+        self._write(path, None)
+        self.audit_log.record("county_overrides.deleted", username, "county", county_id, {}, county_id=county_id)
+        logger.info(f"{username} removed the overrides of county {county_id}")
+        return previous
+
+    def restore(self, county_id: str, previous: Dict[str, Any]) -> None:
+        """Put back the overrides document save() or delete() returned."""
+        self._write(self.config_path(county_id), previous or None)
+
+    def list(self) -> List[Dict[str, Any]]:
+        """The counties with overrides, and what they override."""
+        counties = []
+        for name in sorted(os.listdir(self.config_dir)) if os.path.isdir(self.config_dir) else []:
+            path = os.path.join(self.config_dir, name, f"{name}_config.json")
+            if not os.path.exists(path):
+                continue
+            overlay = read_overrides(path)
+            if overlay:
+                counties.append({"county_id": name, "overrides": sorted(overlay.get("overrides") or {}),
+                                 "features": overlay.get("features") or {}, "updated_at": overlay.get("updated_at"),
+                                 "updated_by": overlay.get("updated_by")})
+        return counties
+
+    @staticmethod
+    def _write(config_path: str, overlay: Optional[Dict[str, Any]]) -> None:
+        path = overrides_path(config_path)
+        if overlay is None:
+            if os.path.exists(path):
+                os.remove(path)
+            return
+        tmp_path = f"{path}.tmp"
+        with open(tmp_path, "w") as f:
+            json.dump(overlay, f, indent=2)
+        os.replace(tmp_path, path)
+
+
+# Create a singleton instance
+county_overrides = CountyOverrides()
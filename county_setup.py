@@ -0,0 +1,491 @@
+"""
+TerraFusion Platform - County Setup
+
+This module provides `terrafusion init`, the wizard a county administrator
+runs to set up a new sync pair without writing its configuration by hand:
+
+    terrafusion init                                   # asks for everything
+    terrafusion init --county franklin_wa --source-type sqlserver --env-file terrafusion.env
+    terrafusion init --county franklin_wa --table dbo.property --table dbo.owner --yes
+
+The wizard connects to the source database (its connection settings are
+kept in environment variables the configuration names, written to
+--env-file when one is given), lists the tables the connecting user can
+read and describes the ones selected from the database catalog. Each table
+gets its catalog primary key (asked for when it has none) and, where the
+source offers one, a change tracking method: a SQL Server rowversion column,
+or a last-modified column named like those in CHANGE_COLUMN_NAMES.
+
+The initial field mapping maps every column to a snake_case target field of
+the type its SQL type converts to (see sync_mapping), and adds the county_id.
+The county configuration file (created, or given the new sync pair) and the
+mapping file are written under county_configs/<county>/ and checked as
+`terrafusion config validate` checks them; when the check fails the files are
+restored as they were. Finally a test sync reads the first TEST_SYNC_RECORDS
+records of each table, runs them through the sync pair's hooks and mapping
+and writes them to the target, reporting what was rejected. The test sync
+stores no job or watermark, so the first real sync reads every table in full.
+"""
+
+import os
+import re
+import json
+import getpass
+import logging
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Callable
+
+from sync_connectors import create_connector, ConnectorError, DEFAULT_SQLITE_STAGING_PATH
+from sync_hooks import build_pipeline, HookContext
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Source types the wizard can introspect, with their connection settings (secret ones are not echoed)
+SOURCE_SETTINGS = {
+    "sqlserver": [("host", False), ("port", False), ("database", False), ("user", False), ("password", True)],
+    "oracle": [("host", False), ("port", False), ("service_name", False), ("user", False), ("password", True)],
+    "postgres": [("dsn", True)],
+}
+
+# Default ports of the source types
+SOURCE_PORTS = {"sqlserver": "1433", "oracle": "1521"}
+
+# Target types the wizard can configure
+TARGET_TYPES = ["postgres_staging", "sqlite_staging"]
+
+# Records of each table the test sync writes
+TEST_SYNC_RECORDS = 100
+
+# SQL types (lower case, without length or precision) by the mapping field type they convert to
+SQL_FIELD_TYPES = {
+    "integer": ["int", "integer", "bigint", "smallint", "tinyint", "int2", "int4", "int8", "serial", "bigserial"],
+    "decimal": ["decimal", "numeric", "money", "smallmoney", "number"],
+    "float": ["float", "real", "double precision", "binary_float", "binary_double", "float4", "float8"],
+    "boolean": ["bit", "boolean", "bool"],
+    "date": ["date"],
+    "datetime": ["datetime", "datetime2", "smalldatetime", "datetimeoffset", "timestamp",
+                 "timestamp without time zone", "timestamp with time zone", "timestamp with local time zone"],
+    "string": ["char", "varchar", "nchar", "nvarchar", "text", "ntext", "varchar2", "nvarchar2", "clob", "nclob",
+               "character", "character varying", "uuid", "uniqueidentifier", "citext"],
+}
+
+# SQL Server types of rowversion columns ("timestamp" is the old name of rowversion there)
+ROWVERSION_TYPES = ["rowversion", "timestamp"]
+
+# Last-modified column names suggested as a table's change_column
+CHANGE_COLUMN_NAMES = ["last_modified", "last_modified_date", "last_updated", "modified_date", "modified_at",
+                       "updated_at", "update_dt", "last_edited_date", "last_change_dt"]
+
+
+def field_type(sql_type: str) -> Optional[str]:
+    """The mapping field type a SQL type converts to; None for types left as read (binary, geometry and the like)."""
+    name = re.sub(r"\(.*\)", "", str(sql_type or "")).strip().lower()
+    for mapped, names in SQL_FIELD_TYPES.items():
+        if name in names:
+            return mapped
+    return None
+
+
+def target_name(name: str) -> str:
+    """A source column or table name as a snake_case staging name (PropID -> prop_id, dbo.Property -> property)."""
+    name = name.rsplit(".", 1)[-1]
+    name = re.sub(r"([a-z0-9])([A-Z])", r"\1_\2", name)
+    name = re.sub(r"([A-Z]+)([A-Z][a-z])", r"\1_\2", name)
+    return re.sub(r"[^0-9a-z]+", "_", name.lower()).strip("_") or "column"
+
+
+def suggest_change_tracking(source_type: str, description: Dict[str, Any]) -> Dict[str, Any]:
+    """The change tracking settings a table's columns allow; empty when only full reads are possible."""
+    for column in description["columns"]:
+        if source_type == "sqlserver" and str(column["type"]).lower() in ROWVERSION_TYPES:
+            return {"change_tracking": "rowversion", "rowversion_column": column["name"]}
+    for column in description["columns"]:
+        if column["name"].lower() in CHANGE_COLUMN_NAMES and field_type(column["type"]) in ("date", "datetime"):
+            return {"change_tracking": "change_column", "change_column": column["name"]}
+    return {}
+
+
+def table_definition(source_type: str, description: Dict[str, Any],
+                     primary_key: Optional[List[str]] = None) -> Dict[str, Any]:
+    """The sync pair table of a described source table."""
+    definition = {
+        "name": description["name"],
+        "target_table": target_name(description["name"]),
+        "primary_key": primary_key or description["primary_key"],
+    }
+    definition.update(suggest_change_tracking(source_type, description))
+    return definition
+
+
+def table_mapping(source_type: str, description: Dict[str, Any], county_id: str) -> Dict[str, Any]:
+    """
+    The initial field mapping of a described source table: every column under
+    its snake_case name, typed where its SQL type converts, and the county_id.
+    A SQL Server rowversion column is left out; it only tracks changes.
+    """
+    fields, targets = [], set()
+    for column in description["columns"]:
+        if source_type == "sqlserver" and str(column["type"]).lower() in ROWVERSION_TYPES:
+            continue
+        name = target_name(column["name"])
+        while name in targets:
+            name += "_"
+        targets.add(name)
+        field_def = {"source": column["name"], "target": name}
+        if field_type(column["type"]):
+            field_def["type"] = field_type(column["type"])
+        fields.append(field_def)
+    if "county_id" not in targets:
+        fields.append({"target": "county_id", "default": county_id})
+    return {"unmapped_columns": "drop", "fields": fields}
+
+
+def env_var_name(sync_pair_id: str, setting: str) -> str:
+    """Environment variable holding a connection setting of a sync pair's source."""
+    return f"{sync_pair_id}_{setting}".upper()
+
+
+def source_connector(source_type: str, sync_pair_id: str, schema: Optional[str] = None) -> Dict[str, Any]:
+    """A source connector configuration whose connection settings are read from environment variables."""
+    config = {"type": source_type}
+    for setting, _ in SOURCE_SETTINGS[source_type]:
+        config[f"{setting}_env_var"] = env_var_name(sync_pair_id, setting)
+    if source_type == "sqlserver":
+        config["driver"] = "ODBC Driver 18 for SQL Server"
+    if schema:
+        config["schema"] = schema
+    return config
+
+
+def target_connector(target_type: str, sqlite_path: Optional[str] = None) -> Dict[str, Any]:
+    """A staging target connector configuration."""
+    if target_type == "sqlite_staging":
+        return {"type": "sqlite_staging", "path": sqlite_path or DEFAULT_SQLITE_STAGING_PATH}
+    return {"type": "postgres_staging", "dsn_env_var": "DATABASE_URL", "schema": "staging"}
+
+
+def sync_pair_definition(sync_pair_id: str, name: str, source: Dict[str, Any], target: Dict[str, Any],
+                         tables: List[Dict[str, Any]], mapping_file: str) -> Dict[str, Any]:
+    """A sync pair definition; incremental by default when every table tracks changes."""
+    incremental = all(table.get("change_tracking") for table in tables)
+    return {
+        "sync_pair_id": sync_pair_id,
+        "name": name,
+        "source": source,
+        "target": target,
+        "default_mode": "incremental" if incremental else "full",
+        "field_mapping": mapping_file,
+        "tables": tables,
+    }
+
+
+def write_configuration(config_dir: str, county_config: Dict[str, Any], definition: Dict[str, Any],
+                        mapping: Dict[str, Any], replace: bool = False) -> Dict[str, Any]:
+    """
+    Write a sync pair into its county's configuration file, and its mapping
+    file, then check the county file as `terrafusion config validate` does.
+    When the check finds errors the files are restored as they were.
+
+    Args:
+        config_dir: Directory containing county configuration folders
+        county_config: The county's configuration, as loaded (or new)
+        definition: Sync pair definition, with its field_mapping relative to the county folder
+        mapping: Field mapping document
+        replace: Whether a sync pair or mapping file of the same name may be replaced
+
+    Returns:
+        The validation report (see config_schema), with the files written
+
+    Raises:
+        ValueError: If the sync pair or mapping file exists and replace is not set
+    """
+    from config_schema import ConfigReport, check_county_file
+    from sync_pairs import SyncPairRegistry
+
+    county_id = county_config["county_id"]
+    county_dir = os.path.join(config_dir, county_id)
+    config_path = os.path.join(county_dir, f"{county_id}_config.json")
+    mapping_path = os.path.join(county_dir, definition["field_mapping"])
+    pairs = [p for p in county_config.get("sync_pairs", []) if p.get("sync_pair_id") != definition["sync_pair_id"]]
+    if not replace:
+        if len(pairs) != len(county_config.get("sync_pairs", [])):
+            raise ValueError(f"Sync pair {definition['sync_pair_id']} already exists in {config_path}")
+        if os.path.exists(mapping_path):
+            raise ValueError(f"Mapping file {mapping_path} already exists")
+
+    previous = {path: _read_text(path) for path in (config_path, mapping_path)}
+    configuration = dict(county_config, sync_pairs=pairs + [definition],
+                         last_updated=datetime.utcnow().strftime("%Y-%m-%dT%H:%M:%SZ"))
+    os.makedirs(os.path.dirname(mapping_path), exist_ok=True)
+    _write_json(mapping_path, mapping)
+    _write_json(config_path, configuration)
+
+    report = ConfigReport()
+    check_county_file(report, SyncPairRegistry(config_dir), county_id, config_path, {})
+    result = report.to_dict()
+    if not result["valid"]:
+        for path, text in previous.items():
+            if text is None:
+                os.remove(path)
+            else:
+                with open(path, "w") as f:
+                    f.write(text)
+        logger.warning(f"Configuration of sync pair {definition['sync_pair_id']} failed validation; files restored")
+    result["written"] = [config_path, mapping_path] if result["valid"] else []
+    return result
+
+
+def test_sync(pair, limit: int = TEST_SYNC_RECORDS) -> List[Dict[str, Any]]:
+    """
+    Read the first records of each table of a sync pair, transform them as a
+    sync job would and write them to the target.
+
+    Args:
+        pair: Loaded SyncPairConfig
+        limit: Records read from each table
+
+    Returns:
+        Per table: records read, written (upserted) and rejected, the first
+        rejections' errors, and the error that stopped the table, if any
+    """
+    results = []
+    with create_connector(pair.source) as source, create_connector(pair.target) as target:
+        for table in pair.tables:
+            result = {"table": table.name, "records_read": 0, "records_written": 0, "records_rejected": 0,
+                      "rejections": []}
+            try:
+                table_def = table.to_dict()
+                pipeline = build_pipeline(pair.hooks, table.name).bind(target)
+                batch = next(iter(source.read_table(table_def, limit)), [])[:limit]
+                context = HookContext(job_id="init-test", sync_pair_id=pair.sync_pair_id, table=table_def,
+                                      mode="full")
+                records, _, rejected = pipeline.apply(batch, context)
+                result["records_read"] = len(batch)
+                result["records_rejected"] = len(rejected)
+                result["rejections"] = [item["errors"] for item in rejected[:5]]
+                if records:
+                    counts = target.write_batch(pipeline.target_table(table_def), records)
+                    result["records_written"] = counts.get("upserted", len(records))
+            except Exception as e:
+                result["error"] = str(e)
+            results.append(result)
+    return results
+
+
+def format_test_sync(results: List[Dict[str, Any]]) -> str:
+    """Test sync results as one line per table."""
+    lines = []
+    for result in results:
+        line = (f"{result['table']}: {result['records_read']} read, {result['records_written']} written, "
+                f"{result['records_rejected']} rejected")
+        if result.get("error"):
+            line += f"; failed: {result['error']}"
+        lines.append(line)
+        lines.extend(f"    {'; '.join(map(str, errors))}" for errors in result["rejections"])
+    return "\n".join(lines)
+
+
+class InitWizard:
+    """
+    The questions of `terrafusion init`. Answers given on the command line
+    are not asked for; with assume_defaults, neither is anything with a
+    default, so the wizard can run unattended.
+    """
+
+    def __init__(self, config_dir: str = "county_configs", answers: Optional[Dict[str, Any]] = None,
+                 assume_defaults: bool = False, ask: Callable[[str], str] = input,
+                 ask_secret: Callable[[str], str] = getpass.getpass, out: Callable[[str], None] = print):
+        """
+        Initialize the wizard.
+
+        Args:
+            config_dir: Directory containing county configuration folders
+            answers: Preset answers: county, county_name, timezone, sync_pair_id, source_type, schema,
+                     tables, target_type, sqlite_path, env_file, replace, skip_test_sync, test_records
+            assume_defaults: Take the default of every question instead of asking it
+            ask: Reads an answer to a prompt
+            ask_secret: Reads an answer without echoing it
+            out: Prints a line
+        """
+        self.config_dir = config_dir
+        self.answers = {name: value for name, value in (answers or {}).items() if value is not None}
+        self.assume_defaults = assume_defaults
+        self.ask = ask
+        self.ask_secret = ask_secret
+        self.out = out
+        # What run() did: the sync pair, the validation report, the files written and the test sync results
+        self.result: Dict[str, Any] = {}
+
+    def run(self) -> int:
+        """Run the wizard; returns the exit status (1 when the configuration is invalid or the test sync fails)."""
+        county_config = self._county()
+        county_id = county_config["county_id"]
+        existing = [p.get("sync_pair_id") for p in county_config.get("sync_pairs", [])]
+        default_id = f"{county_id}_staging" if f"{county_id}_staging" not in existing else None
+        sync_pair_id = target_name(self._question("sync_pair_id", "Sync pair ID", default_id))
+        source_type = self._choice("source_type", "Source database type", list(SOURCE_SETTINGS), "sqlserver")
+        schema = self.answers.get("schema") or (
+            self._question("schema", "Source schema", "public") if source_type == "postgres" else None)
+        source = source_connector(source_type, sync_pair_id, schema)
+        self._connection_settings(source_type, sync_pair_id)
+
+        with create_connector(source) as connector:
+            health = connector.health_check()
+            if health.get("status") not in ("healthy", "unknown"):
+                raise ConnectorError(f"Cannot connect to the source: {health.get('error') or health.get('status')}")
+            self.out(f"Connected to the {source_type} source")
+            names = self._tables(connector)
+            descriptions = [connector.describe_table({"name": name, "primary_key": []}) for name in names]
+
+        tables, mapping = [], {"tables": {}}
+        for description in descriptions:
+            primary_key = description["primary_key"]
+            if not primary_key:
+                primary_key = self._list("", f"{description['name']} has no primary key; key columns "
+                                             f"(comma separated)")
+                if not primary_key:
+                    raise ValueError(f"Table {description['name']} needs key columns to be synced")
+            table = table_definition(source_type, description, primary_key)
+            tables.append(table)
+            mapping["tables"][description["name"]] = table_mapping(source_type, description, county_id)
+            tracking = table.get("change_tracking")
+            self.out(f"{description['name']} -> {table['target_table']}: {len(description['columns'])} columns, "
+                     f"key {', '.join(primary_key)}, "
+                     + (f"{tracking} ({table.get('rowversion_column') or table.get('change_column')})"
+                        if tracking else "full reads only"))
+
+        target_default = "postgres_staging" if os.environ.get("DATABASE_URL") else "sqlite_staging"
+        target_type = self._choice("target_type", "Staging target", TARGET_TYPES, target_default)
+        target = target_connector(target_type, self.answers.get("sqlite_path"))
+        name = self._question("name", "Sync pair name", f"{source_type} to TerraFusion staging")
+        definition = sync_pair_definition(sync_pair_id, name, source, target, tables,
+                                          f"mappings/{sync_pair_id}.json")
+
+        report = write_configuration(self.config_dir, county_config, definition, mapping,
+                                     replace=bool(self.answers.get("replace")))
+        self.result = {"county_id": county_id, "sync_pair_id": sync_pair_id, "valid": report["valid"],
+                       "issues": report["issues"], "written": report["written"], "test_sync": []}
+        from config_schema import format_report
+        self.out(format_report(report))
+        if not report["valid"]:
+            return 1
+        for path in report["written"]:
+            self.out(f"Wrote {path}")
+
+        if self.answers.get("skip_test_sync"):
+            return 0
+        from sync_pairs import SyncPairRegistry
+        pair = SyncPairRegistry(self.config_dir).get(sync_pair_id)
+        limit = int(self.answers.get("test_records") or TEST_SYNC_RECORDS)
+        self.out(f"Test sync of up to {limit} records per table:")
+        results = test_sync(pair, limit)
+        self.result["test_sync"] = results
+        self.out(format_test_sync(results))
+        failed = any(result.get("error") for result in results)
+        if not failed:
+            self.out(f"Run the first sync with: terrafusion sync run {sync_pair_id} --mode full --wait")
+        return 1 if failed else 0
+
+    def _county(self) -> Dict[str, Any]:
+        """The configuration of the county the sync pair is for, loaded or started."""
+        county_id = target_name(self._question("county", "County ID (such as benton_wa)"))
+        path = os.path.join(self.config_dir, county_id, f"{county_id}_config.json")
+        if os.path.exists(path):
+            with open(path, "r") as f:
+                county_config = json.load(f)
+            self.out(f"Adding a sync pair to {path}")
+            return county_config
+        friendly = county_id.replace("_", " ").title()
+        return {
+            "county_id": county_id,
+            "county_friendly_name": self._question("county_name", "County name", friendly),
+            "timezone": self._question("timezone", "County time zone", "UTC"),
+            "configuration_version": "1.0.0",
+            "sync_pairs": [],
+        }
+
+    def _connection_settings(self, source_type: str, sync_pair_id: str) -> None:
+        """Ask for the source connection settings not set in the environment, and keep them there."""
+        env_file = self.answers.get("env_file")
+        for setting, secret in SOURCE_SETTINGS[source_type]:
+            variable = env_var_name(sync_pair_id, setting)
+            if os.environ.get(variable):
+                self.out(f"Using {variable} from the environment")
+                continue
+            prompt = f"Source {setting.replace('_', ' ')} ({variable})"
+            if secret:
+                value = "" if self.assume_defaults else self.ask_secret(f"{prompt}: ")
+            else:
+                value = self._question("", prompt, SOURCE_PORTS.get(source_type) if setting == "port" else "")
+            if not value:
+                continue
+            os.environ[variable] = value
+            if env_file:
+                from dotenv import set_key
+                set_key(env_file, variable, value)
+        if env_file:
+            os.chmod(env_file, 0o600)
+            self.out(f"Connection settings written to {env_file}")
+        else:
+            self.out("Set the source connection variables above for the service; entered values are only "
+                     "used by this session")
+
+    def _tables(self, connector) -> List[str]:
+        """The source tables to sync, chosen from those the connector lists."""
+        if self.answers.get("tables"):
+            return list(self.answers["tables"])
+        try:
+            available = connector.list_tables()
+        except NotImplementedError:
+            available = []
+        for index, name in enumerate(available, 1):
+            self.out(f"  {index:>3}  {name}")
+        chosen = []
+        for item in self._list("", "Tables to sync (numbers or names, comma separated)"):
+            if item.isdigit() and 0 < int(item) <= len(available):
+                chosen.append(available[int(item) - 1])
+            else:
+                chosen.append(item)
+        if not chosen:
+            raise ValueError("No tables selected")
+        return chosen
+
+    def _question(self, answer: str, prompt: str, default: Optional[str] = None) -> str:
+        if answer and self.answers.get(answer) is not None:
+            return str(self.answers[answer])
+        if self.assume_defaults and default is not None:
+            return default
+        while True:
+            reply = self.ask(f"{prompt}{f' [{default}]' if default else ''}: ").strip()
+            if reply or default is not None:
+                return reply or default
+            self.out("An answer is required")
+
+    def _choice(self, answer: str, prompt: str, choices: List[str], default: str) -> str:
+        while True:
+            reply = self._question(answer, f"{prompt} ({', '.join(choices)})", default)
+            if reply in choices:
+                return reply
+            if answer in self.answers or self.assume_defaults:
+                raise ValueError(f"{reply} is not one of {', '.join(choices)}")
+            self.out(f"Choose one of {', '.join(choices)}")
+
+    def _list(self, answer: str, prompt: str) -> List[str]:
+        reply = self._question(answer, prompt, "" if self.assume_defaults else None)
+        return [item.strip() for item in reply.split(",") if item.strip()]
+
+
+def _read_text(path: str) -> Optional[str]:
+    if not os.path.exists(path):
+        return None
+    with open(path, "r") as f:
+        return f.read()
+
+
+def _write_json(path: str, document: Dict[str, Any]) -> None:
+    os.makedirs(os.path.dirname(path), exist_ok=True)
+    with open(path, "w") as f:
+        json.dump(document, f, indent=2)
+        f.write("\n")
@@ -0,0 +1,317 @@
+"""
+TerraFusion Platform - Doctor
+
+This module provides the checks behind `terrafusion doctor`, run by a county
+administrator while onboarding a county or after changing its configuration.
+It reports whether:
+
+- the environment settings and every county configuration file load, with
+  their network policies, alert rules and job retention (see alerting and
+  job_retention)
+- each sync pair's source, target and merge sources accept a connection
+- each source table can be read (and its change version queried), and each
+  target table exists
+- the source tables have the configured key and change columns, and the
+  target tables the key columns the field mapping writes them under; source
+  columns the target lacks are warned about
+- the sync job store can be written, and the export and sync state disks have
+  the room the readiness probe asks for (see health_checks)
+- the clock agrees with DOCTOR_NTP_SERVER within DOCTOR_MAX_CLOCK_SKEW_SECONDS;
+  watermarks, API tokens and MFA codes depend on it
+
+Each check passes, warns, fails or is skipped (the table checks of a side that
+cannot be reached, or of a connector without schema introspection). Nothing
+is written to sources or targets, so write permissions are not checked.
+"""
+
+import os
+import time
+import socket
+import struct
+import logging
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+from config_validator import TerraFusionConfigValidator
+from sync_connectors import create_connector
+from sync_hooks import build_pipeline
+from sync_pairs import SyncPairRegistry, SyncPairConfig
+from sync_store import sync_state_store
+from network_policy import NetworkPolicies
+from health_checks import HealthChecks, disk_status
+from alerting import AlertService
+from job_retention import JobRetention
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Outcomes of a check, best first
+PASS, WARN, FAIL, SKIP = "pass", "warn", "fail", "skip"
+
+# NTP server the clock is compared with
+NTP_SERVER = os.environ.get("DOCTOR_NTP_SERVER", "pool.ntp.org")
+
+# Seconds the clock may differ from the NTP server
+MAX_CLOCK_SKEW_SECONDS = float(os.environ.get("DOCTOR_MAX_CLOCK_SKEW_SECONDS", "5"))
+
+# Seconds to wait for the NTP server
+NTP_TIMEOUT_SECONDS = 3
+
+# Seconds from the NTP epoch (1900) to the Unix epoch
+_NTP_EPOCH_OFFSET = 2208988800
+
+# Disk statuses of health_checks as check outcomes
+_DISK_OUTCOMES = {"healthy": PASS, "degraded": WARN, "unavailable": FAIL}
+
+
+def clock_offset(server: str = NTP_SERVER, timeout: float = NTP_TIMEOUT_SECONDS) -> float:
+    """
+    Seconds the local clock is behind an NTP server (negative when it is ahead), from one SNTP request.
+
+    Raises:
+        OSError: If the server cannot be reached or does not answer in time
+    """
+    family, _, _, _, address = socket.getaddrinfo(server, 123, type=socket.SOCK_DGRAM)[0]
+    with socket.socket(family, socket.SOCK_DGRAM) as sock:
+        sock.settimeout(timeout)
+        sent = time.time()
+        # Version 3 client request
+        sock.sendto(b"\x1b" + b"\0" * 47, address)
+        data, _ = sock.recvfrom(512)
+        received = time.time()
+    if len(data) < 48:
+        raise OSError(f"{server} sent a {len(data)} byte NTP answer")
+    seconds, fraction = struct.unpack("!II", data[40:48])
+    transmitted = seconds - _NTP_EPOCH_OFFSET + fraction / 2 ** 32
+    return transmitted - (sent + received) / 2
+
+
+class Doctor:
+    """
+    Runs the doctor checks and collects their outcomes.
+    """
+
+    def __init__(self, config_dir: str = "county_configs", store=None, export_path: str = "exports",
+                 ntp_server: str = NTP_SERVER):
+        """
+        Initialize the doctor.
+
+        Args:
+            config_dir: Directory containing county configuration folders
+            store: Document store sync jobs are kept in (the configured one by default)
+            export_path: Directory export files are written to
+            ntp_server: NTP server the clock is compared with; None skips the clock check
+        """
+        self.config_dir = config_dir
+        self.store = store if store is not None else sync_state_store
+        self.export_path = export_path
+        self.ntp_server = ntp_server
+        self.results: List[Dict[str, Any]] = []
+
+    def run(self, county_id: Optional[str] = None, sync_pair_id: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Run every check, or only those of a county or sync pair and the shared ones.
+
+        Returns:
+            Dictionary with the overall "status" (the worst outcome), "counts"
+            of each outcome and the "checks"
+        """
+        self.results = []
+        self.check_environment()
+        registry = self.check_county_configs(county_id)
+        pairs = [pair for pair in registry.list(county_id) if sync_pair_id in (None, pair.sync_pair_id)]
+        if sync_pair_id and not pairs:
+            self._add(FAIL, "config", sync_pair_id, "Sync pair is not configured")
+        for pair in pairs:
+            self.check_sync_pair(pair)
+        self.check_storage()
+        if self.ntp_server:
+            self.check_clock()
+
+        counts = {outcome: sum(1 for r in self.results if r["status"] == outcome)
+                  for outcome in (PASS, WARN, FAIL, SKIP)}
+        status = FAIL if counts[FAIL] else WARN if counts[WARN] else PASS
+        return {"status": status, "checked_at": datetime.utcnow().isoformat(), "counts": counts,
+                "checks": list(self.results)}
+
+    def _add(self, status: str, check: str, subject: str, message: str) -> None:
+        self.results.append({"status": status, "check": check, "subject": subject, "message": message})
+
+    def check_environment(self) -> None:
+        result = TerraFusionConfigValidator().validate_configuration()
+        for error in result.errors:
+            self._add(FAIL, "config", "environment", error)
+        for warning in result.warnings:
+            self._add(WARN, "config", "environment", warning)
+        if not result.errors and not result.warnings:
+            self._add(PASS, "config", "environment", "Environment settings are valid")
+
+    def check_county_configs(self, county_id: Optional[str] = None) -> SyncPairRegistry:
+        """Load the county configuration files, reporting each; returns the registry they loaded into."""
+        registry = SyncPairRegistry(self.config_dir)
+        if not os.path.isdir(self.config_dir):
+            self._add(FAIL, "config", self.config_dir, "County configuration directory does not exist")
+            return registry
+        policies = NetworkPolicies(self.config_dir, global_allow=[])
+        alerts = AlertService(store=self.store, config_dir=self.config_dir)
+        retention = JobRetention(None, None, self.config_dir)
+        for county_dir in sorted(os.listdir(self.config_dir)):
+            path = os.path.join(self.config_dir, county_dir, f"{county_dir}_config.json")
+            if not os.path.exists(path) or county_id not in (None, county_dir):
+                continue
+            if path in registry.load_errors:
+                self._add(FAIL, "config", path, registry.load_errors[path])
+                continue
+            try:
+                policies.policy(county_dir)
+                alerts.alerting(county_dir)
+                retention.policy(county_dir)
+            except ValueError as e:
+                self._add(FAIL, "config", path, str(e))
+                continue
+            self._add(PASS, "config", path, f"Loads with {_count(len(registry.list(county_dir)), 'sync pair')}")
+        return registry
+
+    def check_sync_pair(self, pair: SyncPairConfig) -> None:
+        """Connect to each side of a sync pair and check its tables on the sides that connected."""
+        sides = [("source", pair.source), ("target", pair.target)]
+        sides += [(f"merge source {source['name']}", source["connector"]) for source in pair.merge.get("sources", [])]
+        descriptions: Dict[str, Dict[str, Any]] = {}
+        for side, config in sides:
+            subject = f"{pair.sync_pair_id} {side} ({config.get('type')})"
+            try:
+                with create_connector(config) as connector:
+                    reachable = self._check_health(subject, connector)
+                    if reachable and side == "source":
+                        descriptions = self._check_source_tables(pair, connector)
+                    elif reachable and side == "target":
+                        self._check_target_tables(pair, connector, descriptions)
+            except Exception as e:
+                reachable = False
+                self._add(FAIL, "connectivity", subject, f"Cannot connect: {e}")
+            if not reachable and side in ("source", "target"):
+                self._add(SKIP, "schema", f"{pair.sync_pair_id} {side}",
+                          f"Tables not checked; the {side} is unreachable")
+
+    def _check_health(self, subject: str, connector) -> bool:
+        health = connector.health_check()
+        if health.get("status") == "healthy":
+            self._add(PASS, "connectivity", subject, "Connected")
+        elif health.get("status") == "unknown":
+            self._add(WARN, "connectivity", subject, "Connected; the connector does not report its health")
+        else:
+            self._add(FAIL, "connectivity", subject, health.get("error") or f"Status {health.get('status')}")
+            return False
+        return True
+
+    def _check_source_tables(self, pair: SyncPairConfig, source) -> Dict[str, Dict[str, Any]]:
+        """Read a row and the catalog definition of each source table; returns the definitions."""
+        descriptions = {}
+        for table in pair.tables:
+            table_def = table.to_dict()
+            subject = f"{pair.sync_pair_id} source {table.name}"
+            try:
+                next(iter(source.read_table(table_def, 1)), None)
+                if table.change_tracking:
+                    source.get_current_version(table_def)
+                self._add(PASS, "permissions", subject,
+                          "Readable" + (f", {table.change_tracking} version readable" if table.change_tracking else ""))
+            except Exception as e:
+                self._add(FAIL, "permissions", subject, f"Cannot read: {e}")
+                continue
+            try:
+                description = source.describe_table(table_def)
+            except NotImplementedError as e:
+                self._add(SKIP, "schema", subject, str(e))
+                continue
+            except Exception as e:
+                self._add(FAIL, "schema", subject, str(e))
+                continue
+            descriptions[table.name] = description
+            names = {column["name"] for column in description["columns"]}
+            configured = list(table.primary_key) + [c for c in (table.rowversion_column, table.change_column) if c]
+            missing = [c for c in configured if c not in names]
+            if missing:
+                self._add(FAIL, "schema", subject, f"Configured columns missing from the source: {', '.join(missing)}")
+            else:
+                self._add(PASS, "schema", subject, f"{_count(len(names), 'column')}, configured columns present")
+        return descriptions
+
+    def _check_target_tables(self, pair: SyncPairConfig, target, descriptions: Dict[str, Dict[str, Any]]) -> None:
+        """Compare each target table with the key and source columns written to it."""
+        for table in pair.tables:
+            subject = f"{pair.sync_pair_id} target {table.target_table or table.name}"
+            try:
+                pipeline = build_pipeline(pair.hooks, table.name)
+                target_def = pipeline.target_table(table.to_dict())
+                description = target.describe_table(target_def)
+            except NotImplementedError as e:
+                self._add(SKIP, "schema", subject, str(e))
+                continue
+            except Exception as e:
+                self._add(FAIL, "schema", subject, str(e))
+                continue
+            names = {column["name"] for column in description["columns"]}
+            missing_key = [c for c in target_def["primary_key"] if c not in names]
+            if missing_key:
+                self._add(FAIL, "schema", subject, f"Key columns missing from the target: {', '.join(missing_key)}")
+                continue
+            unmatched = []
+            if table.name in descriptions:
+                columns = [column["name"] for column in descriptions[table.name]["columns"]]
+                for hook in pipeline.hooks:
+                    columns = hook.map_columns(table.name, columns)
+                unmatched = [c for c in columns if c not in names]
+            if unmatched:
+                self._add(WARN, "schema", subject, f"Source columns without a target column (dropped or renamed "
+                                                   f"by a hook?): {', '.join(unmatched)}")
+            else:
+                self._add(PASS, "schema", subject, f"{_count(len(names), 'column')}, key columns present")
+
+    def check_storage(self) -> None:
+        try:
+            probe = HealthChecks(self.store, None, None, self.export_path).check_job_store()
+            self._add(PASS, "storage", f"job store ({probe['backend']})", "Writable")
+        except Exception as e:
+            self._add(FAIL, "storage", "job store", f"Cannot write: {e}")
+        paths = [self.export_path] + [p for p in [getattr(self.store, "base_path", None)] if p]
+        for path in dict.fromkeys(paths):
+            if not os.path.isdir(path):
+                self._add(WARN, "disk", path, "Directory does not exist yet; the service creates it when it starts")
+                continue
+            try:
+                disk = disk_status(path)
+            except OSError as e:
+                self._add(FAIL, "disk", path, str(e))
+                continue
+            message = f"{disk['free_mb']} MB free of {disk['total_mb']} MB"
+            self._add(_DISK_OUTCOMES[disk["status"]], "disk", path,
+                      f"{message}; {disk['error']}" if disk.get("error") else message)
+
+    def check_clock(self) -> None:
+        try:
+            offset = clock_offset(self.ntp_server)
+        except OSError as e:
+            self._add(WARN, "clock", self.ntp_server, f"Cannot reach the NTP server to check the clock: {e}")
+            return
+        direction = "behind" if offset > 0 else "ahead of"
+        message = f"Clock is {abs(offset):.2f}s {direction} {self.ntp_server}"
+        if abs(offset) > MAX_CLOCK_SKEW_SECONDS:
+            self._add(FAIL, "clock", "system clock", f"{message}, more than {MAX_CLOCK_SKEW_SECONDS:g}s")
+        else:
+            self._add(PASS, "clock", "system clock", message)
+
+
+def _count(number: int, noun: str) -> str:
+    return f"{number} {noun}{'' if number == 1 else 's'}"
+
+
+def format_report(report: Dict[str, Any]) -> str:
+    """The report as the lines `terrafusion doctor` prints."""
+    lines = [f"{r['status'].upper():<5} {r['check']:<12} {r['subject']}: {r['message']}" for r in report["checks"]]
+    counts = report["counts"]
+    lines.append("")
+    lines.append(f"{report['status'].upper()}: {counts[PASS]} passed, {counts[WARN]} warned, {counts[FAIL]} failed, "
+                 f"{counts[SKIP]} skipped")
+    return "\n".join(lines)
@@ -0,0 +1,309 @@
+"""
+TerraFusion Platform - Encryption at Rest
+
+This module provides the envelope encryption of sensitive staging columns
+(see EncryptedTarget in sync_connectors) and of the job records and other
+documents the platform keeps on disk (see sync_store and gis_export), so a
+stolen copy of the staging database or of a backup does not expose taxpayer
+data.
+
+Each value is encrypted with AES-256-GCM under a data key, and the data key
+is stored with it, wrapped by the master key. The master key is either a key
+file (ENCRYPTION_KEY_FILE) or an AWS KMS key (ENCRYPTION_KMS_KEY_ID). A key
+file holds base64 256-bit keys, one per line: the first encrypts, and the
+others are kept so values written before a rotation can still be read. Make
+one with:
+
+    python encryption.py generate-key > /etc/terrafusion/master.key
+
+A data key encrypts DATA_KEY_MAX_USES values before a new one is made, and
+unwrapped data keys are cached, so KMS is not called once per row. Encrypted
+values are text of the form "tfe1:<base64>"; each is bound to where it is
+stored (a column or document), so one cannot be copied into another place.
+"""
+
+import os
+import sys
+import json
+import base64
+import struct
+import hashlib
+import logging
+import secrets
+import threading
+from typing import Dict, Any, Optional, Tuple
+
+try:
+    from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+    CRYPTOGRAPHY_AVAILABLE = True
+except ImportError:
+    # Encryption at rest requires cryptography
+    CRYPTOGRAPHY_AVAILABLE = False
+
+try:
+    import boto3
+    BOTO3_AVAILABLE = True
+except ImportError:
+    # AWS KMS master keys require boto3
+    BOTO3_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Prefix of encrypted values; the digit is the format version
+PREFIX = "tfe1:"
+
+# Master key settings; encryption is off when neither is set
+KEY_FILE = os.environ.get("ENCRYPTION_KEY_FILE")
+KMS_KEY_ID = os.environ.get("ENCRYPTION_KMS_KEY_ID")
+KMS_REGION = os.environ.get("ENCRYPTION_KMS_REGION")
+
+# Values encrypted under one data key before a new one is made
+DATA_KEY_MAX_USES = int(os.environ.get("ENCRYPTION_DATA_KEY_MAX_USES", "100000"))
+
+# Unwrapped data keys kept for decryption
+UNWRAP_CACHE_SIZE = 1024
+
+KEY_BYTES = 32
+NONCE_BYTES = 12
+
+# Bytes of the key ID a key file key is known by (the start of its SHA-256)
+KEY_ID_BYTES = 8
+
+
+class EncryptionError(Exception):
+    """Raised when a value cannot be encrypted or decrypted."""
+
+
+def is_encrypted(value: Any) -> bool:
+    """Whether a stored value is an encrypted one."""
+    return isinstance(value, str) and value.startswith(PREFIX)
+
+
+class FileKeyProvider:
+    """Master keys read from a key file."""
+
+    name = "file"
+    tag = b"f"
+
+    def __init__(self, path: str):
+        """
+        Raises:
+            EncryptionError: If the file cannot be read or holds no valid key
+        """
+        try:
+            with open(path, "r") as f:
+                lines = [line.strip() for line in f if line.strip() and not line.startswith("#")]
+        except OSError as e:
+            raise EncryptionError(f"Cannot read encryption key file {path}: {e}")
+        keys = []
+        for number, line in enumerate(lines, 1):
+            try:
+                key = base64.b64decode(line, validate=True)
+            except ValueError:
+                key = b""
+            if len(key) != KEY_BYTES:
+                raise EncryptionError(f"Encryption key file {path} line {number} is not a base64 256-bit key")
+            keys.append(key)
+        if not keys:
+            raise EncryptionError(f"Encryption key file {path} holds no key")
+        self.path = path
+        self.keys = {hashlib.sha256(key).digest()[:KEY_ID_BYTES]: key for key in keys}
+        self.current_id = hashlib.sha256(keys[0]).digest()[:KEY_ID_BYTES]
+
+    def new_data_key(self) -> Tuple[bytes, bytes]:
+        """A new data key and its wrapped form."""
+        data_key = secrets.token_bytes(KEY_BYTES)
+        nonce = secrets.token_bytes(NONCE_BYTES)
+        wrapped = AESGCM(self.keys[self.current_id]).encrypt(nonce, data_key, self.current_id)
+        return data_key, self.current_id + nonce + wrapped
+
+    def unwrap(self, wrapped: bytes) -> bytes:
+        key_id, nonce, data = wrapped[:KEY_ID_BYTES], wrapped[KEY_ID_BYTES:KEY_ID_BYTES + NONCE_BYTES], \
+            wrapped[KEY_ID_BYTES + NONCE_BYTES:]
+        if key_id not in self.keys:
+            raise EncryptionError(f"Value was encrypted with master key {key_id.hex()}, which is not in {self.path}")
+        return AESGCM(self.keys[key_id]).decrypt(nonce, data, key_id)
+
+
+class KmsKeyProvider:
+    """A master key held by AWS KMS, which wraps and unwraps the data keys."""
+
+    name = "aws_kms"
+    tag = b"k"
+
+    def __init__(self, key_id: str, region: Optional[str] = None):
+        if not BOTO3_AVAILABLE:
+            raise EncryptionError("AWS KMS master keys require boto3")
+        self.key_id = key_id
+        self.client = boto3.client("kms", region_name=region)
+
+    def new_data_key(self) -> Tuple[bytes, bytes]:
+        response = self.client.generate_data_key(KeyId=self.key_id, KeySpec="AES_256")
+        return response["Plaintext"], response["CiphertextBlob"]
+
+    def unwrap(self, wrapped: bytes) -> bytes:
+        return self.client.decrypt(CiphertextBlob=wrapped, KeyId=self.key_id)["Plaintext"]
+
+
+class EnvelopeCipher:
+    """
+    Encrypts values under data keys wrapped by a master key provider.
+
+    Encrypted values hold the provider tag, the wrapped data key, the nonce
+    and the AES-GCM ciphertext; the context they were encrypted for is
+    authenticated with them.
+    """
+
+    def __init__(self, provider, max_uses: int = DATA_KEY_MAX_USES):
+        """
+        Raises:
+            EncryptionError: If cryptography is not installed
+        """
+        if not CRYPTOGRAPHY_AVAILABLE:
+            raise EncryptionError("Encryption at rest requires the cryptography package")
+        self.provider = provider
+        self.max_uses = max_uses
+        self._data_key: Optional[Tuple[bytes, bytes]] = None
+        self._uses = 0
+        self._unwrapped: Dict[bytes, bytes] = {}
+        self._lock = threading.Lock()
+
+    def _current_key(self) -> Tuple[bytes, bytes]:
+        with self._lock:
+            if self._data_key is None or self._uses >= self.max_uses:
+                self._data_key = self.provider.new_data_key()
+                self._uses = 0
+            self._uses += 1
+            return self._data_key
+
+    def _unwrap(self, wrapped: bytes) -> bytes:
+        with self._lock:
+            data_key = self._unwrapped.get(wrapped)
+        if data_key is None:
+            data_key = self.provider.unwrap(wrapped)
+            with self._lock:
+                if len(self._unwrapped) >= UNWRAP_CACHE_SIZE:
+                    self._unwrapped.pop(next(iter(self._unwrapped)))
+                self._unwrapped[wrapped] = data_key
+        return data_key
+
+    def encrypt(self, plaintext: bytes, context: str = "") -> str:
+        """Encrypt bytes for a context (where the value is stored)."""
+        data_key, wrapped = self._current_key()
+        nonce = secrets.token_bytes(NONCE_BYTES)
+        ciphertext = AESGCM(data_key).encrypt(nonce, plaintext, context.encode())
+        payload = self.provider.tag + struct.pack(">H", len(wrapped)) + wrapped + nonce + ciphertext
+        return PREFIX + base64.b64encode(payload).decode("ascii")
+
+    def decrypt(self, token: str, context: str = "") -> bytes:
+        """
+        Decrypt a value encrypted for a context.
+
+        Raises:
+            EncryptionError: If the value is malformed, was encrypted with another
+                master key or for another context, or was tampered with
+        """
+        try:
+            payload = base64.b64decode(token[len(PREFIX):], validate=True)
+            tag, (length,) = payload[:1], struct.unpack(">H", payload[1:3])
+        except (ValueError, struct.error):
+            raise EncryptionError("Malformed encrypted value")
+        if tag != self.provider.tag:
+            raise EncryptionError(f"Value was not encrypted with a {self.provider.name} master key")
+        wrapped = payload[3:3 + length]
+        nonce, ciphertext = payload[3 + length:3 + length + NONCE_BYTES], payload[3 + length + NONCE_BYTES:]
+        try:
+            return AESGCM(self._unwrap(wrapped)).decrypt(nonce, ciphertext, context.encode())
+        except EncryptionError:
+            raise
+        except Exception as e:
+            raise EncryptionError(f"Cannot decrypt value for {context or 'its context'}: "
+                                  f"{type(e).__name__} (wrong key, context or tampered data)")
+
+    def encrypt_value(self, value: Any, context: str = "") -> Optional[str]:
+        """Encrypt a JSON-serializable value; None stays None."""
+        if value is None:
+            return None
+        return self.encrypt(json.dumps(value, default=str).encode(), context)
+
+    def decrypt_value(self, value: Any, context: str = "") -> Any:
+        """Decrypt a value from encrypt_value; values stored before encryption was on pass through."""
+        if not is_encrypted(value):
+            return value
+        return json.loads(self.decrypt(value, context))
+
+
+def create_cipher(settings: Optional[Dict[str, Any]] = None) -> Optional[EnvelopeCipher]:
+    """
+    Create a cipher for a master key.
+
+    Args:
+        settings: Dictionary with "key_file", or "kms_key_id" and optionally
+            "kms_region"; the ENCRYPTION_* environment variables by default
+
+    Returns:
+        The cipher, None when no master key is configured
+
+    Raises:
+        EncryptionError: If the master key cannot be used
+    """
+    settings = settings or {"key_file": KEY_FILE, "kms_key_id": KMS_KEY_ID, "kms_region": KMS_REGION}
+    if settings.get("key_file") and settings.get("kms_key_id"):
+        raise EncryptionError("Configure either an encryption key file or a KMS key, not both")
+    if settings.get("key_file"):
+        return EnvelopeCipher(FileKeyProvider(settings["key_file"]))
+    if settings.get("kms_key_id"):
+        return EnvelopeCipher(KmsKeyProvider(settings["kms_key_id"], settings.get("kms_region") or KMS_REGION))
+    return None
+
+
+_default_cipher: Optional[EnvelopeCipher] = None
+_default_lock = threading.Lock()
+
+
+def default_cipher() -> Optional[EnvelopeCipher]:
+    """The cipher of the environment's master key, created once; None when encryption is off."""
+    global _default_cipher
+    with _default_lock:
+        if _default_cipher is None and (KEY_FILE or KMS_KEY_ID):
+            _default_cipher = create_cipher()
+        return _default_cipher
+
+
+def dumps_document(document: Any, cipher: Optional[EnvelopeCipher], context: str, **json_options) -> str:
+    """The stored text of a document: its JSON, encrypted when there is a cipher."""
+    if cipher is None:
+        return json.dumps(document, default=str, **json_options)
+    return cipher.encrypt(json.dumps(document, default=str).encode(), context)
+
+
+def loads_document(text: str, cipher: Optional[EnvelopeCipher], context: str) -> Any:
+    """
+    Parse a stored document, encrypted or not.
+
+    Raises:
+        EncryptionError: If it is encrypted and cannot be decrypted
+    """
+    text = text.strip()
+    if not is_encrypted(text):
+        return json.loads(text)
+    if cipher is None:
+        raise EncryptionError(f"{context} is encrypted but no encryption key is configured")
+    return json.loads(cipher.decrypt(text, context))
+
+
+def main(argv=None) -> int:
+    """Command-line entry point for making master keys."""
+    import argparse
+    parser = argparse.ArgumentParser(description="TerraFusion Encryption at Rest")
+    commands = parser.add_subparsers(dest="command", required=True)
+    commands.add_parser("generate-key", help="Print a new base64 master key for a key file")
+    parser.parse_args(argv)
+    print(base64.b64encode(secrets.token_bytes(KEY_BYTES)).decode("ascii"))
+    return 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,464 @@
+"""
+TerraFusion Platform - Event Bus
+
+This module provides the internal event bus the platform's components (API
+gateway, sync engine and job queue, GIS exporter) use to tell each other
+about work instead of calling each other directly, so they can run on
+separate nodes. Two backends are available, chosen with EVENT_BUS_BACKEND:
+
+- inprocess (default): subscribers in the same process; nothing to run
+- nats: a NATS server or cluster (NATS_URL), for multi-node deployments
+
+Subjects are dot-separated tokens; subscriptions may use the NATS wildcards
+"*" (one token) and ">" (the remaining tokens). Subscribers that share a
+queue group split the messages between them, so work announced on the bus is
+picked up by exactly one of them. Every message is an envelope:
+
+    {"event_id": "...", "subject": "sync.jobs.<job_id>.completed",
+     "published_at": "...", "node": "sync-node-2", "data": {...}}
+
+Delivery is at most once: a message published while no subscriber is
+listening is not kept, so components keep their state in the state store
+and treat bus messages as prompts to act on it sooner.
+"""
+
+import os
+import ssl
+import json
+import uuid
+import queue
+import socket
+import asyncio
+import logging
+import threading
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Callable
+
+from service_tls import service_tls
+
+try:
+    import nats
+    NATS_AVAILABLE = True
+except ImportError:
+    # The NATS backend requires nats-py
+    NATS_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Sync job lifecycle events: created, started, progress, completed, failed, paused, cancelled, preempted
+SUBJECT_SYNC_JOB = "sync.jobs.{job_id}.{event}"
+
+# Pause and cancel requests for a running sync job
+SUBJECT_SYNC_CONTROL = "sync.control.{job_id}"
+
+# Pending sync jobs handed to whichever node runs the job queue
+SUBJECT_SYNC_QUEUE_SUBMIT = "sync.queue.submit"
+
+# GIS export job lifecycle events: created, completed, failed, cancelled
+SUBJECT_EXPORT_JOB = "exports.jobs.{job_id}.{event}"
+
+# Platform status changes for dashboards: connector_health, freshness_slo, queue_depth
+SUBJECT_SYSTEM = "system.{event}"
+
+# Changes to synced records announced by entity modules: appeals.status_changed
+SUBJECT_ENTITY = "sync.entities.{entity}.{event}"
+
+# Seconds to wait for the NATS server to accept a publish or subscription
+DEFAULT_NATS_TIMEOUT = 5
+
+# Seconds between attempts to reach the NATS server while it is down
+DEFAULT_NATS_RECONNECT_SECONDS = 2
+
+# Subject prefix separating this platform's messages on a shared NATS server
+DEFAULT_SUBJECT_PREFIX = "terrafusion"
+
+
+class EventBusError(Exception):
+    """Raised when a message cannot be published or a subscription made."""
+
+
+def subject_matches(pattern: str, subject: str) -> bool:
+    """Whether a subject matches a subscription pattern with * and > wildcards."""
+    pattern_tokens, subject_tokens = pattern.split("."), subject.split(".")
+    for index, token in enumerate(pattern_tokens):
+        if token == ">":
+            return len(subject_tokens) > index
+        if index >= len(subject_tokens) or (token != "*" and token != subject_tokens[index]):
+            return False
+    return len(pattern_tokens) == len(subject_tokens)
+
+
+class Subscription:
+    """A handler subscribed to a subject pattern."""
+
+    def __init__(self, bus: "EventBus", subject: str, handler: Callable[[Dict[str, Any]], None],
+                 queue_group: Optional[str] = None):
+        self.bus = bus
+        self.subject = subject
+        self.handler = handler
+        self.queue_group = queue_group
+        self.active = True
+        self.backend_subscription = None
+
+    def unsubscribe(self) -> None:
+        """Stop receiving messages."""
+        if self.active:
+            self.active = False
+            self.bus._unsubscribe(self)
+
+
+class EventBus:
+    """
+    Base class for event bus backends.
+
+    Handlers run one at a time on the bus's dispatcher thread, never on the
+    publisher's thread, so a slow or failing handler cannot hold up or break
+    the component that published. Handler exceptions are logged.
+
+    Subclasses set bus_type and distributed, and implement _send and
+    _unsubscribe; they call _dispatch with each received envelope.
+    """
+
+    bus_type = "base"
+
+    # Whether messages reach other processes
+    distributed = False
+
+    def __init__(self, node: Optional[str] = None):
+        self.node = node or os.environ.get("EVENT_BUS_NODE_NAME") or socket.gethostname()
+        self._subscriptions: List[Subscription] = []
+        self._lock = threading.Lock()
+        self._inbox: "queue.Queue" = queue.Queue()
+        self._dispatcher: Optional[threading.Thread] = None
+
+    def publish(self, subject: str, data: Dict[str, Any]) -> Dict[str, Any]:
+        """
+        Publish a message.
+
+        Returns:
+            The published envelope
+
+        Raises:
+            EventBusError: If the backend does not accept the message
+        """
+        envelope = {
+            "event_id": str(uuid.uuid4()),
+            "subject": subject,
+            "published_at": datetime.utcnow().isoformat(),
+            "node": self.node,
+            "data": data,
+        }
+        self._send(subject, envelope)
+        return envelope
+
+    def subscribe(self, subject: str, handler: Callable[[Dict[str, Any]], None],
+                  queue_group: Optional[str] = None) -> Subscription:
+        """
+        Call handler with the envelope of every message matching a subject pattern.
+
+        Args:
+            subject: Subject, optionally with * and > wildcards
+            handler: Called with each envelope
+            queue_group: Subscribers sharing a group receive each message once between them
+        """
+        subscription = Subscription(self, subject, handler, queue_group)
+        with self._lock:
+            self._subscriptions.append(subscription)
+        self._start_dispatcher()
+        return subscription
+
+    def close(self) -> None:
+        """Drop every subscription and stop the dispatcher."""
+        with self._lock:
+            subscriptions, self._subscriptions = self._subscriptions, []
+        for subscription in subscriptions:
+            subscription.active = False
+        if self._dispatcher is not None:
+            self._inbox.put(None)
+            self._dispatcher.join(timeout=5)
+            self._dispatcher = None
+
+    def health_check(self) -> Dict[str, Any]:
+        """Backend status and subscription count."""
+        return {"bus_type": self.bus_type, "status": "healthy", "node": self.node,
+                "subscriptions": len(self._subscriptions)}
+
+    def _send(self, subject: str, envelope: Dict[str, Any]) -> None:
+        raise NotImplementedError
+
+    def _unsubscribe(self, subscription: Subscription) -> None:
+        with self._lock:
+            if subscription in self._subscriptions:
+                self._subscriptions.remove(subscription)
+
+    def _dispatch(self, subscription: Subscription, envelope: Dict[str, Any]) -> None:
+        """Queue an envelope for a subscription's handler."""
+        self._inbox.put((subscription, envelope))
+
+    def _start_dispatcher(self) -> None:
+        with self._lock:
+            if self._dispatcher is None or not self._dispatcher.is_alive():
+                self._dispatcher = threading.Thread(target=self._run_dispatcher, name=f"event-bus-{self.bus_type}",
+                                                    daemon=True)
+                self._dispatcher.start()
+
+    def _run_dispatcher(self) -> None:
+        while True:
+            item = self._inbox.get()
+            if item is None:
+                return
+            subscription, envelope = item
+            if not subscription.active:
+                continue
+            try:
+                subscription.handler(envelope)
+            except Exception as e:
+                logger.error(f"Event handler for {subscription.subject} failed on {envelope['subject']}: {e}",
+                             exc_info=True)
+
+
+class InProcessEventBus(EventBus):
+    """Event bus for a single process: messages go straight to local subscribers."""
+
+    bus_type = "inprocess"
+
+    def __init__(self, node: Optional[str] = None):
+        super().__init__(node)
+        self._group_turns: Dict[str, int] = {}
+
+    def _send(self, subject: str, envelope: Dict[str, Any]) -> None:
+        with self._lock:
+            matching = [s for s in self._subscriptions if s.active and subject_matches(s.subject, subject)]
+            groups: Dict[str, List[Subscription]] = {}
+            for subscription in matching:
+                if subscription.queue_group:
+                    groups.setdefault(subscription.queue_group, []).append(subscription)
+                else:
+                    self._dispatch(subscription, envelope)
+            for name, members in groups.items():
+                # Queue group members take turns
+                turn = self._group_turns.get(name, 0)
+                self._group_turns[name] = turn + 1
+                self._dispatch(members[turn % len(members)], envelope)
+
+
+class NatsEventBus(EventBus):
+    """
+    Event bus on a NATS server or cluster.
+
+    Configuration (environment):
+        NATS_URL: Server URLs, comma separated (nats://localhost:4222)
+        NATS_TOKEN, or NATS_USER / NATS_PASSWORD, or NATS_CREDENTIALS_FILE
+        NATS_TLS_CA_FILE: CA bundle for tls:// servers with a private CA
+        SERVICE_TLS_*: Client certificate for servers that require mutual TLS (see
+            service_tls); its CA bundle verifies the server
+        EVENT_BUS_SUBJECT_PREFIX: Prepended to every subject ("terrafusion")
+
+    The client runs on its own asyncio loop thread. It connects on first use
+    and keeps retrying while the server is down; publishes made until it is
+    connected fail with EventBusError, and subscriptions are made as soon
+    as it connects. After that the client reconnects and resubscribes on
+    its own.
+    """
+
+    bus_type = "nats"
+    distributed = True
+
+    def __init__(self, settings: Optional[Dict[str, Any]] = None, node: Optional[str] = None):
+        super().__init__(node)
+        settings = settings or {}
+
+        def setting(key: str, default: Any = None) -> Any:
+            value = settings.get(key)
+            return value if value is not None else os.environ.get(f"NATS_{key.upper()}", default)
+
+        self.servers = [s.strip() for s in str(setting("url", "nats://localhost:4222")).split(",") if s.strip()]
+        self.token = setting("token")
+        self.user = setting("user")
+        self.password = setting("password")
+        self.credentials_file = setting("credentials_file")
+        self.tls_ca_file = setting("tls_ca_file")
+        self.timeout = float(setting("timeout_seconds", DEFAULT_NATS_TIMEOUT))
+        self.reconnect_seconds = float(setting("reconnect_seconds", DEFAULT_NATS_RECONNECT_SECONDS))
+        prefix = settings.get("subject_prefix", os.environ.get("EVENT_BUS_SUBJECT_PREFIX", DEFAULT_SUBJECT_PREFIX))
+        self.prefix = f"{prefix.rstrip('.')}." if prefix else ""
+        self._loop: Optional[asyncio.AbstractEventLoop] = None
+        self._thread: Optional[threading.Thread] = None
+        self._client = None
+        self._last_error: Optional[str] = None
+        self._start_lock = threading.Lock()
+        self._subscribing: set = set()
+
+    @property
+    def connected(self) -> bool:
+        return self._client is not None and self._client.is_connected
+
+    def subscribe(self, subject: str, handler: Callable[[Dict[str, Any]], None],
+                  queue_group: Optional[str] = None) -> Subscription:
+        subscription = super().subscribe(subject, handler, queue_group)
+        self._start()
+        if self.connected:
+            self._call(self._subscribe(subscription))
+        return subscription
+
+    def close(self) -> None:
+        if self._loop is not None:
+            try:
+                self._call(self._close())
+            except EventBusError as e:
+                logger.warning(f"Error closing NATS connection: {e}")
+            self._loop.call_soon_threadsafe(self._loop.stop)
+            self._thread.join(timeout=5)
+            self._loop = self._thread = self._client = None
+        super().close()
+
+    def health_check(self) -> Dict[str, Any]:
+        status = super().health_check()
+        try:
+            self._start()
+        except EventBusError as e:
+            return dict(status, status="unavailable", error=str(e))
+        status.update(servers=self.servers, status="healthy" if self.connected else "unavailable")
+        if not self.connected and self._last_error:
+            status["error"] = self._last_error
+        return status
+
+    def _send(self, subject: str, envelope: Dict[str, Any]) -> None:
+        self._start()
+        if not self.connected:
+            raise EventBusError(f"Not connected to NATS ({self._last_error or 'connecting'})")
+        payload = json.dumps(envelope, default=str).encode("utf-8")
+        self._call(self._client.publish(self.prefix + subject, payload))
+
+    def _unsubscribe(self, subscription: Subscription) -> None:
+        super()._unsubscribe(subscription)
+        if subscription.backend_subscription is not None and self.connected:
+            try:
+                self._call(subscription.backend_subscription.unsubscribe())
+            except EventBusError as e:
+                logger.warning(f"Error unsubscribing from {subscription.subject}: {e}")
+
+    def _start(self) -> None:
+        """Start the loop thread and the connection attempts, once."""
+        if not NATS_AVAILABLE:
+            raise EventBusError("The NATS event bus requires nats-py")
+        with self._start_lock:
+            if self._thread is not None:
+                return
+            self._loop = asyncio.new_event_loop()
+            self._thread = threading.Thread(target=self._loop.run_forever, name="event-bus-nats", daemon=True)
+            self._thread.start()
+            asyncio.run_coroutine_threadsafe(self._connect(), self._loop)
+
+    def _call(self, coroutine) -> Any:
+        """Run a coroutine on the loop thread and wait for its result."""
+        try:
+            return asyncio.run_coroutine_threadsafe(coroutine, self._loop).result(self.timeout)
+        except Exception as e:
+            raise EventBusError(f"NATS request failed: {e}")
+
+    async def _connect(self) -> None:
+        options: Dict[str, Any] = {
+            "servers": self.servers,
+            "name": f"terrafusion-{self.node}",
+            "allow_reconnect": True,
+            "max_reconnect_attempts": -1,
+            "reconnect_time_wait": self.reconnect_seconds,
+            "connect_timeout": self.timeout,
+            "error_cb": self._on_error,
+            "disconnected_cb": self._on_disconnected,
+            "reconnected_cb": self._on_reconnected,
+        }
+        if self.token:
+            options["token"] = self.token
+        elif self.user:
+            options.update(user=self.user, password=self.password)
+        if self.credentials_file:
+            options["user_credentials"] = self.credentials_file
+        if service_tls.enabled:
+            # The context is updated in place when the certificate rotates, for later reconnects
+            options["tls"] = service_tls.client_context()
+            if self.tls_ca_file:
+                options["tls"].load_verify_locations(cafile=self.tls_ca_file)
+        elif self.tls_ca_file:
+            options["tls"] = ssl.create_default_context(cafile=self.tls_ca_file)
+        while self._loop is not None:
+            try:
+                client = await nats.connect(**options)
+            except Exception as e:
+                # Keep trying until the server comes up
+                if self._last_error != str(e):
+                    logger.warning(f"Cannot connect to NATS at {', '.join(self.servers)}: {e}")
+                self._last_error = str(e)
+                await asyncio.sleep(self.reconnect_seconds)
+                continue
+            self._client, self._last_error = client, None
+            logger.info(f"Connected to NATS at {', '.join(self.servers)}")
+            with self._lock:
+                pending = [s for s in self._subscriptions if s.active and s.backend_subscription is None]
+            for subscription in pending:
+                await self._subscribe(subscription)
+            return
+
+    async def _subscribe(self, subscription: Subscription) -> None:
+        # Runs on the loop thread; a subscription made while connecting may be requested twice
+        if subscription.backend_subscription is not None or id(subscription) in self._subscribing:
+            return
+        self._subscribing.add(id(subscription))
+
+        async def receive(message) -> None:
+            try:
+                envelope = json.loads(message.data.decode("utf-8"))
+            except (UnicodeDecodeError, ValueError) as e:
+                logger.warning(f"Ignoring undecodable message on {message.subject}: {e}")
+                return
+            if subscription.active:
+                self._dispatch(subscription, envelope)
+
+        try:
+            subscription.backend_subscription = await self._client.subscribe(
+                self.prefix + subscription.subject, queue=subscription.queue_group or "", cb=receive
+            )
+        finally:
+            self._subscribing.discard(id(subscription))
+
+    async def _close(self) -> None:
+        if self._client is not None and not self._client.is_closed:
+            await self._client.drain()
+
+    async def _on_error(self, error: Exception) -> None:
+        self._last_error = str(error)
+        logger.warning(f"NATS error: {error}")
+
+    async def _on_disconnected(self) -> None:
+        logger.warning("Disconnected from NATS; reconnecting")
+
+    async def _on_reconnected(self) -> None:
+        self._last_error = None
+        logger.info("Reconnected to NATS")
+
+
+EVENT_BUS_TYPES = {
+    InProcessEventBus.bus_type: InProcessEventBus,
+    NatsEventBus.bus_type: NatsEventBus,
+}
+
+
+def create_event_bus(bus_type: Optional[str] = None) -> EventBus:
+    """
+    Create the event bus backend named by bus_type or EVENT_BUS_BACKEND.
+
+    Raises:
+        ValueError: If the backend is not supported
+    """
+    bus_type = (bus_type or os.environ.get("EVENT_BUS_BACKEND", InProcessEventBus.bus_type)).lower()
+    bus_class = EVENT_BUS_TYPES.get(bus_type)
+    if bus_class is None:
+        raise ValueError(f"Unsupported event bus backend: {bus_type}. Supported backends: {', '.join(EVENT_BUS_TYPES)}")
+    return bus_class()
+
+
+# Global event bus instance
+event_bus = create_event_bus()
@@ -0,0 +1,427 @@
+"""
+TerraFusion Platform - Export Delivery
+
+This module provides the delivery targets that push completed GIS export
+files to outside recipients, such as the nightly SFTP drops required by the
+state Department of Revenue. Deliveries are configured per county under
+plugin_settings.gis_export.deliveries:
+
+    "deliveries": [
+        {
+            "name": "wa_dor",
+            "type": "sftp",
+            "host": "sftp.dor.wa.gov",
+            "username": "benton_assessor",
+            "private_key_path": "/etc/terrafusion/keys/dor_ed25519",
+            "known_hosts_path": "/etc/terrafusion/keys/known_hosts",
+            "remote_dir": "/incoming/{county_id}/{year}",
+            "formats": ["csv"]
+        }
+    ]
+
+Each file is uploaded under a temporary name and renamed into place once its
+remote size (and, with "verify_checksum", its SHA-256) matches the local
+file, so the recipient never picks up a partial drop. Connection drops and
+timeouts are retried with exponential backoff; authentication and host key
+failures are not. A target with "redaction" only takes exports written
+with that redaction policy (see redaction).
+"""
+
+import io
+import os
+import time
+import socket
+import hashlib
+import logging
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+from secret_providers import secret_resolver, refresh_config_secrets
+
+try:
+    import paramiko
+    PARAMIKO_AVAILABLE = True
+except ImportError:
+    # SFTP delivery requires paramiko
+    PARAMIKO_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+DEFAULT_MAX_ATTEMPTS = 5
+DEFAULT_BACKOFF_SECONDS = 5.0
+DEFAULT_MAX_BACKOFF_SECONDS = 300.0
+DEFAULT_SFTP_TIMEOUT = 60
+
+# Read size when hashing files
+HASH_CHUNK_SIZE = 1024 * 1024
+
+# Suffix of a file while it is being uploaded
+PARTIAL_SUFFIX = ".part"
+
+
+class DeliveryError(Exception):
+    """Raised when an export file cannot be delivered."""
+
+
+class TransientDeliveryError(DeliveryError):
+    """Raised for delivery failures that may succeed on a later attempt."""
+
+
+def file_sha256(path: str) -> str:
+    """SHA-256 hex digest of a local file."""
+    digest = hashlib.sha256()
+    with open(path, "rb") as f:
+        for chunk in iter(lambda: f.read(HASH_CHUNK_SIZE), b""):
+            digest.update(chunk)
+    return digest.hexdigest()
+
+
+def _setting(config: Dict[str, Any], key: str, default: Optional[str] = None) -> Optional[str]:
+    """Read a delivery setting directly, from a secrets provider via *_secret, or via its *_env_var indirection."""
+    if config.get(key) is not None:
+        return str(config[key])
+    if config.get(f"{key}_secret"):
+        return secret_resolver.resolve(config[f"{key}_secret"])
+    env_var = config.get(f"{key}_env_var")
+    if env_var:
+        return os.environ.get(env_var, default)
+    return default
+
+
+class UnknownHostError(DeliveryError):
+    """Raised when an SFTP server's host key is not in known_hosts."""
+
+
+if PARAMIKO_AVAILABLE:
+    class _RejectUnknownHost(paramiko.MissingHostKeyPolicy):
+        """Refuse servers missing from known_hosts without retrying (paramiko's RejectPolicy raises SSHException)."""
+
+        def missing_host_key(self, client, hostname, key):
+            raise UnknownHostError(f"Host key of {hostname} ({key.get_name()}) is not in known_hosts")
+
+
+class DeliveryTarget:
+    """
+    Base class for export delivery targets.
+
+    Subclasses set delivery_type and implement send, which makes one attempt
+    and raises TransientDeliveryError for failures worth retrying.
+    """
+
+    delivery_type = "base"
+
+    def __init__(self, config: Dict[str, Any]):
+        """
+        Initialize the target.
+
+        Args:
+            config: Delivery configuration (one entry of gis_export.deliveries)
+        """
+        self.config = config
+        self.name = config.get("name") or self.delivery_type
+        self.formats = [f.lower() for f in config.get("formats", [])]
+        self.max_attempts = max(1, int(config.get("max_attempts", DEFAULT_MAX_ATTEMPTS)))
+        self.backoff_seconds = float(config.get("backoff_seconds", DEFAULT_BACKOFF_SECONDS))
+        self.max_backoff_seconds = float(config.get("max_backoff_seconds", DEFAULT_MAX_BACKOFF_SECONDS))
+        self.redaction = config.get("redaction")
+
+    def accepts(self, job: Dict[str, Any]) -> bool:
+        """Whether exports of this job's format go to this target."""
+        return not self.formats or job["export_format"] in self.formats
+
+    def deliver(self, job: Dict[str, Any], local_path: str) -> Dict[str, Any]:
+        """
+        Deliver an export file, retrying transient failures with exponential backoff.
+
+        Args:
+            job: Export job the file belongs to
+            local_path: Export file
+
+        Returns:
+            Delivery record saved on the export job; its status is DELIVERED or FAILED
+        """
+        result = {
+            "name": self.name,
+            "type": self.delivery_type,
+            "status": "FAILED",
+            "attempts": 0,
+            "started_at": datetime.utcnow().isoformat(),
+            "completed_at": None,
+            "error": None,
+        }
+        if self.redaction and self.redaction not in job.get("redaction", []):
+            # Written before the target asked for redaction, or for a caller allowed to see more
+            result["error"] = f"Export was not written with redaction policy {self.redaction}"
+            result["completed_at"] = result["started_at"]
+            logger.error(f"Not delivering export {job['job_id']} to {self.name}: {result['error']}")
+            return result
+        delay = self.backoff_seconds
+        while True:
+            result["attempts"] += 1
+            try:
+                result.update(self.send(job, local_path))
+                result["status"] = "DELIVERED"
+                result["error"] = None
+                break
+            except TransientDeliveryError as e:
+                result["error"] = str(e)
+                if result["attempts"] >= self.max_attempts:
+                    logger.error(f"Giving up delivering export {job['job_id']} to {self.name} "
+                                 f"after {result['attempts']} attempts: {e}")
+                    break
+                logger.warning(f"Delivery of export {job['job_id']} to {self.name} failed "
+                               f"(attempt {result['attempts']} of {self.max_attempts}), retrying in {delay:.0f}s: {e}")
+                time.sleep(delay)
+                delay = min(delay * 2, self.max_backoff_seconds)
+            except DeliveryError as e:
+                result["error"] = str(e)
+                logger.error(f"Cannot deliver export {job['job_id']} to {self.name}: {e}")
+                break
+            except Exception as e:
+                result["error"] = str(e)
+                logger.error(f"Error delivering export {job['job_id']} to {self.name}: {e}", exc_info=True)
+                break
+        result["completed_at"] = datetime.utcnow().isoformat()
+        return result
+
+    def send(self, job: Dict[str, Any], local_path: str) -> Dict[str, Any]:
+        """
+        Make one delivery attempt.
+
+        Returns:
+            Details merged into the delivery record (remote path, size, checksum)
+
+        Raises:
+            TransientDeliveryError: If the attempt failed in a way worth retrying
+            DeliveryError: If the delivery cannot succeed without a configuration change
+        """
+        raise NotImplementedError
+
+    def health_check(self) -> Dict[str, Any]:
+        """Check that the target can be reached."""
+        return {"name": self.name, "type": self.delivery_type, "status": "healthy"}
+
+
+class SftpDeliveryTarget(DeliveryTarget):
+    """
+    Delivery target that uploads export files to an SFTP server.
+
+    Settings: host, port (22), username, and a private key (private_key_path
+    or private_key / private_key_env_var holding the key text, with an
+    optional passphrase) or a password (each also as *_env_var, or *_secret
+    naming a secret, see secret_providers). The server's
+    host key must be in known_hosts_path (or the service account's
+    ~/.ssh/known_hosts); unknown hosts are rejected unless
+    "allow_unknown_hosts" is set for testing.
+
+    remote_dir and remote_filename are templates over county_id, year,
+    month, day, job_id, export_format and filename. "checksum_file" also
+    uploads a "<file>.sha256" sidecar for recipients that verify drops.
+    """
+
+    delivery_type = "sftp"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        if not PARAMIKO_AVAILABLE:
+            raise DeliveryError("SFTP delivery requires the paramiko package")
+        self.host = _setting(config, "host")
+        if not self.host:
+            raise ValueError(f"SFTP delivery {self.name} requires a host")
+        self.port = int(config.get("port", 22))
+        self.username = _setting(config, "username")
+        self.password = _setting(config, "password")
+        self.private_key_path = config.get("private_key_path")
+        self.private_key = _setting(config, "private_key")
+        self.passphrase = _setting(config, "passphrase")
+        if not (self.password or self.private_key_path or self.private_key):
+            raise ValueError(f"SFTP delivery {self.name} requires a private key or password")
+        self.known_hosts_path = config.get("known_hosts_path")
+        self.allow_unknown_hosts = bool(config.get("allow_unknown_hosts", False))
+        self.remote_dir = config.get("remote_dir", ".")
+        self.remote_filename = config.get("remote_filename", "{filename}")
+        self.verify_checksum = bool(config.get("verify_checksum", False))
+        self.checksum_file = bool(config.get("checksum_file", False))
+        self.timeout = int(config.get("timeout_seconds", DEFAULT_SFTP_TIMEOUT))
+
+    def send(self, job: Dict[str, Any], local_path: str) -> Dict[str, Any]:
+        fields = self._template_fields(job, local_path)
+        remote_dir = self.remote_dir.format(**fields).rstrip("/") or "/"
+        remote_path = f"{remote_dir}/{self.remote_filename.format(**fields)}"
+        size = os.path.getsize(local_path)
+        checksum = file_sha256(local_path) if self.verify_checksum or self.checksum_file else None
+
+        try:
+            try:
+                client = self._connect()
+            except paramiko.AuthenticationException:
+                # The password or key secret may have been rotated since it was cached
+                if not refresh_config_secrets(self.config):
+                    raise
+                client = self._connect()
+        except paramiko.AuthenticationException as e:
+            raise DeliveryError(f"Authentication to {self.host} failed: {e}")
+        except paramiko.BadHostKeyException as e:
+            raise DeliveryError(f"Host key of {self.host} does not match known_hosts: {e}")
+        except UnknownHostError:
+            raise
+        except (socket.error, EOFError, paramiko.SSHException) as e:
+            raise TransientDeliveryError(f"Could not connect to {self.host}:{self.port}: {e}")
+
+        try:
+            sftp = client.open_sftp()
+            sftp.get_channel().settimeout(self.timeout)
+            self._make_dirs(sftp, remote_dir)
+            partial_path = remote_path + PARTIAL_SUFFIX
+            sftp.put(local_path, partial_path, confirm=False)
+
+            remote_size = sftp.stat(partial_path).st_size
+            if remote_size != size:
+                sftp.remove(partial_path)
+                raise TransientDeliveryError(f"Remote size {remote_size} of {partial_path} does not match local size {size}")
+            if self.verify_checksum:
+                remote_checksum = self._remote_sha256(sftp, partial_path)
+                if remote_checksum != checksum:
+                    sftp.remove(partial_path)
+                    raise TransientDeliveryError(f"Checksum of {partial_path} does not match the local file")
+
+            self._rename(sftp, partial_path, remote_path)
+            if self.checksum_file:
+                with sftp.open(remote_path + ".sha256", "w") as f:
+                    f.write(f"{checksum}  {os.path.basename(remote_path)}\n")
+            logger.info(f"Delivered export {job['job_id']} to sftp://{self.host}{remote_path} ({size} bytes)")
+            return {"remote_path": remote_path, "size": size, "sha256": checksum,
+                    "checksum_verified": self.verify_checksum}
+        except (socket.error, EOFError, paramiko.SSHException) as e:
+            raise TransientDeliveryError(f"Transfer to {self.host} interrupted: {e}")
+        finally:
+            client.close()
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            client = self._connect()
+            try:
+                client.open_sftp().listdir(".")
+            finally:
+                client.close()
+            return {"name": self.name, "type": self.delivery_type, "status": "healthy", "host": self.host}
+        except Exception as e:
+            return {"name": self.name, "type": self.delivery_type, "status": "unavailable", "host": self.host,
+                    "error": str(e)}
+
+    def _connect(self) -> "paramiko.SSHClient":
+        """Open an SSH connection to the server, checking its host key."""
+        # Credentials are read for each connection, so rotated secrets are picked up
+        self.password = _setting(self.config, "password")
+        self.private_key = _setting(self.config, "private_key")
+        self.passphrase = _setting(self.config, "passphrase")
+        client = paramiko.SSHClient()
+        if self.known_hosts_path:
+            client.load_host_keys(self.known_hosts_path)
+        else:
+            client.load_system_host_keys()
+        client.set_missing_host_key_policy(
+            paramiko.AutoAddPolicy() if self.allow_unknown_hosts else _RejectUnknownHost()
+        )
+        key = None
+        if self.private_key:
+            key = self._load_key_text(self.private_key)
+        client.connect(
+            self.host, port=self.port, username=self.username, password=self.password,
+            pkey=key, key_filename=self.private_key_path if key is None else None, passphrase=self.passphrase,
+            timeout=self.timeout, banner_timeout=self.timeout, auth_timeout=self.timeout,
+            look_for_keys=False, allow_agent=False,
+        )
+        return client
+
+    def _load_key_text(self, text: str) -> "paramiko.PKey":
+        """Load a private key given as text, trying each key type paramiko supports."""
+        for key_class in (paramiko.Ed25519Key, paramiko.ECDSAKey, paramiko.RSAKey):
+            try:
+                return key_class.from_private_key(io.StringIO(text), password=self.passphrase)
+            except paramiko.SSHException:
+                continue
+        raise DeliveryError(f"SFTP delivery {self.name}: private key is not a supported Ed25519, ECDSA or RSA key")
+
+    @staticmethod
+    def _make_dirs(sftp: "paramiko.SFTPClient", remote_dir: str) -> None:
+        """Create a remote directory and its parents if they do not exist."""
+        path = "/" if remote_dir.startswith("/") else ""
+        for part in (p for p in remote_dir.split("/") if p):
+            path = path + part if path in ("", "/") else f"{path}/{part}"
+            try:
+                sftp.stat(path)
+            except IOError:
+                sftp.mkdir(path)
+
+    @staticmethod
+    def _rename(sftp: "paramiko.SFTPClient", source: str, target: str) -> None:
+        """Move a file into place, replacing an earlier delivery of the same name."""
+        try:
+            sftp.posix_rename(source, target)
+        except IOError:
+            # Servers without the posix-rename extension refuse to rename over an existing file
+            try:
+                sftp.remove(target)
+            except IOError:
+                pass
+            sftp.rename(source, target)
+
+    @staticmethod
+    def _remote_sha256(sftp: "paramiko.SFTPClient", remote_path: str) -> str:
+        """SHA-256 of a remote file, read back over the connection."""
+        digest = hashlib.sha256()
+        with sftp.open(remote_path, "rb") as f:
+            f.prefetch()
+            for chunk in iter(lambda: f.read(HASH_CHUNK_SIZE), b""):
+                digest.update(chunk)
+        return digest.hexdigest()
+
+    @staticmethod
+    def _template_fields(job: Dict[str, Any], local_path: str) -> Dict[str, str]:
+        """Values of the remote_dir and remote_filename template fields."""
+        created_at = job.get("created_at")
+        created = datetime.fromisoformat(created_at) if created_at else datetime.utcnow()
+        return {
+            "county_id": job["county_id"],
+            "year": f"{created.year:04d}",
+            "month": f"{created.month:02d}",
+            "day": f"{created.day:02d}",
+            "job_id": job["job_id"],
+            "export_format": job["export_format"],
+            "filename": os.path.basename(local_path),
+        }
+
+
+# Registry of delivery target types by name
+DELIVERY_TYPES = {
+    SftpDeliveryTarget.delivery_type: SftpDeliveryTarget,
+}
+
+
+def create_delivery_target(config: Dict[str, Any]) -> DeliveryTarget:
+    """
+    Create the delivery target described by one entry of gis_export.deliveries.
+
+    Args:
+        config: Delivery configuration
+
+    Returns:
+        DeliveryTarget instance
+    """
+    delivery_type = config.get("type")
+    if delivery_type not in DELIVERY_TYPES:
+        raise ValueError(f"Unsupported delivery type: {delivery_type}. Supported types: {', '.join(DELIVERY_TYPES)}")
+    return DELIVERY_TYPES[delivery_type](config)
+
+
+def create_delivery_targets(configs: Optional[List[Dict[str, Any]]]) -> List[DeliveryTarget]:
+    """Create the delivery targets of a county, rejecting duplicate names."""
+    targets = [create_delivery_target(c) for c in configs or []]
+    names = [t.name for t in targets]
+    duplicates = sorted({n for n in names if names.count(n) > 1})
+    if duplicates:
+        raise ValueError(f"Duplicate delivery names: {', '.join(duplicates)}")
+    return targets
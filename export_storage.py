@@ -0,0 +1,610 @@
+"""
+TerraFusion Platform - Export Artifact Storage
+
+This module provides the stores that completed GIS export files are delivered
+to. By default artifacts stay on the local disk of the service; counties can
+instead configure an S3-compatible bucket (AWS S3, MinIO, Wasabi, ...), an
+Azure Blob Storage container or a Google Cloud Storage bucket under plugin_settings.gis_export.artifact_storage
+in their county configuration:
+
+    "artifact_storage": {
+        "type": "s3",
+        "bucket": "benton-gis-exports",
+        "endpoint_url": "https://s3.us-west-2.amazonaws.com",
+        "encryption": "aws:kms",
+        "kms_key_id": "alias/terrafusion-exports"
+    }
+
+Objects are written under a key layout ("{prefix}/{county_id}/{year}/{run_id}/{filename}"
+by default) that keeps each county and year under its own prefix, so bucket
+lifecycle rules can expire or archive old exports without touching current
+ones. Large files are sent as multipart (S3) or block (Azure) uploads; a
+failed upload is aborted so no partial object or orphaned parts remain.
+"""
+
+import os
+import math
+import uuid
+import base64
+import hashlib
+import logging
+from datetime import datetime, timedelta
+from urllib.parse import urlencode
+from typing import Dict, Any, Optional, Iterator, Tuple
+
+from secret_providers import secret_resolver
+
+try:
+    import boto3
+    from botocore.config import Config as BotoConfig
+    BOTO3_AVAILABLE = True
+except ImportError:
+    # S3-compatible storage requires boto3
+    BOTO3_AVAILABLE = False
+
+try:
+    from azure.storage.blob import (
+        BlobServiceClient, BlobSasPermissions, ContentSettings, CustomerProvidedEncryptionKey, generate_blob_sas
+    )
+    AZURE_BLOB_AVAILABLE = True
+except ImportError:
+    # Azure Blob Storage requires azure-storage-blob
+    AZURE_BLOB_AVAILABLE = False
+
+try:
+    from google.cloud import storage as gcs
+    GCS_AVAILABLE = True
+except ImportError:
+    # Google Cloud Storage requires google-cloud-storage
+    GCS_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+DEFAULT_KEY_LAYOUT = "{prefix}/{county_id}/{year}/{run_id}/{filename}"
+DEFAULT_KEY_PREFIX = "gis-exports"
+
+# Fields a key layout may use
+KEY_LAYOUT_FIELDS = ["prefix", "county_id", "year", "month", "run_id", "export_format", "filename"]
+
+# Files at least this large are uploaded in parts
+DEFAULT_MULTIPART_THRESHOLD = 64 * 1024 * 1024
+DEFAULT_PART_SIZE = 16 * 1024 * 1024
+
+# S3 rejects parts smaller than 5 MiB (except the last) and more than 10,000 parts
+S3_MIN_PART_SIZE = 5 * 1024 * 1024
+S3_MAX_PARTS = 10000
+
+# Azure block blobs hold at most 50,000 blocks
+AZURE_MAX_BLOCKS = 50000
+
+DEFAULT_DOWNLOAD_EXPIRY_SECONDS = 3600
+
+# Size of the chunks a download is streamed in
+STREAM_CHUNK_SIZE = 1024 * 1024
+
+S3_ENCRYPTION_MODES = ["AES256", "aws:kms", "customer"]
+
+
+class ArtifactStoreError(Exception):
+    """Raised when an export artifact cannot be stored or retrieved."""
+
+
+def artifact_key(job: Dict[str, Any], filename: str, layout: str = DEFAULT_KEY_LAYOUT,
+                 prefix: str = DEFAULT_KEY_PREFIX) -> str:
+    """
+    Build the object key of an export artifact.
+
+    Args:
+        job: Export job the artifact belongs to
+        filename: Name of the artifact file
+        layout: Key template using the KEY_LAYOUT_FIELDS
+        prefix: Value of the {prefix} field
+
+    Returns:
+        Object key without leading or doubled slashes
+    """
+    created_at = job.get("created_at")
+    created = datetime.fromisoformat(created_at) if created_at else datetime.utcnow()
+    fields = {
+        "prefix": prefix or "",
+        "county_id": job["county_id"],
+        "year": f"{created.year:04d}",
+        "month": f"{created.month:02d}",
+        "run_id": job["job_id"],
+        "export_format": job.get("export_format", ""),
+        "filename": filename,
+    }
+    try:
+        key = layout.format(**{name: str(value).strip("/") for name, value in fields.items()})
+    except KeyError as e:
+        raise ValueError(f"Unknown key layout field {e.args[0]}. Supported fields: {', '.join(KEY_LAYOUT_FIELDS)}")
+    return "/".join(part for part in key.split("/") if part)
+
+
+def _setting(config: Dict[str, Any], key: str, default: Optional[str] = None) -> Optional[str]:
+    """Read a store setting directly, from a secrets provider via *_secret, or via its *_env_var indirection."""
+    if config.get(key) is not None:
+        return str(config[key])
+    if config.get(f"{key}_secret"):
+        return secret_resolver.resolve(config[f"{key}_secret"])
+    env_var = config.get(f"{key}_env_var")
+    if env_var:
+        return os.environ.get(env_var, default)
+    return default
+
+
+def _read_chunks(path: str, chunk_size: int) -> Iterator[bytes]:
+    """Read a file in chunks of chunk_size bytes."""
+    with open(path, "rb") as f:
+        while True:
+            chunk = f.read(chunk_size)
+            if not chunk:
+                return
+            yield chunk
+
+
+class ArtifactStore:
+    """
+    Base class for export artifact stores.
+
+    Subclasses set backend_name and implement put, delete and stream; stores
+    that can hand out signed links also implement download_url.
+    """
+
+    backend_name = "base"
+
+    def __init__(self, config: Dict[str, Any]):
+        """
+        Initialize the store.
+
+        Args:
+            config: Store configuration (the artifact_storage block)
+        """
+        self.config = config
+        self.key_layout = config.get("key_layout", DEFAULT_KEY_LAYOUT)
+        self.prefix = config.get("prefix", DEFAULT_KEY_PREFIX)
+        self.keep_local = bool(config.get("keep_local", False))
+        self.download_expiry_seconds = int(config.get("download_expiry_seconds", DEFAULT_DOWNLOAD_EXPIRY_SECONDS))
+
+    def key_for(self, job: Dict[str, Any], filename: str) -> str:
+        """The object key of an artifact of a job."""
+        return artifact_key(job, filename, self.key_layout, self.prefix)
+
+    def put(self, local_path: str, key: str, content_type: Optional[str] = None,
+            tags: Optional[Dict[str, str]] = None) -> Dict[str, Any]:
+        """
+        Store a local file.
+
+        Args:
+            local_path: File to upload
+            key: Object key to store it under
+            content_type: MIME type of the file
+            tags: Object tags (usable in lifecycle rules)
+
+        Returns:
+            Artifact record saved on the export job (backend, key, size, ...)
+        """
+        raise NotImplementedError
+
+    def delete(self, key: str) -> bool:
+        """Delete an artifact. Returns True if one was removed."""
+        raise NotImplementedError
+
+    def stream(self, key: str) -> Iterator[bytes]:
+        """Stream the contents of an artifact."""
+        raise NotImplementedError
+
+    def download_url(self, key: str, filename: str) -> Optional[str]:
+        """A time-limited link clients can download the artifact from, or None when the store cannot sign one."""
+        return None
+
+    def health_check(self) -> Dict[str, Any]:
+        """Check that the store can be reached."""
+        return {"backend": self.backend_name, "status": "healthy"}
+
+
+class LocalArtifactStore(ArtifactStore):
+    """Artifact store that leaves export files where the exporter wrote them; the key is the file path."""
+
+    backend_name = "local"
+
+    def put(self, local_path: str, key: str, content_type: Optional[str] = None,
+            tags: Optional[Dict[str, str]] = None) -> Dict[str, Any]:
+        return {"backend": self.backend_name, "key": local_path, "size": os.path.getsize(local_path)}
+
+    def delete(self, key: str) -> bool:
+        if os.path.exists(key):
+            os.remove(key)
+            return True
+        return False
+
+    def stream(self, key: str) -> Iterator[bytes]:
+        return _read_chunks(key, STREAM_CHUNK_SIZE)
+
+
+class S3ArtifactStore(ArtifactStore):
+    """
+    Artifact store for S3 and S3-compatible object storage.
+
+    Settings: bucket, endpoint_url (for non-AWS services), region,
+    access_key_id / secret_access_key (or their *_env_var forms; the default
+    AWS credential chain otherwise), addressing_style ("path" for most
+    on-premises services), storage_class, multipart_threshold_mb and
+    part_size_mb.
+
+    Server-side encryption is chosen with "encryption": "AES256" (S3-managed
+    keys), "aws:kms" (with an optional kms_key_id) or "customer" (SSE-C, with
+    a base64 256-bit customer_key / customer_key_env_var). Objects encrypted
+    with a customer key cannot be fetched through a signed link, so their
+    downloads are streamed through the service.
+    """
+
+    backend_name = "s3"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        if not BOTO3_AVAILABLE:
+            raise ArtifactStoreError("S3 artifact storage requires the boto3 package")
+        self.bucket = config.get("bucket")
+        if not self.bucket:
+            raise ValueError("S3 artifact storage requires a bucket")
+        self.encryption = config.get("encryption")
+        if self.encryption and self.encryption not in S3_ENCRYPTION_MODES:
+            raise ValueError(f"Unsupported S3 encryption: {self.encryption}. "
+                             f"Supported modes: {', '.join(S3_ENCRYPTION_MODES)}")
+        self.kms_key_id = _setting(config, "kms_key_id")
+        self.customer_key = _setting(config, "customer_key")
+        if self.encryption == "customer" and not self.customer_key:
+            raise ValueError("S3 customer-key encryption requires customer_key or customer_key_env_var")
+        self.storage_class = config.get("storage_class")
+        self.multipart_threshold = int(float(config.get("multipart_threshold_mb", 0)) * 1024 * 1024) \
+            or DEFAULT_MULTIPART_THRESHOLD
+        self.part_size = max(S3_MIN_PART_SIZE,
+                             int(float(config.get("part_size_mb", 0)) * 1024 * 1024) or DEFAULT_PART_SIZE)
+        self.client = boto3.client(
+            "s3",
+            endpoint_url=_setting(config, "endpoint_url"),
+            region_name=_setting(config, "region"),
+            aws_access_key_id=_setting(config, "access_key_id"),
+            aws_secret_access_key=_setting(config, "secret_access_key"),
+            config=BotoConfig(s3={"addressing_style": config.get("addressing_style", "auto")},
+                              retries={"max_attempts": int(config.get("max_attempts", 5)), "mode": "standard"}),
+        )
+
+    def put(self, local_path: str, key: str, content_type: Optional[str] = None,
+            tags: Optional[Dict[str, str]] = None) -> Dict[str, Any]:
+        size = os.path.getsize(local_path)
+        args = self._object_args(content_type, tags)
+        if size < self.multipart_threshold:
+            with open(local_path, "rb") as f:
+                response = self.client.put_object(Bucket=self.bucket, Key=key, Body=f,
+                                                  **args, **self._customer_key_args())
+            parts = 1
+        else:
+            response, parts = self._multipart_upload(local_path, key, size, args)
+        logger.info(f"Uploaded export artifact s3://{self.bucket}/{key} ({size} bytes, {parts} parts)")
+        return {
+            "backend": self.backend_name,
+            "bucket": self.bucket,
+            "key": key,
+            "size": size,
+            "etag": response.get("ETag", "").strip('"'),
+            "parts": parts,
+            "encryption": self.encryption,
+            "uploaded_at": datetime.utcnow().isoformat(),
+        }
+
+    def delete(self, key: str) -> bool:
+        self.client.delete_object(Bucket=self.bucket, Key=key)
+        return True
+
+    def stream(self, key: str) -> Iterator[bytes]:
+        response = self.client.get_object(Bucket=self.bucket, Key=key, **self._customer_key_args())
+        return response["Body"].iter_chunks(STREAM_CHUNK_SIZE)
+
+    def download_url(self, key: str, filename: str) -> Optional[str]:
+        if self.encryption == "customer":
+            return None
+        return self.client.generate_presigned_url(
+            "get_object",
+            Params={"Bucket": self.bucket, "Key": key,
+                    "ResponseContentDisposition": f'attachment; filename="{filename}"'},
+            ExpiresIn=self.download_expiry_seconds,
+        )
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.client.head_bucket(Bucket=self.bucket)
+            return {"backend": self.backend_name, "status": "healthy", "bucket": self.bucket}
+        except Exception as e:
+            return {"backend": self.backend_name, "status": "unavailable", "bucket": self.bucket, "error": str(e)}
+
+    def _multipart_upload(self, local_path: str, key: str, size: int,
+                          args: Dict[str, Any]) -> Tuple[Dict[str, Any], int]:
+        """Upload a file in parts, aborting the upload if any part fails."""
+        part_size = max(self.part_size, math.ceil(size / S3_MAX_PARTS))
+        upload = self.client.create_multipart_upload(Bucket=self.bucket, Key=key, **args, **self._customer_key_args())
+        upload_id = upload["UploadId"]
+        parts = []
+        try:
+            for number, chunk in enumerate(_read_chunks(local_path, part_size), start=1):
+                response = self.client.upload_part(
+                    Bucket=self.bucket, Key=key, UploadId=upload_id, PartNumber=number, Body=chunk,
+                    **self._customer_key_args()
+                )
+                parts.append({"PartNumber": number, "ETag": response["ETag"]})
+            response = self.client.complete_multipart_upload(
+                Bucket=self.bucket, Key=key, UploadId=upload_id, MultipartUpload={"Parts": parts}
+            )
+        except Exception:
+            # Abandoned parts are billed until aborted
+            try:
+                self.client.abort_multipart_upload(Bucket=self.bucket, Key=key, UploadId=upload_id)
+            except Exception as e:
+                logger.error(f"Error aborting multipart upload {upload_id} of s3://{self.bucket}/{key}: {e}")
+            raise
+        return response, len(parts)
+
+    def _object_args(self, content_type: Optional[str], tags: Optional[Dict[str, str]]) -> Dict[str, Any]:
+        """Arguments of put_object / create_multipart_upload besides the customer key."""
+        args: Dict[str, Any] = {}
+        if content_type:
+            args["ContentType"] = content_type
+        if tags:
+            args["Tagging"] = urlencode(tags)
+        if self.storage_class:
+            args["StorageClass"] = self.storage_class
+        if self.encryption in ("AES256", "aws:kms"):
+            args["ServerSideEncryption"] = self.encryption
+            if self.encryption == "aws:kms" and self.kms_key_id:
+                args["SSEKMSKeyId"] = self.kms_key_id
+        return args
+
+    def _customer_key_args(self) -> Dict[str, Any]:
+        """SSE-C arguments, which every request on the object must repeat."""
+        if self.encryption != "customer":
+            return {}
+        key = base64.b64decode(self.customer_key)
+        return {
+            "SSECustomerAlgorithm": "AES256",
+            "SSECustomerKey": key,
+            "SSECustomerKeyMD5": base64.b64encode(hashlib.md5(key).digest()).decode(),
+        }
+
+
+class AzureBlobArtifactStore(ArtifactStore):
+    """
+    Artifact store for Azure Blob Storage.
+
+    Settings: container, and either connection_string or account_url with an
+    account_key or sas_token (each also as *_env_var). Optional access_tier
+    (Hot, Cool, Cold, Archive), multipart_threshold_mb and part_size_mb.
+
+    Encryption at rest is always on; "encryption_scope" selects a scope set up
+    with customer-managed keys, and "customer_key" / "customer_key_env_var"
+    (base64 256-bit) encrypts with a customer-provided key. Signed download
+    links need the account key and are not available for customer-provided
+    keys; those downloads are streamed through the service.
+    """
+
+    backend_name = "azure_blob"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        if not AZURE_BLOB_AVAILABLE:
+            raise ArtifactStoreError("Azure Blob artifact storage requires the azure-storage-blob package")
+        self.container = config.get("container")
+        if not self.container:
+            raise ValueError("Azure Blob artifact storage requires a container")
+        connection_string = _setting(config, "connection_string")
+        self.account_key = _setting(config, "account_key")
+        if connection_string:
+            self.service = BlobServiceClient.from_connection_string(connection_string)
+            if not self.account_key:
+                self.account_key = getattr(self.service.credential, "account_key", None)
+        else:
+            account_url = _setting(config, "account_url")
+            if not account_url:
+                raise ValueError("Azure Blob artifact storage requires connection_string or account_url")
+            self.service = BlobServiceClient(account_url, credential=self.account_key or _setting(config, "sas_token"))
+        self.encryption_scope = config.get("encryption_scope")
+        customer_key = _setting(config, "customer_key")
+        self.customer_key = None
+        if customer_key:
+            key = base64.b64decode(customer_key)
+            self.customer_key = CustomerProvidedEncryptionKey(
+                key_value=customer_key, key_hash=base64.b64encode(hashlib.sha256(key).digest()).decode()
+            )
+        self.access_tier = config.get("access_tier")
+        self.multipart_threshold = int(float(config.get("multipart_threshold_mb", 0)) * 1024 * 1024) \
+            or DEFAULT_MULTIPART_THRESHOLD
+        self.part_size = int(float(config.get("part_size_mb", 0)) * 1024 * 1024) or DEFAULT_PART_SIZE
+
+    def put(self, local_path: str, key: str, content_type: Optional[str] = None,
+            tags: Optional[Dict[str, str]] = None) -> Dict[str, Any]:
+        size = os.path.getsize(local_path)
+        blob = self.service.get_blob_client(self.container, key)
+        args: Dict[str, Any] = {"content_settings": ContentSettings(content_type=content_type), "tags": tags}
+        if self.access_tier:
+            args["standard_blob_tier"] = self.access_tier
+        if self.encryption_scope:
+            args["encryption_scope"] = self.encryption_scope
+        if self.customer_key:
+            args["cpk"] = self.customer_key
+
+        if size < self.multipart_threshold:
+            with open(local_path, "rb") as f:
+                response = blob.upload_blob(f, overwrite=True, **args)
+            blocks = 1
+        else:
+            part_size = max(self.part_size, math.ceil(size / AZURE_MAX_BLOCKS))
+            # Staged blocks that are never committed expire after a week; a retry rewrites them
+            block_ids = []
+            for number, chunk in enumerate(_read_chunks(local_path, part_size)):
+                block_id = base64.b64encode(f"{uuid.uuid4().hex}-{number:06d}".encode()).decode()
+                blob.stage_block(block_id, chunk, **{k: v for k, v in args.items() if k in ("cpk", "encryption_scope")})
+                block_ids.append(block_id)
+            response = blob.commit_block_list(block_ids, **args)
+            blocks = len(block_ids)
+        logger.info(f"Uploaded export artifact {self.container}/{key} to Azure Blob ({size} bytes, {blocks} blocks)")
+        return {
+            "backend": self.backend_name,
+            "container": self.container,
+            "key": key,
+            "size": size,
+            "etag": str(response.get("etag", "")).strip('"'),
+            "parts": blocks,
+            "encryption_scope": self.encryption_scope,
+            "customer_key": self.customer_key is not None,
+            "uploaded_at": datetime.utcnow().isoformat(),
+        }
+
+    def delete(self, key: str) -> bool:
+        self.service.get_blob_client(self.container, key).delete_blob()
+        return True
+
+    def stream(self, key: str) -> Iterator[bytes]:
+        downloader = self.service.get_blob_client(self.container, key).download_blob(cpk=self.customer_key)
+        return downloader.chunks()
+
+    def download_url(self, key: str, filename: str) -> Optional[str]:
+        if self.customer_key or not self.account_key:
+            return None
+        blob = self.service.get_blob_client(self.container, key)
+        token = generate_blob_sas(
+            account_name=self.service.account_name,
+            container_name=self.container,
+            blob_name=key,
+            account_key=self.account_key,
+            permission=BlobSasPermissions(read=True),
+            expiry=datetime.utcnow() + timedelta(seconds=self.download_expiry_seconds),
+            content_disposition=f'attachment; filename="{filename}"',
+        )
+        return f"{blob.url}?{token}"
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.service.get_container_client(self.container).get_container_properties()
+            return {"backend": self.backend_name, "status": "healthy", "container": self.container}
+        except Exception as e:
+            return {"backend": self.backend_name, "status": "unavailable", "container": self.container,
+                    "error": str(e)}
+
+
+class GCSArtifactStore(ArtifactStore):
+    """
+    Artifact store for Google Cloud Storage.
+
+    Settings: bucket, project, credentials_path / credentials_path_env_var (a
+    service account key file; application default credentials otherwise),
+    storage_class, kms_key_name (a Cloud KMS key for customer-managed
+    encryption) and part_size_mb (the chunk size of resumable uploads, used
+    for files above multipart_threshold_mb).
+    """
+
+    backend_name = "gcs"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        if not GCS_AVAILABLE:
+            raise ArtifactStoreError("Google Cloud Storage artifact storage requires the google-cloud-storage package")
+        self.bucket_name = config.get("bucket")
+        if not self.bucket_name:
+            raise ValueError("Google Cloud Storage artifact storage requires a bucket")
+        credentials_path = _setting(config, "credentials_path")
+        project = _setting(config, "project")
+        if credentials_path:
+            self.client = gcs.Client.from_service_account_json(credentials_path, project=project)
+        else:
+            self.client = gcs.Client(project=project)
+        self.bucket = self.client.bucket(self.bucket_name)
+        self.storage_class = config.get("storage_class")
+        self.kms_key_name = config.get("kms_key_name")
+        self.multipart_threshold = int(float(config.get("multipart_threshold_mb", 0)) * 1024 * 1024) \
+            or DEFAULT_MULTIPART_THRESHOLD
+        # Resumable upload chunks must be multiples of 256 KiB
+        part_size = int(float(config.get("part_size_mb", 0)) * 1024 * 1024) or DEFAULT_PART_SIZE
+        self.part_size = max(256 * 1024, part_size - part_size % (256 * 1024))
+
+    def put(self, local_path: str, key: str, content_type: Optional[str] = None,
+            tags: Optional[Dict[str, str]] = None) -> Dict[str, Any]:
+        size = os.path.getsize(local_path)
+        chunk_size = self.part_size if size >= self.multipart_threshold else None
+        blob = self.bucket.blob(key, chunk_size=chunk_size, kms_key_name=self.kms_key_name)
+        if self.storage_class:
+            blob.storage_class = self.storage_class
+        if tags:
+            # GCS has no object tags; custom metadata serves lifecycle matching and audits
+            blob.metadata = dict(tags)
+        blob.upload_from_filename(local_path, content_type=content_type)
+        logger.info(f"Uploaded export artifact gs://{self.bucket_name}/{key} ({size} bytes)")
+        return {
+            "backend": self.backend_name,
+            "bucket": self.bucket_name,
+            "key": key,
+            "size": size,
+            "etag": blob.etag,
+            "generation": blob.generation,
+            "parts": math.ceil(size / chunk_size) if chunk_size else 1,
+            "kms_key_name": self.kms_key_name,
+            "uploaded_at": datetime.utcnow().isoformat(),
+        }
+
+    def delete(self, key: str) -> bool:
+        self.bucket.blob(key).delete()
+        return True
+
+    def stream(self, key: str) -> Iterator[bytes]:
+        with self.bucket.blob(key).open("rb", chunk_size=STREAM_CHUNK_SIZE) as f:
+            while True:
+                chunk = f.read(STREAM_CHUNK_SIZE)
+                if not chunk:
+                    break
+                yield chunk
+
+    def download_url(self, key: str, filename: str) -> Optional[str]:
+        try:
+            return self.bucket.blob(key).generate_signed_url(
+                version="v4",
+                expiration=timedelta(seconds=self.download_expiry_seconds),
+                response_disposition=f'attachment; filename="{filename}"',
+            )
+        except AttributeError:
+            # Signing needs a private key; credentials without one (e.g. user ADC) stream instead
+            return None
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.bucket.reload()
+            return {"backend": self.backend_name, "status": "healthy", "bucket": self.bucket_name}
+        except Exception as e:
+            return {"backend": self.backend_name, "status": "unavailable", "bucket": self.bucket_name, "error": str(e)}
+
+
+# Registry of artifact store types by name
+ARTIFACT_STORE_TYPES = {
+    LocalArtifactStore.backend_name: LocalArtifactStore,
+    S3ArtifactStore.backend_name: S3ArtifactStore,
+    AzureBlobArtifactStore.backend_name: AzureBlobArtifactStore,
+    GCSArtifactStore.backend_name: GCSArtifactStore,
+}
+
+
+def create_artifact_store(config: Optional[Dict[str, Any]] = None) -> ArtifactStore:
+    """
+    Create the artifact store described by an artifact_storage block.
+
+    Args:
+        config: Store configuration; local storage when empty
+
+    Returns:
+        ArtifactStore instance
+    """
+    config = config or {}
+    store_type = config.get("type", LocalArtifactStore.backend_name)
+    if store_type not in ARTIFACT_STORE_TYPES:
+        raise ValueError(f"Unsupported artifact storage type: {store_type}. "
+                         f"Supported types: {', '.join(ARTIFACT_STORE_TYPES)}")
+    return ARTIFACT_STORE_TYPES[store_type](config)
@@ -0,0 +1,3 @@
+module github.com/bsvalues/TerraFusionSync/gen/go
+
+go 1.21
@@ -0,0 +1,251 @@
+"""
+TerraFusion Platform - Export Bundles
+
+This module packs the files of a GIS export into a single ZIP or tar.gz
+artifact with checksum manifests, so formats that produce several files
+(shapefile sidecars, tile pyramids) or an export with supporting files can be
+handed over and verified as one download. Every bundle holds a top-level
+folder with the export's files, a manifest.json describing the export and its
+files, and a SHA256SUMS file that `sha256sum -c` checks after extracting.
+Large text files such as GeoJSON can be gzipped one by one inside the bundle.
+
+Bundling is chosen per county under plugin_settings.gis_export.bundle:
+
+    "bundle": {"format": "tar.gz", "formats": ["shapefile", "mvt"], "gzip": true}
+
+and per job with parameters.bundle ("zip", "tar.gz", "none" or an object
+like the setting).
+"""
+
+import os
+import gzip
+import json
+import shutil
+import hashlib
+import logging
+import tarfile
+import tempfile
+import time
+import zipfile
+from datetime import datetime
+from typing import Dict, List, Any, Optional, BinaryIO
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Bundle formats with their file extensions and MIME types
+BUNDLE_FORMATS = {
+    "zip": ("zip", "application/zip"),
+    "tar.gz": ("tar.gz", "application/gzip"),
+}
+
+# Extensions of the files gzipped inside a bundle when gzip is on
+DEFAULT_GZIP_EXTENSIONS = ["geojson", "json", "csv", "kml", "dxf"]
+
+# Files smaller than this are never gzipped
+DEFAULT_GZIP_MIN_BYTES = 1024 * 1024
+
+# Extensions of already compressed files, stored in a ZIP bundle without compressing again
+STORED_EXTENSIONS = {"gz", "zip", "kmz", "xlsx", "parquet", "mbtiles", "pdf"}
+
+MANIFEST_NAME = "manifest.json"
+CHECKSUMS_NAME = "SHA256SUMS"
+
+# Bytes copied at a time
+COPY_CHUNK_BYTES = 1024 * 1024
+
+
+class BundleOptions:
+    """
+    How an export is bundled: the county's bundle settings overridden by the
+    job's parameters.bundle.
+
+    Raises:
+        ValueError: If the settings or parameters are invalid
+    """
+
+    def __init__(self, settings: Optional[Dict[str, Any]], parameters: Optional[Dict[str, Any]], export_format: str):
+        settings = settings or {}
+        if not isinstance(settings, dict):
+            raise ValueError("gis_export.bundle must be an object")
+        requested = (parameters or {}).get("bundle")
+        if requested is None:
+            formats = settings.get("formats")
+            if formats is not None and not isinstance(formats, list):
+                raise ValueError("gis_export.bundle.formats must be a list of export formats")
+            values = dict(settings) if formats is None or export_format in formats else {}
+        elif isinstance(requested, str):
+            values = dict(settings, format=requested)
+        elif isinstance(requested, dict):
+            values = dict(settings, **requested)
+        else:
+            raise ValueError('parameters.bundle must be "zip", "tar.gz", "none" or an object')
+
+        self.format = values.get("format") or None
+        if self.format == "none":
+            self.format = None
+        if self.format is not None and self.format not in BUNDLE_FORMATS:
+            raise ValueError(f"Unsupported bundle format: {self.format}. Supported: {', '.join(BUNDLE_FORMATS)}, none")
+        self.gzip = values.get("gzip", False)
+        if not isinstance(self.gzip, bool):
+            raise ValueError("bundle gzip must be true or false")
+        self.gzip_extensions = values.get("gzip_extensions", DEFAULT_GZIP_EXTENSIONS)
+        if not isinstance(self.gzip_extensions, list) or not all(isinstance(e, str) for e in self.gzip_extensions):
+            raise ValueError("bundle gzip_extensions must be a list of file extensions")
+        self.gzip_extensions = [e.lower().lstrip(".") for e in self.gzip_extensions]
+        self.gzip_min_bytes = values.get("gzip_min_bytes", DEFAULT_GZIP_MIN_BYTES)
+        if isinstance(self.gzip_min_bytes, bool) or not isinstance(self.gzip_min_bytes, int) or self.gzip_min_bytes < 0:
+            raise ValueError("bundle gzip_min_bytes must be a non-negative integer")
+
+    @property
+    def extension(self) -> str:
+        return BUNDLE_FORMATS[self.format][0]
+
+    @property
+    def content_type(self) -> str:
+        return BUNDLE_FORMATS[self.format][1]
+
+    def gzips(self, name: str, size: int) -> bool:
+        """Whether a file is gzipped inside the bundle."""
+        extension = name.rsplit(".", 1)[-1].lower() if "." in name else ""
+        return self.gzip and extension in self.gzip_extensions and size >= self.gzip_min_bytes
+
+
+class BundleWriter:
+    """
+    Writes a bundle file a member at a time; close() adds the manifests.
+
+    Members are copied through a temporary file, gzipped if the options say
+    so and hashed on the way, so a member of any size is never held in memory.
+    """
+
+    def __init__(self, path: str, options: BundleOptions, root: str, export: Dict[str, Any]):
+        """
+        Initialize the writer.
+
+        Args:
+            path: Bundle file to write
+            options: Bundle options (with a format)
+            root: Name of the top-level folder the files go in
+            export: Description of the export for the manifest
+        """
+        self.path = path
+        self.options = options
+        self.root = root
+        self.export = export
+        self.files: List[Dict[str, Any]] = []
+        self._mtime = time.time()
+        self._work_dir = tempfile.mkdtemp(prefix="tf_bundle_")
+        if options.format == "zip":
+            self._archive = zipfile.ZipFile(path, "w", zipfile.ZIP_DEFLATED)
+        else:
+            self._archive = tarfile.open(path, "w:gz")
+
+    def __enter__(self) -> "BundleWriter":
+        return self
+
+    def __exit__(self, exc_type, exc, tb) -> None:
+        if exc_type is None:
+            self.close()
+        else:
+            self._discard()
+
+    def add_file(self, path: str, name: str) -> None:
+        """Add a file on disk as a member of the bundle."""
+        with open(path, "rb") as f:
+            self.add_stream(f, name, os.path.getsize(path))
+
+    def add_archive(self, path: str) -> None:
+        """Add the files of a ZIP file as members of the bundle, keeping their folders."""
+        with zipfile.ZipFile(path) as source:
+            for info in source.infolist():
+                if info.is_dir():
+                    continue
+                with source.open(info) as f:
+                    self.add_stream(f, info.filename, info.file_size)
+
+    def add_stream(self, stream: BinaryIO, name: str, size: int) -> None:
+        """
+        Add a member read from a file object.
+
+        Args:
+            stream: Binary file object positioned at the start
+            name: Member path below the bundle's folder
+            size: The member's size, to decide on gzip
+        """
+        gzipped = self.options.gzips(name, size)
+        stored_name = f"{name}.gz" if gzipped else name
+        digest = hashlib.sha256()
+        work_path = os.path.join(self._work_dir, "member")
+        with open(work_path, "wb") as raw:
+            out = gzip.GzipFile(filename=os.path.basename(name), mode="wb", fileobj=raw, mtime=int(self._mtime)) if gzipped else raw
+            try:
+                while True:
+                    chunk = stream.read(COPY_CHUNK_BYTES)
+                    if not chunk:
+                        break
+                    out.write(chunk)
+            finally:
+                if gzipped:
+                    out.close()
+        with open(work_path, "rb") as f:
+            while True:
+                chunk = f.read(COPY_CHUNK_BYTES)
+                if not chunk:
+                    break
+                digest.update(chunk)
+        entry = {"name": stored_name, "size": os.path.getsize(work_path), "sha256": digest.hexdigest()}
+        if gzipped:
+            entry["gzip"] = True
+            entry["uncompressed_size"] = size
+        self._write(work_path, stored_name)
+        os.remove(work_path)
+        self.files.append(entry)
+
+    def close(self) -> Dict[str, Any]:
+        """
+        Add the manifests and finish the bundle.
+
+        Returns:
+            The manifest
+        """
+        manifest = {
+            "created_at": datetime.utcnow().isoformat(),
+            "export": self.export,
+            "files": self.files,
+        }
+        checksums = "".join(f"{f['sha256']}  {f['name']}\n" for f in self.files)
+        self._write_bytes(json.dumps(manifest, indent=2, default=str).encode("utf-8"), MANIFEST_NAME)
+        self._write_bytes(checksums.encode("utf-8"), CHECKSUMS_NAME)
+        self._archive.close()
+        shutil.rmtree(self._work_dir, ignore_errors=True)
+        return manifest
+
+    def _discard(self) -> None:
+        try:
+            self._archive.close()
+        finally:
+            shutil.rmtree(self._work_dir, ignore_errors=True)
+
+    def _write(self, path: str, name: str) -> None:
+        arcname = f"{self.root}/{name}"
+        if self.options.format == "zip":
+            extension = name.rsplit(".", 1)[-1].lower()
+            compression = zipfile.ZIP_STORED if extension in STORED_EXTENSIONS else zipfile.ZIP_DEFLATED
+            self._archive.write(path, arcname, compress_type=compression)
+        else:
+            info = self._archive.gettarinfo(path, arcname)
+            info.mtime = self._mtime
+            info.uid = info.gid = 0
+            info.uname = info.gname = ""
+            info.mode = 0o644
+            with open(path, "rb") as f:
+                self._archive.addfile(info, f)
+
+    def _write_bytes(self, data: bytes, name: str) -> None:
+        work_path = os.path.join(self._work_dir, "manifest")
+        with open(work_path, "wb") as f:
+            f.write(data)
+        self._write(work_path, name)
+        os.remove(work_path)
@@ -0,0 +1,214 @@
+"""
+TerraFusion Platform - CSV Writer
+
+This module provides the writer GIS exports use to produce flat CSV files
+of one layer, for recipients such as title companies that want a
+spreadsheet rather than GIS data. Geometry becomes a WKT column or a
+centroid longitude/latitude pair (or is left out), and each export chooses
+its columns and their headers:
+
+    "parameters": {
+        "columns": ["parcel_number", "owner_name", "situs_address"],
+        "headers": {"parcel_number": "Parcel #", "owner_name": "Owner"},
+        "geometry": "centroid"
+    }
+
+The same keys under a layer's "csv" settings are its defaults (request
+headers are merged over the layer's). Without a column list every property
+is written, in the order first seen; the layer is then read through a spool
+so the header can list them all.
+"""
+
+import csv
+import json
+import logging
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Iterable
+
+from gis_features import ExportLayer, FeatureSpool, encode_wkt, geometry_centroid
+
+try:
+    from pyproj import Transformer
+    PYPROJ_AVAILABLE = True
+except ImportError:
+    PYPROJ_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# How geometry is written
+CSV_GEOMETRY_MODES = ["wkt", "centroid", "none"]
+
+# Columns geometry is written to, by mode
+CSV_GEOMETRY_COLUMNS = {
+    "wkt": ["wkt"],
+    "centroid": ["longitude", "latitude"],
+    "none": [],
+}
+
+
+class CsvOptions:
+    """The columns, headers and geometry of a CSV export of a layer."""
+
+    def __init__(self, layer: ExportLayer, parameters: Optional[Dict[str, Any]] = None):
+        """
+        Read the options of a layer.
+
+        Args:
+            layer: Layer being exported; its "csv" settings are the defaults
+            parameters: Export request parameters, which override the layer settings
+
+        Raises:
+            ValueError: If an option is invalid
+        """
+        settings = dict(layer.settings.get("csv") or {})
+        for key in ("columns", "geometry"):
+            if parameters and parameters.get(key) is not None:
+                settings[key] = parameters[key]
+
+        self.columns = settings.get("columns")
+        if self.columns is not None:
+            if not isinstance(self.columns, list) or not all(isinstance(c, str) for c in self.columns):
+                raise ValueError(f"Layer {layer.name}: csv columns must be a list of field names")
+            if len(set(self.columns)) != len(self.columns):
+                raise ValueError(f"Layer {layer.name}: csv columns lists a field twice")
+            if layer.columns is not None:
+                unknown = [c for c in self.columns if c not in layer.columns]
+                if unknown:
+                    raise ValueError(f"Layer {layer.name} does not export columns: {', '.join(unknown)}")
+
+        # Request headers are added to the layer's, replacing those they share
+        self.headers = {}
+        for headers in (settings.get("headers"), (parameters or {}).get("headers")):
+            if headers is None:
+                continue
+            if not isinstance(headers, dict) or not all(isinstance(v, str) and v for v in headers.values()):
+                raise ValueError(f"Layer {layer.name}: csv headers must map field names to header text")
+            self.headers.update(headers)
+
+        self.geometry = str(settings.get("geometry", "wkt" if layer.geometry_field else "none")).lower()
+        if self.geometry not in CSV_GEOMETRY_MODES:
+            raise ValueError(f"Layer {layer.name}: unsupported csv geometry {self.geometry}. "
+                             f"Supported: {', '.join(CSV_GEOMETRY_MODES)}")
+        if self.geometry != "none" and not layer.geometry_field:
+            raise ValueError(f"Layer {layer.name} has no geometry to write as {self.geometry}")
+
+        if self.columns is not None:
+            self.header_row(self.columns)
+
+    def header_row(self, columns: List[str]) -> List[str]:
+        """
+        The header of a file with these property columns, geometry last.
+
+        Raises:
+            ValueError: If two columns would get the same header
+        """
+        header = [self.headers.get(name, name) for name in columns + CSV_GEOMETRY_COLUMNS[self.geometry]]
+        duplicates = sorted({h for h in header if header.count(h) > 1})
+        if duplicates:
+            raise ValueError(f"CSV headers appear more than once: {', '.join(duplicates)}")
+        return header
+
+
+def csv_value(value: Any) -> str:
+    """A property value as CSV text."""
+    if value is None:
+        return ""
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, (date, datetime)):
+        return value.isoformat()
+    if isinstance(value, (dict, list)):
+        return json.dumps(value, default=str)
+    if isinstance(value, (bytes, bytearray)):
+        return bytes(value).hex()
+    return str(value)
+
+
+class CsvWriter:
+    """Writes one layer as a CSV file."""
+
+    def __init__(self, path: str, options: CsvOptions):
+        """
+        Initialize the writer.
+
+        Args:
+            path: File to create
+            options: Columns, headers and geometry (see CsvOptions)
+        """
+        self.path = path
+        self.options = options
+        self._transformers = {}
+
+    def write_layer(self, layer: ExportLayer, features: Iterable[Dict[str, Any]]) -> Dict[str, Any]:
+        """
+        Write a layer.
+
+        Args:
+            layer: Layer being written
+            features: Features of the layer (see gis_features)
+
+        Returns:
+            Summary: features, header, geometry and missing_columns (selected
+            columns no record had)
+        """
+        spool = None
+        columns = self.options.columns
+        if columns is None:
+            # Every property, so the layer is spooled to learn them before the header is written
+            spool = FeatureSpool()
+            seen: Dict[str, None] = {}
+            for feature in features:
+                for name in feature["properties"]:
+                    seen.setdefault(name, None)
+                spool.append(feature)
+            columns = list(seen)
+            features = spool
+        header = self.options.header_row(columns)
+
+        count = 0
+        present = set()
+        try:
+            with open(self.path, "w", newline="", encoding="utf-8") as f:
+                writer = csv.writer(f)
+                writer.writerow(header)
+                for feature in features:
+                    count += 1
+                    properties = feature["properties"]
+                    present.update(name for name in columns if name in properties)
+                    row = [csv_value(properties.get(name)) for name in columns]
+                    row.extend(self._geometry(layer, feature))
+                    writer.writerow(row)
+        finally:
+            if spool is not None:
+                spool.close()
+
+        missing = [name for name in columns if name not in present] if count else []
+        if missing:
+            logger.warning(f"CSV export of layer {layer.name}: no record has {', '.join(missing)}")
+        logger.info(f"Wrote {count} features of layer {layer.name} to CSV")
+        return {"features": count, "header": header, "geometry": self.options.geometry, "missing_columns": missing}
+
+    def _geometry(self, layer: ExportLayer, feature: Dict[str, Any]) -> List[str]:
+        """The geometry cells of a feature's row."""
+        geometry = feature.get("geometry")
+        if self.options.geometry == "none":
+            return []
+        if self.options.geometry == "wkt":
+            return [encode_wkt(geometry) if geometry else ""]
+        centroid = geometry_centroid(geometry)
+        if centroid is None:
+            return ["", ""]
+        srid = feature.get("srid")
+        if srid not in (None, 4326):
+            if srid not in self._transformers:
+                if not PYPROJ_AVAILABLE:
+                    raise ValueError(
+                        f"Export layer {layer.name} is in EPSG:{srid}; centroids are written as longitude/latitude, "
+                        "and reprojecting requires pyproj (pip install pyproj)"
+                    )
+                self._transformers[srid] = Transformer.from_crs(srid, 4326, always_xy=True)
+            centroid = self._transformers[srid].transform(*centroid)
+        return [f"{centroid[0]:.8f}", f"{centroid[1]:.8f}"]
@@ -0,0 +1,359 @@
+"""
+TerraFusion Platform - DXF Writer
+
+This module provides the writer GIS exports use to produce DXF drawings for
+surveyors and CAD users. Output is ASCII DXF R12 (AC1009), which every CAD
+and survey package reads. Each export layer is drawn on its own DXF layers:
+polygon boundaries (holes included) as closed polylines, lines such as
+easements as open polylines and points as POINT entities, with an optional
+label field (lot numbers, parcel numbers) written as TEXT entities on a
+separate text layer:
+
+    "dxf": {"layer": "V-PROP-LINE", "color": 7,
+            "label_field": "lot_number", "label_layer": "V-PROP-TEXT",
+            "label_color": 2, "label_height": 4}
+
+The drawing's units ($INSUNITS) and an optional CRS to reproject to come
+from the county's gis_export "dxf" settings or the export request; without
+explicit units they are taken from the CRS when pyproj is available. A
+layer_prefix puts every DXF layer name under a common prefix.
+"""
+
+import os
+import re
+import tempfile
+import shutil
+import logging
+from typing import Dict, List, Any, Optional, Iterable, Tuple
+
+from gis_features import ExportLayer, Bounds, geometry_centroid, geometry_has_z, merge_bounds
+
+try:
+    from pyproj import CRS, Transformer
+    PYPROJ_AVAILABLE = True
+except ImportError:
+    PYPROJ_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# $INSUNITS codes of the drawing units exports can declare
+DXF_UNITS = {
+    "unitless": 0,
+    "inches": 1,
+    "feet": 2,
+    "millimeters": 4,
+    "centimeters": 5,
+    "meters": 6,
+    "us_survey_feet": 21,
+}
+
+# Drawing units of CRS axis units, as pyproj names them
+CRS_UNIT_NAMES = {
+    "metre": "meters",
+    "foot": "feet",
+    "US survey foot": "us_survey_feet",
+}
+
+# R12 layer names: at most 31 letters, digits, $, - and _
+DXF_LAYER_NAME_LENGTH = 31
+
+DEFAULT_DXF_COLOR = 7
+DEFAULT_DXF_LABEL_COLOR = 2
+DEFAULT_DXF_LABEL_HEIGHT = 2.5
+
+
+def dxf_layer_name(name: str) -> str:
+    """A name made safe for a DXF R12 layer."""
+    cleaned = re.sub(r"[^A-Za-z0-9$_-]+", "_", name).strip("_").upper()
+    return cleaned[:DXF_LAYER_NAME_LENGTH] or "0"
+
+
+def dxf_text(value: Any) -> str:
+    """Text for a DXF R12 TEXT entity: ANSI, with other characters as \\U+ escapes."""
+    text = " ".join(str(value).split())
+    out = []
+    for char in text:
+        try:
+            char.encode("cp1252")
+            out.append(char)
+        except UnicodeEncodeError:
+            out.append(f"\\U+{ord(char):04X}")
+    return "".join(out)
+
+
+def _number(value: float) -> str:
+    return repr(float(value))
+
+
+class DxfOptions:
+    """Drawing-wide settings: units, layer name prefix and output CRS."""
+
+    def __init__(self, settings: Optional[Dict[str, Any]] = None, parameters: Optional[Dict[str, Any]] = None):
+        """
+        Read the settings.
+
+        Args:
+            settings: The county's gis_export "dxf" settings
+            parameters: Export request parameters, which override the settings
+
+        Raises:
+            ValueError: If a setting is invalid
+        """
+        settings = dict(settings or {})
+        for key in ("units", "layer_prefix", "srid"):
+            if parameters and parameters.get(key) is not None:
+                settings[key] = parameters[key]
+        self.units = settings.get("units")
+        if self.units is not None and self.units not in DXF_UNITS:
+            raise ValueError(f"Unsupported DXF units: {self.units}. Supported: {', '.join(DXF_UNITS)}")
+        self.layer_prefix = settings.get("layer_prefix") or ""
+        if not isinstance(self.layer_prefix, str):
+            raise ValueError("DXF layer_prefix must be text")
+        self.srid = settings.get("srid")
+        if self.srid is not None:
+            if isinstance(self.srid, bool) or not str(self.srid).isdigit():
+                raise ValueError(f"DXF srid must be an EPSG code, not {self.srid}")
+            self.srid = int(self.srid)
+
+
+class DxfLayerStyle:
+    """The DXF layers, colors and labels of an export layer."""
+
+    def __init__(self, layer: ExportLayer, options: DxfOptions):
+        """
+        Read a layer's "dxf" settings.
+
+        Raises:
+            ValueError: If a setting is invalid
+        """
+        settings = layer.settings.get("dxf") or {}
+        self.layer = dxf_layer_name(options.layer_prefix + (settings.get("layer") or layer.name))
+        self.color = self._color(layer, "color", settings.get("color", DEFAULT_DXF_COLOR))
+        self.label_field = settings.get("label_field")
+        self.label_layer = dxf_layer_name(
+            options.layer_prefix + (settings.get("label_layer") or f"{settings.get('layer') or layer.name}-TEXT")
+        )
+        self.label_color = self._color(layer, "label_color", settings.get("label_color", DEFAULT_DXF_LABEL_COLOR))
+        self.label_height = settings.get("label_height", DEFAULT_DXF_LABEL_HEIGHT)
+        if isinstance(self.label_height, bool) or not isinstance(self.label_height, (int, float)) or self.label_height <= 0:
+            raise ValueError(f"Layer {layer.name}: dxf label_height must be a positive number of drawing units")
+        if self.label_field and self.label_layer == self.layer:
+            raise ValueError(f"Layer {layer.name}: dxf labels need a layer of their own")
+
+    @staticmethod
+    def _color(layer: ExportLayer, name: str, value: Any) -> int:
+        if isinstance(value, bool) or not isinstance(value, int) or not 1 <= value <= 255:
+            raise ValueError(f"Layer {layer.name}: dxf {name} must be an AutoCAD color index from 1 to 255")
+        return value
+
+
+class DxfWriter:
+    """Writes feature layers into one DXF drawing."""
+
+    def __init__(self, path: str, options: DxfOptions):
+        """
+        Initialize the writer.
+
+        Args:
+            path: File to create
+            options: Drawing-wide settings (see DxfOptions)
+        """
+        self.path = path
+        self.options = options
+        self.layers: Dict[str, int] = {}
+        self.bounds: Optional[Bounds] = None
+        self.srid: Optional[int] = options.srid
+        self.closed = False
+        self._transformers = {}
+        self._work_dir = tempfile.mkdtemp(prefix="tf_dxf_")
+        # Line ends become CRLF when the entities are copied into the drawing
+        self._entities = open(os.path.join(self._work_dir, "entities"), "w", encoding="cp1252", newline="\n")
+
+    def add_layer(self, layer: ExportLayer, features: Iterable[Dict[str, Any]]) -> Dict[str, Any]:
+        """
+        Draw a layer.
+
+        Args:
+            layer: Layer being written
+            features: Features of the layer (see gis_features)
+
+        Returns:
+            Summary: features, entities, labels and the DXF layer names
+        """
+        style = DxfLayerStyle(layer, self.options)
+        self.layers.setdefault(style.layer, style.color)
+        if style.label_field:
+            self.layers.setdefault(style.label_layer, style.label_color)
+        count = entities = labels = 0
+        for feature in features:
+            count += 1
+            geometry = self._project(layer, feature)
+            if not geometry:
+                continue
+            entities += self._draw(style.layer, geometry)
+            label = feature["properties"].get(style.label_field) if style.label_field else None
+            if label is not None and str(label).strip():
+                position = geometry_centroid(geometry)
+                if position is not None:
+                    self._text(style.label_layer, position, style.label_height, dxf_text(label))
+                    labels += 1
+
+        logger.info(f"Drew {entities} entities and {labels} labels of layer {layer.name} on DXF layer {style.layer}")
+        return {
+            "features": count,
+            "entities": entities,
+            "labels": labels,
+            "layer": style.layer,
+            "label_layer": style.label_layer if style.label_field else None,
+        }
+
+    def close(self) -> None:
+        """Write the drawing: header, layer table and the entities drawn."""
+        if self.closed:
+            return
+        self.closed = True
+        try:
+            self._entities.close()
+            units = self.options.units or self._crs_units(self.srid) or "unitless"
+            bounds = self.bounds or (0.0, 0.0, 0.0, 0.0)
+            with open(self.path, "w", encoding="cp1252", newline="\r\n") as f:
+                self._write_groups(f, [
+                    (0, "SECTION"), (2, "HEADER"),
+                    (9, "$ACADVER"), (1, "AC1009"),
+                    (9, "$DWGCODEPAGE"), (3, "ANSI_1252"),
+                    (9, "$INSUNITS"), (70, DXF_UNITS[units]),
+                    (9, "$MEASUREMENT"), (70, 1 if units in ("millimeters", "centimeters", "meters") else 0),
+                    (9, "$EXTMIN"), (10, _number(bounds[0])), (20, _number(bounds[1])), (30, "0.0"),
+                    (9, "$EXTMAX"), (10, _number(bounds[2])), (20, _number(bounds[3])), (30, "0.0"),
+                    (0, "ENDSEC"),
+                    (0, "SECTION"), (2, "TABLES"),
+                    (0, "TABLE"), (2, "LTYPE"), (70, 1),
+                    (0, "LTYPE"), (2, "CONTINUOUS"), (70, 0), (3, "Solid line"), (72, 65), (73, 0), (40, "0.0"),
+                    (0, "ENDTAB"),
+                    (0, "TABLE"), (2, "LAYER"), (70, len(self.layers) + 1),
+                    (0, "LAYER"), (2, "0"), (70, 0), (62, 7), (6, "CONTINUOUS"),
+                ])
+                for name, color in self.layers.items():
+                    if name != "0":
+                        self._write_groups(f, [(0, "LAYER"), (2, name), (70, 0), (62, color), (6, "CONTINUOUS")])
+                self._write_groups(f, [
+                    (0, "ENDTAB"),
+                    (0, "TABLE"), (2, "STYLE"), (70, 1),
+                    (0, "STYLE"), (2, "STANDARD"), (70, 0), (40, "0.0"), (41, "1.0"), (50, "0.0"), (71, 0),
+                    (42, "2.5"), (3, "txt"), (4, ""),
+                    (0, "ENDTAB"),
+                    (0, "ENDSEC"),
+                    (0, "SECTION"), (2, "ENTITIES"),
+                ])
+                with open(self._entities.name, "r", encoding="cp1252") as entities:
+                    shutil.copyfileobj(entities, f)
+                self._write_groups(f, [(0, "ENDSEC"), (0, "EOF")])
+        finally:
+            shutil.rmtree(self._work_dir, ignore_errors=True)
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        if exc_type is None:
+            self.close()
+        else:
+            self.closed = True
+            self._entities.close()
+            shutil.rmtree(self._work_dir, ignore_errors=True)
+
+    @staticmethod
+    def _write_groups(f, groups: List[Tuple[int, Any]]) -> None:
+        for code, value in groups:
+            f.write(f"{code:>3}\n{value}\n")
+
+    def _draw(self, layer_name: str, geometry: Dict[str, Any]) -> int:
+        """Add the entities of a geometry; returns how many."""
+        kind, coordinates = geometry["type"], geometry["coordinates"]
+        has_z = geometry_has_z(geometry)
+        if kind == "Point":
+            points, lines, rings = [coordinates], [], []
+        elif kind == "MultiPoint":
+            points, lines, rings = coordinates, [], []
+        elif kind == "LineString":
+            points, lines, rings = [], [coordinates], []
+        elif kind == "MultiLineString":
+            points, lines, rings = [], coordinates, []
+        elif kind == "Polygon":
+            points, lines, rings = [], [], coordinates
+        elif kind == "MultiPolygon":
+            points, lines, rings = [], [], [ring for polygon in coordinates for ring in polygon]
+        else:
+            raise ValueError(f"Unsupported geometry type: {kind}")
+
+        groups = []
+        for point in points:
+            self._extend(point)
+            groups += [(0, "POINT"), (8, layer_name),
+                       (10, _number(point[0])), (20, _number(point[1])), (30, _number(point[2] if len(point) > 2 else 0))]
+        for line, closed in [(line, False) for line in lines] + [(ring[:-1], True) for ring in rings]:
+            if len(line) < 2:
+                continue
+            # 1: closed, 8: 3D polyline
+            groups += [(0, "POLYLINE"), (8, layer_name), (66, 1),
+                       (10, "0.0"), (20, "0.0"), (30, "0.0"), (70, (1 if closed else 0) | (8 if has_z else 0))]
+            for point in line:
+                self._extend(point)
+                groups += [(0, "VERTEX"), (8, layer_name),
+                           (10, _number(point[0])), (20, _number(point[1])), (30, _number(point[2] if len(point) > 2 else 0))]
+                if has_z:
+                    groups.append((70, 32))
+            groups += [(0, "SEQEND"), (8, layer_name)]
+        self._write_groups(self._entities, groups)
+        return len(points) + len([l for l in lines if len(l) >= 2]) + len([r for r in rings if len(r) >= 3])
+
+    def _text(self, layer_name: str, position: Tuple[float, float], height: float, text: str) -> None:
+        x, y = _number(position[0]), _number(position[1])
+        # Centered on the position (horizontal 1: center, vertical 2: middle)
+        self._write_groups(self._entities, [
+            (0, "TEXT"), (8, layer_name),
+            (10, x), (20, y), (30, "0.0"), (40, _number(height)), (1, text),
+            (72, 1), (11, x), (21, y), (31, "0.0"), (73, 2),
+        ])
+
+    def _extend(self, point: List[float]) -> None:
+        self.bounds = merge_bounds(self.bounds, (point[0], point[1], point[0], point[1]))
+
+    def _project(self, layer: ExportLayer, feature: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+        """A feature's geometry in the drawing's CRS."""
+        geometry = feature.get("geometry")
+        srid = feature.get("srid")
+        if self.srid is None and srid is not None:
+            # Without a configured CRS the drawing uses the first layer's
+            self.srid = srid
+        if not geometry or srid is None or srid == self.srid:
+            return geometry
+        if srid not in self._transformers:
+            if not PYPROJ_AVAILABLE:
+                raise ValueError(
+                    f"Export layer {layer.name} is in EPSG:{srid} and the drawing in EPSG:{self.srid}; "
+                    "reprojecting requires pyproj (pip install pyproj)"
+                )
+            self._transformers[srid] = Transformer.from_crs(srid, self.srid, always_xy=True)
+        transformer = self._transformers[srid]
+
+        def walk(coordinates):
+            if coordinates and isinstance(coordinates[0], (int, float)):
+                return list(transformer.transform(coordinates[0], coordinates[1])) + list(coordinates[2:3])
+            return [walk(c) for c in coordinates]
+
+        return {"type": geometry["type"], "coordinates": walk(geometry["coordinates"])}
+
+    @staticmethod
+    def _crs_units(srid: Optional[int]) -> Optional[str]:
+        """The drawing units of a CRS's axes, when pyproj knows them."""
+        if srid is None or not PYPROJ_AVAILABLE:
+            return None
+        try:
+            unit = CRS.from_epsg(srid).axis_info[0].unit_name
+        except Exception as e:
+            logger.warning(f"Could not read the units of EPSG:{srid}: {e}")
+            return None
+        return CRS_UNIT_NAMES.get(unit)
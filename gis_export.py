@@ -2,21 +2,134 @@
 TerraFusion Platform - GIS Export Module
 
 This module provides the GIS Export functionality for the TerraFusion Platform.
+Job lifecycle changes are announced on the internal event bus (see event_bus).
+Feature formats (GeoJSON, GeoPackage, shapefile, KML/KMZ, FlatGeobuf, GeoParquet, vector tiles, CSV, Excel, DXF)
+are written from the layers a county configures under plugin_settings.gis_export.layers (see gis_features), as are
+parcel report packets (see gis_reports) and sales ratio studies (see gis_ratio_study).
+Features stream from the database through each stage to the writer with a bounded read-ahead buffer
+(see gis_features.FeatureBuffer), so memory does not grow with the size of the county.
+Features are reprojected to the CRS an export asks for (see gis_reproject) and
+can be simplified without opening gaps between neighbors (see gis_simplify), on worker
+processes when the layer is large enough (see gis_parallel); exports
+can be limited to a bounding box, tax district or clip geometry (see gis_spatial), can add
+centroid and label point layers derived from their polygons (see gis_points), and
+any export can be delivered as a ZIP or tar.gz bundle with checksum manifests (see gis_bundle).
+Recurring exports of a series can write only the features changed since the series' previous export
+(see gis_increments).
+Exports are written with the redaction policies of their requester, of parameters.redaction
+and of the delivery targets they go to (see redaction).
+Exports of layers of sync pairs versioned by assessment roll year read any certified year with
+parameters.roll_year (see roll_years), and the open year without it.
+Each county's jobs, export files and bundles are kept in its own directory under the storage path,
+and a request scoped to some counties (see tenancy) sees only their jobs; counties can be held to a
+number of running exports and a size of stored exports (see tenant_quotas).
 """
 
+import io
 import os
-import uuid
 import json
+import uuid
+import shutil
+import tempfile
+import zipfile
 import logging
 from datetime import datetime
-from typing import Dict, List, Any, Optional
+from typing import Dict, List, Any, Optional, Iterable, Iterator, Tuple
+
+from export_storage import ArtifactStore, LocalArtifactStore, create_artifact_store
+from export_delivery import DeliveryTarget, create_delivery_targets, file_sha256
+from event_bus import EventBusError, event_bus, SUBJECT_EXPORT_JOB
+from gis_features import ExportLayer, FeatureBuffer, LayerReader, area_bounds, county_export_settings, parse_layers
+from redaction import RedactingReader, RedactionPolicies, Redactor
+from encryption import default_cipher, dumps_document, loads_document
+from gis_geojson import GeoJsonWriter
+from gis_geopackage import GeoPackageWriter
+from gis_shapefile import ShapefileWriter
+from gis_kml import KmlLayerStyle, KmlWriter
+from gis_flatgeobuf import FlatGeobufWriter
+from gis_geoparquet import GeoParquetOptions, GeoParquetWriter
+from gis_mvt import MvtLayerSettings, MvtWriter
+from gis_csv import CsvOptions, CsvWriter
+from gis_xlsx import XlsxSheetOptions, XlsxWriter
+from gis_dxf import DxfLayerStyle, DxfOptions, DxfWriter
+from gis_reports import ParcelReports, ParcelReportSettings, MAX_REPORT_PARCELS
+from gis_ratio_study import RatioStudy, RatioStudyParameters, RatioStudySettings
+from gis_bundle import BUNDLE_FORMATS, BundleOptions, BundleWriter
+from gis_reproject import Reprojector, parse_srid
+from gis_simplify import FeatureSimplifier, simplify_tolerance
+from gis_parallel import GeometryStage
+from gis_spatial import DistrictRegions, SpatialFilter, build_spatial_filter, parse_spatial_filter
+from gis_points import derived_layer, derived_point_kinds, point_features
+from gis_increments import ExportSeries, Increment, parse_increment, SERIES_FOLDER
+from metrics import EXPORT_JOBS, EXPORT_JOB_DURATION, EXPORT_SIZE, ERRORS
+from logging_config import log_context, log_fields
+from tenancy import allows as tenant_allows
+from tenant_quotas import TenantQuotas, tenant_quotas
+from roll_years import parse_roll_year
 
 # Configure logging
 logging.basicConfig(level=logging.INFO)
 logger = logging.getLogger(__name__)
 
 # Supported export formats
-SUPPORTED_FORMATS = ["shapefile", "geojson", "kml", "geopackage", "csv"]
+SUPPORTED_FORMATS = ["shapefile", "geojson", "kml", "kmz", "geopackage", "flatgeobuf", "geoparquet", "mvt", "mbtiles", "dxf", "csv", "xlsx", "parcel_reports", "ratio_study"]
+
+# MIME types of the delivered artifacts
+CONTENT_TYPES = {
+    "shapefile": "application/zip",
+    "geojson": "application/geo+json",
+    "kml": "application/vnd.google-earth.kml+xml",
+    "kmz": "application/vnd.google-earth.kmz",
+    "geopackage": "application/geopackage+sqlite3",
+    "flatgeobuf": "application/flatgeobuf",
+    "geoparquet": "application/vnd.apache.parquet",
+    "mvt": "application/zip",
+    "mbtiles": "application/vnd.sqlite3",
+    "dxf": "image/vnd.dxf",
+    "csv": "text/csv",
+    "xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+    "parcel_reports": "application/pdf",
+    "ratio_study": "text/csv",
+}
+
+# File extensions of the delivered artifacts, where they differ from the format name
+FILE_EXTENSIONS = {
+    "shapefile": "zip",  # Shapefiles are delivered as ZIP
+    "geopackage": "gpkg",
+    "flatgeobuf": "fgb",
+    "geoparquet": "parquet",
+    "mvt": "zip",  # A z/x/y tile pyramid, zipped
+    "parcel_reports": "pdf",
+    "ratio_study": "csv",
+}
+
+# Formats written from the county's configured export layers
+FEATURE_FORMATS = ["geojson", "geopackage", "shapefile", "kml", "kmz", "flatgeobuf", "geoparquet", "mvt", "mbtiles", "dxf", "csv", "xlsx"]
+
+# Feature formats whose file holds a single layer
+SINGLE_LAYER_FORMATS = ["flatgeobuf", "geoparquet", "csv"]
+
+# Formats delivered as a ZIP of several files, whose files a bundle holds directly
+ARCHIVE_FORMATS = ["shapefile", "mvt"]
+
+# Formats written in a fixed CRS, which features are always reprojected to
+FIXED_SRID_FORMATS = {"geojson": 4326, "kml": 4326, "kmz": 4326, "mvt": 4326, "mbtiles": 4326}
+
+# Statuses of jobs that will not change again
+FINISHED_STATUSES = ["COMPLETED", "FAILED", "CANCELLED"]
+
+def directory_size(path: str) -> int:
+    """Bytes of the files under a directory."""
+    total = 0
+    for root, _, files in os.walk(path):
+        for name in files:
+            try:
+                total += os.path.getsize(os.path.join(root, name))
+            except OSError:
+                # Removed while counting
+                pass
+    return total
+
 
 class GisExportService:
     """
@@ -26,14 +139,30 @@ class GisExportService:
     data exports from the TerraFusion Platform.
     """
     
-    def __init__(self, storage_path: str = "exports"):
+    def __init__(self, storage_path: str = "exports", config_dir: str = "county_configs", registry=None,
+                 quotas: Optional[TenantQuotas] = None):
         """
         Initialize the GIS Export Service.
         
         Args:
             storage_path: Directory to store export files
+            config_dir: Directory of county configurations (for artifact storage settings)
+            registry: Sync pair registry export layers are read through
+                (the sync_pair_registry singleton by default)
+            quotas: County quotas exports are held to (the tenant_quotas singleton by default)
         """
         self.storage_path = storage_path
+        self.quotas = quotas or tenant_quotas
+        self.config_dir = config_dir
+        self.layer_reader = LayerReader(registry)
+        self.redaction = RedactionPolicies(config_dir)
+        # Job files hold the request's area, filters and requester; encrypted when a master key is set
+        self.cipher = default_cipher()
+        self.series = ExportSeries(storage_path, self.cipher)
+        # Increments of the running jobs of a series, by job
+        self._increments: Dict[str, Increment] = {}
+        self._artifact_stores: Dict[str, ArtifactStore] = {}
+        self._delivery_targets: Dict[str, List[DeliveryTarget]] = {}
         # Create storage directory if it doesn't exist
         os.makedirs(self.storage_path, exist_ok=True)
         logger.info(f"GIS Export Service initialized with storage path: {self.storage_path}")
@@ -44,7 +173,8 @@ class GisExportService:
                          export_format: str,
                          area_of_interest: Dict[str, Any],
                          layers: List[str],
-                         parameters: Optional[Dict[str, Any]] = None) -> Dict[str, Any]:
+                         parameters: Optional[Dict[str, Any]] = None,
+                         redaction: Optional[List[str]] = None) -> Dict[str, Any]:
         """
         Create a new GIS export job.
         
@@ -55,13 +185,95 @@ class GisExportService:
             area_of_interest: GeoJSON defining the area of interest
             layers: List of layers to include in the export
             parameters: Additional parameters for the export
+            redaction: Redaction policies the requester's access calls for (see redaction)
             
         Returns:
             Dictionary with job details including the job_id
+
+        Raises:
+            ValueError: If the request is invalid
+            tenant_quotas.QuotaExceeded: If the county is at its max_running_exports or export_storage_mb
         """
+        quotas = self.quotas.quotas(county_id)
+        if quotas["max_running_exports"] or quotas["export_storage_mb"]:
+            usage = self.usage(county_id)
+            self.quotas.check(county_id, "max_running_exports", usage["max_running_exports"])
+            self.quotas.check(county_id, "export_storage_mb", usage["export_storage_mb"])
+
         # Validate export format
         if export_format.lower() not in SUPPORTED_FORMATS:
             raise ValueError(f"Unsupported export format: {export_format}. Supported formats: {', '.join(SUPPORTED_FORMATS)}")
+        roll_year = (parameters or {}).get("roll_year")
+        if roll_year is not None:
+            roll_year = parse_roll_year(roll_year, "parameters.roll_year")
+        if export_format.lower() in FEATURE_FORMATS:
+            export_layers = self.export_layers(county_id, layers, roll_year)
+            self._check_roll_year(export_layers, roll_year)
+            point_layers = self._check_derived_points(county_id, export_format.lower(), export_layers, parameters)
+            if export_format.lower() in ("kml", "kmz"):
+                # Reject bad styling before the job is queued
+                for layer in export_layers + point_layers:
+                    KmlLayerStyle(layer, layer.name)
+            if export_format.lower() in SINGLE_LAYER_FORMATS and len(export_layers) != 1:
+                raise ValueError(f"A {export_format.lower()} export holds exactly one layer; request one of: "
+                                 f"{', '.join(layer.name for layer in export_layers)}")
+            if export_format.lower() == "geoparquet":
+                GeoParquetOptions(export_layers[0], parameters)
+            if export_format.lower() == "csv":
+                CsvOptions(export_layers[0], parameters)
+            if export_format.lower() == "xlsx":
+                unknown = [name for name in ((parameters or {}).get("sheets") or {}) if name not in layers]
+                if unknown:
+                    raise ValueError(f"Sheet parameters name layers not in the export: {', '.join(unknown)}")
+                for layer in export_layers:
+                    XlsxSheetOptions(layer, parameters)
+            if export_format.lower() in ("mvt", "mbtiles"):
+                for layer in export_layers + point_layers:
+                    MvtLayerSettings(layer)
+            if export_format.lower() == "dxf":
+                options = DxfOptions(self._county_export_settings(county_id).get("dxf"), parameters)
+                for layer in export_layers + point_layers:
+                    DxfLayerStyle(layer, options)
+            if export_format.lower() != "xlsx":
+                self._reprojector(county_id, export_format.lower(), parameters, export_layers)
+            simplify = (parameters or {}).get("simplify")
+            if export_format.lower() in ("mvt", "mbtiles"):
+                if simplify is not None:
+                    raise ValueError("Vector tiles are simplified by each layer's mvt settings; leave out parameters.simplify")
+            elif export_format.lower() != "xlsx":
+                if isinstance(simplify, dict):
+                    unknown = [name for name in simplify if name not in layers]
+                    if unknown:
+                        raise ValueError(f"Simplify parameters name layers not in the export: {', '.join(unknown)}")
+                for layer in export_layers:
+                    simplify_tolerance(layer, parameters)
+            spatial_filter = self._spatial_filter(county_id, parameters)
+            if spatial_filter is not None:
+                for layer in export_layers:
+                    if not layer.geometry_field:
+                        raise ValueError(f"Export layer {layer.name} has no geometry to filter by area")
+                    spatial_filter.check(layer.srid)
+        elif (parameters or {}).get("spatial_filter") is not None:
+            raise ValueError("parameters.spatial_filter applies to exports of the county's layers")
+        elif (parameters or {}).get("derived_points"):
+            raise ValueError("parameters.derived_points applies to exports of the county's layers")
+        BundleOptions(self._county_export_settings(county_id).get("bundle"), parameters, export_format.lower())
+        if export_format.lower() == "parcel_reports":
+            settings = self.parcel_reports(county_id, roll_year=roll_year).settings
+            self._check_roll_year([layer for layer in (settings.layer, settings.values_layer) if layer], roll_year)
+            parcels = (parameters or {}).get("parcels")
+            if not isinstance(parcels, list) or not parcels or not all(isinstance(p, (str, int)) for p in parcels):
+                raise ValueError("A parcel_reports export needs parameters.parcels, a list of parcel numbers")
+            if len(parcels) > MAX_REPORT_PARCELS:
+                raise ValueError(f"A parcel_reports export holds at most {MAX_REPORT_PARCELS} parcels")
+        if export_format.lower() == "ratio_study":
+            self._check_roll_year(self.ratio_study(county_id, roll_year=roll_year).settings.layers, roll_year)
+            RatioStudyParameters(parameters)
+        redaction = self._redaction_policies(county_id, export_format.lower(), parameters, redaction)
+        increment = parse_increment(parameters)
+        if increment and (export_format.lower() not in FEATURE_FORMATS or export_format.lower() in ("mvt", "mbtiles")):
+            raise ValueError(f"A {export_format.lower()} export is written whole; "
+                             f"leave out parameters.series and parameters.mode")
         
         # Create a unique job ID
         job_id = str(uuid.uuid4())
@@ -75,16 +287,23 @@ class GisExportService:
             "area_of_interest": area_of_interest,
             "layers": layers,
             "parameters": parameters or {},
+            "redaction": redaction,
             "status": "PENDING",
             "created_at": datetime.utcnow().isoformat(),
             "started_at": None,
             "completed_at": None,
             "download_url": None,
+            # The request that created the job, for the log lines of its run
+            "request_id": log_fields().get("request_id"),
             "message": "Export job created and pending processing."
         }
+        if increment:
+            # Refuse an increment that would not be comparable with the series before it is queued
+            self.series.check(job, increment)
         
         # Save job to storage
         self._save_job(job)
+        self._announce(job, "created")
         
         logger.info(f"Created GIS export job {job_id} for county {county_id}")
         return job
@@ -104,6 +323,33 @@ class GisExportService:
         """
         return self._load_job(job_id)
     
+    def delete_job(self, job_id: str) -> Dict[str, Any]:
+        """
+        Delete the record of a finished export job and its export file on
+        local disk (see job_retention). Artifacts in object storage are left
+        to the bucket's lifecycle rules.
+        
+        Args:
+            job_id: ID of the export job
+            
+        Returns:
+            The deleted job record
+            
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+            ValueError: If the job has not finished
+        """
+        job = self._load_job(job_id)
+        if job["status"] not in FINISHED_STATUSES:
+            raise ValueError(f"Export job {job_id} is {job['status']}; only finished jobs can be deleted")
+        file_path = job.get("file_path")
+        storage_path = os.path.abspath(self.storage_path)
+        if file_path and os.path.isfile(file_path) and \
+                os.path.commonpath([storage_path, os.path.abspath(file_path)]) == storage_path:
+            os.remove(file_path)
+        os.remove(self._job_file(job_id))
+        return job
+    
     def process_job(self, job_id: str) -> Dict[str, Any]:
         """
         Process a GIS export job.
@@ -130,6 +376,14 @@ class GisExportService:
         if job["status"] != "PENDING":
             raise ValueError(f"Cannot process job {job_id} with status {job['status']}")
         
+        with log_context(request_id=job.get("request_id"), job_id=job_id, county_id=job["county_id"],
+                         user=job.get("username")):
+            return self._run_job(job)
+    
+    def _run_job(self, job: Dict[str, Any]) -> Dict[str, Any]:
+        """Run a loaded PENDING export job to COMPLETED or FAILED."""
+        job_id = job["job_id"]
+        
         # Update job status to PROCESSING
         job["status"] = "PROCESSING"
         job["started_at"] = datetime.utcnow().isoformat()
@@ -138,50 +392,113 @@ class GisExportService:
         
         logger.info(f"Processing GIS export job {job_id}")
         
+        series_lock = None
         try:
             # Simulate export processing
             county_id = job["county_id"]
             export_format = job["export_format"]
             layers = job["layers"]
+            increment = parse_increment(job["parameters"])
+            if increment:
+                # Exports of a series run one at a time, each compared with the one before
+                series_lock = self.series.lock(county_id, increment["series"])
+                series_lock.acquire()
+                self._increments[job_id] = Increment(job, increment, self.series.check(job, increment))
             
             # File paths
-            filename = f"{county_id}_{job_id}.{export_format}"
-            if export_format == "shapefile":
-                filename = f"{county_id}_{job_id}.zip"  # Shapefiles are delivered as ZIP
-            
-            file_path = os.path.join(self.storage_path, filename)
+            filename = f"{county_id}_{job_id}.{FILE_EXTENSIONS.get(export_format, export_format)}"
+            file_path = os.path.join(self.county_path(county_id), filename)
             
             # Call the appropriate export processor based on format
             if export_format == "geojson":
                 self._process_geojson_export(job, file_path)
             elif export_format == "shapefile":
                 self._process_shapefile_export(job, file_path)
-            elif export_format == "kml":
+            elif export_format in ("kml", "kmz"):
                 self._process_kml_export(job, file_path)
             elif export_format == "geopackage":
                 self._process_geopackage_export(job, file_path)
+            elif export_format == "flatgeobuf":
+                self._process_flatgeobuf_export(job, file_path)
+            elif export_format == "geoparquet":
+                self._process_geoparquet_export(job, file_path)
+            elif export_format in ("mvt", "mbtiles"):
+                self._process_vector_tile_export(job, file_path)
+            elif export_format == "dxf":
+                self._process_dxf_export(job, file_path)
             elif export_format == "csv":
                 self._process_csv_export(job, file_path)
+            elif export_format == "xlsx":
+                self._process_xlsx_export(job, file_path)
+            elif export_format == "parcel_reports":
+                self._process_parcel_reports_export(job, file_path)
+            elif export_format == "ratio_study":
+                self._process_ratio_study_export(job, file_path)
             else:
                 raise ValueError(f"Unsupported export format: {export_format}")
+            if job_id in self._increments:
+                job["increment"] = self._increments[job_id].manifest()
+            
+            bundle = BundleOptions(self._county_export_settings(county_id).get("bundle"), job["parameters"], export_format)
+            if bundle.format:
+                file_path = self._bundle_export(job, file_path, bundle)
+            
+            # Push the file to the county's delivery targets, then store it
+            job["file_size"] = os.path.getsize(file_path) if os.path.exists(file_path) else 0
+            job["deliveries"] = self._deliver(job, file_path)
+            job["artifact"] = self._publish_artifact(job, file_path)
+            if job_id in self._increments:
+                self.series.save(self._increments[job_id].state())
             
             # Update job with success
             job["status"] = "COMPLETED"
             job["completed_at"] = datetime.utcnow().isoformat()
             job["download_url"] = f"/api/v1/gis-export/download/{job_id}"
-            job["file_path"] = file_path
-            job["file_size"] = os.path.getsize(file_path) if os.path.exists(file_path) else 0
+            job["file_path"] = file_path if os.path.exists(file_path) else None
             job["message"] = f"Export completed successfully with {len(layers)} layers."
+            derived = [name for name in job.get("layer_results", {}) if name not in layers]
+            if derived:
+                job["message"] += f" Derived point layers: {', '.join(derived)}."
+            if export_format == "parcel_reports":
+                job["message"] = f"Export completed successfully with {job['reports']['pages']} parcel reports."
+                if job["reports"]["missing"]:
+                    job["message"] += f" Not found: {', '.join(job['reports']['missing'])}."
+            if export_format == "ratio_study":
+                study = job["ratio_study"]
+                job["message"] = (f"Export completed successfully with {study['sales_written']} sales; "
+                                  f"median ratio {study['median_ratio']}, COD {study['cod']}, PRD {study['prd']}.")
+            if job_id in self._increments:
+                job["message"] += f" {self._increments[job_id].describe()}"
+            if job.get("reprojection", {}).get("warnings"):
+                job["message"] += f" Reprojection is approximate: {'; '.join(job['reprojection']['warnings'])}."
+            failed = [d["name"] for d in job["deliveries"] if d["status"] != "DELIVERED"]
+            if failed:
+                job["message"] += f" Delivery failed: {', '.join(failed)}."
             
         except Exception as e:
+            for path in (job.pop("derived_files", None) or {}).values():
+                if os.path.exists(path):
+                    os.remove(path)
             # Update job with error
             job["status"] = "FAILED"
             job["completed_at"] = datetime.utcnow().isoformat()
             job["message"] = f"Export failed: {str(e)}"
+            ERRORS.inc(component="export", type=type(e).__name__)
             logger.error(f"Error processing GIS export job {job_id}: {e}", exc_info=True)
+        finally:
+            self._increments.pop(job_id, None)
+            if series_lock is not None:
+                series_lock.release()
         
-        # Save updated job
+        # Count it in the metrics, then save updated job
+        labels = {"export_format": job["export_format"], "status": job["status"]}
+        EXPORT_JOBS.inc(**labels)
+        duration = datetime.fromisoformat(job["completed_at"]) - datetime.fromisoformat(job["started_at"])
+        EXPORT_JOB_DURATION.observe(duration.total_seconds(), **labels)
+        if job["status"] == "COMPLETED":
+            EXPORT_SIZE.observe(job.get("file_size", 0), export_format=job["export_format"])
         self._save_job(job)
+        self._announce(job, job["status"].lower())
         logger.info(f"Finished processing GIS export job {job_id} with status {job['status']}")
         return job
     
@@ -211,6 +528,7 @@ class GisExportService:
         job["completed_at"] = datetime.utcnow().isoformat()
         job["message"] = "Export job cancelled by user."
         self._save_job(job)
+        self._announce(job, "cancelled")
         
         logger.info(f"Cancelled GIS export job {job_id}")
         return job
@@ -235,14 +553,16 @@ class GisExportService:
         jobs = []
         
         # Find all job files
-        os.makedirs(self.storage_path, exist_ok=True)
-        for filename in os.listdir(self.storage_path):
+        for job_file in self._job_files(county_id):
+            filename = os.path.basename(job_file)
             if filename.endswith('.json'):
                 try:
-                    with open(os.path.join(self.storage_path, filename), 'r') as f:
-                        job = json.load(f)
+                    with open(job_file, 'r') as f:
+                        job = loads_document(f.read(), self.cipher, f"export_jobs/{filename[:-len('.json')]}")
                         
                         # Apply filters
+                        if not tenant_allows(job.get("county_id")):
+                            continue
                         if county_id and job.get("county_id") != county_id:
                             continue
                         if status and job.get("status") != status:
@@ -287,10 +607,600 @@ class GisExportService:
             "layers": job["layers"],
             "file_path": job.get("file_path"),
             "file_size": job.get("file_size", 0),
+            "artifact": job.get("artifact"),
+            "bundle": job.get("bundle"),
+            "increment": job.get("increment"),
             "download_url": job["download_url"],
             "completed_at": job["completed_at"]
         }
     
+    def open_download(self, job_id: str) -> Dict[str, Any]:
+        """
+        Locate the artifact of a completed export job for download.
+        
+        Args:
+            job_id: ID of the export job
+            
+        Returns:
+            Dictionary with the download filename and content_type plus either
+            "url" (a signed link to the object store), "path" (a local file)
+            or "stream" (an iterator of bytes read from the object store)
+            
+        Raises:
+            FileNotFoundError: If the job or its artifact does not exist
+            ValueError: If job is not completed
+        """
+        result = self.get_job_result(job_id)
+        extension, content_type = self._artifact_type(result)
+        filename = f"{result['county_id']}_export.{extension}"
+        download = {"filename": filename, "content_type": content_type}
+        
+        artifact = result.get("artifact") or {"backend": LocalArtifactStore.backend_name, "key": result.get("file_path")}
+        if artifact["backend"] == LocalArtifactStore.backend_name:
+            if not artifact.get("key") or not os.path.exists(artifact["key"]):
+                raise FileNotFoundError("Export file not found")
+            download["path"] = artifact["key"]
+            return download
+        
+        store = self.artifact_store(result["county_id"])
+        if store.backend_name != artifact["backend"]:
+            raise FileNotFoundError(f"Export file is in {artifact['backend']} storage, which is no longer configured")
+        url = store.download_url(artifact["key"], filename)
+        if url:
+            download["url"] = url
+        else:
+            download["stream"] = store.stream(artifact["key"])
+        return download
+    
+    def deliver_job(self, job_id: str, names: Optional[List[str]] = None) -> Dict[str, Any]:
+        """
+        Deliver (or re-deliver) a completed export to the county's delivery targets.
+        
+        Args:
+            job_id: ID of the export job
+            names: Delivery targets to push to (all that accept the format by default)
+            
+        Returns:
+            Dictionary with updated job details
+            
+        Raises:
+            FileNotFoundError: If the job or its artifact does not exist
+            ValueError: If job is not completed or a named target is not configured
+        """
+        job = self._load_job(job_id)
+        if job["status"] != "COMPLETED":
+            raise ValueError(f"Cannot deliver job {job_id} with status {job['status']}")
+        configured = {t.name for t in self.delivery_targets(job["county_id"])}
+        unknown = sorted(set(names or []) - configured)
+        if unknown:
+            raise ValueError(f"Delivery targets not configured for county {job['county_id']}: {', '.join(unknown)}")
+        
+        download = self.open_download(job_id)
+        if "path" in download:
+            results = self._deliver(job, download["path"], names)
+        else:
+            # The file lives in object storage; fetch a working copy to send
+            work_dir = tempfile.mkdtemp(prefix="tf_delivery_")
+            try:
+                work_path = os.path.join(work_dir, os.path.basename(job["artifact"]["key"]))
+                store = self.artifact_store(job["county_id"])
+                with open(work_path, "wb") as f:
+                    for chunk in store.stream(job["artifact"]["key"]):
+                        f.write(chunk)
+                results = self._deliver(job, work_path, names)
+            finally:
+                shutil.rmtree(work_dir, ignore_errors=True)
+        
+        # Keep earlier results for targets not delivered this time
+        delivered = {d["name"] for d in results}
+        job["deliveries"] = [d for d in job.get("deliveries", []) if d["name"] not in delivered] + results
+        self._save_job(job)
+        return job
+    
+    def delivery_targets(self, county_id: str) -> List[DeliveryTarget]:
+        """
+        Get the delivery targets configured for a county.
+        
+        Targets are listed in plugin_settings.gis_export.deliveries of the
+        county configuration.
+        
+        Args:
+            county_id: County identifier
+            
+        Returns:
+            List of DeliveryTarget instances
+        """
+        if county_id not in self._delivery_targets:
+            settings = self._county_export_settings(county_id).get("deliveries")
+            self._delivery_targets[county_id] = create_delivery_targets(settings)
+        return self._delivery_targets[county_id]
+    
+    def artifact_store(self, county_id: str) -> ArtifactStore:
+        """
+        Get the artifact store export files of a county are delivered to.
+        
+        The store is configured by plugin_settings.gis_export.artifact_storage in
+        the county configuration; counties without one keep files on local disk.
+        
+        Args:
+            county_id: County identifier
+            
+        Returns:
+            ArtifactStore instance
+        """
+        if county_id not in self._artifact_stores:
+            settings = self._county_export_settings(county_id).get("artifact_storage")
+            self._artifact_stores[county_id] = create_artifact_store(settings)
+        return self._artifact_stores[county_id]
+    
+    def export_layers(self, county_id: str, names: Optional[List[str]] = None,
+                      roll_year: Optional[int] = None) -> List[ExportLayer]:
+        """
+        Get the export layers configured for a county.
+        
+        Args:
+            county_id: County identifier
+            names: Layers to return, in this order (all configured layers by default)
+            roll_year: Roll year the layers of sync pairs are read in (see roll_years);
+                the open year by default
+            
+        Returns:
+            List of ExportLayer instances
+            
+        Raises:
+            ValueError: If a named layer is not configured or a definition is invalid
+        """
+        configured = parse_layers(self._county_export_settings(county_id))
+        for layer in configured.values():
+            if layer.sync_pair_id:
+                layer.roll_year = roll_year
+        if names is None:
+            return list(configured.values())
+        unknown = [n for n in names if n not in configured]
+        if unknown:
+            raise ValueError(
+                f"Export layers not configured for county {county_id}: {', '.join(unknown)}. "
+                f"Configured layers: {', '.join(configured) or 'none'}"
+            )
+        return [configured[n] for n in names]
+    
+    def _check_roll_year(self, layers: List[ExportLayer], roll_year: Optional[int]) -> None:
+        """
+        Check that the layers of an export have its roll year.
+        
+        Raises:
+            ValueError: If a layer is not read from a sync pair, or its sync pair
+                or table does not have the year
+        """
+        if roll_year is None:
+            return
+        for layer in layers:
+            if layer.connector:
+                raise ValueError(f"Export layer {layer.name} is not read from a sync pair and has no roll years")
+            try:
+                self.layer_reader.table_def(layer)
+            except KeyError as e:
+                raise ValueError(f"Export layer {layer.name}: {e.args[0] if e.args else e}")
+    
+    def _job_layers(self, job: Dict[str, Any]) -> List[ExportLayer]:
+        """The export layers of a job, in the roll year it asked for."""
+        return self.export_layers(job["county_id"], job["layers"], job["parameters"].get("roll_year"))
+    
+    def parcel_reports(self, county_id: str, redactor: Optional[Redactor] = None,
+                       roll_year: Optional[int] = None) -> ParcelReports:
+        """
+        Get the parcel report renderer of a county.
+        
+        Args:
+            county_id: County identifier
+            redactor: Redaction of the fields reports show
+            roll_year: Roll year the reports show (see roll_years); the open year by default
+            
+        Raises:
+            ValueError: If the county has no parcel_reports settings or they are invalid
+        """
+        settings = self._county_export_settings(county_id)
+        layers = {layer.name: layer for layer in self.export_layers(county_id, roll_year=roll_year)}
+        reader = RedactingReader(self.layer_reader, redactor) if redactor and redactor.active else self.layer_reader
+        return ParcelReports(ParcelReportSettings(settings.get("parcel_reports"), layers), reader)
+    
+    def ratio_study(self, county_id: str, redactor: Optional[Redactor] = None,
+                    roll_year: Optional[int] = None) -> RatioStudy:
+        """
+        Get the sales ratio study writer of a county.
+        
+        Args:
+            county_id: County identifier
+            redactor: Redaction of the sale fields studies show
+            roll_year: Roll year the sales and values are read in (see roll_years); the open year by default
+            
+        Raises:
+            ValueError: If the county has no ratio_study settings or they are invalid
+        """
+        settings = self._county_export_settings(county_id)
+        layers = {layer.name: layer for layer in self.export_layers(county_id, roll_year=roll_year)}
+        reader = RedactingReader(self.layer_reader, redactor) if redactor and redactor.active else self.layer_reader
+        return RatioStudy(RatioStudySettings(settings.get("ratio_study"), layers), reader)
+    
+    def parcel_report(self, county_id: str, parcel_id: str, redactor: Optional[Redactor] = None) -> bytes:
+        """
+        Render the PDF report of one parcel.
+        
+        Args:
+            county_id: County identifier
+            parcel_id: Value of the report key field (the parcel number)
+            redactor: Redaction of the caller (see redaction)
+            
+        Returns:
+            PDF document
+            
+        Raises:
+            FileNotFoundError: If the parcel is not in the synced data
+            ValueError: If the county has no parcel_reports settings or they are invalid
+        """
+        reports = self.parcel_reports(county_id, redactor)
+        found, _ = reports.load([parcel_id])
+        if not found:
+            raise FileNotFoundError(f"Parcel {parcel_id} not found for county {county_id}")
+        buffer = io.BytesIO()
+        reports.render(found, buffer)
+        return buffer.getvalue()
+    
+    def _reprojector(self, county_id: str, export_format: str, parameters: Optional[Dict[str, Any]],
+                     layers: List[ExportLayer]) -> Reprojector:
+        """
+        The reprojection stage of a feature export, checked against its layers.
+        
+        Formats with a fixed CRS (and CSV centroids, which are longitude and
+        latitude) are reprojected to it; others to parameters.srid, the DXF
+        srid setting or the county's gis_export.srid, when one is given.
+        
+        Raises:
+            ValueError: If the CRS is unknown or conflicts with the format
+        """
+        parameters = parameters or {}
+        settings = self._county_export_settings(county_id)
+        fixed = FIXED_SRID_FORMATS.get(export_format)
+        if export_format == "csv" and CsvOptions(layers[0], parameters).geometry == "centroid":
+            fixed = 4326
+        if fixed is not None:
+            if parameters.get("srid") is not None and parse_srid(parameters["srid"], "parameters.srid") != fixed:
+                raise ValueError(f"A {export_format} export is written in EPSG:{fixed}; leave out parameters.srid")
+            srid = fixed
+        else:
+            srid = parameters.get("srid")
+            if srid is None and export_format == "dxf":
+                srid = (settings.get("dxf") or {}).get("srid")
+            if srid is None:
+                srid = settings.get("srid")
+            srid = parse_srid(srid) if srid is not None else None
+        reprojector = Reprojector(srid)
+        for layer in layers:
+            reprojector.check(layer.srid)
+        return reprojector
+    
+    def _read(self, job: Dict[str, Any], layer: ExportLayer, bounds) -> Iterable[Dict[str, Any]]:
+        """The redacted features of a layer in the job's area of interest and spatial filter."""
+        features = self._redactor(job).features(self.layer_reader.read(layer, bounds))
+        spatial_filter = self._spatial_filter(job["county_id"], job["parameters"])
+        if spatial_filter is None:
+            return features
+        return self._clipped(job, layer, spatial_filter, features)
+    
+    def _redactor(self, job: Dict[str, Any]) -> Redactor:
+        return self.redaction.named(job["county_id"], job.get("redaction") or [])
+    
+    def _redaction_policies(self, county_id: str, export_format: str, parameters: Optional[Dict[str, Any]],
+                            requested: Optional[List[str]]) -> List[str]:
+        """
+        The redaction policies an export is written with: the requester's,
+        any in parameters.redaction, and those of the delivery targets that
+        will take it.
+        
+        Raises:
+            ValueError: If a policy is not configured for the county
+        """
+        names = list(requested or [])
+        extra = (parameters or {}).get("redaction") or []
+        names.extend([extra] if isinstance(extra, str) else extra)
+        names.extend(target.redaction for target in self.delivery_targets(county_id)
+                     if target.redaction and target.accepts({"export_format": export_format}))
+        return self.redaction.named(county_id, names).names
+    
+    @staticmethod
+    def _clipped(job: Dict[str, Any], layer: ExportLayer, spatial_filter: SpatialFilter,
+                 features: Iterable[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+        yield from spatial_filter.features(features)
+        job.setdefault("spatial_filter", {})[layer.name] = spatial_filter.summary()
+    
+    def _spatial_filter(self, county_id: str, parameters: Optional[Dict[str, Any]]) -> Optional[SpatialFilter]:
+        """
+        The spatial filter of an export's parameters, or None without one.
+        
+        Raises:
+            ValueError: If the filter is invalid or names an unknown district
+        """
+        spec = (parameters or {}).get("spatial_filter")
+        if spec is None:
+            return None
+        spec = parse_spatial_filter(spec)
+        districts = None
+        if spec["kind"] == "district":
+            districts = DistrictRegions(self._county_export_settings(county_id), self.layer_reader)
+        return build_spatial_filter(spec, districts)
+    
+    def _features(self, job: Dict[str, Any], layer: ExportLayer, bounds, reprojector: Reprojector) -> Iterable[Dict[str, Any]]:
+        """
+        The features of a layer for a feature export, limited to the job's
+        spatial filter (see gis_spatial), reprojected and then simplified when
+        the layer or job gives a tolerance. Vector tiles simplify each zoom
+        level themselves (see gis_mvt). The stages run ahead of the writer in
+        a bounded buffer; the spatial filter test and reprojection of each
+        feature, and the simplification of the layer's arcs, on the geometry
+        workers.
+        """
+        features = self._redactor(job).features(self.layer_reader.read(layer, bounds))
+        features = self._geometry(job, layer, features, self._spatial_filter(job["county_id"], job["parameters"]),
+                                  reprojector)
+        if job["export_format"] not in ("mvt", "mbtiles"):
+            simplifier = FeatureSimplifier(simplify_tolerance(layer, job["parameters"]))
+            if simplifier.active:
+                features = self._simplified(job, layer, simplifier, features)
+        return self._buffered(job, layer.name, self._changed(job, layer.name, features))
+
+    def _changed(self, job: Dict[str, Any], name: str, features: Iterable[Dict[str, Any]]) -> Iterable[Dict[str, Any]]:
+        """The features of a layer an export of a series writes: in an increment, those changed (see gis_increments)."""
+        increment = self._increments.get(job["job_id"])
+        return increment.features(name, features) if increment else features
+
+    @staticmethod
+    def _geometry(job: Dict[str, Any], layer: ExportLayer, features: Iterable[Dict[str, Any]],
+                  spatial_filter: Optional[SpatialFilter], reprojector: Reprojector) -> Iterator[Dict[str, Any]]:
+        """The features meeting the spatial filter, reprojected, both done on a geometry stage (see gis_parallel)."""
+        if spatial_filter is None and not reprojector.active:
+            yield from features
+            return
+
+        def checked(features: Iterable[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+            # Transforms are built here too, so their warnings reach the job rather than staying in a worker
+            for feature in features:
+                if spatial_filter is not None:
+                    spatial_filter.check(feature.get("srid"))
+                reprojector.check(feature.get("srid") or 4326)
+                yield feature
+
+        def process(feature: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+            if spatial_filter is not None and not spatial_filter.matches(feature.get("geometry"), feature.get("srid")):
+                return None
+            return reprojector.project(feature) if reprojector.active else feature
+
+        stage = GeometryStage(f"geometry of layer {layer.name}")
+        for feature, processed in stage.map(process, checked(features)):
+            if spatial_filter is not None:
+                spatial_filter.count(processed is not None)
+            if processed is not None:
+                if reprojector.active:
+                    reprojector.count(feature)
+                yield processed
+        job.setdefault("geometry_workers", {})[layer.name] = stage.summary()
+        if spatial_filter is not None:
+            job.setdefault("spatial_filter", {})[layer.name] = spatial_filter.summary()
+
+    @staticmethod
+    def _buffered(job: Dict[str, Any], name: str, features: Iterable[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+        buffer = FeatureBuffer(features)
+        yield from buffer
+        job.setdefault("streaming", {})[name] = buffer.summary()
+    
+    @staticmethod
+    def _simplified(job: Dict[str, Any], layer: ExportLayer, simplifier: FeatureSimplifier,
+                    features: Iterable[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+        yield from simplifier.features(features)
+        job.setdefault("simplification", {})[layer.name] = simplifier.summary()
+    
+    def _check_derived_points(self, county_id: str, export_format: str, layers: List[ExportLayer],
+                              parameters: Optional[Dict[str, Any]]) -> List[ExportLayer]:
+        """
+        The point layers an export derives from its layers, checked against the format.
+        
+        Raises:
+            ValueError: If a derived layer is invalid, clashes with a configured
+                layer, or a single-layer format has no bundle to hold it
+        """
+        if export_format == "xlsx":
+            # Sheets leave geometry out, so there is nothing to derive points from
+            if (parameters or {}).get("derived_points"):
+                raise ValueError("An xlsx export has no geometry; leave out parameters.derived_points")
+            return []
+        if isinstance((parameters or {}).get("derived_points"), dict):
+            unknown = [name for name in parameters["derived_points"] if name not in [layer.name for layer in layers]]
+            if unknown:
+                raise ValueError(f"Derived point parameters name layers not in the export: {', '.join(unknown)}")
+        point_layers = [point_layer for _, _, point_layer in self._derived_layers(export_format, layers, parameters)]
+        if not point_layers:
+            return []
+        configured = [layer.name for layer in self.export_layers(county_id)]
+        clashing = [layer.name for layer in point_layers if layer.name in configured]
+        if clashing:
+            raise ValueError(f"Derived point layers would replace configured layers: {', '.join(clashing)}")
+        if export_format in SINGLE_LAYER_FORMATS and not BundleOptions(
+                self._county_export_settings(county_id).get("bundle"), parameters, export_format).format:
+            raise ValueError(f"A {export_format} export holds one layer; its derived point layers are written as "
+                             f"further files, so set parameters.bundle to deliver them together")
+        return point_layers
+    
+    @staticmethod
+    def _derived_layers(export_format: str, layers: List[ExportLayer],
+                        parameters: Optional[Dict[str, Any]]) -> List[Tuple[ExportLayer, str, ExportLayer]]:
+        """(source layer, kind, point layer) of each point layer an export derives (see gis_points)."""
+        if export_format == "xlsx":
+            return []
+        return [(layer, kind, derived_layer(layer, kind))
+                for layer in layers for kind in derived_point_kinds(layer, parameters)]
+    
+    def _layer_features(self, job: Dict[str, Any], layers: List[ExportLayer], bounds,
+                        reprojector: Reprojector) -> Iterator[Tuple[ExportLayer, Iterable[Dict[str, Any]]]]:
+        """
+        Each layer of a feature export with its features, followed by the
+        point layers derived from it.
+        """
+        derived = self._derived_layers(job["export_format"], layers, job["parameters"])
+        for layer in layers:
+            yield layer, self._features(job, layer, bounds, reprojector)
+            for source, kind, point_layer in derived:
+                if source is layer:
+                    yield point_layer, self._points(job, layer, kind, bounds, reprojector)
+    
+    def _points(self, job: Dict[str, Any], layer: ExportLayer, kind: str, bounds,
+                reprojector: Reprojector) -> Iterable[Dict[str, Any]]:
+        """
+        The derived points of a layer, taken from its features in their own
+        CRS before they are reprojected and without simplification.
+        """
+        features = reprojector.features(point_features(self._read(job, layer, bounds), kind))
+        name = derived_layer(layer, kind).name
+        return self._buffered(job, name, self._changed(job, name, features))
+    
+    def _write_derived_files(self, job: Dict[str, Any], file_path: str, layer: ExportLayer, bounds,
+                             reprojector: Reprojector, write) -> None:
+        """
+        Write the point layers derived from the layer of a single-layer export
+        as files of their own beside it, for its bundle to hold.
+        
+        Args:
+            write: Callable writing (path, layer, features) and returning the layer result
+        """
+        extension = FILE_EXTENSIONS.get(job["export_format"], job["export_format"])
+        for _, kind, point_layer in self._derived_layers(job["export_format"], [layer], job["parameters"]):
+            path = f"{os.path.splitext(file_path)[0]}_{point_layer.name}.{extension}"
+            work_path = f"{path}.partial"
+            try:
+                features = self._points(job, layer, kind, bounds, reprojector)
+                job["layer_results"][point_layer.name] = write(work_path, reprojector.layer(point_layer), features)
+                os.replace(work_path, path)
+            finally:
+                if os.path.exists(work_path):
+                    os.remove(work_path)
+            job.setdefault("derived_files", {})[point_layer.name] = path
+    
+    def _county_export_settings(self, county_id: str) -> Dict[str, Any]:
+        """Load the gis_export plugin settings of a county, if it has a configuration file."""
+        return county_export_settings(self.config_dir, county_id)
+    
+    def _deliver(self, job: Dict[str, Any], file_path: str, names: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+        """
+        Push an export file to the delivery targets that take its format.
+        
+        Args:
+            job: Export job
+            file_path: Local export file
+            names: Delivery targets to push to (all by default)
+            
+        Returns:
+            Delivery records to save on the job
+        """
+        results = []
+        for target in self.delivery_targets(job["county_id"]):
+            if names and target.name not in names:
+                continue
+            if not names and not target.accepts(job):
+                continue
+            results.append(target.deliver(job, file_path))
+        return results
+    
+    def _publish_artifact(self, job: Dict[str, Any], file_path: str) -> Dict[str, Any]:
+        """
+        Deliver a finished export file to the county's artifact store.
+        
+        Args:
+            job: Export job
+            file_path: Local export file
+            
+        Returns:
+            Artifact record to save on the job
+        """
+        store = self.artifact_store(job["county_id"])
+        key = store.key_for(job, os.path.basename(file_path))
+        tags = {"county_id": job["county_id"], "export_format": job["export_format"]}
+        artifact = store.put(file_path, key, self._artifact_type(job)[1], tags)
+        if store.backend_name != LocalArtifactStore.backend_name and not store.keep_local:
+            os.remove(file_path)
+        return artifact
+    
+    def _bundle_export(self, job: Dict[str, Any], file_path: str, options: BundleOptions) -> str:
+        """
+        Pack a finished export file into a bundle, which replaces it.
+        
+        Args:
+            job: Export job
+            file_path: Local export file
+            options: Bundle options
+            
+        Returns:
+            Path of the bundle file
+        """
+        export_format = job["export_format"]
+        root = f"{job['county_id']}_export"
+        bundle_path = os.path.join(self.county_path(job["county_id"]),
+                                   f"{job['county_id']}_{job['job_id']}_bundle.{options.extension}")
+        work_path = f"{bundle_path}.partial"
+        export = {
+            "job_id": job["job_id"],
+            "county_id": job["county_id"],
+            "export_format": export_format,
+            "layers": job["layers"],
+            "requested_by": job["username"],
+            "created_at": job["created_at"],
+        }
+        try:
+            with BundleWriter(work_path, options, root, export) as writer:
+                if export_format in ARCHIVE_FORMATS:
+                    writer.add_archive(file_path)
+                else:
+                    writer.add_file(file_path, f"{root}.{FILE_EXTENSIONS.get(export_format, export_format)}")
+                for name, path in (job.get("derived_files") or {}).items():
+                    writer.add_file(path, f"{name}.{FILE_EXTENSIONS.get(export_format, export_format)}")
+                if job.get("increment"):
+                    manifest = json.dumps(job["increment"], indent=2).encode("utf-8")
+                    writer.add_stream(io.BytesIO(manifest), "increment.json", len(manifest))
+            os.replace(work_path, bundle_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
+        os.remove(file_path)
+        for path in (job.pop("derived_files", None) or {}).values():
+            os.remove(path)
+        job["bundle"] = {
+            "format": options.format,
+            "files": writer.files,
+            "sha256": file_sha256(bundle_path),
+        }
+        logger.info(f"Bundled GIS export {job['job_id']} as {options.format} with {len(writer.files)} files")
+        return bundle_path
+    
+    @staticmethod
+    def _artifact_type(job: Dict[str, Any]) -> Tuple[str, Optional[str]]:
+        """File extension and MIME type of a job's artifact: its bundle's, or its format's."""
+        if job.get("bundle"):
+            return BUNDLE_FORMATS[job["bundle"]["format"]]
+        export_format = job["export_format"]
+        return FILE_EXTENSIONS.get(export_format, export_format), CONTENT_TYPES.get(export_format)
+    
+    def _announce(self, job: Dict[str, Any], event: str) -> None:
+        """Publish an export job lifecycle event; the bus being down never affects the job."""
+        try:
+            event_bus.publish(SUBJECT_EXPORT_JOB.format(job_id=job["job_id"], event=event), {
+                "job_id": job["job_id"],
+                "county_id": job["county_id"],
+                "status": job["status"],
+                "export_format": job["export_format"],
+                "layers": job["layers"],
+                "download_url": job.get("download_url"),
+                "message": job.get("message"),
+            })
+        except EventBusError as e:
+            logger.warning(f"Cannot announce GIS export job {job['job_id']} {event}: {e}")
+
     def _save_job(self, job: Dict[str, Any]) -> None:
         """
         Save job details to a JSON file.
@@ -299,10 +1209,14 @@ class GisExportService:
             job: Job dictionary
         """
         job_id = job["job_id"]
-        job_file = os.path.join(self.storage_path, f"{job_id}.json")
+        job_file = os.path.join(self.county_path(job["county_id"]), f"{job_id}.json")
         
         with open(job_file, 'w') as f:
-            json.dump(job, f, indent=2)
+            f.write(dumps_document(job, self.cipher, f"export_jobs/{job_id}", indent=2))
+        # Jobs saved before counties had their own directory move into it
+        legacy_file = os.path.join(self.storage_path, f"{job_id}.json")
+        if os.path.exists(legacy_file):
+            os.remove(legacy_file)
     
     def _load_job(self, job_id: str) -> Dict[str, Any]:
         """
@@ -315,150 +1229,393 @@ class GisExportService:
             Job dictionary
             
         Raises:
-            FileNotFoundError: If job with the given ID does not exist
+            FileNotFoundError: If job with the given ID does not exist, or belongs
+                to a county outside the request's scope (see tenancy)
         """
-        job_file = os.path.join(self.storage_path, f"{job_id}.json")
+        job_file = self._job_file(job_id)
         
-        if not os.path.exists(job_file):
+        if job_file is None:
             raise FileNotFoundError(f"Export job {job_id} not found")
         
         with open(job_file, 'r') as f:
-            return json.load(f)
+            job = loads_document(f.read(), self.cipher, f"export_jobs/{job_id}")
+        if not tenant_allows(job.get("county_id")):
+            raise FileNotFoundError(f"Export job {job_id} not found")
+        return job
+
+    def county_path(self, county_id: str, create: bool = True) -> str:
+        """
+        The export directory of a county, created when missing unless create is False.
+
+        Raises:
+            ValueError: If the county ID cannot name a directory
+        """
+        if not county_id or county_id.startswith(".") or county_id == SERIES_FOLDER or \
+                os.path.basename(county_id) != county_id:
+            raise ValueError(f"Invalid county_id: {county_id}")
+        path = os.path.join(self.storage_path, county_id)
+        if create:
+            os.makedirs(path, exist_ok=True)
+        return path
+
+    def usage(self, county_id: str) -> Dict[str, float]:
+        """
+        A county's unfinished export jobs and the MB its export directory
+        holds, by the tenant_quotas quota they count against.
+
+        Raises:
+            ValueError: If the county ID cannot name a directory
+        """
+        path = self.county_path(county_id, create=False)
+        running = sum(1 for job in self.list_jobs(county_id=county_id, limit=1_000_000)
+                      if job["status"] not in FINISHED_STATUSES)
+        return {"max_running_exports": running, "export_storage_mb": round(directory_size(path) / (1024 * 1024), 1)}
+
+    def _county_directories(self) -> List[str]:
+        os.makedirs(self.storage_path, exist_ok=True)
+        return sorted(os.path.join(self.storage_path, name) for name in os.listdir(self.storage_path)
+                      if name != SERIES_FOLDER and os.path.isdir(os.path.join(self.storage_path, name)))
+
+    def _job_files(self, county_id: Optional[str] = None) -> List[str]:
+        """The job files of a county's directory, or of every county's, and those saved before either."""
+        directories = [self.storage_path]
+        if county_id:
+            directories.append(os.path.join(self.storage_path, county_id))
+        else:
+            directories.extend(self._county_directories())
+        return [os.path.join(directory, name) for directory in directories if os.path.isdir(directory)
+                for name in os.listdir(directory) if name.endswith(".json")]
+
+    def _job_file(self, job_id: str) -> Optional[str]:
+        """The file of a job, in its county's directory or, saved before counties had one, the storage path."""
+        for directory in [self.storage_path] + self._county_directories():
+            job_file = os.path.join(directory, f"{job_id}.json")
+            if os.path.isfile(job_file):
+                return job_file
+        return None
     
     # Export processors for different formats
     def _process_geojson_export(self, job: Dict[str, Any], file_path: str) -> None:
-        """Process a GeoJSON export."""
-        county_id = job["county_id"]
-        layers = job["layers"]
-        area_of_interest = job["area_of_interest"]
-        
-        # In a real implementation, this would query the database and generate actual GeoJSON
-        # For demonstration, we'll create a simple GeoJSON file
-        
-        features = []
-        for i, layer in enumerate(layers):
-            # Create a sample feature for each layer
-            feature = {
-                "type": "Feature",
-                "id": f"{i+1}",
-                "properties": {
-                    "layer": layer,
-                    "county": county_id,
-                    "name": f"Feature {i+1}",
-                    "description": f"Sample {layer} feature for {county_id}"
-                },
-                "geometry": {
-                    "type": "Polygon",
-                    "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 1], [0, 0]]]
-                }
-            }
-            features.append(feature)
-        
-        # Create the GeoJSON structure
-        geojson = {
-            "type": "FeatureCollection",
-            "name": f"{county_id} Export",
-            "features": features,
-            "metadata": {
-                "exported_by": job["username"],
-                "exported_at": datetime.utcnow().isoformat(),
-                "layers": layers,
-                "area_of_interest": area_of_interest
-            }
+        """
+        Process a GeoJSON export.
+        
+        Every requested layer streams into one FeatureCollection in WGS 84,
+        each feature naming its layer (see gis_geojson). Features are written
+        as they are read, so memory use does not grow with the layers.
+        """
+        layers = self._job_layers(job)
+        bounds = area_bounds(job["area_of_interest"])
+        reprojector = self._reprojector(job["county_id"], job["export_format"], job["parameters"], layers)
+        metadata = {
+            "exported_by": job["username"],
+            "exported_at": datetime.utcnow().isoformat(),
+            "layers": job["layers"],
+            "area_of_interest": job["area_of_interest"],
         }
         
-        # Write to file
-        with open(file_path, 'w') as f:
-            json.dump(geojson, f, indent=2)
+        work_path = f"{file_path}.partial"
+        try:
+            with GeoJsonWriter(work_path, f"{job['county_id']} Export", metadata) as writer:
+                job["layer_results"] = {}
+                for layer, features in self._layer_features(job, layers, bounds, reprojector):
+                    job["layer_results"][layer.name] = writer.add_layer(reprojector.layer(layer), features)
+            if reprojector.active:
+                job["reprojection"] = reprojector.summary()
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
     
     def _process_shapefile_export(self, job: Dict[str, Any], file_path: str) -> None:
         """
         Process a Shapefile export.
         
-        In a real implementation, this would use a library like Fiona or GeoPandas
-        to create actual Shapefiles. For this demo, we'll create a simple placeholder file.
+        Every requested layer becomes a shapefile (.shp, .shx, .dbf, .prj, .cpg
+        and a field name mapping, see gis_shapefile), delivered together in
+        one ZIP file.
         """
-        county_id = job["county_id"]
-        layers = job["layers"]
+        layers = self._job_layers(job)
+        bounds = area_bounds(job["area_of_interest"])
+        reprojector = self._reprojector(job["county_id"], job["export_format"], job["parameters"], layers)
         
-        # Create a simple placeholder file
-        with open(file_path, 'w') as f:
-            f.write(f"# TerraFusion Shapefile Export\n")
-            f.write(f"# County: {county_id}\n")
-            f.write(f"# Layers: {', '.join(layers)}\n")
-            f.write(f"# Generated: {datetime.utcnow().isoformat()}\n")
-            f.write(f"# This is a placeholder for a real Shapefile export.\n")
-            f.write(f"# In production, this would be a ZIP file containing actual Shapefiles.\n")
+        work_dir = tempfile.mkdtemp(prefix="tf_shapefile_")
+        work_path = f"{file_path}.partial"
+        try:
+            writer = ShapefileWriter(work_dir)
+            job["layer_results"] = {}
+            for layer, features in self._layer_features(job, layers, bounds, reprojector):
+                job["layer_results"][layer.name] = writer.add_layer(reprojector.layer(layer), features)
+            with zipfile.ZipFile(work_path, "w", zipfile.ZIP_DEFLATED) as archive:
+                for path in writer.files:
+                    archive.write(path, os.path.basename(path))
+            if reprojector.active:
+                job["reprojection"] = reprojector.summary()
+            os.replace(work_path, file_path)
+        finally:
+            shutil.rmtree(work_dir, ignore_errors=True)
+            if os.path.exists(work_path):
+                os.remove(work_path)
     
     def _process_kml_export(self, job: Dict[str, Any], file_path: str) -> None:
-        """Process a KML export."""
-        county_id = job["county_id"]
-        layers = job["layers"]
-        
-        # Create a simple KML file
-        kml_content = f"""<?xml version="1.0" encoding="UTF-8"?>
-<kml xmlns="http://www.opengis.net/kml/2.2">
-  <Document>
-    <name>{county_id} Export</name>
-    <description>Exported layers: {', '.join(layers)}</description>
-    <Style id="polygon">
-      <LineStyle>
-        <color>ff0000ff</color>
-        <width>2</width>
-      </LineStyle>
-      <PolyStyle>
-        <color>7f0000ff</color>
-      </PolyStyle>
-    </Style>
-    <Placemark>
-      <name>Sample Feature</name>
-      <description>This is a sample feature</description>
-      <styleUrl>#polygon</styleUrl>
-      <Polygon>
-        <outerBoundaryIs>
-          <LinearRing>
-            <coordinates>
-              0,0,0
-              1,0,0
-              1,1,0
-              0,1,0
-              0,0,0
-            </coordinates>
-          </LinearRing>
-        </outerBoundaryIs>
-      </Polygon>
-    </Placemark>
-  </Document>
-</kml>
-"""
-        with open(file_path, 'w') as f:
-            f.write(kml_content)
+        """
+        Process a KML or KMZ export.
+        
+        Every requested layer becomes a styled folder of placemarks (see
+        gis_kml); large layers are split into region tiles, which a KMZ
+        loads through network links.
+        """
+        layers = self._job_layers(job)
+        bounds = area_bounds(job["area_of_interest"])
+        reprojector = self._reprojector(job["county_id"], job["export_format"], job["parameters"], layers)
+        
+        work_path = f"{file_path}.partial"
+        try:
+            job["layer_results"] = {}
+            with KmlWriter(work_path, f"{job['county_id']} Export", kmz=job["export_format"] == "kmz") as writer:
+                for layer, features in self._layer_features(job, layers, bounds, reprojector):
+                    job["layer_results"][layer.name] = writer.add_layer(reprojector.layer(layer), features)
+            if reprojector.active:
+                job["reprojection"] = reprojector.summary()
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
+    
+    def _process_flatgeobuf_export(self, job: Dict[str, Any], file_path: str) -> None:
+        """
+        Process a FlatGeobuf export.
+        
+        The requested layer streams into one .fgb file with its packed
+        Hilbert R-tree index ahead of the features (see gis_flatgeobuf), so
+        clients can range-request the features in view straight from the
+        artifact store or download endpoint.
+        """
+        layer = self._job_layers(job)[0]
+        bounds = area_bounds(job["area_of_interest"])
+        reprojector = self._reprojector(job["county_id"], job["export_format"], job["parameters"], [layer])
+        
+        work_path = f"{file_path}.partial"
+        try:
+            writer = FlatGeobufWriter(work_path)
+            features = self._features(job, layer, bounds, reprojector)
+            job["layer_results"] = {layer.name: writer.write_layer(reprojector.layer(layer), features)}
+            self._write_derived_files(job, file_path, layer, bounds, reprojector,
+                                      lambda path, point_layer, points: FlatGeobufWriter(path).write_layer(point_layer, points))
+            if reprojector.active:
+                job["reprojection"] = reprojector.summary()
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
+    
+    def _process_geoparquet_export(self, job: Dict[str, Any], file_path: str) -> None:
+        """
+        Process a GeoParquet export.
+        
+        The requested layer becomes one Parquet file with a WKB geometry
+        column and GeoParquet metadata (see gis_geoparquet); row group size,
+        compression and row order come from the layer's geoparquet settings
+        and the job parameters.
+        """
+        layer = self._job_layers(job)[0]
+        bounds = area_bounds(job["area_of_interest"])
+        reprojector = self._reprojector(job["county_id"], job["export_format"], job["parameters"], [layer])
+        
+        work_path = f"{file_path}.partial"
+        try:
+            writer = GeoParquetWriter(work_path, GeoParquetOptions(layer, job["parameters"]))
+            features = self._features(job, layer, bounds, reprojector)
+            job["layer_results"] = {layer.name: writer.write_layer(reprojector.layer(layer), features)}
+            self._write_derived_files(job, file_path, layer, bounds, reprojector,
+                                      lambda path, point_layer, points: GeoParquetWriter(
+                                          path, GeoParquetOptions(point_layer, job["parameters"])).write_layer(point_layer, points))
+            if reprojector.active:
+                job["reprojection"] = reprojector.summary()
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
+    
+    def _process_vector_tile_export(self, job: Dict[str, Any], file_path: str) -> None:
+        """
+        Process a vector tile export.
+        
+        Every requested layer becomes a layer of Mapbox Vector Tiles over
+        its configured zoom levels (see gis_mvt), delivered as a zipped
+        z/x/y pyramid ("mvt") or an MBTiles file ("mbtiles").
+        """
+        layers = self._job_layers(job)
+        bounds = area_bounds(job["area_of_interest"])
+        reprojector = self._reprojector(job["county_id"], job["export_format"], job["parameters"], layers)
+        container = "mbtiles" if job["export_format"] == "mbtiles" else "directory"
+        
+        work_path = f"{file_path}.partial"
+        try:
+            job["layer_results"] = {}
+            with MvtWriter(work_path, f"{job['county_id']} Export", container) as writer:
+                for layer, features in self._layer_features(job, layers, bounds, reprojector):
+                    job["layer_results"][layer.name] = writer.add_layer(reprojector.layer(layer), features)
+            job["tileset"] = writer.tileset
+            if reprojector.active:
+                job["reprojection"] = reprojector.summary()
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
+    
+    def _process_dxf_export(self, job: Dict[str, Any], file_path: str) -> None:
+        """
+        Process a DXF export.
+        
+        Every requested layer is drawn on its own DXF layers of one R12
+        drawing, with label fields such as lot numbers as text (see
+        gis_dxf); units, layer prefix and CRS come from the county's dxf
+        settings and the job parameters.
+        """
+        layers = self._job_layers(job)
+        bounds = area_bounds(job["area_of_interest"])
+        reprojector = self._reprojector(job["county_id"], job["export_format"], job["parameters"], layers)
+        options = DxfOptions(self._county_export_settings(job["county_id"]).get("dxf"), job["parameters"])
+        
+        work_path = f"{file_path}.partial"
+        try:
+            job["layer_results"] = {}
+            with DxfWriter(work_path, options) as writer:
+                for layer, features in self._layer_features(job, layers, bounds, reprojector):
+                    job["layer_results"][layer.name] = writer.add_layer(reprojector.layer(layer), features)
+            if reprojector.active:
+                job["reprojection"] = reprojector.summary()
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
     
     def _process_geopackage_export(self, job: Dict[str, Any], file_path: str) -> None:
-        """Process a GeoPackage export."""
-        county_id = job["county_id"]
-        layers = job["layers"]
-        
-        # Create a simple placeholder file
-        with open(file_path, 'w') as f:
-            f.write(f"# TerraFusion GeoPackage Export\n")
-            f.write(f"# County: {county_id}\n")
-            f.write(f"# Layers: {', '.join(layers)}\n")
-            f.write(f"# Generated: {datetime.utcnow().isoformat()}\n")
-            f.write(f"# This is a placeholder for a real GeoPackage export.\n")
-            f.write(f"# In production, this would be a GeoPackage database file (.gpkg).\n")
+        """
+        Process a GeoPackage export.
+        
+        Every requested layer becomes a feature table (with an R-tree spatial
+        index) of one .gpkg file, holding the features that meet the bounding
+        box of the area of interest.
+        """
+        layers = self._job_layers(job)
+        bounds = area_bounds(job["area_of_interest"])
+        reprojector = self._reprojector(job["county_id"], job["export_format"], job["parameters"], layers)
+        
+        # Written beside the final path so a failed export leaves no partial file
+        work_path = f"{file_path}.partial"
+        if os.path.exists(work_path):
+            os.remove(work_path)
+        try:
+            job["layer_results"] = {}
+            with GeoPackageWriter(work_path) as writer:
+                for layer, features in self._layer_features(job, layers, bounds, reprojector):
+                    job["layer_results"][layer.name] = writer.add_layer(reprojector.layer(layer), features)
+            if reprojector.active:
+                job["reprojection"] = reprojector.summary()
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
     
     def _process_csv_export(self, job: Dict[str, Any], file_path: str) -> None:
-        """Process a CSV export."""
-        county_id = job["county_id"]
-        layers = job["layers"]
+        """
+        Process a CSV export.
         
-        # Create a simple CSV file
-        with open(file_path, 'w') as f:
-            f.write(f"id,layer,county,name,description,geometry\n")
-            for i, layer in enumerate(layers):
-                f.write(f"{i+1},{layer},{county_id},Feature {i+1},\"Sample {layer} feature for {county_id}\",\"POLYGON((0 0, 1 0, 1 1, 0 1, 0 0))\"\n")
+        The requested layer becomes one flat file with geometry as WKT or a
+        centroid longitude/latitude, and the columns and headers the job
+        parameters or the layer's csv settings choose (see gis_csv).
+        """
+        layer = self._job_layers(job)[0]
+        bounds = area_bounds(job["area_of_interest"])
+        reprojector = self._reprojector(job["county_id"], job["export_format"], job["parameters"], [layer])
+        
+        work_path = f"{file_path}.partial"
+        try:
+            writer = CsvWriter(work_path, CsvOptions(layer, job["parameters"]))
+            features = self._features(job, layer, bounds, reprojector)
+            job["layer_results"] = {layer.name: writer.write_layer(reprojector.layer(layer), features)}
+            self._write_derived_files(job, file_path, layer, bounds, reprojector,
+                                      lambda path, point_layer, points: CsvWriter(
+                                          path, CsvOptions(point_layer, job["parameters"])).write_layer(point_layer, points))
+            if reprojector.active:
+                job["reprojection"] = reprojector.summary()
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
 
+    
+    def _process_xlsx_export(self, job: Dict[str, Any], file_path: str) -> None:
+        """
+        Process an Excel export.
+        
+        Every requested layer becomes a sheet of one workbook, with typed
+        cells, a frozen header row and the columns, headers and number
+        formats of the layer's xlsx settings and the job parameters (see
+        gis_xlsx).
+        """
+        layers = self._job_layers(job)
+        bounds = area_bounds(job["area_of_interest"])
+        
+        work_path = f"{file_path}.partial"
+        try:
+            job["layer_results"] = {}
+            with XlsxWriter(work_path, f"{job['county_id']} Export") as writer:
+                for layer in layers:
+                    options = XlsxSheetOptions(layer, job["parameters"])
+                    features = self._changed(job, layer.name, self._read(job, layer, bounds))
+                    job["layer_results"][layer.name] = writer.add_layer(layer, features, options)
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
+    
+    def _process_parcel_reports_export(self, job: Dict[str, Any], file_path: str) -> None:
+        """
+        Process a parcel report packet.
+        
+        The parcels listed in the job parameters become one PDF, a report
+        page and a bookmark per parcel in the order listed (see gis_reports),
+        for appeal hearings; parcels not in the synced data are left out and
+        listed on the job.
+        """
+        reports = self.parcel_reports(job["county_id"], self._redactor(job), job["parameters"].get("roll_year"))
+        found, missing = reports.load(job["parameters"]["parcels"])
+        if not found:
+            raise ValueError("None of the requested parcels are in the synced data")
+        
+        work_path = f"{file_path}.partial"
+        try:
+            with open(work_path, "wb") as f:
+                pages = reports.render(found, f)
+            job["reports"] = {"pages": pages, "parcels": [r.key for r in found], "missing": missing}
+            if missing:
+                logger.warning(f"Parcel report export {job['job_id']}: parcels not found: {', '.join(missing)}")
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
+
+    
+    def _process_ratio_study_export(self, job: Dict[str, Any], file_path: str) -> None:
+        """
+        Process a sales ratio study.
+        
+        The sales the job parameters select are written as CSV, a row per
+        sale with the assessed value of its parcels in parameters.tax_year
+        and its ratio (see gis_ratio_study); the study's statistics are
+        recorded on the job.
+        """
+        study = self.ratio_study(job["county_id"], self._redactor(job), job["parameters"].get("roll_year"))
+        work_path = f"{file_path}.partial"
+        try:
+            with open(work_path, "w", newline="", encoding="utf-8") as f:
+                job["ratio_study"] = study.write(RatioStudyParameters(job["parameters"]), f)
+            os.replace(work_path, file_path)
+        finally:
+            if os.path.exists(work_path):
+                os.remove(work_path)
 
 # Create a singleton instance
 gis_export_service = GisExportService()
\ No newline at end of file
@@ -0,0 +1,718 @@
+"""
+TerraFusion Platform - GIS Export Features
+
+This module provides the features GIS exports are built from. The layers a
+county can export are listed under plugin_settings.gis_export.layers in its
+configuration, each naming where its records live: a table of a sync pair
+(read from the pair's target, so exports carry what the last sync loaded) or
+a table reached through its own connector (a source connector, read with
+read_table, or a target connector):
+
+    "layers": {
+        "parcels": {"sync_pair_id": "benton_wa_gis", "table": "gis.parcels",
+                    "geometry_type": "MultiPolygon", "srid": 2927},
+        "districts": {"connector": {"type": "postgis", "dsn_env_var": "GIS_DATABASE_URL",
+                                    "schema": "gis"},
+                      "table": "districts", "primary_key": ["district_id"]}
+    }
+
+A layer of a sync pair versioned by assessment roll year (see roll_years)
+reads the open year's staging table unless it is given a certified year's
+(ExportLayer.roll_year), which reads that year's table instead.
+
+Layers are read a page at a time in primary key order, so exports of large
+layers never hold the whole table in memory. Each feature is a dictionary
+with "id" (its key as text), "properties", "geometry" (GeoJSON-style
+{"type", "coordinates"}, or None) and "srid".
+
+Exports read through a FeatureBuffer: the reading and transformation stages
+run on a thread of their own, at most EXPORT_BUFFER_FEATURES features ahead
+of the writer, and pause while the writer catches up. Reading the database
+overlaps with writing the file, and memory stays bounded by the buffer and
+a page of rows however large the county.
+"""
+
+import os
+import json
+import queue
+import struct
+import tempfile
+import math
+import logging
+import threading
+import contextvars
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Iterable, Iterator, Sequence, Tuple
+
+from sync_connectors import (
+    ConnectorError, SourceConnector, create_connector, keyset_after, record_key, ewkb_bytes, _parse_wkb,
+    RESERVED_FIELDS
+)
+from sync_filters import _compare
+from county_overrides import load_county_config, county_config_path
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Rows read per query while exporting a layer
+LAYER_PAGE_SIZE = 1000
+
+# Values per "in" query when looking features up by a field
+LOOKUP_CHUNK_SIZE = 500
+
+# Features read ahead of an export's writer; 0 reads on the writer's thread
+EXPORT_BUFFER_FEATURES = int(os.environ.get("EXPORT_BUFFER_FEATURES", "2000"))
+
+# Features handed from the reading thread to the writer at a time
+BUFFER_CHUNK_FEATURES = 100
+
+# Record field holding a layer's geometry unless the layer names another
+DEFAULT_GEOMETRY_FIELD = "geometry"
+
+# Geometry type names by WKB type code
+GEOMETRY_TYPE_NAMES = {
+    1: "Point",
+    2: "LineString",
+    3: "Polygon",
+    4: "MultiPoint",
+    5: "MultiLineString",
+    6: "MultiPolygon",
+}
+
+WKB_TYPE_CODES = {name: code for code, name in GEOMETRY_TYPE_NAMES.items()}
+
+# (min x, min y, max x, max y)
+Bounds = Tuple[float, float, float, float]
+
+# Where a point lies relative to a polygon
+OUTSIDE, BOUNDARY, INSIDE = -1, 0, 1
+
+
+class ExportLayer:
+    """A layer exports can include, from plugin_settings.gis_export.layers."""
+
+    def __init__(self, name: str, definition: Dict[str, Any]):
+        """
+        Build and validate a layer.
+
+        Raises:
+            ValueError: If the definition is invalid
+        """
+        self.name = name
+        self.title = definition.get("title", name)
+        self.description = definition.get("description", "")
+        self.sync_pair_id = definition.get("sync_pair_id")
+        self.connector = definition.get("connector")
+        self.table = definition.get("table")
+        self.primary_key = list(definition.get("primary_key") or [])
+        self.geometry_field = definition.get("geometry_field", DEFAULT_GEOMETRY_FIELD)
+        self.geometry_type = definition.get("geometry_type")
+        self.srid = int(definition["srid"]) if definition.get("srid") else None
+        self.columns = definition.get("columns")
+        self.settings = definition
+        # Roll year the layer is read in (see roll_years); None for the open year
+        self.roll_year = None
+
+        if not self.table:
+            raise ValueError(f"Export layer {name} needs a table")
+        if bool(self.sync_pair_id) == bool(self.connector):
+            raise ValueError(f"Export layer {name} needs either a sync_pair_id or a connector")
+        if self.connector and not self.primary_key:
+            raise ValueError(f"Export layer {name} needs a primary_key to page through its table")
+        if self.geometry_type and self.geometry_type not in WKB_TYPE_CODES:
+            raise ValueError(
+                f"Unsupported geometry_type for export layer {name}: {self.geometry_type}. "
+                f"Supported types: {', '.join(WKB_TYPE_CODES)}"
+            )
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {
+            "name": self.name,
+            "title": self.title,
+            "description": self.description,
+            "sync_pair_id": self.sync_pair_id,
+            "table": self.table,
+            "geometry_type": self.geometry_type,
+            "srid": self.srid,
+        }
+
+
+def parse_layers(settings: Optional[Dict[str, Any]]) -> Dict[str, ExportLayer]:
+    """
+    The export layers of a county's gis_export settings, by name.
+
+    Raises:
+        ValueError: If a layer definition is invalid
+    """
+    return {name: ExportLayer(name, definition) for name, definition in ((settings or {}).get("layers") or {}).items()}
+
+
+def county_export_settings(config_dir: str, county_id: str) -> Dict[str, Any]:
+    """Load the gis_export plugin settings of a county, if it has a configuration file."""
+    config_path = county_config_path(config_dir, county_id)
+    if config_path is None:
+        return {}
+    return load_county_config(config_path).get("plugin_settings", {}).get("gis_export", {})
+
+
+def decode_geometry(value: Any) -> Tuple[Optional[Dict[str, Any]], Optional[int]]:
+    """
+    A stored geometry as a GeoJSON-style geometry and its SRID.
+
+    Accepts (E)WKB bytes or hex, as the PostGIS connectors carry geometry,
+    and GeoJSON geometry objects (or their JSON text).
+
+    Raises:
+        ValueError: If the value is not a supported geometry
+    """
+    if value is None or value == "":
+        return None, None
+    if isinstance(value, str) and value.lstrip().startswith("{"):
+        value = json.loads(value)
+    if isinstance(value, dict):
+        if value.get("type") not in WKB_TYPE_CODES or "coordinates" not in value:
+            raise ValueError(f"Unsupported GeoJSON geometry: {value.get('type')}")
+        return {"type": value["type"], "coordinates": value["coordinates"]}, None
+    data = ewkb_bytes(value)
+    try:
+        srid, base, coordinates, _, _ = _parse_wkb(data)
+    except struct.error:
+        raise ValueError("Truncated WKB geometry")
+    return {"type": GEOMETRY_TYPE_NAMES[base], "coordinates": coordinates}, srid
+
+
+def geometry_has_z(geometry: Dict[str, Any]) -> bool:
+    """Whether a geometry's coordinates carry Z values."""
+    for point in iter_points(geometry):
+        return len(point) > 2
+    return False
+
+
+def iter_points(geometry: Optional[Dict[str, Any]]) -> Iterator[List[float]]:
+    """Every coordinate of a geometry."""
+    if not geometry:
+        return
+
+    def walk(coordinates):
+        if coordinates and isinstance(coordinates[0], (int, float)):
+            yield coordinates
+        else:
+            for part in coordinates:
+                yield from walk(part)
+
+    yield from walk(geometry["coordinates"])
+
+
+def geometry_bounds(geometry: Optional[Dict[str, Any]]) -> Optional[Bounds]:
+    """The bounding box of a geometry, or None when it is empty."""
+    xs, ys = [], []
+    for point in iter_points(geometry):
+        xs.append(point[0])
+        ys.append(point[1])
+    if not xs:
+        return None
+    return min(xs), min(ys), max(xs), max(ys)
+
+
+def merge_bounds(a: Optional[Bounds], b: Optional[Bounds]) -> Optional[Bounds]:
+    """The bounding box of two boxes."""
+    if a is None or b is None:
+        return a or b
+    return min(a[0], b[0]), min(a[1], b[1]), max(a[2], b[2]), max(a[3], b[3])
+
+
+def bounds_intersect(a: Bounds, b: Bounds) -> bool:
+    return a[0] <= b[2] and b[0] <= a[2] and a[1] <= b[3] and b[1] <= a[3]
+
+
+def area_bounds(area_of_interest: Optional[Dict[str, Any]]) -> Optional[Bounds]:
+    """
+    The bounding box of an export's area of interest (a GeoJSON geometry,
+    Feature or FeatureCollection), or None when it covers everything.
+    """
+    if not area_of_interest:
+        return None
+    kind = area_of_interest.get("type")
+    if kind == "FeatureCollection":
+        bounds = None
+        for feature in area_of_interest.get("features") or []:
+            bounds = merge_bounds(bounds, area_bounds(feature))
+        return bounds
+    if kind == "Feature":
+        return area_bounds(area_of_interest.get("geometry"))
+    if area_of_interest.get("bbox") and len(area_of_interest["bbox"]) == 4:
+        return tuple(float(v) for v in area_of_interest["bbox"])
+    return geometry_bounds({"type": kind, "coordinates": area_of_interest.get("coordinates") or []})
+
+
+def segment_distance(p: Sequence[float], a: Sequence[float], b: Sequence[float]) -> float:
+    """The distance from a point to the segment a-b."""
+    dx, dy = b[0] - a[0], b[1] - a[1]
+    length = dx * dx + dy * dy
+    t = 0.0 if not length else max(0.0, min(1.0, ((p[0] - a[0]) * dx + (p[1] - a[1]) * dy) / length))
+    return math.hypot(p[0] - a[0] - t * dx, p[1] - a[1] - t * dy)
+
+
+def crosses_ray(p: Sequence[float], a: Sequence[float], b: Sequence[float]) -> bool:
+    """Whether the edge a-b crosses the ray from a point towards +x: one step of the even-odd rule."""
+    return (a[1] > p[1]) != (b[1] > p[1]) and p[0] < a[0] + (p[1] - a[1]) * (b[0] - a[0]) / (b[1] - a[1])
+
+
+def on_edge(p: Sequence[float], a: Sequence[float], b: Sequence[float], tolerance: float = 0.0) -> bool:
+    """Whether a point lies on the edge a-b, or within tolerance of it."""
+    if tolerance > 0:
+        return segment_distance(p, a, b) <= tolerance
+    return (b[0] - a[0]) * (p[1] - a[1]) == (b[1] - a[1]) * (p[0] - a[0]) and \
+        min(a[0], b[0]) <= p[0] <= max(a[0], b[0]) and min(a[1], b[1]) <= p[1] <= max(a[1], b[1])
+
+
+def ring_edges(rings: Iterable[Sequence[Sequence[float]]]) -> Iterator[Tuple[Sequence[float], Sequence[float]]]:
+    """The edges of rings, closed or open; edges of no length are skipped."""
+    for ring in rings:
+        for i in range(len(ring)):
+            a, b = ring[i - 1], ring[i]
+            if (a[0], a[1]) != (b[0], b[1]):
+                yield a, b
+
+
+def locate_point(p: Sequence[float], edges: Iterable[Tuple[Sequence[float], Sequence[float]]],
+                 tolerance: float = 0.0) -> int:
+    """
+    INSIDE, BOUNDARY or OUTSIDE of the polygon the edges outline, holes
+    included, by the even-odd rule; within tolerance of an edge is BOUNDARY.
+    """
+    inside = False
+    for a, b in edges:
+        if on_edge(p, a, b, tolerance):
+            return BOUNDARY
+        if crosses_ray(p, a, b):
+            inside = not inside
+    return INSIDE if inside else OUTSIDE
+
+
+def encode_wkb(geometry: Dict[str, Any]) -> bytes:
+    """
+    A GeoJSON-style geometry as ISO WKB (little endian; Z types when the
+    coordinates have three values).
+
+    Raises:
+        ValueError: If the geometry type is not supported
+    """
+    has_z = geometry_has_z(geometry)
+    width = 3 if has_z else 2
+
+    def header(kind: str) -> bytes:
+        return struct.pack("<BI", 1, WKB_TYPE_CODES[kind] + (1000 if has_z else 0))
+
+    def points(coordinates: List[List[float]]) -> bytes:
+        values = []
+        for point in coordinates:
+            values.extend(float(v) for v in point[:width])
+            values.extend([0.0] * (width - len(point)))
+        return struct.pack(f"<I{len(values)}d", len(coordinates), *values)
+
+    def encode(kind: str, coordinates: Any) -> bytes:
+        if kind == "Point":
+            return header(kind) + points([coordinates])[4:]
+        if kind == "LineString":
+            return header(kind) + points(coordinates)
+        if kind == "Polygon":
+            return header(kind) + struct.pack("<I", len(coordinates)) + b"".join(points(r) for r in coordinates)
+        if kind in ("MultiPoint", "MultiLineString", "MultiPolygon"):
+            part = kind[len("Multi"):]
+            return header(kind) + struct.pack("<I", len(coordinates)) + b"".join(encode(part, c) for c in coordinates)
+        raise ValueError(f"Unsupported geometry type: {kind}")
+
+    return encode(geometry["type"], geometry["coordinates"])
+
+
+def encode_wkt(geometry: Dict[str, Any]) -> str:
+    """
+    A GeoJSON-style geometry as WKT ("POLYGON Z ((...))" when the
+    coordinates have three values).
+
+    Raises:
+        ValueError: If the geometry type is not supported
+    """
+    has_z = geometry_has_z(geometry)
+    width = 3 if has_z else 2
+
+    def point(coordinates: List[float]) -> str:
+        values = [float(v) for v in coordinates[:width]] + [0.0] * (width - len(coordinates))
+        return " ".join(f"{v:.15g}" for v in values)
+
+    def text(kind: str, coordinates: Any) -> str:
+        if kind == "Point":
+            return f"({point(coordinates)})"
+        if kind in ("LineString", "MultiPoint"):
+            return "(" + ", ".join(point(p) for p in coordinates) + ")"
+        if kind in ("Polygon", "MultiLineString"):
+            return "(" + ", ".join(text("LineString", line) for line in coordinates) + ")"
+        if kind == "MultiPolygon":
+            return "(" + ", ".join(text("Polygon", polygon) for polygon in coordinates) + ")"
+        raise ValueError(f"Unsupported geometry type: {kind}")
+
+    kind = geometry["type"]
+    body = text(kind, geometry["coordinates"])
+    return f"{kind.upper()}{' Z' if has_z else ''} {body}"
+
+
+def geometry_centroid(geometry: Optional[Dict[str, Any]]) -> Optional[Tuple[float, float]]:
+    """
+    The centroid of a geometry: area weighted for polygons (holes
+    subtracted), length weighted for lines, the mean of points; None when
+    it is empty.
+    """
+    if not geometry:
+        return None
+    kind, coordinates = geometry["type"], geometry["coordinates"]
+    polygons = [coordinates] if kind == "Polygon" else coordinates if kind == "MultiPolygon" else []
+    area = cx = cy = 0.0
+    for polygon in polygons:
+        for i, ring in enumerate(polygon):
+            ring_area = ring_x = ring_y = 0.0
+            for (x1, y1, *_), (x2, y2, *_) in zip(ring, ring[1:]):
+                cross = x1 * y2 - x2 * y1
+                ring_area += cross
+                ring_x += (x1 + x2) * cross
+                ring_y += (y1 + y2) * cross
+            if ring_area:
+                # Exteriors add and holes subtract, whichever way the rings wind
+                weight = (1 if i == 0 else -1) * abs(ring_area) / ring_area
+                area += weight * ring_area / 2
+                cx += weight * ring_x / 6
+                cy += weight * ring_y / 6
+    if area:
+        return cx / area, cy / area
+
+    lines = []
+    if kind in ("LineString",):
+        lines = [coordinates]
+    elif kind in ("MultiLineString", "Polygon"):
+        lines = coordinates
+    elif kind == "MultiPolygon":
+        lines = [ring for polygon in coordinates for ring in polygon]
+    length = cx = cy = 0.0
+    for line in lines:
+        for (x1, y1, *_), (x2, y2, *_) in zip(line, line[1:]):
+            segment = ((x2 - x1) ** 2 + (y2 - y1) ** 2) ** 0.5
+            length += segment
+            cx += (x1 + x2) / 2 * segment
+            cy += (y1 + y2) / 2 * segment
+    if length:
+        return cx / length, cy / length
+
+    points = list(iter_points(geometry))
+    if not points:
+        return None
+    return sum(p[0] for p in points) / len(points), sum(p[1] for p in points) / len(points)
+
+
+class FeatureSpool:
+    """
+    A temporary file of JSON values (features, or just their properties)
+    for writers that need a second pass over a layer. Decimals, dates and
+    timestamps come back as the types they went in as.
+    """
+
+    def __init__(self):
+        self.file = tempfile.TemporaryFile()
+
+    def append(self, value: Any) -> int:
+        """Add a value; returns its offset for read()."""
+        self.file.seek(0, 2)
+        offset = self.file.tell()
+        self.file.write(json.dumps(value, default=self._encode).encode("utf-8") + b"\n")
+        return offset
+
+    def read(self, offset: int) -> Any:
+        """The value added at an offset."""
+        self.file.seek(offset)
+        return json.loads(self.file.readline(), object_hook=self._decode)
+
+    def __iter__(self) -> Iterator[Any]:
+        self.file.seek(0)
+        for line in self.file:
+            yield json.loads(line, object_hook=self._decode)
+
+    def close(self) -> None:
+        self.file.close()
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        self.close()
+
+    @staticmethod
+    def _encode(value: Any) -> Any:
+        if isinstance(value, Decimal):
+            return {"$decimal": str(value)}
+        if isinstance(value, datetime):
+            return {"$datetime": value.isoformat()}
+        if isinstance(value, date):
+            return {"$date": value.isoformat()}
+        if isinstance(value, (bytes, bytearray, memoryview)):
+            return {"$bytes": bytes(value).hex()}
+        return str(value)
+
+    @staticmethod
+    def _decode(value: Dict[str, Any]) -> Any:
+        if len(value) == 1:
+            (key, text), = value.items()
+            if key == "$decimal":
+                return Decimal(text)
+            if key == "$datetime":
+                return datetime.fromisoformat(text)
+            if key == "$date":
+                return date.fromisoformat(text)
+            if key == "$bytes":
+                return bytes.fromhex(text)
+        return value
+
+
+class FeatureBuffer:
+    """
+    Features read ahead of their consumer on a thread of their own, at most
+    capacity at a time. Errors of the reading side are raised where the
+    features are consumed; a consumer that stops early stops the reading
+    and closes its connector.
+    """
+
+    def __init__(self, features: Iterable[Dict[str, Any]], capacity: int = EXPORT_BUFFER_FEATURES):
+        self.features = features
+        self.capacity = max(0, capacity)
+        self.chunk = max(1, min(BUFFER_CHUNK_FEATURES, self.capacity))
+        self.count = 0
+        self.peak = 0
+        self.reader_waits = 0
+        self._queue: "queue.Queue[Any]" = queue.Queue(maxsize=max(1, self.capacity // self.chunk))
+        self._stop = threading.Event()
+        self._lock = threading.Lock()
+        self._buffered = 0
+
+    def __iter__(self) -> Iterator[Dict[str, Any]]:
+        if not self.capacity:
+            for feature in self.features:
+                self.count += 1
+                yield feature
+            return
+        # The reading side keeps the log and trace context of the export
+        context = contextvars.copy_context()
+        thread = threading.Thread(target=context.run, args=(self._read,), name="export-buffer", daemon=True)
+        thread.start()
+        try:
+            while True:
+                chunk = self._queue.get()
+                if isinstance(chunk, BaseException):
+                    raise chunk
+                if chunk is None:
+                    return
+                with self._lock:
+                    self._buffered -= len(chunk)
+                for feature in chunk:
+                    self.count += 1
+                    yield feature
+        finally:
+            self._stop.set()
+            # Unblock a reader waiting for room, so it sees the stop
+            while not self._queue.empty():
+                self._queue.get_nowait()
+            thread.join(timeout=5)
+
+    def summary(self) -> Dict[str, Any]:
+        """How far reading ran ahead, for the export job."""
+        return {"features": self.count, "capacity": self.capacity, "peak_buffered": self.peak,
+                "reader_waits": self.reader_waits}
+
+    def _read(self) -> None:
+        features = iter(self.features)
+        try:
+            chunk = []
+            for feature in features:
+                chunk.append(feature)
+                if len(chunk) >= self.chunk:
+                    if not self._put(chunk):
+                        return
+                    chunk = []
+            if chunk and not self._put(chunk):
+                return
+            self._put(None)
+        except BaseException as e:
+            self._put(e)
+        finally:
+            if hasattr(features, "close"):
+                features.close()
+
+    def _put(self, item: Any) -> bool:
+        """Hand an item to the consumer, waiting while the buffer is full; False once it has stopped."""
+        if self._queue.full():
+            self.reader_waits += 1
+        while not self._stop.is_set():
+            try:
+                self._queue.put(item, timeout=0.5)
+            except queue.Full:
+                continue
+            if isinstance(item, list):
+                with self._lock:
+                    self._buffered += len(item)
+                    self.peak = max(self.peak, self._buffered)
+            return True
+        return False
+
+
+class LayerReader:
+    """Reads the features of export layers from the stores they live in."""
+
+    def __init__(self, registry=None):
+        """
+        Initialize the reader.
+
+        Args:
+            registry: Sync pair registry for layers read from sync pairs;
+                defaults to the sync_pair_registry singleton
+        """
+        self._registry = registry
+
+    @property
+    def registry(self):
+        if self._registry is None:
+            # Imported here: loading the registry reads every county configuration
+            from sync_pairs import sync_pair_registry
+            self._registry = sync_pair_registry
+        return self._registry
+
+    def read(self, layer: ExportLayer, bounds: Optional[Bounds] = None,
+             page_size: int = LAYER_PAGE_SIZE) -> Iterator[Dict[str, Any]]:
+        """
+        Yield the features of a layer, in primary key order.
+
+        Args:
+            layer: Layer to read
+            bounds: Only features whose bounding box meets this box (layers with geometry)
+            page_size: Rows per query
+
+        Raises:
+            KeyError: If the layer's sync pair or table is not configured
+            ConnectorError: If the table cannot be read
+            ValueError: If a feature's geometry cannot be decoded
+        """
+        connector_config, table_def = self._resolve(layer)
+        key_columns = table_def["primary_key"]
+        with create_connector(connector_config) as connector:
+            if isinstance(connector, SourceConnector):
+                pages = connector.read_table(table_def, page_size)
+            else:
+                pages = self._query_pages(layer, connector, table_def, page_size)
+            for rows in pages:
+                for row in rows:
+                    feature = self._feature(layer, key_columns, row)
+                    if bounds is not None and layer.geometry_field:
+                        feature_bounds = geometry_bounds(feature["geometry"])
+                        if feature_bounds is None or not bounds_intersect(bounds, feature_bounds):
+                            continue
+                    yield feature
+
+    def lookup(self, layer: ExportLayer, field: str, values: List[Any],
+               page_size: int = LAYER_PAGE_SIZE) -> Iterator[Dict[str, Any]]:
+        """
+        Yield the features of a layer whose field holds one of a list of values.
+
+        Target tables are queried with "in" conditions a chunk of values at a
+        time, so values compare as the database compares them; layers read
+        through a source connector are scanned once and filtered as they are
+        read, comparing values as the sync filters do.
+
+        Args:
+            layer: Layer to read
+            field: Record field to match (a column of the stored table)
+            values: Values to look up
+            page_size: Rows per query
+
+        Raises:
+            KeyError: If the layer's sync pair or table is not configured
+            ConnectorError: If the table cannot be read
+            ValueError: If a feature's geometry cannot be decoded
+        """
+        values = list(dict.fromkeys(values))
+        if not values:
+            return
+        connector_config, table_def = self._resolve(layer)
+        key_columns = table_def["primary_key"]
+        with create_connector(connector_config) as connector:
+            if isinstance(connector, SourceConnector):
+                for rows in connector.read_table(table_def, page_size):
+                    for row in rows:
+                        if any(_compare("=", row.get(field), value) for value in values):
+                            yield self._feature(layer, key_columns, row)
+                return
+            for start in range(0, len(values), LOOKUP_CHUNK_SIZE):
+                where = ("in", ("field", field), values[start:start + LOOKUP_CHUNK_SIZE])
+                for rows in self._query_pages(layer, connector, table_def, page_size, where):
+                    for row in rows:
+                        yield self._feature(layer, key_columns, row)
+
+    def table_def(self, layer: ExportLayer) -> Dict[str, Any]:
+        """
+        The table definition a layer is read through, in its roll year.
+
+        Raises:
+            KeyError: If the layer's sync pair or table is not configured
+            ValueError: If the layer's sync pair or table does not have its roll year
+        """
+        return self._resolve(layer)[1]
+
+    def _resolve(self, layer: ExportLayer) -> Tuple[Dict[str, Any], Dict[str, Any]]:
+        """The connector configuration and table definition a layer is read through."""
+        if layer.connector:
+            return layer.connector, {"name": layer.table, "target_table": layer.table, "primary_key": layer.primary_key}
+        # Imported here to keep this module free of the sync engine's imports
+        from sync_hooks import build_pipeline
+        pair = self.registry.get(layer.sync_pair_id)
+        table = pair.get_table(layer.table)
+        table_def = build_pipeline(pair.hooks, table.name).target_table(table.to_dict())
+        if layer.primary_key:
+            table_def["primary_key"] = layer.primary_key
+        if layer.roll_year is not None:
+            from roll_years import roll_years
+            table_def = roll_years.table_def(pair, table_def, layer.roll_year)
+        return pair.target, table_def
+
+    def _query_pages(self, layer: ExportLayer, connector, table_def: Dict[str, Any],
+                     page_size: int, condition: Optional[Tuple] = None) -> Iterator[List[Dict[str, Any]]]:
+        """Pages of a target table's rows (those meeting a condition, if given), read in key order with query_records."""
+        key_columns = table_def["primary_key"]
+        last_key = None
+        while True:
+            where = keyset_after(key_columns, last_key) if last_key is not None else None
+            if condition is not None:
+                where = condition if where is None else ("and", condition, where)
+            try:
+                rows = connector.query_records(table_def, where, None, [(c, False) for c in key_columns],
+                                               limit=page_size)
+            except NotImplementedError as e:
+                raise ConnectorError(f"Export layer {layer.name} cannot be read: {e}")
+            yield rows
+            if len(rows) < page_size:
+                return
+            last_key = [rows[-1].get(c) for c in key_columns]
+
+    @staticmethod
+    def _feature(layer: ExportLayer, key_columns: List[str], row: Dict[str, Any]) -> Dict[str, Any]:
+        properties = {k: v for k, v in row.items() if k not in RESERVED_FIELDS}
+        geometry, srid = None, None
+        if layer.geometry_field:
+            try:
+                geometry, srid = decode_geometry(properties.pop(layer.geometry_field, None))
+            except ValueError as e:
+                raise ValueError(f"Export layer {layer.name} feature {record_key(key_columns, row)}: {e}")
+        if layer.columns is not None:
+            properties = {c: properties.get(c) for c in layer.columns}
+        return {
+            "id": record_key(key_columns, row),
+            "properties": properties,
+            "geometry": geometry,
+            "srid": srid or layer.srid,
+        }
@@ -0,0 +1,483 @@
+"""
+TerraFusion Platform - FlatGeobuf Writer
+
+This module provides the writer GIS exports use to produce FlatGeobuf (.fgb)
+files: one layer of features with a packed Hilbert R-tree index ahead of
+them, so web clients (OpenLayers, Leaflet, the flatgeobuf JavaScript reader)
+can fetch just the features in view with HTTP range requests against the
+plain file, with no feature server in between.
+
+Features stream from the layer reader into a spool file while the layer's
+bounds and property schema are collected. The second pass sorts them along a
+Hilbert curve, builds the index and writes header, index and features in the
+order the index expects. Memory use is a few numbers per feature.
+
+FlatGeobuf's header and features are FlatBuffers (see the flatgeobuf schema
+files header.fbs and feature.fbs); FlatBufferWriter below encodes the handful
+of tables the format uses.
+"""
+
+import os
+import json
+import math
+import struct
+import tempfile
+import shutil
+import logging
+from array import array
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Iterable, Tuple
+
+from gis_features import ExportLayer, FeatureSpool, geometry_bounds, geometry_has_z, merge_bounds
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+FGB_MAGIC = b"fgb\x03fgb\x00"
+
+# Children per R-tree node
+FGB_INDEX_NODE_SIZE = 16
+
+# Index entry: min x, min y, max x, max y, offset
+FGB_NODE = struct.Struct("<4dQ")
+
+# Grid the Hilbert curve is computed on
+HILBERT_MAX = (1 << 16) - 1
+
+# FlatGeobuf GeometryType
+FGB_GEOMETRY_TYPES = {
+    None: 0,
+    "Point": 1,
+    "LineString": 2,
+    "Polygon": 3,
+    "MultiPoint": 4,
+    "MultiLineString": 5,
+    "MultiPolygon": 6,
+}
+
+# FlatGeobuf ColumnType
+FGB_BOOL = 2
+FGB_LONG = 7
+FGB_DOUBLE = 10
+FGB_STRING = 11
+FGB_JSON = 12
+FGB_DATETIME = 13
+FGB_BINARY = 14
+
+
+class FlatBufferWriter:
+    """
+    Encodes FlatBuffer tables front to back: each table's vtable comes just
+    before it and the strings, vectors and tables it refers to come after,
+    so every offset points forward as the format requires.
+
+    A table is a list of (slot, kind, value) with kind one of "bool",
+    "ubyte", "ushort", "int", "uint", "ulong", "double", "string",
+    "table", "tables" (vector of tables), "bytes" (vector of ubyte) or a
+    struct format character for vectors of scalars ("I", "Q", "d").
+    """
+
+    SCALARS = {"bool": "<?", "ubyte": "<B", "ushort": "<H", "int": "<i", "uint": "<I", "ulong": "<Q", "double": "<d"}
+
+    def __init__(self):
+        self.buffer = bytearray()
+
+    @classmethod
+    def encode(cls, table: List[Tuple[int, str, Any]]) -> bytes:
+        """A root table as a FlatBuffer."""
+        writer = cls()
+        writer.buffer += b"\0\0\0\0"
+        root = writer._table(table)
+        struct.pack_into("<I", writer.buffer, 0, root)
+        return bytes(writer.buffer)
+
+    def _pad(self, alignment: int, extra: int = 0) -> None:
+        while (len(self.buffer) + extra) % alignment:
+            self.buffer.append(0)
+
+    def _table(self, fields: List[Tuple[int, str, Any]]) -> int:
+        fields = [f for f in fields if f[2] is not None]
+        # Inline layout: the vtable offset, then fields from widest to narrowest
+        layout, cursor = {}, 4
+        for slot, kind, value in sorted(fields, key=lambda f: -self._inline_size(f[1])):
+            size = self._inline_size(kind)
+            cursor += -cursor % size
+            layout[slot] = cursor
+            cursor += size
+        table_size = cursor + (-cursor % 4)
+        slots = max((f[0] for f in fields), default=-1) + 1
+        vtable = struct.pack(f"<HH{slots}H", 4 + 2 * slots, table_size, *[layout.get(i, 0) for i in range(slots)])
+
+        self._pad(8, len(vtable))
+        vtable_position = len(self.buffer)
+        self.buffer += vtable
+        table_position = len(self.buffer)
+        self.buffer += bytes(table_size)
+        struct.pack_into("<i", self.buffer, table_position, table_position - vtable_position)
+
+        children = []
+        for slot, kind, value in fields:
+            position = table_position + layout[slot]
+            if kind in self.SCALARS:
+                struct.pack_into(self.SCALARS[kind], self.buffer, position, value)
+            else:
+                children.append((position, kind, value))
+        for position, kind, value in children:
+            target = self._child(kind, value)
+            struct.pack_into("<I", self.buffer, position, target - position)
+        return table_position
+
+    def _child(self, kind: str, value: Any) -> int:
+        if kind == "string":
+            data = value.encode("utf-8")
+            self._pad(4)
+            position = len(self.buffer)
+            self.buffer += struct.pack("<I", len(data)) + data + b"\0"
+            return position
+        if kind == "table":
+            return self._table(value)
+        if kind == "tables":
+            self._pad(4)
+            position = len(self.buffer)
+            self.buffer += struct.pack("<I", len(value)) + bytes(4 * len(value))
+            for i, table in enumerate(value):
+                slot_position = position + 4 + 4 * i
+                struct.pack_into("<I", self.buffer, slot_position, self._table(table) - slot_position)
+            return position
+        if kind == "bytes":
+            self._pad(4)
+            position = len(self.buffer)
+            self.buffer += struct.pack("<I", len(value)) + bytes(value)
+            return position
+        size = struct.calcsize(kind)
+        # The elements (after the 4-byte length) must be aligned to their size
+        self._pad(max(size, 4), 4)
+        position = len(self.buffer)
+        self.buffer += struct.pack(f"<I{len(value)}{kind}", len(value), *value)
+        return position
+
+    def _inline_size(self, kind: str) -> int:
+        return struct.calcsize(self.SCALARS[kind]) if kind in self.SCALARS else 4
+
+
+def hilbert(x: int, y: int) -> int:
+    """Position of a grid cell along a 16-bit Hilbert curve."""
+    a = x ^ y
+    b = 0xFFFF ^ a
+    c = 0xFFFF ^ (x | y)
+    d = x & (y ^ 0xFFFF)
+    A = a | (b >> 1)
+    B = (a >> 1) ^ a
+    C = ((c >> 1) ^ (b & (d >> 1))) ^ c
+    D = ((a & (c >> 1)) ^ (d >> 1)) ^ d
+
+    a, b, c, d = A, B, C, D
+    A = (a & (a >> 2)) ^ (b & (b >> 2))
+    B = (a & (b >> 2)) ^ (b & ((a ^ b) >> 2))
+    C ^= (a & (c >> 2)) ^ (b & (d >> 2))
+    D ^= (b & (c >> 2)) ^ ((a ^ b) & (d >> 2))
+
+    a, b, c, d = A, B, C, D
+    A = (a & (a >> 4)) ^ (b & (b >> 4))
+    B = (a & (b >> 4)) ^ (b & ((a ^ b) >> 4))
+    C ^= (a & (c >> 4)) ^ (b & (d >> 4))
+    D ^= (b & (c >> 4)) ^ ((a ^ b) & (d >> 4))
+
+    a, b, c, d = A, B, C, D
+    C ^= (a & (c >> 8)) ^ (b & (d >> 8))
+    D ^= (b & (c >> 8)) ^ ((a ^ b) & (d >> 8))
+
+    a = C ^ (C >> 1)
+    b = D ^ (D >> 1)
+    i0 = x ^ y
+    i1 = b | (0xFFFF ^ (i0 | a))
+
+    def spread(v: int) -> int:
+        v = (v | (v << 8)) & 0x00FF00FF
+        v = (v | (v << 4)) & 0x0F0F0F0F
+        v = (v | (v << 2)) & 0x33333333
+        return (v | (v << 1)) & 0x55555555
+
+    return (spread(i1) << 1) | spread(i0)
+
+
+def hilbert_order(boxes: array, extent: Tuple[float, float, float, float]) -> List[int]:
+    """
+    Feature numbers sorted by the Hilbert value of their box centers.
+
+    Args:
+        boxes: Min x, min y, max x, max y of each feature in turn (NaN for no geometry)
+        extent: Bounds the curve is laid over
+    """
+    minx, miny, maxx, maxy = extent
+    width = (maxx - minx) or 1.0
+    height = (maxy - miny) or 1.0
+
+    def key(i: int) -> int:
+        x0, y0, x1, y1 = boxes[4 * i:4 * i + 4]
+        if math.isnan(x0):
+            return 0
+        x = int(HILBERT_MAX * ((x0 + x1) / 2 - minx) / width)
+        y = int(HILBERT_MAX * ((y0 + y1) / 2 - miny) / height)
+        return hilbert(x, y)
+
+    return sorted(range(len(boxes) // 4), key=key)
+
+
+def index_level_bounds(count: int, node_size: int) -> List[Tuple[int, int]]:
+    """(first, end) node positions of each R-tree level, leaves first; the root is node 0."""
+    level_sizes = [count]
+    n = count
+    while n != 1:
+        n = math.ceil(n / node_size)
+        level_sizes.append(n)
+    bounds, end = [], sum(level_sizes)
+    for size in level_sizes:
+        bounds.append((end - size, end))
+        end -= size
+    return bounds
+
+
+def fgb_column_type(value: Any) -> int:
+    """The FlatGeobuf column type of a property value."""
+    if isinstance(value, bool):
+        return FGB_BOOL
+    if isinstance(value, int):
+        return FGB_LONG
+    if isinstance(value, (float, Decimal)):
+        return FGB_DOUBLE
+    if isinstance(value, (date, datetime)):
+        return FGB_DATETIME
+    if isinstance(value, (dict, list)):
+        return FGB_JSON
+    if isinstance(value, (bytes, bytearray)):
+        return FGB_BINARY
+    return FGB_STRING
+
+
+def fgb_merge_column_type(current: Optional[int], value: Any) -> Optional[int]:
+    """A column's type once it has also held a value (integers widen to doubles, other mixes to strings)."""
+    if value is None:
+        return current
+    kind = fgb_column_type(value)
+    if current is None or current == kind:
+        return kind
+    if {current, kind} == {FGB_LONG, FGB_DOUBLE}:
+        return FGB_DOUBLE
+    return FGB_STRING
+
+
+def fgb_property(column_type: int, value: Any) -> bytes:
+    """A property value encoded for its column."""
+    if column_type == FGB_BOOL:
+        return struct.pack("<?", bool(value))
+    if column_type == FGB_LONG:
+        return struct.pack("<q", int(value))
+    if column_type == FGB_DOUBLE:
+        return struct.pack("<d", float(value))
+    if column_type == FGB_BINARY:
+        data = bytes(value)
+    elif column_type == FGB_JSON:
+        data = json.dumps(value, default=str).encode("utf-8")
+    elif isinstance(value, (date, datetime)):
+        data = value.isoformat().encode("utf-8")
+    elif isinstance(value, (dict, list)):
+        data = json.dumps(value, default=str).encode("utf-8")
+    elif isinstance(value, (bytes, bytearray)):
+        data = bytes(value).hex().encode("utf-8")
+    else:
+        data = str(value).encode("utf-8")
+    return struct.pack("<I", len(data)) + data
+
+
+def fgb_geometry(geometry: Dict[str, Any], has_z: bool) -> List[Tuple[int, str, Any]]:
+    """A GeoJSON-style geometry as a FlatGeobuf Geometry table."""
+    kind, coordinates = geometry["type"], geometry["coordinates"]
+    if kind == "MultiPolygon":
+        parts = [fgb_geometry({"type": "Polygon", "coordinates": polygon}, has_z) for polygon in coordinates]
+        return [(6, "ubyte", FGB_GEOMETRY_TYPES[kind]), (7, "tables", parts)]
+
+    if kind == "Point":
+        lines = [[coordinates]]
+    elif kind in ("LineString", "MultiPoint"):
+        lines = [coordinates]
+    else:
+        # Polygon rings or MultiLineString lines
+        lines = coordinates
+    points = [point for line in lines for point in line]
+    ends = None
+    if len(lines) > 1:
+        ends, total = [], 0
+        for line in lines:
+            total += len(line)
+            ends.append(total)
+    table = [
+        (0, "I", ends),
+        (1, "d", [float(v) for point in points for v in point[:2]]),
+        (6, "ubyte", FGB_GEOMETRY_TYPES[kind]),
+    ]
+    if has_z:
+        table.append((2, "d", [float(point[2]) if len(point) > 2 else 0.0 for point in points]))
+    return table
+
+
+class FlatGeobufWriter:
+    """Writes one feature layer as a FlatGeobuf file."""
+
+    def __init__(self, path: str):
+        """
+        Initialize the writer.
+
+        Args:
+            path: File to create
+        """
+        self.path = path
+
+    def write_layer(self, layer: ExportLayer, features: Iterable[Dict[str, Any]]) -> Dict[str, Any]:
+        """
+        Write a layer, with its spatial index.
+
+        Args:
+            layer: Layer being written
+            features: Features of the layer (see gis_features)
+
+        Returns:
+            Summary: features, geometry_type, srid, bounds, columns and index_nodes
+        """
+        # First pass: spool the features, collecting bounds and the property schema
+        spool = FeatureSpool()
+        offsets = array("Q")
+        boxes = array("d")
+        columns: Dict[str, Optional[int]] = {}
+        geometry_types = set()
+        has_z = False
+        srid = layer.srid
+        bounds = None
+        try:
+            for feature in features:
+                geometry = feature.get("geometry")
+                feature_bounds = geometry_bounds(geometry)
+                if geometry:
+                    geometry_types.add(geometry["type"])
+                    has_z = has_z or geometry_has_z(geometry)
+                    if srid is None:
+                        srid = feature.get("srid")
+                    bounds = merge_bounds(bounds, feature_bounds)
+                for name, value in feature["properties"].items():
+                    columns[name] = fgb_merge_column_type(columns.get(name), value)
+                offsets.append(spool.append({"geometry": geometry, "properties": feature["properties"]}))
+                boxes.extend(feature_bounds or (math.nan,) * 4)
+
+            count = len(offsets)
+            column_types = [(name, kind if kind is not None else FGB_STRING) for name, kind in columns.items()]
+            column_index = {name: i for i, (name, _) in enumerate(column_types)}
+            # Readers decode every feature by the header's type unless it is Unknown
+            if layer.geometry_type and geometry_types <= {layer.geometry_type}:
+                geometry_type = layer.geometry_type
+            else:
+                geometry_type = next(iter(geometry_types)) if len(geometry_types) == 1 else None
+            extent = bounds or (0.0, 0.0, 0.0, 0.0)
+
+            # Second pass: encode the features along the Hilbert curve into a work file
+            order = hilbert_order(boxes, extent)
+            feature_dir = tempfile.mkdtemp(prefix="tf_fgb_")
+            try:
+                features_path = os.path.join(feature_dir, "features")
+                leaves = []
+                with open(features_path, "wb") as out:
+                    for i in order:
+                        record = spool.read(offsets[i])
+                        data = self._feature(record, column_types, column_index, geometry_type, has_z)
+                        box = tuple(boxes[4 * i:4 * i + 4])
+                        if math.isnan(box[0]):
+                            # No geometry: an empty box at the layer's corner keeps the index complete
+                            box = (extent[0], extent[1], extent[0], extent[1])
+                        leaves.append((box, out.tell()))
+                        out.write(struct.pack("<I", len(data)) + data)
+
+                header = self._header(layer, count, geometry_type, has_z, bounds, column_types, srid)
+                with open(self.path, "wb") as f:
+                    f.write(FGB_MAGIC)
+                    f.write(struct.pack("<I", len(header)) + header)
+                    node_count = self._write_index(f, leaves)
+                    with open(features_path, "rb") as written:
+                        shutil.copyfileobj(written, f)
+            finally:
+                shutil.rmtree(feature_dir, ignore_errors=True)
+        finally:
+            spool.close()
+
+        logger.info(f"Wrote {count} features of layer {layer.name} to FlatGeobuf with a {node_count}-node index")
+        type_names = {FGB_BOOL: "bool", FGB_LONG: "long", FGB_DOUBLE: "double", FGB_STRING: "string",
+                      FGB_JSON: "json", FGB_DATETIME: "datetime", FGB_BINARY: "binary"}
+        return {
+            "features": count,
+            "geometry_type": geometry_type,
+            "srid": srid,
+            "bounds": list(bounds) if bounds else None,
+            "columns": {name: type_names[kind] for name, kind in column_types},
+            "index_nodes": node_count,
+        }
+
+    @staticmethod
+    def _write_index(f, leaves: List[Tuple[Tuple[float, float, float, float], int]]) -> int:
+        """Write the packed R-tree over the leaves (in file order); returns its node count."""
+        if not leaves:
+            return 0
+        levels = index_level_bounds(len(leaves), FGB_INDEX_NODE_SIZE)
+        nodes: List[Optional[Tuple[float, float, float, float, int]]] = [None] * levels[0][1]
+        first_leaf = levels[0][0]
+        for i, (box, offset) in enumerate(leaves):
+            nodes[first_leaf + i] = (*box, offset)
+        for level in range(len(levels) - 1):
+            position, end = levels[level]
+            parent = levels[level + 1][0]
+            while position < end:
+                first = position
+                children = nodes[position:min(position + FGB_INDEX_NODE_SIZE, end)]
+                position += len(children)
+                nodes[parent] = (
+                    min(c[0] for c in children), min(c[1] for c in children),
+                    max(c[2] for c in children), max(c[3] for c in children),
+                    first,
+                )
+                parent += 1
+        for node in nodes:
+            f.write(FGB_NODE.pack(*node))
+        return len(nodes)
+
+    @staticmethod
+    def _header(layer: ExportLayer, count: int, geometry_type: Optional[str], has_z: bool,
+                bounds, column_types: List[Tuple[str, int]], srid: Optional[int]) -> bytes:
+        table = [
+            (0, "string", layer.name),
+            (1, "d", list(bounds) if bounds else None),
+            (2, "ubyte", FGB_GEOMETRY_TYPES[geometry_type]),
+            (3, "bool", has_z),
+            (7, "tables", [[(0, "string", name), (1, "ubyte", kind)] for name, kind in column_types] or None),
+            (8, "ulong", count),
+            (9, "ushort", FGB_INDEX_NODE_SIZE if count else 0),
+            (11, "string", layer.title),
+            (12, "string", layer.description or None),
+        ]
+        if srid is not None:
+            table.append((10, "table", [(0, "string", "EPSG"), (1, "int", int(srid))]))
+        return FlatBufferWriter.encode(table)
+
+    @staticmethod
+    def _feature(record: Dict[str, Any], column_types: List[Tuple[str, int]], column_index: Dict[str, int],
+                 geometry_type: Optional[str], has_z: bool) -> bytes:
+        properties = bytearray()
+        for name, value in record["properties"].items():
+            if value is None or (isinstance(value, float) and value != value):
+                continue
+            i = column_index[name]
+            properties += struct.pack("<H", i) + fgb_property(column_types[i][1], value)
+        geometry = record["geometry"]
+        table = [
+            (0, "table", fgb_geometry(geometry, has_z) if geometry else None),
+            (1, "bytes", properties or None),
+        ]
+        return FlatBufferWriter.encode(table)
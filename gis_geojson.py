@@ -0,0 +1,116 @@
+"""
+TerraFusion Platform - GeoJSON Writer
+
+This module provides the writer GIS exports use to produce GeoJSON
+(RFC 7946): one FeatureCollection in WGS 84 holding every requested layer,
+each feature naming its layer in a "layer" member beside its properties.
+
+Features are written as they stream in, one line each, so a county-wide
+export takes the same memory as a single parcel: nothing is held but the
+layer's running bounds and counts. What is only known at the end (each
+layer's feature count, geometry types and bounds, and the collection's
+bbox) follows the features in a "layers" member and "bbox".
+
+Values GeoJSON has no type for are written as their nearest JSON value:
+decimals as numbers, dates and timestamps in ISO 8601, binary as hex.
+"""
+
+import json
+import logging
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Iterable
+
+from gis_features import ExportLayer, Bounds, geometry_bounds, merge_bounds
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+
+def geojson_value(value: Any) -> Any:
+    """A property value JSON cannot encode, as the JSON value it is written as."""
+    if isinstance(value, Decimal):
+        return int(value) if value == value.to_integral_value() else float(value)
+    if isinstance(value, (date, datetime)):
+        return value.isoformat()
+    if isinstance(value, (bytes, bytearray, memoryview)):
+        return bytes(value).hex()
+    return str(value)
+
+
+class GeoJsonWriter:
+    """Writes feature layers into one GeoJSON FeatureCollection file."""
+
+    def __init__(self, path: str, name: str, metadata: Optional[Dict[str, Any]] = None):
+        """
+        Open the file and write the start of the collection.
+
+        Args:
+            path: File to create
+            name: Name of the collection
+            metadata: Written as the collection's "metadata" member, ahead of the features
+        """
+        self.path = path
+        self._file = open(path, "w", encoding="utf-8")
+        self._layers: List[Dict[str, Any]] = []
+        self._bounds: Optional[Bounds] = None
+        self._count = 0
+        head = {"type": "FeatureCollection", "name": name}
+        if metadata is not None:
+            head["metadata"] = metadata
+        self._file.write(json.dumps(head, default=geojson_value)[:-1] + ', "features": [\n')
+
+    def add_layer(self, layer: ExportLayer, features: Iterable[Dict[str, Any]]) -> Dict[str, Any]:
+        """
+        Write the features of a layer.
+
+        Args:
+            layer: Layer being written, in WGS 84
+            features: Features of the layer (see gis_features)
+
+        Returns:
+            Summary: features, geometry_types and bounds
+        """
+        count = 0
+        bounds = None
+        geometry_types: Dict[str, int] = {}
+        for feature in features:
+            geometry = feature.get("geometry")
+            if geometry:
+                geometry_types[geometry["type"]] = geometry_types.get(geometry["type"], 0) + 1
+                bounds = merge_bounds(bounds, geometry_bounds(geometry))
+            record = {
+                "type": "Feature",
+                "id": feature["id"],
+                "layer": layer.name,
+                "properties": feature["properties"],
+                "geometry": {"type": geometry["type"], "coordinates": geometry["coordinates"]} if geometry else None,
+            }
+            self._file.write((",\n" if self._count else "") + json.dumps(record, default=geojson_value))
+            self._count += 1
+            count += 1
+        self._bounds = merge_bounds(self._bounds, bounds)
+        result = {"features": count, "geometry_types": geometry_types, "bounds": list(bounds) if bounds else None}
+        self._layers.append(dict(result, name=layer.name, title=layer.title))
+        logger.info(f"Wrote {count} features of layer {layer.name} to GeoJSON")
+        return result
+
+    def close(self) -> None:
+        """Write the end of the collection and close the file."""
+        if self._file.closed:
+            return
+        tail = {"layers": self._layers}
+        if self._bounds is not None:
+            tail["bbox"] = list(self._bounds)
+        self._file.write("\n], " + json.dumps(tail)[1:] + "\n")
+        self._file.close()
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        if exc_type is None:
+            self.close()
+        else:
+            self._file.close()
@@ -0,0 +1,384 @@
+"""
+TerraFusion Platform - GeoPackage Writer
+
+This module provides the writer GIS exports use to produce OGC GeoPackage
+(.gpkg) files: one SQLite database holding any number of feature layers
+(parcels, situs points, districts...) plus the tables the specification
+requires (gpkg_spatial_ref_sys, gpkg_contents, gpkg_geometry_columns).
+
+Every layer with geometry gets an R-tree spatial index (the gpkg_rtree_index
+extension) so desktop GIS clients can pan large layers without a full scan.
+The index is filled while features are written and its maintenance triggers
+are added when the layer is finished, as the specification describes.
+"""
+
+import re
+import json
+import struct
+import sqlite3
+import logging
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Iterable, Tuple
+
+from gis_features import ExportLayer, Bounds, encode_wkb, geometry_bounds, geometry_has_z, merge_bounds
+
+try:
+    from pyproj import CRS
+    PYPROJ_AVAILABLE = True
+except ImportError:
+    PYPROJ_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# "GPKG" in the SQLite header, and GeoPackage 1.3
+GPKG_APPLICATION_ID = 0x47504B47
+GPKG_USER_VERSION = 10300
+
+# Features written per transaction
+GPKG_BATCH_SIZE = 1000
+
+# Name of the geometry column of every feature table
+GPKG_GEOMETRY_COLUMN = "geom"
+
+WGS84_WKT = (
+    'GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,'
+    'AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,'
+    'AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],'
+    'AUTHORITY["EPSG","4326"]]'
+)
+
+GPKG_SCHEMA = [
+    """CREATE TABLE gpkg_spatial_ref_sys (
+        srs_name TEXT NOT NULL,
+        srs_id INTEGER PRIMARY KEY,
+        organization TEXT NOT NULL,
+        organization_coordsys_id INTEGER NOT NULL,
+        definition TEXT NOT NULL,
+        description TEXT
+    )""",
+    """CREATE TABLE gpkg_contents (
+        table_name TEXT NOT NULL PRIMARY KEY,
+        data_type TEXT NOT NULL,
+        identifier TEXT UNIQUE,
+        description TEXT DEFAULT '',
+        last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+        min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE,
+        srs_id INTEGER,
+        CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id)
+    )""",
+    """CREATE TABLE gpkg_geometry_columns (
+        table_name TEXT NOT NULL,
+        column_name TEXT NOT NULL,
+        geometry_type_name TEXT NOT NULL,
+        srs_id INTEGER NOT NULL,
+        z TINYINT NOT NULL,
+        m TINYINT NOT NULL,
+        CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name),
+        CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+        CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id)
+    )""",
+    """CREATE TABLE gpkg_extensions (
+        table_name TEXT,
+        column_name TEXT,
+        extension_name TEXT NOT NULL,
+        definition TEXT NOT NULL,
+        scope TEXT NOT NULL,
+        CONSTRAINT ge_tce UNIQUE (table_name, column_name, extension_name)
+    )""",
+]
+
+# Rows gpkg_spatial_ref_sys must always hold
+GPKG_REQUIRED_SRS = [
+    ("WGS 84 geodetic", 4326, "EPSG", 4326, WGS84_WKT, "longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid"),
+    ("Undefined cartesian SRS", -1, "NONE", -1, "undefined", "undefined cartesian coordinate reference system"),
+    ("Undefined geographic SRS", 0, "NONE", 0, "undefined", "undefined geographic coordinate reference system"),
+]
+
+RTREE_TRIGGERS = [
+    """CREATE TRIGGER "rtree_{t}_{c}_insert" AFTER INSERT ON "{t}"
+    WHEN (new."{c}" NOT NULL AND NOT ST_IsEmpty(NEW."{c}"))
+    BEGIN
+      INSERT OR REPLACE INTO "rtree_{t}_{c}" VALUES (
+        NEW."{i}", ST_MinX(NEW."{c}"), ST_MaxX(NEW."{c}"), ST_MinY(NEW."{c}"), ST_MaxY(NEW."{c}"));
+    END""",
+    """CREATE TRIGGER "rtree_{t}_{c}_update1" AFTER UPDATE OF "{c}" ON "{t}"
+    WHEN OLD."{i}" = NEW."{i}" AND (NEW."{c}" NOTNULL AND NOT ST_IsEmpty(NEW."{c}"))
+    BEGIN
+      INSERT OR REPLACE INTO "rtree_{t}_{c}" VALUES (
+        NEW."{i}", ST_MinX(NEW."{c}"), ST_MaxX(NEW."{c}"), ST_MinY(NEW."{c}"), ST_MaxY(NEW."{c}"));
+    END""",
+    """CREATE TRIGGER "rtree_{t}_{c}_update2" AFTER UPDATE OF "{c}" ON "{t}"
+    WHEN OLD."{i}" = NEW."{i}" AND (NEW."{c}" ISNULL OR ST_IsEmpty(NEW."{c}"))
+    BEGIN
+      DELETE FROM "rtree_{t}_{c}" WHERE id = OLD."{i}";
+    END""",
+    """CREATE TRIGGER "rtree_{t}_{c}_update3" AFTER UPDATE ON "{t}"
+    WHEN OLD."{i}" != NEW."{i}" AND (NEW."{c}" NOTNULL AND NOT ST_IsEmpty(NEW."{c}"))
+    BEGIN
+      DELETE FROM "rtree_{t}_{c}" WHERE id = OLD."{i}";
+      INSERT OR REPLACE INTO "rtree_{t}_{c}" VALUES (
+        NEW."{i}", ST_MinX(NEW."{c}"), ST_MaxX(NEW."{c}"), ST_MinY(NEW."{c}"), ST_MaxY(NEW."{c}"));
+    END""",
+    """CREATE TRIGGER "rtree_{t}_{c}_update4" AFTER UPDATE ON "{t}"
+    WHEN OLD."{i}" != NEW."{i}" AND (NEW."{c}" ISNULL OR ST_IsEmpty(NEW."{c}"))
+    BEGIN
+      DELETE FROM "rtree_{t}_{c}" WHERE id IN (OLD."{i}", NEW."{i}");
+    END""",
+    """CREATE TRIGGER "rtree_{t}_{c}_delete" AFTER DELETE ON "{t}"
+    WHEN old."{c}" NOT NULL
+    BEGIN
+      DELETE FROM "rtree_{t}_{c}" WHERE id = OLD."{i}";
+    END""",
+]
+
+
+def gpkg_table_name(name: str) -> str:
+    """A layer name as a GeoPackage table name (lower case letters, digits and underscores)."""
+    table = re.sub(r"[^a-z0-9_]+", "_", name.lower()).strip("_") or "layer"
+    return table if table[0].isalpha() else f"layer_{table}"
+
+
+def gpkg_geometry(geometry: Dict[str, Any], srs_id: int) -> Tuple[bytes, Optional[Bounds]]:
+    """
+    A geometry as a GeoPackage geometry blob (header with an XY envelope,
+    then little-endian WKB) and its bounds.
+    """
+    bounds = geometry_bounds(geometry)
+    if bounds is None:
+        # Empty geometry: flag bit 4, no envelope
+        return b"GP" + struct.pack("<BBi", 0, 0x11, srs_id) + encode_wkb(geometry), None
+    minx, miny, maxx, maxy = bounds
+    header = b"GP" + struct.pack("<BBi4d", 0, 0x03, srs_id, minx, maxx, miny, maxy)
+    return header + encode_wkb(geometry), bounds
+
+
+def gpkg_value(value: Any) -> Any:
+    """A property value as SQLite stores it in a GeoPackage."""
+    if isinstance(value, bool):
+        return int(value)
+    if isinstance(value, Decimal):
+        return float(value)
+    if isinstance(value, datetime):
+        return value.strftime("%Y-%m-%dT%H:%M:%S.%f")[:-3] + "Z"
+    if isinstance(value, date):
+        return value.isoformat()
+    if isinstance(value, (dict, list)):
+        return json.dumps(value, default=str)
+    if isinstance(value, (bytearray, memoryview)):
+        return bytes(value)
+    return value
+
+
+def gpkg_column_type(value: Any) -> str:
+    """The GeoPackage column type for a property value."""
+    if isinstance(value, bool):
+        return "BOOLEAN"
+    if isinstance(value, int):
+        return "INTEGER"
+    if isinstance(value, (float, Decimal)):
+        return "REAL"
+    if isinstance(value, datetime):
+        return "DATETIME"
+    if isinstance(value, date):
+        return "DATE"
+    if isinstance(value, (bytes, bytearray, memoryview)):
+        return "BLOB"
+    return "TEXT"
+
+
+class GeoPackageWriter:
+    """Writes feature layers into a new GeoPackage file."""
+
+    def __init__(self, path: str):
+        """
+        Create the GeoPackage.
+
+        Args:
+            path: File to create (an existing file is replaced)
+        """
+        self.path = path
+        self.connection = sqlite3.connect(path)
+        self.connection.execute(f"PRAGMA application_id = {GPKG_APPLICATION_ID}")
+        self.connection.execute(f"PRAGMA user_version = {GPKG_USER_VERSION}")
+        for statement in GPKG_SCHEMA:
+            self.connection.execute(statement)
+        self.connection.executemany("INSERT INTO gpkg_spatial_ref_sys VALUES (?, ?, ?, ?, ?, ?)", GPKG_REQUIRED_SRS)
+        self.connection.commit()
+        self._srs_ids = {row[1] for row in GPKG_REQUIRED_SRS}
+        self._tables: Dict[str, str] = {}
+
+    def add_layer(self, layer: ExportLayer, features: Iterable[Dict[str, Any]]) -> Dict[str, Any]:
+        """
+        Write a layer as a feature table (or an attributes table when it has no geometry).
+
+        Args:
+            layer: Layer being written
+            features: Features of the layer (see gis_features)
+
+        Returns:
+            Summary of the written table: table, features, geometry_type,
+            srs_id, bounds and spatial_index
+        """
+        table = gpkg_table_name(layer.name)
+        if table in self._tables.values():
+            table = f"{table}_{len(self._tables) + 1}"
+        self._tables[layer.name] = table
+
+        has_geometry = bool(layer.geometry_field)
+        columns: Dict[str, str] = {}
+        renamed: Dict[str, str] = {}
+        geometry_types = set()
+        has_z = False
+        srs_id = layer.srid
+        bounds = None
+        count = 0
+
+        self.connection.execute(
+            f'CREATE TABLE "{table}" (fid INTEGER PRIMARY KEY AUTOINCREMENT'
+            + (f', "{GPKG_GEOMETRY_COLUMN}" GEOMETRY' if has_geometry else "") + ")"
+        )
+        spatial_index = has_geometry and self._create_rtree(table)
+
+        batch = []
+        for feature in features:
+            properties = feature["properties"]
+            for name, value in properties.items():
+                if name not in renamed:
+                    renamed[name] = self._column_name(name, renamed)
+                column = renamed[name]
+                if column not in columns and value is not None:
+                    columns[column] = gpkg_column_type(value)
+                    self.connection.execute(f'ALTER TABLE "{table}" ADD COLUMN "{column}" {columns[column]}')
+
+            blob = None
+            geometry = feature.get("geometry")
+            if has_geometry and geometry:
+                if srs_id is None:
+                    srs_id = feature.get("srid") or 4326
+                blob, feature_bounds = gpkg_geometry(geometry, srs_id)
+                geometry_types.add(geometry["type"])
+                has_z = has_z or geometry_has_z(geometry)
+                bounds = merge_bounds(bounds, feature_bounds)
+            else:
+                feature_bounds = None
+
+            values = {renamed[n]: gpkg_value(v) for n, v in properties.items() if renamed[n] in columns}
+            batch.append((blob, values, feature_bounds))
+            count += 1
+            if len(batch) >= GPKG_BATCH_SIZE:
+                self._insert(table, has_geometry, spatial_index, batch)
+                batch = []
+        self._insert(table, has_geometry, spatial_index, batch)
+        for column in renamed.values():
+            if column not in columns:
+                # Only ever null: keep the column so the table has the layer's full schema
+                columns[column] = "TEXT"
+                self.connection.execute(f'ALTER TABLE "{table}" ADD COLUMN "{column}" TEXT')
+
+        srs_id = self._register_srs(srs_id if srs_id is not None else (4326 if has_geometry else None))
+        data_type = "features" if has_geometry else "attributes"
+        self.connection.execute(
+            "INSERT INTO gpkg_contents (table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id)"
+            " VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+            (table, data_type, layer.title, layer.description, *(bounds or (None, None, None, None)), srs_id),
+        )
+        geometry_type = None
+        if has_geometry:
+            geometry_type = layer.geometry_type or (next(iter(geometry_types)) if len(geometry_types) == 1 else "GEOMETRY")
+            self.connection.execute(
+                "INSERT INTO gpkg_geometry_columns VALUES (?, ?, ?, ?, ?, 0)",
+                (table, GPKG_GEOMETRY_COLUMN, geometry_type.upper(), srs_id, 1 if has_z else 0),
+            )
+        if spatial_index:
+            self.connection.execute(
+                "INSERT INTO gpkg_extensions VALUES (?, ?, 'gpkg_rtree_index', 'http://www.geopackage.org/spec120/#extension_rtree', 'write-only')",
+                (table, GPKG_GEOMETRY_COLUMN),
+            )
+            for trigger in RTREE_TRIGGERS:
+                self.connection.execute(trigger.format(t=table, c=GPKG_GEOMETRY_COLUMN, i="fid"))
+        self.connection.commit()
+
+        logger.info(f"Wrote {count} features of layer {layer.name} to GeoPackage table {table}")
+        return {
+            "table": table,
+            "features": count,
+            "geometry_type": geometry_type,
+            "srs_id": srs_id,
+            "bounds": list(bounds) if bounds else None,
+            "spatial_index": spatial_index,
+        }
+
+    def close(self) -> None:
+        self.connection.commit()
+        self.connection.close()
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        self.close()
+
+    def _insert(self, table: str, has_geometry: bool, spatial_index: bool,
+                batch: List[Tuple[Optional[bytes], Dict[str, Any], Optional[Bounds]]]) -> None:
+        """Insert a batch of features, with their spatial index entries."""
+        for blob, values, feature_bounds in batch:
+            names = ([GPKG_GEOMETRY_COLUMN] if has_geometry else []) + list(values)
+            params = ([blob] if has_geometry else []) + list(values.values())
+            if names:
+                quoted = ", ".join(f'"{n}"' for n in names)
+                cursor = self.connection.execute(
+                    f'INSERT INTO "{table}" ({quoted}) VALUES ({", ".join("?" * len(names))})', params
+                )
+            else:
+                cursor = self.connection.execute(f'INSERT INTO "{table}" DEFAULT VALUES')
+            if spatial_index and feature_bounds is not None:
+                minx, miny, maxx, maxy = feature_bounds
+                self.connection.execute(
+                    f'INSERT INTO "rtree_{table}_{GPKG_GEOMETRY_COLUMN}" VALUES (?, ?, ?, ?, ?)',
+                    (cursor.lastrowid, minx, maxx, miny, maxy),
+                )
+        self.connection.commit()
+
+    def _create_rtree(self, table: str) -> bool:
+        """Create a table's spatial index; False when this SQLite build has no R-tree module."""
+        try:
+            self.connection.execute(
+                f'CREATE VIRTUAL TABLE "rtree_{table}_{GPKG_GEOMETRY_COLUMN}" USING rtree(id, minx, maxx, miny, maxy)'
+            )
+            return True
+        except sqlite3.OperationalError as e:
+            logger.warning(f"GeoPackage table {table} is written without a spatial index: {e}")
+            return False
+
+    @staticmethod
+    def _column_name(name: str, renamed: Dict[str, str]) -> str:
+        """A property name as a column name that does not clash with fid, geom or another property."""
+        column = name.replace('"', "")
+        taken = {c.lower() for c in renamed.values()} | {"fid", GPKG_GEOMETRY_COLUMN}
+        candidate, suffix = column, 1
+        while candidate.lower() in taken:
+            candidate = f"{column}_{suffix}"
+            suffix += 1
+        return candidate
+
+    def _register_srs(self, srs_id: Optional[int]) -> Optional[int]:
+        """Add a spatial reference system to gpkg_spatial_ref_sys if it is not there yet."""
+        if srs_id is None or srs_id in self._srs_ids:
+            return srs_id
+        name, definition = f"EPSG:{srs_id}", "undefined"
+        if PYPROJ_AVAILABLE:
+            try:
+                crs = CRS.from_epsg(srs_id)
+                name, definition = crs.name, crs.to_wkt("WKT1_GDAL")
+            except Exception as e:
+                logger.warning(f"Cannot look up the definition of EPSG:{srs_id}: {e}")
+        else:
+            logger.warning(f"pyproj is not installed; EPSG:{srs_id} is written to the GeoPackage without a definition")
+        self.connection.execute(
+            "INSERT INTO gpkg_spatial_ref_sys VALUES (?, ?, 'EPSG', ?, ?, NULL)", (name, srs_id, srs_id, definition)
+        )
+        self._srs_ids.add(srs_id)
+        return srs_id
@@ -0,0 +1,341 @@
+"""
+TerraFusion Platform - GeoParquet Writer
+
+This module provides the writer GIS exports use to produce GeoParquet files:
+one layer as a Parquet table with its geometry in a WKB column and the "geo"
+file metadata of the GeoParquet 1.1 specification (encoding, geometry types,
+bounding box and CRS), so DuckDB, Spark (Sedona), GeoPandas and GDAL read it
+as spatial data without further setup.
+
+Rows are ordered along a Hilbert curve and carry a "bbox" covering column,
+which gives every row group tight min/max statistics; engines use them to
+skip row groups outside a spatial filter. Row groups are sized by rows
+(row_group_size) or by an approximate uncompressed size (row_group_mb),
+from the layer's "geoparquet" settings or the export request's parameters.
+
+Property types are inferred from the values: booleans, integers, doubles,
+decimals (kept exact, at the largest scale seen), dates and timestamps map
+to their Parquet types; objects are JSON text and anything else, or a column
+of mixed types, is a string. Layers without geometry are written as plain
+Parquet.
+
+Writing requires the pyarrow package.
+"""
+
+import json
+import logging
+from array import array
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Iterable, Tuple
+
+from gis_features import ExportLayer, FeatureSpool, encode_wkb, geometry_bounds, geometry_has_z, merge_bounds
+from gis_flatgeobuf import hilbert_order
+
+try:
+    import pyarrow as pa
+    import pyarrow.parquet as pq
+    PYARROW_AVAILABLE = True
+except ImportError:
+    PYARROW_AVAILABLE = False
+
+try:
+    from pyproj import CRS
+    PYPROJ_AVAILABLE = True
+except ImportError:
+    PYPROJ_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GEOPARQUET_VERSION = "1.1.0"
+
+# Rows per row group unless configured
+DEFAULT_ROW_GROUP_SIZE = 65536
+
+# Parquet compression codecs pyarrow writes
+COMPRESSIONS = ["none", "snappy", "gzip", "zstd", "lz4", "brotli"]
+
+# Widest decimal Parquet stores exactly
+MAX_DECIMAL_PRECISION = 38
+
+
+class GeoParquetOptions:
+    """How a layer is written: row group sizing, compression and row order."""
+
+    def __init__(self, layer: ExportLayer, parameters: Optional[Dict[str, Any]] = None):
+        """
+        Read the options of a layer.
+
+        Args:
+            layer: Layer being exported; its "geoparquet" settings are the defaults
+            parameters: Export request parameters, which override the layer settings
+
+        Raises:
+            ValueError: If an option is invalid or pyarrow is not installed
+        """
+        if not PYARROW_AVAILABLE:
+            raise ValueError("GeoParquet exports require the pyarrow package")
+        settings = dict(layer.settings.get("geoparquet") or {})
+        for key in ("row_group_size", "row_group_mb", "compression", "bbox_column", "spatial_sort"):
+            if parameters and parameters.get(key) is not None:
+                settings[key] = parameters[key]
+
+        self.row_group_size = settings.get("row_group_size", DEFAULT_ROW_GROUP_SIZE)
+        if isinstance(self.row_group_size, bool) or not isinstance(self.row_group_size, int) or self.row_group_size < 1:
+            raise ValueError(f"Layer {layer.name}: row_group_size must be a positive number of rows")
+        self.row_group_mb = settings.get("row_group_mb")
+        if self.row_group_mb is not None and (
+                isinstance(self.row_group_mb, bool) or not isinstance(self.row_group_mb, (int, float)) or self.row_group_mb <= 0):
+            raise ValueError(f"Layer {layer.name}: row_group_mb must be a positive number")
+        self.compression = str(settings.get("compression", "zstd")).lower()
+        if self.compression not in COMPRESSIONS:
+            raise ValueError(f"Layer {layer.name}: unsupported compression {self.compression}. "
+                             f"Supported: {', '.join(COMPRESSIONS)}")
+        self.bbox_column = bool(settings.get("bbox_column", True))
+        self.spatial_sort = bool(settings.get("spatial_sort", True))
+
+
+class ParquetColumn:
+    """The Parquet type of a property, inferred from the values it holds."""
+
+    def __init__(self, name: str):
+        self.name = name
+        self.kind: Optional[str] = None
+        self.scale = 0
+        self.integer_digits = 1
+
+    def observe(self, value: Any) -> None:
+        """Widen the column's type to hold a value."""
+        if value is None:
+            return
+        kind = self._kind(value)
+        if kind == "decimal":
+            sign, digits, exponent = value.as_tuple()
+            self.scale = max(self.scale, -exponent)
+            self.integer_digits = max(self.integer_digits, len(digits) + exponent)
+        elif kind == "int":
+            self.integer_digits = max(self.integer_digits, len(str(abs(value))))
+        if self.kind is None or self.kind == kind:
+            self.kind = kind
+        elif {self.kind, kind} == {"int", "float"} or {self.kind, kind} == {"decimal", "float"}:
+            self.kind = "float"
+        elif {self.kind, kind} == {"int", "decimal"}:
+            self.kind = "decimal"
+        else:
+            self.kind = "string"
+
+    def finish(self) -> None:
+        """Settle the type once every value has been seen."""
+        if self.kind is None:
+            self.kind = "string"
+        if self.kind == "decimal" and self.integer_digits + self.scale > MAX_DECIMAL_PRECISION:
+            self.kind = "float"
+
+    def arrow_type(self):
+        return {
+            "bool": pa.bool_(),
+            "int": pa.int64(),
+            "float": pa.float64(),
+            "date": pa.date32(),
+            "timestamp": pa.timestamp("us"),
+            "timestamptz": pa.timestamp("us", tz="UTC"),
+            "binary": pa.binary(),
+        }.get(self.kind) or (pa.decimal128(MAX_DECIMAL_PRECISION, self.scale) if self.kind == "decimal" else pa.string())
+
+    def convert(self, value: Any) -> Any:
+        """A value as the column stores it."""
+        if value is None:
+            return None
+        if self.kind == "float":
+            return float(value)
+        if self.kind == "decimal":
+            return Decimal(value)
+        if self.kind == "json":
+            return json.dumps(value, default=str)
+        if self.kind == "string":
+            if isinstance(value, (dict, list)):
+                return json.dumps(value, default=str)
+            if isinstance(value, (date, datetime)):
+                return value.isoformat()
+            if isinstance(value, (bytes, bytearray)):
+                return bytes(value).hex()
+            return str(value)
+        return value
+
+    @staticmethod
+    def _kind(value: Any) -> str:
+        if isinstance(value, bool):
+            return "bool"
+        if isinstance(value, int):
+            return "int"
+        if isinstance(value, Decimal):
+            return "decimal" if value.is_finite() else "float"
+        if isinstance(value, float):
+            return "float"
+        if isinstance(value, datetime):
+            return "timestamptz" if value.tzinfo else "timestamp"
+        if isinstance(value, date):
+            return "date"
+        if isinstance(value, (dict, list)):
+            return "json"
+        if isinstance(value, (bytes, bytearray)):
+            return "binary"
+        return "string"
+
+
+def geoparquet_crs(srid: Optional[int]) -> Optional[Dict[str, Any]]:
+    """
+    The PROJJSON CRS of an SRID for the "geo" metadata, or None for
+    longitude/latitude (4326, GeoParquet's default CRS, which need not be
+    written). Without pyproj only the EPSG identifier is written.
+    """
+    if srid is None or int(srid) == 4326:
+        return None
+    if PYPROJ_AVAILABLE:
+        return CRS.from_epsg(int(srid)).to_json_dict()
+    logger.warning(f"pyproj is not installed; GeoParquet CRS for EPSG:{srid} is written as an identifier only")
+    return {"id": {"authority": "EPSG", "code": int(srid)}}
+
+
+class GeoParquetWriter:
+    """Writes one feature layer as a GeoParquet file."""
+
+    def __init__(self, path: str, options: GeoParquetOptions):
+        """
+        Initialize the writer.
+
+        Args:
+            path: File to create
+            options: How the layer is written (see GeoParquetOptions)
+        """
+        if not PYARROW_AVAILABLE:
+            raise ValueError("GeoParquet exports require the pyarrow package")
+        self.path = path
+        self.options = options
+
+    def write_layer(self, layer: ExportLayer, features: Iterable[Dict[str, Any]]) -> Dict[str, Any]:
+        """
+        Write a layer.
+
+        Args:
+            layer: Layer being written
+            features: Features of the layer (see gis_features)
+
+        Returns:
+            Summary: features, row_groups, row_group_size, compression,
+            geometry_types, srid, bounds and columns
+        """
+        # First pass: spool the features, collecting bounds, geometry types and property types
+        spool = FeatureSpool()
+        offsets = array("Q")
+        boxes = array("d")
+        columns: Dict[str, ParquetColumn] = {}
+        geometry_types = set()
+        srid = layer.srid
+        bounds = None
+        try:
+            for feature in features:
+                geometry = feature.get("geometry")
+                feature_bounds = geometry_bounds(geometry)
+                if geometry:
+                    geometry_types.add(geometry["type"] + (" Z" if geometry_has_z(geometry) else ""))
+                    if srid is None:
+                        srid = feature.get("srid")
+                    bounds = merge_bounds(bounds, feature_bounds)
+                for name, value in feature["properties"].items():
+                    if name not in columns:
+                        columns[name] = ParquetColumn(name)
+                    columns[name].observe(value)
+                offsets.append(spool.append({"geometry": geometry, "properties": feature["properties"]}))
+                boxes.extend(feature_bounds or (float("nan"),) * 4)
+            for column in columns.values():
+                column.finish()
+
+            count = len(offsets)
+            geometry_column = layer.geometry_field
+            bbox_column = None
+            if geometry_column and self.options.bbox_column:
+                bbox_column = "bbox" if "bbox" not in columns else f"{geometry_column}_bbox"
+            schema = self._schema(layer, columns, geometry_column, bbox_column, geometry_types, bounds, srid)
+            row_group_size = self._row_group_size(spool, count)
+
+            if geometry_column and self.options.spatial_sort and bounds:
+                order = hilbert_order(boxes, bounds)
+            else:
+                order = range(count)
+
+            # Second pass: write the rows in order, a row group at a time
+            row_groups = 0
+            writer = pq.ParquetWriter(self.path, schema, compression=self.options.compression)
+            try:
+                batch: Dict[str, List[Any]] = {name: [] for name in schema.names}
+                for n, i in enumerate(order, 1):
+                    record = spool.read(offsets[i])
+                    for name, column in columns.items():
+                        batch[name].append(column.convert(record["properties"].get(name)))
+                    if geometry_column:
+                        geometry = record["geometry"]
+                        batch[geometry_column].append(encode_wkb(geometry) if geometry else None)
+                    if bbox_column:
+                        box = boxes[4 * i:4 * i + 4]
+                        batch[bbox_column].append(
+                            dict(zip(("xmin", "ymin", "xmax", "ymax"), box)) if record["geometry"] else None
+                        )
+                    if n % row_group_size == 0 or n == count:
+                        writer.write_table(pa.Table.from_pydict(batch, schema=schema), row_group_size=row_group_size)
+                        row_groups += 1
+                        batch = {name: [] for name in schema.names}
+            finally:
+                writer.close()
+        finally:
+            spool.close()
+
+        logger.info(f"Wrote {count} features of layer {layer.name} to GeoParquet in {row_groups} row groups")
+        return {
+            "features": count,
+            "row_groups": row_groups,
+            "row_group_size": row_group_size,
+            "compression": self.options.compression,
+            "geometry_types": sorted(geometry_types),
+            "srid": srid,
+            "bounds": list(bounds) if bounds else None,
+            "columns": {name: column.kind for name, column in columns.items()},
+        }
+
+    def _row_group_size(self, spool: FeatureSpool, count: int) -> int:
+        """Rows per row group, capped by row_group_mb (estimated from the spooled size) when set."""
+        rows = self.options.row_group_size
+        if self.options.row_group_mb and count:
+            spool.file.seek(0, 2)
+            row_bytes = max(1, spool.file.tell() // count)
+            rows = min(rows, max(1, int(self.options.row_group_mb * 1024 * 1024 / row_bytes)))
+        return rows
+
+    @staticmethod
+    def _schema(layer: ExportLayer, columns: Dict[str, ParquetColumn], geometry_column: Optional[str],
+                bbox_column: Optional[str], geometry_types: set, bounds, srid: Optional[int]):
+        fields = [pa.field(name, column.arrow_type()) for name, column in columns.items()]
+        if not geometry_column:
+            return pa.schema(fields)
+
+        fields.append(pa.field(geometry_column, pa.binary()))
+        column_metadata: Dict[str, Any] = {
+            "encoding": "WKB",
+            "geometry_types": sorted(geometry_types),
+        }
+        if bounds:
+            column_metadata["bbox"] = list(bounds)
+        crs = geoparquet_crs(srid)
+        if crs is not None:
+            column_metadata["crs"] = crs
+        if bbox_column:
+            fields.append(pa.field(bbox_column, pa.struct([(k, pa.float64()) for k in ("xmin", "ymin", "xmax", "ymax")])))
+            column_metadata["covering"] = {"bbox": {k: [bbox_column, k] for k in ("xmin", "ymin", "xmax", "ymax")}}
+        geo = {
+            "version": GEOPARQUET_VERSION,
+            "primary_column": geometry_column,
+            "columns": {geometry_column: column_metadata},
+        }
+        return pa.schema(fields, metadata={b"geo": json.dumps(geo).encode("utf-8")})
@@ -0,0 +1,254 @@
+"""
+TerraFusion Platform - Incremental Exports
+
+This module lets a recurring feature export write only the features that
+changed since its previous run. Exports that name a series in their
+parameters keep a fingerprint of every feature they wrote (a hash of its
+properties and geometry as written, by layer and feature id):
+
+    "parameters": {"series": "nightly_parcels", "mode": "incremental"}
+
+A full export of a series ("mode": "full", the default) writes every feature
+and starts the series again from it. An incremental export writes the
+features whose fingerprint is new or differs from the previous export of the
+series, and lists the ids of the features that export had and this one does
+not. Each export of a series records a manifest, in its job's "increment" and
+as increment.json in its bundle, linking it to the full export the series
+started from and to the export before it, so a consumer can apply the
+increments in order on top of the full export.
+
+Increments are only comparable between exports of the same format, layers,
+area and parameters, so a series remembers them: an incremental export that
+differs is refused until a full export starts the series again. An
+incremental export of a series with no full export yet is written as a full
+export.
+"""
+
+import os
+import re
+import json
+import hashlib
+import logging
+import threading
+from typing import Dict, Any, Optional, Iterable, Iterator
+
+from encryption import dumps_document, loads_document
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Export modes of a series
+INCREMENT_MODES = ["full", "incremental"]
+
+# Parameters that do not change what an export holds, left out of a series' signature
+PACKAGING_PARAMETERS = ["series", "mode", "bundle"]
+
+# Folder below the export storage the series are kept in
+SERIES_FOLDER = "increments"
+
+SERIES_NAME = re.compile(r"^[A-Za-z0-9_.-]{1,64}$")
+
+
+def parse_increment(parameters: Optional[Dict[str, Any]]) -> Optional[Dict[str, str]]:
+    """
+    The series and mode of an export's parameters, or None for an export outside a series.
+
+    Raises:
+        ValueError: If the mode is unknown, or incremental without a series
+    """
+    parameters = parameters or {}
+    mode = parameters.get("mode", "full")
+    if mode not in INCREMENT_MODES:
+        raise ValueError(f"Unknown export mode {mode}; modes: {', '.join(INCREMENT_MODES)}")
+    series = parameters.get("series")
+    if series is None:
+        if mode == "incremental":
+            raise ValueError("An incremental export needs parameters.series, the series it continues")
+        return None
+    if not isinstance(series, str) or not SERIES_NAME.match(series):
+        raise ValueError("parameters.series must be a name of letters, digits, '_', '-' and '.' (at most 64)")
+    return {"series": series, "mode": mode}
+
+
+def series_signature(job: Dict[str, Any]) -> str:
+    """A hash of what an export holds: its format, layers, area, redaction and parameters."""
+    parameters = {name: value for name, value in (job.get("parameters") or {}).items()
+                  if name not in PACKAGING_PARAMETERS}
+    content = {
+        "export_format": job["export_format"],
+        "layers": job["layers"],
+        "area_of_interest": job.get("area_of_interest"),
+        "redaction": sorted(job.get("redaction") or []),
+        "parameters": parameters,
+    }
+    return hashlib.sha256(json.dumps(content, sort_keys=True, default=str).encode("utf-8")).hexdigest()
+
+
+def feature_fingerprint(feature: Dict[str, Any]) -> str:
+    """A hash of a feature as written: its properties, geometry and CRS."""
+    content = [feature.get("properties"), feature.get("geometry"), feature.get("srid")]
+    return hashlib.sha1(json.dumps(content, sort_keys=True, default=str).encode("utf-8")).hexdigest()[:20]
+
+
+class ExportSeries:
+    """The series of a county's exports, each the fingerprints of its last export, in one folder."""
+
+    def __init__(self, storage_path: str, cipher=None):
+        """
+        Initialize the store.
+
+        Args:
+            storage_path: Export storage directory; series are kept in a folder below it
+            cipher: Cipher series files are encrypted with, as job files are
+        """
+        self.path = os.path.join(storage_path, SERIES_FOLDER)
+        self.cipher = cipher
+        self._locks: Dict[tuple, threading.Lock] = {}
+        self._lock = threading.Lock()
+
+    def load(self, county_id: str, series: str) -> Optional[Dict[str, Any]]:
+        """The state of a series after its last export, or None before its first."""
+        path = self._file(county_id, series)
+        if not os.path.exists(path):
+            return None
+        with open(path, "r") as f:
+            return loads_document(f.read(), self.cipher, f"export_series/{county_id}/{series}")
+
+    def save(self, state: Dict[str, Any]) -> None:
+        os.makedirs(self.path, exist_ok=True)
+        path = self._file(state["county_id"], state["series"])
+        with open(f"{path}.partial", "w") as f:
+            f.write(dumps_document(state, self.cipher, f"export_series/{state['county_id']}/{state['series']}"))
+        os.replace(f"{path}.partial", path)
+
+    def lock(self, county_id: str, series: str) -> threading.Lock:
+        """The lock exports of a series hold while they run, so each compares with the one before."""
+        with self._lock:
+            return self._locks.setdefault((county_id, series), threading.Lock())
+
+    def check(self, job: Dict[str, Any], increment: Dict[str, str]) -> Optional[Dict[str, Any]]:
+        """
+        The state an export of a series is compared with: None when it is
+        written in full.
+
+        Raises:
+            ValueError: If an incremental export differs from the series' exports
+        """
+        if increment["mode"] != "incremental":
+            return None
+        state = self.load(job["county_id"], increment["series"])
+        if state is not None and state["signature"] != series_signature(job):
+            raise ValueError(f"Export series {increment['series']} was started with other layers, area or "
+                             f"parameters; run a full export to start it again")
+        return state
+
+    def _file(self, county_id: str, series: str) -> str:
+        return os.path.join(self.path, f"{county_id}_{series}.json")
+
+
+class Increment:
+    """The changes one export of a series writes, found as its features pass through."""
+
+    def __init__(self, job: Dict[str, Any], increment: Dict[str, str], previous: Optional[Dict[str, Any]]):
+        """
+        Initialize the increment.
+
+        Args:
+            job: Export job
+            increment: Series and mode from parse_increment
+            previous: State of the series to compare with, None to write every feature
+        """
+        self.job = job
+        self.series = increment["series"]
+        self.previous = previous
+        self.fingerprints: Dict[str, Dict[str, str]] = {}
+        self.layers: Dict[str, Dict[str, Any]] = {}
+
+    @property
+    def incremental(self) -> bool:
+        return self.previous is not None
+
+    def features(self, name: str, features: Iterable[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+        """
+        Fingerprint the features of a layer, yielding those an incremental
+        export writes (every one in a full export).
+        """
+        before = (self.previous or {}).get("layers", {}).get(name) if self.incremental else None
+        fingerprints = self.fingerprints.setdefault(name, {})
+        counts = {"features": 0, "added": 0, "changed": 0, "unchanged": 0}
+        for feature in features:
+            counts["features"] += 1
+            if feature.get("id") is None:
+                # Nothing to compare it with another time, so it is always written
+                counts["added"] += 1
+                yield feature
+                continue
+            key = str(feature["id"])
+            fingerprint = feature_fingerprint(feature)
+            fingerprints[key] = fingerprint
+            if before is None or key not in before:
+                counts["added"] += 1
+            elif before[key] != fingerprint:
+                counts["changed"] += 1
+            else:
+                counts["unchanged"] += 1
+                continue
+            yield feature
+        summary = {"features": counts["features"]}
+        if self.incremental:
+            deleted = sorted(key for key in (before or {}) if key not in fingerprints)
+            summary.update(added=counts["added"], changed=counts["changed"], unchanged=counts["unchanged"],
+                           deleted=len(deleted), deleted_ids=deleted)
+        self.layers[name] = summary
+
+    def manifest(self) -> Dict[str, Any]:
+        """How the export fits in its series, for its job and bundle."""
+        job = self.job
+        if self.incremental:
+            previous = self.previous
+            return {
+                "series": self.series,
+                "mode": "incremental",
+                "export_id": job["job_id"],
+                "sequence": previous["sequence"] + 1,
+                "base_export_id": previous["base_export_id"],
+                "base_exported_at": previous["base_exported_at"],
+                "previous_export_id": previous["export_id"],
+                "previous_exported_at": previous["exported_at"],
+                "layers": self.layers,
+            }
+        return {
+            "series": self.series,
+            "mode": "full",
+            "export_id": job["job_id"],
+            "sequence": 0,
+            "base_export_id": job["job_id"],
+            "base_exported_at": job["started_at"],
+            "layers": self.layers,
+        }
+
+    def state(self) -> Dict[str, Any]:
+        """The state of the series after this export, for the next one to compare with."""
+        manifest = self.manifest()
+        return {
+            "county_id": self.job["county_id"],
+            "series": self.series,
+            "signature": series_signature(self.job),
+            "export_id": self.job["job_id"],
+            "exported_at": self.job["started_at"],
+            "sequence": manifest["sequence"],
+            "base_export_id": manifest["base_export_id"],
+            "base_exported_at": manifest["base_exported_at"],
+            "layers": self.fingerprints,
+        }
+
+    def describe(self) -> str:
+        """A sentence on the increment for the job message."""
+        if not self.incremental:
+            return f"Full export of series {self.series}."
+        totals = {name: sum(layer.get(name, 0) for layer in self.layers.values())
+                  for name in ("added", "changed", "deleted")}
+        return (f"Increment {self.manifest()['sequence']} of series {self.series} since export "
+                f"{self.previous['export_id']}: {totals['added']} added, {totals['changed']} changed, "
+                f"{totals['deleted']} deleted.")
@@ -0,0 +1,444 @@
+"""
+TerraFusion Platform - KML/KMZ Writer
+
+This module provides the writer GIS exports use to produce KML documents and
+KMZ packages for Google Earth. Each layer becomes a folder of placemarks,
+styled by the "kml" settings of its layer definition:
+
+    "kml": {
+        "name_field": "parcel_number",
+        "balloon": "<h3>{parcel_number}</h3>Owner: {owner_name}<br/>Assessed: ${assessed_value:,.0f}",
+        "line_color": "#ffffff", "line_width": 1, "fill_color": "#3388ff", "fill_opacity": 0.4,
+        "color_by": {"field": "land_use_code", "colors": {"11": "#f5e663", "5": "#ff7f7f"},
+                     "default": "#bbbbbb"},
+        "region_features": 2000
+    }
+
+Colors are CSS hex ("#rrggbb" or "#rrggbbaa"); KML's own aabbggrr order is
+produced here. color_by picks the fill (and icon) color from a field's value:
+an exact match first, then the longest matching prefix ("5" covers every 5x
+code), then the default. Balloons are rendered per placemark from the template,
+whose {field} placeholders take Python format specs; values are HTML-escaped
+and missing values are left blank. Without a template the balloon lists the
+record's fields.
+
+Layers with more placemarks than region_features are split into a grid of
+tiles, each with a Region so Google Earth only draws the tiles in view. In a
+KMZ every tile is its own file behind a network link, so tiles also load on
+demand; a KML keeps the tiles as folders of the one document.
+
+KML coordinates are always WGS 84 longitude/latitude. Layers in another SRID
+are reprojected with pyproj, which must then be installed.
+"""
+
+import os
+import re
+import json
+import math
+import html
+import shutil
+import string
+import tempfile
+import zipfile
+import logging
+from typing import Dict, List, Any, Optional, Iterable, Tuple
+from xml.sax.saxutils import escape, quoteattr
+
+from gis_features import ExportLayer, Bounds, geometry_bounds, merge_bounds
+
+try:
+    from pyproj import Transformer
+    PYPROJ_AVAILABLE = True
+except ImportError:
+    PYPROJ_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Placemarks a layer may have before it is split into region tiles
+DEFAULT_KML_REGION_FEATURES = 2000
+
+# Tiles become visible once their region covers this many pixels on screen
+KML_REGION_MIN_LOD_PIXELS = 128
+
+# Default styling of layers without kml settings
+DEFAULT_KML_LINE_COLOR = "#ffffff"
+DEFAULT_KML_LINE_WIDTH = 1
+DEFAULT_KML_FILL_COLOR = "#3388ff"
+DEFAULT_KML_FILL_OPACITY = 0.4
+
+KML_NAMESPACE = "http://www.opengis.net/kml/2.2"
+
+# Folder of tile documents inside a KMZ
+KMZ_FILES_DIR = "files"
+
+
+def kml_color(value: str, opacity: Optional[float] = None) -> str:
+    """
+    A CSS hex color as a KML color (aabbggrr).
+
+    Args:
+        value: "#rrggbb" or "#rrggbbaa"
+        opacity: Alpha (0-1) for colors that do not give one
+
+    Raises:
+        ValueError: If the color is not a CSS hex color
+    """
+    match = re.fullmatch(r"#([0-9a-fA-F]{6})([0-9a-fA-F]{2})?", str(value).strip())
+    if not match:
+        raise ValueError(f"Invalid KML style color {value!r}; use #rrggbb or #rrggbbaa")
+    rgb, alpha = match.group(1), match.group(2)
+    if alpha is None:
+        alpha = format(round(255 * (1.0 if opacity is None else max(0.0, min(float(opacity), 1.0)))), "02x")
+    return f"{alpha}{rgb[4:6]}{rgb[2:4]}{rgb[0:2]}".lower()
+
+
+class BalloonFormatter(string.Formatter):
+    """Fills balloon templates from record fields, HTML-escaping every value."""
+
+    def get_value(self, key, args, kwargs):
+        return kwargs.get(key)
+
+    def format_field(self, value: Any, format_spec: str) -> str:
+        if value is None:
+            return ""
+        try:
+            text = format(value, format_spec)
+        except (TypeError, ValueError):
+            text = str(value)
+        return html.escape(text)
+
+
+class KmlLayerStyle:
+    """The styles and balloon of one layer, from the kml settings of its definition."""
+
+    def __init__(self, layer: ExportLayer, key: str):
+        """
+        Parse a layer's kml settings.
+
+        Args:
+            layer: Layer being written
+            key: Prefix for the layer's style ids
+
+        Raises:
+            ValueError: If a setting is invalid
+        """
+        settings = layer.settings.get("kml") or {}
+        self.key = key
+        self.name_field = settings.get("name_field")
+        self.balloon = settings.get("balloon")
+        self.region_features = int(settings.get("region_features", DEFAULT_KML_REGION_FEATURES))
+        self.icon = settings.get("icon")
+        self.line_color = kml_color(settings.get("line_color", DEFAULT_KML_LINE_COLOR), 1.0)
+        self.line_width = float(settings.get("line_width", DEFAULT_KML_LINE_WIDTH))
+        self.fill_opacity = float(settings.get("fill_opacity", DEFAULT_KML_FILL_OPACITY))
+        self.fill_color = kml_color(settings.get("fill_color", DEFAULT_KML_FILL_COLOR), self.fill_opacity)
+        if self.region_features < 1:
+            raise ValueError(f"kml region_features of export layer {layer.name} must be at least 1")
+        if self.balloon:
+            try:
+                list(string.Formatter().parse(self.balloon))
+            except ValueError as e:
+                raise ValueError(f"Invalid kml balloon template for export layer {layer.name}: {e}")
+
+        color_by = settings.get("color_by")
+        self.color_field = None
+        self.colors: Dict[str, str] = {}
+        if color_by:
+            if not color_by.get("field"):
+                raise ValueError(f"kml color_by of export layer {layer.name} needs a field")
+            self.color_field = color_by["field"]
+            self.colors = {str(k): kml_color(v, self.fill_opacity) for k, v in (color_by.get("colors") or {}).items()}
+            if color_by.get("default"):
+                self.fill_color = kml_color(color_by["default"], self.fill_opacity)
+        # Style id by fill color, in order of first use
+        self.styles: Dict[str, str] = {}
+        self._formatter = BalloonFormatter()
+
+    def style_id(self, properties: Dict[str, Any]) -> str:
+        """The id of the style a placemark uses."""
+        color = self.fill_color
+        if self.color_field:
+            value = properties.get(self.color_field)
+            value = "" if value is None else str(value)
+            if value in self.colors:
+                color = self.colors[value]
+            else:
+                prefixes = [k for k in self.colors if k and value.startswith(k)]
+                if prefixes:
+                    color = self.colors[max(prefixes, key=len)]
+        if color not in self.styles:
+            self.styles[color] = f"{self.key}_{len(self.styles)}"
+        return self.styles[color]
+
+    def description(self, properties: Dict[str, Any]) -> str:
+        """The balloon HTML of a placemark."""
+        if self.balloon:
+            return self._formatter.vformat(self.balloon, (), properties)
+        rows = "".join(
+            f"<tr><th>{html.escape(str(k))}</th><td>{html.escape('' if v is None else str(v))}</td></tr>"
+            for k, v in properties.items()
+        )
+        return f"<table>{rows}</table>"
+
+    def styles_xml(self) -> str:
+        """The Style elements the layer's placemarks have used."""
+        parts = []
+        for color, style_id in self.styles.items():
+            icon = f"<Icon><href>{escape(self.icon)}</href></Icon>" if self.icon else ""
+            parts.append(
+                f"<Style id={quoteattr(style_id)}>"
+                f"<IconStyle><color>ff{color[2:]}</color>{icon}</IconStyle>"
+                f"<LineStyle><color>{self.line_color}</color><width>{self.line_width:g}</width></LineStyle>"
+                f"<PolyStyle><color>{color}</color></PolyStyle>"
+                "</Style>"
+            )
+        return "".join(parts)
+
+
+def kml_coordinates(points: List[List[float]]) -> str:
+    # 10 significant digits keep longitude/latitude to about a centimetre
+    return " ".join(",".join(format(float(v), ".10g") for v in point[:3]) for point in points)
+
+
+def kml_geometry(geometry: Dict[str, Any]) -> str:
+    """A GeoJSON-style geometry (in longitude/latitude) as KML."""
+    kind, coordinates = geometry["type"], geometry["coordinates"]
+    if kind == "Point":
+        return f"<Point><coordinates>{kml_coordinates([coordinates])}</coordinates></Point>"
+    if kind == "LineString":
+        return f"<LineString><tessellate>1</tessellate><coordinates>{kml_coordinates(coordinates)}</coordinates></LineString>"
+    if kind == "Polygon":
+        rings = [f"<outerBoundaryIs><LinearRing><coordinates>{kml_coordinates(coordinates[0])}</coordinates></LinearRing></outerBoundaryIs>"]
+        rings += [f"<innerBoundaryIs><LinearRing><coordinates>{kml_coordinates(r)}</coordinates></LinearRing></innerBoundaryIs>"
+                  for r in coordinates[1:]]
+        return f"<Polygon><tessellate>1</tessellate>{''.join(rings)}</Polygon>"
+    if kind in ("MultiPoint", "MultiLineString", "MultiPolygon"):
+        part = kind[len("Multi"):]
+        return "<MultiGeometry>" + "".join(kml_geometry({"type": part, "coordinates": c}) for c in coordinates) + "</MultiGeometry>"
+    raise ValueError(f"Unsupported geometry type: {kind}")
+
+
+def kml_region(bounds: Bounds) -> str:
+    """A Region element covering a box of longitude/latitude."""
+    west, south, east, north = bounds
+    return (
+        "<Region><LatLonAltBox>"
+        f"<north>{north:.10g}</north><south>{south:.10g}</south><east>{east:.10g}</east><west>{west:.10g}</west>"
+        f"</LatLonAltBox><Lod><minLodPixels>{KML_REGION_MIN_LOD_PIXELS}</minLodPixels><maxLodPixels>-1</maxLodPixels></Lod></Region>"
+    )
+
+
+def kml_document(name: str, body: str) -> str:
+    return (
+        f'<?xml version="1.0" encoding="UTF-8"?>\n<kml xmlns="{KML_NAMESPACE}"><Document>'
+        f"<name>{escape(name)}</name>{body}</Document></kml>\n"
+    )
+
+
+class KmlWriter:
+    """Writes feature layers into a KML document or a KMZ package."""
+
+    def __init__(self, path: str, title: str, kmz: bool = False):
+        """
+        Initialize the writer; the file is written by close().
+
+        Args:
+            path: File to create
+            title: Document name shown in Google Earth
+            kmz: Write a KMZ package (tiles of large layers as network-linked files)
+        """
+        self.path = path
+        self.title = title
+        self.kmz = kmz
+        self.work_dir = tempfile.mkdtemp(prefix="tf_kml_")
+        self._folders: List[str] = []
+        self._styles: List[str] = []
+        self._keys = set()
+        self._transformers: Dict[int, Any] = {}
+
+    def add_layer(self, layer: ExportLayer, features: Iterable[Dict[str, Any]]) -> Dict[str, Any]:
+        """
+        Write a layer as a folder of placemarks.
+
+        Args:
+            layer: Layer being written
+            features: Features of the layer (see gis_features)
+
+        Returns:
+            Summary: folder, features, styles and tiles (0 when not split)
+
+        Raises:
+            ValueError: If the kml settings are invalid or the layer cannot
+                be reprojected to longitude/latitude
+        """
+        key = re.sub(r"[^A-Za-z0-9_]+", "_", layer.name).strip("_") or "layer"
+        while key in self._keys:
+            key = f"{key}_"
+        self._keys.add(key)
+        style = KmlLayerStyle(layer, key)
+
+        # Placemarks are spooled until the layer's size decides whether it is tiled
+        spool = tempfile.TemporaryFile(mode="w+", encoding="utf-8")
+        bounds = None
+        count = 0
+        for feature in features:
+            geometry = self._lonlat(layer, feature)
+            feature_bounds = geometry_bounds(geometry)
+            bounds = merge_bounds(bounds, feature_bounds)
+            spool.write(json.dumps([feature_bounds, self._placemark(style, feature, geometry)]) + "\n")
+            count += 1
+
+        spool.seek(0)
+        folder_path = os.path.join(self.work_dir, f"{key}.folder.kml")
+        tiles = 0
+        with open(folder_path, "w", encoding="utf-8") as folder:
+            folder.write(f"<Folder><name>{escape(layer.title)}</name>")
+            if layer.description:
+                folder.write(f"<description>{escape(layer.description)}</description>")
+            if count > style.region_features and bounds is not None:
+                tiles = self._write_tiles(layer, style, spool, count, bounds, folder)
+            else:
+                for line in spool:
+                    folder.write(json.loads(line)[1])
+            folder.write("</Folder>")
+        spool.close()
+        self._folders.append(folder_path)
+        self._styles.append(style.styles_xml())
+
+        logger.info(f"Wrote {count} placemarks of layer {layer.name} to KML" + (f" in {tiles} region tiles" if tiles else ""))
+        return {"folder": layer.title, "features": count, "styles": len(style.styles), "tiles": tiles}
+
+    def close(self) -> None:
+        """Assemble the document (and package it for KMZ), then remove the work files."""
+        try:
+            doc_path = os.path.join(self.work_dir, "doc.kml")
+            with open(doc_path, "w", encoding="utf-8") as doc:
+                head, tail = kml_document(self.title, "\0").split("\0")
+                doc.write(head)
+                doc.write("".join(self._styles))
+                for folder_path in self._folders:
+                    with open(folder_path, encoding="utf-8") as folder:
+                        shutil.copyfileobj(folder, doc)
+                doc.write(tail)
+            if self.kmz:
+                with zipfile.ZipFile(self.path, "w", zipfile.ZIP_DEFLATED) as archive:
+                    # Google Earth opens the first .kml of the package
+                    archive.write(doc_path, "doc.kml")
+                    files_dir = os.path.join(self.work_dir, KMZ_FILES_DIR)
+                    if os.path.isdir(files_dir):
+                        for name in sorted(os.listdir(files_dir)):
+                            archive.write(os.path.join(files_dir, name), f"{KMZ_FILES_DIR}/{name}")
+            else:
+                shutil.move(doc_path, self.path)
+        finally:
+            shutil.rmtree(self.work_dir, ignore_errors=True)
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        if exc_type is None:
+            self.close()
+        else:
+            shutil.rmtree(self.work_dir, ignore_errors=True)
+
+    def _write_tiles(self, layer: ExportLayer, style: KmlLayerStyle, spool, count: int, bounds: Bounds, folder) -> int:
+        """Split a layer's placemarks into a grid of region tiles; returns the number of tiles written."""
+        size = math.ceil(math.sqrt(math.ceil(count / style.region_features)))
+        west, south, east, north = bounds
+        width = (east - west) / size or 1.0
+        height = (north - south) / size or 1.0
+
+        tile_paths: Dict[Tuple[int, int], str] = {}
+        tile_files: Dict[Tuple[int, int], Any] = {}
+        tile_bounds: Dict[Tuple[int, int], Bounds] = {}
+        unplaced = []
+        try:
+            for line in spool:
+                feature_bounds, placemark = json.loads(line)
+                if feature_bounds is None:
+                    # No geometry to place it by: keep it outside the tiles
+                    unplaced.append(placemark)
+                    continue
+                cx = (feature_bounds[0] + feature_bounds[2]) / 2
+                cy = (feature_bounds[1] + feature_bounds[3]) / 2
+                cell = (min(int((north - cy) / height), size - 1), min(int((cx - west) / width), size - 1))
+                if cell not in tile_files:
+                    tile_paths[cell] = os.path.join(self.work_dir, f"{style.key}_tile_{cell[0]}_{cell[1]}.part")
+                    tile_files[cell] = open(tile_paths[cell], "w", encoding="utf-8")
+                tile_files[cell].write(placemark)
+                # A tile's region covers all of its placemarks, even where they cross the grid lines
+                tile_bounds[cell] = merge_bounds(tile_bounds.get(cell), tuple(feature_bounds))
+        finally:
+            for f in tile_files.values():
+                f.close()
+
+        for cell in sorted(tile_paths):
+            name = f"{layer.title} {cell[0] + 1}-{cell[1] + 1}"
+            region = kml_region(tile_bounds[cell])
+            with open(tile_paths[cell], encoding="utf-8") as placemarks:
+                if self.kmz:
+                    files_dir = os.path.join(self.work_dir, KMZ_FILES_DIR)
+                    os.makedirs(files_dir, exist_ok=True)
+                    href = f"{KMZ_FILES_DIR}/{style.key}_{cell[0] + 1}_{cell[1] + 1}.kml"
+                    head, tail = kml_document(name, "\0").split("\0")
+                    with open(os.path.join(self.work_dir, href), "w", encoding="utf-8") as tile:
+                        # Each tile carries the layer's styles; it is loaded on its own
+                        tile.write(head)
+                        tile.write(style.styles_xml())
+                        shutil.copyfileobj(placemarks, tile)
+                        tile.write(tail)
+                    folder.write(
+                        f"<NetworkLink><name>{escape(name)}</name>{region}"
+                        f"<Link><href>{escape(href)}</href><viewRefreshMode>onRegion</viewRefreshMode></Link></NetworkLink>"
+                    )
+                else:
+                    folder.write(f"<Folder><name>{escape(name)}</name>{region}")
+                    shutil.copyfileobj(placemarks, folder)
+                    folder.write("</Folder>")
+            os.remove(tile_paths[cell])
+        folder.write("".join(unplaced))
+        return len(tile_paths)
+
+    def _placemark(self, style: KmlLayerStyle, feature: Dict[str, Any], geometry: Optional[Dict[str, Any]]) -> str:
+        properties = feature["properties"]
+        name = properties.get(style.name_field) if style.name_field else None
+        if name is None:
+            name = feature["id"]
+        data = "".join(
+            f"<Data name={quoteattr(str(k))}><value>{escape('' if v is None else str(v))}</value></Data>"
+            for k, v in properties.items()
+        )
+        return (
+            f"<Placemark><name>{escape(str(name))}</name>"
+            f"<description>{escape(style.description(properties))}</description>"
+            f"<styleUrl>#{style.style_id(properties)}</styleUrl>"
+            f"<ExtendedData>{data}</ExtendedData>"
+            + (kml_geometry(geometry) if geometry else "")
+            + "</Placemark>"
+        )
+
+    def _lonlat(self, layer: ExportLayer, feature: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+        """A feature's geometry in WGS 84 longitude/latitude."""
+        geometry = feature.get("geometry")
+        srid = feature.get("srid")
+        if not geometry or srid in (None, 4326):
+            return geometry
+        if srid not in self._transformers:
+            if not PYPROJ_AVAILABLE:
+                raise ValueError(
+                    f"Export layer {layer.name} is in EPSG:{srid}; KML needs longitude/latitude, "
+                    "and reprojecting requires pyproj (pip install pyproj)"
+                )
+            self._transformers[srid] = Transformer.from_crs(srid, 4326, always_xy=True)
+        transformer = self._transformers[srid]
+
+        def walk(coordinates):
+            if coordinates and isinstance(coordinates[0], (int, float)):
+                x, y = transformer.transform(coordinates[0], coordinates[1])
+                return [x, y] + list(coordinates[2:3])
+            return [walk(c) for c in coordinates]
+
+        return {"type": geometry["type"], "coordinates": walk(geometry["coordinates"])}
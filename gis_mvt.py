@@ -0,0 +1,767 @@
+"""
+TerraFusion Platform - Vector Tile Writer
+
+This module provides the writer GIS exports use to tile layers into Mapbox
+Vector Tiles (MVT 2.1): either a z/x/y pyramid of .pbf files with a TileJSON
+metadata.json, delivered as one ZIP for static hosting, or an MBTiles
+container. Each export layer is a layer of the tiles, so the county web map
+can draw parcels, situs points and districts straight from the files,
+without a tiling service in between.
+
+How much detail a zoom level carries is set per layer under "mvt":
+minzoom/maxzoom, the properties to keep, a simplification tolerance and a
+minimum polygon area (both in tile units, 4096 to a tile side), with
+"zooms" overriding them from a zoom level up:
+
+    "mvt": {
+        "minzoom": 12, "maxzoom": 16,
+        "properties": ["parcel_number"],
+        "simplify": 2, "min_area": 4,
+        "zooms": {"15": {"properties": ["parcel_number", "owner_name"], "simplify": 0.5}}
+    }
+
+Polygons and lines are simplified along their shared boundaries (see
+gis_simplify), so neighboring parcels keep meeting without slivers at every
+zoom; "topology": false simplifies each feature on its own instead, which
+needs no spooling of the layer. Features are then clipped and staged in a
+temporary SQLite table; tiles are assembled from it when the writer is
+closed.
+"""
+
+import os
+import json
+import math
+import gzip
+import struct
+import sqlite3
+import tempfile
+import zipfile
+import logging
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Iterable, Tuple
+
+from gis_features import ExportLayer, Bounds, FeatureSpool, geometry_bounds, merge_bounds
+from gis_simplify import Topology
+
+try:
+    from pyproj import Transformer
+    PYPROJ_AVAILABLE = True
+except ImportError:
+    PYPROJ_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Tile side in tile units, and the margin clipped geometry keeps around a tile
+MVT_EXTENT = 4096
+DEFAULT_MVT_BUFFER = 64
+
+DEFAULT_MVT_MINZOOM = 10
+DEFAULT_MVT_MAXZOOM = 16
+MAX_MVT_ZOOM = 22
+
+# Polygon simplification tolerance, in tile units, unless configured
+DEFAULT_MVT_SIMPLIFY = 1.0
+
+# Latitude limit of Web Mercator
+MAX_MERCATOR_LATITUDE = 85.0511287798
+
+# MVT GeomType
+MVT_POINT = 1
+MVT_LINESTRING = 2
+MVT_POLYGON = 3
+
+# Staged tile features written per transaction
+MVT_BATCH_SIZE = 1000
+
+TILE_CONTAINERS = ["directory", "mbtiles"]
+
+
+class MvtLayerSettings:
+    """The tiling settings of a layer for each zoom level."""
+
+    def __init__(self, layer: ExportLayer):
+        """
+        Read a layer's "mvt" settings.
+
+        Args:
+            layer: Layer being tiled
+
+        Raises:
+            ValueError: If a setting is invalid
+        """
+        settings = layer.settings.get("mvt") or {}
+        self.layer_name = settings.get("layer_name") or layer.name
+        self.minzoom = self._zoom(layer, "minzoom", settings.get("minzoom", DEFAULT_MVT_MINZOOM))
+        self.maxzoom = self._zoom(layer, "maxzoom", settings.get("maxzoom", DEFAULT_MVT_MAXZOOM))
+        if self.minzoom > self.maxzoom:
+            raise ValueError(f"Layer {layer.name}: mvt minzoom is above maxzoom")
+        self.buffer = settings.get("buffer", DEFAULT_MVT_BUFFER)
+        if isinstance(self.buffer, bool) or not isinstance(self.buffer, int) or not 0 <= self.buffer <= MVT_EXTENT:
+            raise ValueError(f"Layer {layer.name}: mvt buffer must be 0 to {MVT_EXTENT} tile units")
+        self.topology = settings.get("topology", True)
+        if not isinstance(self.topology, bool):
+            raise ValueError(f"Layer {layer.name}: mvt topology must be true or false")
+
+        base = self._detail(layer, "mvt", settings)
+        overrides = []
+        for zoom, detail in (settings.get("zooms") or {}).items():
+            if not str(zoom).isdigit() or not isinstance(detail, dict):
+                raise ValueError(f"Layer {layer.name}: mvt zooms must map zoom levels to settings")
+            overrides.append((int(zoom), self._detail(layer, f"mvt zoom {zoom}", detail)))
+        overrides.sort(key=lambda o: o[0])
+
+        # Each zoom level takes the base settings plus the override of the nearest configured zoom at or below it
+        self.zooms: Dict[int, Dict[str, Any]] = {}
+        for zoom in range(self.minzoom, self.maxzoom + 1):
+            detail = dict(base)
+            for override_zoom, override in overrides:
+                if override_zoom <= zoom:
+                    detail.update(override)
+            self.zooms[zoom] = detail
+
+    @staticmethod
+    def _zoom(layer: ExportLayer, name: str, value: Any) -> int:
+        if isinstance(value, bool) or not isinstance(value, int) or not 0 <= value <= MAX_MVT_ZOOM:
+            raise ValueError(f"Layer {layer.name}: mvt {name} must be a zoom level from 0 to {MAX_MVT_ZOOM}")
+        return value
+
+    @staticmethod
+    def _detail(layer: ExportLayer, where: str, settings: Dict[str, Any]) -> Dict[str, Any]:
+        detail = {}
+        if "properties" in settings:
+            properties = settings["properties"]
+            if properties is not None and (not isinstance(properties, list) or not all(isinstance(p, str) for p in properties)):
+                raise ValueError(f"Layer {layer.name}: {where} properties must be a list of field names")
+            detail["properties"] = properties
+        for key in ("simplify", "min_area"):
+            if key in settings:
+                value = settings[key]
+                if isinstance(value, bool) or not isinstance(value, (int, float)) or value < 0:
+                    raise ValueError(f"Layer {layer.name}: {where} {key} must be a non-negative number of tile units")
+                detail[key] = float(value)
+        if where == "mvt":
+            detail.setdefault("properties", None)
+            detail.setdefault("simplify", DEFAULT_MVT_SIMPLIFY)
+            detail.setdefault("min_area", 0.0)
+        return detail
+
+
+def mercator(lon: float, lat: float) -> Tuple[float, float]:
+    """Web Mercator position of a point, from (0, 0) at the top left of the world to (1, 1)."""
+    lat = max(-MAX_MERCATOR_LATITUDE, min(MAX_MERCATOR_LATITUDE, lat))
+    sin_lat = math.sin(math.radians(lat))
+    return (lon + 180.0) / 360.0, 0.5 - math.log((1 + sin_lat) / (1 - sin_lat)) / (4 * math.pi)
+
+
+def ring_area(ring: List[Tuple[float, float]]) -> float:
+    """Signed area of an open ring; positive for clockwise rings on a y-down grid, as MVT wants exteriors."""
+    area = 0.0
+    for i in range(len(ring)):
+        x1, y1 = ring[i - 1]
+        x2, y2 = ring[i]
+        area += x1 * y2 - x2 * y1
+    return area / 2
+
+
+def simplify_line(points: List[Tuple[float, float]], tolerance: float) -> List[Tuple[float, float]]:
+    """Douglas-Peucker simplification keeping both ends."""
+    if tolerance <= 0 or len(points) < 3:
+        return points
+    keep = [False] * len(points)
+    keep[0] = keep[-1] = True
+    stack = [(0, len(points) - 1)]
+    squared = tolerance * tolerance
+    while stack:
+        first, last = stack.pop()
+        (x1, y1), (x2, y2) = points[first], points[last]
+        dx, dy = x2 - x1, y2 - y1
+        length = dx * dx + dy * dy
+        farthest, distance = None, squared
+        for i in range(first + 1, last):
+            px, py = points[i]
+            if length:
+                t = max(0.0, min(1.0, ((px - x1) * dx + (py - y1) * dy) / length))
+                ex, ey = px - (x1 + t * dx), py - (y1 + t * dy)
+            else:
+                ex, ey = px - x1, py - y1
+            d = ex * ex + ey * ey
+            if d > distance:
+                farthest, distance = i, d
+        if farthest is not None:
+            keep[farthest] = True
+            stack.append((first, farthest))
+            stack.append((farthest, last))
+    return [p for p, k in zip(points, keep) if k]
+
+
+def clip_ring(ring: List[Tuple[float, float]], low: float, high: float) -> List[Tuple[float, float]]:
+    """An open ring clipped to the square [low, high] (Sutherland-Hodgman)."""
+    for axis, bound, inside in ((0, low, lambda v: v >= low), (0, high, lambda v: v <= high),
+                                (1, low, lambda v: v >= low), (1, high, lambda v: v <= high)):
+        if not ring:
+            break
+        clipped = []
+        previous = ring[-1]
+        for point in ring:
+            if inside(point[axis]):
+                if not inside(previous[axis]):
+                    clipped.append(_intersect(previous, point, axis, bound))
+                clipped.append(point)
+            elif inside(previous[axis]):
+                clipped.append(_intersect(previous, point, axis, bound))
+            previous = point
+        ring = clipped
+    return ring
+
+
+def clip_line(line: List[Tuple[float, float]], low: float, high: float) -> List[List[Tuple[float, float]]]:
+    """The pieces of a line inside the square [low, high]."""
+    pieces, current = [], []
+    for a, b in zip(line, line[1:]):
+        segment = _clip_segment(a, b, low, high)
+        if segment is None:
+            if current:
+                pieces.append(current)
+                current = []
+            continue
+        start, end = segment
+        if not current:
+            current = [start]
+        elif current[-1] != start:
+            pieces.append(current)
+            current = [start]
+        current.append(end)
+        if end != b:
+            pieces.append(current)
+            current = []
+    if current:
+        pieces.append(current)
+    return [p for p in pieces if len(p) > 1]
+
+
+def _intersect(a: Tuple[float, float], b: Tuple[float, float], axis: int, bound: float) -> Tuple[float, float]:
+    t = (bound - a[axis]) / (b[axis] - a[axis])
+    if axis == 0:
+        return bound, a[1] + t * (b[1] - a[1])
+    return a[0] + t * (b[0] - a[0]), bound
+
+
+def _clip_segment(a, b, low: float, high: float):
+    """A segment clipped to the square (Liang-Barsky), or None outside it."""
+    t0, t1 = 0.0, 1.0
+    dx, dy = b[0] - a[0], b[1] - a[1]
+    for p, q in ((-dx, a[0] - low), (dx, high - a[0]), (-dy, a[1] - low), (dy, high - a[1])):
+        if p == 0:
+            if q < 0:
+                return None
+            continue
+        t = q / p
+        if p < 0:
+            t0 = max(t0, t)
+        else:
+            t1 = min(t1, t)
+        if t0 > t1:
+            return None
+    start = a if t0 == 0 else (a[0] + t0 * dx, a[1] + t0 * dy)
+    end = b if t1 == 1 else (a[0] + t1 * dx, a[1] + t1 * dy)
+    return start, end
+
+
+def _quantize(points: Iterable[Tuple[float, float]]) -> List[Tuple[int, int]]:
+    """Points rounded to the tile grid, without repeats."""
+    quantized = []
+    for x, y in points:
+        point = (int(round(x)), int(round(y)))
+        if not quantized or quantized[-1] != point:
+            quantized.append(point)
+    return quantized
+
+
+def _varint(value: int) -> bytes:
+    data = bytearray()
+    while True:
+        byte = value & 0x7F
+        value >>= 7
+        if value:
+            data.append(byte | 0x80)
+        else:
+            data.append(byte)
+            return bytes(data)
+
+
+def _zigzag(value: int) -> int:
+    return value << 1 if value >= 0 else (-value << 1) - 1
+
+
+def _field(number: int, data: bytes) -> bytes:
+    """A length-delimited protobuf field."""
+    return _varint(number << 3 | 2) + _varint(len(data)) + data
+
+
+def encode_geometry(kind: int, parts: List[List[Tuple[int, int]]]) -> bytes:
+    """
+    MVT geometry commands (packed varints) for points, lines or polygon rings.
+
+    Args:
+        kind: MVT_POINT, MVT_LINESTRING or MVT_POLYGON
+        parts: One list of points per point group, line or ring (rings open)
+    """
+    commands = []
+    x = y = 0
+
+    def moves(points):
+        nonlocal x, y
+        for px, py in points:
+            commands.append(_zigzag(px - x))
+            commands.append(_zigzag(py - y))
+            x, y = px, py
+
+    if kind == MVT_POINT:
+        points = [p for part in parts for p in part]
+        commands.append(1 | len(points) << 3)
+        moves(points)
+    else:
+        for part in parts:
+            commands.append(1 | 1 << 3)
+            moves(part[:1])
+            commands.append(2 | (len(part) - 1) << 3)
+            moves(part[1:])
+            if kind == MVT_POLYGON:
+                commands.append(7 | 1 << 3)
+    return b"".join(_varint(c) for c in commands)
+
+
+def mvt_value(value: Any) -> bytes:
+    """A property value as an MVT Value message."""
+    if isinstance(value, bool):
+        return _varint(7 << 3) + _varint(int(value))
+    if isinstance(value, int) and -(1 << 63) <= value < (1 << 63):
+        return _varint(6 << 3) + _varint(_zigzag(value))
+    if isinstance(value, (int, float)):
+        return _varint(3 << 3 | 1) + struct.pack("<d", float(value))
+    return _field(1, str(value).encode("utf-8"))
+
+
+def _property_value(value: Any) -> Any:
+    """A property value as tiles store it: a boolean, number or string."""
+    if isinstance(value, (bool, int, float, str)):
+        return value
+    if isinstance(value, Decimal):
+        return float(value)
+    if isinstance(value, (date, datetime)):
+        return value.isoformat()
+    if isinstance(value, (dict, list)):
+        return json.dumps(value, default=str)
+    if isinstance(value, (bytes, bytearray)):
+        return bytes(value).hex()
+    return str(value)
+
+
+def mercator_shapes(geometry: Dict[str, Any]) -> Tuple[int, List[List[List[Tuple[float, float]]]]]:
+    """
+    The MVT type of a geometry and its shapes in normalized Web Mercator:
+    one list of point groups, lines or rings (exterior first) per shape.
+    """
+    kind, coordinates = geometry["type"], geometry["coordinates"]
+    project = lambda points: [mercator(p[0], p[1]) for p in points]
+    if kind == "Point":
+        return MVT_POINT, [[project([coordinates])]]
+    if kind == "MultiPoint":
+        return MVT_POINT, [[project(coordinates)]]
+    if kind == "LineString":
+        return MVT_LINESTRING, [[project(coordinates)]]
+    if kind == "MultiLineString":
+        return MVT_LINESTRING, [[project(line) for line in coordinates]]
+    if kind == "Polygon":
+        return MVT_POLYGON, [[project(ring[:-1]) for ring in coordinates]]
+    if kind == "MultiPolygon":
+        return MVT_POLYGON, [[project(ring[:-1]) for ring in polygon] for polygon in coordinates]
+    raise ValueError(f"Unsupported geometry type: {kind}")
+
+
+def tile_geometry(kind: int, shapes: List[List[List[Tuple[float, float]]]], zoom: int, detail: Dict[str, Any],
+                  buffer: int, only: Optional[Tuple[int, int]] = None) -> Optional[List[Tuple[Tuple[int, int], bytes]]]:
+    """
+    A feature's geometry at one zoom level, clipped to each tile it meets
+    (or only to the tile given); None when a polygon is below the zoom's
+    min_area.
+    """
+    scale = MVT_EXTENT * (1 << zoom)
+    world = [[[(x * scale, y * scale) for x, y in part] for part in shape] for shape in shapes]
+    if kind == MVT_POLYGON:
+        if detail["min_area"] and sum(abs(ring_area(shape[0])) for shape in world if shape) < detail["min_area"]:
+            return None
+        world = [[simplify_line(ring + ring[:1], detail["simplify"])[:-1] for ring in shape] for shape in world]
+    elif kind == MVT_LINESTRING:
+        world = [[simplify_line(line, detail["simplify"]) for line in shape] for shape in world]
+
+    points = [p for shape in world for part in shape for p in part]
+    if not points:
+        return []
+    last = (1 << zoom) - 1
+    first_x = max(0, int(math.floor((min(p[0] for p in points) - buffer) / MVT_EXTENT)))
+    last_x = min(last, int(math.floor((max(p[0] for p in points) + buffer) / MVT_EXTENT)))
+    first_y = max(0, int(math.floor((min(p[1] for p in points) - buffer) / MVT_EXTENT)))
+    last_y = min(last, int(math.floor((max(p[1] for p in points) + buffer) / MVT_EXTENT)))
+    if only is not None:
+        first_x, last_x = max(first_x, only[0]), min(last_x, only[0])
+        first_y, last_y = max(first_y, only[1]), min(last_y, only[1])
+
+    tiles = []
+    low, high = -buffer, MVT_EXTENT + buffer
+    for tx in range(first_x, last_x + 1):
+        for ty in range(first_y, last_y + 1):
+            ox, oy = tx * MVT_EXTENT, ty * MVT_EXTENT
+            parts = []
+            for shape in world:
+                local = [[(x - ox, y - oy) for x, y in part] for part in shape]
+                if kind == MVT_POINT:
+                    parts.append(_quantize(p for p in local[0] if low <= p[0] <= high and low <= p[1] <= high))
+                elif kind == MVT_LINESTRING:
+                    for line in local:
+                        parts.extend(piece for piece in (_quantize(p) for p in clip_line(line, low, high)) if len(piece) > 1)
+                else:
+                    rings = []
+                    for i, ring in enumerate(local):
+                        ring = _quantize(clip_ring(ring, low, high))
+                        if len(ring) > 1 and ring[0] == ring[-1]:
+                            ring.pop()
+                        area = ring_area(ring) if len(ring) > 2 else 0
+                        if not area:
+                            if i == 0:
+                                break
+                            continue
+                        # Exteriors clockwise (positive area), holes counterclockwise
+                        if (area > 0) != (i == 0):
+                            ring.reverse()
+                        rings.append(ring)
+                    parts.extend(rings)
+            parts = [p for p in parts if p]
+            if parts:
+                tiles.append(((tx, ty), encode_geometry(kind, parts)))
+    return tiles
+
+
+def encode_tile(layers: List[Tuple[str, List[Tuple]]]) -> bytes:
+    """
+    Encode a tile from its layers: (name, features) pairs, each feature an
+    (id, type, encoded geometry, [[key, value], ...]) tuple.
+    """
+    data = bytearray()
+    for name, features in layers:
+        keys: Dict[str, int] = {}
+        values: Dict[Tuple[str, Any], int] = {}
+        encoded = bytearray()
+        for feature_id, kind, geometry, properties in features:
+            tags = []
+            for key, value in properties:
+                tags.append(keys.setdefault(key, len(keys)))
+                tags.append(values.setdefault((type(value).__name__, value), len(values)))
+            feature = bytearray()
+            if feature_id is not None:
+                feature += _varint(1 << 3) + _varint(feature_id)
+            if tags:
+                feature += _field(2, b"".join(_varint(t) for t in tags))
+            feature += _varint(3 << 3) + _varint(kind)
+            feature += _field(4, geometry)
+            encoded += _field(2, bytes(feature))
+        layer = bytearray(_varint(15 << 3) + _varint(2))
+        layer += _field(1, name.encode("utf-8"))
+        layer += encoded
+        for key in keys:
+            layer += _field(3, key.encode("utf-8"))
+        for _, value in values:
+            layer += _field(4, mvt_value(value))
+        layer += _varint(5 << 3) + _varint(MVT_EXTENT)
+        data += _field(3, bytes(layer))
+    return bytes(data)
+
+
+def tile_properties(properties: Dict[str, Any], detail: Dict[str, Any]) -> List[List[Any]]:
+    """A feature's properties as the [key, value] pairs a zoom level keeps."""
+    if detail["properties"] is not None:
+        properties = {k: properties[k] for k in detail["properties"] if k in properties}
+    return [[k, _property_value(v)] for k, v in properties.items() if v is not None]
+
+
+def tile_feature_id(feature: Dict[str, Any]) -> Optional[int]:
+    """The feature's key as an MVT id, when it is a single non-negative integer."""
+    try:
+        key = json.loads(feature.get("id") or "null")
+    except (TypeError, ValueError):
+        return None
+    if isinstance(key, list) and len(key) == 1:
+        key = key[0]
+    if isinstance(key, int) and not isinstance(key, bool) and 0 <= key < (1 << 64):
+        return key
+    return None
+
+
+class MvtWriter:
+    """Tiles feature layers into a vector tile pyramid or an MBTiles file."""
+
+    def __init__(self, path: str, title: str, container: str = "mbtiles"):
+        """
+        Initialize the writer.
+
+        Args:
+            path: File to create: a ZIP of the z/x/y pyramid, or an MBTiles database
+            title: Tileset name
+            container: "directory" (the ZIP pyramid) or "mbtiles"
+        """
+        if container not in TILE_CONTAINERS:
+            raise ValueError(f"Unsupported tile container: {container}. Supported: {', '.join(TILE_CONTAINERS)}")
+        self.path = path
+        self.title = title
+        self.container = container
+        self.layers: List[Dict[str, Any]] = []
+        self.bounds: Optional[Bounds] = None
+        self.tileset: Optional[Dict[str, Any]] = None
+        self._transformers = {}
+        handle, self._work_path = tempfile.mkstemp(prefix="tf_mvt_", suffix=".sqlite")
+        os.close(handle)
+        self._work = sqlite3.connect(self._work_path)
+        self._work.execute(
+            "CREATE TABLE tile_features (z INTEGER, x INTEGER, y INTEGER, layer INTEGER, "
+            "id INTEGER, type INTEGER, geometry BLOB, properties TEXT)"
+        )
+
+    def add_layer(self, layer: ExportLayer, features: Iterable[Dict[str, Any]]) -> Dict[str, Any]:
+        """
+        Tile a layer at each of its zoom levels.
+
+        Args:
+            layer: Layer being tiled
+            features: Features of the layer (see gis_features)
+
+        Returns:
+            Summary: features, tile_features (feature pieces written to tiles),
+            dropped (features too small for some zoom), minzoom and maxzoom
+        """
+        settings = MvtLayerSettings(layer)
+        layer_index = len(self.layers)
+        fields: Dict[str, str] = {}
+        count = pieces = dropped = 0
+        batch = []
+        for feature, geometry, kind, zoom_shapes in self._shapes(layer, features, settings):
+            count += 1
+            if not geometry:
+                continue
+            self.bounds = merge_bounds(self.bounds, geometry_bounds(geometry))
+            feature_id = tile_feature_id(feature)
+            too_small = False
+            for zoom, detail in settings.zooms.items():
+                properties = tile_properties(feature["properties"], detail)
+                for key, value in properties:
+                    fields[key] = (
+                        "Boolean" if isinstance(value, bool) else "Number" if isinstance(value, (int, float)) else "String"
+                    )
+                shapes, simplified = zoom_shapes(zoom)
+                tiles = tile_geometry(kind, shapes, zoom, dict(detail, simplify=0.0) if simplified else detail, settings.buffer)
+                if tiles is None:
+                    too_small = True
+                    continue
+                text = json.dumps(properties)
+                for (x, y), geometry_data in tiles:
+                    batch.append((zoom, x, y, layer_index, feature_id, kind, geometry_data, text))
+                    pieces += 1
+            dropped += too_small
+            if len(batch) >= MVT_BATCH_SIZE:
+                self._stage(batch)
+                batch = []
+        self._stage(batch)
+
+        self.layers.append({
+            "id": settings.layer_name,
+            "title": layer.title,
+            "fields": fields,
+            "minzoom": settings.minzoom,
+            "maxzoom": settings.maxzoom,
+        })
+        logger.info(f"Tiled {count} features of layer {layer.name} into {pieces} tile features "
+                    f"at zoom {settings.minzoom}-{settings.maxzoom}")
+        return {
+            "features": count,
+            "tile_features": pieces,
+            "dropped": dropped,
+            "minzoom": settings.minzoom,
+            "maxzoom": settings.maxzoom,
+        }
+
+    def close(self) -> Dict[str, Any]:
+        """
+        Assemble the tiles and write the pyramid or MBTiles file.
+
+        Returns:
+            Summary of the tileset: tiles, minzoom, maxzoom, bounds
+        """
+        if self.tileset is not None:
+            return self.tileset
+        try:
+            minzoom = min((l["minzoom"] for l in self.layers), default=0)
+            maxzoom = max((l["maxzoom"] for l in self.layers), default=0)
+            bounds = list(self.bounds) if self.bounds else [-180.0, -85.0511, 180.0, 85.0511]
+            vector_layers = [
+                {"id": l["id"], "description": l["title"], "fields": l["fields"], "minzoom": l["minzoom"], "maxzoom": l["maxzoom"]}
+                for l in self.layers
+            ]
+            center = [(bounds[0] + bounds[2]) / 2, (bounds[1] + bounds[3]) / 2, minzoom]
+
+            if self.container == "mbtiles":
+                if os.path.exists(self.path):
+                    os.remove(self.path)
+                out = sqlite3.connect(self.path)
+                out.execute("CREATE TABLE metadata (name TEXT, value TEXT)")
+                out.execute("CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB)")
+                metadata = {
+                    "name": self.title, "format": "pbf", "type": "overlay", "version": "1",
+                    "minzoom": str(minzoom), "maxzoom": str(maxzoom),
+                    "bounds": ",".join(str(v) for v in bounds), "center": ",".join(str(v) for v in center),
+                    "json": json.dumps({"vector_layers": vector_layers}),
+                }
+                out.executemany("INSERT INTO metadata VALUES (?, ?)", metadata.items())
+                tiles = 0
+                for (z, x, y), data in self._tiles():
+                    # MBTiles rows count from the bottom (TMS)
+                    out.execute("INSERT INTO tiles VALUES (?, ?, ?, ?)", (z, x, (1 << z) - 1 - y, gzip.compress(data)))
+                    tiles += 1
+                out.execute("CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row)")
+                out.commit()
+                out.close()
+            else:
+                tiles = 0
+                with zipfile.ZipFile(self.path, "w", zipfile.ZIP_DEFLATED) as archive:
+                    for (z, x, y), data in self._tiles():
+                        archive.writestr(f"{z}/{x}/{y}.pbf", data)
+                        tiles += 1
+                    archive.writestr("metadata.json", json.dumps({
+                        "tilejson": "3.0.0", "name": self.title, "tiles": ["{z}/{x}/{y}.pbf"],
+                        "minzoom": minzoom, "maxzoom": maxzoom, "bounds": bounds, "center": center,
+                        "vector_layers": vector_layers,
+                    }, indent=2))
+        finally:
+            self._discard()
+
+        self.tileset = {"tiles": tiles, "minzoom": minzoom, "maxzoom": maxzoom, "bounds": bounds}
+        logger.info(f"Wrote {tiles} vector tiles to {self.path}")
+        return self.tileset
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        if exc_type is None:
+            self.close()
+        else:
+            self._discard()
+
+    def _discard(self) -> None:
+        """Remove the staging database."""
+        if self._work is not None:
+            self._work.close()
+            self._work = None
+            os.remove(self._work_path)
+
+    def _stage(self, batch: List[Tuple]) -> None:
+        if batch:
+            self._work.executemany("INSERT INTO tile_features VALUES (?, ?, ?, ?, ?, ?, ?, ?)", batch)
+            self._work.commit()
+
+    def _tiles(self):
+        """(z, x, y) and encoded tile of every tile holding features."""
+        rows = self._work.execute(
+            "SELECT z, x, y, layer, id, type, geometry, properties FROM tile_features ORDER BY z, x, y, layer, rowid"
+        )
+        tile, layers = None, {}
+        for z, x, y, layer, feature_id, kind, geometry, properties in rows:
+            if (z, x, y) != tile:
+                if tile is not None:
+                    yield tile, self._encode_tile(layers)
+                tile, layers = (z, x, y), {}
+            layers.setdefault(layer, []).append((feature_id, kind, geometry, json.loads(properties)))
+        if tile is not None:
+            yield tile, self._encode_tile(layers)
+
+    def _encode_tile(self, layers: Dict[int, List[Tuple]]) -> bytes:
+        return encode_tile([(self.layers[index]["id"], features) for index, features in layers.items()])
+
+    def _shapes(self, layer: ExportLayer, features: Iterable[Dict[str, Any]], settings: MvtLayerSettings):
+        """
+        Yield each feature with its longitude/latitude geometry, MVT type and
+        a function giving its shapes at a zoom level, and whether they are
+        simplified already.
+
+        With topology on, the layer is spooled and its boundaries simplified
+        together for each zoom level's tolerance before any feature is tiled.
+        """
+        if not settings.topology:
+            for feature in features:
+                geometry = self._lonlat(layer, feature)
+                kind, shapes = mercator_shapes(geometry) if geometry else (None, None)
+                yield feature, geometry, kind, lambda zoom, shapes=shapes: (shapes, False)
+            return
+
+        topology = Topology()
+        with FeatureSpool() as spool:
+            for feature in features:
+                geometry = self._lonlat(layer, feature)
+                if geometry:
+                    kind, shapes = mercator_shapes(geometry)
+                    if kind != MVT_POINT:
+                        for shape in shapes:
+                            topology.add(shape, kind == MVT_POLYGON)
+                spool.append(dict(feature, geometry=geometry))
+
+            # One simplification per distinct tolerance, in the normalized Mercator units of mercator_shapes
+            simplifications = {}
+            by_zoom = {}
+            for zoom, detail in settings.zooms.items():
+                tolerance = detail["simplify"] / (MVT_EXTENT * (1 << zoom))
+                if tolerance not in simplifications:
+                    simplification = topology.simplification(tolerance)
+                    for feature in spool:
+                        if feature["geometry"]:
+                            kind, shapes = mercator_shapes(feature["geometry"])
+                            if kind != MVT_POINT:
+                                for shape in shapes:
+                                    simplification.prepare(shape, kind == MVT_POLYGON)
+                    simplifications[tolerance] = simplification
+                by_zoom[zoom] = simplifications[tolerance]
+
+            for feature in spool:
+                geometry = feature["geometry"]
+                if not geometry:
+                    yield feature, None, None, None
+                    continue
+                kind, shapes = mercator_shapes(geometry)
+                if kind == MVT_POINT:
+                    yield feature, geometry, kind, lambda zoom, shapes=shapes: (shapes, False)
+                    continue
+                closed = kind == MVT_POLYGON
+                yield feature, geometry, kind, lambda zoom, shapes=shapes, closed=closed: (
+                    [by_zoom[zoom].parts(shape, closed) for shape in shapes], True)
+
+    def _lonlat(self, layer: ExportLayer, feature: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+        """A feature's geometry in WGS 84 longitude/latitude."""
+        geometry = feature.get("geometry")
+        srid = feature.get("srid")
+        if not geometry or srid in (None, 4326):
+            return geometry
+        if srid not in self._transformers:
+            if not PYPROJ_AVAILABLE:
+                raise ValueError(
+                    f"Export layer {layer.name} is in EPSG:{srid}; vector tiles need longitude/latitude, "
+                    "and reprojecting requires pyproj (pip install pyproj)"
+                )
+            self._transformers[srid] = Transformer.from_crs(srid, 4326, always_xy=True)
+        transformer = self._transformers[srid]
+
+        def walk(coordinates):
+            if coordinates and isinstance(coordinates[0], (int, float)):
+                return list(transformer.transform(coordinates[0], coordinates[1]))
+            return [walk(c) for c in coordinates]
+
+        return {"type": geometry["type"], "coordinates": walk(geometry["coordinates"])}
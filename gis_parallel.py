@@ -0,0 +1,140 @@
+"""
+TerraFusion Platform - Parallel Geometry Stage
+
+This module runs the CPU-bound geometry work of feature exports (spatial
+filter tests, reprojection and arc simplification) on worker processes, since
+threads of one interpreter take turns at Python code. A stage forks its
+workers once what they need is built (a reprojector's transforms, a layer's
+frozen topology), so they inherit it instead of being sent it; items go out in
+chunks of GIS_GEOMETRY_CHUNK_ITEMS and results come back in input order, with
+at most two chunks per worker in flight, so a stage holds a few chunks rather
+than the layer.
+
+GIS_GEOMETRY_WORKERS (the number of CPUs by default) caps the worker
+processes of every export of the process together: a stage takes the workers
+free when it starts, and runs on its export's own thread when fewer than two
+are, when the layer is smaller than one chunk, or where processes cannot be
+forked. 0 or 1 runs every stage on its export's thread.
+"""
+
+import os
+import uuid
+import logging
+import threading
+import multiprocessing
+from collections import deque
+from concurrent.futures import ProcessPoolExecutor
+from itertools import chain, islice
+from typing import Dict, List, Any, Callable, Iterable, Iterator, Tuple
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Worker processes all geometry stages of the process may use at once
+GEOMETRY_WORKERS = int(os.environ.get("GIS_GEOMETRY_WORKERS") or os.cpu_count() or 1)
+
+# Items sent to a worker at a time
+GEOMETRY_CHUNK_ITEMS = max(1, int(os.environ.get("GIS_GEOMETRY_CHUNK_ITEMS", "200")))
+
+# Chunks in flight per worker
+CHUNKS_PER_WORKER = 2
+
+# Workers inherit the stage's state, which only forking gives them
+FORK_AVAILABLE = "fork" in multiprocessing.get_all_start_methods()
+
+_free_workers = GEOMETRY_WORKERS
+_free_workers_lock = threading.Lock()
+
+# Functions of the running stages, by token; forked workers inherit them
+_functions: Dict[str, Callable[[Any], Any]] = {}
+
+
+def parallel_enabled() -> bool:
+    """Whether stages can run on worker processes at all."""
+    return FORK_AVAILABLE and GEOMETRY_WORKERS >= 2
+
+
+def _run_chunk(token: str, chunk: List[Any]) -> List[Any]:
+    """Apply a stage's function to a chunk, in a worker."""
+    function = _functions[token]
+    return [function(item) for item in chunk]
+
+
+def _take_workers(wanted: int) -> int:
+    global _free_workers
+    with _free_workers_lock:
+        taken = min(wanted, _free_workers)
+        if taken < 2:
+            return 0
+        _free_workers -= taken
+        return taken
+
+
+def _release_workers(count: int) -> None:
+    global _free_workers
+    with _free_workers_lock:
+        _free_workers += count
+
+
+class GeometryStage:
+    """One geometry step of an export layer, run over its features in worker processes when it can."""
+
+    def __init__(self, name: str):
+        """
+        Initialize the stage.
+
+        Args:
+            name: What the stage does, for the log and the job summary
+        """
+        self.name = name
+        self.workers = 0
+        self.chunks = 0
+        self.items = 0
+
+    def map(self, function: Callable[[Any], Any], items: Iterable[Any]) -> Iterator[Tuple[Any, Any]]:
+        """
+        Yield each item with the function's result for it, in the order of the items.
+
+        The function runs in forked workers, so what it reads must be set up
+        before the first item is taken; what it changes stays in the workers.
+        Exceptions it raises are raised here.
+        """
+        iterator = iter(items)
+        first = list(islice(iterator, GEOMETRY_CHUNK_ITEMS))
+        workers = (_take_workers(GEOMETRY_WORKERS)
+                   if FORK_AVAILABLE and len(first) == GEOMETRY_CHUNK_ITEMS else 0)
+        if not workers:
+            for item in chain(first, iterator):
+                self.items += 1
+                yield item, function(item)
+            return
+
+        self.workers = workers
+        token = uuid.uuid4().hex
+        _functions[token] = function
+        executor = ProcessPoolExecutor(workers, mp_context=multiprocessing.get_context("fork"))
+        logger.info(f"Running {self.name} on {workers} worker processes")
+        try:
+            pending = deque()
+            chunks = chain([first], iter(lambda: list(islice(iterator, GEOMETRY_CHUNK_ITEMS)), []))
+            for chunk in chunks:
+                pending.append((chunk, executor.submit(_run_chunk, token, chunk)))
+                self.chunks += 1
+                if len(pending) >= workers * CHUNKS_PER_WORKER:
+                    yield from self._results(*pending.popleft())
+            while pending:
+                yield from self._results(*pending.popleft())
+        finally:
+            executor.shutdown(wait=True, cancel_futures=True)
+            _functions.pop(token, None)
+            _release_workers(workers)
+
+    def summary(self) -> Dict[str, Any]:
+        """How the stage ran, for the export job."""
+        return {"workers": self.workers, "chunks": self.chunks, "items": self.items}
+
+    def _results(self, chunk: List[Any], future) -> Iterator[Tuple[Any, Any]]:
+        results = future.result()
+        self.items += len(chunk)
+        yield from zip(chunk, results)
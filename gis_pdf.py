@@ -0,0 +1,314 @@
+"""
+TerraFusion Platform - PDF Writer
+
+This module provides a small PDF 1.4 writer for the reports the platform
+renders: pages of text in the standard Helvetica fonts, lines, rectangles
+and filled polygons, with a bookmark per page so a packet of reports can be
+navigated by parcel. Pages are written to the output as they are added,
+so large batches never hold more than one page in memory.
+
+Coordinates are PDF points (1/72 inch) from the bottom left corner of the
+page. Text is encoded as Windows-1252; characters outside it print as "?".
+"""
+
+import zlib
+import logging
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Tuple, Sequence, BinaryIO
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# US Letter, portrait
+LETTER = (612.0, 792.0)
+
+# Advance widths (1/1000 em) of characters 32-126 in Helvetica and Helvetica-Bold
+HELVETICA_WIDTHS = [
+    278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+    556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+    1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+    667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+    333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+    556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+]
+HELVETICA_BOLD_WIDTHS = [
+    278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+    556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+    975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+    667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+    333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+    611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+]
+
+# Width assumed for characters outside the tables above
+DEFAULT_CHARACTER_WIDTH = 556
+
+# Object numbers of the objects every document has; pages and bookmarks follow
+CATALOG_OBJECT, PAGES_OBJECT, FONT_OBJECT, BOLD_FONT_OBJECT, INFO_OBJECT = 1, 2, 3, 4, 5
+FIRST_FREE_OBJECT = 6
+
+Color = Tuple[float, float, float]
+
+
+def pdf_color(value: Any) -> Optional[Color]:
+    """
+    A color as RGB fractions, from a "#rrggbb" string or an RGB tuple (0-1).
+
+    Raises:
+        ValueError: If the color cannot be read
+    """
+    if value is None:
+        return None
+    if isinstance(value, str):
+        text = value.lstrip("#")
+        if len(text) != 6:
+            raise ValueError(f"Colors are written #rrggbb, not {value}")
+        try:
+            return tuple(int(text[i:i + 2], 16) / 255 for i in (0, 2, 4))
+        except ValueError:
+            raise ValueError(f"Colors are written #rrggbb, not {value}")
+    return tuple(float(c) for c in value)
+
+
+def pdf_string(text: str) -> bytes:
+    """Text as a PDF literal string."""
+    data = str(text).encode("cp1252", errors="replace")
+    return b"(" + data.replace(b"\\", b"\\\\").replace(b"(", b"\\(").replace(b")", b"\\)") + b")"
+
+
+def text_width(text: str, size: float, bold: bool = False) -> float:
+    """The width of text set in Helvetica (or Helvetica-Bold) at a size, in points."""
+    widths = HELVETICA_BOLD_WIDTHS if bold else HELVETICA_WIDTHS
+    total = 0
+    for char in str(text):
+        code = ord(char)
+        total += widths[code - 32] if 32 <= code <= 126 else DEFAULT_CHARACTER_WIDTH
+    return total * size / 1000
+
+
+def fit_text(text: str, width: float, size: float, bold: bool = False) -> str:
+    """Text shortened with "..." to fit a width."""
+    text = str(text)
+    if text_width(text, size, bold) <= width:
+        return text
+    while text and text_width(text + "...", size, bold) > width:
+        text = text[:-1]
+    return text.rstrip() + "..."
+
+
+def _number(value: float) -> str:
+    return f"{value:.2f}".rstrip("0").rstrip(".") if value != int(value) else str(int(value))
+
+
+class PdfPage:
+    """The drawing operations of one page, collected until it is added to a writer."""
+
+    def __init__(self, size: Tuple[float, float] = LETTER):
+        self.width, self.height = size
+        self.operations: List[str] = []
+
+    def text(self, x: float, y: float, text: str, size: float = 10, bold: bool = False,
+             align: str = "left", color: Any = None) -> None:
+        """
+        Draw a line of text with its baseline at y.
+
+        Args:
+            align: "left", "right" or "center": where x is on the text
+        """
+        if align == "right":
+            x -= text_width(text, size, bold)
+        elif align == "center":
+            x -= text_width(text, size, bold) / 2
+        fill = pdf_color(color) or (0, 0, 0)
+        font = "F2" if bold else "F1"
+        self.operations.append(
+            f"BT {self._rgb(fill, 'rg')} /{font} {_number(size)} Tf {_number(x)} {_number(y)} Td "
+            f"{pdf_string(text).decode('latin-1')} Tj ET"
+        )
+
+    def line(self, x1: float, y1: float, x2: float, y2: float, width: float = 0.5,
+             color: Any = None, dash: Optional[Sequence[float]] = None) -> None:
+        """Draw a straight line."""
+        self.operations.append(
+            f"q {self._stroke(color, width, dash)} {_number(x1)} {_number(y1)} m {_number(x2)} {_number(y2)} l S Q"
+        )
+
+    def rect(self, x: float, y: float, width: float, height: float, stroke: Any = None, fill: Any = None,
+             line_width: float = 0.5, dash: Optional[Sequence[float]] = None) -> None:
+        """Draw a rectangle from its bottom left corner, stroked, filled or both."""
+        path = f"{_number(x)} {_number(y)} {_number(width)} {_number(height)} re"
+        self._paint(path, stroke, fill, line_width, dash)
+
+    def polygon(self, rings: List[List[Tuple[float, float]]], stroke: Any = None, fill: Any = None,
+                line_width: float = 0.5) -> None:
+        """Draw a polygon from its rings (page coordinates); holes are left unfilled."""
+        parts = []
+        for ring in rings:
+            if len(ring) < 2:
+                continue
+            (x, y), rest = ring[0], ring[1:]
+            parts.append(f"{_number(x)} {_number(y)} m " + " ".join(f"{_number(px)} {_number(py)} l" for px, py in rest) + " h")
+        if parts:
+            self._paint(" ".join(parts), stroke, fill, line_width, None, even_odd=True)
+
+    def polyline(self, points: List[Tuple[float, float]], width: float = 0.5, color: Any = None) -> None:
+        """Draw an open line through points (page coordinates)."""
+        if len(points) < 2:
+            return
+        (x, y), rest = points[0], points[1:]
+        path = f"{_number(x)} {_number(y)} m " + " ".join(f"{_number(px)} {_number(py)} l" for px, py in rest)
+        self.operations.append(f"q {self._stroke(color, width, None)} {path} S Q")
+
+    def begin_clip(self, x: float, y: float, width: float, height: float) -> None:
+        """Limit drawing to a rectangle until end_clip()."""
+        self.operations.append(f"q {_number(x)} {_number(y)} {_number(width)} {_number(height)} re W n")
+
+    def end_clip(self) -> None:
+        self.operations.append("Q")
+
+    def content(self) -> bytes:
+        return "\n".join(self.operations).encode("latin-1")
+
+    def _paint(self, path: str, stroke: Any, fill: Any, line_width: float,
+               dash: Optional[Sequence[float]], even_odd: bool = False) -> None:
+        stroke, fill = pdf_color(stroke), pdf_color(fill)
+        if stroke is None and fill is None:
+            return
+        state = []
+        if stroke is not None:
+            state.append(self._stroke(stroke, line_width, dash))
+        if fill is not None:
+            state.append(self._rgb(fill, "rg"))
+        if stroke is not None and fill is not None:
+            paint = "B*" if even_odd else "B"
+        elif fill is not None:
+            paint = "f*" if even_odd else "f"
+        else:
+            paint = "S"
+        self.operations.append(f"q {' '.join(state)} {path} {paint} Q")
+
+    def _stroke(self, color: Any, width: float, dash: Optional[Sequence[float]]) -> str:
+        state = f"{self._rgb(pdf_color(color) or (0, 0, 0), 'RG')} {_number(width)} w"
+        if dash:
+            state += " [" + " ".join(_number(d) for d in dash) + "] 0 d"
+        return state
+
+    @staticmethod
+    def _rgb(color: Color, operator: str) -> str:
+        return " ".join(_number(round(c, 3)) for c in color) + f" {operator}"
+
+
+class PdfWriter:
+    """Writes a PDF document to a binary stream, a page at a time."""
+
+    def __init__(self, stream: BinaryIO, title: Optional[str] = None, author: Optional[str] = None):
+        """
+        Initialize the writer and write the file header.
+
+        Args:
+            stream: Binary file (or buffer) to write to
+            title: Document title, shown by viewers
+            author: Document author
+        """
+        self.stream = stream
+        self.title = title
+        self.author = author
+        self.pages: List[int] = []
+        self._bookmarks: List[Tuple[str, int]] = []
+        self._offsets: Dict[int, int] = {}
+        self._position = 0
+        self._next_object = FIRST_FREE_OBJECT
+        self._write(b"%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        if exc_type is None:
+            self.close()
+
+    def add_page(self, page: PdfPage, bookmark: Optional[str] = None) -> int:
+        """
+        Write a page.
+
+        Args:
+            page: Page to write
+            bookmark: Title of the page's entry in the document outline
+
+        Returns:
+            The page number (from 1)
+        """
+        content_object, page_object = self._allocate(), self._allocate()
+        data = zlib.compress(page.content())
+        self._object(content_object, f"<< /Length {len(data)} /Filter /FlateDecode >>\nstream\n".encode("latin-1")
+                     + data + b"\nendstream")
+        self._object(page_object, (
+            f"<< /Type /Page /Parent {PAGES_OBJECT} 0 R /MediaBox [0 0 {_number(page.width)} {_number(page.height)}] "
+            f"/Resources << /Font << /F1 {FONT_OBJECT} 0 R /F2 {BOLD_FONT_OBJECT} 0 R >> >> "
+            f"/Contents {content_object} 0 R >>"
+        ).encode("latin-1"))
+        self.pages.append(page_object)
+        if bookmark:
+            self._bookmarks.append((bookmark, page_object))
+        return len(self.pages)
+
+    def close(self) -> None:
+        """Write the page tree, outline, document information and cross-reference table."""
+        if not self.pages:
+            # A PDF needs at least one page
+            self.add_page(PdfPage())
+        kids = " ".join(f"{number} 0 R" for number in self.pages)
+        self._object(PAGES_OBJECT, f"<< /Type /Pages /Kids [{kids}] /Count {len(self.pages)} >>".encode("latin-1"))
+        for number, name in ((FONT_OBJECT, "Helvetica"), (BOLD_FONT_OBJECT, "Helvetica-Bold")):
+            self._object(number, f"<< /Type /Font /Subtype /Type1 /BaseFont /{name} /Encoding /WinAnsiEncoding >>"
+                         .encode("latin-1"))
+
+        catalog = f"<< /Type /Catalog /Pages {PAGES_OBJECT} 0 R"
+        if self._bookmarks:
+            outline = self._write_outline()
+            catalog += f" /Outlines {outline} 0 R /PageMode /UseOutlines"
+        self._object(CATALOG_OBJECT, (catalog + " >>").encode("latin-1"))
+
+        info = [f"/Producer {pdf_string('TerraFusion Platform').decode('latin-1')}",
+                f"/CreationDate (D:{datetime.utcnow().strftime('%Y%m%d%H%M%S')}Z)"]
+        if self.title:
+            info.append(f"/Title {pdf_string(self.title).decode('latin-1')}")
+        if self.author:
+            info.append(f"/Author {pdf_string(self.author).decode('latin-1')}")
+        self._object(INFO_OBJECT, f"<< {' '.join(info)} >>".encode("latin-1"))
+
+        xref_offset = self._position
+        lines = [f"xref\n0 {self._next_object}\n", "0000000000 65535 f \n"]
+        lines.extend(f"{self._offsets[number]:010d} 00000 n \n" for number in range(1, self._next_object))
+        self._write("".join(lines).encode("latin-1"))
+        self._write((f"trailer\n<< /Size {self._next_object} /Root {CATALOG_OBJECT} 0 R /Info {INFO_OBJECT} 0 R >>\n"
+                     f"startxref\n{xref_offset}\n%%EOF\n").encode("latin-1"))
+        logger.info(f"Wrote PDF of {len(self.pages)} pages")
+
+    def _write_outline(self) -> int:
+        outline = self._allocate()
+        items = [self._allocate() for _ in self._bookmarks]
+        for i, ((title, page_object), number) in enumerate(zip(self._bookmarks, items)):
+            entry = f"<< /Title {pdf_string(title).decode('latin-1')} /Parent {outline} 0 R /Dest [{page_object} 0 R /Fit]"
+            if i > 0:
+                entry += f" /Prev {items[i - 1]} 0 R"
+            if i < len(items) - 1:
+                entry += f" /Next {items[i + 1]} 0 R"
+            self._object(number, (entry + " >>").encode("latin-1"))
+        self._object(outline, f"<< /Type /Outlines /First {items[0]} 0 R /Last {items[-1]} 0 R /Count {len(items)} >>"
+                     .encode("latin-1"))
+        return outline
+
+    def _allocate(self) -> int:
+        number = self._next_object
+        self._next_object += 1
+        return number
+
+    def _object(self, number: int, body: bytes) -> None:
+        self._offsets[number] = self._position
+        self._write(f"{number} 0 obj\n".encode("latin-1") + body + b"\nendobj\n")
+
+    def _write(self, data: bytes) -> None:
+        self.stream.write(data)
+        self._position += len(data)
@@ -0,0 +1,152 @@
+"""
+TerraFusion Platform - Derived Point Layers
+
+This module derives point layers from the polygons (or lines) of an export
+layer, for consumers that want one point per parcel: address geocoders,
+label placement, heat maps, or spreadsheets of coordinates. A layer can add
+
+- centroids: the area-weighted center of each feature; for an L-shaped or
+  ring-shaped parcel it can fall outside the parcel
+- label points: a point guaranteed to lie on the feature, the centroid when
+  that is inside it and otherwise the middle of the widest run across a
+  horizontal line through the middle of one of its polygons
+
+as secondary outputs of any geometry export, from a layer's
+"derived_points" setting or parameters.derived_points (a list of kinds for
+every layer, or a list by layer name; an empty list adds none):
+
+    "parameters": {"derived_points": {"parcels": ["centroid", "label_point"]}}
+
+Each derived layer is named after its layer ("parcels_centroids",
+"parcels_label_points"), keeps the feature IDs and properties, and is written
+beside it: as another layer of the same file for formats that hold several,
+or as another file of the export's bundle for single-layer formats. Points
+are derived in the layer's own CRS before the export reprojects them and
+from the full geometry, not a simplified one.
+"""
+
+import copy
+import logging
+from typing import Dict, List, Any, Optional, Iterator, Iterable, Tuple
+
+from gis_features import INSIDE, ExportLayer, geometry_centroid, iter_points, locate_point, ring_edges
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Kinds of derived point, with the suffix and title of the layers they make
+DERIVED_POINT_KINDS = {
+    "centroid": ("centroids", "centroids"),
+    "label_point": ("label_points", "label points"),
+}
+
+# Geometry types points are not derived from, since they are points already
+POINT_TYPES = ["Point", "MultiPoint"]
+
+Point = Tuple[float, float]
+
+
+def derived_point_kinds(layer: ExportLayer, parameters: Optional[Dict[str, Any]]) -> List[str]:
+    """
+    The kinds of point layer an export derives from a layer.
+
+    Args:
+        layer: Export layer, whose "derived_points" setting is the default
+        parameters: Export parameters; "derived_points" is a list of kinds
+            for every layer or a mapping of layer names to lists
+
+    Raises:
+        ValueError: If a kind is unknown or the layer has no polygons or lines
+    """
+    value = layer.settings.get("derived_points")
+    requested = (parameters or {}).get("derived_points")
+    if isinstance(requested, dict):
+        value = requested.get(layer.name, value)
+    elif requested is not None:
+        value = requested
+    if not value:
+        return []
+    if not isinstance(value, list) or any(kind not in DERIVED_POINT_KINDS for kind in value):
+        raise ValueError(f"Layer {layer.name}: derived_points must be a list of: {', '.join(DERIVED_POINT_KINDS)}")
+    if not layer.geometry_field:
+        raise ValueError(f"Layer {layer.name} has no geometry to derive points from")
+    if layer.geometry_type in POINT_TYPES:
+        raise ValueError(f"Layer {layer.name} holds {layer.geometry_type} features; points are derived from polygons and lines")
+    return list(dict.fromkeys(value))
+
+
+def derived_layer(layer: ExportLayer, kind: str) -> ExportLayer:
+    """The point layer of one kind derived from a layer: read like it, with Point geometry."""
+    suffix, title = DERIVED_POINT_KINDS[kind]
+    point_layer = copy.copy(layer)
+    point_layer.name = f"{layer.name}_{suffix}"
+    point_layer.title = f"{layer.title} {title}"
+    point_layer.description = f"{title.capitalize()} of {layer.title}"
+    point_layer.geometry_type = "Point"
+    point_layer.settings = {k: v for k, v in layer.settings.items() if k not in ("derived_points", "simplify")}
+    point_layer.settings["geometry_type"] = "Point"
+    return point_layer
+
+
+def point_features(features: Iterable[Dict[str, Any]], kind: str) -> Iterator[Dict[str, Any]]:
+    """Yield the features with their geometry replaced by a derived point (none for empty geometry)."""
+    derive = geometry_centroid if kind == "centroid" else label_point
+    for feature in features:
+        point = derive(feature.get("geometry"))
+        geometry = {"type": "Point", "coordinates": [point[0], point[1]]} if point is not None else None
+        yield dict(feature, geometry=geometry)
+
+
+def label_point(geometry: Optional[Dict[str, Any]]) -> Optional[Point]:
+    """
+    A point on a geometry: its centroid when that lies inside it, otherwise
+    the middle of the widest interior run along a horizontal line through
+    the middle of one of its polygons. Lines and points use the vertex nearest their
+    centroid.
+    """
+    center = geometry_centroid(geometry)
+    if center is None:
+        return None
+    kind = geometry["type"]
+    if kind not in ("Polygon", "MultiPolygon"):
+        points = list(iter_points(geometry))
+        nearest = min(points, key=lambda p: (p[0] - center[0]) ** 2 + (p[1] - center[1]) ** 2)
+        return float(nearest[0]), float(nearest[1])
+    polygons = [geometry["coordinates"]] if kind == "Polygon" else geometry["coordinates"]
+    if locate_point(center, ring_edges(_rings(polygons))) == INSIDE:
+        return center
+    return _widest_run(polygons) or center
+
+
+def _rings(polygons: List[Any]) -> Iterator[List[Point]]:
+    for polygon in polygons:
+        for ring in polygon:
+            yield [(float(p[0]), float(p[1])) for p in ring]
+
+
+def _widest_run(polygons: List[Any]) -> Optional[Point]:
+    """
+    The middle of the widest interior run along a horizontal line through
+    the middle of each polygon. The line runs halfway between the vertex
+    heights nearest the polygon's middle, so it passes through no vertex.
+    """
+    widest = None
+    for polygon in polygons:
+        rings = list(_rings([polygon]))
+        ys = sorted({y for ring in rings for _, y in ring})
+        if len(ys) < 2:
+            continue
+        middle = (ys[0] + ys[-1]) / 2
+        below = max(v for v in ys if v <= middle)
+        above = min(v for v in ys if v > below)
+        y = (below + above) / 2
+        crossings = sorted(
+            x1 + (y - y1) * (x2 - x1) / (y2 - y1)
+            for ring in rings for (x1, y1), (x2, y2) in zip(ring, ring[1:] + ring[:1]) if (y1 > y) != (y2 > y)
+        )
+        for i in range(0, len(crossings) - 1, 2):
+            width = crossings[i + 1] - crossings[i]
+            if widest is None or width > widest[0]:
+                widest = (width, ((crossings[i] + crossings[i + 1]) / 2, y))
+    return widest[1] if widest else None
@@ -0,0 +1,274 @@
+"""
+TerraFusion Platform - Sales Ratio Studies
+
+This module writes sales ratio studies from synced sales (see the sales
+entity module in sync_entities): each sale with the assessed value of the
+parcels it conveyed in a tax year and the ratio of that value to its price,
+as a CSV file ratio study tools read, with the study's statistics on the
+export job. A county names the export layers (see gis_features) of its
+sales, their parcels and the parcels' values under
+plugin_settings.gis_export.ratio_study:
+
+    "ratio_study": {
+        "sales_layer": "sales",
+        "sale_parcels_layer": "sale_parcels",
+        "values": {"layer": "parcel_values", "key_field": "prop_id",
+                   "year_field": "tax_year", "value_field": "assessed_value"}
+    }
+
+The "ratio_study" export format takes parameters.tax_year, the year of the
+values, and optionally sales_from and sales_to (ISO dates, inclusive) and
+include_invalid (sales that are not arm's-length are left out by default).
+A sale of several parcels is one row, valued at the sum of its parcels'
+values. A sale with a parcel that has no value in the year is written
+without a ratio and left out of the statistics:
+
+- median_ratio: the median ratio of assessed value to sale price
+- cod: coefficient of dispersion, the average absolute deviation from the
+  median ratio as a percentage of it
+- prd: price-related differential, the mean ratio over the ratio of the
+  total value to the total price; well above 1 suggests higher-priced
+  properties are assessed low relative to lower-priced ones
+"""
+
+import csv
+import logging
+from datetime import date, datetime
+from decimal import Decimal, InvalidOperation
+from statistics import median
+from typing import Dict, List, Any, Optional, TextIO, Tuple
+
+from gis_features import ExportLayer, LayerReader
+from gis_reports import parcel_key
+from roll_years import parse_roll_year
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Columns of a ratio study file, in order
+RATIO_STUDY_COLUMNS = ["sale_id", "sale_date", "sale_price", "instrument_type", "validity_code", "valid_sale",
+                       "parcel_count", "parcels", "assessed_value", "ratio"]
+
+# Sales whose parcels and values are looked up at a time
+SALES_PER_LOOKUP = 500
+
+# Separator of the parcels of a multi-parcel sale in the parcels column
+PARCEL_SEPARATOR = ";"
+
+TRUE_VALUES = {"true", "t", "yes", "y", "1"}
+
+
+def _decimal(value: Any) -> Optional[Decimal]:
+    if isinstance(value, bool) or value is None:
+        return None
+    try:
+        return Decimal(str(value).strip().replace(",", ""))
+    except InvalidOperation:
+        return None
+
+
+def _date_text(value: Any) -> Optional[str]:
+    """A stored date as YYYY-MM-DD, so dates and date text compare alike."""
+    if value is None or value == "":
+        return None
+    if isinstance(value, (date, datetime)):
+        return value.isoformat()[:10]
+    return str(value).strip()[:10]
+
+
+def _is_true(value: Any) -> bool:
+    if isinstance(value, bool):
+        return value
+    return value is not None and str(value).strip().lower() in TRUE_VALUES
+
+
+def ratio_statistics(ratios: List[Tuple[Decimal, Decimal]]) -> Dict[str, Any]:
+    """
+    The statistics of a ratio study.
+
+    Args:
+        ratios: (assessed value, sale price) of each sale with a ratio
+
+    Returns:
+        Sales counted, median ratio, COD and PRD; None where there are no sales
+    """
+    if not ratios:
+        return {"sales": 0, "median_ratio": None, "cod": None, "prd": None}
+    values = [value / price for value, price in ratios]
+    middle = median(values)
+    cod = (sum(abs(r - middle) for r in values) / len(values) / middle * 100) if middle else None
+    weighted = sum(value for value, _ in ratios) / sum(price for _, price in ratios)
+    prd = (sum(values) / len(values) / weighted) if weighted else None
+    return {
+        "sales": len(values),
+        "median_ratio": float(round(middle, 4)),
+        "cod": float(round(cod, 2)) if cod is not None else None,
+        "prd": float(round(prd, 4)) if prd is not None else None,
+    }
+
+
+class RatioStudySettings:
+    """The ratio study settings of a county, from plugin_settings.gis_export.ratio_study."""
+
+    def __init__(self, settings: Optional[Dict[str, Any]], layers: Dict[str, ExportLayer]):
+        """
+        Read and validate the settings.
+
+        Args:
+            settings: The ratio_study settings
+            layers: The county's export layers, by name
+
+        Raises:
+            ValueError: If the county has no ratio study settings or they are invalid
+        """
+        if not settings:
+            raise ValueError("Ratio studies are not configured for this county "
+                             "(plugin_settings.gis_export.ratio_study)")
+        self.sales_layer = self._layer(layers, settings.get("sales_layer"), "sales_layer")
+        self.sale_parcels_layer = self._layer(layers, settings.get("sale_parcels_layer"), "sale_parcels_layer")
+        self.parcel_field = settings.get("parcel_field", "prop_id")
+        values = settings.get("values") or {}
+        self.values_layer = self._layer(layers, values.get("layer"), "values.layer")
+        self.values_key_field = values.get("key_field", self.parcel_field)
+        self.year_field = values.get("year_field", "tax_year")
+        self.value_field = values.get("value_field", "assessed_value")
+        for layer, names in ((self.sales_layer, ["sale_id", "sale_date", "sale_price", "valid_sale"]),
+                             (self.sale_parcels_layer, ["sale_id", self.parcel_field]),
+                             (self.values_layer, [self.values_key_field, self.year_field, self.value_field])):
+            for name in names:
+                if layer.columns is not None and name not in layer.columns:
+                    raise ValueError(f"Ratio study: layer {layer.name} does not export column {name}")
+
+    @property
+    def layers(self) -> List[ExportLayer]:
+        return [self.sales_layer, self.sale_parcels_layer, self.values_layer]
+
+    @staticmethod
+    def _layer(layers: Dict[str, ExportLayer], name: Optional[str], setting: str) -> ExportLayer:
+        if not name:
+            raise ValueError(f"Ratio study settings need a {setting}")
+        if name not in layers:
+            raise ValueError(f"Ratio study {setting} {name} is not a configured export layer. "
+                             f"Configured layers: {', '.join(layers) or 'none'}")
+        return layers[name]
+
+
+class RatioStudyParameters:
+    """The sales and year one ratio study export covers, from its parameters."""
+
+    def __init__(self, parameters: Optional[Dict[str, Any]]):
+        """
+        Raises:
+            ValueError: If the parameters are invalid
+        """
+        parameters = parameters or {}
+        if parameters.get("tax_year") is None:
+            raise ValueError("A ratio_study export needs parameters.tax_year, the year of the assessed values")
+        self.tax_year = parse_roll_year(parameters["tax_year"], "parameters.tax_year")
+        self.sales_from = self._date(parameters.get("sales_from"), "sales_from")
+        self.sales_to = self._date(parameters.get("sales_to"), "sales_to")
+        if self.sales_from and self.sales_to and self.sales_from > self.sales_to:
+            raise ValueError("parameters.sales_from must not be after parameters.sales_to")
+        self.include_invalid = parameters.get("include_invalid", False)
+        if not isinstance(self.include_invalid, bool):
+            raise ValueError("parameters.include_invalid must be true or false")
+
+    @staticmethod
+    def _date(value: Any, name: str) -> Optional[str]:
+        if value is None:
+            return None
+        try:
+            return date.fromisoformat(str(value)).isoformat()
+        except ValueError:
+            raise ValueError(f"parameters.{name} must be a date (YYYY-MM-DD)")
+
+    def selects(self, sale: Dict[str, Any]) -> bool:
+        """Whether a sale is in the study."""
+        if not self.include_invalid and not _is_true(sale.get("valid_sale")):
+            return False
+        sale_date = _date_text(sale.get("sale_date"))
+        if (self.sales_from or self.sales_to) and sale_date is None:
+            return False
+        if self.sales_from and sale_date < self.sales_from:
+            return False
+        return not (self.sales_to and sale_date > self.sales_to)
+
+
+class RatioStudy:
+    """Loads sales with their parcels' values and writes ratio study files."""
+
+    def __init__(self, settings: RatioStudySettings, reader: LayerReader):
+        self.settings = settings
+        self.reader = reader
+
+    def write(self, parameters: RatioStudyParameters, out: TextIO) -> Dict[str, Any]:
+        """
+        Write the ratio study of the selected sales as CSV.
+
+        Sales are read once, in key order, and their parcels and values looked
+        up SALES_PER_LOOKUP sales at a time.
+
+        Returns:
+            The study's statistics, with the sales written and those without a
+            ratio (no price, or a parcel without a value in the year)
+
+        Raises:
+            ConnectorError: If a layer cannot be read
+        """
+        writer = csv.writer(out)
+        writer.writerow(RATIO_STUDY_COLUMNS)
+        ratios: List[Tuple[Decimal, Decimal]] = []
+        counts = {"written": 0, "without_ratio": 0}
+        chunk: List[Dict[str, Any]] = []
+        for feature in self.reader.read(self.settings.sales_layer):
+            if parameters.selects(feature["properties"]):
+                chunk.append(feature["properties"])
+            if len(chunk) >= SALES_PER_LOOKUP:
+                self._write_sales(chunk, parameters, writer, ratios, counts)
+                chunk = []
+        if chunk:
+            self._write_sales(chunk, parameters, writer, ratios, counts)
+        summary = dict(ratio_statistics(ratios), tax_year=parameters.tax_year,
+                       sales_written=counts["written"], sales_without_ratio=counts["without_ratio"])
+        logger.info(f"Ratio study of {counts['written']} sales for {parameters.tax_year}: "
+                    f"median ratio {summary['median_ratio']}, COD {summary['cod']}, PRD {summary['prd']}")
+        return summary
+
+    def _write_sales(self, sales: List[Dict[str, Any]], parameters: RatioStudyParameters, writer,
+                     ratios: List[Tuple[Decimal, Decimal]], counts: Dict[str, int]) -> None:
+        settings = self.settings
+        parcels: Dict[str, List[Dict[str, Any]]] = {}
+        for feature in self.reader.lookup(settings.sale_parcels_layer, "sale_id", [s.get("sale_id") for s in sales]):
+            parcels.setdefault(parcel_key(feature["properties"].get("sale_id")), []).append(feature["properties"])
+
+        # Looked up by the stored values, so the values table's database compares like types
+        links = list(dict.fromkeys(
+            p.get(settings.parcel_field) for rows in parcels.values() for p in rows
+            if p.get(settings.parcel_field) is not None
+        ))
+        values: Dict[str, Decimal] = {}
+        for feature in self.reader.lookup(settings.values_layer, settings.values_key_field, links):
+            row = feature["properties"]
+            value = _decimal(row.get(settings.value_field))
+            if parcel_key(row.get(settings.year_field)) == str(parameters.tax_year) and value is not None:
+                values[parcel_key(row.get(settings.values_key_field))] = value
+
+        for sale in sales:
+            rows = sorted(parcels.get(parcel_key(sale.get("sale_id")), []),
+                          key=lambda p: (p.get("parcel_sequence") is None, p.get("parcel_sequence") or 0))
+            keys = [parcel_key(p.get(settings.parcel_field)) for p in rows if p.get(settings.parcel_field) is not None]
+            price = _decimal(sale.get("sale_price"))
+            assessed = sum(values[key] for key in keys) if keys and all(key in values for key in keys) else None
+            ratio = assessed / price if assessed is not None and price else None
+            if ratio is None:
+                counts["without_ratio"] += 1
+            else:
+                ratios.append((assessed, price))
+            writer.writerow([
+                sale.get("sale_id"), _date_text(sale.get("sale_date")), sale.get("sale_price"),
+                sale.get("instrument_type"), sale.get("validity_code"), _is_true(sale.get("valid_sale")),
+                len(keys), PARCEL_SEPARATOR.join(keys), assessed,
+                round(ratio, 4) if ratio is not None else None,
+            ])
+            counts["written"] += 1
@@ -0,0 +1,494 @@
+"""
+TerraFusion Platform - Parcel Reports
+
+This module renders one-page PDF parcel summaries from synced data: the
+ownership and other fields of the parcel, its values by year, a small map
+of the parcel among its neighbors, and placeholder boxes for the sketch
+and photo (which are not synced). A county configures its reports under
+plugin_settings.gis_export.parcel_reports, naming export layers (see
+gis_features) for the parcel and its values:
+
+    "parcel_reports": {
+        "title": "Benton County Assessor - Parcel Summary",
+        "layer": "parcels",
+        "key_field": "parcel_number",
+        "sections": [
+            {"title": "Ownership", "fields": {"owner_name": "Owner", "owner_address": "Mailing address"}},
+            {"title": "Property", "fields": {"situs_address": "Situs",
+                                             "acres": {"label": "Acres", "format": "acres"}}}
+        ],
+        "values": {"layer": "parcel_values", "year_field": "tax_year", "years": 6,
+                   "columns": {"land_value": "Land", "improvement_value": "Improvements",
+                               "assessed_value": "Assessed"}}
+    }
+
+Values columns are formatted as currency unless they say otherwise. Values
+rows are found by their key_field holding the parcel's parcel_field (both
+default to the report key_field), so a values table keyed by property id
+can serve reports looked up by parcel number.
+Reports are available one parcel at a time from the API, and as the
+"parcel_reports" export format, which writes the requested parcels into one
+PDF with a bookmark per parcel for appeal hearing packets.
+"""
+
+import math
+import logging
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Tuple, BinaryIO
+
+from gis_features import ExportLayer, LayerReader, Bounds, geometry_bounds, merge_bounds, bounds_intersect
+from gis_pdf import PdfPage, PdfWriter, LETTER, fit_text, text_width
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# How report values are written
+VALUE_FORMATS = ["text", "currency", "number", "acres", "date"]
+
+# Years of values shown unless the settings say otherwise, and the most a page holds
+DEFAULT_REPORT_YEARS = 6
+MAX_REPORT_YEARS = 12
+
+# Most parcels one batch export may hold
+MAX_REPORT_PARCELS = 2000
+
+# Ground added around the parcel on each side of the map inset, as a share of its size
+DEFAULT_INSET_MARGIN = 0.5
+
+# Neighbors drawn on one map inset at most
+MAX_INSET_NEIGHBORS = 500
+
+# Page layout, in points
+PAGE_MARGIN = 36
+INSET_SIZE = 200
+ROW_HEIGHT = 13
+PLACEHOLDER_HEIGHT = 150
+MIN_PLACEHOLDER_HEIGHT = 60
+FOOTER_HEIGHT = 40
+
+# Colors
+RULE_COLOR = "#999999"
+SHADE_COLOR = "#f0f0f0"
+SUBJECT_STROKE = "#b2182b"
+SUBJECT_FILL = "#f4a582"
+NEIGHBOR_STROKE = "#8c8c8c"
+MUTED_TEXT = "#666666"
+
+
+class ReportField:
+    """A field shown on a report: the record field, its label and format."""
+
+    def __init__(self, field: str, spec: Any, default_format: str, where: str):
+        """
+        Read a field from its settings: a label, or {"label", "format"}.
+
+        Raises:
+            ValueError: If the settings are invalid
+        """
+        if isinstance(spec, str):
+            spec = {"label": spec}
+        if not isinstance(spec, dict):
+            raise ValueError(f"{where}: field {field} needs a label or {{\"label\", \"format\"}}")
+        self.field = field
+        self.label = spec.get("label") or field
+        self.format = spec.get("format", default_format)
+        if self.format not in VALUE_FORMATS:
+            raise ValueError(f"{where}: unsupported format {self.format} for field {field}. "
+                             f"Supported formats: {', '.join(VALUE_FORMATS)}")
+
+    def text(self, properties: Dict[str, Any]) -> str:
+        return format_value(properties.get(self.field), self.format)
+
+
+def _fields(mapping: Any, default_format: str, where: str) -> List[ReportField]:
+    if not isinstance(mapping, dict) or not mapping:
+        raise ValueError(f"{where} needs fields, mapping each field to its label")
+    return [ReportField(field, spec, default_format, where) for field, spec in mapping.items()]
+
+
+def _number(value: Any) -> Optional[Decimal]:
+    if isinstance(value, bool) or value is None:
+        return None
+    try:
+        return Decimal(str(value).strip().replace(",", ""))
+    except ArithmeticError:
+        return None
+
+
+def format_value(value: Any, fmt: str = "text") -> str:
+    """A field value as report text; empty values print as "-"."""
+    if value is None or value == "":
+        return "-"
+    if fmt in ("currency", "number", "acres"):
+        number = _number(value)
+        if number is None:
+            return str(value)
+        if fmt == "currency":
+            return f"-${-number:,.0f}" if number < 0 else f"${number:,.0f}"
+        if fmt == "acres":
+            return f"{number:,.3f} ac"
+        return f"{number.normalize():,f}" if number == number.to_integral_value() else f"{number:,}"
+    if fmt == "date":
+        if isinstance(value, (date, datetime)):
+            return value.strftime("%m/%d/%Y")
+        try:
+            return datetime.fromisoformat(str(value)).strftime("%m/%d/%Y")
+        except ValueError:
+            return str(value)
+    if isinstance(value, bool):
+        return "Yes" if value else "No"
+    if isinstance(value, (date, datetime)):
+        return value.isoformat()
+    return str(value)
+
+
+def parcel_key(value: Any) -> str:
+    """A parcel key as text, so a key given in a URL matches a numeric stored value."""
+    if isinstance(value, float) and value.is_integer():
+        value = int(value)
+    return str(value).strip()
+
+
+class ParcelReportSettings:
+    """The parcel report settings of a county, from plugin_settings.gis_export.parcel_reports."""
+
+    def __init__(self, settings: Optional[Dict[str, Any]], layers: Dict[str, ExportLayer]):
+        """
+        Read and validate the settings.
+
+        Args:
+            settings: The parcel_reports settings
+            layers: The county's export layers, by name
+
+        Raises:
+            ValueError: If the county has no report settings or they are invalid
+        """
+        if not settings:
+            raise ValueError("Parcel reports are not configured for this county "
+                             "(plugin_settings.gis_export.parcel_reports)")
+        self.title = settings.get("title", "Parcel Summary")
+        self.layer = self._layer(layers, settings.get("layer"), "Parcel reports")
+        if not self.layer.geometry_field:
+            logger.info(f"Parcel report layer {self.layer.name} has no geometry; reports will have no map")
+        self.key_field = settings.get("key_field") or self._single_key(self.layer, "Parcel reports")
+        self._check_column(self.layer, self.key_field, "Parcel reports")
+        self.key_label = settings.get("key_label", "Parcel")
+
+        self.sections = []
+        for i, section in enumerate(settings.get("sections") or []):
+            title = section.get("title") or f"Section {i + 1}"
+            fields = _fields(section.get("fields"), "text", f"Parcel report section {title}")
+            for field in fields:
+                self._check_column(self.layer, field.field, f"Parcel report section {title}")
+            self.sections.append((title, fields))
+
+        self.values_layer = None
+        values = settings.get("values")
+        if values:
+            self.values_layer = self._layer(layers, values.get("layer"), "Parcel report values")
+            self.values_key_field = values.get("key_field", self.key_field)
+            self.values_parcel_field = values.get("parcel_field", self.key_field)
+            self._check_column(self.layer, self.values_parcel_field, "Parcel report values")
+            self.year_field = values.get("year_field")
+            if not self.year_field:
+                raise ValueError("Parcel report values need a year_field")
+            self.value_columns = _fields(values.get("columns"), "currency", "Parcel report values")
+            for name in [self.values_key_field, self.year_field] + [c.field for c in self.value_columns]:
+                self._check_column(self.values_layer, name, "Parcel report values")
+            self.years = values.get("years", DEFAULT_REPORT_YEARS)
+            if not isinstance(self.years, int) or not 1 <= self.years <= MAX_REPORT_YEARS:
+                raise ValueError(f"Parcel report values: years must be between 1 and {MAX_REPORT_YEARS}")
+
+        inset = settings.get("inset") or {}
+        self.inset_neighbors = bool(inset.get("neighbors", True))
+        self.inset_margin = inset.get("margin", DEFAULT_INSET_MARGIN)
+        if not isinstance(self.inset_margin, (int, float)) or self.inset_margin < 0:
+            raise ValueError("Parcel report inset margin must be a number of at least 0")
+
+    @staticmethod
+    def _layer(layers: Dict[str, ExportLayer], name: Optional[str], where: str) -> ExportLayer:
+        if not name:
+            raise ValueError(f"{where} need a layer")
+        if name not in layers:
+            raise ValueError(f"{where} layer {name} is not a configured export layer. "
+                             f"Configured layers: {', '.join(layers) or 'none'}")
+        return layers[name]
+
+    @staticmethod
+    def _single_key(layer: ExportLayer, where: str) -> str:
+        if len(layer.primary_key) != 1:
+            raise ValueError(f"{where} need a key_field: layer {layer.name} has no single-column primary key")
+        return layer.primary_key[0]
+
+    @staticmethod
+    def _check_column(layer: ExportLayer, name: str, where: str) -> None:
+        if layer.columns is not None and name not in layer.columns:
+            raise ValueError(f"{where}: layer {layer.name} does not export column {name}")
+
+
+class ParcelReport:
+    """What one parcel's report shows."""
+
+    def __init__(self, key: str, feature: Dict[str, Any]):
+        self.key = key
+        self.properties = feature["properties"]
+        self.id = feature["id"]
+        self.geometry = feature["geometry"]
+        self.srid = feature["srid"]
+        self.values: List[Dict[str, Any]] = []
+        self.inset: Optional[Bounds] = None
+        self.neighbors: List[Dict[str, Any]] = []
+
+
+class ParcelReports:
+    """Loads parcels from their layers and renders their reports."""
+
+    def __init__(self, settings: ParcelReportSettings, reader: LayerReader):
+        self.settings = settings
+        self.reader = reader
+
+    def load(self, parcel_ids: List[Any]) -> Tuple[List[ParcelReport], List[str]]:
+        """
+        Read the records the reports of some parcels show.
+
+        The parcel and values layers are read once for the whole list, as is
+        the parcel layer for the neighbors drawn on the map insets.
+
+        Args:
+            parcel_ids: Values of the key field, in the order the reports are wanted
+
+        Returns:
+            Tuple of (reports in the requested order, the keys not found)
+
+        Raises:
+            ValueError: If too many parcels are requested
+            ConnectorError: If a layer cannot be read
+        """
+        keys = list(dict.fromkeys(parcel_key(p) for p in parcel_ids))
+        if len(keys) > MAX_REPORT_PARCELS:
+            raise ValueError(f"At most {MAX_REPORT_PARCELS} parcels can be reported at once, not {len(keys)}")
+        settings = self.settings
+
+        wanted = set(keys)
+        found: Dict[str, ParcelReport] = {}
+        for feature in self.reader.lookup(settings.layer, settings.key_field, keys):
+            key = parcel_key(feature["properties"].get(settings.key_field))
+            if key in wanted and key not in found:
+                found[key] = ParcelReport(key, feature)
+        reports = [found[key] for key in keys if key in found]
+        missing = [key for key in keys if key not in found]
+
+        if settings.values_layer is not None and reports:
+            # Looked up by the stored values, so the values table's database compares like types
+            linked: Dict[str, List[ParcelReport]] = {}
+            links = []
+            for report in reports:
+                link = report.properties.get(settings.values_parcel_field)
+                if link is not None:
+                    if parcel_key(link) not in linked:
+                        links.append(link)
+                    linked.setdefault(parcel_key(link), []).append(report)
+            for feature in self.reader.lookup(settings.values_layer, settings.values_key_field, links):
+                for report in linked.get(parcel_key(feature["properties"].get(settings.values_key_field)), ()):
+                    report.values.append(feature["properties"])
+            for report in reports:
+                report.values.sort(key=lambda row: (_number(row.get(settings.year_field)) or 0,
+                                                    parcel_key(row.get(settings.year_field))), reverse=True)
+                report.values = report.values[:settings.years]
+
+        for report in reports:
+            report.inset = self._inset_bounds(report)
+        if settings.inset_neighbors:
+            self._load_neighbors([r for r in reports if r.inset is not None])
+        return reports, missing
+
+    def render(self, reports: List[ParcelReport], stream: BinaryIO, generated_at: Optional[datetime] = None) -> int:
+        """
+        Write reports as one PDF, a page and a bookmark per parcel.
+
+        Returns:
+            Number of pages written
+        """
+        generated_at = generated_at or datetime.utcnow()
+        with PdfWriter(stream, title=self.settings.title, author="TerraFusion Platform") as writer:
+            for i, report in enumerate(reports):
+                page = PdfPage(LETTER)
+                self._draw(page, report, generated_at, i + 1, len(reports))
+                writer.add_page(page, bookmark=f"{self.settings.key_label} {report.key}")
+        return len(reports)
+
+    # Loading ----------------------------------------------------------------
+
+    def _inset_bounds(self, report: ParcelReport) -> Optional[Bounds]:
+        """The ground the map inset of a report covers: the parcel and a margin, square on the ground."""
+        bounds = geometry_bounds(report.geometry)
+        if bounds is None:
+            return None
+        x_scale = self._x_scale(report.srid, bounds)
+        # Ground extent, in the units of the y axis
+        width, height = (bounds[2] - bounds[0]) * x_scale, bounds[3] - bounds[1]
+        side = max(width, height) * (1 + 2 * self.settings.inset_margin)
+        if side <= 0:
+            # A point: about 200 m (or 200 units) of ground around it
+            side = 0.002 if report.srid in (None, 4326) else 200.0
+        cx, cy = (bounds[0] + bounds[2]) / 2, (bounds[1] + bounds[3]) / 2
+        return cx - side / x_scale / 2, cy - side / 2, cx + side / x_scale / 2, cy + side / 2
+
+    @staticmethod
+    def _x_scale(srid: Optional[int], bounds: Bounds) -> float:
+        """Ground length of a unit of x relative to a unit of y (longitude degrees shrink away from the equator)."""
+        if srid in (None, 4326):
+            return max(math.cos(math.radians((bounds[1] + bounds[3]) / 2)), 0.01)
+        return 1.0
+
+    def _load_neighbors(self, reports: List[ParcelReport]) -> None:
+        """Give each report the parcels its map inset meets, reading the layer once."""
+        if not reports or not self.settings.layer.geometry_field:
+            return
+        extent = None
+        for report in reports:
+            extent = merge_bounds(extent, report.inset)
+        # Insets indexed on a grid of cells the size of the largest, so each feature is tested against few
+        cell = max(max(r.inset[2] - r.inset[0], r.inset[3] - r.inset[1]) for r in reports)
+        grid: Dict[Tuple[int, int], List[ParcelReport]] = {}
+        for report in reports:
+            for cx in range(int((report.inset[0] - extent[0]) // cell), int((report.inset[2] - extent[0]) // cell) + 1):
+                for cy in range(int((report.inset[1] - extent[1]) // cell), int((report.inset[3] - extent[1]) // cell) + 1):
+                    grid.setdefault((cx, cy), []).append(report)
+
+        full = set()
+        for feature in self.reader.read(self.settings.layer, extent):
+            bounds = geometry_bounds(feature["geometry"])
+            candidates = {}
+            for cx in range(int((bounds[0] - extent[0]) // cell), int((bounds[2] - extent[0]) // cell) + 1):
+                for cy in range(int((bounds[1] - extent[1]) // cell), int((bounds[3] - extent[1]) // cell) + 1):
+                    for report in grid.get((cx, cy), ()):
+                        candidates[id(report)] = report
+            for report in candidates.values():
+                if report.id == feature["id"] or not bounds_intersect(report.inset, bounds):
+                    continue
+                if len(report.neighbors) >= MAX_INSET_NEIGHBORS:
+                    full.add(report.key)
+                    continue
+                report.neighbors.append(feature["geometry"])
+        if full:
+            logger.info(f"Map insets of parcels {', '.join(sorted(full))} show their first {MAX_INSET_NEIGHBORS} neighbors")
+
+    # Drawing ----------------------------------------------------------------
+
+    def _draw(self, page: PdfPage, report: ParcelReport, generated_at: datetime, number: int, count: int) -> None:
+        settings = self.settings
+        left, right = PAGE_MARGIN, page.width - PAGE_MARGIN
+        top = page.height - PAGE_MARGIN
+
+        page.text(left, top - 10, settings.title, size=12, bold=True)
+        page.text(right, top - 10, f"Generated {generated_at.strftime('%m/%d/%Y %H:%M')} UTC", size=8,
+                  align="right", color=MUTED_TEXT)
+        page.text(left, top - 32, f"{settings.key_label} {report.key}", size=18, bold=True)
+        page.line(left, top - 42, right, top - 42, color=RULE_COLOR)
+
+        # Fields on the left, the map inset on the right
+        inset_x, inset_top = right - INSET_SIZE, top - 56
+        column_right = inset_x - 16
+        y = top - 64
+        for title, fields in settings.sections:
+            y = self._section_title(page, left, column_right, y, title)
+            label_width = max(text_width(f.label, 8, bold=True) for f in fields) + 10
+            for field in fields:
+                page.text(left, y, fit_text(field.label, label_width - 6, 8, bold=True), size=8, bold=True)
+                page.text(left + label_width, y, fit_text(field.text(report.properties),
+                                                          column_right - left - label_width, 9), size=9)
+                y -= ROW_HEIGHT
+            y -= 8
+        self._draw_inset(page, report, inset_x, inset_top - INSET_SIZE)
+        y = min(y, inset_top - INSET_SIZE - 24)
+
+        if settings.values_layer is not None:
+            y = self._draw_values(page, report, left, right, y)
+
+        # Sketch and photo are not synced; their boxes hold the space for them
+        height = min(PLACEHOLDER_HEIGHT, y - 14 - (PAGE_MARGIN + FOOTER_HEIGHT))
+        if height >= MIN_PLACEHOLDER_HEIGHT:
+            gap = 16
+            width = (right - left - gap) / 2
+            for i, caption in enumerate(("Sketch", "Photo")):
+                x = left + i * (width + gap)
+                page.text(x, y, caption, size=10, bold=True)
+                page.rect(x, y - 8 - height, width, height, stroke=RULE_COLOR, dash=(4, 3))
+                page.text(x + width / 2, y - 8 - height / 2, f"{caption} not available", size=9,
+                          align="center", color=MUTED_TEXT)
+
+        page.line(left, PAGE_MARGIN + 16, right, PAGE_MARGIN + 16, color=RULE_COLOR)
+        page.text(left, PAGE_MARGIN + 4, "Prepared from synced assessment records; values are as of the last sync.",
+                  size=7, color=MUTED_TEXT)
+        page.text(right, PAGE_MARGIN + 4, f"{number} of {count}", size=7, align="right", color=MUTED_TEXT)
+
+    @staticmethod
+    def _section_title(page: PdfPage, left: float, right: float, y: float, title: str) -> float:
+        page.text(left, y, title, size=11, bold=True)
+        page.line(left, y - 4, right, y - 4, color=RULE_COLOR)
+        return y - 4 - ROW_HEIGHT
+
+    def _draw_values(self, page: PdfPage, report: ParcelReport, left: float, right: float, y: float) -> float:
+        settings = self.settings
+        y = self._section_title(page, left, right, y, "Values by Year")
+        columns = settings.value_columns
+        year_width = 60
+        width = (right - left - year_width) / len(columns)
+        page.text(left + 4, y, "Year", size=8, bold=True)
+        for i, column in enumerate(columns):
+            page.text(left + year_width + (i + 1) * width - 4, y, fit_text(column.label, width - 8, 8, bold=True),
+                      size=8, bold=True, align="right")
+        y -= ROW_HEIGHT
+        if not report.values:
+            page.text(left + 4, y, "No values synced for this parcel.", size=9, color=MUTED_TEXT)
+            return y - ROW_HEIGHT - 8
+        for n, row in enumerate(report.values):
+            if n % 2 == 0:
+                page.rect(left, y - 4, right - left, ROW_HEIGHT, fill=SHADE_COLOR)
+            page.text(left + 4, y, format_value(row.get(settings.year_field)), size=9)
+            for i, column in enumerate(columns):
+                page.text(left + year_width + (i + 1) * width - 4, y, fit_text(column.text(row), width - 8, 9),
+                          size=9, align="right")
+            y -= ROW_HEIGHT
+        return y - 8
+
+    def _draw_inset(self, page: PdfPage, report: ParcelReport, x: float, y: float) -> None:
+        """The map inset: neighbors outlined around the shaded parcel, north up."""
+        page.rect(x, y, INSET_SIZE, INSET_SIZE, stroke=RULE_COLOR)
+        if report.inset is None:
+            page.text(x + INSET_SIZE / 2, y + INSET_SIZE / 2, "No map available", size=9,
+                      align="center", color=MUTED_TEXT)
+            return
+        min_x, min_y, max_x, max_y = report.inset
+        scale_x, scale_y = INSET_SIZE / (max_x - min_x), INSET_SIZE / (max_y - min_y)
+
+        def to_page(point):
+            return x + (point[0] - min_x) * scale_x, y + (point[1] - min_y) * scale_y
+
+        page.begin_clip(x, y, INSET_SIZE, INSET_SIZE)
+        for geometry in report.neighbors:
+            self._draw_geometry(page, geometry, to_page, NEIGHBOR_STROKE, None)
+        self._draw_geometry(page, report.geometry, to_page, SUBJECT_STROKE, SUBJECT_FILL, width=1.2)
+        page.end_clip()
+        page.text(x + INSET_SIZE - 8, y + INSET_SIZE - 14, "N", size=9, bold=True, align="center")
+        page.line(x + INSET_SIZE - 8, y + INSET_SIZE - 34, x + INSET_SIZE - 8, y + INSET_SIZE - 17, width=1)
+
+    @staticmethod
+    def _draw_geometry(page: PdfPage, geometry: Optional[Dict[str, Any]], to_page, stroke: str,
+                       fill: Optional[str], width: float = 0.5) -> None:
+        if not geometry:
+            return
+        kind, coordinates = geometry["type"], geometry["coordinates"]
+        if kind in ("Polygon", "MultiPolygon"):
+            for polygon in ([coordinates] if kind == "Polygon" else coordinates):
+                page.polygon([[to_page(p) for p in ring] for ring in polygon], stroke=stroke, fill=fill, line_width=width)
+        elif kind in ("LineString", "MultiLineString"):
+            for line in ([coordinates] if kind == "LineString" else coordinates):
+                page.polyline([to_page(p) for p in line], width=width, color=stroke)
+        else:
+            for point in ([coordinates] if kind == "Point" else coordinates):
+                px, py = to_page(point)
+                page.rect(px - 2.5, py - 2.5, 5, 5, stroke=stroke, fill=fill or stroke, line_width=width)
@@ -0,0 +1,406 @@
+"""
+TerraFusion Platform - Coordinate Reprojection
+
+This module reprojects export features from the CRS a county stores them in
+(usually State Plane) to the one an export is written in, such as WGS 84
+longitude/latitude or Web Mercator. The target is an EPSG code, from the
+job's parameters.srid or the county's gis_export.srid; formats with a fixed
+CRS (KML and vector tiles, in longitude/latitude) always get theirs.
+
+Transforms come from pyproj, with the EPSG database it ships, when it is
+installed. Without it, the well-known CRS in WELL_KNOWN_CRS (geographic
+WGS 84 and NAD83, Web Mercator, UTM and the Washington State Plane zones)
+are projected with built-in Lambert Conformal Conic and Transverse Mercator
+formulas. Built-in transforms between NAD83 realizations and WGS 84 treat
+the datum shift as zero, which places features up to about two meters off;
+every transform that approximates a datum shift like this (including
+pyproj's ballpark transforms, used when the grids for a better one are
+missing) is reported as a warning on the export job.
+"""
+
+import copy
+import math
+import logging
+from typing import Dict, List, Any, Optional, Iterator, Tuple
+
+# Optional dependency
+try:
+    from pyproj import CRS, Transformer
+    from pyproj.exceptions import CRSError
+    PYPROJ_AVAILABLE = True
+except ImportError:
+    PYPROJ_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Meters per US survey foot
+US_SURVEY_FOOT = 1200 / 3937
+
+# Transforms less accurate than this (in meters) are reported
+ACCURACY_WARNING_METERS = 0.5
+
+# Ellipsoids by name: (semi-major axis in meters, inverse flattening)
+ELLIPSOIDS = {
+    "WGS84": (6378137.0, 298.257223563),
+    "GRS80": (6378137.0, 298.257222101),
+}
+
+# Worst-case error of treating the shift between two datums as zero, in meters
+NULL_DATUM_SHIFT_METERS = 2
+
+# Parameters of the Washington State Plane zones (Lambert Conformal Conic, two standard parallels)
+_WA_NORTH = {"projection": "lcc", "lat_1": 48 + 44 / 60, "lat_2": 47.5, "lat_0": 47.0, "lon_0": -(120 + 50 / 60),
+             "x_0": 500000.0, "y_0": 0.0}
+_WA_SOUTH = {"projection": "lcc", "lat_1": 47 + 20 / 60, "lat_2": 45 + 50 / 60, "lat_0": 45 + 20 / 60, "lon_0": -120.5,
+             "x_0": 500000.0, "y_0": 0.0}
+
+
+def _state_plane(name: str, datum: str, zone: Dict[str, Any], units: float) -> Dict[str, Any]:
+    return dict(zone, name=name, datum=datum, ellipsoid="GRS80", units=units)
+
+
+def _utm(name: str, datum: str, ellipsoid: str, zone: int, south: bool = False) -> Dict[str, Any]:
+    return {"name": name, "datum": datum, "ellipsoid": ellipsoid, "projection": "tmerc", "lat_0": 0.0,
+            "lon_0": zone * 6 - 183.0, "k_0": 0.9996, "x_0": 500000.0, "y_0": 10000000.0 if south else 0.0, "units": 1.0}
+
+
+# CRS the built-in transforms know, by EPSG code
+WELL_KNOWN_CRS: Dict[int, Dict[str, Any]] = {
+    4326: {"name": "WGS 84", "datum": "WGS 84", "ellipsoid": "WGS84", "projection": "longlat"},
+    4269: {"name": "NAD83", "datum": "NAD83", "ellipsoid": "GRS80", "projection": "longlat"},
+    4152: {"name": "NAD83(HARN)", "datum": "NAD83(HARN)", "ellipsoid": "GRS80", "projection": "longlat"},
+    6318: {"name": "NAD83(2011)", "datum": "NAD83(2011)", "ellipsoid": "GRS80", "projection": "longlat"},
+    3857: {"name": "WGS 84 / Pseudo-Mercator", "datum": "WGS 84", "ellipsoid": "WGS84", "projection": "webmerc"},
+    2285: _state_plane("NAD83 / Washington North (ftUS)", "NAD83", _WA_NORTH, US_SURVEY_FOOT),
+    2286: _state_plane("NAD83 / Washington South (ftUS)", "NAD83", _WA_SOUTH, US_SURVEY_FOOT),
+    32148: _state_plane("NAD83 / Washington North", "NAD83", _WA_NORTH, 1.0),
+    32149: _state_plane("NAD83 / Washington South", "NAD83", _WA_SOUTH, 1.0),
+    2855: _state_plane("NAD83(HARN) / Washington North", "NAD83(HARN)", _WA_NORTH, 1.0),
+    2856: _state_plane("NAD83(HARN) / Washington South", "NAD83(HARN)", _WA_SOUTH, 1.0),
+    2926: _state_plane("NAD83(HARN) / Washington North (ftUS)", "NAD83(HARN)", _WA_NORTH, US_SURVEY_FOOT),
+    2927: _state_plane("NAD83(HARN) / Washington South (ftUS)", "NAD83(HARN)", _WA_SOUTH, US_SURVEY_FOOT),
+    6596: _state_plane("NAD83(2011) / Washington North", "NAD83(2011)", _WA_NORTH, 1.0),
+    6597: _state_plane("NAD83(2011) / Washington North (ftUS)", "NAD83(2011)", _WA_NORTH, US_SURVEY_FOOT),
+    6598: _state_plane("NAD83(2011) / Washington South", "NAD83(2011)", _WA_SOUTH, 1.0),
+    6599: _state_plane("NAD83(2011) / Washington South (ftUS)", "NAD83(2011)", _WA_SOUTH, US_SURVEY_FOOT),
+}
+WELL_KNOWN_CRS.update({26900 + z: _utm(f"NAD83 / UTM zone {z}N", "NAD83", "GRS80", z) for z in range(1, 24)})
+WELL_KNOWN_CRS.update({32600 + z: _utm(f"WGS 84 / UTM zone {z}N", "WGS 84", "WGS84", z) for z in range(1, 61)})
+WELL_KNOWN_CRS.update({32700 + z: _utm(f"WGS 84 / UTM zone {z}S", "WGS 84", "WGS84", z, south=True) for z in range(1, 61)})
+
+# Latitude limit of Web Mercator
+WEB_MERCATOR_MAX_LATITUDE = 85.0511287798066
+
+
+def parse_srid(value: Any, name: str = "srid") -> int:
+    """
+    An EPSG code given as a number or "EPSG:xxxx".
+
+    Raises:
+        ValueError: If the value is not an EPSG code
+    """
+    if isinstance(value, str) and value.upper().startswith("EPSG:"):
+        value = value[5:]
+    try:
+        srid = int(value)
+    except (TypeError, ValueError):
+        srid = 0
+    if isinstance(value, bool) or srid <= 0:
+        raise ValueError(f"{name} must be an EPSG code, e.g. 4326 or \"EPSG:3857\"")
+    return srid
+
+
+def crs_known(srid: int) -> bool:
+    """Whether this process can reproject to or from an EPSG code."""
+    if PYPROJ_AVAILABLE:
+        try:
+            CRS.from_epsg(srid)
+            return True
+        except CRSError:
+            return False
+    return srid in WELL_KNOWN_CRS
+
+
+class _Projection:
+    """Forward and inverse formulas of a built-in CRS, in its own units and degrees."""
+
+    def __init__(self, srid: int):
+        self.definition = WELL_KNOWN_CRS[srid]
+        a, inverse_flattening = ELLIPSOIDS[self.definition["ellipsoid"]]
+        self.a = a
+        f = 1 / inverse_flattening
+        self.e2 = f * (2 - f)
+        self.e = math.sqrt(self.e2)
+        self.units = self.definition.get("units", 1.0)
+        kind = self.definition["projection"]
+        if kind == "lcc":
+            self._setup_lcc()
+        elif kind == "tmerc":
+            self._setup_tmerc()
+
+    def forward(self, lon: float, lat: float) -> Tuple[float, float]:
+        kind = self.definition["projection"]
+        if kind == "longlat":
+            return lon, lat
+        if kind == "webmerc":
+            lat = max(-WEB_MERCATOR_MAX_LATITUDE, min(WEB_MERCATOR_MAX_LATITUDE, lat))
+            return self.a * math.radians(lon), self.a * math.log(math.tan(math.pi / 4 + math.radians(lat) / 2))
+        if kind == "lcc":
+            x, y = self._lcc_forward(math.radians(lon), math.radians(lat))
+        else:
+            x, y = self._tmerc_forward(math.radians(lon), math.radians(lat))
+        return x / self.units, y / self.units
+
+    def inverse(self, x: float, y: float) -> Tuple[float, float]:
+        kind = self.definition["projection"]
+        if kind == "longlat":
+            return x, y
+        if kind == "webmerc":
+            return math.degrees(x / self.a), math.degrees(2 * math.atan(math.exp(y / self.a)) - math.pi / 2)
+        x, y = x * self.units, y * self.units
+        if kind == "lcc":
+            lon, lat = self._lcc_inverse(x, y)
+        else:
+            lon, lat = self._tmerc_inverse(x, y)
+        return math.degrees(lon), math.degrees(lat)
+
+    # Lambert Conformal Conic (2SP), EPSG method 9802 --------------------------
+
+    def _m(self, phi: float) -> float:
+        return math.cos(phi) / math.sqrt(1 - self.e2 * math.sin(phi) ** 2)
+
+    def _t(self, phi: float) -> float:
+        s = self.e * math.sin(phi)
+        return math.tan(math.pi / 4 - phi / 2) / ((1 - s) / (1 + s)) ** (self.e / 2)
+
+    def _setup_lcc(self) -> None:
+        d = self.definition
+        phi1, phi2, phi0 = math.radians(d["lat_1"]), math.radians(d["lat_2"]), math.radians(d["lat_0"])
+        m1, m2 = self._m(phi1), self._m(phi2)
+        t1, t2, t0 = self._t(phi1), self._t(phi2), self._t(phi0)
+        self.n = (math.log(m1) - math.log(m2)) / (math.log(t1) - math.log(t2))
+        self.F = m1 / (self.n * t1 ** self.n)
+        self.r0 = self.a * self.F * t0 ** self.n
+        self.lon0 = math.radians(d["lon_0"])
+
+    def _lcc_forward(self, lon: float, lat: float) -> Tuple[float, float]:
+        r = self.a * self.F * self._t(lat) ** self.n
+        theta = self.n * (lon - self.lon0)
+        d = self.definition
+        return d["x_0"] + r * math.sin(theta), d["y_0"] + self.r0 - r * math.cos(theta)
+
+    def _lcc_inverse(self, x: float, y: float) -> Tuple[float, float]:
+        d = self.definition
+        dx, dy = x - d["x_0"], self.r0 - (y - d["y_0"])
+        sign = 1 if self.n > 0 else -1
+        r = sign * math.hypot(dx, dy)
+        theta = math.atan2(sign * dx, sign * dy)
+        t = (r / (self.a * self.F)) ** (1 / self.n)
+        lat = math.pi / 2 - 2 * math.atan(t)
+        for _ in range(15):
+            s = self.e * math.sin(lat)
+            next_lat = math.pi / 2 - 2 * math.atan(t * ((1 - s) / (1 + s)) ** (self.e / 2))
+            if abs(next_lat - lat) < 1e-12:
+                lat = next_lat
+                break
+            lat = next_lat
+        return theta / self.n + self.lon0, lat
+
+    # Transverse Mercator, EPSG method 9807 (Snyder's series) ------------------
+
+    def _meridian_arc(self, phi: float) -> float:
+        e2 = self.e2
+        e4, e6 = e2 * e2, e2 * e2 * e2
+        return self.a * ((1 - e2 / 4 - 3 * e4 / 64 - 5 * e6 / 256) * phi
+                         - (3 * e2 / 8 + 3 * e4 / 32 + 45 * e6 / 1024) * math.sin(2 * phi)
+                         + (15 * e4 / 256 + 45 * e6 / 1024) * math.sin(4 * phi)
+                         - (35 * e6 / 3072) * math.sin(6 * phi))
+
+    def _setup_tmerc(self) -> None:
+        d = self.definition
+        self.k0 = d["k_0"]
+        self.lon0 = math.radians(d["lon_0"])
+        self.ep2 = self.e2 / (1 - self.e2)
+        self.M0 = self._meridian_arc(math.radians(d["lat_0"]))
+
+    def _tmerc_forward(self, lon: float, lat: float) -> Tuple[float, float]:
+        d = self.definition
+        sin_lat, cos_lat = math.sin(lat), math.cos(lat)
+        T = math.tan(lat) ** 2
+        C = self.ep2 * cos_lat ** 2
+        A = (lon - self.lon0) * cos_lat
+        nu = self.a / math.sqrt(1 - self.e2 * sin_lat ** 2)
+        M = self._meridian_arc(lat)
+        x = d["x_0"] + self.k0 * nu * (A + (1 - T + C) * A ** 3 / 6
+                                       + (5 - 18 * T + T * T + 72 * C - 58 * self.ep2) * A ** 5 / 120)
+        y = d["y_0"] + self.k0 * (M - self.M0 + nu * math.tan(lat) * (
+            A ** 2 / 2 + (5 - T + 9 * C + 4 * C * C) * A ** 4 / 24
+            + (61 - 58 * T + T * T + 600 * C - 330 * self.ep2) * A ** 6 / 720))
+        return x, y
+
+    def _tmerc_inverse(self, x: float, y: float) -> Tuple[float, float]:
+        d = self.definition
+        e2 = self.e2
+        M1 = self.M0 + (y - d["y_0"]) / self.k0
+        mu = M1 / (self.a * (1 - e2 / 4 - 3 * e2 ** 2 / 64 - 5 * e2 ** 3 / 256))
+        e1 = (1 - math.sqrt(1 - e2)) / (1 + math.sqrt(1 - e2))
+        phi1 = (mu + (3 * e1 / 2 - 27 * e1 ** 3 / 32) * math.sin(2 * mu)
+                + (21 * e1 ** 2 / 16 - 55 * e1 ** 4 / 32) * math.sin(4 * mu)
+                + (151 * e1 ** 3 / 96) * math.sin(6 * mu)
+                + (1097 * e1 ** 4 / 512) * math.sin(8 * mu))
+        sin1, cos1 = math.sin(phi1), math.cos(phi1)
+        nu1 = self.a / math.sqrt(1 - e2 * sin1 ** 2)
+        rho1 = self.a * (1 - e2) / (1 - e2 * sin1 ** 2) ** 1.5
+        T1 = math.tan(phi1) ** 2
+        C1 = self.ep2 * cos1 ** 2
+        D = (x - d["x_0"]) / (nu1 * self.k0)
+        lat = phi1 - (nu1 * math.tan(phi1) / rho1) * (
+            D ** 2 / 2 - (5 + 3 * T1 + 10 * C1 - 4 * C1 ** 2 - 9 * self.ep2) * D ** 4 / 24
+            + (61 + 90 * T1 + 298 * C1 + 45 * T1 ** 2 - 252 * self.ep2 - 3 * C1 ** 2) * D ** 6 / 720)
+        lon = self.lon0 + (D - (1 + 2 * T1 + C1) * D ** 3 / 6
+                           + (5 - 2 * C1 + 28 * T1 - 3 * C1 ** 2 + 8 * self.ep2 + 24 * T1 ** 2) * D ** 5 / 120) / cos1
+        return lon, lat
+
+
+class _BuiltinTransform:
+    """A transform between two CRS of WELL_KNOWN_CRS, through longitude/latitude."""
+
+    def __init__(self, source: int, target: int):
+        self.source = _Projection(source)
+        self.target = _Projection(target)
+
+    def transform(self, x: float, y: float) -> Tuple[float, float]:
+        return self.target.forward(*self.source.inverse(x, y))
+
+
+class Reprojector:
+    """
+    Reprojects the features of an export to one CRS, caching a transform per
+    source EPSG code and collecting accuracy warnings as it goes.
+
+    A reprojector without a target passes features through unchanged.
+    """
+
+    def __init__(self, srid: Optional[int]):
+        """
+        Initialize the reprojector.
+
+        Args:
+            srid: EPSG code features are written in (None to leave them as they are)
+
+        Raises:
+            ValueError: If the EPSG code is unknown
+        """
+        if srid is not None and not crs_known(srid):
+            raise ValueError(self._unknown(srid))
+        self.srid = srid
+        self.engine = "pyproj" if PYPROJ_AVAILABLE else "builtin"
+        self.warnings: List[str] = []
+        self.sources: Dict[int, int] = {}
+        self._transforms: Dict[int, Any] = {}
+
+    @property
+    def active(self) -> bool:
+        return self.srid is not None
+
+    def check(self, source: Optional[int]) -> None:
+        """
+        Check that features in a CRS can be reprojected, before reading any.
+
+        Raises:
+            ValueError: If there is no transform from the source CRS
+        """
+        if self.active and source is not None and source != self.srid:
+            self._transform(source)
+
+    def layer(self, layer):
+        """The export layer as its writer sees it: a copy in the target CRS."""
+        if not self.active or layer.srid == self.srid:
+            return layer
+        reprojected = copy.copy(layer)
+        reprojected.srid = self.srid
+        return reprojected
+
+    def features(self, features: Iterator[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+        """Yield the features reprojected to the target CRS."""
+        for feature in features:
+            yield self.feature(feature)
+
+    def feature(self, feature: Dict[str, Any]) -> Dict[str, Any]:
+        """
+        A feature reprojected to the target CRS. Features without an SRID
+        are taken to be in WGS 84 longitude/latitude.
+        """
+        if not self.active:
+            return feature
+        self.count(feature)
+        return self.project(feature)
+
+    def count(self, feature: Dict[str, Any]) -> None:
+        """Count a feature's source CRS, checking it can be reprojected."""
+        source = feature.get("srid") or 4326
+        if source != self.srid and feature.get("geometry"):
+            self._transform(source)
+            self.sources[source] = self.sources.get(source, 0) + 1
+
+    def project(self, feature: Dict[str, Any]) -> Dict[str, Any]:
+        """A feature reprojected without counting it, as geometry workers do (see gis_parallel)."""
+        source = feature.get("srid") or 4326
+        geometry = feature.get("geometry")
+        if source == self.srid or not geometry:
+            return dict(feature, srid=self.srid)
+        transform = self._transform(source)
+
+        def walk(coordinates):
+            if coordinates and isinstance(coordinates[0], (int, float)):
+                x, y = transform.transform(coordinates[0], coordinates[1])
+                return [x, y] + list(coordinates[2:3])
+            return [walk(c) for c in coordinates]
+
+        return dict(feature, geometry={"type": geometry["type"], "coordinates": walk(geometry["coordinates"])},
+                    srid=self.srid)
+
+    def summary(self) -> Dict[str, Any]:
+        """What was reprojected, for the export job."""
+        return {
+            "srid": self.srid,
+            "engine": self.engine,
+            "features_by_source_srid": {str(srid): count for srid, count in self.sources.items()},
+            "warnings": self.warnings,
+        }
+
+    def _transform(self, source: int):
+        if source in self._transforms:
+            return self._transforms[source]
+        if not crs_known(source):
+            raise ValueError(self._unknown(source))
+        if PYPROJ_AVAILABLE:
+            transform = Transformer.from_crs(source, self.srid, always_xy=True)
+            accuracy = getattr(transform, "accuracy", -1)
+            if "ballpark" in (transform.description or "").lower():
+                self._warn(f"EPSG:{source} to EPSG:{self.srid} uses a ballpark transform ({transform.description}) "
+                           "because a more accurate one is not installed; positions may be off by several meters")
+            elif accuracy is not None and accuracy > ACCURACY_WARNING_METERS:
+                self._warn(f"EPSG:{source} to EPSG:{self.srid} ({transform.description}) is accurate to about {accuracy:g} m")
+        else:
+            transform = _BuiltinTransform(source, self.srid)
+            source_datum, target_datum = WELL_KNOWN_CRS[source]["datum"], WELL_KNOWN_CRS[self.srid]["datum"]
+            if source_datum != target_datum:
+                self._warn(f"EPSG:{source} ({source_datum}) to EPSG:{self.srid} ({target_datum}) treats the datum shift as "
+                           f"zero; positions may be off by up to {NULL_DATUM_SHIFT_METERS} m (install pyproj for an exact shift)")
+        self._transforms[source] = transform
+        return transform
+
+    def _warn(self, message: str) -> None:
+        logger.warning(f"Reprojection: {message}")
+        self.warnings.append(message)
+
+    @staticmethod
+    def _unknown(srid: int) -> str:
+        if PYPROJ_AVAILABLE:
+            return f"Unknown coordinate system EPSG:{srid}"
+        return (f"EPSG:{srid} cannot be reprojected without pyproj (pip install pyproj); "
+                f"built-in transforms cover EPSG {', '.join(str(s) for s in sorted(WELL_KNOWN_CRS) if s < 26900)}, "
+                "NAD83 UTM (269xx) and WGS 84 UTM (326xx, 327xx)")
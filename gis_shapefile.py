@@ -0,0 +1,465 @@
+"""
+TerraFusion Platform - Shapefile Writer
+
+This module provides the writer GIS exports use to produce Esri shapefiles
+for consumers that still need them. Each layer becomes a .shp/.shx/.dbf set
+plus:
+
+- a .prj holding the export SRID's coordinate system (from pyproj when it is
+  installed, otherwise from the definitions below),
+- a .cpg declaring UTF-8 text,
+- a {name}_fields.csv sidecar listing every DBF field with the property it
+  holds, since DBF field names are limited to 10 characters.
+
+Field names are truncated deterministically: the property name is reduced to
+letters, digits and underscores and cut to 10 characters; a name that clashes
+with an earlier field (ignoring case) is cut further and given a numeric
+suffix, so land_value and land_value_prior become land_value and land_val_1.
+Fields are taken in the order the layer's records list them, so the same
+table always maps the same way.
+
+DBF has no types for nested values or timestamps, so values are coerced:
+booleans to L, integers and decimals to N (widest value decides the width),
+dates to D, and everything else (timestamps in ISO 8601, objects as JSON) to
+C. A field whose values have mixed types is written as C. Text longer than
+254 bytes is cut, and the number of cut values is reported.
+
+Geometry is written while features stream in; attributes are spooled to a
+temporary file until the layer ends, because DBF field widths must be known
+before the first record.
+"""
+
+import os
+import re
+import csv
+import json
+import struct
+import logging
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Iterable, Tuple
+
+from gis_features import ExportLayer, Bounds, FeatureSpool, geometry_bounds, geometry_has_z, iter_points, merge_bounds
+from sync_connectors import _oriented
+
+try:
+    from pyproj import CRS
+    PYPROJ_AVAILABLE = True
+except ImportError:
+    PYPROJ_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Longest DBF field name, C field and N field
+DBF_FIELD_NAME_LENGTH = 10
+DBF_MAX_CHARACTER_WIDTH = 254
+DBF_MAX_NUMERIC_WIDTH = 19
+
+# Most decimal places kept in N fields
+DBF_MAX_DECIMALS = 8
+
+# Neither .shp nor .dbf files may reach 2 GB (offsets are signed 32-bit word counts)
+SHAPEFILE_MAX_BYTES = 2 ** 31 - 1
+
+# Written as the M value of Z shapes ("no data")
+SHAPEFILE_NO_DATA = -1.0e39
+
+# Shape types, without and with Z
+SHAPE_NULL = 0
+SHAPE_TYPES = {
+    "Point": (1, 11),
+    "MultiPoint": (8, 18),
+    "LineString": (3, 13),
+    "Polygon": (5, 15),
+}
+
+# The shape type each geometry type is written as
+SHAPE_FAMILIES = {
+    "Point": "Point",
+    "MultiPoint": "MultiPoint",
+    "LineString": "LineString",
+    "MultiLineString": "LineString",
+    "Polygon": "Polygon",
+    "MultiPolygon": "Polygon",
+}
+
+# .prj contents for coordinate systems counties commonly export in, used when pyproj is not installed
+ESRI_PRJ = {
+    4326: (
+        'GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],'
+        'PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]'
+    ),
+    2927: (
+        'PROJCS["NAD_1983_HARN_StatePlane_Washington_South_FIPS_4602_Feet",'
+        'GEOGCS["GCS_North_American_1983_HARN",DATUM["D_North_American_1983_HARN",'
+        'SPHEROID["GRS_1980",6378137.0,298.257222101]],PRIMEM["Greenwich",0.0],'
+        'UNIT["Degree",0.0174532925199433]],PROJECTION["Lambert_Conformal_Conic"],'
+        'PARAMETER["False_Easting",1640416.666666667],PARAMETER["False_Northing",0.0],'
+        'PARAMETER["Central_Meridian",-120.5],PARAMETER["Standard_Parallel_1",45.83333333333334],'
+        'PARAMETER["Standard_Parallel_2",47.33333333333334],PARAMETER["Latitude_Of_Origin",45.33333333333334],'
+        'UNIT["Foot_US",0.3048006096012192]]'
+    ),
+}
+
+
+def shapefile_name(name: str) -> str:
+    """A layer name as a shapefile base name."""
+    return re.sub(r"[^A-Za-z0-9_-]+", "_", name).strip("_") or "layer"
+
+
+def dbf_field_names(names: List[str]) -> Dict[str, str]:
+    """
+    DBF field names for property names, in order (see the module docstring).
+
+    Returns:
+        Property name to field name
+    """
+    fields: Dict[str, str] = {}
+    taken = set()
+    for name in names:
+        base = re.sub(r"[^A-Za-z0-9_]", "_", name.encode("ascii", "ignore").decode()) or "FIELD"
+        if not base[0].isalpha():
+            base = f"F{base}"
+        candidate = base[:DBF_FIELD_NAME_LENGTH]
+        suffix = 1
+        while candidate.upper() in taken:
+            tail = f"_{suffix}"
+            candidate = base[:DBF_FIELD_NAME_LENGTH - len(tail)] + tail
+            suffix += 1
+        taken.add(candidate.upper())
+        fields[name] = candidate
+    return fields
+
+
+def esri_prj(srid: Optional[int]) -> Optional[str]:
+    """The .prj (Esri WKT) of a coordinate system, or None when it is not known."""
+    if srid is None:
+        return None
+    if PYPROJ_AVAILABLE:
+        try:
+            return CRS.from_epsg(srid).to_wkt("WKT1_ESRI")
+        except Exception as e:
+            logger.warning(f"Cannot look up the definition of EPSG:{srid}: {e}")
+    return ESRI_PRJ.get(srid)
+
+
+def dbf_kind(value: Any) -> str:
+    """The DBF field type a property value is written as."""
+    if isinstance(value, bool):
+        return "L"
+    if isinstance(value, (int, float, Decimal)):
+        return "N"
+    if isinstance(value, date) and not isinstance(value, datetime):
+        return "D"
+    return "C"
+
+
+def dbf_text(value: Any) -> str:
+    """A property value as the text of a C field."""
+    if isinstance(value, str):
+        return value
+    if isinstance(value, (dict, list)):
+        return json.dumps(value, default=str)
+    if isinstance(value, (bytes, bytearray, memoryview)):
+        return bytes(value).hex()
+    if hasattr(value, "isoformat"):
+        return value.isoformat()
+    return str(value)
+
+
+def dbf_number(value: Any, decimals: int) -> str:
+    """A numeric property value with a fixed number of decimal places."""
+    return f"{Decimal(str(value)):.{decimals}f}"
+
+
+class DbfField:
+    """A DBF field and what its values need (type, width, decimals)."""
+
+    def __init__(self, name: str, source: str):
+        self.name = name
+        self.source = source
+        self.kind: Optional[str] = None
+        self.width = 1
+        self.decimals = 0
+        self.integer_digits = 1
+
+    def observe(self, value: Any) -> None:
+        """Widen the field to take a value."""
+        if value is None:
+            return
+        kind = dbf_kind(value)
+        if self.kind is None:
+            self.kind = kind
+        elif self.kind != kind:
+            self.kind = "C"
+        if isinstance(value, float) and value != value:
+            # NaN is written as a blank
+            return
+        if kind == "N":
+            number = Decimal(str(value))
+            # A decimal's scale is kept (money stays at 2 places); floats drop trailing zeros
+            fraction = format(number, "f").partition(".")[2]
+            places = len(fraction) if isinstance(value, Decimal) else len(fraction.rstrip("0"))
+            self.decimals = max(self.decimals, min(places, DBF_MAX_DECIMALS))
+            whole = format(round(number, DBF_MAX_DECIMALS), "f").partition(".")[0]
+            self.integer_digits = max(self.integer_digits, len(whole))
+        self.width = max(self.width, len(dbf_text(value).encode("utf-8")))
+
+    def finish(self) -> None:
+        """Settle the type and width once every value is seen."""
+        if self.kind is None:
+            self.kind = "C"
+        if self.kind == "N":
+            self.decimals = min(self.decimals, max(DBF_MAX_NUMERIC_WIDTH - self.integer_digits - 1, 0))
+            self.width = self.integer_digits + (self.decimals + 1 if self.decimals else 0)
+            if self.width > DBF_MAX_NUMERIC_WIDTH:
+                # Too large for N: keep the digits as text
+                self.kind, self.decimals = "C", 0
+        if self.kind == "L":
+            self.width = 1
+        elif self.kind == "D":
+            self.width = 8
+        elif self.kind == "C":
+            self.width = min(max(self.width, 1), DBF_MAX_CHARACTER_WIDTH)
+
+    def encode(self, value: Any) -> Tuple[bytes, bool]:
+        """The bytes of a value in this field, and whether it had to be cut."""
+        if value is None or (isinstance(value, float) and value != value):
+            blank = b"?" if self.kind == "L" else b" " * self.width
+            return blank, False
+        if self.kind == "L":
+            return (b"T" if value else b"F"), False
+        if self.kind == "D":
+            return value.strftime("%Y%m%d").encode("ascii"), False
+        if self.kind == "N":
+            return dbf_number(value, self.decimals).rjust(self.width).encode("ascii"), False
+        data = dbf_text(value).encode("utf-8")
+        if len(data) <= self.width:
+            return data.ljust(self.width), False
+        # Cut on a character boundary
+        return data[:self.width].decode("utf-8", "ignore").encode("utf-8").ljust(self.width), True
+
+
+class ShapefileWriter:
+    """Writes feature layers as shapefiles into a directory."""
+
+    def __init__(self, directory: str):
+        """
+        Initialize the writer.
+
+        Args:
+            directory: Directory the files of every layer are written to
+        """
+        self.directory = directory
+        self.files: List[str] = []
+        self._names = set()
+
+    def add_layer(self, layer: ExportLayer, features: Iterable[Dict[str, Any]]) -> Dict[str, Any]:
+        """
+        Write a layer as a shapefile.
+
+        Args:
+            layer: Layer being written
+            features: Features of the layer (see gis_features)
+
+        Returns:
+            Summary: name, features, shape_type, srid, bounds, fields (DBF
+            field to property), truncated_values and files
+
+        Raises:
+            ValueError: If the layer mixes geometry types a shapefile cannot
+                hold together, or a file would exceed 2 GB
+        """
+        name = shapefile_name(layer.name)
+        suffix = 1
+        while name.lower() in self._names:
+            suffix += 1
+            name = f"{shapefile_name(layer.name)}_{suffix}"
+        self._names.add(name.lower())
+        base = os.path.join(self.directory, name)
+
+        family = SHAPE_FAMILIES.get(layer.geometry_type) if layer.geometry_type else None
+        has_z = None
+        srid = layer.srid
+        bounds = None
+        z_range = None
+        count = 0
+        shp_offset = 100
+        shx_entries: List[Tuple[int, int]] = []
+        properties_seen: Dict[str, None] = {}
+
+        spool = FeatureSpool()
+        shp = open(f"{base}.shp", "wb")
+        try:
+            shp.write(b"\0" * 100)
+            for feature in features:
+                geometry = feature.get("geometry")
+                if geometry:
+                    feature_family = SHAPE_FAMILIES[geometry["type"]]
+                    if family is None:
+                        family = feature_family
+                    elif family != feature_family and (family, feature_family) != ("MultiPoint", "Point"):
+                        hint = " (set the layer's geometry_type to MultiPoint)" if feature_family == "MultiPoint" else ""
+                        raise ValueError(
+                            f"Export layer {layer.name} mixes {family} and {geometry['type']} geometry, "
+                            f"which one shapefile cannot hold{hint}"
+                        )
+                    if has_z is None:
+                        has_z = geometry_has_z(geometry)
+                    if srid is None:
+                        srid = feature.get("srid")
+                    bounds = merge_bounds(bounds, geometry_bounds(geometry))
+                    z_range = self._merge_z(z_range, geometry)
+                content = self._shape(geometry, family, bool(has_z))
+                count += 1
+                shp.write(struct.pack(">ii", count, len(content) // 2) + content)
+                shx_entries.append((shp_offset, len(content)))
+                shp_offset += 8 + len(content)
+                if shp_offset > SHAPEFILE_MAX_BYTES:
+                    raise ValueError(f"Export layer {layer.name} is too large for a shapefile (over 2 GB)")
+                for key in feature["properties"]:
+                    properties_seen.setdefault(key)
+                spool.append(feature["properties"])
+
+            shape_type = SHAPE_NULL if family is None else SHAPE_TYPES[family][1 if has_z else 0]
+            header_bounds = bounds or (0.0, 0.0, 0.0, 0.0)
+            shp.seek(0)
+            shp.write(self._header(shp_offset, shape_type, header_bounds, z_range))
+        finally:
+            shp.close()
+
+        with open(f"{base}.shx", "wb") as shx:
+            shx.write(self._header(100 + 8 * len(shx_entries), shape_type, header_bounds, z_range))
+            for offset, length in shx_entries:
+                shx.write(struct.pack(">ii", offset // 2, length // 2))
+
+        fields = [DbfField(field, source) for source, field in dbf_field_names(list(properties_seen)).items()]
+        for properties in spool:
+            for field in fields:
+                field.observe(properties.get(field.source))
+        for field in fields:
+            field.finish()
+        truncated = self._write_dbf(f"{base}.dbf", fields, spool, count)
+        spool.close()
+        if truncated:
+            logger.warning(f"Cut {truncated} text values of export layer {layer.name} to {DBF_MAX_CHARACTER_WIDTH} bytes")
+
+        files = [f"{base}.shp", f"{base}.shx", f"{base}.dbf"]
+        with open(f"{base}.cpg", "w") as f:
+            f.write("UTF-8")
+        files.append(f"{base}.cpg")
+        prj = esri_prj(srid if srid is not None else (4326 if bounds else None))
+        if prj:
+            with open(f"{base}.prj", "w") as f:
+                f.write(prj)
+            files.append(f"{base}.prj")
+        elif srid is not None:
+            logger.warning(f"No coordinate system definition for EPSG:{srid}; {name}.shp is written without a .prj")
+        with open(f"{base}_fields.csv", "w", newline="", encoding="utf-8") as f:
+            writer = csv.writer(f)
+            writer.writerow(["dbf_field", "source_field", "type", "width", "decimals"])
+            for field in fields:
+                writer.writerow([field.name, field.source, field.kind, field.width, field.decimals])
+        files.append(f"{base}_fields.csv")
+        self.files.extend(files)
+
+        logger.info(f"Wrote {count} features of layer {layer.name} to {name}.shp")
+        return {
+            "name": name,
+            "features": count,
+            "shape_type": shape_type,
+            "srid": srid,
+            "bounds": list(bounds) if bounds else None,
+            "fields": {field.name: field.source for field in fields},
+            "truncated_values": truncated,
+            "files": [os.path.basename(f) for f in files],
+        }
+
+    @staticmethod
+    def _merge_z(z_range: Optional[Tuple[float, float]], geometry: Dict[str, Any]) -> Optional[Tuple[float, float]]:
+        for point in iter_points(geometry):
+            if len(point) > 2:
+                z = float(point[2])
+                z_range = (min(z_range[0], z), max(z_range[1], z)) if z_range else (z, z)
+        return z_range
+
+    @staticmethod
+    def _header(length: int, shape_type: int, bounds: Bounds, z_range: Optional[Tuple[float, float]]) -> bytes:
+        """The 100-byte header shared by .shp and .shx files."""
+        z_min, z_max = z_range or (0.0, 0.0)
+        return (
+            struct.pack(">i5ii", 9994, 0, 0, 0, 0, 0, length // 2)
+            + struct.pack("<ii", 1000, shape_type)
+            + struct.pack("<8d", *bounds, z_min, z_max, 0.0, 0.0)
+        )
+
+    @staticmethod
+    def _shape(geometry: Optional[Dict[str, Any]], family: Optional[str], has_z: bool) -> bytes:
+        """The record contents of one geometry."""
+        if not geometry or geometry_bounds(geometry) is None:
+            return struct.pack("<i", SHAPE_NULL)
+        shape_type = SHAPE_TYPES[family][1 if has_z else 0]
+        kind, coordinates = geometry["type"], geometry["coordinates"]
+
+        if family == "Point":
+            values = [float(v) for v in coordinates[:2]]
+            if has_z:
+                values += [float(coordinates[2]) if len(coordinates) > 2 else 0.0, SHAPEFILE_NO_DATA]
+            return struct.pack(f"<i{len(values)}d", shape_type, *values)
+
+        if family == "MultiPoint":
+            parts = [[coordinates]] if kind == "Point" else [coordinates]
+        elif family == "LineString":
+            parts = [coordinates] if kind == "LineString" else coordinates
+        else:
+            polygons = [coordinates] if kind == "Polygon" else coordinates
+            # Outer rings clockwise, holes counterclockwise
+            parts = [_oriented(ring, clockwise=(i == 0)) for polygon in polygons for i, ring in enumerate(polygon)]
+        points = [point for part in parts for point in part]
+        xs = [float(p[0]) for p in points]
+        ys = [float(p[1]) for p in points]
+        box = struct.pack("<4d", min(xs), min(ys), max(xs), max(ys))
+        xy = struct.pack(f"<{2 * len(points)}d", *[v for p in points for v in (float(p[0]), float(p[1]))])
+
+        if family == "MultiPoint":
+            content = struct.pack("<i", shape_type) + box + struct.pack("<i", len(points)) + xy
+        else:
+            starts, start = [], 0
+            for part in parts:
+                starts.append(start)
+                start += len(part)
+            content = (struct.pack("<i", shape_type) + box + struct.pack("<ii", len(parts), len(points))
+                       + struct.pack(f"<{len(starts)}i", *starts) + xy)
+        if has_z:
+            zs = [float(p[2]) if len(p) > 2 else 0.0 for p in points]
+            content += struct.pack(f"<2d{len(zs)}d", min(zs), max(zs), *zs)
+            content += struct.pack(f"<2d{len(points)}d", SHAPEFILE_NO_DATA, SHAPEFILE_NO_DATA,
+                                   *([SHAPEFILE_NO_DATA] * len(points)))
+        return content
+
+    def _write_dbf(self, path: str, fields: List[DbfField], spool: FeatureSpool, count: int) -> int:
+        """Write the .dbf of a layer from its spooled properties; returns the number of cut values."""
+        record_length = 1 + sum(f.width for f in fields)
+        header_length = 32 + 32 * len(fields) + 1
+        if header_length + record_length * count + 1 > SHAPEFILE_MAX_BYTES:
+            raise ValueError(f"Attributes of {os.path.basename(path)} are too large for a shapefile (over 2 GB)")
+        today = date.today()
+        truncated = 0
+        with open(path, "wb") as dbf:
+            dbf.write(struct.pack("<BBBBIHH20x", 0x03, today.year - 1900, today.month, today.day,
+                                  count, header_length, record_length))
+            for field in fields:
+                dbf.write(struct.pack("<11sc4xBB14x", field.name.encode("ascii"), field.kind.encode("ascii"),
+                                      field.width, field.decimals))
+            dbf.write(b"\r")
+            for properties in spool:
+                record = [b" "]
+                for field in fields:
+                    data, cut = field.encode(properties.get(field.source))
+                    truncated += cut
+                    record.append(data)
+                dbf.write(b"".join(record))
+            dbf.write(b"\x1a")
+        return truncated
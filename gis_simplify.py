@@ -0,0 +1,424 @@
+"""
+TerraFusion Platform - Topology-Preserving Simplification
+
+This module simplifies the polygons and lines of an export layer without
+opening gaps or overlaps between neighbors. Simplifying each parcel on its
+own moves a shared boundary differently on either side of it; here the layer
+is first broken into arcs, the runs of boundary between junctions (vertices
+where the set of features meeting changes), and each arc is simplified once
+and used by every ring along it. A vertex is only dropped when no other
+vertex of the layer falls between the arc and its shortcut, so simplified
+boundaries don't cross one another, and rings that would collapse keep their
+full detail.
+
+Exports simplify with a tolerance in the units of the CRS they are written
+in, from a layer's "simplify" setting or parameters.simplify (one number for
+every layer, or a tolerance by layer name); vector tiles simplify each zoom
+level with their mvt settings instead (see gis_mvt). Simplified geometry is
+two-dimensional.
+
+Topology needs the whole layer, so features are spooled to disk (see
+gis_features.FeatureSpool) and read back once the arcs are known; the
+vertices themselves are held in memory while the layer is simplified. With
+geometry workers (see gis_parallel) the layer's arcs are all simplified on
+them before the features are read back, each worker inheriting the topology.
+"""
+
+import math
+import logging
+from typing import Dict, List, Any, Optional, Iterator, Iterable, Set, Tuple
+
+from gis_features import OUTSIDE, ExportLayer, FeatureSpool, locate_point, ring_edges
+from gis_parallel import GeometryStage, parallel_enabled
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+Point = Tuple[float, float]
+
+# Vertices per spatial index cell, roughly
+INDEX_CELL_POINTS = 4
+
+
+def simplify_tolerance(layer: ExportLayer, parameters: Optional[Dict[str, Any]]) -> Optional[float]:
+    """
+    The simplification tolerance of a layer in an export, if any.
+
+    Args:
+        layer: Export layer, whose "simplify" setting is the default
+        parameters: Export parameters; "simplify" is a tolerance for every
+            layer or a mapping of layer names to tolerances
+
+    Raises:
+        ValueError: If a tolerance is not a non-negative number
+    """
+    value = layer.settings.get("simplify")
+    requested = (parameters or {}).get("simplify")
+    if isinstance(requested, dict):
+        value = requested.get(layer.name, value)
+    elif requested is not None:
+        value = requested
+    if value is None:
+        return None
+    if isinstance(value, bool) or not isinstance(value, (int, float)) or value < 0 or not math.isfinite(value):
+        raise ValueError(f"Layer {layer.name}: simplify must be a non-negative tolerance in the units of the export's CRS")
+    return float(value) or None
+
+
+def _open(part: Iterable[Any], closed: bool) -> List[Point]:
+    """A part as (x, y) points without repeats; rings without their closing point."""
+    points: List[Point] = []
+    for p in part:
+        point = (float(p[0]), float(p[1]))
+        if not points or points[-1] != point:
+            points.append(point)
+    if closed and len(points) > 1 and points[0] == points[-1]:
+        points.pop()
+    return points
+
+
+def _area(ring: List[Point]) -> float:
+    return sum(ring[i - 1][0] * ring[i][1] - ring[i][0] * ring[i - 1][1] for i in range(len(ring))) / 2
+
+
+class Topology:
+    """
+    The shared boundaries of a set of rings and lines: which vertices are
+    junctions, and every vertex for checking shortcuts against.
+    """
+
+    def __init__(self):
+        self._neighbors: Dict[Point, Set[Point]] = {}
+        self._junctions: Set[Point] = set()
+        self._grid: Dict[Tuple[int, int], List[Point]] = {}
+        self._cell = 1.0
+        self.frozen = False
+
+    def add(self, parts: Iterable[Iterable[Any]], closed: bool) -> None:
+        """
+        Add the rings (closed) or lines of a feature.
+
+        Args:
+            parts: Point lists; a ring's closing point may be left out
+            closed: Whether the parts are rings
+        """
+        for part in parts:
+            points = _open(part, closed)
+            if not points:
+                continue
+            count = len(points)
+            for i, point in enumerate(points):
+                neighbors = self._neighbors.setdefault(point, set())
+                if closed:
+                    neighbors.add(points[i - 1])
+                    neighbors.add(points[(i + 1) % count])
+                else:
+                    if i > 0:
+                        neighbors.add(points[i - 1])
+                    if i < count - 1:
+                        neighbors.add(points[i + 1])
+            if not closed:
+                self._junctions.add(points[0])
+                self._junctions.add(points[-1])
+
+    def freeze(self) -> None:
+        """Find the junctions and index the vertices; call once every feature is added."""
+        for point, neighbors in self._neighbors.items():
+            neighbors.discard(point)
+            if len(neighbors) != 2:
+                self._junctions.add(point)
+        if self._neighbors:
+            xs = [p[0] for p in self._neighbors]
+            ys = [p[1] for p in self._neighbors]
+            span = max(max(xs) - min(xs), max(ys) - min(ys))
+            cells = max(1, int(math.sqrt(len(self._neighbors) / INDEX_CELL_POINTS)))
+            self._cell = span / cells or 1.0
+        for point in self._neighbors:
+            self._grid.setdefault(self._cell_of(point), []).append(point)
+        self.frozen = True
+
+    @property
+    def vertices(self) -> int:
+        return len(self._neighbors)
+
+    def simplification(self, tolerance: float) -> "Simplification":
+        """Arcs simplified at a tolerance."""
+        if not self.frozen:
+            self.freeze()
+        return Simplification(self, tolerance)
+
+    def arcs(self, points: List[Point], closed: bool) -> List[List[Point]]:
+        """An open part split into arcs at its junctions, in its own direction."""
+        if closed:
+            starts = [i for i, p in enumerate(points) if p in self._junctions]
+            # A ring that meets no other feature, or shares all of itself with one, starts at its least vertex
+            first = starts[0] if starts else points.index(min(points))
+            ring = points[first:] + points[:first]
+            ring.append(ring[0])
+            arcs, start = [], 0
+            for i in range(1, len(ring)):
+                if i == len(ring) - 1 or ring[i] in self._junctions:
+                    arcs.append(ring[start:i + 1])
+                    start = i
+            return arcs
+        arcs, start = [], 0
+        for i in range(1, len(points)):
+            if i == len(points) - 1 or points[i] in self._junctions:
+                arcs.append(points[start:i + 1])
+                start = i
+        return arcs
+
+    def near(self, bounds: Tuple[float, float, float, float]) -> Iterator[Point]:
+        """The vertices in a box."""
+        min_x, min_y, max_x, max_y = bounds
+        (cx1, cy1), (cx2, cy2) = self._cell_of((min_x, min_y)), self._cell_of((max_x, max_y))
+        for cx in range(cx1, cx2 + 1):
+            for cy in range(cy1, cy2 + 1):
+                for point in self._grid.get((cx, cy), ()):
+                    if min_x <= point[0] <= max_x and min_y <= point[1] <= max_y:
+                        yield point
+
+    def _cell_of(self, point: Point) -> Tuple[int, int]:
+        return int(math.floor(point[0] / self._cell)), int(math.floor(point[1] / self._cell))
+
+
+class Simplification:
+    """
+    The arcs of a topology simplified at one tolerance, each computed once
+    and shared by every part along it.
+    """
+
+    def __init__(self, topology: Topology, tolerance: float):
+        self.topology = topology
+        self.tolerance = tolerance
+        self._arcs: Dict[Tuple[Point, ...], List[Point]] = {}
+        self.kept: Set[Tuple[Point, ...]] = set()
+
+    def prepare(self, parts: Iterable[Iterable[Any]], closed: bool) -> None:
+        """
+        Check a feature's rings before any part is output, keeping the full
+        detail of the arcs of any ring that would collapse. Every feature
+        must be prepared before the first is simplified.
+        """
+        if not closed:
+            return
+        for part in parts:
+            points = _open(part, closed)
+            if len(points) < 3:
+                continue
+            arcs = [self._canonical(arc) for arc in self.topology.arcs(points, closed)]
+            ring = self._join([self._arc(key, reverse) for key, reverse in arcs])
+            if len(set(ring)) < 3 or not _area(ring):
+                for key, _ in arcs:
+                    self._arcs[key] = list(key)
+                    self.kept.add(key)
+
+    def simplify_arcs(self, keys: Iterable[Tuple[Point, ...]], stage: GeometryStage) -> None:
+        """Simplify arcs, by their keys, on a geometry stage ahead of prepare and parts."""
+        for key, arc in stage.map(lambda key: self._simplify(list(key)), keys):
+            self._arcs[key] = arc
+
+    def parts(self, parts: Iterable[Iterable[Any]], closed: bool) -> List[List[Point]]:
+        """A feature's rings (open) or lines, simplified."""
+        simplified = []
+        for part in parts:
+            points = _open(part, closed)
+            if len(points) < (3 if closed else 2):
+                simplified.append(points)
+                continue
+            arcs = [self._arc(*self._canonical(arc)) for arc in self.topology.arcs(points, closed)]
+            simplified.append(self._join(arcs, closed))
+        return simplified
+
+    def geometry(self, geometry: Optional[Dict[str, Any]], prepare: bool = False) -> Optional[Dict[str, Any]]:
+        """A GeoJSON-style geometry simplified (or, with prepare, checked); points pass through."""
+        if not geometry:
+            return geometry
+        kind, coordinates = geometry["type"], geometry["coordinates"]
+        step = self.prepare if prepare else self.parts
+        if kind == "LineString":
+            result = step([coordinates], False)
+            return None if prepare else {"type": kind, "coordinates": [list(p) for p in result[0]]}
+        if kind == "MultiLineString":
+            result = step(coordinates, False)
+            return None if prepare else {"type": kind, "coordinates": [[list(p) for p in line] for line in result]}
+        if kind == "Polygon":
+            result = step(coordinates, True)
+            return None if prepare else {"type": kind, "coordinates": [self._closed(ring) for ring in result]}
+        if kind == "MultiPolygon":
+            if prepare:
+                for polygon in coordinates:
+                    step(polygon, True)
+                return None
+            return {"type": kind, "coordinates": [[self._closed(ring) for ring in step(polygon, True)] for polygon in coordinates]}
+        return None if prepare else geometry
+
+    @staticmethod
+    def _closed(ring: List[Point]) -> List[List[float]]:
+        return [list(p) for p in ring] + ([list(ring[0])] if ring else [])
+
+    @staticmethod
+    def _canonical(arc: List[Point]) -> Tuple[Tuple[Point, ...], bool]:
+        """An arc's key, the same from either direction, and whether the arc runs against it."""
+        forward = tuple(arc)
+        backward = forward[::-1]
+        return (backward, True) if backward < forward else (forward, False)
+
+    @staticmethod
+    def _join(arcs: List[List[Point]], closed: bool = True) -> List[Point]:
+        points: List[Point] = []
+        for arc in arcs:
+            points.extend(arc if not points else arc[1:])
+        if closed and len(points) > 1 and points[0] == points[-1]:
+            points.pop()
+        return points
+
+    def _arc(self, key: Tuple[Point, ...], reverse: bool) -> List[Point]:
+        if key not in self._arcs:
+            self._arcs[key] = self._simplify(list(key))
+        arc = self._arcs[key]
+        return arc[::-1] if reverse else arc
+
+    def _simplify(self, chain: List[Point]) -> List[Point]:
+        """Douglas-Peucker keeping both ends, refusing shortcuts that would pass another vertex."""
+        if self.tolerance <= 0 or len(chain) < 3:
+            return chain
+        keep = [False] * len(chain)
+        keep[0] = keep[-1] = True
+        squared = self.tolerance * self.tolerance
+        stack = [(0, len(chain) - 1)]
+        while stack:
+            first, last = stack.pop()
+            if last - first < 2:
+                continue
+            (x1, y1), (x2, y2) = chain[first], chain[last]
+            dx, dy = x2 - x1, y2 - y1
+            length = dx * dx + dy * dy
+            farthest, distance = first + 1, -1.0
+            for i in range(first + 1, last):
+                px, py = chain[i]
+                if length:
+                    t = max(0.0, min(1.0, ((px - x1) * dx + (py - y1) * dy) / length))
+                    ex, ey = px - (x1 + t * dx), py - (y1 + t * dy)
+                else:
+                    ex, ey = px - x1, py - y1
+                d = ex * ex + ey * ey
+                if d > distance:
+                    farthest, distance = i, d
+            # A closed arc's ends are one point; it always keeps its farthest vertex
+            if distance > squared or not length or self._blocked(chain, first, last):
+                keep[farthest] = True
+                stack.append((first, farthest))
+                stack.append((farthest, last))
+        return [p for p, k in zip(chain, keep) if k]
+
+    def _blocked(self, chain: List[Point], first: int, last: int) -> bool:
+        """Whether another vertex lies between a run of the chain and the shortcut over it."""
+        polygon = chain[first:last + 1]
+        xs = [p[0] for p in polygon]
+        ys = [p[1] for p in polygon]
+        own = None
+        for point in self.topology.near((min(xs), min(ys), max(xs), max(ys))):
+            if own is None:
+                own = set(polygon)
+            # Inside the run and its shortcut, or on their outline
+            if point not in own and locate_point(point, ring_edges([polygon])) != OUTSIDE:
+                return True
+        return False
+
+
+class FeatureSimplifier:
+    """
+    The simplification stage of an export layer: spools the layer, builds
+    its topology and yields the features with shared boundaries simplified.
+
+    A simplifier without a tolerance passes features through unchanged.
+    """
+
+    def __init__(self, tolerance: Optional[float]):
+        self.tolerance = tolerance
+        self.vertices = 0
+        self.simplified_vertices = 0
+        self.kept_arcs = 0
+        self.stage = GeometryStage("arc simplification")
+
+    @property
+    def active(self) -> bool:
+        return bool(self.tolerance)
+
+    def features(self, features: Iterable[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+        """Yield the features, simplified."""
+        if not self.active:
+            yield from features
+            return
+        topology = Topology()
+        with FeatureSpool() as spool:
+            for feature in features:
+                geometry = feature.get("geometry")
+                if geometry:
+                    for parts, closed in self._parts(geometry):
+                        topology.add(parts, closed)
+                spool.append(feature)
+            simplification = topology.simplification(self.tolerance)
+            if parallel_enabled():
+                simplification.simplify_arcs(self._arc_keys(topology, spool), self.stage)
+            for feature in spool:
+                simplification.geometry(feature.get("geometry"), prepare=True)
+            for feature in spool:
+                geometry = simplification.geometry(feature.get("geometry"))
+                self.simplified_vertices += self._count(geometry)
+                yield dict(feature, geometry=geometry)
+            self.vertices = topology.vertices
+            self.kept_arcs = len(simplification.kept)
+
+    def summary(self) -> Dict[str, Any]:
+        """What was simplified, for the export job."""
+        return {
+            "tolerance": self.tolerance,
+            "vertices": self.vertices,
+            "simplified_vertices": self.simplified_vertices,
+            "arcs_kept_in_full": self.kept_arcs,
+            "workers": self.stage.workers,
+        }
+
+    def _arc_keys(self, topology: Topology, spool: FeatureSpool) -> List[Tuple[Point, ...]]:
+        """The distinct arcs of the spooled features."""
+        keys = set()
+        for feature in spool:
+            geometry = feature.get("geometry")
+            for parts, closed in (self._parts(geometry) if geometry else []):
+                for part in parts:
+                    points = _open(part, closed)
+                    if len(points) >= (3 if closed else 2):
+                        keys.update(Simplification._canonical(arc)[0] for arc in topology.arcs(points, closed))
+        return list(keys)
+
+    @staticmethod
+    def _parts(geometry: Dict[str, Any]) -> List[Tuple[List[Any], bool]]:
+        kind, coordinates = geometry["type"], geometry["coordinates"]
+        if kind == "LineString":
+            return [([coordinates], False)]
+        if kind == "MultiLineString":
+            return [(coordinates, False)]
+        if kind == "Polygon":
+            return [(coordinates, True)]
+        if kind == "MultiPolygon":
+            return [(polygon, True) for polygon in coordinates]
+        return []
+
+    @staticmethod
+    def _count(geometry: Optional[Dict[str, Any]]) -> int:
+        """Distinct vertices of a geometry's parts (a ring's closing point not counted)."""
+        if not geometry:
+            return 0
+        kind, coordinates = geometry["type"], geometry["coordinates"]
+        if kind == "Point":
+            return 1
+        if kind in ("MultiPoint", "LineString"):
+            return len(coordinates)
+        if kind == "MultiLineString":
+            return sum(len(line) for line in coordinates)
+        if kind == "Polygon":
+            return sum(max(0, len(ring) - 1) for ring in coordinates)
+        return sum(max(0, len(ring) - 1) for polygon in coordinates for ring in polygon)
@@ -0,0 +1,492 @@
+"""
+TerraFusion Platform - Spatial Filters
+
+This module restricts a sync or an export to an area: a bounding box, a named
+tax district or a clip geometry sent with the request, so a user can pull just
+the parcels in an annexation study area instead of the whole county. Exports
+take it as parameters.spatial_filter and sync jobs as parameters.spatial_filter
+with the geometry column to test:
+
+    {"district": "Kennewick School District 17", "predicate": "centroid"}
+    {"bbox": [-119.3, 46.18, -119.1, 46.3], "srid": 4326}
+    {"geometry": {"type": "Polygon", "coordinates": [...]}, "srid": 2927,
+     "column": "shape", "tables": ["dbo.property"]}
+
+Exactly one of bbox, district or geometry is given. A clip geometry is a
+GeoJSON Polygon or MultiPolygon, or a Feature or FeatureCollection of them.
+Named districts are read from the export layer a county names under
+plugin_settings.gis_export.districts:
+
+    "districts": {"layer": "tax_districts", "name_field": "district_name"}
+
+The predicate decides which features are kept: "intersects" (the default)
+keeps those that touch the area, "within" those lying entirely inside it, and
+"centroid" those whose centroid falls inside it, so neighboring areas split
+the parcels along their shared boundary without counting a parcel twice.
+
+An area with an srid is reprojected to the CRS of each feature it is tested
+against (see gis_reproject); without one, or for features without an SRID,
+coordinates are compared as they are. Features and records without a
+geometry fall outside every area.
+"""
+
+import math
+import logging
+from typing import Dict, List, Any, Optional, Iterable, Iterator, Tuple
+
+from gis_features import (
+    BOUNDARY, INSIDE, OUTSIDE, Bounds, DEFAULT_GEOMETRY_FIELD, ExportLayer, bounds_intersect, crosses_ray,
+    decode_geometry, geometry_bounds, geometry_centroid, on_edge, parse_layers,
+)
+from gis_reproject import Reprojector, parse_srid
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Which features an area keeps
+SPATIAL_PREDICATES = ["intersects", "within", "centroid"]
+
+# Ways of naming the area, exactly one of which a filter gives
+AREA_KINDS = ["bbox", "district", "geometry"]
+
+# Points added along each edge of a bounding box before it is reprojected, so its edges bend with the CRS
+BBOX_EDGE_POINTS = 16
+
+Point = Tuple[float, float]
+
+
+def parse_spatial_filter(definition: Any, for_sync: bool = False,
+                         name: str = "parameters.spatial_filter") -> Dict[str, Any]:
+    """
+    Check a spatial filter from a request and return it with its defaults filled in.
+
+    Args:
+        definition: The filter object
+        for_sync: Whether it restricts a sync job, which also names the
+            geometry column and optionally the tables it applies to
+        name: How the filter is named in error messages
+
+    Raises:
+        ValueError: If the filter is invalid
+    """
+    if not isinstance(definition, dict):
+        raise ValueError(f"{name} must be an object")
+    kinds = [kind for kind in AREA_KINDS if definition.get(kind) is not None]
+    if len(kinds) != 1:
+        raise ValueError(f"{name} needs exactly one of: {', '.join(AREA_KINDS)}")
+    allowed = set(AREA_KINDS) | {"srid", "predicate"} | ({"column", "tables"} if for_sync else set())
+    unknown = sorted(set(definition) - allowed)
+    if unknown:
+        raise ValueError(f"Unknown {name} options: {', '.join(unknown)}")
+
+    spec = {"kind": kinds[0], "predicate": definition.get("predicate") or "intersects"}
+    if spec["predicate"] not in SPATIAL_PREDICATES:
+        raise ValueError(f"Unsupported {name}.predicate: {spec['predicate']}. "
+                         f"Supported predicates: {', '.join(SPATIAL_PREDICATES)}")
+    spec["srid"] = parse_srid(definition["srid"], f"{name}.srid") if definition.get("srid") is not None else None
+
+    if spec["kind"] == "bbox":
+        bbox = definition["bbox"]
+        if (not isinstance(bbox, list) or len(bbox) != 4 or not all(_finite(v) for v in bbox)
+                or bbox[0] >= bbox[2] or bbox[1] >= bbox[3]):
+            raise ValueError(f"{name}.bbox must be [min x, min y, max x, max y] with min below max")
+        spec["bbox"] = [float(v) for v in bbox]
+    elif spec["kind"] == "district":
+        if not isinstance(definition["district"], str) or not definition["district"].strip():
+            raise ValueError(f"{name}.district must be a district name")
+        spec["district"] = definition["district"]
+    else:
+        spec["geometry"] = {"type": "MultiPolygon", "coordinates": clip_polygons(definition["geometry"], f"{name}.geometry")}
+
+    if for_sync:
+        spec["column"] = definition.get("column") or DEFAULT_GEOMETRY_FIELD
+        if not isinstance(spec["column"], str):
+            raise ValueError(f"{name}.column must be a column name")
+        tables = definition.get("tables")
+        if tables is not None and (not isinstance(tables, list) or not tables
+                                   or not all(isinstance(t, str) for t in tables)):
+            raise ValueError(f"{name}.tables must be a list of table names")
+        spec["tables"] = tables
+    return spec
+
+
+def clip_polygons(value: Any, name: str = "geometry") -> List[List[List[List[float]]]]:
+    """
+    The polygons of a clip geometry: a GeoJSON Polygon or MultiPolygon, or a
+    Feature or FeatureCollection of them, as MultiPolygon coordinates.
+
+    Raises:
+        ValueError: If it is not polygonal or its rings are malformed
+    """
+    if not isinstance(value, dict):
+        raise ValueError(f"{name} must be a GeoJSON geometry, Feature or FeatureCollection")
+    kind = value.get("type")
+    if kind == "FeatureCollection":
+        polygons = []
+        for feature in value.get("features") or []:
+            polygons.extend(clip_polygons(feature, name))
+    elif kind == "Feature":
+        polygons = clip_polygons(value.get("geometry"), name)
+    elif kind in ("Polygon", "MultiPolygon"):
+        coordinates = value.get("coordinates")
+        polygons = [coordinates] if kind == "Polygon" else coordinates
+        if not isinstance(polygons, list):
+            raise ValueError(f"{name} has no coordinates")
+        for polygon in polygons:
+            if not isinstance(polygon, list) or not polygon:
+                raise ValueError(f"{name} has a polygon without rings")
+            for ring in polygon:
+                if (not isinstance(ring, list) or len(ring) < 4
+                        or not all(isinstance(p, list) and len(p) >= 2 and _finite(p[0]) and _finite(p[1]) for p in ring)):
+                    raise ValueError(f"{name} has a ring that is not a list of at least four [x, y] positions")
+    else:
+        raise ValueError(f"{name} must be a Polygon or MultiPolygon (got {kind})")
+    if not polygons:
+        raise ValueError(f"{name} holds no polygons")
+    return polygons
+
+
+def _finite(value: Any) -> bool:
+    return isinstance(value, (int, float)) and not isinstance(value, bool) and math.isfinite(value)
+
+
+def _bbox_ring(bbox: List[float], points: int) -> List[List[float]]:
+    """A bounding box as a counterclockwise ring with points along each edge."""
+    x1, y1, x2, y2 = bbox
+    corners = [(x1, y1), (x2, y1), (x2, y2), (x1, y2)]
+    ring = []
+    for (ax, ay), (bx, by) in zip(corners, corners[1:] + corners[:1]):
+        for i in range(points):
+            ring.append([ax + (bx - ax) * i / points, ay + (by - ay) * i / points])
+    return ring + [ring[0]]
+
+
+class DistrictRegions:
+    """The district polygons named in spatial filters, from the county's district layer."""
+
+    def __init__(self, settings: Optional[Dict[str, Any]], reader):
+        """
+        Initialize the district source.
+
+        Args:
+            settings: The county's gis_export plugin settings
+            reader: LayerReader the district layer is read with
+
+        Raises:
+            ValueError: If the districts setting or its layer is invalid
+        """
+        settings = settings or {}
+        districts = settings.get("districts")
+        self.layer: Optional[ExportLayer] = None
+        self.name_field: Optional[str] = None
+        self.reader = reader
+        if districts is None:
+            return
+        if not isinstance(districts, dict) or not districts.get("layer") or not districts.get("name_field"):
+            raise ValueError("gis_export.districts needs a layer and a name_field")
+        layers = parse_layers(settings)
+        if districts["layer"] not in layers:
+            raise ValueError(f"gis_export.districts names layer {districts['layer']}, which is not configured")
+        self.layer = layers[districts["layer"]]
+        if not self.layer.geometry_field:
+            raise ValueError(f"District layer {self.layer.name} has no geometry")
+        self.name_field = districts["name_field"]
+
+    def region(self, name: str) -> Tuple[List[Any], Optional[int]]:
+        """
+        The polygons of a named district, as MultiPolygon coordinates, and their SRID.
+
+        A district stored as several features is the union of them.
+
+        Raises:
+            ValueError: If no district layer is configured or none is named so
+        """
+        if self.layer is None:
+            raise ValueError("Spatial filters by district need plugin_settings.gis_export.districts in the county configuration")
+        polygons, srid = [], None
+        for feature in self.reader.lookup(self.layer, self.name_field, [name]):
+            geometry = feature.get("geometry")
+            if not geometry:
+                continue
+            polygons.extend(clip_polygons(geometry, f"District {name}"))
+            srid = srid or feature.get("srid")
+        if not polygons:
+            raise ValueError(f"No district named {name} in layer {self.layer.name}")
+        return polygons, srid
+
+    def all(self) -> Dict[str, Tuple[List[Any], Optional[int]]]:
+        """
+        Every district of the layer by name, as region() returns them.
+
+        Raises:
+            ValueError: If no district layer is configured
+        """
+        if self.layer is None:
+            raise ValueError("No district layer is configured under plugin_settings.gis_export.districts")
+        districts: Dict[str, Tuple[List[Any], Optional[int]]] = {}
+        for feature in self.reader.read(self.layer):
+            name = feature["properties"].get(self.name_field)
+            if name is None or not feature.get("geometry") or feature["geometry"]["type"] not in ("Polygon", "MultiPolygon"):
+                continue
+            polygons, srid = districts.get(str(name), ([], None))
+            polygons = polygons + clip_polygons(feature["geometry"], f"District {name}")
+            districts[str(name)] = (polygons, srid or feature.get("srid"))
+        return districts
+
+
+def build_spatial_filter(spec: Dict[str, Any], districts: Optional[DistrictRegions] = None) -> "SpatialFilter":
+    """
+    The spatial filter of a checked filter spec (see parse_spatial_filter).
+
+    Raises:
+        ValueError: If a named district cannot be found
+    """
+    if spec["kind"] == "bbox":
+        polygons = [[_bbox_ring(spec["bbox"], BBOX_EDGE_POINTS if spec["srid"] else 1)]]
+        srid, description = spec["srid"], f"bbox {spec['bbox']}"
+    elif spec["kind"] == "district":
+        if districts is None:
+            raise ValueError("Spatial filters by district need the county's district layer")
+        polygons, srid = districts.region(spec["district"])
+        srid, description = spec["srid"] or srid, f"district {spec['district']}"
+    else:
+        polygons, srid = spec["geometry"]["coordinates"], spec["srid"]
+        description = f"clip geometry of {len(polygons)} polygon{'s' if len(polygons) != 1 else ''}"
+    return SpatialFilter(polygons, srid, spec["predicate"], description, spec["kind"], spec.get("column"))
+
+
+class _Region:
+    """
+    Polygons indexed for point and segment tests: edges are bucketed into
+    horizontal bands, so a test looks only at the edges near its row.
+    """
+
+    def __init__(self, polygons: List[Any]):
+        self.edges: List[Tuple[float, float, float, float, int]] = []
+        # A vertex of each exterior and of each hole
+        self.shell_points: List[Point] = []
+        self.hole_points: List[Point] = []
+        for index, polygon in enumerate(polygons):
+            self.shell_points.append((float(polygon[0][0][0]), float(polygon[0][0][1])))
+            self.hole_points.extend((float(ring[0][0]), float(ring[0][1])) for ring in polygon[1:])
+            for ring in polygon:
+                for a, b in zip(ring, ring[1:]):
+                    if (a[0], a[1]) != (b[0], b[1]):
+                        self.edges.append((float(a[0]), float(a[1]), float(b[0]), float(b[1]), index))
+        self.polygon_count = len(polygons)
+        xs = [e[0] for e in self.edges] + [e[2] for e in self.edges]
+        ys = [e[1] for e in self.edges] + [e[3] for e in self.edges]
+        self.bounds: Optional[Bounds] = (min(xs), min(ys), max(xs), max(ys)) if xs else None
+        self._count = max(1, int(math.sqrt(len(self.edges))))
+        self._bands: List[List[Tuple[float, float, float, float, int]]] = [[] for _ in range(self._count)]
+        for edge in self.edges:
+            for band in range(self._band(min(edge[1], edge[3])), self._band(max(edge[1], edge[3])) + 1):
+                self._bands[band].append(edge)
+
+    def _band(self, y: float) -> int:
+        low, high = self.bounds[1], self.bounds[3]
+        if high <= low:
+            return 0
+        return min(self._count - 1, max(0, int((y - low) / (high - low) * self._count)))
+
+    def _near(self, y1: float, y2: float) -> Iterator[Tuple[float, float, float, float, int]]:
+        first, last = self._band(min(y1, y2)), self._band(max(y1, y2))
+        if first == last:
+            yield from self._bands[first]
+            return
+        seen = set()
+        for band in range(first, last + 1):
+            for edge in self._bands[band]:
+                if id(edge) not in seen:
+                    seen.add(id(edge))
+                    yield edge
+
+    def locate(self, x: float, y: float) -> int:
+        """INSIDE, BOUNDARY or OUTSIDE: inside any polygon, by the even-odd rule within each."""
+        if self.bounds is None or not (self.bounds[0] <= x <= self.bounds[2] and self.bounds[1] <= y <= self.bounds[3]):
+            return OUTSIDE
+        parity = [False] * self.polygon_count
+        for x1, y1, x2, y2, index in self._near(y, y):
+            if on_edge((x, y), (x1, y1), (x2, y2)):
+                return BOUNDARY
+            if crosses_ray((x, y), (x1, y1), (x2, y2)):
+                parity[index] = not parity[index]
+        return INSIDE if any(parity) else OUTSIDE
+
+    def meets(self, a: Point, b: Point, proper: bool = False) -> bool:
+        """Whether a segment meets an edge (crosses inside both, when proper)."""
+        low_x, high_x = min(a[0], b[0]), max(a[0], b[0])
+        for x1, y1, x2, y2, _ in self._near(a[1], b[1]):
+            if max(x1, x2) < low_x or min(x1, x2) > high_x:
+                continue
+            if _segments_meet(a, b, (x1, y1), (x2, y2), proper):
+                return True
+        return False
+
+
+def _cross(o: Point, a: Point, b: Point) -> float:
+    return (a[0] - o[0]) * (b[1] - o[1]) - (a[1] - o[1]) * (b[0] - o[0])
+
+
+def _between(p: Point, a: Point, b: Point) -> bool:
+    """Whether a point collinear with a segment lies within it."""
+    return min(a[0], b[0]) <= p[0] <= max(a[0], b[0]) and min(a[1], b[1]) <= p[1] <= max(a[1], b[1])
+
+
+def _segments_meet(a: Point, b: Point, c: Point, d: Point, proper: bool) -> bool:
+    d1, d2 = _cross(c, d, a), _cross(c, d, b)
+    d3, d4 = _cross(a, b, c), _cross(a, b, d)
+    if ((d1 > 0 > d2) or (d1 < 0 < d2)) and ((d3 > 0 > d4) or (d3 < 0 < d4)):
+        return True
+    if proper:
+        return False
+    return ((d1 == 0 and _between(a, c, d)) or (d2 == 0 and _between(b, c, d))
+            or (d3 == 0 and _between(c, a, b)) or (d4 == 0 and _between(d, a, b)))
+
+
+def _parts(geometry: Dict[str, Any]) -> Tuple[List[Point], List[Tuple[Point, Point]], List[Any]]:
+    """The vertices, segments and polygons of a GeoJSON geometry."""
+    kind, coordinates = geometry.get("type"), geometry.get("coordinates") or []
+    if kind == "Point":
+        return ([(coordinates[0], coordinates[1])] if len(coordinates) >= 2 else []), [], []
+    if kind == "MultiPoint":
+        return [(p[0], p[1]) for p in coordinates], [], []
+    lines = ([coordinates] if kind == "LineString" else coordinates if kind == "MultiLineString"
+             else coordinates if kind == "Polygon" else [r for p in coordinates for r in p] if kind == "MultiPolygon"
+             else [])
+    polygons = [coordinates] if kind == "Polygon" else coordinates if kind == "MultiPolygon" else []
+    points = [(p[0], p[1]) for line in lines for p in line]
+    segments = [((a[0], a[1]), (b[0], b[1])) for line in lines for a, b in zip(line, line[1:])]
+    return points, segments, polygons
+
+
+class SpatialFilter:
+    """
+    An area features or records are tested against, counting what it keeps
+    and leaves out.
+    """
+
+    def __init__(self, polygons: List[Any], srid: Optional[int], predicate: str = "intersects",
+                 description: str = "", kind: str = "geometry", column: Optional[str] = None):
+        """
+        Initialize the filter.
+
+        Args:
+            polygons: The area, as MultiPolygon coordinates
+            srid: EPSG code of the area's coordinates (None to compare as they are)
+            predicate: One of SPATIAL_PREDICATES
+            description: What the area is, for job results
+            kind: One of AREA_KINDS
+            column: Record column tested during a sync
+        """
+        self.polygons = polygons
+        self.srid = srid
+        self.predicate = predicate
+        self.description = description
+        self.kind = kind
+        self.column = column or DEFAULT_GEOMETRY_FIELD
+        self.matched = 0
+        self.excluded = 0
+        self.warnings: List[str] = []
+        self._regions: Dict[Optional[int], _Region] = {None: _Region(polygons)}
+
+    @property
+    def bounds(self) -> Optional[Bounds]:
+        """The area's bounding box, in its own CRS."""
+        return self._regions[None].bounds
+
+    def matches(self, geometry: Optional[Dict[str, Any]], srid: Optional[int] = None) -> bool:
+        """
+        Whether a geometry meets the predicate.
+
+        Raises:
+            ValueError: If the area cannot be reprojected to the geometry's CRS
+        """
+        if not geometry:
+            return False
+        region = self._region(srid)
+        feature_bounds = geometry_bounds(geometry)
+        if feature_bounds is None or region.bounds is None or not bounds_intersect(feature_bounds, region.bounds):
+            return False
+        if self.predicate == "centroid":
+            centroid = geometry_centroid(geometry)
+            return centroid is not None and region.locate(*centroid) != OUTSIDE
+        points, segments, polygons = _parts(geometry)
+        if self.predicate == "within":
+            if any(region.locate(*p) == OUTSIDE for p in points):
+                return False
+            if any(region.locate((a[0] + b[0]) / 2, (a[1] + b[1]) / 2) == OUTSIDE for a, b in segments):
+                return False
+            if any(region.meets(a, b, proper=True) for a, b in segments):
+                return False
+            # A hole of the area inside the feature leaves part of the feature outside
+            return not polygons or not any(_Region(polygons).locate(*p) == INSIDE for p in region.hole_points)
+        if any(region.locate(*p) != OUTSIDE for p in points):
+            return True
+        if any(region.meets(a, b) for a, b in segments):
+            return True
+        # The area may lie entirely inside a polygon feature
+        return bool(polygons) and any(_Region(polygons).locate(*p) != OUTSIDE for p in region.shell_points)
+
+    def matches_feature(self, feature: Dict[str, Any]) -> bool:
+        """Whether an export feature meets the predicate, counting it."""
+        matched = self.matches(feature.get("geometry"), feature.get("srid"))
+        self.count(matched)
+        return matched
+
+    def matches_record(self, record: Dict[str, Any]) -> bool:
+        """Whether a synced record's geometry column meets the predicate, counting it."""
+        try:
+            geometry, srid = decode_geometry(record.get(self.column))
+        except ValueError:
+            geometry, srid = None, None
+        matched = self.matches(geometry, srid)
+        self.count(matched)
+        return matched
+
+    def features(self, features: Iterable[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+        """Yield the features that meet the predicate."""
+        for feature in features:
+            if self.matches_feature(feature):
+                yield feature
+
+    def check(self, srid: Optional[int]) -> None:
+        """
+        Check that the area can be tested against features in a CRS, before reading any.
+
+        Raises:
+            ValueError: If there is no transform to that CRS
+        """
+        self._region(srid)
+
+    def summary(self) -> Dict[str, Any]:
+        """What the filter kept, for the job."""
+        summary = {
+            "area": self.description,
+            "kind": self.kind,
+            "predicate": self.predicate,
+            "srid": self.srid,
+            "matched": self.matched,
+            "excluded": self.excluded,
+        }
+        if self.warnings:
+            summary["warnings"] = self.warnings
+        return summary
+
+    def count(self, matched: bool) -> None:
+        """Count a tested feature as matched or excluded."""
+        if matched:
+            self.matched += 1
+        else:
+            self.excluded += 1
+
+    def _region(self, srid: Optional[int]) -> _Region:
+        if self.srid is None or srid is None or srid == self.srid:
+            return self._regions[None]
+        if srid not in self._regions:
+            reprojector = Reprojector(srid)
+            area = reprojector.feature({"geometry": {"type": "MultiPolygon", "coordinates": self.polygons}, "srid": self.srid})
+            self.warnings.extend(w for w in reprojector.warnings if w not in self.warnings)
+            self._regions[srid] = _Region(area["geometry"]["coordinates"])
+        return self._regions[srid]
@@ -0,0 +1,491 @@
+"""
+TerraFusion Platform - Tile Server
+
+This module serves XYZ map tiles of a county's export layers straight from
+the synced data, so county web maps can point at TerraFusionSync instead of
+standing up GeoServer. Each layer is available as Mapbox Vector Tiles and as
+PNG raster tiles, with a TileJSON document describing it:
+
+    /api/v1/tiles/<county_id>/<layer>/{z}/{x}/{y}.mvt
+    /api/v1/tiles/<county_id>/<layer>/{z}/{x}/{y}.png
+    /api/v1/tiles/<county_id>/<layer>.json
+
+The layers are the county's plugin_settings.gis_export.layers with geometry
+(see gis_features); "tiles": false keeps a layer off the tile server. A
+layer's "mvt" settings give its zoom range and the detail each zoom carries,
+as they do for vector tile exports (see gis_mvt), except that each feature
+is simplified on its own. Its "raster" settings style the PNG tiles, with
+colors as #rrggbb or #rrggbbaa. Vector tiles carry the properties the
+caller's redaction policy leaves (see redaction):
+
+    "raster": {"fill": "#3388ff40", "stroke": "#1f5fbf", "stroke_width": 1, "point_radius": 3}
+
+The first tile asked of a layer reads the whole layer once into an index:
+its features reprojected to longitude/latitude (see gis_reproject),
+projected to Web Mercator and spooled to disk (see gis_features.FeatureSpool),
+with their bounds bucketed by tile at TILE_INDEX_ZOOM. Tiles are rendered
+from the index and kept in a least-recently-used cache. When a sync job
+completes, the layers read from the tables it synced are dropped from the
+index and the cache and rebuilt at their next tile, so maps show the new
+geometry at once; every layer is also rebuilt once it is
+TILE_LAYER_TTL_SECONDS old, which covers layers read through their own
+connector and rollbacks. Tiles carry an ETag of their layer's version, so
+clients revalidate without downloading them again.
+"""
+
+import os
+import math
+import uuid
+import zlib
+import struct
+import logging
+import threading
+from collections import OrderedDict
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Iterator, Tuple
+
+from gis_features import ExportLayer, FeatureSpool, LayerReader, county_export_settings, parse_layers
+from redaction import Redactor
+from gis_mvt import (
+    MvtLayerSettings, MVT_EXTENT, MVT_POINT, MVT_POLYGON, MAX_MERCATOR_LATITUDE,
+    encode_tile, mercator_shapes, tile_feature_id, tile_geometry, tile_properties,
+)
+from gis_reproject import Reprojector
+from event_bus import EventBus, EventBusError, event_bus, SUBJECT_SYNC_JOB
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Tile formats and their MIME types
+TILE_FORMATS = {
+    "mvt": "application/vnd.mapbox-vector-tile",
+    "png": "image/png",
+}
+
+# Side of a raster tile, in pixels
+RASTER_TILE_SIZE = 256
+
+# Zoom level whose tiles bucket the features of a layer index
+TILE_INDEX_ZOOM = 14
+
+# Rendered tiles kept in memory across every layer
+TILE_CACHE_SIZE = int(os.environ.get("TILE_CACHE_TILES", "4096"))
+
+# Seconds before a layer index is read again even without a sync
+TILE_LAYER_TTL_SECONDS = int(os.environ.get("TILE_LAYER_TTL_SECONDS", "3600"))
+
+# Raster style used where a layer's "raster" settings leave one out
+DEFAULT_RASTER_STYLE = {"fill": "#3388ff40", "stroke": "#3388ff", "stroke_width": 1, "point_radius": 3}
+
+
+def _color(layer: ExportLayer, name: str, value: Any) -> Tuple[int, int, int, int]:
+    text = value.lstrip("#") if isinstance(value, str) else ""
+    if len(text) not in (6, 8) or any(c not in "0123456789abcdefABCDEF" for c in text):
+        raise ValueError(f"Layer {layer.name}: raster {name} must be a #rrggbb or #rrggbbaa color")
+    if len(text) == 6:
+        text += "ff"
+    return tuple(int(text[i:i + 2], 16) for i in range(0, 8, 2))
+
+
+class RasterStyle:
+    """How a layer is drawn on PNG tiles, from its "raster" settings."""
+
+    def __init__(self, layer: ExportLayer):
+        """
+        Read a layer's raster style.
+
+        Raises:
+            ValueError: If a setting is invalid
+        """
+        settings = layer.settings.get("raster") or {}
+        if not isinstance(settings, dict):
+            raise ValueError(f"Layer {layer.name}: raster settings must be an object")
+        settings = dict(DEFAULT_RASTER_STYLE, **settings)
+        self.fill = _color(layer, "fill", settings["fill"])
+        self.stroke = _color(layer, "stroke", settings["stroke"])
+        for name in ("stroke_width", "point_radius"):
+            value = settings[name]
+            if isinstance(value, bool) or not isinstance(value, (int, float)) or not 0 <= value <= 32:
+                raise ValueError(f"Layer {layer.name}: raster {name} must be 0 to 32 pixels")
+        self.stroke_width = float(settings["stroke_width"])
+        self.point_radius = float(settings["point_radius"])
+
+
+class _Canvas:
+    """An RGBA pixel grid, drawn on with alpha blending and written as a PNG."""
+
+    def __init__(self, size: int):
+        self.size = size
+        self.pixels = bytearray(size * size * 4)
+        self.empty = True
+
+    def _blend(self, x: int, y: int, color: Tuple[int, int, int, int]) -> None:
+        if not (0 <= x < self.size and 0 <= y < self.size) or not color[3]:
+            return
+        i = (y * self.size + x) * 4
+        alpha = color[3] / 255
+        base = self.pixels[i + 3] / 255
+        out = alpha + base * (1 - alpha)
+        for c in range(3):
+            self.pixels[i + c] = round((color[c] * alpha + self.pixels[i + c] * base * (1 - alpha)) / out)
+        self.pixels[i + 3] = round(out * 255)
+        self.empty = False
+
+    def fill(self, rings: List[List[Tuple[float, float]]], color: Tuple[int, int, int, int]) -> None:
+        """Fill rings (open, in pixels) by the even-odd rule, sampling pixel centers."""
+        ys = [p[1] for ring in rings for p in ring]
+        if not ys:
+            return
+        edges = [(ring[i - 1], ring[i]) for ring in rings for i in range(len(ring))]
+        for row in range(max(0, int(math.floor(min(ys)))), min(self.size, int(math.ceil(max(ys))) + 1)):
+            center = row + 0.5
+            crossings = sorted(
+                a[0] + (center - a[1]) * (b[0] - a[0]) / (b[1] - a[1])
+                for a, b in edges if (a[1] > center) != (b[1] > center)
+            )
+            for start, end in zip(crossings[::2], crossings[1::2]):
+                for column in range(max(0, int(math.ceil(start - 0.5))), min(self.size, int(math.floor(end - 0.5)) + 1)):
+                    self._blend(column, row, color)
+
+    def line(self, points: List[Tuple[float, float]], width: float, color: Tuple[int, int, int, int]) -> None:
+        """Stroke a polyline (in pixels), each pixel once."""
+        if width <= 0:
+            return
+        half = max(0.5, width / 2)
+        covered = set()
+        for (x1, y1), (x2, y2) in zip(points, points[1:]):
+            steps = max(1, int(math.ceil(max(abs(x2 - x1), abs(y2 - y1)))))
+            for step in range(steps + 1):
+                x = x1 + (x2 - x1) * step / steps
+                y = y1 + (y2 - y1) * step / steps
+                for px in range(int(math.floor(x - half + 0.5)), int(math.floor(x + half - 0.5)) + 1):
+                    for py in range(int(math.floor(y - half + 0.5)), int(math.floor(y + half - 0.5)) + 1):
+                        covered.add((px, py))
+        for px, py in covered:
+            self._blend(px, py, color)
+
+    def dot(self, x: float, y: float, radius: float, color: Tuple[int, int, int, int]) -> None:
+        """Fill a circle (in pixels)."""
+        for px in range(int(math.floor(x - radius)), int(math.ceil(x + radius)) + 1):
+            for py in range(int(math.floor(y - radius)), int(math.ceil(y + radius)) + 1):
+                if (px + 0.5 - x) ** 2 + (py + 0.5 - y) ** 2 <= radius * radius:
+                    self._blend(px, py, color)
+
+    def png(self) -> bytes:
+        """The canvas as an 8-bit RGBA PNG."""
+        def chunk(kind: bytes, data: bytes) -> bytes:
+            return struct.pack(">I", len(data)) + kind + data + struct.pack(">I", zlib.crc32(kind + data) & 0xFFFFFFFF)
+
+        stride = self.size * 4
+        raw = b"".join(b"\x00" + bytes(self.pixels[row * stride:(row + 1) * stride]) for row in range(self.size))
+        return (b"\x89PNG\r\n\x1a\n"
+                + chunk(b"IHDR", struct.pack(">IIBBBBB", self.size, self.size, 8, 6, 0, 0, 0))
+                + chunk(b"IDAT", zlib.compress(raw, 6))
+                + chunk(b"IEND", b""))
+
+
+class _LayerIndex:
+    """The features of one layer in Web Mercator, spooled to disk and bucketed by tile."""
+
+    def __init__(self, layer: ExportLayer, features: Iterator[Dict[str, Any]]):
+        self.layer = layer
+        self.version = uuid.uuid4().hex[:16]
+        self.built_at = datetime.utcnow()
+        self.fields: Dict[str, str] = {}
+        self.features = 0
+        self.bounds: Optional[List[float]] = None
+        self._spool = FeatureSpool()
+        # Spool reads seek its file, so they take turns
+        self._lock = threading.Lock()
+        self._offsets: List[int] = []
+        self._cells: Dict[Tuple[int, int], List[int]] = {}
+        cells = 1 << TILE_INDEX_ZOOM
+        reprojector = Reprojector(4326)
+        reprojector.check(layer.srid)
+        for feature in features:
+            geometry = reprojector.feature(feature)["geometry"]
+            if not geometry:
+                continue
+            kind, shapes = mercator_shapes(geometry)
+            points = [p for shape in shapes for part in shape for p in part]
+            if not points:
+                continue
+            west, north = min(p[0] for p in points), min(p[1] for p in points)
+            east, south = max(p[0] for p in points), max(p[1] for p in points)
+            index = len(self._offsets)
+            self._offsets.append(self._spool.append({
+                "id": feature["id"], "properties": feature["properties"], "kind": kind, "shapes": shapes,
+                "bounds": [west, north, east, south],
+            }))
+            for cx in range(int(west * cells), min(cells - 1, int(east * cells)) + 1):
+                for cy in range(int(north * cells), min(cells - 1, int(south * cells)) + 1):
+                    self._cells.setdefault((cx, cy), []).append(index)
+            for key, value in feature["properties"].items():
+                if value is not None:
+                    self.fields[key] = ("Boolean" if isinstance(value, bool)
+                                        else "Number" if isinstance(value, (int, float)) else "String")
+            self._extend(geometry)
+            self.features += 1
+
+    def _extend(self, geometry: Dict[str, Any]) -> None:
+        def walk(coordinates):
+            if coordinates and isinstance(coordinates[0], (int, float)):
+                yield coordinates
+            else:
+                for c in coordinates:
+                    yield from walk(c)
+
+        for x, y, *_ in walk(geometry["coordinates"]):
+            if self.bounds is None:
+                self.bounds = [x, y, x, y]
+            else:
+                self.bounds = [min(self.bounds[0], x), min(self.bounds[1], y),
+                               max(self.bounds[2], x), max(self.bounds[3], y)]
+
+    def near(self, z: int, x: int, y: int, margin: float) -> Iterator[Dict[str, Any]]:
+        """The features whose bounds meet a tile grown by a margin (in tile widths)."""
+        n = 1 << z
+        west, north = (x - margin) / n, (y - margin) / n
+        east, south = (x + 1 + margin) / n, (y + 1 + margin) / n
+        cells = 1 << TILE_INDEX_ZOOM
+        found = set()
+        for cx in range(max(0, int(west * cells)), min(cells - 1, int(east * cells)) + 1):
+            for cy in range(max(0, int(north * cells)), min(cells - 1, int(south * cells)) + 1):
+                found.update(self._cells.get((cx, cy), ()))
+        for index in sorted(found):
+            with self._lock:
+                feature = self._spool.read(self._offsets[index])
+            b = feature["bounds"]
+            if b[0] <= east and b[2] >= west and b[1] <= south and b[3] >= north:
+                yield feature
+
+    def expired(self) -> bool:
+        return (datetime.utcnow() - self.built_at).total_seconds() > TILE_LAYER_TTL_SECONDS
+
+
+class TileServer:
+    """Renders and caches XYZ tiles of counties' export layers."""
+
+    def __init__(self, config_dir: str = "county_configs", registry=None, bus: Optional[EventBus] = None):
+        """
+        Initialize the tile server.
+
+        Args:
+            config_dir: Directory of county configurations holding the export layers
+            registry: Sync pair registry layers are read through
+                (the sync_pair_registry singleton by default)
+            bus: Event bus whose sync job completions invalidate layers
+        """
+        self.config_dir = config_dir
+        self.layer_reader = LayerReader(registry)
+        self.bus = bus or event_bus
+        self._lock = threading.Lock()
+        self._indexes: Dict[Tuple[str, str], _LayerIndex] = {}
+        self._building: Dict[Tuple[str, str], threading.Lock] = {}
+        self._tiles: "OrderedDict[Tuple, bytes]" = OrderedDict()
+        self._hits = self._misses = 0
+        try:
+            self.bus.subscribe(SUBJECT_SYNC_JOB.format(job_id="*", event="completed"), self._on_sync_completed)
+        except EventBusError as e:
+            # Layers still refresh after TILE_LAYER_TTL_SECONDS
+            logger.warning(f"Cannot subscribe to sync job completions; tiles refresh on their TTL only: {e}")
+        logger.info("Tile server initialized")
+
+    def layer(self, county_id: str, layer_name: str) -> ExportLayer:
+        """
+        A layer the tile server serves.
+
+        Raises:
+            KeyError: If the county has no such layer with geometry, or it is off the tile server
+        """
+        layers = parse_layers(county_export_settings(self.config_dir, county_id))
+        layer = layers.get(layer_name)
+        if layer is None or not layer.geometry_field or layer.settings.get("tiles") is False:
+            raise KeyError(f"County {county_id} serves no tile layer {layer_name}")
+        return layer
+
+    def tile(self, county_id: str, layer_name: str, z: int, x: int, y: int, tile_format: str,
+             redactor: Optional[Redactor] = None) -> Dict[str, Any]:
+        """
+        Render a tile, or take it from the cache.
+
+        Args:
+            redactor: Redaction of the caller, applied to vector tile properties
+
+        Returns:
+            Dictionary with content, content_type and etag
+
+        Raises:
+            KeyError: If the layer is not served
+            ValueError: If the format or tile coordinates are invalid
+        """
+        if tile_format not in TILE_FORMATS:
+            raise ValueError(f"Unsupported tile format: {tile_format}. Supported formats: {', '.join(TILE_FORMATS)}")
+        if not 0 <= z <= 22 or not 0 <= x < (1 << z) or not 0 <= y < (1 << z):
+            raise ValueError(f"No tile {z}/{x}/{y}")
+        index = self._index(county_id, layer_name)
+        redactor = redactor or Redactor()
+        key = (county_id, layer_name, index.version, tile_format, z, x, y, tuple(redactor.names))
+        with self._lock:
+            content = self._tiles.get(key)
+            if content is not None:
+                self._tiles.move_to_end(key)
+                self._hits += 1
+        if content is None:
+            settings = MvtLayerSettings(index.layer)
+            if tile_format == "mvt":
+                content = self._vector_tile(index, settings, z, x, y, redactor)
+            else:
+                content = self._raster_tile(index, settings, RasterStyle(index.layer), z, x, y)
+            with self._lock:
+                self._misses += 1
+                self._tiles[key] = content
+                while len(self._tiles) > TILE_CACHE_SIZE:
+                    self._tiles.popitem(last=False)
+        etag = "-".join([index.version] + redactor.names)
+        return {"content": content, "content_type": TILE_FORMATS[tile_format], "etag": f'"{etag}"'}
+
+    def tilejson(self, county_id: str, layer_name: str, tiles_url: str) -> Dict[str, Any]:
+        """
+        The TileJSON document of a layer.
+
+        Args:
+            tiles_url: URL of the layer's tiles up to the zoom level, e.g.
+                https://host/api/v1/tiles/benton_wa/parcels
+
+        Raises:
+            KeyError: If the layer is not served
+        """
+        index = self._index(county_id, layer_name)
+        settings = MvtLayerSettings(index.layer)
+        bounds = index.bounds or [-180.0, -MAX_MERCATOR_LATITUDE, 180.0, MAX_MERCATOR_LATITUDE]
+        return {
+            "tilejson": "3.0.0",
+            "name": index.layer.title,
+            "description": index.layer.description,
+            "version": index.version,
+            "tiles": [f"{tiles_url}/{{z}}/{{x}}/{{y}}.mvt"],
+            "raster_tiles": [f"{tiles_url}/{{z}}/{{x}}/{{y}}.png"],
+            "minzoom": settings.minzoom,
+            "maxzoom": settings.maxzoom,
+            "bounds": bounds,
+            "center": [(bounds[0] + bounds[2]) / 2, (bounds[1] + bounds[3]) / 2, settings.minzoom],
+            "vector_layers": [{"id": settings.layer_name, "description": index.layer.title, "fields": index.fields,
+                               "minzoom": settings.minzoom, "maxzoom": settings.maxzoom}],
+        }
+
+    def invalidate(self, county_id: Optional[str] = None, layer_name: Optional[str] = None,
+                   sync_pair_id: Optional[str] = None, tables: Optional[List[str]] = None) -> List[str]:
+        """
+        Drop layer indexes and their cached tiles, so the next tile reads the layer again.
+
+        Args:
+            county_id: Only layers of this county
+            layer_name: Only this layer
+            sync_pair_id: Only layers read from this sync pair
+            tables: Only layers read from these tables of the sync pair
+
+        Returns:
+            The dropped layers, as county_id/layer names
+        """
+        with self._lock:
+            dropped = [
+                key for key, index in self._indexes.items()
+                if (county_id is None or key[0] == county_id)
+                and (layer_name is None or key[1] == layer_name)
+                and (sync_pair_id is None or index.layer.sync_pair_id == sync_pair_id)
+                and (tables is None or index.layer.table in tables)
+            ]
+            for key in dropped:
+                del self._indexes[key]
+            stale = [key for key in self._tiles if key[:2] in dropped]
+            for key in stale:
+                del self._tiles[key]
+        if dropped:
+            logger.info(f"Invalidated tile layers {', '.join('/'.join(key) for key in dropped)}")
+        return ["/".join(key) for key in dropped]
+
+    def status(self) -> Dict[str, Any]:
+        """The layers indexed and the tile cache's size and hit counts."""
+        with self._lock:
+            return {
+                "layers": [
+                    {"county_id": key[0], "layer": key[1], "version": index.version, "features": index.features,
+                     "built_at": index.built_at.isoformat()}
+                    for key, index in self._indexes.items()
+                ],
+                "cached_tiles": len(self._tiles),
+                "cache_size": TILE_CACHE_SIZE,
+                "hits": self._hits,
+                "misses": self._misses,
+            }
+
+    def _index(self, county_id: str, layer_name: str) -> _LayerIndex:
+        """The index of a layer, read once and shared by the requests that wait for it."""
+        key = (county_id, layer_name)
+        with self._lock:
+            index = self._indexes.get(key)
+            if index is not None and not index.expired():
+                return index
+            building = self._building.setdefault(key, threading.Lock())
+        with building:
+            with self._lock:
+                index = self._indexes.get(key)
+                if index is not None and not index.expired():
+                    return index
+            layer = self.layer(county_id, layer_name)
+            MvtLayerSettings(layer)
+            RasterStyle(layer)
+            index = _LayerIndex(layer, self.layer_reader.read(layer))
+            with self._lock:
+                self._indexes[key] = index
+                for stale in [k for k in self._tiles if k[:2] == key and k[2] != index.version]:
+                    del self._tiles[stale]
+        logger.info(f"Indexed {index.features} features of tile layer {county_id}/{layer_name}")
+        return index
+
+    @staticmethod
+    def _vector_tile(index: _LayerIndex, settings: MvtLayerSettings, z: int, x: int, y: int,
+                     redactor: Redactor) -> bytes:
+        detail = settings.zooms.get(z)
+        if detail is None:
+            return b""
+        features = []
+        for feature in index.near(z, x, y, settings.buffer / MVT_EXTENT):
+            shapes = [[[tuple(p) for p in part] for part in shape] for shape in feature["shapes"]]
+            pieces = tile_geometry(feature["kind"], shapes, z, detail, settings.buffer, only=(x, y))
+            if pieces:
+                features.append((tile_feature_id(feature), feature["kind"], pieces[0][1],
+                                 tile_properties(redactor.record(feature["properties"]), detail)))
+        return encode_tile([(settings.layer_name, features)]) if features else b""
+
+    @staticmethod
+    def _raster_tile(index: _LayerIndex, settings: MvtLayerSettings, style: RasterStyle,
+                     z: int, x: int, y: int) -> bytes:
+        canvas = _Canvas(RASTER_TILE_SIZE)
+        if z in settings.zooms:
+            scale = RASTER_TILE_SIZE * (1 << z)
+            margin = (max(style.stroke_width, style.point_radius * 2) + 1) / RASTER_TILE_SIZE
+            for feature in index.near(z, x, y, margin):
+                for shape in feature["shapes"]:
+                    parts = [[(px * scale - x * RASTER_TILE_SIZE, py * scale - y * RASTER_TILE_SIZE) for px, py in part]
+                             for part in shape]
+                    if feature["kind"] == MVT_POINT:
+                        for px, py in parts[0]:
+                            canvas.dot(px, py, style.point_radius, style.stroke)
+                    elif feature["kind"] == MVT_POLYGON:
+                        canvas.fill(parts, style.fill)
+                        for ring in parts:
+                            canvas.line(ring + ring[:1], style.stroke_width, style.stroke)
+                    else:
+                        for line in parts:
+                            canvas.line(line, style.stroke_width, style.stroke)
+        return canvas.png()
+
+    def _on_sync_completed(self, envelope: Dict[str, Any]) -> None:
+        """Drop the layers read from the tables a completed sync job wrote."""
+        data = envelope.get("data") or {}
+        if data.get("dry_run") or not data.get("sync_pair_id"):
+            return
+        self.invalidate(county_id=data.get("county_id"), sync_pair_id=data["sync_pair_id"], tables=data.get("tables"))
@@ -0,0 +1,494 @@
+"""
+TerraFusion Platform - Excel Workbook Writer
+
+This module provides the writer GIS exports use to produce Excel workbooks
+(.xlsx, Office Open XML) for staff who work in spreadsheets. Every requested
+layer becomes a sheet of its properties (geometry is left out): numbers,
+dates and booleans are written as typed cells rather than text, the header
+row is bold, frozen and filtered, and columns are sized to their contents.
+A layer's "xlsx" settings name its sheet and pick, rename and format its
+columns:
+
+    "xlsx": {
+        "sheet": "Parcels",
+        "columns": ["parcel_number", "owner_name", "assessed_value", "legal_acres"],
+        "headers": {"parcel_number": "Parcel #"},
+        "formats": {"assessed_value": "currency", "legal_acres": "acres"}
+    }
+
+Requests override them per layer with parameters.sheets, for example
+{"sheets": {"parcels": {"columns": [...]}}}. Columns without a format get
+one from their values (dates as dates, other values as Excel shows them).
+Text always stays text, so parcel numbers keep their leading zeros; whole
+numbers too long for Excel's precision are written as text as well. A layer
+with more rows than a sheet holds continues on further sheets.
+"""
+
+import re
+import json
+import math
+import zipfile
+import logging
+from datetime import date, datetime, time, timezone
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Iterable, Tuple
+from xml.sax.saxutils import escape, quoteattr
+
+from gis_features import ExportLayer, FeatureSpool
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Number formats columns can be given, with their Excel format codes (None: built in)
+XLSX_FORMATS = {
+    "general": ("General", 0),
+    "text": ("@", 49),
+    "integer": ("#,##0", 3),
+    "decimal": ("#,##0.00", 4),
+    "currency": ('"$"#,##0.00', None),
+    "acres": ("#,##0.000", None),
+    "percent": ("0.00%", 10),
+    "date": ("yyyy-mm-dd", None),
+    "datetime": ("yyyy-mm-dd hh:mm:ss", None),
+}
+
+# Rows a sheet holds, the header included
+MAX_SHEET_ROWS = 1048576
+
+# Characters a sheet name may not have, and its longest length
+SHEET_NAME_INVALID = re.compile(r"[\[\]:*?/\\]")
+MAX_SHEET_NAME = 31
+
+# Column widths, in characters
+MIN_COLUMN_WIDTH = 8
+MAX_COLUMN_WIDTH = 60
+
+# Longest text a cell holds
+MAX_CELL_TEXT = 32767
+
+# Whole numbers beyond this lose digits as Excel numbers
+MAX_EXACT_INTEGER = 10 ** 15
+
+# Characters XML 1.0 cannot carry
+XML_INVALID = re.compile("[\x00-\x08\x0b\x0c\x0e-\x1f\ufffe\uffff]")
+
+# Day 0 of Excel's 1900 date system, as Excel counts it
+EXCEL_EPOCH = datetime(1899, 12, 30)
+
+MAIN_NAMESPACE = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+RELATIONSHIP_NAMESPACE = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+RELATIONSHIP_TYPE = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+PACKAGE_RELATIONSHIPS = "http://schemas.openxmlformats.org/package/2006/relationships"
+SHEET_CONTENT_TYPE = "application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"
+
+
+def column_letter(index: int) -> str:
+    """The letters of a column (0 is A)."""
+    letters = ""
+    index += 1
+    while index:
+        index, remainder = divmod(index - 1, 26)
+        letters = chr(65 + remainder) + letters
+    return letters
+
+
+def excel_serial(value: Any) -> float:
+    """A date or timestamp as an Excel serial day number (aware timestamps in UTC)."""
+    if isinstance(value, datetime):
+        if value.tzinfo is not None:
+            value = value.astimezone(timezone.utc).replace(tzinfo=None)
+    else:
+        value = datetime.combine(value, time())
+    delta = value - EXCEL_EPOCH
+    return delta.days + delta.seconds / 86400 + delta.microseconds / 86400e6
+
+
+def sheet_name(name: str) -> str:
+    """A name Excel accepts for a sheet."""
+    name = SHEET_NAME_INVALID.sub("_", str(name)).strip("'").strip() or "Sheet"
+    return name[:MAX_SHEET_NAME]
+
+
+class XlsxSheetOptions:
+    """The sheet name, columns, headers and formats of a layer's sheet."""
+
+    def __init__(self, layer: ExportLayer, parameters: Optional[Dict[str, Any]] = None):
+        """
+        Read the options of a layer.
+
+        Args:
+            layer: Layer being exported; its "xlsx" settings are the defaults
+            parameters: Export request parameters; parameters.sheets[layer name]
+                overrides the layer settings
+
+        Raises:
+            ValueError: If an option is invalid
+        """
+        settings = dict(layer.settings.get("xlsx") or {})
+        overrides = ((parameters or {}).get("sheets") or {}).get(layer.name) or {}
+        if not isinstance(overrides, dict):
+            raise ValueError(f"Layer {layer.name}: xlsx sheet parameters must be an object")
+        for key in ("sheet", "columns"):
+            if overrides.get(key) is not None:
+                settings[key] = overrides[key]
+
+        self.sheet = sheet_name(settings.get("sheet") or layer.title)
+
+        self.columns = settings.get("columns")
+        if self.columns is not None:
+            if not isinstance(self.columns, list) or not self.columns or not all(isinstance(c, str) for c in self.columns):
+                raise ValueError(f"Layer {layer.name}: xlsx columns must be a list of field names")
+            if len(set(self.columns)) != len(self.columns):
+                raise ValueError(f"Layer {layer.name}: xlsx columns lists a field twice")
+            if layer.columns is not None:
+                unknown = [c for c in self.columns if c not in layer.columns]
+                if unknown:
+                    raise ValueError(f"Layer {layer.name} does not export columns: {', '.join(unknown)}")
+
+        # Request headers and formats are added to the layer's, replacing those they share
+        self.headers, self.formats = {}, {}
+        for source in (settings, overrides):
+            headers, formats = source.get("headers"), source.get("formats")
+            if headers is not None:
+                if not isinstance(headers, dict) or not all(isinstance(v, str) and v for v in headers.values()):
+                    raise ValueError(f"Layer {layer.name}: xlsx headers must map field names to header text")
+                self.headers.update(headers)
+            if formats is not None:
+                if not isinstance(formats, dict):
+                    raise ValueError(f"Layer {layer.name}: xlsx formats must map field names to formats")
+                unknown = sorted({str(f) for f in formats.values() if f not in XLSX_FORMATS})
+                if unknown:
+                    raise ValueError(f"Layer {layer.name}: unsupported xlsx formats {', '.join(unknown)}. "
+                                     f"Supported formats: {', '.join(XLSX_FORMATS)}")
+                self.formats.update(formats)
+
+        if self.columns is not None:
+            self.header_row(self.columns)
+
+    def header_row(self, columns: List[str]) -> List[str]:
+        """
+        The header of a sheet with these columns.
+
+        Raises:
+            ValueError: If two columns would get the same header
+        """
+        header = [self.headers.get(name, name) for name in columns]
+        duplicates = sorted({h for h in header if header.count(h) > 1})
+        if duplicates:
+            raise ValueError(f"Sheet {self.sheet} headers appear more than once: {', '.join(duplicates)}")
+        return header
+
+
+class XlsxWriter:
+    """Writes layers as the sheets of one Excel workbook."""
+
+    def __init__(self, path: str, title: Optional[str] = None):
+        """
+        Initialize the writer.
+
+        Args:
+            path: Workbook file to create
+            title: Workbook title (document properties)
+        """
+        self.path = path
+        self.title = title
+        self.archive = zipfile.ZipFile(path, "w", zipfile.ZIP_DEFLATED)
+        # (sheet name, rows and columns of its data range)
+        self.sheets: List[Tuple[str, int, int]] = []
+        self._styles = Styles()
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        if exc_type is None:
+            self.close()
+        else:
+            self.archive.close()
+
+    def add_layer(self, layer: ExportLayer, features: Iterable[Dict[str, Any]],
+                  options: XlsxSheetOptions) -> Dict[str, Any]:
+        """
+        Write a layer as a sheet (or several, when it has more rows than a sheet holds).
+
+        The layer is spooled first, so columns can be sized and every
+        property found before the sheet is written.
+
+        Returns:
+            Summary: features, sheets, header, formats (by column) and
+            missing_columns (selected columns no record had)
+        """
+        with FeatureSpool() as spool:
+            count = 0
+            seen: Dict[str, None] = {}
+            widths: Dict[str, int] = {}
+            kinds: Dict[str, set] = {}
+            for feature in features:
+                properties = feature["properties"]
+                if options.columns is not None:
+                    properties = {name: properties[name] for name in options.columns if name in properties}
+                for name, value in properties.items():
+                    seen.setdefault(name, None)
+                    if value is not None:
+                        widths[name] = max(widths.get(name, 0), self._display_width(value))
+                        kinds.setdefault(name, set()).add(self._kind(value))
+                spool.append(properties)
+                count += 1
+
+            columns = options.columns if options.columns is not None else list(seen)
+            header = options.header_row(columns)
+            formats = [options.formats.get(name) or self._default_format(kinds.get(name, set())) for name in columns]
+            column_widths = [
+                min(max(len(title) + 4, widths.get(name, 0) + 2, MIN_COLUMN_WIDTH), MAX_COLUMN_WIDTH)
+                for name, title in zip(columns, header)
+            ]
+
+            names = []
+            rows = iter(spool)
+            remaining = count
+            part = 1
+            while True:
+                name = self._unique_name(options.sheet if part == 1 else f"{options.sheet[:MAX_SHEET_NAME - 5]} ({part})")
+                taken = min(remaining, MAX_SHEET_ROWS - 1)
+                self._write_sheet(name, header, columns, formats, column_widths, rows, taken)
+                names.append(name)
+                remaining -= taken
+                part += 1
+                if remaining <= 0:
+                    break
+
+        missing = [name for name in columns if name not in seen] if count else []
+        if missing:
+            logger.warning(f"Excel export of layer {layer.name}: no record has {', '.join(missing)}")
+        logger.info(f"Wrote {count} features of layer {layer.name} to sheet {names[0]}")
+        return {"features": count, "sheets": names, "header": header,
+                "formats": dict(zip(columns, formats)), "missing_columns": missing}
+
+    def close(self) -> None:
+        """Write the workbook parts that list the sheets, and finish the file."""
+        if not self.sheets:
+            # A workbook needs a sheet
+            self._write_sheet("Sheet1", [], [], [], [], iter(()), 0)
+        count = len(self.sheets)
+        sheet_overrides = "".join(
+            f'<Override PartName="/xl/worksheets/sheet{i}.xml" ContentType="{SHEET_CONTENT_TYPE}"/>'
+            for i in range(1, count + 1)
+        )
+        self._part("[Content_Types].xml", (
+            '<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">'
+            '<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>'
+            '<Default Extension="xml" ContentType="application/xml"/>'
+            '<Override PartName="/xl/workbook.xml" '
+            'ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>'
+            '<Override PartName="/xl/styles.xml" '
+            'ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>'
+            '<Override PartName="/docProps/core.xml" '
+            'ContentType="application/vnd.openxmlformats-package.core-properties+xml"/>'
+            f"{sheet_overrides}</Types>"
+        ))
+        self._part("_rels/.rels", (
+            f'<Relationships xmlns="{PACKAGE_RELATIONSHIPS}">'
+            f'<Relationship Id="rId1" Type="{RELATIONSHIP_TYPE}/officeDocument" Target="xl/workbook.xml"/>'
+            '<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/'
+            'core-properties" Target="docProps/core.xml"/></Relationships>'
+        ))
+        created = datetime.utcnow().strftime("%Y-%m-%dT%H:%M:%SZ")
+        self._part("docProps/core.xml", (
+            '<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" '
+            'xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" '
+            'xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">'
+            f"<dc:title>{escape(self._text(self.title or ''))}</dc:title><dc:creator>TerraFusion Platform</dc:creator>"
+            f'<dcterms:created xsi:type="dcterms:W3CDTF">{created}</dcterms:created></cp:coreProperties>'
+        ))
+
+        sheets, filters = [], []
+        for i, (name, rows, columns) in enumerate(self.sheets):
+            sheets.append(f'<sheet name={quoteattr(name)} sheetId="{i + 1}" r:id="rId{i + 1}"/>')
+            if columns:
+                quoted = "'" + name.replace("'", "''") + "'"
+                filters.append(f'<definedName name="_xlnm._FilterDatabase" localSheetId="{i}" hidden="1">'
+                               f"{escape(quoted)}!$A$1:${column_letter(columns - 1)}${rows + 1}</definedName>")
+        defined = f"<definedNames>{''.join(filters)}</definedNames>" if filters else ""
+        self._part("xl/workbook.xml", (
+            f'<workbook xmlns="{MAIN_NAMESPACE}" xmlns:r="{RELATIONSHIP_NAMESPACE}">'
+            f"<bookViews><workbookView/></bookViews><sheets>{''.join(sheets)}</sheets>{defined}</workbook>"
+        ))
+        relationships = "".join(
+            f'<Relationship Id="rId{i}" Type="{RELATIONSHIP_TYPE}/worksheet" Target="worksheets/sheet{i}.xml"/>'
+            for i in range(1, count + 1)
+        )
+        self._part("xl/_rels/workbook.xml.rels", (
+            f'<Relationships xmlns="{PACKAGE_RELATIONSHIPS}">{relationships}'
+            f'<Relationship Id="rId{count + 1}" Type="{RELATIONSHIP_TYPE}/styles" Target="styles.xml"/></Relationships>'
+        ))
+        self._part("xl/styles.xml", self._styles.xml())
+        self.archive.close()
+        logger.info(f"Wrote Excel workbook of {count} sheets")
+
+    def _write_sheet(self, name: str, header: List[str], columns: List[str], formats: List[str],
+                     widths: List[int], rows, count: int) -> None:
+        """Write a sheet: sized columns, the frozen and filtered header, then count rows."""
+        number = len(self.sheets) + 1
+        last = column_letter(len(columns) - 1) if columns else "A"
+        styles = [self._styles.cell_style(fmt) for fmt in formats]
+        as_text = [fmt == "text" for fmt in formats]
+        selected = ' tabSelected="1"' if number == 1 else ""
+        with self.archive.open(f"xl/worksheets/sheet{number}.xml", "w") as f:
+            def write(text: str) -> None:
+                f.write(text.encode("utf-8"))
+
+            write(f'<?xml version="1.0" encoding="UTF-8" standalone="yes"?>\n<worksheet xmlns="{MAIN_NAMESPACE}">')
+            write(f'<dimension ref="A1:{last}{count + 1}"/>')
+            if columns:
+                write(f'<sheetViews><sheetView workbookViewId="0"{selected}>'
+                      '<pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/>'
+                      '<selection pane="bottomLeft" activeCell="A2" sqref="A2"/></sheetView></sheetViews>')
+                write("<cols>" + "".join(
+                    f'<col min="{i + 1}" max="{i + 1}" width="{width}" customWidth="1"'
+                    + (f' style="{styles[i]}"' if styles[i] else "") + "/>"
+                    for i, width in enumerate(widths)
+                ) + "</cols>")
+            write("<sheetData>")
+            if columns:
+                header_style = self._styles.header_style()
+                write('<row r="1">' + "".join(
+                    self._cell(f"{column_letter(i)}1", title, header_style) for i, title in enumerate(header)
+                ) + "</row>")
+            letters = [column_letter(i) for i in range(len(columns))]
+            for r in range(2, count + 2):
+                properties = next(rows)
+                cells = "".join(
+                    self._cell(f"{letters[i]}{r}", properties[name], styles[i], as_text[i])
+                    for i, name in enumerate(columns) if properties.get(name) is not None
+                )
+                write(f'<row r="{r}">{cells}</row>')
+            write("</sheetData>")
+            if columns:
+                write(f'<autoFilter ref="A1:{last}{count + 1}"/>')
+            write("</worksheet>")
+        self.sheets.append((name, count, len(columns)))
+
+    def _unique_name(self, name: str) -> str:
+        """A sheet name no earlier sheet has (Excel compares them ignoring case)."""
+        taken = {existing.lower() for existing, _, _ in self.sheets}
+        candidate, n = name, 2
+        while candidate.lower() in taken:
+            suffix = f" {n}"
+            candidate = name[:MAX_SHEET_NAME - len(suffix)] + suffix
+            n += 1
+        return candidate
+
+    def _cell(self, reference: str, value: Any, style: int, as_text: bool = False) -> str:
+        s = f' s="{style}"' if style else ""
+        if as_text and isinstance(value, (bool, int, float, Decimal, date, datetime)):
+            value = value.isoformat() if isinstance(value, (date, datetime)) else str(value)
+        if isinstance(value, bool):
+            return f'<c r="{reference}" t="b"{s}><v>{int(value)}</v></c>'
+        if isinstance(value, (int, float, Decimal)):
+            if (isinstance(value, int) and abs(value) >= MAX_EXACT_INTEGER) or not math.isfinite(value):
+                return self._text_cell(reference, str(value), s)
+            return f'<c r="{reference}"{s}><v>{value}</v></c>'
+        if isinstance(value, (date, datetime)):
+            if style == 0:
+                # Typed dates need a date format to show as dates
+                style = self._styles.cell_style("datetime" if isinstance(value, datetime) else "date")
+                s = f' s="{style}"'
+            return f'<c r="{reference}"{s}><v>{excel_serial(value)!r}</v></c>'
+        if isinstance(value, (dict, list)):
+            value = json.dumps(value, default=str)
+        elif isinstance(value, (bytes, bytearray)):
+            value = bytes(value).hex()
+        return self._text_cell(reference, str(value), s)
+
+    def _text_cell(self, reference: str, text: str, style: str) -> str:
+        text = self._text(text)
+        if len(text) > MAX_CELL_TEXT:
+            text = text[:MAX_CELL_TEXT]
+        space = ' xml:space="preserve"' if text != text.strip() else ""
+        return f'<c r="{reference}" t="inlineStr"{style}><is><t{space}>{escape(text)}</t></is></c>'
+
+    def _part(self, name: str, xml: str) -> None:
+        self.archive.writestr(name, '<?xml version="1.0" encoding="UTF-8" standalone="yes"?>\n' + xml)
+
+    @staticmethod
+    def _text(text: str) -> str:
+        return XML_INVALID.sub("", text)
+
+    @staticmethod
+    def _kind(value: Any) -> str:
+        if isinstance(value, bool):
+            return "bool"
+        if isinstance(value, datetime):
+            return "datetime"
+        if isinstance(value, date):
+            return "date"
+        if isinstance(value, (int, float, Decimal)):
+            return "number"
+        return "text"
+
+    @staticmethod
+    def _default_format(kinds: set) -> str:
+        """The format of a column without one, from the kinds of its values."""
+        if kinds == {"date"}:
+            return "date"
+        if kinds and kinds <= {"date", "datetime"}:
+            return "datetime"
+        return "general"
+
+    @staticmethod
+    def _display_width(value: Any) -> int:
+        if isinstance(value, datetime):
+            return 19
+        if isinstance(value, date):
+            return 10
+        if isinstance(value, (int, float, Decimal)) and not isinstance(value, bool):
+            # Room for thousands separators and two decimals
+            digits = len(f"{abs(value):.0f}")
+            return digits + digits // 3 + 4
+        return min(len(str(value)), MAX_COLUMN_WIDTH)
+
+
+class Styles:
+    """The cell styles a workbook uses, added as columns ask for them."""
+
+    def __init__(self):
+        # Index 0 is the default style; the header style is index 1
+        self._formats: List[Optional[int]] = [0, 0]
+        self._by_format: Dict[str, int] = {"general": 0}
+        self._custom: Dict[str, int] = {}
+
+    @staticmethod
+    def header_style() -> int:
+        return 1
+
+    def cell_style(self, fmt: str) -> int:
+        """The style index of cells in a format."""
+        if fmt not in self._by_format:
+            code, builtin = XLSX_FORMATS[fmt]
+            if builtin is None:
+                builtin = self._custom.setdefault(code, 164 + len(self._custom))
+            self._by_format[fmt] = len(self._formats)
+            self._formats.append(builtin)
+        return self._by_format[fmt]
+
+    def xml(self) -> str:
+        custom = "".join(f'<numFmt numFmtId="{number}" formatCode={quoteattr(code)}/>'
+                         for code, number in self._custom.items())
+        formats = f'<numFmts count="{len(self._custom)}">{custom}</numFmts>' if self._custom else ""
+        xfs = ['<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>',
+               '<xf numFmtId="0" fontId="1" fillId="2" borderId="1" xfId="0" applyFont="1" applyFill="1" applyBorder="1"/>']
+        xfs.extend(f'<xf numFmtId="{number}" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>'
+                   for number in self._formats[2:])
+        return (
+            f'<styleSheet xmlns="{MAIN_NAMESPACE}">{formats}'
+            '<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font>'
+            '<font><b/><sz val="11"/><name val="Calibri"/></font></fonts>'
+            '<fills count="3"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill>'
+            '<fill><patternFill patternType="solid"><fgColor rgb="FFD9E1F2"/><bgColor indexed="64"/></patternFill></fill></fills>'
+            '<borders count="2"><border><left/><right/><top/><bottom/><diagonal/></border>'
+            '<border><left/><right/><top/><bottom style="thin"><color rgb="FF8EA9DB"/></bottom><diagonal/></border></borders>'
+            '<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>'
+            f'<cellXfs count="{len(xfs)}">{"".join(xfs)}</cellXfs>'
+            '<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles></styleSheet>'
+        )
@@ -0,0 +1,507 @@
+"""
+TerraFusion Platform - Go Client Generator
+
+This module renders the typed Go client of the REST API from the OpenAPI
+document (see openapi_spec), so integrators import a client instead of
+hand-rolling HTTP calls that drift from the server. openapi_spec.py writes
+it next to the spec; do not edit the generated files by hand:
+
+    import client "github.com/bsvalues/TerraFusionSync/gen/go/terrafusion/client/v1"
+
+    c, err := client.New("https://terrafusion.example.gov", client.WithAPIKey("tfk_..."))
+    jobs, resp, err := c.ListSyncJobs(ctx, &client.ListSyncJobsParams{Status: "FAILED", Limit: 50})
+    more, _, err := c.ListSyncJobs(ctx, &client.ListSyncJobsParams{Status: "FAILED", Limit: 50, Cursor: resp.NextCursor})
+
+Every operation is a Client method taking its path parameters, a Params
+struct of its query parameters and a typed request body, and returning the
+decoded response (a struct of the spec's schema, a slice of one, or a
+map[string]any where the spec has no schema) with the *Response it came
+in. Operations answering with files or event streams return the body as an
+io.ReadCloser for the caller to close. Error statuses come back as
+*APIError. Timestamps are strings: the API writes ISO 8601 without a zone.
+
+The package directory carries the major version of the API's paths
+(/api/v1/ -> client/v1), and Version holds the spec's info.version.
+"""
+
+import re
+import logging
+from typing import Dict, List, Any, Optional, Tuple
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Go module the client ships in, rooted at GO_MODULE_DIR
+GO_MODULE = "github.com/bsvalues/TerraFusionSync/gen/go"
+GO_MODULE_DIR = "gen/go"
+
+GO_VERSION = "1.21"
+
+PACKAGE = "client"
+
+# Package directory under the module, by API major version
+PACKAGE_DIR = "terrafusion/client/v{major}"
+
+GENERATED_HEADER = "// Code generated by openapi_spec.py from the TerraFusion OpenAPI spec. DO NOT EDIT."
+
+# Words written in capitals in Go names
+INITIALISMS = {"id": "ID", "url": "URL", "uri": "URI", "api": "API", "http": "HTTP", "json": "JSON", "ip": "IP",
+               "gis": "GIS", "ai": "AI", "rbac": "RBAC", "cdc": "CDC", "csv": "CSV", "sql": "SQL", "uuid": "UUID",
+               "ttl": "TTL", "eta": "ETA"}
+
+GO_KEYWORDS = {"break", "case", "chan", "const", "continue", "default", "defer", "else", "fallthrough", "for", "func",
+               "go", "goto", "if", "import", "interface", "map", "package", "range", "return", "select", "struct",
+               "switch", "type", "var"}
+
+_WORD = re.compile(r"[A-Z]+(?![a-z])|[A-Z]?[a-z0-9]+")
+
+
+def go_name(name: str) -> str:
+    """An exported Go name for a snake_case, kebab-case or camelCase name."""
+    words = [w for part in re.split(r"[^A-Za-z0-9]+", name) for w in _WORD.findall(part)]
+    text = "".join(INITIALISMS.get(w.lower(), w[0].upper() + w[1:]) for w in words)
+    return text if text and not text[0].isdigit() else "X" + text
+
+
+def go_variable(name: str) -> str:
+    """An unexported Go name, e.g. for a path parameter."""
+    exported = go_name(name)
+    match = re.match(r"[A-Z]+(?=[A-Z][a-z]|$)|[A-Z]", exported)
+    variable = exported[:match.end()].lower() + exported[match.end():]
+    return variable + "_" if variable in GO_KEYWORDS else variable
+
+
+def _schema_name(ref: str) -> str:
+    return go_name(ref.rsplit("/", 1)[-1])
+
+
+def go_type(schema: Dict[str, Any], optional_pointer: bool = False) -> str:
+    """The Go type of a schema."""
+    if not schema:
+        return "any"
+    if "$ref" in schema:
+        return _schema_name(schema["$ref"])
+    kind = schema.get("type")
+    if kind == "array":
+        return "[]" + go_type(schema.get("items") or {})
+    if kind == "object":
+        extra = schema.get("additionalProperties")
+        if isinstance(extra, dict) and extra:
+            return "map[string]" + go_type(extra)
+        return "map[string]any"
+    base = {"string": "string", "integer": "int64", "number": "float64", "boolean": "bool"}.get(kind, "any")
+    if base != "any" and (schema.get("nullable") or (optional_pointer and base == "bool")):
+        return "*" + base
+    return base
+
+
+def _comment(text: str, indent: str = "") -> List[str]:
+    return [f"{indent}// {line}".rstrip() for line in text.splitlines()]
+
+
+def _aligned(rows: List[Tuple[str, ...]], indent: str = "\t") -> List[str]:
+    """Rows of cells aligned in columns as gofmt does; a row of one cell (a comment) ends a section."""
+    lines, section = [], []
+
+    def flush():
+        if not section:
+            return
+        widths = [max(len(row[i]) for row in section if len(row) > i) for i in range(max(len(r) for r in section))]
+        for row in section:
+            cells = [cell.ljust(widths[i]) if i < len(row) - 1 else cell for i, cell in enumerate(row)]
+            lines.append(indent + " ".join(cells).rstrip())
+        section.clear()
+
+    for row in rows:
+        if len(row) == 1:
+            flush()
+            lines.append(indent + row[0])
+        else:
+            section.append(row)
+    flush()
+    return lines
+
+
+def _struct(name: str, schema: Dict[str, Any], doc: str, request: bool) -> List[str]:
+    lines = _comment(doc)
+    properties = schema.get("properties") or {}
+    if not properties:
+        return lines + [f"type {name} map[string]any", ""]
+    required = set(schema.get("required") or [])
+    rows = []
+    for field, field_schema in properties.items():
+        if field_schema.get("description"):
+            rows.extend((line,) for line in _comment(field_schema["description"]))
+        tag = field if field in required else f"{field},omitempty"
+        rows.append((go_name(field), go_type(field_schema, optional_pointer=request and field not in required),
+                     f'`json:"{tag}"`'))
+    return lines + [f"type {name} struct {{"] + _aligned(rows) + ["}", ""]
+
+
+def render_models(spec: Dict[str, Any]) -> str:
+    lines = [GENERATED_HEADER, "", f"package {PACKAGE}", ""]
+    for name, schema in spec["components"]["schemas"].items():
+        type_name = go_name(name)
+        doc = f"{type_name} is the {name} schema of the API."
+        if schema.get("description"):
+            doc += "\n" + schema["description"]
+        lines.extend(_struct(type_name, schema, doc, request=name.endswith("Request")))
+    return "\n".join(lines).rstrip("\n") + "\n"
+
+
+def _operations(spec: Dict[str, Any]) -> List[Tuple[str, str, Dict[str, Any]]]:
+    return [(path, method.upper(), operation) for path, item in spec["paths"].items() for method, operation in item.items()]
+
+
+def _success(operation: Dict[str, Any]) -> Tuple[Optional[Dict[str, Any]], bool]:
+    """The JSON schema of an operation's success response, and whether its body is a raw stream."""
+    for code in sorted(operation["responses"]):
+        if not code.startswith("2"):
+            continue
+        content = operation["responses"][code].get("content")
+        if not content:
+            continue
+        if "application/json" in content:
+            return content["application/json"].get("schema"), False
+        return None, True
+    return None, False
+
+
+def _result_type(schema: Optional[Dict[str, Any]]) -> Tuple[str, str, str]:
+    """The Go return type of a JSON response, the declaration of the value decoded into, and its address."""
+    if schema and "$ref" in schema:
+        name = _schema_name(schema["$ref"])
+        return f"*{name}", f"out := new({name})", "out"
+    kind = go_type(schema or {"type": "object"})
+    return kind, f"var out {kind}", "&out"
+
+
+def _path_expression(path: str, parameters: Dict[str, Dict[str, Any]]) -> str:
+    parts = []
+    for index, piece in enumerate(re.split(r"\{(\w+)\}", path)):
+        if index % 2 == 0:
+            if piece:
+                parts.append(f'"{piece}"')
+        elif parameters[piece].get("type") == "integer":
+            parts.append(f"strconv.FormatInt({go_variable(piece)}, 10)")
+        else:
+            parts.append(f"url.PathEscape({go_variable(piece)})")
+    return "+".join(parts) or '"/"'
+
+
+def _params_struct(name: str, parameters: List[Dict[str, Any]]) -> List[str]:
+    lines = _comment(f"{name} holds the query parameters of {name[:-len('Params')]}; zero values are left out.")
+    rows = []
+    for parameter in parameters:
+        if parameter.get("description") or parameter.get("deprecated"):
+            text = parameter.get("description", "")
+            if parameter.get("deprecated"):
+                text = (text + "\n\n" if text else "") + "Deprecated: page with Cursor instead."
+            rows.extend((line,) for line in _comment(text))
+        rows.append((go_name(parameter["name"]), _query_type(parameter["schema"])))
+    lines += [f"type {name} struct {{"] + _aligned(rows) + ["}", ""]
+
+    lines += [f"func (p *{name}) values() url.Values {{", "\tq := url.Values{}", "\tif p == nil {", "\t\treturn q", "\t}"]
+    for parameter in parameters:
+        field = go_name(parameter["name"])
+        kind = _query_type(parameter["schema"])
+        key = parameter["name"]
+        if kind == "[]string":
+            lines += [f"\tfor _, v := range p.{field} {{", f'\t\tq.Add("{key}", v)', "\t}"]
+        elif kind == "int64":
+            lines += [f"\tif p.{field} != 0 {{", f'\t\tq.Set("{key}", strconv.FormatInt(p.{field}, 10))', "\t}"]
+        else:
+            lines += [f'\tif p.{field} != "" {{', f'\t\tq.Set("{key}", p.{field})', "\t}"]
+    lines += ["\treturn q", "}", ""]
+    return lines
+
+
+def _query_type(schema: Dict[str, Any]) -> str:
+    if schema.get("type") == "array":
+        return "[]string"
+    return "int64" if schema.get("type") == "integer" else "string"
+
+
+def render_operations(spec: Dict[str, Any]) -> str:
+    body: List[str] = []
+    uses_strconv = False
+    for path, method, operation in _operations(spec):
+        name = go_name(operation["operationId"])
+        path_parameters = {p["name"]: p["schema"] for p in operation.get("parameters", []) if p["in"] == "path"}
+        query_parameters = [p for p in operation.get("parameters", []) if p["in"] == "query"]
+
+        arguments = ["ctx context.Context"]
+        for parameter, schema in path_parameters.items():
+            uses_strconv = uses_strconv or schema.get("type") == "integer"
+            arguments.append(f"{go_variable(parameter)} {'int64' if schema.get('type') == 'integer' else 'string'}")
+        query = "nil"
+        if query_parameters:
+            params_name = f"{name}Params"
+            body.extend(_params_struct(params_name, query_parameters))
+            uses_strconv = uses_strconv or any(_query_type(p["schema"]) == "int64" for p in query_parameters)
+            arguments.append(f"params *{params_name}")
+            query = "params.values()"
+        payload = "nil"
+        request_body = operation.get("requestBody")
+        if request_body and "application/json" not in request_body["content"]:
+            # Streamed as it is read, in one of the content types the operation takes
+            arguments += ["contentType string", "body io.Reader"]
+            payload = "rawBody{contentType, body}"
+        elif request_body:
+            schema = request_body["content"]["application/json"]["schema"]
+            arguments.append(f"body *{_schema_name(schema['$ref'])}" if "$ref" in schema else f"body {go_type(schema)}")
+            payload = "body"
+
+        schema, raw = _success(operation)
+        doc = f"{name} calls {method} {path} ({operation['summary'][0].lower() + operation['summary'][1:]})."
+        if request_body and not request_body.get("required"):
+            doc += " body may be nil."
+        elif request_body and "application/json" not in request_body["content"]:
+            doc += f" contentType is one of {', '.join(request_body['content'])}."
+        body.extend(_comment(doc))
+        if operation.get("deprecated"):
+            body += ["//"] + _comment(f"Deprecated: {operation['description']}")
+        expression = _path_expression(path, path_parameters)
+        if raw:
+            body += [f"func (c *Client) {name}({', '.join(arguments)}) (io.ReadCloser, *Response, error) {{",
+                     f'\treturn c.stream(ctx, "{method}", {expression}, {query}, {payload})', "}", ""]
+            continue
+        result, declaration, target = _result_type(schema)
+        body += [f"func (c *Client) {name}({', '.join(arguments)}) ({result}, *Response, error) {{",
+                 f"\t{declaration}",
+                 f'\tresp, err := c.do(ctx, "{method}", {expression}, {query}, {payload}, {target})',
+                 "\tif err != nil {", "\t\treturn nil, resp, err", "\t}",
+                 "\treturn out, resp, nil", "}", ""]
+
+    imports = ['"context"', '"io"', '"net/url"'] + (['"strconv"'] if uses_strconv else [])
+    header = [GENERATED_HEADER, "", f"package {PACKAGE}", "", "import ("] + [f"\t{i}" for i in imports] + [")", ""]
+    return "\n".join(header + body).rstrip("\n") + "\n"
+
+
+def render_client(spec: Dict[str, Any]) -> str:
+    return CLIENT_TEMPLATE.replace("{{HEADER}}", GENERATED_HEADER).replace("{{PACKAGE}}", PACKAGE) \
+        .replace("{{VERSION}}", spec["info"]["version"]).replace("{{MAJOR}}", api_major_version(spec)) \
+        .replace("{{TITLE}}", spec["info"]["title"])
+
+
+def api_major_version(spec: Dict[str, Any]) -> str:
+    """The major version in the spec's /api/vN/ paths, which the package directory carries."""
+    versions = sorted({int(m) for m in re.findall(r"^/api/v(\d+)/", "\n".join(spec["paths"]), re.MULTILINE)})
+    return str(versions[-1] if versions else 1)
+
+
+def render(spec: Dict[str, Any]) -> Dict[str, str]:
+    """
+    The files of the Go client of a spec.
+
+    Returns:
+        Dictionary of file path (relative to the repository root) to content
+    """
+    major = api_major_version(spec)
+    package_dir = f"{GO_MODULE_DIR}/{PACKAGE_DIR.format(major=major)}"
+    return {
+        f"{GO_MODULE_DIR}/go.mod": f"module {GO_MODULE}\n\ngo {GO_VERSION}\n",
+        f"{package_dir}/client.go": render_client(spec),
+        f"{package_dir}/models.go": render_models(spec),
+        f"{package_dir}/operations.go": render_operations(spec),
+    }
+
+
+CLIENT_TEMPLATE = '''{{HEADER}}
+
+// Package {{PACKAGE}} is a typed client of the {{TITLE}}, generated from its
+// OpenAPI spec (api_documentation.json) by openapi_spec.py.
+//
+// Every operation is a method of Client returning the decoded response and
+// the *Response it came in; error statuses come back as *APIError.
+// Listings page with cursors: pass Response.NextCursor as the next call's
+// Cursor until it is empty.
+package {{PACKAGE}}
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// Version is the version of the API spec the client was generated from.
+const Version = "{{VERSION}}"
+
+// APIMajorVersion is the version of the /api/vN/ paths the client calls.
+const APIMajorVersion = {{MAJOR}}
+
+// Client calls the API of one TerraFusion server.
+type Client struct {
+	// BaseURL is the server's root, e.g. https://terrafusion.example.gov.
+	BaseURL *url.URL
+	// HTTPClient sends the requests; http.DefaultClient when nil.
+	HTTPClient *http.Client
+	// Header is added to every request, e.g. for authentication.
+	Header http.Header
+	// UserAgent is sent with every request.
+	UserAgent string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sends requests with an http.Client of the caller's.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.HTTPClient = httpClient }
+}
+
+// WithHeader adds a header to every request.
+func WithHeader(key, value string) Option {
+	return func(c *Client) { c.Header.Add(key, value) }
+}
+
+// WithAPIKey authenticates every request with a scoped API key (X-API-Key).
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.Header.Set("X-API-Key", key) }
+}
+
+// New returns a client of the server at baseURL.
+func New(baseURL string, options ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("terrafusion: invalid base URL: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("terrafusion: base URL %q needs a scheme and host", baseURL)
+	}
+	c := &Client{BaseURL: u, Header: http.Header{}, UserAgent: "terrafusion-go/" + Version}
+	for _, option := range options {
+		option(c)
+	}
+	return c, nil
+}
+
+// Response is the HTTP response an operation's result came in.
+type Response struct {
+	*http.Response
+	// NextCursor is the cursor of a listing's next page; empty on the last page.
+	NextCursor string
+	// Deprecated is set when the server flagged the request as deprecated (e.g. offset paging).
+	Deprecated bool
+}
+
+// APIError is an error status from the server.
+type APIError struct {
+	StatusCode int
+	// Message is the server's "error" field, or the status text.
+	Message string
+	// Body is the raw response body.
+	Body []byte
+	// RetryAfter is the server's Retry-After header, if any.
+	RetryAfter string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("terrafusion: %d: %s", e.StatusCode, e.Message)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) (*Response, error) {
+	raw, resp, err := c.stream(ctx, method, path, query, body)
+	if err != nil {
+		return resp, err
+	}
+	defer raw.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return resp, nil
+	}
+	if err := json.NewDecoder(raw).Decode(out); err != nil && err != io.EOF {
+		return resp, fmt.Errorf("terrafusion: decoding %s %s: %w", method, path, err)
+	}
+	return resp, nil
+}
+
+func (c *Client) stream(ctx context.Context, method, path string, query url.Values, body any) (io.ReadCloser, *Response, error) {
+	// path is escaped already; RawPath keeps escaped slashes in parameters
+	u := *c.BaseURL
+	u.RawPath = strings.TrimRight(c.BaseURL.EscapedPath(), "/") + path
+	unescaped, err := url.PathUnescape(u.RawPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.Path = unescaped
+	if encoded := query.Encode(); encoded != "" {
+		u.RawQuery = encoded
+	}
+	var reader io.Reader
+	contentType := "application/json"
+	if raw, ok := body.(rawBody); ok {
+		reader, contentType = raw.reader, raw.contentType
+	} else if !isNil(body) {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("terrafusion: encoding %s %s: %w", method, path, err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range c.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json, */*")
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	httpResp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp := &Response{Response: httpResp, NextCursor: httpResp.Header.Get("X-Next-Cursor"),
+		Deprecated: httpResp.Header.Get("Deprecation") != ""}
+	if httpResp.StatusCode >= 400 {
+		defer httpResp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+		apiErr := &APIError{StatusCode: httpResp.StatusCode, Message: http.StatusText(httpResp.StatusCode), Body: data,
+			RetryAfter: httpResp.Header.Get("Retry-After")}
+		var payload struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &payload) == nil && payload.Error != "" {
+			apiErr.Message = payload.Error
+		}
+		return nil, resp, apiErr
+	}
+	return httpResp.Body, resp, nil
+}
+
+// rawBody is a request body sent as it is, rather than encoded as JSON.
+type rawBody struct {
+	contentType string
+	reader      io.Reader
+}
+
+// isNil reports whether an operation was called without a body.
+func isNil(body any) bool {
+	if body == nil {
+		return true
+	}
+	switch v := reflect.ValueOf(body); v.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+'''
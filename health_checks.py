@@ -0,0 +1,229 @@
+"""
+TerraFusion Platform - Health Checks
+
+This module provides the readiness checks behind GET /health/ready. Each
+check probes one dependency: the sync job store (a document is written, read
+back and deleted), the free space of the disk exports are written to, the
+event bus, the source and target connectors of every sync pair, and any check
+registered with HealthChecks.check (the gateway registers its database).
+
+A failed critical check (the job store, the export disk, the gateway
+database) makes the instance unavailable and /health/ready answers 503, so
+load balancers stop routing to it. A failed connector or event bus only
+degrades it: the sync pairs using an unreachable connector cannot run, but
+everything else can, so /health/ready answers 200 with status "degraded" and
+lists the sync pairs affected. GET /health stays a liveness probe that
+answers 200 whenever the process serves requests.
+
+Checks run in parallel, each bounded by HEALTH_CHECK_TIMEOUT_SECONDS, and a
+report is reused for HEALTH_CACHE_SECONDS so frequent probes do not open a
+connection to every source database each time.
+"""
+
+import os
+import json
+import time
+import uuid
+import shutil
+import logging
+import threading
+from concurrent.futures import ThreadPoolExecutor, wait
+from datetime import datetime
+from typing import Dict, Any, Optional, Callable
+
+from system_events import check_connector, CONNECTOR_SIDES
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Seconds a check may take before it counts as unavailable
+CHECK_TIMEOUT_SECONDS = float(os.environ.get("HEALTH_CHECK_TIMEOUT_SECONDS", "5"))
+
+# Seconds a readiness report is reused
+CACHE_SECONDS = float(os.environ.get("HEALTH_CACHE_SECONDS", "15"))
+
+# Free megabytes on the export disk below which the instance is unavailable
+EXPORT_DISK_MIN_FREE_MB = float(os.environ.get("HEALTH_EXPORT_DISK_MIN_FREE_MB", "512"))
+
+# Free megabytes on the export disk below which the instance is degraded
+EXPORT_DISK_WARN_FREE_MB = float(os.environ.get("HEALTH_EXPORT_DISK_WARN_FREE_MB", "2048"))
+
+# Checks run at once
+MAX_PARALLEL_CHECKS = 16
+
+# Collection the job store probe writes to
+PROBE_COLLECTION = "health_probes"
+
+# Statuses of checks and reports
+STATUSES = ["healthy", "degraded", "unavailable"]
+
+
+def disk_status(path: str) -> Dict[str, Any]:
+    """Free space of the disk holding path, unavailable or degraded below the export disk thresholds."""
+    usage = shutil.disk_usage(path)
+    free_mb = usage.free / (1024 * 1024)
+    result = {"path": path, "free_mb": round(free_mb), "total_mb": round(usage.total / (1024 * 1024))}
+    if free_mb < EXPORT_DISK_MIN_FREE_MB:
+        return dict(result, status="unavailable", error=f"Less than {EXPORT_DISK_MIN_FREE_MB:g} MB free")
+    if free_mb < EXPORT_DISK_WARN_FREE_MB:
+        return dict(result, status="degraded", error=f"Less than {EXPORT_DISK_WARN_FREE_MB:g} MB free")
+    return dict(result, status="healthy")
+
+
+class HealthChecks:
+    """
+    Service class for the readiness report of a gateway instance.
+    """
+
+    def __init__(self, store, registry, bus, export_path: str = "exports",
+                 timeout_seconds: float = CHECK_TIMEOUT_SECONDS, cache_seconds: float = CACHE_SECONDS):
+        """
+        Initialize the health checks.
+
+        Args:
+            store: Document store sync jobs are kept in
+            registry: Sync pair registry whose connectors are checked
+            bus: Event bus whose connection is checked
+            export_path: Directory export files are written to
+            timeout_seconds: Seconds each check may take
+            cache_seconds: Seconds a report is reused
+        """
+        self.store = store
+        self.registry = registry
+        self.bus = bus
+        self.export_path = export_path
+        self.timeout_seconds = timeout_seconds
+        self.cache_seconds = cache_seconds
+        self._checks: Dict[str, Dict[str, Any]] = {}
+        self._report: Optional[Dict[str, Any]] = None
+        self._report_at = 0.0
+        self._lock = threading.Lock()
+        self.register("job_store", self.check_job_store)
+        self.register("export_disk", self.check_export_disk)
+        self.register("event_bus", self.check_event_bus, critical=False)
+
+    def register(self, name: str, func: Callable[[], Dict[str, Any]], critical: bool = True) -> None:
+        """
+        Add a check. func returns a dict with a "status" of STATUSES and any
+        details, or raises when the dependency is unavailable; when critical,
+        an unavailable result makes the whole instance unavailable.
+        """
+        self._checks[name] = {"func": func, "critical": critical}
+
+    def check(self, name: str, critical: bool = True):
+        """Decorator form of register."""
+        def decorator(func):
+            self.register(name, func, critical)
+            return func
+        return decorator
+
+    def check_job_store(self) -> Dict[str, Any]:
+        key = f"probe-{uuid.uuid4().hex}"
+        self.store.save(PROBE_COLLECTION, key, {"written_at": datetime.utcnow().isoformat()})
+        try:
+            self.store.load(PROBE_COLLECTION, key)
+        finally:
+            self.store.delete(PROBE_COLLECTION, key)
+        return {"status": "healthy", "backend": getattr(self.store, "backend_name", None)}
+
+    def check_export_disk(self) -> Dict[str, Any]:
+        return disk_status(self.export_path)
+
+    def check_event_bus(self) -> Dict[str, Any]:
+        return self.bus.health_check()
+
+    def report(self, refresh: bool = False) -> Dict[str, Any]:
+        """
+        The readiness report: the overall status, each check's result, each
+        connector's result and the sync pairs that cannot run.
+        """
+        with self._lock:
+            if not refresh and self._report is not None and time.monotonic() - self._report_at < self.cache_seconds:
+                return self._report
+            self._report = self._run()
+            self._report_at = time.monotonic()
+            return self._report
+
+    def _connector_targets(self) -> Dict[str, Dict[str, Any]]:
+        # Pairs sharing a source or target connect to it once
+        targets: Dict[str, Dict[str, Any]] = {}
+        for pair in self.registry.list():
+            for side in CONNECTOR_SIDES:
+                config = getattr(pair, side)
+                key = json.dumps(config, sort_keys=True, default=str)
+                target = targets.setdefault(key, {"config": config, "uses": []})
+                target["uses"].append({"sync_pair_id": pair.sync_pair_id, "county_id": pair.county_id, "side": side})
+        return targets
+
+    def _run(self) -> Dict[str, Any]:
+        started = time.monotonic()
+        connectors = self._connector_targets()
+        calls = {f"check:{name}": check["func"] for name, check in self._checks.items()}
+        calls.update({f"connector:{number}": (lambda config=target["config"]: check_connector(config))
+                      for number, target in enumerate(connectors.values())})
+        results = self._call_all(calls)
+
+        checks = {}
+        for name, check in self._checks.items():
+            checks[name] = dict(results[f"check:{name}"], critical=check["critical"])
+        connector_results = []
+        for number, target in enumerate(connectors.values()):
+            result = results[f"connector:{number}"]
+            for use in target["uses"]:
+                connector_results.append(dict(use, connector_type=result.get("connector_type") or
+                                              target["config"].get("type"), status=result["status"],
+                                              error=result.get("error"),
+                                              circuit=(result.get("circuit") or {}).get("state"),
+                                              duration_ms=result["duration_ms"]))
+
+        failed_critical = [name for name, result in checks.items()
+                           if result["critical"] and result["status"] == "unavailable"]
+        degraded_pairs = sorted({c["sync_pair_id"] for c in connector_results if c["status"] != "healthy"})
+        if failed_critical:
+            status = "unavailable"
+        elif degraded_pairs or any(result["status"] != "healthy" for result in checks.values()):
+            status = "degraded"
+        else:
+            status = "healthy"
+        if status != "healthy":
+            logger.warning(f"Readiness is {status}: unavailable checks {failed_critical or 'none'}, "
+                           f"degraded sync pairs {degraded_pairs or 'none'}")
+        return {
+            "status": status,
+            "checked_at": datetime.utcnow().isoformat(),
+            "duration_ms": round((time.monotonic() - started) * 1000),
+            "checks": checks,
+            "connectors": connector_results,
+            "unavailable_checks": failed_critical,
+            "degraded_sync_pairs": degraded_pairs,
+        }
+
+    def _call_all(self, calls: Dict[str, Callable[[], Dict[str, Any]]]) -> Dict[str, Dict[str, Any]]:
+        # A hung dependency must not hold the report, so threads still running at the timeout are left behind
+        executor = ThreadPoolExecutor(max_workers=max(1, min(MAX_PARALLEL_CHECKS, len(calls))),
+                                      thread_name_prefix="health-check")
+        try:
+            futures = {key: executor.submit(self._call, func) for key, func in calls.items()}
+            wait(futures.values(), timeout=self.timeout_seconds)
+        finally:
+            executor.shutdown(wait=False, cancel_futures=True)
+        results = {}
+        for key, future in futures.items():
+            if future.done() and not future.cancelled():
+                results[key] = future.result()
+            else:
+                results[key] = {"status": "unavailable", "error": f"No answer within {self.timeout_seconds:g}s",
+                                "duration_ms": round(self.timeout_seconds * 1000)}
+        return results
+
+    @staticmethod
+    def _call(func: Callable[[], Dict[str, Any]]) -> Dict[str, Any]:
+        started = time.monotonic()
+        try:
+            result = dict(func() or {})
+            result.setdefault("status", "healthy")
+        except Exception as e:
+            result = {"status": "unavailable", "error": str(e)}
+        result["duration_ms"] = round((time.monotonic() - started) * 1000)
+        return result
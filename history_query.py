@@ -0,0 +1,144 @@
+"""
+TerraFusion Platform - History Query
+
+This module provides the query language of the audit event, sync job and
+export job listings (the ?q= parameter), so auditors can ask questions like
+"failed exports by jdoe touching parcels in March" in one request:
+
+    GET /api/v1/gis-export/jobs?q=status = 'FAILED' and username = 'jdoe'
+        and layers contains 'parcels' and created_at during '2026-03'
+    GET /api/v1/audit/events?q=action like 'sync_conflict.%' and details.table_name = 'dbo.property'
+    GET /api/v1/sync/jobs?q=status = 'FAILED' and 'deadlock'
+
+It is the predicate language of sync pair filters (see sync_filters:
+and/or/not, parentheses, = != < <= > >=, in (...), like, is null) with
+three additions:
+
+- field contains value: a list field holds the value, or a text field
+  contains it (case insensitive)
+- field during 'YYYY[-MM[-DD]]': a timestamp falls in that year, month or day
+- a bare 'string': free text, matched case insensitively against the
+  listing's message fields (a job's message; an audit event's action,
+  resource and details)
+
+Fields are the listed records' own, with dots reaching into nested objects
+(stats.errors, details.table_name); a field a record lacks is null.
+Timestamps are ISO strings, so created_at >= '2026-03-01' compares as
+expected.
+"""
+
+import json
+import logging
+from typing import Dict, List, Any, Optional, Sequence
+
+from sync_filters import FilterExpression, FilterSyntaxError, _compare
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Operators added to the filter language, spelled like fields by its tokenizer
+HISTORY_OPERATORS = ["contains", "during"]
+
+# Fields a bare string is matched against, per listing
+JOB_TEXT_FIELDS = ["message"]
+AUDIT_TEXT_FIELDS = ["action", "resource_type", "resource_id", "details"]
+
+# Longest query accepted
+MAX_QUERY_LENGTH = 2000
+
+
+def _text(value: Any) -> str:
+    if isinstance(value, (dict, list)):
+        return json.dumps(value, default=str)
+    return "" if value is None else str(value)
+
+
+class HistoryQuery(FilterExpression):
+    """A parsed history query that can be evaluated against audit events and job records."""
+
+    def __init__(self, text: str, text_fields: Sequence[str] = JOB_TEXT_FIELDS):
+        """
+        Parse a history query.
+
+        Args:
+            text: The query
+            text_fields: Fields a bare string is matched against
+
+        Raises:
+            FilterSyntaxError: If the query is invalid
+        """
+        if len(text) > MAX_QUERY_LENGTH:
+            raise FilterSyntaxError(f"Query is longer than {MAX_QUERY_LENGTH} characters")
+        self.text_fields = list(text_fields)
+        super().__init__(text)
+
+    def _token_at(self, offset: int):
+        position = self._position + offset
+        return self._tokens[position] if position < len(self._tokens) else (None, None)
+
+    @staticmethod
+    def _is_operator(token) -> bool:
+        return token[0] == "field" and token[1].lower() in HISTORY_OPERATORS
+
+    def _parse_comparison(self):
+        kind, value = self._peek()
+        following = self._token_at(1)
+        if kind == "literal" and isinstance(value, str) and following[0] != "op" and not self._is_operator(following) \
+                and not (following[0] == "keyword" and following[1] in ("in", "like", "is", "not")):
+            # A bare string searches the text fields
+            self._take()
+            return ("text", value.lower())
+        if kind == "field" and self._is_operator(following):
+            self._take()
+            operator = self._take()[1].lower()
+            operand = self._parse_operand()
+            if operator == "during" and (operand[0] != "literal" or operand[1] is None):
+                raise FilterSyntaxError(f"during needs a date like '2026-03' in query: {self.text}")
+            return (operator, ("field", value), operand)
+        return super()._parse_comparison()
+
+    def _value(self, node, record: Dict[str, Any]) -> Any:
+        if node[0] != "field":
+            return node[1]
+        name = node[1]
+        if name in record or "." not in name:
+            return record.get(name)
+        value: Any = record
+        for part in name.split("."):
+            if not isinstance(value, dict):
+                return None
+            value = value.get(part)
+        return value
+
+    def _evaluate(self, node, record: Dict[str, Any]) -> Any:
+        op = node[0]
+        if op == "text":
+            return any(node[1] in _text(record.get(name)).lower() for name in self.text_fields)
+        if op == "contains":
+            value, wanted = self._value(node[1], record), self._value(node[2], record)
+            if wanted is None or value is None:
+                return False
+            if isinstance(value, list):
+                return any(_compare("=", item, wanted) for item in value)
+            if isinstance(value, dict):
+                return str(wanted) in value
+            return str(wanted).lower() in str(value).lower()
+        if op == "during":
+            value = self._value(node[1], record)
+            return value is not None and str(value).startswith(str(node[2][1]))
+        return super()._evaluate(node, record)
+
+
+def search(items: List[Dict[str, Any]], query: Optional[str],
+           text_fields: Sequence[str] = JOB_TEXT_FIELDS) -> List[Dict[str, Any]]:
+    """
+    The items a history query matches; all of them when there is no query.
+
+    Raises:
+        FilterSyntaxError: If the query is invalid
+    """
+    if not query or not query.strip():
+        return items
+    parsed = HistoryQuery(query, text_fields)
+    return [item for item in items if parsed.matches(item)]
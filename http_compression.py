@@ -0,0 +1,326 @@
+"""
+TerraFusion Platform - HTTP Compression
+
+This module compresses the API's response bodies and decompresses its request
+bodies, so sync traffic between a county office and a cloud instance over a
+slow WAN link travels compressed: record streams, OData pages and job
+listings one way, pushed records and batch submissions the other. It is WSGI
+middleware around the whole application, so it sees each body after every
+other layer (redaction, API versions) is done with it.
+
+Responses are compressed in the best encoding the client's Accept-Encoding
+allows: zstd when the zstandard package is installed, gzip otherwise (and
+when the client prefers it). Only text-like bodies (JSON, NDJSON, GeoJSON,
+CSV, XML and other text) of at least HTTP_COMPRESSION_MIN_BYTES are
+compressed. Archives, images and downloads served with byte ranges go out
+as they are, and so do event streams, which proxies would otherwise hold
+back. A body is compressed as the application produces it and flushed after
+each piece, so a record stream still reaches its reader a page at a time and
+keeps its backpressure.
+
+Requests may send their body with Content-Encoding gzip or zstd, such as a
+gzipped NDJSON file pushed to the ingestion endpoint. The body is
+decompressed as the application reads it, and refused once it decompresses
+to more than HTTP_MAX_DECOMPRESSED_MB. Other encodings are answered with 415
+and the encodings accepted.
+"""
+
+import io
+import os
+import gzip
+import json
+import zlib
+import logging
+from typing import Dict, List, Any, Optional, Callable, Iterable, Iterator, Tuple
+
+from metrics import HTTP_COMPRESSION_BYTES
+
+try:
+    import zstandard
+    ZSTD_AVAILABLE = True
+except ImportError:
+    ZSTD_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Compress response bodies; request bodies are decompressed either way
+COMPRESSION_ENABLED = os.environ.get("HTTP_COMPRESSION_ENABLED", "true").lower() == "true"
+
+# Smallest response body compressed; a body of unknown length (a stream) always is
+COMPRESSION_MIN_BYTES = int(os.environ.get("HTTP_COMPRESSION_MIN_BYTES", "1024"))
+
+# Compression levels; fast ones, since bodies are compressed while they are sent
+GZIP_LEVEL = int(os.environ.get("HTTP_GZIP_LEVEL", "6"))
+ZSTD_LEVEL = int(os.environ.get("HTTP_ZSTD_LEVEL", "3"))
+
+# Size a request body may decompress to
+MAX_DECOMPRESSED_BYTES = int(float(os.environ.get("HTTP_MAX_DECOMPRESSED_MB", "1024")) * 1024 * 1024)
+
+# Content types compressed besides text/* and the +json and +xml types
+COMPRESSIBLE_TYPES = [
+    "application/json",
+    "application/x-ndjson",
+    "application/xml",
+    "application/javascript",
+    "image/svg+xml",
+    "image/vnd.dxf",
+]
+
+# Text types sent as they are: events must reach the client when they happen
+UNCOMPRESSED_TYPES = ["text/event-stream"]
+
+# Decompressed bytes a request body is read ahead by
+READ_CHUNK_BYTES = 64 * 1024
+
+_DECODE_ERRORS = (OSError, EOFError, zlib.error) + ((zstandard.ZstdError,) if ZSTD_AVAILABLE else ())
+
+
+def supported_encodings() -> List[str]:
+    """Content encodings bodies can be sent in, best first."""
+    return (["zstd"] if ZSTD_AVAILABLE else []) + ["gzip"]
+
+
+def choose_encoding(accept_encoding: Optional[str]) -> Optional[str]:
+    """
+    The encoding to send a response in: the supported encoding an
+    Accept-Encoding header weighs highest, the best of them on a tie, or None
+    for none.
+    """
+    if not accept_encoding:
+        return None
+    weights: Dict[str, float] = {}
+    for part in accept_encoding.split(","):
+        name, _, parameters = part.strip().partition(";")
+        name = name.strip().lower()
+        if not name:
+            continue
+        weight = 1.0
+        for parameter in parameters.split(";"):
+            key, _, value = parameter.strip().partition("=")
+            if key.strip().lower() == "q":
+                try:
+                    weight = float(value)
+                except ValueError:
+                    weight = 0.0
+        weights[name] = weight
+    if "x-gzip" in weights:
+        weights.setdefault("gzip", weights["x-gzip"])
+    best = None
+    for encoding in supported_encodings():
+        weight = weights.get(encoding, weights.get("*", 0.0))
+        if weight > 0 and (best is None or weight > best[1]):
+            best = (encoding, weight)
+    return best[0] if best else None
+
+
+class BodyDecodingError(ValueError):
+    """A request body that is not valid in its Content-Encoding (400), or decompresses to too much (413)."""
+
+    def __init__(self, message: str, status: int = 400):
+        super().__init__(message)
+        self.status = status
+
+
+class _Encoder:
+    """Compresses a response body a piece at a time, flushing after each."""
+
+    def __init__(self, encoding: str):
+        self.encoding = encoding
+        if encoding == "zstd":
+            self._compressor = zstandard.ZstdCompressor(level=ZSTD_LEVEL).compressobj()
+            self._flush_mode = zstandard.COMPRESSOBJ_FLUSH_BLOCK
+        else:
+            self._compressor = zlib.compressobj(GZIP_LEVEL, zlib.DEFLATED, 31)
+            self._flush_mode = zlib.Z_SYNC_FLUSH
+
+    def piece(self, data: bytes) -> bytes:
+        return self._compressor.compress(data) + self._compressor.flush(self._flush_mode)
+
+    def finish(self) -> bytes:
+        return self._compressor.flush()
+
+
+class _WireBody(io.RawIOBase):
+    """The compressed bytes of a request body, as many as it has, counted as they are read."""
+
+    def __init__(self, stream, length: Optional[int], encoding: str):
+        self._stream = stream
+        self._remaining = length
+        self._encoding = encoding
+
+    def readable(self) -> bool:
+        return True
+
+    def readinto(self, buffer) -> int:
+        size = len(buffer) if self._remaining is None else min(len(buffer), self._remaining)
+        if size <= 0:
+            return 0
+        data = self._stream.read(size)
+        buffer[:len(data)] = data
+        if self._remaining is not None:
+            self._remaining -= len(data)
+        HTTP_COMPRESSION_BYTES.inc(len(data), direction="request", encoding=self._encoding, form="encoded")
+        return len(data)
+
+
+class DecodingStream(io.RawIOBase):
+    """A compressed request body, read decompressed."""
+
+    def __init__(self, stream, length: Optional[int], encoding: str, limit: int = MAX_DECOMPRESSED_BYTES):
+        """
+        Initialize the stream.
+
+        Args:
+            stream: The request's wsgi.input
+            length: Its Content-Length; None when the server ends the input at the body's end
+            encoding: gzip or zstd
+            limit: Decompressed bytes the body may have
+        """
+        self.encoding = encoding
+        self.limit = limit
+        self.decoded = 0
+        wire = io.BufferedReader(_WireBody(stream, length, encoding), READ_CHUNK_BYTES)
+        if encoding == "zstd":
+            self._decoder = zstandard.ZstdDecompressor().stream_reader(wire, read_across_frames=True)
+        else:
+            # Reads every member of a multi-member file, as gunzip does
+            self._decoder = gzip.GzipFile(fileobj=wire, mode="rb")
+
+    def readable(self) -> bool:
+        return True
+
+    def readinto(self, buffer) -> int:
+        try:
+            data = self._decoder.read(len(buffer))
+        except _DECODE_ERRORS as e:
+            raise BodyDecodingError(f"Request body is not valid {self.encoding}: {e}")
+        self.decoded += len(data)
+        if self.decoded > self.limit:
+            raise BodyDecodingError(f"Request body decompresses to more than {self.limit // (1024 * 1024)} MB", 413)
+        buffer[:len(data)] = data
+        HTTP_COMPRESSION_BYTES.inc(len(data), direction="request", encoding=self.encoding, form="decoded")
+        return len(data)
+
+
+class CompressionMiddleware:
+    """WSGI middleware decompressing request bodies and compressing response bodies."""
+
+    def __init__(self, app: Callable, enabled: bool = COMPRESSION_ENABLED, min_bytes: int = COMPRESSION_MIN_BYTES):
+        """
+        Initialize the middleware.
+
+        Args:
+            app: WSGI application
+            enabled: Compress response bodies
+            min_bytes: Smallest response body compressed
+        """
+        self.app = app
+        self.enabled = enabled
+        self.min_bytes = min_bytes
+
+    def __call__(self, environ: Dict[str, Any], start_response: Callable) -> Iterable[bytes]:
+        encoding = environ.get("HTTP_CONTENT_ENCODING", "").strip().lower()
+        if encoding and encoding != "identity":
+            encoding = "gzip" if encoding == "x-gzip" else encoding
+            if encoding not in supported_encodings():
+                return self._unsupported(encoding, start_response)
+            self._decode_request(environ, encoding)
+        accepted = None
+        if self.enabled and environ.get("REQUEST_METHOD") != "HEAD":
+            accepted = choose_encoding(environ.get("HTTP_ACCEPT_ENCODING"))
+        if accepted is None:
+            return self.app(environ, start_response)
+
+        # The encoding start_response settled on; called again with exc_info, it decides afresh
+        chosen: List[Optional[str]] = []
+
+        def compressing_start_response(status: str, headers: List[Tuple[str, str]], exc_info=None):
+            chosen[:] = [accepted if self._compressible(status, headers) else None]
+            if chosen[0]:
+                headers = [(name, value) for name, value in headers if name.lower() != "content-length"]
+                headers.append(("Content-Encoding", accepted))
+                vary = [value for name, value in headers if name.lower() == "vary"]
+                if not any("accept-encoding" in value.lower() or value.strip() == "*" for value in vary):
+                    headers.append(("Vary", "Accept-Encoding"))
+            return start_response(status, headers, exc_info)
+
+        body = self.app(environ, compressing_start_response)
+        if chosen and chosen[0] is None:
+            # Sent as it is, keeping the server's file wrapper for downloads
+            return body
+        return self._encoded(body, chosen)
+
+    @staticmethod
+    def _decode_request(environ: Dict[str, Any], encoding: str) -> None:
+        """Replace a compressed request body by its decompressed stream, of a length known only at its end."""
+        length = environ.pop("CONTENT_LENGTH", None)
+        if length:
+            length = int(length)
+        elif environ.get("wsgi.input_terminated"):
+            length = None
+        else:
+            length = 0
+        stream = DecodingStream(environ["wsgi.input"], length, encoding)
+        environ["wsgi.input"] = io.BufferedReader(stream, READ_CHUNK_BYTES)
+        environ["wsgi.input_terminated"] = True
+        del environ["HTTP_CONTENT_ENCODING"]
+
+    def _compressible(self, status: str, headers: List[Tuple[str, str]]) -> bool:
+        code = int(status.split(" ", 1)[0])
+        if code < 200 or code in (204, 206, 304):
+            return False
+        values = {name.lower(): value for name, value in headers}
+        if "content-encoding" in values or "content-range" in values:
+            return False
+        if values.get("accept-ranges", "none").lower() != "none":
+            # A range of a compressed body would not be the range the client asked for
+            return False
+        content_type = values.get("content-type", "").split(";")[0].strip().lower()
+        if content_type in UNCOMPRESSED_TYPES:
+            return False
+        if not (content_type.startswith("text/") or content_type in COMPRESSIBLE_TYPES
+                or content_type.endswith(("+json", "+xml"))):
+            return False
+        length = values.get("content-length")
+        return length is None or int(length) >= self.min_bytes
+
+    @staticmethod
+    def _encoded(body: Iterable[bytes], chosen: List[Optional[str]]) -> Iterator[bytes]:
+        encoder = None
+        try:
+            for piece in body:
+                if encoder is None and chosen and chosen[0]:
+                    encoder = _Encoder(chosen[0])
+                if encoder is None:
+                    yield piece
+                    continue
+                if piece:
+                    encoded = encoder.piece(piece)
+                    HTTP_COMPRESSION_BYTES.inc(len(piece), direction="response", encoding=encoder.encoding,
+                                               form="decoded")
+                    HTTP_COMPRESSION_BYTES.inc(len(encoded), direction="response", encoding=encoder.encoding,
+                                               form="encoded")
+                    yield encoded
+            if encoder is None and chosen and chosen[0]:
+                # An empty body still needs its encoding's framing
+                encoder = _Encoder(chosen[0])
+            if encoder is not None:
+                encoded = encoder.finish()
+                HTTP_COMPRESSION_BYTES.inc(len(encoded), direction="response", encoding=encoder.encoding,
+                                           form="encoded")
+                yield encoded
+        finally:
+            # Ends the application's stream, so a record stream stops reading when its reader is gone
+            if hasattr(body, "close"):
+                body.close()
+
+    @staticmethod
+    def _unsupported(encoding: str, start_response: Callable) -> List[bytes]:
+        accepted = ", ".join(supported_encodings() + ["identity"])
+        body = json.dumps({"error": f"Unsupported Content-Encoding {encoding}; send one of: {accepted}"}).encode()
+        start_response("415 Unsupported Media Type", [("Content-Type", "application/json"),
+                                                      ("Content-Length", str(len(body))),
+                                                      ("Accept-Encoding", accepted)])
+        return [body]
@@ -0,0 +1,391 @@
+"""
+TerraFusion Platform - Job Batches
+
+This module provides batch job submission, for integrators that queue many
+jobs in one call, e.g. one GIS export per tax district:
+
+    POST /api/v1/batches
+    {"username": "dor_feed",
+     "defaults": {"type": "export", "county_id": "benton_wa", "export_format": "shapefile",
+                  "layers": ["parcels"]},
+     "jobs": [{"area_of_interest": {"type": "Polygon", "coordinates": [...]}},   # Kennewick district
+              {"area_of_interest": {"type": "Polygon", "coordinates": [...]}}]}  # Richland district
+
+Each entry of "jobs" (merged over "defaults") is the body the job's own
+endpoint takes, plus "type": "export" (POST /api/v1/gis-export/jobs) or
+"sync" (POST /api/v1/sync/jobs). Every job is created before the call
+returns; one that cannot be created is REJECTED with its error while the
+rest of the batch goes ahead. Export jobs then run on the batch service's
+own worker threads, and sync jobs go to the sync job queue (or run on those
+threads when no queue is running). A worker waits for a load shedding slot
+of its job's type before running it (see load_shedding), so batches never
+run more jobs at once than the API would; a sync job the queue refuses
+under load is cancelled with the reason in its item.
+
+A batch's status is worked out from its jobs each time it is read: RUNNING
+while any job has not finished; then COMPLETED when every job completed,
+FAILED when none did (CANCELLED if the batch was cancelled), and
+PARTIALLY_FAILED otherwise, with each failed or rejected job's error in its
+item. The failed and cancelled jobs of a finished batch can be retried.
+Export jobs are written with the submitter's redaction policies (see
+redaction), kept on their items for retries.
+"""
+
+import os
+import uuid
+import logging
+import threading
+from concurrent.futures import ThreadPoolExecutor
+from datetime import datetime
+from typing import Callable, Dict, List, Any, Optional
+
+from sync_store import DocumentStore, sync_state_store
+from event_bus import EventBusError
+from load_shedding import LoadShedder, OverloadedError, load_shedder
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection for batches
+BATCHES_COLLECTION = "job_batches"
+
+JOB_TYPES = ["export", "sync"]
+
+# Most jobs one batch may hold
+MAX_BATCH_JOBS = int(os.environ.get("BATCH_MAX_JOBS", "500"))
+
+# Jobs of all batches run at once on this process's batch workers
+BATCH_WORKERS = int(os.environ.get("BATCH_WORKERS", "2"))
+
+# Statuses of a job that has finished, whether or not it succeeded
+FINISHED_STATUSES = ["COMPLETED", "FAILED", "CANCELLED"]
+
+# Item status of a job that could not be created
+STATUS_REJECTED = "REJECTED"
+
+BATCH_STATUSES = ["RUNNING", "COMPLETED", "PARTIALLY_FAILED", "FAILED", "CANCELLED"]
+
+# Fields each job type takes, besides "type"
+JOB_FIELDS = {
+    "export": {"county_id", "username", "export_format", "area_of_interest", "layers", "parameters"},
+    "sync": {"sync_pair_id", "username", "mode", "tables", "parameters", "dry_run", "priority", "express"},
+}
+
+REQUIRED_FIELDS = {
+    "export": ["county_id", "username", "export_format", "area_of_interest", "layers"],
+    "sync": ["sync_pair_id", "username"],
+}
+
+
+class JobBatchService:
+    """Creates batches of export and sync jobs and reports their combined status."""
+
+    def __init__(self, export_service, sync_engine, job_queue, store: Optional[DocumentStore] = None,
+                 workers: int = BATCH_WORKERS, shedder: Optional[LoadShedder] = None):
+        """
+        Initialize the service.
+
+        Args:
+            export_service: GIS export service export jobs are created with
+            sync_engine: Sync engine sync jobs are created with
+            job_queue: Sync job queue sync jobs are handed to
+            store: Document store for batch records
+            workers: Threads running the batches' jobs
+            shedder: Load shedder whose slots the jobs run in; defaults to the load_shedder singleton
+        """
+        self.export_service = export_service
+        self.sync_engine = sync_engine
+        self.job_queue = job_queue
+        self.store = store or sync_state_store
+        self.workers = workers
+        self.shedder = shedder or load_shedder
+        self._executor: Optional[ThreadPoolExecutor] = None
+        self._lock = threading.Lock()
+
+    def submit(self, jobs: List[Dict[str, Any]], username: Optional[str] = None,
+               defaults: Optional[Dict[str, Any]] = None, name: Optional[str] = None,
+               redaction: Optional[Callable[[str], List[str]]] = None) -> Dict[str, Any]:
+        """
+        Create the jobs of a batch and start them.
+
+        Args:
+            jobs: Job specs, each merged over defaults
+            username: Submitting user, and the jobs' username unless they give one
+            defaults: Fields shared by every job
+            name: Free-text label of the batch
+            redaction: The submitter's redaction policies in a county, for export jobs
+
+        Returns:
+            The batch record, with an item per job
+
+        Raises:
+            ValueError: If jobs is empty, too long or not a list of objects
+        """
+        if not isinstance(jobs, list) or not jobs:
+            raise ValueError("jobs must be a non-empty list of job specs")
+        if len(jobs) > MAX_BATCH_JOBS:
+            raise ValueError(f"A batch holds at most {MAX_BATCH_JOBS} jobs; got {len(jobs)}")
+        if defaults is not None and not isinstance(defaults, dict):
+            raise ValueError("defaults must be an object")
+        if any(not isinstance(spec, dict) for spec in jobs):
+            raise ValueError("Each job spec must be an object")
+
+        batch_id = str(uuid.uuid4())
+        items = []
+        for index, job_spec in enumerate(jobs):
+            spec = self._merge(job_spec, defaults or {})
+            if username and "username" not in spec:
+                spec["username"] = username
+            item = {"index": index, "type": spec.get("type"), "job_id": None, "status": None, "error": None}
+            try:
+                item["type"] = self._job_type(spec)
+                if item["type"] == "export" and redaction is not None:
+                    item["redaction"] = redaction(spec["county_id"])
+                item["job_id"] = self._create(item["type"], spec, item.get("redaction"))
+                item["status"] = "PENDING"
+            except (KeyError, ValueError) as e:
+                item["status"] = STATUS_REJECTED
+                item["error"] = e.args[0] if isinstance(e, KeyError) and e.args else str(e)
+            item["spec"] = spec
+            items.append(item)
+
+        batch = {
+            "batch_id": batch_id,
+            "name": name,
+            "username": username,
+            "status": "RUNNING",
+            "created_at": datetime.utcnow().isoformat(),
+            "completed_at": None,
+            "items": items,
+        }
+        self._summarize(batch)
+        self.store.save(BATCHES_COLLECTION, batch_id, batch)
+        accepted = [item for item in items if item["job_id"]]
+        logger.info(f"Created batch {batch_id} with {len(accepted)} of {len(items)} jobs")
+        for item in accepted:
+            self._start(batch_id, item)
+        return self.get(batch_id)
+
+    def get(self, batch_id: str) -> Dict[str, Any]:
+        """
+        A batch with the current status of its jobs.
+
+        Raises:
+            FileNotFoundError: If the batch does not exist
+        """
+        batch = self.store.load(BATCHES_COLLECTION, batch_id)
+        if batch["status"] == "RUNNING":
+            with self._lock:
+                batch = self.store.load(BATCHES_COLLECTION, batch_id)
+                for item in batch["items"]:
+                    self._refresh(item)
+                self._summarize(batch)
+                self.store.save(BATCHES_COLLECTION, batch_id, batch)
+        return batch
+
+    def list(self, username: Optional[str] = None, status: Optional[str] = None,
+             limit: int = 100) -> List[Dict[str, Any]]:
+        """Batches without their items, newest first."""
+        batches = []
+        for batch in self.store.list(BATCHES_COLLECTION):
+            if username and batch.get("username") != username:
+                continue
+            if batch.get("status") == "RUNNING":
+                batch = self.get(batch["batch_id"])
+            if status and batch.get("status") != status:
+                continue
+            batches.append({k: v for k, v in batch.items() if k != "items"})
+        batches.sort(key=lambda b: b.get("created_at", ""), reverse=True)
+        return batches[:limit]
+
+    def cancel(self, batch_id: str, requested_by: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Cancel every job of a batch that has not finished.
+
+        Raises:
+            FileNotFoundError: If the batch does not exist
+        """
+        batch = self.get(batch_id)
+        for item in batch["items"]:
+            if not item["job_id"] or item["status"] in FINISHED_STATUSES:
+                continue
+            try:
+                if item["type"] == "export":
+                    self.export_service.cancel_job(item["job_id"])
+                else:
+                    self.sync_engine.cancel_job(item["job_id"], requested_by)
+            except (FileNotFoundError, ValueError) as e:
+                # Finished in the meantime
+                logger.info(f"Job {item['job_id']} of batch {batch_id} was not cancelled: {e}")
+        with self._lock:
+            batch = self.store.load(BATCHES_COLLECTION, batch_id)
+            batch["cancelled_by"] = requested_by
+            batch["cancelled_at"] = datetime.utcnow().isoformat()
+            self.store.save(BATCHES_COLLECTION, batch_id, batch)
+        logger.info(f"Cancelled batch {batch_id}")
+        return self.get(batch_id)
+
+    def retry(self, batch_id: str) -> Dict[str, Any]:
+        """
+        Create new jobs for the batch's failed and cancelled jobs and start them.
+
+        Rejected jobs are not retried; their specs are invalid.
+
+        Raises:
+            FileNotFoundError: If the batch does not exist
+            ValueError: If the batch is still running or has nothing to retry
+        """
+        batch = self.get(batch_id)
+        if batch["status"] == "RUNNING":
+            raise ValueError(f"Batch {batch_id} is still running")
+        retried = []
+        with self._lock:
+            batch = self.store.load(BATCHES_COLLECTION, batch_id)
+            for item in batch["items"]:
+                if item["status"] not in ("FAILED", "CANCELLED"):
+                    continue
+                item.setdefault("previous_job_ids", []).append(item["job_id"])
+                try:
+                    item["job_id"] = self._create(item["type"], item["spec"], item.get("redaction"))
+                    item["status"], item["error"] = "PENDING", None
+                    retried.append(item)
+                except (KeyError, ValueError) as e:
+                    item["error"] = e.args[0] if isinstance(e, KeyError) and e.args else str(e)
+            if not retried:
+                raise ValueError(f"Batch {batch_id} has no failed or cancelled jobs to retry")
+            batch["status"], batch["completed_at"] = "RUNNING", None
+            batch.pop("cancelled_at", None)
+            batch.pop("cancelled_by", None)
+            self._summarize(batch)
+            self.store.save(BATCHES_COLLECTION, batch_id, batch)
+        logger.info(f"Retrying {len(retried)} jobs of batch {batch_id}")
+        for item in retried:
+            self._start(batch_id, item)
+        return self.get(batch_id)
+
+    def shutdown(self) -> None:
+        """Stop the batch workers once the jobs already started have finished."""
+        if self._executor is not None:
+            self._executor.shutdown(wait=True)
+            self._executor = None
+
+    @staticmethod
+    def _merge(job_spec: Dict[str, Any], defaults: Dict[str, Any]) -> Dict[str, Any]:
+        """A job spec over the defaults its job type takes, so one batch can mix exports and syncs."""
+        job_type = (job_spec.get("type") or JobBatchService._inferred_type(job_spec)
+                    or defaults.get("type") or JobBatchService._inferred_type(defaults))
+        spec = {k: v for k, v in defaults.items() if k in JOB_FIELDS.get(job_type, ())}
+        spec.update(job_spec)
+        if job_type:
+            spec["type"] = job_type
+        return spec
+
+    @staticmethod
+    def _inferred_type(spec: Dict[str, Any]) -> Optional[str]:
+        return "export" if "export_format" in spec else "sync" if "sync_pair_id" in spec else None
+
+    @staticmethod
+    def _job_type(spec: Dict[str, Any]) -> str:
+        job_type = spec.get("type") or JobBatchService._inferred_type(spec)
+        if job_type not in JOB_TYPES:
+            raise ValueError(f"Job type must be one of: {', '.join(JOB_TYPES)}")
+        unknown = sorted(set(spec) - JOB_FIELDS[job_type] - {"type"})
+        if unknown:
+            raise ValueError(f"Unknown {job_type} job field {unknown[0]}")
+        for field in REQUIRED_FIELDS[job_type]:
+            if field not in spec:
+                raise ValueError(f"Missing required field: {field}")
+        return job_type
+
+    def _create(self, job_type: str, spec: Dict[str, Any], redaction: Optional[List[str]] = None) -> str:
+        if job_type == "export":
+            job = self.export_service.create_export_job(
+                county_id=spec["county_id"],
+                username=spec["username"],
+                export_format=spec["export_format"],
+                area_of_interest=spec["area_of_interest"],
+                layers=spec["layers"],
+                parameters=spec.get("parameters"),
+                redaction=redaction
+            )
+        else:
+            job = self.sync_engine.create_sync_job(
+                sync_pair_id=spec["sync_pair_id"],
+                username=spec["username"],
+                mode=spec.get("mode"),
+                tables=spec.get("tables"),
+                parameters=spec.get("parameters"),
+                dry_run=bool(spec.get("dry_run", False)),
+                priority=spec.get("priority", "normal")
+            )
+        return job["job_id"]
+
+    def _start(self, batch_id: str, item: Dict[str, Any]) -> None:
+        """Queue a sync job, or hand a job to the batch workers."""
+        if item["type"] == "sync":
+            express = bool(item["spec"].get("express", False))
+            try:
+                if self.job_queue.is_running():
+                    self.job_queue.submit(item["job_id"], express=express)
+                    return
+                if self.job_queue.can_dispatch():
+                    self.job_queue.dispatch(item["job_id"], express=express)
+                    return
+            except EventBusError as e:
+                # The job stays queued in the state store and starts when a queue next recovers it
+                logger.error(f"Error dispatching sync job {item['job_id']} of batch {batch_id}: {e}")
+                return
+            except OverloadedError as e:
+                # Cancelled by the queue; the item reports it
+                logger.warning(f"Sync job {item['job_id']} of batch {batch_id} refused: {e}")
+                return
+        with self._lock:
+            if self._executor is None:
+                self._executor = ThreadPoolExecutor(max_workers=self.workers, thread_name_prefix="job-batch")
+        self._executor.submit(self._run, batch_id, item["type"], item["job_id"], item["spec"].get("priority", "normal"))
+
+    def _run(self, batch_id: str, job_type: str, job_id: str, priority: str = "normal") -> None:
+        service = self.export_service if job_type == "export" else self.sync_engine
+        try:
+            with self.shedder.slot(job_type, priority, wait_seconds=None):
+                service.process_job(job_id)
+        except ValueError as e:
+            # Cancelled before it started
+            logger.info(f"Skipped {job_type} job {job_id} of batch {batch_id}: {e}")
+        except Exception as e:
+            logger.error(f"Error running {job_type} job {job_id} of batch {batch_id}: {e}", exc_info=True)
+
+    def _refresh(self, item: Dict[str, Any]) -> None:
+        if not item["job_id"] or item["status"] in FINISHED_STATUSES + [STATUS_REJECTED]:
+            return
+        service = self.export_service if item["type"] == "export" else self.sync_engine
+        try:
+            job = service.get_job_status(item["job_id"])
+        except FileNotFoundError:
+            item["status"], item["error"] = "FAILED", f"Job {item['job_id']} no longer exists"
+            return
+        item["status"] = job["status"]
+        if job["status"] in ("FAILED", "CANCELLED"):
+            item["error"] = job.get("message")
+        if job.get("download_url"):
+            item["download_url"] = job["download_url"]
+
+    @staticmethod
+    def _summarize(batch: Dict[str, Any]) -> None:
+        """Count the items by status and work out the batch's status."""
+        counts: Dict[str, int] = {}
+        for item in batch["items"]:
+            counts[item["status"]] = counts.get(item["status"], 0) + 1
+        batch["counts"] = dict(counts, total=len(batch["items"]))
+        finished = sum(n for status, n in counts.items() if status in FINISHED_STATUSES + [STATUS_REJECTED])
+        if finished < len(batch["items"]):
+            return
+        completed = counts.get("COMPLETED", 0)
+        if completed == len(batch["items"]):
+            batch["status"] = "COMPLETED"
+        elif completed == 0:
+            batch["status"] = "CANCELLED" if batch.get("cancelled_at") and counts.get("CANCELLED") else "FAILED"
+        else:
+            batch["status"] = "PARTIALLY_FAILED"
+        batch["completed_at"] = batch.get("completed_at") or datetime.utcnow().isoformat()
@@ -0,0 +1,343 @@
+"""
+TerraFusion Platform - Job History Retention
+
+This module keeps the sync and export job history from growing without
+bound. Finished jobs past their county's retention are written to a
+compressed archive, with the log lines that name them, and then deleted from
+the job store; the most recent jobs of each sync pair (and each county's
+exports) are always kept, however old. Counties set their policy in the
+"job_retention" block of their configuration:
+
+    "job_retention": {
+        "keep_days": 90,
+        "failed_keep_days": 365,
+        "keep_last": 20,
+        "archive": {"type": "s3", "bucket": "benton-terrafusion-archive", "prefix": "job-archive"}
+    }
+
+Without a block, JOB_RETENTION_DAYS, JOB_RETENTION_FAILED_DAYS and
+JOB_RETENTION_KEEP_LAST apply. Archives are gzip-compressed JSON Lines files,
+one per county and job kind per run, each line holding one job record and
+its log lines ({"kind", "job", "logs"}); lines are encrypted like the job
+store when a master key is configured (see encryption). They are kept under
+JOB_ARCHIVE_PATH, or uploaded to an object store configured like an export
+artifact store (see export_storage) and removed locally unless keep_local is
+set. "archive": false deletes expired jobs without archiving them.
+
+A run ends by compacting the job store, so a SQLite store gives the space of
+the deleted jobs back to the disk. Runs happen every
+JOB_RETENTION_INTERVAL_HOURS on the instance with JOB_RETENTION_ENABLED, and
+on demand with `terrafusion compact` (add --dry-run to see what would go).
+"""
+
+import os
+import re
+import gzip
+import json
+import logging
+import threading
+from datetime import datetime, timedelta
+from typing import Dict, List, Any, Optional, Iterator, Set
+
+from encryption import dumps_document, loads_document
+from county_overrides import load_county_config, county_config_path
+from export_storage import create_artifact_store, LocalArtifactStore
+from gis_export import FINISHED_STATUSES
+from logging_config import LOG_DIR
+from sync_control import TERMINAL_STATUSES
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Days finished jobs are kept by counties without a job_retention block
+RETENTION_DAYS = float(os.environ.get("JOB_RETENTION_DAYS", "90"))
+
+# Days failed jobs are kept; they are looked back at longer than successful ones
+FAILED_RETENTION_DAYS = float(os.environ.get("JOB_RETENTION_FAILED_DAYS", str(RETENTION_DAYS)))
+
+# Most recent jobs of each sync pair (and of each county's exports) kept whatever their age
+KEEP_LAST = int(os.environ.get("JOB_RETENTION_KEEP_LAST", "20"))
+
+# Directory archives are written to
+ARCHIVE_PATH = os.environ.get("JOB_ARCHIVE_PATH", "job_archive")
+
+# Hours between scheduled runs
+INTERVAL_HOURS = float(os.environ.get("JOB_RETENTION_INTERVAL_HOURS", "24"))
+
+# Object key prefix of archives uploaded to an object store
+DEFAULT_ARCHIVE_PREFIX = "job-archive"
+
+JOB_KINDS = ["sync", "export"]
+
+# Job IDs are UUIDs; log lines are matched to jobs by the UUIDs they contain
+_UUID_PATTERN = re.compile(r"[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}")
+
+
+def _number(policy: Dict[str, Any], key: str, default: float, label: str) -> float:
+    value = policy.get(key, default)
+    if not isinstance(value, (int, float)) or isinstance(value, bool) or value < 0:
+        raise ValueError(f"{label}.{key} must be a number of at least 0")
+    return value
+
+
+def read_archive(path: str, cipher=None) -> Iterator[Dict[str, Any]]:
+    """
+    The entries of an archive file: {"kind", "job", "logs"} each.
+
+    Raises:
+        EncryptionError: If the archive is encrypted and cipher cannot decrypt it
+    """
+    context = f"job_archive/{os.path.basename(path)}"
+    with gzip.open(path, "rt", encoding="utf-8") as f:
+        for line in f:
+            if line.strip():
+                yield loads_document(line, cipher, context)
+
+
+def format_report(report: Dict[str, Any]) -> str:
+    """The report as the lines `terrafusion compact` prints."""
+    verb = "would delete" if report["dry_run"] else "deleted"
+    lines = []
+    for county_id, result in report["counties"].items():
+        for kind in JOB_KINDS:
+            counts = result[kind]
+            deleted = counts["expired"] if report["dry_run"] else counts["deleted"]
+            line = f"{county_id} {kind}: {verb} {deleted} of {counts['jobs']} jobs"
+            if counts["archive"]:
+                line += f", archived to {counts['archive']['key']}"
+            lines.append(line)
+    lines += [f"ERROR {error}" for error in report["errors"]]
+    compaction = report.get("compaction")
+    if compaction and compaction.get("compacted"):
+        lines.append(f"Compacted the {compaction['backend']} job store from {compaction['size_before']:,} "
+                     f"to {compaction['size_after']:,} bytes")
+    return "\n".join(lines) if lines else "No job history to compact"
+
+
+class JobRetention:
+    """
+    Service class that archives and deletes job history past its retention.
+    """
+
+    def __init__(self, engine, exports, config_dir: str = "county_configs", archive_path: str = ARCHIVE_PATH,
+                 log_dir: str = LOG_DIR):
+        """
+        Initialize the service.
+
+        Args:
+            engine: Sync engine whose jobs are kept
+            exports: GIS export service whose jobs are kept
+            config_dir: Directory containing county configuration folders
+            archive_path: Directory archives are written to
+            log_dir: Directory of the log files job log lines are gathered from
+        """
+        self.engine = engine
+        self.exports = exports
+        self.config_dir = config_dir
+        self.archive_path = archive_path
+        self.log_dir = log_dir
+        self._run_lock = threading.Lock()
+        self._stop_event = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+        self.last_run: Optional[Dict[str, Any]] = None
+
+    def policy(self, county_id: str) -> Dict[str, Any]:
+        """
+        The retention policy of a county.
+
+        Raises:
+            ValueError: If its job_retention block is invalid
+        """
+        label = f"County {county_id} job_retention"
+        path = county_config_path(self.config_dir, county_id)
+        block: Dict[str, Any] = {}
+        if path is not None:
+            block = load_county_config(path).get("job_retention") or {}
+        if not isinstance(block, dict):
+            raise ValueError(f"{label} must be an object")
+        keep_days = _number(block, "keep_days", RETENTION_DAYS, label)
+        archive = block.get("archive", {})
+        if archive is not False and not isinstance(archive, dict):
+            raise ValueError(f"{label}.archive must be an artifact storage block or false")
+        return {
+            "keep_days": keep_days,
+            # Failed jobs are kept at least as long as the others
+            "failed_keep_days": _number(block, "failed_keep_days", max(keep_days, FAILED_RETENTION_DAYS), label),
+            "keep_last": int(_number(block, "keep_last", KEEP_LAST, label)),
+            "archive": archive,
+        }
+
+    def expired(self, jobs: List[Dict[str, Any]], policy: Dict[str, Any], finished: List[str],
+                group_field: Optional[str], now: datetime) -> List[Dict[str, Any]]:
+        """The finished jobs past a policy's retention, besides the keep_last newest of each group."""
+        groups: Dict[Any, List[Dict[str, Any]]] = {}
+        for job in jobs:
+            groups.setdefault(job.get(group_field) if group_field else None, []).append(job)
+        expired = []
+        for group in groups.values():
+            group.sort(key=lambda j: j.get("created_at") or "", reverse=True)
+            for job in group[policy["keep_last"]:]:
+                if job.get("status") not in finished:
+                    continue
+                days = policy["failed_keep_days"] if job["status"] == "FAILED" else policy["keep_days"]
+                ended = job.get("completed_at") or job.get("created_at")
+                if ended and datetime.fromisoformat(ended) < now - timedelta(days=days):
+                    expired.append(job)
+        return expired
+
+    def job_logs(self, job_ids: Set[str]) -> Dict[str, List[Any]]:
+        """The log lines naming each job in the log files (JSON objects, or text lines of LOG_FORMAT=text)."""
+        logs: Dict[str, List[Any]] = {job_id: [] for job_id in job_ids}
+        if not job_ids or not os.path.isdir(self.log_dir):
+            return logs
+        for name in sorted(os.listdir(self.log_dir)):
+            if ".log" not in name:
+                continue
+            with open(os.path.join(self.log_dir, name), "r", encoding="utf-8", errors="replace") as f:
+                for line in f:
+                    named = [job_id for job_id in set(_UUID_PATTERN.findall(line)) if job_id in job_ids]
+                    if not named:
+                        continue
+                    try:
+                        entry = json.loads(line)
+                    except ValueError:
+                        entry = line.rstrip("\n")
+                    for job_id in named:
+                        logs[job_id].append(entry)
+        return logs
+
+    def run(self, county_id: Optional[str] = None, dry_run: bool = False,
+            now: Optional[datetime] = None) -> Dict[str, Any]:
+        """
+        Archive and delete the jobs past their retention, then compact the job store.
+
+        Args:
+            county_id: Only this county's jobs (all counties by default)
+            dry_run: Report what would be archived without changing anything
+            now: Time retention is measured from (now by default)
+
+        Returns:
+            Report of the run, with counts and the archive of each county and job kind
+        """
+        with self._run_lock:
+            report = self._run(county_id, dry_run, now or datetime.utcnow())
+        if not dry_run:
+            self.last_run = report
+        return report
+
+    def _run(self, county_id: Optional[str], dry_run: bool, now: datetime) -> Dict[str, Any]:
+        started = datetime.utcnow()
+        jobs = {
+            "sync": self.engine.list_jobs(county_id=county_id, limit=None),
+            "export": self.exports.list_jobs(county_id=county_id, limit=None),
+        }
+        counties = sorted({job["county_id"] for kind in JOB_KINDS for job in jobs[kind] if job.get("county_id")})
+        plans: Dict[str, Dict[str, Any]] = {}
+        report = {"dry_run": dry_run, "started_at": started.isoformat(), "counties": {}, "errors": []}
+        for county in counties:
+            try:
+                policy = self.policy(county)
+            except ValueError as e:
+                report["errors"].append(str(e))
+                continue
+            county_jobs = {kind: [job for job in kind_jobs if job.get("county_id") == county]
+                           for kind, kind_jobs in jobs.items()}
+            plans[county] = {
+                "policy": policy,
+                "sync": self.expired(county_jobs["sync"], policy, TERMINAL_STATUSES, "sync_pair_id", now),
+                "export": self.expired(county_jobs["export"], policy, FINISHED_STATUSES, None, now),
+            }
+            report["counties"][county] = {
+                "policy": {name: value for name, value in policy.items() if name != "archive"},
+                **{kind: {"jobs": len(county_jobs[kind]), "expired": len(plans[county][kind]), "deleted": 0,
+                          "archive": None} for kind in JOB_KINDS},
+            }
+
+        expired_ids = {job["job_id"] for plan in plans.values() for kind in JOB_KINDS for job in plan[kind]}
+        logs = {} if dry_run else self.job_logs(expired_ids)
+        for county, plan in plans.items():
+            policy = plan["policy"]
+            for kind in JOB_KINDS:
+                if dry_run or not plan[kind]:
+                    continue
+                result = report["counties"][county][kind]
+                try:
+                    if policy["archive"] is not False:
+                        result["archive"] = self._archive(county, kind, plan[kind], logs, policy["archive"], now)
+                except Exception as e:
+                    # Nothing is deleted that did not reach its archive
+                    report["errors"].append(f"Cannot archive {kind} jobs of county {county}: {e}")
+                    logger.error(f"Cannot archive {kind} jobs of county {county}: {e}", exc_info=True)
+                    continue
+                service = self.engine if kind == "sync" else self.exports
+                for job in plan[kind]:
+                    try:
+                        service.delete_job(job["job_id"])
+                        result["deleted"] += 1
+                    except (FileNotFoundError, ValueError) as e:
+                        report["errors"].append(str(e))
+
+        report["compaction"] = None if dry_run else self.engine.store.compact()
+        report["deleted"] = sum(result[kind]["deleted"] for result in report["counties"].values() for kind in JOB_KINDS)
+        report["expired"] = sum(result[kind]["expired"] for result in report["counties"].values() for kind in JOB_KINDS)
+        report["completed_at"] = datetime.utcnow().isoformat()
+        if not dry_run:
+            logger.info(f"Job retention deleted {report['deleted']} of {report['expired']} expired jobs"
+                        + (f" with {len(report['errors'])} errors" if report["errors"] else ""))
+        return report
+
+    def _archive(self, county_id: str, kind: str, jobs: List[Dict[str, Any]], logs: Dict[str, List[Any]],
+                 config: Dict[str, Any], now: datetime) -> Dict[str, Any]:
+        """Write an archive of jobs and put it in its store; returns the artifact record."""
+        filename = f"{kind}-jobs-{now.strftime('%Y%m%dT%H%M%S')}.jsonl.gz"
+        directory = os.path.join(self.archive_path, county_id)
+        os.makedirs(directory, exist_ok=True)
+        path = os.path.join(directory, filename)
+        cipher = self.engine.store.cipher
+        with gzip.open(path, "wt", encoding="utf-8") as f:
+            for job in sorted(jobs, key=lambda j: j.get("created_at") or ""):
+                entry = {"kind": kind, "job": job, "logs": logs.get(job["job_id"], [])}
+                f.write(dumps_document(entry, cipher, f"job_archive/{filename}") + "\n")
+
+        store = create_artifact_store(config)
+        if isinstance(store, LocalArtifactStore):
+            record = store.put(path, path, "application/gzip")
+        else:
+            key = "/".join([config.get("prefix", DEFAULT_ARCHIVE_PREFIX).strip("/"), county_id,
+                            f"{now.year:04d}", filename]).lstrip("/")
+            record = store.put(path, key, "application/gzip", {"county_id": county_id, "job_kind": kind})
+            if not store.keep_local:
+                os.remove(path)
+        return dict(record, jobs=len(jobs))
+
+    # Worker -----------------------------------------------------------------
+
+    def start(self) -> None:
+        """Run retention every INTERVAL_HOURS on a background thread."""
+        if self._thread is not None and self._thread.is_alive():
+            return
+        self._stop_event.clear()
+        self._thread = threading.Thread(target=self._loop, name="job-retention", daemon=True)
+        self._thread.start()
+        logger.info(f"Job retention started (every {INTERVAL_HOURS:g}h)")
+
+    def stop(self) -> None:
+        """Stop the scheduled runs."""
+        self._stop_event.set()
+        if self._thread is not None:
+            self._thread.join(timeout=5)
+            self._thread = None
+        logger.info("Job retention stopped")
+
+    def status(self) -> Dict[str, Any]:
+        """Whether the worker runs, and the report of the last run."""
+        return {"running": self._thread is not None and self._thread.is_alive(), "last_run": self.last_run}
+
+    def _loop(self) -> None:
+        while not self._stop_event.is_set():
+            try:
+                self.run()
+            except Exception as e:
+                logger.error(f"Error running job retention: {e}", exc_info=True)
+            self._stop_event.wait(INTERVAL_HOURS * 3600)
@@ -0,0 +1,337 @@
+"""
+TerraFusion Platform - LDAP / Active Directory Authentication
+
+This module provides the directory authenticator used by the RBAC manager when
+AUTH_BACKEND is "ldap". Users sign in with their county AD (or any LDAP
+directory) credentials; their group memberships, nested groups included, are
+mapped to a TerraFusion role.
+"""
+
+import os
+import re
+import ssl
+import json
+import queue
+import logging
+import threading
+from contextlib import contextmanager
+from typing import Any, Dict, List, Optional
+
+logger = logging.getLogger(__name__)
+
+try:
+    from ldap3 import Server, ServerPool, Connection, Tls, SUBTREE, FIRST, AUTO_BIND_NO_TLS, AUTO_BIND_TLS_BEFORE_BIND
+    from ldap3.core.exceptions import LDAPException, LDAPBindError, LDAPCommunicationError, LDAPServerPoolExhaustedError
+    from ldap3.utils.conv import escape_filter_chars
+    LDAP3_AVAILABLE = True
+except ImportError:
+    # Directory logins require ldap3
+    LDAP3_AVAILABLE = False
+
+# Default user search; {username} is the escaped sAMAccountName
+DEFAULT_USER_FILTER = "(&(objectClass=user)(sAMAccountName={username}))"
+
+# Nested group strategies: AD's LDAP_MATCHING_RULE_IN_CHAIN, a walk up member links, or direct groups only
+NESTED_GROUP_MODES = ("in_chain", "recursive", "none")
+
+# Matching rule OID that makes AD resolve group nesting server-side
+MATCHING_RULE_IN_CHAIN = "1.2.840.113556.1.4.1941"
+
+# Deepest group nesting followed by the recursive strategy
+MAX_GROUP_DEPTH = 10
+
+# Pooled service-account connections used for user and group searches
+DEFAULT_POOL_SIZE = 4
+
+# Attributes read from the user entry
+USER_ATTRIBUTES = ["mail", "userPrincipalName", "displayName", "memberOf"]
+
+
+class LDAPAuthError(Exception):
+    """The directory rejected the credentials, or the user holds no mapped role."""
+
+
+class LDAPUnavailableError(Exception):
+    """No directory server could be reached."""
+
+
+def _normalize_dn(dn: str) -> str:
+    """A DN in a form comparable across directories (case and spacing differ)."""
+    return re.sub(r"\s*([,=])\s*", r"\1", dn.strip()).lower()
+
+
+def _first_rdn_value(dn: str) -> str:
+    """The value of a DN's first RDN, e.g. the group name of CN=TF-Admins,OU=Groups,..."""
+    first = _normalize_dn(dn).split(",", 1)[0]
+    return first.split("=", 1)[-1]
+
+
+def account_name(username: str) -> str:
+    """
+    The account name in a login, which may be given as DOMAIN\\user,
+    user@domain or bare.
+    """
+    username = username.strip()
+    if "\\" in username:
+        username = username.split("\\", 1)[1]
+    if "@" in username:
+        username = username.split("@", 1)[0]
+    return username
+
+
+class LDAPAuthenticator:
+    """
+    Authenticates users against LDAP or Active Directory.
+
+    A service account (LDAP_BIND_DN / LDAP_BIND_PASSWORD) finds the user's
+    entry and resolves groups over a small pool of bound connections; the
+    password is then checked with a bind as the user on a connection of its
+    own. Several servers may be listed in LDAP_URL (comma separated); they
+    are tried in order and a server that fails is skipped for a minute.
+
+    LDAP_GROUP_ROLE_MAP is a JSON object from group (full DN, or bare CN) to
+    RBAC role. Entries are checked in order and the first group the user
+    belongs to, directly or through nesting, decides the role; users in no
+    mapped group cannot sign in.
+    """
+
+    def __init__(self, settings: Optional[Dict[str, Any]] = None):
+        """
+        Initialize the authenticator.
+
+        Args:
+            settings: Overrides for the LDAP_* environment settings, keyed by
+                their lower-case names without the prefix (e.g. "url")
+        """
+        settings = settings or {}
+
+        def setting(name: str, default: Any = None) -> Any:
+            value = settings.get(name)
+            return value if value is not None else os.environ.get(f"LDAP_{name.upper()}", default)
+
+        self.urls = [u.strip() for u in str(setting("url", "")).split(",") if u.strip()]
+        self.bind_dn = setting("bind_dn")
+        self.bind_password = setting("bind_password")
+        self.user_base_dn = setting("user_base_dn")
+        self.group_base_dn = setting("group_base_dn") or self.user_base_dn
+        self.user_filter = setting("user_filter", DEFAULT_USER_FILTER)
+        self.nested_groups = str(setting("nested_groups", "in_chain")).lower()
+        self.start_tls = str(setting("start_tls", "false")).lower() in ("1", "true", "yes")
+        self.ca_cert_file = setting("ca_cert_file")
+        self.timeout = int(setting("timeout_seconds", 10))
+        self.pool_size = int(setting("pool_size", DEFAULT_POOL_SIZE))
+        role_map = setting("group_role_map", "{}")
+        self.group_roles: Dict[str, str] = json.loads(role_map) if isinstance(role_map, str) else dict(role_map)
+
+        if self.nested_groups not in NESTED_GROUP_MODES:
+            raise ValueError(f"LDAP_NESTED_GROUPS must be one of {', '.join(NESTED_GROUP_MODES)}")
+        self._server = None
+        self._pool: "queue.LifoQueue" = queue.LifoQueue()
+        self._opened = 0
+        self._lock = threading.Lock()
+
+    @property
+    def configured(self) -> bool:
+        return bool(self.urls and self.user_base_dn)
+
+    def authenticate(self, username: str, password: str) -> Dict[str, Any]:
+        """
+        Check a user's directory credentials and work out their role.
+
+        Args:
+            username: Login name (DOMAIN\\user, user@domain or user)
+            password: The user's directory password
+
+        Returns:
+            Dictionary with username, email, display_name, dn, groups and role
+
+        Raises:
+            LDAPAuthError: If the credentials are wrong or no mapped group applies
+            LDAPUnavailableError: If no directory server answers
+        """
+        name = account_name(username)
+        # A simple bind with an empty password is an anonymous bind, which most directories accept
+        if not name or not password:
+            raise LDAPAuthError("Invalid credentials")
+
+        with self._connection() as conn:
+            entry = self._find_user(conn, name)
+            if entry is None:
+                raise LDAPAuthError("Invalid credentials")
+            self._check_password(entry["dn"], password)
+            groups = self._groups(conn, entry)
+
+        role = self.role_for(groups)
+        if role is None:
+            logger.warning(f"Directory user {name} authenticated but belongs to no group mapped to a role")
+            raise LDAPAuthError("User is not a member of any group granted access")
+        attributes = entry["attributes"]
+        return {
+            "username": name.lower(),
+            "email": _single(attributes.get("mail")) or _single(attributes.get("userPrincipalName")),
+            "display_name": _single(attributes.get("displayName")),
+            "dn": entry["dn"],
+            "groups": groups,
+            "role": role,
+        }
+
+    def role_for(self, groups: List[str]) -> Optional[str]:
+        """The role of the first LDAP_GROUP_ROLE_MAP entry matching one of the groups."""
+        dns = {_normalize_dn(g) for g in groups}
+        names = {_first_rdn_value(g) for g in groups}
+        for group, role in self.group_roles.items():
+            if "=" in group:
+                if _normalize_dn(group) in dns:
+                    return role
+            elif group.strip().lower() in names:
+                return role
+        return None
+
+    def health_check(self) -> Dict[str, Any]:
+        """Check that the service account can bind."""
+        if not LDAP3_AVAILABLE:
+            return {"status": "unavailable", "error": "ldap3 is not installed"}
+        try:
+            with self._connection():
+                pass
+            return {"status": "healthy", "servers": self.urls, "pooled_connections": self._opened}
+        except LDAPUnavailableError as e:
+            return {"status": "unavailable", "servers": self.urls, "error": str(e)}
+
+    def close(self) -> None:
+        """Unbind every pooled connection."""
+        while True:
+            try:
+                conn = self._pool.get_nowait()
+            except queue.Empty:
+                break
+            self._discard(conn)
+
+    def _servers(self):
+        if self._server is None:
+            if not LDAP3_AVAILABLE:
+                raise LDAPUnavailableError("Directory logins require ldap3")
+            if not self.configured:
+                raise LDAPUnavailableError("LDAP_URL and LDAP_USER_BASE_DN must be set")
+            tls = None
+            if self.start_tls or any(u.lower().startswith("ldaps://") for u in self.urls):
+                tls = Tls(validate=ssl.CERT_REQUIRED, ca_certs_file=self.ca_cert_file)
+            servers = [Server(u, tls=tls, connect_timeout=self.timeout) for u in self.urls]
+            self._server = ServerPool(servers, FIRST, active=True, exhaust=60)
+        return self._server
+
+    def _bind(self, user: Optional[str], password: Optional[str]):
+        """A connection bound as the given DN; raises LDAPBindError when refused."""
+        auto_bind = AUTO_BIND_TLS_BEFORE_BIND if self.start_tls else AUTO_BIND_NO_TLS
+        try:
+            return Connection(self._servers(), user=user, password=password, auto_bind=auto_bind,
+                              read_only=True, receive_timeout=self.timeout)
+        except (LDAPCommunicationError, LDAPServerPoolExhaustedError) as e:
+            raise LDAPUnavailableError(f"No directory server reachable: {e}")
+
+    @contextmanager
+    def _connection(self):
+        """Borrow a pooled service-account connection, opening one if the pool has room."""
+        conn = None
+        try:
+            conn = self._pool.get_nowait()
+        except queue.Empty:
+            with self._lock:
+                room = self._opened < self.pool_size
+                if room:
+                    self._opened += 1
+            if room:
+                try:
+                    conn = self._bind(self.bind_dn, self.bind_password)
+                except LDAPBindError as e:
+                    with self._lock:
+                        self._opened -= 1
+                    raise LDAPUnavailableError(f"Directory service account bind failed: {e}")
+                except Exception:
+                    with self._lock:
+                        self._opened -= 1
+                    raise
+            else:
+                try:
+                    conn = self._pool.get(timeout=self.timeout)
+                except queue.Empty:
+                    raise LDAPUnavailableError(f"No pooled directory connection became free within {self.timeout} seconds")
+        try:
+            yield conn
+        except LDAPException as e:
+            self._discard(conn)
+            conn = None
+            raise LDAPUnavailableError(f"Directory request failed: {e}")
+        finally:
+            if conn is not None:
+                self._pool.put(conn)
+
+    def _discard(self, conn) -> None:
+        with self._lock:
+            self._opened -= 1
+        try:
+            conn.unbind()
+        except Exception:
+            pass
+
+    def _find_user(self, conn, name: str) -> Optional[Dict[str, Any]]:
+        search_filter = self.user_filter.format(username=escape_filter_chars(name))
+        conn.search(self.user_base_dn, search_filter, search_scope=SUBTREE, attributes=USER_ATTRIBUTES, size_limit=2)
+        entries = [r for r in conn.response or [] if r.get("type") == "searchResEntry"]
+        if len(entries) > 1:
+            logger.warning(f"Directory search for {name} matched more than one entry; refusing the login")
+            return None
+        return entries[0] if entries else None
+
+    def _check_password(self, dn: str, password: str) -> None:
+        try:
+            conn = self._bind(dn, password)
+        except LDAPBindError:
+            raise LDAPAuthError("Invalid credentials")
+        conn.unbind()
+
+    def _groups(self, conn, entry: Dict[str, Any]) -> List[str]:
+        """DNs of every group the user belongs to, following nesting per LDAP_NESTED_GROUPS."""
+        dn = entry["dn"]
+        direct = list(entry["attributes"].get("memberOf") or [])
+        if self.nested_groups == "in_chain":
+            conn.search(self.group_base_dn, f"(member:{MATCHING_RULE_IN_CHAIN}:={escape_filter_chars(dn)})",
+                        search_scope=SUBTREE, attributes=["cn"])
+            found = [r["dn"] for r in conn.response or [] if r.get("type") == "searchResEntry"]
+            return _unique(direct + found)
+
+        # Walk up member/uniqueMember links, one level per search, for directories without in-chain matching
+        groups: List[str] = []
+        seen = {_normalize_dn(dn)}
+        frontier = [dn]
+        depth = 1 if self.nested_groups == "none" else MAX_GROUP_DEPTH
+        for _ in range(depth):
+            terms = "".join(f"(member={escape_filter_chars(d)})(uniqueMember={escape_filter_chars(d)})" for d in frontier)
+            conn.search(self.group_base_dn, f"(|{terms})", search_scope=SUBTREE, attributes=["cn"])
+            frontier = []
+            for r in conn.response or []:
+                if r.get("type") == "searchResEntry" and _normalize_dn(r["dn"]) not in seen:
+                    seen.add(_normalize_dn(r["dn"]))
+                    groups.append(r["dn"])
+                    frontier.append(r["dn"])
+            if not frontier:
+                break
+        return _unique(direct + groups)
+
+
+def _single(value: Any) -> Optional[str]:
+    """First value of an attribute that may come back as a list."""
+    if isinstance(value, (list, tuple)):
+        return value[0] if value else None
+    return value or None
+
+
+def _unique(dns: List[str]) -> List[str]:
+    seen = set()
+    result = []
+    for dn in dns:
+        key = _normalize_dn(dn)
+        if key not in seen:
+            seen.add(key)
+            result.append(dn)
+    return result
@@ -0,0 +1,223 @@
+"""
+TerraFusion Platform - Backpressure and Load Shedding
+
+This module keeps a pile-up of submissions from growing memory until the
+service runs out. Each job type runs at most a set number of jobs at once
+in a process (EXPORT_MAX_IN_FLIGHT, SYNC_MAX_IN_FLIGHT for syncs run
+without the job queue), and the sync job queue holds at most
+SYNC_QUEUE_MAX_WAITING jobs (see sync_queue). A submission beyond either
+raises OverloadedError, which the API answers with 429 Too Many Requests
+and a Retry-After header, and gRPC with RESOURCE_EXHAUSTED. Batch workers
+wait for a slot instead of failing.
+
+The pressure on a job type is the larger of the share of its slots (or
+queue places) in use and, with LOAD_SHED_MEMORY_LIMIT_MB set, the process's
+resident memory as a share of that limit. As pressure rises the lowest
+priorities are shed first: low-priority work is refused from
+SHED_PRESSURE["low"], normal work from SHED_PRESSURE["normal"], and high
+and urgent work only once the slots are full or memory is at its limit.
+A full queue makes room for a job by cancelling its newest waiting job of
+a lower priority.
+
+Retry-After is the mean run time of the type's recent jobs spread over its
+slots, or LOAD_SHED_RETRY_AFTER_SECONDS before any has finished.
+"""
+
+import os
+import math
+import time
+import logging
+import threading
+from collections import deque
+from contextlib import contextmanager
+from typing import Dict, Any, Iterator, Optional, Tuple
+
+from sync_engine import JOB_PRIORITIES
+from runtime_debug import rss_bytes
+from metrics import JOBS_IN_FLIGHT, JOBS_SHED
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Jobs of each type one process runs at once
+EXPORT_MAX_IN_FLIGHT = int(os.environ.get("EXPORT_MAX_IN_FLIGHT", "4"))
+SYNC_MAX_IN_FLIGHT = int(os.environ.get("SYNC_MAX_IN_FLIGHT", "2"))
+
+# Resident memory at which all new work is refused; unset leaves memory out of the pressure
+MEMORY_LIMIT_MB = float(os.environ["LOAD_SHED_MEMORY_LIMIT_MB"]) if os.environ.get("LOAD_SHED_MEMORY_LIMIT_MB") \
+    else None
+
+# Retry-After before a job type has a run time to go by, and the longest one given
+RETRY_AFTER_SECONDS = int(os.environ.get("LOAD_SHED_RETRY_AFTER_SECONDS", "30"))
+MAX_RETRY_AFTER_SECONDS = 600
+
+# Pressure from which work of each priority is refused
+SHED_PRESSURE = {"low": 0.5, "normal": 0.8, "high": 1.0, "urgent": 1.0}
+
+# Recent run times kept per job type for Retry-After
+DURATION_SAMPLES = 20
+
+class OverloadedError(Exception):
+    """Raised when work is refused to relieve pressure; retry_after is the seconds to wait."""
+
+    def __init__(self, message: str, retry_after: int = RETRY_AFTER_SECONDS):
+        super().__init__(message)
+        self.retry_after = retry_after
+
+
+def check_priority(priority: str) -> int:
+    """The rank of a priority in JOB_PRIORITIES."""
+    if priority not in JOB_PRIORITIES:
+        raise ValueError(f"Unsupported job priority: {priority}. Supported priorities: {', '.join(JOB_PRIORITIES)}")
+    return JOB_PRIORITIES.index(priority)
+
+
+class LoadShedder:
+    """
+    Service class for admitting jobs by priority while their type has slots
+    and the process has memory to spare.
+    """
+
+    def __init__(self, limits: Optional[Dict[str, int]] = None, memory_limit_mb: Optional[float] = MEMORY_LIMIT_MB):
+        """
+        Initialize the load shedder.
+
+        Args:
+            limits: Jobs of each type run at once; defaults to EXPORT_MAX_IN_FLIGHT and SYNC_MAX_IN_FLIGHT
+            memory_limit_mb: Resident memory at which all new work is refused; None leaves memory out
+        """
+        self.limits = dict(limits or {"export": EXPORT_MAX_IN_FLIGHT, "sync": SYNC_MAX_IN_FLIGHT})
+        self.memory_limit_mb = memory_limit_mb
+        self._in_flight = {job_type: 0 for job_type in self.limits}
+        self._durations = {job_type: deque(maxlen=DURATION_SAMPLES) for job_type in self.limits}
+        self._condition = threading.Condition()
+        for job_type in self.limits:
+            JOBS_IN_FLIGHT.set(0, job_type=job_type)
+
+    def memory_pressure(self) -> float:
+        """Resident memory as a share of the memory limit; 0 without a limit or where it cannot be read."""
+        if not self.memory_limit_mb:
+            return 0.0
+        rss = rss_bytes()
+        return rss / (self.memory_limit_mb * 1024 * 1024) if rss is not None else 0.0
+
+    def pressure(self, job_type: str) -> float:
+        """The larger of a job type's share of its slots in use and the memory pressure."""
+        with self._condition:
+            used = self._in_flight[job_type] / max(1, self.limits[job_type])
+        return max(used, self.memory_pressure())
+
+    def check(self, job_type: str, priority: str, pressure: float, full: bool, retry_after: int) -> None:
+        """
+        Refuse work whose priority is shed at a pressure.
+
+        Args:
+            job_type: Job type, for the metrics and message
+            priority: Priority of the work, one of JOB_PRIORITIES
+            pressure: Pressure on the job type (see pressure)
+            full: Whether the type's slots or queue places are all taken
+            retry_after: Seconds the client should wait before submitting again
+
+        Raises:
+            ValueError: If the priority is not supported
+            OverloadedError: If the work is shed
+        """
+        refusal = self._refusal(job_type, priority, pressure, full)
+        if refusal is not None:
+            self._refuse(job_type, priority, pressure, refusal, retry_after)
+
+    def retry_after(self, job_type: str, backlog: int = 0, slots: Optional[int] = None) -> int:
+        """Seconds until a slot is likely to free up, with backlog jobs ahead on slots workers."""
+        with self._condition:
+            durations = list(self._durations.get(job_type) or [])
+            slots = max(1, slots or self.limits.get(job_type, 1))
+        if not durations:
+            return RETRY_AFTER_SECONDS
+        seconds = sum(durations) / len(durations) * (backlog + 1) / slots
+        return max(1, min(MAX_RETRY_AFTER_SECONDS, math.ceil(seconds)))
+
+    def record_duration(self, job_type: str, seconds: float) -> None:
+        with self._condition:
+            self._durations[job_type].append(seconds)
+
+    @contextmanager
+    def slot(self, job_type: str, priority: str = "normal",
+             wait_seconds: Optional[float] = 0) -> Iterator[None]:
+        """
+        Hold one of a job type's slots while the block runs.
+
+        Args:
+            job_type: One of the configured job types
+            priority: Priority of the work, one of JOB_PRIORITIES
+            wait_seconds: Seconds to wait for admission before giving up; None waits as long as it takes
+
+        Raises:
+            ValueError: If the priority is not supported
+            OverloadedError: If no slot was admitted in time
+        """
+        deadline = None if wait_seconds is None else time.monotonic() + wait_seconds
+        with self._condition:
+            while True:
+                if job_type not in self.limits:
+                    raise ValueError(f"Unknown job type {job_type}; job types: {', '.join(self.limits)}")
+                limit = max(1, self.limits[job_type])
+                used = self._in_flight[job_type]
+                pressure = max(used / limit, self.memory_pressure())
+                refusal = self._refusal(job_type, priority, pressure, used >= limit)
+                if refusal is None:
+                    break
+                remaining = None if deadline is None else deadline - time.monotonic()
+                if remaining is not None and remaining <= 0:
+                    self._refuse(job_type, priority, pressure, refusal, self.retry_after(job_type))
+                # Memory is not signalled, so waiting rechecks it every second
+                self._condition.wait(timeout=1 if remaining is None else min(1, remaining))
+            self._in_flight[job_type] += 1
+            JOBS_IN_FLIGHT.set(self._in_flight[job_type], job_type=job_type)
+        started = time.monotonic()
+        try:
+            yield
+        finally:
+            with self._condition:
+                self._in_flight[job_type] -= 1
+                self._durations[job_type].append(time.monotonic() - started)
+                JOBS_IN_FLIGHT.set(self._in_flight[job_type], job_type=job_type)
+                self._condition.notify_all()
+
+    def status(self) -> Dict[str, Any]:
+        """Slots, pressure and Retry-After of every job type, and the memory pressure."""
+        with self._condition:
+            in_flight = dict(self._in_flight)
+        memory = self.memory_pressure()
+        return {
+            "job_types": {
+                job_type: {"in_flight": in_flight[job_type], "max_in_flight": limit,
+                           "pressure": round(max(in_flight[job_type] / max(1, limit), memory), 3),
+                           "retry_after_seconds": self.retry_after(job_type)}
+                for job_type, limit in self.limits.items()
+            },
+            "memory": {"rss_bytes": rss_bytes(), "limit_mb": self.memory_limit_mb, "pressure": round(memory, 3)},
+            "shed_pressure": dict(SHED_PRESSURE),
+        }
+
+    def _refusal(self, job_type: str, priority: str, pressure: float, full: bool) -> Optional[Tuple[str, str]]:
+        """The reason and message work is shed for, or None when it is admitted."""
+        check_priority(priority)
+        if full:
+            return "capacity", f"All {job_type} job slots are busy"
+        if self.memory_pressure() >= 1.0:
+            return "memory", f"Memory is at its {self.memory_limit_mb:g} MB limit"
+        if pressure >= SHED_PRESSURE[priority]:
+            return "pressure", f"The service is shedding {priority}-priority {job_type} jobs under load"
+        return None
+
+    @staticmethod
+    def _refuse(job_type: str, priority: str, pressure: float, refusal: Tuple[str, str], retry_after: int) -> None:
+        reason, message = refusal
+        JOBS_SHED.inc(job_type=job_type, priority=priority, reason=reason)
+        logger.warning(f"Refused a {priority}-priority {job_type} job ({reason}, pressure {pressure:.2f})")
+        raise OverloadedError(f"{message}; retry in {retry_after} seconds", retry_after)
+
+
+# Create a singleton instance
+load_shedder = LoadShedder()
@@ -2,15 +2,39 @@
 TerraFusion SyncService Logging Configuration
 
 This module provides centralized logging configuration for the TerraFusion SyncService platform.
+
+Log lines are JSON objects (LOG_FORMAT=json, the default) carrying the
+context of the work that wrote them: the API request (request_id, user,
+county_id), the sync or export job (job_id, sync_pair_id, table) and, with
+tracing on, the trace_id. The context follows the work onto the worker
+threads of a job, and a job remembers the request that created it, so the
+log lines of a failed nightly run can be gathered by its job_id and traced
+back to whoever started it:
+
+    {"timestamp": "2026-03-02T09:15:05.123Z", "level": "ERROR", "logger": "sync_engine",
+     "message": "...", "thread": "sync-worker-2", "request_id": "6f1c...", "job_id": "c0a8...",
+     "sync_pair_id": "benton_wa_pacs_staging", "county_id": "benton_wa", "user": "it_lead",
+     "table": "dbo.property", "trace_id": "4bf9...", "exception": "Traceback ..."}
+
+LOG_FORMAT=text keeps the readable format, with the context appended.
+LOG_LEVELS sets the level of single loggers ("sync_engine=DEBUG,
+urllib3=WARNING"). The level, LOG_LEVELS and the format can be changed while
+the service runs (see config_reload).
 """
 
 import os
+import json
 import logging
+import contextvars
+from contextlib import contextmanager
+from datetime import datetime, timezone
 from logging.handlers import RotatingFileHandler
+from typing import Dict, Any, Optional, Iterator
+
+from tracing import tracer
 
 # Directory for log files
 LOG_DIR = os.path.join(os.getcwd(), 'logs')
-os.makedirs(LOG_DIR, exist_ok=True)
 
 # Log file paths
 API_GATEWAY_LOG = os.path.join(LOG_DIR, 'api_gateway.log')
@@ -18,6 +42,18 @@ SYNC_SERVICE_LOG = os.path.join(LOG_DIR, 'sync_service.log')
 MONITORING_LOG = os.path.join(LOG_DIR, 'monitoring.log')
 DATABASE_LOG = os.path.join(LOG_DIR, 'database.log')
 
+# "json" or "text"
+LOG_FORMAT = os.environ.get("LOG_FORMAT", "json").lower()
+
+# Level of the root logger; each entry point has its own default
+LOG_LEVEL = os.environ.get("LOG_LEVEL")
+
+# Levels of single loggers, "name=LEVEL" pairs separated by commas
+LOG_LEVELS = os.environ.get("LOG_LEVELS", "")
+
+# Text format of LOG_FORMAT=text; the context follows the message
+TEXT_FORMAT = '%(asctime)s - %(name)s - %(levelname)s - %(message)s'
+
 # Log rotation settings (7 days, 100MB per file)
 MAX_LOG_SIZE = 100 * 1024 * 1024  # 100 MB
 BACKUP_COUNT = 7
@@ -43,17 +79,17 @@ def configure_logger(name, log_file=None, level=logging.INFO):
         logger.handlers.clear()
     
     # Create formatter
-    formatter = logging.Formatter(
-        '%(asctime)s - %(name)s - %(levelname)s - %(message)s'
-    )
+    formatter = log_formatter()
     
     # Create console handler
     console_handler = logging.StreamHandler()
     console_handler.setFormatter(formatter)
+    console_handler.addFilter(LogContextFilter())
     logger.addHandler(console_handler)
     
     # Create file handler if log file specified
     if log_file:
+        os.makedirs(os.path.dirname(log_file), exist_ok=True)
         file_handler = RotatingFileHandler(
             log_file,
             maxBytes=MAX_LOG_SIZE,
@@ -61,6 +97,7 @@ def configure_logger(name, log_file=None, level=logging.INFO):
             encoding='utf-8'
         )
         file_handler.setFormatter(formatter)
+        file_handler.addFilter(LogContextFilter())
         logger.addHandler(file_handler)
     
     return logger
@@ -84,4 +121,194 @@ def configure_monitoring_logging():
 def configure_database_logging():
     """Configure logging for database operations."""
     # Database logging at debug level for detailed SQL
-    return configure_logger('sqlalchemy.engine', DATABASE_LOG, logging.WARNING)
\ No newline at end of file
+    return configure_logger('sqlalchemy.engine', DATABASE_LOG, logging.WARNING)
+
+
+# Log context ---------------------------------------------------------------
+
+# Context fields of the work running in this thread (a request, a job, a table)
+_log_context: contextvars.ContextVar = contextvars.ContextVar("log_context", default={})
+
+# Attributes every LogRecord has; the others came in through extra=
+_RECORD_ATTRIBUTES = set(logging.LogRecord("", 0, "", 0, "", (), None).__dict__) | {"message", "asctime"}
+
+
+def log_fields() -> Dict[str, Any]:
+    """The context fields of the current work."""
+    return dict(_log_context.get())
+
+
+def bind_log_context(**fields) -> contextvars.Token:
+    """
+    Add fields to the log context until reset_log_context is called with the
+    returned token; None values are left out.
+    """
+    return _log_context.set({**_log_context.get(), **{k: v for k, v in fields.items() if v is not None}})
+
+
+def reset_log_context(token: contextvars.Token) -> None:
+    """Restore the log context from before bind_log_context (and any updates since)."""
+    _log_context.reset(token)
+
+
+@contextmanager
+def log_context(**fields) -> Iterator[None]:
+    """Add fields to the log context for a block."""
+    token = bind_log_context(**fields)
+    try:
+        yield
+    finally:
+        reset_log_context(token)
+
+
+class LogContextFilter(logging.Filter):
+    """Adds the log context and trace ID of the logging thread to its records."""
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        record.log_context = log_fields()
+        trace_id = tracer.trace_id()
+        if trace_id:
+            record.log_context["trace_id"] = trace_id
+        return True
+
+
+class JsonLogFormatter(logging.Formatter):
+    """Formats records as one JSON object per line."""
+
+    def format(self, record: logging.LogRecord) -> str:
+        entry = {
+            "timestamp": datetime.fromtimestamp(record.created, timezone.utc).isoformat(timespec="milliseconds")
+            .replace("+00:00", "Z"),
+            "level": record.levelname,
+            "logger": record.name,
+            "message": record.getMessage(),
+            "thread": record.threadName,
+        }
+        entry.update(getattr(record, "log_context", None) or {})
+        for key, value in record.__dict__.items():
+            if key not in _RECORD_ATTRIBUTES and key != "log_context":
+                entry[key] = value
+        if record.exc_info:
+            entry["exception"] = self.formatException(record.exc_info)
+        elif record.exc_text:
+            entry["exception"] = record.exc_text
+        if record.stack_info:
+            entry["stack"] = self.formatStack(record.stack_info)
+        return json.dumps(entry, default=str)
+
+
+class TextLogFormatter(logging.Formatter):
+    """The readable format, with the log context after the message."""
+
+    def format(self, record: logging.LogRecord) -> str:
+        text = super().format(record)
+        fields = getattr(record, "log_context", None)
+        if not fields:
+            return text
+        line, _, rest = text.partition("\n")
+        context = " ".join(f"{key}={value}" for key, value in fields.items())
+        return f"{line} [{context}]" + (f"\n{rest}" if rest else "")
+
+
+def log_formatter(log_format: Optional[str] = None) -> logging.Formatter:
+    """
+    The formatter of LOG_FORMAT.
+    
+    Raises:
+        ValueError: If the format is not json or text
+    """
+    log_format = (log_format or LOG_FORMAT).lower()
+    if log_format == "json":
+        return JsonLogFormatter()
+    if log_format == "text":
+        return TextLogFormatter(TEXT_FORMAT)
+    raise ValueError(f"Unsupported LOG_FORMAT: {log_format}. Supported formats: json, text")
+
+
+def configure_structured_logging(level=logging.INFO, log_format: Optional[str] = None) -> None:
+    """
+    Format every log line of this process with its context, for entry points (the gateway, CLIs).
+    
+    LOG_LEVEL overrides the entry point's level. The root logger gets a
+    console handler if it has none; handlers it already has are reformatted.
+    
+    Args:
+        level: Level of the root logger when LOG_LEVEL is unset
+        log_format: "json" or "text"; LOG_FORMAT by default
+    """
+    root = logging.getLogger()
+    root.setLevel(LOG_LEVEL.upper() if LOG_LEVEL else level)
+    if not root.handlers:
+        root.addHandler(logging.StreamHandler())
+    formatter = log_formatter(log_format)
+    for handler in root.handlers:
+        handler.setFormatter(formatter)
+        if not any(isinstance(f, LogContextFilter) for f in handler.filters):
+            handler.addFilter(LogContextFilter())
+    try:
+        _set_logger_levels(parse_logger_levels(LOG_LEVELS))
+    except ValueError as e:
+        logging.getLogger(__name__).warning(f"Ignoring LOG_LEVELS: {e}")
+
+
+# Loggers whose level LOG_LEVELS set, reset when a reload leaves them out
+_leveled_loggers: set = set()
+
+
+def _level(value: str) -> str:
+    if not isinstance(logging.getLevelName(value.strip().upper()), int):
+        raise ValueError(f"Unknown log level: {value}")
+    return value.strip().upper()
+
+
+def parse_logger_levels(text: str) -> Dict[str, str]:
+    """
+    The levels of a LOG_LEVELS setting, by logger name.
+
+    Raises:
+        ValueError: If an entry is not name=LEVEL or names an unknown level
+    """
+    levels = {}
+    for entry in (text or "").split(","):
+        if not entry.strip():
+            continue
+        name, separator, value = entry.partition("=")
+        if not separator or not name.strip():
+            raise ValueError(f"Expected name=LEVEL, got {entry.strip()!r}")
+        levels[name.strip()] = _level(value)
+    return levels
+
+
+def _set_logger_levels(levels: Dict[str, str]) -> None:
+    for name in _leveled_loggers - set(levels):
+        logging.getLogger(name).setLevel(logging.NOTSET)
+    for name, value in levels.items():
+        logging.getLogger(name).setLevel(value)
+    _leveled_loggers.clear()
+    _leveled_loggers.update(levels)
+
+
+def reconfigure_logging(level: str, log_format: Optional[str] = None,
+                        logger_levels: Optional[Dict[str, str]] = None) -> None:
+    """
+    Change the level, single logger levels and format of this process's
+    logging while it runs. Handlers with a format of their own (the Windows
+    event log's) keep it.
+
+    Args:
+        level: Level of the root logger
+        log_format: "json" or "text"; LOG_FORMAT by default
+        logger_levels: Levels of single loggers (see parse_logger_levels)
+
+    Raises:
+        ValueError: If a level or the format is not supported; nothing is changed
+    """
+    root_level = _level(level)
+    levels = {name: _level(value) for name, value in (logger_levels or {}).items()}
+    formatter = log_formatter(log_format)
+    root = logging.getLogger()
+    root.setLevel(root_level)
+    _set_logger_levels(levels)
+    for handler in root.handlers:
+        if isinstance(handler.formatter, (JsonLogFormatter, TextLogFormatter)):
+            handler.setFormatter(formatter)
@@ -1 +1,6 @@
-from app import app
\ No newline at end of file
+from config_profiles import apply_profile
+
+# The configuration profile and environment file, before the gateway's modules read their settings
+apply_profile()
+
+from app import app
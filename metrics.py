@@ -0,0 +1,408 @@
+"""
+TerraFusion Platform - Metrics
+
+This module provides the Prometheus metrics the gateway serves at /metrics
+in the Prometheus text format: sync throughput (rows read and written per
+connector, whose rate() is rows per second), sync and export job durations,
+queue depth, errors by type, export file sizes, database connection pool
+use, API request counts and latencies, and AI provider calls and tokens.
+
+Counters and histograms are kept by the process that counts them. When the
+gateway runs several worker processes (gunicorn --workers), set
+METRICS_MULTIPROCESS_DIR to a directory they share: each process writes its
+metrics there every METRICS_WRITE_SECONDS, and /metrics adds up the files of
+every process, so a scrape through any worker sees the whole service.
+Counts of processes that have exited are kept; their gauges are dropped.
+Empty the directory when the service is deployed.
+"""
+
+import os
+import json
+import time
+import atexit
+import logging
+import tempfile
+import threading
+from typing import Dict, List, Any, Optional, Tuple, Callable, Iterable
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Prefix of every metric name
+NAMESPACE = "terrafusion"
+
+# Directory worker processes share their metrics through; off when unset
+MULTIPROCESS_DIR = os.environ.get("METRICS_MULTIPROCESS_DIR")
+
+# Seconds between writes of this process's metrics to the shared directory
+WRITE_SECONDS = float(os.environ.get("METRICS_WRITE_SECONDS", "5"))
+
+# Bearer token scrapes must send; /metrics is open when unset
+TOKEN = os.environ.get("METRICS_TOKEN")
+
+# Content type of the Prometheus text format
+CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+# Histogram buckets of durations in seconds (API requests up to sync jobs of several hours)
+DURATION_BUCKETS = (0.005, 0.025, 0.1, 0.5, 1, 5, 15, 60, 300, 900, 1800, 3600, 7200, 14400)
+
+# Histogram buckets of export file sizes in bytes (1 KB to 10 GB)
+SIZE_BUCKETS = tuple(10 ** exponent for exponent in range(3, 11))
+
+KINDS = ("counter", "gauge", "histogram")
+
+
+def _escape(value: Any) -> str:
+    return str(value).replace("\\", "\\\\").replace("\n", "\\n").replace('"', '\\"')
+
+
+def _number(value: float) -> str:
+    if value == float("inf"):
+        return "+Inf"
+    if float(value).is_integer():
+        return str(int(value))
+    return repr(float(value))
+
+
+def _labels(names: Iterable[str], values: Iterable[Any], extra: Optional[Tuple[str, str]] = None) -> str:
+    pairs = [f'{name}="{_escape(value)}"' for name, value in zip(names, values)]
+    if extra:
+        pairs.append(f'{extra[0]}="{extra[1]}"')
+    return "{" + ",".join(pairs) + "}" if pairs else ""
+
+
+class Metric:
+    """One metric and its values by label values."""
+
+    kind = "untyped"
+
+    def __init__(self, name: str, documentation: str, label_names: Iterable[str] = ()):
+        self.name = name
+        self.documentation = documentation
+        self.label_names = tuple(label_names)
+        self._values: Dict[Tuple[str, ...], Any] = {}
+        self._lock = threading.Lock()
+
+    def _key(self, labels: Dict[str, Any]) -> Tuple[str, ...]:
+        """
+        Raises:
+            ValueError: If the labels are not the metric's
+        """
+        if set(labels) != set(self.label_names):
+            raise ValueError(f"Metric {self.name} takes labels {', '.join(self.label_names) or 'none'}, "
+                             f"not {', '.join(sorted(labels)) or 'none'}")
+        return tuple("" if labels[name] is None else str(labels[name]) for name in self.label_names)
+
+    def samples(self) -> List[Tuple[Tuple[str, ...], Any]]:
+        with self._lock:
+            return [(key, list(value) if isinstance(value, list) else value) for key, value in self._values.items()]
+
+    def definition(self) -> Dict[str, Any]:
+        return {"kind": self.kind, "help": self.documentation, "labels": list(self.label_names)}
+
+
+class Counter(Metric):
+    """A count that only goes up."""
+
+    kind = "counter"
+
+    def inc(self, amount: float = 1, **labels) -> None:
+        if amount < 0:
+            raise ValueError(f"Counter {self.name} cannot go down")
+        key = self._key(labels)
+        with self._lock:
+            self._values[key] = self._values.get(key, 0) + amount
+
+
+class Gauge(Metric):
+    """A value that goes up and down."""
+
+    kind = "gauge"
+
+    def set(self, value: float, **labels) -> None:
+        key = self._key(labels)
+        with self._lock:
+            self._values[key] = value
+
+    def inc(self, amount: float = 1, **labels) -> None:
+        key = self._key(labels)
+        with self._lock:
+            self._values[key] = self._values.get(key, 0) + amount
+
+    def dec(self, amount: float = 1, **labels) -> None:
+        self.inc(-amount, **labels)
+
+    def clear(self) -> None:
+        with self._lock:
+            self._values.clear()
+
+
+class Histogram(Metric):
+    """Observations counted into buckets, with their sum and count."""
+
+    kind = "histogram"
+
+    def __init__(self, name: str, documentation: str, label_names: Iterable[str] = (),
+                 buckets: Iterable[float] = DURATION_BUCKETS):
+        super().__init__(name, documentation, label_names)
+        self.buckets = tuple(sorted(buckets))
+
+    def observe(self, value: float, **labels) -> None:
+        key = self._key(labels)
+        with self._lock:
+            # Per-bucket (not cumulative) counts, then the sum and the count
+            counts = self._values.setdefault(key, [0] * (len(self.buckets) + 1) + [0.0, 0])
+            for index, bound in enumerate(self.buckets):
+                if value <= bound:
+                    counts[index] += 1
+                    break
+            else:
+                counts[len(self.buckets)] += 1
+            counts[-2] += value
+            counts[-1] += 1
+
+    def definition(self) -> Dict[str, Any]:
+        return dict(super().definition(), buckets=list(self.buckets))
+
+
+class MetricsRegistry:
+    """
+    Service class holding the metrics of this process and rendering them for scrapes.
+
+    Collectors are functions called before each scrape and each write to the
+    shared directory, to set gauges read from elsewhere (queue depth, pools).
+    """
+
+    def __init__(self, namespace: str = NAMESPACE, multiprocess_dir: Optional[str] = MULTIPROCESS_DIR,
+                 write_seconds: float = WRITE_SECONDS):
+        self.namespace = namespace
+        self.multiprocess_dir = multiprocess_dir
+        self.write_seconds = write_seconds
+        self._metrics: Dict[str, Metric] = {}
+        self._collectors: List[Callable[[], None]] = []
+        self._lock = threading.Lock()
+        self._writer: Optional[threading.Thread] = None
+
+    def _register(self, metric: Metric) -> Metric:
+        with self._lock:
+            existing = self._metrics.get(metric.name)
+            if existing is not None:
+                if existing.kind != metric.kind or existing.label_names != metric.label_names:
+                    raise ValueError(f"Metric {metric.name} is already registered as a different {existing.kind}")
+                return existing
+            self._metrics[metric.name] = metric
+        return metric
+
+    def counter(self, name: str, documentation: str, labels: Iterable[str] = ()) -> Counter:
+        return self._register(Counter(f"{self.namespace}_{name}", documentation, labels))
+
+    def gauge(self, name: str, documentation: str, labels: Iterable[str] = ()) -> Gauge:
+        return self._register(Gauge(f"{self.namespace}_{name}", documentation, labels))
+
+    def histogram(self, name: str, documentation: str, labels: Iterable[str] = (),
+                  buckets: Iterable[float] = DURATION_BUCKETS) -> Histogram:
+        return self._register(Histogram(f"{self.namespace}_{name}", documentation, labels, buckets))
+
+    def collector(self, function: Callable[[], None]) -> Callable[[], None]:
+        """Register a function that updates gauges before they are read; usable as a decorator."""
+        with self._lock:
+            self._collectors.append(function)
+        return function
+
+    def collect(self) -> None:
+        for function in list(self._collectors):
+            try:
+                function()
+            except Exception as e:
+                # A broken collector leaves its gauges as they were rather than failing the scrape
+                logger.warning(f"Metrics collector {getattr(function, '__name__', function)} failed: {e}")
+
+    def snapshot(self) -> Dict[str, Any]:
+        """The metrics of this process, as written to the shared directory."""
+        self.collect()
+        with self._lock:
+            metrics = list(self._metrics.values())
+        return {
+            "pid": os.getpid(),
+            "written_at": time.time(),
+            "metrics": {m.name: dict(m.definition(), samples=[[list(key), value] for key, value in m.samples()])
+                        for m in metrics},
+        }
+
+    # Sharing between processes ----------------------------------------------
+
+    def start(self) -> None:
+        """Write this process's metrics to the shared directory periodically; nothing without one."""
+        if not self.multiprocess_dir:
+            return
+        with self._lock:
+            if self._writer is not None:
+                return
+            os.makedirs(self.multiprocess_dir, exist_ok=True)
+            self._writer = threading.Thread(target=self._write_loop, name="metrics-writer", daemon=True)
+        self._writer.start()
+        atexit.register(self.write)
+
+    def write(self) -> None:
+        """Write this process's metrics to the shared directory."""
+        if not self.multiprocess_dir:
+            return
+        snapshot = self.snapshot()
+        path = os.path.join(self.multiprocess_dir, f"{snapshot['pid']}.json")
+        fd, partial = tempfile.mkstemp(dir=self.multiprocess_dir, prefix=".metrics-")
+        with os.fdopen(fd, "w") as f:
+            json.dump(snapshot, f)
+        os.replace(partial, path)
+
+    def _write_loop(self) -> None:
+        while True:
+            time.sleep(self.write_seconds)
+            try:
+                self.write()
+            except Exception as e:
+                logger.warning(f"Cannot write metrics to {self.multiprocess_dir}: {e}")
+
+    def _process_snapshots(self) -> List[Dict[str, Any]]:
+        """This process's snapshot and those the other processes wrote."""
+        snapshots = [self.snapshot()]
+        if not self.multiprocess_dir or not os.path.isdir(self.multiprocess_dir):
+            return snapshots
+        for name in os.listdir(self.multiprocess_dir):
+            if not name.endswith(".json") or name == f"{os.getpid()}.json":
+                continue
+            try:
+                with open(os.path.join(self.multiprocess_dir, name), "r") as f:
+                    snapshot = json.load(f)
+            except (OSError, ValueError):
+                continue
+            if not _alive(snapshot.get("pid")):
+                # Exited processes' counts still add up; their gauges no longer describe anything
+                snapshot["metrics"] = {k: m for k, m in snapshot.get("metrics", {}).items() if m["kind"] != "gauge"}
+            snapshots.append(snapshot)
+        return snapshots
+
+    # Rendering --------------------------------------------------------------
+
+    def render(self) -> str:
+        """Every process's metrics, added up, in the Prometheus text format."""
+        merged: Dict[str, Dict[str, Any]] = {}
+        for snapshot in self._process_snapshots():
+            for name, metric in snapshot.get("metrics", {}).items():
+                target = merged.setdefault(name, dict(metric, samples={}))
+                if target["kind"] != metric["kind"] or target["labels"] != metric["labels"] \
+                        or target.get("buckets") != metric.get("buckets"):
+                    # Written by a process running another version; left out rather than added up wrongly
+                    continue
+                for key, value in metric["samples"]:
+                    key = tuple(key)
+                    if metric["kind"] == "histogram":
+                        current = target["samples"].get(key) or [0] * len(value)
+                        target["samples"][key] = [a + b for a, b in zip(current, value)]
+                    else:
+                        target["samples"][key] = target["samples"].get(key, 0) + value
+
+        lines = []
+        for name in sorted(merged):
+            metric = merged[name]
+            lines.append(f"# HELP {name} {metric['help']}")
+            lines.append(f"# TYPE {name} {metric['kind']}")
+            for key, value in sorted(metric["samples"].items()):
+                if metric["kind"] != "histogram":
+                    lines.append(f"{name}{_labels(metric['labels'], key)} {_number(value)}")
+                    continue
+                cumulative = 0
+                for bound, count in zip(list(metric["buckets"]) + [float("inf")], value):
+                    cumulative += count
+                    lines.append(f"{name}_bucket{_labels(metric['labels'], key, ('le', _number(bound)))} {cumulative}")
+                lines.append(f"{name}_sum{_labels(metric['labels'], key)} {_number(value[-2])}")
+                lines.append(f"{name}_count{_labels(metric['labels'], key)} {_number(value[-1])}")
+        return "\n".join(lines) + "\n"
+
+
+def _alive(pid: Any) -> bool:
+    try:
+        os.kill(int(pid), 0)
+    except (TypeError, ValueError, ProcessLookupError):
+        return False
+    except PermissionError:
+        return True
+    return True
+
+
+# Create a singleton instance
+metrics_registry = MetricsRegistry()
+
+# Sync throughput; rate() of these is rows per second
+SYNC_ROWS_READ = metrics_registry.counter(
+    "sync_rows_read_total", "Source rows read by sync jobs", ["sync_pair", "connector"])
+SYNC_ROWS_WRITTEN = metrics_registry.counter(
+    "sync_rows_written_total", "Rows upserted or deleted in targets by sync jobs", ["sync_pair", "connector"])
+SYNC_BULK_LOAD_ROWS = metrics_registry.counter(
+    "sync_bulk_load_rows_total", "Rows written by the targets' bulk load path", ["connector", "method"])
+SYNC_BULK_LOAD_FALLBACKS = metrics_registry.counter(
+    "sync_bulk_load_fallbacks_total", "Bulk loads rolled back and written as upserts instead", ["connector", "reason"])
+LOOKUP_CACHE_REQUESTS = metrics_registry.counter(
+    "lookup_cache_requests_total", "Reference lookups read from the cache (hit) or the database (miss)",
+    ["lookup", "result"])
+LOOKUP_CACHE_INVALIDATIONS = metrics_registry.counter(
+    "lookup_cache_invalidations_total", "Cached reference lookups dropped because a sync wrote their table", ["lookup"])
+LOOKUP_CACHE_ROWS = metrics_registry.gauge(
+    "lookup_cache_rows", "Rows of the reference lookups in the cache", ["lookup"])
+SYNC_JOBS = metrics_registry.counter(
+    "sync_jobs_total", "Sync jobs finished, by final status", ["sync_pair", "status"])
+SYNC_JOB_DURATION = metrics_registry.histogram(
+    "sync_job_duration_seconds", "Duration of finished sync job runs", ["sync_pair", "status"])
+SYNC_QUEUE_DEPTH = metrics_registry.gauge(
+    "sync_queue_jobs", "Sync jobs in this gateway's queue", ["state", "priority"])
+ERRORS = metrics_registry.counter(
+    "errors_total", "Failed jobs and requests by component and error type", ["component", "type"])
+EXPORT_JOBS = metrics_registry.counter(
+    "export_jobs_total", "GIS export jobs finished, by final status", ["export_format", "status"])
+EXPORT_JOB_DURATION = metrics_registry.histogram(
+    "export_job_duration_seconds", "Duration of finished GIS export jobs", ["export_format", "status"])
+EXPORT_SIZE = metrics_registry.histogram(
+    "export_size_bytes", "Size of completed GIS export files", ["export_format"], buckets=SIZE_BUCKETS)
+DB_POOL_CONNECTIONS = metrics_registry.gauge(
+    "db_pool_connections", "Database pool connections by state (in_use, idle)", ["pool", "state"])
+DB_POOL_SIZE = metrics_registry.gauge(
+    "db_pool_max_connections", "Largest number of connections a database pool opens", ["pool"])
+DB_POOL_WAIT = metrics_registry.histogram(
+    "db_pool_wait_seconds", "Time connectors waited for a pooled database connection", ["pool"])
+DB_POOL_TIMEOUTS = metrics_registry.counter(
+    "db_pool_timeouts_total", "Connectors that gave up waiting for a pooled connection", ["pool"])
+DB_POOL_CLOSED = metrics_registry.counter(
+    "db_pool_connections_closed_total", "Pooled connections closed (lifetime, idle, surplus, broken)",
+    ["pool", "reason"])
+HTTP_REQUESTS = metrics_registry.counter(
+    "http_requests_total", "API requests by endpoint and status code", ["method", "endpoint", "status"])
+HTTP_REQUEST_DURATION = metrics_registry.histogram(
+    "http_request_duration_seconds", "Time to answer API requests", ["method", "endpoint"])
+HTTP_COMPRESSION_BYTES = metrics_registry.counter(
+    "http_compression_bytes_total", "Bytes of compressed request and response bodies, as sent and as read",
+    ["direction", "encoding", "form"])
+DATASET_FRESHNESS = metrics_registry.gauge(
+    "dataset_freshness_seconds", "Seconds since the last successful sync of a table's stalest source",
+    ["sync_pair", "table"])
+DATASET_FRESHNESS_SLO = metrics_registry.gauge(
+    "dataset_freshness_slo_seconds", "Freshness objective of a table", ["sync_pair", "table"])
+DATASET_FRESHNESS_BREACHED = metrics_registry.gauge(
+    "dataset_freshness_breached", "1 while a table breaches its freshness objective", ["sync_pair", "table"])
+FRESHNESS_SLO_BREACHES = metrics_registry.counter(
+    "freshness_slo_breaches_total", "Freshness objective breaches started", ["sync_pair", "table"])
+CONNECTOR_CIRCUIT_STATE = metrics_registry.gauge(
+    "connector_circuit_state", "1 for the state each connector circuit breaker is in", ["connector", "state"])
+CONNECTOR_RETRIES = metrics_registry.counter(
+    "connector_retries_total", "Connector calls retried after a transient failure", ["connector", "error_class"])
+CONNECTOR_CIRCUIT_REJECTIONS = metrics_registry.counter(
+    "connector_circuit_rejections_total", "Connector calls refused by an open circuit breaker", ["connector"])
+JOBS_IN_FLIGHT = metrics_registry.gauge(
+    "jobs_in_flight", "Jobs holding a load shedding slot, by job type", ["job_type"])
+JOBS_SHED = metrics_registry.counter(
+    "jobs_shed_total", "Job submissions refused or cancelled to relieve pressure", ["job_type", "priority", "reason"])
+AI_REQUESTS = metrics_registry.counter(
+    "ai_requests_total", "Calls to AI providers, by outcome", ["provider", "operation", "outcome"])
+AI_TOKENS = metrics_registry.counter(
+    "ai_tokens_total", "Tokens AI providers took in and generated", ["provider", "model", "feature", "kind"])
+AI_REQUEST_DURATION = metrics_registry.histogram(
+    "ai_request_duration_seconds", "Time AI providers took to answer", ["provider", "operation"])
@@ -0,0 +1,158 @@
+"""
+TerraFusion Platform - Multi-Factor Authentication
+
+This module provides the TOTP second factor of RBAC logins (RFC 6238: 6
+digits, 30 second steps, SHA-1, as every authenticator app supports), the
+single-use backup codes that stand in for a lost device, and the policy of
+which roles must use it (MFA_REQUIRED_ROLES). The RBAC manager keeps each
+user's secret and backup code hashes in rbac_mfa and runs the login
+challenge; see RBACManager.authenticate_user.
+"""
+
+import io
+import os
+import hmac
+import time
+import base64
+import struct
+import hashlib
+import secrets
+import logging
+from typing import Dict, List, Any, Optional
+from urllib.parse import quote, urlencode
+
+logger = logging.getLogger(__name__)
+
+try:
+    import qrcode
+    QRCODE_AVAILABLE = True
+except ImportError:
+    # Without qrcode enrollment returns the otpauth URI and secret to type in
+    QRCODE_AVAILABLE = False
+
+# Roles that must sign in with a second factor; users of other roles may enroll by choice
+MFA_REQUIRED_ROLES = [r.strip() for r in os.environ.get("MFA_REQUIRED_ROLES", "admin,manager").split(",") if r.strip()]
+
+# Issuer shown in authenticator apps
+MFA_ISSUER = os.environ.get("MFA_ISSUER", "TerraFusion")
+
+# TOTP parameters
+TOTP_DIGITS = 6
+TOTP_PERIOD_SECONDS = 30
+SECRET_BYTES = 20
+
+# Steps either side of now a code is accepted in, for clock drift
+TOTP_WINDOW = 1
+
+# Backup codes issued at enrollment and on regeneration
+BACKUP_CODE_COUNT = 10
+
+# Failed codes before the second factor is locked, and for how long
+MAX_FAILED_ATTEMPTS = 5
+LOCKOUT_MINUTES = 15
+
+# Seconds a login has to answer its challenge
+CHALLENGE_SECONDS = 300
+
+# ID token amr values an identity provider reports for multi-factor sign-ins (SSO logins)
+MFA_AMR_VALUES = {"mfa", "otp", "hwk", "swk", "fido", "sms", "face", "fpt"}
+
+
+def mfa_required(role: Optional[str]) -> bool:
+    """Whether a role must sign in with a second factor."""
+    return role in MFA_REQUIRED_ROLES
+
+
+def new_secret() -> str:
+    """A new base32 TOTP secret."""
+    return base64.b32encode(secrets.token_bytes(SECRET_BYTES)).decode("ascii").rstrip("=")
+
+
+def _key(secret: str) -> bytes:
+    padded = secret.upper() + "=" * (-len(secret) % 8)
+    return base64.b32decode(padded)
+
+
+def totp(secret: str, step: int) -> str:
+    """The code of a time step (floor(unix time / period))."""
+    digest = hmac.new(_key(secret), struct.pack(">Q", step), hashlib.sha1).digest()
+    offset = digest[-1] & 0x0F
+    value = struct.unpack(">I", digest[offset:offset + 4])[0] & 0x7FFFFFFF
+    return str(value % 10 ** TOTP_DIGITS).zfill(TOTP_DIGITS)
+
+
+def current_step(now: Optional[float] = None) -> int:
+    return int((time.time() if now is None else now) // TOTP_PERIOD_SECONDS)
+
+
+def verify_totp(secret: str, code: str, last_step: Optional[int] = None, now: Optional[float] = None) -> Optional[int]:
+    """
+    Check a TOTP code.
+
+    Args:
+        secret: The user's secret
+        code: The code they entered
+        last_step: Step of the last code accepted, so no code is accepted twice
+        now: Time to check against (unix seconds)
+
+    Returns:
+        The code's step when it is valid, else None
+    """
+    code = (code or "").replace(" ", "")
+    if len(code) != TOTP_DIGITS or not code.isdigit():
+        return None
+    step = current_step(now)
+    for candidate in range(step - TOTP_WINDOW, step + TOTP_WINDOW + 1):
+        if last_step is not None and candidate <= last_step:
+            continue
+        if hmac.compare_digest(totp(secret, candidate), code):
+            return candidate
+    return None
+
+
+def provisioning_uri(secret: str, username: str) -> str:
+    """The otpauth:// URI authenticator apps scan."""
+    label = quote(f"{MFA_ISSUER}:{username}")
+    query = urlencode({"secret": secret, "issuer": MFA_ISSUER, "algorithm": "SHA1", "digits": TOTP_DIGITS,
+                       "period": TOTP_PERIOD_SECONDS})
+    return f"otpauth://totp/{label}?{query}"
+
+
+def qr_code(uri: str) -> Optional[str]:
+    """A data: URI of a PNG QR code of the provisioning URI; None without qrcode."""
+    if not QRCODE_AVAILABLE:
+        return None
+    buffer = io.BytesIO()
+    qrcode.make(uri).save(buffer, format="PNG")
+    return "data:image/png;base64," + base64.b64encode(buffer.getvalue()).decode("ascii")
+
+
+def _normalize_code(code: str) -> str:
+    return (code or "").replace("-", "").replace(" ", "").lower()
+
+
+def hash_backup_code(code: str, salt: str) -> str:
+    return hashlib.sha256((salt + _normalize_code(code)).encode()).hexdigest()
+
+
+def new_backup_codes(salt: str) -> Dict[str, Any]:
+    """
+    Fresh backup codes.
+
+    Returns:
+        Dictionary with codes (to show the user once, as xxxxx-xxxxx) and hashes (to store)
+    """
+    codes = []
+    for _ in range(BACKUP_CODE_COUNT):
+        raw = secrets.token_hex(5)
+        codes.append(f"{raw[:5]}-{raw[5:]}")
+    return {"codes": codes, "hashes": [hash_backup_code(c, salt) for c in codes]}
+
+
+def use_backup_code(code: str, salt: str, hashes: List[str]) -> Optional[List[str]]:
+    """The remaining hashes once a backup code is used; None when it is not one of them."""
+    wanted = hash_backup_code(code, salt)
+    for index, stored in enumerate(hashes):
+        if hmac.compare_digest(stored, wanted):
+            return hashes[:index] + hashes[index + 1:]
+    return None
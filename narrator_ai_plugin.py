@@ -2,17 +2,21 @@
 TerraFusion Platform - NarratorAI Plugin
 
 This plugin provides intelligent data analysis and narrative generation
-using Ollama for offline AI capabilities, perfect for county networks.
+using the county's AI provider (see ai_providers), or a local Ollama model
+for offline AI capabilities when none is configured, perfect for county
+networks. When no model answers, the narrative comes from a template.
 """
 
 import os
 import json
 import logging
-import requests
 from datetime import datetime
 from typing import Dict, List, Any, Optional
 from dataclasses import dataclass
 
+from ai_providers import (ai_providers, create_provider, AIClient, AIProvider, AIProviderError, LocalProvider,
+                          OpenAICompatibleProvider, DEFAULT_OLLAMA_URL, DEFAULT_CONTEXT_TOKENS)
+
 # Configure logging
 logging.basicConfig(level=logging.INFO)
 logger = logging.getLogger(__name__)
@@ -40,8 +44,10 @@ class NarratorAI:
     """
     AI-powered data analysis and narrative generation service.
     
-    Uses Ollama for offline AI capabilities, with fallback to cloud AI
-    when internet is available and configured.
+    Uses the county's AI provider when one is configured, its data redacted
+    by the provider's redaction hooks. Otherwise uses a local Ollama model
+    for offline AI capabilities, with fallback to cloud AI when internet is
+    available and configured.
     """
     
     def __init__(self, config: Optional[Dict[str, Any]] = None):
@@ -52,19 +58,42 @@ class NarratorAI:
             config: Configuration dictionary for AI settings
         """
         self.config = config or self._get_default_config()
-        self.ollama_url = self.config.get("ollama_url", "http://localhost:11434")
+        self.ollama_url = self.config.get("ollama_url", DEFAULT_OLLAMA_URL)
         self.model_name = self.config.get("model_name", "llama2")
         self.max_tokens = self.config.get("max_tokens", 2000)
         self.temperature = self.config.get("temperature", 0.7)
+        self.local_provider = self._create_fallback_provider({
+            "provider": LocalProvider.provider_type,
+            "model": self.model_name,
+            "base_url": self.ollama_url,
+            "context_tokens": self.config.get("context_tokens", DEFAULT_CONTEXT_TOKENS),
+        })
+        self.cloud_provider = None
+        if self.config.get("enable_cloud_fallback") and self.config.get("openai_api_key"):
+            self.cloud_provider = self._create_fallback_provider({
+                "provider": OpenAICompatibleProvider.provider_type,
+                "model": "gpt-3.5-turbo",
+                "api_key": self.config["openai_api_key"],
+            })
         
         logger.info(f"NarratorAI initialized with Ollama at {self.ollama_url}")
     
+    def _create_fallback_provider(self, block: Dict[str, Any]) -> Optional[AIProvider]:
+        """A provider for counties without one, with the plugin's token settings; None when invalid."""
+        block.update({"max_output_tokens": self.max_tokens, "temperature": self.temperature})
+        try:
+            return create_provider(block)
+        except ValueError as e:
+            logger.error(f"NarratorAI cannot use {block['provider']}: {e}")
+            return None
+    
     def _get_default_config(self) -> Dict[str, Any]:
         """Get default configuration for NarratorAI."""
         return {
-            "ollama_url": os.getenv("OLLAMA_URL", "http://localhost:11434"),
+            "ollama_url": os.getenv("OLLAMA_BASE_URL") or os.getenv("OLLAMA_URL", DEFAULT_OLLAMA_URL),
             "model_name": os.getenv("AI_MODEL_NAME", "llama2"),
             "max_tokens": int(os.getenv("AI_MAX_TOKENS", "2000")),
+            "context_tokens": int(os.getenv("AI_CONTEXT_TOKENS", str(DEFAULT_CONTEXT_TOKENS))),
             "temperature": float(os.getenv("AI_TEMPERATURE", "0.7")),
             "enable_cloud_fallback": os.getenv("ENABLE_CLOUD_AI", "false").lower() == "true",
             "openai_api_key": os.getenv("OPENAI_API_KEY"),
@@ -81,6 +110,8 @@ class NarratorAI:
             AI analysis with narrative and recommendations
         """
         start_time = datetime.now()
+        county_id = export_data.get("county_id")
+        export_data = self._redacted(export_data, county_id)
         
         # Build context for AI analysis
         context = self._build_gis_context(export_data)
@@ -89,7 +120,7 @@ class NarratorAI:
         prompt = self._create_gis_analysis_prompt(export_data, context)
         
         # Get AI response
-        ai_response = await self._query_ai(prompt)
+        ai_response = await self._query_ai(prompt, county_id, "gis_export")
         
         # Parse and structure the response
         analysis = self._parse_ai_response(ai_response, "gis_export")
@@ -117,10 +148,12 @@ class NarratorAI:
             AI analysis with performance insights and recommendations
         """
         start_time = datetime.now()
+        county_id = sync_data.get("county_id")
+        sync_data = self._redacted(sync_data, county_id)
         
         context = self._build_sync_context(sync_data)
         prompt = self._create_sync_analysis_prompt(sync_data, context)
-        ai_response = await self._query_ai(prompt)
+        ai_response = await self._query_ai(prompt, county_id, "sync_operation")
         analysis = self._parse_ai_response(ai_response, "sync_operation")
         
         processing_time = (datetime.now() - start_time).total_seconds() * 1000
@@ -149,7 +182,7 @@ class NarratorAI:
         
         context = self._build_platform_context(platform_data)
         prompt = self._create_summary_prompt(platform_data, context)
-        ai_response = await self._query_ai(prompt)
+        ai_response = await self._query_ai(prompt, feature="summary_report")
         analysis = self._parse_ai_response(ai_response, "summary_report")
         
         processing_time = (datetime.now() - start_time).total_seconds() * 1000
@@ -264,92 +297,51 @@ Please provide:
 Write for county administrators and IT directors. Emphasize ROI and operational benefits.
 """
     
-    async def _query_ai(self, prompt: str) -> str:
+    def _redacted(self, data: Dict[str, Any], county_id: Optional[str]) -> Dict[str, Any]:
+        """Data with the fields of the county's AI redaction policies redacted, to build prompts from."""
+        try:
+            client = ai_providers.client(county_id)
+        except ValueError:
+            # Invalid settings fall back to the template response, which sends nothing
+            return data
+        return client.redact(data) if client is not None else data
+    
+    async def _query_ai(self, prompt: str, county_id: Optional[str] = None, feature: str = "narrator") -> str:
         """
-        Query the AI service (Ollama or cloud fallback).
+        Query the AI service (the configured provider, or Ollama or cloud fallback).
         
         Args:
             prompt: The prompt to send to the AI
+            county_id: County whose AI provider answers
+            feature: What the tokens are accounted to
             
         Returns:
             AI response text
         """
         try:
-            # Try Ollama first (offline AI)
-            response = await self._query_ollama(prompt)
-            if response:
-                logger.info("Generated AI response using Ollama")
-                return response
-        except Exception as e:
-            logger.warning(f"Ollama query failed: {e}")
+            client = ai_providers.client(county_id)
+        except ValueError as e:
+            logger.error(f"AI provider settings are invalid: {e}")
+            return self._generate_template_response(prompt)
+        if client is not None:
+            clients = [client]
+        else:
+            # Try the local model first (offline AI), then cloud AI if enabled
+            clients = [AIClient(provider, county_id) for provider in (self.local_provider, self.cloud_provider)
+                       if provider is not None]
         
-        # Fallback to cloud AI if enabled
-        if self.config.get("enable_cloud_fallback") and self.config.get("openai_api_key"):
+        for client in clients:
             try:
-                response = await self._query_openai(prompt)
-                if response:
-                    logger.info("Generated AI response using OpenAI fallback")
-                    return response
-            except Exception as e:
-                logger.warning(f"OpenAI fallback failed: {e}")
+                completion = client.complete(prompt, feature=feature)
+                logger.info(f"Generated AI response using {completion.provider} ({completion.model})")
+                return completion.text
+            except AIProviderError as e:
+                logger.warning(f"{client.provider.provider_type} AI query failed: {e}")
         
         # Final fallback: structured template response
         logger.info("Using template fallback for AI response")
         return self._generate_template_response(prompt)
     
-    async def _query_ollama(self, prompt: str) -> Optional[str]:
-        """Query Ollama for AI response."""
-        try:
-            response = requests.post(
-                f"{self.ollama_url}/api/generate",
-                json={
-                    "model": self.model_name,
-                    "prompt": prompt,
-                    "stream": False,
-                    "options": {
-                        "num_predict": self.max_tokens,
-                        "temperature": self.temperature,
-                    }
-                },
-                timeout=30
-            )
-            
-            if response.status_code == 200:
-                return response.json().get("response", "")
-            else:
-                logger.error(f"Ollama responded with status {response.status_code}")
-                return None
-        except requests.exceptions.RequestException as e:
-            logger.error(f"Failed to connect to Ollama: {e}")
-            return None
-    
-    async def _query_openai(self, prompt: str) -> Optional[str]:
-        """Query OpenAI as cloud fallback."""
-        try:
-            response = requests.post(
-                "https://api.openai.com/v1/chat/completions",
-                headers={
-                    "Authorization": f"Bearer {self.config['openai_api_key']}",
-                    "Content-Type": "application/json"
-                },
-                json={
-                    "model": "gpt-3.5-turbo",
-                    "messages": [{"role": "user", "content": prompt}],
-                    "max_tokens": self.max_tokens,
-                    "temperature": self.temperature,
-                },
-                timeout=30
-            )
-            
-            if response.status_code == 200:
-                return response.json()["choices"][0]["message"]["content"]
-            else:
-                logger.error(f"OpenAI responded with status {response.status_code}")
-                return None
-        except requests.exceptions.RequestException as e:
-            logger.error(f"Failed to connect to OpenAI: {e}")
-            return None
-    
     def _generate_template_response(self, prompt: str) -> str:
         """Generate a structured template response when AI is unavailable."""
         return """
@@ -444,12 +436,10 @@ Note: This analysis was generated using offline templates. For enhanced AI insig
     
     def health_check(self) -> Dict[str, Any]:
         """Check the health of the NarratorAI service."""
-        try:
-            # Test Ollama connection
-            response = requests.get(f"{self.ollama_url}/api/tags", timeout=5)
-            ollama_status = "healthy" if response.status_code == 200 else "unavailable"
-        except:
-            ollama_status = "unavailable"
+        # Test Ollama connection
+        ollama_status = "unavailable"
+        if self.local_provider is not None and self.local_provider.health_check()["status"] == "available":
+            ollama_status = "healthy"
         
         return {
             "service": "NarratorAI",
@@ -457,7 +447,8 @@ Note: This analysis was generated using offline templates. For enhanced AI insig
             "version": "1.0.0",
             "ollama_status": ollama_status,
             "model": self.model_name,
-            "cloud_fallback": self.config.get("enable_cloud_fallback", False),
+            "cloud_fallback": self.cloud_provider is not None,
+            "ai_provider": ai_providers.health(),
             "timestamp": datetime.now().isoformat()
         }
 
@@ -0,0 +1,285 @@
+"""
+TerraFusion Platform - Network Policies
+
+This module provides the network policies the gateway checks before it
+authenticates a request, so internet scanners are turned away without
+reaching key lookups, token checks or the handlers. A county lists the
+networks its data may be reached from, and optionally the hours writes are
+accepted, in the "network_policy" block of its configuration:
+
+    "network_policy": {
+        "allow": ["10.40.0.0/16", "198.51.100.24/29"],
+        "write_hours": {
+            "timezone": "America/Los_Angeles",
+            "windows": [{"days": ["mon", "tue", "wed", "thu", "fri"], "start": "06:00", "end": "19:00"}]
+        }
+    }
+
+A request naming a county (in its path, query or body, or through the
+records it names) must come from one of that county's networks; counties
+without "allow" accept any address. A request naming no county must come
+from the networks of every county its caller is bound to, once the caller
+is known. Writes (every method but GET, HEAD and
+OPTIONS) to a county with write hours are refused outside its windows; a
+window whose end is before its start runs past midnight. API keys can carry
+their own "allowed_ips", and NETWORK_POLICY_ALLOW applies to every /api/ and
+/odata/ request. When the gateway runs behind load balancers, set
+NETWORK_POLICY_PROXY_HOPS to their number so the client address is taken
+from X-Forwarded-For.
+"""
+
+import os
+import logging
+import ipaddress
+import threading
+from datetime import datetime, time as time_of_day, timezone
+from typing import Dict, List, Any, Optional, Iterable
+from zoneinfo import ZoneInfo, ZoneInfoNotFoundError
+
+from county_overrides import load_county_config, config_version, county_config_path
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Networks every API request must come from; any address when empty
+GLOBAL_ALLOW = [s.strip() for s in os.environ.get("NETWORK_POLICY_ALLOW", "").split(",") if s.strip()]
+
+# Proxies in front of the gateway that append to X-Forwarded-For
+PROXY_HOPS = int(os.environ.get("NETWORK_POLICY_PROXY_HOPS", "0"))
+
+# Day names of write hour windows, Monday first as datetime.weekday() counts them
+DAYS = ["mon", "tue", "wed", "thu", "fri", "sat", "sun"]
+
+# Methods that are not writes
+READ_METHODS = ("GET", "HEAD", "OPTIONS")
+
+
+class NetworkPolicyDenied(PermissionError):
+    """Raised when a request's address or time is outside a network policy."""
+
+    status = 403
+
+
+def parse_networks(values: Any, label: str) -> List[Any]:
+    """
+    Parse a list of addresses and CIDR networks.
+
+    Raises:
+        ValueError: If it is not a list or an entry is not an address or network
+    """
+    if not isinstance(values, list):
+        raise ValueError(f"{label} must be a list of addresses or CIDR networks")
+    networks = []
+    for value in values:
+        try:
+            networks.append(ipaddress.ip_network(str(value).strip(), strict=False))
+        except ValueError:
+            raise ValueError(f"{label}: {value} is not an IP address or CIDR network")
+    return networks
+
+
+def address_allowed(address: Optional[str], networks: List[Any]) -> bool:
+    """Whether an address is in one of the networks; unparseable addresses are in none."""
+    if not networks:
+        return True
+    try:
+        ip = ipaddress.ip_address(address or "")
+    except ValueError:
+        return False
+    if getattr(ip, "ipv4_mapped", None):
+        ip = ip.ipv4_mapped
+    return any(ip.version == network.version and ip in network for network in networks)
+
+
+def client_address(remote_addr: Optional[str], forwarded_for: Optional[str],
+                   proxy_hops: int = PROXY_HOPS) -> Optional[str]:
+    """
+    The address of the client behind proxy_hops proxies.
+
+    Each proxy appends the address it received the request from to
+    X-Forwarded-For, so the client is the proxy_hops-th entry from the end;
+    entries before it were sent by the client and cannot be trusted.
+    """
+    if proxy_hops <= 0:
+        return remote_addr
+    hops = [hop.strip() for hop in (forwarded_for or "").split(",") if hop.strip()]
+    if len(hops) < proxy_hops:
+        # Reached the gateway without passing every proxy, so every entry may be the client's own
+        return remote_addr
+    return hops[-proxy_hops]
+
+
+def _parse_time(value: Any, label: str) -> time_of_day:
+    try:
+        hours, minutes = str(value).split(":")
+        if str(value) == "24:00":
+            return time_of_day.max
+        return time_of_day(int(hours), int(minutes))
+    except ValueError:
+        raise ValueError(f"{label} must be a HH:MM time, not {value}")
+
+
+class WriteWindow:
+    """One window of a county's write hours."""
+
+    def __init__(self, definition: Dict[str, Any], label: str):
+        """
+        Raises:
+            ValueError: If the window is invalid
+        """
+        if not isinstance(definition, dict):
+            raise ValueError(f"{label} must be an object with days, start and end")
+        days = definition.get("days") or DAYS
+        unknown = [day for day in days if str(day).lower()[:3] not in DAYS]
+        if unknown:
+            raise ValueError(f"{label}: unknown days {', '.join(map(str, unknown))}. Days: {', '.join(DAYS)}")
+        self.days = sorted({DAYS.index(str(day).lower()[:3]) for day in days})
+        self.start = _parse_time(definition.get("start", "00:00"), f"{label} start")
+        self.end = _parse_time(definition.get("end", "24:00"), f"{label} end")
+        if self.start == self.end:
+            raise ValueError(f"{label} starts and ends at the same time")
+
+    def contains(self, moment: datetime) -> bool:
+        """Whether a local time is in the window."""
+        now, day = moment.time(), moment.weekday()
+        if self.start < self.end:
+            return day in self.days and self.start <= now < self.end
+        # Overnight: the part after the start belongs to the day it starts on
+        return (day in self.days and now >= self.start) or ((day - 1) % 7 in self.days and now < self.end)
+
+    def to_dict(self) -> Dict[str, Any]:
+        end = "24:00" if self.end == time_of_day.max else self.end.strftime("%H:%M")
+        return {"days": [DAYS[day] for day in self.days], "start": self.start.strftime("%H:%M"), "end": end}
+
+
+class CountyNetworkPolicy:
+    """The parsed "network_policy" block of one county."""
+
+    def __init__(self, county_id: str, definition: Optional[Dict[str, Any]]):
+        """
+        Raises:
+            ValueError: If the block is invalid
+        """
+        definition = definition or {}
+        self.county_id = county_id
+        self.allow = parse_networks(definition.get("allow", []), f"County {county_id} network_policy.allow")
+        hours = definition.get("write_hours") or {}
+        label = f"County {county_id} network_policy.write_hours"
+        if not isinstance(hours, dict):
+            raise ValueError(f"{label} must be an object with timezone and windows")
+        self.timezone_name = hours.get("timezone", "UTC")
+        self.timezone = timezone.utc
+        if self.timezone_name != "UTC":
+            try:
+                self.timezone = ZoneInfo(self.timezone_name)
+            except (ZoneInfoNotFoundError, ValueError):
+                raise ValueError(f"{label}: unknown timezone {self.timezone_name}")
+        self.windows = [WriteWindow(window, f"{label} window {number}")
+                        for number, window in enumerate(hours.get("windows") or [], 1)]
+
+    def allows_address(self, address: Optional[str]) -> bool:
+        return address_allowed(address, self.allow)
+
+    def allows_write(self, moment: Optional[datetime] = None) -> bool:
+        """Whether writes are accepted at a moment (now by default)."""
+        if not self.windows:
+            return True
+        local = (moment or datetime.now(timezone.utc)).astimezone(self.timezone)
+        return any(window.contains(local) for window in self.windows)
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {
+            "county_id": self.county_id,
+            "allow": [str(network) for network in self.allow],
+            "write_hours": {"timezone": self.timezone_name, "windows": [w.to_dict() for w in self.windows]},
+        }
+
+
+class NetworkPolicies:
+    """
+    Service class for the gateway's network checks.
+
+    County policies are read from the county configuration files and
+    reloaded when a file changes.
+    """
+
+    def __init__(self, config_dir: str = "county_configs", global_allow: Optional[List[str]] = None):
+        self.config_dir = config_dir
+        self.global_allow = parse_networks(GLOBAL_ALLOW if global_allow is None else global_allow,
+                                           "NETWORK_POLICY_ALLOW")
+        self._policies: Dict[str, Any] = {}
+        self._lock = threading.Lock()
+
+    def policy(self, county_id: str) -> CountyNetworkPolicy:
+        """
+        The network policy of a county; open when it has none.
+
+        Raises:
+            ValueError: If its network_policy block is invalid
+        """
+        path = county_config_path(self.config_dir, county_id)
+        if path is None:
+            return CountyNetworkPolicy(county_id, None)
+        version = config_version(path)
+        with self._lock:
+            cached = self._policies.get(path)
+        if cached is not None and cached[0] == version:
+            return cached[1]
+        policy = CountyNetworkPolicy(county_id, load_county_config(path).get("network_policy"))
+        with self._lock:
+            self._policies[path] = (version, policy)
+        return policy
+
+    def counties(self) -> List[str]:
+        """The counties with a configuration file."""
+        if not os.path.isdir(self.config_dir):
+            return []
+        return sorted(name for name in os.listdir(self.config_dir) if county_config_path(self.config_dir, name))
+
+    def check_reach(self, address: Optional[str], county_ids: Iterable[Optional[str]]) -> None:
+        """
+        Check the address of a request naming no county against the counties
+        its caller is bound to, whose data it may reach.
+
+        Raises:
+            NetworkPolicyDenied: If one of those counties does not accept the address
+            ValueError: If a county's network_policy block is invalid
+        """
+        for county_id in dict.fromkeys(c for c in county_ids if c):
+            if not self.policy(county_id).allows_address(address):
+                raise NetworkPolicyDenied(f"County {county_id} does not accept requests from {address}")
+
+    def check(self, address: Optional[str], method: str, county_ids: Iterable[Optional[str]] = (),
+              key_allow: Optional[List[str]] = None, moment: Optional[datetime] = None) -> None:
+        """
+        Check a request against the global, API key and county policies.
+
+        Args:
+            address: Client address (see client_address)
+            method: Request method; all but GET, HEAD and OPTIONS are writes
+            county_ids: Counties the request names
+            key_allow: allowed_ips of the API key the request carries
+            moment: Time of the request, now by default
+
+        Raises:
+            NetworkPolicyDenied: If the address or time is outside a policy
+            ValueError: If a county's network_policy block is invalid
+        """
+        if not address_allowed(address, self.global_allow):
+            raise NetworkPolicyDenied(f"Requests from {address} are not allowed")
+        if key_allow and not address_allowed(address, parse_networks(key_allow, "allowed_ips")):
+            raise NetworkPolicyDenied(f"This API key may not be used from {address}")
+        for county_id in dict.fromkeys(c for c in county_ids if c):
+            policy = self.policy(county_id)
+            if not policy.allows_address(address):
+                raise NetworkPolicyDenied(f"County {county_id} does not accept requests from {address}")
+            if method.upper() not in READ_METHODS and not policy.allows_write(moment):
+                hours = "; ".join(f"{', '.join(w['days'])} {w['start']}-{w['end']}"
+                                  for w in policy.to_dict()["write_hours"]["windows"])
+                raise NetworkPolicyDenied(f"County {county_id} accepts changes only {hours} "
+                                          f"({policy.timezone_name})")
+
+
+# Create a singleton instance
+network_policies = NetworkPolicies()
@@ -0,0 +1,341 @@
+"""
+TerraFusion Platform - OpenID Connect Single Sign-On
+
+This module provides the single sign-on authenticator used by the RBAC manager
+when AUTH_BACKEND is "oidc". Users sign in at their county's identity provider
+(Azure AD / Entra ID, Okta, or any OpenID Connect provider) with the
+authorization code flow and PKCE; the groups in their ID token are mapped to
+a TerraFusion role, and the provider's refresh token lets the gateway check
+periodically that they are still allowed in.
+"""
+
+import os
+import json
+import time
+import base64
+import hashlib
+import logging
+import secrets
+import threading
+from typing import Any, Dict, List, Optional
+from urllib.parse import urlencode
+
+import requests
+
+logger = logging.getLogger(__name__)
+
+try:
+    import jwt
+    JWT_AVAILABLE = True
+except ImportError:
+    # ID tokens are verified with PyJWT
+    JWT_AVAILABLE = False
+
+# Scopes requested by default; offline_access asks for the refresh token
+DEFAULT_SCOPES = "openid profile email offline_access"
+
+# Signing algorithms accepted for ID tokens
+ID_TOKEN_ALGORITHMS = ["RS256", "RS384", "RS512", "ES256", "ES384", "PS256"]
+
+# Seconds of clock skew tolerated when checking ID token times
+CLOCK_SKEW_SECONDS = 60
+
+# Seconds the provider's discovery document is cached
+DISCOVERY_CACHE_SECONDS = 3600
+
+# Seconds a started login may take to come back from the provider
+LOGIN_TIMEOUT_SECONDS = 600
+
+
+class OIDCAuthError(Exception):
+    """The provider refused the login or refresh, or the user holds no mapped role."""
+
+
+class OIDCUnavailableError(Exception):
+    """The provider could not be reached or answered with an error."""
+
+
+def _pkce_challenge(verifier: str) -> str:
+    digest = hashlib.sha256(verifier.encode("ascii")).digest()
+    return base64.urlsafe_b64encode(digest).rstrip(b"=").decode("ascii")
+
+
+def safe_return_path(path: Optional[str], default: str = "/dashboard") -> str:
+    """A path to send the browser back to after login; only local paths, so logins are no open redirect."""
+    if not path or not path.startswith("/") or path.startswith("//") or "\\" in path:
+        return default
+    return path
+
+
+class OIDCAuthenticator:
+    """
+    Signs users in against an OpenID Connect provider.
+
+    The provider is found from its issuer (OIDC_ISSUER, e.g.
+    https://login.microsoftonline.com/<tenant>/v2.0 or
+    https://benton.okta.com/oauth2/default) and its discovery document. A
+    login is started with begin(), which returns the provider URL to send the
+    browser to and the state to keep in the browser's session, and finished
+    with complete() when the provider redirects back to OIDC_REDIRECT_URI.
+
+    OIDC_GROUP_ROLE_MAP is a JSON object from group (name, or object ID for
+    Azure AD tokens that carry IDs) to RBAC role, read from the
+    OIDC_GROUPS_CLAIM claim of the ID token ("groups"; "roles" for Azure app
+    roles). Entries are checked in order and the first group the user holds
+    decides the role; users in no mapped group cannot sign in.
+    """
+
+    def __init__(self, settings: Optional[Dict[str, Any]] = None):
+        """
+        Initialize the authenticator.
+
+        Args:
+            settings: Overrides for the OIDC_* environment settings, keyed by
+                their lower-case names without the prefix (e.g. "issuer")
+        """
+        settings = settings or {}
+
+        def setting(name: str, default: Any = None) -> Any:
+            value = settings.get(name)
+            return value if value is not None else os.environ.get(f"OIDC_{name.upper()}", default)
+
+        self.issuer = str(setting("issuer", "")).rstrip("/")
+        self.client_id = setting("client_id")
+        self.client_secret = setting("client_secret")
+        self.redirect_uri = setting("redirect_uri")
+        self.scopes = str(setting("scopes", DEFAULT_SCOPES))
+        self.groups_claim = str(setting("groups_claim", "groups"))
+        self.username_claim = str(setting("username_claim", "preferred_username"))
+        self.timeout = int(setting("timeout_seconds", 10))
+        role_map = setting("group_role_map", "{}")
+        self.group_roles: Dict[str, str] = json.loads(role_map) if isinstance(role_map, str) else dict(role_map)
+
+        self.session = requests.Session()
+        self._discovery: Optional[Dict[str, Any]] = None
+        self._discovered_at = 0.0
+        self._jwks_client = None
+        self._lock = threading.Lock()
+
+    @property
+    def configured(self) -> bool:
+        return bool(self.issuer and self.client_id and self.redirect_uri)
+
+    def begin(self, return_to: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Start a login.
+
+        Args:
+            return_to: Local path to send the browser to once signed in
+
+        Returns:
+            Dictionary with authorization_url, to redirect the browser to, and
+            pending, to keep in the browser's session until complete()
+
+        Raises:
+            OIDCUnavailableError: If the provider's discovery document cannot be read
+        """
+        provider = self.discovery()
+        pending = {
+            "state": secrets.token_urlsafe(32),
+            "nonce": secrets.token_urlsafe(32),
+            "code_verifier": secrets.token_urlsafe(64),
+            "return_to": safe_return_path(return_to),
+            "started_at": time.time(),
+        }
+        query = {
+            "response_type": "code",
+            "client_id": self.client_id,
+            "redirect_uri": self.redirect_uri,
+            "scope": self.scopes,
+            "state": pending["state"],
+            "nonce": pending["nonce"],
+            "code_challenge": _pkce_challenge(pending["code_verifier"]),
+            "code_challenge_method": "S256",
+        }
+        return {"authorization_url": f"{provider['authorization_endpoint']}?{urlencode(query)}", "pending": pending}
+
+    def complete(self, pending: Optional[Dict[str, Any]], code: Optional[str], state: Optional[str]) -> Dict[str, Any]:
+        """
+        Finish a login: check the state, redeem the code and verify the ID token.
+
+        Args:
+            pending: What begin() returned to keep in the session
+            code: Authorization code from the redirect
+            state: State from the redirect
+
+        Returns:
+            Dictionary with username, email, display_name, subject, groups, role,
+            amr (how the provider authenticated the user), refresh_token (None
+            when the provider issued none) and expires_at (epoch seconds the
+            provider's access token lasts until)
+
+        Raises:
+            OIDCAuthError: If the login is not the one started, has expired, or the user holds no mapped role
+            OIDCUnavailableError: If the provider cannot be reached
+        """
+        if not pending or not state or not secrets.compare_digest(str(pending.get("state")), str(state)):
+            raise OIDCAuthError("Login state does not match; start the login again")
+        if time.time() - pending.get("started_at", 0) > LOGIN_TIMEOUT_SECONDS:
+            raise OIDCAuthError("Login took too long; start it again")
+        if not code:
+            raise OIDCAuthError("The provider returned no authorization code")
+        tokens = self._token_request({
+            "grant_type": "authorization_code",
+            "code": code,
+            "redirect_uri": self.redirect_uri,
+            "code_verifier": pending["code_verifier"],
+        })
+        if not tokens.get("id_token"):
+            raise OIDCAuthError("The provider returned no ID token; is the openid scope requested?")
+        claims = self.verify_id_token(tokens["id_token"], pending["nonce"])
+        return self._identity(claims, tokens)
+
+    def refresh(self, refresh_token: str) -> Dict[str, Any]:
+        """
+        Redeem a refresh token, to check that a signed-in user still has access.
+
+        Returns:
+            The identity of complete(), with role, username and groups None when
+            the provider returned no new ID token; refresh_token is the new one
+            when the provider rotates them, else the one given
+
+        Raises:
+            OIDCAuthError: If the provider refuses the refresh token (the user was
+                disabled or signed out) or the user no longer holds a mapped role
+            OIDCUnavailableError: If the provider cannot be reached
+        """
+        tokens = self._token_request({"grant_type": "refresh_token", "refresh_token": refresh_token,
+                                      "scope": self.scopes})
+        tokens.setdefault("refresh_token", refresh_token)
+        if not tokens.get("id_token"):
+            return {"username": None, "email": None, "display_name": None, "subject": None, "groups": None,
+                    "role": None, "amr": None, "refresh_token": tokens["refresh_token"],
+                    "expires_at": self._expires_at(tokens)}
+        return self._identity(self.verify_id_token(tokens["id_token"]), tokens)
+
+    def verify_id_token(self, id_token: str, nonce: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Check an ID token's signature (against the provider's JWKS), issuer,
+        audience, times and, on login, nonce.
+
+        Raises:
+            OIDCAuthError: If the token is not valid
+            OIDCUnavailableError: If the provider's signing keys cannot be read
+        """
+        if not JWT_AVAILABLE:
+            raise OIDCUnavailableError("Single sign-on requires PyJWT")
+        try:
+            key = self._signing_keys().get_signing_key_from_jwt(id_token).key
+        except jwt.PyJWKClientError as e:
+            raise OIDCUnavailableError(f"Could not read the provider's signing keys: {e}")
+        except jwt.InvalidTokenError as e:
+            raise OIDCAuthError(f"Invalid ID token: {e}")
+        try:
+            claims = jwt.decode(id_token, key, algorithms=ID_TOKEN_ALGORITHMS, audience=self.client_id,
+                                issuer=self.discovery().get("issuer", self.issuer), leeway=CLOCK_SKEW_SECONDS)
+        except jwt.InvalidTokenError as e:
+            raise OIDCAuthError(f"Invalid ID token: {e}")
+        if nonce is not None and not secrets.compare_digest(str(claims.get("nonce", "")), nonce):
+            raise OIDCAuthError("ID token nonce does not match the login")
+        return claims
+
+    def role_for(self, groups: List[str]) -> Optional[str]:
+        """The role of the first OIDC_GROUP_ROLE_MAP entry matching one of the groups."""
+        held = {str(g).strip().lower() for g in groups}
+        for group, role in self.group_roles.items():
+            if group.strip().lower() in held:
+                return role
+        return None
+
+    def discovery(self) -> Dict[str, Any]:
+        """The provider's discovery document, cached for DISCOVERY_CACHE_SECONDS."""
+        with self._lock:
+            if self._discovery and time.monotonic() - self._discovered_at < DISCOVERY_CACHE_SECONDS:
+                return self._discovery
+        if not self.configured:
+            raise OIDCUnavailableError("OIDC_ISSUER, OIDC_CLIENT_ID and OIDC_REDIRECT_URI must be set")
+        url = f"{self.issuer}/.well-known/openid-configuration"
+        try:
+            response = self.session.get(url, timeout=self.timeout)
+            response.raise_for_status()
+            document = response.json()
+        except (requests.RequestException, ValueError) as e:
+            raise OIDCUnavailableError(f"Could not read {url}: {e}")
+        for field in ("authorization_endpoint", "token_endpoint", "jwks_uri"):
+            if not document.get(field):
+                raise OIDCUnavailableError(f"{url} has no {field}")
+        with self._lock:
+            if self._discovery is None or self._discovery.get("jwks_uri") != document["jwks_uri"]:
+                self._jwks_client = None
+            self._discovery, self._discovered_at = document, time.monotonic()
+        return document
+
+    def health_check(self) -> Dict[str, Any]:
+        """Check that the provider's discovery document can be read."""
+        try:
+            provider = self.discovery()
+            return {"status": "healthy", "issuer": provider.get("issuer", self.issuer),
+                    "refresh_tokens": "offline_access" in self.scopes.split()}
+        except OIDCUnavailableError as e:
+            return {"status": "unavailable", "issuer": self.issuer, "error": str(e)}
+
+    def _signing_keys(self):
+        provider = self.discovery()
+        with self._lock:
+            if self._jwks_client is None:
+                self._jwks_client = jwt.PyJWKClient(provider["jwks_uri"], cache_keys=True, timeout=self.timeout)
+            return self._jwks_client
+
+    def _token_request(self, form: Dict[str, Any]) -> Dict[str, Any]:
+        form = dict(form, client_id=self.client_id)
+        if self.client_secret:
+            form["client_secret"] = self.client_secret
+        try:
+            response = self.session.post(self.discovery()["token_endpoint"], data=form, timeout=self.timeout,
+                                         headers={"Accept": "application/json"})
+        except requests.RequestException as e:
+            raise OIDCUnavailableError(f"Token request failed: {e}")
+        try:
+            body = response.json()
+        except ValueError:
+            body = {}
+        if response.status_code in (400, 401):
+            # invalid_grant: the code was used or expired, or the refresh token was revoked
+            raise OIDCAuthError(f"The provider refused the token request: {body.get('error', response.status_code)}"
+                                + (f" ({body['error_description']})" if body.get("error_description") else ""))
+        if response.status_code >= 300 or not isinstance(body, dict) or not body.get("access_token"):
+            raise OIDCUnavailableError(f"The provider's token endpoint answered {response.status_code}")
+        return body
+
+    def _identity(self, claims: Dict[str, Any], tokens: Dict[str, Any]) -> Dict[str, Any]:
+        if "_claim_names" in claims and self.groups_claim in claims["_claim_names"]:
+            # Azure AD leaves groups out of tokens of users in too many of them
+            logger.warning(f"ID token of {claims.get('sub')} has too many groups to list; "
+                           f"map an app role (OIDC_GROUPS_CLAIM=roles) or limit the groups sent to the app")
+        groups = claims.get(self.groups_claim) or []
+        if isinstance(groups, str):
+            groups = [groups]
+        username = claims.get(self.username_claim) or claims.get("email") or claims.get("sub")
+        role = self.role_for(groups)
+        if role is None:
+            logger.warning(f"SSO user {username} signed in but belongs to no group mapped to a role")
+            raise OIDCAuthError("User is not a member of any group granted access")
+        return {
+            "username": str(username).lower(),
+            "email": claims.get("email") or (username if "@" in str(username) else None),
+            "display_name": claims.get("name"),
+            "subject": claims.get("sub"),
+            "groups": list(groups),
+            "role": role,
+            "amr": list(claims.get("amr") or []),
+            "refresh_token": tokens.get("refresh_token"),
+            "expires_at": self._expires_at(tokens),
+        }
+
+    @staticmethod
+    def _expires_at(tokens: Dict[str, Any]) -> float:
+        try:
+            lifetime = int(tokens.get("expires_in") or 3600)
+        except (TypeError, ValueError):
+            lifetime = 3600
+        return time.time() + lifetime
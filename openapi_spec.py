@@ -0,0 +1,975 @@
+"""
+TerraFusion Platform - OpenAPI Specification
+
+This module generates the OpenAPI 3 documents of the REST gateway from the
+Flask routes themselves, one per API version (see api_versions), so the
+published specs (api_documentation.json for the latest version,
+api_documentation.v1.json), the spec the gateway serves at
+GET /api/<version>/openapi.json and the generated Go clients (see go_client)
+cannot drift from the server:
+
+    python openapi_spec.py            # rewrite the specs and the Go clients
+    python openapi_spec.py --check    # exit 1 if any is out of date (for CI)
+
+Every route under /api/<version>/ (and /health, /health/ready, /api/versions)
+becomes an operation of that version's spec, marked deprecated where the version
+deprecates it. Path parameters
+come from the rule; query parameters, JSON body fields, status codes and
+non-JSON responses are read from the view function's source (request.args,
+request.get_json(), jsonify(...), N, Response(mimetype=...)), and paged
+listings get limit, cursor and offset (see pagination). The core resources
+(jobs, sync pairs, batches, webhooks, ...) have typed schemas below, listed
+in OPERATION_MODELS; other operations get a request schema of the body
+fields their view reads and a free-form object response. Operations taking
+streamed NDJSON or CSV bodies are listed in RAW_REQUEST_BODIES, and uploads
+in MULTIPART_REQUEST_BODIES. OData is described
+by each sync pair's own $metadata document and is left out.
+"""
+
+import os
+import re
+import sys
+import json
+import inspect
+import logging
+import argparse
+from typing import Dict, List, Any, Optional, Tuple
+
+from api_versions import API_VERSIONS, LATEST_VERSION, deprecation
+from sync_ingest import INGEST_FORMATS, RECORD_STATUSES
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+OPENAPI_VERSION = "3.0.3"
+
+# Revision of the specs, and of the Go clients generated from them; bump the
+# minor version when operations are added and the major one when any change
+API_VERSION = "2.2.0"
+
+# The spec of the latest API version checked in at the repository root; older
+# versions' specs are written next to it as api_documentation.<version>.json
+SPEC_PATH = "api_documentation.json"
+
+# Routes outside /api/<version>/ that belong in every version's spec
+EXTRA_ROUTES = ["/health", "/health/ready", "/api/versions"]
+
+# Route prefixes left out of the spec (described elsewhere)
+EXCLUDED_PREFIXES = ["/odata/"]
+
+# Words of route and endpoint names written in capitals
+ACRONYMS = {"gis": "GIS", "ai": "AI", "rbac": "RBAC", "cdc": "CDC", "id": "ID", "graphql": "GraphQL", "openapi": "OpenAPI",
+            "sso": "SSO", "mfa": "MFA"}
+
+# Descriptions of the status codes operations answer with
+_SUCCESS_DESCRIPTIONS = {200: "Success", 201: "Created", 202: "Accepted", 204: "No content", 304: "Not modified"}
+_ERROR_DESCRIPTIONS = {
+    400: "Invalid request", 401: "Not authenticated", 403: "Not allowed", 404: "Not found",
+    409: "Conflicts with the resource's state", 413: "Request too large", 429: "Too many requests",
+    500: "Server error", 502: "Upstream error", 503: "Unavailable; retry later",
+}
+
+# How callers authenticate: a scoped API key (see api_keys) or an RBAC bearer token
+SECURITY_SCHEMES = {
+    "apiKey": {"type": "apiKey", "in": "header", "name": "X-API-Key"},
+    "bearer": {"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+}
+
+# Operation IDs of endpoints that serve more than one method
+METHOD_OPERATION_IDS = {
+    ("sync_snapshot", "GET"): "get_sync_snapshot",
+    ("sync_snapshot", "DELETE"): "discard_sync_snapshot",
+    ("sync_import", "GET"): "get_sync_import",
+    ("sync_import", "DELETE"): "discard_sync_import",
+    ("query_sync_graphql", "GET"): "query_sync_graphql_get",
+    ("query_sync_graphql", "POST"): "query_sync_graphql",
+}
+
+
+def _ref(name: str) -> Dict[str, Any]:
+    return {"$ref": f"#/components/schemas/{name}"}
+
+
+def _array(items: Dict[str, Any]) -> Dict[str, Any]:
+    return {"type": "array", "items": items}
+
+
+def _object(properties: Dict[str, Any], required: Optional[List[str]] = None, description: Optional[str] = None) -> Dict[str, Any]:
+    schema = {"type": "object", "properties": properties}
+    if required:
+        schema["required"] = required
+    if description:
+        schema["description"] = description
+    return schema
+
+
+def _listing(key: str, item: str, paged: bool = True) -> Dict[str, Any]:
+    """The schema of a listing body such as {"snapshots": [...], "count": 2, "next_cursor": "..."}."""
+    properties = {key: _array(_ref(item)), "count": INTEGER}
+    if paged:
+        properties["next_cursor"] = dict(STRING, nullable=True, description="Cursor of the next page; null on the last one")
+    return _object(properties)
+
+
+STRING = {"type": "string"}
+INTEGER = {"type": "integer"}
+NUMBER = {"type": "number"}
+BOOLEAN = {"type": "boolean"}
+TIMESTAMP = {"type": "string", "format": "date-time"}
+NULLABLE_TIMESTAMP = {"type": "string", "format": "date-time", "nullable": True}
+NULLABLE_STRING = {"type": "string", "nullable": True}
+FREE_FORM = {"type": "object", "additionalProperties": True}
+STRINGS = _array(STRING)
+READINESS_STATUS = {"type": "string", "enum": ["healthy", "degraded", "unavailable"]}
+
+# Typed schemas of the gateway's core resources
+SCHEMAS = {
+    "Error": _object({
+        "error": STRING,
+        "message": STRING,
+    }, ["error"]),
+    "HealthStatus": _object({
+        "status": {"type": "string", "enum": ["healthy", "degraded", "unhealthy"]},
+        "service": STRING,
+        "version": STRING,
+    }),
+    "HealthCheckResult": _object({
+        "status": READINESS_STATUS,
+        "critical": dict(BOOLEAN, description="An unavailable critical check makes the instance unavailable"),
+        "error": NULLABLE_STRING,
+        "duration_ms": INTEGER,
+    }, ["status"]),
+    "ConnectorHealth": _object({
+        "sync_pair_id": STRING,
+        "county_id": STRING,
+        "side": {"type": "string", "enum": ["source", "target"]},
+        "connector_type": STRING,
+        "status": READINESS_STATUS,
+        "error": NULLABLE_STRING,
+        "circuit": {"type": "string", "enum": ["closed", "open", "half_open"], "nullable": True,
+                    "description": "State of the connector's circuit breaker in the answering instance"},
+        "duration_ms": INTEGER,
+    }),
+    "ReadinessReport": _object({
+        "status": READINESS_STATUS,
+        "checked_at": TIMESTAMP,
+        "duration_ms": INTEGER,
+        "checks": {"type": "object", "additionalProperties": _ref("HealthCheckResult")},
+        "connectors": _array(_ref("ConnectorHealth")),
+        "unavailable_checks": STRINGS,
+        "degraded_sync_pairs": STRINGS,
+    }),
+    "ExportJob": _object({
+        "job_id": STRING,
+        "county_id": STRING,
+        "username": STRING,
+        "export_format": STRING,
+        "area_of_interest": dict(FREE_FORM, description="GeoJSON geometry of the area exported"),
+        "layers": STRINGS,
+        "parameters": FREE_FORM,
+        "redaction": dict(STRINGS, description="Redaction policies the export was written with"),
+        "status": {"type": "string", "enum": ["PENDING", "PROCESSING", "COMPLETED", "FAILED", "CANCELLED"]},
+        "created_at": TIMESTAMP,
+        "started_at": NULLABLE_TIMESTAMP,
+        "completed_at": NULLABLE_TIMESTAMP,
+        "download_url": NULLABLE_STRING,
+        "message": STRING,
+    }),
+    "CreateExportJobRequest": _object({
+        "county_id": STRING,
+        "username": STRING,
+        "export_format": dict(STRING, description="shapefile, geojson, kml, kmz, geopackage, flatgeobuf, geoparquet, "
+                                                  "mvt, mbtiles, dxf, csv, xlsx, parcel_reports or ratio_study"),
+        "area_of_interest": dict(FREE_FORM, description="GeoJSON geometry of the area to export"),
+        "layers": STRINGS,
+        "parameters": dict(FREE_FORM, description="Format and delivery options"),
+        "priority": {"type": "string", "enum": ["low", "normal", "high", "urgent"],
+                     "description": "Lower priorities are refused first under load"},
+    }, ["county_id", "username", "export_format", "area_of_interest", "layers"]),
+    "SyncPair": _object({
+        "sync_pair_id": STRING,
+        "county_id": STRING,
+        "name": STRING,
+        "source_system": STRING,
+        "target_system": STRING,
+        "vendor": NULLABLE_STRING,
+        "batch_size": INTEGER,
+        "default_mode": STRING,
+        "direction": STRING,
+        "conflict_strategy": STRING,
+        "tables": _array(FREE_FORM),
+    }),
+    "SyncJob": _object({
+        "job_id": STRING,
+        "sync_pair_id": STRING,
+        "county_id": STRING,
+        "username": STRING,
+        "mode": STRING,
+        "dry_run": BOOLEAN,
+        "priority": STRING,
+        "tables": STRINGS,
+        "parameters": FREE_FORM,
+        "source_system": STRING,
+        "target_system": STRING,
+        "status": dict(STRING, description="PENDING, QUEUED, RUNNING, PAUSING, PAUSED, CANCELLING, CANCELLED, COMPLETED or FAILED"),
+        "created_at": TIMESTAMP,
+        "started_at": NULLABLE_TIMESTAMP,
+        "completed_at": NULLABLE_TIMESTAMP,
+        "table_results": FREE_FORM,
+        "stats": {"type": "object", "additionalProperties": INTEGER},
+        "resume_count": INTEGER,
+        "message": STRING,
+    }),
+    "CreateSyncJobRequest": _object({
+        "sync_pair_id": STRING,
+        "username": STRING,
+        "mode": dict(STRING, description="full or incremental; the sync pair's default_mode when omitted"),
+        "tables": dict(STRINGS, description="Tables to sync; all of the sync pair's when omitted"),
+        "parameters": FREE_FORM,
+        "dry_run": BOOLEAN,
+        "priority": {"type": "string", "enum": ["low", "normal", "high", "urgent"]},
+        "express": BOOLEAN,
+    }, ["sync_pair_id", "username"]),
+    "IngestedRecord": _object({
+        "line": INTEGER,
+        "status": {"type": "string", "enum": RECORD_STATUSES},
+        "key": dict(_array(FREE_FORM), nullable=True, description="Primary key values; null when the line has none"),
+        "errors": STRINGS,
+        "stage": NULLABLE_STRING,
+    }),
+    "IngestReport": _object({
+        "counts": {"type": "object", "additionalProperties": INTEGER},
+        "records": _array(_ref("IngestedRecord")),
+        "limit_exceeded": BOOLEAN,
+    }),
+    "IngestResult": _object({
+        "job": _ref("SyncJob"),
+        "report": _ref("IngestReport"),
+        "error": NULLABLE_STRING,
+    }),
+    "Snapshot": _object({
+        "snapshot_id": STRING,
+        "job_id": STRING,
+        "sync_pair_id": STRING,
+        "county_id": STRING,
+        "status": STRING,
+        "tables": FREE_FORM,
+        "created_at": TIMESTAMP,
+        "restored_at": NULLABLE_TIMESTAMP,
+        "restored_by": NULLABLE_STRING,
+    }),
+    "DeadLetter": _object({
+        "dead_letter_id": STRING,
+        "sync_pair_id": STRING,
+        "table": STRING,
+        "record_key": dict(STRING, description="JSON array of the record's primary key values"),
+        "status": STRING,
+        "stage": STRING,
+        "errors": STRINGS,
+        "operation": NULLABLE_STRING,
+        "payload": FREE_FORM,
+        "job_id": NULLABLE_STRING,
+        "failure_count": INTEGER,
+        "retry_count": INTEGER,
+        "first_failed_at": TIMESTAMP,
+        "last_failed_at": TIMESTAMP,
+    }),
+    "Conflict": _object({
+        "conflict_id": STRING,
+        "job_id": STRING,
+        "sync_pair_id": STRING,
+        "table": STRING,
+        "record_key": dict(STRING, description="JSON array of the record's primary key values"),
+        "source_record": FREE_FORM,
+        "target_record": FREE_FORM,
+        "strategy": STRING,
+        "status": {"type": "string", "enum": ["PENDING", "RESOLVED"]},
+        "resolution": NULLABLE_STRING,
+        "resolved_by": NULLABLE_STRING,
+        "detected_at": TIMESTAMP,
+        "resolved_at": NULLABLE_TIMESTAMP,
+    }),
+    "Schedule": _object({
+        "schedule_id": STRING,
+        "sync_pair_id": STRING,
+        "county_id": STRING,
+        "cron": STRING,
+        "timezone": STRING,
+        "mode": NULLABLE_STRING,
+        "tables": dict(STRINGS, nullable=True),
+        "parameters": FREE_FORM,
+        "catch_up": BOOLEAN,
+        "username": STRING,
+        "status": {"type": "string", "enum": ["ACTIVE", "PAUSED"]},
+        "created_at": TIMESTAMP,
+        "updated_at": TIMESTAMP,
+        "next_run_at": NULLABLE_TIMESTAMP,
+        "last_run_at": NULLABLE_TIMESTAMP,
+        "last_job_id": NULLABLE_STRING,
+        "last_job_status": NULLABLE_STRING,
+        "missed_runs": INTEGER,
+    }),
+    "BatchItem": _object({
+        "index": INTEGER,
+        "type": {"type": "string", "enum": ["export", "sync"], "nullable": True},
+        "job_id": NULLABLE_STRING,
+        "status": NULLABLE_STRING,
+        "error": NULLABLE_STRING,
+        "spec": FREE_FORM,
+    }),
+    "Batch": _object({
+        "batch_id": STRING,
+        "name": NULLABLE_STRING,
+        "username": NULLABLE_STRING,
+        "status": {"type": "string", "enum": ["RUNNING", "COMPLETED", "PARTIALLY_FAILED", "FAILED", "CANCELLED"]},
+        "created_at": TIMESTAMP,
+        "completed_at": NULLABLE_TIMESTAMP,
+        "items": _array(_ref("BatchItem")),
+        "counts": {"type": "object", "additionalProperties": INTEGER},
+    }),
+    "SubmitBatchRequest": _object({
+        "jobs": dict(_array(FREE_FORM), description="Export or sync job specs, as the single-job endpoints take them"),
+        "defaults": dict(FREE_FORM, description="Fields every job takes unless its spec sets them"),
+        "username": STRING,
+        "name": STRING,
+    }, ["jobs"]),
+    "Webhook": _object({
+        "webhook_id": STRING,
+        "url": STRING,
+        "events": STRINGS,
+        "county_id": NULLABLE_STRING,
+        "sync_pair_id": NULLABLE_STRING,
+        "min_validation_failures": INTEGER,
+        "appeal_statuses": dict(STRINGS, nullable=True),
+        "description": NULLABLE_STRING,
+        "active": BOOLEAN,
+        "secret": dict(STRING, description="Signing secret; returned only when the webhook is created or its secret rotated"),
+        "created_by": STRING,
+        "created_at": TIMESTAMP,
+        "updated_at": NULLABLE_TIMESTAMP,
+    }),
+    "CreateWebhookRequest": _object({
+        "url": STRING,
+        "events": STRINGS,
+        "username": STRING,
+        "county_id": STRING,
+        "sync_pair_id": STRING,
+        "secret": dict(STRING, description="At least 16 characters; generated when omitted"),
+        "min_validation_failures": INTEGER,
+        "appeal_statuses": dict(STRINGS, description="Only send appeal.status_changed for appeals reaching these statuses"),
+        "description": STRING,
+    }, ["url", "events", "username"]),
+    "WebhookDelivery": _object({
+        "delivery_id": STRING,
+        "webhook_id": STRING,
+        "event": STRING,
+        "event_id": STRING,
+        "payload": FREE_FORM,
+        "status": {"type": "string", "enum": ["PENDING", "DELIVERED", "DEAD"]},
+        "attempt_count": INTEGER,
+        "attempts": _array(FREE_FORM),
+        "next_attempt_at": NULLABLE_TIMESTAMP,
+        "created_at": TIMESTAMP,
+        "delivered_at": NULLABLE_TIMESTAMP,
+    }),
+    "Alert": _object({
+        "alert_id": STRING,
+        "county_id": STRING,
+        "rule": STRING,
+        "rule_type": {"type": "string", "enum": ["job_failure", "validation_failure_rate", "connector_down",
+                                                  "stale_data", "freshness_slo"]},
+        "severity": {"type": "string", "enum": ["critical", "error", "warning", "info"]},
+        "subject": dict(STRING, description="Sync pair, connector (pair/side) or table (pair/table) alerted on"),
+        "sync_pair_id": NULLABLE_STRING,
+        "status": {"type": "string", "enum": ["PENDING", "FIRING", "RESOLVED"]},
+        "summary": STRING,
+        "details": FREE_FORM,
+        "link": NULLABLE_STRING,
+        "since": TIMESTAMP,
+        "fired_at": NULLABLE_TIMESTAMP,
+        "resolved_at": NULLABLE_TIMESTAMP,
+        "last_notified_at": NULLABLE_TIMESTAMP,
+        "occurrences": INTEGER,
+        "notifications": _array(FREE_FORM),
+        "updated_at": TIMESTAMP,
+    }),
+    "TableFreshness": _object({
+        "sync_pair_id": STRING,
+        "county_id": STRING,
+        "table": STRING,
+        "status": {"type": "string", "enum": ["met", "breached"]},
+        "age_seconds": dict(INTEGER, nullable=True,
+                            description="Since the stalest source's last sync; null when never synced"),
+        "slo_seconds": INTEGER,
+        "synced_at": NULLABLE_TIMESTAMP,
+        "refreshed_at": NULLABLE_TIMESTAMP,
+        "checked_at": TIMESTAMP,
+        "breaches": INTEGER,
+        "breach_seconds": INTEGER,
+        "attainment": dict(NUMBER, description="Fraction of the window the table met its objective"),
+    }),
+    "FreshnessReport": _object({
+        "since": TIMESTAMP,
+        "until": TIMESTAMP,
+        "days": NUMBER,
+        "datasets": _array(_object({
+            "sync_pair_id": STRING,
+            "county_id": STRING,
+            "status": {"type": "string", "enum": ["met", "breached"]},
+            "attainment": dict(NUMBER, description="Attainment of the dataset's least fresh table"),
+            "breaches": INTEGER,
+            "tables": _array(_ref("TableFreshness")),
+        })),
+        "worker": FREE_FORM,
+    }),
+    "FreshnessBreach": _object({
+        "breach_id": STRING,
+        "sync_pair_id": STRING,
+        "county_id": STRING,
+        "table": STRING,
+        "slo_seconds": INTEGER,
+        "synced_at": NULLABLE_TIMESTAMP,
+        "started_at": dict(TIMESTAMP, description="When the table passed its objective"),
+        "ended_at": dict(NULLABLE_TIMESTAMP, description="When a sync brought it back; null while open"),
+        "duration_seconds": dict(INTEGER, nullable=True),
+        "detected_at": TIMESTAMP,
+    }),
+    "LoadStatus": _object({
+        "job_types": {"type": "object", "additionalProperties": _object({
+            "in_flight": INTEGER,
+            "max_in_flight": INTEGER,
+            "pressure": dict(NUMBER, description="Share of the slots in use, or the memory pressure if higher"),
+            "retry_after_seconds": INTEGER,
+        })},
+        "memory": _object({
+            "rss_bytes": dict(INTEGER, nullable=True),
+            "limit_mb": dict(NUMBER, nullable=True),
+            "pressure": NUMBER,
+        }),
+        "shed_pressure": dict({"type": "object", "additionalProperties": NUMBER},
+                              description="Pressure from which work of each priority is refused"),
+        "sync_queue": FREE_FORM,
+        "sync_queue_max_waiting": INTEGER,
+    }),
+    "ApiKey": _object({
+        "key_id": STRING,
+        "prefix": dict(STRING, description="Start of the key, to recognize it by"),
+        "name": STRING,
+        "service": STRING,
+        "scopes": STRINGS,
+        "rate_limit_per_minute": INTEGER,
+        "status": {"type": "string", "enum": ["active", "expired", "revoked"]},
+        "county_id": NULLABLE_STRING,
+        "description": NULLABLE_STRING,
+        "allowed_ips": dict(STRINGS, nullable=True, description="Addresses and CIDR networks the key may be used from"),
+        "api_key": dict(STRING, description="The key itself; returned only when the key is created or rotated"),
+        "expires_at": NULLABLE_TIMESTAMP,
+        "replaces": NULLABLE_STRING,
+        "replaced_by": NULLABLE_STRING,
+        "created_by": STRING,
+        "created_at": TIMESTAMP,
+        "revoked_at": NULLABLE_TIMESTAMP,
+        "revoked_by": NULLABLE_STRING,
+        "last_used_at": NULLABLE_TIMESTAMP,
+        "last_used_ip": NULLABLE_STRING,
+        "last_used_path": NULLABLE_STRING,
+    }),
+    "CreateApiKeyRequest": _object({
+        "name": STRING,
+        "service": STRING,
+        "scopes": STRINGS,
+        "rate_limit_per_minute": INTEGER,
+        "expires_at": TIMESTAMP,
+        "county_id": STRING,
+        "description": STRING,
+        "allowed_ips": STRINGS,
+    }, ["name", "service", "scopes"]),
+    "RoleBinding": _object({
+        "binding_id": STRING,
+        "username": STRING,
+        "role": {"type": "string", "enum": ["viewer", "assessor", "operator", "admin"]},
+        "county_id": dict(STRING, description="County the role applies in; \"*\" for every county"),
+        "datasets": dict(STRINGS, description="Sync pairs of the county the role is limited to; empty for all"),
+        "created_by": STRING,
+        "created_at": TIMESTAMP,
+    }),
+    "RedactionPolicy": _object({
+        "name": STRING,
+        "fields": _array(_object({
+            "field": dict(STRING, description="Column name or fnmatch pattern"),
+            "mode": {"type": "string", "enum": ["remove", "mask", "hash"]},
+        })),
+        "mask": STRING,
+    }),
+    "RedactionSettings": _object({
+        "county_id": STRING,
+        "policies": _array(_ref("RedactionPolicy")),
+        "roles": dict(FREE_FORM, description="Policy of each access role, and of \"anonymous\" callers"),
+        "services": dict(FREE_FORM, description="Policy of each API key service"),
+        "applied": dict(STRINGS, description="Policies applied to the caller"),
+    }),
+    "CreateRoleBindingRequest": _object({
+        "username": STRING,
+        "role": {"type": "string", "enum": ["viewer", "assessor", "operator", "admin"]},
+        "county_id": STRING,
+        "datasets": STRINGS,
+    }, ["username", "role", "county_id"]),
+    "AuditEvent": _object({
+        "event_id": STRING,
+        "action": STRING,
+        "username": NULLABLE_STRING,
+        "resource_type": STRING,
+        "resource_id": NULLABLE_STRING,
+        "county_id": NULLABLE_STRING,
+        "details": FREE_FORM,
+        "created_at": TIMESTAMP,
+        "sequence": dict(INTEGER, description="Position in the audit hash chain"),
+        "previous_hash": STRING,
+        "hash": dict(STRING, description="SHA-256 of the event's canonical JSON without this field"),
+    }),
+    "AuditChainReport": _object({
+        "valid": BOOLEAN,
+        "entries": INTEGER,
+        "unchained_entries": dict(INTEGER, description="Events recorded before hash chaining"),
+        "first_sequence": dict(INTEGER, nullable=True),
+        "last_sequence": dict(INTEGER, nullable=True),
+        "anchors_checked": INTEGER,
+        "problem_count": INTEGER,
+        "problems": _array(_object({
+            "sequence": dict(INTEGER, nullable=True),
+            "problem": {"type": "string", "enum": [
+                "duplicate", "missing", "modified", "unlinked", "head_missing", "truncated", "head_mismatch",
+                "anchor_unreadable", "anchor_forged", "anchor_missing_event", "anchor_mismatch"]},
+            "detail": STRING,
+            "event_id": NULLABLE_STRING,
+        })),
+        "verified_at": TIMESTAMP,
+    }),
+    "ExportJobList": _listing("jobs", "ExportJob"),
+    "SyncJobList": _listing("jobs", "SyncJob"),
+    "SyncPairList": _listing("sync_pairs", "SyncPair", paged=False),
+    "SnapshotList": _listing("snapshots", "Snapshot"),
+    "DeadLetterList": _listing("dead_letters", "DeadLetter"),
+    "ConflictList": _listing("conflicts", "Conflict"),
+    "ScheduleList": _listing("schedules", "Schedule", paged=False),
+    "BatchList": _listing("batches", "Batch"),
+    "WebhookList": _listing("webhooks", "Webhook", paged=False),
+    "WebhookDeliveryList": _listing("deliveries", "WebhookDelivery"),
+    "AlertList": _listing("alerts", "Alert"),
+    "FreshnessBreachList": _listing("breaches", "FreshnessBreach"),
+    "ApiKeyList": _listing("api_keys", "ApiKey", paged=False),
+    "RoleBindingList": _listing("bindings", "RoleBinding", paged=False),
+    "AuditEventList": _listing("events", "AuditEvent"),
+}
+
+# Request and response schemas of operations in the latest version, by operation ID; "[Name]" is an array of Name
+OPERATION_MODELS = {
+    "health_check": (None, "HealthStatus"),
+    "readiness_check": (None, "ReadinessReport"),
+    "list_export_jobs": (None, "ExportJobList"),
+    "create_export_job": ("CreateExportJobRequest", "ExportJob"),
+    "get_export_job": (None, "ExportJob"),
+    "cancel_export_job": (None, "ExportJob"),
+    "deliver_export_job": (None, "ExportJob"),
+    "list_sync_pairs": (None, "SyncPairList"),
+    "list_sync_jobs": (None, "SyncJobList"),
+    "create_sync_job": ("CreateSyncJobRequest", "SyncJob"),
+    "get_sync_job": (None, "SyncJob"),
+    "pause_sync_job": (None, "SyncJob"),
+    "cancel_sync_job": (None, "SyncJob"),
+    "resume_sync_job": (None, "SyncJob"),
+    "rollback_sync_job": (None, "SyncJob"),
+    "list_sync_snapshots": (None, "SnapshotList"),
+    "get_sync_snapshot": (None, "Snapshot"),
+    "discard_sync_snapshot": (None, "Snapshot"),
+    "restore_sync_snapshot": (None, "Snapshot"),
+    "list_dead_letters": (None, "DeadLetterList"),
+    "get_dead_letter": (None, "DeadLetter"),
+    "discard_dead_letter": (None, "DeadLetter"),
+    "list_sync_schedules": (None, "ScheduleList"),
+    "get_sync_schedule": (None, "Schedule"),
+    "create_sync_schedule": (None, "Schedule"),
+    "pause_sync_schedule": (None, "Schedule"),
+    "resume_sync_schedule": (None, "Schedule"),
+    "list_sync_conflicts": (None, "ConflictList"),
+    "get_sync_conflict": (None, "Conflict"),
+    "resolve_sync_conflict": (None, "Conflict"),
+    "submit_job_batch": ("SubmitBatchRequest", "Batch"),
+    "list_job_batches": (None, "BatchList"),
+    "get_job_batch": (None, "Batch"),
+    "cancel_job_batch": (None, "Batch"),
+    "retry_job_batch": (None, "Batch"),
+    "ingest_sync_records": (None, "IngestResult"),
+    "list_webhooks": (None, "WebhookList"),
+    "create_webhook": ("CreateWebhookRequest", "Webhook"),
+    "get_webhook": (None, "Webhook"),
+    "update_webhook": (None, "Webhook"),
+    "rotate_webhook_secret": (None, "Webhook"),
+    "list_webhook_deliveries": (None, "WebhookDeliveryList"),
+    "get_webhook_delivery": (None, "WebhookDelivery"),
+    "redeliver_webhook": (None, "WebhookDelivery"),
+    "list_alerts": (None, "AlertList"),
+    "get_alert": (None, "Alert"),
+    "get_freshness_report": (None, "FreshnessReport"),
+    "get_load": (None, "LoadStatus"),
+    "list_freshness_breaches": (None, "FreshnessBreachList"),
+    "list_api_keys": (None, "ApiKeyList"),
+    "create_api_key": ("CreateApiKeyRequest", "ApiKey"),
+    "get_api_key": (None, "ApiKey"),
+    "revoke_api_key": (None, "ApiKey"),
+    "rotate_api_key": (None, "ApiKey"),
+    "list_role_bindings": (None, "RoleBindingList"),
+    "create_role_binding": ("CreateRoleBindingRequest", "RoleBinding"),
+    "delete_role_binding": (None, "RoleBinding"),
+    "get_redaction_policies": (None, "RedactionSettings"),
+    "list_audit_events": (None, "AuditEventList"),
+    "verify_audit_chain": (None, "AuditChainReport"),
+}
+
+# Operations whose request body is not JSON, and the content types they take
+RAW_REQUEST_BODIES = {
+    "ingest_sync_records": list(INGEST_FORMATS),
+}
+
+# Operations taking uploads as multipart form data, and the form fields they read
+MULTIPART_REQUEST_BODIES = {
+    "create_sync_import": _object({
+        "file": {"type": "string", "format": "binary", "description": "CSV (.csv, .txt) or Excel (.xlsx) file"},
+        "sheet": dict(STRING, description="Worksheet of an Excel file (the first otherwise)"),
+        "mapping": dict(STRING, description="JSON object of header to source column (null leaves a header out)"),
+        "username": dict(STRING, description="Uploader, when the request has no signed-in user"),
+    }, ["file"]),
+}
+
+# Schemas of operations that older versions answer differently (see api_versions.RESPONSE_SHIMS)
+VERSION_OPERATION_MODELS = {
+    "v1": {
+        "list_export_jobs": (None, "[ExportJob]"),
+        "list_sync_pairs": (None, "[SyncPair]"),
+        "list_sync_jobs": (None, "[SyncJob]"),
+    },
+}
+
+_RULE_PARAMETER = re.compile(r"<(?:(\w+):)?(\w+)>")
+_QUERY_GET = re.compile(r"request\.args\.get\(\s*['\"]([\w$.-]+)['\"]\s*(?:,\s*([^,)]+?))?\s*(?:,\s*type=(\w+))?\s*\)")
+_QUERY_LIST = re.compile(r"request\.args\.getlist\(\s*['\"]([\w$.-]+)['\"]")
+_QUERY_INT = re.compile(r"int\(\s*request\.args\.get\(\s*['\"]([\w$.-]+)['\"]")
+_ARGS_VARIABLE = re.compile(r"(\w+)\s*=\s*request\.args\s*$", re.MULTILINE)
+_BODY_VARIABLE = re.compile(r"(\w+)\s*=\s*request\.(?:json\b|get_json\()")
+_STATUS = re.compile(r"(?:\),|\belse|\bstatus=|_error\()\s*(\d{3})\b")
+_MIMETYPE = re.compile(r"mimetype=([\w.\"'/+-]+)")
+_HELPER_CALL = re.compile(r"\b(_\w+)\(")
+
+
+def _words(name: str) -> List[str]:
+    return [ACRONYMS.get(word, word) for word in re.split(r"[_\-\s]+", name) if word]
+
+
+def _camel(name: str) -> str:
+    words = re.split(r"[_\-]+", name)
+    return words[0] + "".join(ACRONYMS.get(word, word.capitalize()) for word in words[1:])
+
+
+def _summary(operation_id: str) -> str:
+    words = _words(operation_id)
+    text = " ".join(words)
+    return text[0].upper() + text[1:]
+
+
+def _tag(path: str) -> str:
+    segments = [s for s in path.split("/") if s and not s.startswith("<")]
+    if segments[:1] == ["api"]:
+        segments = segments[2:] if len(segments) > 1 and re.fullmatch(r"v\d+", segments[1]) else segments[1:]
+    if not segments or path in EXTRA_ROUTES:
+        return "System"
+    words = segments[:2] if segments[0] == "sync" and len(segments) > 1 else segments[:1]
+    return " ".join(w[0].upper() + w[1:] for word in words for w in _words(word.split(".")[0]))
+
+
+def _view_source(view) -> str:
+    """The source of a view function and of the module-level helpers it calls."""
+    try:
+        source = inspect.getsource(view)
+    except (OSError, TypeError):
+        return ""
+    helpers = []
+    for name in sorted(set(_HELPER_CALL.findall(source))):
+        helper = view.__globals__.get(name)
+        if inspect.isfunction(helper) and helper.__module__ == view.__module__:
+            try:
+                helpers.append(inspect.getsource(helper))
+            except (OSError, TypeError):
+                pass
+    return "\n".join([source] + helpers)
+
+
+def _query_parameters(source: str, method: str) -> List[Dict[str, Any]]:
+    parameters = {}
+    integers = set(_QUERY_INT.findall(source))
+    for name, default, type_name in _QUERY_GET.findall(source):
+        default = default.strip()
+        if default.startswith("type="):
+            default, type_name = "", default[len("type="):]
+        schema = dict(INTEGER) if type_name == "int" or name in integers else dict(STRING)
+        if re.fullmatch(r"-?\d+", default):
+            schema = {"type": "integer", "default": int(default)}
+        elif re.fullmatch(r"(['\"]).*\1", default) and default[1:-1]:
+            schema["default"] = default[1:-1]
+        parameters.setdefault(name, schema)
+    for name in _QUERY_LIST.findall(source):
+        parameters[name] = _array(STRING)
+    # Views serving GET and POST may read the same fields from either
+    for variable in _ARGS_VARIABLE.findall(source) if method == "GET" else []:
+        for pattern in (rf"\b{variable}\[\s*['\"](\w+)['\"]\s*\]", rf"\b{variable}\.get\(\s*['\"](\w+)['\"]"):
+            for name in re.findall(pattern, source):
+                parameters.setdefault(name, dict(STRING))
+    if "paginate_args(" in source:
+        parameters.pop("limit", None)
+        parameters["limit"] = {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}
+        parameters["cursor"] = dict(STRING, description="Cursor of the previous page (X-Next-Cursor)")
+        parameters["offset"] = dict(INTEGER, description="Items to skip (deprecated offset paging)")
+    result = []
+    for name, schema in parameters.items():
+        parameter = {"name": name, "in": "query", "required": False}
+        if "description" in schema:
+            parameter["description"] = schema.pop("description")
+        if name == "offset" and "paginate_args(" in source:
+            parameter["deprecated"] = True
+        parameter["schema"] = schema
+        result.append(parameter)
+    return result
+
+
+def _body_schema(source: str) -> Optional[Dict[str, Any]]:
+    """The request body a view reads: the fields it takes from request.get_json()."""
+    variables = list(dict.fromkeys(_BODY_VARIABLE.findall(source)))
+    if not variables:
+        return None
+    fields, required = [], []
+    for variable in variables:
+        for pattern in (rf"\b{variable}\[\s*['\"](\w+)['\"]\s*\]", rf"\b{variable}\.get\(\s*['\"](\w+)['\"]"):
+            for name in re.findall(pattern, source):
+                if name not in fields:
+                    fields.append(name)
+        for name in re.findall(rf"['\"](\w+)['\"]\s+not\s+in\s+{variable}\b", source):
+            required.append(name)
+    for listed in re.findall(r"(?:required_fields\s*=|for\s+field\s+in)\s*[\[(]([^\])]*)[\])]", source):
+        required.extend(re.findall(r"['\"](\w+)['\"]", listed))
+    for name in required:
+        if name not in fields:
+            fields.append(name)
+    return _object({name: {} for name in fields}, [name for name in fields if name in set(required)])
+
+
+def _responses(source: str, view_globals: Dict[str, Any], schema: Optional[Dict[str, Any]]) -> Dict[str, Any]:
+    success, errors = set(), set()
+    json_success = False
+    media_types = []
+    for line in source.splitlines():
+        line = line.strip()
+        if not line.startswith("return"):
+            continue
+        codes = {int(code) for code in _STATUS.findall(line)}
+        is_error = '"error"' in line or '"errors"' in line or "_error(" in line
+        if is_error:
+            errors.update(code for code in codes if code >= 400)
+            continue
+        if line.startswith(("return jsonify(", "return {", "return _paged(")):
+            json_success = True
+        success.update(code for code in codes if code < 400)
+        errors.update(code for code in codes if code >= 400)
+        if not codes and (line.startswith(("return jsonify(", "return {", "return _paged(")) or "Response(" in line):
+            success.add(200)
+    for value in _MIMETYPE.findall(source):
+        value = value.strip("\"'")
+        resolved = view_globals.get(value, value) if re.fullmatch(r"[A-Z_]+", value) else value
+        media_type = resolved if isinstance(resolved, str) and "/" in resolved else "application/octet-stream"
+        if media_type not in media_types:
+            media_types.append(media_type)
+    if "send_file(" in source and not media_types:
+        media_types.append("application/octet-stream")
+    # The helper of a streaming response is not a JSON body
+    if media_types and not json_success:
+        content = {media_type: {"schema": {"type": "string", "format": "binary"}} for media_type in media_types}
+    else:
+        content = {"application/json": {"schema": schema or FREE_FORM}}
+
+    responses = {}
+    for code in sorted(success or {200}):
+        responses[str(code)] = {"description": _SUCCESS_DESCRIPTIONS.get(code, "Success")}
+        if code not in (204, 304):
+            responses[str(code)]["content"] = content
+    for code in sorted(errors | {500}):
+        responses[str(code)] = {"$ref": f"#/components/responses/Error{code}"}
+    return responses
+
+
+def _model(reference: Optional[str]) -> Optional[Dict[str, Any]]:
+    if reference is None:
+        return None
+    if reference.startswith("["):
+        return _array(_ref(reference[1:-1]))
+    return _ref(reference)
+
+
+def _routes(flask_app, version: str) -> List[Tuple[str, str, str]]:
+    routes = []
+    for rule in flask_app.url_map.iter_rules():
+        path = rule.rule
+        if not (path.startswith(f"/api/{version}/") or path in EXTRA_ROUTES) or any(path.startswith(p) for p in EXCLUDED_PREFIXES):
+            continue
+        for method in sorted(rule.methods - {"HEAD", "OPTIONS"}):
+            routes.append((path, method, rule.endpoint))
+    return routes
+
+
+def build_spec(flask_app, version: str = LATEST_VERSION, server_url: str = "http://localhost:5000") -> Dict[str, Any]:
+    """
+    The OpenAPI document of one version of a Flask app's API routes.
+
+    Args:
+        flask_app: The gateway app
+        version: API version (see api_versions)
+        server_url: URL of the server the spec names
+
+    Returns:
+        OpenAPI 3 document
+    """
+    if version not in API_VERSIONS:
+        raise ValueError(f"Unknown API version {version}")
+    models = dict(OPERATION_MODELS, **VERSION_OPERATION_MODELS.get(version, {}))
+    endpoint_methods: Dict[str, int] = {}
+    routes = _routes(flask_app, version)
+    for _, _, endpoint in routes:
+        endpoint_methods[endpoint] = endpoint_methods.get(endpoint, 0) + 1
+
+    paths: Dict[str, Dict[str, Any]] = {}
+    request_schemas: Dict[str, Dict[str, Any]] = {}
+    tags: List[str] = []
+    for path, method, endpoint in sorted(routes):
+        view = flask_app.view_functions[endpoint]
+        operation_id = METHOD_OPERATION_IDS.get((endpoint, method))
+        if operation_id is None:
+            operation_id = endpoint if endpoint_methods[endpoint] == 1 else f"{endpoint}_{method.lower()}"
+        source = _view_source(view)
+        request_model, response_model = models.get(operation_id, (None, None))
+        tag = _tag(path)
+        if tag not in tags:
+            tags.append(tag)
+
+        parameters = []
+        for converter, name in _RULE_PARAMETER.findall(path):
+            schema = dict(INTEGER) if converter == "int" else dict(STRING)
+            parameters.append({"name": name, "in": "path", "required": True, "schema": schema})
+        parameters.extend(_query_parameters(source, method))
+
+        operation = {
+            "operationId": _camel(operation_id),
+            "summary": _summary(operation_id),
+            "tags": [tag],
+        }
+        deprecated = deprecation(version, endpoint)
+        if deprecated:
+            operation["deprecated"] = True
+            operation["description"] = f"Removed after {deprecated.sunset} (deprecated since {deprecated.since}); {deprecated.note}."
+            operation["x-sunset"] = deprecated.sunset
+        if parameters:
+            operation["parameters"] = parameters
+        if method in ("POST", "PUT", "PATCH"):
+            body = _model(request_model)
+            required = body is not None
+            if body is None:
+                inferred = _body_schema(source)
+                if inferred is not None:
+                    name = "".join(ACRONYMS.get(w, w.capitalize()) for w in operation_id.split("_")) + "Request"
+                    request_schemas[name] = inferred
+                    body = _ref(name)
+                    required = bool(inferred.get("required"))
+            if operation_id in RAW_REQUEST_BODIES:
+                operation["requestBody"] = {"required": True, "content": {
+                    content_type: {"schema": {"type": "string", "format": "binary"}}
+                    for content_type in RAW_REQUEST_BODIES[operation_id]
+                }}
+            elif operation_id in MULTIPART_REQUEST_BODIES:
+                operation["requestBody"] = {"required": True, "content": {
+                    "multipart/form-data": {"schema": MULTIPART_REQUEST_BODIES[operation_id]}
+                }}
+            elif body is not None:
+                operation["requestBody"] = {"required": required, "content": {"application/json": {"schema": body}}}
+        operation["responses"] = _responses(source, view.__globals__, _model(response_model))
+        paths.setdefault(_RULE_PARAMETER.sub(r"{\2}", path), {})[method.lower()] = operation
+
+    error_codes = sorted({int(ref["$ref"][-3:]) for item in paths.values() for op in item.values()
+                          for ref in op["responses"].values() if "$ref" in ref})
+    return {
+        "openapi": OPENAPI_VERSION,
+        "info": {
+            "title": "TerraFusion Platform API",
+            "description": f"Enterprise geospatial data synchronization platform for county government operations "
+                           f"(API {version}). Generated from the gateway routes by openapi_spec.py; do not edit by hand.",
+            "version": API_VERSION,
+            "contact": {"name": "TerraFusion Support", "email": "support@terrafusion.gov"},
+            "license": {"name": "Government Open Source", "url": "https://opensource.gov"},
+        },
+        "servers": [{"url": server_url, "description": "Development server"}],
+        "tags": [{"name": tag} for tag in tags],
+        "paths": paths,
+        "components": {
+            "schemas": dict(sorted({**SCHEMAS, **request_schemas}.items())),
+            "responses": {f"Error{code}": {"description": _ERROR_DESCRIPTIONS.get(code, "Error"),
+                                           "content": {"application/json": {"schema": _ref("Error")}}}
+                          for code in error_codes},
+            "securitySchemes": SECURITY_SCHEMES,
+        },
+        # Routes check their own callers; a key or token is optional at the gateway
+        "security": [{}] + [{name: []} for name in SECURITY_SCHEMES],
+    }
+
+
+def render(spec: Dict[str, Any]) -> str:
+    """The spec as committed: indented JSON with a trailing newline."""
+    return json.dumps(spec, indent=2) + "\n"
+
+
+def main():
+    parser = argparse.ArgumentParser(description="TerraFusion Platform OpenAPI Specification")
+    parser.add_argument("--check", action="store_true", help="Fail if the committed specs or Go clients are out of date")
+    parser.add_argument("--spec", default=SPEC_PATH, help="Where the latest version's spec is written")
+    args = parser.parse_args()
+
+    # Imported here: importing the app starts its services
+    from app import app as flask_app
+    import go_client
+
+    files = {}
+    for version in API_VERSIONS:
+        spec = build_spec(flask_app, version)
+        root, extension = os.path.splitext(args.spec)
+        files[args.spec if version == LATEST_VERSION else f"{root}.{version}{extension}"] = render(spec)
+        files.update(go_client.render(spec))
+
+    stale = []
+    for path, content in files.items():
+        current = None
+        if os.path.exists(path):
+            with open(path) as f:
+                current = f.read()
+        if current == content:
+            continue
+        stale.append(path)
+        if not args.check:
+            os.makedirs(os.path.dirname(path) or ".", exist_ok=True)
+            with open(path, "w") as f:
+                f.write(content)
+    if args.check:
+        if stale:
+            print(f"Out of date (run python openapi_spec.py): {', '.join(stale)}")
+            sys.exit(1)
+        print("OpenAPI spec and Go client are up to date")
+    else:
+        print(f"Wrote {len(stale)} of {len(files)} files" if stale else "Nothing to update")
+
+
+if __name__ == "__main__":
+    main()
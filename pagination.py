@@ -0,0 +1,199 @@
+"""
+TerraFusion Platform - Pagination
+
+This module provides the cursor pagination of the API's list endpoints
+(jobs, batches, audit events, dead letters, conflicts, snapshots, webhook
+deliveries). Items are ordered by a stable sort key, a timestamp with the
+item's ID as tie-breaker, and a page ends with an opaque cursor holding the
+key of its last item:
+
+    GET /api/v1/sync/jobs?limit=50
+    GET /api/v1/sync/jobs?limit=50&cursor=eyJ2IjpbIjIwMjYtMDEtMTVUMTA6...
+
+The next page starts after that key rather than after a count of items, so
+jobs created while a client pages through the list neither repeat nor push
+items off the end, and a deep page costs no more than the first. A cursor is
+bound to the listing and filters it was issued for; reusing it with other
+filters is an error. The next cursor comes back in the X-Next-Cursor header
+and a Link: <...>; rel="next" header (and in the body's "next_cursor" where
+the body is an object); the last page has none.
+
+?offset=N paging is still accepted, with a Deprecation header on the
+response, while PAGINATION_OFFSET_ENABLED is true; set it to false to turn
+it off once clients have moved to cursors.
+"""
+
+import os
+import json
+import base64
+import hashlib
+import logging
+from urllib.parse import urlencode
+from typing import Dict, List, Any, Optional, Callable, Mapping, Tuple
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Offset paging (deprecated) is accepted while this is true
+OFFSET_PAGING_ENABLED = os.environ.get("PAGINATION_OFFSET_ENABLED", "true").lower() == "true"
+
+DEFAULT_PAGE_SIZE = 100
+
+# Largest page a client may ask for
+MAX_PAGE_SIZE = 1000
+
+# Query parameters that move through a listing rather than define it
+PAGING_PARAMETERS = {"cursor", "limit", "offset"}
+
+
+class CursorError(ValueError):
+    """Raised for a malformed cursor, or one issued for another listing."""
+
+
+def scope_of(listing: str, filters: Mapping[str, Any]) -> str:
+    """A short fingerprint of a listing and its filters, which its cursors carry."""
+    text = json.dumps([listing, sorted((k, str(v)) for k, v in filters.items() if k not in PAGING_PARAMETERS)])
+    return hashlib.sha256(text.encode("utf-8")).hexdigest()[:16]
+
+
+def encode_cursor(position: Dict[str, Any], scope: str) -> str:
+    """An opaque cursor for a position in a listing."""
+    payload = json.dumps(dict(position, s=scope), separators=(",", ":"), default=str)
+    return base64.urlsafe_b64encode(payload.encode("utf-8")).decode("ascii").rstrip("=")
+
+
+def decode_cursor(cursor: str, scope: str) -> Dict[str, Any]:
+    """
+    The position a cursor holds.
+
+    Raises:
+        CursorError: If the cursor is malformed or belongs to another listing
+    """
+    try:
+        padded = cursor + "=" * (-len(cursor) % 4)
+        position = json.loads(base64.urlsafe_b64decode(padded.encode("ascii")).decode("utf-8"))
+    except (ValueError, UnicodeError):
+        raise CursorError("Invalid cursor")
+    if not isinstance(position, dict):
+        raise CursorError("Invalid cursor")
+    if position.pop("s", None) != scope:
+        raise CursorError("The cursor was issued for a different listing or filters; start again without it")
+    return position
+
+
+def page_size(value: Any, default: int = DEFAULT_PAGE_SIZE, maximum: int = MAX_PAGE_SIZE) -> int:
+    """
+    A requested page size, capped at maximum.
+
+    Raises:
+        ValueError: If the value is not a positive integer
+    """
+    if value is None or value == "":
+        return default
+    try:
+        size = int(value)
+    except (TypeError, ValueError):
+        raise ValueError("limit must be a positive integer")
+    if size < 1:
+        raise ValueError("limit must be a positive integer")
+    return min(size, maximum)
+
+
+def check_offset(value: Any) -> Optional[int]:
+    """
+    A requested offset (deprecated offset paging).
+
+    Raises:
+        ValueError: If offset paging is turned off or the value is not a non-negative integer
+    """
+    if value is None or value == "":
+        return None
+    if not OFFSET_PAGING_ENABLED:
+        raise ValueError("Offset paging has been turned off; page with the cursor of the previous page")
+    try:
+        offset = int(value)
+    except (TypeError, ValueError):
+        raise ValueError("offset must be a non-negative integer")
+    if offset < 0:
+        raise ValueError("offset must be a non-negative integer")
+    return offset
+
+
+class Page:
+    """One page of a listing and where the next one starts."""
+
+    def __init__(self, items: List[Any], next_cursor: Optional[str], offset_mode: bool = False):
+        self.items = items
+        self.next_cursor = next_cursor
+        self.offset_mode = offset_mode
+
+    def headers(self, url: str, args: Mapping[str, Any]) -> Dict[str, str]:
+        """Response headers pointing at the next page."""
+        headers = {}
+        if self.offset_mode:
+            headers["Deprecation"] = "true"
+        if self.next_cursor:
+            query = {k: v for k, v in args.items() if k not in ("cursor", "offset")}
+            query["cursor"] = self.next_cursor
+            headers["X-Next-Cursor"] = self.next_cursor
+            headers["Link"] = f'<{url}?{urlencode(query)}>; rel="next"'
+        return headers
+
+
+def paginate(items: List[Dict[str, Any]], key: Callable[[Dict[str, Any]], Tuple], limit: int,
+             cursor: Optional[str] = None, offset: Optional[int] = None, scope: str = "",
+             descending: bool = True) -> Page:
+    """
+    One page of a list of items, ordered by a stable sort key.
+
+    Args:
+        items: Every item of the listing, in any order
+        key: Sort key of an item, a tuple of strings whose last part is unique (the item's ID)
+        limit: Page size
+        cursor: Cursor of the previous page
+        offset: Items to skip (deprecated offset paging)
+        scope: Fingerprint of the listing (see scope_of)
+        descending: Newest first
+
+    Raises:
+        CursorError: If the cursor is invalid
+        ValueError: If both a cursor and an offset are given
+    """
+    if cursor and offset is not None:
+        raise ValueError("Give either cursor or offset, not both")
+    ordered = sorted(items, key=key, reverse=descending)
+    if offset is not None:
+        page = ordered[offset:offset + limit]
+        more = len(ordered) > offset + limit
+        # Offset callers get a cursor too, so they can switch mid-listing
+        return Page(page, encode_cursor({"v": list(key(page[-1]))}, scope) if more and page else None, True)
+    if cursor:
+        after = decode_cursor(cursor, scope).get("v")
+        if not isinstance(after, list):
+            raise CursorError("Invalid cursor")
+        after = tuple(after)
+        try:
+            ordered = [item for item in ordered if (key(item) < after if descending else key(item) > after)]
+        except TypeError:
+            raise CursorError("Invalid cursor")
+    page = ordered[:limit]
+    more = len(ordered) > limit
+    return Page(page, encode_cursor({"v": list(key(page[-1]))}, scope) if more else None)
+
+
+def paginate_args(items: List[Dict[str, Any]], key: Callable[[Dict[str, Any]], Tuple], listing: str,
+                  args: Mapping[str, Any], default_limit: int = DEFAULT_PAGE_SIZE, descending: bool = True) -> Page:
+    """
+    A page of a listing as asked for by a request's query parameters (limit, cursor, offset).
+
+    Raises:
+        ValueError: If a paging parameter or the cursor is invalid
+    """
+    return paginate(items, key, page_size(args.get("limit"), default_limit), args.get("cursor") or None,
+                    check_offset(args.get("offset")), scope_of(listing, args), descending)
+
+
+def sort_key(time_field: str, id_field: str) -> Callable[[Dict[str, Any]], Tuple[str, str]]:
+    """The stable sort key of items with a timestamp and an ID field."""
+    return lambda item: (item.get(time_field) or "", str(item.get(id_field) or ""))
@@ -7,6 +7,7 @@ enabling county IT staff to manage user permissions through a web interface.
 
 import os
 import jwt
+import json
 import hashlib
 import secrets
 from datetime import datetime, timedelta
@@ -16,9 +17,27 @@ from flask import request, jsonify, session
 import logging
 import psycopg2
 from psycopg2.extras import RealDictCursor
+from ldap_auth import LDAPAuthenticator, LDAPAuthError, LDAPUnavailableError
+from oidc_auth import OIDCAuthenticator, OIDCAuthError, OIDCUnavailableError
+import mfa
 
 logger = logging.getLogger(__name__)
 
+# Authentication backends: rbac_users passwords, LDAP / Active Directory, or OpenID Connect single sign-on
+AUTH_BACKENDS = ('local', 'ldap', 'oidc')
+
+# Seconds before retrying an SSO session check the provider could not answer
+SSO_RETRY_SECONDS = 60
+
+# Minutes an access token (the JWT) lasts; clients renew it with their refresh token
+ACCESS_TOKEN_MINUTES = int(os.environ.get('AUTH_ACCESS_TOKEN_MINUTES', '15'))
+
+# Hours a session lasts from login, however often its tokens are refreshed
+SESSION_HOURS = int(os.environ.get('AUTH_SESSION_HOURS', '24'))
+
+# Refusal of enrollment with a login's mfa_token when a second factor is already in force
+MFA_ENROLLED_ERROR = 'A second factor is already enrolled; verify with it, or sign in to enroll a new device'
+
 # RBAC Configuration
 RBAC_ROLES = {
     'admin': {
@@ -53,6 +72,9 @@ RBAC_ROLES = {
     }
 }
 
+def _token_hash(token: str) -> str:
+    return hashlib.sha256(token.encode()).hexdigest()
+
 class RBACManager:
     """
     Role-Based Access Control Manager for TerraFusion Platform.
@@ -62,6 +84,14 @@ class RBACManager:
     - County-based access control
     - JWT token generation and validation
     - Audit logging for all changes
+    - LDAP / Active Directory logins (AUTH_BACKEND=ldap) or OpenID Connect
+      single sign-on (AUTH_BACKEND=oidc), with a local break-glass account
+      (AUTH_BREAK_GLASS_USERNAME) for directory outages
+    - TOTP second factors with backup codes, required of the roles in
+      MFA_REQUIRED_ROLES (see mfa)
+    - Short-lived access tokens renewed with single-use refresh tokens; a
+      refresh token used twice ends its session, and revoked access tokens
+      are refused until they expire (rbac_revoked_tokens)
     """
     
     def __init__(self):
@@ -69,7 +99,14 @@ class RBACManager:
         self.db_url = os.environ.get('DATABASE_URL')
         self.jwt_secret = os.environ.get('JWT_SECRET', self._generate_jwt_secret())
         self.jwt_algorithm = 'HS256'
-        self.token_expiry_hours = 24
+        self.access_token_minutes = ACCESS_TOKEN_MINUTES
+        self.session_hours = SESSION_HOURS
+        self.auth_backend = os.environ.get('AUTH_BACKEND', 'local').lower()
+        if self.auth_backend not in AUTH_BACKENDS:
+            raise ValueError(f"AUTH_BACKEND must be one of {', '.join(AUTH_BACKENDS)}")
+        self.ldap = LDAPAuthenticator() if self.auth_backend == 'ldap' else None
+        self.oidc = OIDCAuthenticator() if self.auth_backend == 'oidc' else None
+        self.break_glass_username = (os.environ.get('AUTH_BREAK_GLASS_USERNAME') or '').strip().lower() or None
         
     def _generate_jwt_secret(self) -> str:
         """Generate a secure JWT secret if none exists."""
@@ -100,6 +137,12 @@ class RBACManager:
                         )
                     """)
                     
+                    # Directory users are provisioned on first login and have no local password
+                    cur.execute("""
+                        ALTER TABLE rbac_users
+                        ADD COLUMN IF NOT EXISTS auth_source VARCHAR(16) NOT NULL DEFAULT 'local'
+                    """)
+                    
                     # Create rbac_audit_log table
                     cur.execute("""
                         CREATE TABLE IF NOT EXISTS rbac_audit_log (
@@ -130,6 +173,59 @@ class RBACManager:
                         )
                     """)
                     
+                    # SSO sessions keep the provider's refresh token, redeemed when its access token lapses
+                    cur.execute("""
+                        ALTER TABLE rbac_sessions
+                        ADD COLUMN IF NOT EXISTS idp_refresh_token TEXT,
+                        ADD COLUMN IF NOT EXISTS idp_expires_at TIMESTAMP
+                    """)
+                    
+                    # Sessions are renewed with refresh tokens; access_jti is the current access token's ID
+                    cur.execute("""
+                        ALTER TABLE rbac_sessions
+                        ADD COLUMN IF NOT EXISTS access_jti VARCHAR(64),
+                        ADD COLUMN IF NOT EXISTS refreshed_at TIMESTAMP,
+                        ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP,
+                        ADD COLUMN IF NOT EXISTS revoked_reason VARCHAR(32)
+                    """)
+                    
+                    # Refresh tokens, by hash; a used one is kept so its reuse can be caught
+                    cur.execute("""
+                        CREATE TABLE IF NOT EXISTS rbac_refresh_tokens (
+                            token_hash VARCHAR(64) PRIMARY KEY,
+                            session_id INTEGER NOT NULL REFERENCES rbac_sessions(id) ON DELETE CASCADE,
+                            issued_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                            used_at TIMESTAMP
+                        )
+                    """)
+                    
+                    # Access tokens revoked before they expire; entries are dropped once they would have
+                    cur.execute("""
+                        CREATE TABLE IF NOT EXISTS rbac_revoked_tokens (
+                            jti VARCHAR(64) PRIMARY KEY,
+                            user_id INTEGER,
+                            reason VARCHAR(32),
+                            revoked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                            expires_at TIMESTAMP NOT NULL
+                        )
+                    """)
+                    
+                    # TOTP second factors; pending_secret is an enrollment awaiting its first code
+                    cur.execute("""
+                        CREATE TABLE IF NOT EXISTS rbac_mfa (
+                            user_id INTEGER PRIMARY KEY REFERENCES rbac_users(id) ON DELETE CASCADE,
+                            secret VARCHAR(64),
+                            pending_secret VARCHAR(64),
+                            confirmed_at TIMESTAMP,
+                            last_step BIGINT,
+                            backup_salt VARCHAR(64),
+                            backup_code_hashes JSONB NOT NULL DEFAULT '[]',
+                            failed_attempts INTEGER NOT NULL DEFAULT 0,
+                            locked_until TIMESTAMP,
+                            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+                        )
+                    """)
+                    
                     conn.commit()
                     logger.info("RBAC tables initialized successfully")
                     
@@ -339,7 +435,7 @@ class RBACManager:
             with self.get_db_connection() as conn:
                 with conn.cursor() as cur:
                     query = """
-                        SELECT id, username, email, role, county_id, is_active, 
+                        SELECT id, username, email, role, county_id, is_active, auth_source,
                                created_at, updated_at, last_login
                         FROM rbac_users
                         WHERE 1=1
@@ -372,6 +468,12 @@ class RBACManager:
         """
         Authenticate user credentials and generate JWT token.
         
+        With AUTH_BACKEND=ldap only directory credentials are accepted, and with
+        AUTH_BACKEND=oidc users sign in at the identity provider instead (see
+        begin_sso_login), except for the break-glass account, which always
+        signs in with its local password so administrators keep access when the
+        directory is down.
+        
         Args:
             username: Username or email
             password: Plain text password
@@ -380,6 +482,12 @@ class RBACManager:
             Dictionary with authentication result
         """
         try:
+            if self.ldap is not None and not self._is_break_glass(username):
+                return self._authenticate_directory_user(username, password)
+            if self.oidc is not None and not self._is_break_glass(username):
+                return {'success': False, 'error': 'Passwords are not accepted; sign in with single sign-on',
+                        'sso_login_url': '/api/v1/rbac/sso/login'}
+            
             with self.get_db_connection() as conn:
                 with conn.cursor() as cur:
                     # Find user by username or email
@@ -396,56 +504,607 @@ class RBACManager:
                     user = dict(user_row)
                     
                     # Verify password
-                    if not self._verify_password(password, user['password_hash']):
+                    if not user['password_hash'] or not self._verify_password(password, user['password_hash']):
                         return {'success': False, 'error': 'Invalid credentials'}
                     
-                    # Generate JWT token
-                    token = self._generate_jwt_token(user)
-                    session_token = secrets.token_urlsafe(32)
+                    result = self._finish_login(cur, user)
+                    conn.commit()
+            
+            if self.auth_backend != 'local':
+                logger.warning(f"Break-glass account {username} signed in with its local password")
+                self._log_audit_action('break_glass_login', target_user_id=user['id'], target_username=user['username'])
+            logger.info(f"User authenticated: {username}")
+            return result
                     
-                    # Create session record
-                    expires_at = datetime.utcnow() + timedelta(hours=self.token_expiry_hours)
+        except Exception as e:
+            logger.error(f"Authentication failed for {username}: {e}")
+            return {'success': False, 'error': 'Authentication failed'}
+    
+    def _authenticate_directory_user(self, username: str, password: str) -> Dict:
+        """
+        Authenticate against LDAP / Active Directory and start a session.
+        
+        The directory user is provisioned in rbac_users on first login, and
+        their role and email are refreshed from the directory on every login;
+        deactivating the local record still blocks them. The county
+        restriction is managed locally and is left as it is.
+        """
+        try:
+            directory_user = self.ldap.authenticate(username, password)
+        except LDAPAuthError as e:
+            logger.info(f"Directory login refused for {username}: {e}")
+            return {'success': False, 'error': 'Invalid credentials'}
+        except LDAPUnavailableError as e:
+            logger.error(f"Directory unavailable for login of {username}: {e}")
+            return {'success': False, 'error': 'Directory service unavailable'}
+        
+        return self._sign_in_directory_user(directory_user, 'ldap', {'dn': directory_user['dn']})
+    
+    def begin_sso_login(self, return_to: str = None) -> Dict:
+        """
+        Start a single sign-on login (AUTH_BACKEND=oidc).
+        
+        Returns:
+            Dictionary with the provider's authorization_url and the pending
+            login to keep in the browser's session until complete_sso_login
+        """
+        if self.oidc is None:
+            return {'success': False, 'error': 'Single sign-on is not enabled (AUTH_BACKEND=oidc)'}
+        try:
+            return dict(self.oidc.begin(return_to), success=True)
+        except OIDCUnavailableError as e:
+            logger.error(f"Identity provider unavailable for login: {e}")
+            return {'success': False, 'error': 'Identity provider unavailable'}
+    
+    def complete_sso_login(self, pending: Dict, code: str, state: str) -> Dict:
+        """
+        Finish a single sign-on login from the provider's redirect and start a session.
+        
+        SSO users are provisioned like directory users; the provider's refresh
+        token is kept with the session so verify_token can check with the
+        provider, each time its access token lapses, that they still have access.
+        """
+        if self.oidc is None:
+            return {'success': False, 'error': 'Single sign-on is not enabled (AUTH_BACKEND=oidc)'}
+        try:
+            identity = self.oidc.complete(pending, code, state)
+        except OIDCAuthError as e:
+            logger.info(f"SSO login refused: {e}")
+            return {'success': False, 'error': str(e)}
+        except OIDCUnavailableError as e:
+            logger.error(f"Identity provider unavailable for login: {e}")
+            return {'success': False, 'error': 'Identity provider unavailable'}
+        if mfa.mfa_required(identity['role']) and not mfa.MFA_AMR_VALUES & set(identity.get('amr') or []):
+            # The provider's own second factor stands in for TOTP, but it has to report one
+            logger.warning(f"SSO login of {identity['username']} refused: {identity['role']} needs MFA at the provider")
+            return {'success': False, 'error': 'Multi-factor authentication at the identity provider is required'}
+        result = self._sign_in_directory_user(identity, 'oidc', {'subject': identity['subject']}, identity)
+        if result.get('success'):
+            result['return_to'] = (pending or {}).get('return_to')
+        return result
+    
+    def _sign_in_directory_user(self, directory_user: Dict, source: str, provenance: Dict,
+                                identity: Dict = None) -> Dict:
+        """
+        Provision or refresh the rbac_users record of a directory or SSO user and start a session.
+        
+        Local accounts, the break-glass account among them, are never taken
+        over: a directory or SSO identity with the same username is refused.
+        
+        Args:
+            directory_user: The authenticator's user (username, email, role)
+            source: auth_source of the record, 'ldap' or 'oidc'
+            provenance: Where the user came from, for the provisioning audit entry
+            identity: The SSO identity, whose refresh token is kept with the session
+        """
+        username = directory_user['username']
+        if directory_user['role'] not in RBAC_ROLES:
+            logger.error(f"{source.upper()}_GROUP_ROLE_MAP grants unknown role {directory_user['role']} to {username}")
+            return {'success': False, 'error': 'Authentication failed'}
+        email = directory_user['email'] or f"{username}@directory.invalid"
+        if self._is_break_glass(username):
+            return self._refuse_local_takeover(username, source, provenance)
+        
+        with self.get_db_connection() as conn:
+            with conn.cursor() as cur:
+                cur.execute("""
+                    INSERT INTO rbac_users (username, email, role, auth_source)
+                    VALUES (%s, %s, %s, %s)
+                    ON CONFLICT (username) DO UPDATE
+                    SET email = EXCLUDED.email, role = EXCLUDED.role, auth_source = EXCLUDED.auth_source,
+                        updated_at = CURRENT_TIMESTAMP
+                    WHERE rbac_users.auth_source <> 'local'
+                    RETURNING id, username, email, role, county_id, is_active, (xmax = 0) AS created
+                """, (username, email, directory_user['role'], source))
+                
+                row = cur.fetchone()
+                if row is None:
+                    # The username belongs to a local account, which the upsert left alone
+                    return self._refuse_local_takeover(username, source, provenance)
+                user = dict(row)
+                if not user['is_active']:
+                    conn.commit()
+                    return {'success': False, 'error': 'Invalid credentials'}
+                
+                result = self._finish_login(cur, user, identity)
+                conn.commit()
+        
+        if user.pop('created'):
+            self._log_audit_action(
+                'user_provisioned',
+                target_user_id=user['id'],
+                target_username=user['username'],
+                details=dict(provenance, role=user['role'], source=source)
+            )
+        logger.info(f"Directory user authenticated: {user['username']} as {user['role']} ({source})")
+        return result
+    
+    def _refuse_local_takeover(self, username: str, source: str, provenance: Dict) -> Dict:
+        """Refuse a directory or SSO sign-in naming a local account, and audit it."""
+        logger.warning(f"{source.upper()} identity {username} matches a local account; sign-in refused")
+        self._log_audit_action('directory_login_refused', target_username=username,
+                               details=dict(provenance, source=source, reason='local account'))
+        return {'success': False, 'error': 'Authentication failed'}
+    
+    def _finish_login(self, cur, user: Dict, identity: Dict = None) -> Dict:
+        """
+        Start the session of a user whose password checked out, or challenge them for their second factor.
+        
+        Users with a TOTP enrolled, and users whose role requires MFA, get an
+        mfa_token instead of a session: verify_mfa exchanges it with a code for
+        the session, and users who are not enrolled yet can enroll with it
+        (enroll_mfa, confirm_mfa). SSO logins are checked by the provider instead.
+        """
+        if identity is not None:
+            return self._start_session(cur, user, identity)
+        cur.execute("SELECT confirmed_at FROM rbac_mfa WHERE user_id = %s", (user['id'],))
+        row = cur.fetchone()
+        enrolled = bool(row and row['confirmed_at'])
+        if not enrolled and not mfa.mfa_required(user['role']):
+            return self._start_session(cur, user)
+        return {
+            'success': False,
+            'mfa_required': True,
+            'enrollment_required': not enrolled,
+            'mfa_token': self._generate_mfa_token(user),
+            'error': 'Enter the code from your authenticator app' if enrolled
+                     else f"The {user['role']} role requires multi-factor authentication; enroll an authenticator app",
+        }
+    
+    def _generate_mfa_token(self, user: Dict) -> str:
+        """A short-lived token naming a user who passed their first factor; it opens no session."""
+        payload = {
+            'typ': 'mfa',
+            'user_id': user['id'],
+            'username': user['username'],
+            'iat': datetime.utcnow(),
+            'exp': datetime.utcnow() + timedelta(seconds=mfa.CHALLENGE_SECONDS),
+        }
+        return jwt.encode(payload, self.jwt_secret, algorithm=self.jwt_algorithm)
+    
+    def mfa_challenge_user(self, mfa_token: str) -> Optional[Dict]:
+        """The user_id and username of a login's mfa_token; None when it is invalid or expired."""
+        try:
+            payload = jwt.decode(mfa_token, self.jwt_secret, algorithms=[self.jwt_algorithm])
+        except jwt.InvalidTokenError:
+            return None
+        if payload.get('typ') != 'mfa':
+            return None
+        return {'id': payload['user_id'], 'username': payload['username']}
+    
+    def verify_mfa(self, mfa_token: str, code: str) -> Dict:
+        """
+        Finish a login with a TOTP or backup code.
+        
+        Args:
+            mfa_token: The login's mfa_token
+            code: Code from the authenticator app, or an unused backup code
+        
+        Returns:
+            The login response of authenticate_user, with the session
+        """
+        challenge = self.mfa_challenge_user(mfa_token or '')
+        if challenge is None:
+            return {'success': False, 'error': 'Login expired; sign in again'}
+        try:
+            with self.get_db_connection() as conn:
+                with conn.cursor() as cur:
                     cur.execute("""
-                        INSERT INTO rbac_sessions (user_id, session_token, jwt_token, expires_at, ip_address)
-                        VALUES (%s, %s, %s, %s, %s)
-                        RETURNING id
-                    """, (user['id'], session_token, token, expires_at, request.remote_addr if request else None))
-                    
-                    session_id = cur.fetchone()['id']
-                    
-                    # Update last login
+                        SELECT m.*, u.username, u.email, u.role, u.county_id
+                        FROM rbac_mfa m JOIN rbac_users u ON u.id = m.user_id
+                        WHERE m.user_id = %s AND u.is_active = TRUE AND m.confirmed_at IS NOT NULL
+                        FOR UPDATE
+                    """, (challenge['id'],))
+                    row = cur.fetchone()
+                    if not row:
+                        return {'success': False, 'error': 'Multi-factor authentication is not enrolled'}
+                    state = dict(row)
+                    method = self._check_second_factor(cur, state, code)
+                    if method is None:
+                        conn.commit()
+                        return {'success': False, 'error': self._mfa_refusal(state)}
+                    user = {'id': state['user_id'], 'username': state['username'], 'email': state['email'],
+                            'role': state['role'], 'county_id': state['county_id']}
+                    result = self._start_session(cur, user)
+                    conn.commit()
+        except Exception as e:
+            logger.error(f"MFA verification failed for {challenge['username']}: {e}")
+            return {'success': False, 'error': 'Authentication failed'}
+        
+        if method == 'backup_code':
+            self._log_audit_action('mfa_backup_code_used', target_user_id=user['id'], target_username=user['username'],
+                                   details={'remaining': len(state['backup_code_hashes'])})
+        logger.info(f"User authenticated with second factor ({method}): {user['username']}")
+        return result
+    
+    def _check_second_factor(self, cur, state: Dict, code: str, allow_backup: bool = True) -> Optional[str]:
+        """
+        Check a code against a user's rbac_mfa row, recording the outcome.
+        Failed codes count towards the lockout whatever they were for.
+        
+        Returns:
+            'totp' or 'backup_code' when the code is accepted, else None
+        """
+        if state['locked_until'] and state['locked_until'] > datetime.utcnow():
+            return None
+        method = None
+        step = mfa.verify_totp(state['secret'], code, state['last_step'])
+        if step is not None:
+            method = 'totp'
+            state['last_step'] = step
+        elif allow_backup:
+            remaining = mfa.use_backup_code(code, state['backup_salt'] or '', state['backup_code_hashes'] or [])
+            if remaining is not None:
+                method = 'backup_code'
+                state['backup_code_hashes'] = remaining
+        if method is None:
+            state['failed_attempts'] += 1
+            if state['failed_attempts'] >= mfa.MAX_FAILED_ATTEMPTS:
+                state['locked_until'] = datetime.utcnow() + timedelta(minutes=mfa.LOCKOUT_MINUTES)
+                state['failed_attempts'] = 0
+                logger.warning(f"Second factor of {state['username']} locked after "
+                               f"{mfa.MAX_FAILED_ATTEMPTS} failed codes")
+                self._log_audit_action('mfa_locked', target_user_id=state['user_id'], target_username=state['username'])
+        else:
+            state['failed_attempts'] = 0
+            state['locked_until'] = None
+        cur.execute("""
+            UPDATE rbac_mfa
+            SET last_step = %s, backup_code_hashes = %s, failed_attempts = %s, locked_until = %s,
+                updated_at = CURRENT_TIMESTAMP
+            WHERE user_id = %s
+        """, (state['last_step'], json.dumps(state['backup_code_hashes'] or []), state['failed_attempts'],
+              state['locked_until'], state['user_id']))
+        return method
+    
+    @staticmethod
+    def _mfa_confirmed(cur, user_id: int) -> bool:
+        cur.execute("SELECT 1 FROM rbac_mfa WHERE user_id = %s AND confirmed_at IS NOT NULL", (user_id,))
+        return cur.fetchone() is not None
+    
+    @staticmethod
+    def _mfa_refusal(state: Dict) -> str:
+        if state['locked_until'] and state['locked_until'] > datetime.utcnow():
+            return f"Too many failed codes; try again after {state['locked_until'].isoformat()}Z"
+        return 'Invalid code'
+    
+    def enroll_mfa(self, user: Dict, at_login: bool = False) -> Dict:
+        """
+        Start TOTP enrollment, or re-enrollment of a new device; the current
+        factor, if any, stays in force until confirm_mfa checks a code from it.
+        
+        Args:
+            user: The enrolling user (id, username)
+            at_login: Whether the user holds only a login's mfa_token; then only a first enrollment is allowed
+        
+        Returns:
+            Dictionary with secret, otpauth_uri and qr_code (a PNG data: URI; None without qrcode)
+        """
+        secret = mfa.new_secret()
+        with self.get_db_connection() as conn:
+            with conn.cursor() as cur:
+                if at_login and self._mfa_confirmed(cur, user['id']):
+                    return {'success': False, 'error': MFA_ENROLLED_ERROR}
+                cur.execute("""
+                    INSERT INTO rbac_mfa (user_id, pending_secret) VALUES (%s, %s)
+                    ON CONFLICT (user_id) DO UPDATE
+                    SET pending_secret = EXCLUDED.pending_secret, updated_at = CURRENT_TIMESTAMP
+                """, (user['id'], secret))
+                conn.commit()
+        uri = mfa.provisioning_uri(secret, user['username'])
+        return {'success': True, 'secret': secret, 'otpauth_uri': uri, 'qr_code': mfa.qr_code(uri)}
+    
+    def confirm_mfa(self, user: Dict, code: str, current_code: Optional[str] = None,
+                    start_session: bool = False) -> Dict:
+        """
+        Finish enrollment with a first code from the new secret, and issue backup codes.
+        
+        Args:
+            user: The enrolling user (id, username)
+            code: Code from the authenticator app
+            current_code: Code from the device already enrolled, needed to replace it
+            start_session: Sign the user in too, for enrollment during a login (with its mfa_token);
+                only a first enrollment may be confirmed this way
+        
+        Returns:
+            Dictionary with backup_codes (shown only now) and, with start_session, the login response
+        """
+        with self.get_db_connection() as conn:
+            with conn.cursor() as cur:
+                cur.execute("""
+                    SELECT m.*, u.username FROM rbac_mfa m JOIN rbac_users u ON u.id = m.user_id
+                    WHERE m.user_id = %s FOR UPDATE
+                """, (user['id'],))
+                row = cur.fetchone()
+                if not row or not row['pending_secret']:
+                    return {'success': False, 'error': 'No enrollment in progress; start one first'}
+                state = dict(row)
+                if state['confirmed_at'] is not None:
+                    # A login's password alone must not replace the device it is waiting for
+                    if start_session:
+                        return {'success': False, 'error': MFA_ENROLLED_ERROR}
+                    if not current_code:
+                        return {'success': False, 'error': 'A code from the enrolled device is needed to replace it'}
+                    if self._check_second_factor(cur, state, current_code, allow_backup=False) is None:
+                        conn.commit()
+                        return {'success': False, 'error': self._mfa_refusal(state)}
+                step = mfa.verify_totp(state['pending_secret'], code)
+                if step is None:
+                    # Keeps the current code's step used, so it cannot be replayed
+                    conn.commit()
+                    return {'success': False, 'error': 'Invalid code'}
+                salt = secrets.token_hex(16)
+                backup = mfa.new_backup_codes(salt)
+                cur.execute("""
+                    UPDATE rbac_mfa
+                    SET secret = pending_secret, pending_secret = NULL, confirmed_at = CURRENT_TIMESTAMP,
+                        last_step = %s, backup_salt = %s, backup_code_hashes = %s, failed_attempts = 0,
+                        locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+                    WHERE user_id = %s
+                """, (step, salt, json.dumps(backup['hashes']), user['id']))
+                result = {'success': True, 'backup_codes': backup['codes']}
+                if start_session:
                     cur.execute("""
-                        UPDATE rbac_users 
-                        SET last_login = CURRENT_TIMESTAMP
-                        WHERE id = %s
+                        SELECT id, username, email, role, county_id FROM rbac_users WHERE id = %s AND is_active = TRUE
                     """, (user['id'],))
-                    
+                    user_row = cur.fetchone()
+                    if not user_row:
+                        return {'success': False, 'error': 'Invalid credentials'}
+                    result.update(self._start_session(cur, dict(user_row)))
+                conn.commit()
+        self._log_audit_action('mfa_enrolled', target_user_id=user['id'], target_username=user['username'])
+        logger.info(f"User enrolled a second factor: {user['username']}")
+        return result
+    
+    def regenerate_backup_codes(self, user: Dict, code: str) -> Dict:
+        """Replace a user's backup codes, after checking a current TOTP code."""
+        with self.get_db_connection() as conn:
+            with conn.cursor() as cur:
+                cur.execute("""
+                    SELECT m.*, u.username FROM rbac_mfa m JOIN rbac_users u ON u.id = m.user_id
+                    WHERE m.user_id = %s AND m.confirmed_at IS NOT NULL FOR UPDATE
+                """, (user['id'],))
+                row = cur.fetchone()
+                if not row:
+                    return {'success': False, 'error': 'Multi-factor authentication is not enrolled'}
+                state = dict(row)
+                # Only a code from the device may replace the backup codes
+                if self._check_second_factor(cur, state, code, allow_backup=False) is None:
                     conn.commit()
-                    
-                    logger.info(f"User authenticated: {username}")
-                    return {
-                        'success': True,
-                        'token': token,
-                        'session_token': session_token,
-                        'session_id': session_id,
-                        'user': {
-                            'id': user['id'],
-                            'username': user['username'],
-                            'email': user['email'],
-                            'role': user['role'],
-                            'county_id': user['county_id'],
-                            'permissions': RBAC_ROLES.get(user['role'], {}).get('permissions', [])
-                        }
-                    }
-                    
+                    return {'success': False, 'error': self._mfa_refusal(state)}
+                salt = secrets.token_hex(16)
+                backup = mfa.new_backup_codes(salt)
+                cur.execute("""
+                    UPDATE rbac_mfa SET backup_salt = %s, backup_code_hashes = %s, updated_at = CURRENT_TIMESTAMP
+                    WHERE user_id = %s
+                """, (salt, json.dumps(backup['hashes']), user['id']))
+                conn.commit()
+        self._log_audit_action('mfa_backup_codes_regenerated', target_user_id=user['id'],
+                               target_username=user['username'])
+        return {'success': True, 'backup_codes': backup['codes']}
+    
+    def mfa_status(self, user: Dict) -> Dict:
+        """Whether a user has a second factor, whether their role requires one, and their backup codes left."""
+        with self.get_db_connection() as conn:
+            with conn.cursor() as cur:
+                cur.execute("SELECT * FROM rbac_mfa WHERE user_id = %s", (user['id'],))
+                row = cur.fetchone()
+        enrolled = bool(row and row['confirmed_at'])
+        return {
+            'enrolled': enrolled,
+            'required': mfa.mfa_required(user.get('role')),
+            'enrolled_at': row['confirmed_at'].isoformat() if enrolled else None,
+            'enrollment_pending': bool(row and row['pending_secret']),
+            'backup_codes_remaining': len(row['backup_code_hashes'] or []) if enrolled else 0,
+            'locked_until': row['locked_until'].isoformat() if row and row['locked_until'] else None,
+        }
+    
+    def reset_mfa(self, user_id: int, admin_user_id: int = None) -> Dict:
+        """Remove a user's second factor (a lost device without backup codes); they enroll again at next login."""
+        with self.get_db_connection() as conn:
+            with conn.cursor() as cur:
+                cur.execute("""
+                    DELETE FROM rbac_mfa m USING rbac_users u
+                    WHERE m.user_id = %s AND u.id = m.user_id
+                    RETURNING u.username
+                """, (user_id,))
+                row = cur.fetchone()
+                conn.commit()
+        if not row:
+            return {'success': False, 'error': 'User has no second factor'}
+        self._log_audit_action('mfa_reset', target_user_id=user_id, target_username=row['username'],
+                               admin_user_id=admin_user_id)
+        logger.info(f"Second factor of {row['username']} reset")
+        return {'success': True}
+    
+    def _is_break_glass(self, username: str) -> bool:
+        """Whether a login names the local break-glass account."""
+        return bool(self.break_glass_username) and (username or '').strip().lower() == self.break_glass_username
+    
+    def _start_session(self, cur, user: Dict, identity: Dict = None) -> Dict:
+        """Record the session and last login, issue its first tokens, and build the login response."""
+        session_token = secrets.token_urlsafe(32)
+        idp_refresh_token = identity.get('refresh_token') if identity else None
+        idp_expires_at = datetime.utcfromtimestamp(identity['expires_at']) if idp_refresh_token else None
+        
+        # Create session record
+        expires_at = datetime.utcnow() + timedelta(hours=self.session_hours)
+        cur.execute("""
+            INSERT INTO rbac_sessions (user_id, session_token, expires_at, ip_address,
+                                       idp_refresh_token, idp_expires_at)
+            VALUES (%s, %s, %s, %s, %s, %s)
+            RETURNING id
+        """, (user['id'], session_token, expires_at, request.remote_addr if request else None,
+              idp_refresh_token, idp_expires_at))
+        
+        session_id = cur.fetchone()['id']
+        tokens = self._issue_tokens(cur, user, session_id)
+        
+        # Update last login
+        cur.execute("""
+            UPDATE rbac_users 
+            SET last_login = CURRENT_TIMESTAMP
+            WHERE id = %s
+        """, (user['id'],))
+        
+        return {
+            'success': True,
+            'token': tokens['token'],
+            'refresh_token': tokens['refresh_token'],
+            'expires_in': tokens['expires_in'],
+            'session_token': session_token,
+            'session_id': session_id,
+            'user': {
+                'id': user['id'],
+                'username': user['username'],
+                'email': user['email'],
+                'role': user['role'],
+                'county_id': user['county_id'],
+                'permissions': RBAC_ROLES.get(user['role'], {}).get('permissions', [])
+            }
+        }
+    
+    def _issue_tokens(self, cur, user: Dict, session_id: int) -> Dict:
+        """A new access token and refresh token for a session."""
+        jti = secrets.token_urlsafe(16)
+        token = self._generate_jwt_token(user, session_id, jti)
+        refresh_token = secrets.token_urlsafe(48)
+        cur.execute("INSERT INTO rbac_refresh_tokens (token_hash, session_id) VALUES (%s, %s)",
+                    (_token_hash(refresh_token), session_id))
+        cur.execute("""
+            UPDATE rbac_sessions SET jwt_token = %s, access_jti = %s, refreshed_at = CURRENT_TIMESTAMP
+            WHERE id = %s
+        """, (token, jti, session_id))
+        return {'token': token, 'refresh_token': refresh_token, 'expires_in': self.access_token_minutes * 60}
+    
+    def refresh_session(self, refresh_token: str) -> Dict:
+        """
+        Exchange a refresh token for a new access token and refresh token.
+        
+        Each refresh token works once. Presenting one that was already used
+        (a copy was stolen, or a client kept an old one) ends the session, so
+        whichever of the thief and the owner refreshes second is signed out.
+        
+        Returns:
+            Dictionary with token, refresh_token and expires_in
+        """
+        try:
+            with self.get_db_connection() as conn:
+                with conn.cursor() as cur:
+                    cur.execute("""
+                        SELECT rt.session_id, rt.used_at, s.is_active AS session_active, s.expires_at,
+                               u.id, u.username, u.email, u.role, u.county_id, u.is_active
+                        FROM rbac_refresh_tokens rt
+                        JOIN rbac_sessions s ON s.id = rt.session_id
+                        JOIN rbac_users u ON u.id = s.user_id
+                        WHERE rt.token_hash = %s
+                        FOR UPDATE OF rt, s
+                    """, (_token_hash(refresh_token or ''),))
+                    row = cur.fetchone()
+                    if not row:
+                        return {'success': False, 'error': 'Invalid refresh token'}
+                    row = dict(row)
+                    if row['used_at'] is not None:
+                        revoked = self._revoke_sessions(cur, 'id = %s', (row['session_id'],), 'refresh_token_reused')
+                        conn.commit()
+                        if revoked:
+                            logger.warning(f"Refresh token of {row['username']} reused; session {row['session_id']} ended")
+                            self._log_audit_action('refresh_token_reused', target_user_id=row['id'],
+                                                   target_username=row['username'],
+                                                   details={'session_id': row['session_id']})
+                        return {'success': False, 'error': 'Invalid refresh token'}
+                    if not row['session_active'] or not row['is_active'] or row['expires_at'] <= datetime.utcnow():
+                        return {'success': False, 'error': 'Session has ended; sign in again'}
+                    cur.execute("UPDATE rbac_refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE token_hash = %s",
+                                (_token_hash(refresh_token),))
+                    tokens = self._issue_tokens(cur, row, row['session_id'])
+                    conn.commit()
+            return dict(tokens, success=True, session_id=row['session_id'])
         except Exception as e:
-            logger.error(f"Authentication failed for {username}: {e}")
-            return {'success': False, 'error': 'Authentication failed'}
+            logger.error(f"Token refresh failed: {e}")
+            return {'success': False, 'error': 'Token refresh failed'}
+    
+    def logout(self, token: str) -> Dict:
+        """End the session of an access token."""
+        try:
+            payload = jwt.decode(token, self.jwt_secret, algorithms=[self.jwt_algorithm])
+        except jwt.InvalidTokenError:
+            return {'success': False, 'error': 'Invalid or expired token'}
+        if not payload.get('sid'):
+            return {'success': False, 'error': 'Invalid or expired token'}
+        with self.get_db_connection() as conn:
+            with conn.cursor() as cur:
+                self._revoke_sessions(cur, 'id = %s AND user_id = %s', (payload['sid'], payload['user_id']), 'logout')
+                conn.commit()
+        return {'success': True}
+    
+    def revoke_user_sessions(self, user_id: int, admin_user_id: int = None, reason: str = 'admin') -> Dict:
+        """
+        End every session of a user at once: their refresh tokens stop working and
+        their access tokens are refused from the next request.
+        
+        Returns:
+            Dictionary with the number of sessions ended
+        """
+        with self.get_db_connection() as conn:
+            with conn.cursor() as cur:
+                cur.execute("SELECT username FROM rbac_users WHERE id = %s", (user_id,))
+                user_row = cur.fetchone()
+                if not user_row:
+                    return {'success': False, 'error': 'User not found'}
+                revoked = self._revoke_sessions(cur, 'user_id = %s', (user_id,), reason)
+                conn.commit()
+        self._log_audit_action('sessions_revoked', target_user_id=user_id, target_username=user_row['username'],
+                               admin_user_id=admin_user_id, details={'sessions': revoked, 'reason': reason})
+        logger.info(f"Ended {revoked} sessions of {user_row['username']}")
+        return {'success': True, 'sessions_revoked': revoked}
+    
+    def _revoke_sessions(self, cur, where: str, params: Tuple, reason: str) -> int:
+        """End the active sessions matching a condition and list their access tokens as revoked."""
+        cur.execute(f"""
+            UPDATE rbac_sessions
+            SET is_active = FALSE, revoked_at = CURRENT_TIMESTAMP, revoked_reason = %s
+            WHERE is_active = TRUE AND {where}
+            RETURNING id, user_id, access_jti
+        """, (reason,) + tuple(params))
+        sessions = cur.fetchall()
+        expires_at = datetime.utcnow() + timedelta(minutes=self.access_token_minutes)
+        for revoked in sessions:
+            if revoked['access_jti']:
+                cur.execute("""
+                    INSERT INTO rbac_revoked_tokens (jti, user_id, reason, expires_at) VALUES (%s, %s, %s, %s)
+                    ON CONFLICT (jti) DO NOTHING
+                """, (revoked['access_jti'], revoked['user_id'], reason, expires_at))
+        cur.execute("DELETE FROM rbac_revoked_tokens WHERE expires_at < CURRENT_TIMESTAMP")
+        return len(sessions)
     
     def verify_token(self, token: str) -> Optional[Dict]:
         """
         Verify JWT token and return user information.
         
+        The token's session must still be active and the token itself not
+        revoked (rbac_revoked_tokens).
+        
         Args:
             token: JWT token to verify
             
@@ -455,27 +1114,37 @@ class RBACManager:
         try:
             payload = jwt.decode(token, self.jwt_secret, algorithms=[self.jwt_algorithm])
             
-            # Check if token is expired
-            if datetime.utcnow().timestamp() > payload.get('exp', 0):
+            # Check if token is expired; login challenge tokens (mfa_token) have no session
+            if datetime.utcnow().timestamp() > payload.get('exp', 0) or not payload.get('sid'):
                 return None
             
             # Verify session is still active
             with self.get_db_connection() as conn:
                 with conn.cursor() as cur:
                     cur.execute("""
-                        SELECT u.id, u.username, u.email, u.role, u.county_id, u.is_active
+                        SELECT u.id, u.username, u.email, u.role, u.county_id, u.is_active,
+                               s.id AS session_id, s.idp_refresh_token, s.idp_expires_at
                         FROM rbac_users u
                         JOIN rbac_sessions s ON u.id = s.user_id
-                        WHERE u.id = %s AND s.jwt_token = %s 
+                        WHERE u.id = %s AND s.id = %s
                         AND s.is_active = TRUE AND s.expires_at > CURRENT_TIMESTAMP
                         AND u.is_active = TRUE
-                    """, (payload.get('user_id'), token))
+                        AND NOT EXISTS (SELECT 1 FROM rbac_revoked_tokens r WHERE r.jti = %s)
+                    """, (payload.get('user_id'), payload.get('sid'), payload.get('jti')))
                     
                     user_row = cur.fetchone()
                     if not user_row:
                         return None
                     
                     user = dict(user_row)
+                    session_id = user.pop('session_id')
+                    idp_refresh_token = user.pop('idp_refresh_token')
+                    idp_expires_at = user.pop('idp_expires_at')
+                    if idp_refresh_token and self.oidc is not None and idp_expires_at <= datetime.utcnow():
+                        if not self._refresh_sso_session(cur, user, session_id, idp_refresh_token):
+                            conn.commit()
+                            return None
+                        conn.commit()
                     user['permissions'] = RBAC_ROLES.get(user['role'], {}).get('permissions', [])
                     return user
                     
@@ -485,6 +1154,42 @@ class RBACManager:
             logger.error(f"Token verification failed: {e}")
             return None
     
+    def _refresh_sso_session(self, cur, user: Dict, session_id: int, refresh_token: str) -> bool:
+        """
+        Check with the identity provider that an SSO user still has access, once its access token lapses.
+        
+        A refused refresh (the user was disabled, signed out everywhere or left
+        every mapped group) ends the session; a changed group mapping updates
+        the user's role. While the provider cannot be reached the session is
+        kept and the check retried after SSO_RETRY_SECONDS.
+        
+        Returns:
+            Whether the session is still valid
+        """
+        try:
+            identity = self.oidc.refresh(refresh_token)
+        except OIDCUnavailableError as e:
+            logger.warning(f"Could not check the SSO session of {user['username']}; retrying later: {e}")
+            cur.execute("UPDATE rbac_sessions SET idp_expires_at = %s WHERE id = %s",
+                        (datetime.utcnow() + timedelta(seconds=SSO_RETRY_SECONDS), session_id))
+            return True
+        except OIDCAuthError as e:
+            logger.info(f"Ending the SSO session of {user['username']}: {e}")
+            cur.execute("UPDATE rbac_sessions SET is_active = FALSE WHERE id = %s", (session_id,))
+            self._log_audit_action('sso_session_ended', target_user_id=user['id'], target_username=user['username'],
+                                   details={'reason': str(e)})
+            return False
+        
+        cur.execute("UPDATE rbac_sessions SET idp_refresh_token = %s, idp_expires_at = %s WHERE id = %s",
+                    (identity['refresh_token'], datetime.utcfromtimestamp(identity['expires_at']), session_id))
+        if identity['role'] and identity['role'] in RBAC_ROLES and identity['role'] != user['role']:
+            cur.execute("UPDATE rbac_users SET role = %s, updated_at = CURRENT_TIMESTAMP WHERE id = %s",
+                        (identity['role'], user['id']))
+            self._log_audit_action('role_changed', target_user_id=user['id'], target_username=user['username'],
+                                   details={'from': user['role'], 'to': identity['role'], 'source': 'oidc'})
+            user['role'] = identity['role']
+        return True
+    
     def _hash_password(self, password: str) -> str:
         """Hash password using SHA256 with salt."""
         salt = secrets.token_hex(32)
@@ -498,15 +1203,17 @@ class RBACManager:
         except ValueError:
             return False
     
-    def _generate_jwt_token(self, user: Dict) -> str:
-        """Generate JWT token for user."""
+    def _generate_jwt_token(self, user: Dict, session_id: int, jti: str) -> str:
+        """Generate an access token of a session."""
         payload = {
             'user_id': user['id'],
             'username': user['username'],
             'role': user['role'],
             'county_id': user['county_id'],
+            'sid': session_id,
+            'jti': jti,
             'iat': datetime.utcnow(),
-            'exp': datetime.utcnow() + timedelta(hours=self.token_expiry_hours)
+            'exp': datetime.utcnow() + timedelta(minutes=self.access_token_minutes)
         }
         return jwt.encode(payload, self.jwt_secret, algorithm=self.jwt_algorithm)
     
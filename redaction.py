@@ -0,0 +1,310 @@
+"""
+TerraFusion Platform - Field Redaction
+
+This module provides the redaction policies that keep owner names, mailing
+addresses and other personal fields from consumers that must not see them,
+such as public open data feeds. A county lists its policies in the
+"redaction" block of its configuration, with the access roles (see
+access_control) and API key services each one applies to:
+
+    "redaction": {
+        "policies": {
+            "public": {"fields": ["owner_name", "owner_address", "mail_*"]},
+            "partner": {"fields": {"owner_phone": "mask", "owner_name": "hash"}}
+        },
+        "roles": {"anonymous": "public", "viewer": "public"},
+        "services": {"county-gis-viewer": "partner"}
+    }
+
+A policy's fields are column names or fnmatch patterns, matched without
+regard to case. Each is redacted in the policy's "mode" (or its own, when
+fields is an object): "remove" drops it, "mask" replaces its value with
+"mask" (REDACTED by default) and "hash" with a keyed SHA-256 of it, so
+records can still be matched up without showing the value. When several
+policies name a field the strongest mode wins (remove, then mask, then
+hash).
+
+A caller's policy is that of its highest role in the county ("anonymous"
+for unauthenticated requests); API keys go by their service, and roles and
+services not listed see every field. Export delivery targets and open data
+datasets name the policy their files and rows get with "redaction". The
+same policies are applied everywhere: to the features of export files,
+parcel reports and map tiles, to published open data rows, and to every
+object key of the API's JSON responses.
+"""
+
+import os
+import json
+import hmac
+import hashlib
+import fnmatch
+import logging
+import threading
+from typing import Dict, List, Any, Optional, Iterable, Iterator
+
+from access_control import ALL, ACCESS_ROLES
+from county_overrides import load_county_config, config_version, county_config_path
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Redaction modes, from strongest to weakest
+MODES = ["remove", "mask", "hash"]
+
+DEFAULT_MODE = "remove"
+DEFAULT_MASK = "REDACTED"
+
+# Role of unauthenticated callers in the roles mapping
+ANONYMOUS_ROLE = "anonymous"
+
+# Key of hashed values; set it so hashes cannot be matched against guessed names
+HASH_KEY = os.environ.get("REDACTION_HASH_KEY", "")
+
+# Hex digits kept of a hashed value
+HASH_LENGTH = 16
+
+
+class RedactionPolicy:
+    """One named policy of a county: the fields it redacts and how."""
+
+    def __init__(self, name: str, definition: Dict[str, Any]):
+        """
+        Parse a policy definition.
+
+        Raises:
+            ValueError: If the definition is invalid
+        """
+        if not isinstance(definition, dict):
+            raise ValueError(f"Redaction policy {name} must be an object")
+        mode = definition.get("mode", DEFAULT_MODE)
+        fields = definition.get("fields")
+        if isinstance(fields, list):
+            fields = {field: mode for field in fields}
+        if not isinstance(fields, dict) or not fields:
+            raise ValueError(f"Redaction policy {name} needs fields, a list of columns or an object of modes")
+        for field, field_mode in fields.items():
+            if field_mode not in MODES:
+                raise ValueError(f"Redaction policy {name}: unsupported mode {field_mode} of {field}. "
+                                 f"Supported modes: {', '.join(MODES)}")
+        self.name = name
+        self.fields = {field.lower(): field_mode for field, field_mode in fields.items()}
+        self.mask = definition.get("mask", DEFAULT_MASK)
+
+    def mode_of(self, field: str) -> Optional[str]:
+        """How the policy redacts a field; None when it leaves it alone."""
+        field = field.lower()
+        if field in self.fields:
+            return self.fields[field]
+        matched = [mode for pattern, mode in self.fields.items() if fnmatch.fnmatchcase(field, pattern)]
+        return min(matched, key=MODES.index) if matched else None
+
+    def to_dict(self) -> Dict[str, Any]:
+        # Fields as values, not keys, so API responses do not redact their own policies
+        return {"name": self.name, "fields": [{"field": field, "mode": mode} for field, mode in self.fields.items()],
+                "mask": self.mask}
+
+
+def hash_value(value: Any) -> str:
+    """The keyed hash a "hash" field's value is replaced with."""
+    text = value if isinstance(value, str) else json.dumps(value, sort_keys=True, default=str)
+    return hmac.new(HASH_KEY.encode(), text.encode(), hashlib.sha256).hexdigest()[:HASH_LENGTH]
+
+
+class Redactor:
+    """
+    Applies a set of policies to records, features and JSON bodies.
+
+    A redactor without policies leaves everything as it is.
+    """
+
+    def __init__(self, policies: Iterable[RedactionPolicy] = ()):
+        self.policies = list({p.name: p for p in policies}.values())
+        self._modes: Dict[str, Optional[Any]] = {}
+
+    @property
+    def active(self) -> bool:
+        return bool(self.policies)
+
+    @property
+    def names(self) -> List[str]:
+        return sorted(p.name for p in self.policies)
+
+    def _rule(self, field: str) -> Optional[Any]:
+        """The (mode, mask) a field gets; None when no policy names it."""
+        if field not in self._modes:
+            rules = [(p.mode_of(field), p.mask) for p in self.policies]
+            rules = [rule for rule in rules if rule[0] is not None]
+            self._modes[field] = min(rules, key=lambda rule: MODES.index(rule[0])) if rules else None
+        return self._modes[field]
+
+    def redacts(self, field: str) -> bool:
+        return self._rule(field) is not None
+
+    def record(self, record: Dict[str, Any]) -> Dict[str, Any]:
+        """A copy of a flat record with its redacted fields removed, masked or hashed."""
+        if not self.policies:
+            return record
+        redacted = {}
+        for field, value in record.items():
+            rule = self._rule(field) if isinstance(field, str) else None
+            if rule is None:
+                redacted[field] = value
+            elif rule[0] == "mask":
+                redacted[field] = rule[1] if value is not None else None
+            elif rule[0] == "hash":
+                redacted[field] = hash_value(value) if value is not None else None
+        return redacted
+
+    def features(self, features: Iterable[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+        """Features (see gis_features) with their properties redacted."""
+        for feature in features:
+            if self.policies and feature.get("properties"):
+                feature = dict(feature, properties=self.record(feature["properties"]))
+            yield feature
+
+    def body(self, value: Any) -> Any:
+        """A JSON value with every object key a policy names redacted, at any depth."""
+        if not self.policies:
+            return value
+        if isinstance(value, dict):
+            return {k: self.body(v) for k, v in self.record(value).items()}
+        if isinstance(value, list):
+            return [self.body(item) for item in value]
+        return value
+
+
+class RedactingReader:
+    """A LayerReader (see gis_features) whose features come back redacted, for parcel reports."""
+
+    def __init__(self, reader, redactor: Redactor):
+        self.reader = reader
+        self.redactor = redactor
+
+    def read(self, *args, **kwargs) -> Iterator[Dict[str, Any]]:
+        return self.redactor.features(self.reader.read(*args, **kwargs))
+
+    def lookup(self, *args, **kwargs) -> Iterator[Dict[str, Any]]:
+        return self.redactor.features(self.reader.lookup(*args, **kwargs))
+
+    def __getattr__(self, name: str) -> Any:
+        return getattr(self.reader, name)
+
+
+class RedactionSettings:
+    """The parsed "redaction" block of one county."""
+
+    def __init__(self, county_id: str, definition: Optional[Dict[str, Any]]):
+        """
+        Raises:
+            ValueError: If the block is invalid
+        """
+        definition = definition or {}
+        self.county_id = county_id
+        self.policies = {name: RedactionPolicy(name, policy)
+                         for name, policy in (definition.get("policies") or {}).items()}
+        self.roles = dict(definition.get("roles") or {})
+        self.services = dict(definition.get("services") or {})
+        unknown_roles = sorted(set(self.roles) - set(ACCESS_ROLES) - {ANONYMOUS_ROLE})
+        if unknown_roles:
+            raise ValueError(f"County {county_id}: redaction names unknown roles: {', '.join(unknown_roles)}")
+        for name in list(self.roles.values()) + list(self.services.values()):
+            if name is not None:
+                self.policy(name)
+
+    def policy(self, name: str) -> RedactionPolicy:
+        """
+        Raises:
+            ValueError: If the county has no such policy
+        """
+        if name not in self.policies:
+            raise ValueError(f"County {self.county_id} has no redaction policy {name}. "
+                             f"Policies: {', '.join(self.policies) or 'none'}")
+        return self.policies[name]
+
+    def policy_for(self, principal) -> Optional[RedactionPolicy]:
+        """The policy of a caller (an access_control Principal, or None for anonymous ones)."""
+        if principal is None:
+            name = self.roles.get(ANONYMOUS_ROLE)
+        elif principal.kind == "service" and principal.name.split(":", 1)[-1] in self.services:
+            name = self.services[principal.name.split(":", 1)[-1]]
+        else:
+            name = self.roles.get(principal.role_in(self.county_id))
+        return self.policies.get(name) if name else None
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {
+            "county_id": self.county_id,
+            "policies": [p.to_dict() for p in self.policies.values()],
+            "roles": self.roles,
+            "services": self.services,
+        }
+
+
+class RedactionPolicies:
+    """
+    Service class for the counties' redaction settings.
+
+    Settings are read from the county configuration files and reloaded when
+    a file changes.
+    """
+
+    def __init__(self, config_dir: str = "county_configs"):
+        self.config_dir = config_dir
+        self._settings: Dict[str, Any] = {}
+        self._lock = threading.Lock()
+
+    def settings(self, county_id: str) -> RedactionSettings:
+        """
+        The redaction settings of a county; empty when it has none.
+
+        Raises:
+            ValueError: If its redaction block is invalid
+        """
+        path = county_config_path(self.config_dir, county_id)
+        if path is None:
+            return RedactionSettings(county_id, None)
+        version = config_version(path)
+        with self._lock:
+            cached = self._settings.get(path)
+        if cached is not None and cached[0] == version:
+            return cached[1]
+        settings = RedactionSettings(county_id, load_county_config(path).get("redaction"))
+        with self._lock:
+            self._settings[path] = (version, settings)
+        return settings
+
+    def counties(self) -> List[str]:
+        """The counties with a configuration file."""
+        if not os.path.isdir(self.config_dir):
+            return []
+        return sorted(name for name in os.listdir(self.config_dir) if county_config_path(self.config_dir, name))
+
+    def for_principal(self, principal, county_ids: Optional[Iterable[str]] = None) -> Redactor:
+        """
+        The redactor of a caller's view of some counties' data.
+
+        Args:
+            principal: The caller (an access_control Principal), None when anonymous
+            county_ids: Counties the data may come from; every configured county when none are given
+
+        Raises:
+            ValueError: If a county's redaction block is invalid, so nothing is shown unredacted
+        """
+        county_ids = [c for c in (county_ids or []) if c and c != ALL] or self.counties()
+        policies = [self.settings(county_id).policy_for(principal) for county_id in dict.fromkeys(county_ids)]
+        return Redactor(policy for policy in policies if policy is not None)
+
+    def named(self, county_id: str, names: Iterable[str]) -> Redactor:
+        """
+        The redactor of named policies of a county.
+
+        Raises:
+            ValueError: If a policy is not configured
+        """
+        settings = self.settings(county_id)
+        return Redactor(settings.policy(name) for name in names)
+
+
+# Create a singleton instance
+redaction_policies = RedactionPolicies()
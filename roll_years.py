@@ -0,0 +1,293 @@
+"""
+TerraFusion SyncService - Assessment Roll Years
+
+This module versions the staging tables of a sync pair by assessment roll
+year (the 2025 roll, the 2026 roll). Sync pairs opt in with a "roll_years"
+block in the county configuration:
+
+    "roll_years": {
+        "current_year": 2026,
+        "tables": ["dbo.property", "dbo.property_val", "dbo.owner"],
+        "year_table": "{table}_{year}"
+    }
+
+The staging tables always hold the open roll, the year syncs load; every
+job records the roll year it loaded (roll_year), and so does the lineage of
+each record it wrote (see sync_lineage). Rolling over certifies the open
+roll: each year-versioned table is copied into a table of its own for the
+year (parcels_2026 from parcels, named by year_table), and the next year
+opens in the staging tables, starting from the certified roll's records.
+Certified years are not synced again.
+
+    POST /api/v1/sync/pairs/benton_wa_pacs_staging/roll-years/rollover
+    {"username": "assessor", "to_year": 2027}
+
+A roll-over is refused while jobs of the sync pair are pending or running,
+so no sync writes to the tables while they are copied. current_year is the
+open year until the first roll-over; after it the state store's is used.
+
+Any year can then be read: GIS exports take parameters.roll_year (see
+gis_export) and record streams ?roll_year= (see sync_streams); the open
+year, or no year, reads the staging tables and a certified year its own.
+"""
+
+import re
+import logging
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+from sync_store import DocumentStore, sync_state_store
+from sync_connectors import create_connector
+from audit_log import AuditLog, audit_log
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection of each sync pair's roll years, by sync pair ID
+ROLL_YEARS_COLLECTION = "roll_years"
+
+# Name of a certified year's table, from the staging table's name
+DEFAULT_YEAR_TABLE = "{table}_{year}"
+
+# Roll years a configuration or request may name
+MIN_ROLL_YEAR = 1900
+MAX_ROLL_YEAR = 9999
+
+# PostgreSQL truncates identifiers beyond this length
+MAX_IDENTIFIER_LENGTH = 63
+
+_YEAR_TABLE = re.compile(r"^[A-Za-z0-9_{}]+$")
+
+
+def parse_roll_year(value: Any, label: str = "roll_year") -> int:
+    """
+    A roll year given as a number or text.
+
+    Raises:
+        ValueError: If it is not a year
+    """
+    if isinstance(value, str) and value.strip().isdigit():
+        value = int(value.strip())
+    if not isinstance(value, int) or isinstance(value, bool) or not MIN_ROLL_YEAR <= value <= MAX_ROLL_YEAR:
+        raise ValueError(f"{label} must be a year between {MIN_ROLL_YEAR} and {MAX_ROLL_YEAR}")
+    return value
+
+
+def year_table_name(target_table: str, year_table: str, year: int) -> str:
+    """The table of a certified year, in the schema of the staging table."""
+    schema, _, name = target_table.rpartition(".")
+    name = year_table.format(table=name, year=year)
+    return f"{schema}.{name}" if schema else name
+
+
+def parse_roll_years(sync_pair_id: str, definition: Any, tables: List[Any]) -> Dict[str, Any]:
+    """
+    Validate the "roll_years" block of a sync pair.
+
+    Args:
+        sync_pair_id: Sync pair the block belongs to
+        definition: The block
+        tables: The sync pair's SyncTableConfigs
+
+    Returns:
+        The open year, the year-versioned tables and the year table format;
+        empty when the block is absent
+    """
+    if not definition:
+        return {}
+    label = f"Sync pair {sync_pair_id}: roll_years"
+    if not isinstance(definition, dict):
+        raise ValueError(f"{label} must be an object")
+    unknown = [name for name in definition if name not in ("current_year", "tables", "year_table")]
+    if unknown:
+        raise ValueError(f"{label}: unknown settings {', '.join(unknown)}")
+    current_year = parse_roll_year(definition.get("current_year"), f"{label}.current_year")
+
+    by_name = {table.name: table for table in tables}
+    names = definition.get("tables") or list(by_name)
+    if not isinstance(names, list) or not all(isinstance(name, str) for name in names):
+        raise ValueError(f"{label}.tables must be a list of table names")
+    for name in names:
+        if name not in by_name:
+            raise ValueError(f"{label} names unknown table {name}")
+
+    year_table = definition.get("year_table") or DEFAULT_YEAR_TABLE
+    if not isinstance(year_table, str) or not _YEAR_TABLE.match(year_table) \
+            or "{table}" not in year_table or "{year}" not in year_table:
+        raise ValueError(f"{label}.year_table must name {{table}} and {{year}}, in letters, digits and underscores")
+    for name in names:
+        target_table = by_name[name].target_table or name
+        longest = year_table_name(target_table, year_table, MAX_ROLL_YEAR).rpartition(".")[2]
+        if len(longest) > MAX_IDENTIFIER_LENGTH:
+            raise ValueError(f"{label}: the year table of {name} ({longest}) is longer than "
+                             f"{MAX_IDENTIFIER_LENGTH} characters")
+        if target_table == year_table_name(target_table, year_table, current_year):
+            raise ValueError(f"{label}.year_table must differ from the staging table")
+    return {"current_year": current_year, "tables": list(names), "year_table": year_table}
+
+
+class RollYearManager:
+    """
+    Service class for the roll years of sync pairs: the open year, the
+    certified years and their tables, and roll-overs.
+    """
+
+    def __init__(self, store: DocumentStore, audit: Optional[AuditLog] = None):
+        """
+        Initialize the manager.
+
+        Args:
+            store: Document store for the roll year records
+            audit: Audit log for roll-overs (the audit_log singleton by default)
+        """
+        self.store = store
+        self.audit_log = audit or audit_log
+
+    def current_year(self, pair) -> Optional[int]:
+        """The open roll year of a sync pair; None when it is not year-versioned."""
+        if not pair.roll_years:
+            return None
+        record = self._load(pair)
+        return record["current_year"] if record else pair.roll_years["current_year"]
+
+    def describe(self, pair) -> Dict[str, Any]:
+        """
+        The roll years of a sync pair, the open year first, with the table
+        each year-versioned table is read from in each.
+
+        Raises:
+            KeyError: If the sync pair is not year-versioned
+        """
+        self._check(pair)
+        record = self._load(pair) or {}
+        current_year = self.current_year(pair)
+        open_year = {
+            "roll_year": current_year,
+            "status": "OPEN",
+            "tables": {name: {"target_table": self._target_table(pair, name)} for name in pair.roll_years["tables"]},
+            "opened_at": record.get("opened_at"),
+            "opened_by": record.get("opened_by"),
+        }
+        years = sorted(record.get("years", []), key=lambda year: year["roll_year"], reverse=True)
+        return {
+            "sync_pair_id": pair.sync_pair_id,
+            "county_id": pair.county_id,
+            "current_year": current_year,
+            "tables": list(pair.roll_years["tables"]),
+            "years": [open_year] + years,
+        }
+
+    def table_def(self, pair, table_def: Dict[str, Any], roll_year: Optional[Any]) -> Dict[str, Any]:
+        """
+        The definition of a sync pair's table as it stood in a roll year:
+        itself for the open year (or no year), else with target_table naming
+        the certified year's table.
+
+        Raises:
+            ValueError: If the year is not one of the sync pair's, or the
+                table is not year-versioned
+        """
+        if roll_year is None:
+            return table_def
+        roll_year = parse_roll_year(roll_year)
+        if not pair.roll_years:
+            raise ValueError(f"Sync pair {pair.sync_pair_id} is not versioned by roll year")
+        if roll_year == self.current_year(pair):
+            return table_def
+        if table_def["name"] not in pair.roll_years["tables"]:
+            raise ValueError(f"Table {table_def['name']} of sync pair {pair.sync_pair_id} is not versioned by roll year")
+        for year in (self._load(pair) or {}).get("years", []):
+            if year["roll_year"] == roll_year:
+                entry = year["tables"].get(table_def["name"])
+                if entry is None:
+                    raise ValueError(f"Table {table_def['name']} was not versioned in the {roll_year} roll")
+                return dict(table_def, target_table=entry["year_table"])
+        raise ValueError(f"Sync pair {pair.sync_pair_id} has no {roll_year} roll; "
+                         f"its rolls are {', '.join(str(y['roll_year']) for y in self.describe(pair)['years'])}")
+
+    def roll_over(self, pair, username: str, to_year: Optional[Any] = None,
+                  reason: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Certify a sync pair's open roll year and open the next.
+
+        Each year-versioned table is copied into its certified year's table;
+        if a copy fails, those made are dropped and the open year is left as
+        it was. The caller makes sure no job of the sync pair is running.
+
+        Args:
+            pair: The sync pair
+            username: User rolling over
+            to_year: Year to open, after the open year; the next by default
+            reason: Why, for the audit log
+
+        Returns:
+            The sync pair's roll years, as describe() gives them
+
+        Raises:
+            KeyError: If the sync pair is not year-versioned
+            ValueError: If to_year is not after the open year
+        """
+        self._check(pair)
+        current_year = self.current_year(pair)
+        to_year = current_year + 1 if to_year is None else parse_roll_year(to_year, "to_year")
+        if to_year <= current_year:
+            raise ValueError(f"to_year must be after the open {current_year} roll")
+        record = self._load(pair) or {"sync_pair_id": pair.sync_pair_id, "county_id": pair.county_id, "years": []}
+
+        certified = {"roll_year": current_year, "status": "CERTIFIED", "tables": {},
+                     "opened_at": record.get("opened_at"), "opened_by": record.get("opened_by"),
+                     "certified_at": datetime.utcnow().isoformat(), "certified_by": username, "reason": reason}
+        target = create_connector(pair.target)
+        with target:
+            try:
+                for name in pair.roll_years["tables"]:
+                    table_def = pair.get_table(name).to_dict()
+                    year_table = year_table_name(table_def["target_table"], pair.roll_years["year_table"],
+                                                 current_year)
+                    rows = target.create_snapshot(table_def, year_table)
+                    certified["tables"][name] = {"target_table": table_def["target_table"],
+                                                 "year_table": year_table, "rows": rows}
+            except Exception:
+                # Do not leave a partly certified roll behind
+                for name, entry in certified["tables"].items():
+                    try:
+                        target.drop_snapshot(pair.get_table(name).to_dict(), entry["year_table"])
+                    except Exception as e:
+                        logger.error(f"Could not drop {entry['year_table']} of the failed roll-over: {e}")
+                raise
+
+        record["years"].append(certified)
+        record.update(current_year=to_year, opened_at=certified["certified_at"], opened_by=username)
+        self.store.save(ROLL_YEARS_COLLECTION, pair.sync_pair_id, record)
+        self.audit_log.record(
+            "roll_year.rolled_over",
+            username,
+            "sync_pair",
+            pair.sync_pair_id,
+            {"certified_year": current_year, "current_year": to_year, "reason": reason,
+             "rows": {name: entry["rows"] for name, entry in certified["tables"].items()}},
+            county_id=pair.county_id
+        )
+        logger.info(f"{username} certified the {current_year} roll of sync pair {pair.sync_pair_id} "
+                    f"and opened {to_year}")
+        return self.describe(pair)
+
+    @staticmethod
+    def _check(pair) -> None:
+        if not pair.roll_years:
+            raise KeyError(f"Sync pair {pair.sync_pair_id} is not versioned by roll year")
+
+    @staticmethod
+    def _target_table(pair, name: str) -> str:
+        return pair.get_table(name).target_table or name
+
+    def _load(self, pair) -> Optional[Dict[str, Any]]:
+        try:
+            return self.store.load(ROLL_YEARS_COLLECTION, pair.sync_pair_id)
+        except FileNotFoundError:
+            return None
+
+
+# Create a singleton instance
+roll_years = RollYearManager(sync_state_store)
@@ -0,0 +1,358 @@
+"""
+TerraFusion Platform - Run Summaries
+
+This module writes plain-language summaries of sync and export runs, for
+the staff who read the nightly report rather than the job records: what
+changed, the anomalies flagged for review, what failed and its likely
+cause.
+
+A summary is written from a fact sheet of the finished job (its counts per
+table or layer, the open anomalies it flagged (see sync_anomalies), its
+failures and rollbacks, failed deliveries) and the likely causes matched
+from its error messages. The county's AI provider (see ai_providers) writes
+the prose, with the fact sheet redacted by its redaction hooks; counties
+without a provider, and runs the provider cannot answer for, get a summary
+assembled from the same facts by template.
+
+Summaries are kept per run in the state store and given again until the
+run's facts change (a resumed job, an anomaly reviewed), or a refresh is
+asked for. A template summary written because the provider failed is not
+kept, so the next request tries the provider again.
+"""
+
+import json
+import hashlib
+import logging
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+from ai_providers import ai_providers, AIProviderError
+from sync_anomalies import AnomalyStore
+from sync_store import DocumentStore, sync_state_store
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection of the summaries written
+RUN_SUMMARIES_COLLECTION = "run_summaries"
+
+# Kinds of run that are summarized
+RUN_KINDS = ["sync", "export"]
+
+# Job statuses of finished runs
+FINISHED_STATUSES = ("COMPLETED", "FAILED", "CANCELLED")
+
+# Most anomalies, failures and validation errors a fact sheet carries
+MAX_FACTS = 10
+
+# Output tokens a summary may take
+SUMMARY_MAX_TOKENS = 600
+
+# Likely causes of failures, by words of their error messages
+LIKELY_CAUSES = [
+    (("timed out", "timeout"), "The source or target system did not answer in time; it may have been busy or "
+                               "offline for maintenance."),
+    (("connection refused", "connection reset", "could not connect", "unreachable", "name or service not known"),
+     "The service could not reach the other system; check the network and that the system is running."),
+    (("login failed", "authentication", "unauthorized", "permission denied", "access denied", "forbidden"),
+     "The credentials the sync uses were rejected; a password or key may have expired."),
+    (("watermark expired",), "The source no longer had the changes since the last sync, so everything was "
+                             "copied again."),
+    (("validation failed", "rolled back"), "The synced data failed the post-sync checks, so the changes were "
+                                           "undone and the target is as it was before the run."),
+    (("no space left", "disk full", "disk quota"), "The server ran out of disk space."),
+    (("deadlock", "is locked", "lock request"), "Another process was using the same tables at the time."),
+    (("does not exist", "invalid object name", "no such table", "unknown column"),
+     "A table or column the sync expects was missing; the source system may have been upgraded."),
+]
+
+# How the model is asked to write the summary
+SUMMARY_SYSTEM_PROMPT = (
+    "You write short summaries of data synchronization and GIS export runs for county assessor staff who are "
+    "not technical. Use plain language, no jargon or field names. In at most three short paragraphs say what "
+    "the run did and what changed, which changes were flagged for an appraiser to review, and, if anything "
+    "failed, what failed and its likely cause. Use only the facts given; do not guess numbers."
+)
+
+
+def likely_causes(messages: List[str]) -> List[str]:
+    """The likely causes of failures matched from their messages, each once."""
+    causes = []
+    for message in messages:
+        text = (message or "").lower()
+        for keywords, cause in LIKELY_CAUSES:
+            if any(keyword in text for keyword in keywords) and cause not in causes:
+                causes.append(cause)
+    return causes
+
+
+def digest(facts: Dict[str, Any]) -> str:
+    return hashlib.sha1(json.dumps(facts, sort_keys=True, default=str).encode("utf-8")).hexdigest()
+
+
+def _plural(count: int, noun: str) -> str:
+    return f"{count:,} {noun}{'' if count == 1 else 's'}"
+
+
+class RunSummaryService:
+    """Service class for the plain-language summaries of sync and export runs."""
+
+    def __init__(self, sync_engine, export_service, store: Optional[DocumentStore] = None):
+        self.sync_engine = sync_engine
+        self.export_service = export_service
+        self.store = store or sync_state_store
+        self.anomalies = AnomalyStore(self.store)
+
+    def summarize(self, kind: str, job_id: str, refresh: bool = False) -> Dict[str, Any]:
+        """
+        The summary of a finished run, written when it has none (or refresh is set) or its facts changed.
+
+        Args:
+            kind: sync or export
+            job_id: Job of the run
+            refresh: Write the summary again even if one is kept
+
+        Raises:
+            KeyError: If the job is not found
+            ValueError: If the kind is not supported or the run has not finished
+        """
+        if kind not in RUN_KINDS:
+            raise ValueError(f"Run kind must be one of {', '.join(RUN_KINDS)}")
+        job = self._job(kind, job_id)
+        if job.get("status") not in FINISHED_STATUSES:
+            raise ValueError(f"Cannot summarize {kind} job {job_id} with status {job.get('status')}; "
+                             f"it has not finished")
+        facts = self.sync_facts(job) if kind == "sync" else self.export_facts(job)
+        key = f"{kind}__{job_id}"
+        facts_digest = digest(facts)
+        if not refresh:
+            try:
+                cached = self.store.load(RUN_SUMMARIES_COLLECTION, key)
+                if cached.get("facts_digest") == facts_digest:
+                    return cached
+            except FileNotFoundError:
+                pass
+
+        summary = {
+            "kind": kind,
+            "job_id": job_id,
+            "county_id": job.get("county_id"),
+            "status": job.get("status"),
+            "facts": facts,
+            "facts_digest": facts_digest,
+            "generated_at": datetime.utcnow().isoformat(),
+        }
+        summary.update(self._write(kind, facts, job.get("county_id")))
+        if summary.get("fallback_reason") is None:
+            self.store.save(RUN_SUMMARIES_COLLECTION, key, summary)
+        return summary
+
+    def _job(self, kind: str, job_id: str) -> Dict[str, Any]:
+        service = self.sync_engine if kind == "sync" else self.export_service
+        try:
+            return service.get_job_status(job_id)
+        except FileNotFoundError:
+            raise KeyError(f"{'Sync' if kind == 'sync' else 'Export'} job {job_id} not found")
+
+    def sync_facts(self, job: Dict[str, Any]) -> Dict[str, Any]:
+        """The fact sheet of a sync run."""
+        tables = []
+        for name, result in (job.get("table_results") or {}).items():
+            table = {"table": name, "mode": result.get("mode")}
+            for count in ("records_read", "records_written", "records_deleted", "records_rejected",
+                          "records_quarantined", "conflicts"):
+                if result.get(count):
+                    table[count] = result[count]
+            if result.get("fallback_reason"):
+                table["full_copy_because"] = result["fallback_reason"]
+            if result.get("warnings"):
+                table["warnings"] = result["warnings"][:MAX_FACTS]
+            tables.append(table)
+
+        failures = []
+        if job.get("status") == "FAILED":
+            failures.append(job.get("message"))
+        failures.extend((job.get("validation_errors") or [])[:MAX_FACTS])
+        facts = {
+            "run": "sync",
+            "job_id": job["job_id"],
+            "sync_pair_id": job.get("sync_pair_id"),
+            "county_id": job.get("county_id"),
+            "source_system": job.get("source_system"),
+            "target_system": job.get("target_system"),
+            "mode": job.get("mode"),
+            "dry_run": bool(job.get("dry_run")),
+            "status": job.get("status"),
+            "started_at": job.get("started_at"),
+            "completed_at": job.get("completed_at"),
+            "message": job.get("message"),
+            "totals": job.get("stats") or {},
+            "tables": tables,
+            "rolled_back": bool(job.get("rolled_back")),
+            "failures": [f for f in failures if f],
+        }
+        if job.get("anomalies"):
+            facts["anomalies"] = self._anomaly_facts(job)
+        if (job.get("topology_qa") or {}).get("open"):
+            facts["topology_issues"] = job["topology_qa"]["open"]
+        messages = facts["failures"] + [t["full_copy_because"] for t in tables if "full_copy_because" in t]
+        facts["likely_causes"] = likely_causes(messages)
+        return facts
+
+    def export_facts(self, job: Dict[str, Any]) -> Dict[str, Any]:
+        """The fact sheet of an export run."""
+        layers = []
+        for name, result in (job.get("layer_results") or {}).items():
+            layer = {"layer": name}
+            if isinstance(result, dict) and "features" in result:
+                layer["features"] = result["features"]
+            layers.append(layer)
+        failed_deliveries = [{"delivery": d.get("name"), "error": d.get("error")}
+                             for d in job.get("deliveries") or [] if d.get("status") != "DELIVERED"]
+
+        failures = [job.get("message")] if job.get("status") == "FAILED" else []
+        failures.extend(d["error"] for d in failed_deliveries if d["error"])
+        facts = {
+            "run": "export",
+            "job_id": job["job_id"],
+            "county_id": job.get("county_id"),
+            "export_format": job.get("export_format"),
+            "status": job.get("status"),
+            "started_at": job.get("started_at"),
+            "completed_at": job.get("completed_at"),
+            "message": job.get("message"),
+            "layers": layers or [{"layer": name} for name in job.get("layers") or []],
+            "file_size": job.get("file_size"),
+            "deliveries": len(job.get("deliveries") or []),
+            "failed_deliveries": failed_deliveries[:MAX_FACTS],
+            "failures": [f for f in failures if f][:MAX_FACTS],
+        }
+        facts["likely_causes"] = likely_causes(facts["failures"])
+        return facts
+
+    def _anomaly_facts(self, job: Dict[str, Any]) -> Dict[str, Any]:
+        found = job["anomalies"]
+        facts = {"found": found.get("found", 0), "by_kind": {k: v for k, v in found.get("by_kind", {}).items() if v}}
+        try:
+            anomalies = self.anomalies.list(job["sync_pair_id"], job_id=job["job_id"])
+        except (KeyError, ValueError):
+            anomalies = []
+        facts["open"] = sum(1 for a in anomalies if a.get("status") == "OPEN")
+        # Mass changes lead: one of them touches more parcels than any value swing
+        anomalies.sort(key=lambda a: (a.get("kind") == "value_change", -(a.get("changed") or 0)))
+        facts["examples"] = [{"table": a.get("table"), "kind": a.get("kind"), "column": a.get("column"),
+                              "reasons": a.get("reasons"), "status": a.get("status")}
+                             for a in anomalies[:MAX_FACTS]]
+        return facts
+
+    def _write(self, kind: str, facts: Dict[str, Any], county_id: Optional[str]) -> Dict[str, Any]:
+        """The summary text and how it was written."""
+        fallback_reason = None
+        try:
+            client = ai_providers.client(county_id)
+        except ValueError as e:
+            logger.error(f"AI provider settings are invalid: {e}")
+            client = None
+            fallback_reason = str(e)
+        if client is not None:
+            prompt = f"Summarize this {'data sync' if kind == 'sync' else 'GIS export'} run:"
+            try:
+                completion = client.complete(prompt, data=facts, system=SUMMARY_SYSTEM_PROMPT,
+                                             feature="run_summary", max_tokens=SUMMARY_MAX_TOKENS)
+                return {
+                    "summary": completion.text.strip(),
+                    "generated_by": "ai",
+                    "provider": completion.provider,
+                    "model": completion.model,
+                    "input_tokens": completion.input_tokens,
+                    "output_tokens": completion.output_tokens,
+                }
+            except AIProviderError as e:
+                logger.warning(f"AI provider could not summarize {kind} job {facts['job_id']}: {e}")
+                fallback_reason = str(e)
+        text = self.sync_template(facts) if kind == "sync" else self.export_template(facts)
+        return {"summary": text, "generated_by": "template", "provider": None, "model": None,
+                "fallback_reason": fallback_reason}
+
+    @staticmethod
+    def sync_template(facts: Dict[str, Any]) -> str:
+        """A sync run's summary assembled from its facts."""
+        when = f" on {facts['completed_at'][:16].replace('T', ' at ')} UTC" if facts.get("completed_at") else ""
+        run = f"The {'trial ' if facts['dry_run'] else ''}{facts.get('mode') or ''} sync of {facts['sync_pair_id']}"
+        totals = facts["totals"]
+        tables = len(facts["tables"])
+        paragraphs = []
+        if facts["status"] == "COMPLETED":
+            if facts["dry_run"]:
+                text = f"{run} finished{when}. It was a trial run, so nothing was changed."
+            else:
+                text = (f"{run} finished{when}: {_plural(totals.get('records_written', 0), 'record')} were "
+                        f"updated across {_plural(tables, 'table')}.")
+                if totals.get("records_unchanged"):
+                    text += f" {_plural(totals['records_unchanged'], 'record')} were already up to date."
+            for table in facts["tables"]:
+                if table.get("full_copy_because"):
+                    text += f" {table['table']} was copied in full ({table['full_copy_because']})."
+            paragraphs.append(text)
+        elif facts["status"] == "CANCELLED":
+            paragraphs.append(f"{run} was cancelled{when} after "
+                              f"{_plural(totals.get('records_written', 0), 'record')} were updated. "
+                              f"It can be resumed where it stopped.")
+        else:
+            text = f"{run} failed{when}."
+            if facts["rolled_back"]:
+                text += " Its changes were undone, so the data is as it was before the run."
+            elif totals.get("records_written"):
+                text += f" {_plural(totals['records_written'], 'record')} were updated before it stopped."
+            paragraphs.append(text)
+
+        anomalies = facts.get("anomalies")
+        if anomalies and anomalies["found"]:
+            kinds = ", ".join(_plural(count, kind.replace("_", " ")) for kind, count in anomalies["by_kind"].items())
+            text = (f"{_plural(anomalies['found'], 'change')} were flagged for an appraiser to review ({kinds}); "
+                    f"{anomalies['open']} still open.")
+            reasons = [reason for example in anomalies["examples"] if example["kind"] != "value_change"
+                       for reason in example.get("reasons") or []]
+            if reasons:
+                text += f" Most notable: {'; '.join(reasons[:3])}."
+            paragraphs.append(text)
+        if facts.get("topology_issues"):
+            paragraphs.append(f"{_plural(facts['topology_issues'], 'parcel map problem')} (overlaps, gaps "
+                              f"or slivers) are open for the GIS staff.")
+
+        if facts["failures"]:
+            text = f"What went wrong: {'; '.join(facts['failures'][:3])}."
+            if facts["likely_causes"]:
+                text += f" Likely cause: {' '.join(facts['likely_causes'])}"
+            paragraphs.append(text)
+        return "\n\n".join(paragraphs)
+
+    @staticmethod
+    def export_template(facts: Dict[str, Any]) -> str:
+        """An export run's summary assembled from its facts."""
+        when = f" on {facts['completed_at'][:16].replace('T', ' at ')} UTC" if facts.get("completed_at") else ""
+        run = f"The {facts.get('export_format') or ''} export for {facts['county_id']}"
+        paragraphs = []
+        if facts["status"] == "COMPLETED":
+            counts = [f"{_plural(layer['features'], 'feature')} in {layer['layer']}" for layer in facts["layers"]
+                      if "features" in layer]
+            text = f"{run} finished{when} with {_plural(len(facts['layers']), 'layer')}"
+            if counts:
+                text += f" ({', '.join(counts)})"
+            text += "."
+            if facts["deliveries"]:
+                delivered = facts["deliveries"] - len(facts["failed_deliveries"])
+                text += f" It was delivered to {delivered} of {_plural(facts['deliveries'], 'destination')}."
+            paragraphs.append(text)
+        elif facts["status"] == "CANCELLED":
+            paragraphs.append(f"{run} was cancelled{when}.")
+        else:
+            paragraphs.append(f"{run} failed{when}; no file was produced.")
+
+        if facts["failures"]:
+            text = f"What went wrong: {'; '.join(facts['failures'][:3])}."
+            if facts["likely_causes"]:
+                text += f" Likely cause: {' '.join(facts['likely_causes'])}"
+            paragraphs.append(text)
+        return "\n\n".join(paragraphs)
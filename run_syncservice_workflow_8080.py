@@ -4,7 +4,10 @@ from fastapi import FastAPI
 from fastapi.middleware.cors import CORSMiddleware
 import uvicorn
 
-logging.basicConfig(level=logging.INFO)
+from service_tls import PeerVerificationError, service_tls
+from logging_config import configure_structured_logging
+
+configure_structured_logging()
 logger = logging.getLogger(__name__)
 
 app = FastAPI(
@@ -38,5 +41,30 @@ async def sync_status():
         "status": "ready"
     }
 
+def serve_mutual_tls(host: str, port: int) -> None:
+    """
+    Serve over TLS with the service certificate (see service_tls), dropping
+    clients whose certificate has none of the accepted SANs. The context is
+    updated in place when the certificate files rotate.
+    """
+    from uvicorn.protocols.http.h11_impl import H11Protocol
+
+    class VerifiedH11Protocol(H11Protocol):
+        def connection_made(self, transport):
+            super().connection_made(transport)
+            try:
+                service_tls.verify_peer(transport.get_extra_info("peercert"))
+            except PeerVerificationError as e:
+                logger.warning(f"Refused connection from {transport.get_extra_info('peername')}: {e}")
+                transport.close()
+
+    config = uvicorn.Config(app, host=host, port=port, http=VerifiedH11Protocol)
+    config.load()
+    config.ssl = service_tls.server_context()
+    uvicorn.Server(config).run()
+
 if __name__ == "__main__":
-    uvicorn.run(app, host="0.0.0.0", port=8080)
\ No newline at end of file
+    if service_tls.enabled:
+        serve_mutual_tls("0.0.0.0", 8080)
+    else:
+        uvicorn.run(app, host="0.0.0.0", port=8080)
\ No newline at end of file
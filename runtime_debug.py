@@ -0,0 +1,303 @@
+"""
+TerraFusion Platform - Runtime Debugging
+
+This module provides the diagnostics behind the gateway's /debug/ endpoints,
+for finding where a production instance spends its time or memory (a large
+geometry export growing without bound, a hung sync worker) without a
+rebuild or a restart:
+
+- runtime_stats: process memory (RSS and peak), CPU time, threads, garbage
+  collector generations, open file descriptors and, on request, the most
+  numerous object types
+- thread_dump: the stack of every thread, the Python counterpart of a
+  goroutine dump
+- cpu_profile: a sampling profile of every thread over some seconds, as
+  folded stacks (flamegraph.pl, speedscope) and the hottest functions; the
+  threads being profiled are not slowed beyond the sampling itself
+- HeapProfiler: allocation tracing with tracemalloc, off until started; each
+  snapshot lists the largest allocation sites and how each grew since the
+  previous snapshot, so two snapshots during an export show what leaks
+
+The endpoints are served only with DEBUG_ENDPOINTS_ENABLED and only to
+admins of every county; stacks and object listings can show record values.
+"""
+
+import gc
+import os
+import sys
+import time
+import platform
+import threading
+import traceback
+import tracemalloc
+from collections import Counter
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+try:
+    import resource
+    RESOURCE_AVAILABLE = True
+except ImportError:
+    # Peak RSS and CPU times by getrusage are unavailable on Windows
+    RESOURCE_AVAILABLE = False
+
+# Longest CPU profile a request may ask for
+MAX_PROFILE_SECONDS = float(os.environ.get("DEBUG_MAX_PROFILE_SECONDS", "60"))
+
+# Sampling interval of CPU profiles
+DEFAULT_SAMPLE_INTERVAL_MS = 10
+MIN_SAMPLE_INTERVAL_MS = 1
+
+# Frames kept per allocation traceback when heap tracing starts without a number
+DEFAULT_HEAP_FRAMES = 10
+
+# Functions or allocation sites listed by default
+DEFAULT_TOP = 25
+
+HEAP_GROUPINGS = ["lineno", "filename", "traceback"]
+
+_STARTED_AT = datetime.utcnow()
+_STARTED_MONOTONIC = time.monotonic()
+
+
+class ProfileInProgressError(Exception):
+    """Raised when a CPU profile is asked for while another runs."""
+
+
+def rss_bytes() -> Optional[int]:
+    """Current resident set size, from /proc where there is one."""
+    try:
+        with open("/proc/self/statm", "r") as f:
+            return int(f.read().split()[1]) * os.sysconf("SC_PAGE_SIZE")
+    except (OSError, ValueError, IndexError):
+        return None
+
+
+def _open_files() -> Optional[int]:
+    try:
+        return len(os.listdir("/proc/self/fd"))
+    except OSError:
+        return None
+
+
+def runtime_stats(objects: int = 0) -> Dict[str, Any]:
+    """
+    Process statistics.
+
+    Args:
+        objects: List this many of the most numerous object types tracked by the garbage collector
+            (walks every object; slow on a large heap)
+    """
+    times = os.times()
+    memory = {"rss_bytes": rss_bytes(), "peak_rss_bytes": None}
+    if RESOURCE_AVAILABLE:
+        peak = resource.getrusage(resource.RUSAGE_SELF).ru_maxrss
+        # Linux reports kilobytes, macOS bytes
+        memory["peak_rss_bytes"] = peak if sys.platform == "darwin" else peak * 1024
+    if tracemalloc.is_tracing():
+        current, peak = tracemalloc.get_traced_memory()
+        memory.update(traced_bytes=current, traced_peak_bytes=peak)
+    stats = {
+        "pid": os.getpid(),
+        "python": platform.python_version(),
+        "platform": platform.platform(),
+        "started_at": _STARTED_AT.isoformat(),
+        "uptime_seconds": round(time.monotonic() - _STARTED_MONOTONIC),
+        "memory": memory,
+        "cpu": {"user_seconds": round(times.user, 3), "system_seconds": round(times.system, 3)},
+        "threads": {"count": threading.active_count(), "names": sorted(t.name for t in threading.enumerate())},
+        "gc": {
+            "enabled": gc.isenabled(),
+            "counts": list(gc.get_count()),
+            "thresholds": list(gc.get_threshold()),
+            "generations": gc.get_stats(),
+            "uncollectable": len(gc.garbage),
+        },
+        "open_files": _open_files(),
+        "heap_tracing": tracemalloc.is_tracing(),
+    }
+    if objects > 0:
+        counts = Counter(type(obj).__qualname__ for obj in gc.get_objects())
+        stats["gc"]["tracked_objects"] = sum(counts.values())
+        stats["objects"] = [{"type": name, "count": count} for name, count in counts.most_common(objects)]
+    return stats
+
+
+def thread_dump() -> List[Dict[str, Any]]:
+    """The stack of every thread, innermost frame last."""
+    frames = sys._current_frames()
+    threads = []
+    for thread in sorted(threading.enumerate(), key=lambda t: t.name):
+        frame = frames.get(thread.ident)
+        threads.append({
+            "name": thread.name,
+            "ident": thread.ident,
+            "native_id": getattr(thread, "native_id", None),
+            "daemon": thread.daemon,
+            "stack": [line.rstrip("\n") for line in traceback.format_stack(frame)] if frame else [],
+        })
+    return threads
+
+
+def format_thread_dump(threads: List[Dict[str, Any]]) -> str:
+    """A thread dump as text, one block per thread."""
+    blocks = []
+    for thread in threads:
+        header = f"Thread {thread['name']} (ident {thread['ident']}{', daemon' if thread['daemon'] else ''}):"
+        blocks.append("\n".join([header] + thread["stack"]))
+    return "\n\n".join(blocks) + "\n"
+
+
+def _frame_name(code) -> str:
+    return f"{code.co_name} ({os.path.basename(code.co_filename)}:{code.co_firstlineno})"
+
+
+_profile_lock = threading.Lock()
+
+
+def cpu_profile(seconds: float, interval_ms: float = DEFAULT_SAMPLE_INTERVAL_MS,
+                top: int = DEFAULT_TOP) -> Dict[str, Any]:
+    """
+    Sample the stacks of every thread for some seconds.
+
+    Returns:
+        The samples taken, the folded stacks ("outer;inner" to samples) and the
+        functions with the most samples on top of a stack (self) and anywhere in
+        one (total)
+
+    Raises:
+        ValueError: If seconds or interval_ms is out of range
+        ProfileInProgressError: If another profile is running
+    """
+    if not 0 < seconds <= MAX_PROFILE_SECONDS:
+        raise ValueError(f"seconds must be more than 0 and at most {MAX_PROFILE_SECONDS:g}")
+    if interval_ms < MIN_SAMPLE_INTERVAL_MS:
+        raise ValueError(f"interval_ms must be at least {MIN_SAMPLE_INTERVAL_MS}")
+    if not _profile_lock.acquire(blocking=False):
+        raise ProfileInProgressError("A CPU profile is already running")
+    try:
+        own = threading.get_ident()
+        names = {}
+        folded: Counter = Counter()
+        own_samples: Counter = Counter()
+        total_samples: Counter = Counter()
+        samples = 0
+        started = time.monotonic()
+        deadline = started + seconds
+        while time.monotonic() < deadline:
+            names.update({t.ident: t.name for t in threading.enumerate()})
+            for ident, frame in sys._current_frames().items():
+                if ident == own:
+                    continue
+                stack = []
+                while frame is not None:
+                    stack.append(_frame_name(frame.f_code))
+                    frame = frame.f_back
+                if not stack:
+                    continue
+                stack.reverse()
+                folded[";".join([names.get(ident, str(ident))] + stack)] += 1
+                own_samples[stack[-1]] += 1
+                for name in set(stack):
+                    total_samples[name] += 1
+                samples += 1
+            time.sleep(interval_ms / 1000)
+    finally:
+        _profile_lock.release()
+    return {
+        "seconds": round(time.monotonic() - started, 3),
+        "interval_ms": interval_ms,
+        "samples": samples,
+        "top": [{"function": name, "self": count, "total": total_samples[name]}
+                for name, count in own_samples.most_common(top)],
+        "folded": dict(folded.most_common()),
+    }
+
+
+def format_folded(profile: Dict[str, Any]) -> str:
+    """A CPU profile's folded stacks, one "stack count" line each, as flamegraph tools read them."""
+    return "".join(f"{stack} {count}\n" for stack, count in profile["folded"].items())
+
+
+class HeapProfiler:
+    """
+    Allocation tracing with tracemalloc. Tracing slows allocation and keeps
+    a traceback per live block, so it stays off until started; snapshots
+    are compared with the previous one to show growth.
+    """
+
+    def __init__(self):
+        self._previous: Optional[tracemalloc.Snapshot] = None
+        self._previous_at: Optional[str] = None
+        self._lock = threading.Lock()
+
+    def start(self, frames: int = DEFAULT_HEAP_FRAMES) -> Dict[str, Any]:
+        """
+        Start tracing, keeping frames frames per allocation.
+
+        Raises:
+            ValueError: If frames is not positive
+        """
+        if frames < 1:
+            raise ValueError("frames must be at least 1")
+        with self._lock:
+            if tracemalloc.is_tracing():
+                tracemalloc.stop()
+            tracemalloc.start(frames)
+            self._previous = self._previous_at = None
+        return self.status()
+
+    def stop(self) -> Dict[str, Any]:
+        """Stop tracing and free its tracebacks."""
+        with self._lock:
+            tracemalloc.stop()
+            self._previous = self._previous_at = None
+        return self.status()
+
+    def status(self) -> Dict[str, Any]:
+        tracing = tracemalloc.is_tracing()
+        status = {"tracing": tracing, "frames": tracemalloc.get_traceback_limit() if tracing else None}
+        if tracing:
+            status["traced_bytes"], status["traced_peak_bytes"] = tracemalloc.get_traced_memory()
+        return status
+
+    def snapshot(self, group_by: str = "lineno", top: int = DEFAULT_TOP) -> Dict[str, Any]:
+        """
+        The largest allocation sites, and their growth since the previous snapshot.
+
+        Raises:
+            ValueError: If group_by is unknown or tracing has not been started
+        """
+        if group_by not in HEAP_GROUPINGS:
+            raise ValueError(f"Invalid group_by {group_by}; choose from {', '.join(HEAP_GROUPINGS)}")
+        if not tracemalloc.is_tracing():
+            raise ValueError("Heap tracing is not running; start it first")
+        with self._lock:
+            snapshot = tracemalloc.take_snapshot().filter_traces([
+                tracemalloc.Filter(False, tracemalloc.__file__),
+                tracemalloc.Filter(False, "<frozen importlib._bootstrap>"),
+            ])
+            previous, previous_at = self._previous, self._previous_at
+            self._previous, self._previous_at = snapshot, datetime.utcnow().isoformat()
+        stats = snapshot.statistics(group_by)
+        result = dict(self.status(), taken_at=self._previous_at, group_by=group_by,
+                      total_bytes=sum(stat.size for stat in stats),
+                      top=[self._site(stat.traceback, stat.size, stat.count, group_by) for stat in stats[:top]])
+        if previous is not None:
+            differences = snapshot.compare_to(previous, group_by)
+            result["previous_taken_at"] = previous_at
+            result["growth"] = [dict(self._site(diff.traceback, diff.size, diff.count, group_by),
+                                     size_diff=diff.size_diff, count_diff=diff.count_diff)
+                                for diff in differences[:top] if diff.size_diff > 0]
+        return result
+
+    @staticmethod
+    def _site(trace: tracemalloc.Traceback, size: int, count: int, group_by: str) -> Dict[str, Any]:
+        site = {"size": size, "count": count, "file": trace[-1].filename, "line": trace[-1].lineno}
+        if group_by == "traceback":
+            site["traceback"] = [f"{frame.filename}:{frame.lineno}" for frame in trace]
+        return site
+
+
+# Create a singleton instance
+heap_profiler = HeapProfiler()
@@ -0,0 +1,541 @@
+"""
+TerraFusion Platform - Secrets Providers
+
+This module provides the secrets providers that keep database passwords,
+SFTP keys and API tokens out of the configuration files. Any setting read
+with a "*_env_var" indirection (connector, delivery target and export store
+settings) can instead name a secret with "*_secret":
+
+    "source": {
+        "type": "sqlserver",
+        "host": "pacs-db.benton.internal",
+        "user_secret": "vault:database/creds/pacs-reader#username",
+        "password_secret": "vault:database/creds/pacs-reader#password"
+    }
+
+A reference is "<provider>:<path>#<field>"; without a field the secret's
+"value" field (or its only field) is used. Providers:
+
+    vault: HashiCorp Vault (VAULT_ADDR), KV version 2 paths such as
+        "secret/data/benton/sftp" and dynamic secrets such as database
+        credentials. It signs in with VAULT_TOKEN, VAULT_TOKEN_FILE (a Vault
+        Agent sink) or AppRole (VAULT_ROLE_ID and VAULT_SECRET_ID).
+    aws: AWS Secrets Manager secret IDs or ARNs, holding JSON or plain text
+    file: A file, such as a mounted Kubernetes secret, holding JSON or plain text
+    env: An environment variable
+
+Secrets are cached. Leased secrets (Vault dynamic credentials) are renewed
+in the background before their lease runs out, and read again for fresh
+credentials once Vault will not extend them; other secrets are read again
+after SECRETS_CACHE_SECONDS. Connectors read their settings each time they
+connect, so a rotated password is used by the next connection without a
+restart, and a connection refused with cached credentials is retried once
+with the secrets read again.
+"""
+
+import os
+import sys
+import json
+import time
+import logging
+import threading
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+import requests
+
+try:
+    import boto3
+    BOTO3_AVAILABLE = True
+except ImportError:
+    # AWS Secrets Manager requires boto3
+    BOTO3_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Seconds secrets without a lease are cached before they are read again
+CACHE_SECONDS = float(os.environ.get("SECRETS_CACHE_SECONDS", "300"))
+
+# Share of a lease that passes before it is renewed
+RENEW_FRACTION = 2 / 3
+
+# Seconds between checks for leases due for renewal
+RENEW_CHECK_SECONDS = 10
+
+# Vault settings
+VAULT_ADDR = os.environ.get("VAULT_ADDR")
+VAULT_NAMESPACE = os.environ.get("VAULT_NAMESPACE")
+VAULT_CACERT = os.environ.get("VAULT_CACERT")
+VAULT_APPROLE_PATH = os.environ.get("VAULT_APPROLE_PATH", "approle")
+
+# Region of AWS Secrets Manager; the AWS default region when unset
+AWS_REGION = os.environ.get("SECRETS_AWS_REGION")
+
+# Seconds to wait for a secrets provider
+REQUEST_TIMEOUT = 10
+
+# Field of a secret used when a reference names none
+DEFAULT_FIELD = "value"
+
+
+class SecretError(Exception):
+    """Raised when a secret cannot be read."""
+
+
+class Secret:
+    """The fields of one secret as read from its provider, with its lease if it has one."""
+
+    def __init__(self, data: Dict[str, Any], version: Optional[str] = None, lease_id: Optional[str] = None,
+                 lease_seconds: float = 0, renewable: bool = False):
+        self.data = data
+        self.version = version
+        self.lease_id = lease_id
+        self.lease_seconds = lease_seconds
+        self.renewable = renewable
+        self.read_at = time.time()
+        self.renewed_at = self.read_at
+
+    @property
+    def leased(self) -> bool:
+        return bool(self.lease_id) and self.lease_seconds > 0
+
+    def due(self, now: Optional[float] = None) -> bool:
+        """Whether the secret should be renewed (leased) or read again (not leased)."""
+        now = time.time() if now is None else now
+        if self.leased:
+            return now >= self.renewed_at + self.lease_seconds * RENEW_FRACTION
+        return now >= self.read_at + CACHE_SECONDS
+
+    def field(self, name: Optional[str], reference: str) -> str:
+        """
+        Raises:
+            SecretError: If the secret has no such field
+        """
+        if name is None:
+            if DEFAULT_FIELD in self.data or len(self.data) != 1:
+                name = DEFAULT_FIELD
+            else:
+                name = next(iter(self.data))
+        if self.data.get(name) is None:
+            raise SecretError(f"Secret {reference} has no field {name}. Fields: {', '.join(self.data) or 'none'}")
+        value = self.data[name]
+        return value if isinstance(value, str) else json.dumps(value)
+
+
+def _parse_text(text: str) -> Dict[str, Any]:
+    """The fields of a secret stored as text: a JSON object, or one value."""
+    try:
+        data = json.loads(text)
+    except ValueError:
+        data = None
+    return data if isinstance(data, dict) else {DEFAULT_FIELD: text.strip()}
+
+
+class SecretProvider:
+    """Base class for secrets providers."""
+
+    provider_type = "base"
+
+    def read(self, path: str) -> Secret:
+        """
+        Read a secret.
+
+        Raises:
+            SecretError: If it cannot be read
+        """
+        raise NotImplementedError
+
+    def renew(self, secret: Secret) -> bool:
+        """
+        Extend a secret's lease.
+
+        Returns:
+            True if the lease was extended for its full duration; False when
+            the secret should be read again instead
+        """
+        return False
+
+    def maintain(self) -> None:
+        """Keep the provider's own sign-in alive; called with each renewal check."""
+
+
+class EnvSecretProvider(SecretProvider):
+    """Secrets in environment variables, for development."""
+
+    provider_type = "env"
+
+    def read(self, path: str) -> Secret:
+        if path not in os.environ:
+            raise SecretError(f"Environment variable {path} is not set")
+        return Secret(_parse_text(os.environ[path]))
+
+
+class FileSecretProvider(SecretProvider):
+    """Secrets in files, such as Kubernetes or Docker secrets mounts."""
+
+    provider_type = "file"
+
+    def read(self, path: str) -> Secret:
+        try:
+            with open(path, "r") as f:
+                text = f.read()
+        except OSError as e:
+            raise SecretError(f"Cannot read secret file {path}: {e}")
+        return Secret(_parse_text(text), version=str(os.path.getmtime(path)))
+
+
+class VaultSecretProvider(SecretProvider):
+    """
+    Secrets in HashiCorp Vault, read over its HTTP API.
+
+    KV version 2 responses are unwrapped to the secret's own fields, and
+    their metadata version kept. A VAULT_TOKEN token is renewed while it is
+    renewable, and an AppRole token is replaced by signing in again when it
+    cannot be; a token file is read for each call, as Vault Agent keeps it
+    current.
+    """
+
+    provider_type = "vault"
+
+    def __init__(self, address: Optional[str] = None, token: Optional[str] = None,
+                 token_file: Optional[str] = None, role_id: Optional[str] = None, secret_id: Optional[str] = None,
+                 namespace: Optional[str] = None, ca_file: Optional[str] = None):
+        """
+        Raises:
+            SecretError: If no address or way to sign in is configured
+        """
+        self.address = (address or VAULT_ADDR or "").rstrip("/")
+        if not self.address:
+            raise SecretError("Vault secrets require VAULT_ADDR")
+        self.token_file = token_file or os.environ.get("VAULT_TOKEN_FILE")
+        self.role_id = role_id or os.environ.get("VAULT_ROLE_ID")
+        self.secret_id = secret_id or os.environ.get("VAULT_SECRET_ID")
+        self._token = token or os.environ.get("VAULT_TOKEN")
+        if not (self._token or self.token_file or (self.role_id and self.secret_id)):
+            raise SecretError("Vault secrets require VAULT_TOKEN, VAULT_TOKEN_FILE, "
+                              "or VAULT_ROLE_ID and VAULT_SECRET_ID")
+        self.namespace = namespace or VAULT_NAMESPACE
+        self.verify = ca_file or VAULT_CACERT or True
+        self.session = requests.Session()
+        self._token_expires: Optional[float] = None
+        self._token_ttl = 0.0
+        self._lock = threading.Lock()
+
+    def _login(self) -> None:
+        """Sign in with AppRole."""
+        body = self._send("POST", f"auth/{VAULT_APPROLE_PATH}/login",
+                          {"role_id": self.role_id, "secret_id": self.secret_id}, token=None)
+        auth = body.get("auth") or {}
+        self._token = auth.get("client_token")
+        self._set_ttl(auth.get("lease_duration", 0))
+        logger.info("Signed in to Vault with AppRole")
+
+    def _set_ttl(self, ttl: float) -> None:
+        self._token_ttl = float(ttl or 0)
+        self._token_expires = time.time() + self._token_ttl if self._token_ttl else None
+
+    def token(self) -> str:
+        with self._lock:
+            if self.token_file:
+                # Vault Agent rewrites the sink file when it renews or replaces the token
+                try:
+                    with open(self.token_file, "r") as f:
+                        return f.read().strip()
+                except OSError as e:
+                    raise SecretError(f"Cannot read Vault token file {self.token_file}: {e}")
+            if self.role_id and (not self._token or (self._token_expires and time.time() >= self._token_expires)):
+                self._login()
+            return self._token
+
+    def _send(self, method: str, path: str, body: Optional[Dict[str, Any]] = None,
+              token: Optional[str] = "") -> Dict[str, Any]:
+        headers = {}
+        token = self.token() if token == "" else token
+        if token:
+            headers["X-Vault-Token"] = token
+        if self.namespace:
+            headers["X-Vault-Namespace"] = self.namespace
+        try:
+            response = self.session.request(method, f"{self.address}/v1/{path.lstrip('/')}", json=body,
+                                            headers=headers, verify=self.verify, timeout=REQUEST_TIMEOUT)
+        except requests.RequestException as e:
+            raise SecretError(f"Cannot reach Vault at {self.address}: {e}")
+        if response.status_code >= 400:
+            try:
+                errors = "; ".join(response.json().get("errors") or []) or response.reason
+            except ValueError:
+                errors = response.reason
+            raise SecretError(f"Vault {method} {path} failed ({response.status_code}): {errors}")
+        return response.json() if response.content else {}
+
+    def request(self, method: str, path: str, body: Optional[Dict[str, Any]] = None) -> Dict[str, Any]:
+        """A Vault API call; an AppRole token Vault refuses is replaced once."""
+        try:
+            return self._send(method, path, body)
+        except SecretError as e:
+            if not (self.role_id and "(403)" in str(e)):
+                raise
+            with self._lock:
+                self._token = None
+            return self._send(method, path, body)
+
+    def read(self, path: str) -> Secret:
+        body = self.request("GET", path)
+        data = body.get("data") or {}
+        version = None
+        if isinstance(data.get("data"), dict) and isinstance(data.get("metadata"), dict):
+            version = str(data["metadata"].get("version"))
+            data = data["data"]
+        return Secret(data, version=version, lease_id=body.get("lease_id") or None,
+                      lease_seconds=float(body.get("lease_duration") or 0), renewable=bool(body.get("renewable")))
+
+    def renew(self, secret: Secret) -> bool:
+        if not secret.renewable:
+            return False
+        body = self.request("PUT", "sys/leases/renew",
+                            {"lease_id": secret.lease_id, "increment": int(secret.lease_seconds)})
+        granted = float(body.get("lease_duration") or 0)
+        secret.renewed_at = time.time()
+        # A shorter lease than asked for means the lease is near its maximum TTL
+        return granted >= secret.lease_seconds
+
+    def maintain(self) -> None:
+        if self.token_file or not self._token:
+            return
+        if self._token_expires is None:
+            body = self._send("GET", "auth/token/lookup-self")
+            data = body.get("data") or {}
+            if not data.get("renewable") or not data.get("ttl"):
+                # Tokens that never expire, or cannot be renewed and are used until they do
+                self._token_expires = float("inf")
+                return
+            self._token_ttl = float(data.get("creation_ttl") or data["ttl"])
+            self._token_expires = time.time() + float(data["ttl"])
+        if time.time() < self._token_expires - self._token_ttl * (1 - RENEW_FRACTION):
+            return
+        try:
+            auth = self._send("POST", "auth/token/renew-self", {}).get("auth") or {}
+            self._set_ttl(auth.get("lease_duration", 0))
+        except SecretError as e:
+            if not self.role_id:
+                raise
+            # Past its maximum TTL; sign in again for a new token
+            logger.info(f"Vault token renewal refused ({e}); signing in again")
+            with self._lock:
+                self._token = None
+
+
+class AwsSecretsManagerProvider(SecretProvider):
+    """Secrets in AWS Secrets Manager; rotations are picked up when the cache expires."""
+
+    provider_type = "aws"
+
+    def __init__(self, region: Optional[str] = None):
+        """
+        Raises:
+            SecretError: If boto3 is not installed
+        """
+        if not BOTO3_AVAILABLE:
+            raise SecretError("AWS Secrets Manager secrets require boto3")
+        self.client = boto3.client("secretsmanager", region_name=region or AWS_REGION)
+
+    def read(self, path: str) -> Secret:
+        try:
+            response = self.client.get_secret_value(SecretId=path)
+        except Exception as e:
+            raise SecretError(f"Cannot read AWS secret {path}: {e}")
+        if response.get("SecretString") is not None:
+            data = _parse_text(response["SecretString"])
+        else:
+            data = {DEFAULT_FIELD: response["SecretBinary"].decode("utf-8")}
+        return Secret(data, version=response.get("VersionId"))
+
+
+# Provider classes by reference prefix
+PROVIDER_TYPES = {
+    EnvSecretProvider.provider_type: EnvSecretProvider,
+    FileSecretProvider.provider_type: FileSecretProvider,
+    VaultSecretProvider.provider_type: VaultSecretProvider,
+    AwsSecretsManagerProvider.provider_type: AwsSecretsManagerProvider,
+}
+
+
+def parse_reference(reference: str) -> tuple:
+    """
+    Split a "<provider>:<path>#<field>" reference.
+
+    Raises:
+        SecretError: If it names no provider or path
+    """
+    provider, _, rest = str(reference).partition(":")
+    path, _, field = rest.partition("#")
+    if provider not in PROVIDER_TYPES or not path:
+        raise SecretError(f"Invalid secret reference {reference}; expected <provider>:<path>#<field> "
+                          f"with provider one of {', '.join(PROVIDER_TYPES)}")
+    return provider, path, field or None
+
+
+class SecretResolver:
+    """
+    Service class resolving secret references, caching and renewing the secrets.
+
+    Providers are created the first time a reference names them. Secrets read
+    from one path are shared by its fields, so the username and password of
+    dynamic database credentials always come from the same lease.
+    """
+
+    def __init__(self, providers: Optional[Dict[str, SecretProvider]] = None):
+        self._providers: Dict[str, SecretProvider] = dict(providers or {})
+        self._secrets: Dict[tuple, Secret] = {}
+        self._lock = threading.Lock()
+        self._renewer: Optional[threading.Thread] = None
+
+    def provider(self, name: str) -> SecretProvider:
+        with self._lock:
+            if name not in self._providers:
+                self._providers[name] = PROVIDER_TYPES[name]()
+            return self._providers[name]
+
+    def _read(self, provider: str, path: str) -> Secret:
+        secret = self.provider(provider).read(path)
+        with self._lock:
+            previous = self._secrets.get((provider, path))
+            self._secrets[(provider, path)] = secret
+        if previous is not None and (previous.data != secret.data or previous.version != secret.version):
+            version = f" to version {secret.version}" if secret.version else ""
+            logger.info(f"Secret {provider}:{path} changed{version}")
+        if secret.leased:
+            self._start_renewer()
+        return secret
+
+    def resolve(self, reference: str) -> str:
+        """
+        The value of a secret reference.
+
+        Raises:
+            SecretError: If the reference is invalid or the secret cannot be read
+        """
+        provider, path, field = parse_reference(reference)
+        with self._lock:
+            secret = self._secrets.get((provider, path))
+        # Leased secrets are kept current by the renewer; others are read again when stale
+        if secret is None or (not secret.leased and secret.due()):
+            secret = self._read(provider, path)
+        return secret.field(field, reference)
+
+    def refresh(self, references: List[str]) -> bool:
+        """
+        Read secrets again, as when their values were refused.
+
+        Returns:
+            True if any of them changed
+        """
+        changed = False
+        for path_key in dict.fromkeys(parse_reference(r)[:2] for r in references):
+            with self._lock:
+                previous = self._secrets.get(path_key)
+            secret = self._read(*path_key)
+            if previous is None or previous.data != secret.data:
+                changed = True
+        return changed
+
+    def renew_due(self) -> None:
+        """Renew the leases due for it, reading secrets again whose lease cannot be extended."""
+        for provider in list(self._providers.values()):
+            try:
+                provider.maintain()
+            except SecretError as e:
+                logger.warning(f"Cannot renew {provider.provider_type} sign-in: {e}")
+        with self._lock:
+            due = [(key, secret) for key, secret in self._secrets.items() if secret.leased and secret.due()]
+        for (provider, path), secret in due:
+            try:
+                if not self.provider(provider).renew(secret):
+                    self._read(provider, path)
+            except SecretError as e:
+                logger.warning(f"Cannot renew secret {provider}:{path}: {e}")
+                # Read it again once the lease has run out, failing loudly if that cannot be done either
+                if time.time() >= secret.renewed_at + secret.lease_seconds:
+                    with self._lock:
+                        self._secrets.pop((provider, path), None)
+
+    def _start_renewer(self) -> None:
+        with self._lock:
+            if self._renewer is not None:
+                return
+            self._renewer = threading.Thread(target=self._renew_loop, name="secret-renewer", daemon=True)
+        self._renewer.start()
+
+    def _renew_loop(self) -> None:
+        while True:
+            time.sleep(RENEW_CHECK_SECONDS)
+            try:
+                self.renew_due()
+            except Exception as e:
+                logger.error(f"Secret renewal failed: {e}", exc_info=True)
+
+    def status(self) -> List[Dict[str, Any]]:
+        """The cached secrets, without their values."""
+        with self._lock:
+            secrets = list(self._secrets.items())
+        return [{
+            "reference": f"{provider}:{path}",
+            "fields": sorted(secret.data),
+            "version": secret.version,
+            "leased": secret.leased,
+            "renewable": secret.renewable,
+            "read_at": datetime.utcfromtimestamp(secret.read_at).isoformat(),
+        } for (provider, path), secret in secrets]
+
+
+def secret_references(config: Dict[str, Any]) -> List[str]:
+    """The "*_secret" references of a settings block."""
+    return [value for key, value in config.items() if key.endswith("_secret") and isinstance(value, str)]
+
+
+def refresh_config_secrets(config: Dict[str, Any]) -> bool:
+    """
+    Read the secrets of a settings block again after its credentials were refused.
+
+    Returns:
+        True if one changed, so connecting again may succeed
+    """
+    references = secret_references(config)
+    if not references:
+        return False
+    try:
+        return secret_resolver.refresh(references)
+    except SecretError as e:
+        logger.warning(f"Cannot read secrets again: {e}")
+        return False
+
+
+# Create a singleton instance
+secret_resolver = SecretResolver()
+
+
+def main(argv=None) -> int:
+    """Command-line entry point for checking secret references."""
+    import argparse
+    parser = argparse.ArgumentParser(description="TerraFusion Secrets Providers")
+    commands = parser.add_subparsers(dest="command", required=True)
+    check = commands.add_parser("check", help="Read secrets and list their fields and versions, not their values")
+    check.add_argument("references", nargs="+", help="<provider>:<path>#<field> references")
+    args = parser.parse_args(argv)
+
+    failed = False
+    for reference in args.references:
+        try:
+            secret_resolver.resolve(reference)
+        except SecretError as e:
+            print(json.dumps({"reference": reference, "error": str(e)}))
+            failed = True
+    for status in secret_resolver.status():
+        print(json.dumps(status))
+    return 1 if failed else 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,533 @@
+"""
+TerraFusion Platform - Service Host
+
+This module runs the gateway as an operating system service, for counties
+that install it on their own servers rather than in containers:
+
+    terrafusion service install --env-file C:\\TerraFusion\\terrafusion.env
+    terrafusion service start
+    terrafusion service status
+    terrafusion service stop
+    terrafusion service uninstall
+
+On Windows the service is registered with the Service Control Manager
+(pywin32 must be installed) and starts automatically with the server; its
+warnings and errors are written to the Application event log under
+TERRAFUSION_SERVICE_NAME, and everything it logs to
+TERRAFUSION_SERVICE_LOG. On Linux `install` writes a systemd unit of
+Type=notify: the host tells systemd when it is ready to serve and when it is
+stopping, and pings its watchdog while the HTTP server is alive, so a hung
+gateway is restarted. Either way the service runs `terrafusion service run`,
+which can also be run in the foreground.
+
+The host serves the API with waitress when it is installed (werkzeug's
+threaded server otherwise), on SERVICE_HOST and SERVICE_PORT, and starts the
+background services app.py enables. A service stop, SIGTERM or Ctrl+C shuts
+down gracefully: the HTTP server stops accepting requests, the sync job
+queue is drained (running jobs yield after their next committed batch and
+resume from their checkpoints after the restart; see SyncJobQueue.drain)
+within SERVICE_SHUTDOWN_TIMEOUT_SECONDS, and the other background services
+are stopped in reverse order.
+
+SIGHUP (`systemctl reload`) reloads the configuration without a restart
+(see config_reload); systemd is told while the reload runs.
+
+The environment file (KEY=VALUE lines, as python-dotenv reads them) is
+loaded before the gateway's modules read their settings, over the
+configuration profile it or TERRAFUSION_PROFILE names (see config_profiles);
+variables already set take precedence. Its path is kept in
+TERRAFUSION_ENV_FILE, where a reload reads the logging settings again.
+"""
+
+import os
+import sys
+import socket
+import signal
+import logging
+import getpass
+import threading
+import subprocess
+import logging.handlers
+from typing import Dict, Any, Optional, Callable
+
+from logging_config import configure_structured_logging, log_formatter, LogContextFilter, MAX_LOG_SIZE, BACKUP_COUNT
+
+try:
+    import win32service
+    import win32serviceutil
+    import servicemanager
+    WIN32_AVAILABLE = True
+except ImportError:
+    WIN32_AVAILABLE = False
+
+try:
+    from waitress.server import create_server
+    WAITRESS_AVAILABLE = True
+except ImportError:
+    WAITRESS_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Name the service is registered under (and its event log source and systemd unit)
+SERVICE_NAME = os.environ.get("TERRAFUSION_SERVICE_NAME", "TerraFusion")
+SERVICE_DISPLAY_NAME = "TerraFusion Platform"
+SERVICE_DESCRIPTION = "TerraFusion Platform API gateway, sync job queue and background services"
+
+# Address and worker threads of the HTTP server
+SERVICE_HOST = os.environ.get("SERVICE_HOST", "0.0.0.0")
+SERVICE_PORT = int(os.environ.get("SERVICE_PORT", "5000"))
+SERVICE_THREADS = int(os.environ.get("SERVICE_THREADS", "8"))
+
+# Seconds a stop waits for running sync jobs to reach a checkpoint
+SHUTDOWN_TIMEOUT_SECONDS = float(os.environ.get("SERVICE_SHUTDOWN_TIMEOUT_SECONDS", "120"))
+
+# Lowest level of the messages written to the Windows event log
+EVENT_LOG_LEVEL = os.environ.get("SERVICE_EVENT_LOG_LEVEL", "WARNING").upper()
+
+# Log file of the Windows service, which has no console
+SERVICE_LOG = os.environ.get("TERRAFUSION_SERVICE_LOG", os.path.join("logs", "service.log"))
+
+# Directory the systemd unit is written to
+SYSTEMD_UNIT_DIR = "/etc/systemd/system"
+
+# Seconds without a watchdog ping before systemd restarts the service
+WATCHDOG_SECONDS = 60
+
+SYSTEMD_UNIT = """[Unit]
+Description={description}
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+User={user}
+WorkingDirectory={directory}
+EnvironmentFile=-{env_file}
+ExecStart={python} {script} service run
+ExecReload=/bin/kill -HUP $MAINPID
+KillSignal=SIGTERM
+TimeoutStopSec={stop_seconds}
+WatchdogSec={watchdog_seconds}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+"""
+
+
+def load_env_file(path: Optional[str]) -> bool:
+    """
+    Set the variables of an environment file and the configuration profile
+    under it that are not set already; returns whether the file exists.
+    """
+    from config_profiles import apply_profile
+    exists = bool(path) and os.path.exists(path)
+    apply_profile(env_file=path if exists else None)
+    return exists
+
+
+class SystemdNotifier:
+    """
+    Sends sd_notify messages to systemd's NOTIFY_SOCKET; does nothing when the
+    process was not started by a Type=notify unit.
+    """
+
+    def __init__(self, environ: Optional[Dict[str, str]] = None):
+        """
+        Initialize the notifier.
+
+        Args:
+            environ: Environment the socket and watchdog settings are read from; os.environ by default
+        """
+        environ = os.environ if environ is None else environ
+        self.address = environ.get("NOTIFY_SOCKET")
+        if self.address and self.address.startswith("@"):
+            # Abstract namespace socket
+            self.address = "\0" + self.address[1:]
+        watchdog_pid = environ.get("WATCHDOG_PID")
+        watchdog_usec = environ.get("WATCHDOG_USEC")
+        self.watchdog_seconds: Optional[float] = None
+        if watchdog_usec and (not watchdog_pid or int(watchdog_pid) == os.getpid()):
+            self.watchdog_seconds = int(watchdog_usec) / 1_000_000
+
+    @property
+    def enabled(self) -> bool:
+        return bool(self.address) and hasattr(socket, "AF_UNIX")
+
+    def notify(self, **fields) -> bool:
+        """Send a message of state fields, such as READY=1; returns whether it was sent."""
+        if not self.enabled:
+            return False
+        message = "\n".join(f"{name.upper()}={value}" for name, value in fields.items())
+        try:
+            with socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM) as sock:
+                sock.sendto(message.encode(), self.address)
+        except OSError as e:
+            logger.warning(f"Cannot notify systemd: {e}")
+            return False
+        return True
+
+    def ready(self, status: str) -> bool:
+        return self.notify(ready=1, status=status)
+
+    def stopping(self, status: str) -> bool:
+        return self.notify(stopping=1, status=status)
+
+    def reloading(self, status: str) -> bool:
+        return self.notify(reloading=1, status=status)
+
+    def watchdog(self) -> bool:
+        return self.notify(watchdog=1)
+
+
+class ServiceHost:
+    """Serves the gateway until it is asked to stop, then shuts it down gracefully."""
+
+    def __init__(self, host: Optional[str] = None, port: Optional[int] = None, threads: Optional[int] = None,
+                 shutdown_timeout: Optional[float] = None, notifier: Optional[SystemdNotifier] = None,
+                 app_factory: Optional[Callable[[], Any]] = None):
+        """
+        Initialize the host.
+
+        Args:
+            host: Address to listen on; SERVICE_HOST by default
+            port: Port to listen on; SERVICE_PORT by default
+            threads: Request threads of the HTTP server; SERVICE_THREADS by default
+            shutdown_timeout: Seconds a stop waits for running sync jobs; SERVICE_SHUTDOWN_TIMEOUT_SECONDS by default
+            notifier: Notifier systemd is told the service's state with
+            app_factory: Returns the module with the WSGI app and its background services; imports app by default
+        """
+        self.host = host or SERVICE_HOST
+        self.port = SERVICE_PORT if port is None else port
+        self.threads = threads or SERVICE_THREADS
+        self.shutdown_timeout = SHUTDOWN_TIMEOUT_SECONDS if shutdown_timeout is None else shutdown_timeout
+        self.notifier = notifier or SystemdNotifier()
+        self.app_factory = app_factory or _import_app
+        self._server = None
+        self._server_thread: Optional[threading.Thread] = None
+        self._module = None
+        self._stop_requested = threading.Event()
+        self._reload_requested = threading.Event()
+        self._stopped = threading.Event()
+
+    @classmethod
+    def from_environment(cls) -> "ServiceHost":
+        """A host with the settings of the current environment, which an environment file may have changed."""
+        return cls(host=os.environ.get("SERVICE_HOST"), port=int(os.environ.get("SERVICE_PORT", SERVICE_PORT)),
+                   threads=int(os.environ.get("SERVICE_THREADS", SERVICE_THREADS)),
+                   shutdown_timeout=float(os.environ.get("SERVICE_SHUTDOWN_TIMEOUT_SECONDS", SHUTDOWN_TIMEOUT_SECONDS)))
+
+    def run(self) -> int:
+        """
+        Serve until request_stop is called (or a stop signal arrives), then
+        shut down; returns the exit status, 1 when the HTTP server failed.
+        """
+        self._install_signal_handlers()
+        self._module = self.app_factory()
+        self._server = _make_server(self._module.app, self.host, self.port, self.threads)
+        self._server_thread = threading.Thread(target=self._server.serve, name="service-http", daemon=True)
+        self._server_thread.start()
+        logger.info(f"{SERVICE_DISPLAY_NAME} serving on {self.host}:{self.port} with {self._server.name}")
+        self.notifier.ready(f"Serving on {self.host}:{self.port}")
+        failed = False
+        # Each second, well within any watchdog interval
+        while not self._stop_requested.wait(1.0):
+            if not self._server_thread.is_alive():
+                logger.error("The HTTP server stopped unexpectedly")
+                failed = True
+                break
+            if self._reload_requested.is_set():
+                self._reload_requested.clear()
+                self.reload()
+            if self.notifier.watchdog_seconds:
+                self.notifier.watchdog()
+        self.shutdown()
+        return 1 if failed else 0
+
+    def request_stop(self) -> None:
+        """Ask the host to shut down; returns at once."""
+        self._stop_requested.set()
+
+    def request_reload(self) -> None:
+        """Ask the host to reload the configuration; returns at once."""
+        self._reload_requested.set()
+
+    def reload(self) -> Optional[Dict[str, Any]]:
+        """Reload the configuration (see config_reload); returns the reload, None when the app has no reloader."""
+        reloader = getattr(self._module, "config_reloader", None)
+        if reloader is None:
+            return None
+        self.notifier.reloading("Reloading the configuration")
+        try:
+            result = reloader.reload("SIGHUP")
+        except Exception as e:
+            logger.error(f"Configuration reload failed: {e}", exc_info=True)
+            result = None
+        self.notifier.ready(f"Serving on {self.host}:{self.port}")
+        return result
+
+    def wait_stopped(self, timeout: Optional[float] = None) -> bool:
+        """Wait until the host has shut down; returns whether it has."""
+        return self._stopped.wait(timeout)
+
+    def shutdown(self) -> None:
+        """Stop serving, drain the sync job queue and stop the background services."""
+        logger.info(f"{SERVICE_DISPLAY_NAME} stopping")
+        self.notifier.stopping("Draining the sync job queue")
+        if self._server is not None:
+            self._server.close()
+            self._server = None
+        for service in reversed(getattr(self._module, "background_services", [])):
+            try:
+                if hasattr(service, "drain"):
+                    service.drain(self.shutdown_timeout)
+                else:
+                    service.stop()
+            except Exception as e:
+                logger.error(f"Error stopping {type(service).__name__}: {e}", exc_info=True)
+        logger.info(f"{SERVICE_DISPLAY_NAME} stopped")
+        self._stopped.set()
+
+    def _install_signal_handlers(self) -> None:
+        if threading.current_thread() is not threading.main_thread():
+            # The Windows service stops the host through request_stop instead
+            return
+        for name in ("SIGTERM", "SIGINT", "SIGBREAK"):
+            if hasattr(signal, name):
+                signal.signal(getattr(signal, name), lambda signum, frame: self.request_stop())
+        if hasattr(signal, "SIGHUP"):
+            # Reloaded on the serving loop rather than inside the handler
+            signal.signal(signal.SIGHUP, lambda signum, frame: self.request_reload())
+
+
+def _import_app():
+    import app
+    return app
+
+
+class _WaitressServer:
+    name = "waitress"
+
+    def __init__(self, app, host: str, port: int, threads: int):
+        self._server = create_server(app, host=host, port=port, threads=threads)
+
+    def serve(self) -> None:
+        self._server.run()
+
+    def close(self) -> None:
+        self._server.close()
+
+
+class _WerkzeugServer:
+    name = "werkzeug"
+
+    def __init__(self, app, host: str, port: int, threads: int):
+        from werkzeug.serving import make_server
+        self._server = make_server(host, port, app, threaded=True)
+
+    def serve(self) -> None:
+        self._server.serve_forever()
+
+    def close(self) -> None:
+        self._server.shutdown()
+        self._server.server_close()
+
+
+def _make_server(app, host: str, port: int, threads: int):
+    """The HTTP server of the host: waitress when it is installed, werkzeug's otherwise."""
+    server = _WaitressServer if WAITRESS_AVAILABLE else _WerkzeugServer
+    return server(app, host, port, threads)
+
+
+def configure_service_logging(windows_service: bool = False) -> None:
+    """
+    Log INFO messages of the service in the entry points' format; a Windows
+    service also logs to its log file and to the event log.
+    """
+    configure_structured_logging(logging.INFO)
+    if not windows_service:
+        return
+    root = logging.getLogger()
+    os.makedirs(os.path.dirname(os.path.abspath(SERVICE_LOG)), exist_ok=True)
+    log_file = logging.handlers.RotatingFileHandler(SERVICE_LOG, maxBytes=MAX_LOG_SIZE, backupCount=BACKUP_COUNT)
+    log_file.setFormatter(log_formatter())
+    log_file.addFilter(LogContextFilter())
+    root.addHandler(log_file)
+    event_log = logging.handlers.NTEventLogHandler(SERVICE_NAME)
+    event_log.setLevel(EVENT_LOG_LEVEL)
+    event_log.setFormatter(logging.Formatter("%(name)s: %(message)s"))
+    root.addHandler(event_log)
+
+
+# Windows -------------------------------------------------------------------
+
+# Registry options of the installed service
+OPTION_DIRECTORY = "directory"
+OPTION_ENV_FILE = "env_file"
+
+WINDOWS_STATES = {1: "stopped", 2: "start pending", 3: "stop pending", 4: "running",
+                  5: "continue pending", 6: "pause pending", 7: "paused"}
+
+if WIN32_AVAILABLE:
+    class WindowsService(win32serviceutil.ServiceFramework):
+        """The gateway as a Windows service, run by pythonservice.exe."""
+
+        _svc_name_ = SERVICE_NAME
+        _svc_display_name_ = SERVICE_DISPLAY_NAME
+        _svc_description_ = SERVICE_DESCRIPTION
+
+        def __init__(self, args):
+            super().__init__(args)
+            # The service starts in the system directory; settings are read relative to the installation
+            directory = win32serviceutil.GetServiceCustomOption(self._svc_name_, OPTION_DIRECTORY)
+            if directory:
+                os.chdir(directory)
+            load_env_file(win32serviceutil.GetServiceCustomOption(self._svc_name_, OPTION_ENV_FILE))
+            configure_service_logging(windows_service=True)
+            self.host = ServiceHost.from_environment()
+
+        def SvcStop(self):
+            self.ReportServiceStatus(win32service.SERVICE_STOP_PENDING,
+                                     waitHint=int((self.host.shutdown_timeout + 30) * 1000))
+            self.host.request_stop()
+
+        # A system shutdown stops the service the same way
+        SvcShutdown = SvcStop
+
+        def SvcDoRun(self):
+            servicemanager.LogInfoMsg(f"{self._svc_name_} starting")
+            try:
+                status = self.host.run()
+            except Exception as e:
+                logger.critical(f"{self._svc_name_} failed: {e}", exc_info=True)
+                raise
+            if status:
+                servicemanager.LogErrorMsg(f"{self._svc_name_} stopped because its HTTP server failed")
+
+
+def _require_win32() -> None:
+    if not WIN32_AVAILABLE:
+        raise RuntimeError("Windows services need pywin32: pip install pywin32")
+
+
+def install_windows_service(directory: str, env_file: Optional[str], auto_start: bool = True) -> str:
+    """Register the service with the Service Control Manager; returns its name."""
+    _require_win32()
+    start_type = win32service.SERVICE_AUTO_START if auto_start else win32service.SERVICE_DEMAND_START
+    win32serviceutil.InstallService(win32serviceutil.GetServiceClassString(WindowsService), SERVICE_NAME,
+                                    SERVICE_DISPLAY_NAME, startType=start_type, description=SERVICE_DESCRIPTION)
+    win32serviceutil.SetServiceCustomOption(SERVICE_NAME, OPTION_DIRECTORY, directory)
+    win32serviceutil.SetServiceCustomOption(SERVICE_NAME, OPTION_ENV_FILE, env_file or "")
+    return SERVICE_NAME
+
+
+def control_windows_service(action: str, timeout: float = SHUTDOWN_TIMEOUT_SECONDS) -> str:
+    """Start, stop, uninstall or query the installed service; returns its state."""
+    _require_win32()
+    if action == "start":
+        win32serviceutil.StartService(SERVICE_NAME)
+        win32serviceutil.WaitForServiceStatus(SERVICE_NAME, win32service.SERVICE_RUNNING, 60)
+    elif action in ("stop", "uninstall"):
+        if win32serviceutil.QueryServiceStatus(SERVICE_NAME)[1] != win32service.SERVICE_STOPPED:
+            win32serviceutil.StopService(SERVICE_NAME)
+            win32serviceutil.WaitForServiceStatus(SERVICE_NAME, win32service.SERVICE_STOPPED, timeout + 30)
+        if action == "uninstall":
+            win32serviceutil.RemoveService(SERVICE_NAME)
+            return "removed"
+    return WINDOWS_STATES.get(win32serviceutil.QueryServiceStatus(SERVICE_NAME)[1], "unknown")
+
+
+# systemd -------------------------------------------------------------------
+
+def unit_name() -> str:
+    return f"{SERVICE_NAME.lower()}.service"
+
+
+def render_systemd_unit(directory: str, env_file: Optional[str], user: Optional[str] = None,
+                        script: Optional[str] = None) -> str:
+    """The systemd unit that runs `terrafusion service run` in a directory."""
+    return SYSTEMD_UNIT.format(
+        description=SERVICE_DISPLAY_NAME, user=user or getpass.getuser(), directory=directory,
+        env_file=env_file or os.path.join(directory, "terrafusion.env"), python=sys.executable,
+        script=script or os.path.join(os.path.dirname(os.path.abspath(__file__)), "terrafusion.py"),
+        stop_seconds=int(SHUTDOWN_TIMEOUT_SECONDS) + 30, watchdog_seconds=WATCHDOG_SECONDS
+    )
+
+
+def install_systemd_unit(unit: str, unit_dir: str = SYSTEMD_UNIT_DIR) -> str:
+    """Write the unit, reload systemd and enable it; returns the unit's path."""
+    path = os.path.join(unit_dir, unit_name())
+    with open(path, "w") as f:
+        f.write(unit)
+    _systemctl("daemon-reload")
+    _systemctl("enable", unit_name())
+    return path
+
+
+def control_systemd_unit(action: str, unit_dir: str = SYSTEMD_UNIT_DIR) -> str:
+    """Start, stop, uninstall or query the unit; returns its state."""
+    if action == "uninstall":
+        _systemctl("disable", "--now", unit_name())
+        path = os.path.join(unit_dir, unit_name())
+        if os.path.exists(path):
+            os.remove(path)
+        _systemctl("daemon-reload")
+        return "removed"
+    if action in ("start", "stop"):
+        _systemctl(action, unit_name())
+    return _systemctl("is-active", unit_name(), check=False) or "unknown"
+
+
+def _systemctl(*arguments: str, check: bool = True) -> str:
+    try:
+        result = subprocess.run(["systemctl", *arguments], capture_output=True, text=True)
+    except FileNotFoundError:
+        raise RuntimeError("systemctl was not found; this system does not run systemd")
+    if check and result.returncode != 0:
+        raise RuntimeError(f"systemctl {' '.join(arguments)} failed: {result.stderr.strip() or result.returncode}")
+    return result.stdout.strip()
+
+
+def is_windows() -> bool:
+    return sys.platform == "win32"
+
+
+def run_service(env_file: Optional[str] = None) -> int:
+    """Run the gateway in the foreground (or under systemd) until it is stopped."""
+    load_env_file(env_file)
+    configure_service_logging()
+    return ServiceHost.from_environment().run()
+
+
+def manage_service(action: str, directory: Optional[str] = None, env_file: Optional[str] = None,
+                   user: Optional[str] = None, unit_dir: str = SYSTEMD_UNIT_DIR, manual: bool = False) -> str:
+    """
+    Install, uninstall, start, stop or query the service of this platform.
+
+    Args:
+        action: "install", "uninstall", "start", "stop" or "status"
+        directory: Working directory of the service; the current directory by default
+        env_file: Environment file the service loads
+        user: User a systemd unit runs as; the current user by default
+        unit_dir: Directory of the systemd unit
+        manual: Install a Windows service that does not start with the server
+
+    Returns:
+        What was done, or the service's state
+
+    Raises:
+        RuntimeError: If the service manager refuses or is not available
+    """
+    directory = os.path.abspath(directory or os.getcwd())
+    env_file = os.path.abspath(env_file) if env_file else None
+    if is_windows():
+        if action == "install":
+            return f"installed {install_windows_service(directory, env_file, auto_start=not manual)}"
+        return control_windows_service(action)
+    if action == "install":
+        return f"installed {install_systemd_unit(render_systemd_unit(directory, env_file, user), unit_dir)}"
+    return control_systemd_unit(action, unit_dir)
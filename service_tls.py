@@ -0,0 +1,241 @@
+"""
+TerraFusion Platform - Service Mutual TLS
+
+This module provides the mutual TLS of calls between the API gateway and the
+internal services: the sync service HTTP API, the gRPC API and the NATS event
+bus that carries job hand-offs and control messages between gateway and
+queue nodes. Each side presents a certificate signed by the internal CA and
+checks the other's:
+
+    SERVICE_TLS_CERT_FILE, SERVICE_TLS_KEY_FILE: This service's certificate chain and key
+    SERVICE_TLS_CA_FILE: CA bundle peer certificates must be signed by
+    SERVICE_TLS_PEER_SANS: Subject alternative names servers accept from clients,
+        comma separated fnmatch patterns such as "DNS:gateway-*.terrafusion.internal"
+        or "URI:spiffe://terrafusion/gateway" (a pattern without a type matches any)
+
+Servers refuse clients whose certificate carries none of the peer SANs (any
+certificate the CA signed is accepted when none are listed); clients check
+the server's SANs against the host they connect to, as TLS always does. The
+files are checked every SERVICE_TLS_RELOAD_SECONDS, and a rotated
+certificate, key or CA bundle is used for new connections without a restart.
+"""
+
+import os
+import ssl
+import time
+import fnmatch
+import hashlib
+import logging
+import threading
+from typing import Dict, List, Any, Optional, Tuple
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Subject alternative names accepted from clients; any CA-signed client when empty
+PEER_SANS = [s.strip() for s in os.environ.get("SERVICE_TLS_PEER_SANS", "").split(",") if s.strip()]
+
+# Seconds between checks of the certificate files
+RELOAD_SECONDS = float(os.environ.get("SERVICE_TLS_RELOAD_SECONDS", "30"))
+
+# SAN types of ssl.getpeercert() and the prefixes peer patterns name them by
+SAN_TYPES = {"DNS": "DNS", "URI": "URI", "IP Address": "IP", "email": "EMAIL"}
+
+
+class PeerVerificationError(Exception):
+    """Raised when a peer's certificate carries none of the accepted SANs."""
+
+
+def certificate_sans(certificate: Dict[str, Any]) -> List[Tuple[Optional[str], str]]:
+    """The (type, value) SANs of a certificate as ssl.getpeercert() returns it."""
+    return [(SAN_TYPES.get(kind, kind.upper()), value) for kind, value in certificate.get("subjectAltName", ())]
+
+
+def san_allowed(sans: List[Tuple[Optional[str], str]], patterns: List[str]) -> bool:
+    """
+    Whether a peer's SANs match one of the patterns.
+
+    Args:
+        sans: (type, value) pairs; the type is None when the transport does not report it (gRPC)
+        patterns: "TYPE:value" or "value" fnmatch patterns
+    """
+    if not patterns:
+        return True
+    for pattern in patterns:
+        kind, _, value = pattern.partition(":")
+        if kind.upper() not in SAN_TYPES.values() or not value:
+            kind, value = None, pattern
+        for san_kind, san_value in sans:
+            if kind and san_kind and kind.upper() != san_kind:
+                continue
+            if fnmatch.fnmatchcase(san_value.lower(), value.lower()):
+                return True
+    return False
+
+
+class ServiceTls:
+    """
+    The certificate, key and CA of one service, and the TLS contexts made from them.
+
+    Contexts are created once and updated in place when the files change, so
+    servers and clients holding them pick up rotated certificates on their
+    next handshake. CAs added to the bundle are trusted at once; a CA taken
+    out of it stays trusted until the service restarts.
+    """
+
+    def __init__(self, cert_file: Optional[str], key_file: Optional[str], ca_file: Optional[str],
+                 peer_sans: Optional[List[str]] = None, reload_seconds: float = RELOAD_SECONDS):
+        """
+        Raises:
+            ValueError: If only one of the certificate and key is set
+        """
+        if bool(cert_file) != bool(key_file):
+            raise ValueError("Service TLS needs both a certificate and a key file")
+        self.cert_file = cert_file
+        self.key_file = key_file
+        self.ca_file = ca_file
+        self.peer_sans = list(peer_sans if peer_sans is not None else PEER_SANS)
+        self.reload_seconds = reload_seconds
+        self.version = 0
+        self._fingerprint: Optional[str] = None
+        self._contexts: Dict[str, ssl.SSLContext] = {}
+        self._lock = threading.Lock()
+        self._watcher: Optional[threading.Thread] = None
+
+    @classmethod
+    def from_env(cls, prefix: str = "SERVICE_TLS", ca_variable: Optional[str] = None) -> "ServiceTls":
+        """Settings from PREFIX_CERT_FILE, PREFIX_KEY_FILE and PREFIX_CA_FILE (or ca_variable)."""
+        return cls(os.environ.get(f"{prefix}_CERT_FILE"), os.environ.get(f"{prefix}_KEY_FILE"),
+                   os.environ.get(ca_variable or f"{prefix}_CA_FILE"))
+
+    @property
+    def enabled(self) -> bool:
+        return bool(self.cert_file)
+
+    @property
+    def mutual(self) -> bool:
+        """Whether peers must present certificates signed by the CA."""
+        return self.enabled and bool(self.ca_file)
+
+    def files(self) -> Dict[str, bytes]:
+        """
+        The PEM contents of the certificate, key and CA files.
+
+        Raises:
+            OSError: If a file cannot be read
+        """
+        contents = {}
+        for name, path in (("cert", self.cert_file), ("key", self.key_file), ("ca", self.ca_file)):
+            if path:
+                with open(path, "rb") as f:
+                    contents[name] = f.read()
+        return contents
+
+    def _file_fingerprint(self) -> str:
+        digest = hashlib.sha256()
+        for name, content in sorted(self.files().items()):
+            digest.update(name.encode() + content)
+        return digest.hexdigest()
+
+    def server_context(self) -> ssl.SSLContext:
+        """A server context presenting the certificate and, with a CA, requiring client certificates."""
+        return self._context("server")
+
+    def client_context(self) -> ssl.SSLContext:
+        """A client context presenting the certificate and verifying servers against the CA."""
+        return self._context("client")
+
+    def _context(self, side: str) -> ssl.SSLContext:
+        with self._lock:
+            context = self._contexts.get(side)
+            if context is None:
+                purpose = ssl.Purpose.CLIENT_AUTH if side == "server" else ssl.Purpose.SERVER_AUTH
+                context = ssl.create_default_context(purpose)
+                context.minimum_version = ssl.TLSVersion.TLSv1_2
+                if side == "server" and self.ca_file:
+                    context.verify_mode = ssl.CERT_REQUIRED
+                self._load(context)
+                self._contexts[side] = context
+        self._watch()
+        return context
+
+    def _load(self, context: ssl.SSLContext) -> None:
+        if self.cert_file:
+            context.load_cert_chain(self.cert_file, self.key_file)
+        if self.ca_file:
+            context.load_verify_locations(cafile=self.ca_file)
+
+    def reload(self, force: bool = False) -> bool:
+        """
+        Re-read the files into the contexts when they changed.
+
+        Returns:
+            True if they were reloaded
+
+        Raises:
+            OSError, ssl.SSLError: If the files cannot be read or do not match;
+                the contexts keep the previous certificate
+        """
+        fingerprint = self._file_fingerprint()
+        with self._lock:
+            if fingerprint == self._fingerprint and not force:
+                return False
+            first = self._fingerprint is None
+            for context in self._contexts.values():
+                self._load(context)
+            self._fingerprint = fingerprint
+            self.version += 1
+        if not first:
+            logger.info(f"Reloaded service TLS certificate {self.cert_file}")
+        return True
+
+    def _watch(self) -> None:
+        """Start the thread that reloads the files when they change."""
+        with self._lock:
+            if self._watcher is not None or self.reload_seconds <= 0:
+                return
+            self._watcher = threading.Thread(target=self._watch_loop, name="service-tls-watch", daemon=True)
+        self._watcher.start()
+
+    def _watch_loop(self) -> None:
+        while True:
+            try:
+                self.reload()
+            except (OSError, ssl.SSLError, ValueError) as e:
+                # Half-written files during a rotation are read again on the next check
+                logger.warning(f"Cannot reload service TLS certificate {self.cert_file}: {e}")
+            time.sleep(self.reload_seconds)
+
+    def verify_peer(self, certificate: Optional[Dict[str, Any]]) -> None:
+        """
+        Check a client's certificate (as ssl.getpeercert() returns it) against the peer SANs.
+
+        Raises:
+            PeerVerificationError: If it has none of them
+        """
+        if not self.peer_sans:
+            return
+        sans = certificate_sans(certificate or {})
+        if not san_allowed(sans, self.peer_sans):
+            names = ", ".join(f"{kind}:{value}" for kind, value in sans) or "no SANs"
+            raise PeerVerificationError(f"Peer certificate ({names}) matches none of the accepted SANs")
+
+    def verify_grpc_peer(self, auth_context: Dict[str, List[bytes]]) -> None:
+        """
+        Check a gRPC caller (its ServicerContext.auth_context()) against the peer SANs.
+
+        Raises:
+            PeerVerificationError: If it has none of them
+        """
+        if not self.peer_sans:
+            return
+        values = auth_context.get("x509_subject_alternative_name", [])
+        sans = [(None, value.decode("utf-8", "replace")) for value in values]
+        if not san_allowed(sans, self.peer_sans):
+            raise PeerVerificationError(f"Peer certificate ({', '.join(v for _, v in sans) or 'no SANs'}) "
+                                        f"matches none of the accepted SANs")
+
+
+# Create a singleton instance
+service_tls = ServiceTls.from_env()
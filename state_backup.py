@@ -0,0 +1,321 @@
+"""
+TerraFusion Platform - Backup and Restore
+
+This module provides `terrafusion backup` and `terrafusion restore`, which
+carry a server's sync state to a rebuilt or replacement server so its sync
+pairs continue incrementally instead of starting over with full syncs:
+
+    terrafusion backup /mnt/backups/terrafusion-2026-10-14.tfbak
+    terrafusion restore /mnt/backups/terrafusion-2026-10-14.tfbak --dry-run
+    terrafusion restore /mnt/backups/terrafusion-2026-10-14.tfbak
+
+An archive holds every document of the sync state store (job history,
+watermarks, schedules, conflicts, dead letters, API keys, the audit log and
+the rest; see sync_store) except the ones rebuilt at runtime
+(TRANSIENT_COLLECTIONS), the county configuration files with their field
+mappings, and the secret references of the configuration: the *_secret and
+*_env_var settings it reads credentials through, never their values. The
+secrets themselves stay in their provider or environment; restore lists the
+environment variables the new server has not set yet.
+
+The archive is a zip encrypted with AES-256-GCM under a key derived from a
+passphrase (scrypt), so it restores on a server with a different master key,
+or none: documents are read decrypted and stored under the restoring
+server's master key. The passphrase comes from --passphrase-file,
+TERRAFUSION_BACKUP_PASSPHRASE or a prompt.
+
+Restore replaces documents with the same key and keeps the others (--clean
+deletes the documents of the restored collections the archive does not
+have). Configuration files that differ from the archive's are only replaced
+with --overwrite-config. Restore with the service stopped, so running jobs
+do not write state under it.
+"""
+
+import io
+import os
+import json
+import socket
+import zipfile
+import getpass
+import logging
+import secrets
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Tuple
+
+try:
+    from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+    from cryptography.hazmat.primitives.kdf.scrypt import Scrypt
+    CRYPTOGRAPHY_AVAILABLE = True
+except ImportError:
+    # Backup archives require cryptography
+    CRYPTOGRAPHY_AVAILABLE = False
+
+from sync_store import DocumentStore, sync_state_store
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# First line of an archive; the digit is the format version
+MAGIC = b"TFBACKUP1\n"
+
+# scrypt cost parameters of new archives (read back from the header on restore)
+SCRYPT_N = 2 ** 15
+SCRYPT_R = 8
+SCRYPT_P = 1
+
+# State collections rebuilt at runtime, left out of archives
+TRANSIENT_COLLECTIONS = ["health_probes", "spreadsheet_imports"]
+
+# County configuration files archived, by extension
+CONFIG_EXTENSIONS = (".json", ".yaml", ".yml", ".csv", ".geojson")
+
+# Environment variable holding the archive passphrase
+PASSPHRASE_ENV = "TERRAFUSION_BACKUP_PASSPHRASE"
+
+
+class BackupError(Exception):
+    """An archive that cannot be written or read."""
+
+
+def read_passphrase(path: Optional[str] = None, confirm: bool = False) -> str:
+    """
+    The archive passphrase, from a file, PASSPHRASE_ENV or a prompt.
+
+    Raises:
+        BackupError: If it is empty, or the confirmation differs
+    """
+    if path:
+        with open(path, "r") as f:
+            passphrase = f.read().strip()
+    elif os.environ.get(PASSPHRASE_ENV):
+        passphrase = os.environ[PASSPHRASE_ENV]
+    else:
+        passphrase = getpass.getpass("Backup passphrase: ")
+        if confirm and getpass.getpass("Repeat the passphrase: ") != passphrase:
+            raise BackupError("The passphrases differ")
+    if not passphrase:
+        raise BackupError("The backup passphrase is empty")
+    return passphrase
+
+
+def secret_references(config: Any, file: str, path: str = "") -> List[Dict[str, str]]:
+    """The *_secret and *_env_var settings of a configuration document, with where they are."""
+    references = []
+    if isinstance(config, dict):
+        for name, value in config.items():
+            where = f"{path}.{name}" if path else name
+            if isinstance(value, str) and name.endswith("_secret"):
+                references.append({"file": file, "path": where, "kind": "secret", "reference": value})
+            elif isinstance(value, str) and name.endswith("_env_var"):
+                references.append({"file": file, "path": where, "kind": "env_var", "reference": value})
+            else:
+                references.extend(secret_references(value, file, where))
+    elif isinstance(config, list):
+        for index, item in enumerate(config):
+            references.extend(secret_references(item, file, f"{path}[{index}]"))
+    return references
+
+
+def _key(passphrase: str, salt: bytes, n: int, r: int, p: int) -> bytes:
+    if not CRYPTOGRAPHY_AVAILABLE:
+        raise BackupError("Backup archives require the cryptography package")
+    return Scrypt(salt=salt, length=32, n=n, r=r, p=p).derive(passphrase.encode("utf-8"))
+
+
+def encrypt_archive(payload: bytes, passphrase: str) -> bytes:
+    """A zip payload as an encrypted archive: MAGIC, a JSON header line, then the AES-GCM ciphertext."""
+    salt, nonce = secrets.token_bytes(16), secrets.token_bytes(12)
+    header = json.dumps({"kdf": "scrypt", "n": SCRYPT_N, "r": SCRYPT_R, "p": SCRYPT_P, "salt": salt.hex(),
+                         "nonce": nonce.hex()}).encode("ascii") + b"\n"
+    key = _key(passphrase, salt, SCRYPT_N, SCRYPT_R, SCRYPT_P)
+    return MAGIC + header + AESGCM(key).encrypt(nonce, payload, MAGIC + header)
+
+
+def decrypt_archive(data: bytes, passphrase: str) -> bytes:
+    """
+    The zip payload of an encrypted archive.
+
+    Raises:
+        BackupError: If it is not an archive, or the passphrase is wrong or the archive was altered
+    """
+    if not data.startswith(MAGIC):
+        raise BackupError("Not a TerraFusion backup archive")
+    header_end = data.index(b"\n", len(MAGIC)) + 1
+    header_bytes = data[len(MAGIC):header_end]
+    try:
+        header = json.loads(header_bytes)
+        key = _key(passphrase, bytes.fromhex(header["salt"]), header["n"], header["r"], header["p"])
+        return AESGCM(key).decrypt(bytes.fromhex(header["nonce"]), data[header_end:], MAGIC + header_bytes)
+    except BackupError:
+        raise
+    except Exception:
+        raise BackupError("Cannot decrypt the archive: wrong passphrase, or the archive was altered")
+
+
+class StateBackup:
+    """Writes and restores archives of a state store and a county configuration directory."""
+
+    def __init__(self, store: Optional[DocumentStore] = None, config_dir: str = "county_configs"):
+        """
+        Initialize the backup service.
+
+        Args:
+            store: State store archived and restored; defaults to the sync_state_store singleton
+            config_dir: County configuration directory archived and restored
+        """
+        self.store = store or sync_state_store
+        self.config_dir = config_dir
+
+    def backup(self, output: str, passphrase: str, collections: Optional[List[str]] = None) -> Dict[str, Any]:
+        """
+        Write an archive.
+
+        Args:
+            output: Archive path
+            passphrase: Passphrase the archive is encrypted with
+            collections: Only these state collections (every one but the transient ones by default)
+
+        Returns:
+            The archive's manifest
+        """
+        names = [c for c in (collections or self.store.collections()) if c not in TRANSIENT_COLLECTIONS]
+        buffer = io.BytesIO()
+        manifest = {"format": 1, "created_at": datetime.utcnow().isoformat(), "host": socket.gethostname(),
+                    "state_backend": self.store.backend_name, "collections": {}, "config_files": [],
+                    "secret_references": []}
+        with zipfile.ZipFile(buffer, "w", zipfile.ZIP_DEFLATED) as archive:
+            for collection in sorted(names):
+                documents = {key: self.store.load(collection, key) for key in self.store.keys(collection)}
+                archive.writestr(f"state/{collection}.json", json.dumps(documents, default=str))
+                manifest["collections"][collection] = len(documents)
+            for relative, path in self._config_files():
+                archive.write(path, f"config/{relative}")
+                manifest["config_files"].append(relative)
+                if relative.endswith(".json"):
+                    try:
+                        with open(path, "r") as f:
+                            manifest["secret_references"] += secret_references(json.load(f), relative)
+                    except ValueError:
+                        logger.warning(f"Archived {path} without its secret references; it is not valid JSON")
+            archive.writestr("manifest.json", json.dumps(manifest, indent=2))
+        data = encrypt_archive(buffer.getvalue(), passphrase)
+        temporary = f"{output}.partial"
+        with open(temporary, "wb") as f:
+            f.write(data)
+        os.chmod(temporary, 0o600)
+        os.replace(temporary, output)
+        logger.info(f"Backed up {sum(manifest['collections'].values())} state documents and "
+                    f"{len(manifest['config_files'])} configuration files to {output}")
+        return dict(manifest, archive=output, bytes=len(data))
+
+    def restore(self, archive_path: str, passphrase: str, collections: Optional[List[str]] = None,
+                clean: bool = False, overwrite_config: bool = False, skip_config: bool = False,
+                dry_run: bool = False) -> Dict[str, Any]:
+        """
+        Restore an archive.
+
+        Args:
+            archive_path: Archive written by backup
+            passphrase: Its passphrase
+            collections: Only these state collections
+            clean: Delete documents of the restored collections that the archive does not have
+            overwrite_config: Replace configuration files that differ from the archive's
+            skip_config: Restore state only
+            dry_run: Report what would change; change nothing
+
+        Returns:
+            Per collection the documents restored and deleted, the configuration
+            files written, kept (they differ; see overwrite_config) and unchanged,
+            and the env_var references not set in this environment
+
+        Raises:
+            BackupError: If the archive cannot be read
+        """
+        with open(archive_path, "rb") as f:
+            payload = decrypt_archive(f.read(), passphrase)
+        result = {"archive": archive_path, "dry_run": dry_run, "collections": {}, "config_written": [],
+                  "config_kept": [], "config_unchanged": [], "missing_env_vars": []}
+        with zipfile.ZipFile(io.BytesIO(payload)) as archive:
+            manifest = json.loads(archive.read("manifest.json"))
+            result["created_at"], result["host"] = manifest["created_at"], manifest["host"]
+            for collection in sorted(manifest["collections"]):
+                if collections and collection not in collections:
+                    continue
+                documents = json.loads(archive.read(f"state/{collection}.json"))
+                stale = [key for key in self.store.keys(collection) if key not in documents] if clean else []
+                if not dry_run:
+                    for key, document in documents.items():
+                        self.store.save(collection, key, document)
+                    for key in stale:
+                        self.store.delete(collection, key)
+                result["collections"][collection] = {"restored": len(documents), "deleted": len(stale)}
+            if not skip_config:
+                for relative in manifest["config_files"]:
+                    self._restore_config(archive, relative, overwrite_config, dry_run, result)
+        result["missing_env_vars"] = sorted({ref["reference"] for ref in manifest["secret_references"]
+                                             if ref["kind"] == "env_var" and not os.environ.get(ref["reference"])})
+        result["secret_references"] = sorted({ref["reference"] for ref in manifest["secret_references"]
+                                              if ref["kind"] == "secret"})
+        if not dry_run:
+            logger.info(f"Restored {sum(c['restored'] for c in result['collections'].values())} state documents "
+                        f"and {len(result['config_written'])} configuration files from {archive_path}")
+        return result
+
+    def _restore_config(self, archive: zipfile.ZipFile, relative: str, overwrite: bool, dry_run: bool,
+                        result: Dict[str, Any]) -> None:
+        path = os.path.join(self.config_dir, *relative.split("/"))
+        content = archive.read(f"config/{relative}")
+        if os.path.exists(path):
+            with open(path, "rb") as f:
+                current = f.read()
+            if current == content:
+                result["config_unchanged"].append(path)
+                return
+            if not overwrite:
+                result["config_kept"].append(path)
+                return
+        if not dry_run:
+            os.makedirs(os.path.dirname(path), exist_ok=True)
+            with open(path, "wb") as f:
+                f.write(content)
+        result["config_written"].append(path)
+
+    def _config_files(self) -> List[Tuple[str, str]]:
+        """The county configuration files, as (path relative to the directory with / separators, path)."""
+        files = []
+        if not os.path.isdir(self.config_dir):
+            return files
+        for root, _, names in os.walk(self.config_dir):
+            for name in sorted(names):
+                if name.lower().endswith(CONFIG_EXTENSIONS):
+                    path = os.path.join(root, name)
+                    files.append((os.path.relpath(path, self.config_dir).replace(os.sep, "/"), path))
+        return sorted(files)
+
+
+def format_backup(manifest: Dict[str, Any]) -> str:
+    """A backup's manifest as a summary."""
+    lines = [f"{collection}: {count} documents" for collection, count in manifest["collections"].items()]
+    lines.append(f"{len(manifest['config_files'])} configuration files, "
+                 f"{len(manifest['secret_references'])} secret references (names only)")
+    lines.append(f"Wrote {manifest['archive']} ({manifest['bytes']} bytes)")
+    return "\n".join(lines)
+
+
+def format_restore(result: Dict[str, Any]) -> str:
+    """A restore's result as a summary."""
+    verb = "Would restore" if result["dry_run"] else "Restored"
+    lines = [f"{verb} the backup of {result['host']} taken {result['created_at']}"]
+    lines += [f"{collection}: {counts['restored']} documents" + (f", {counts['deleted']} deleted"
+                                                                  if counts["deleted"] else "")
+              for collection, counts in result["collections"].items()]
+    lines += [f"Wrote {path}" for path in result["config_written"]]
+    lines += [f"Kept {path}; it differs from the archive's (--overwrite-config replaces it)"
+              for path in result["config_kept"]]
+    if result["missing_env_vars"]:
+        lines.append(f"Set these environment variables the configuration reads: "
+                     f"{', '.join(result['missing_env_vars'])}")
+    if result["secret_references"]:
+        lines.append(f"Check that these secrets resolve here: {', '.join(result['secret_references'])}")
+    return "\n".join(lines)
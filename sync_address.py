@@ -0,0 +1,833 @@
+"""
+TerraFusion SyncService - Address Standardization and Geocoding
+
+This module standardizes the situs (or mailing) addresses of synced tables
+as records are loaded, since they arrive from the CAMA systems as typed:
+"123 north main street apt. 4", "123 N MAIN ST #4, Kennewick WA 99336" and
+"123 N. Main" are the same address. Each address is parsed into USPS
+Publication 28 components (house number, directionals, street name,
+abbreviated street type, unit, city, state, ZIP+4), optionally geocoded, and
+the components and a match confidence are written back to the record:
+
+    "address_standardization": {
+        "tables": {
+            "dbo.situs": {
+                "columns": {"street": "situs_street", "city": "situs_city", "zip": "situs_zip"},
+                "defaults": {"state": "WA"},
+                "cities": ["KENNEWICK", "RICHLAND", "WEST RICHLAND", "PROSSER", "BENTON CITY"],
+                "prefix": "situs_",
+                "geocoder": {"type": "census"},
+                "min_confidence": 0.6,
+                "below_min": "keep"
+            }
+        }
+    }
+
+A table's address is one column ("address") or the street, city, state and
+zip columns given by "columns". The outputs are written as prefix + name
+for the names in ADDRESS_OUTPUTS ("outputs" keeps fewer); latitude and
+longitude only with a geocoder. "cities" lists the county's city names so
+they can be told apart from street names when an address has no commas.
+
+Parsers and geocoders are pluggable. The parser is "local" (the built-in
+rule-based parser, the default), "libpostal" (libpostal's statistical parser,
+when the postal package is installed, with the street standardized as
+"local" does) or a "package.module:ClassName" subclass of AddressParser. The
+geocoder is "census" (the US Census Bureau geocoder), "arcgis" (an ArcGIS
+geocode service such as the county's own locator; "url" required),
+"nominatim" (OpenStreetMap; "user_agent" required, one request a second) or
+a "package.module:ClassName" subclass of Geocoder. Geocoded results are cached
+for the table's run, and geocoding stops for the run after
+GEOCODER_FAILURE_LIMIT failed requests in a row, so an unreachable service
+slows a sync but doesn't fail it.
+
+The match confidence is the geocoder's (0 when it finds no match) with a
+geocoder, and the parser's otherwise: how much of a complete address it
+found. match_status is "matched", "parsed", "unmatched" or "low_confidence";
+records below min_confidence are loaded so flagged ("below_min": "keep", the
+default) or rejected to the dead-letter store ("reject"). The stage runs
+after hooks, field mappings and geometry repair, so columns are target names
+and validation rules can check the outputs. Each table result counts the
+addresses checked, standardized, geocoded, unmatched, below min_confidence
+and rejected, and the geocoder errors.
+"""
+
+import os
+import re
+import time
+import logging
+import importlib
+from collections import OrderedDict
+from typing import Dict, List, Any, Optional
+
+import requests
+
+from sync_connectors import OPERATION_FIELD
+from tracing import tracer
+
+try:
+    from postal.parser import parse_address as postal_parse_address
+    POSTAL_AVAILABLE = True
+except ImportError:
+    POSTAL_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Components an address is parsed into
+ADDRESS_COMPONENTS = [
+    "house_number", "predirectional", "street_name", "street_type", "postdirectional",
+    "unit_type", "unit_number", "city", "state", "zip", "zip4",
+]
+
+# Columns written back to the record, each as the table's prefix + name
+ADDRESS_OUTPUTS = ADDRESS_COMPONENTS + ["standardized", "match_confidence", "match_status", "latitude", "longitude"]
+
+# Outputs written only when the table has a geocoder
+GEOCODED_OUTPUTS = ["latitude", "longitude"]
+
+# Columns an address can be read from
+ADDRESS_COLUMNS = ["street", "city", "state", "zip"]
+
+# What happens to a record whose match confidence is below min_confidence
+BELOW_MIN_ACTIONS = ["keep", "reject"]
+
+# Geocoded results cached for a table's run
+GEOCODE_CACHE_SIZE = 10000
+
+# Failed geocoder requests in a row before geocoding stops for the run
+GEOCODER_FAILURE_LIMIT = 5
+
+# Seconds to wait for a geocoder response
+DEFAULT_GEOCODER_TIMEOUT = 10
+
+# US Census Bureau geocoder endpoint and benchmark
+CENSUS_GEOCODER_URL = "https://geocoding.geo.census.gov/geocoder/locations/address"
+DEFAULT_CENSUS_BENCHMARK = "Public_AR_Current"
+
+# OpenStreetMap Nominatim search endpoint; its usage policy allows one request a second
+NOMINATIM_URL = "https://nominatim.openstreetmap.org/search"
+NOMINATIM_INTERVAL_SECONDS = 1.0
+
+# Directionals and their USPS abbreviations
+DIRECTIONALS = {
+    "N": "N", "NORTH": "N", "S": "S", "SOUTH": "S", "E": "E", "EAST": "E", "W": "W", "WEST": "W",
+    "NE": "NE", "NORTHEAST": "NE", "NW": "NW", "NORTHWEST": "NW",
+    "SE": "SE", "SOUTHEAST": "SE", "SW": "SW", "SOUTHWEST": "SW",
+}
+
+# USPS street type abbreviations and the spellings that map to them (Publication 28, appendix C1)
+_STREET_TYPES = {
+    "ALY": ["ALLEY", "ALLEE", "ALLY"], "AVE": ["AVENUE", "AV", "AVEN", "AVENU", "AVN", "AVNUE"],
+    "BLVD": ["BOULEVARD", "BOUL", "BOULV"], "BR": ["BRANCH", "BRNCH"], "BRG": ["BRIDGE", "BRDGE"],
+    "BYP": ["BYPASS", "BYPA", "BYPAS", "BYPS"], "CIR": ["CIRCLE", "CIRC", "CIRCL", "CRCL", "CRCLE"],
+    "CLF": ["CLIFF"], "CT": ["COURT", "CRT"], "CTR": ["CENTER", "CEN", "CENT", "CENTR", "CNTR"],
+    "CTS": ["COURTS"], "CV": ["COVE"], "CRK": ["CREEK"], "CRES": ["CRESCENT", "CRSENT"],
+    "CSWY": ["CAUSEWAY", "CAUSWA"], "CYN": ["CANYON", "CANYN", "CNYN"], "DR": ["DRIVE", "DRIV", "DRV"],
+    "ESTS": ["ESTATES"], "EXPY": ["EXPRESSWAY", "EXP", "EXPR", "EXPRESS", "EXPW"],
+    "EXT": ["EXTENSION", "EXTN", "EXTNSN"], "FWY": ["FREEWAY", "FREEWY", "FRWAY", "FRWY"],
+    "GDNS": ["GARDENS", "GARDN", "GRDEN", "GRDN"], "GLN": ["GLEN"], "GRN": ["GREEN"], "GRV": ["GROVE", "GROV"],
+    "HBR": ["HARBOR", "HARB", "HARBR", "HRBOR"], "HL": ["HILL"], "HLS": ["HILLS"],
+    "HOLW": ["HOLLOW", "HLLW", "HOLLOWS", "HOLWS"], "HTS": ["HEIGHTS", "HT"],
+    "HWY": ["HIGHWAY", "HIGHWY", "HIWAY", "HIWY", "HWAY"], "JCT": ["JUNCTION", "JCTION", "JCTN", "JUNCTN"],
+    "KNL": ["KNOLL", "KNOL"], "LK": ["LAKE"], "LKS": ["LAKES"], "LN": ["LANE"], "LNDG": ["LANDING", "LNDNG"],
+    "LOOP": ["LOOPS"], "MDWS": ["MEADOWS", "MDW", "MEDOWS"], "ML": ["MILL"], "MNR": ["MANOR"],
+    "MT": ["MOUNT", "MNT"], "MTN": ["MOUNTAIN", "MNTAIN", "MNTN", "MOUNTIN"], "PARK": ["PRK"],
+    "PASS": [], "PATH": ["PATHS"], "PIKE": ["PIKES"], "PKWY": ["PARKWAY", "PARKWY", "PKWAY", "PKY"],
+    "PL": ["PLACE"], "PLZ": ["PLAZA", "PLZA"], "PR": ["PRAIRIE", "PRR"], "PT": ["POINT"],
+    "RDG": ["RIDGE", "RDGE"], "RD": ["ROAD"], "RNCH": ["RANCH", "RANCHES", "RNCHS"], "ROW": [],
+    "RTE": ["ROUTE"], "RUN": [], "SMT": ["SUMMIT", "SUMIT", "SUMITT"], "SQ": ["SQUARE", "SQR", "SQRE", "SQU"],
+    "ST": ["STREET", "STRT", "STR"], "STA": ["STATION", "STATN", "STN"], "TER": ["TERRACE", "TERR"],
+    "TPKE": ["TURNPIKE", "TRNPK", "TURNPK"], "TRCE": ["TRACE", "TRACES"], "TRL": ["TRAIL", "TRAILS", "TRLS"],
+    "VIS": ["VISTA", "VIST", "VST", "VSTA"], "VLG": ["VILLAGE", "VILL", "VILLAG", "VILLG"],
+    "VLY": ["VALLEY", "VALLY", "VLLY"], "VW": ["VIEW"], "WALK": ["WALKS"], "WAY": ["WY"], "XING": ["CROSSING", "CRSSNG"],
+}
+STREET_TYPES = {variant: abbreviation for abbreviation, variants in _STREET_TYPES.items()
+                for variant in [abbreviation] + variants}
+
+# Street types that name a numbered road ("HWY 395", "RTE 240") when a number follows
+NUMBERED_ROAD_TYPES = ["HWY", "RTE"]
+
+# USPS unit designators (Publication 28, appendix C2), with whether a number follows
+_UNIT_TYPES = {
+    "APT": (["APARTMENT"], True), "BLDG": (["BUILDING"], True), "DEPT": (["DEPARTMENT"], True),
+    "FL": (["FLOOR"], True), "HNGR": (["HANGAR"], True), "LOT": ([], True), "PIER": ([], True),
+    "RM": (["ROOM"], True), "SLIP": ([], True), "SPC": (["SPACE"], True), "STE": (["SUITE"], True),
+    "TRLR": (["TRAILER"], True), "UNIT": ([], True), "#": ([], True),
+    "BSMT": (["BASEMENT"], False), "FRNT": (["FRONT"], False), "LBBY": (["LOBBY"], False),
+    "LOWR": (["LOWER"], False), "OFC": (["OFFICE"], False), "PH": (["PENTHOUSE"], False),
+    "REAR": ([], False), "UPPR": (["UPPER"], False),
+}
+UNIT_TYPES = {variant: abbreviation for abbreviation, (variants, _) in _UNIT_TYPES.items()
+              for variant in [abbreviation] + variants}
+UNIT_NEEDS_NUMBER = {abbreviation: numbered for abbreviation, (_, numbered) in _UNIT_TYPES.items()}
+
+# State and territory names and their USPS abbreviations
+_STATES = {
+    "AL": "ALABAMA", "AK": "ALASKA", "AZ": "ARIZONA", "AR": "ARKANSAS", "CA": "CALIFORNIA", "CO": "COLORADO",
+    "CT": "CONNECTICUT", "DE": "DELAWARE", "DC": "DISTRICT OF COLUMBIA", "FL": "FLORIDA", "GA": "GEORGIA",
+    "HI": "HAWAII", "ID": "IDAHO", "IL": "ILLINOIS", "IN": "INDIANA", "IA": "IOWA", "KS": "KANSAS",
+    "KY": "KENTUCKY", "LA": "LOUISIANA", "ME": "MAINE", "MD": "MARYLAND", "MA": "MASSACHUSETTS",
+    "MI": "MICHIGAN", "MN": "MINNESOTA", "MS": "MISSISSIPPI", "MO": "MISSOURI", "MT": "MONTANA",
+    "NE": "NEBRASKA", "NV": "NEVADA", "NH": "NEW HAMPSHIRE", "NJ": "NEW JERSEY", "NM": "NEW MEXICO",
+    "NY": "NEW YORK", "NC": "NORTH CAROLINA", "ND": "NORTH DAKOTA", "OH": "OHIO", "OK": "OKLAHOMA",
+    "OR": "OREGON", "PA": "PENNSYLVANIA", "RI": "RHODE ISLAND", "SC": "SOUTH CAROLINA", "SD": "SOUTH DAKOTA",
+    "TN": "TENNESSEE", "TX": "TEXAS", "UT": "UTAH", "VT": "VERMONT", "VA": "VIRGINIA", "WA": "WASHINGTON",
+    "WV": "WEST VIRGINIA", "WI": "WISCONSIN", "WY": "WYOMING", "PR": "PUERTO RICO", "GU": "GUAM",
+    "VI": "VIRGIN ISLANDS", "AS": "AMERICAN SAMOA", "MP": "NORTHERN MARIANA ISLANDS",
+}
+STATES = dict({name: abbreviation for abbreviation, name in _STATES.items()},
+              **{abbreviation: abbreviation for abbreviation in _STATES})
+
+# What each missing part of an address takes off the parser's confidence
+CONFIDENCE_PENALTIES = {
+    "house_number": 0.4,
+    "street_name": 0.3,
+    "street_type": 0.1,
+    "locality": 0.1,  # Neither a city nor a ZIP code
+    "city_inferred": 0.05,  # A city told from the street without a comma or a known city name
+}
+
+_ZIP = re.compile(r"^(\d{5})(?:-?(\d{4}))?$")
+_HOUSE_NUMBER = re.compile(r"^\d+[A-Z]?$|^\d+-\d+[A-Z]?$|^[NSEW]\d+$")
+_FRACTION = re.compile(r"^\d/\d$")
+_PO_BOX = re.compile(r"^(?:P\s?O|POST OFFICE)\s+BOX\s+(\S+)(.*)$")
+
+
+class GeocoderError(Exception):
+    """Raised when a geocoder request fails (not when it finds no match)."""
+
+
+def normalize_text(text: Any) -> str:
+    """An address upper-cased, with periods dropped and punctuation other than , # / - & turned into spaces."""
+    text = str(text or "").upper().replace(".", "")
+    text = re.sub(r"[^A-Z0-9,#/&\- ]", " ", text)
+    text = text.replace("#", " # ")
+    return re.sub(r"\s+", " ", re.sub(r"\s*,\s*", ", ", text)).strip(" ,")
+
+
+def empty_address() -> Dict[str, Any]:
+    return {name: None for name in ADDRESS_COMPONENTS}
+
+
+def standardized_line(address: Dict[str, Any]) -> Optional[str]:
+    """The delivery line of parsed components: "123 N MAIN ST APT 4"."""
+    parts = [address.get(name) for name in
+             ("house_number", "predirectional", "street_name", "street_type", "postdirectional", "unit_type", "unit_number")]
+    line = " ".join(p for p in parts if p)
+    return line or None
+
+
+def parser_confidence(address: Dict[str, Any], city_inferred: bool = False) -> float:
+    """How much of a complete address the parser found, from 0 to 1."""
+    confidence = 1.0
+    po_box = (address.get("street_name") or "").startswith("PO BOX")
+    if not address.get("house_number") and not po_box:
+        confidence -= CONFIDENCE_PENALTIES["house_number"]
+    if not address.get("street_name"):
+        confidence -= CONFIDENCE_PENALTIES["street_name"]
+    elif not address.get("street_type") and not po_box and not _numbered_road(address["street_name"].split()):
+        confidence -= CONFIDENCE_PENALTIES["street_type"]
+    if not address.get("city") and not address.get("zip"):
+        confidence -= CONFIDENCE_PENALTIES["locality"]
+    if city_inferred:
+        confidence -= CONFIDENCE_PENALTIES["city_inferred"]
+    return round(max(0.0, confidence), 2)
+
+
+def _numbered_road(tokens: List[str]) -> bool:
+    return any(STREET_TYPES.get(t) in NUMBERED_ROAD_TYPES and i + 1 < len(tokens) and tokens[i + 1][:1].isdigit()
+               for i, t in enumerate(tokens))
+
+
+class AddressParser:
+    """
+    Base class for address parsers.
+
+    Subclasses implement parse(); a parser is created once per table run
+    with the "parser_options" of the table's settings.
+    """
+
+    parser_type = "base"
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None, cities: Optional[List[str]] = None):
+        """
+        Initialize the parser.
+
+        Args:
+            options: The table's parser_options
+            cities: City names of the county, upper-cased
+
+        Raises:
+            ValueError: If the options are invalid
+        """
+        self.options = options or {}
+        self.cities = sorted(cities or [], key=lambda c: -len(c.split()))
+
+    def parse(self, text: str) -> Dict[str, Any]:
+        """
+        Parse an address.
+
+        Returns:
+            The ADDRESS_COMPONENTS (None when not found) and "confidence", from 0 to 1
+        """
+        raise NotImplementedError
+
+
+class LocalAddressParser(AddressParser):
+    """
+    Rule-based parser for US addresses.
+
+    The address is split at commas; the ZIP code and state are taken from
+    the end, the city from the segment before them (or, without commas, the
+    county's known city names or whatever follows the street type), and the
+    street line is read left to right: house number, predirectional, street
+    name up to its last street type, postdirectional and unit.
+    """
+
+    parser_type = "local"
+
+    def parse(self, text: str) -> Dict[str, Any]:
+        address = empty_address()
+        segments = [s.split() for s in normalize_text(text).split(", ") if s]
+        if not segments:
+            return dict(address, confidence=0.0)
+        self._locality(segments, address)
+        street = segments[0]
+        if len(segments) > 1:
+            # Segments between the street line and the city, and a last one that is a unit, belong to the street
+            for segment in segments[1:-1]:
+                street = street + segment
+            if self._unit_at(segments[-1], 0):
+                street = street + segments[-1]
+            else:
+                address["city"] = " ".join(segments[-1])
+        else:
+            street = self._city_from_street(street, address)
+        leftover = self.street(street, address)
+        city_inferred = False
+        if leftover and not address["city"]:
+            address["city"] = " ".join(leftover)
+            city_inferred = True
+        return dict(address, confidence=parser_confidence(address, city_inferred))
+
+    def street(self, tokens: List[str], address: Dict[str, Any]) -> List[str]:
+        """
+        Read a street line into address; returns the tokens left after it
+        (a city, when the line had one).
+        """
+        if not tokens:
+            return []
+        match = _PO_BOX.match(" ".join(tokens))
+        if match:
+            address["street_name"] = f"PO BOX {match.group(1)}"
+            return match.group(2).split()
+        i = 0
+        if _HOUSE_NUMBER.match(tokens[0]) and len(tokens) > 1:
+            address["house_number"] = tokens[0]
+            i = 1
+            if i < len(tokens) - 1 and _FRACTION.match(tokens[i]):
+                address["house_number"] += f" {tokens[i]}"
+                i += 1
+        # A directional followed only by a street type is the street name ("123 NORTH ST")
+        if i < len(tokens) - 1 and tokens[i] in DIRECTIONALS and not (
+                tokens[i + 1] in STREET_TYPES and (i + 2 == len(tokens) or tokens[i + 2] in DIRECTIONALS
+                                                   or self._unit_at(tokens, i + 2))):
+            address["predirectional"] = DIRECTIONALS[tokens[i]]
+            i += 1
+
+        # The street name runs to the first unit designator after it, or to the end
+        end = next((j for j in range(i + 1, len(tokens)) if self._unit_at(tokens, j)), len(tokens))
+        name = tokens[i:end]
+        leftover = self._unit(tokens[end:], address)
+
+        # The street type is the last one after the first name word, unless it names a numbered road
+        kind = next((j for j in range(len(name) - 1, 0, -1) if name[j] in STREET_TYPES
+                     and not (STREET_TYPES[name[j]] in NUMBERED_ROAD_TYPES
+                              and j + 1 < len(name) and name[j + 1][:1].isdigit())), None)
+        if kind is not None:
+            after = name[kind + 1:]
+            address["street_type"] = STREET_TYPES[name[kind]]
+            name = name[:kind]
+            if after and after[0] in DIRECTIONALS:
+                address["postdirectional"] = DIRECTIONALS[after[0]]
+                after = after[1:]
+            leftover = after + leftover
+        elif len(name) > 1 and name[-1] in DIRECTIONALS and not address["predirectional"]:
+            address["postdirectional"] = DIRECTIONALS[name[-1]]
+            name = name[:-1]
+        address["street_name"] = " ".join(name) or None
+        return leftover
+
+    def _locality(self, segments: List[List[str]], address: Dict[str, Any]) -> None:
+        """Take the ZIP code and state off the end of the address."""
+        last = segments[-1]
+        if last and _ZIP.match(last[-1]):
+            match = _ZIP.match(last.pop())
+            address["zip"], address["zip4"] = match.group(1), match.group(2)
+        commas = len(segments) > 1
+        for size in (3, 2, 1):
+            name = " ".join(last[-size:])
+            if len(last) < size or name not in STATES or (not commas and len(last) == size):
+                continue
+            # Without a comma or a ZIP code, "CT" and "MT" are read as a street type rather than a state
+            if commas or address["zip"] or name not in STREET_TYPES:
+                address["state"] = STATES[name]
+                del last[-size:]
+                break
+        if not last and commas:
+            segments.pop()
+            if len(segments) > 1 and not address["state"] and len(segments[-1]) <= 3 and " ".join(segments[-1]) in STATES:
+                address["state"] = STATES[" ".join(segments.pop())]
+
+    def _city_from_street(self, street: List[str], address: Dict[str, Any]) -> List[str]:
+        """Take a known city name off the end of a street line with no comma before the city."""
+        for city in self.cities:
+            words = city.split()
+            if len(street) > len(words) and street[-len(words):] == words:
+                address["city"] = city
+                return street[:-len(words)]
+        return street
+
+    @staticmethod
+    def _unit_at(tokens: List[str], j: int) -> bool:
+        designator = UNIT_TYPES.get(tokens[j])
+        if designator is None:
+            return False
+        if UNIT_NEEDS_NUMBER[designator]:
+            return j + 1 < len(tokens) and (any(c.isdigit() for c in tokens[j + 1]) or len(tokens[j + 1]) == 1)
+        return j == len(tokens) - 1
+
+    @staticmethod
+    def _unit(tokens: List[str], address: Dict[str, Any]) -> List[str]:
+        if not tokens:
+            return []
+        designator = UNIT_TYPES[tokens[0]]
+        if UNIT_NEEDS_NUMBER[designator]:
+            address["unit_type"] = "#" if designator == "#" else designator
+            address["unit_number"] = tokens[1].lstrip("#")
+            return tokens[2:]
+        address["unit_type"] = designator
+        return tokens[1:]
+
+
+class LibpostalAddressParser(AddressParser):
+    """
+    Parser using libpostal's statistical model (the postal package), with
+    the street standardized by the local parser's rules.
+    """
+
+    parser_type = "libpostal"
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None, cities: Optional[List[str]] = None):
+        super().__init__(options, cities)
+        if not POSTAL_AVAILABLE:
+            raise ValueError("The libpostal address parser requires the postal package (pip install postal)")
+        self.local = LocalAddressParser(options, cities)
+
+    def parse(self, text: str) -> Dict[str, Any]:
+        labels: Dict[str, str] = {}
+        for value, label in postal_parse_address(str(text or "")):
+            labels.setdefault(label, value)
+        address = empty_address()
+        street = " ".join(labels[k] for k in ("house_number", "road") if k in labels)
+        if "unit" in labels:
+            street += " " + labels["unit"]
+        self.local.street(normalize_text(street).split(), address)
+        address["city"] = normalize_text(labels.get("city", "")) or None
+        state = normalize_text(labels.get("state", ""))
+        address["state"] = STATES.get(state, state or None)
+        match = _ZIP.match(normalize_text(labels.get("postcode", "")).replace(" ", ""))
+        if match:
+            address["zip"], address["zip4"] = match.group(1), match.group(2)
+        return dict(address, confidence=parser_confidence(address))
+
+
+class Geocoder:
+    """
+    Base class for geocoders.
+
+    Subclasses implement geocode(); a geocoder is created once per table run
+    from the table's "geocoder" settings and may keep a session across requests.
+    """
+
+    geocoder_type = "base"
+    # Seconds between requests, unless the settings give min_interval_seconds
+    default_interval = 0.0
+
+    def __init__(self, config: Dict[str, Any]):
+        """
+        Initialize the geocoder.
+
+        Args:
+            config: The table's "geocoder" settings
+
+        Raises:
+            ValueError: If a setting is invalid
+        """
+        self.config = config
+        self.timeout = float(config.get("timeout_seconds", DEFAULT_GEOCODER_TIMEOUT))
+        self.interval = float(config.get("min_interval_seconds", self.default_interval))
+        self.session = None
+        self._last_request = 0.0
+
+    def geocode(self, address: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+        """
+        Geocode a parsed address.
+
+        Args:
+            address: ADDRESS_COMPONENTS and "standardized", the delivery line
+
+        Returns:
+            The match's latitude, longitude, confidence (0 to 1) and
+            matched_address, or None when there is no match
+
+        Raises:
+            GeocoderError: If the request fails
+        """
+        raise NotImplementedError
+
+    def close(self) -> None:
+        if self.session is not None:
+            self.session.close()
+            self.session = None
+
+    def _get(self, url: str, params: Dict[str, Any], headers: Optional[Dict[str, str]] = None) -> Any:
+        """Send a GET request, no sooner than the interval after the last one, and return the JSON body."""
+        if self.session is None:
+            self.session = tracer.traced_session(requests.Session())
+            self.session.verify = self.config.get("verify_ssl", True)
+        wait = self._last_request + self.interval - time.monotonic()
+        if wait > 0:
+            time.sleep(wait)
+        self._last_request = time.monotonic()
+        try:
+            response = self.session.get(url, params=params, headers=headers, timeout=self.timeout)
+            response.raise_for_status()
+            return response.json()
+        except (requests.RequestException, ValueError) as e:
+            raise GeocoderError(f"{self.geocoder_type} geocoder request failed: {e}")
+
+
+class CensusGeocoder(Geocoder):
+    """The US Census Bureau geocoder, matching against TIGER address ranges."""
+
+    geocoder_type = "census"
+
+    def geocode(self, address: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+        params = {
+            "street": address["standardized"],
+            "city": address.get("city") or "",
+            "state": address.get("state") or "",
+            "zip": address.get("zip") or "",
+            "benchmark": self.config.get("benchmark", DEFAULT_CENSUS_BENCHMARK),
+            "format": "json",
+        }
+        body = self._get(self.config.get("url", CENSUS_GEOCODER_URL), params)
+        matches = ((body or {}).get("result") or {}).get("addressMatches") or []
+        if not matches:
+            return None
+        best = matches[0]
+        # Several candidates mean the address was ambiguous
+        return {
+            "latitude": float(best["coordinates"]["y"]),
+            "longitude": float(best["coordinates"]["x"]),
+            "confidence": 1.0 if len(matches) == 1 else 0.7,
+            "matched_address": best.get("matchedAddress"),
+        }
+
+
+class ArcGisGeocoder(Geocoder):
+    """An ArcGIS geocode service (findAddressCandidates), such as a county's own locator."""
+
+    geocoder_type = "arcgis"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        if not config.get("url"):
+            raise ValueError("The arcgis geocoder requires 'url', the GeocodeServer URL")
+
+    def geocode(self, address: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+        line = ", ".join(p for p in (address["standardized"], address.get("city"),
+                                     " ".join(p for p in (address.get("state"), address.get("zip")) if p)) if p)
+        params = {"SingleLine": line, "outSR": 4326, "maxLocations": 1, "outFields": "Match_addr", "f": "json"}
+        token = os.environ.get(self.config["token_env_var"]) if self.config.get("token_env_var") else None
+        if token:
+            params["token"] = token
+        body = self._get(self.config["url"].rstrip("/") + "/findAddressCandidates", params)
+        if isinstance(body, dict) and body.get("error"):
+            raise GeocoderError(f"arcgis geocoder request failed: {body['error'].get('message', body['error'])}")
+        candidates = (body or {}).get("candidates") or []
+        if not candidates:
+            return None
+        best = candidates[0]
+        return {
+            "latitude": float(best["location"]["y"]),
+            "longitude": float(best["location"]["x"]),
+            "confidence": round(float(best.get("score", 0)) / 100, 2),
+            "matched_address": best.get("address"),
+        }
+
+
+class NominatimGeocoder(Geocoder):
+    """OpenStreetMap's Nominatim search, for addresses the other geocoders miss."""
+
+    geocoder_type = "nominatim"
+    default_interval = NOMINATIM_INTERVAL_SECONDS
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        if not config.get("user_agent"):
+            raise ValueError("The nominatim geocoder requires 'user_agent', identifying the county to OpenStreetMap")
+
+    def geocode(self, address: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+        street = " ".join(p for p in (address.get("house_number"), address.get("predirectional"), address.get("street_name"),
+                                      address.get("street_type"), address.get("postdirectional")) if p)
+        params = {"street": street, "city": address.get("city") or "", "state": address.get("state") or "",
+                  "postalcode": address.get("zip") or "", "countrycodes": "us", "format": "jsonv2", "limit": 1}
+        body = self._get(self.config.get("url", NOMINATIM_URL), params, {"User-Agent": self.config["user_agent"]})
+        if not body:
+            return None
+        best = body[0]
+        rank = int(best.get("place_rank", 0))
+        # Rank 30 is a building or address point, 26-27 a street
+        return {
+            "latitude": float(best["lat"]),
+            "longitude": float(best["lon"]),
+            "confidence": 1.0 if rank >= 30 else 0.6 if rank >= 26 else 0.3,
+            "matched_address": best.get("display_name"),
+        }
+
+
+# Built-in parser and geocoder types
+PARSER_TYPES = {cls.parser_type: cls for cls in (LocalAddressParser, LibpostalAddressParser)}
+GEOCODER_TYPES = {cls.geocoder_type: cls for cls in (CensusGeocoder, ArcGisGeocoder, NominatimGeocoder)}
+
+
+def _provider_class(kind: str, provider_type: str, types: Dict[str, type], base: type) -> type:
+    """A built-in provider class, or a "package.module:ClassName" plugin subclassing base."""
+    provider_class = types.get(provider_type)
+    if provider_class is None and isinstance(provider_type, str) and ":" in provider_type:
+        module_name, class_name = provider_type.split(":", 1)
+        try:
+            provider_class = getattr(importlib.import_module(module_name), class_name)
+        except (ImportError, AttributeError) as e:
+            raise ValueError(f"Cannot load address {kind} plugin {provider_type}: {e}")
+        if not isinstance(provider_class, type) or not issubclass(provider_class, base):
+            raise ValueError(f"Address {kind} plugin {provider_type} is not a {base.__name__}")
+    if provider_class is None:
+        raise ValueError(f"Unsupported address {kind}: {provider_type}. Supported: {', '.join(types)}")
+    return provider_class
+
+
+def parse_address_standardization(sync_pair_id: str, definition: Optional[Dict[str, Any]],
+                                  table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the address_standardization block of a sync pair and fill in defaults.
+
+    Raises:
+        ValueError: If a setting is invalid or names an unknown table
+    """
+    if not definition:
+        return {}
+    tables = {}
+    for table_name, settings in (definition.get("tables") or {}).items():
+        if table_name not in table_names:
+            raise ValueError(f"Address standardization of sync pair {sync_pair_id} names unknown table {table_name}")
+        if not isinstance(settings, dict):
+            raise ValueError(f"Address standardization settings of {table_name} must be an object")
+        columns = settings.get("columns") or {}
+        if settings.get("address"):
+            if columns:
+                raise ValueError(f"Address standardization of {table_name} takes 'address' or 'columns', not both")
+            columns = {"street": settings["address"]}
+        if not isinstance(columns, dict) or not isinstance(columns.get("street"), str) \
+                or any(k not in ADDRESS_COLUMNS or not isinstance(v, str) for k, v in columns.items()):
+            raise ValueError(f"Address standardization of {table_name} requires 'address', the address column, "
+                             f"or 'columns' mapping {', '.join(ADDRESS_COLUMNS)} to columns (street required)")
+        defaults = settings.get("defaults") or {}
+        if not isinstance(defaults, dict) or any(k not in ("city", "state", "zip") for k in defaults):
+            raise ValueError(f"Address standardization defaults of {table_name} may set city, state and zip")
+        cities = settings.get("cities") or []
+        if not isinstance(cities, list) or not all(isinstance(c, str) for c in cities):
+            raise ValueError(f"Address standardization cities of {table_name} must be a list of names")
+        prefix = settings.get("prefix", "address_")
+        if not isinstance(prefix, str):
+            raise ValueError(f"Address standardization prefix of {table_name} must be a string")
+        geocoder = settings.get("geocoder")
+        if geocoder is not None and (not isinstance(geocoder, dict) or not geocoder.get("type")):
+            raise ValueError(f"Address standardization geocoder of {table_name} must be an object with a 'type'")
+        outputs = settings.get("outputs") or [
+            name for name in ADDRESS_OUTPUTS if geocoder or name not in GEOCODED_OUTPUTS
+        ]
+        if not isinstance(outputs, list) or any(name not in ADDRESS_OUTPUTS for name in outputs):
+            raise ValueError(f"Address standardization outputs of {table_name} must be a list of: {', '.join(ADDRESS_OUTPUTS)}")
+        if not geocoder and any(name in GEOCODED_OUTPUTS for name in outputs):
+            raise ValueError(f"Address standardization of {table_name} outputs latitude and longitude only with a geocoder")
+        min_confidence = settings.get("min_confidence", 0)
+        if isinstance(min_confidence, bool) or not isinstance(min_confidence, (int, float)) or not 0 <= min_confidence <= 1:
+            raise ValueError(f"Address standardization min_confidence of {table_name} must be 0 to 1")
+        below_min = settings.get("below_min", "keep")
+        if below_min not in BELOW_MIN_ACTIONS:
+            raise ValueError(f"Unsupported below_min action: {below_min}. Supported: {', '.join(BELOW_MIN_ACTIONS)}")
+        table = {
+            "columns": dict(columns),
+            "defaults": {k: normalize_text(v) for k, v in defaults.items()},
+            "cities": [normalize_text(c) for c in cities],
+            "prefix": prefix,
+            "parser": settings.get("parser", "local"),
+            "parser_options": dict(settings.get("parser_options") or {}),
+            "geocoder": dict(geocoder) if geocoder else None,
+            "outputs": list(outputs),
+            "min_confidence": float(min_confidence),
+            "below_min": below_min,
+        }
+        # Fail at load time on unknown types, missing plugins or bad options
+        AddressStandardizer(table_name, table)
+        tables[table_name] = table
+    return {"tables": tables}
+
+
+class AddressStandardizer:
+    """Standardizes and geocodes the addresses of one table's records, batch by batch."""
+
+    def __init__(self, table_name: str, settings: Dict[str, Any]):
+        """
+        Initialize the standardizer.
+
+        Args:
+            table_name: Source table name
+            settings: The table's settings from parse_address_standardization
+
+        Raises:
+            ValueError: If the parser or geocoder cannot be created
+        """
+        self.table_name = table_name
+        self.settings = settings
+        cities = settings["cities"] + [settings["defaults"]["city"]] if settings["defaults"].get("city") else settings["cities"]
+        self.parser = _provider_class("parser", settings["parser"], PARSER_TYPES, AddressParser)(
+            settings["parser_options"], cities)
+        self.geocoder = None
+        if settings["geocoder"]:
+            self.geocoder = _provider_class("geocoder", settings["geocoder"]["type"], GEOCODER_TYPES, Geocoder)(
+                settings["geocoder"])
+        self._cache: "OrderedDict[str, Optional[Dict[str, Any]]]" = OrderedDict()
+        self._failures = 0
+
+    def standardize(self, records: List[Dict[str, Any]], result: Optional[Dict[str, Any]] = None) -> Dict[int, List[str]]:
+        """
+        Write the standardized address of each record of a batch, in place.
+
+        Counts go to result["address"]: checked, standardized, geocoded,
+        unmatched, low_confidence, rejected and geocoder_errors.
+
+        Returns:
+            Errors of the records to reject, by position
+        """
+        counts = None
+        if result is not None:
+            counts = result.setdefault("address", {"checked": 0, "standardized": 0, "geocoded": 0, "unmatched": 0,
+                                                   "low_confidence": 0, "rejected": 0, "geocoder_errors": 0})
+        failures: Dict[int, List[str]] = {}
+        for position, record in enumerate(records):
+            if record.get(OPERATION_FIELD) == "delete":
+                continue
+            text = self.address_text(record)
+            if not text:
+                continue
+            match = self.match(text, counts)
+            prefix = self.settings["prefix"]
+            for name in self.settings["outputs"]:
+                record[prefix + name] = match.get(name)
+            if counts is not None:
+                counts["checked"] += 1
+                if match["standardized"]:
+                    counts["standardized"] += 1
+                if match["match_status"] == "matched" or match.get("latitude") is not None:
+                    counts["geocoded"] += 1
+                elif self.geocoder is not None:
+                    counts["unmatched"] += 1
+            if match["match_confidence"] < self.settings["min_confidence"]:
+                if counts is not None:
+                    counts["low_confidence"] += 1
+                if self.settings["below_min"] == "reject":
+                    failures[position] = [
+                        f"Address '{text}' matched with confidence {match['match_confidence']}, "
+                        f"below {self.settings['min_confidence']}"
+                    ]
+                    if counts is not None:
+                        counts["rejected"] += 1
+        return failures
+
+    def address_text(self, record: Dict[str, Any]) -> Optional[str]:
+        """A record's address as one line, "street, city, state zip", with the defaults filled in."""
+        columns = self.settings["columns"]
+        street = normalize_text(record.get(columns["street"]))
+        if not street:
+            return None
+        parts = {name: normalize_text(record.get(column)) for name, column in columns.items() if name != "street"}
+        if len(columns) == 1:
+            # One address column; defaults fill in only what it leaves out
+            return street
+        for name, value in self.settings["defaults"].items():
+            parts[name] = parts.get(name) or value
+        locality = " ".join(p for p in (parts.get("state"), parts.get("zip")) if p)
+        return ", ".join(p for p in (street, parts.get("city"), locality) if p)
+
+    def match(self, text: str, counts: Optional[Dict[str, int]] = None) -> Dict[str, Any]:
+        """
+        An address parsed, and geocoded when the table has a geocoder.
+
+        Returns:
+            The ADDRESS_OUTPUTS, with the geocoder's matched_address when it matched
+        """
+        address = self.parser.parse(text)
+        for name, value in self.settings["defaults"].items():
+            if not address.get(name):
+                address[name] = value
+        address["standardized"] = standardized_line(address)
+        confidence = address.pop("confidence")
+        status = "parsed"
+        if self.geocoder is not None:
+            geocoded = self._geocode(address, counts) if address["standardized"] else None
+            if geocoded:
+                address.update(latitude=geocoded["latitude"], longitude=geocoded["longitude"],
+                               matched_address=geocoded.get("matched_address"))
+                confidence, status = geocoded["confidence"], "matched"
+            else:
+                address.update(latitude=None, longitude=None)
+                confidence, status = 0.0, "unmatched"
+        if confidence < self.settings["min_confidence"]:
+            status = "low_confidence"
+        return dict(address, match_confidence=confidence, match_status=status)
+
+    def _geocode(self, address: Dict[str, Any], counts: Optional[Dict[str, int]]) -> Optional[Dict[str, Any]]:
+        """Geocode an address once per run; requests stop after GEOCODER_FAILURE_LIMIT failures in a row."""
+        key = "|".join(str(address.get(name) or "") for name in ("standardized", "city", "state", "zip"))
+        if key in self._cache:
+            self._cache.move_to_end(key)
+            return self._cache[key]
+        if self._failures >= GEOCODER_FAILURE_LIMIT:
+            return None
+        try:
+            geocoded = self.geocoder.geocode(address)
+            self._failures = 0
+        except GeocoderError as e:
+            self._failures += 1
+            if counts is not None:
+                counts["geocoder_errors"] += 1
+            if self._failures == GEOCODER_FAILURE_LIMIT:
+                logger.warning(f"Geocoding of {self.table_name} stopped for this run after "
+                               f"{GEOCODER_FAILURE_LIMIT} failed requests: {e}")
+            return None
+        self._cache[key] = geocoded
+        while len(self._cache) > GEOCODE_CACHE_SIZE:
+            self._cache.popitem(last=False)
+        return geocoded
+
+
+def build_address_standardizer(address_standardization: Dict[str, Any], table_name: str) -> Optional[AddressStandardizer]:
+    """The address standardizer of a table, or None when its addresses are not standardized."""
+    settings = (address_standardization.get("tables") or {}).get(table_name)
+    return AddressStandardizer(table_name, settings) if settings else None
@@ -0,0 +1,631 @@
+"""
+TerraFusion SyncService - Sync Delta Anomaly Detection
+
+This module flags the unusual changes a sync writes, so appraisers review
+them before they reach the roll: assessed values that swing beyond a
+percentage band, mass ownership changes and land-use reclassification
+spikes. Tables named in the sync pair's "anomalies" block are checked:
+
+    "anomalies": {
+        "tables": {
+            "dbo.property_val": {
+                "value_bands": {
+                    "assessed_val": {"max_increase_pct": 25, "max_decrease_pct": 20, "min_value": 1000,
+                                     "max_z_score": 4}
+                },
+                "ownership": {"columns": ["owner_id"], "max_changed_pct": 5, "max_per_owner": 25},
+                "reclassification": {"columns": ["property_use_cd"], "max_changed_pct": 2,
+                                     "max_per_transition": 50},
+                "min_records": 100
+            }
+        }
+    }
+
+Columns are named as loaded (after the hooks). Before each batch is written
+the rows it updates are looked up from the target, as change events do (see
+sync_events), and compared with what the batch writes:
+
+- value_bands: an update that raises a column by more than max_increase_pct
+  or lowers it by more than max_decrease_pct is flagged on its own record.
+  Values below min_value on both sides are left alone, as are values that
+  were null or zero. With max_z_score, a change is also flagged when its
+  percentage lies more than that many standard deviations from the mean
+  change of the column over earlier jobs (once MIN_BASELINE_CHANGES are
+  known); each job's changes are added to the baseline after it.
+- ownership: the share of the table's rows whose owner columns change in
+  one job above max_changed_pct, or max_changes rows in all, is a mass
+  ownership change; so is one new owner taking max_per_owner parcels.
+- reclassification: the same for each column (property use, land use or
+  class codes), with max_per_transition bounding any one from/to pair of
+  codes.
+
+Shares are of the table's row count in the target, or of the rows the job
+compared when the target cannot count them, and are only judged when that
+count reaches min_records. Dry runs flag nothing.
+
+Anomalies are kept per job in the state store, OPEN until a reviewer marks
+them CONFIRMED (the change is genuine) or DATA_ERROR (to be corrected at the
+source). The job records how many it flagged, "sync_anomalies" alert rules
+notify of them (see alerting), and they can be listed and exported as CSV
+through the API.
+"""
+
+import io
+import csv
+import json
+import math
+import hashlib
+import logging
+import threading
+from datetime import datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional
+
+from sync_connectors import ConnectorError, record_key, OPERATION_FIELD
+from sync_diff import json_value, values_equal
+from sync_store import DocumentStore, sync_state_store
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection of flagged anomalies
+ANOMALIES_COLLECTION = "sync_anomalies"
+
+# State store collection of the value change statistics of earlier jobs
+ANOMALY_BASELINES_COLLECTION = "anomaly_baselines"
+
+# Kinds of anomaly
+ANOMALY_KINDS = ["value_change", "ownership_change", "reclassification"]
+
+# Statuses of an anomaly; reviewers set CONFIRMED or DATA_ERROR, or put it back OPEN
+ANOMALY_STATUSES = ["OPEN", "CONFIRMED", "DATA_ERROR"]
+
+# Rows a table must have before shares of it are judged, by default
+DEFAULT_MIN_RECORDS = 100
+
+# Earlier value changes a column needs before z-scores are judged
+MIN_BASELINE_CHANGES = 30
+
+# Record keys kept as examples on a mass change anomaly
+MAX_EXAMPLES = 20
+
+# New owners or code transitions counted per job; beyond this, those seen once are forgotten
+MAX_TRACKED_VALUES = 1000
+
+# Formats anomalies can be exported in
+ANOMALY_EXPORT_FORMATS = ["csv", "json"]
+
+# Columns of the CSV export
+EXPORT_COLUMNS = ["anomaly_id", "sync_pair_id", "table", "job_id", "kind", "column", "record_key", "before",
+                  "after", "change_pct", "z_score", "changed", "share_pct", "reasons", "status", "found_at",
+                  "reviewed_by", "reviewed_at", "note"]
+
+_lock = threading.Lock()
+
+
+def _number(value: Any) -> Optional[float]:
+    if value is None or isinstance(value, bool):
+        return None
+    if isinstance(value, (int, float, Decimal)):
+        number = float(value)
+    else:
+        try:
+            number = float(str(value).strip())
+        except ValueError:
+            return None
+    return number if math.isfinite(number) else None
+
+
+def _code(value: Any) -> Optional[str]:
+    if value is None:
+        return None
+    text = str(value).strip().upper()
+    return text or None
+
+
+def _percentage(settings: Dict[str, Any], name: str, label: str) -> Optional[float]:
+    value = settings.get(name)
+    if value is None:
+        return None
+    if isinstance(value, bool) or not isinstance(value, (int, float)) or not math.isfinite(value) or value <= 0:
+        raise ValueError(f"{label} {name} must be a positive number")
+    return float(value)
+
+
+def _count(settings: Dict[str, Any], name: str, label: str, default: Optional[int] = None) -> Optional[int]:
+    value = settings.get(name, default)
+    if value is None:
+        return None
+    if isinstance(value, bool) or not isinstance(value, int) or value < 1:
+        raise ValueError(f"{label} {name} must be a positive integer")
+    return value
+
+
+def _mass_settings(settings: Any, label: str) -> Dict[str, Any]:
+    if not isinstance(settings, dict):
+        raise ValueError(f"{label} must be an object")
+    columns = settings.get("columns")
+    if not isinstance(columns, list) or not columns or not all(isinstance(c, str) and c for c in columns):
+        raise ValueError(f"{label} requires 'columns', the columns to compare")
+    return {"columns": list(columns), "max_changed_pct": _percentage(settings, "max_changed_pct", label),
+            "max_changes": _count(settings, "max_changes", label)}
+
+
+def parse_anomalies(sync_pair_id: str, definition: Optional[Dict[str, Any]],
+                    table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the anomalies block of a sync pair and fill in defaults.
+
+    Raises:
+        ValueError: If a setting is invalid or names an unknown table
+    """
+    if not definition:
+        return {}
+    tables = {}
+    for table_name, settings in (definition.get("tables") or {}).items():
+        if table_name not in table_names:
+            raise ValueError(f"Anomaly detection of sync pair {sync_pair_id} names unknown table {table_name}")
+        label = f"Anomaly detection of {table_name}"
+        if not isinstance(settings, dict):
+            raise ValueError(f"{label} must be an object")
+        parsed = {"value_bands": {}, "ownership": None, "reclassification": None,
+                  "min_records": _count(settings, "min_records", label, DEFAULT_MIN_RECORDS)}
+        bands = settings.get("value_bands") or {}
+        if not isinstance(bands, dict):
+            raise ValueError(f"{label} value_bands must map columns to their bands")
+        for column, band in bands.items():
+            band_label = f"{label} value band of {column}"
+            if not isinstance(band, dict):
+                raise ValueError(f"{band_label} must be an object")
+            parsed_band = {name: _percentage(band, name, band_label)
+                           for name in ("max_increase_pct", "max_decrease_pct", "max_z_score")}
+            if not any(parsed_band.values()):
+                raise ValueError(f"{band_label} needs max_increase_pct, max_decrease_pct or max_z_score")
+            min_value = band.get("min_value", 0)
+            if isinstance(min_value, bool) or not isinstance(min_value, (int, float)) or min_value < 0:
+                raise ValueError(f"{band_label} min_value must be a non-negative number")
+            parsed_band["min_value"] = float(min_value)
+            parsed["value_bands"][column] = parsed_band
+        if settings.get("ownership"):
+            ownership = _mass_settings(settings["ownership"], f"{label} ownership")
+            ownership["max_per_owner"] = _count(settings["ownership"], "max_per_owner", f"{label} ownership")
+            parsed["ownership"] = ownership
+        if settings.get("reclassification"):
+            reclassification = _mass_settings(settings["reclassification"], f"{label} reclassification")
+            reclassification["max_per_transition"] = _count(settings["reclassification"], "max_per_transition",
+                                                            f"{label} reclassification")
+            parsed["reclassification"] = reclassification
+        for kind in ("ownership", "reclassification"):
+            mass = parsed[kind]
+            if mass and not (mass["max_changed_pct"] or mass["max_changes"]
+                             or mass.get("max_per_owner") or mass.get("max_per_transition")):
+                raise ValueError(f"{label} {kind} needs a threshold")
+        if not parsed["value_bands"] and not parsed["ownership"] and not parsed["reclassification"]:
+            raise ValueError(f"{label} needs value_bands, ownership or reclassification")
+        tables[table_name] = parsed
+    return {"tables": tables}
+
+
+def _merge_stats(stats: Dict[str, float], count: int, mean: float, m2: float) -> Dict[str, float]:
+    """Combine running (count, mean, m2) statistics of percentage changes."""
+    total = stats["count"] + count
+    if not total:
+        return stats
+    delta = mean - stats["mean"]
+    return {
+        "count": total,
+        "mean": stats["mean"] + delta * count / total,
+        "m2": stats["m2"] + m2 + delta * delta * stats["count"] * count / total,
+    }
+
+
+def _empty_stats() -> Dict[str, float]:
+    return {"count": 0, "mean": 0.0, "m2": 0.0}
+
+
+def _tally(counter: Dict[str, int], value: str) -> None:
+    counter[value] = counter.get(value, 0) + 1
+    if len(counter) > MAX_TRACKED_VALUES:
+        for name in [name for name, count in counter.items() if count == 1]:
+            del counter[name]
+
+
+class AnomalyStore:
+    """Persists the anomalies flagged by sync jobs and their review status."""
+
+    def __init__(self, store: Optional[DocumentStore] = None):
+        self.store = store or sync_state_store
+
+    @staticmethod
+    def anomaly_id(sync_pair_id: str, table_name: str, job_id: str, kind: str, column: Optional[str],
+                   key: Optional[str]) -> str:
+        identity = [table_name, job_id, kind, column, key]
+        digest = hashlib.sha1(json.dumps(identity).encode("utf-8")).hexdigest()[:20]
+        return f"{sync_pair_id}__{digest}"
+
+    def record(self, anomaly: Dict[str, Any]) -> bool:
+        """
+        Save an anomaly, leaving one already flagged (by a resumed job) as reviewed.
+
+        Returns:
+            Whether the anomaly is new
+        """
+        with _lock:
+            try:
+                existing = self.store.load(ANOMALIES_COLLECTION, anomaly["anomaly_id"])
+            except FileNotFoundError:
+                existing = None
+            document = dict(anomaly, status="OPEN", found_at=datetime.utcnow().isoformat())
+            if existing is not None:
+                document.update({k: existing[k] for k in ("status", "found_at", "reviewed_by", "reviewed_at", "note")
+                                 if k in existing})
+            self.store.save(ANOMALIES_COLLECTION, anomaly["anomaly_id"], document)
+        return existing is None
+
+    def list(self, sync_pair_id: str, table_name: Optional[str] = None, kind: Optional[str] = None,
+             status: Optional[str] = None, job_id: Optional[str] = None) -> List[Dict[str, Any]]:
+        """
+        The anomalies of a sync pair.
+
+        Raises:
+            ValueError: If the kind or status is not supported
+        """
+        if kind is not None and kind not in ANOMALY_KINDS:
+            raise ValueError(f"Unsupported anomaly kind: {kind}. Supported kinds: {', '.join(ANOMALY_KINDS)}")
+        if status is not None and status not in ANOMALY_STATUSES:
+            raise ValueError(f"Unsupported anomaly status: {status}. "
+                             f"Supported statuses: {', '.join(ANOMALY_STATUSES)}")
+        return [
+            anomaly for anomaly in self.store.list(ANOMALIES_COLLECTION)
+            if anomaly.get("sync_pair_id") == sync_pair_id
+            and (table_name is None or anomaly["table"] == table_name)
+            and (kind is None or anomaly["kind"] == kind)
+            and (status is None or anomaly["status"] == status)
+            and (job_id is None or anomaly["job_id"] == job_id)
+        ]
+
+    def get(self, sync_pair_id: str, anomaly_id: str) -> Dict[str, Any]:
+        """
+        Raises:
+            KeyError: If the sync pair has no such anomaly
+        """
+        try:
+            anomaly = self.store.load(ANOMALIES_COLLECTION, anomaly_id)
+        except FileNotFoundError:
+            anomaly = None
+        if anomaly is None or anomaly.get("sync_pair_id") != sync_pair_id:
+            raise KeyError(f"Anomaly {anomaly_id} not found in sync pair {sync_pair_id}")
+        return anomaly
+
+    def review(self, sync_pair_id: str, anomaly_id: str, status: str, username: str,
+               note: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Mark an anomaly CONFIRMED or DATA_ERROR, or put it back OPEN.
+
+        Raises:
+            KeyError: If the anomaly does not exist
+            ValueError: If the status is not supported
+        """
+        if status not in ANOMALY_STATUSES:
+            raise ValueError(f"Unsupported review status: {status}. "
+                             f"Reviewers can set {', '.join(ANOMALY_STATUSES)}")
+        with _lock:
+            anomaly = self.get(sync_pair_id, anomaly_id)
+            anomaly.update({"status": status, "reviewed_by": username, "reviewed_at": datetime.utcnow().isoformat()})
+            if note:
+                anomaly["note"] = note
+            self.store.save(ANOMALIES_COLLECTION, anomaly_id, anomaly)
+        return anomaly
+
+    @staticmethod
+    def export(anomalies: List[Dict[str, Any]], export_format: str = "csv") -> str:
+        """
+        Render anomalies for download.
+
+        Raises:
+            ValueError: If the format is not supported
+        """
+        if export_format == "json":
+            return json.dumps(anomalies, indent=2)
+        if export_format == "csv":
+            output = io.StringIO()
+            writer = csv.writer(output)
+            writer.writerow(EXPORT_COLUMNS)
+            for anomaly in anomalies:
+                row = []
+                for column in EXPORT_COLUMNS:
+                    value = anomaly.get(column)
+                    if column == "reasons":
+                        value = "; ".join(value or [])
+                    elif isinstance(value, (dict, list)):
+                        value = json.dumps(value, default=str)
+                    row.append("" if value is None else value)
+                writer.writerow(row)
+            return output.getvalue()
+        raise ValueError(f"Unsupported export format: {export_format}. "
+                         f"Supported formats: {', '.join(ANOMALY_EXPORT_FORMATS)}")
+
+
+class AnomalyDetector:
+    """Compares the batches a job writes to one table with the rows they replace and flags unusual changes."""
+
+    def __init__(self, sync_pair_id: str, table: Dict[str, Any], target_table: Dict[str, Any],
+                 settings: Dict[str, Any], store: Optional[DocumentStore], job_id: str):
+        """
+        Initialize the detector.
+
+        Args:
+            sync_pair_id: Sync pair writing the table
+            table: Source table definition
+            target_table: Target table definition (after hooks), whose primary key the rows are looked up by
+            settings: The table's settings from parse_anomalies
+            store: State store holding anomalies and baselines
+            job_id: Sync job writing the batches
+        """
+        self.sync_pair_id = sync_pair_id
+        self.table = table
+        self.target_table = target_table
+        self.settings = settings
+        self.store = store or sync_state_store
+        self.anomalies = AnomalyStore(self.store)
+        self.job_id = job_id
+        self._lookup = True
+        self._baseline_key = f"{sync_pair_id}__{table['name']}"
+        try:
+            self.baseline = self.store.load(ANOMALY_BASELINES_COLLECTION, self._baseline_key)["columns"]
+        except FileNotFoundError:
+            self.baseline = {}
+
+    def lookup(self, target, records: List[Dict[str, Any]]) -> Dict[str, Dict[str, Any]]:
+        """Target rows a batch about to be written replaces, by record key."""
+        if not self._lookup:
+            return {}
+        primary_key = self.target_table["primary_key"]
+        keys = [[record.get(column) for column in primary_key] for record in records
+                if record.get(OPERATION_FIELD) != "delete"]
+        if not keys:
+            return {}
+        try:
+            rows = target.fetch_records(self.target_table, keys)
+        except NotImplementedError:
+            logger.warning(f"Target of {self.table['name']} cannot look up rows; its changes are not checked "
+                           f"for anomalies")
+            self._lookup = False
+            return {}
+        return {record_key(primary_key, row): row for row in rows}
+
+    def observe(self, records: List[Dict[str, Any]], before: Dict[str, Dict[str, Any]],
+                result: Dict[str, Any]) -> int:
+        """
+        Compare the records written with the rows they replaced, flagging
+        value swings and counting ownership and code changes into result.
+
+        Returns:
+            Number of anomalies newly flagged
+        """
+        counts = self._counts(result)
+        primary_key = self.target_table["primary_key"]
+        flagged = 0
+        for record in records:
+            if record.get(OPERATION_FIELD) == "delete":
+                continue
+            key = record_key(primary_key, record)
+            previous = before.get(key)
+            if previous is None:
+                continue
+            counts["compared"] += 1
+            for column, band in self.settings["value_bands"].items():
+                if column in record and self._check_value(column, band, previous.get(column), record[column],
+                                                          key, record, counts):
+                    flagged += 1
+            ownership = self.settings["ownership"]
+            if ownership and self._changed(ownership["columns"], previous, record):
+                owner = "/".join(_code(record.get(c)) or "" for c in ownership["columns"])
+                self._count_change(counts["ownership"], record, owner)
+            for column in (self.settings["reclassification"] or {}).get("columns", []):
+                if column in record and self._changed([column], previous, record):
+                    transition = (f"from {_code(previous.get(column)) or 'none'} "
+                                  f"to {_code(record.get(column)) or 'none'}")
+                    self._count_change(counts["reclassification"].setdefault(column, self._empty_change()),
+                                       record, transition)
+        counts["flagged"] += flagged
+        return flagged
+
+    def finish(self, target, result: Dict[str, Any]) -> Dict[str, Any]:
+        """
+        Judge the job's ownership and code changes of the table, and add its
+        value changes to the baseline.
+
+        Returns:
+            The anomalies flagged by kind, and the rows compared and judged against
+        """
+        counts = self._counts(result)
+        result.pop("anomaly_counts", None)
+        rows = counts["compared"]
+        try:
+            rows = max(rows, target.count_records(self.target_table))
+        except (NotImplementedError, ConnectorError):
+            pass
+        found = {kind: 0 for kind in ANOMALY_KINDS}
+        found["value_change"] = counts["flagged"]
+        if rows >= self.settings["min_records"]:
+            ownership = self.settings["ownership"]
+            if ownership and self._check_mass("ownership_change", None, ownership, counts["ownership"], rows,
+                                              ownership.get("max_per_owner"), "to new owner {value}"):
+                found["ownership_change"] += 1
+            reclassification = self.settings["reclassification"]
+            for column in (reclassification or {}).get("columns", []):
+                change = counts["reclassification"].get(column)
+                if change and self._check_mass("reclassification", column, reclassification, change, rows,
+                                               reclassification.get("max_per_transition"), f"{column} {{value}}"):
+                    found["reclassification"] += 1
+        self._update_baseline(counts["values"])
+        summary = {"found": sum(found.values()), "by_kind": found, "records_compared": counts["compared"],
+                   "table_rows": rows}
+        if summary["found"]:
+            logger.info(f"Anomaly detection of {self.sync_pair_id} {self.table['name']}: {summary['found']} "
+                        f"anomalies flagged by job {self.job_id}")
+        return summary
+
+    def _check_value(self, column: str, band: Dict[str, Any], before: Any, after: Any, key: str,
+                     record: Dict[str, Any], counts: Dict[str, Any]) -> bool:
+        old, new = _number(before), _number(after)
+        if old is None or new is None or old == 0 or old == new:
+            return False
+        if abs(old) < band["min_value"] and abs(new) < band["min_value"]:
+            return False
+        change = (new - old) / abs(old) * 100
+        stats = counts["values"].setdefault(column, _empty_stats())
+        counts["values"][column] = _merge_stats(stats, 1, change, 0.0)
+        reasons = []
+        if band["max_increase_pct"] and change > band["max_increase_pct"]:
+            reasons.append(f"{column} rose {change:.1f}%, more than {band['max_increase_pct']:g}%")
+        if band["max_decrease_pct"] and -change > band["max_decrease_pct"]:
+            reasons.append(f"{column} fell {-change:.1f}%, more than {band['max_decrease_pct']:g}%")
+        z_score = None
+        baseline = self.baseline.get(column)
+        if band["max_z_score"] and baseline and baseline["count"] >= MIN_BASELINE_CHANGES:
+            deviation = math.sqrt(baseline["m2"] / (baseline["count"] - 1))
+            if deviation > 0:
+                z_score = round((change - baseline["mean"]) / deviation, 2)
+                if abs(z_score) > band["max_z_score"]:
+                    reasons.append(f"{column} changed {change:.1f}%, {abs(z_score):.1f} standard deviations from "
+                                   f"its usual {baseline['mean']:.1f}%")
+        if not reasons:
+            return False
+        primary_key = self.target_table["primary_key"]
+        return self.anomalies.record({
+            "anomaly_id": AnomalyStore.anomaly_id(self.sync_pair_id, self.table["name"], self.job_id,
+                                                  "value_change", column, key),
+            "sync_pair_id": self.sync_pair_id,
+            "table": self.table["name"],
+            "job_id": self.job_id,
+            "kind": "value_change",
+            "column": column,
+            "record_key": {c: json_value(record.get(c)) for c in primary_key},
+            "before": json_value(before),
+            "after": json_value(after),
+            "change_pct": round(change, 2),
+            "z_score": z_score,
+            "reasons": reasons,
+        })
+
+    def _check_mass(self, kind: str, column: Optional[str], settings: Dict[str, Any], change: Dict[str, Any],
+                    rows: int, max_per_value: Optional[int], change_label: str) -> bool:
+        changed = change["changed"]
+        share = changed / rows * 100 if rows else 0.0
+        subject = "owners" if kind == "ownership_change" else column
+        reasons = []
+        if settings["max_changed_pct"] and share > settings["max_changed_pct"]:
+            reasons.append(f"{changed} rows ({share:.1f}%) changed {subject}, more than "
+                           f"{settings['max_changed_pct']:g}% of {rows}")
+        if settings["max_changes"] and changed > settings["max_changes"]:
+            reasons.append(f"{changed} rows changed {subject}, more than {settings['max_changes']}")
+        top = sorted(change["values"].items(), key=lambda item: -item[1])[:MAX_EXAMPLES]
+        if max_per_value:
+            for value, count in top:
+                if count >= max_per_value:
+                    reasons.append(f"{count} rows changed {change_label.format(value=value)}, "
+                                   f"at least {max_per_value}")
+        if not reasons:
+            return False
+        return self.anomalies.record({
+            "anomaly_id": AnomalyStore.anomaly_id(self.sync_pair_id, self.table["name"], self.job_id, kind,
+                                                  column, None),
+            "sync_pair_id": self.sync_pair_id,
+            "table": self.table["name"],
+            "job_id": self.job_id,
+            "kind": kind,
+            "column": column if column else "/".join(settings["columns"]),
+            "changed": changed,
+            "share_pct": round(share, 2),
+            "table_rows": rows,
+            "top_values": [{"value": value, "count": count} for value, count in top],
+            "examples": change["examples"],
+            "reasons": reasons,
+        })
+
+    def _update_baseline(self, values: Dict[str, Dict[str, float]]) -> None:
+        if not values:
+            return
+        with _lock:
+            try:
+                document = self.store.load(ANOMALY_BASELINES_COLLECTION, self._baseline_key)
+            except FileNotFoundError:
+                document = {"sync_pair_id": self.sync_pair_id, "table": self.table["name"], "columns": {}}
+            for column, stats in values.items():
+                document["columns"][column] = _merge_stats(document["columns"].get(column) or _empty_stats(),
+                                                           stats["count"], stats["mean"], stats["m2"])
+            document.update(job_id=self.job_id, updated_at=datetime.utcnow().isoformat())
+            self.store.save(ANOMALY_BASELINES_COLLECTION, self._baseline_key, document)
+
+    @staticmethod
+    def _changed(columns: List[str], before: Dict[str, Any], record: Dict[str, Any]) -> bool:
+        return any(column in record and not values_equal(before.get(column), record[column])
+                   and _code(before.get(column)) != _code(record[column]) for column in columns)
+
+    def _count_change(self, change: Dict[str, Any], record: Dict[str, Any], value: str) -> None:
+        change["changed"] += 1
+        _tally(change["values"], value)
+        if len(change["examples"]) < MAX_EXAMPLES:
+            change["examples"].append({c: json_value(record.get(c)) for c in self.target_table["primary_key"]})
+
+    @staticmethod
+    def _empty_change() -> Dict[str, Any]:
+        return {"changed": 0, "values": {}, "examples": []}
+
+    def _counts(self, result: Dict[str, Any]) -> Dict[str, Any]:
+        """The job's running counts of the table, kept on its result so a resumed job carries them on."""
+        return result.setdefault("anomaly_counts", {
+            "compared": 0, "flagged": 0, "values": {}, "ownership": self._empty_change(), "reclassification": {},
+        })
+
+
+class AnomalyService:
+    """The anomalies of the sync pairs with an anomalies block, for the API."""
+
+    def __init__(self, registry, store: Optional[DocumentStore] = None):
+        self.registry = registry
+        self.anomalies = AnomalyStore(store)
+
+    def list_anomalies(self, sync_pair_id: str, table_name: Optional[str] = None, kind: Optional[str] = None,
+                       status: Optional[str] = None, job_id: Optional[str] = None) -> List[Dict[str, Any]]:
+        """
+        Raises:
+            KeyError: If the sync pair is unknown or has no anomaly detection
+            ValueError: If a filter is not supported
+        """
+        self._check(sync_pair_id)
+        return self.anomalies.list(sync_pair_id, table_name, kind, status, job_id)
+
+    def get_anomaly(self, sync_pair_id: str, anomaly_id: str) -> Dict[str, Any]:
+        self._check(sync_pair_id)
+        return self.anomalies.get(sync_pair_id, anomaly_id)
+
+    def review_anomaly(self, sync_pair_id: str, anomaly_id: str, status: str, username: str,
+                       note: Optional[str] = None) -> Dict[str, Any]:
+        self._check(sync_pair_id)
+        return self.anomalies.review(sync_pair_id, anomaly_id, status, username, note)
+
+    def export_anomalies(self, anomalies: List[Dict[str, Any]], export_format: str = "csv") -> str:
+        return self.anomalies.export(anomalies, export_format)
+
+    def _check(self, sync_pair_id: str) -> None:
+        pair = self.registry.get(sync_pair_id)
+        if not pair.anomalies:
+            raise KeyError(f"Sync pair {sync_pair_id} has no anomaly detection")
+
+
+def build_detector(sync_pair_id: str, config: Dict[str, Any], table: Dict[str, Any], target_table: Dict[str, Any],
+                   store: DocumentStore, job_id: str) -> Optional[AnomalyDetector]:
+    """
+    Build the anomaly detector of a table.
+
+    Returns:
+        The detector, or None when the sync pair does not check the table
+    """
+    settings = (config.get("tables") or {}).get(table["name"]) if config else None
+    if not settings:
+        return None
+    return AnomalyDetector(sync_pair_id, table, target_table, settings, store, job_id)
@@ -0,0 +1,133 @@
+"""
+TerraFusion SyncService - Appeal Status Events
+
+This module announces the status changes of appeals synced by the appeals
+entity module (see sync_entities), so the assessor's dashboard follows
+appeal outcomes without polling the clerk's system. The module adds an
+appeal_status hook to its appeals table: after each batch is written, the
+hook compares every appeal's status with the one it last saw and publishes
+the change on the event bus:
+
+    sync.entities.appeals.status_changed
+    {"change_id": "...", "sync_pair_id": "benton_wa_pacs_staging", "job_id": "...",
+     "appeal_id": "BOE-2026-0142", "prop_id": 1001, "tax_year": 2026,
+     "previous_status": "heard", "status": "decided", "decision": "reduced",
+     "decision_date": "2026-09-14", "value_before": 512000, "value_after": 468000,
+     "value_change": -44000}
+
+Webhooks subscribed to appeal.status_changed receive each change (see
+webhooks), narrowed to some statuses with the webhook's appeal_statuses.
+The statuses last seen are kept in the state store, per sync pair; the
+first sync of a pair records them without announcing the appeals already
+on file, and deleted appeals are forgotten. Dry runs announce nothing.
+"""
+
+import uuid
+import logging
+import threading
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional
+
+from sync_connectors import OPERATION_FIELD
+from sync_hooks import TransformHook, HookContext, register_hook
+from sync_store import DocumentStore, sync_state_store
+from event_bus import EventBus, EventBusError, event_bus, SUBJECT_ENTITY
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Statuses of an appeal, from petition to outcome
+APPEAL_STATUSES = ["filed", "scheduled", "heard", "decided", "withdrawn", "dismissed"]
+
+# Hook type the appeals module adds to its appeals table
+APPEAL_STATUS_HOOK = "appeal_status"
+
+# State store collection of the appeal statuses last seen, by sync pair ID
+APPEAL_STATUSES_COLLECTION = "appeal_statuses"
+
+# Namespace of the deterministic change IDs
+CHANGE_ID_NAMESPACE = uuid.UUID("6f1d2a7e-3b8c-4e59-a0d4-91c7e25b8f13")
+
+# Appeal columns carried in a status change
+CHANGE_COLUMNS = ["prop_id", "tax_year", "decision", "decision_date", "value_before", "value_after"]
+
+_lock = threading.Lock()
+
+
+def _json_value(value: Any) -> Any:
+    if isinstance(value, (date, datetime)):
+        return value.isoformat()
+    if isinstance(value, Decimal):
+        return float(value)
+    return value
+
+
+@register_hook(APPEAL_STATUS_HOOK)
+class AppealStatusHook(TransformHook):
+    """Publishes the status changes of the appeals a batch wrote."""
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None, store: Optional[DocumentStore] = None,
+                 bus: Optional[EventBus] = None):
+        super().__init__(options)
+        self.store = store or sync_state_store
+        self.bus = bus or event_bus
+
+    def after_load(self, records: List[Dict[str, Any]], counts: Dict[str, int], context: HookContext) -> None:
+        if context.dry_run or not records:
+            return
+        with _lock:
+            try:
+                seen = self.store.load(APPEAL_STATUSES_COLLECTION, context.sync_pair_id)
+            except FileNotFoundError:
+                seen = None
+            statuses = dict((seen or {}).get("statuses") or {})
+            # The appeals on file when a pair is first synced are not news, in any batch of that job
+            first_job = seen["first_job_id"] if seen else context.job_id
+            changes = []
+            for record in records:
+                if record.get("appeal_id") is None:
+                    continue
+                appeal_id = str(record["appeal_id"])
+                if record.get(OPERATION_FIELD) == "delete":
+                    statuses.pop(appeal_id, None)
+                    continue
+                status = record.get("status")
+                previous = statuses.get(appeal_id)
+                if status == previous:
+                    continue
+                statuses[appeal_id] = status
+                if context.job_id != first_job:
+                    changes.append(self._change(record, previous, context))
+            self.store.save(APPEAL_STATUSES_COLLECTION, context.sync_pair_id, {
+                "sync_pair_id": context.sync_pair_id,
+                "statuses": statuses,
+                "first_job_id": first_job,
+                "updated_at": datetime.utcnow().isoformat(),
+            })
+        for change in changes:
+            try:
+                self.bus.publish(SUBJECT_ENTITY.format(entity="appeals", event="status_changed"), change)
+            except EventBusError as e:
+                logger.warning(f"Cannot announce the status change of appeal {change['appeal_id']}: {e}")
+        if changes:
+            logger.info(f"Announced {len(changes)} appeal status changes of sync pair {context.sync_pair_id}")
+
+    @staticmethod
+    def _change(record: Dict[str, Any], previous: Optional[str], context: HookContext) -> Dict[str, Any]:
+        appeal_id = str(record["appeal_id"])
+        change = {
+            # The same each time the same job writes the same change, so receivers can deduplicate
+            "change_id": str(uuid.uuid5(CHANGE_ID_NAMESPACE,
+                                        f"{context.sync_pair_id}/{appeal_id}/{record.get('status')}/{context.job_id}")),
+            "sync_pair_id": context.sync_pair_id,
+            "job_id": context.job_id,
+            "appeal_id": appeal_id,
+            "previous_status": previous,
+            "status": record.get("status"),
+        }
+        change.update({column: _json_value(record.get(column)) for column in CHANGE_COLUMNS})
+        before, after = record.get("value_before"), record.get("value_after")
+        change["value_change"] = _json_value(after - before) if before is not None and after is not None else None
+        return change
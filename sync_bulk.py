@@ -0,0 +1,156 @@
+"""
+TerraFusion SyncService - Bulk Loading
+
+This module decides when the PostgreSQL and SQL Server targets load a batch
+with their bulk path instead of upserting it: COPY FROM STDIN into
+PostgreSQL, and for SQL Server one INSERT whose rows pyodbc binds as
+parameter arrays (fast_executemany), the bulk path of the ODBC driver. Both
+send the batch in one round trip instead of a statement per row, which is
+where initial loads of a county's parcels spent their hours.
+
+A batch goes the bulk path when it has at least min_rows upserts (initial
+loads and large deltas) and its table is not conflict-prone. A bulk insert
+only adds rows, so a batch holding a row the table already has fails with a
+key violation; the target then rolls it back and writes the same batch as
+batched upserts, and remembers the table as conflict-prone for
+conflict_memory_seconds so the following batches upsert straight away. A
+table a full load starts from empty copies all the way through; a table
+mostly updated falls back after its first batch. Tables can also opt out
+(or into bulk loads of every size) in the sync pair with "bulk_load":
+
+    "bulk_load": {"min_rows": 1000, "conflict_memory_seconds": 3600}
+
+on the target connector ("bulk_load": false to always upsert), and
+"bulk_load": false or true on a table.
+"""
+
+import os
+import json
+import time
+import logging
+import threading
+from datetime import date, datetime, time as time_of_day
+from decimal import Decimal
+from typing import Dict, List, Any
+
+from metrics import SYNC_BULK_LOAD_ROWS, SYNC_BULK_LOAD_FALLBACKS
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Upserts a batch needs to be bulk loaded
+BULK_MIN_ROWS = int(os.environ.get("SYNC_BULK_MIN_ROWS", "1000"))
+
+# Seconds a table that refused a bulk load keeps getting upserts
+CONFLICT_MEMORY_SECONDS = float(os.environ.get("SYNC_BULK_CONFLICT_MEMORY_SECONDS", "3600"))
+
+BULK_FIELDS = ["min_rows", "conflict_memory_seconds"]
+
+
+def parse_bulk_load(definition: Any) -> Dict[str, Any]:
+    """
+    Validate the "bulk_load" block of a target connector.
+
+    Returns:
+        min_rows and conflict_memory_seconds; {"enabled": False} when the block is false
+
+    Raises:
+        ValueError: If a setting is invalid
+    """
+    if definition is False:
+        return {"enabled": False}
+    definition = definition if isinstance(definition, dict) else {}
+    if definition.get("enabled") is False:
+        return {"enabled": False}
+    unknown = [name for name in definition if name not in BULK_FIELDS + ["enabled"]]
+    if unknown:
+        raise ValueError(f"Unknown bulk_load setting {unknown[0]}; settings: {', '.join(BULK_FIELDS)}")
+    parsed = {"enabled": True}
+    for name, default in (("min_rows", BULK_MIN_ROWS), ("conflict_memory_seconds", CONFLICT_MEMORY_SECONDS)):
+        value = definition.get(name, default)
+        try:
+            value = float(value)
+        except (TypeError, ValueError):
+            raise ValueError(f"bulk_load {name} must be a number")
+        if value < (1 if name == "min_rows" else 0):
+            raise ValueError(f"bulk_load {name} must be at least {1 if name == 'min_rows' else 0}")
+        parsed[name] = value
+    parsed["min_rows"] = int(parsed["min_rows"])
+    return parsed
+
+
+# Tables that refused a bulk load, by database and table, with when they did
+_conflict_prone: Dict[tuple, float] = {}
+_conflict_prone_lock = threading.Lock()
+
+
+class BulkLoader:
+    """The bulk load decisions of one target connector."""
+
+    def __init__(self, connector_type: str, database: str, definition: Any):
+        """
+        Initialize the loader.
+
+        Args:
+            connector_type: Target connector type, for the metrics
+            database: What the target connects to, so connectors of one database share conflict-prone tables
+            definition: The connector's "bulk_load" block
+
+        Raises:
+            ValueError: If the block is invalid
+        """
+        self.connector_type = connector_type
+        self.database = database
+        self.settings = parse_bulk_load(definition)
+
+    def use_bulk(self, table: Dict[str, Any], table_name: str, upserts: int) -> bool:
+        """Whether a batch of upserts into a table goes the bulk path."""
+        setting = table.get("bulk_load")
+        if not self.settings["enabled"] or setting is False or not upserts:
+            return False
+        if setting is not True and upserts < self.settings["min_rows"]:
+            return False
+        key = (self.database, table_name)
+        with _conflict_prone_lock:
+            since = _conflict_prone.get(key)
+            if since is not None and time.monotonic() - since < self.settings["conflict_memory_seconds"]:
+                return False
+            _conflict_prone.pop(key, None)
+        return True
+
+    def loaded(self, method: str, rows: int) -> None:
+        SYNC_BULK_LOAD_ROWS.inc(rows, connector=self.connector_type, method=method)
+
+    def conflicted(self, table_name: str, error: Exception) -> None:
+        """A bulk load hit a row the table already has: upsert this table for a while."""
+        with _conflict_prone_lock:
+            _conflict_prone[(self.database, table_name)] = time.monotonic()
+        SYNC_BULK_LOAD_FALLBACKS.inc(connector=self.connector_type, reason="conflict")
+        first_line = str(error).strip().split("\n")[0]
+        logger.info(f"Bulk load into {table_name} hit existing rows ({first_line}); "
+                    f"upserting its batches for {self.settings['conflict_memory_seconds']:g}s")
+
+
+def copy_text(value: Any) -> str:
+    """A value in PostgreSQL COPY text format, escaped."""
+    if value is None:
+        return "\\N"
+    if isinstance(value, bool):
+        return "t" if value else "f"
+    if isinstance(value, (datetime, date, time_of_day)):
+        text = value.isoformat()
+    elif isinstance(value, (bytes, bytearray, memoryview)):
+        text = "\\x" + bytes(value).hex()
+    elif isinstance(value, Decimal):
+        text = format(value, "f")
+    elif isinstance(value, (dict, list)):
+        text = json.dumps(value, default=str)
+    else:
+        text = str(value)
+    return text.replace("\\", "\\\\").replace("\t", "\\t").replace("\n", "\\n").replace("\r", "\\r")
+
+
+def copy_rows(rows: List[tuple]) -> str:
+    """Rows as the body of a COPY FROM STDIN in text format."""
+    return "".join("\t".join(copy_text(value) for value in row) + "\n" for row in rows)
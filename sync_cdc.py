@@ -0,0 +1,284 @@
+"""
+TerraFusion SyncService - Change Data Capture Listener
+
+This module provides the change listener that keeps staging close to real
+time. Sync pairs opt in with a "cdc" block in the county configuration:
+
+    "cdc": {"enabled": true, "poll_seconds": 30, "tables": ["dbo.property"]}
+
+Every poll_seconds the listener asks the source for the current change version
+of each listed table (SQL Server CDC LSN, change tracking version or
+rowversion) and compares it with the stored watermark. When anything changed
+it starts an incremental sync job for the changed tables, so the normal sync
+pipeline (hooks, mappings, conflicts, checkpoints) handles the changes. Polls
+that fail back off exponentially up to MAX_BACKOFF_SECONDS. Sync pairs of a
+county with the cdc feature turned off (see county_overrides) are not polled.
+"""
+
+import os
+import time
+import logging
+import threading
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+from sync_store import DocumentStore, sync_state_store
+from sync_connectors import create_connector
+from sync_engine import SyncEngine, sync_engine
+from sync_control import TERMINAL_STATUSES
+from county_overrides import county_overrides
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Collection holding listener state per sync pair
+LISTENERS_COLLECTION = "cdc_listeners"
+
+# Longest wait between polls after repeated errors
+MAX_BACKOFF_SECONDS = int(os.environ.get("SYNC_CDC_MAX_BACKOFF_SECONDS", "600"))
+
+# Username recorded on jobs started by the listener
+CDC_USERNAME = "cdc-listener"
+
+
+class CdcListener:
+    """
+    Service class that polls sync pairs for source changes and runs incremental syncs.
+
+    Pairs are polled one after another on a single background thread
+    (start/stop); poll_pair can also be called directly. Pause state is
+    persisted, so a paused pair stays paused across restarts.
+    """
+
+    def __init__(self, store: Optional[DocumentStore] = None, engine: Optional[SyncEngine] = None):
+        """
+        Initialize the listener.
+
+        Args:
+            store: Document store for listener state
+            engine: Sync engine used to run jobs; defaults to the sync_engine singleton
+        """
+        self.store = store or sync_state_store
+        self.engine = engine or sync_engine
+        self._lock = threading.RLock()
+        self._sources: Dict[str, Any] = {}
+        self._next_poll: Dict[str, float] = {}
+        self._stop_event = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+        logger.info("CDC listener initialized")
+
+    def listened_pairs(self) -> List[Any]:
+        """Sync pairs with an enabled cdc block."""
+        return [pair for pair in self.engine.registry.list() if pair.cdc.get("enabled")]
+
+    def get_status(self, sync_pair_id: str) -> Dict[str, Any]:
+        """
+        Get the listener state of a sync pair.
+
+        Raises:
+            KeyError: If the sync pair is not configured or has no enabled listener
+        """
+        pair = self.engine.registry.get(sync_pair_id)
+        if not pair.cdc.get("enabled"):
+            raise KeyError(f"Sync pair {sync_pair_id} has no CDC listener enabled")
+        return self._load_state(pair)
+
+    def list_status(self) -> List[Dict[str, Any]]:
+        """Listener state of every listened sync pair."""
+        return [self._load_state(pair) for pair in self.listened_pairs()]
+
+    def pause(self, sync_pair_id: str) -> Dict[str, Any]:
+        """
+        Stop polling a sync pair until it is resumed.
+
+        Raises:
+            KeyError: If the sync pair is not configured or has no enabled listener
+        """
+        with self._lock:
+            state = self.get_status(sync_pair_id)
+            state["paused"] = True
+            state["updated_at"] = datetime.utcnow().isoformat()
+            self._save_state(state)
+        logger.info(f"Paused CDC listener for sync pair {sync_pair_id}")
+        return state
+
+    def resume(self, sync_pair_id: str) -> Dict[str, Any]:
+        """
+        Resume polling a paused sync pair; the next poll runs immediately.
+
+        Raises:
+            KeyError: If the sync pair is not configured or has no enabled listener
+        """
+        with self._lock:
+            state = self.get_status(sync_pair_id)
+            state["paused"] = False
+            state["consecutive_errors"] = 0
+            state["updated_at"] = datetime.utcnow().isoformat()
+            self._save_state(state)
+            self._next_poll.pop(sync_pair_id, None)
+        logger.info(f"Resumed CDC listener for sync pair {sync_pair_id}")
+        return state
+
+    def poll_pair(self, sync_pair_id: str) -> Optional[Dict[str, Any]]:
+        """
+        Check a sync pair for source changes and sync the changed tables.
+
+        Returns:
+            The sync job that was run, or None when nothing changed or the poll was skipped
+
+        Raises:
+            KeyError: If the sync pair is not configured or has no enabled listener
+        """
+        pair = self.engine.registry.get(sync_pair_id)
+        state = self.get_status(sync_pair_id)
+        if state.get("paused"):
+            return None
+        if not county_overrides.enabled(pair.county_id, "cdc"):
+            logger.debug(f"CDC poll for {sync_pair_id} skipped: county {pair.county_id} has cdc turned off")
+            return None
+        if self._job_running(state):
+            logger.info(f"CDC poll for {sync_pair_id} skipped: job {state['last_job_id']} is still running")
+            return None
+
+        state["last_poll_at"] = datetime.utcnow().isoformat()
+        state["polls"] = state.get("polls", 0) + 1
+        try:
+            changed = self._changed_tables(pair)
+            job = None
+            if changed:
+                job = self.engine.create_sync_job(
+                    sync_pair_id, CDC_USERNAME, "incremental", changed, {"trigger": "cdc"}
+                )
+                job = self.engine.process_job(job["job_id"])
+                state.update({
+                    "last_change_at": state["last_poll_at"],
+                    "last_job_id": job["job_id"],
+                    "last_job_status": job["status"],
+                    "jobs_started": state.get("jobs_started", 0) + 1,
+                })
+                if job["status"] == "FAILED":
+                    raise RuntimeError(job.get("message", f"Sync job {job['job_id']} failed"))
+            state["consecutive_errors"] = 0
+            state["last_error"] = None
+            return job
+        except Exception as e:
+            state["consecutive_errors"] = state.get("consecutive_errors", 0) + 1
+            state["last_error"] = str(e)
+            self._close_source(sync_pair_id)
+            raise
+        finally:
+            with self._lock:
+                # Keep a pause made while the poll was running
+                current = self._load_state(pair)
+                state["paused"] = current.get("paused", False)
+                state["updated_at"] = datetime.utcnow().isoformat()
+                self._save_state(state)
+
+    def start(self) -> None:
+        """Start the background polling thread."""
+        if self._thread is not None and self._thread.is_alive():
+            return
+        self._stop_event.clear()
+        self._thread = threading.Thread(target=self._loop, name="sync-cdc-listener", daemon=True)
+        self._thread.start()
+        logger.info(f"CDC listener started for {len(self.listened_pairs())} sync pair(s)")
+
+    def stop(self) -> None:
+        """Stop the background polling thread and close source connections."""
+        self._stop_event.set()
+        if self._thread is not None:
+            self._thread.join(timeout=30)
+            self._thread = None
+        for sync_pair_id in list(self._sources):
+            self._close_source(sync_pair_id)
+        logger.info("CDC listener stopped")
+
+    def _loop(self) -> None:
+        while not self._stop_event.is_set():
+            for pair in self.listened_pairs():
+                if self._stop_event.is_set():
+                    break
+                if self._next_poll.get(pair.sync_pair_id, 0) > time.monotonic():
+                    continue
+                delay = pair.cdc["poll_seconds"]
+                try:
+                    self.poll_pair(pair.sync_pair_id)
+                except Exception as e:
+                    errors = self._load_state(pair).get("consecutive_errors", 1)
+                    delay = min(pair.cdc["poll_seconds"] * (2 ** errors), MAX_BACKOFF_SECONDS)
+                    logger.error(f"CDC poll for {pair.sync_pair_id} failed ({errors} in a row), retrying in {delay}s: {e}")
+                self._next_poll[pair.sync_pair_id] = time.monotonic() + delay
+            self._stop_event.wait(self._seconds_until_next_poll())
+
+    def _seconds_until_next_poll(self) -> float:
+        if not self._next_poll:
+            return 1.0
+        return max(1.0, min(self._next_poll.values()) - time.monotonic())
+
+    def _changed_tables(self, pair) -> List[str]:
+        """Tables whose current source version differs from their watermark."""
+        source = self._source(pair)
+        changed = []
+        for name in pair.cdc["tables"]:
+            table = pair.get_table(name)
+            watermark = self.engine.watermarks.get(pair.sync_pair_id, name)
+            current = source.get_current_version(table.to_dict())
+            if watermark is None or watermark.get("version") != current:
+                changed.append(name)
+        return changed
+
+    def _source(self, pair):
+        """The listener's own source connection for a pair, opened on first use."""
+        source = self._sources.get(pair.sync_pair_id)
+        if source is None:
+            source = create_connector(pair.source)
+            source.connect()
+            self._sources[pair.sync_pair_id] = source
+        return source
+
+    def _close_source(self, sync_pair_id: str) -> None:
+        source = self._sources.pop(sync_pair_id, None)
+        if source is None:
+            return
+        try:
+            source.close()
+        except Exception as e:
+            logger.warning(f"Could not close CDC source connection for {sync_pair_id}: {e}")
+
+    def _job_running(self, state: Dict[str, Any]) -> bool:
+        if not state.get("last_job_id"):
+            return False
+        try:
+            job = self.engine.get_job_status(state["last_job_id"])
+        except FileNotFoundError:
+            return False
+        # A paused job still owns its change window
+        return job["status"] not in TERMINAL_STATUSES
+
+    def _load_state(self, pair) -> Dict[str, Any]:
+        try:
+            state = self.store.load(LISTENERS_COLLECTION, pair.sync_pair_id)
+        except FileNotFoundError:
+            state = {
+                "sync_pair_id": pair.sync_pair_id,
+                "paused": False,
+                "polls": 0,
+                "jobs_started": 0,
+                "consecutive_errors": 0,
+                "last_poll_at": None,
+                "last_change_at": None,
+                "last_job_id": None,
+                "last_job_status": None,
+                "last_error": None,
+            }
+        state["poll_seconds"] = pair.cdc["poll_seconds"]
+        state["tables"] = list(pair.cdc["tables"])
+        return state
+
+    def _save_state(self, state: Dict[str, Any]) -> None:
+        self.store.save(LISTENERS_COLLECTION, state["sync_pair_id"], state)
+
+
+# Create a singleton instance
+cdc_listener = CdcListener()
@@ -0,0 +1,328 @@
+"""
+TerraFusion SyncService - Conflict Detection and Resolution
+
+This module provides conflict handling for bidirectional sync pairs. A conflict
+occurs when the same record changed in both the source system and TerraFusion
+since the last sync. Each sync pair selects a resolution strategy:
+
+- source_wins: the source record overwrites the target
+- target_wins: the target record is pushed back to the source
+- newest_timestamp: the side with the later change timestamp wins
+- manual_review: neither side is written; the conflict is queued for review
+
+Queued conflicts are reviewed with a field-by-field diff of the two records and
+resolved by taking one side, or by merging with a choice of side per field.
+"""
+
+import json
+import uuid
+import hashlib
+import logging
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+from sync_store import DocumentStore
+from sync_connectors import RESERVED_FIELDS
+from sync_diff import json_value, values_equal
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Supported conflict resolution strategies
+CONFLICT_STRATEGIES = ["source_wins", "target_wins", "newest_timestamp", "manual_review"]
+
+# Resolution outcomes
+WINNER_SOURCE = "source"
+WINNER_TARGET = "target"
+WINNER_MANUAL = "manual"
+WINNER_MERGE = "merge"
+
+# State store collections
+CONFLICTS_COLLECTION = "conflicts"
+FINGERPRINTS_COLLECTION = "sync_fingerprints"
+
+
+def _as_datetime(value: Any) -> Optional[datetime]:
+    """Normalize a timestamp value from either side to a naive datetime."""
+    if value is None:
+        return None
+    if isinstance(value, datetime):
+        return value.replace(tzinfo=None)
+    try:
+        return datetime.fromisoformat(str(value).replace('Z', '+00:00')).replace(tzinfo=None)
+    except ValueError:
+        return None
+
+
+def choose_winner(strategy: str, source_record: Dict[str, Any], target_record: Dict[str, Any],
+                  table: Dict[str, Any]) -> str:
+    """
+    Decide which side of a conflict wins.
+
+    Args:
+        strategy: One of CONFLICT_STRATEGIES
+        source_record: Changed record from the source
+        target_record: Changed record from the target
+        table: Table definition (timestamp_column / target_change_column are
+            used by newest_timestamp)
+
+    Returns:
+        WINNER_SOURCE, WINNER_TARGET or WINNER_MANUAL
+    """
+    if strategy == "source_wins":
+        return WINNER_SOURCE
+    if strategy == "target_wins":
+        return WINNER_TARGET
+    if strategy == "manual_review":
+        return WINNER_MANUAL
+    if strategy == "newest_timestamp":
+        source_time = _as_datetime(source_record.get(table.get("timestamp_column") or ""))
+        target_time = _as_datetime(target_record.get(table.get("target_change_column") or ""))
+        if source_time is None or target_time is None or source_time == target_time:
+            # Without two comparable timestamps the conflict needs a person
+            return WINNER_MANUAL
+        return WINNER_SOURCE if source_time > target_time else WINNER_TARGET
+    raise ValueError(f"Unsupported conflict strategy: {strategy}. Supported strategies: {', '.join(CONFLICT_STRATEGIES)}")
+
+
+def record_fingerprint(record: Dict[str, Any], exclude: Optional[List[str]] = None) -> str:
+    """
+    Hash a record's data columns.
+
+    Reserved sync fields and change-timestamp columns are excluded because they
+    differ between the two systems even when the data is identical.
+    """
+    skip = set(RESERVED_FIELDS) | set(exclude or [])
+    data = {k: v for k, v in record.items() if k not in skip}
+    return hashlib.sha256(json.dumps(data, sort_keys=True, default=str).encode()).hexdigest()
+
+
+def conflict_diff(conflict: Dict[str, Any], ignore: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+    """
+    Compare the two sides of a conflict field by field.
+
+    Args:
+        conflict: Conflict document
+        ignore: Columns left out of the diff (e.g. change timestamps)
+
+    Returns:
+        One entry per field with the source and target values and whether they differ
+    """
+    source_record = conflict.get("source_record") or {}
+    target_record = conflict.get("target_record") or {}
+    fields = list(source_record) + [c for c in target_record if c not in source_record]
+    diff = []
+    for name in fields:
+        if name in (ignore or []):
+            continue
+        in_source, in_target = name in source_record, name in target_record
+        source_value, target_value = source_record.get(name), target_record.get(name)
+        if in_source and in_target:
+            status = "same" if values_equal(source_value, target_value) else "changed"
+        else:
+            status = "source_only" if in_source else "target_only"
+        diff.append({
+            "field": name,
+            "source": json_value(source_value),
+            "target": json_value(target_value),
+            "status": status,
+        })
+    return diff
+
+
+def merge_records(conflict: Dict[str, Any], field_choices: Dict[str, str],
+                  ignore: Optional[List[str]] = None) -> Dict[str, Any]:
+    """
+    Build a merged record from a conflict, taking each differing field from the chosen side.
+
+    Args:
+        conflict: Conflict document
+        field_choices: Field name to "source" or "target"; every changed field needs a choice
+        ignore: Columns that need no choice (e.g. change timestamps); taken from the source
+
+    Raises:
+        ValueError: If a choice is invalid or a changed field has no choice
+    """
+    diff = {entry["field"]: entry for entry in conflict_diff(conflict)}
+    for name, side in field_choices.items():
+        if name not in diff:
+            raise ValueError(f"Field {name} is not part of conflict {conflict['conflict_id']}")
+        if side not in (WINNER_SOURCE, WINNER_TARGET):
+            raise ValueError(f"Unsupported choice for field {name}: {side}. Use 'source' or 'target'")
+    missing = [
+        name for name, entry in diff.items()
+        if entry["status"] != "same" and name not in field_choices and name not in (ignore or [])
+    ]
+    if missing:
+        raise ValueError(f"Merge needs a choice for changed fields: {', '.join(missing)}")
+
+    merged = {}
+    for name in diff:
+        side = field_choices.get(name, WINNER_SOURCE)
+        record = conflict[f"{side}_record"] or {}
+        if name in record:
+            merged[name] = record[name]
+    return merged
+
+
+class FingerprintStore:
+    """
+    Remembers records the engine itself wrote, to suppress echoes.
+
+    When the engine writes a record to one side, that side reports it as a
+    change on the next run. A matching fingerprint identifies the change as
+    our own write rather than a user edit. Fingerprints are loaded and saved
+    once per table per run.
+    """
+
+    def __init__(self, store: DocumentStore):
+        """
+        Initialize the fingerprint store.
+
+        Args:
+            store: Document store for persistence
+        """
+        self.store = store
+
+    def load(self, sync_pair_id: str, table_name: str, side: str) -> Dict[str, str]:
+        """Load fingerprints of records written to one side of a table, by record key."""
+        try:
+            return self.store.load(FINGERPRINTS_COLLECTION, self._doc_key(sync_pair_id, table_name, side))["keys"]
+        except FileNotFoundError:
+            return {}
+
+    def save(self, sync_pair_id: str, table_name: str, side: str, fingerprints: Dict[str, str]) -> None:
+        """Replace the stored fingerprints for one side of a table."""
+        self.store.save(
+            FINGERPRINTS_COLLECTION,
+            self._doc_key(sync_pair_id, table_name, side),
+            {"sync_pair_id": sync_pair_id, "table": table_name, "side": side, "keys": fingerprints}
+        )
+
+    @staticmethod
+    def _doc_key(sync_pair_id: str, table_name: str, side: str) -> str:
+        return f"{sync_pair_id}__{table_name}__{side}"
+
+
+class ConflictStore:
+    """
+    Persists conflicts and their resolutions.
+
+    Conflicts are created with status PENDING (manual_review) or RESOLVED
+    (automatic strategies, kept for the record).
+    """
+
+    def __init__(self, store: DocumentStore):
+        """
+        Initialize the conflict store.
+
+        Args:
+            store: Document store for persistence
+        """
+        self.store = store
+
+    def record_conflict(self,
+                        job_id: str,
+                        sync_pair_id: str,
+                        table_name: str,
+                        key: str,
+                        source_record: Dict[str, Any],
+                        target_record: Dict[str, Any],
+                        strategy: str,
+                        winner: str) -> Dict[str, Any]:
+        """
+        Record a detected conflict.
+
+        Returns:
+            The conflict document
+        """
+        now = datetime.utcnow().isoformat()
+        conflict = {
+            "conflict_id": str(uuid.uuid4()),
+            "job_id": job_id,
+            "sync_pair_id": sync_pair_id,
+            "table": table_name,
+            "record_key": key,
+            "source_record": self._clean(source_record),
+            "target_record": self._clean(target_record),
+            "strategy": strategy,
+            "status": "PENDING" if winner == WINNER_MANUAL else "RESOLVED",
+            "resolution": None if winner == WINNER_MANUAL else winner,
+            "resolved_by": None if winner == WINNER_MANUAL else f"strategy:{strategy}",
+            "detected_at": now,
+            "resolved_at": None if winner == WINNER_MANUAL else now,
+        }
+        self.store.save(CONFLICTS_COLLECTION, conflict["conflict_id"], conflict)
+        return conflict
+
+    def get(self, conflict_id: str) -> Dict[str, Any]:
+        """
+        Get a conflict.
+
+        Raises:
+            FileNotFoundError: If the conflict does not exist
+        """
+        try:
+            return self.store.load(CONFLICTS_COLLECTION, conflict_id)
+        except FileNotFoundError:
+            raise FileNotFoundError(f"Conflict {conflict_id} not found")
+
+    def list(self,
+             sync_pair_id: Optional[str] = None,
+             table_name: Optional[str] = None,
+             key: Optional[str] = None,
+             status: Optional[str] = None,
+             limit: int = 100) -> List[Dict[str, Any]]:
+        """List conflicts with optional filtering, newest first."""
+        conflicts = []
+        for conflict in self.store.list(CONFLICTS_COLLECTION):
+            if sync_pair_id and conflict.get("sync_pair_id") != sync_pair_id:
+                continue
+            if table_name and conflict.get("table") != table_name:
+                continue
+            if key and conflict.get("record_key") != key:
+                continue
+            if status and conflict.get("status") != status:
+                continue
+            conflicts.append(conflict)
+        conflicts.sort(key=lambda c: c.get("detected_at", ""), reverse=True)
+        return conflicts[:limit]
+
+    def pending_by_key(self, sync_pair_id: str, table_name: str) -> Dict[str, Dict[str, Any]]:
+        """Unresolved conflicts for a table by record key; these records are held back from sync."""
+        pending = self.list(sync_pair_id, table_name, status="PENDING", limit=1_000_000)
+        return {c["record_key"]: c for c in pending}
+
+    def refresh(self, conflict: Dict[str, Any], side: str, record: Dict[str, Any]) -> Dict[str, Any]:
+        """Replace one side of a pending conflict with a newer change to the same record."""
+        conflict[f"{side}_record"] = self._clean(record)
+        conflict.setdefault("refreshed_at", [])
+        conflict["refreshed_at"].append(datetime.utcnow().isoformat())
+        self.store.save(CONFLICTS_COLLECTION, conflict["conflict_id"], conflict)
+        return conflict
+
+    def mark_resolved(self, conflict_id: str, resolution: str, username: str,
+                      field_choices: Optional[Dict[str, str]] = None) -> Dict[str, Any]:
+        """
+        Mark a pending conflict as resolved.
+
+        Raises:
+            FileNotFoundError: If the conflict does not exist
+            ValueError: If the conflict is not pending
+        """
+        conflict = self.get(conflict_id)
+        if conflict["status"] != "PENDING":
+            raise ValueError(f"Cannot resolve conflict {conflict_id} with status {conflict['status']}")
+        conflict["status"] = "RESOLVED"
+        conflict["resolution"] = resolution
+        conflict["resolved_by"] = username
+        conflict["resolved_at"] = datetime.utcnow().isoformat()
+        if field_choices:
+            conflict["field_choices"] = dict(field_choices)
+        self.store.save(CONFLICTS_COLLECTION, conflict_id, conflict)
+        return conflict
+
+    @staticmethod
+    def _clean(record: Dict[str, Any]) -> Dict[str, Any]:
+        return {k: v for k, v in record.items() if k not in RESERVED_FIELDS}
@@ -0,0 +1,5522 @@
+"""
+TerraFusion SyncService - Connectors
+
+This module provides the source and target connectors used by the sync engine.
+Source connectors read rows from county systems (full reads or change-tracked
+deltas); target connectors write batches into the TerraFusion staging store
+(PostgreSQL, or an embedded SQLite database for evaluation installs) and GIS
+systems. File geodatabases can be read for one-time imports, and generic
+REST APIs polled, or folders of dropped export files read, for systems that
+expose nothing else.
+"""
+
+import os
+import re
+import gzip
+import json
+import time
+import uuid
+import base64
+import struct
+import io
+import csv
+import hashlib
+import tempfile
+import sqlite3
+import logging
+import string
+import fnmatch
+import calendar
+import threading
+from decimal import Decimal
+from datetime import date, datetime, timedelta, timezone, time as time_of_day
+from typing import Dict, List, Any, Optional, Iterator, Tuple
+from email.utils import parsedate_to_datetime
+from urllib.parse import urljoin, urlsplit, quote as url_quote
+
+import psycopg2
+import requests
+from psycopg2.extras import RealDictCursor, execute_values
+
+from export_storage import create_artifact_store
+from encryption import EncryptionError, create_cipher, default_cipher
+from secret_providers import secret_resolver, refresh_config_secrets
+from tracing import tracer
+from sync_jsonpath import JsonPath, compile_path
+from sync_resilience import parse_resilience, circuit_breaker, classify_error, backoff_seconds, record_retry
+from sync_pools import parse_pool, connection_pool, PoolTimeoutError, DEFAULT_MAX_OPEN
+from sync_bulk import BulkLoader, copy_rows
+from sync_columnar import ColumnBatch
+
+try:
+    import pyodbc
+    PYODBC_AVAILABLE = True
+except ImportError:
+    # SQL Server access requires pyodbc and an ODBC driver
+    PYODBC_AVAILABLE = False
+
+try:
+    import oracledb
+    ORACLEDB_AVAILABLE = True
+except ImportError:
+    # Oracle access requires python-oracledb (thin mode needs no Oracle client)
+    ORACLEDB_AVAILABLE = False
+
+try:
+    from osgeo import ogr, osr
+    ogr.UseExceptions()
+    osr.UseExceptions()
+    OGR_AVAILABLE = True
+except ImportError:
+    # File Geodatabase imports require GDAL's Python bindings (OpenFileGDB driver)
+    OGR_AVAILABLE = False
+
+try:
+    import snowflake.connector
+    SNOWFLAKE_AVAILABLE = True
+except ImportError:
+    # Snowflake loads require snowflake-connector-python
+    SNOWFLAKE_AVAILABLE = False
+
+try:
+    from google.cloud import bigquery
+    from google.api_core import exceptions as google_exceptions
+    BIGQUERY_AVAILABLE = True
+except ImportError:
+    # BigQuery loads require google-cloud-bigquery
+    BIGQUERY_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Change detection methods supported for incremental sync
+CHANGE_TRACKING_METHODS = ["change_tracking", "rowversion", "cdc", "ora_rowscn", "change_column", "file_modified"]
+
+# Reserved record fields added by source connectors
+OPERATION_FIELD = "_sync_operation"
+VERSION_FIELD = "_sync_version"
+IDEMPOTENCY_FIELD = "_sync_idempotency_key"  # Added by the engine (see sync_idempotency)
+LINEAGE_FIELD = "_sync_lineage"  # Added by the engine (see sync_lineage)
+RESERVED_FIELDS = (OPERATION_FIELD, VERSION_FIELD, IDEMPOTENCY_FIELD, LINEAGE_FIELD)
+
+# Longest PostgreSQL identifier
+MAX_POSTGRES_IDENTIFIER = 63
+
+# Parameters used per SQL Server key lookup statement (the server limit is 2100)
+SQLSERVER_MAX_PARAMETERS = 2000
+
+# Bind variables per Oracle key lookup statement (the server limit is 65535)
+ORACLE_MAX_BINDS = 1000
+
+# Oracle identifiers that need no quoting (they are folded to upper case)
+ORACLE_SIMPLE_IDENTIFIER = re.compile(r"^[A-Za-z][A-Za-z0-9_$#]*$")
+
+# SQL Server change tracking operation codes
+SQLSERVER_OPERATIONS = {"I": "insert", "U": "update", "D": "delete"}
+
+# Fragments of the errors SQL Server raises for a duplicate key (2627 constraint, 2601 unique index)
+SQLSERVER_DUPLICATE_KEY_ERRORS = ("2627", "2601", "duplicate key")
+
+# SQLSTATE of a PostgreSQL unique violation
+POSTGRES_UNIQUE_VIOLATION = "23505"
+
+# SQL Server CDC __$operation codes (net changes)
+SQLSERVER_CDC_OPERATIONS = {1: "delete", 2: "insert", 3: "update", 4: "update", 5: "update"}
+
+# Comparison operators of query expressions and their SQL spelling
+QUERY_COMPARISONS = {"=": "=", "==": "=", "!=": "<>", "<>": "<>", "<": "<", "<=": "<=", ">": ">", ">=": ">="}
+
+
+def record_key(primary_key: List[str], record: Dict[str, Any]) -> str:
+    """Build a stable string key for a record from its primary key values."""
+    return json.dumps([record.get(column) for column in primary_key], default=str)
+
+
+def dedupe_batch(records: List[Dict[str, Any]], primary_key: List[str]) -> List[Dict[str, Any]]:
+    """
+    Keep only the last record for each primary key in a batch.
+
+    A batch can hold the same key twice (for example when a hook maps two
+    source rows to one target key); a single upsert statement cannot touch a
+    row twice, and the last change is the one that must win.
+    """
+    latest: Dict[str, Dict[str, Any]] = {}
+    for record in records:
+        key = record_key(primary_key, record)
+        latest.pop(key, None)
+        latest[key] = record
+    return list(latest.values())
+
+
+def compile_where(tree: Tuple, quote, placeholder: str = "%s", value=None) -> Tuple[str, List[Any]]:
+    """
+    Compile a query expression into a SQL condition and its parameters.
+
+    Query expressions (the "where" of query_records) use the node shapes of
+    sync_filters: ("and", a, b), ("or", a, b), ("not", a),
+    ("compare", operator, left, right), ("in", operand, values) and
+    ("is_null", operand), where operands are ("field", column) or
+    ("literal", value). ("like", operand, pattern) takes a SQL LIKE pattern
+    that escapes wildcards with a backslash.
+
+    Args:
+        tree: Query expression
+        quote: Quotes a column name for the target database
+        placeholder: Parameter placeholder of the database driver
+        value: Converts literal values to what the driver binds (optional)
+
+    Raises:
+        ConnectorError: If the expression has an unknown node or operator
+    """
+    params = []
+
+    def bind(literal: Any) -> str:
+        params.append(value(literal) if value else literal)
+        return placeholder
+
+    def operand(node: Tuple) -> str:
+        return quote(node[1]) if node[0] == "field" else bind(node[1])
+
+    def condition(node: Tuple) -> str:
+        op = node[0]
+        if op in ("and", "or"):
+            return f"({condition(node[1])} {op.upper()} {condition(node[2])})"
+        if op == "not":
+            return f"NOT ({condition(node[1])})"
+        if op == "compare":
+            operator = QUERY_COMPARISONS.get(node[1])
+            if operator is None:
+                raise ConnectorError(f"Unsupported comparison {node[1]} in query")
+            left, right = node[2], node[3]
+            if left == ("literal", None):
+                left, right = right, left
+            if right == ("literal", None) and operator in ("=", "<>"):
+                return f"{operand(left)} IS {'NOT ' if operator == '<>' else ''}NULL"
+            return f"{operand(left)} {operator} {operand(right)}"
+        if op == "is_null":
+            return f"{operand(node[1])} IS NULL"
+        if op == "in":
+            if not node[2]:
+                return "1 = 0"
+            return f"{operand(node[1])} IN ({', '.join(bind(v) for v in node[2])})"
+        if op == "like":
+            return f"{operand(node[1])} LIKE {bind(node[2])} ESCAPE '\\'"
+        raise ConnectorError(f"Unsupported query expression {op}")
+
+    return condition(tree), params
+
+
+def keyset_after(key_columns: List[str], last_key: List[Any], descending: Optional[List[bool]] = None) -> Tuple:
+    """
+    Query expression for the rows after a key in key order, for reading a
+    table a page at a time without OFFSET. descending flags the columns
+    ordered high to low.
+    """
+    tree = None
+    for i, column in enumerate(key_columns):
+        operator = "<" if descending and descending[i] else ">"
+        term = ("compare", operator, ("field", column), ("literal", last_key[i]))
+        for previous, value in zip(key_columns[:i], last_key[:i]):
+            term = ("and", ("compare", "=", ("field", previous), ("literal", value)), term)
+        tree = term if tree is None else ("or", tree, term)
+    return tree
+
+
+class ConnectorError(Exception):
+    """Raised when a connector cannot complete an operation."""
+
+
+class CircuitOpenError(ConnectorError):
+    """Raised instead of calling a database or service whose circuit breaker is open (see sync_resilience)."""
+
+
+class WatermarkExpiredError(ConnectorError):
+    """
+    Raised when a stored watermark is older than the source can serve.
+
+    SQL Server purges change tracking history after the configured retention
+    period; once that happens the table must be re-read in full.
+    """
+
+
+class SourceConnector:
+    """
+    Base class for sync sources.
+
+    Table definitions are dictionaries from the sync pair configuration with
+    at least "name" and "primary_key" keys. Connectors used on the source side
+    of a bidirectional sync pair also implement write_batch.
+    """
+
+    connector_type = "base"
+
+    # Whether read_table_columns reads column batches natively (see sync_columnar)
+    columnar_reads = False
+
+    def __init__(self, config: Dict[str, Any]):
+        """
+        Initialize the connector.
+
+        Args:
+            config: Connector configuration from the sync pair
+        """
+        self.config = config
+
+    def connect(self) -> None:
+        """Open the underlying connection."""
+
+    def close(self) -> None:
+        """Close the underlying connection."""
+
+    def __enter__(self):
+        _connect_with_secrets(self)
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        self.close()
+
+    def read_table(self, table: Dict[str, Any], batch_size: int,
+                   after_key: Optional[List[Any]] = None) -> Iterator[List[Dict[str, Any]]]:
+        """
+        Yield every row of a table in batches, ordered by primary key.
+
+        When after_key (primary key values of the last row already written) is
+        given, only rows after it are read, so an interrupted read can resume.
+        """
+        raise NotImplementedError
+
+    def read_table_columns(self, table: Dict[str, Any], batch_size: int,
+                           after_key: Optional[List[Any]] = None) -> Iterator[ColumnBatch]:
+        """Yield every row of a table as read_table does, in column batches."""
+        for batch in self.read_table(table, batch_size, after_key=after_key):
+            yield ColumnBatch.from_records(batch)
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        """
+        Yield rows changed after since_version up to and including until_version.
+
+        Records are ordered by change version. Each record carries
+        OPERATION_FIELD ("insert", "update" or "delete") and VERSION_FIELD.
+        Deleted rows contain only their primary key columns.
+        """
+        raise NotImplementedError
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        """Return the change version to store as the table's next watermark."""
+        raise NotImplementedError
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        """
+        Return the rows whose table["primary_key"] columns match the given values.
+
+        Used by merge sync pairs to look up records by their join key, which
+        need not be the table's real primary key.
+        """
+        raise NotImplementedError(f"{self.connector_type} connectors do not support record lookups")
+
+    def write_batch(self, table: Dict[str, Any], records: List[Dict[str, Any]]) -> Dict[str, int]:
+        """Write records back to the source (bidirectional sync pairs only)."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not support writes")
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        """
+        Describe a source table from the database catalog.
+
+        Returns:
+            Dictionary with "name", "columns" (each with "name", "type" and
+            "nullable") and the catalog's "primary_key" columns
+
+        Raises:
+            ConnectorError: If the table does not exist
+        """
+        raise NotImplementedError(f"{self.connector_type} connectors do not support schema introspection")
+
+    def list_tables(self) -> List[str]:
+        """
+        List the tables the connecting user can read, by the names table definitions use.
+
+        Used by `terrafusion init` to offer the tables of a new sync pair.
+        """
+        raise NotImplementedError(f"{self.connector_type} connectors do not support schema introspection")
+
+    def health_check(self) -> Dict[str, Any]:
+        """Check connectivity to the source."""
+        return {"connector_type": self.connector_type, "status": "unknown"}
+
+
+class TargetConnector:
+    """
+    Base class for sync targets.
+
+    Connectors used on the target side of a bidirectional sync pair also
+    implement read_changes and get_current_version so target-side edits can
+    be detected and pushed back to the source.
+    """
+
+    connector_type = "base"
+
+    # Whether write_columns writes column batches without making records of them (see sync_columnar)
+    columnar_writes = False
+
+    def __init__(self, config: Dict[str, Any]):
+        """
+        Initialize the connector.
+
+        Args:
+            config: Connector configuration from the sync pair
+        """
+        self.config = config
+
+    def connect(self) -> None:
+        """Open the underlying connection."""
+
+    def close(self) -> None:
+        """Close the underlying connection."""
+
+    def __enter__(self):
+        _connect_with_secrets(self)
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        self.close()
+
+    def write_batch(self, table: Dict[str, Any], records: List[Dict[str, Any]]) -> Dict[str, int]:
+        """
+        Apply a batch of records to the target table.
+
+        Returns:
+            Dictionary with "upserted" and "deleted" counts
+        """
+        raise NotImplementedError
+
+    def write_columns(self, table: Dict[str, Any], batch: ColumnBatch) -> Dict[str, int]:
+        """Apply a column batch to the target table, as write_batch applies its records."""
+        return self.write_batch(table, batch.records())
+
+    def is_record_error(self, exc: Exception) -> bool:
+        """
+        Whether a write_batch error was caused by the data of a record (a value the
+        target cannot store or a constraint it violates) rather than by the target
+        itself. The engine then writes the batch record by record and dead-letters
+        the records that still fail.
+        """
+        return False
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        """Return the current target rows for the given primary key values (used by dry runs)."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not support record lookups")
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        """Yield target rows changed in the version window (bidirectional sync pairs only)."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not support change reads")
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        """Return the target change version for bidirectional watermarks."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not support change reads")
+
+    def table_stats(self, table: Dict[str, Any], columns: Optional[List[str]] = None) -> Dict[str, Any]:
+        """
+        Return the row count of a target table and the number of NULLs in the given columns.
+
+        Returns:
+            Dictionary with "row_count" and "null_counts" (column to count)
+        """
+        raise NotImplementedError(f"{self.connector_type} connectors do not support table statistics")
+
+    def create_snapshot(self, table: Dict[str, Any], snapshot_table: str) -> int:
+        """Copy a target table into snapshot_table and return the number of rows copied."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not support snapshots")
+
+    def restore_snapshot(self, snapshot_tables: List[Tuple[Dict[str, Any], str]]) -> Dict[str, int]:
+        """
+        Replace the contents of target tables with their snapshots in one transaction.
+
+        Args:
+            snapshot_tables: (table, snapshot_table) pairs in dependency order
+
+        Returns:
+            Rows restored per table name
+        """
+        raise NotImplementedError(f"{self.connector_type} connectors do not support snapshots")
+
+    def drop_snapshot(self, table: Dict[str, Any], snapshot_table: str) -> None:
+        """Remove a snapshot table."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not support snapshots")
+
+    def fetch_lineage(self, table: Dict[str, Any], keys: Optional[List[List[Any]]] = None,
+                      job_id: Optional[str] = None, limit: int = 100) -> List[Dict[str, Any]]:
+        """
+        Return the primary key values and lineage metadata (see sync_lineage) of
+        target rows, selected by primary key values or by the job that wrote them.
+        """
+        raise NotImplementedError(f"{self.connector_type} connectors do not support lineage")
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        """
+        Describe a target table, without the connector's idempotency and lineage columns.
+
+        Returns:
+            Dictionary with "name", "columns" (each with "name", "type" and
+            "nullable") and the table's "primary_key" columns
+
+        Raises:
+            ConnectorError: If the table does not exist
+        """
+        raise NotImplementedError(f"{self.connector_type} connectors do not support schema introspection")
+
+    def query_records(self, table: Dict[str, Any], where: Optional[Tuple] = None, columns: Optional[List[str]] = None,
+                      order_by: Optional[List[Tuple[str, bool]]] = None, limit: Optional[int] = None,
+                      offset: int = 0) -> List[Dict[str, Any]]:
+        """
+        Read target rows for query APIs such as the OData service (see sync_odata).
+
+        Args:
+            table: Target table definition
+            where: Query expression the rows must match (see compile_where)
+            columns: Only these columns of each row
+            order_by: (column, descending) pairs
+            limit: Maximum number of rows
+            offset: Number of matching rows to skip
+        """
+        raise NotImplementedError(f"{self.connector_type} connectors do not support queries")
+
+    def count_records(self, table: Dict[str, Any], where: Optional[Tuple] = None) -> int:
+        """Count the target rows that match a query expression."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not support queries")
+
+    def quarantine_records(self, quarantine_table: str, entries: List[Dict[str, Any]]) -> int:
+        """
+        Store records that failed validation in the quarantine table (see sync_validation).
+
+        Each entry has sync_pair_id, source_table, target_table, record_key,
+        job_id, reasons, record (as extracted) and loaded (as it would have been
+        written). An entry replaces the earlier one for the same record.
+
+        Returns:
+            Number of entries stored
+        """
+        raise NotImplementedError(f"{self.connector_type} connectors do not support quarantine")
+
+    def list_quarantined(self, quarantine_table: str, sync_pair_id: str, source_table: Optional[str] = None,
+                         limit: int = 100) -> List[Dict[str, Any]]:
+        """List quarantined records of a sync pair, most recent first."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not support quarantine")
+
+    def list_load_manifests(self, table: Optional[Dict[str, Any]] = None, job_id: Optional[str] = None,
+                            limit: int = 100) -> List[Dict[str, Any]]:
+        """List the bulk loads recorded by a warehouse target (see WarehouseTarget), most recent first."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not record load manifests")
+
+    def quarantined_keys(self, quarantine_table: str, sync_pair_id: str, source_table: str) -> set:
+        """Record keys currently quarantined for a table."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not support quarantine")
+
+    def release_quarantined(self, quarantine_table: str, sync_pair_id: str, source_table: str,
+                            record_keys: List[str]) -> int:
+        """Remove records from quarantine (they have since loaded) and return how many were removed."""
+        raise NotImplementedError(f"{self.connector_type} connectors do not support quarantine")
+
+    def health_check(self) -> Dict[str, Any]:
+        """Check connectivity to the target."""
+        return {"connector_type": self.connector_type, "status": "unknown"}
+
+
+def _version_timestamp(version: Any) -> Any:
+    """Bind value for a change_column version stored as an ISO timestamp."""
+    if isinstance(version, str):
+        try:
+            return datetime.fromisoformat(version)
+        except ValueError:
+            return version
+    return version
+
+
+def _env_setting(config: Dict[str, Any], key: str, default: Optional[str] = None) -> Optional[str]:
+    """Read a connector setting directly, from a secrets provider via *_secret, or via its *_env_var indirection."""
+    if config.get(key) is not None:
+        return str(config[key])
+    if config.get(f"{key}_secret"):
+        return secret_resolver.resolve(config[f"{key}_secret"])
+    env_var = config.get(f"{key}_env_var")
+    if env_var:
+        return os.environ.get(env_var, default)
+    return default
+
+
+def _connect_with_secrets(connector) -> None:
+    """Connect, retrying once when refused credentials' secrets have been rotated since they were cached."""
+    with tracer.span("connector.connect", {"sync.connector": connector.connector_type}):
+        try:
+            connector.connect()
+        except Exception:
+            if not refresh_config_secrets(connector.config):
+                raise
+            logger.info(f"Connecting {connector.connector_type} connector again with its rotated secrets")
+            connector.connect()
+
+
+def _pool_settings(config: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    The pool settings of a connector (see sync_pools); pool_size and
+    pool_timeout_seconds are still read as max_open and wait_seconds.
+
+    Raises:
+        ValueError: If the pool block is invalid
+    """
+    max_open = config.get("pool_size") or max(DEFAULT_MAX_OPEN, int(config.get("max_workers", 1)))
+    return parse_pool(config.get("pool"), {"max_open": max_open, "wait_seconds": config.get("pool_timeout_seconds")})
+
+
+def _pooled_connect(connector, label: str, identity: str, open_connection):
+    """
+    A connection from the pool of the connector's database, or a new one with pooling off.
+
+    Args:
+        connector: Connector taking the connection; it keeps the pool in connector.pool for close
+        label: Host and database, naming the pool
+        identity: Every connection parameter, credentials included
+        open_connection: Opens a connection given the statement timeout in seconds (None for none)
+
+    Raises:
+        ConnectorError: If no pooled connection frees up in time
+    """
+    settings = _pool_settings(connector.config)
+    if not settings["enabled"]:
+        connector.pool = None
+        return open_connection(None)
+    timeout = settings["statement_timeout_seconds"]
+    name = settings["name"] or f"{connector.pool_family}:{label}"
+    pool = connection_pool(name, identity, lambda: open_connection(timeout), settings)
+    try:
+        connection = pool.acquire()
+    except PoolTimeoutError as e:
+        raise ConnectorError(str(e))
+    connector.pool = pool
+    return connection
+
+
+def _pooled_release(connector, connection) -> None:
+    """Hand a connection back to its pool, or close it with pooling off."""
+    connection = tracer.unwrap(connection)
+    pool = getattr(connector, "pool", None)
+    if pool is None:
+        connection.close()
+    else:
+        pool.release(connection)
+
+
+def _with_pool(connector, result: Dict[str, Any]) -> Dict[str, Any]:
+    """A health check result with the status of the connector's pool, if it has one."""
+    pool = getattr(connector, "pool", None)
+    return dict(result, pool=pool.status()) if pool is not None else result
+
+
+def _postgres_connect(connector, dsn: str, autocommit: bool):
+    """A pooled psycopg2 connection returning rows as dictionaries."""
+    def open_connection(statement_timeout: Optional[float]):
+        options = {"options": f"-c statement_timeout={int(statement_timeout * 1000)}"} if statement_timeout else {}
+        return psycopg2.connect(dsn, cursor_factory=RealDictCursor, **options)
+
+    connection = _pooled_connect(connector, _dsn_label(dsn), dsn, open_connection)
+    connection.autocommit = autocommit
+    return tracer.traced_connection(connection)
+
+
+class SqlServerConnector(SourceConnector):
+    """
+    Source connector for SQL Server based CAMA systems such as PACS.
+
+    Incremental reads use SQL Server Change Tracking (CHANGETABLE), a rowversion
+    column, Change Data Capture or a last-modified "change_column", selected per
+    table with the "change_tracking" setting. CDC versions are log sequence
+    numbers rendered as hex strings; change_column versions are ISO timestamps.
+
+    Target-side changes written back by bidirectional sync pairs are MERGE
+    upserts; large batches of new rows are bulk inserted instead (see
+    sync_bulk).
+    """
+
+    connector_type = "sqlserver"
+    pool_family = "sqlserver"
+    columnar_reads = True
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.connection = None
+        self.pool = None
+        self.bulk_loader = BulkLoader(self.connector_type, _circuit_name(config, {}), config.get("bulk_load"))
+
+    def connect(self) -> None:
+        if not PYODBC_AVAILABLE:
+            raise ConnectorError("pyodbc is required for SQL Server connectors")
+        if self.connection is None:
+            connection_string = self._connection_string()
+
+            def open_connection(statement_timeout: Optional[float]):
+                connection = pyodbc.connect(connection_string, autocommit=True)
+                if statement_timeout:
+                    # pyodbc's query timeout, in whole seconds
+                    connection.timeout = max(1, int(round(statement_timeout)))
+                return connection
+
+            label = "/".join(part for part in (_env_setting(self.config, "host"),
+                                               _env_setting(self.config, "database")) if part)
+            self.connection = tracer.traced_connection(
+                _pooled_connect(self, label, connection_string, open_connection))
+
+    def close(self) -> None:
+        if self.connection is not None:
+            _pooled_release(self, self.connection)
+            self.connection = None
+
+    def _connection_string(self) -> str:
+        """Build the ODBC connection string from configuration and environment."""
+        host = _env_setting(self.config, "host")
+        if not host:
+            raise ConnectorError("SQL Server host is not configured")
+        port = _env_setting(self.config, "port", "1433")
+        database = _env_setting(self.config, "database")
+        user = _env_setting(self.config, "user")
+        password = _env_setting(self.config, "password")
+        driver = self.config.get("driver", "ODBC Driver 18 for SQL Server")
+
+        parts = [f"DRIVER={{{driver}}}", f"SERVER={host},{port}"]
+        if database:
+            parts.append(f"DATABASE={database}")
+        if user:
+            parts.append(f"UID={user}")
+            parts.append(f"PWD={password or ''}")
+        else:
+            parts.append("Trusted_Connection=yes")
+        if self.config.get("trust_server_certificate", False):
+            parts.append("TrustServerCertificate=yes")
+        return ";".join(parts)
+
+    def read_table(self, table: Dict[str, Any], batch_size: int,
+                   after_key: Optional[List[Any]] = None) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        yield from self._fetch_batches(*self._table_query(table, after_key), batch_size, operation="update")
+
+    def read_table_columns(self, table: Dict[str, Any], batch_size: int,
+                           after_key: Optional[List[Any]] = None) -> Iterator[ColumnBatch]:
+        self.connect()
+        yield from self._fetch_batches(*self._table_query(table, after_key), batch_size, operation="update",
+                                       columnar=True)
+
+    def _table_query(self, table: Dict[str, Any], after_key: Optional[List[Any]]) -> Tuple[str, List[Any]]:
+        """Query and parameters reading a table in primary key order, after after_key when given."""
+        key_columns = [self._quote(col) for col in table["primary_key"]]
+        query = f"SELECT * FROM {self._quote_table(table['name'])}"
+        params: List[Any] = []
+        if after_key:
+            # Keyset predicate equivalent to (k1, k2, ...) > (?, ?, ...)
+            clauses = []
+            for i, column in enumerate(key_columns):
+                equal = [f"{c} = ?" for c in key_columns[:i]]
+                clauses.append("(" + " AND ".join(equal + [f"{column} > ?"]) + ")")
+                params.extend(list(after_key[:i]) + [after_key[i]])
+            query += " WHERE " + " OR ".join(clauses)
+        query += " ORDER BY " + ", ".join(key_columns)
+        return query, params
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        method = table.get("change_tracking")
+        if method == "change_tracking":
+            yield from self._read_change_tracking(table, int(since_version), int(until_version), batch_size)
+        elif method == "rowversion":
+            yield from self._read_rowversion(table, int(since_version), int(until_version), batch_size)
+        elif method == "cdc":
+            yield from self._read_cdc(table, str(since_version), str(until_version), batch_size)
+        elif method == "change_column":
+            yield from self._read_change_column(table, since_version, until_version, batch_size)
+        else:
+            raise ConnectorError(f"Table {table['name']} has no change tracking method configured")
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        self.connect()
+        method = table.get("change_tracking")
+        cursor = self.connection.cursor()
+        try:
+            if method == "cdc":
+                cursor.execute("SELECT sys.fn_cdc_get_max_lsn()")
+                row = cursor.fetchone()
+                return self._lsn_hex(row[0]) if row and row[0] is not None else None
+            if method == "change_column":
+                column = self._quote(table["change_column"])
+                cursor.execute(f"SELECT MAX({column}) FROM {self._quote_table(table['name'])}")
+                row = cursor.fetchone()
+                version = row[0] if row else None
+                return version.isoformat() if hasattr(version, "isoformat") else version
+            if method == "change_tracking":
+                cursor.execute("SELECT CHANGE_TRACKING_CURRENT_VERSION()")
+            elif method == "rowversion":
+                # MIN_ACTIVE_ROWVERSION excludes values held by open transactions,
+                # so rows committed later with a lower rowversion are not skipped.
+                cursor.execute("SELECT CAST(MIN_ACTIVE_ROWVERSION() AS BIGINT) - 1")
+            else:
+                return None
+            row = cursor.fetchone()
+            return int(row[0]) if row and row[0] is not None else 0
+        finally:
+            cursor.close()
+
+    def write_batch(self, table: Dict[str, Any], records: List[Dict[str, Any]]) -> Dict[str, int]:
+        """
+        Apply changes to SQL Server using MERGE upserts, or as one bulk insert
+        when the batch is large enough (see sync_bulk).
+        """
+        self.connect()
+        upserts = [r for r in records if r.get(OPERATION_FIELD) != "delete"]
+        if self.bulk_loader.use_bulk(table, table["name"], len(upserts)):
+            try:
+                return self._write(table, records, bulk=True)
+            except Exception as e:
+                if not any(marker in str(e).lower() for marker in SQLSERVER_DUPLICATE_KEY_ERRORS):
+                    raise
+                self.bulk_loader.conflicted(table["name"], e)
+        return self._write(table, records, bulk=False)
+
+    def _write(self, table: Dict[str, Any], records: List[Dict[str, Any]], bulk: bool) -> Dict[str, int]:
+        table_name = self._quote_table(table["name"])
+        key_columns = list(table["primary_key"])
+        excluded = set(RESERVED_FIELDS)
+        if table.get("target_change_column"):
+            excluded.add(table["target_change_column"])
+
+        upserts = [r for r in records if r.get(OPERATION_FIELD) != "delete"]
+        deletes = [r for r in records if r.get(OPERATION_FIELD) == "delete"]
+
+        cursor = self.connection.cursor()
+        try:
+            cursor.execute("BEGIN TRANSACTION")
+            if bulk:
+                self._bulk_insert(cursor, table_name, upserts, excluded)
+                upserts = []
+            for record in upserts:
+                columns = [c for c in record if c not in excluded]
+                source_sql = ", ".join(f"? AS {self._quote(c)}" for c in columns)
+                match_sql = " AND ".join(f"t.{self._quote(c)} = s.{self._quote(c)}" for c in key_columns)
+                update_columns = [c for c in columns if c not in key_columns]
+                column_sql = ", ".join(self._quote(c) for c in columns)
+                values_sql = ", ".join(f"s.{self._quote(c)}" for c in columns)
+                query = f"MERGE {table_name} WITH (HOLDLOCK) AS t USING (SELECT {source_sql}) AS s ON {match_sql} "
+                if update_columns:
+                    update_sql = ", ".join(f"t.{self._quote(c)} = s.{self._quote(c)}" for c in update_columns)
+                    query += f"WHEN MATCHED THEN UPDATE SET {update_sql} "
+                query += f"WHEN NOT MATCHED THEN INSERT ({column_sql}) VALUES ({values_sql});"
+                cursor.execute(query, *[record.get(c) for c in columns])
+
+            where_sql = " AND ".join(f"{self._quote(c)} = ?" for c in key_columns)
+            for record in deletes:
+                cursor.execute(f"DELETE FROM {table_name} WHERE {where_sql}", *[record.get(c) for c in key_columns])
+            cursor.execute("COMMIT TRANSACTION")
+        except Exception:
+            cursor.execute("IF @@TRANCOUNT > 0 ROLLBACK TRANSACTION")
+            raise
+        finally:
+            cursor.close()
+
+        written = len(records) - len(deletes)
+        if bulk:
+            self.bulk_loader.loaded("fast_executemany", written)
+            return {"upserted": written, "deleted": len(deletes), "bulk_loaded": written}
+        return {"upserted": written, "deleted": len(deletes)}
+
+    def _bulk_insert(self, cursor, table_name: str, records: List[Dict[str, Any]], excluded: set) -> None:
+        """Insert records with one statement per column set, their rows bound as parameter arrays."""
+        groups: Dict[Tuple[str, ...], List[Dict[str, Any]]] = {}
+        for record in records:
+            groups.setdefault(tuple(c for c in record if c not in excluded), []).append(record)
+        cursor.fast_executemany = True
+        for columns, group in groups.items():
+            column_sql = ", ".join(self._quote(c) for c in columns)
+            cursor.executemany(
+                f"INSERT INTO {table_name} ({column_sql}) VALUES ({', '.join('?' for _ in columns)})",
+                [tuple(record.get(c) for c in columns) for record in group]
+            )
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.connect()
+            cursor = self.connection.cursor()
+            cursor.execute("SELECT 1")
+            cursor.fetchone()
+            cursor.close()
+            return _with_pool(self, {"connector_type": self.connector_type, "status": "healthy"})
+        except Exception as e:
+            return {"connector_type": self.connector_type, "status": "unavailable", "error": str(e)}
+
+    def _read_change_tracking(self, table: Dict[str, Any], since_version: int, until_version: int,
+                              batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        """Read changes through CHANGETABLE(CHANGES ...)."""
+        table_name = self._quote_table(table["name"])
+        cursor = self.connection.cursor()
+        try:
+            cursor.execute("SELECT CHANGE_TRACKING_MIN_VALID_VERSION(OBJECT_ID(?))", table["name"])
+            row = cursor.fetchone()
+        finally:
+            cursor.close()
+
+        min_valid = row[0] if row else None
+        if min_valid is None:
+            raise ConnectorError(f"Change tracking is not enabled on {table['name']}")
+        if since_version < int(min_valid):
+            raise WatermarkExpiredError(
+                f"Watermark {since_version} for {table['name']} is older than the minimum "
+                f"valid change tracking version {min_valid}"
+            )
+
+        key_columns = [self._quote(col) for col in table["primary_key"]]
+        join = " AND ".join(f"t.{col} = ct.{col}" for col in key_columns)
+        key_select = ", ".join(f"ct.{col} AS {self._quote('_ct_' + col.strip('[]'))}" for col in key_columns)
+        query = (
+            f"SELECT ct.SYS_CHANGE_OPERATION AS _ct_operation, ct.SYS_CHANGE_VERSION AS _ct_version, "
+            f"{key_select}, t.* "
+            f"FROM CHANGETABLE(CHANGES {table_name}, ?) AS ct "
+            f"LEFT OUTER JOIN {table_name} AS t ON {join} "
+            f"WHERE ct.SYS_CHANGE_VERSION <= ? "
+            f"ORDER BY ct.SYS_CHANGE_VERSION"
+        )
+
+        for batch in self._fetch_batches(query, [since_version, until_version], batch_size):
+            records = []
+            for raw in batch:
+                operation = SQLSERVER_OPERATIONS.get(raw.pop("_ct_operation", "U"), "update")
+                version = raw.pop("_ct_version", None)
+                keys = {col: raw.pop(f"_ct_{col}", None) for col in table["primary_key"]}
+                if operation == "delete":
+                    record = dict(keys)
+                else:
+                    record = raw
+                    record.update(keys)
+                record[OPERATION_FIELD] = operation
+                record[VERSION_FIELD] = version
+                records.append(record)
+            yield records
+
+    def _read_rowversion(self, table: Dict[str, Any], since_version: int, until_version: int,
+                         batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        """Read rows whose rowversion column advanced past the watermark."""
+        column = table.get("rowversion_column")
+        if not column:
+            raise ConnectorError(f"Table {table['name']} uses rowversion but has no rowversion_column")
+
+        quoted = self._quote(column)
+        query = (
+            f"SELECT *, CAST({quoted} AS BIGINT) AS _rv_version "
+            f"FROM {self._quote_table(table['name'])} "
+            f"WHERE {quoted} > CAST(CAST(? AS BIGINT) AS BINARY(8)) "
+            f"AND {quoted} <= CAST(CAST(? AS BIGINT) AS BINARY(8)) "
+            f"ORDER BY {quoted}"
+        )
+
+        for batch in self._fetch_batches(query, [since_version, until_version], batch_size, operation="update"):
+            for record in batch:
+                record[VERSION_FIELD] = record.pop("_rv_version", None)
+                # Raw rowversion bytes are not meaningful to the target
+                record.pop(column, None)
+            yield batch
+
+    def _read_change_column(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                            batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        """Read rows whose last-modified column advanced past the watermark (deletes are not seen)."""
+        column = table.get("change_column")
+        if not column:
+            raise ConnectorError(f"Table {table['name']} uses change_column but has no change_column")
+
+        quoted = self._quote(column)
+        query = f"SELECT * FROM {self._quote_table(table['name'])} WHERE {quoted} <= ?"
+        params = [_version_timestamp(until_version)]
+        if since_version is not None:
+            query += f" AND {quoted} > ?"
+            params.append(_version_timestamp(since_version))
+        query += f" ORDER BY {quoted}"
+        for batch in self._fetch_batches(query, params, batch_size, operation="update"):
+            for record in batch:
+                version = record.get(column)
+                record[VERSION_FIELD] = version.isoformat() if hasattr(version, "isoformat") else version
+            yield batch
+
+    def _read_cdc(self, table: Dict[str, Any], since_lsn: str, until_lsn: str,
+                  batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        """Read net changes from the table's CDC capture instance."""
+        capture_instance = table.get("capture_instance") or table["name"].replace(".", "_")
+        if not re.match(r"^\w+$", capture_instance):
+            raise ConnectorError(f"Invalid CDC capture instance name: {capture_instance}")
+
+        cursor = self.connection.cursor()
+        try:
+            cursor.execute("SELECT sys.fn_cdc_get_min_lsn(?)", capture_instance)
+            row = cursor.fetchone()
+        finally:
+            cursor.close()
+
+        min_lsn = row[0] if row else None
+        if not min_lsn or not any(min_lsn):
+            raise ConnectorError(f"CDC is not enabled for capture instance {capture_instance}")
+        if bytes.fromhex(since_lsn[2:]) < bytes(min_lsn):
+            raise WatermarkExpiredError(
+                f"Watermark {since_lsn} for {table['name']} is older than the minimum "
+                f"available CDC LSN {self._lsn_hex(min_lsn)}"
+            )
+        if bytes.fromhex(since_lsn[2:]) >= bytes.fromhex(until_lsn[2:]):
+            return
+
+        function = self._quote(f"fn_cdc_get_net_changes_{capture_instance}")
+        query = (
+            f"SELECT * FROM cdc.{function}("
+            f"sys.fn_cdc_increment_lsn(CONVERT(binary(10), ?, 1)), CONVERT(binary(10), ?, 1), N'all') "
+            f"ORDER BY __$start_lsn"
+        )
+
+        for batch in self._fetch_batches(query, [since_lsn, until_lsn], batch_size):
+            records = []
+            for raw in batch:
+                operation = SQLSERVER_CDC_OPERATIONS.get(raw.get("__$operation"), "update")
+                version = self._lsn_hex(raw.get("__$start_lsn"))
+                record = {k: v for k, v in raw.items() if not k.startswith("__$")}
+                if operation == "delete":
+                    record = {col: record.get(col) for col in table["primary_key"]}
+                record[OPERATION_FIELD] = operation
+                record[VERSION_FIELD] = version
+                records.append(record)
+            yield records
+
+    @staticmethod
+    def _lsn_hex(lsn: Any) -> Optional[str]:
+        """Render a binary(10) LSN as a 0x-prefixed hex string."""
+        if lsn is None:
+            return None
+        return "0x" + bytes(lsn).hex().upper()
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        self.connect()
+        schema, name = table["name"].split(".", 1) if "." in table["name"] else ("dbo", table["name"])
+        columns = list(self._fetch_rows(
+            "SELECT COLUMN_NAME AS name, DATA_TYPE AS type, IS_NULLABLE AS nullable "
+            "FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION",
+            [schema, name]
+        ))
+        if not columns:
+            raise ConnectorError(f"Table {table['name']} does not exist")
+        primary_key = [row["name"] for row in self._fetch_rows(
+            "SELECT k.COLUMN_NAME AS name FROM INFORMATION_SCHEMA.TABLE_CONSTRAINTS c "
+            "JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE k ON k.CONSTRAINT_NAME = c.CONSTRAINT_NAME "
+            "AND k.TABLE_SCHEMA = c.TABLE_SCHEMA AND k.TABLE_NAME = c.TABLE_NAME "
+            "WHERE c.CONSTRAINT_TYPE = 'PRIMARY KEY' AND c.TABLE_SCHEMA = ? AND c.TABLE_NAME = ? "
+            "ORDER BY k.ORDINAL_POSITION",
+            [schema, name]
+        )]
+        for column in columns:
+            column["nullable"] = column["nullable"] == "YES"
+        return {"name": table["name"], "columns": columns, "primary_key": primary_key}
+
+    def list_tables(self) -> List[str]:
+        self.connect()
+        return [f"{row['table_schema']}.{row['table_name']}" for row in self._fetch_rows(
+            "SELECT TABLE_SCHEMA AS table_schema, TABLE_NAME AS table_name FROM INFORMATION_SCHEMA.TABLES "
+            "WHERE TABLE_TYPE = 'BASE TABLE' ORDER BY TABLE_SCHEMA, TABLE_NAME",
+            []
+        )]
+
+    def _fetch_rows(self, query: str, params: List[Any]) -> Iterator[Dict[str, Any]]:
+        """Execute a catalog query and yield its rows as dictionaries."""
+        for batch in self._fetch_batches(query, params, 1000):
+            yield from batch
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        if not keys:
+            return []
+        self.connect()
+        key_columns = list(table["primary_key"])
+        match_sql = "(" + " AND ".join(f"{self._quote(c)} = ?" for c in key_columns) + ")"
+        # SQL Server accepts at most 2100 parameters per statement
+        chunk_size = max(1, SQLSERVER_MAX_PARAMETERS // len(key_columns))
+        records = []
+        for start in range(0, len(keys), chunk_size):
+            chunk = keys[start:start + chunk_size]
+            query = f"SELECT * FROM {self._quote_table(table['name'])} WHERE " + " OR ".join([match_sql] * len(chunk))
+            params = [value for key in chunk for value in key]
+            for batch in self._fetch_batches(query, params, len(chunk) or 1):
+                records.extend(batch)
+        return records
+
+    def _fetch_batches(self, query: str, params: List[Any], batch_size: int,
+                       operation: Optional[str] = None, columnar: bool = False) -> Iterator[List[Dict[str, Any]]]:
+        """Execute a query and yield dictionaries (column batches when columnar is set) in batches."""
+        cursor = self.connection.cursor()
+        try:
+            cursor.execute(query, *params)
+            columns = [col[0] for col in cursor.description]
+            while True:
+                rows = cursor.fetchmany(batch_size)
+                if not rows:
+                    break
+                if columnar:
+                    yield ColumnBatch.from_rows(columns, rows, {OPERATION_FIELD: operation} if operation else None)
+                    continue
+                batch = []
+                for row in rows:
+                    record = dict(zip(columns, row))
+                    if operation:
+                        record[OPERATION_FIELD] = operation
+                    batch.append(record)
+                yield batch
+        finally:
+            cursor.close()
+
+    @staticmethod
+    def _quote(identifier: str) -> str:
+        """Quote a SQL Server identifier."""
+        return "[" + identifier.strip("[]").replace("]", "]]") + "]"
+
+    def _quote_table(self, name: str) -> str:
+        """Quote a possibly schema-qualified table name."""
+        return ".".join(self._quote(part) for part in name.split("."))
+
+
+class OracleConnector(SourceConnector):
+    """
+    Source connector for Oracle based CAMA systems.
+
+    Incremental reads use ORA_ROWSCN or a last-modified column, selected per
+    table with "change_tracking": "ora_rowscn" or "change_column" (naming the
+    column in "change_column"). Neither detects hard deletes. ORA_ROWSCN is
+    the commit SCN of a row's block (of the row itself for tables created with
+    ROWDEPENDENCIES), so untouched rows sharing a block with a changed one are
+    re-read; writes are upserts, so that only costs time. Reading the current
+    SCN needs EXECUTE on DBMS_FLASHBACK.
+
+    Oracle folds unquoted names to upper case; column names are returned in
+    lower case unless "lowercase_columns" is false, so configuration and
+    field mappings can name columns as they would for SQL Server.
+    """
+
+    connector_type = "oracle"
+    pool_family = "oracle"
+    columnar_reads = True
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.connection = None
+        self.pool = None
+        self.schema = config.get("schema")
+        self.lowercase_columns = config.get("lowercase_columns", True)
+
+    def connect(self) -> None:
+        if not ORACLEDB_AVAILABLE:
+            raise ConnectorError("python-oracledb is required for Oracle connectors")
+        if self.connection is None:
+            dsn = _env_setting(self.config, "dsn")
+            if not dsn:
+                host = _env_setting(self.config, "host")
+                if not host:
+                    raise ConnectorError("Oracle DSN or host is not configured")
+                port = _env_setting(self.config, "port", "1521")
+                service_name = _env_setting(self.config, "service_name")
+                dsn = f"{host}:{port}/{service_name}" if service_name else f"{host}:{port}"
+            user = _env_setting(self.config, "user")
+            password = _env_setting(self.config, "password")
+
+            def open_connection(statement_timeout: Optional[float]):
+                connection = oracledb.connect(user=user, password=password, dsn=dsn)
+                if statement_timeout:
+                    connection.call_timeout = int(statement_timeout * 1000)
+                return connection
+
+            identity = json.dumps([user, password, dsn])
+            self.connection = tracer.traced_connection(_pooled_connect(self, dsn, identity, open_connection))
+            self.connection.outputtypehandler = self._output_type_handler
+
+    def close(self) -> None:
+        if self.connection is not None:
+            _pooled_release(self, self.connection)
+            self.connection = None
+
+    def read_table(self, table: Dict[str, Any], batch_size: int,
+                   after_key: Optional[List[Any]] = None) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        yield from self._fetch_batches(*self._table_query(table, after_key), batch_size, operation="update")
+
+    def read_table_columns(self, table: Dict[str, Any], batch_size: int,
+                           after_key: Optional[List[Any]] = None) -> Iterator[ColumnBatch]:
+        self.connect()
+        yield from self._fetch_batches(*self._table_query(table, after_key), batch_size, operation="update",
+                                       columnar=True)
+
+    def _table_query(self, table: Dict[str, Any], after_key: Optional[List[Any]]) -> Tuple[str, List[Any]]:
+        """Query and binds reading a table in primary key order, after after_key when given."""
+        key_columns = [self._quote(col) for col in table["primary_key"]]
+        query = f"SELECT * FROM {self._quote_table(table['name'])}"
+        params: List[Any] = []
+        if after_key:
+            # Oracle has no row value comparison; expand (k1, k2, ...) > (:1, :2, ...)
+            clauses = []
+            for i, column in enumerate(key_columns):
+                terms = []
+                for previous, value in zip(key_columns[:i], after_key[:i]):
+                    params.append(value)
+                    terms.append(f"{previous} = :{len(params)}")
+                params.append(after_key[i])
+                terms.append(f"{column} > :{len(params)}")
+                clauses.append("(" + " AND ".join(terms) + ")")
+            query += " WHERE " + " OR ".join(clauses)
+        query += " ORDER BY " + ", ".join(key_columns)
+        return query, params
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        method = table.get("change_tracking")
+        table_name = self._quote_table(table["name"])
+        if method == "ora_rowscn":
+            query = (
+                f'SELECT t.*, ORA_ROWSCN AS "_tf_scn" FROM {table_name} t '
+                f"WHERE ORA_ROWSCN > :1 AND ORA_ROWSCN <= :2 ORDER BY ORA_ROWSCN"
+            )
+            params = [int(since_version), int(until_version)]
+            version_column = "_tf_scn"
+        elif method == "change_column":
+            column = self._quote(self._change_column(table))
+            query = f"SELECT * FROM {table_name} WHERE {column} > :1 AND {column} <= :2 ORDER BY {column}"
+            params = [_version_timestamp(since_version), _version_timestamp(until_version)]
+            version_column = self._column_name(table["change_column"])
+        else:
+            raise ConnectorError(f"Table {table['name']} has no Oracle change tracking method configured")
+
+        for batch in self._fetch_batches(query, params, batch_size, operation="update"):
+            for record in batch:
+                version = record.pop(version_column) if method == "ora_rowscn" else record.get(version_column)
+                record[VERSION_FIELD] = version.isoformat() if hasattr(version, "isoformat") else version
+            yield batch
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        self.connect()
+        method = table.get("change_tracking")
+        cursor = self.connection.cursor()
+        try:
+            if method == "ora_rowscn":
+                cursor.execute("SELECT DBMS_FLASHBACK.GET_SYSTEM_CHANGE_NUMBER FROM DUAL")
+                row = cursor.fetchone()
+                return int(row[0])
+            if method == "change_column":
+                column = self._quote(self._change_column(table))
+                cursor.execute(f"SELECT MAX({column}) FROM {self._quote_table(table['name'])}")
+                row = cursor.fetchone()
+                version = row[0] if row else None
+                return version.isoformat() if hasattr(version, "isoformat") else version
+            return None
+        finally:
+            cursor.close()
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        if not keys:
+            return []
+        self.connect()
+        key_columns = [self._quote(c) for c in table["primary_key"]]
+        chunk_size = max(1, ORACLE_MAX_BINDS // len(key_columns))
+        records = []
+        for start in range(0, len(keys), chunk_size):
+            chunk = keys[start:start + chunk_size]
+            params, clauses = [], []
+            for key in chunk:
+                terms = []
+                for column, value in zip(key_columns, key):
+                    params.append(value)
+                    terms.append(f"{column} = :{len(params)}")
+                clauses.append("(" + " AND ".join(terms) + ")")
+            query = f"SELECT * FROM {self._quote_table(table['name'])} WHERE " + " OR ".join(clauses)
+            for batch in self._fetch_batches(query, params, len(chunk)):
+                records.extend(batch)
+        return records
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        self.connect()
+        owner, name = table["name"].split(".", 1) if "." in table["name"] else (self.schema, table["name"])
+        owner_sql = ":1" if owner else "SYS_CONTEXT('USERENV', 'CURRENT_SCHEMA')"
+        params = [self._catalog_name(owner)] if owner else []
+        params.append(self._catalog_name(name))
+        name_bind = f":{len(params)}"
+        columns = [
+            {"name": self._column_name(row["column_name"]), "type": row["data_type"], "nullable": row["nullable"] == "Y"}
+            for batch in self._fetch_batches(
+                f'SELECT column_name AS "column_name", data_type AS "data_type", nullable AS "nullable" '
+                f"FROM all_tab_columns "
+                f"WHERE owner = {owner_sql} AND table_name = {name_bind} ORDER BY column_id",
+                params, 1000
+            )
+            for row in batch
+        ]
+        if not columns:
+            raise ConnectorError(f"Table {table['name']} does not exist or is not visible to the connecting user")
+        primary_key = [
+            self._column_name(row["column_name"])
+            for batch in self._fetch_batches(
+                f'SELECT cc.column_name AS "column_name" FROM all_constraints c '
+                f"JOIN all_cons_columns cc ON cc.owner = c.owner AND cc.constraint_name = c.constraint_name "
+                f"WHERE c.constraint_type = 'P' AND c.owner = {owner_sql} AND c.table_name = {name_bind} "
+                f"ORDER BY cc.position",
+                params, 1000
+            )
+            for row in batch
+        ]
+        return {"name": table["name"], "columns": columns, "primary_key": primary_key}
+
+    def list_tables(self) -> List[str]:
+        self.connect()
+        owner_sql = ":1" if self.schema else "SYS_CONTEXT('USERENV', 'CURRENT_SCHEMA')"
+        params = [self._catalog_name(self.schema)] if self.schema else []
+        # Unqualified names resolve against the configured schema
+        return [
+            self._column_name(row["table_name"])
+            for batch in self._fetch_batches(
+                f'SELECT table_name AS "table_name" FROM all_tables WHERE owner = {owner_sql} ORDER BY table_name',
+                params, 1000
+            )
+            for row in batch
+        ]
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.connect()
+            cursor = self.connection.cursor()
+            cursor.execute("SELECT 1 FROM DUAL")
+            cursor.fetchone()
+            cursor.close()
+            return _with_pool(self, {"connector_type": self.connector_type, "status": "healthy"})
+        except Exception as e:
+            return {"connector_type": self.connector_type, "status": "unavailable", "error": str(e)}
+
+    def _fetch_batches(self, query: str, params: List[Any], batch_size: int,
+                       operation: Optional[str] = None, columnar: bool = False) -> Iterator[List[Dict[str, Any]]]:
+        """Execute a query and yield dictionaries (column batches when columnar is set) in batches."""
+        cursor = self.connection.cursor()
+        try:
+            cursor.arraysize = batch_size
+            cursor.prefetchrows = batch_size + 1
+            cursor.execute(query, params)
+            columns = [self._column_name(col[0]) for col in cursor.description]
+            while True:
+                rows = cursor.fetchmany(batch_size)
+                if not rows:
+                    break
+                if columnar:
+                    yield ColumnBatch.from_rows(columns, rows, {OPERATION_FIELD: operation} if operation else None)
+                    continue
+                batch = []
+                for row in rows:
+                    record = dict(zip(columns, row))
+                    if operation:
+                        record[OPERATION_FIELD] = operation
+                    batch.append(record)
+                yield batch
+        finally:
+            cursor.close()
+
+    @staticmethod
+    def _output_type_handler(cursor, metadata):
+        """Fetch decimal NUMBERs as Decimal and LOBs as plain values."""
+        if metadata.type_code is oracledb.DB_TYPE_NUMBER and metadata.scale and metadata.scale > 0:
+            return cursor.var(Decimal, arraysize=cursor.arraysize)
+        if metadata.type_code is oracledb.DB_TYPE_CLOB:
+            return cursor.var(oracledb.DB_TYPE_LONG, arraysize=cursor.arraysize)
+        if metadata.type_code is oracledb.DB_TYPE_BLOB:
+            return cursor.var(oracledb.DB_TYPE_LONG_RAW, arraysize=cursor.arraysize)
+        return None
+
+    @staticmethod
+    def _change_column(table: Dict[str, Any]) -> str:
+        column = table.get("change_column")
+        if not column:
+            raise ConnectorError(f"Table {table['name']} has no change_column for incremental reads")
+        return column
+
+    def _column_name(self, name: str) -> str:
+        """Column name as it appears in records."""
+        return name.lower() if self.lowercase_columns and name.isupper() else name
+
+    @staticmethod
+    def _catalog_name(name: str) -> str:
+        """Name as stored in the data dictionary (unquoted names are upper case)."""
+        return name.upper() if ORACLE_SIMPLE_IDENTIFIER.match(name) else name
+
+    @staticmethod
+    def _quote(identifier: str) -> str:
+        """Quote an Oracle identifier unless it is a simple, case-insensitive name."""
+        if ORACLE_SIMPLE_IDENTIFIER.match(identifier):
+            return identifier
+        return '"' + identifier.replace('"', '""') + '"'
+
+    def _quote_table(self, name: str) -> str:
+        """Quote a table name, qualifying it with the configured schema."""
+        if "." not in name and self.schema:
+            name = f"{self.schema}.{name}"
+        return ".".join(self._quote(part) for part in name.split("."))
+
+
+class PostgresStagingTarget(TargetConnector):
+    """
+    Target connector that writes into the TerraFusion PostgreSQL staging schema.
+
+    Rows are upserted on the table's primary key; delete operations remove the
+    matching staging row.
+
+    Each row stores the idempotency key of the source change that wrote it
+    (in the idempotency_column, "sync_idempotency_key" by default; null
+    disables it). An upsert carrying the key a row already has is skipped and
+    counted as unchanged. Before the first write to a table the connector makes
+    sure the column exists and that a unique index covers the primary key,
+    removing duplicate rows left by earlier loads if necessary, so that re-runs
+    update rows instead of adding copies.
+
+    Rows also store the lineage metadata of the write (see sync_lineage) as
+    jsonb in the lineage_column, "sync_lineage" by default (null disables it).
+
+    Large batches are copied in with COPY instead, falling back to upserts
+    for tables that already hold their rows (see sync_bulk).
+    """
+
+    connector_type = "postgres_staging"
+    pool_family = "postgres"
+    columnar_writes = True
+
+    # Whether large batches may be copied in (see sync_bulk)
+    BULK_COPY = True
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.connection = None
+        self.pool = None
+        self.schema = config.get("schema", "staging")
+        self.idempotency_column = config.get("idempotency_column", "sync_idempotency_key")
+        self.lineage_column = config.get("lineage_column", "sync_lineage")
+        self.bulk_loader = BulkLoader(self.connector_type, _circuit_name(config, {}), config.get("bulk_load"))
+        self._prepared_tables = set()
+        self._quarantine_tables = set()
+
+    def connect(self) -> None:
+        if self.connection is None:
+            dsn = _env_setting(self.config, "dsn", os.environ.get("DATABASE_URL"))
+            if not dsn:
+                raise ConnectorError("Staging database DSN is not configured")
+            self.connection = _postgres_connect(self, dsn, autocommit=False)
+
+    def close(self) -> None:
+        if self.connection is not None:
+            _pooled_release(self, self.connection)
+            self.connection = None
+
+    def write_batch(self, table: Dict[str, Any], records: List[Dict[str, Any]]) -> Dict[str, int]:
+        return self.write_columns(table, ColumnBatch.from_records(records))
+
+    def write_columns(self, table: Dict[str, Any], batch: ColumnBatch) -> Dict[str, int]:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        self._prepare_table(table_name, list(table["primary_key"]))
+        upserts = sum(1 for operation in batch.column(OPERATION_FIELD) if operation != "delete")
+        if self.BULK_COPY and self.bulk_loader.use_bulk(table, table_name, upserts):
+            try:
+                return self._write(table, table_name, batch, bulk=True)
+            except psycopg2.Error as e:
+                if getattr(e, "pgcode", None) != POSTGRES_UNIQUE_VIOLATION:
+                    raise
+                self.bulk_loader.conflicted(table_name, e)
+        return self._write(table, table_name, batch, bulk=False)
+
+    def _write(self, table: Dict[str, Any], table_name: str, batch: ColumnBatch, bulk: bool) -> Dict[str, int]:
+        """Write a batch in one transaction, copying its upserts in when bulk is set."""
+        target_table = self._quote_table(table_name)
+        key_columns = list(table["primary_key"])
+        unique = batch.dedupe(key_columns)
+        operations = unique.column(OPERATION_FIELD)
+        upserts = unique.take(i for i, operation in enumerate(operations) if operation != "delete")
+        deletes = unique.take(i for i, operation in enumerate(operations) if operation == "delete")
+        written = 0
+
+        try:
+            with self.connection.cursor() as cur:
+                if upserts:
+                    columns = [c for c in upserts.columns if c not in RESERVED_FIELDS]
+                    if self.idempotency_column and self.idempotency_column not in columns:
+                        columns.append(self.idempotency_column)
+                    if self.lineage_column and self.lineage_column not in columns and \
+                            LINEAGE_FIELD in upserts.columns:
+                        # Writes without lineage (e.g. conflict resolutions) keep the row's last lineage
+                        columns.append(self.lineage_column)
+                    column_sql = ", ".join(self._quote(c) for c in columns)
+                    values = list(zip(*(self._column_values(table_name, upserts, c) for c in columns)))
+                if upserts and bulk:
+                    cur.copy_expert(f"COPY {target_table} ({column_sql}) FROM STDIN", io.StringIO(copy_rows(values)))
+                    written = len(values)
+                elif upserts:
+                    key_sql = ", ".join(self._quote(c) for c in key_columns)
+                    update_columns = [c for c in columns if c not in key_columns]
+                    if update_columns:
+                        update_sql = ", ".join(f"{self._quote(c)} = EXCLUDED.{self._quote(c)}" for c in update_columns)
+                        conflict_sql = f"ON CONFLICT ({key_sql}) DO UPDATE SET {update_sql}"
+                        if self.idempotency_column:
+                            # Rows already written by the same source change are left alone;
+                            # writes without a key (e.g. conflict resolutions) always apply
+                            column = self._quote(self.idempotency_column)
+                            conflict_sql += f" WHERE EXCLUDED.{column} IS NULL OR t.{column} IS DISTINCT FROM EXCLUDED.{column}"
+                    else:
+                        conflict_sql = f"ON CONFLICT ({key_sql}) DO NOTHING"
+                    template = "(" + ", ".join(self._value_sql(table_name, c) for c in columns) + ")"
+                    returned = execute_values(
+                        cur,
+                        f"INSERT INTO {target_table} AS t ({column_sql}) VALUES %s {conflict_sql} RETURNING 1",
+                        values,
+                        template=template,
+                        fetch=True
+                    )
+                    written = len(returned)
+
+                if deletes:
+                    where_sql = " AND ".join(f"{self._quote(c)} = %s" for c in key_columns)
+                    for key in deletes.rows(key_columns):
+                        cur.execute(f"DELETE FROM {target_table} WHERE {where_sql}", list(key))
+
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+
+        counts = {
+            "upserted": written,
+            "deleted": len(deletes),
+            "unchanged": len(upserts) - written,
+            "duplicates": len(batch) - len(unique),
+        }
+        if bulk:
+            self.bulk_loader.loaded("copy", written)
+            counts["bulk_loaded"] = written
+        return counts
+
+    def _column_values(self, table_name: str, batch: ColumnBatch, column: str) -> List[Any]:
+        """Values written to a column, taking the connector's own columns from reserved fields."""
+        if column == self.idempotency_column:
+            return batch.column(IDEMPOTENCY_FIELD)
+        if column == self.lineage_column:
+            return [json.dumps(lineage, default=str) if lineage is not None else None
+                    for lineage in batch.column(LINEAGE_FIELD)]
+        return batch.column(column)
+
+    def _value_sql(self, table_name: str, column: str) -> str:
+        """SQL placeholder for a column's value in an upsert."""
+        return "%s"
+
+    def _prepare_table(self, table_name: str, key_columns: List[str]) -> None:
+        """Add the idempotency and lineage columns and a unique primary key index to a staging table once per connection."""
+        if table_name in self._prepared_tables:
+            return
+        target_table = self._quote_table(table_name)
+        try:
+            with self.connection.cursor() as cur:
+                self._add_sync_columns(cur, target_table)
+                if not self._has_unique_key(cur, target_table, key_columns):
+                    match_sql = " AND ".join(f"a.{self._quote(c)} = b.{self._quote(c)}" for c in key_columns)
+                    # Keep the most recently written copy of each duplicated key
+                    cur.execute(f"DELETE FROM {target_table} a USING {target_table} b WHERE a.ctid < b.ctid AND {match_sql}")
+                    if cur.rowcount:
+                        logger.warning(f"Removed {cur.rowcount} duplicate rows from {table_name}")
+                    index_name = re.sub(r"\W", "_", f"{table_name.split('.')[-1]}_sync_key")[:MAX_POSTGRES_IDENTIFIER]
+                    key_sql = ", ".join(self._quote(c) for c in key_columns)
+                    cur.execute(f"CREATE UNIQUE INDEX IF NOT EXISTS {self._quote(index_name)} ON {target_table} ({key_sql})")
+                    logger.info(f"Created unique index {index_name} on {table_name} ({', '.join(key_columns)})")
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        self._prepared_tables.add(table_name)
+
+    def _add_sync_columns(self, cur, target_table: str) -> None:
+        """Add the configured idempotency and lineage columns to a table."""
+        if self.idempotency_column:
+            cur.execute(
+                f"ALTER TABLE {target_table} ADD COLUMN IF NOT EXISTS {self._quote(self.idempotency_column)} text"
+            )
+        if self.lineage_column:
+            cur.execute(
+                f"ALTER TABLE {target_table} ADD COLUMN IF NOT EXISTS {self._quote(self.lineage_column)} jsonb"
+            )
+
+    @staticmethod
+    def _has_unique_key(cur, target_table: str, key_columns: List[str]) -> bool:
+        """Whether a unique index covers exactly the primary key columns."""
+        cur.execute(
+            """
+            SELECT 1 FROM pg_index i
+            WHERE i.indrelid = %s::regclass AND i.indisunique AND i.indpred IS NULL
+              AND (SELECT array_agg(a.attname::text ORDER BY a.attname::text)
+                   FROM pg_attribute a
+                   WHERE a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)) = %s
+              AND i.indnatts = %s
+            """,
+            (target_table, sorted(key_columns), len(key_columns))
+        )
+        return cur.fetchone() is not None
+
+    def is_record_error(self, exc: Exception) -> bool:
+        return isinstance(exc, (psycopg2.DataError, psycopg2.IntegrityError))
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        if not keys:
+            return []
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        key_sql = ", ".join(self._quote(c) for c in table["primary_key"])
+        with self.connection.cursor() as cur:
+            cur.execute(
+                f"{self._select_sql(table_name)} WHERE ({key_sql}) IN %s",
+                (tuple(tuple(k) for k in keys),)
+            )
+            return [self._data_columns(row, table_name) for row in cur.fetchall()]
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        """
+        Read staging rows edited in TerraFusion since the last sync.
+
+        Changes are detected with the table's target_change_column (a timestamp
+        maintained by the staging schema). Hard deletes are not detectable this
+        way; staging tables in bidirectional pairs should soft-delete instead.
+        """
+        self.connect()
+        column = self._change_column(table)
+        table_name = table.get("target_table") or table["name"]
+        query = f"{self._select_sql(table_name)} WHERE {self._quote(column)} <= %s"
+        params = [until_version]
+        if since_version is not None:
+            query += f" AND {self._quote(column)} > %s"
+            params.append(since_version)
+        query += f" ORDER BY {self._quote(column)}"
+
+        with self.connection.cursor(name=f"tf_changes_{os.getpid()}") as cur:
+            cur.itersize = batch_size
+            cur.execute(query, params)
+            while True:
+                rows = cur.fetchmany(batch_size)
+                if not rows:
+                    break
+                batch = []
+                for row in rows:
+                    record = self._data_columns(row, table_name)
+                    record[OPERATION_FIELD] = "update"
+                    record[VERSION_FIELD] = record.get(column)
+                    batch.append(record)
+                yield batch
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        self.connect()
+        column = self._change_column(table)
+        target_table = self._quote_table(table.get("target_table") or table["name"])
+        with self.connection.cursor() as cur:
+            cur.execute(f"SELECT MAX({self._quote(column)}) AS version FROM {target_table}")
+            row = cur.fetchone()
+        version = row["version"] if row else None
+        return version.isoformat() if hasattr(version, "isoformat") else version
+
+    def table_stats(self, table: Dict[str, Any], columns: Optional[List[str]] = None) -> Dict[str, Any]:
+        self.connect()
+        target_table = self._quote_table(table.get("target_table") or table["name"])
+        columns = list(columns or [])
+        select_sql = ", ".join(
+            ["COUNT(*) AS row_count"] +
+            [f"COUNT(*) FILTER (WHERE {self._quote(c)} IS NULL) AS null_{i}" for i, c in enumerate(columns)]
+        )
+        with self.connection.cursor() as cur:
+            cur.execute(f"SELECT {select_sql} FROM {target_table}")
+            row = cur.fetchone()
+        return {
+            "row_count": row["row_count"],
+            "null_counts": {c: row[f"null_{i}"] for i, c in enumerate(columns)},
+        }
+
+    def create_snapshot(self, table: Dict[str, Any], snapshot_table: str) -> int:
+        self.connect()
+        target_table = self._quote_table(table.get("target_table") or table["name"])
+        try:
+            with self.connection.cursor() as cur:
+                cur.execute(f"CREATE TABLE {self._quote_table(snapshot_table)} AS TABLE {target_table}")
+                rows = cur.rowcount
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        return rows
+
+    def restore_snapshot(self, snapshot_tables: List[Tuple[Dict[str, Any], str]]) -> Dict[str, int]:
+        self.connect()
+        restored = {}
+        try:
+            with self.connection.cursor() as cur:
+                # Clear dependents first so foreign keys hold, then reload in dependency order
+                for table, _ in reversed(snapshot_tables):
+                    cur.execute(f"DELETE FROM {self._quote_table(table.get('target_table') or table['name'])}")
+                for table, snapshot_table in snapshot_tables:
+                    cur.execute(
+                        f"INSERT INTO {self._quote_table(table.get('target_table') or table['name'])} "
+                        f"SELECT * FROM {self._quote_table(snapshot_table)}"
+                    )
+                    restored[table["name"]] = cur.rowcount
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        return restored
+
+    def drop_snapshot(self, table: Dict[str, Any], snapshot_table: str) -> None:
+        self.connect()
+        try:
+            with self.connection.cursor() as cur:
+                cur.execute(f"DROP TABLE IF EXISTS {self._quote_table(snapshot_table)}")
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+
+    def fetch_lineage(self, table: Dict[str, Any], keys: Optional[List[List[Any]]] = None,
+                      job_id: Optional[str] = None, limit: int = 100) -> List[Dict[str, Any]]:
+        if not self.lineage_column:
+            raise ConnectorError("Lineage is disabled on this target (lineage_column is null)")
+        self.connect()
+        target_table = self._quote_table(table.get("target_table") or table["name"])
+        key_columns = list(table["primary_key"])
+        key_sql = ", ".join(self._quote(c) for c in key_columns)
+        lineage_sql = self._quote(self.lineage_column)
+        conditions, params = [], []
+        if keys:
+            conditions.append(f"({key_sql}) IN %s")
+            params.append(tuple(tuple(k) for k in keys))
+        if job_id:
+            conditions.append(f"{lineage_sql}->>'job_id' = %s")
+            params.append(job_id)
+        query = f"SELECT {key_sql}, {lineage_sql} AS lineage FROM {target_table}"
+        if conditions:
+            query += " WHERE " + " AND ".join(conditions)
+        query += f" ORDER BY {key_sql} LIMIT %s"
+        params.append(limit)
+        with self.connection.cursor() as cur:
+            cur.execute(query, params)
+            return [
+                {"key": {c: row[c] for c in key_columns}, "lineage": row["lineage"]}
+                for row in cur.fetchall()
+            ]
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        schema, name = table_name.split(".", 1) if "." in table_name else (self.schema, table_name)
+        with self.connection.cursor() as cur:
+            cur.execute(
+                "SELECT column_name AS name, CASE WHEN data_type = 'USER-DEFINED' THEN udt_name ELSE data_type END AS type, "
+                "is_nullable = 'YES' AS nullable "
+                "FROM information_schema.columns WHERE table_schema = %s AND table_name = %s ORDER BY ordinal_position",
+                (schema, name)
+            )
+            columns = [dict(row) for row in cur.fetchall()
+                       if row["name"] not in (self.idempotency_column, self.lineage_column)]
+        if not columns:
+            raise ConnectorError(f"Table {schema}.{name} does not exist")
+        return {"name": table_name, "columns": columns, "primary_key": list(table["primary_key"])}
+
+    def query_records(self, table: Dict[str, Any], where: Optional[Tuple] = None, columns: Optional[List[str]] = None,
+                      order_by: Optional[List[Tuple[str, bool]]] = None, limit: Optional[int] = None,
+                      offset: int = 0) -> List[Dict[str, Any]]:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        query = self._select_sql(table_name)
+        params = []
+        if where:
+            condition, params = compile_where(where, self._quote)
+            query += f" WHERE {condition}"
+        if order_by:
+            query += " ORDER BY " + ", ".join(f"{self._quote(c)}{' DESC' if descending else ''}"
+                                              for c, descending in order_by)
+        if limit is not None:
+            query += " LIMIT %s"
+            params.append(int(limit))
+        if offset:
+            query += " OFFSET %s"
+            params.append(int(offset))
+        with self.connection.cursor() as cur:
+            cur.execute(query, params)
+            records = [self._data_columns(row, table_name) for row in cur.fetchall()]
+        if columns:
+            records = [{c: record.get(c) for c in columns} for record in records]
+        return records
+
+    def count_records(self, table: Dict[str, Any], where: Optional[Tuple] = None) -> int:
+        self.connect()
+        query = f"SELECT COUNT(*) AS row_count FROM {self._quote_table(table.get('target_table') or table['name'])}"
+        params = []
+        if where:
+            condition, params = compile_where(where, self._quote)
+            query += f" WHERE {condition}"
+        with self.connection.cursor() as cur:
+            cur.execute(query, params)
+            return cur.fetchone()["row_count"]
+
+    def quarantine_records(self, quarantine_table: str, entries: List[Dict[str, Any]]) -> int:
+        if not entries:
+            return 0
+        self.connect()
+        table = self._prepare_quarantine(quarantine_table)
+        values = [
+            (e["sync_pair_id"], e["source_table"], e["record_key"], e.get("target_table"), e.get("job_id"),
+             json.dumps(e["reasons"], default=str), json.dumps(e["record"], default=str),
+             json.dumps(e.get("loaded"), default=str))
+            for e in entries
+        ]
+        try:
+            with self.connection.cursor() as cur:
+                execute_values(
+                    cur,
+                    f"""
+                    INSERT INTO {table} AS q
+                        (sync_pair_id, source_table, record_key, target_table, job_id, reasons, record, loaded)
+                    VALUES %s
+                    ON CONFLICT (sync_pair_id, source_table, record_key) DO UPDATE SET
+                        target_table = EXCLUDED.target_table, job_id = EXCLUDED.job_id,
+                        reasons = EXCLUDED.reasons, record = EXCLUDED.record, loaded = EXCLUDED.loaded,
+                        quarantined_at = now(), failure_count = q.failure_count + 1
+                    """,
+                    values,
+                    template="(%s, %s, %s, %s, %s, %s::jsonb, %s::jsonb, %s::jsonb)"
+                )
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        return len(values)
+
+    def list_quarantined(self, quarantine_table: str, sync_pair_id: str, source_table: Optional[str] = None,
+                         limit: int = 100) -> List[Dict[str, Any]]:
+        self.connect()
+        table = self._prepare_quarantine(quarantine_table)
+        query = f"SELECT * FROM {table} WHERE sync_pair_id = %s"
+        params: List[Any] = [sync_pair_id]
+        if source_table:
+            query += " AND source_table = %s"
+            params.append(source_table)
+        query += " ORDER BY quarantined_at DESC LIMIT %s"
+        params.append(limit)
+        with self.connection.cursor() as cur:
+            cur.execute(query, params)
+            rows = [dict(row) for row in cur.fetchall()]
+        for row in rows:
+            for column in ("quarantined_at", "first_quarantined_at"):
+                if hasattr(row.get(column), "isoformat"):
+                    row[column] = row[column].isoformat()
+        return rows
+
+    def quarantined_keys(self, quarantine_table: str, sync_pair_id: str, source_table: str) -> set:
+        self.connect()
+        table = self._prepare_quarantine(quarantine_table)
+        with self.connection.cursor() as cur:
+            cur.execute(f"SELECT record_key FROM {table} WHERE sync_pair_id = %s AND source_table = %s",
+                        (sync_pair_id, source_table))
+            return {row["record_key"] for row in cur.fetchall()}
+
+    def release_quarantined(self, quarantine_table: str, sync_pair_id: str, source_table: str,
+                            record_keys: List[str]) -> int:
+        if not record_keys:
+            return 0
+        self.connect()
+        table = self._prepare_quarantine(quarantine_table)
+        try:
+            with self.connection.cursor() as cur:
+                cur.execute(
+                    f"DELETE FROM {table} WHERE sync_pair_id = %s AND source_table = %s AND record_key = ANY(%s)",
+                    (sync_pair_id, source_table, list(record_keys))
+                )
+                released = cur.rowcount
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        return released
+
+    def _prepare_quarantine(self, quarantine_table: str) -> str:
+        """Create the quarantine table once per connection and return its quoted name."""
+        table = self._quote_table(quarantine_table)
+        if quarantine_table in self._quarantine_tables:
+            return table
+        try:
+            with self.connection.cursor() as cur:
+                cur.execute(f"""
+                    CREATE TABLE IF NOT EXISTS {table} (
+                        sync_pair_id text NOT NULL,
+                        source_table text NOT NULL,
+                        record_key text NOT NULL,
+                        target_table text,
+                        job_id text,
+                        reasons jsonb NOT NULL,
+                        record jsonb NOT NULL,
+                        loaded jsonb,
+                        failure_count integer NOT NULL DEFAULT 1,
+                        first_quarantined_at timestamptz NOT NULL DEFAULT now(),
+                        quarantined_at timestamptz NOT NULL DEFAULT now(),
+                        PRIMARY KEY (sync_pair_id, source_table, record_key)
+                    )
+                """)
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        self._quarantine_tables.add(quarantine_table)
+        return table
+
+    @staticmethod
+    def _change_column(table: Dict[str, Any]) -> str:
+        column = table.get("target_change_column")
+        if not column:
+            raise ConnectorError(f"Table {table['name']} has no target_change_column for change reads")
+        return column
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.connect()
+            with self.connection.cursor() as cur:
+                cur.execute("SELECT 1")
+            return _with_pool(self, {"connector_type": self.connector_type, "status": "healthy"})
+        except Exception as e:
+            return {"connector_type": self.connector_type, "status": "unavailable", "error": str(e)}
+
+    @staticmethod
+    def _collect_columns(records: List[Dict[str, Any]]) -> List[str]:
+        """Collect the ordered union of record columns, excluding reserved fields."""
+        columns = []
+        for record in records:
+            for column in record:
+                if column not in RESERVED_FIELDS and column not in columns:
+                    columns.append(column)
+        return columns
+
+    def _select_sql(self, table_name: str) -> str:
+        """SELECT ... FROM clause for reading rows of a table."""
+        return f"SELECT * FROM {self._quote_table(table_name)}"
+
+    def _data_columns(self, row: Dict[str, Any], table_name: Optional[str] = None) -> Dict[str, Any]:
+        """A staging row without the connector's idempotency and lineage columns."""
+        record = dict(row)
+        for column in (self.idempotency_column, self.lineage_column):
+            if column:
+                record.pop(column, None)
+        return record
+
+    @staticmethod
+    def _quote(identifier: str) -> str:
+        """Quote a PostgreSQL identifier."""
+        return '"' + identifier.replace('"', '""') + '"'
+
+    def _quote_table(self, name: str) -> str:
+        """Quote a table name, qualifying it with the staging schema."""
+        if "." not in name:
+            name = f"{self.schema}.{name}"
+        return ".".join(self._quote(part) for part in name.split("."))
+
+
+class PostgresSourceConnector(SourceConnector):
+    """
+    Source connector for PostgreSQL databases, such as a GIS department's
+    PostGIS enterprise geodatabase used as a merge source.
+
+    PostgreSQL has no built-in change tracking; incremental reads use the
+    table's "change_column" (a last-edited timestamp), so hard deletes are not
+    detected. Versions are ISO timestamps.
+    """
+
+    connector_type = "postgres"
+    pool_family = "postgres"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.connection = None
+        self.pool = None
+        self.schema = config.get("schema", "public")
+
+    def connect(self) -> None:
+        if self.connection is None:
+            dsn = _env_setting(self.config, "dsn")
+            if not dsn:
+                raise ConnectorError("PostgreSQL source DSN is not configured")
+            # Reads only; avoid holding a transaction open between batches
+            self.connection = _postgres_connect(self, dsn, autocommit=True)
+
+    def close(self) -> None:
+        if self.connection is not None:
+            _pooled_release(self, self.connection)
+            self.connection = None
+
+    def read_table(self, table: Dict[str, Any], batch_size: int,
+                   after_key: Optional[List[Any]] = None) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        key_sql = ", ".join(self._quote(c) for c in table["primary_key"])
+        query = self._select(table)
+        params: List[Any] = []
+        if after_key:
+            query += f" WHERE ({key_sql}) > %s"
+            params.append(tuple(after_key))
+        query += f" ORDER BY {key_sql}"
+        yield from self._fetch_batches(table, query, params, batch_size)
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        column = self._change_column(table)
+        query = f"{self._select(table)} WHERE {self._quote(column)} <= %s"
+        params = [until_version]
+        if since_version is not None:
+            query += f" AND {self._quote(column)} > %s"
+            params.append(since_version)
+        query += f" ORDER BY {self._quote(column)}"
+        yield from self._fetch_batches(table, query, params, batch_size, version_column=column)
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        self.connect()
+        column = self._change_column(table)
+        with self.connection.cursor() as cur:
+            cur.execute(f"SELECT MAX({self._quote(column)}) AS version FROM {self._quote_table(table['name'])}")
+            row = cur.fetchone()
+        version = row["version"] if row else None
+        return version.isoformat() if hasattr(version, "isoformat") else version
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        if not keys:
+            return []
+        self.connect()
+        key_sql = ", ".join(self._quote(c) for c in table["primary_key"])
+        with self.connection.cursor() as cur:
+            cur.execute(
+                f"{self._select(table)} WHERE ({key_sql}) IN %s",
+                (tuple(tuple(k) for k in keys),)
+            )
+            return [self._record(table, row) for row in cur.fetchall()]
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        self.connect()
+        schema, name = table["name"].split(".", 1) if "." in table["name"] else (self.schema, table["name"])
+        with self.connection.cursor() as cur:
+            cur.execute(
+                "SELECT column_name AS name, data_type AS type, is_nullable = 'YES' AS nullable "
+                "FROM information_schema.columns WHERE table_schema = %s AND table_name = %s ORDER BY ordinal_position",
+                (schema, name)
+            )
+            columns = [dict(row) for row in cur.fetchall()]
+            if not columns:
+                raise ConnectorError(f"Table {schema}.{name} does not exist")
+            cur.execute(
+                "SELECT a.attname AS name FROM pg_index i "
+                "JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey) "
+                "WHERE i.indrelid = %s::regclass AND i.indisprimary ORDER BY array_position(i.indkey::int2[], a.attnum)",
+                (self._quote_table(table["name"]),)
+            )
+            primary_key = [row["name"] for row in cur.fetchall()]
+        return {"name": table["name"], "columns": columns, "primary_key": primary_key}
+
+    def list_tables(self) -> List[str]:
+        self.connect()
+        with self.connection.cursor() as cur:
+            cur.execute(
+                "SELECT table_schema, table_name FROM information_schema.tables "
+                "WHERE table_schema = %s AND table_type = 'BASE TABLE' ORDER BY table_name",
+                (self.schema,)
+            )
+            return [f"{row['table_schema']}.{row['table_name']}" for row in cur.fetchall()]
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.connect()
+            with self.connection.cursor() as cur:
+                cur.execute("SELECT 1")
+            return _with_pool(self, {"connector_type": self.connector_type, "status": "healthy"})
+        except Exception as e:
+            return {"connector_type": self.connector_type, "status": "unavailable", "error": str(e)}
+
+    def _select(self, table: Dict[str, Any]) -> str:
+        """SELECT ... FROM clause for reading rows of a source table."""
+        return f"SELECT * FROM {self._quote_table(table['name'])}"
+
+    def _record(self, table: Dict[str, Any], row: Dict[str, Any]) -> Dict[str, Any]:
+        """A source record from a fetched row."""
+        return dict(row)
+
+    def _fetch_batches(self, table: Dict[str, Any], query: str, params: List[Any], batch_size: int,
+                       version_column: Optional[str] = None) -> Iterator[List[Dict[str, Any]]]:
+        """Execute a query on a server-side cursor and yield records in batches."""
+        with self.connection.cursor(name=f"tf_source_{os.getpid()}_{id(self)}", withhold=True) as cur:
+            cur.itersize = batch_size
+            cur.execute(query, params)
+            while True:
+                rows = cur.fetchmany(batch_size)
+                if not rows:
+                    break
+                batch = []
+                for row in rows:
+                    record = self._record(table, row)
+                    record[OPERATION_FIELD] = "update"
+                    if version_column:
+                        version = record.get(version_column)
+                        record[VERSION_FIELD] = version.isoformat() if hasattr(version, "isoformat") else version
+                    batch.append(record)
+                yield batch
+
+    @staticmethod
+    def _change_column(table: Dict[str, Any]) -> str:
+        column = table.get("change_column")
+        if not column:
+            raise ConnectorError(f"Table {table['name']} has no change_column for incremental reads")
+        return column
+
+    @staticmethod
+    def _quote(identifier: str) -> str:
+        """Quote a PostgreSQL identifier."""
+        return '"' + identifier.replace('"', '""') + '"'
+
+    def _quote_table(self, name: str) -> str:
+        """Quote a table name, qualifying it with the configured schema."""
+        if "." not in name:
+            name = f"{self.schema}.{name}"
+        return ".".join(self._quote(part) for part in name.split("."))
+
+
+# Staging database file of the SQLite target when none is configured
+DEFAULT_SQLITE_STAGING_PATH = os.path.join(os.environ.get("SYNC_STATE_PATH", "sync_state"), "staging.db")
+
+# Keys per SQLite lookup statement (each key column is one host parameter)
+SQLITE_MAX_PARAMETERS = 900
+
+
+def _sqlite_value(value: Any) -> Any:
+    """A record value as SQLite stores it."""
+    if value is None or isinstance(value, (str, int, float, bytes)):
+        return value
+    if isinstance(value, Decimal):
+        return float(value)
+    if isinstance(value, (bytearray, memoryview)):
+        return bytes(value)
+    if hasattr(value, "isoformat"):
+        return value.isoformat()
+    return json.dumps(value, default=str)
+
+
+class SqliteStagingTarget(TargetConnector):
+    """
+    Target connector that writes into an embedded SQLite staging database, so
+    small offices can evaluate the service without running PostgreSQL.
+
+    Rows are upserted on the primary key, with the same idempotency and
+    lineage columns as the PostgreSQL staging target. The connector manages
+    the schema itself: a table is created on its first write, gains columns
+    as records bring new ones, and gets a unique index on the primary key.
+    Values keep SQLite's dynamic types; dates are stored as ISO text and
+    decimals as floating point.
+
+    Because the column and key conventions match, a county that outgrows
+    SQLite points its sync pair at postgres_staging and runs one full sync;
+    job state moves with "python sync_store.py migrate".
+    """
+
+    connector_type = "sqlite_staging"
+    columnar_writes = True
+
+    # Seconds a writer waits for another worker's write to finish
+    BUSY_TIMEOUT = 30
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.connection = None
+        self.path = _env_setting(config, "path", DEFAULT_SQLITE_STAGING_PATH)
+        self.idempotency_column = config.get("idempotency_column", "sync_idempotency_key")
+        self.lineage_column = config.get("lineage_column", "sync_lineage")
+        self._columns: Dict[str, List[str]] = {}
+        self._prepared_tables = set()
+        self._quarantine_tables = set()
+
+    def connect(self) -> None:
+        if self.connection is None:
+            os.makedirs(os.path.dirname(os.path.abspath(self.path)), exist_ok=True)
+            self.connection = tracer.traced_connection(
+                sqlite3.connect(self.path, timeout=self.BUSY_TIMEOUT, check_same_thread=False)
+            )
+            self.connection.row_factory = sqlite3.Row
+            self.connection.execute("PRAGMA journal_mode=WAL")
+
+    def close(self) -> None:
+        if self.connection is not None:
+            self.connection.close()
+            self.connection = None
+            self._columns = {}
+            self._prepared_tables = set()
+            self._quarantine_tables = set()
+
+    def write_batch(self, table: Dict[str, Any], records: List[Dict[str, Any]]) -> Dict[str, int]:
+        return self.write_columns(table, ColumnBatch.from_records(records))
+
+    def write_columns(self, table: Dict[str, Any], batch: ColumnBatch) -> Dict[str, int]:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        target_table = self._quote(table_name)
+        key_columns = list(table["primary_key"])
+
+        unique = batch.dedupe(key_columns)
+        operations = unique.column(OPERATION_FIELD)
+        upserts = unique.take(i for i, operation in enumerate(operations) if operation != "delete")
+        deletes = unique.take(i for i, operation in enumerate(operations) if operation == "delete")
+        columns = [c for c in upserts.columns if c not in RESERVED_FIELDS] if upserts else []
+        for column in key_columns:
+            if column not in columns:
+                columns.insert(0, column)
+        if self.idempotency_column and self.idempotency_column not in columns:
+            columns.append(self.idempotency_column)
+        if self.lineage_column and self.lineage_column not in columns and upserts and LINEAGE_FIELD in upserts.columns:
+            # Writes without lineage (e.g. conflict resolutions) keep the row's last lineage
+            columns.append(self.lineage_column)
+        written = 0
+
+        try:
+            self._prepare_table(table_name, key_columns, columns)
+            cur = self.connection.cursor()
+            if upserts:
+                column_sql = ", ".join(self._quote(c) for c in columns)
+                key_sql = ", ".join(self._quote(c) for c in key_columns)
+                update_columns = [c for c in columns if c not in key_columns]
+                if update_columns:
+                    update_sql = ", ".join(f"{self._quote(c)} = excluded.{self._quote(c)}" for c in update_columns)
+                    conflict_sql = f"ON CONFLICT ({key_sql}) DO UPDATE SET {update_sql}"
+                    if self.idempotency_column:
+                        # Rows already written by the same source change are left alone
+                        column = self._quote(self.idempotency_column)
+                        conflict_sql += (f" WHERE excluded.{column} IS NULL"
+                                         f" OR {target_table}.{column} IS NOT excluded.{column}")
+                else:
+                    conflict_sql = f"ON CONFLICT ({key_sql}) DO NOTHING"
+                placeholders = ", ".join("?" for _ in columns)
+                cur.executemany(
+                    f"INSERT INTO {target_table} ({column_sql}) VALUES ({placeholders}) {conflict_sql}",
+                    list(zip(*([_sqlite_value(v) for v in self._column_values(upserts, c)] for c in columns)))
+                )
+                written = cur.rowcount
+
+            if deletes:
+                where_sql = " AND ".join(f"{self._quote(c)} = ?" for c in key_columns)
+                cur.executemany(
+                    f"DELETE FROM {target_table} WHERE {where_sql}",
+                    [[_sqlite_value(v) for v in key] for key in deletes.rows(key_columns)]
+                )
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+
+        return {
+            "upserted": written,
+            "deleted": len(deletes),
+            "unchanged": len(upserts) - written,
+            "duplicates": len(batch) - len(unique),
+        }
+
+    def is_record_error(self, exc: Exception) -> bool:
+        return isinstance(exc, (sqlite3.IntegrityError, sqlite3.DataError, sqlite3.InterfaceError))
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        if not keys:
+            return []
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        if not self._table_columns(table_name):
+            return []
+        key_columns = list(table["primary_key"])
+        key_sql = ", ".join(self._quote(c) for c in key_columns)
+        row_sql = "(" + ", ".join("?" for _ in key_columns) + ")"
+        chunk_size = max(1, SQLITE_MAX_PARAMETERS // len(key_columns))
+        records = []
+        for start in range(0, len(keys), chunk_size):
+            chunk = keys[start:start + chunk_size]
+            rows = self.connection.execute(
+                f"SELECT * FROM {self._quote(table_name)} WHERE ({key_sql}) IN (VALUES {', '.join(row_sql for _ in chunk)})",
+                [_sqlite_value(v) for key in chunk for v in key]
+            ).fetchall()
+            records.extend(self._data_columns(row) for row in rows)
+        return records
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        """Read staging rows edited since the last sync, by their target_change_column (ISO text)."""
+        self.connect()
+        column = PostgresStagingTarget._change_column(table)
+        table_name = table.get("target_table") or table["name"]
+        query = f"SELECT * FROM {self._quote(table_name)} WHERE {self._quote(column)} <= ?"
+        params = [_sqlite_value(until_version)]
+        if since_version is not None:
+            query += f" AND {self._quote(column)} > ?"
+            params.append(_sqlite_value(since_version))
+        query += f" ORDER BY {self._quote(column)}"
+        cur = self.connection.execute(query, params)
+        while True:
+            rows = cur.fetchmany(batch_size)
+            if not rows:
+                break
+            batch = []
+            for row in rows:
+                record = self._data_columns(row)
+                record[OPERATION_FIELD] = "update"
+                record[VERSION_FIELD] = record.get(column)
+                batch.append(record)
+            yield batch
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        self.connect()
+        column = PostgresStagingTarget._change_column(table)
+        row = self.connection.execute(
+            f"SELECT MAX({self._quote(column)}) FROM {self._quote(table.get('target_table') or table['name'])}"
+        ).fetchone()
+        return row[0] if row else None
+
+    def table_stats(self, table: Dict[str, Any], columns: Optional[List[str]] = None) -> Dict[str, Any]:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        columns = list(columns or [])
+        if not self._table_columns(table_name):
+            return {"row_count": 0, "null_counts": {c: 0 for c in columns}}
+        select_sql = ", ".join(
+            ["COUNT(*)"] + [f"COALESCE(SUM({self._quote(c)} IS NULL), 0)" for c in columns]
+        )
+        row = self.connection.execute(f"SELECT {select_sql} FROM {self._quote(table_name)}").fetchone()
+        return {"row_count": row[0], "null_counts": {c: row[i + 1] for i, c in enumerate(columns)}}
+
+    def create_snapshot(self, table: Dict[str, Any], snapshot_table: str) -> int:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        try:
+            if not self._table_columns(table_name):
+                # Nothing has been loaded yet; snapshot the empty table
+                self._prepare_table(table_name, list(table["primary_key"]), list(table["primary_key"]))
+            self.connection.execute(
+                f"CREATE TABLE {self._quote(snapshot_table)} AS SELECT * FROM {self._quote(table_name)}"
+            )
+            rows = self.connection.execute(f"SELECT COUNT(*) FROM {self._quote(snapshot_table)}").fetchone()[0]
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        return rows
+
+    def restore_snapshot(self, snapshot_tables: List[Tuple[Dict[str, Any], str]]) -> Dict[str, int]:
+        self.connect()
+        restored = {}
+        try:
+            for table, _ in reversed(snapshot_tables):
+                self.connection.execute(f"DELETE FROM {self._quote(table.get('target_table') or table['name'])}")
+            for table, snapshot_table in snapshot_tables:
+                # Columns added since the snapshot was taken are left null
+                columns = ", ".join(self._quote(c) for c in self._table_columns(snapshot_table, refresh=True))
+                cur = self.connection.execute(
+                    f"INSERT INTO {self._quote(table.get('target_table') or table['name'])} ({columns}) "
+                    f"SELECT {columns} FROM {self._quote(snapshot_table)}"
+                )
+                restored[table["name"]] = cur.rowcount
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        return restored
+
+    def drop_snapshot(self, table: Dict[str, Any], snapshot_table: str) -> None:
+        self.connect()
+        self.connection.execute(f"DROP TABLE IF EXISTS {self._quote(snapshot_table)}")
+        self.connection.commit()
+        self._columns.pop(snapshot_table, None)
+
+    def fetch_lineage(self, table: Dict[str, Any], keys: Optional[List[List[Any]]] = None,
+                      job_id: Optional[str] = None, limit: int = 100) -> List[Dict[str, Any]]:
+        if not self.lineage_column:
+            raise ConnectorError("Lineage is disabled on this target (lineage_column is null)")
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        if self.lineage_column not in self._table_columns(table_name):
+            return []
+        key_columns = list(table["primary_key"])
+        key_sql = ", ".join(self._quote(c) for c in key_columns)
+        lineage_sql = self._quote(self.lineage_column)
+        conditions, params = [], []
+        if keys:
+            row_sql = "(" + ", ".join("?" for _ in key_columns) + ")"
+            conditions.append(f"({key_sql}) IN (VALUES {', '.join(row_sql for _ in keys)})")
+            params.extend(_sqlite_value(v) for key in keys for v in key)
+        if job_id:
+            conditions.append(f"json_extract({lineage_sql}, '$.job_id') = ?")
+            params.append(job_id)
+        query = f"SELECT {key_sql}, {lineage_sql} AS lineage FROM {self._quote(table_name)}"
+        if conditions:
+            query += " WHERE " + " AND ".join(conditions)
+        query += f" ORDER BY {key_sql} LIMIT ?"
+        params.append(limit)
+        return [
+            {"key": {c: row[c] for c in key_columns}, "lineage": json.loads(row["lineage"]) if row["lineage"] else None}
+            for row in self.connection.execute(query, params).fetchall()
+        ]
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        """
+        Describe a staging table. The connector creates columns without a
+        declared type, so a column's type is the storage class of its values.
+        """
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        target_table = self._quote(table_name)
+        columns = []
+        for row in self.connection.execute(f"PRAGMA table_info({target_table})").fetchall():
+            if row["name"] in (self.idempotency_column, self.lineage_column):
+                continue
+            column_type = row["type"].lower()
+            if not column_type:
+                sample = self.connection.execute(
+                    f"SELECT typeof({self._quote(row['name'])}) FROM {target_table} "
+                    f"WHERE {self._quote(row['name'])} IS NOT NULL LIMIT 1"
+                ).fetchone()
+                column_type = sample[0] if sample else "text"
+            columns.append({"name": row["name"], "type": column_type, "nullable": not row["notnull"]})
+        if not columns:
+            raise ConnectorError(f"Table {table_name} does not exist")
+        return {"name": table_name, "columns": columns, "primary_key": list(table["primary_key"])}
+
+    def query_records(self, table: Dict[str, Any], where: Optional[Tuple] = None, columns: Optional[List[str]] = None,
+                      order_by: Optional[List[Tuple[str, bool]]] = None, limit: Optional[int] = None,
+                      offset: int = 0) -> List[Dict[str, Any]]:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        if not self._table_columns(table_name):
+            return []
+        select_sql = ", ".join(self._quote(c) for c in columns) if columns else "*"
+        query = f"SELECT {select_sql} FROM {self._quote(table_name)}"
+        params = []
+        if where:
+            condition, params = compile_where(where, self._quote, "?", _sqlite_value)
+            query += f" WHERE {condition}"
+        if order_by:
+            query += " ORDER BY " + ", ".join(f"{self._quote(c)}{' DESC' if descending else ''}"
+                                              for c, descending in order_by)
+        if limit is not None or offset:
+            # SQLite needs a LIMIT before OFFSET; -1 is no limit
+            query += " LIMIT ? OFFSET ?"
+            params.extend([int(limit) if limit is not None else -1, int(offset)])
+        return [self._data_columns(row) for row in self.connection.execute(query, params).fetchall()]
+
+    def count_records(self, table: Dict[str, Any], where: Optional[Tuple] = None) -> int:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        if not self._table_columns(table_name):
+            return 0
+        query = f"SELECT COUNT(*) FROM {self._quote(table_name)}"
+        params = []
+        if where:
+            condition, params = compile_where(where, self._quote, "?", _sqlite_value)
+            query += f" WHERE {condition}"
+        return self.connection.execute(query, params).fetchone()[0]
+
+    def quarantine_records(self, quarantine_table: str, entries: List[Dict[str, Any]]) -> int:
+        if not entries:
+            return 0
+        self.connect()
+        table = self._prepare_quarantine(quarantine_table)
+        values = [
+            (e["sync_pair_id"], e["source_table"], e["record_key"], e.get("target_table"), e.get("job_id"),
+             json.dumps(e["reasons"], default=str), json.dumps(e["record"], default=str),
+             json.dumps(e.get("loaded"), default=str))
+            for e in entries
+        ]
+        try:
+            self.connection.executemany(
+                f"""
+                INSERT INTO {table}
+                    (sync_pair_id, source_table, record_key, target_table, job_id, reasons, record, loaded)
+                VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+                ON CONFLICT (sync_pair_id, source_table, record_key) DO UPDATE SET
+                    target_table = excluded.target_table, job_id = excluded.job_id,
+                    reasons = excluded.reasons, record = excluded.record, loaded = excluded.loaded,
+                    quarantined_at = strftime('%Y-%m-%dT%H:%M:%f', 'now'),
+                    failure_count = {table}.failure_count + 1
+                """,
+                values
+            )
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        return len(values)
+
+    def list_quarantined(self, quarantine_table: str, sync_pair_id: str, source_table: Optional[str] = None,
+                         limit: int = 100) -> List[Dict[str, Any]]:
+        self.connect()
+        table = self._prepare_quarantine(quarantine_table)
+        query = f"SELECT * FROM {table} WHERE sync_pair_id = ?"
+        params: List[Any] = [sync_pair_id]
+        if source_table:
+            query += " AND source_table = ?"
+            params.append(source_table)
+        query += " ORDER BY quarantined_at DESC LIMIT ?"
+        params.append(limit)
+        rows = [dict(row) for row in self.connection.execute(query, params).fetchall()]
+        for row in rows:
+            for column in ("reasons", "record", "loaded"):
+                row[column] = json.loads(row[column]) if row.get(column) else None
+        return rows
+
+    def quarantined_keys(self, quarantine_table: str, sync_pair_id: str, source_table: str) -> set:
+        self.connect()
+        table = self._prepare_quarantine(quarantine_table)
+        rows = self.connection.execute(
+            f"SELECT record_key FROM {table} WHERE sync_pair_id = ? AND source_table = ?", (sync_pair_id, source_table)
+        ).fetchall()
+        return {row[0] for row in rows}
+
+    def release_quarantined(self, quarantine_table: str, sync_pair_id: str, source_table: str,
+                            record_keys: List[str]) -> int:
+        if not record_keys:
+            return 0
+        self.connect()
+        table = self._prepare_quarantine(quarantine_table)
+        try:
+            cur = self.connection.executemany(
+                f"DELETE FROM {table} WHERE sync_pair_id = ? AND source_table = ? AND record_key = ?",
+                [(sync_pair_id, source_table, key) for key in record_keys]
+            )
+            released = cur.rowcount
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        return released
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.connect()
+            self.connection.execute("SELECT 1")
+            return {"connector_type": self.connector_type, "status": "healthy", "path": self.path,
+                    "sqlite_version": sqlite3.sqlite_version}
+        except Exception as e:
+            return {"connector_type": self.connector_type, "status": "unavailable", "error": str(e)}
+
+    def _column_values(self, batch: ColumnBatch, column: str) -> List[Any]:
+        if column == self.idempotency_column:
+            return batch.column(IDEMPOTENCY_FIELD)
+        if column == self.lineage_column:
+            return [json.dumps(lineage, default=str) if lineage is not None else None
+                    for lineage in batch.column(LINEAGE_FIELD)]
+        return batch.column(column)
+
+    def _prepare_table(self, table_name: str, key_columns: List[str], columns: List[str]) -> None:
+        """Create the table, add columns it lacks and make sure a unique index covers the primary key."""
+        target_table = self._quote(table_name)
+        existing = self._table_columns(table_name)
+        if not existing:
+            self.connection.execute(
+                f"CREATE TABLE IF NOT EXISTS {target_table} ({', '.join(self._quote(c) for c in columns)})"
+            )
+            logger.info(f"Created SQLite staging table {table_name}")
+        else:
+            for column in columns:
+                if column not in existing:
+                    self.connection.execute(f"ALTER TABLE {target_table} ADD COLUMN {self._quote(column)}")
+        if not existing or any(c not in existing for c in columns):
+            self._table_columns(table_name, refresh=True)
+        if table_name not in self._prepared_tables:
+            if not self._has_unique_key(table_name, key_columns):
+                match_sql = " AND ".join(f"a.{self._quote(c)} IS {target_table}.{self._quote(c)}" for c in key_columns)
+                # Keep the most recently written copy of each duplicated key
+                cur = self.connection.execute(
+                    f"DELETE FROM {target_table} WHERE EXISTS "
+                    f"(SELECT 1 FROM {target_table} a WHERE a.rowid > {target_table}.rowid AND {match_sql})"
+                )
+                if cur.rowcount:
+                    logger.warning(f"Removed {cur.rowcount} duplicate rows from {table_name}")
+                index_name = re.sub(r"\W", "_", f"{table_name}_sync_key")
+                self.connection.execute(
+                    f"CREATE UNIQUE INDEX IF NOT EXISTS {self._quote(index_name)} ON {target_table} "
+                    f"({', '.join(self._quote(c) for c in key_columns)})"
+                )
+            self._prepared_tables.add(table_name)
+
+    def _has_unique_key(self, table_name: str, key_columns: List[str]) -> bool:
+        """Whether a unique index covers exactly the primary key columns."""
+        for index in self.connection.execute(f"PRAGMA index_list({self._quote(table_name)})").fetchall():
+            if not index["unique"] or index["partial"]:
+                continue
+            indexed = [row["name"] for row in self.connection.execute(f"PRAGMA index_info({self._quote(index['name'])})")]
+            if sorted(indexed) == sorted(key_columns):
+                return True
+        return False
+
+    def _table_columns(self, table_name: str, refresh: bool = False) -> List[str]:
+        """Columns of a table (empty when it does not exist), cached per connection."""
+        if refresh or table_name not in self._columns:
+            rows = self.connection.execute(f"PRAGMA table_info({self._quote(table_name)})").fetchall()
+            self._columns[table_name] = [row["name"] for row in rows]
+        return self._columns[table_name]
+
+    def _prepare_quarantine(self, quarantine_table: str) -> str:
+        """Create the quarantine table once per connection and return its quoted name."""
+        table = self._quote(quarantine_table)
+        if quarantine_table not in self._quarantine_tables:
+            self.connection.execute(f"""
+                CREATE TABLE IF NOT EXISTS {table} (
+                    sync_pair_id TEXT NOT NULL,
+                    source_table TEXT NOT NULL,
+                    record_key TEXT NOT NULL,
+                    target_table TEXT,
+                    job_id TEXT,
+                    reasons TEXT NOT NULL,
+                    record TEXT NOT NULL,
+                    loaded TEXT,
+                    failure_count INTEGER NOT NULL DEFAULT 1,
+                    first_quarantined_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%f', 'now')),
+                    quarantined_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%f', 'now')),
+                    PRIMARY KEY (sync_pair_id, source_table, record_key)
+                )
+            """)
+            self.connection.commit()
+            self._quarantine_tables.add(quarantine_table)
+        return table
+
+    def _data_columns(self, row: sqlite3.Row) -> Dict[str, Any]:
+        """A staging row without the connector's idempotency and lineage columns."""
+        record = dict(row)
+        for column in (self.idempotency_column, self.lineage_column):
+            if column:
+                record.pop(column, None)
+        return record
+
+    @staticmethod
+    def _quote(identifier: str) -> str:
+        """Quote a SQLite identifier; a schema-qualified name becomes one table name."""
+        return '"' + identifier.replace('"', '""') + '"'
+
+
+# EWKB geometry type flag marking an embedded SRID
+EWKB_SRID_FLAG = 0x20000000
+
+
+def ewkb_bytes(value: Any) -> bytes:
+    """
+    Geometry value as EWKB bytes.
+
+    Raises:
+        ValueError: If the value is not EWKB bytes or a hex string
+    """
+    if isinstance(value, (bytes, bytearray, memoryview)):
+        return bytes(value)
+    if isinstance(value, str):
+        try:
+            return bytes.fromhex(value)
+        except ValueError:
+            pass
+    raise ValueError(f"Geometry values must be EWKB bytes or hex, not {type(value).__name__}")
+
+
+def ewkb_srid(value: Any) -> Optional[int]:
+    """The SRID embedded in an EWKB geometry, or None for plain WKB."""
+    data = ewkb_bytes(value)
+    if len(data) < 5:
+        raise ValueError("Geometry value is too short to be EWKB")
+    order = "<" if data[0] == 1 else ">"
+    geometry_type = struct.unpack(order + "I", data[1:5])[0]
+    if not geometry_type & EWKB_SRID_FLAG:
+        return None
+    return struct.unpack(order + "I", data[5:9])[0]
+
+
+def ewkb_with_srid(value: Any, srid: int) -> bytes:
+    """EWKB bytes of a geometry, embedding an SRID when it has none."""
+    data = ewkb_bytes(value)
+    if ewkb_srid(data) is not None:
+        return data
+    order = "<" if data[0] == 1 else ">"
+    geometry_type = struct.unpack(order + "I", data[1:5])[0] | EWKB_SRID_FLAG
+    return data[:1] + struct.pack(order + "I", geometry_type) + struct.pack(order + "I", srid) + data[5:]
+
+
+def _quote_postgres(identifier: str) -> str:
+    """Quote a PostgreSQL identifier."""
+    return '"' + identifier.replace('"', '""') + '"'
+
+
+def _dsn_label(dsn: str) -> str:
+    """The host and database of a DSN (URL or key=value), without its credentials."""
+    if "://" in dsn:
+        parts = urlsplit(dsn)
+        return f"{parts.hostname or 'localhost'}{parts.path or ''}"
+    settings = dict(re.findall(r"(\w+)\s*=\s*'?([^\s']*)", dsn))
+    return f"{settings.get('host', 'localhost')}/{settings.get('dbname', '')}"
+
+
+class PostGISTables:
+    """
+    Column and geometry metadata of PostGIS tables, read from the catalog
+    once per connector.
+
+    Geometry and geography columns are read as hex EWKB strings, which keep
+    the SRID with the shape and survive the JSON job and dead-letter records.
+    """
+
+    def __init__(self, default_schema: str):
+        self.default_schema = default_schema
+        self._tables: Dict[str, Dict[str, Any]] = {}
+
+    def describe(self, connection, table_name: str) -> Dict[str, Any]:
+        """
+        Columns and geometry columns ({column: {"srid", "kind"}}) of a table.
+
+        Raises:
+            ConnectorError: If the table does not exist
+        """
+        if table_name in self._tables:
+            return self._tables[table_name]
+        schema, name = table_name.split(".", 1) if "." in table_name else (self.default_schema, table_name)
+        with connection.cursor() as cur:
+            cur.execute(
+                "SELECT column_name FROM information_schema.columns "
+                "WHERE table_schema = %s AND table_name = %s ORDER BY ordinal_position",
+                (schema, name)
+            )
+            columns = [row["column_name"] for row in cur.fetchall()]
+            if not columns:
+                raise ConnectorError(f"PostGIS table {schema}.{name} does not exist")
+            cur.execute(
+                "SELECT f_geometry_column AS column_name, srid, 'geometry' AS kind FROM geometry_columns "
+                "WHERE f_table_schema = %s AND f_table_name = %s "
+                "UNION ALL "
+                "SELECT f_geography_column, srid, 'geography' FROM geography_columns "
+                "WHERE f_table_schema = %s AND f_table_name = %s",
+                (schema, name, schema, name)
+            )
+            geometry = {row["column_name"]: {"srid": row["srid"] or None, "kind": row["kind"]} for row in cur.fetchall()}
+        self._tables[table_name] = {"columns": columns, "geometry": geometry}
+        return self._tables[table_name]
+
+    def select_list(self, connection, table_name: str, srid: Optional[int] = None) -> str:
+        """Select list reading geometries as EWKB, transformed to an SRID when given."""
+        described = self.describe(connection, table_name)
+        items = []
+        for column in described["columns"]:
+            quoted = _quote_postgres(column)
+            geometry = described["geometry"].get(column)
+            if geometry is None:
+                items.append(quoted)
+                continue
+            expression = f"{quoted}::geometry" if geometry["kind"] == "geography" else quoted
+            if srid and geometry["srid"] != srid:
+                expression = f"ST_Transform({expression}, {int(srid)})"
+            items.append(f"ST_AsEWKB({expression}) AS {quoted}")
+        return ", ".join(items)
+
+    def decode(self, connection, table_name: str, row: Dict[str, Any]) -> Dict[str, Any]:
+        """A fetched row with its EWKB geometries as hex strings."""
+        record = dict(row)
+        for column in self.describe(connection, table_name)["geometry"]:
+            if record.get(column) is not None:
+                record[column] = ewkb_bytes(record[column]).hex().upper()
+        return record
+
+    def value_sql(self, connection, table_name: str, column: str) -> str:
+        """Placeholder for a column's value, converting EWKB to the column's type and SRID."""
+        geometry = self.describe(connection, table_name)["geometry"].get(column)
+        if geometry is None:
+            return "%s"
+        expression = "ST_GeomFromEWKB(%s)"
+        if geometry["srid"]:
+            expression = f"ST_Transform({expression}, {int(geometry['srid'])})"
+        return f"{expression}::geography" if geometry["kind"] == "geography" else expression
+
+    def encode(self, connection, table_name: str, column: str, value: Any,
+               default_srid: Optional[int] = None) -> Any:
+        """
+        Value bound for a column; geometries without an SRID are given
+        default_srid, or the column's SRID.
+        """
+        geometry = self.describe(connection, table_name)["geometry"].get(column)
+        if geometry is None or value is None:
+            return value
+        srid = default_srid or geometry["srid"] or (4326 if geometry["kind"] == "geography" else None)
+        data = ewkb_with_srid(value, srid) if srid else ewkb_bytes(value)
+        return psycopg2.Binary(data)
+
+
+def _postgis_health(connector) -> Dict[str, Any]:
+    """Health check shared by the PostGIS connectors, reporting the PostGIS version."""
+    try:
+        connector.connect()
+        with connector.connection.cursor() as cur:
+            cur.execute("SELECT PostGIS_Lib_Version() AS version")
+            version = cur.fetchone()["version"]
+        return _with_pool(connector, {"connector_type": connector.connector_type, "status": "healthy",
+                                      "postgis_version": version})
+    except Exception as e:
+        return {"connector_type": connector.connector_type, "status": "unavailable", "error": str(e)}
+
+
+class PostGISSourceConnector(PostgresSourceConnector):
+    """
+    Source connector for PostGIS databases, such as the GIS department's
+    authoritative parcel geometry.
+
+    Incremental reads work as in the PostgreSQL source (a change_column).
+    Geometry and geography columns are read as hex EWKB, which loads as-is
+    into PostGIS columns of the staging store; set "srid" to transform them
+    on read (for example to 2927, Washington State Plane South).
+
+    Connections come from a pool shared by every PostGIS connector with the
+    same DSN (see sync_pools), so workers and jobs reuse them rather than
+    reconnecting.
+    """
+
+    connector_type = "postgis"
+    pool_family = "postgis"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.srid = int(config["srid"]) if config.get("srid") else None
+        self.tables = PostGISTables(self.schema)
+
+    def connect(self) -> None:
+        if self.connection is None:
+            dsn = _env_setting(self.config, "dsn")
+            if not dsn:
+                raise ConnectorError("PostGIS DSN is not configured")
+            # Reads only; avoid holding a transaction open between batches
+            self.connection = _postgres_connect(self, dsn, autocommit=True)
+
+    def health_check(self) -> Dict[str, Any]:
+        return _postgis_health(self)
+
+    def _select(self, table: Dict[str, Any]) -> str:
+        select_list = self.tables.select_list(self.connection, table["name"], self.srid)
+        return f"SELECT {select_list} FROM {self._quote_table(table['name'])}"
+
+    def _record(self, table: Dict[str, Any], row: Dict[str, Any]) -> Dict[str, Any]:
+        return self.tables.decode(self.connection, table["name"], row)
+
+
+class PostGISTarget(PostgresStagingTarget):
+    """
+    Target connector that upserts into PostGIS tables, such as publishing
+    reviewed parcel geometry back to the GIS department's database.
+
+    Geometry values are EWKB (bytes or hex). Values without an SRID are taken
+    to be in "default_srid", or the column's SRID when that is not set, and
+    are transformed to the column's SRID on write.
+
+    Unlike the staging target, the connector does not alter the tables it
+    writes to: they need a unique index on the primary key already, and
+    idempotency and lineage columns are only added when idempotency_column
+    or lineage_column is configured. Connections are pooled as for the
+    PostGIS source.
+    """
+
+    connector_type = "postgis_target"
+    pool_family = "postgis"
+
+    # Geometries are converted on write (see PostGISTables.value_sql), which COPY cannot do
+    BULK_COPY = False
+
+    def __init__(self, config: Dict[str, Any]):
+        config = dict(config)
+        config.setdefault("schema", "public")
+        config.setdefault("idempotency_column", None)
+        config.setdefault("lineage_column", None)
+        super().__init__(config)
+        self.default_srid = int(config["default_srid"]) if config.get("default_srid") else None
+        self.tables = PostGISTables(self.schema)
+
+    def connect(self) -> None:
+        if self.connection is None:
+            dsn = _env_setting(self.config, "dsn")
+            if not dsn:
+                raise ConnectorError("PostGIS DSN is not configured")
+            self.connection = _postgres_connect(self, dsn, autocommit=False)
+
+    def health_check(self) -> Dict[str, Any]:
+        return _postgis_health(self)
+
+    def _prepare_table(self, table_name: str, key_columns: List[str]) -> None:
+        """Add configured sync columns and check the primary key index once per connection."""
+        if table_name in self._prepared_tables:
+            return
+        target_table = self._quote_table(table_name)
+        try:
+            with self.connection.cursor() as cur:
+                self._add_sync_columns(cur, target_table)
+                if not self._has_unique_key(cur, target_table, key_columns):
+                    raise ConnectorError(
+                        f"PostGIS table {table_name} needs a unique index on ({', '.join(key_columns)}) for upserts"
+                    )
+            self.connection.commit()
+        except Exception:
+            self.connection.rollback()
+            raise
+        self._prepared_tables.add(table_name)
+
+    def _column_values(self, table_name: str, batch: ColumnBatch, column: str) -> List[Any]:
+        return [self.tables.encode(self.connection, table_name, column, value, self.default_srid)
+                for value in super()._column_values(table_name, batch, column)]
+
+    def _value_sql(self, table_name: str, column: str) -> str:
+        return self.tables.value_sql(self.connection, table_name, column)
+
+    def _select_sql(self, table_name: str) -> str:
+        return f"SELECT {self.tables.select_list(self.connection, table_name)} FROM {self._quote_table(table_name)}"
+
+    def _data_columns(self, row: Dict[str, Any], table_name: Optional[str] = None) -> Dict[str, Any]:
+        record = super()._data_columns(row, table_name)
+        return self.tables.decode(self.connection, table_name, record) if table_name else record
+
+
+# EWKB geometry type flags for Z and M coordinates
+EWKB_Z_FLAG = 0x80000000
+EWKB_M_FLAG = 0x40000000
+
+# Token endpoint used when no token_url is configured (ArcGIS Online); an
+# ArcGIS Enterprise portal serves https://<host>/portal/sharing/rest/generateToken
+ARCGIS_ONLINE_TOKEN_URL = "https://www.arcgis.com/sharing/rest/generateToken"
+
+# ArcGIS REST error codes for a missing, invalid or expired token
+ARCGIS_TOKEN_ERRORS = (498, 499)
+
+# Lifetime of a generated ArcGIS token, in minutes
+DEFAULT_ARCGIS_TOKEN_MINUTES = 60
+
+# Seconds to wait for an ArcGIS REST response
+DEFAULT_ARCGIS_TIMEOUT = 60
+
+# Keys per ArcGIS key lookup query, keeping where clauses a manageable size
+ARCGIS_MAX_WHERE_KEYS = 250
+
+# Geometry value formats of ArcGIS records
+ARCGIS_GEOMETRY_FORMATS = ["ewkb", "esri"]
+
+
+def _parse_wkb(data: bytes, offset: int = 0) -> Tuple[Optional[int], int, Any, bool, int]:
+    """
+    Parse one (E)WKB geometry.
+
+    Returns:
+        (srid, base geometry type, coordinates nested as in GeoJSON, has_z, end offset)
+    """
+    order = "<" if data[offset] == 1 else ">"
+    geometry_type = struct.unpack_from(order + "I", data, offset + 1)[0]
+    offset += 5
+    srid = None
+    if geometry_type & EWKB_SRID_FLAG:
+        srid = struct.unpack_from(order + "I", data, offset)[0]
+        offset += 4
+    base = geometry_type & 0x0FFFFFFF
+    has_z = bool(geometry_type & EWKB_Z_FLAG) or base // 1000 in (1, 3)
+    has_m = bool(geometry_type & EWKB_M_FLAG) or base // 1000 in (2, 3)
+    base %= 1000
+    dimensions = 2 + has_z + has_m
+
+    def points(position: int, count: int) -> Tuple[List[List[float]], int]:
+        values = struct.unpack_from(order + "d" * (count * dimensions), data, position)
+        width = 3 if has_z else 2
+        return ([list(values[i:i + width]) for i in range(0, len(values), dimensions)],
+                position + 8 * dimensions * count)
+
+    def count(position: int) -> Tuple[int, int]:
+        return struct.unpack_from(order + "I", data, position)[0], position + 4
+
+    if base == 1:
+        coordinates, offset = points(offset, 1)
+        coordinates = coordinates[0]
+    elif base == 2:
+        n, offset = count(offset)
+        coordinates, offset = points(offset, n)
+    elif base == 3:
+        n, offset = count(offset)
+        coordinates = []
+        for _ in range(n):
+            size, offset = count(offset)
+            ring, offset = points(offset, size)
+            coordinates.append(ring)
+    elif base in (4, 5, 6):
+        n, offset = count(offset)
+        coordinates = []
+        for _ in range(n):
+            _, _, part, part_z, offset = _parse_wkb(data, offset)
+            has_z = has_z or part_z
+            coordinates.append(part)
+    else:
+        raise ValueError(f"Unsupported WKB geometry type: {base}")
+    return srid, base, coordinates, has_z, offset
+
+
+def _ring_area(ring: List[List[float]]) -> float:
+    """Signed area of a ring: positive when counterclockwise, negative when clockwise."""
+    return sum(a[0] * b[1] - b[0] * a[1] for a, b in zip(ring, ring[1:])) / 2
+
+
+def _oriented(ring: List[List[float]], clockwise: bool) -> List[List[float]]:
+    return ring[::-1] if (_ring_area(ring) < 0) != clockwise else ring
+
+
+def ewkb_to_esri(value: Any) -> Optional[Dict[str, Any]]:
+    """
+    Convert an (E)WKB geometry to Esri JSON, or None for an empty point.
+
+    Polygon rings are reoriented as ArcGIS expects: exterior rings clockwise,
+    holes counterclockwise.
+    """
+    srid, base, coordinates, has_z, _ = _parse_wkb(ewkb_bytes(value))
+    if base == 1:
+        if any(c != c for c in coordinates):
+            return None
+        geometry = {"x": coordinates[0], "y": coordinates[1]}
+        if has_z:
+            geometry["z"] = coordinates[2]
+    elif base == 4:
+        geometry = {"points": [point for point in coordinates]}
+    elif base in (2, 5):
+        geometry = {"paths": [coordinates] if base == 2 else coordinates}
+    else:
+        polygons = [coordinates] if base == 3 else coordinates
+        geometry = {"rings": [
+            _oriented(ring, clockwise=(i == 0)) for polygon in polygons for i, ring in enumerate(polygon)
+        ]}
+    if has_z:
+        geometry["hasZ"] = True
+    if srid:
+        geometry["spatialReference"] = {"wkid": srid}
+    return geometry
+
+
+def esri_to_ewkb(geometry: Optional[Dict[str, Any]], srid: Optional[int] = None) -> Optional[bytes]:
+    """
+    Convert Esri JSON geometry to little-endian EWKB, or None for a null or empty geometry.
+
+    Polygon rings are grouped into polygons by orientation: each clockwise
+    ring starts a polygon and the counterclockwise rings after it are its holes.
+
+    Raises:
+        ValueError: For curves and other geometries without a WKB equivalent
+    """
+    if not geometry:
+        return None
+    if srid is None:
+        reference = geometry.get("spatialReference") or {}
+        srid = reference.get("latestWkid") or reference.get("wkid")
+    has_z = bool(geometry.get("hasZ")) or "z" in geometry
+    dimensions = 3 if has_z else 2
+
+    def header(geometry_type: int, with_srid: bool) -> bytes:
+        flags = (EWKB_Z_FLAG if has_z else 0) | (EWKB_SRID_FLAG if with_srid and srid else 0)
+        data = struct.pack("<BI", 1, geometry_type | flags)
+        return data + struct.pack("<I", srid) if with_srid and srid else data
+
+    def pack(points: List[List[float]]) -> bytes:
+        values = [float(v) for point in points for v in (list(point[:dimensions]) + [0.0] * dimensions)[:dimensions]]
+        return struct.pack("<I", len(points)) + struct.pack("<" + "d" * len(values), *values)
+
+    def polygon(rings: List[List[List[float]]], with_srid: bool) -> bytes:
+        return header(3, with_srid) + struct.pack("<I", len(rings)) + b"".join(pack(ring) for ring in rings)
+
+    if "x" in geometry:
+        if geometry["x"] is None or geometry["x"] != geometry["x"]:
+            return None
+        return header(1, True) + pack([[geometry["x"], geometry["y"], geometry.get("z", 0.0)]])[4:]
+    if "points" in geometry:
+        return header(4, True) + struct.pack("<I", len(geometry["points"])) + b"".join(
+            header(1, False) + pack([point])[4:] for point in geometry["points"]
+        )
+    if "paths" in geometry:
+        paths = geometry["paths"]
+        if len(paths) == 1:
+            return header(2, True) + pack(paths[0])
+        return header(5, True) + struct.pack("<I", len(paths)) + b"".join(header(2, False) + pack(p) for p in paths)
+    if "rings" in geometry:
+        polygons: List[List[List[List[float]]]] = []
+        for ring in geometry["rings"]:
+            if _ring_area(ring) <= 0 or not polygons:
+                polygons.append([ring])
+            else:
+                polygons[-1].append(ring)
+        if len(polygons) == 1:
+            return polygon(polygons[0], True)
+        return header(6, True) + struct.pack("<I", len(polygons)) + b"".join(polygon(p, False) for p in polygons)
+    raise ValueError(f"Unsupported Esri geometry with keys: {', '.join(sorted(geometry))}")
+
+
+def _arcgis_literal(value: Any) -> str:
+    """A value as an ArcGIS (standardized SQL) where clause literal."""
+    if value is None:
+        return "NULL"
+    if isinstance(value, bool):
+        return "1" if value else "0"
+    if isinstance(value, (int, float, Decimal)):
+        return str(value)
+    if isinstance(value, datetime):
+        return f"timestamp '{value:%Y-%m-%d %H:%M:%S}'"
+    return "'" + str(value).replace("'", "''") + "'"
+
+
+def _arcgis_timestamp(epoch_ms: Any, round_up: bool = False) -> str:
+    """An epoch-milliseconds change version as a where clause timestamp (whole seconds)."""
+    seconds = int(epoch_ms) // 1000 + (1 if round_up and int(epoch_ms) % 1000 else 0)
+    return _arcgis_literal(datetime.utcfromtimestamp(seconds))
+
+
+def _arcgis_key_text(value: Any) -> str:
+    """Compare key values as text, so a double 12.0 matches an integer 12."""
+    if isinstance(value, (float, Decimal)) and value == int(value):
+        value = int(value)
+    return str(value)
+
+
+class ArcGISEditError(ConnectorError):
+    """Raised when a feature service rejects edits in an applyEdits request."""
+
+    def __init__(self, failures: List[Dict[str, Any]]):
+        self.failures = failures
+        descriptions = sorted({(f.get("error") or {}).get("description") or "unknown error" for f in failures})
+        super().__init__(f"ArcGIS rejected {len(failures)} edit(s): {'; '.join(descriptions)}")
+
+
+class ArcGISFeatureService:
+    """
+    REST client for one ArcGIS feature service, shared by the ArcGIS source and target.
+
+    Configuration:
+        url: The FeatureServer (or MapServer, read only) URL
+        token: A long-lived token or API key, or
+        username / password: Credentials for generateToken at token_url
+            (ArcGIS Online by default; set the portal URL for Enterprise)
+        srid: Spatial reference to read geometry in (the layer's by default)
+        geometry_field: Record field holding the geometry ("geometry")
+        geometry_format: "ewkb" (hex, as the PostGIS connectors use) or "esri" (Esri JSON)
+
+    Tables are named by layer ID or layer name. All requests are POSTs, so
+    long where clauses and edit payloads are not limited by URL length.
+    """
+
+    def __init__(self, config: Dict[str, Any]):
+        self.config = config
+        self.url = (_env_setting(config, "url") or "").rstrip("/")
+        self.timeout = float(config.get("timeout_seconds", DEFAULT_ARCGIS_TIMEOUT))
+        self.out_srid = int(config["srid"]) if config.get("srid") else None
+        self.geometry_field = config.get("geometry_field", "geometry")
+        self.geometry_format = config.get("geometry_format", "ewkb")
+        if self.geometry_format not in ARCGIS_GEOMETRY_FORMATS:
+            raise ValueError(
+                f"Unsupported ArcGIS geometry_format: {self.geometry_format}. "
+                f"Supported formats: {', '.join(ARCGIS_GEOMETRY_FORMATS)}"
+            )
+        self.session = None
+        self._token: Optional[str] = None
+        self._token_expires = 0.0
+        self._layers: Dict[str, Dict[str, Any]] = {}
+
+    def connect(self) -> None:
+        if not self.url:
+            raise ConnectorError("ArcGIS feature service url is not configured")
+        if self.session is None:
+            self.session = tracer.traced_session(requests.Session())
+            self.session.verify = self.config.get("verify_ssl", True)
+            if _env_setting(self.config, "username"):
+                # Generated tokens are bound to the referer they were requested for
+                self.session.headers["Referer"] = self._referer()
+
+    def close(self) -> None:
+        if self.session is not None:
+            self.session.close()
+            self.session = None
+
+    def request(self, path: str, params: Dict[str, Any], authenticate: bool = True) -> Dict[str, Any]:
+        """
+        POST to a URL of the service and return the decoded response.
+
+        Args:
+            path: Absolute URL, or path relative to the service URL
+            params: Form parameters (f=json is added)
+            authenticate: Whether to send the token
+
+        Raises:
+            ConnectorError: If the request fails or the service returns an error
+        """
+        url = path if path.startswith(("http://", "https://")) else "/".join(p for p in (self.url, path) if p)
+        for attempt in range(2):
+            data = dict(params, f="json")
+            token = self._access_token(refresh=attempt > 0) if authenticate else None
+            if token:
+                data["token"] = token
+            try:
+                response = self.session.post(url, data=data, timeout=self.timeout)
+                response.raise_for_status()
+                body = response.json()
+            except (requests.RequestException, ValueError) as e:
+                raise ConnectorError(f"ArcGIS request to {url} failed: {e}")
+            error = body.get("error") if isinstance(body, dict) else None
+            if not error:
+                return body
+            if error.get("code") in ARCGIS_TOKEN_ERRORS and attempt == 0 and self._generates_tokens():
+                # The generated token expired early or was revoked; get a new one
+                continue
+            details = "; ".join(d for d in error.get("details") or [] if d)
+            raise ConnectorError(
+                f"ArcGIS request to {url} failed: {error.get('message') or error.get('code')}"
+                + (f" ({details})" if details else "")
+            )
+
+    def layer(self, name: str) -> Dict[str, Any]:
+        """
+        Metadata of a layer or table, by ID or name, with its "url".
+
+        Raises:
+            ConnectorError: If the service has no such layer
+        """
+        if name not in self._layers:
+            layer_id = str(name)
+            if not layer_id.isdigit():
+                service = self.request("", {})
+                matches = [l for l in (service.get("layers") or []) + (service.get("tables") or [])
+                           if l.get("name") == name]
+                if not matches:
+                    raise ConnectorError(f"ArcGIS service {self.url} has no layer or table named {name}")
+                layer_id = str(matches[0]["id"])
+            info = self.request(layer_id, {})
+            info["url"] = f"{self.url}/{layer_id}"
+            self._layers[name] = info
+        return self._layers[name]
+
+    def query(self, layer: Dict[str, Any], params: Dict[str, Any]) -> Dict[str, Any]:
+        return self.request(f"{layer['url']}/query", params)
+
+    def features(self, layer: Dict[str, Any], where: str, order_by: List[str],
+                 batch_size: int) -> Iterator[Tuple[List[Dict[str, Any]], Dict[str, Any]]]:
+        """
+        Yield pages of features matching a where clause with their spatial reference.
+
+        Pages hold at most batch_size features, or the layer's maxRecordCount
+        when that is smaller.
+        """
+        if not (layer.get("advancedQueryCapabilities") or {}).get("supportsPagination", True):
+            raise ConnectorError(f"ArcGIS layer {layer.get('name')} does not support paged queries")
+        page_size = min(batch_size, int(layer.get("maxRecordCount") or batch_size))
+        offset = 0
+        while True:
+            params = {
+                "where": where,
+                "outFields": "*",
+                "orderByFields": ", ".join(order_by),
+                "resultOffset": offset,
+                "resultRecordCount": page_size,
+                "returnGeometry": "true" if layer.get("geometryType") else "false",
+            }
+            if self.out_srid:
+                params["outSR"] = self.out_srid
+            if layer.get("hasZ"):
+                params["returnZ"] = "true"
+            body = self.query(layer, params)
+            features = body.get("features") or []
+            if features:
+                yield features, body.get("spatialReference") or {}
+            offset += len(features)
+            if not features or (len(features) < page_size and not body.get("exceededTransferLimit")):
+                return
+
+    def record(self, layer: Dict[str, Any], feature: Dict[str, Any], spatial_reference: Dict[str, Any]) -> Dict[str, Any]:
+        """A feature as a record: attributes, with dates as datetimes, and the geometry."""
+        record = dict(feature.get("attributes") or {})
+        for field in layer.get("fields") or []:
+            if field.get("type") == "esriFieldTypeDate" and isinstance(record.get(field["name"]), (int, float)):
+                record[field["name"]] = datetime.utcfromtimestamp(record[field["name"]] / 1000)
+        if layer.get("geometryType"):
+            geometry = feature.get("geometry")
+            if self.geometry_format == "esri":
+                record[self.geometry_field] = dict(geometry, spatialReference=spatial_reference) if geometry else None
+            else:
+                srid = spatial_reference.get("latestWkid") or spatial_reference.get("wkid")
+                ewkb = esri_to_ewkb(geometry, srid)
+                record[self.geometry_field] = ewkb.hex().upper() if ewkb else None
+        return record
+
+    def field_name(self, layer: Dict[str, Any], column: str) -> Optional[str]:
+        """The layer field matching a column name, ignoring case."""
+        for field in layer.get("fields") or []:
+            if field["name"].lower() == column.lower():
+                return field["name"]
+        return None
+
+    def key_where(self, layer: Dict[str, Any], key_columns: List[str], keys: List[List[Any]]) -> str:
+        fields = [self.field_name(layer, c) or c for c in key_columns]
+        if len(fields) == 1:
+            return f"{fields[0]} IN ({', '.join(_arcgis_literal(key[0]) for key in keys)})"
+        return " OR ".join(
+            "(" + " AND ".join(f"{f} = {_arcgis_literal(v)}" for f, v in zip(fields, key)) + ")" for key in keys
+        )
+
+    def lookup(self, layer: Dict[str, Any], key_columns: List[str], keys: List[List[Any]],
+               out_fields: str = "*") -> List[Dict[str, Any]]:
+        """Features whose key columns match the given values, as records."""
+        features = []
+        for start in range(0, len(keys), ARCGIS_MAX_WHERE_KEYS):
+            body = self.query(layer, {
+                "where": self.key_where(layer, key_columns, keys[start:start + ARCGIS_MAX_WHERE_KEYS]),
+                "outFields": out_fields,
+                "returnGeometry": "true" if out_fields == "*" and layer.get("geometryType") else "false",
+                **({"outSR": self.out_srid} if self.out_srid else {}),
+            })
+            reference = body.get("spatialReference") or {}
+            features.extend(self.record(layer, f, reference) if out_fields == "*" else f.get("attributes") or {}
+                            for f in body.get("features") or [])
+        return features
+
+    def write(self, layer: Dict[str, Any], key_columns: List[str], records: List[Dict[str, Any]]) -> Dict[str, int]:
+        """
+        Upsert and delete records with one applyEdits request.
+
+        Existing features are found by their key columns; records without a
+        match are added. Record columns the layer does not have are left out.
+
+        Raises:
+            ArcGISEditError: If the service rejects an edit (the request is rolled back)
+        """
+        records = dedupe_batch(records, key_columns)
+        object_id_field = layer.get("objectIdField") or "OBJECTID"
+        key_fields = [self.field_name(layer, c) or c for c in key_columns]
+        existing = {
+            tuple(_arcgis_key_text(row.get(f)) for f in key_fields): row.get(object_id_field)
+            for row in self.lookup(layer, key_columns, [[r.get(c) for c in key_columns] for r in records],
+                                   out_fields=",".join([object_id_field] + key_fields))
+        }
+
+        adds, updates, deletes = [], [], []
+        for record in records:
+            object_id = existing.get(tuple(_arcgis_key_text(record.get(c)) for c in key_columns))
+            if record.get(OPERATION_FIELD) == "delete":
+                if object_id is not None:
+                    deletes.append(object_id)
+                continue
+            feature = {"attributes": self._attributes(layer, record)}
+            if layer.get("geometryType") and self.geometry_field in record:
+                feature["geometry"] = self._geometry(record[self.geometry_field])
+            feature["attributes"].pop(object_id_field, None)
+            if object_id is None:
+                adds.append(feature)
+            else:
+                feature["attributes"][object_id_field] = object_id
+                updates.append(feature)
+
+        if adds or updates or deletes:
+            body = self.request(f"{layer['url']}/applyEdits", {
+                "adds": json.dumps(adds, default=str),
+                "updates": json.dumps(updates, default=str),
+                "deletes": ",".join(str(object_id) for object_id in deletes),
+                "rollbackOnFailure": "true",
+            })
+            failures = [result for name in ("addResults", "updateResults", "deleteResults")
+                        for result in body.get(name) or [] if not result.get("success")]
+            if failures:
+                raise ArcGISEditError(failures)
+        return {"upserted": len(adds) + len(updates), "deleted": len(deletes)}
+
+    def health(self, connector_type: str) -> Dict[str, Any]:
+        try:
+            self.connect()
+            service = self.request("", {})
+            return {
+                "connector_type": connector_type,
+                "status": "healthy",
+                "layers": len(service.get("layers") or []) + len(service.get("tables") or []),
+            }
+        except Exception as e:
+            return {"connector_type": connector_type, "status": "unavailable", "error": str(e)}
+
+    def _attributes(self, layer: Dict[str, Any], record: Dict[str, Any]) -> Dict[str, Any]:
+        attributes = {}
+        for column, value in record.items():
+            if column in RESERVED_FIELDS or column == self.geometry_field:
+                continue
+            name = self.field_name(layer, column)
+            if name is None:
+                continue
+            if isinstance(value, datetime):
+                # Naive datetimes are UTC, as everywhere in the sync engine
+                value = int(calendar.timegm(value.utctimetuple()) * 1000 + value.microsecond // 1000)
+            elif isinstance(value, Decimal):
+                value = float(value)
+            attributes[name] = value
+        return attributes
+
+    def _geometry(self, value: Any) -> Optional[Dict[str, Any]]:
+        if value is None or isinstance(value, dict):
+            return value
+        return ewkb_to_esri(value)
+
+    def _generates_tokens(self) -> bool:
+        return not _env_setting(self.config, "token") and bool(_env_setting(self.config, "username"))
+
+    def _referer(self) -> str:
+        return _env_setting(self.config, "referer", self.url)
+
+    def _access_token(self, refresh: bool = False) -> Optional[str]:
+        """The configured token, a generated one (renewed before it expires), or None for public services."""
+        token = _env_setting(self.config, "token")
+        if token or not self._generates_tokens():
+            return token
+        if refresh or self._token is None or time.time() >= self._token_expires - 60:
+            minutes = int(self.config.get("token_minutes", DEFAULT_ARCGIS_TOKEN_MINUTES))
+            body = self.request(_env_setting(self.config, "token_url", ARCGIS_ONLINE_TOKEN_URL), {
+                "username": _env_setting(self.config, "username"),
+                "password": _env_setting(self.config, "password"),
+                "client": "referer",
+                "referer": self._referer(),
+                "expiration": minutes,
+            }, authenticate=False)
+            if not body.get("token"):
+                raise ConnectorError("ArcGIS token request returned no token")
+            self._token = body["token"]
+            self._token_expires = float(body.get("expires") or (time.time() + minutes * 60) * 1000) / 1000
+        return self._token
+
+
+class ArcGISFeatureSource(SourceConnector):
+    """
+    Source connector for ArcGIS Online and Enterprise feature services.
+
+    Full reads page through a layer with resultOffset, ordered by primary
+    key. Incremental reads use "change_tracking": "change_column" with the
+    layer's editor tracking field (usually EditDate) as the change_column;
+    versions are epoch milliseconds. Deletes are not detected. The source can
+    also take writes for bidirectional sync pairs (see ArcGISFeatureTarget).
+    """
+
+    connector_type = "arcgis"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.service = ArcGISFeatureService(config)
+
+    def connect(self) -> None:
+        self.service.connect()
+
+    def close(self) -> None:
+        self.service.close()
+
+    def read_table(self, table: Dict[str, Any], batch_size: int,
+                   after_key: Optional[List[Any]] = None) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        layer = self.service.layer(table["name"])
+        key_columns = table["primary_key"]
+        where = "1=1"
+        if after_key:
+            clauses = []
+            for i, column in enumerate(key_columns):
+                terms = [f"{c} = {_arcgis_literal(v)}" for c, v in zip(key_columns[:i], after_key[:i])]
+                terms.append(f"{column} > {_arcgis_literal(after_key[i])}")
+                clauses.append("(" + " AND ".join(terms) + ")")
+            where = " OR ".join(clauses)
+        for features, reference in self.service.features(layer, where, key_columns, batch_size):
+            yield [dict(self.service.record(layer, f, reference), **{OPERATION_FIELD: "update"}) for f in features]
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        layer = self.service.layer(table["name"])
+        column = self._change_field(table, layer)
+        # Where clause timestamps have whole seconds: the window is widened to
+        # whole seconds, which only re-reads a few rows (writes are upserts)
+        where = f"{column} > {_arcgis_timestamp(since_version)}"
+        if until_version is not None:
+            where += f" AND {column} <= {_arcgis_timestamp(until_version, round_up=True)}"
+        for features, reference in self.service.features(layer, where, [column] + table["primary_key"], batch_size):
+            batch = []
+            for feature in features:
+                record = self.service.record(layer, feature, reference)
+                record[OPERATION_FIELD] = "update"
+                record[VERSION_FIELD] = (feature.get("attributes") or {}).get(column)
+                batch.append(record)
+            yield batch
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        self.connect()
+        layer = self.service.layer(table["name"])
+        column = self._change_field(table, layer)
+        body = self.service.query(layer, {
+            "where": "1=1",
+            "outStatistics": json.dumps([{
+                "statisticType": "max", "onStatisticField": column, "outStatisticFieldName": "max_version",
+            }]),
+        })
+        features = body.get("features") or []
+        # Some services return statistics under upper-cased names
+        value = next(iter((features[0].get("attributes") or {}).values()), None) if features else None
+        return int(value) if value is not None else 0
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        if not keys:
+            return []
+        self.connect()
+        return self.service.lookup(self.service.layer(table["name"]), table["primary_key"], keys)
+
+    def write_batch(self, table: Dict[str, Any], records: List[Dict[str, Any]]) -> Dict[str, int]:
+        self.connect()
+        return self.service.write(self.service.layer(table["name"]), table["primary_key"], records)
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        self.connect()
+        layer = self.service.layer(table["name"])
+        columns = [{"name": f["name"], "type": f.get("type"), "nullable": f.get("nullable", True)}
+                   for f in layer.get("fields") or []]
+        if layer.get("geometryType"):
+            columns.append({"name": self.service.geometry_field, "type": layer["geometryType"], "nullable": True})
+        object_id_field = layer.get("objectIdField") or (layer.get("uniqueIdField") or {}).get("name")
+        return {"name": table["name"], "columns": columns, "primary_key": [object_id_field] if object_id_field else []}
+
+    def health_check(self) -> Dict[str, Any]:
+        return self.service.health(self.connector_type)
+
+    def _change_field(self, table: Dict[str, Any], layer: Dict[str, Any]) -> str:
+        column = table.get("change_column")
+        if table.get("change_tracking") != "change_column" or not column:
+            raise ConnectorError(
+                f"Table {table['name']} needs change_column tracking (an editor tracking field) for incremental reads"
+            )
+        return self.service.field_name(layer, column) or column
+
+
+class ArcGISFeatureTarget(TargetConnector):
+    """
+    Target connector that publishes records to an ArcGIS feature service layer
+    with applyEdits, so parcels reach ArcGIS Online or Enterprise without a
+    file handoff.
+
+    The target_table is a layer ID or name, and the primary key columns must
+    identify features (object IDs are looked up by them before each write).
+    Geometry is taken from the geometry_field as EWKB or Esri JSON. Each batch
+    is applied with rollbackOnFailure, so a rejected feature fails the batch
+    and the engine retries it record by record, dead-lettering the rejects.
+    """
+
+    connector_type = "arcgis_target"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.service = ArcGISFeatureService(config)
+
+    def connect(self) -> None:
+        self.service.connect()
+
+    def close(self) -> None:
+        self.service.close()
+
+    def write_batch(self, table: Dict[str, Any], records: List[Dict[str, Any]]) -> Dict[str, int]:
+        self.connect()
+        return self.service.write(self._layer(table), table["primary_key"], records)
+
+    def is_record_error(self, exc: Exception) -> bool:
+        return isinstance(exc, ArcGISEditError)
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        if not keys:
+            return []
+        self.connect()
+        return self.service.lookup(self._layer(table), table["primary_key"], keys)
+
+    def table_stats(self, table: Dict[str, Any], columns: Optional[List[str]] = None) -> Dict[str, Any]:
+        self.connect()
+        layer = self._layer(table)
+
+        def count(where: str) -> int:
+            return int(self.service.query(layer, {"where": where, "returnCountOnly": "true"}).get("count", 0))
+
+        return {
+            "row_count": count("1=1"),
+            "null_counts": {c: count(f"{self.service.field_name(layer, c) or c} IS NULL") for c in columns or []},
+        }
+
+    def health_check(self) -> Dict[str, Any]:
+        return self.service.health(self.connector_type)
+
+    def _layer(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        return self.service.layer(table.get("target_table") or table["name"])
+
+
+# Lowest FindMatches confidence accepted when a coordinate system has no EPSG code
+FILEGDB_SRS_MATCH_CONFIDENCE = 90
+
+
+class FileGDBSource(SourceConnector):
+    """
+    Source connector that reads an Esri File Geodatabase with GDAL's
+    OpenFileGDB driver, for one-time imports such as a county's historic
+    parcel layers. A geodatabase has no change tracking, so its tables are
+    synced in full.
+
+    Configuration:
+        path: The .gdb folder, or a .zip holding one
+        srid: SRID to reproject geometry to (each feature class's own by default)
+        geometry_field: Record field holding the geometry ("geometry")
+
+    Tables are feature classes or standalone tables, by name. Geometry is
+    read as EWKB hex with the SRID embedded, as the PostGIS and ArcGIS
+    connectors use; true curves are linearized and M values dropped. The
+    ObjectID (the layer's FID column) is the natural primary key and is read
+    in its native order; other keys are sorted in memory.
+    """
+
+    connector_type = "filegdb"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.path = _env_setting(config, "path")
+        self.out_srid = int(config["srid"]) if config.get("srid") else None
+        self.geometry_field = config.get("geometry_field", "geometry")
+        self.dataset = None
+        self._srids: Dict[str, Optional[int]] = {}
+        self._transforms: Dict[str, Any] = {}
+
+    def connect(self) -> None:
+        if self.dataset is not None:
+            return
+        if not OGR_AVAILABLE:
+            raise ConnectorError("File Geodatabase imports require GDAL's Python bindings (osgeo)")
+        if not self.path:
+            raise ConnectorError("File Geodatabase path is not configured")
+        path = os.path.abspath(self.path)
+        if path.lower().endswith(".zip"):
+            path = f"/vsizip/{path}"
+        try:
+            self.dataset = ogr.GetDriverByName("OpenFileGDB").Open(path, 0)
+        except RuntimeError as e:
+            raise ConnectorError(f"Cannot open File Geodatabase {self.path}: {e}")
+        if self.dataset is None:
+            raise ConnectorError(f"Cannot open File Geodatabase {self.path}")
+
+    def close(self) -> None:
+        self.dataset = None
+        self._srids = {}
+        self._transforms = {}
+
+    def read_table(self, table: Dict[str, Any], batch_size: int,
+                   after_key: Optional[List[Any]] = None) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        layer = self._layer(table["name"])
+        key_columns = list(table["primary_key"])
+        native = key_columns == [self._fid_column(layer)]
+        layer.SetAttributeFilter(f"{key_columns[0]} > {int(after_key[0])}" if native and after_key else None)
+        layer.ResetReading()
+        if native:
+            records = (self._record(layer, feature) for feature in layer)
+        else:
+            order = lambda values: [(value is None, value) for value in values]
+            records = sorted((self._record(layer, feature) for feature in layer),
+                             key=lambda r: order([r.get(c) for c in key_columns]))
+            if after_key:
+                records = [r for r in records if order([r.get(c) for c in key_columns]) > order(after_key)]
+
+        batch = []
+        for record in records:
+            record[OPERATION_FIELD] = "update"
+            batch.append(record)
+            if len(batch) >= batch_size:
+                yield batch
+                batch = []
+        if batch:
+            yield batch
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        if not keys:
+            return []
+        self.connect()
+        layer = self._layer(table["name"])
+        key_columns = list(table["primary_key"])
+        if key_columns == [self._fid_column(layer)]:
+            features = [layer.GetFeature(int(key[0])) for key in keys]
+            return [self._record(layer, feature) for feature in features if feature is not None]
+        wanted = {json.dumps(list(key), default=str) for key in keys}
+        layer.SetAttributeFilter(None)
+        layer.ResetReading()
+        records = (self._record(layer, feature) for feature in layer)
+        return [r for r in records if record_key(key_columns, r) in wanted]
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        self.connect()
+        layer = self._layer(table["name"])
+        fid_column = self._fid_column(layer)
+        definition = layer.GetLayerDefn()
+        columns = [{"name": fid_column, "type": "objectid", "nullable": False}]
+        for i in range(definition.GetFieldCount()):
+            field = definition.GetFieldDefn(i)
+            columns.append({"name": field.GetName(), "type": ogr.GetFieldTypeName(field.GetType()).lower(),
+                            "nullable": bool(field.IsNullable())})
+        if layer.GetGeomType() != ogr.wkbNone:
+            columns.append({"name": self.geometry_field, "type": ogr.GeometryTypeToName(layer.GetGeomType()),
+                            "nullable": True})
+        return {"name": table["name"], "columns": columns, "primary_key": [fid_column],
+                "srid": self._layer_srid(layer), "feature_count": layer.GetFeatureCount()}
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.connect()
+            layers = [self.dataset.GetLayer(i).GetName() for i in range(self.dataset.GetLayerCount())]
+            return {"connector_type": self.connector_type, "status": "healthy", "path": self.path, "layers": layers}
+        except Exception as e:
+            return {"connector_type": self.connector_type, "status": "unavailable", "error": str(e)}
+
+    def _layer(self, name: str):
+        layer = self.dataset.GetLayerByName(name)
+        if layer is None:
+            raise ConnectorError(f"File Geodatabase {self.path} has no feature class or table {name}")
+        return layer
+
+    @staticmethod
+    def _fid_column(layer) -> str:
+        return layer.GetFIDColumn() or "OBJECTID"
+
+    def _record(self, layer, feature) -> Dict[str, Any]:
+        record = {self._fid_column(layer): feature.GetFID()}
+        definition = feature.GetDefnRef()
+        for i in range(definition.GetFieldCount()):
+            field = definition.GetFieldDefn(i)
+            field_type = field.GetType()
+            if not feature.IsFieldSetAndNotNull(i):
+                value = None
+            elif field_type in (ogr.OFTDate, ogr.OFTDateTime, ogr.OFTTime):
+                year, month, day, hour, minute, second, _ = feature.GetFieldAsDateTime(i)
+                moment = datetime(max(year, 1), max(month, 1), max(day, 1), hour, minute, int(second),
+                                  int((second - int(second)) * 1000000))
+                value = moment.date() if field_type == ogr.OFTDate else moment.time() if field_type == ogr.OFTTime else moment
+            elif field_type == ogr.OFTBinary:
+                value = feature.GetFieldAsBinary(i)
+            else:
+                value = feature.GetField(i)
+            record[field.GetName()] = value
+        if layer.GetGeomType() != ogr.wkbNone:
+            record[self.geometry_field] = self._geometry(layer, feature.GetGeometryRef())
+        return record
+
+    def _geometry(self, layer, geometry) -> Optional[str]:
+        """A feature geometry as EWKB hex."""
+        if geometry is None:
+            return None
+        geometry = geometry.Clone()
+        if geometry.HasCurveGeometry():
+            geometry = geometry.GetLinearGeometry()
+        if geometry.IsMeasured():
+            geometry.SetMeasured(False)
+        srid = self._layer_srid(layer)
+        if self.out_srid and srid != self.out_srid:
+            geometry.Transform(self._transform(layer))
+            srid = self.out_srid
+        data = bytes(geometry.ExportToWkb(ogr.wkbNDR))
+        return (ewkb_with_srid(data, srid) if srid else data).hex()
+
+    def _layer_srid(self, layer) -> Optional[int]:
+        """EPSG code of a layer's coordinate system; geodatabases often carry Esri WKT without one."""
+        name = layer.GetName()
+        if name not in self._srids:
+            srid = None
+            reference = layer.GetSpatialRef()
+            if reference is not None:
+                reference = reference.Clone()
+                try:
+                    reference.AutoIdentifyEPSG()
+                except RuntimeError:
+                    pass
+                if reference.GetAuthorityName(None) == "EPSG":
+                    srid = int(reference.GetAuthorityCode(None))
+                else:
+                    matches = [(m, c) for m, c in reference.FindMatches() if c >= FILEGDB_SRS_MATCH_CONFIDENCE]
+                    if matches and matches[0][0].GetAuthorityName(None) == "EPSG":
+                        srid = int(matches[0][0].GetAuthorityCode(None))
+                if srid is None:
+                    logger.warning(f"Coordinate system of {name} in {self.path} has no EPSG code; geometry has no SRID")
+            self._srids[name] = srid
+        return self._srids[name]
+
+    def _transform(self, layer):
+        name = layer.GetName()
+        if name not in self._transforms:
+            source = layer.GetSpatialRef()
+            if source is None:
+                raise ConnectorError(f"{name} in {self.path} has no coordinate system to reproject from")
+            target = osr.SpatialReference()
+            target.ImportFromEPSG(self.out_srid)
+            for reference in (source, target):
+                reference.SetAxisMappingStrategy(osr.OAMS_TRADITIONAL_GIS_ORDER)
+            self._transforms[name] = osr.CoordinateTransformation(source, target)
+        return self._transforms[name]
+
+
+# Seconds to wait for a REST API response
+DEFAULT_REST_TIMEOUT = 30
+
+# Records requested per page from a REST API that takes a page size
+DEFAULT_REST_PAGE_SIZE = 100
+
+# How a REST resource pages through its records
+REST_PAGINATION_TYPES = ["offset", "page", "cursor", "link", "none"]
+
+# HTTP statuses after which a REST request is retried (rate limited or briefly unavailable)
+REST_RETRY_STATUSES = (429, 502, 503, 504)
+
+# Retries of a throttled or failed REST request before the read fails
+DEFAULT_REST_MAX_RETRIES = 5
+
+# Longest wait before retrying a REST request, in seconds, whatever Retry-After asks for
+DEFAULT_REST_MAX_RETRY_WAIT = 300
+
+# Formats of REST change_column values and since parameters
+REST_CHANGE_FORMATS = ["iso", "epoch", "epoch_ms"]
+
+
+class RestRateLimiter:
+    """
+    Spaces requests to one API host at most requests_per_second apart.
+
+    Limiters are shared by every connector (and worker thread) calling the
+    same host, so parallel table syncs stay within the API's limit together.
+    A Retry-After response pauses the host for all of them.
+    """
+
+    _limiters: Dict[str, "RestRateLimiter"] = {}
+    _registry_lock = threading.Lock()
+
+    def __init__(self, requests_per_second: float):
+        self.interval = 1.0 / requests_per_second if requests_per_second > 0 else 0.0
+        self._next = 0.0
+        self._lock = threading.Lock()
+
+    @classmethod
+    def for_host(cls, host: str, requests_per_second: float) -> "RestRateLimiter":
+        with cls._registry_lock:
+            limiter = cls._limiters.get(host)
+            if limiter is None:
+                limiter = cls._limiters[host] = cls(requests_per_second)
+            elif requests_per_second > 0:
+                # The strictest configured limit wins
+                limiter.interval = max(limiter.interval, 1.0 / requests_per_second)
+            return limiter
+
+    def wait(self) -> None:
+        """Block until the next request may be sent."""
+        with self._lock:
+            now = time.monotonic()
+            slot = max(now, self._next)
+            self._next = slot + self.interval
+        if slot > now:
+            time.sleep(slot - now)
+
+    def pause(self, seconds: float) -> None:
+        """Hold back every request to the host for the given time."""
+        with self._lock:
+            self._next = max(self._next, time.monotonic() + seconds)
+
+
+def _rest_timestamp(value: Any, change_format: str) -> Optional[datetime]:
+    """A REST change value or watermark as an aware UTC datetime (None when it cannot be read)."""
+    if value is None or value == "":
+        return None
+    if isinstance(value, datetime):
+        return value if value.tzinfo else value.replace(tzinfo=timezone.utc)
+    try:
+        if isinstance(value, (int, float, Decimal)) or (change_format != "iso" and not isinstance(value, str)):
+            seconds = float(value) / (1000 if change_format == "epoch_ms" else 1)
+            return datetime.fromtimestamp(seconds, tz=timezone.utc)
+        text = str(value).strip()
+        if change_format != "iso" and re.fullmatch(r"-?\d+(\.\d+)?", text):
+            return _rest_timestamp(float(text), change_format)
+        parsed = datetime.fromisoformat(text[:-1] + "+00:00" if text.endswith(("Z", "z")) else text)
+        return parsed if parsed.tzinfo else parsed.replace(tzinfo=timezone.utc)
+    except (ValueError, OverflowError, OSError):
+        return None
+
+
+class RestSource(SourceConnector):
+    """
+    Source connector for systems that only expose a JSON REST API.
+
+    Configuration:
+        base_url: API root; resource paths are relative to it
+        headers: Request headers, as templates whose {placeholders} are
+            connector settings (read directly or via *_env_var), e.g.
+            {"Authorization": "Bearer {token}"} with token_env_var; {basic_auth}
+            is the base64 username:password pair
+        params: Query parameters sent with every request (templates too)
+        timeout_seconds: Seconds to wait for a response
+        page_size: Records requested per page (default 100)
+        rate_limit: {"requests_per_second", "max_retries", "max_retry_wait_seconds"};
+            429 and 5xx gateway responses are retried, honouring Retry-After
+        health_path: Path requested by health checks (base_url by default)
+        resources: Per table, keyed by table name:
+            path: Resource path (the table name by default)
+            params: Extra query parameters
+            records_path: JSONPath to the records in a response (the
+                response itself when it is a list)
+            pagination: {"type": offset | page | cursor | link | none, ...}
+                offset: offset_param ("offset"), limit_param ("limit")
+                page: page_param ("page"), page_start (1), limit_param
+                cursor: cursor_path (JSONPath to the next cursor), cursor_param ("cursor"), limit_param
+                link: the Link header's rel="next" URL, or next_path (JSONPath to it)
+            key_ordered: The API returns records in primary key order, so an
+                interrupted full read resumes after the last written key
+                (otherwise it restarts; writes are upserts)
+            since_param: Query parameter narrowing incremental reads to
+                records changed after the watermark
+            change_format: iso (default), epoch or epoch_ms, for change_column
+                values and since_param
+            item_path: Path of one record by key, e.g. "/permits/{permit_id}",
+                for merge sync pairs to look records up
+
+    Records are the API's items as returned; nested values are extracted into
+    target columns with "path" field mappings (see sync_mapping). Primary key
+    fields must be top level. Incremental reads use "change_tracking":
+    "change_column"; versions are ISO UTC timestamps taken from this host's
+    clock (less clock_skew_seconds), so the window is filtered here as well as
+    by since_param. Deletes are not detected.
+    """
+
+    connector_type = "rest"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.base_url = (_env_setting(config, "base_url") or "").rstrip("/")
+        self.timeout = float(config.get("timeout_seconds", DEFAULT_REST_TIMEOUT))
+        self.page_size = int(config.get("page_size", DEFAULT_REST_PAGE_SIZE))
+        rate_limit = config.get("rate_limit") or {}
+        self.requests_per_second = float(rate_limit.get("requests_per_second") or 0)
+        self.max_retries = int(rate_limit.get("max_retries", DEFAULT_REST_MAX_RETRIES))
+        self.max_retry_wait = float(rate_limit.get("max_retry_wait_seconds", DEFAULT_REST_MAX_RETRY_WAIT))
+        self.clock_skew = float(config.get("clock_skew_seconds", 0))
+        self.resources = config.get("resources") or {}
+        for name, resource in self.resources.items():
+            pagination = (resource.get("pagination") or {}).get("type", "none")
+            if pagination not in REST_PAGINATION_TYPES:
+                raise ValueError(
+                    f"Unsupported pagination type for REST resource {name}: {pagination}. "
+                    f"Supported types: {', '.join(REST_PAGINATION_TYPES)}"
+                )
+            if pagination == "cursor" and not resource["pagination"].get("cursor_path"):
+                raise ValueError(f"REST resource {name} uses cursor pagination but has no cursor_path")
+            if resource.get("change_format", "iso") not in REST_CHANGE_FORMATS:
+                raise ValueError(
+                    f"Unsupported change_format for REST resource {name}: {resource['change_format']}. "
+                    f"Supported formats: {', '.join(REST_CHANGE_FORMATS)}"
+                )
+        self.session = None
+        self._limiter: Optional[RestRateLimiter] = None
+        self._paths: Dict[str, JsonPath] = {}
+
+    def connect(self) -> None:
+        if not self.base_url:
+            raise ConnectorError("REST source base_url is not configured")
+        if self.session is None:
+            self.session = tracer.traced_session(requests.Session())
+            self.session.verify = self.config.get("verify_ssl", True)
+            self.session.headers.update({"Accept": "application/json"})
+            self.session.headers.update(self._templates(self.config.get("headers") or {}))
+            self._limiter = RestRateLimiter.for_host(urlsplit(self.base_url).netloc, self.requests_per_second)
+
+    def close(self) -> None:
+        if self.session is not None:
+            self.session.close()
+            self.session = None
+
+    def read_table(self, table: Dict[str, Any], batch_size: int,
+                   after_key: Optional[List[Any]] = None) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        resource = self._resource(table)
+        key_columns = table["primary_key"]
+        skip_to = None
+        if after_key:
+            if resource.get("key_ordered"):
+                skip_to = tuple(after_key)
+            else:
+                logger.info(f"REST resource {table['name']} is not key ordered; re-reading it from the start")
+        for records in self._pages(table, resource, {}, batch_size):
+            batch = []
+            for record in records:
+                key = self._key(table, record)
+                if skip_to is not None and not self._key_after(key, skip_to):
+                    continue
+                batch.append(dict(record, **{OPERATION_FIELD: "update"}))
+            for start in range(0, len(batch), batch_size):
+                yield batch[start:start + batch_size]
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        resource = self._resource(table)
+        column = table.get("change_column")
+        if table.get("change_tracking") != "change_column" or not column:
+            raise ConnectorError(f"Table {table['name']} needs change_column tracking for incremental reads")
+        change_format = resource.get("change_format", "iso")
+        since = _rest_timestamp(since_version, "iso")
+        until = _rest_timestamp(until_version, "iso")
+        params = {}
+        if resource.get("since_param") and since is not None:
+            params[resource["since_param"]] = self._format_version(since, change_format)
+        changed = []
+        for records in self._pages(table, resource, params, batch_size):
+            for record in records:
+                changed_at = _rest_timestamp(record.get(column), change_format)
+                if changed_at is None:
+                    raise ConnectorError(
+                        f"REST resource {table['name']} record {self._key(table, record)} has no readable {column}"
+                    )
+                if (since is None or changed_at > since) and (until is None or changed_at <= until):
+                    changed.append((changed_at, record))
+        # Changes are ordered by version, which APIs rarely sort by
+        changed.sort(key=lambda item: item[0])
+        for start in range(0, len(changed), batch_size):
+            yield [
+                dict(record, **{OPERATION_FIELD: "update", VERSION_FIELD: changed_at.isoformat()})
+                for changed_at, record in changed[start:start + batch_size]
+            ]
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        now = datetime.now(timezone.utc) - timedelta(seconds=self.clock_skew)
+        return now.isoformat()
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        resource = self._resource(table)
+        if not resource.get("item_path"):
+            raise NotImplementedError(f"REST resource {table['name']} has no item_path for record lookups")
+        self.connect()
+        records = []
+        for key in keys:
+            values = {column: url_quote(str(value), safe="") for column, value in zip(table["primary_key"], key)}
+            try:
+                path = resource["item_path"].format(**values)
+            except KeyError as e:
+                raise ConnectorError(f"REST resource {table['name']} item_path uses {e.args[0]}, which is not a key column")
+            body = self._request(self._url(path), dict(resource.get("params") or {}), missing_ok=True)
+            if body is None:
+                continue
+            record = self._path(resource["item_record_path"]).first(body) if resource.get("item_record_path") else body
+            if isinstance(record, dict):
+                records.append(record)
+        return records
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        """Describe a resource from the records of its first page."""
+        self.connect()
+        resource = self._resource(table)
+        columns: Dict[str, Dict[str, Any]] = {}
+        for records in self._pages(table, resource, {}, self.page_size):
+            for record in records:
+                for name, value in record.items():
+                    column = columns.setdefault(name, {"name": name, "type": None, "nullable": False})
+                    if value is None:
+                        column["nullable"] = True
+                    elif column["type"] is None:
+                        column["type"] = type(value).__name__
+            for name, column in columns.items():
+                column["nullable"] = column["nullable"] or any(name not in record for record in records)
+            break
+        return {"name": table["name"], "columns": list(columns.values()), "primary_key": list(table.get("primary_key") or [])}
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.connect()
+            self._request(self._url(self.config.get("health_path", "")), {})
+            return {"connector_type": self.connector_type, "status": "healthy", "resources": sorted(self.resources)}
+        except Exception as e:
+            return {"connector_type": self.connector_type, "status": "unavailable", "error": str(e)}
+
+    def _resource(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        return self.resources.get(table["name"]) or {}
+
+    def _pages(self, table: Dict[str, Any], resource: Dict[str, Any], extra_params: Dict[str, Any],
+               batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        """Yield each page of a resource's records."""
+        pagination = dict(resource.get("pagination") or {})
+        kind = pagination.get("type", "none")
+        page_size = int(resource.get("page_size") or min(self.page_size, batch_size))
+        url = self._url(resource.get("path", table["name"]))
+        params = dict(resource.get("params") or {}, **extra_params)
+        limit_param = pagination.get("limit_param", "limit" if kind == "offset" else None)
+        if limit_param:
+            params[limit_param] = page_size
+        offset = 0
+        page = int(pagination.get("page_start", 1))
+        while True:
+            if kind == "offset":
+                params[pagination.get("offset_param", "offset")] = offset
+            elif kind == "page":
+                params[pagination.get("page_param", "page")] = page
+            body, links = self._request(url, params, with_links=True)
+            records = self._records(table, resource, body)
+            if records:
+                yield records
+            if kind == "none" or not records:
+                return
+            if kind in ("offset", "page"):
+                if len(records) < page_size and not pagination.get("ignore_short_pages"):
+                    return
+                offset += len(records)
+                page += 1
+            elif kind == "cursor":
+                cursor = self._path(pagination["cursor_path"]).first(body)
+                if cursor in (None, "") or cursor == params.get(pagination.get("cursor_param", "cursor")):
+                    return
+                params[pagination.get("cursor_param", "cursor")] = cursor
+            else:
+                next_url = self._path(pagination["next_path"]).first(body) if pagination.get("next_path") \
+                    else (links.get("next") or {}).get("url")
+                if not next_url:
+                    return
+                # The next link carries every query parameter itself
+                url, params = urljoin(url, next_url), {}
+
+    def _records(self, table: Dict[str, Any], resource: Dict[str, Any], body: Any) -> List[Dict[str, Any]]:
+        if resource.get("records_path"):
+            found = self._path(resource["records_path"]).find(body)
+            records = found[0] if len(found) == 1 and isinstance(found[0], list) else found
+        elif isinstance(body, list):
+            records = body
+        else:
+            raise ConnectorError(
+                f"REST resource {table['name']} returned an object; set records_path to the list of records"
+            )
+        bad = [r for r in records if not isinstance(r, dict)]
+        if bad:
+            raise ConnectorError(f"REST resource {table['name']} records_path selects non-object values")
+        for record in records:
+            self._key(table, record)
+        return records
+
+    def _request(self, url: str, params: Dict[str, Any], with_links: bool = False, missing_ok: bool = False) -> Any:
+        """
+        GET a URL and return the decoded JSON (and the parsed Link header).
+
+        Throttled and gateway error responses, and connection failures, are
+        retried with backoff; Retry-After is honoured and pauses every
+        connector calling the same host.
+        """
+        params = self._templates(dict(self.config.get("params") or {}, **params))
+        for attempt in range(self.max_retries + 1):
+            self._limiter.wait()
+            delay = min(2 ** attempt, self.max_retry_wait)
+            try:
+                response = self.session.get(url, params=params, timeout=self.timeout)
+            except (requests.ConnectionError, requests.Timeout) as e:
+                if attempt >= self.max_retries:
+                    raise ConnectorError(f"REST request to {url} failed: {e}")
+                logger.warning(f"REST request to {url} failed ({e}); retrying in {delay}s")
+                time.sleep(delay)
+                continue
+            except requests.RequestException as e:
+                raise ConnectorError(f"REST request to {url} failed: {e}")
+            if response.status_code in REST_RETRY_STATUSES and attempt < self.max_retries:
+                wait = self._retry_after(response.headers.get("Retry-After"))
+                wait = min(wait if wait is not None else delay, self.max_retry_wait)
+                logger.warning(f"REST request to {url} returned {response.status_code}; retrying in {wait:.0f}s")
+                self._limiter.pause(wait)
+                continue
+            if missing_ok and response.status_code == 404:
+                return None
+            try:
+                response.raise_for_status()
+                body = response.json()
+            except (requests.RequestException, ValueError) as e:
+                raise ConnectorError(f"REST request to {url} failed: {e}")
+            return (body, response.links or {}) if with_links else body
+        raise ConnectorError(f"REST request to {url} failed: still throttled after {self.max_retries} retries")
+
+    @staticmethod
+    def _retry_after(value: Optional[str]) -> Optional[float]:
+        """Seconds a Retry-After header (delta seconds or an HTTP date) asks to wait."""
+        if not value:
+            return None
+        if value.strip().isdigit():
+            return float(value)
+        try:
+            return max(0.0, (parsedate_to_datetime(value) - datetime.now(timezone.utc)).total_seconds())
+        except (TypeError, ValueError):
+            return None
+
+    def _templates(self, values: Dict[str, Any]) -> Dict[str, Any]:
+        """Fill {setting} placeholders in header and parameter templates."""
+        resolved = {}
+        for name, template in values.items():
+            if not isinstance(template, str):
+                resolved[name] = template
+                continue
+            settings = {}
+            for _, field, _, _ in string.Formatter().parse(template):
+                if not field or field in settings:
+                    continue
+                if field == "basic_auth":
+                    username, password = _env_setting(self.config, "username"), _env_setting(self.config, "password")
+                    if username is None or password is None:
+                        raise ConnectorError(f"REST template {name} uses {{basic_auth}} but username/password are not configured")
+                    settings[field] = base64.b64encode(f"{username}:{password}".encode()).decode()
+                else:
+                    settings[field] = _env_setting(self.config, field)
+                    if settings[field] is None:
+                        raise ConnectorError(f"REST template {name} uses {{{field}}}, which is not configured")
+            resolved[name] = template.format(**settings)
+        return resolved
+
+    def _url(self, path: str) -> str:
+        if path.startswith(("http://", "https://")):
+            return path
+        return "/".join(p for p in (self.base_url, path.strip("/")) if p)
+
+    def _path(self, expression: str) -> JsonPath:
+        if expression not in self._paths:
+            self._paths[expression] = compile_path(expression)
+        return self._paths[expression]
+
+    @staticmethod
+    def _key(table: Dict[str, Any], record: Dict[str, Any]) -> Tuple:
+        missing = [c for c in table["primary_key"] if record.get(c) is None]
+        if missing:
+            raise ConnectorError(
+                f"REST resource {table['name']} returned a record without primary key field(s) {', '.join(missing)}"
+            )
+        return tuple(record[c] for c in table["primary_key"])
+
+    @staticmethod
+    def _key_after(key: Tuple, after: Tuple) -> bool:
+        try:
+            return key > after
+        except TypeError:
+            return tuple(str(v) for v in key) > tuple(str(v) for v in after)
+
+    @staticmethod
+    def _format_version(version: datetime, change_format: str) -> Any:
+        if change_format == "epoch":
+            return int(version.timestamp())
+        if change_format == "epoch_ms":
+            return int(version.timestamp() * 1000)
+        return version.astimezone(timezone.utc).isoformat().replace("+00:00", "Z")
+
+
+# Formats of the files a file drop source reads
+FILE_DROP_FORMATS = ["csv", "json", "ndjson"]
+
+# Encoding of dropped files unless a resource sets its own (a byte order mark is skipped)
+DEFAULT_FILE_DROP_ENCODING = "utf-8-sig"
+
+
+class FileDropSource(SourceConnector):
+    """
+    Source connector for systems that drop export files in a folder, such
+    as the permit feeds of cities without an API.
+
+    Configuration:
+        path: The drop folder (or path_env_var)
+        resources: Per table, keyed by table name:
+            pattern: File name pattern, e.g. "permits_*.csv" (the table name
+                and the format's extension by default)
+            format: csv, json or ndjson (from the pattern's extension by default)
+            encoding: Text encoding (utf-8 by default)
+            delimiter: CSV field delimiter (",")
+            records_path: JSONPath to the records of a JSON file (the file
+                itself when it is a list)
+
+    Files are read in name order, so when several carry a record the latest
+    drop wins; a file is read once it has not changed for settle_seconds
+    (default 0), so files still being written are left for the next sync.
+    CSV values are read as text, empty values as null; field mappings type
+    them. Incremental reads use "change_tracking": "file_modified": the
+    records of the files modified since the watermark, whose versions are
+    ISO UTC timestamps of the files' modification times. Deletes are not
+    detected.
+    """
+
+    connector_type = "file_drop"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.path = _env_setting(config, "path")
+        self.settle_seconds = float(config.get("settle_seconds", 0))
+        self.resources = config.get("resources") or {}
+        for name, resource in self.resources.items():
+            file_format = self._format(name, resource)
+            if file_format not in FILE_DROP_FORMATS:
+                raise ValueError(
+                    f"Unsupported format for file drop resource {name}: {file_format}. "
+                    f"Supported formats: {', '.join(FILE_DROP_FORMATS)}"
+                )
+        self._paths: Dict[str, JsonPath] = {}
+
+    def connect(self) -> None:
+        if not self.path:
+            raise ConnectorError("File drop path is not configured")
+        if not os.path.isdir(self.path):
+            raise ConnectorError(f"File drop folder {self.path} does not exist")
+
+    def read_table(self, table: Dict[str, Any], batch_size: int,
+                   after_key: Optional[List[Any]] = None) -> Iterator[List[Dict[str, Any]]]:
+        self.connect()
+        key_columns = list(table["primary_key"])
+        order = lambda values: [(value is None, str(value)) for value in values]
+        records: Dict[str, Dict[str, Any]] = {}
+        for path, _ in self._files(table):
+            for record in self._read(table, path):
+                records[record_key(key_columns, record)] = record
+        ordered = sorted(records.values(), key=lambda r: order([r.get(c) for c in key_columns]))
+        if after_key:
+            ordered = [r for r in ordered if order([r.get(c) for c in key_columns]) > order(after_key)]
+        for start in range(0, len(ordered), batch_size):
+            yield [dict(record, **{OPERATION_FIELD: "update"}) for record in ordered[start:start + batch_size]]
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        if table.get("change_tracking") != "file_modified":
+            raise ConnectorError(f"Table {table['name']} needs file_modified tracking for incremental reads")
+        self.connect()
+        since = _rest_timestamp(since_version, "iso")
+        until = _rest_timestamp(until_version, "iso")
+        # Files are read in modification order, so the latest drop of a record comes last
+        files = sorted(((modified, path) for path, modified in self._files(table)
+                        if (since is None or modified > since) and (until is None or modified <= until)))
+        batch = []
+        for modified, path in files:
+            for record in self._read(table, path):
+                batch.append(dict(record, **{OPERATION_FIELD: "update", VERSION_FIELD: modified.isoformat()}))
+                if len(batch) >= batch_size:
+                    yield batch
+                    batch = []
+        if batch:
+            yield batch
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        return datetime.now(timezone.utc).isoformat()
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        """Describe a resource from the records of its latest file."""
+        self.connect()
+        files = self._files(table)
+        columns: Dict[str, Dict[str, Any]] = {}
+        if files:
+            records = self._read(table, files[-1][0])
+            for record in records:
+                for name, value in record.items():
+                    column = columns.setdefault(name, {"name": name, "type": None, "nullable": False})
+                    if value is None:
+                        column["nullable"] = True
+                    elif column["type"] is None:
+                        column["type"] = type(value).__name__
+            for name, column in columns.items():
+                column["nullable"] = column["nullable"] or any(name not in record for record in records)
+        return {"name": table["name"], "columns": list(columns.values()),
+                "primary_key": list(table.get("primary_key") or []), "files": len(files)}
+
+    def list_tables(self) -> List[str]:
+        return sorted(self.resources)
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.connect()
+            files = {name: len(self._files({"name": name})) for name in sorted(self.resources)}
+            return {"connector_type": self.connector_type, "status": "healthy", "path": self.path, "files": files}
+        except Exception as e:
+            return {"connector_type": self.connector_type, "status": "unavailable", "error": str(e)}
+
+    def _format(self, name: str, resource: Dict[str, Any]) -> str:
+        if resource.get("format"):
+            return resource["format"]
+        extension = os.path.splitext(resource.get("pattern") or "")[1].lstrip(".").lower()
+        return extension or "csv"
+
+    def _files(self, table: Dict[str, Any]) -> List[Tuple[str, datetime]]:
+        """The settled files of a table's resource in name order, with their modification times."""
+        resource = self.resources.get(table["name"]) or {}
+        pattern = resource.get("pattern") or f"{table['name']}*.{self._format(table['name'], resource)}"
+        settled = time.time() - self.settle_seconds
+        files = []
+        for name in sorted(os.listdir(self.path)):
+            path = os.path.join(self.path, name)
+            if not fnmatch.fnmatch(name, pattern) or not os.path.isfile(path):
+                continue
+            modified = os.path.getmtime(path)
+            if modified <= settled:
+                files.append((path, datetime.fromtimestamp(modified, tz=timezone.utc)))
+        return files
+
+    def _read(self, table: Dict[str, Any], path: str) -> List[Dict[str, Any]]:
+        resource = self.resources.get(table["name"]) or {}
+        file_format = self._format(table["name"], resource)
+        try:
+            with open(path, encoding=resource.get("encoding", DEFAULT_FILE_DROP_ENCODING), newline="") as f:
+                if file_format == "csv":
+                    reader = csv.DictReader(f, delimiter=resource.get("delimiter", ","))
+                    records = [{name: (value if value != "" else None) for name, value in row.items() if name}
+                               for row in reader]
+                elif file_format == "ndjson":
+                    records = [json.loads(line) for line in f if line.strip()]
+                else:
+                    body = json.load(f)
+                    records = body
+                    if resource.get("records_path"):
+                        found = self._path(resource["records_path"]).find(body)
+                        records = found[0] if len(found) == 1 and isinstance(found[0], list) else found
+        except (OSError, UnicodeDecodeError, ValueError, csv.Error) as e:
+            raise ConnectorError(f"Cannot read {file_format} file {path} of {table['name']}: {e}")
+        if not isinstance(records, list) or not all(isinstance(r, dict) for r in records):
+            raise ConnectorError(f"{file_format} file {path} of {table['name']} does not hold a list of records")
+        missing = [c for c in table.get("primary_key") or [] if any(r.get(c) is None for r in records)]
+        if missing:
+            raise ConnectorError(f"File {path} of {table['name']} has records without primary key field(s) "
+                                 f"{', '.join(missing)}")
+        return records
+
+    def _path(self, expression: str) -> JsonPath:
+        if expression not in self._paths:
+            self._paths[expression] = compile_path(expression)
+        return self._paths[expression]
+
+
+# Column holding each staged row's operation in warehouse load files
+WAREHOUSE_OPERATION_COLUMN = "sync_operation"
+
+# Default table warehouse targets record their loads in
+DEFAULT_LOAD_MANIFEST_TABLE = "sync_load_manifests"
+
+# Default key prefix of warehouse load files in the stage store
+DEFAULT_WAREHOUSE_STAGE_PREFIX = "warehouse-loads"
+
+# Keys per warehouse key lookup statement
+WAREHOUSE_MAX_LOOKUP_KEYS = 500
+
+# Columns of the load manifest table and their value kinds
+LOAD_MANIFEST_COLUMNS = [
+    ("load_id", "text"), ("target_table", "text"), ("job_id", "text"), ("status", "text"),
+    ("file_uri", "text"), ("file_bytes", "int"), ("file_sha256", "text"), ("records", "int"),
+    ("upserted", "int"), ("deleted", "int"), ("columns_added", "text"), ("error", "text"),
+    ("started_at", "datetime"), ("finished_at", "datetime"),
+]
+
+# When a new column sees several value kinds, the kind that holds them all
+WAREHOUSE_KIND_WIDENING = {
+    frozenset(["int", "float"]): "float",
+    frozenset(["int", "decimal"]): "decimal",
+    frozenset(["float", "decimal"]): "float",
+    frozenset(["int", "float", "decimal"]): "float",
+    frozenset(["datetime", "date"]): "datetime",
+}
+
+
+def _value_kind(value: Any) -> Optional[str]:
+    """The warehouse column kind a Python value needs (None for NULL)."""
+    if value is None:
+        return None
+    if isinstance(value, bool):
+        return "bool"
+    if isinstance(value, int):
+        return "int"
+    if isinstance(value, float):
+        return "float"
+    if isinstance(value, Decimal):
+        return "decimal"
+    if isinstance(value, datetime):
+        return "datetime_tz" if value.tzinfo else "datetime"
+    if isinstance(value, date):
+        return "date"
+    if isinstance(value, time_of_day):
+        return "time"
+    if isinstance(value, (bytes, bytearray, memoryview)):
+        return "binary"
+    if isinstance(value, (dict, list)):
+        return "json"
+    return "text"
+
+
+class WarehouseTarget(TargetConnector):
+    """
+    Base class for cloud data warehouse targets, which bulk-load each batch
+    through object storage instead of writing rows.
+
+    A batch is written as a gzipped newline-delimited JSON file and uploaded
+    to the "stage" store (an artifact_storage block, see export_storage). It
+    is then loaded into a temporary table with the warehouse's bulk loader
+    and merged into the target table on the primary key in one MERGE
+    statement, deletes included. Rows whose idempotency key is unchanged are
+    left alone, as in the staging targets.
+
+    The target table is created by its first load and gains a column when
+    records bring a new one, typed from the values ("schema_evolution", on
+    by default). Columns are never dropped or retyped; a value the column
+    cannot hold fails the load. Every load, failed ones included, is recorded
+    in the manifest table ("manifest_table", sync_load_manifests by default)
+    with its staged file, checksum and row counts, so the warehouse can be
+    reconciled with sync job results (see SyncEngine.reconcile_loads). Staged
+    files are kept for that purpose; expire them with a lifecycle rule on
+    the stage prefix.
+
+    Subclasses implement the dialect: the connection, identifier quoting,
+    COLUMN_TYPES, query parameters, table DDL and the load job.
+    """
+
+    connector_type = "warehouse"
+
+    # Column types by value kind (see _value_kind)
+    COLUMN_TYPES: Dict[str, str] = {}
+
+    # Artifact store types the warehouse can load from
+    STAGE_TYPES: Tuple[str, ...] = ()
+
+    # Whether column names differ by case alone
+    CASE_SENSITIVE_COLUMNS = True
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.stage_config = dict({"prefix": DEFAULT_WAREHOUSE_STAGE_PREFIX}, **(config.get("stage") or {}))
+        self.manifest_table = config.get("manifest_table", DEFAULT_LOAD_MANIFEST_TABLE)
+        self.schema_evolution = bool(config.get("schema_evolution", True))
+        self.idempotency_column = config.get("idempotency_column", "sync_idempotency_key")
+        self.lineage_column = config.get("lineage_column", "sync_lineage")
+        self.stage = None
+        self._columns: Dict[str, List[Dict[str, Any]]] = {}
+        self._manifest_ready = False
+        self._job_id = None
+
+    def connect(self) -> None:
+        if self.stage is None:
+            if self.stage_config.get("type") not in self.STAGE_TYPES:
+                raise ConnectorError(f"{self.connector_type} targets need a stage of type "
+                                     f"{' or '.join(self.STAGE_TYPES)} to load from")
+            self.stage = create_artifact_store(self.stage_config)
+        self._connect_warehouse()
+
+    def _connect_warehouse(self) -> None:
+        """Open the warehouse connection or client."""
+        raise NotImplementedError
+
+    def write_batch(self, table: Dict[str, Any], records: List[Dict[str, Any]]) -> Dict[str, int]:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        key_columns = list(table["primary_key"])
+
+        unique = dedupe_batch(records, key_columns)
+        upserts = [r for r in unique if r.get(OPERATION_FIELD) != "delete"]
+        columns = PostgresStagingTarget._collect_columns(upserts)
+        for column in reversed(key_columns):
+            if column not in columns:
+                columns.insert(0, column)
+        if self.idempotency_column and self.idempotency_column not in columns:
+            columns.append(self.idempotency_column)
+        if self.lineage_column and self.lineage_column not in columns and any(LINEAGE_FIELD in r for r in upserts):
+            # Writes without lineage (e.g. conflict resolutions) keep the row's last lineage
+            columns.append(self.lineage_column)
+        # Delete-only batches carry no lineage; they belong to the job of the table's previous batch
+        self._job_id = next((r[LINEAGE_FIELD].get("job_id") for r in upserts if r.get(LINEAGE_FIELD)), self._job_id)
+
+        load = {"load_id": uuid.uuid4().hex, "target_table": table_name, "job_id": self._job_id,
+                "records": len(unique), "started_at": datetime.utcnow(), "columns_added": []}
+        path = None
+        try:
+            load["columns_added"] = self._evolve_schema(table_name, key_columns, columns, unique)
+            path, load["file_bytes"], load["file_sha256"] = self._write_load_file(columns, unique)
+            key = f"{self.stage.prefix}/{table_name}/{datetime.utcnow():%Y/%m/%d}/{load['load_id']}.json.gz"
+            artifact = self.stage.put(path, key, "application/gzip",
+                                      {"target_table": table_name, "load_id": load["load_id"]})
+            load["file_uri"] = self._stage_uri(artifact)
+            counts = self._load(table_name, key_columns, columns, key, len(unique), load["load_id"])
+        except Exception as e:
+            load.update(status="failed", error=str(e)[:2000], finished_at=datetime.utcnow())
+            self._record_load(load)
+            raise
+        finally:
+            if path:
+                os.remove(path)
+
+        upserted = counts["inserted"] + counts["updated"]
+        load.update(status="loaded", upserted=upserted, deleted=counts["deleted"], finished_at=datetime.utcnow())
+        self._record_load(load)
+        logger.info(f"Loaded {len(unique)} records into {table_name} ({upserted} upserted, "
+                    f"{counts['deleted']} deleted) from {load['file_uri']}")
+        return {
+            "upserted": upserted,
+            "deleted": counts["deleted"],
+            "unchanged": len(upserts) - upserted,
+            "duplicates": len(records) - len(unique),
+        }
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        if not keys:
+            return []
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        if not self._table_columns(table_name):
+            return []
+        key_columns = list(table["primary_key"])
+        records = []
+        for start in range(0, len(keys), WAREHOUSE_MAX_LOOKUP_KEYS):
+            chunk = keys[start:start + WAREHOUSE_MAX_LOOKUP_KEYS]
+            params: List[Any] = []
+            terms = []
+            for key in chunk:
+                match = []
+                for column, value in zip(key_columns, key):
+                    match.append(f"{self._quote(column)} = {self._placeholder(len(params))}")
+                    params.append(value)
+                terms.append("(" + " AND ".join(match) + ")")
+            rows = self._query(f"SELECT * FROM {self._quote_table(table_name)} WHERE {' OR '.join(terms)}", params)
+            records.extend(self._data_columns(row) for row in rows)
+        return records
+
+    def table_stats(self, table: Dict[str, Any], columns: Optional[List[str]] = None) -> Dict[str, Any]:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        columns = list(columns or [])
+        if not self._table_columns(table_name):
+            return {"row_count": 0, "null_counts": {c: 0 for c in columns}}
+        select_sql = ", ".join(
+            ["COUNT(*) AS row_count"] +
+            [f"SUM(CASE WHEN {self._quote(c)} IS NULL THEN 1 ELSE 0 END) AS n{i}" for i, c in enumerate(columns)]
+        )
+        row = self._query(f"SELECT {select_sql} FROM {self._quote_table(table_name)}", [])[0]
+        row = {k.lower(): v for k, v in row.items()}
+        return {"row_count": int(row["row_count"]),
+                "null_counts": {c: int(row[f"n{i}"] or 0) for i, c in enumerate(columns)}}
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        self.connect()
+        table_name = table.get("target_table") or table["name"]
+        columns = self._table_columns(table_name, refresh=True)
+        if not columns:
+            raise ConnectorError(f"Warehouse table {table_name} does not exist")
+        internal = {self.idempotency_column, self.lineage_column}
+        return {"name": table_name, "columns": [c for c in columns if c["name"] not in internal],
+                "primary_key": list(table["primary_key"])}
+
+    def list_load_manifests(self, table: Optional[Dict[str, Any]] = None, job_id: Optional[str] = None,
+                            limit: int = 100) -> List[Dict[str, Any]]:
+        """
+        Load manifest entries, most recent first.
+
+        Args:
+            table: Only loads into this table
+            job_id: Only loads by this sync job
+            limit: Maximum number of entries
+        """
+        self.connect()
+        if not self._table_columns(self.manifest_table):
+            return []
+        terms, params = [], []
+        filters = {"target_table": (table.get("target_table") or table["name"]) if table else None, "job_id": job_id}
+        for column, value in filters.items():
+            if value is not None:
+                terms.append(f"{self._quote(column)} = {self._placeholder(len(params))}")
+                params.append(value)
+        where_sql = f" WHERE {' AND '.join(terms)}" if terms else ""
+        rows = self._query(f"SELECT * FROM {self._quote_table(self.manifest_table)}{where_sql} "
+                           f"ORDER BY {self._quote('started_at')} DESC LIMIT {int(limit)}", params)
+        manifests = []
+        for row in rows:
+            entry = {name: row.get(name) for name, _ in LOAD_MANIFEST_COLUMNS}
+            entry["columns_added"] = json.loads(entry["columns_added"]) if entry["columns_added"] else []
+            for name in ("started_at", "finished_at"):
+                if isinstance(entry[name], datetime):
+                    entry[name] = entry[name].isoformat()
+            manifests.append(entry)
+        return manifests
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.connect()
+            self._query("SELECT 1 AS ok", [])
+            stage = self.stage.health_check()
+            status = "healthy" if stage.get("status") == "healthy" else "degraded"
+            return {"connector_type": self.connector_type, "status": status, "stage": stage}
+        except Exception as e:
+            return {"connector_type": self.connector_type, "status": "unavailable", "error": str(e)}
+
+    def _evolve_schema(self, table_name: str, key_columns: List[str], columns: List[str],
+                       records: List[Dict[str, Any]]) -> List[str]:
+        """Create the table or add the columns it lacks; returns the columns added."""
+        existing = self._table_columns(table_name)
+        if existing:
+            names = {self._column_name(c["name"]) for c in existing}
+            missing = [c for c in columns if self._column_name(c) not in names]
+        else:
+            missing = list(columns)
+        if not missing:
+            return []
+        if existing and not self.schema_evolution:
+            raise ConnectorError(f"Warehouse table {table_name} has no column {', '.join(missing)} "
+                                 f"and schema_evolution is off")
+        typed = [(c, self.COLUMN_TYPES[self._column_kind(c, records)]) for c in missing]
+        if existing:
+            self._add_columns(table_name, typed)
+            logger.info(f"Added columns {', '.join(missing)} to warehouse table {table_name}")
+        else:
+            self._create_table(table_name, typed, key_columns)
+            logger.info(f"Created warehouse table {table_name}")
+        self._table_columns(table_name, refresh=True)
+        return missing
+
+    def _column_kind(self, column: str, records: List[Dict[str, Any]]) -> str:
+        """The value kind of a new column, from the values a batch brings."""
+        if column == self.idempotency_column:
+            return "text"
+        if column == self.lineage_column:
+            return "json"
+        kinds = {_value_kind(r.get(column)) for r in records} - {None}
+        if len(kinds) == 1:
+            return kinds.pop()
+        # An all-NULL column is created as text; mixed kinds widen where they can
+        return WAREHOUSE_KIND_WIDENING.get(frozenset(kinds), "text")
+
+    def _column_name(self, name: str) -> str:
+        return name if self.CASE_SENSITIVE_COLUMNS else name.lower()
+
+    def _write_load_file(self, columns: List[str], records: List[Dict[str, Any]]) -> Tuple[str, int, str]:
+        """Write a batch as gzipped NDJSON and return its path, size and SHA-256."""
+        fd, path = tempfile.mkstemp(suffix=".json.gz", prefix="warehouse-load-")
+        os.close(fd)
+        with gzip.open(path, "wt", encoding="utf-8") as f:
+            for record in records:
+                if record.get(OPERATION_FIELD) == "delete":
+                    row = {c: record.get(c) for c in columns if c in record}
+                    row[WAREHOUSE_OPERATION_COLUMN] = "delete"
+                else:
+                    row = {c: self._column_value(record, c) for c in columns}
+                    row[WAREHOUSE_OPERATION_COLUMN] = "upsert"
+                f.write(json.dumps(row, default=self._file_value, separators=(",", ":")) + "\n")
+        digest = hashlib.sha256()
+        with open(path, "rb") as f:
+            for chunk in iter(lambda: f.read(1024 * 1024), b""):
+                digest.update(chunk)
+        return path, os.path.getsize(path), digest.hexdigest()
+
+    def _column_value(self, record: Dict[str, Any], column: str) -> Any:
+        if column == self.idempotency_column:
+            return record.get(IDEMPOTENCY_FIELD)
+        if column == self.lineage_column:
+            return record.get(LINEAGE_FIELD)
+        return record.get(column)
+
+    def _file_value(self, value: Any) -> Any:
+        """JSON form of a value json cannot encode itself."""
+        if isinstance(value, (datetime, date, time_of_day)):
+            return value.isoformat()
+        if isinstance(value, Decimal):
+            return str(value)
+        if isinstance(value, (bytes, bytearray, memoryview)):
+            return self._binary_text(bytes(value))
+        return str(value)
+
+    def _binary_text(self, value: bytes) -> str:
+        """Text form of binary values in load files."""
+        return value.hex()
+
+    @staticmethod
+    def _stage_uri(artifact: Dict[str, Any]) -> str:
+        """URI of a staged file, for the manifest."""
+        if artifact["backend"] == "azure_blob":
+            return f"azure://{artifact['container']}/{artifact['key']}"
+        scheme = "gs" if artifact["backend"] == "gcs" else artifact["backend"]
+        return f"{scheme}://{artifact['bucket']}/{artifact['key']}"
+
+    def _record_load(self, load: Dict[str, Any]) -> None:
+        """Insert a manifest entry; a manifest failure is logged rather than failing the load."""
+        try:
+            if not self._manifest_ready:
+                if not self._table_columns(self.manifest_table):
+                    self._create_table(self.manifest_table,
+                                       [(name, self.COLUMN_TYPES[kind]) for name, kind in LOAD_MANIFEST_COLUMNS],
+                                       ["load_id"])
+                self._manifest_ready = True
+            entry = dict(load, columns_added=json.dumps(load.get("columns_added") or []))
+            names = [name for name, _ in LOAD_MANIFEST_COLUMNS]
+            self._query(
+                f"INSERT INTO {self._quote_table(self.manifest_table)} ({', '.join(self._quote(n) for n in names)}) "
+                f"VALUES ({', '.join(self._placeholder(i) for i in range(len(names)))})",
+                [entry.get(n) for n in names], [kind for _, kind in LOAD_MANIFEST_COLUMNS]
+            )
+        except Exception as e:
+            logger.error(f"Error recording load {load['load_id']} into {load['target_table']} in the manifest: {e}")
+
+    def _merge_sql(self, target_table: str, load_table: str, key_columns: List[str], columns: List[str]) -> str:
+        """MERGE of a load table into the target: deletes, idempotent updates and inserts."""
+        q = self._quote
+        operation = f"s.{q(WAREHOUSE_OPERATION_COLUMN)}"
+        match_sql = " AND ".join(f"t.{q(c)} = s.{q(c)}" for c in key_columns)
+        sql = (f"MERGE INTO {target_table} t USING {load_table} s ON {match_sql} "
+               f"WHEN MATCHED AND {operation} = 'delete' THEN DELETE ")
+        update_columns = [c for c in columns if c not in key_columns]
+        if update_columns:
+            condition = ""
+            if self.idempotency_column:
+                # Rows already written by the same source change are left alone
+                column = q(self.idempotency_column)
+                condition = f" AND (s.{column} IS NULL OR t.{column} IS DISTINCT FROM s.{column})"
+            sql += (f"WHEN MATCHED AND {operation} <> 'delete'{condition} THEN UPDATE SET "
+                    + ", ".join(f"{q(c)} = s.{q(c)}" for c in update_columns) + " ")
+        sql += (f"WHEN NOT MATCHED AND {operation} <> 'delete' THEN INSERT ({', '.join(q(c) for c in columns)}) "
+                f"VALUES ({', '.join(f's.{q(c)}' for c in columns)})")
+        return sql
+
+    def _data_columns(self, row: Dict[str, Any]) -> Dict[str, Any]:
+        """A warehouse row without the connector's idempotency and lineage columns."""
+        record = dict(row)
+        for column in (self.idempotency_column, self.lineage_column):
+            if column:
+                record.pop(column, None)
+        return record
+
+    def _table_columns(self, table_name: str, refresh: bool = False) -> List[Dict[str, Any]]:
+        """Columns of a table ("name", "type", "nullable"), cached per connection; [] when it does not exist."""
+        if refresh or table_name not in self._columns:
+            columns = self._describe_columns(table_name)
+            if not columns:
+                # Not cached, so the table is seen once a load creates it
+                return []
+            self._columns[table_name] = columns
+        return self._columns[table_name]
+
+    def _describe_columns(self, table_name: str) -> List[Dict[str, Any]]:
+        raise NotImplementedError
+
+    def _create_table(self, table_name: str, columns: List[Tuple[str, str]], key_columns: List[str]) -> None:
+        raise NotImplementedError
+
+    def _add_columns(self, table_name: str, columns: List[Tuple[str, str]]) -> None:
+        raise NotImplementedError
+
+    def _load(self, table_name: str, key_columns: List[str], columns: List[str], key: str,
+              rows: int, load_id: str) -> Dict[str, int]:
+        """Bulk-load a staged file and merge it; returns "inserted", "updated" and "deleted" counts."""
+        raise NotImplementedError
+
+    def _query(self, sql: str, params: List[Any], kinds: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+        """Run a statement and return its rows as dictionaries; kinds types parameters that may be NULL."""
+        raise NotImplementedError
+
+    def _placeholder(self, index: int) -> str:
+        """Parameter marker of the index-th parameter of a statement."""
+        raise NotImplementedError
+
+    def _quote(self, identifier: str) -> str:
+        raise NotImplementedError
+
+    def _quote_table(self, table_name: str) -> str:
+        raise NotImplementedError
+
+
+class SnowflakeTarget(WarehouseTarget):
+    """
+    Warehouse target that bulk-loads into Snowflake with COPY INTO from an
+    external stage.
+
+    Configuration:
+        account, user: Snowflake account identifier and user
+        password: Password (or password_env_var), or
+        private_key_path: Key pair authentication key file (with private_key_passphrase_env_var)
+        warehouse, database, schema, role: Session context
+        stage_name: External stage whose URL is the stage store at its
+            prefix, e.g. s3://bucket/warehouse-loads/ (create it with a storage integration)
+        stage: The artifact store (s3, azure_blob or gcs) load files are uploaded to
+
+    Identifiers are quoted, so tables and columns keep the case of the
+    record fields. Table names may be qualified as schema.table.
+    """
+
+    connector_type = "snowflake"
+
+    COLUMN_TYPES = {
+        "bool": "BOOLEAN", "int": "NUMBER(38,0)", "float": "FLOAT", "decimal": "NUMBER(38,9)",
+        "datetime": "TIMESTAMP_NTZ", "datetime_tz": "TIMESTAMP_TZ", "date": "DATE", "time": "TIME",
+        "binary": "BINARY", "json": "VARIANT", "text": "VARCHAR",
+    }
+
+    STAGE_TYPES = ("s3", "azure_blob", "gcs")
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.connection = None
+        self.database = config.get("database")
+        self.schema = config.get("schema", "PUBLIC")
+        self.stage_name = config.get("stage_name")
+
+    def _connect_warehouse(self) -> None:
+        if self.connection is not None:
+            return
+        if not SNOWFLAKE_AVAILABLE:
+            raise ConnectorError("Snowflake targets require snowflake-connector-python")
+        if not self.stage_name:
+            raise ConnectorError("Snowflake target requires stage_name, the external stage over the stage store")
+        args = {
+            "account": _env_setting(self.config, "account"),
+            "user": _env_setting(self.config, "user"),
+            "warehouse": self.config.get("warehouse"),
+            "database": self.database,
+            "schema": self.schema,
+            "role": self.config.get("role"),
+            "application": "TerraFusionSync",
+        }
+        private_key_path = _env_setting(self.config, "private_key_path")
+        if private_key_path:
+            args["private_key_file"] = private_key_path
+            args["private_key_file_pwd"] = _env_setting(self.config, "private_key_passphrase")
+        else:
+            args["password"] = _env_setting(self.config, "password")
+        try:
+            self.connection = tracer.traced_connection(
+                snowflake.connector.connect(**{k: v for k, v in args.items() if v is not None})
+            )
+        except snowflake.connector.errors.Error as e:
+            raise ConnectorError(f"Snowflake connection failed: {e}")
+
+    def close(self) -> None:
+        if self.connection is not None:
+            self.connection.close()
+            self.connection = None
+            self._columns = {}
+            self._manifest_ready = False
+
+    def _load(self, table_name: str, key_columns: List[str], columns: List[str], key: str,
+              rows: int, load_id: str) -> Dict[str, int]:
+        target_table = self._quote_table(table_name)
+        load_table = self._quote_table(f"{table_name}_load_{load_id}")
+        relative = key[len(self.stage.prefix) + 1:] if key.startswith(self.stage.prefix + "/") else key
+        location = f"@{self.stage_name}/{relative}".replace("'", "''")
+        cur = self.connection.cursor(snowflake.connector.DictCursor)
+        try:
+            cur.execute(f"CREATE TEMPORARY TABLE {load_table} LIKE {target_table}")
+            cur.execute(f"ALTER TABLE {load_table} ADD COLUMN {self._quote(WAREHOUSE_OPERATION_COLUMN)} VARCHAR")
+            cur.execute(f"COPY INTO {load_table} FROM '{location}' "
+                        f"FILE_FORMAT = (TYPE = JSON BINARY_FORMAT = HEX) "
+                        f"MATCH_BY_COLUMN_NAME = CASE_SENSITIVE ON_ERROR = ABORT_STATEMENT")
+            loaded = sum(int(r.get("rows_loaded") or 0) for r in cur.fetchall())
+            if loaded != rows:
+                raise ConnectorError(f"COPY INTO loaded {loaded} of the {rows} rows in {location}")
+            cur.execute(self._merge_sql(target_table, load_table, key_columns, columns))
+            result = {k.lower(): v for k, v in (cur.fetchone() or {}).items()}
+            return {
+                "inserted": int(result.get("number of rows inserted") or 0),
+                "updated": int(result.get("number of rows updated") or 0),
+                "deleted": int(result.get("number of rows deleted") or 0),
+            }
+        finally:
+            try:
+                cur.execute(f"DROP TABLE IF EXISTS {load_table}")
+            finally:
+                cur.close()
+
+    def _describe_columns(self, table_name: str) -> List[Dict[str, Any]]:
+        schema, name = self._schema_and_name(table_name)
+        catalog = f"{self._quote(self.database)}.INFORMATION_SCHEMA" if self.database else "INFORMATION_SCHEMA"
+        rows = self._query(
+            f"SELECT column_name, data_type, is_nullable FROM {catalog}.COLUMNS "
+            f"WHERE table_schema = %s AND table_name = %s ORDER BY ordinal_position",
+            [schema, name]
+        )
+        rows = [{k.lower(): v for k, v in r.items()} for r in rows]
+        return [{"name": r["column_name"], "type": r["data_type"].lower(), "nullable": r["is_nullable"] == "YES"}
+                for r in rows]
+
+    def _create_table(self, table_name: str, columns: List[Tuple[str, str]], key_columns: List[str]) -> None:
+        column_sql = ", ".join(f"{self._quote(name)} {column_type}" for name, column_type in columns)
+        # Snowflake records but does not enforce the key; the MERGE keeps it unique
+        key_sql = ", ".join(self._quote(c) for c in key_columns)
+        self._query(f"CREATE TABLE IF NOT EXISTS {self._quote_table(table_name)} ({column_sql}, PRIMARY KEY ({key_sql}))", [])
+
+    def _add_columns(self, table_name: str, columns: List[Tuple[str, str]]) -> None:
+        column_sql = ", ".join(f"{self._quote(name)} {column_type}" for name, column_type in columns)
+        self._query(f"ALTER TABLE {self._quote_table(table_name)} ADD COLUMN {column_sql}", [])
+
+    def _query(self, sql: str, params: List[Any], kinds: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+        cur = self.connection.cursor(snowflake.connector.DictCursor)
+        try:
+            cur.execute(sql, params or None)
+            return list(cur.fetchall()) if cur.description else []
+        finally:
+            cur.close()
+
+    def _placeholder(self, index: int) -> str:
+        return "%s"
+
+    def _schema_and_name(self, table_name: str) -> Tuple[str, str]:
+        parts = table_name.split(".")
+        return (parts[-2], parts[-1]) if len(parts) > 1 else (self.schema, parts[0])
+
+    def _quote(self, identifier: str) -> str:
+        return '"' + identifier.replace('"', '""') + '"'
+
+    def _quote_table(self, table_name: str) -> str:
+        schema, name = self._schema_and_name(table_name)
+        qualified = f"{self._quote(schema)}.{self._quote(name)}"
+        return f"{self._quote(self.database)}.{qualified}" if self.database else qualified
+
+
+class BigQueryTarget(WarehouseTarget):
+    """
+    Warehouse target that bulk-loads into Google BigQuery with load jobs from
+    Cloud Storage.
+
+    Configuration:
+        project: Google Cloud project of the dataset (and of the jobs)
+        dataset: Default dataset of target tables (names may be dataset.table)
+        location: Dataset location, e.g. "US" or "us-west1"
+        credentials_path: Service account key file (or credentials_path_env_var);
+            application default credentials otherwise
+        stage: The gcs artifact store load files are uploaded to
+
+    Each load job fills a load table in the target's dataset that expires
+    after a day, in case the connector dies before dropping it. Column names
+    are case-insensitive in BigQuery.
+    """
+
+    connector_type = "bigquery"
+
+    COLUMN_TYPES = {
+        "bool": "BOOL", "int": "INT64", "float": "FLOAT64", "decimal": "NUMERIC",
+        "datetime": "DATETIME", "datetime_tz": "TIMESTAMP", "date": "DATE", "time": "TIME",
+        "binary": "BYTES", "json": "JSON", "text": "STRING",
+    }
+
+    STAGE_TYPES = ("gcs",)
+
+    CASE_SENSITIVE_COLUMNS = False
+
+    # Query parameter types by value kind
+    PARAMETER_TYPES = {"bool": "BOOL", "int": "INT64", "float": "FLOAT64", "decimal": "NUMERIC",
+                       "datetime": "DATETIME", "datetime_tz": "TIMESTAMP", "date": "DATE", "time": "TIME",
+                       "binary": "BYTES"}
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.client = None
+        self.project = _env_setting(config, "project")
+        self.dataset = config.get("dataset")
+        self.location = config.get("location")
+
+    def _connect_warehouse(self) -> None:
+        if self.client is not None:
+            return
+        if not BIGQUERY_AVAILABLE:
+            raise ConnectorError("BigQuery targets require google-cloud-bigquery")
+        if not self.dataset:
+            raise ConnectorError("BigQuery target requires a dataset")
+        credentials_path = _env_setting(self.config, "credentials_path")
+        if credentials_path:
+            self.client = bigquery.Client.from_service_account_json(credentials_path, project=self.project,
+                                                                    location=self.location)
+        else:
+            self.client = bigquery.Client(project=self.project, location=self.location)
+        self.project = self.project or self.client.project
+
+    def close(self) -> None:
+        if self.client is not None:
+            self.client.close()
+            self.client = None
+            self._columns = {}
+            self._manifest_ready = False
+
+    def _load(self, table_name: str, key_columns: List[str], columns: List[str], key: str,
+              rows: int, load_id: str) -> Dict[str, int]:
+        target = self.client.get_table(self._table_id(table_name))
+        schema = list(target.schema) + [bigquery.SchemaField(WAREHOUSE_OPERATION_COLUMN, "STRING")]
+        schema = [bigquery.SchemaField(f.name, f.field_type, mode="NULLABLE") for f in schema]
+        load_table = bigquery.Table(f"{target.project}.{target.dataset_id}.{target.table_id}__load_{load_id}", schema=schema)
+        load_table.expires = datetime.now(timezone.utc) + timedelta(days=1)
+        load_table = self.client.create_table(load_table)
+        try:
+            job_config = bigquery.LoadJobConfig(
+                source_format=bigquery.SourceFormat.NEWLINE_DELIMITED_JSON,
+                write_disposition=bigquery.WriteDisposition.WRITE_TRUNCATE,
+                schema=schema,
+            )
+            job = self.client.load_table_from_uri(f"gs://{self.stage.bucket_name}/{key}", load_table,
+                                                  job_config=job_config)
+            job.result()
+            if job.output_rows != rows:
+                raise ConnectorError(f"Load job {job.job_id} loaded {job.output_rows} of the {rows} staged rows")
+            merge = self.client.query(self._merge_sql(f"`{target.full_table_id.replace(':', '.')}`",
+                                                      f"`{load_table.full_table_id.replace(':', '.')}`",
+                                                      key_columns, columns))
+            merge.result()
+            stats = getattr(merge, "dml_stats", None)
+            return {
+                "inserted": int(stats.inserted_row_count or 0) if stats else int(merge.num_dml_affected_rows or 0),
+                "updated": int(stats.updated_row_count or 0) if stats else 0,
+                "deleted": int(stats.deleted_row_count or 0) if stats else 0,
+            }
+        finally:
+            self.client.delete_table(load_table, not_found_ok=True)
+
+    def _describe_columns(self, table_name: str) -> List[Dict[str, Any]]:
+        try:
+            table = self.client.get_table(self._table_id(table_name))
+        except google_exceptions.NotFound:
+            return []
+        return [{"name": f.name, "type": f.field_type.lower(), "nullable": f.mode != "REQUIRED"} for f in table.schema]
+
+    def _create_table(self, table_name: str, columns: List[Tuple[str, str]], key_columns: List[str]) -> None:
+        schema = [bigquery.SchemaField(name, column_type, mode="REQUIRED" if name in key_columns else "NULLABLE")
+                  for name, column_type in columns]
+        self.client.create_table(bigquery.Table(self._table_id(table_name), schema=schema), exists_ok=True)
+
+    def _add_columns(self, table_name: str, columns: List[Tuple[str, str]]) -> None:
+        table = self.client.get_table(self._table_id(table_name))
+        table.schema = list(table.schema) + [bigquery.SchemaField(name, column_type) for name, column_type in columns]
+        self.client.update_table(table, ["schema"])
+
+    def _query(self, sql: str, params: List[Any], kinds: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+        kinds = kinds or [_value_kind(v) for v in params]
+        job_config = bigquery.QueryJobConfig(query_parameters=[
+            bigquery.ScalarQueryParameter(f"p{i}", self.PARAMETER_TYPES.get(kind, "STRING"), v)
+            for i, (v, kind) in enumerate(zip(params, kinds))
+        ])
+        return [dict(row.items()) for row in self.client.query(sql, job_config=job_config).result()]
+
+    def _placeholder(self, index: int) -> str:
+        return f"@p{index}"
+
+    def _binary_text(self, value: bytes) -> str:
+        return base64.b64encode(value).decode()
+
+    def _table_id(self, table_name: str) -> str:
+        parts = table_name.split(".")
+        if len(parts) == 1:
+            return f"{self.project}.{self.dataset}.{table_name}"
+        if len(parts) == 2:
+            return f"{self.project}.{table_name}"
+        return table_name
+
+    def _quote(self, identifier: str) -> str:
+        return "`" + identifier.replace("`", "\\`") + "`"
+
+    def _quote_table(self, table_name: str) -> str:
+        return self._quote(self._table_id(table_name))
+
+
+class EncryptedTarget(TargetConnector):
+    """
+    Target connector wrapper that encrypts sensitive columns (see encryption).
+
+    create_connector wraps targets whose configuration has an "encryption"
+    block naming the columns of each target table:
+
+        "encryption": {"columns": {"parcel_owners": ["owner_name", "mail_address"]}}
+
+    The block may set its own "key_file" or "kms_key_id"; the configured
+    master key is used otherwise. Values are stored as "tfe1:" text, so the
+    columns must be text columns, and come back decrypted; rows written
+    before encryption was turned on are read as they are. The records of
+    quarantined entries are encrypted whole. Since the database only sees
+    ciphertext, encrypted columns cannot be primary key or change columns,
+    or be filtered (other than on being null) or sorted on.
+    """
+
+    def __init__(self, target: TargetConnector, settings: Dict[str, Any]):
+        """
+        Raises:
+            ValueError: If the encryption block is invalid or no master key is configured
+        """
+        super().__init__(target.config)
+        columns = settings.get("columns")
+        if not isinstance(columns, dict) or not all(isinstance(c, list) for c in columns.values()):
+            raise ValueError("Target encryption needs columns, an object of target tables and their column lists")
+        try:
+            cipher = create_cipher(settings) if settings.get("key_file") or settings.get("kms_key_id") \
+                else default_cipher()
+        except EncryptionError as e:
+            raise ValueError(str(e))
+        if cipher is None:
+            raise ValueError("Target encryption needs a master key: set ENCRYPTION_KEY_FILE or ENCRYPTION_KMS_KEY_ID")
+        self.target = target
+        self.cipher = cipher
+        self.columns = {table: set(names) for table, names in columns.items()}
+        self.connector_type = target.connector_type
+
+    def __getattr__(self, name: str) -> Any:
+        # Connector-specific attributes (schema, connection, ...) are the wrapped target's
+        target = self.__dict__.get("target")
+        if target is None:
+            raise AttributeError(name)
+        return getattr(target, name)
+
+    def _encrypted_columns(self, table: Dict[str, Any]) -> Tuple[str, set]:
+        table_name = table.get("target_table") or table["name"]
+        columns = self.columns.get(table_name, set())
+        fixed = columns & (set(table.get("primary_key") or []) | {table.get("target_change_column")})
+        if fixed:
+            raise ConnectorError(f"Key and change columns of {table_name} cannot be encrypted: {', '.join(sorted(fixed))}")
+        return table_name, columns
+
+    def _check_query(self, table_name: str, columns: set, where: Optional[Tuple],
+                     order_by: Optional[List[Tuple[str, bool]]] = None) -> None:
+        """Refuse conditions and orderings the database cannot evaluate on ciphertext."""
+        used = set()
+
+        def visit(node: Tuple) -> None:
+            op = node[0]
+            if op in ("and", "or"):
+                visit(node[1])
+                visit(node[2])
+            elif op == "not":
+                visit(node[1])
+            elif (op == "compare" and ("literal", None) not in (node[2], node[3])) or op in ("in", "like"):
+                used.update(n[1] for n in node[1:] if isinstance(n, tuple) and n and n[0] == "field")
+
+        if where:
+            visit(where)
+        used.update(column for column, _ in order_by or [])
+        refused = used & columns
+        if refused:
+            raise ConnectorError(f"Encrypted columns of {table_name} cannot be queried or sorted on: "
+                                 f"{', '.join(sorted(refused))}")
+
+    def _encrypt(self, table_name: str, columns: set, record: Dict[str, Any]) -> Dict[str, Any]:
+        if not columns & set(record):
+            return record
+        return {k: self.cipher.encrypt_value(v, f"{table_name}.{k}") if k in columns else v for k, v in record.items()}
+
+    def _decrypt(self, table_name: str, columns: set, record: Dict[str, Any]) -> Dict[str, Any]:
+        for column in columns & set(record):
+            record[column] = self.cipher.decrypt_value(record[column], f"{table_name}.{column}")
+        return record
+
+    def connect(self) -> None:
+        self.target.connect()
+
+    def close(self) -> None:
+        self.target.close()
+
+    def write_batch(self, table: Dict[str, Any], records: List[Dict[str, Any]]) -> Dict[str, int]:
+        table_name, columns = self._encrypted_columns(table)
+        return self.target.write_batch(table, [self._encrypt(table_name, columns, r) for r in records])
+
+    def is_record_error(self, exc: Exception) -> bool:
+        return self.target.is_record_error(exc)
+
+    def fetch_records(self, table: Dict[str, Any], keys: List[List[Any]]) -> List[Dict[str, Any]]:
+        table_name, columns = self._encrypted_columns(table)
+        return [self._decrypt(table_name, columns, r) for r in self.target.fetch_records(table, keys)]
+
+    def read_changes(self, table: Dict[str, Any], since_version: Any, until_version: Any,
+                     batch_size: int) -> Iterator[List[Dict[str, Any]]]:
+        table_name, columns = self._encrypted_columns(table)
+        for batch in self.target.read_changes(table, since_version, until_version, batch_size):
+            yield [self._decrypt(table_name, columns, r) for r in batch]
+
+    def get_current_version(self, table: Dict[str, Any]) -> Any:
+        return self.target.get_current_version(table)
+
+    def table_stats(self, table: Dict[str, Any], columns: Optional[List[str]] = None) -> Dict[str, Any]:
+        return self.target.table_stats(table, columns)
+
+    def create_snapshot(self, table: Dict[str, Any], snapshot_table: str) -> int:
+        return self.target.create_snapshot(table, snapshot_table)
+
+    def restore_snapshot(self, snapshot_tables: List[Tuple[Dict[str, Any], str]]) -> Dict[str, int]:
+        return self.target.restore_snapshot(snapshot_tables)
+
+    def drop_snapshot(self, table: Dict[str, Any], snapshot_table: str) -> None:
+        self.target.drop_snapshot(table, snapshot_table)
+
+    def fetch_lineage(self, table: Dict[str, Any], keys: Optional[List[List[Any]]] = None,
+                      job_id: Optional[str] = None, limit: int = 100) -> List[Dict[str, Any]]:
+        return self.target.fetch_lineage(table, keys, job_id, limit)
+
+    def describe_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        return self.target.describe_table(table)
+
+    def query_records(self, table: Dict[str, Any], where: Optional[Tuple] = None, columns: Optional[List[str]] = None,
+                      order_by: Optional[List[Tuple[str, bool]]] = None, limit: Optional[int] = None,
+                      offset: int = 0) -> List[Dict[str, Any]]:
+        table_name, encrypted = self._encrypted_columns(table)
+        self._check_query(table_name, encrypted, where, order_by)
+        rows = self.target.query_records(table, where, columns, order_by, limit, offset)
+        return [self._decrypt(table_name, encrypted, r) for r in rows]
+
+    def count_records(self, table: Dict[str, Any], where: Optional[Tuple] = None) -> int:
+        table_name, columns = self._encrypted_columns(table)
+        self._check_query(table_name, columns, where)
+        return self.target.count_records(table, where)
+
+    def quarantine_records(self, quarantine_table: str, entries: List[Dict[str, Any]]) -> int:
+        entries = [dict(e, record=self.cipher.encrypt_value(e["record"], f"{quarantine_table}.record"),
+                        loaded=self.cipher.encrypt_value(e.get("loaded"), f"{quarantine_table}.loaded"))
+                   for e in entries]
+        return self.target.quarantine_records(quarantine_table, entries)
+
+    def list_quarantined(self, quarantine_table: str, sync_pair_id: str, source_table: Optional[str] = None,
+                         limit: int = 100) -> List[Dict[str, Any]]:
+        rows = self.target.list_quarantined(quarantine_table, sync_pair_id, source_table, limit)
+        for row in rows:
+            for column in ("record", "loaded"):
+                row[column] = self.cipher.decrypt_value(row.get(column), f"{quarantine_table}.{column}")
+        return rows
+
+    def list_load_manifests(self, table: Optional[Dict[str, Any]] = None, job_id: Optional[str] = None,
+                            limit: int = 100) -> List[Dict[str, Any]]:
+        return self.target.list_load_manifests(table, job_id, limit)
+
+    def quarantined_keys(self, quarantine_table: str, sync_pair_id: str, source_table: str) -> set:
+        return self.target.quarantined_keys(quarantine_table, sync_pair_id, source_table)
+
+    def release_quarantined(self, quarantine_table: str, sync_pair_id: str, source_table: str,
+                            record_keys: List[str]) -> int:
+        return self.target.release_quarantined(quarantine_table, sync_pair_id, source_table, record_keys)
+
+    def health_check(self) -> Dict[str, Any]:
+        return self.target.health_check()
+
+
+# Calls retried after transient failures on every connector, and the reads retried on sources
+RETRIED_OPERATIONS = ["connect"]
+RETRIED_SOURCE_OPERATIONS = ["get_current_version", "fetch_records", "describe_table", "list_tables"]
+
+# Calls only guarded by the circuit breaker: writes may sit in a transaction a retry would not redo
+GUARDED_OPERATIONS = ["write_batch", "write_columns", "get_current_version", "fetch_records", "describe_table",
+                      "list_tables", "query_records", "count_records"]
+
+# Batch reads retried on sources; table reads resume after the last batch, read_changes only before the first
+RETRIED_READS = ["read_table", "read_table_columns", "read_changes"]
+
+# Reads that can resume after the key of their last batch
+RESUMABLE_READS = ["read_table", "read_table_columns"]
+
+_guarded_calls = threading.local()
+
+
+def _circuit_name(config: Dict[str, Any], resilience: Dict[str, Any]) -> str:
+    """The circuit breaker a connector shares with every connector reaching the same database or service."""
+    if resilience.get("name"):
+        return str(resilience["name"])
+    try:
+        endpoint = None
+        if config.get("host") or config.get("host_env_var") or config.get("host_secret"):
+            endpoint = "/".join(part for part in (_env_setting(config, "host"), _env_setting(config, "database"))
+                                if part)
+        elif config.get("dsn") or config.get("dsn_env_var"):
+            endpoint = _dsn_label(_env_setting(config, "dsn") or "")
+        elif config.get("base_url") or config.get("url"):
+            parts = urlsplit(config.get("base_url") or config["url"])
+            endpoint = f"{parts.hostname}{parts.path.rstrip('/')}"
+        elif config.get("path") or config.get("account"):
+            endpoint = str(config.get("path") or config["account"])
+    except Exception:
+        endpoint = None
+    return f"{config.get('type')}:{endpoint}" if endpoint else str(config.get("type"))
+
+
+def database_name(config: Dict[str, Any]) -> str:
+    """What a connector configuration reaches, the same for every connector of one database or service."""
+    return _circuit_name(config, {})
+
+
+class _Guard:
+    """
+    The circuit breaker and retry policies of one connector instance.
+
+    Calls made while another guarded call of the same connector runs (a read
+    connecting first) pass straight through, so retries do not multiply.
+    """
+
+    def __init__(self, connector, config: Dict[str, Any], resilience: Dict[str, Any]):
+        self.connector = connector
+        self.name = _circuit_name(config, resilience)
+        self.breaker = circuit_breaker(self.name, resilience["circuit_breaker"])
+        self.policies = resilience["retries"]
+        self.retries_reads = isinstance(connector, SourceConnector)
+
+    def _active(self) -> set:
+        if not hasattr(_guarded_calls, "connectors"):
+            _guarded_calls.connectors = set()
+        return _guarded_calls.connectors
+
+    def _admit(self, operation: str) -> None:
+        if not self.breaker.allow():
+            status = self.breaker.status()
+            raise CircuitOpenError(f"{self.connector.connector_type} {operation} refused: circuit {self.name} is open "
+                                   f"after {status['failures']} failures ({status['last_error']}); "
+                                   f"next probe in {status['retry_in_seconds']:.0f}s")
+
+    def _failed(self, operation: str, error: Exception, attempt: int, retries: bool) -> float:
+        """Record a failure; returns the seconds to wait before retrying, or raises it again."""
+        error_class = classify_error(error)
+        if error_class == "permanent":
+            # The database answered; only its answer was an error
+            self.breaker.record_success()
+            raise error
+        self.breaker.record_failure(error)
+        policy = self.policies[error_class]
+        if not retries or attempt >= policy["max_attempts"] or self.breaker.state == "open":
+            raise error
+        delay = backoff_seconds(policy, attempt)
+        record_retry(self.name, error_class)
+        logger.warning(f"{self.connector.connector_type} {operation} failed ({error_class}: {error}); "
+                       f"attempt {attempt + 1} of {policy['max_attempts']} in {delay:.1f}s")
+        return delay
+
+    def _reset(self) -> None:
+        """Drop a connection a failure may have broken, so the retry reconnects."""
+        try:
+            self.connector.close()
+        except Exception:
+            pass
+
+    def call(self, operation: str, function, retries: bool):
+        def guarded(*args, **kwargs):
+            active = self._active()
+            if id(self.connector) in active:
+                return function(*args, **kwargs)
+            attempt = 1
+            while True:
+                self._admit(operation)
+                active.add(id(self.connector))
+                try:
+                    result = function(*args, **kwargs)
+                except Exception as e:
+                    active.discard(id(self.connector))
+                    delay = self._failed(operation, e, attempt, retries)
+                    self._reset()
+                    time.sleep(delay)
+                    attempt += 1
+                    continue
+                active.discard(id(self.connector))
+                self.breaker.record_success()
+                return result
+        return guarded
+
+    def batches(self, operation: str, function, retries: bool):
+        def guarded(table: Dict[str, Any], *args, **kwargs):
+            active = self._active()
+            if id(self.connector) in active:
+                yield from function(table, *args, **kwargs)
+                return
+            read_args, last_record, yielded = list(args), None, False
+            attempt = 1
+            while True:
+                self._admit(operation)
+                iterator = iter(function(table, *read_args, **kwargs))
+                try:
+                    while True:
+                        active.add(id(self.connector))
+                        try:
+                            batch = next(iterator, None)
+                        finally:
+                            active.discard(id(self.connector))
+                        if batch is None:
+                            break
+                        if batch:
+                            last_record = batch[-1]
+                        yielded, attempt = True, 1
+                        yield batch
+                except GeneratorExit:
+                    self.breaker.record_success()
+                    raise
+                except Exception as e:
+                    # Changes cannot resume mid-read; a table read resumes after its last batch's key
+                    delay = self._failed(operation, e, attempt,
+                                         retries and not (yielded and operation not in RESUMABLE_READS))
+                    self._reset()
+                    time.sleep(delay)
+                    attempt += 1
+                    if operation in RESUMABLE_READS and last_record is not None:
+                        after_key = [last_record.get(column) for column in table["primary_key"]]
+                        read_args = read_args[:1] + [after_key]
+                        kwargs.pop("after_key", None)
+                    continue
+                self.breaker.record_success()
+                return
+        return guarded
+
+    def health_check(self, function):
+        def guarded() -> Dict[str, Any]:
+            if not self.breaker.allow():
+                return {"connector_type": self.connector.connector_type, "status": "unavailable",
+                        "error": f"Circuit {self.name} is open", "circuit": self.breaker.status()}
+            active = self._active()
+            active.add(id(self.connector))
+            try:
+                result = function()
+            except Exception as e:
+                result = {"connector_type": self.connector.connector_type, "status": "unavailable", "error": str(e)}
+            finally:
+                active.discard(id(self.connector))
+            if result.get("status") == "unavailable" and \
+                    classify_error(ConnectorError(result.get("error") or "")) != "permanent":
+                self.breaker.record_failure(ConnectorError(result.get("error")))
+            else:
+                self.breaker.record_success()
+            return dict(result, circuit=self.breaker.status())
+        return guarded
+
+
+def guard_connector(connector, config: Dict[str, Any]):
+    """
+    Give a connector its circuit breaker and retry policies (see sync_resilience).
+
+    Raises:
+        ValueError: If the resilience block is invalid
+    """
+    resilience = parse_resilience(config.get("resilience"))
+    if not resilience["enabled"]:
+        return connector
+    guard = _Guard(connector, config, resilience)
+    connector.circuit_breaker = guard.breaker
+    for operation in GUARDED_OPERATIONS + RETRIED_OPERATIONS:
+        if operation in RETRIED_READS or not hasattr(connector, operation):
+            continue
+        retries = operation in RETRIED_OPERATIONS or (guard.retries_reads and operation in RETRIED_SOURCE_OPERATIONS)
+        setattr(connector, operation, guard.call(operation, getattr(connector, operation), retries))
+    for operation in RETRIED_READS:
+        if hasattr(connector, operation):
+            setattr(connector, operation, guard.batches(operation, getattr(connector, operation), guard.retries_reads))
+    connector.health_check = guard.health_check(connector.health_check)
+    return connector
+
+
+# Registered connector implementations by type name
+CONNECTOR_TYPES = {
+    SqlServerConnector.connector_type: SqlServerConnector,
+    OracleConnector.connector_type: OracleConnector,
+    PostgresStagingTarget.connector_type: PostgresStagingTarget,
+    PostgresSourceConnector.connector_type: PostgresSourceConnector,
+    SqliteStagingTarget.connector_type: SqliteStagingTarget,
+    PostGISSourceConnector.connector_type: PostGISSourceConnector,
+    PostGISTarget.connector_type: PostGISTarget,
+    ArcGISFeatureSource.connector_type: ArcGISFeatureSource,
+    ArcGISFeatureTarget.connector_type: ArcGISFeatureTarget,
+    FileGDBSource.connector_type: FileGDBSource,
+    RestSource.connector_type: RestSource,
+    FileDropSource.connector_type: FileDropSource,
+    SnowflakeTarget.connector_type: SnowflakeTarget,
+    BigQueryTarget.connector_type: BigQueryTarget,
+}
+
+
+def create_connector(config: Dict[str, Any]):
+    """
+    Create a connector from its configuration.
+
+    Args:
+        config: Connector configuration with a "type" key
+
+    Returns:
+        SourceConnector or TargetConnector instance; targets with an
+        "encryption" block come wrapped in an EncryptedTarget. Every call
+        reaching the database goes through its circuit breaker, and
+        connections and source reads are retried (see guard_connector).
+        Database connectors draw their connections from a pool (see sync_pools)
+
+    Raises:
+        ValueError: If the connector type is not registered or its encryption, resilience or pool block is invalid
+    """
+    connector_type = config.get("type")
+    connector_class = CONNECTOR_TYPES.get(connector_type)
+    if connector_class is None:
+        raise ValueError(f"Unsupported connector type: {connector_type}. Supported types: {', '.join(CONNECTOR_TYPES)}")
+    if getattr(connector_class, "pool_family", None):
+        _pool_settings(config)
+    connector = connector_class(config)
+    if config.get("encryption"):
+        if not isinstance(connector, TargetConnector):
+            raise ValueError(f"Encryption is only supported on target connectors, not {connector_type}")
+        connector = EncryptedTarget(connector, config["encryption"])
+    return guard_connector(connector, config)
@@ -0,0 +1,266 @@
+"""
+TerraFusion SyncService - Dead-Letter Store
+
+This module provides the dead-letter store for records that fail individually
+during a sync: records rejected by a transform or validation hook (for example
+a field mapping that cannot convert a value) and records the target refuses
+with a data error. A failed record no longer aborts its batch; it is kept here
+with its source payload, the errors and its failure and retry counts, and the
+rest of the batch is loaded.
+
+Dead letters are keyed by sync pair, table and record key, so a record that
+fails again updates its existing entry. When the same record later syncs
+cleanly its entry is marked SUPERSEDED. Pending entries can be reprocessed
+(after fixing the mapping), discarded or exported, through the API or:
+
+    python sync_dead_letters.py list benton_wa_pacs_staging
+    python sync_dead_letters.py reprocess benton_wa_pacs_staging --table dbo.property
+    python sync_dead_letters.py export benton_wa_pacs_staging --format csv > dead_letters.csv
+"""
+
+import io
+import os
+import csv
+import sys
+import json
+import hashlib
+import logging
+import argparse
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+from sync_store import DocumentStore
+from sync_connectors import record_key, RESERVED_FIELDS, OPERATION_FIELD
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection for dead letters
+DEAD_LETTERS_COLLECTION = "dead_letters"
+
+# Dead-letter statuses
+DEAD_LETTER_STATUSES = ["PENDING", "REPROCESSED", "SUPERSEDED", "DISCARDED"]
+
+# Pipeline stage at which a record failed
+STAGE_MERGE = "merge"  # No match in a required merge source (see sync_merge)
+STAGE_TRANSFORM = "transform"
+STAGE_VALIDATE = "validate"
+STAGE_GEOMETRY = "geometry"  # A geometry that could not be repaired (see sync_geometry)
+STAGE_ADDRESS = "address"  # An address matched below its min_confidence (see sync_address)
+STAGE_LOAD = "load"
+
+# Supported export formats
+EXPORT_FORMATS = ["json", "csv"]
+
+
+def _json_safe(record: Dict[str, Any]) -> Dict[str, Any]:
+    """Round-trip a record through JSON so dates and decimals are stored as text."""
+    return json.loads(json.dumps(record, default=str))
+
+
+class DeadLetterStore:
+    """Persists records that failed individually during sync."""
+
+    def __init__(self, store: DocumentStore):
+        """
+        Initialize the dead-letter store.
+
+        Args:
+            store: Document store for persistence
+        """
+        self.store = store
+
+    def capture(self, job_id: str, sync_pair_id: str, table: Dict[str, Any],
+                record: Dict[str, Any], errors: List[str], stage: str) -> Dict[str, Any]:
+        """
+        Record a failed source record, or update its existing entry.
+
+        Args:
+            job_id: Job in which the record failed
+            sync_pair_id: Sync pair of the job
+            table: Source table definition
+            record: Source record as extracted (including its sync operation)
+            errors: Error messages
+            stage: STAGE_MERGE, STAGE_TRANSFORM, STAGE_VALIDATE, STAGE_GEOMETRY, STAGE_ADDRESS or STAGE_LOAD
+
+        Returns:
+            The dead-letter document
+        """
+        key = record_key(table["primary_key"], record)
+        dead_letter_id = self._dead_letter_id(sync_pair_id, table["name"], key)
+        now = datetime.utcnow().isoformat()
+        try:
+            letter = self.store.load(DEAD_LETTERS_COLLECTION, dead_letter_id)
+            if letter["status"] != "PENDING":
+                letter["retry_count"] = 0
+            letter["failure_count"] = letter.get("failure_count", 0) + 1
+        except FileNotFoundError:
+            letter = {
+                "dead_letter_id": dead_letter_id,
+                "sync_pair_id": sync_pair_id,
+                "table": table["name"],
+                "record_key": key,
+                "first_failed_at": now,
+                "failure_count": 1,
+                "retry_count": 0,
+            }
+        letter.update({
+            "status": "PENDING",
+            "stage": stage,
+            "errors": list(errors),
+            "operation": record.get(OPERATION_FIELD),
+            "payload": _json_safe({k: v for k, v in record.items() if k not in RESERVED_FIELDS}),
+            "job_id": job_id,
+            "last_failed_at": now,
+        })
+        self.store.save(DEAD_LETTERS_COLLECTION, dead_letter_id, letter)
+        return letter
+
+    def get(self, dead_letter_id: str) -> Dict[str, Any]:
+        """
+        Get a dead letter.
+
+        Raises:
+            FileNotFoundError: If the dead letter does not exist
+        """
+        try:
+            return self.store.load(DEAD_LETTERS_COLLECTION, dead_letter_id)
+        except FileNotFoundError:
+            raise FileNotFoundError(f"Dead letter {dead_letter_id} not found")
+
+    def list(self,
+             sync_pair_id: Optional[str] = None,
+             table_name: Optional[str] = None,
+             status: Optional[str] = None,
+             limit: int = 100) -> List[Dict[str, Any]]:
+        """List dead letters with optional filtering, most recent failure first."""
+        letters = []
+        for letter in self.store.list(DEAD_LETTERS_COLLECTION):
+            if sync_pair_id and letter.get("sync_pair_id") != sync_pair_id:
+                continue
+            if table_name and letter.get("table") != table_name:
+                continue
+            if status and letter.get("status") != status:
+                continue
+            letters.append(letter)
+        letters.sort(key=lambda d: d.get("last_failed_at", ""), reverse=True)
+        return letters[:limit]
+
+    def pending_keys(self, sync_pair_id: str, table_name: str) -> Dict[str, str]:
+        """Record keys of a table's pending dead letters, mapped to their IDs."""
+        pending = self.list(sync_pair_id, table_name, status="PENDING", limit=1_000_000)
+        return {letter["record_key"]: letter["dead_letter_id"] for letter in pending}
+
+    def source_record(self, letter: Dict[str, Any]) -> Dict[str, Any]:
+        """The stored payload as a source record ready to run through the pipeline again."""
+        record = dict(letter["payload"])
+        record[OPERATION_FIELD] = letter.get("operation") or "update"
+        return record
+
+    def mark(self, dead_letter_id: str, status: str, username: Optional[str] = None,
+             note: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Set the status of a dead letter.
+
+        Raises:
+            FileNotFoundError: If the dead letter does not exist
+            ValueError: If the status is not supported
+        """
+        if status not in DEAD_LETTER_STATUSES:
+            raise ValueError(f"Unsupported dead letter status: {status}. Supported statuses: {', '.join(DEAD_LETTER_STATUSES)}")
+        letter = self.get(dead_letter_id)
+        letter["status"] = status
+        letter["updated_at"] = datetime.utcnow().isoformat()
+        if username:
+            letter["updated_by"] = username
+        if note:
+            letter["note"] = note
+        self.store.save(DEAD_LETTERS_COLLECTION, dead_letter_id, letter)
+        return letter
+
+    def record_retry_failure(self, dead_letter_id: str, errors: List[str], stage: str) -> Dict[str, Any]:
+        """Count a failed reprocessing attempt."""
+        letter = self.get(dead_letter_id)
+        letter["retry_count"] = letter.get("retry_count", 0) + 1
+        letter["errors"] = list(errors)
+        letter["stage"] = stage
+        letter["last_retry_at"] = datetime.utcnow().isoformat()
+        self.store.save(DEAD_LETTERS_COLLECTION, dead_letter_id, letter)
+        return letter
+
+    def supersede(self, dead_letter_ids: List[str], job_id: str) -> None:
+        """Mark pending dead letters whose records have since synced cleanly."""
+        for dead_letter_id in dead_letter_ids:
+            self.mark(dead_letter_id, "SUPERSEDED", note=f"Record synced by job {job_id}")
+
+    def export(self, letters: List[Dict[str, Any]], export_format: str = "json") -> str:
+        """
+        Render dead letters for download.
+
+        Raises:
+            ValueError: If the format is not supported
+        """
+        if export_format == "json":
+            return json.dumps(letters, indent=2, default=str)
+        if export_format == "csv":
+            payload_columns = []
+            for letter in letters:
+                for column in letter.get("payload", {}):
+                    if column not in payload_columns:
+                        payload_columns.append(column)
+            output = io.StringIO()
+            writer = csv.writer(output)
+            header = ["dead_letter_id", "sync_pair_id", "table", "record_key", "status", "stage",
+                      "errors", "failure_count", "retry_count", "last_failed_at"]
+            writer.writerow(header + payload_columns)
+            for letter in letters:
+                row = [letter.get(c) for c in header]
+                row[header.index("errors")] = "; ".join(letter.get("errors", []))
+                writer.writerow(row + [letter.get("payload", {}).get(c) for c in payload_columns])
+            return output.getvalue()
+        raise ValueError(f"Unsupported export format: {export_format}. Supported formats: {', '.join(EXPORT_FORMATS)}")
+
+    @staticmethod
+    def _dead_letter_id(sync_pair_id: str, table_name: str, key: str) -> str:
+        digest = hashlib.sha1(key.encode("utf-8")).hexdigest()[:20]
+        return f"{sync_pair_id}__{table_name}__{digest}"
+
+
+def main():
+    """Command-line entry point for listing, reprocessing and exporting dead letters."""
+    parser = argparse.ArgumentParser(description="TerraFusion SyncService Dead Letters")
+    subparsers = parser.add_subparsers(dest="command", required=True)
+    for command in ("list", "reprocess", "export"):
+        sub = subparsers.add_parser(command)
+        sub.add_argument('sync_pair_id', help="Sync pair")
+        sub.add_argument('--table', help="Limit to one table")
+        if command == "export":
+            sub.add_argument('--format', choices=EXPORT_FORMATS, default="json", help="Export format")
+            sub.add_argument('--status', default="PENDING", help="Dead letter status to export")
+        if command == "reprocess":
+            sub.add_argument('--id', action='append', dest='ids', help="Dead letter to reprocess (repeatable)")
+            sub.add_argument('--username', default=os.environ.get('USER', 'cli'), help="Username recorded in the audit log")
+
+    args = parser.parse_args()
+
+    # Imported here because the engine itself uses this module
+    from sync_engine import sync_engine
+
+    if args.command == "list":
+        for letter in sync_engine.dead_letters.list(args.sync_pair_id, args.table, "PENDING", limit=1_000_000):
+            print(f"{letter['dead_letter_id']}  {letter['table']}  {letter['record_key']}  "
+                  f"{letter['stage']}  retries={letter['retry_count']}  {'; '.join(letter['errors'])}")
+        return 0
+    if args.command == "export":
+        letters = sync_engine.dead_letters.list(args.sync_pair_id, args.table, args.status, limit=1_000_000)
+        sys.stdout.write(sync_engine.dead_letters.export(letters, args.format))
+        return 0
+
+    summary = sync_engine.reprocess_dead_letters(args.sync_pair_id, args.username, args.table, args.ids)
+    print(json.dumps(summary, indent=2))
+    return 0 if summary["failed"] == 0 else 1
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,111 @@
+"""
+TerraFusion SyncService - Dry-Run Diff Reports
+
+This module provides the diff report produced by dry-run sync jobs. Instead of
+writing, each batch is compared with the rows currently in the target and
+classified as inserts, updates, deletes or unchanged rows, with a sample of
+changed fields, so assessors can review the impact of a sync before it is
+committed against the production roll.
+"""
+
+import logging
+from typing import Dict, List, Any, Optional
+
+from sync_connectors import record_key, OPERATION_FIELD, RESERVED_FIELDS
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Number of sample records kept per change type in each table report
+DIFF_SAMPLE_LIMIT = 20
+
+# Change types reported for each table
+DIFF_CHANGE_TYPES = ["inserts", "updates", "deletes"]
+
+
+def new_table_diff() -> Dict[str, Any]:
+    """Create an empty diff report for one table."""
+    return {
+        "inserts": 0,
+        "updates": 0,
+        "deletes": 0,
+        "unchanged": 0,
+        "changed_fields": {},
+        "samples": {change_type: [] for change_type in DIFF_CHANGE_TYPES}
+    }
+
+
+def json_value(value: Any) -> Any:
+    """Render a column value for the report."""
+    if value is None or isinstance(value, (str, int, float, bool)):
+        return value
+    return str(value)
+
+
+def values_equal(left: Any, right: Any) -> bool:
+    """Compare column values from the two systems, tolerating driver type differences."""
+    if left == right:
+        return True
+    if left is None or right is None:
+        return False
+    return str(left) == str(right)
+
+
+def diff_batch(table: Dict[str, Any], batch: List[Dict[str, Any]], existing: List[Dict[str, Any]],
+               report: Dict[str, Any], exclude: Optional[List[str]] = None) -> None:
+    """
+    Classify a batch against the current target rows and add it to a table report.
+
+    Args:
+        table: Table definition
+        batch: Records that would be written
+        existing: Current target rows for the batch's primary keys
+        report: Table report from new_table_diff(), updated in place
+        exclude: Additional columns to ignore when comparing (e.g. change timestamps)
+    """
+    primary_key = table["primary_key"]
+    current = {record_key(primary_key, row): row for row in existing}
+    skip = set(RESERVED_FIELDS) | set(exclude or [])
+
+    for record in batch:
+        key = record_key(primary_key, record)
+        row = current.get(key)
+
+        if record.get(OPERATION_FIELD) == "delete":
+            if row is None:
+                report["unchanged"] += 1
+                continue
+            change_type, sample = "deletes", {"key": [json_value(record.get(c)) for c in primary_key]}
+        elif row is None:
+            change_type = "inserts"
+            sample = {
+                "key": [json_value(record.get(c)) for c in primary_key],
+                "values": {c: json_value(v) for c, v in record.items() if c not in skip}
+            }
+        else:
+            changes = {
+                column: {"from": json_value(row.get(column)), "to": json_value(value)}
+                for column, value in record.items()
+                if column not in skip and not values_equal(row.get(column), value)
+            }
+            if not changes:
+                report["unchanged"] += 1
+                continue
+            for column in changes:
+                report["changed_fields"][column] = report["changed_fields"].get(column, 0) + 1
+            change_type = "updates"
+            sample = {"key": [json_value(record.get(c)) for c in primary_key], "changes": changes}
+
+        report[change_type] += 1
+        if len(report["samples"][change_type]) < DIFF_SAMPLE_LIMIT:
+            report["samples"][change_type].append(sample)
+
+
+def summarize(table_reports: Dict[str, Dict[str, Any]]) -> Dict[str, int]:
+    """Total the change counts across table reports."""
+    totals = {"inserts": 0, "updates": 0, "deletes": 0, "unchanged": 0}
+    for report in table_reports.values():
+        for name in totals:
+            totals[name] += report.get(name, 0)
+    return totals
@@ -0,0 +1,485 @@
+"""
+TerraFusion SyncService - Tax District Assignment
+
+This module assigns parcels to the taxing districts that contain them and
+reports the parcels whose districts changed, so the levy roll follows
+annexations and boundary adjustments. District boundaries and their levy
+rates sync into the staging tables of the tax_districts entity module (see
+sync_entities); the module adds a district_assignment hook to the sync
+pair's table of parcel shapes:
+
+    "tax_districts": {
+        "template": "generic",
+        "parcels": {"table": "dbo.property", "fields": ["prop_id"]},
+        "assignment": {"table": "gis.parcels", "key_field": "prop_id", "geometry_column": "shape"}
+    }
+
+After each batch of parcels is written, the hook tests the centroid of each
+parcel's shape against the synced district boundaries (see gis_spatial), so
+a parcel on a shared boundary falls in one district of a kind, and records
+the districts each parcel falls in. The table of parcel shapes syncs after
+the district tables, so parcels are assigned against the boundaries of the
+same job. Boundary changes move parcels whose shapes did not change, so
+after loading new boundaries a full reassignment re-tests every parcel on
+file:
+
+    POST /api/v1/sync/pairs/benton_wa_pacs_staging/district-assignments/reassign
+
+Each sync job that assigns parcels, and each reassignment, is a run. A run
+lists the parcels whose districts differ from those recorded before it,
+with the districts added and removed; the first run of a pair records the
+assignments without reporting them, and parcels new to the pair are counted
+rather than reported. The assignments and the last DISTRICT_RUNS_KEPT runs
+of each pair are kept in the state store. Dry runs assign nothing.
+"""
+
+import io
+import csv
+import json
+import uuid
+import logging
+import threading
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Tuple
+
+from sync_connectors import OPERATION_FIELD, keyset_after, create_connector
+from sync_hooks import TransformHook, HookContext, build_pipeline, register_hook
+from sync_store import DocumentStore, sync_state_store
+from gis_features import decode_geometry
+from gis_spatial import SpatialFilter, clip_polygons
+from roll_years import parse_roll_year
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Hook type the tax_districts module adds to the table of parcel shapes
+DISTRICT_ASSIGNMENT_HOOK = "district_assignment"
+
+# State store collection of the districts each parcel was last assigned, by sync pair ID
+DISTRICT_ASSIGNMENTS_COLLECTION = "district_assignments"
+
+# State store collection of assignment runs, by sync pair ID and run ID
+DISTRICT_RUNS_COLLECTION = "district_assignment_runs"
+
+# Assignment runs kept per sync pair
+DISTRICT_RUNS_KEPT = 20
+
+# Run ID naming a pair's most recent run
+LATEST_RUN = "latest"
+
+# Formats the changes of a run are exported in
+CHANGE_EXPORT_FORMATS = ["csv", "json"]
+
+# Columns of a change export, in order
+CHANGE_COLUMNS = ["parcel_id", "previous_districts", "districts", "added", "removed"]
+
+# Separator of the districts of a parcel in CSV exports
+DISTRICT_SEPARATOR = ";"
+
+# Parcels read at a time during a reassignment
+PARCELS_PER_READ = 1000
+
+_lock = threading.Lock()
+
+
+def _key(value: Any) -> str:
+    """A parcel key as text, so keys of numeric and text columns match."""
+    if isinstance(value, float) and value.is_integer():
+        value = int(value)
+    return str(value).strip()
+
+
+def _json_row(row: Dict[str, Any]) -> Dict[str, Any]:
+    converted = {}
+    for column, value in row.items():
+        if isinstance(value, (date, datetime)):
+            value = value.isoformat()
+        elif isinstance(value, Decimal):
+            value = float(value)
+        converted[column] = value
+    return converted
+
+
+class DistrictMap:
+    """The synced district boundaries, for assigning parcels to the districts containing them."""
+
+    def __init__(self, districts: Dict[str, SpatialFilter]):
+        self.districts = districts
+
+    @classmethod
+    def load(cls, target, table: Dict[str, Any], boundary_column: str = "boundary") -> "DistrictMap":
+        """
+        Read the district boundaries from the target.
+
+        A district stored as several rows (one per tax year, say) is the
+        union of their boundaries. Rows without a polygon boundary are
+        skipped.
+
+        Raises:
+            ConnectorError: If the table cannot be read
+        """
+        polygons: Dict[str, Tuple[List[Any], Optional[int]]] = {}
+        skipped = 0
+        for row in target.query_records(table, None, ["district_id", boundary_column]):
+            try:
+                geometry, srid = decode_geometry(row.get(boundary_column))
+            except ValueError:
+                geometry, srid = None, None
+            if row.get("district_id") is None or not geometry or geometry["type"] not in ("Polygon", "MultiPolygon"):
+                skipped += 1
+                continue
+            district_id = _key(row["district_id"])
+            shapes, known_srid = polygons.get(district_id, ([], None))
+            polygons[district_id] = (shapes + clip_polygons(geometry, f"District {district_id}"), known_srid or srid)
+        if skipped:
+            logger.warning(f"Skipped {skipped} districts of {table.get('target_table') or table['name']} "
+                           f"without a polygon boundary")
+        return cls({district_id: SpatialFilter(shapes, srid, "centroid", f"district {district_id}")
+                    for district_id, (shapes, srid) in polygons.items()})
+
+    def assign(self, geometry: Optional[Dict[str, Any]], srid: Optional[int] = None) -> List[str]:
+        """
+        The districts a parcel's centroid falls in, sorted.
+
+        Raises:
+            ValueError: If a boundary cannot be reprojected to the parcel's CRS
+        """
+        return sorted(district_id for district_id, area in self.districts.items() if area.matches(geometry, srid))
+
+    def assign_record(self, record: Dict[str, Any], column: str) -> Optional[List[str]]:
+        """The districts of a record's shape; None when it has no geometry."""
+        try:
+            geometry, srid = decode_geometry(record.get(column))
+        except ValueError:
+            return None
+        if not geometry:
+            return None
+        return self.assign(geometry, srid)
+
+
+def record_assignments(store: DocumentStore, sync_pair_id: str, run_id: str, kind: str,
+                       assigned: Dict[str, List[str]], removed: Optional[List[str]] = None,
+                       complete: bool = False) -> Dict[str, Any]:
+    """
+    Record the districts of some parcels as part of a run, noting changes.
+
+    A run recorded in parts (the batches of a sync job) accumulates; a
+    parcel that changes twice in a run is reported once, from its districts
+    before the run.
+
+    Args:
+        store: State store
+        sync_pair_id: Sync pair of the parcels
+        run_id: Run the assignments belong to: a sync job ID or a reassignment ID
+        kind: "sync" or "reassignment"
+        assigned: Districts of each parcel, by parcel key
+        removed: Parcels deleted from the pair, whose assignments are forgotten
+        complete: Whether assigned covers every parcel on file, so parcels
+            missing from it are forgotten too
+
+    Returns:
+        The run, without its changes
+    """
+    now = datetime.utcnow().isoformat()
+    with _lock:
+        try:
+            state = store.load(DISTRICT_ASSIGNMENTS_COLLECTION, sync_pair_id)
+        except FileNotFoundError:
+            state = None
+        assignments = dict((state or {}).get("assignments") or {})
+        # The assignments of a pair's first run are not news, in any batch of it
+        first_run = state["first_run_id"] if state else run_id
+        run_key = f"{sync_pair_id}:{run_id}"
+        try:
+            run = store.load(DISTRICT_RUNS_COLLECTION, run_key)
+        except FileNotFoundError:
+            run = {
+                "run_id": run_id, "sync_pair_id": sync_pair_id, "kind": kind, "baseline": run_id == first_run,
+                "started_at": now, "parcels": 0, "unassigned": 0, "new_parcels": 0, "changed": 0, "changes": [],
+            }
+            _prune_runs(store, sync_pair_id)
+        changes = {change["parcel_id"]: change for change in run["changes"]}
+
+        for parcel_id in removed or []:
+            assignments.pop(parcel_id, None)
+        if complete:
+            assignments = {parcel_id: districts for parcel_id, districts in assignments.items() if parcel_id in assigned}
+        for parcel_id, districts in assigned.items():
+            run["parcels"] += 1
+            if not districts:
+                run["unassigned"] += 1
+            # A parcel changed earlier in the run is compared with its districts before the run
+            previous = changes[parcel_id]["previous_districts"] if parcel_id in changes else assignments.get(parcel_id)
+            assignments[parcel_id] = districts
+            if run["baseline"]:
+                continue
+            if previous is None:
+                run["new_parcels"] += 1
+            elif districts == previous:
+                changes.pop(parcel_id, None)
+            else:
+                changes[parcel_id] = {
+                    "parcel_id": parcel_id,
+                    "previous_districts": previous,
+                    "districts": districts,
+                    "added": [d for d in districts if d not in previous],
+                    "removed": [d for d in previous if d not in districts],
+                }
+
+        run["changes"] = sorted(changes.values(), key=lambda change: change["parcel_id"])
+        run["changed"] = len(run["changes"])
+        run["updated_at"] = now
+        store.save(DISTRICT_RUNS_COLLECTION, run_key, run)
+        store.save(DISTRICT_ASSIGNMENTS_COLLECTION, sync_pair_id, {
+            "sync_pair_id": sync_pair_id,
+            "assignments": assignments,
+            "first_run_id": first_run,
+            "updated_at": now,
+        })
+    return _run_summary(run)
+
+
+def _prune_runs(store: DocumentStore, sync_pair_id: str) -> None:
+    runs = sorted((run for run in store.list(DISTRICT_RUNS_COLLECTION) if run.get("sync_pair_id") == sync_pair_id),
+                  key=lambda run: run.get("started_at") or "")
+    for run in runs[:max(len(runs) - DISTRICT_RUNS_KEPT + 1, 0)]:
+        store.delete(DISTRICT_RUNS_COLLECTION, f"{sync_pair_id}:{run['run_id']}")
+
+
+def _run_summary(run: Dict[str, Any]) -> Dict[str, Any]:
+    return {name: value for name, value in run.items() if name != "changes"}
+
+
+@register_hook(DISTRICT_ASSIGNMENT_HOOK)
+class DistrictAssignmentHook(TransformHook):
+    """
+    Assigns the parcels a batch wrote to the districts containing them.
+
+    Options:
+        districts: Table definition of the tax_districts staging table (required)
+        key_field: Column of the parcel key (required)
+        geometry_column: Column of the parcel's shape (required)
+        boundary_column: Column of a district's boundary, default "boundary"
+    """
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None, store: Optional[DocumentStore] = None):
+        super().__init__(options)
+        for name in ("districts", "key_field", "geometry_column"):
+            if not self.options.get(name):
+                raise ValueError(f"district_assignment hook requires a '{name}' option")
+        self.store = store or sync_state_store
+        self.target = None
+        self.district_map: Optional[DistrictMap] = None
+
+    def bind(self, target) -> "DistrictAssignmentHook":
+        self.target = target
+        self.district_map = None
+        return self
+
+    def after_load(self, records: List[Dict[str, Any]], counts: Dict[str, int], context: HookContext) -> None:
+        if context.dry_run or not records or self.target is None:
+            return
+        if self.district_map is None:
+            # Read once per run of the table, after the district tables it depends on have loaded
+            self.district_map = DistrictMap.load(self.target, self.options["districts"],
+                                                 self.options.get("boundary_column", "boundary"))
+        if not self.district_map.districts:
+            logger.warning(f"Sync pair {context.sync_pair_id} has no district boundaries synced; "
+                           f"parcels of {context.table['name']} are not assigned")
+            return
+        key_field, column = self.options["key_field"], self.options["geometry_column"]
+        assigned, removed = {}, []
+        for record in records:
+            if record.get(key_field) is None:
+                continue
+            parcel_id = _key(record[key_field])
+            if record.get(OPERATION_FIELD) == "delete":
+                removed.append(parcel_id)
+                continue
+            try:
+                districts = self.district_map.assign_record(record, column)
+            except ValueError as e:
+                logger.warning(f"Cannot assign parcel {parcel_id} of {context.table['name']} to districts: {e}")
+                continue
+            if districts is not None:
+                assigned[parcel_id] = districts
+        if assigned or removed:
+            run = record_assignments(self.store, context.sync_pair_id, context.job_id, "sync", assigned, removed)
+            logger.info(f"Assigned {len(assigned)} parcels of sync pair {context.sync_pair_id} to districts "
+                        f"({run['changed']} changed in job {context.job_id} so far)")
+
+
+class DistrictAssignmentService:
+    """Runs reassignments and reports the parcels whose districts changed."""
+
+    def __init__(self, registry, store: Optional[DocumentStore] = None):
+        self.registry = registry
+        self.store = store or sync_state_store
+
+    def list_runs(self, sync_pair_id: str) -> List[Dict[str, Any]]:
+        """
+        The assignment runs kept for a sync pair, without their changes.
+
+        Raises:
+            KeyError: If the sync pair is unknown or has no tax_districts module
+        """
+        self._settings(sync_pair_id)
+        return [_run_summary(run) for run in self.store.list(DISTRICT_RUNS_COLLECTION)
+                if run.get("sync_pair_id") == sync_pair_id]
+
+    def get_changes(self, sync_pair_id: str, run_id: str,
+                    district_id: Optional[str] = None) -> Tuple[Dict[str, Any], List[Dict[str, Any]]]:
+        """
+        A run and the parcels whose districts it changed.
+
+        Args:
+            sync_pair_id: Sync pair ID
+            run_id: Run ID, or LATEST_RUN for the pair's most recent run
+            district_id: Only parcels that joined or left this district
+
+        Raises:
+            KeyError: If the sync pair or the run is unknown
+        """
+        self._settings(sync_pair_id)
+        if run_id == LATEST_RUN:
+            runs = sorted(self.list_runs(sync_pair_id), key=lambda r: (r.get("started_at") or "", r["run_id"]))
+            if not runs:
+                raise KeyError(f"Sync pair {sync_pair_id} has no district assignment runs")
+            run_id = runs[-1]["run_id"]
+        try:
+            run = self.store.load(DISTRICT_RUNS_COLLECTION, f"{sync_pair_id}:{run_id}")
+        except FileNotFoundError:
+            raise KeyError(f"District assignment run {run_id} not found in sync pair {sync_pair_id}")
+        changes = run["changes"]
+        if district_id is not None:
+            changes = [c for c in changes if district_id in c["added"] or district_id in c["removed"]]
+        return _run_summary(run), changes
+
+    def export_changes(self, changes: List[Dict[str, Any]], export_format: str = "csv") -> str:
+        """
+        Render the changes of a run for download.
+
+        Raises:
+            ValueError: If the format is not supported
+        """
+        if export_format == "json":
+            return json.dumps(changes, indent=2)
+        if export_format == "csv":
+            output = io.StringIO()
+            writer = csv.writer(output)
+            writer.writerow(CHANGE_COLUMNS)
+            for change in changes:
+                writer.writerow([change["parcel_id"]] + [DISTRICT_SEPARATOR.join(change[c]) for c in CHANGE_COLUMNS[1:]])
+            return output.getvalue()
+        raise ValueError(f"Unsupported export format: {export_format}. "
+                         f"Supported formats: {', '.join(CHANGE_EXPORT_FORMATS)}")
+
+    def reassign(self, sync_pair_id: str) -> Dict[str, Any]:
+        """
+        Re-test every parcel on file against the current district boundaries.
+
+        Returns:
+            The run, without its changes
+
+        Raises:
+            KeyError: If the sync pair is unknown or has no tax_districts module
+            ValueError: If no district boundaries are synced
+            ConnectorError: If the target cannot be read
+        """
+        pair, settings = self._settings(sync_pair_id)
+        assignment = settings["assignment"]
+        key_field, column = assignment["key_field"], assignment["geometry_column"]
+        parcels = self._table_def(pair, assignment["table"])
+        assigned: Dict[str, List[str]] = {}
+        with create_connector(pair.target) as target:
+            district_map = DistrictMap.load(target, self._table_def(pair, settings["tables"]["tax_districts"]["table"]))
+            if not district_map.districts:
+                raise ValueError(f"Sync pair {sync_pair_id} has no district boundaries synced")
+            after = None
+            while True:
+                where = keyset_after([key_field], [after]) if after is not None else None
+                rows = target.query_records(parcels, where, [key_field, column], order_by=[(key_field, False)],
+                                            limit=PARCELS_PER_READ)
+                for row in rows:
+                    if row.get(key_field) is None:
+                        continue
+                    districts = district_map.assign_record(row, column)
+                    if districts is not None:
+                        assigned[_key(row[key_field])] = districts
+                if len(rows) < PARCELS_PER_READ:
+                    break
+                after = rows[-1][key_field]
+        run = record_assignments(self.store, sync_pair_id, str(uuid.uuid4()), "reassignment", assigned, complete=True)
+        logger.info(f"Reassigned {run['parcels']} parcels of sync pair {sync_pair_id} to "
+                    f"{len(district_map.districts)} districts: {run['changed']} changed")
+        return run
+
+    def parcel_districts(self, sync_pair_id: str, parcel_id: str, tax_year: Any = None) -> Dict[str, Any]:
+        """
+        The districts a parcel is assigned to, with their levy rates.
+
+        Args:
+            sync_pair_id: Sync pair ID
+            parcel_id: Parcel key
+            tax_year: Year of the levy rates; the latest year each district has by default
+
+        Raises:
+            KeyError: If the sync pair is unknown or the parcel has not been assigned
+            ValueError: If the tax year is invalid
+            ConnectorError: If the target cannot be read
+        """
+        pair, settings = self._settings(sync_pair_id)
+        tax_year = parse_roll_year(tax_year, "tax_year") if tax_year is not None else None
+        try:
+            state = self.store.load(DISTRICT_ASSIGNMENTS_COLLECTION, sync_pair_id)
+        except FileNotFoundError:
+            state = {}
+        district_ids = (state.get("assignments") or {}).get(_key(parcel_id))
+        if district_ids is None:
+            raise KeyError(f"Parcel {parcel_id} of sync pair {sync_pair_id} has not been assigned to districts")
+        districts, rates = {}, {}
+        if district_ids:
+            with create_connector(pair.target) as target:
+                lookup = ("in", ("field", "district_id"), list(district_ids))
+                district_def = self._table_def(pair, settings["tables"]["tax_districts"]["table"])
+                for row in target.query_records(district_def, lookup, ["district_id", "district_name", "district_type"]):
+                    districts.setdefault(_key(row["district_id"]), row)
+                where = lookup if tax_year is None else \
+                    ("and", lookup, ("compare", "=", ("field", "tax_year"), ("literal", tax_year)))
+                rate_def = self._table_def(pair, settings["tables"]["levy_rates"]["table"])
+                for row in target.query_records(rate_def, where):
+                    rates.setdefault(_key(row["district_id"]), []).append(_json_row(row))
+        total = Decimal(0)
+        listed = []
+        for district_id in district_ids:
+            levies = rates.get(district_id, [])
+            if tax_year is None and levies:
+                latest = max(levy.get("tax_year") or 0 for levy in levies)
+                levies = [levy for levy in levies if (levy.get("tax_year") or 0) == latest]
+            rate = sum(Decimal(str(levy["levy_rate"])) for levy in levies if levy.get("levy_rate") is not None)
+            total += rate
+            row = districts.get(district_id, {})
+            listed.append({
+                "district_id": district_id,
+                "district_name": row.get("district_name"),
+                "district_type": row.get("district_type"),
+                "levies": sorted(levies, key=lambda levy: str(levy.get("levy_code"))),
+                "levy_rate": float(rate),
+            })
+        return {"sync_pair_id": sync_pair_id, "parcel_id": _key(parcel_id), "tax_year": tax_year,
+                "districts": listed, "levy_rate": float(total)}
+
+    # Helpers ----------------------------------------------------------------
+
+    def _settings(self, sync_pair_id: str):
+        pair = self.registry.get(sync_pair_id)
+        settings = pair.entities.get("tax_districts")
+        if not settings:
+            raise KeyError(f"Sync pair {sync_pair_id} has no tax_districts entity module")
+        return pair, settings
+
+    @staticmethod
+    def _table_def(pair, name: str) -> Dict[str, Any]:
+        return build_pipeline(pair.hooks, name).target_table(pair.get_table(name).to_dict())
@@ -0,0 +1,2463 @@
+"""
+TerraFusion SyncService - Sync Engine
+
+This module provides the sync engine that moves data from county source
+systems into the TerraFusion staging store.
+
+Two modes are supported:
+- full: every row of each table is read and upserted
+- incremental: only rows changed since the table's last successful sync are
+  read, using SQL Server change tracking or a rowversion column. The change
+  version reached by each table is persisted as a watermark.
+
+Bidirectional sync pairs additionally read edits made in the staging store
+and push them back to the source; records edited on both sides are handled
+by the pair's conflict strategy (see sync_conflicts).
+
+After every committed batch the job record stores a checkpoint for the table
+in progress, so a failed, paused or cancelled job can be resumed where it
+stopped. Running jobs can be paused or cancelled; the request is checked
+between batches through extract, transform and load (see sync_control).
+
+Records pass through the sync pair's transform hooks (see sync_hooks) between
+extract and load.
+
+Tables run on a worker pool sized by the connectors' max_workers settings;
+a table starts only after the tables it depends_on have completed.
+
+Dry-run jobs read and compare everything but write nothing: each table gets a
+diff report (see sync_diff) and watermarks are left untouched.
+
+Records that fail on their own (rejected by a hook, or refused by the target
+with a data error) are kept in the dead-letter store (see sync_dead_letters)
+while the rest of their batch is loaded.
+
+Records that break the sync pair's validation rules are written to a
+quarantine table in the target instead (see sync_validation).
+
+Tables in a sync pair's "address_standardization" block have their addresses
+parsed into standard components, and optionally geocoded, as they are loaded
+(see sync_address).
+
+Merge sync pairs join columns from secondary sources into each record before
+it is transformed (see sync_merge). Each secondary source has its own
+watermark, and its changes re-sync the primary records they join to.
+
+A job's parameters.spatial_filter limits it to a bounding box, tax district
+or clip geometry (see gis_spatial); records outside the area are skipped and
+counted as records_outside_area.
+
+Tables in a sync pair's "topology_qa" block are checked for parcel gaps,
+overlaps, duplicates and district crossings after each job that changes them
+(see sync_topology); the issues found go on a reviewable list.
+
+Tables in a sync pair's "anomalies" block have the rows each batch replaces
+compared with what it writes, flagging value swings beyond their bands, mass
+ownership changes and reclassification spikes for review (see sync_anomalies).
+
+Sync pairs whose exemptions module has an "audit" block score the exemptions
+against its risk rules after each job that changes them, their owners or the
+death records, for the auditors' worklist (see sync_exemption_audit).
+
+Sync pairs with an "events" block publish a change event for every record a
+committed batch inserts, updates or deletes (see sync_events).
+
+Sync pairs with an "ingestion" block also accept records pushed by county
+systems (see sync_ingest); each push runs as a "push" job through the same
+filters, hooks, validation and dead-letter store, on the request's thread.
+
+Sync pairs with a "roll_years" block load the open assessment roll year into
+their staging tables; each job records it as roll_year, and roll_over()
+certifies the year into tables of its own and opens the next (see roll_years).
+
+Job lifecycle changes (created, started, completed, failed, paused, cancelled,
+preempted) are announced on the internal event bus (see event_bus), along with
+a "progress" event after committed batches for live progress bars (see
+sync_progress), and pause
+and cancel requests are broadcast on it so they reach the node running the
+job at once rather than at its next poll of the state store.
+
+Usage:
+    python sync_engine.py benton_wa_pacs_staging --mode full --table dbo.property --dry-run
+"""
+
+import os
+import sys
+import json
+import uuid
+import logging
+import argparse
+import time
+import threading
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Tuple, Iterator, Callable
+
+from sync_store import DocumentStore, sync_state_store
+from sync_pairs import SyncPairConfig, SyncTableConfig, SyncPairRegistry, sync_pair_registry
+from sync_connectors import create_connector, record_key, WatermarkExpiredError, OPERATION_FIELD, VERSION_FIELD
+from sync_diff import new_table_diff, diff_batch, summarize
+from sync_workers import SyncWorkerPool, worker_count
+from sync_hooks import HookContext, HookPipeline, build_pipeline, record_rejections
+from sync_filters import RecordFilter, build_filter
+from sync_idempotency import IdempotencyKeys, build_idempotency
+from sync_lineage import LineageStamper, build_lineage
+from sync_events import ChangeEventEmitter, build_emitter
+from sync_anomalies import AnomalyDetector, build_detector
+from sync_exemption_audit import ExemptionAuditService
+from sync_throttle import source_throttle, throttled
+from sync_control import (
+    JobControl, checked, control_request, SyncJobCancelled, SyncJobPaused, SyncJobPreempted,
+    TERMINAL_STATUSES, RUNNING_STATUSES
+)
+from sync_merge import MergePlan, build_merge_plan, merges_table, PRIMARY_SOURCE_NAME, MERGE_WATERMARK_METHOD
+from sync_validation import build_validator, STAGE_QUARANTINE
+from sync_lookups import lookup_cache
+from sync_columnar import ColumnBatch, COLUMNAR_ENABLED
+from sync_geometry import build_geometry_repairer
+from sync_address import build_address_standardizer, normalize_text
+from sync_topology import TopologyChecker, TopologyIssueStore, qa_layer
+from gis_features import LayerReader, county_export_settings
+from gis_spatial import DistrictRegions, SpatialFilter, build_spatial_filter, parse_spatial_filter
+from sync_conflicts import (
+    ConflictStore, FingerprintStore, choose_winner, record_fingerprint, conflict_diff, merge_records,
+    CONFLICT_STRATEGIES, WINNER_MANUAL, WINNER_SOURCE, WINNER_TARGET, WINNER_MERGE
+)
+from audit_log import AuditLog
+from sync_snapshots import SnapshotManager, SyncValidationFailed
+from roll_years import RollYearManager
+from sync_dead_letters import DeadLetterStore, STAGE_LOAD, STAGE_MERGE
+from event_bus import EventBus, EventBusError, event_bus, SUBJECT_SYNC_JOB, SUBJECT_SYNC_CONTROL
+from sync_progress import progress_summary
+from metrics import SYNC_ROWS_READ, SYNC_ROWS_WRITTEN, SYNC_JOBS, SYNC_JOB_DURATION, ERRORS
+from tracing import tracer
+from logging_config import log_context, log_fields, configure_structured_logging
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Supported sync modes
+SYNC_MODES = ["full", "incremental"]
+
+# Mode of jobs loading pushed records (see ingest_records); not a mode sync jobs can be created with
+PUSH_MODE = "push"
+
+# Job priorities, lowest first
+JOB_PRIORITIES = ["low", "normal", "high", "urgent"]
+
+# Preemption requester of jobs yielding their worker because the service is stopping (see SyncJobQueue.drain)
+SHUTDOWN_PREEMPTION = "shutdown"
+
+# State store collections
+JOBS_COLLECTION = "sync_jobs"
+WATERMARKS_COLLECTION = "watermarks"
+
+# Lifecycle event announced on the event bus when a job finishes with a status
+JOB_STATUS_EVENTS = {
+    "COMPLETED": "completed",
+    "FAILED": "failed",
+    "PAUSED": "paused",
+    "CANCELLED": "cancelled",
+    "PENDING": "preempted",
+}
+
+# Least seconds between two progress events of a job
+PROGRESS_EVENT_SECONDS = float(os.environ.get("SYNC_PROGRESS_EVENT_SECONDS", "1"))
+
+
+class WatermarkStore:
+    """
+    Persists the last successfully synced change version for each table.
+
+    Watermarks are only advanced after every batch of a table has been
+    written, so a failed run is simply re-read from the previous watermark.
+    """
+
+    def __init__(self, store: DocumentStore):
+        """
+        Initialize the watermark store.
+
+        Args:
+            store: Document store for persistence
+        """
+        self.store = store
+        # Watermarks for all tables of a pair share one document
+        self._lock = threading.Lock()
+
+    def get(self, sync_pair_id: str, table_name: str) -> Optional[Dict[str, Any]]:
+        """Get the watermark for a table, or None if the table has never synced."""
+        return self._load(sync_pair_id)["tables"].get(table_name)
+
+    def set(self, sync_pair_id: str, table_name: str, version: Any, method: str, job_id: str) -> Dict[str, Any]:
+        """Record the change version a table has been synced up to."""
+        watermark = {
+            "version": version,
+            "method": method,
+            "job_id": job_id,
+            "updated_at": datetime.utcnow().isoformat()
+        }
+        with self._lock:
+            document = self._load(sync_pair_id)
+            document["tables"][table_name] = watermark
+            self.store.save(WATERMARKS_COLLECTION, sync_pair_id, document)
+        return watermark
+
+    def reset(self, sync_pair_id: str, table_name: Optional[str] = None) -> None:
+        """Clear watermarks so the next run re-reads the table(s) in full."""
+        with self._lock:
+            document = self._load(sync_pair_id)
+            if table_name:
+                document["tables"].pop(table_name, None)
+            else:
+                document["tables"] = {}
+            self.store.save(WATERMARKS_COLLECTION, sync_pair_id, document)
+
+    def restore(self, sync_pair_id: str, table_name: str, watermark: Optional[Dict[str, Any]]) -> None:
+        """Put back a previously read watermark (None clears it)."""
+        with self._lock:
+            document = self._load(sync_pair_id)
+            if watermark is None:
+                document["tables"].pop(table_name, None)
+            else:
+                document["tables"][table_name] = watermark
+            self.store.save(WATERMARKS_COLLECTION, sync_pair_id, document)
+
+    def list(self, sync_pair_id: str) -> Dict[str, Any]:
+        """Get all table watermarks for a sync pair."""
+        return self._load(sync_pair_id)["tables"]
+
+    def _load(self, sync_pair_id: str) -> Dict[str, Any]:
+        try:
+            return self.store.load(WATERMARKS_COLLECTION, sync_pair_id)
+        except FileNotFoundError:
+            return {"sync_pair_id": sync_pair_id, "tables": {}}
+
+
+def _preempted_by(requested_by: str) -> str:
+    """What a preemption was requested for, for job messages."""
+    return "the service stopping" if requested_by == SHUTDOWN_PREEMPTION else f"job {requested_by}"
+
+
+class SyncEngine:
+    """
+    Service class for running sync jobs.
+
+    A sync job reads the tables of a sync pair from its source connector and
+    writes them to its target connector, table by table, in batches.
+    """
+
+    def __init__(self, store: Optional[DocumentStore] = None, registry: Optional[SyncPairRegistry] = None,
+                 bus: Optional[EventBus] = None):
+        """
+        Initialize the sync engine.
+
+        Args:
+            store: Document store for job records and watermarks
+            registry: Sync pair registry
+            bus: Event bus for job lifecycle events and control requests
+        """
+        self.store = store or sync_state_store
+        self.registry = registry or sync_pair_registry
+        self.bus = bus or event_bus
+        self.watermarks = WatermarkStore(self.store)
+        self.conflicts = ConflictStore(self.store)
+        self.fingerprints = FingerprintStore(self.store)
+        self.audit_log = AuditLog(self.store)
+        self.snapshots = SnapshotManager(self.store, self.registry, self.watermarks, self.audit_log)
+        self.roll_years = RollYearManager(self.store, self.audit_log)
+        self.dead_letters = DeadLetterStore(self.store)
+        self.topology_issues = TopologyIssueStore(self.store)
+        self.exemption_audit = ExemptionAuditService(self.registry, self.store)
+        # Guards job records while several workers update the same job
+        self._job_lock = threading.RLock()
+        # Records and controls of the jobs running in this process, by job ID
+        self._running: Dict[str, Tuple[Dict[str, Any], JobControl]] = {}
+        # When each running job last announced its progress (time.monotonic)
+        self._progress_announced: Dict[str, float] = {}
+        try:
+            self.bus.subscribe(SUBJECT_SYNC_CONTROL.format(job_id="*"), self._on_control_request)
+        except EventBusError as e:
+            # Requests still arrive through the job record, within CONTROL_POLL_SECONDS
+            logger.warning(f"Cannot subscribe to sync job control requests: {e}")
+        logger.info("Sync engine initialized")
+
+    def create_sync_job(self,
+                        sync_pair_id: str,
+                        username: str,
+                        mode: Optional[str] = None,
+                        tables: Optional[List[str]] = None,
+                        parameters: Optional[Dict[str, Any]] = None,
+                        dry_run: bool = False,
+                        priority: str = "normal") -> Dict[str, Any]:
+        """
+        Create a new sync job.
+
+        Args:
+            sync_pair_id: Sync pair to run
+            username: Username of the requester
+            mode: "full" or "incremental"; defaults to the sync pair's default_mode
+            tables: Subset of table names to sync; defaults to all tables
+            parameters: Additional parameters for the job
+            dry_run: Compare against the target and report a diff instead of writing
+            priority: Queue priority, one of JOB_PRIORITIES
+
+        Returns:
+            Dictionary with job details including the job_id
+
+        Raises:
+            KeyError: If the sync pair or a table is not configured
+            ValueError: If the mode or priority is not supported, or a table is push_only
+            tenant_quotas.QuotaExceeded: If the county has its max_queued_sync_jobs pending or running
+        """
+        if priority not in JOB_PRIORITIES:
+            raise ValueError(f"Unsupported job priority: {priority}. Supported priorities: {', '.join(JOB_PRIORITIES)}")
+        pair = self.registry.get(sync_pair_id)
+        mode = (mode or pair.default_mode).lower()
+        if mode not in SYNC_MODES:
+            raise ValueError(f"Unsupported sync mode: {mode}. Supported modes: {', '.join(SYNC_MODES)}")
+
+        # Push-only tables are loaded by pushes (see sync_ingest), never read from the source
+        table_names = tables or [t.name for t in pair.tables if not t.push_only]
+        for name in table_names:
+            if pair.get_table(name).push_only:
+                raise ValueError(f"Table {name} of sync pair {sync_pair_id} is push_only; push its records instead")
+        if not table_names:
+            raise ValueError(f"Sync pair {sync_pair_id} has only push_only tables; push their records instead")
+
+        strategy = (parameters or {}).get("conflict_strategy")
+        if strategy and strategy not in CONFLICT_STRATEGIES:
+            raise ValueError(f"Unsupported conflict strategy: {strategy}. Supported strategies: {', '.join(CONFLICT_STRATEGIES)}")
+        if (parameters or {}).get("spatial_filter") is not None:
+            if pair.direction == "bidirectional":
+                raise ValueError("Bidirectional sync pairs cannot be limited to an area")
+            spec = parse_spatial_filter(parameters["spatial_filter"], for_sync=True)
+            unknown = [name for name in spec["tables"] or [] if name not in table_names]
+            if unknown:
+                raise ValueError(f"parameters.spatial_filter names tables not in the job: {', '.join(unknown)}")
+            # Resolves a named district now, so a misspelled one fails before the job is queued
+            self._spatial_filter(pair, parameters)
+
+        # Imported here: tenant_quotas imports load_shedding, which imports this module
+        from tenant_quotas import tenant_quotas
+        if tenant_quotas.quotas(pair.county_id)["max_queued_sync_jobs"]:
+            active = sum(1 for j in self.store.list(JOBS_COLLECTION) if j.get("county_id") == pair.county_id
+                         and j.get("status") in ["PENDING"] + RUNNING_STATUSES)
+            tenant_quotas.check(pair.county_id, "max_queued_sync_jobs", active)
+
+        job = self._job_record(pair, username, mode, table_names, parameters or {}, dry_run, priority)
+        job["roll_year"] = self.roll_years.current_year(pair)
+        self._save_job(job)
+        self._announce(job, "created")
+        logger.info(f"Created {mode} {'dry-run ' if dry_run else ''}sync job {job['job_id']} for sync pair {sync_pair_id}")
+        return job
+
+    @staticmethod
+    def _job_record(pair: SyncPairConfig, username: str, mode: str, table_names: List[str],
+                    parameters: Dict[str, Any], dry_run: bool, priority: str) -> Dict[str, Any]:
+        """A new pending job record."""
+        return {
+            "job_id": str(uuid.uuid4()),
+            "sync_pair_id": pair.sync_pair_id,
+            "county_id": pair.county_id,
+            "username": username,
+            "mode": mode,
+            "dry_run": dry_run,
+            "priority": priority,
+            "tables": table_names,
+            "parameters": parameters,
+            "source_system": pair.source.get("type"),
+            "target_system": pair.target.get("type"),
+            "status": "PENDING",
+            "created_at": datetime.utcnow().isoformat(),
+            "started_at": None,
+            "completed_at": None,
+            "table_results": {},
+            "checkpoints": {},
+            "resume_count": 0,
+            "stats": {"records_processed": 0, "records_written": 0, "records_unchanged": 0, "errors": 0},
+            # The request that created the job, so its run joins the request's trace and logs its ID
+            "trace_context": tracer.carrier(),
+            "request_id": log_fields().get("request_id"),
+            "message": "Sync job created and pending processing."
+        }
+
+    def ingest_records(self, sync_pair_id: str, table_name: str, batches: Iterator[List[Dict[str, Any]]],
+                       username: str, dry_run: bool = False,
+                       on_batch: Optional[Callable[[List[Dict[str, Any]], List[Dict[str, Any]], List[Dict[str, Any]]], None]] = None
+                       ) -> Dict[str, Any]:
+        """
+        Load batches of records pushed to the gateway into one table of a sync pair.
+
+        The records take the path of a sync's source batches: filters, merge
+        sources, idempotency keys, lineage, hooks and field mappings,
+        validation rules (quarantine), dead-lettering and change events. The
+        push is recorded as a job in PUSH_MODE, run at once on the caller's
+        thread; it has no checkpoints and cannot be paused, cancelled or
+        resumed, since the client holds the records.
+
+        Args:
+            sync_pair_id: Sync pair whose target receives the records
+            table_name: Table of the sync pair the records belong to
+            batches: Batches of records, as extracted from a source
+            username: User or service pushing the records
+            dry_run: Compare against the target and report a diff instead of writing
+            on_batch: Called after each batch with the batch, the records
+                that passed the filters and the rejected records
+
+        Returns:
+            The finished job record; FAILED when the batches or the target raised
+
+        Raises:
+            KeyError: If the sync pair or table is not configured
+        """
+        pair = self.registry.get(sync_pair_id)
+        table = pair.get_table(table_name)
+        job = self._job_record(pair, username, PUSH_MODE, [table_name], {}, dry_run, "normal")
+        job.update({"source_system": PUSH_MODE, "status": "PROCESSING", "started_at": datetime.utcnow().isoformat(),
+                    "roll_year": self.roll_years.current_year(pair), "message": "Pushed records are being loaded."})
+        self._save_job(job)
+        self._announce(job, "started")
+
+        table_def = table.to_dict()
+        result = {
+            "mode": PUSH_MODE,
+            "records_read": 0,
+            "records_written": 0,
+            "records_deleted": 0,
+            "batches": 0,
+            "from_version": None,
+            "to_version": None,
+            "started_at": datetime.utcnow().isoformat(),
+        }
+        target = create_connector(pair.target)
+        merge_plan = build_merge_plan(pair.sync_pair_id, pair.merge, table_def, pair.batch_size)
+        try:
+            target.connect()
+            if merge_plan:
+                merge_plan.open()
+            self._write_batches(batches, table_def, target, result, job, table, self._pipeline(pair, table.name, target),
+                                build_filter(pair.filters, table_def), self._idempotency(job, pair, table_def),
+                                checkpoint=False, merge_plan=merge_plan, lineage=self._lineage(job, pair, table_def),
+                                interruptible=False, on_batch=on_batch)
+            result["completed_at"] = datetime.utcnow().isoformat()
+            self._add_table_result(job, table_name, result)
+            job["status"] = "COMPLETED"
+            if dry_run:
+                job["diff_summary"] = summarize({table_name: result.get("diff", {})})
+                job["message"] = "Dry run of pushed records completed. Nothing was written."
+            else:
+                rejected = result.get("records_rejected", 0)
+                job["message"] = (f"Push completed: {result['records_written']} of {result['records_read']} records written"
+                                  f"{f', {rejected} rejected' if rejected else ''}.")
+        except Exception as e:
+            self._add_table_result(job, table_name, result)
+            job["status"] = "FAILED"
+            job["stats"]["errors"] += 1
+            job["message"] = f"Push failed after {result['records_read']} records: {str(e)}"
+            ERRORS.inc(component="sync", type=type(e).__name__)
+            logger.error(f"Error loading records pushed to {table_name} of {sync_pair_id}: {e}", exc_info=True)
+        finally:
+            if merge_plan:
+                merge_plan.close()
+            target.close()
+
+        job["completed_at"] = datetime.utcnow().isoformat()
+        self._count_finished(job)
+        self._save_job(job)
+        self._announce(job, JOB_STATUS_EVENTS[job["status"]])
+        logger.info(f"Loaded records pushed to {table_name} of {sync_pair_id} as job {job['job_id']}: {job['status']}")
+        return job
+
+    def get_job_status(self, job_id: str) -> Dict[str, Any]:
+        """
+        Get the status of a sync job.
+
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+        """
+        return self._load_job(job_id)
+
+    def process_job(self, job_id: str) -> Dict[str, Any]:
+        """
+        Run a pending sync job.
+
+        Args:
+            job_id: ID of the sync job
+
+        Returns:
+            Dictionary with updated job details
+
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+            ValueError: If job is not in PENDING status
+        """
+        job = self._load_job(job_id)
+        if job["status"] != "PENDING":
+            raise ValueError(f"Cannot process job {job_id} with status {job['status']}")
+
+        attributes = {"sync.job_id": job_id, "sync.pair_id": job["sync_pair_id"], "sync.mode": job["mode"],
+                      "sync.priority": job.get("priority"), "sync.resume_count": job.get("resume_count", 0)}
+        if not job.get("started_at"):
+            tracer.record("sync.queue.wait", job.get("queued_at"), attributes, parent=job.get("trace_context"))
+        with log_context(request_id=job.get("request_id"), job_id=job_id, sync_pair_id=job["sync_pair_id"],
+                         county_id=job.get("county_id"), user=job.get("username")):
+            with tracer.span("sync.job", attributes, parent=job.get("trace_context")) as span:
+                self._run_job(job)
+                span.set_attribute("sync.status", job["status"])
+                span.set_attribute("sync.records_written", job["stats"]["records_written"])
+                if job["status"] == "FAILED":
+                    tracer.fail(span, job["message"])
+        return job
+
+    def _run_job(self, job: Dict[str, Any]) -> None:
+        """Run a loaded PENDING job to its next status, recording the outcome on the job."""
+        job_id = job["job_id"]
+        job["status"] = "PROCESSING"
+        job["started_at"] = datetime.utcnow().isoformat()
+        job["message"] = "Sync job is being processed."
+        job.pop("control_request", None)
+        job["estimated_records"] = self._estimate_records(job)
+        with self._job_lock:
+            self._running[job_id] = (job, JobControl(job_id, lambda: self._merge_stored_control(job).get("control_request")))
+            self._save_job(job)
+        self._announce(job, "started")
+
+        logger.info(f"Processing sync job {job_id}")
+
+        try:
+            pair = self.registry.get(job["sync_pair_id"])
+            # Tables that completed before the job was interrupted are skipped
+            remaining = [name for name in job["tables"] if name not in job["table_results"]]
+            dependencies = {name: pair.get_table(name).depends_on for name in remaining}
+
+            use_snapshot = pair.snapshot.get("enabled") and not job.get("dry_run")
+            if use_snapshot and not job.get("snapshot_id"):
+                # A resumed job keeps the snapshot taken before its first attempt
+                with tracer.span("sync.snapshot"):
+                    job["snapshot_id"] = self.snapshots.create(job, pair)["snapshot_id"]
+                self._save_job(job)
+
+            pool = SyncWorkerPool(
+                worker_count(pair.source, pair.target),
+                lambda: (create_connector(pair.source), create_connector(pair.target))
+            )
+            try:
+                pool.run(remaining, dependencies,
+                         lambda name, source, target: self._run_table(job, pair, name, source, target))
+            finally:
+                job["worker_metrics"] = pool.metrics_summary()
+
+            if use_snapshot:
+                with tracer.span("sync.validate"):
+                    self._validate_or_roll_back(job, pair)
+
+            job["status"] = "COMPLETED"
+            job["completed_at"] = datetime.utcnow().isoformat()
+            if job.get("dry_run"):
+                job["diff_summary"] = summarize({
+                    name: result.get("diff", {}) for name, result in job["table_results"].items()
+                })
+                job["message"] = (
+                    f"Dry run completed: {job['diff_summary']['inserts']} inserts, "
+                    f"{job['diff_summary']['updates']} updates and {job['diff_summary']['deletes']} deletes "
+                    f"across {len(job['tables'])} tables. Nothing was written."
+                )
+            else:
+                unchanged = job["stats"].get("records_unchanged", 0)
+                job["message"] = (
+                    f"Sync completed successfully: {job['stats']['records_written']} records written "
+                    f"{f'({unchanged} already applied) ' if unchanged else ''}across {len(job['tables'])} tables."
+                )
+                if "geometries_repaired" in job["stats"]:
+                    job["message"] += (f" {job['stats']['geometries_repaired']} geometries repaired, "
+                                       f"{job['stats']['geometries_rejected']} rejected.")
+                if "addresses_geocoded" in job["stats"]:
+                    job["message"] += (f" {job['stats']['addresses_geocoded']} addresses geocoded, "
+                                       f"{job['stats']['addresses_low_confidence']} below min_confidence.")
+                with tracer.span("sync.topology"):
+                    self._check_topology(job, pair)
+                self._summarize_anomalies(job, pair)
+                self._score_exemptions(job, pair)
+
+        except SyncValidationFailed as e:
+            job["status"] = "FAILED"
+            job["completed_at"] = datetime.utcnow().isoformat()
+            job["rolled_back"] = True
+            job["validation_errors"] = e.errors
+            job["message"] = (
+                f"Post-sync validation failed; target tables were rolled back to snapshot {e.snapshot_id}: {str(e)}"
+            )
+            ERRORS.inc(component="sync", type=type(e).__name__)
+            logger.error(f"Sync job {job_id} rolled back: {e}")
+
+        except SyncJobPreempted as e:
+            # Back to the queue; the next attempt continues from the checkpoints
+            job["status"] = "PENDING"
+            job["preempt_count"] = job.get("preempt_count", 0) + 1
+            job.pop("preempt_requested_by", None)
+            job["message"] = f"{str(e)}; it will resume from its last checkpoint."
+            logger.info(f"Sync job {job_id} preempted")
+
+        except SyncJobPaused:
+            job["status"] = "PAUSED"
+            job["paused_at"] = datetime.utcnow().isoformat()
+            job["paused_by"] = (job.get("control_request") or {}).get("requested_by")
+            job["message"] = "Sync job paused; resume it to continue from its last checkpoint."
+            logger.info(f"Sync job {job_id} paused")
+
+        except SyncJobCancelled:
+            job["status"] = "CANCELLED"
+            job["completed_at"] = datetime.utcnow().isoformat()
+            job["cancelled_by"] = (job.get("control_request") or {}).get("requested_by")
+            job["message"] = "Sync job cancelled by user; it can be resumed from its last checkpoint."
+            logger.info(f"Sync job {job_id} stopped after cancellation")
+
+        except Exception as e:
+            job["status"] = "FAILED"
+            job["completed_at"] = datetime.utcnow().isoformat()
+            job["stats"]["errors"] += 1
+            job["message"] = f"Sync failed: {str(e)}"
+            ERRORS.inc(component="sync", type=type(e).__name__)
+            logger.error(f"Error processing sync job {job_id}: {e}", exc_info=True)
+
+        if job["status"] in ("COMPLETED", "FAILED", "CANCELLED"):
+            self._count_finished(job)
+        with self._job_lock:
+            self._running.pop(job_id, None)
+            self._progress_announced.pop(job_id, None)
+            job.pop("control_request", None)
+            self._save_job(job)
+        self._announce(job, JOB_STATUS_EVENTS.get(job["status"], job["status"].lower()))
+        logger.info(f"Finished processing sync job {job_id} with status {job['status']}")
+
+    @staticmethod
+    def _count_finished(job: Dict[str, Any]) -> None:
+        """Count a finished job and the duration of its last run in the metrics."""
+        SYNC_JOBS.inc(sync_pair=job["sync_pair_id"], status=job["status"])
+        if job.get("started_at") and job.get("completed_at"):
+            duration = datetime.fromisoformat(job["completed_at"]) - datetime.fromisoformat(job["started_at"])
+            SYNC_JOB_DURATION.observe(duration.total_seconds(), sync_pair=job["sync_pair_id"], status=job["status"])
+
+    def cancel_job(self, job_id: str, requested_by: Optional[str] = None,
+                   reason: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Cancel a sync job.
+
+        A pending or paused job is cancelled at once. A running job moves to
+        CANCELLING and stops before its next batch is written; it becomes
+        CANCELLED when its workers have stopped, and keeps its checkpoint so
+        it can be resumed later.
+
+        Args:
+            job_id: ID of the sync job
+            requested_by: Username recorded on the job
+            reason: Message recorded on the job instead of the user cancellation one
+
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+            ValueError: If job is already finished
+        """
+        with self._job_lock:
+            job = self._live_job(job_id)
+            if job["status"] in TERMINAL_STATUSES:
+                raise ValueError(f"Cannot cancel job {job_id} with status {job['status']}")
+            if job["status"] == "CANCELLING":
+                return job
+            if job.get("mode") == PUSH_MODE:
+                raise ValueError(f"Job {job_id} loads pushed records within its request and cannot be cancelled")
+
+            if job["status"] in RUNNING_STATUSES:
+                self._request_control(job, "cancel", requested_by)
+                job["status"] = "CANCELLING"
+                job["message"] = "Cancellation requested; the job stops before its next batch is written."
+            else:
+                job["status"] = "CANCELLED"
+                job["completed_at"] = datetime.utcnow().isoformat()
+                job["cancelled_by"] = requested_by
+                job["message"] = reason or "Sync job cancelled by user."
+            self._save_job(job)
+        self._announce_control_change(job)
+
+        logger.info(f"Cancelled sync job {job_id}")
+        return job
+
+    def pause_job(self, job_id: str, requested_by: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Pause a sync job.
+
+        A pending job is paused at once and leaves the queue. A running job
+        moves to PAUSING and stops before its next batch is written; it
+        becomes PAUSED when its workers have stopped. resume_job continues a
+        paused job from its checkpoints.
+
+        Args:
+            job_id: ID of the sync job
+            requested_by: Username recorded on the job
+
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+            ValueError: If job is finished or being cancelled
+        """
+        with self._job_lock:
+            job = self._live_job(job_id)
+            if job["status"] in ["PAUSING", "PAUSED"]:
+                return job
+            if job["status"] not in ["PENDING", "PROCESSING"]:
+                raise ValueError(f"Cannot pause job {job_id} with status {job['status']}")
+            if job.get("mode") == PUSH_MODE:
+                raise ValueError(f"Job {job_id} loads pushed records within its request and cannot be paused")
+
+            if job["status"] == "PROCESSING":
+                self._request_control(job, "pause", requested_by)
+                job["status"] = "PAUSING"
+                job["message"] = "Pause requested; the job stops before its next batch is written."
+            else:
+                job["status"] = "PAUSED"
+                job["paused_at"] = datetime.utcnow().isoformat()
+                job["paused_by"] = requested_by
+                job["message"] = "Sync job paused; resume it to continue."
+            self._save_job(job)
+        self._announce_control_change(job)
+
+        logger.info(f"Paused sync job {job_id}")
+        return job
+
+    def mark_queued(self, job_id: str, express: bool = False) -> Dict[str, Any]:
+        """
+        Record that a pending job is waiting in the job queue.
+
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+            ValueError: If job is not in PENDING status
+        """
+        with self._job_lock:
+            job = self._load_job(job_id)
+            if job["status"] != "PENDING":
+                raise ValueError(f"Cannot queue job {job_id} with status {job['status']}")
+            job["express"] = express
+            job.setdefault("queued_at", datetime.utcnow().isoformat())
+            job["message"] = f"Sync job queued with {job.get('priority', 'normal')} priority{' in the express lane' if express else ''}."
+            self._save_job(job)
+        return job
+
+    def request_preemption(self, job_id: str, requested_by: str) -> None:
+        """
+        Ask a running job to return to the queue after its next committed batch.
+
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+        """
+        with self._job_lock:
+            job = self._load_job(job_id)
+            if job["status"] != "PROCESSING":
+                return
+            job["preempt_requested_by"] = requested_by
+            self._save_job(job)
+        logger.info(f"Requested preemption of sync job {job_id} for {_preempted_by(requested_by)}")
+
+    def resume_job(self, job_id: str) -> Dict[str, Any]:
+        """
+        Return a paused, failed or cancelled sync job to PENDING so it can be processed again.
+
+        Tables that completed are skipped when the job is reprocessed, and the
+        table that was in progress continues from its last checkpoint using
+        the same change window as the original attempt.
+
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+            ValueError: If job is not PAUSED, FAILED or CANCELLED
+        """
+        with self._job_lock:
+            job = self._load_job(job_id)
+            if job["status"] not in ["PAUSED", "FAILED", "CANCELLED"]:
+                raise ValueError(f"Cannot resume job {job_id} with status {job['status']}")
+            if job.get("rolled_back"):
+                raise ValueError(f"Job {job_id} was rolled back after failed validation; start a new sync job")
+            if job.get("mode") == PUSH_MODE:
+                raise ValueError(f"Job {job_id} loaded pushed records; push them again to retry")
+
+            job["status"] = "PENDING"
+            job["completed_at"] = None
+            job["resume_count"] = job.get("resume_count", 0) + 1
+            job.setdefault("checkpoints", {})
+            job["message"] = "Sync job resumed from checkpoint and pending processing."
+            self._save_job(job)
+
+        logger.info(f"Resuming sync job {job_id} (attempt {job['resume_count'] + 1})")
+        return job
+
+    def list_jobs(self,
+                  county_id: Optional[str] = None,
+                  sync_pair_id: Optional[str] = None,
+                  status: Optional[str] = None,
+                  limit: int = 100) -> List[Dict[str, Any]]:
+        """
+        List sync jobs with optional filtering, newest first.
+        """
+        jobs = []
+        for job in self.store.list(JOBS_COLLECTION):
+            if county_id and job.get("county_id") != county_id:
+                continue
+            if sync_pair_id and job.get("sync_pair_id") != sync_pair_id:
+                continue
+            if status and job.get("status") != status:
+                continue
+            jobs.append(job)
+
+        jobs.sort(key=lambda j: j.get("created_at", ""), reverse=True)
+        return jobs[:limit]
+
+    def delete_job(self, job_id: str) -> Dict[str, Any]:
+        """
+        Delete the record of a finished job (see job_retention).
+
+        Returns:
+            The deleted record
+
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+            ValueError: If the job has not finished
+        """
+        with self._job_lock:
+            job = self._load_job(job_id)
+            if job["status"] not in TERMINAL_STATUSES:
+                raise ValueError(f"Sync job {job_id} is {job['status']}; only finished jobs can be deleted")
+            self.store.delete(JOBS_COLLECTION, job_id)
+        return job
+
+    def _run_table(self, job: Dict[str, Any], pair: SyncPairConfig, table_name: str,
+                   source, target) -> Dict[str, Any]:
+        """Sync one table on a worker and record its result on the job."""
+        started = datetime.utcnow()
+        attributes = {"sync.table": table_name, "sync.source": source.connector_type,
+                      "sync.target": target.connector_type}
+        with log_context(table=table_name), tracer.span("sync.table", attributes) as span:
+            result = self._sync_table(job, pair, pair.get_table(table_name), source, target)
+            span.set_attribute("sync.table_mode", result.get("mode"))
+            span.set_attribute("sync.records_read", result["records_read"])
+            span.set_attribute("sync.records_written", result["records_written"])
+        result["worker"] = threading.current_thread().name
+        result["duration_seconds"] = round((datetime.utcnow() - started).total_seconds(), 3)
+        self._add_table_result(job, table_name, result)
+        return result
+
+    def _add_table_result(self, job: Dict[str, Any], table_name: str, result: Dict[str, Any]) -> None:
+        """Record a table's result on its job and add its counts to the job's stats."""
+        with self._job_lock:
+            self._merge_stored_control(job)
+            job["table_results"][table_name] = result
+            job["checkpoints"].pop(table_name, None)
+            job["stats"]["records_processed"] += result["records_read"]
+            job["stats"]["records_written"] += result["records_written"]
+            job["stats"]["records_unchanged"] = job["stats"].get("records_unchanged", 0) + result.get("records_unchanged", 0)
+            if "records_outside_area" in result:
+                job["stats"]["records_outside_area"] = job["stats"].get("records_outside_area", 0) + result["records_outside_area"]
+            if result.get("geometry"):
+                for name in ("repaired", "rejected"):
+                    job["stats"][f"geometries_{name}"] = job["stats"].get(f"geometries_{name}", 0) + result["geometry"][name]
+            if result.get("address"):
+                for name in ("geocoded", "low_confidence"):
+                    job["stats"][f"addresses_{name}"] = job["stats"].get(f"addresses_{name}", 0) + result["address"][name]
+            self._save_job(job)
+
+    def _sync_table(self, job: Dict[str, Any], pair: SyncPairConfig, table: SyncTableConfig,
+                    source, target) -> Dict[str, Any]:
+        """
+        Sync one table and advance its watermark.
+
+        Incremental mode falls back to a full read when the table has no change
+        tracking, has never been synced, or its watermark has expired.
+        """
+        table_def = table.to_dict()
+        checkpoint = job.get("checkpoints", {}).get(table.name)
+        pipeline = self._pipeline(pair, table.name, target)
+        record_filter = build_filter(pair.filters, table_def, self._spatial_filter(pair, job["parameters"], table.name))
+        idempotency = self._idempotency(job, pair, table_def)
+        lineage = self._lineage(job, pair, table_def)
+        throttle = source_throttle(pair.source.get("throttle"), pair.sync_pair_id)
+        merge_plan = build_merge_plan(pair.sync_pair_id, pair.merge, table_def, pair.batch_size)
+        if merge_plan:
+            merge_plan.open()
+        try:
+            return self._sync_table_with(job, pair, table, source, target, table_def, checkpoint,
+                                         pipeline, record_filter, idempotency, lineage, throttle, merge_plan)
+        finally:
+            if merge_plan:
+                merge_plan.close()
+
+    def _sync_table_with(self, job: Dict[str, Any], pair: SyncPairConfig, table: SyncTableConfig,
+                         source, target, table_def: Dict[str, Any], checkpoint: Optional[Dict[str, Any]],
+                         pipeline: HookPipeline, record_filter: Optional[RecordFilter],
+                         idempotency: Optional[IdempotencyKeys], lineage: LineageStamper, throttle,
+                         merge_plan: Optional[MergePlan]) -> Dict[str, Any]:
+        """Body of _sync_table, run while the table's merge sources are connected."""
+        bidirectional = pair.direction == "bidirectional" and table.change_tracking is not None
+        if checkpoint:
+            # Resume with the change window of the interrupted attempt
+            result = dict(checkpoint["result"])
+            result["resumed_from_batch"] = result["batches"]
+            until_version = result["to_version"]
+            watermark = {"version": result["from_version"]}
+            logger.info(f"Resuming {table.name} after {result['batches']} committed batches")
+        else:
+            watermark = self.watermarks.get(pair.sync_pair_id, table.name) if table.change_tracking else None
+
+            effective_mode = job["mode"]
+            reason = None
+            if effective_mode == "incremental":
+                if not table.change_tracking:
+                    effective_mode, reason = "full", "no change tracking configured"
+                elif watermark is None:
+                    effective_mode, reason = "full", "no previous watermark"
+                elif watermark.get("method") != table.change_tracking:
+                    effective_mode, reason = "full", "change tracking method changed"
+
+            merge_watermarks = {}
+            for lookup in (merge_plan.lookups if merge_plan else []):
+                merge_watermarks[lookup.name] = self.watermarks.get(pair.sync_pair_id, lookup.watermark_name)
+                if effective_mode == "incremental" and merge_watermarks[lookup.name] is None:
+                    # Records synced before the merge source was added lack its columns
+                    effective_mode, reason = "full", f"no previous watermark for merge source {lookup.name}"
+
+            # Capture the upper bound before reading so changes committed during the
+            # run are picked up by the next incremental sync rather than lost.
+            until_version = source.get_current_version(table_def) if table.change_tracking else None
+
+            result = {
+                "mode": effective_mode,
+                "records_read": 0,
+                "records_written": 0,
+                "records_deleted": 0,
+                "batches": 0,
+                "from_version": watermark.get("version") if effective_mode == "incremental" else None,
+                "to_version": until_version,
+                "started_at": datetime.utcnow().isoformat(),
+            }
+            if reason:
+                result["fallback_reason"] = reason
+            for lookup in (merge_plan.lookups if merge_plan else []):
+                merge_watermark = merge_watermarks[lookup.name]
+                result.setdefault("merge_sources", {})[lookup.name] = {
+                    "matched": 0,
+                    "missing": 0,
+                    "from_version": merge_watermark.get("version") if effective_mode == "incremental" else None,
+                    "to_version": lookup.current_version(),
+                }
+
+        try:
+            if result["mode"] == "incremental" and bidirectional:
+                # Target edits are collected in memory, so this path restarts
+                # the table rather than resuming mid-way.
+                self._sync_bidirectional_changes(job, pair, table, source, target, watermark, until_version, result)
+            elif result["mode"] == "incremental":
+                since = watermark["version"]
+                if checkpoint and isinstance(checkpoint.get("last_version"), int):
+                    # Rows sharing the last committed version may straddle a batch
+                    # boundary; re-reading that version is safe because writes are upserts.
+                    since = checkpoint["last_version"] - 1
+                batches = source.read_changes(table_def, since, until_version, pair.batch_size)
+                batches = throttled(batches, throttle, result, self._control(job))
+                self._write_batches(batches, table_def, target, result, job, table, pipeline, record_filter,
+                                    idempotency, merge_plan=merge_plan, lineage=lineage)
+            else:
+                after_key = checkpoint.get("last_key") if checkpoint else None
+                read = self._table_reader(job, source, target, pipeline, record_filter, merge_plan)
+                batches = read(table_def, pair.batch_size, after_key=after_key)
+                batches = throttled(batches, throttle, result, self._control(job))
+                self._write_batches(batches, table_def, target, result, job, table, pipeline, record_filter,
+                                    idempotency, merge_plan=merge_plan, lineage=lineage)
+        except WatermarkExpiredError as e:
+            logger.warning(f"{e}; re-reading {table.name} in full")
+            result.update({"mode": "full", "from_version": None, "fallback_reason": "watermark expired"})
+            job.get("checkpoints", {}).pop(table.name, None)
+            read = self._table_reader(job, source, target, pipeline, record_filter, merge_plan)
+            batches = throttled(read(table_def, pair.batch_size), throttle, result, self._control(job))
+            self._write_batches(batches, table_def, target, result, job, table, pipeline, record_filter,
+                                idempotency, merge_plan=merge_plan, lineage=lineage)
+
+        if merge_plan and result["mode"] == "incremental":
+            self._sync_merge_changes(job, table, source, target, table_def, pipeline, record_filter,
+                                     idempotency, lineage, throttle, merge_plan, result)
+
+        # Dry runs write nothing, so the next real run must cover the same changes
+        if not job.get("dry_run"):
+            if bidirectional and result["mode"] == "full":
+                # A full load establishes the target baseline; only edits made
+                # after it are pushed back to the source.
+                self.watermarks.set(pair.sync_pair_id, self._target_watermark_name(table),
+                                    target.get_current_version(table_def), "target_change_column", job["job_id"])
+
+            if table.change_tracking and until_version is not None:
+                self.watermarks.set(pair.sync_pair_id, table.name, until_version, table.change_tracking, job["job_id"])
+
+            for lookup in (merge_plan.lookups if merge_plan else []):
+                merge_version = result.get("merge_sources", {}).get(lookup.name, {}).get("to_version")
+                if merge_version is not None:
+                    self.watermarks.set(pair.sync_pair_id, lookup.watermark_name, merge_version,
+                                        MERGE_WATERMARK_METHOD, job["job_id"])
+
+        anomalies = None if job.get("dry_run") else self._anomalies(job, table_def, pipeline.target_table(table_def))
+        if anomalies:
+            result["anomalies"] = anomalies.finish(target, result)
+
+        result["completed_at"] = datetime.utcnow().isoformat()
+        logger.info(
+            f"Synced {table.name} ({result['mode']}): {result['records_read']} read, "
+            f"{result['records_written']} written"
+        )
+        return result
+
+    def _sync_merge_changes(self, job: Dict[str, Any], table: SyncTableConfig, source, target,
+                            table_def: Dict[str, Any], pipeline: HookPipeline,
+                            record_filter: Optional[RecordFilter], idempotency: Optional[IdempotencyKeys],
+                            lineage: LineageStamper, throttle, merge_plan: MergePlan, result: Dict[str, Any]) -> None:
+        """
+        Re-sync the primary records joined to rows that changed in a merge source.
+
+        The primary records are read again by their join columns and merged
+        with every merge source, so the written record stays complete.
+        """
+        for lookup in merge_plan.lookups:
+            stats = MergePlan.stats(result, lookup)
+            if stats.get("to_version") is None:
+                continue
+
+            def primary_batches():
+                for keys in lookup.changed_keys(stats["from_version"], stats["to_version"], stats):
+                    keys = [k for k in keys if all(v is not None for v in k)]
+                    records = source.fetch_records(lookup.primary_lookup_def, keys) if keys else []
+                    for record in records:
+                        record[OPERATION_FIELD] = "update"
+                    stats["records_remerged"] = stats.get("records_remerged", 0) + len(records)
+                    yield records
+
+            batches = throttled(primary_batches(), throttle, result, self._control(job))
+            self._write_batches(batches, table_def, target, result, job, table, pipeline, record_filter,
+                                idempotency, count_reads=False, checkpoint=False, merge_plan=merge_plan,
+                                lineage=lineage)
+            logger.info(
+                f"Re-synced {stats.get('records_remerged', 0)} {table.name} records for "
+                f"{stats.get('changes_read', 0)} changes in merge source {lookup.name}"
+            )
+
+    def _sync_bidirectional_changes(self, job: Dict[str, Any], pair: SyncPairConfig, table: SyncTableConfig,
+                                    source, target, watermark: Dict[str, Any], until_version: Any,
+                                    result: Dict[str, Any]) -> None:
+        """
+        Exchange changes in both directions for one table.
+
+        Target edits since the last run are collected first. Source changes
+        are then applied to the target unless the same record was also edited
+        in the target, in which case the conflict strategy decides. Remaining
+        target edits are pushed back to the source. Records with a pending
+        manual-review conflict are held back on both sides.
+
+        A pause or cancel request stops the table while target edits are
+        being collected; once source changes are being applied it runs to the
+        end, since the echo fingerprints are only saved when it completes.
+        """
+        table_def = table.to_dict()
+        pair_id = job["sync_pair_id"]
+        dry_run = job.get("dry_run", False)
+        strategy = job["parameters"].get("conflict_strategy") or pair.conflict_strategy
+        volatile_columns = [c for c in (table.target_change_column, table.timestamp_column) if c]
+        pipeline = build_pipeline(pair.hooks, table.name).bind(target)
+
+        target_watermark_name = self._target_watermark_name(table)
+        target_watermark = self.watermarks.get(pair_id, target_watermark_name)
+        target_until = target.get_current_version(table_def)
+
+        source_prints = self.fingerprints.load(pair_id, table.name, "source")
+        target_prints = self.fingerprints.load(pair_id, table.name, "target")
+        pending = self.conflicts.pending_by_key(pair_id, table.name)
+
+        result.update({"target_changes_read": 0, "records_pushed": 0, "echoes_skipped": 0,
+                       "conflicts": 0, "conflicts_pending": 0, "strategy": strategy})
+
+        # Collect target edits, dropping echoes of records this engine wrote
+        target_changes: Dict[str, Dict[str, Any]] = {}
+        if target_watermark is not None:
+            since = target_watermark.get("version")
+            for batch in checked(target.read_changes(table_def, since, target_until, pair.batch_size), self._control(job)):
+                for record in batch:
+                    key = record_key(table.primary_key, record)
+                    if target_prints.get(key) == record_fingerprint(record, volatile_columns):
+                        del target_prints[key]
+                        result["echoes_skipped"] += 1
+                        continue
+                    target_changes[key] = record
+                    result["target_changes_read"] += 1
+
+        # Apply source changes to the target
+        throttle = source_throttle(pair.source.get("throttle"), pair.sync_pair_id)
+        control = self._control(job)
+        if control:
+            control.check()
+        source_batches = source.read_changes(table_def, watermark["version"], until_version, pair.batch_size)
+        for batch in throttled(source_batches, throttle, result):
+            SYNC_ROWS_READ.inc(len(batch), sync_pair=pair.sync_pair_id, connector=source.connector_type)
+            to_write = []
+            for record in batch:
+                result["records_read"] += 1
+                key = record_key(table.primary_key, record)
+                fingerprint = record_fingerprint(record, volatile_columns)
+                if source_prints.get(key) == fingerprint:
+                    del source_prints[key]
+                    result["echoes_skipped"] += 1
+                    continue
+                if key in pending:
+                    if not dry_run:
+                        self.conflicts.refresh(pending[key], "source", record)
+                    continue
+
+                target_record = target_changes.pop(key, None)
+                if target_record is not None:
+                    winner = choose_winner(strategy, record, target_record, table_def)
+                    conflict = {"record_key": key, "winner": winner}
+                    if not dry_run:
+                        conflict = self.conflicts.record_conflict(
+                            job["job_id"], pair_id, table.name, key, record, target_record, strategy, winner
+                        )
+                    result["conflicts"] += 1
+                    if winner == WINNER_MANUAL:
+                        pending[key] = conflict
+                        result["conflicts_pending"] += 1
+                        continue
+                    if winner == WINNER_TARGET:
+                        target_changes[key] = target_record
+                        continue
+
+                to_write.append(record)
+                target_prints[key] = fingerprint
+
+            if to_write:
+                self._write_batches([to_write], table_def, target, result, job, table, pipeline,
+                                    count_reads=False, checkpoint=False, lineage=self._lineage(job, pair, table_def),
+                                    interruptible=False)
+
+        # Push the remaining target edits back to the source
+        to_push = []
+        for key, record in target_changes.items():
+            if key in pending:
+                if not dry_run:
+                    self.conflicts.refresh(pending[key], "target", record)
+                continue
+            to_push.append(record)
+            source_prints[key] = record_fingerprint(record, volatile_columns)
+
+        if dry_run:
+            result["records_to_push"] = len(to_push)
+            return
+
+        for start in range(0, len(to_push), pair.batch_size):
+            counts = source.write_batch(table_def, to_push[start:start + pair.batch_size])
+            result["records_pushed"] += counts.get("upserted", 0) + counts.get("deleted", 0)
+
+        self.fingerprints.save(pair_id, table.name, "source", source_prints)
+        self.fingerprints.save(pair_id, table.name, "target", target_prints)
+        self.watermarks.set(pair_id, target_watermark_name, target_until, "target_change_column", job["job_id"])
+
+    def get_conflict_diff(self, conflict_id: str) -> Dict[str, Any]:
+        """
+        Get a conflict with a field-by-field diff of the source and target records.
+
+        Raises:
+            FileNotFoundError: If the conflict does not exist
+        """
+        conflict = self.conflicts.get(conflict_id)
+        ignore = []
+        try:
+            table = self.registry.get(conflict["sync_pair_id"]).get_table(conflict["table"])
+            # Change timestamps always differ between the two sides
+            ignore = [c for c in (table.target_change_column, table.timestamp_column) if c]
+        except KeyError:
+            logger.warning(f"Conflict {conflict_id} refers to a table that is no longer configured")
+        diff = conflict_diff(conflict, ignore)
+        return dict(
+            conflict,
+            diff=diff,
+            changed_fields=[entry["field"] for entry in diff if entry["status"] != "same"]
+        )
+
+    def resolve_conflict(self, conflict_id: str, resolution: str, username: str,
+                         field_choices: Optional[Dict[str, str]] = None) -> Dict[str, Any]:
+        """
+        Resolve a pending conflict by applying the chosen record and record it in the audit log.
+
+        Args:
+            conflict_id: ID of the conflict
+            resolution: "source" (source value overwrites the target),
+                "target" (target value is pushed to the source) or
+                "merge" (a record built from field_choices is written to both sides)
+            username: User resolving the conflict
+            field_choices: For "merge", field name to "source" or "target"
+
+        Returns:
+            The resolved conflict
+
+        Raises:
+            FileNotFoundError: If the conflict does not exist
+            ValueError: If the conflict is not pending or the resolution is invalid
+        """
+        if resolution not in (WINNER_SOURCE, WINNER_TARGET, WINNER_MERGE):
+            raise ValueError(f"Unsupported resolution: {resolution}. Use 'source', 'target' or 'merge'")
+        if field_choices and resolution != WINNER_MERGE:
+            raise ValueError("field_choices can only be used with the 'merge' resolution")
+
+        conflict = self.conflicts.get(conflict_id)
+        if conflict["status"] != "PENDING":
+            raise ValueError(f"Cannot resolve conflict {conflict_id} with status {conflict['status']}")
+
+        pair = self.registry.get(conflict["sync_pair_id"])
+        table = pair.get_table(conflict["table"])
+        table_def = table.to_dict()
+        volatile_columns = [c for c in (table.target_change_column, table.timestamp_column) if c]
+        changed_fields = [e["field"] for e in conflict_diff(conflict, volatile_columns) if e["status"] != "same"]
+
+        if resolution == WINNER_MERGE:
+            record = merge_records(conflict, field_choices or {}, volatile_columns)
+            written_sides = ["target", "source"]
+        else:
+            record = dict(conflict[f"{resolution}_record"])
+            written_sides = ["target" if resolution == WINNER_SOURCE else "source"]
+        record[OPERATION_FIELD] = "update"
+
+        for side in written_sides:
+            connector = create_connector(pair.target if side == "target" else pair.source)
+            with connector:
+                connector.write_batch(table_def, [record])
+
+            prints = self.fingerprints.load(pair.sync_pair_id, table.name, side)
+            prints[conflict["record_key"]] = record_fingerprint(record, volatile_columns)
+            self.fingerprints.save(pair.sync_pair_id, table.name, side, prints)
+
+        logger.info(f"Resolved conflict {conflict_id} on {table.name} in favor of {resolution}")
+        resolved = self.conflicts.mark_resolved(conflict_id, resolution, username, field_choices)
+        self.audit_log.record(
+            "sync_conflict.resolved",
+            username,
+            "sync_conflict",
+            conflict_id,
+            {
+                "sync_pair_id": pair.sync_pair_id,
+                "table": table.name,
+                "record_key": conflict["record_key"],
+                "resolution": resolution,
+                "field_choices": field_choices or {},
+                "changed_fields": changed_fields,
+                "written_to": written_sides,
+                "source_record": conflict["source_record"],
+                "target_record": conflict["target_record"],
+            },
+            county_id=pair.county_id
+        )
+        return resolved
+
+    def _validate_or_roll_back(self, job: Dict[str, Any], pair: SyncPairConfig) -> None:
+        """
+        Run post-sync validation; restore the job's snapshot if any rule fails.
+
+        Raises:
+            SyncValidationFailed: If validation failed and the target was rolled back
+        """
+        snapshot_id = job["snapshot_id"]
+        errors = self.snapshots.validate(snapshot_id, pair, job["table_results"])
+        if errors:
+            self.snapshots.restore(snapshot_id, "system", f"Post-sync validation failed for job {job['job_id']}")
+            raise SyncValidationFailed(errors, snapshot_id)
+        self.snapshots.prune(pair)
+
+    def rollback_job(self, job_id: str, username: str) -> Dict[str, Any]:
+        """
+        Restore the snapshot taken before a job ran.
+
+        Raises:
+            FileNotFoundError: If the job or its snapshot does not exist
+            ValueError: If the job is still running, has no snapshot or the snapshot is no longer available
+        """
+        job = self._load_job(job_id)
+        if job["status"] in ["PENDING", "PAUSED"] + RUNNING_STATUSES:
+            raise ValueError(f"Cannot roll back job {job_id} with status {job['status']}")
+        if not job.get("snapshot_id"):
+            raise ValueError(f"Job {job_id} has no snapshot")
+
+        self.snapshots.restore(job["snapshot_id"], username, f"Manual rollback of job {job_id}")
+        with self._job_lock:
+            job = self._load_job(job_id)
+            job["rolled_back"] = True
+            job["rolled_back_by"] = username
+            job["rolled_back_at"] = datetime.utcnow().isoformat()
+            job["message"] = f"Target tables rolled back to snapshot {job['snapshot_id']} by {username}."
+            self._save_job(job)
+        return job
+
+    def roll_over(self, sync_pair_id: str, username: str, to_year: Optional[Any] = None,
+                  reason: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Certify a sync pair's open roll year and open the next (see roll_years).
+
+        Raises:
+            KeyError: If the sync pair is not configured or not versioned by roll year
+            ValueError: If a job of the sync pair is pending, paused or running, or
+                to_year is not after the open year
+        """
+        pair = self.registry.get(sync_pair_id)
+        active = [j for j in self.store.list(JOBS_COLLECTION) if j.get("sync_pair_id") == sync_pair_id
+                  and j.get("status") in ["PENDING", "PAUSED"] + RUNNING_STATUSES]
+        if active:
+            raise ValueError(f"Sync pair {sync_pair_id} has {len(active)} job{'s' if len(active) != 1 else ''} "
+                             f"pending, paused or running; let them finish or cancel them before rolling over")
+        return self.roll_years.roll_over(pair, username, to_year, reason)
+
+    def reprocess_dead_letters(self,
+                               sync_pair_id: str,
+                               username: str,
+                               table_name: Optional[str] = None,
+                               dead_letter_ids: Optional[List[str]] = None) -> Dict[str, Any]:
+        """
+        Run pending dead letters through the sync pair's current filters, hooks and
+        target again, typically after a field mapping has been fixed.
+
+        Args:
+            sync_pair_id: Sync pair of the dead letters
+            username: User reprocessing the records
+            table_name: Only reprocess dead letters of this table
+            dead_letter_ids: Only reprocess these dead letters
+
+        Returns:
+            Summary with attempted, reprocessed, excluded and failed counts and
+            the outcome of each dead letter
+
+        Raises:
+            KeyError: If the sync pair or a table is not configured
+            FileNotFoundError: If a dead letter does not exist
+            ValueError: If a dead letter belongs to another sync pair or is not pending
+        """
+        pair = self.registry.get(sync_pair_id)
+        if dead_letter_ids:
+            letters = [self.dead_letters.get(dead_letter_id) for dead_letter_id in dead_letter_ids]
+            for letter in letters:
+                if letter["sync_pair_id"] != sync_pair_id:
+                    raise ValueError(f"Dead letter {letter['dead_letter_id']} belongs to sync pair {letter['sync_pair_id']}")
+                if letter["status"] != "PENDING":
+                    raise ValueError(f"Cannot reprocess dead letter {letter['dead_letter_id']} with status {letter['status']}")
+        else:
+            if table_name:
+                pair.get_table(table_name)
+            letters = self.dead_letters.list(sync_pair_id, table_name, "PENDING", limit=1_000_000)
+
+        summary = {"sync_pair_id": sync_pair_id, "attempted": len(letters), "reprocessed": 0,
+                   "excluded": 0, "failed": 0, "dead_letters": []}
+        if not letters:
+            return summary
+
+        by_table: Dict[str, List[Dict[str, Any]]] = {}
+        for letter in letters:
+            by_table.setdefault(letter["table"], []).append(letter)
+
+        reprocess_id = f"reprocess-{uuid.uuid4()}"
+        target = create_connector(pair.target)
+        with target:
+            for name, table_letters in by_table.items():
+                table = pair.get_table(name)
+                table_def = table.to_dict()
+                pipeline = self._pipeline(pair, table.name, target)
+                record_filter = build_filter(pair.filters, table_def)
+                idempotency = build_idempotency(pair.source_system_id, self._idempotency_hooks(pair, table.name),
+                                                table_def, merges_table(pair.merge, table.name))
+                lineage = build_lineage(pair.source_system_id, self._idempotency_hooks(pair, table.name),
+                                        table_def, reprocess_id, self.roll_years.current_year(pair))
+                target_def = pipeline.target_table(table_def)
+                context = HookContext(reprocess_id, sync_pair_id, table_def, "incremental")
+                merge_plan = build_merge_plan(sync_pair_id, pair.merge, table_def, pair.batch_size)
+                if merge_plan:
+                    merge_plan.open()
+                try:
+                    for letter in table_letters:
+                        outcome = self._reprocess_dead_letter(letter, target, target_def, pipeline, record_filter,
+                                                              idempotency, lineage, context, username, merge_plan)
+                        summary[outcome["outcome"]] += 1
+                        summary["dead_letters"].append(outcome)
+                finally:
+                    if merge_plan:
+                        merge_plan.close()
+
+        logger.info(f"Reprocessed {summary['reprocessed']} of {summary['attempted']} dead letters for {sync_pair_id}")
+        self.audit_log.record(
+            "sync_dead_letters.reprocessed",
+            username,
+            "sync_pair",
+            sync_pair_id,
+            {
+                "table": table_name,
+                "attempted": summary["attempted"],
+                "reprocessed": summary["reprocessed"],
+                "excluded": summary["excluded"],
+                "failed": summary["failed"],
+                "dead_letter_ids": [letter["dead_letter_id"] for letter in letters],
+            },
+            county_id=pair.county_id
+        )
+        return summary
+
+    def _reprocess_dead_letter(self, letter: Dict[str, Any], target, target_def: Dict[str, Any],
+                               pipeline: HookPipeline, record_filter: Optional[RecordFilter],
+                               idempotency: IdempotencyKeys, lineage: LineageStamper, context: HookContext,
+                               username: str, merge_plan: Optional[MergePlan] = None) -> Dict[str, Any]:
+        """Retry one dead letter, joining current merge source data, and update its status."""
+        dead_letter_id = letter["dead_letter_id"]
+        records = [self.dead_letters.source_record(letter)]
+        if record_filter:
+            records, _ = record_filter.apply(records)
+            if not records:
+                self.dead_letters.mark(dead_letter_id, "DISCARDED", username, "Excluded by the sync pair's filters")
+                return {"dead_letter_id": dead_letter_id, "outcome": "excluded"}
+
+        missing = merge_plan.merge(records, {}) if merge_plan else []
+        if missing:
+            errors, stage = missing[0][1], STAGE_MERGE
+            self.dead_letters.record_retry_failure(dead_letter_id, errors, stage)
+            return {"dead_letter_id": dead_letter_id, "outcome": "failed", "errors": errors}
+
+        idempotency.stamp(records)
+        lineage.stamp(records)
+        records, _, rejected = pipeline.apply(records, context)
+        if rejected:
+            errors, stage = rejected[0]["errors"], rejected[0]["stage"]
+        else:
+            try:
+                if records:
+                    target.write_batch(target_def, records)
+                self.dead_letters.mark(dead_letter_id, "REPROCESSED", username)
+                return {"dead_letter_id": dead_letter_id, "outcome": "reprocessed"}
+            except Exception as e:
+                if not target.is_record_error(e):
+                    raise
+                errors, stage = [str(e).strip()], STAGE_LOAD
+
+        self.dead_letters.record_retry_failure(dead_letter_id, errors, stage)
+        return {"dead_letter_id": dead_letter_id, "outcome": "failed", "errors": errors}
+
+    def discard_dead_letter(self, dead_letter_id: str, username: str, reason: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Give up on a pending dead letter and record it in the audit log.
+
+        Raises:
+            FileNotFoundError: If the dead letter does not exist
+            ValueError: If the dead letter is not pending
+        """
+        letter = self.dead_letters.get(dead_letter_id)
+        if letter["status"] != "PENDING":
+            raise ValueError(f"Cannot discard dead letter {dead_letter_id} with status {letter['status']}")
+        letter = self.dead_letters.mark(dead_letter_id, "DISCARDED", username, reason)
+        pair = self.registry.get(letter["sync_pair_id"])
+        self.audit_log.record(
+            "sync_dead_letter.discarded",
+            username,
+            "sync_dead_letter",
+            dead_letter_id,
+            {"sync_pair_id": letter["sync_pair_id"], "table": letter["table"],
+             "record_key": letter["record_key"], "reason": reason, "payload": letter["payload"]},
+            county_id=pair.county_id
+        )
+        return letter
+
+    def list_quarantined(self, sync_pair_id: str, table_name: Optional[str] = None,
+                         limit: int = 100) -> List[Dict[str, Any]]:
+        """
+        List records held in a sync pair's quarantine table.
+
+        Raises:
+            KeyError: If the sync pair or table is not configured
+            ValueError: If the sync pair has no validation rules
+        """
+        pair = self.registry.get(sync_pair_id)
+        if table_name:
+            pair.get_table(table_name)
+        if not pair.validation:
+            raise ValueError(f"Sync pair {sync_pair_id} has no validation rules")
+        with create_connector(pair.target) as target:
+            return target.list_quarantined(pair.validation["quarantine_table"], sync_pair_id, table_name, limit)
+
+    def revalidate_quarantine(self, sync_pair_id: str, username: str,
+                              table_name: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Check quarantined records against the current rules and target data again.
+
+        Records that now pass are loaded and released from quarantine, for
+        example once the street segments a situs address references have been
+        synced; the rest stay quarantined with updated reasons.
+
+        Returns:
+            Per-table counts of records attempted, released (loaded) and still quarantined
+
+        Raises:
+            KeyError: If the sync pair or table is not configured
+            ValueError: If the sync pair has no validation rules
+        """
+        pair = self.registry.get(sync_pair_id)
+        tables = [pair.get_table(table_name)] if table_name else pair.tables
+        if not pair.validation:
+            raise ValueError(f"Sync pair {sync_pair_id} has no validation rules")
+
+        job = {"job_id": f"revalidate-{uuid.uuid4()}", "sync_pair_id": sync_pair_id,
+               "parameters": {}, "dry_run": False}
+        summary = {"sync_pair_id": sync_pair_id, "tables": {}}
+        target = create_connector(pair.target)
+        with target:
+            for table in tables:
+                entries = target.list_quarantined(pair.validation["quarantine_table"], sync_pair_id,
+                                                  table.name, limit=1_000_000)
+                if not entries:
+                    continue
+                table_def = table.to_dict()
+                result = {"mode": "incremental", "records_read": 0, "records_written": 0,
+                          "records_deleted": 0, "batches": 0}
+                records = [dict(entry["record"]) for entry in entries]
+                batches = (records[i:i + pair.batch_size] for i in range(0, len(records), pair.batch_size))
+                merge_plan = build_merge_plan(sync_pair_id, pair.merge, table_def, pair.batch_size)
+                if merge_plan:
+                    merge_plan.open()
+                try:
+                    self._write_batches(batches, table_def, target, result, job, table,
+                                        self._pipeline(pair, table.name, target),
+                                        build_filter(pair.filters, table_def),
+                                        self._idempotency(job, pair, table_def),
+                                        count_reads=False, checkpoint=False, merge_plan=merge_plan,
+                                        lineage=self._lineage(job, pair, table_def))
+                finally:
+                    if merge_plan:
+                        merge_plan.close()
+                summary["tables"][table.name] = {
+                    "attempted": len(records),
+                    "released": result.get("records_released", 0),
+                    "quarantined": result.get("records_quarantined", 0),
+                    "records_written": result["records_written"],
+                }
+
+        logger.info(f"Revalidated quarantined records of {sync_pair_id}: {summary['tables']}")
+        self.audit_log.record(
+            "sync_quarantine.revalidated",
+            username,
+            "sync_pair",
+            sync_pair_id,
+            {"table": table_name, "tables": summary["tables"]},
+            county_id=pair.county_id
+        )
+        return summary
+
+    def standardize_address(self, sync_pair_id: str, table_name: str, address: str) -> Dict[str, Any]:
+        """
+        Standardize one address as a table's sync would, to try out its settings.
+
+        Raises:
+            KeyError: If the sync pair or table is unknown
+            ValueError: If the table's addresses are not standardized
+        """
+        pair = self.registry.get(sync_pair_id)
+        pair.get_table(table_name)
+        standardizer = build_address_standardizer(pair.address_standardization, table_name)
+        if standardizer is None:
+            raise ValueError(f"Table {table_name} of sync pair {sync_pair_id} has no address standardization")
+        try:
+            return standardizer.match(normalize_text(address))
+        finally:
+            if standardizer.geocoder is not None:
+                standardizer.geocoder.close()
+
+    def run_topology_qa(self, sync_pair_id: str, table_name: Optional[str] = None,
+                        username: Optional[str] = None, job_id: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Run the topology checks of a sync pair's tables over their target data
+        and update the issue list.
+
+        Args:
+            sync_pair_id: Sync pair to check
+            table_name: Only check this table
+            username: User who started the run by hand, recorded in the audit log
+            job_id: Sync job the run follows
+
+        Returns:
+            Per-table issue counts (see TopologyIssueStore.record_run)
+
+        Raises:
+            KeyError: If the sync pair or table is not configured
+            ValueError: If the sync pair or table has no topology QA settings
+        """
+        pair = self.registry.get(sync_pair_id)
+        configured = (pair.topology_qa or {}).get("tables") or {}
+        if table_name:
+            pair.get_table(table_name)
+            if table_name not in configured:
+                raise ValueError(f"Table {table_name} of sync pair {sync_pair_id} has no topology QA settings")
+            tables = [table_name]
+        else:
+            if not configured:
+                raise ValueError(f"Sync pair {sync_pair_id} has no topology QA settings")
+            tables = list(configured)
+
+        reader = LayerReader(self.registry)
+        districts = None
+        if any("district_crossing" in configured[name]["checks"] for name in tables):
+            regions = DistrictRegions(county_export_settings(self.registry.config_dir, pair.county_id), reader)
+            districts = regions.all() if regions.layer is not None else None
+
+        summary = {"sync_pair_id": sync_pair_id, "tables": {}}
+        for name in tables:
+            settings = configured[name]
+            checker = TopologyChecker(settings, districts)
+            issues = checker.run(reader.read(qa_layer(sync_pair_id, name, settings)))
+            result = self.topology_issues.record_run(sync_pair_id, name, issues, job_id, checker.srid)
+            result.update(checker.stats)
+            if "district_crossing" in settings["checks"] and "district_crossing" not in checker.checks:
+                result["warnings"] = ["District crossings were not checked: the county has no district layer"]
+            summary["tables"][name] = result
+            logger.info(f"Topology QA of {sync_pair_id} {name}: {result['open']} open issues, "
+                        f"{result['new']} new, {result['resolved']} resolved")
+        summary["open"] = sum(result["open"] for result in summary["tables"].values())
+
+        if username:
+            self.audit_log.record(
+                "sync_topology.checked",
+                username,
+                "sync_pair",
+                sync_pair_id,
+                {"table": table_name, "tables": summary["tables"]},
+                county_id=pair.county_id
+            )
+        return summary
+
+    def review_topology_issue(self, issue_id: str, status: str, username: str,
+                              note: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Accept a topology issue (or reopen it) and record the review in the audit log.
+
+        Raises:
+            FileNotFoundError: If the issue does not exist
+            ValueError: If the status is not one a reviewer can set
+        """
+        issue = self.topology_issues.review(issue_id, status, username, note)
+        pair = self.registry.get(issue["sync_pair_id"])
+        self.audit_log.record(
+            "sync_topology_issue.reviewed",
+            username,
+            "sync_topology_issue",
+            issue_id,
+            {"sync_pair_id": issue["sync_pair_id"], "table": issue["table"], "kind": issue["kind"],
+             "record_keys": issue["record_keys"], "status": status, "note": note},
+            county_id=pair.county_id
+        )
+        return issue
+
+    def _check_topology(self, job: Dict[str, Any], pair: SyncPairConfig) -> None:
+        """
+        Run topology QA over the tables of a completed job that have it and
+        changed. A QA failure is recorded on the job; the sync itself stands.
+        """
+        configured = (pair.topology_qa or {}).get("tables") or {}
+        tables = [
+            name for name in job["tables"] if name in configured
+            and (job["table_results"].get(name, {}).get("records_written")
+                 or job["table_results"].get(name, {}).get("records_deleted"))
+        ]
+        if not tables:
+            return
+        try:
+            results = {}
+            for name in tables:
+                results.update(self.run_topology_qa(pair.sync_pair_id, name, job_id=job["job_id"])["tables"])
+            job["topology_qa"] = {"tables": results, "open": sum(r["open"] for r in results.values())}
+            job["message"] += f" {job['topology_qa']['open']} topology issues open."
+        except Exception as e:
+            logger.error(f"Topology QA after sync job {job['job_id']} failed: {e}")
+            job["topology_qa"] = {"error": str(e)}
+            job["message"] += f" Topology QA failed: {e}"
+
+    @staticmethod
+    def _summarize_anomalies(job: Dict[str, Any], pair: SyncPairConfig) -> None:
+        """Total the anomalies the tables of a completed job flagged onto the job."""
+        if not pair.anomalies:
+            return
+        found = {name: result["anomalies"] for name, result in job["table_results"].items()
+                 if result.get("anomalies")}
+        by_kind: Dict[str, int] = {}
+        for summary in found.values():
+            for kind, count in summary["by_kind"].items():
+                by_kind[kind] = by_kind.get(kind, 0) + count
+        job["anomalies"] = {"found": sum(by_kind.values()), "by_kind": by_kind,
+                            "tables": {name: summary["found"] for name, summary in found.items()}}
+        if job["anomalies"]["found"]:
+            job["message"] += f" {job['anomalies']['found']} anomalies flagged for review."
+
+    def _score_exemptions(self, job: Dict[str, Any], pair: SyncPairConfig) -> None:
+        """
+        Score the exemptions after a completed job that changed the audit's
+        tables. A scoring failure is recorded on the job; the sync itself stands.
+        """
+        settings = (pair.entities.get("exemptions") or {}).get("audit")
+        if not settings or not any(
+                job["table_results"].get(name, {}).get("records_written")
+                or job["table_results"].get(name, {}).get("records_deleted") for name in settings["tables"]):
+            return
+        try:
+            result = self.exemption_audit.score(pair.sync_pair_id, job_id=job["job_id"])
+            job["exemption_audit"] = {name: result[name] for name in ("tax_year", "scored", "flagged", "added",
+                                                                      "reopened", "by_rule")}
+            job["message"] += f" {result['flagged']} exemptions on the audit worklist."
+        except Exception as e:
+            logger.error(f"Exemption audit after sync job {job['job_id']} failed: {e}")
+            job["exemption_audit"] = {"error": str(e)}
+            job["message"] += f" Exemption audit failed: {e}"
+
+    def record_lineage(self, sync_pair_id: str, table_name: str, key: Optional[Dict[str, Any]] = None,
+                       job_id: Optional[str] = None, limit: int = 100) -> Dict[str, Any]:
+        """
+        Look up where synced records came from and when.
+
+        Args:
+            sync_pair_id: Sync pair of the table
+            table_name: Source table name
+            key: Primary key values of one record, by target column name
+            job_id: Only records last written by this job
+
+        Returns:
+            The matching records' lineage, with a summary of each writing job
+
+        Raises:
+            KeyError: If the sync pair or table is not configured
+            ValueError: If neither a complete key nor a job ID is given
+        """
+        pair = self.registry.get(sync_pair_id)
+        table = pair.get_table(table_name)
+        target_def = build_pipeline(pair.hooks, table.name).target_table(table.to_dict())
+        keys = None
+        if key:
+            missing = [c for c in target_def["primary_key"] if c not in key]
+            if missing:
+                raise ValueError(f"Missing key column: {', '.join(missing)}")
+            keys = [[key[c] for c in target_def["primary_key"]]]
+        elif not job_id:
+            raise ValueError("Provide the record's key columns or a job_id")
+
+        with create_connector(pair.target) as target:
+            records = target.fetch_lineage(target_def, keys, job_id, limit)
+
+        jobs = {}
+        for record in records:
+            writer = (record.get("lineage") or {}).get("job_id")
+            if writer and writer not in jobs:
+                try:
+                    stored = self._load_job(writer)
+                    jobs[writer] = {name: stored.get(name) for name in
+                                    ("job_id", "mode", "status", "username", "created_at", "completed_at")}
+                except FileNotFoundError:
+                    # Reprocessing runs and pruned jobs have no job record
+                    jobs[writer] = None
+            record["job"] = jobs.get(writer)
+        return {"sync_pair_id": sync_pair_id, "table": table.name,
+                "target_table": target_def.get("target_table") or table.name, "records": records}
+
+    def reconcile_loads(self, job_id: str) -> Dict[str, Any]:
+        """
+        Compare a job's table results with the loads its warehouse target recorded.
+
+        A table reconciles when the rows the loads upserted and deleted add up
+        to the job's written and deleted counts. Loads that were retried after
+        a failure appear with status "failed" next to the load that replaced them.
+
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+            KeyError: If the job's sync pair is no longer configured
+            ValueError: If the sync pair's target records no load manifests
+        """
+        job = self._load_job(job_id)
+        pair = self.registry.get(job["sync_pair_id"])
+        tables = []
+        with create_connector(pair.target) as target:
+            for table_name, result in job.get("table_results", {}).items():
+                table = pair.get_table(table_name)
+                target_def = build_pipeline(pair.hooks, table.name).target_table(table.to_dict())
+                try:
+                    loads = target.list_load_manifests(target_def, job_id, limit=10000)
+                except NotImplementedError as e:
+                    raise ValueError(str(e))
+                loaded = [entry for entry in loads if entry["status"] == "loaded"]
+                upserted = sum(entry["upserted"] or 0 for entry in loaded)
+                deleted = sum(entry["deleted"] or 0 for entry in loaded)
+                tables.append({
+                    "table": table_name,
+                    "target_table": target_def.get("target_table") or target_def["name"],
+                    "records_written": result.get("records_written", 0),
+                    "records_deleted": result.get("records_deleted", 0),
+                    "rows_upserted": upserted,
+                    "rows_deleted": deleted,
+                    "failed_loads": len(loads) - len(loaded),
+                    "reconciled": (upserted + deleted == result.get("records_written", 0)
+                                   and deleted == result.get("records_deleted", 0)),
+                    "loads": loads,
+                })
+        return {"job_id": job_id, "sync_pair_id": job["sync_pair_id"],
+                "reconciled": all(t["reconciled"] for t in tables), "tables": tables}
+
+    def source_freshness(self, sync_pair_id: str) -> Dict[str, Any]:
+        """
+        Report how current each source of a sync pair is, table by table.
+
+        Every table lists its primary source and any merge sources joined into
+        it, with the version each was last synced up to and how long ago.
+
+        Raises:
+            KeyError: If the sync pair is not configured
+        """
+        pair = self.registry.get(sync_pair_id)
+        watermarks = self.watermarks.list(sync_pair_id)
+        now = datetime.utcnow()
+
+        def freshness(source_name: str, source_system: Optional[str], watermark_name: str) -> Dict[str, Any]:
+            watermark = watermarks.get(watermark_name)
+            entry = {"source": source_name, "source_system": source_system, "version": None,
+                     "synced_at": None, "age_seconds": None}
+            if watermark:
+                entry.update({"version": watermark.get("version"), "synced_at": watermark.get("updated_at"),
+                              "job_id": watermark.get("job_id")})
+                if watermark.get("updated_at"):
+                    entry["age_seconds"] = int((now - datetime.fromisoformat(watermark["updated_at"])).total_seconds())
+            return entry
+
+        tables = []
+        for table in pair.tables:
+            sources = [freshness(PRIMARY_SOURCE_NAME, pair.source.get("type"), table.name)]
+            for source in pair.merge.get("sources", []):
+                if any(entry["table"] == table.name for entry in source["tables"]):
+                    sources.append(freshness(source["name"], source["connector"].get("type"),
+                                             f"{table.name}@{source['name']}"))
+            ages = [entry["age_seconds"] for entry in sources]
+            tables.append({
+                "table": table.name,
+                "sources": sources,
+                # A merged record is only as fresh as its stalest source
+                "age_seconds": None if None in ages else max(ages),
+            })
+        return {"sync_pair_id": sync_pair_id, "checked_at": now.isoformat(), "tables": tables}
+
+    def describe_source(self, sync_pair_id: str, table_name: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Read the source catalog definition of a sync pair's tables.
+
+        Each table is compared with its configuration: configured key and
+        change columns that the source does not have are listed in
+        "missing_columns", which usually means a name or case mismatch.
+
+        Args:
+            sync_pair_id: Sync pair to describe
+            table_name: Only this source table
+
+        Raises:
+            KeyError: If the sync pair or table is not configured
+            ValueError: If the source connector cannot describe tables, or the table is push_only
+        """
+        pair = self.registry.get(sync_pair_id)
+        tables = [pair.get_table(table_name)] if table_name else [t for t in pair.tables if not t.push_only]
+        if any(table.push_only for table in tables):
+            raise ValueError(f"Table {table_name} of sync pair {sync_pair_id} is push_only and has no source table")
+        described = []
+        with create_connector(pair.source) as source:
+            for table in tables:
+                try:
+                    description = source.describe_table(table.to_dict())
+                except NotImplementedError as e:
+                    raise ValueError(str(e))
+                names = {column["name"] for column in description["columns"]}
+                configured = list(table.primary_key) + [c for c in (table.rowversion_column, table.change_column) if c]
+                description["configured_primary_key"] = table.primary_key
+                description["missing_columns"] = [c for c in configured if c not in names]
+                described.append(description)
+        return {"sync_pair_id": sync_pair_id, "source_type": pair.source.get("type"), "tables": described}
+
+    @staticmethod
+    def _target_watermark_name(table: SyncTableConfig) -> str:
+        """Watermark entry name for the target side of a bidirectional table."""
+        return f"{table.name}@target"
+
+    def _write_batches(self, batches, table_def: Dict[str, Any], target, result: Dict[str, Any],
+                       job: Dict[str, Any], table: SyncTableConfig, pipeline: HookPipeline,
+                       record_filter: Optional[RecordFilter] = None,
+                       idempotency: Optional[IdempotencyKeys] = None,
+                       count_reads: bool = True, checkpoint: bool = True,
+                       merge_plan: Optional[MergePlan] = None,
+                       lineage: Optional[LineageStamper] = None,
+                       interruptible: bool = True,
+                       on_batch: Optional[Callable[[List[Dict[str, Any]], List[Dict[str, Any]], List[Dict[str, Any]]], None]] = None
+                       ) -> None:
+        """
+        Filter, transform and write source batches to the target, accumulating counts into result.
+
+        A checkpoint is saved after each committed batch. Dry-run jobs compare
+        each batch with the current target rows instead of writing it.
+
+        Unless interruptible is False, the job's control is checked before
+        each batch is read, transformed and written, so a paused or cancelled
+        job stops without loading a partial batch.
+
+        Merge source columns are joined in after filtering, and records are
+        stamped with their idempotency keys and lineage before the hooks run;
+        upserts the target has already applied are counted as unchanged.
+
+        Rejected records go to the dead-letter store, except records that break
+        a validation rule, which go to the quarantine table. When the target
+        refuses a batch because of a record's data, the batch is written record
+        by record and only the failing records are dead-lettered. Pending dead
+        letters of records that now sync cleanly are marked superseded, and
+        quarantined records that now pass are released.
+
+        When the sync pair publishes change events, each batch's events are
+        staged before it is written and published before its checkpoint.
+        When it checks the table for anomalies, the rows each batch replaces
+        are looked up before it is written and compared with it afterwards.
+
+        on_batch, when given, is called after each batch with the batch, the
+        records of it that passed the filters and merge, and its rejected records.
+
+        Column batches (see sync_columnar) are stamped and written as they are
+        when nothing on the way needs records, and turned into records otherwise.
+        """
+        control = self._control(job) if interruptible else None
+        context = HookContext(job["job_id"], job["sync_pair_id"], table_def, result["mode"], job.get("dry_run", False),
+                              control)
+        target_def = pipeline.target_table(table_def)
+        pending_letters = None if job.get("dry_run") else self.dead_letters.pending_keys(job["sync_pair_id"], table.name)
+        events = None if job.get("dry_run") else self._events(job, table_def, target_def)
+        anomalies = None if job.get("dry_run") else self._anomalies(job, table_def, target_def)
+        validator = pipeline.validator
+        quarantined_keys = None
+        if validator and not job.get("dry_run"):
+            quarantined_keys = target.quarantined_keys(validator.quarantine_table, job["sync_pair_id"], table.name)
+        columnar = (not job.get("dry_run") and events is None and anomalies is None and on_batch is None
+                    and not pipeline and record_filter is None and merge_plan is None)
+        reads = tracer.iterate("sync.read", batches, {"sync.connector": job.get("source_system")})
+        for batch in checked(reads, control):
+            if not batch:
+                continue
+            result["batches"] += 1
+            if count_reads:
+                result["records_read"] += len(batch)
+                SYNC_ROWS_READ.inc(len(batch), sync_pair=job["sync_pair_id"], connector=job.get("source_system"))
+            if isinstance(batch, ColumnBatch):
+                if columnar and self._write_columns(batch, job, table, table_def, target_def, target, result,
+                                                    idempotency, lineage, pending_letters, checkpoint, control):
+                    continue
+                batch = batch.records()
+
+            records = batch
+            if record_filter:
+                records, excluded = record_filter.apply(records)
+                result["records_filtered"] = result.get("records_filtered", 0) + excluded
+                if record_filter.spatial is not None:
+                    result["records_outside_area"] = result.get("records_outside_area", 0) + record_filter.outside
+            failed = []
+            if merge_plan:
+                with tracer.span("sync.merge", {"sync.records": len(records)}):
+                    missing = merge_plan.merge(records, result)
+                if missing:
+                    unmatched = {id(record) for record, _ in missing}
+                    records = [r for r in records if id(r) not in unmatched]
+                    failed = [{"record": dict(record), "errors": errors, "stage": STAGE_MERGE}
+                              for record, errors in missing]
+            if idempotency:
+                idempotency.stamp(records)
+            if lineage:
+                lineage.stamp(records)
+            source_records = records
+            if pipeline:
+                with tracer.span("sync.transform", {"sync.records": len(records)}):
+                    records, dropped, rejected = pipeline.apply(records, context, result)
+                result["records_dropped"] = result.get("records_dropped", 0) + dropped
+                failed.extend(rejected)
+            if control:
+                control.check()
+
+            if job.get("dry_run"):
+                if failed:
+                    record_rejections(result, table_def, failed)
+                    self._count_quarantined(result, failed)
+                if records:
+                    self._diff_batch(records, target_def, target, result, table)
+                if on_batch:
+                    on_batch(batch, source_records, failed)
+                continue
+
+            if records:
+                staged = events.stage(target, records) if events else None
+                replaced = anomalies.lookup(target, records) if anomalies else None
+                try:
+                    write_attributes = {"sync.connector": target.connector_type, "sync.records": len(records)}
+                    with tracer.span("sync.write", write_attributes):
+                        counts = target.write_batch(target_def, records)
+                except Exception as e:
+                    if not target.is_record_error(e):
+                        if events:
+                            events.discard(staged)
+                        raise
+                    logger.warning(f"Batch write to {table.name} failed ({e}); writing its records one at a time")
+                    failed_keys = {record_key(table_def["primary_key"], item["record"]) for item in failed}
+                    retry = [r for r in source_records if record_key(table_def["primary_key"], r) not in failed_keys]
+                    records, counts, load_failed = self._write_records_individually(
+                        retry, target_def, target, pipeline, context
+                    )
+                    failed.extend(load_failed)
+                    if events:
+                        staged = events.restage(staged, records)
+                if events:
+                    published = events.publish(staged)
+                    if published:
+                        result["events_published"] = result.get("events_published", 0) + published
+                self._count_written(job, target, target_def, result, counts)
+                if anomalies and records:
+                    anomalies.observe(records, replaced, result)
+                if pipeline and records:
+                    pipeline.after_load(records, counts, context)
+
+            if failed:
+                record_rejections(result, table_def, failed)
+            quarantined = self._count_quarantined(result, failed)
+            if quarantined_keys is not None:
+                self._update_quarantine(job, table_def, target_def, target, validator.quarantine_table,
+                                        source_records, quarantined, quarantined_keys, result)
+            self._update_dead_letters(job, table_def, source_records,
+                                      [item for item in failed if item["stage"] != STAGE_QUARANTINE], pending_letters)
+            if on_batch:
+                on_batch(batch, source_records, failed)
+            if checkpoint:
+                # Positions refer to source values, before any transform
+                with tracer.span("sync.checkpoint"):
+                    self._checkpoint(job, table, result, batch[-1])
+
+    def _write_columns(self, batch: ColumnBatch, job: Dict[str, Any], table: SyncTableConfig,
+                       table_def: Dict[str, Any], target_def: Dict[str, Any], target, result: Dict[str, Any],
+                       idempotency: Optional[IdempotencyKeys], lineage: Optional[LineageStamper],
+                       pending_letters: Optional[Dict[str, str]], checkpoint: bool, control) -> bool:
+        """
+        Stamp and write a column batch without making records of it.
+
+        Returns:
+            False when the target refused the batch because of a record's
+            data, so it goes through the record path, which finds the record
+        """
+        if idempotency:
+            idempotency.stamp_columns(batch)
+        if lineage:
+            lineage.stamp_columns(batch)
+        if control:
+            control.check()
+        try:
+            write_attributes = {"sync.connector": target.connector_type, "sync.records": len(batch),
+                                "sync.columnar": True}
+            with tracer.span("sync.write", write_attributes):
+                counts = target.write_columns(target_def, batch)
+        except Exception as e:
+            if not target.is_record_error(e):
+                raise
+            logger.warning(f"Batch write to {table.name} failed ({e}); writing it as records")
+            return False
+        self._count_written(job, target, target_def, result, counts)
+        result["columnar_batches"] = result.get("columnar_batches", 0) + 1
+        self._update_dead_letters(job, table_def, batch, [], pending_letters)
+        if checkpoint:
+            with tracer.span("sync.checkpoint"):
+                self._checkpoint(job, table, result, batch[-1])
+        return True
+
+    @staticmethod
+    def _count_written(job: Dict[str, Any], target, target_def: Dict[str, Any], result: Dict[str, Any],
+                       counts: Dict[str, int]) -> None:
+        """Add a written batch's counts to the table result."""
+        result["records_written"] += counts.get("upserted", 0) + counts.get("deleted", 0)
+        result["records_deleted"] += counts.get("deleted", 0)
+        SYNC_ROWS_WRITTEN.inc(counts.get("upserted", 0) + counts.get("deleted", 0),
+                              sync_pair=job["sync_pair_id"], connector=target.connector_type)
+        for name in ("unchanged", "duplicates", "bulk_loaded"):
+            if counts.get(name):
+                result[f"records_{name}"] = result.get(f"records_{name}", 0) + counts[name]
+        if counts.get("upserted") or counts.get("deleted"):
+            # Reference lookups read from this table are stale now
+            lookup_cache.invalidate(target, target_def.get("target_table") or target_def["name"])
+
+    @staticmethod
+    def _table_reader(job: Dict[str, Any], source, target, pipeline: HookPipeline,
+                      record_filter: Optional[RecordFilter], merge_plan: Optional[MergePlan]):
+        """
+        The source's full table read: in column batches when both connectors
+        handle them natively and no filter, merge, hook or rule needs records.
+        """
+        if (COLUMNAR_ENABLED and getattr(source, "columnar_reads", False) and getattr(target, "columnar_writes", False)
+                and not job.get("dry_run") and not pipeline and record_filter is None and merge_plan is None):
+            return source.read_table_columns
+        return source.read_table
+
+    @staticmethod
+    def _idempotency(job: Dict[str, Any], pair: SyncPairConfig, table_def: Dict[str, Any]) -> Optional[IdempotencyKeys]:
+        """Key stamper for a table, or None when the job forces every record to be rewritten."""
+        if job["parameters"].get("force_write"):
+            return None
+        return build_idempotency(pair.source_system_id, SyncEngine._idempotency_hooks(pair, table_def["name"]),
+                                 table_def, merges_table(pair.merge, table_def["name"]))
+
+    def _events(self, job: Dict[str, Any], table_def: Dict[str, Any],
+                target_def: Dict[str, Any]) -> Optional[ChangeEventEmitter]:
+        """Change event emitter for the batches a job writes to a table, if its sync pair publishes events."""
+        pair = self.registry.get(job["sync_pair_id"])
+        return build_emitter(pair.sync_pair_id, pair.county_id, pair.events, table_def, target_def,
+                             self.store, job["job_id"])
+
+    def _anomalies(self, job: Dict[str, Any], table_def: Dict[str, Any],
+                   target_def: Dict[str, Any]) -> Optional[AnomalyDetector]:
+        """Anomaly detector for the batches a job writes to a table, if its sync pair checks the table."""
+        pair = self.registry.get(job["sync_pair_id"])
+        return build_detector(pair.sync_pair_id, pair.anomalies, table_def, target_def, self.store, job["job_id"])
+
+    @staticmethod
+    def _lineage(job: Dict[str, Any], pair: SyncPairConfig, table_def: Dict[str, Any]) -> LineageStamper:
+        """Lineage stamper for the records a job writes to a table."""
+        return build_lineage(pair.source_system_id, SyncEngine._idempotency_hooks(pair, table_def["name"]),
+                             table_def, job["job_id"], job.get("roll_year"))
+
+    @staticmethod
+    def _idempotency_hooks(pair: SyncPairConfig, table_name: str) -> List[Dict[str, Any]]:
+        """Hook definitions keyed into idempotency keys; validation rules, geometry repair and address standardization count too, so new rules re-check loaded rows."""
+        rules = (pair.validation.get("rules") or {}).get(table_name)
+        geometry = (pair.geometry_repair.get("tables") or {}).get(table_name)
+        address = (pair.address_standardization.get("tables") or {}).get(table_name)
+        return (pair.hooks + ([{"type": "validation", "tables": [table_name], "rules": rules}] if rules else [])
+                + ([{"type": "geometry_repair", "tables": [table_name], "settings": geometry}] if geometry else [])
+                + ([{"type": "address_standardization", "tables": [table_name], "settings": address}] if address else []))
+
+    def _spatial_filter(self, pair: SyncPairConfig, parameters: Optional[Dict[str, Any]],
+                        table_name: Optional[str] = None) -> Optional[SpatialFilter]:
+        """
+        The spatial filter of a job's parameters, or None when it has none or
+        it leaves out the table.
+
+        Raises:
+            ValueError: If the filter is invalid or names an unknown district
+        """
+        definition = (parameters or {}).get("spatial_filter")
+        if definition is None:
+            return None
+        spec = parse_spatial_filter(definition, for_sync=True)
+        if table_name is not None and spec["tables"] and table_name not in spec["tables"]:
+            return None
+        districts = None
+        if spec["kind"] == "district":
+            districts = DistrictRegions(county_export_settings(self.registry.config_dir, pair.county_id),
+                                        LayerReader(self.registry))
+        return build_spatial_filter(spec, districts)
+
+    @staticmethod
+    def _pipeline(pair: SyncPairConfig, table_name: str, target) -> HookPipeline:
+        """Hook pipeline of a table, with its geometry repair, address standardization and validation rules checked against the target."""
+        pipeline = build_pipeline(pair.hooks, table_name).bind(target)
+        pipeline.geometry = build_geometry_repairer(pair.geometry_repair, table_name)
+        pipeline.address = build_address_standardizer(pair.address_standardization, table_name)
+        if (pair.validation.get("rules") or {}).get(table_name):
+            target_tables = {
+                t.name: build_pipeline(pair.hooks, t.name).target_table(t.to_dict()) for t in pair.tables
+            }
+            pipeline.validator = build_validator(pair.validation, table_name, target_tables).bind(target)
+        return pipeline
+
+    def _write_records_individually(self, source_records: List[Dict[str, Any]], target_def: Dict[str, Any],
+                                    target, pipeline: HookPipeline, context: HookContext):
+        """
+        Transform and write records one at a time after a batch write failed.
+
+        Returns:
+            Tuple of (records written, combined counts, failed records with their errors)
+        """
+        written, failed = [], []
+        counts = {"upserted": 0, "deleted": 0}
+        for source_record in source_records:
+            records = [source_record]
+            if pipeline:
+                records, _, rejected = pipeline.apply(records, context)
+                failed.extend(rejected)
+            if not records:
+                continue
+            try:
+                record_counts = target.write_batch(target_def, records)
+            except Exception as e:
+                if not target.is_record_error(e):
+                    raise
+                failed.append({"record": dict(source_record), "errors": [str(e).strip()], "stage": STAGE_LOAD})
+                continue
+            written.extend(records)
+            for name, count in record_counts.items():
+                counts[name] = counts.get(name, 0) + count
+        return written, counts, failed
+
+    @staticmethod
+    def _count_quarantined(result: Dict[str, Any], failed: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        """Count the rejected records that broke a validation rule and return them."""
+        quarantined = [item for item in failed if item["stage"] == STAGE_QUARANTINE]
+        if quarantined:
+            result["records_quarantined"] = result.get("records_quarantined", 0) + len(quarantined)
+        return quarantined
+
+    @staticmethod
+    def _update_quarantine(job: Dict[str, Any], table_def: Dict[str, Any], target_def: Dict[str, Any], target,
+                           quarantine_table: str, source_records: List[Dict[str, Any]],
+                           quarantined: List[Dict[str, Any]], quarantined_keys: set, result: Dict[str, Any]) -> None:
+        """Quarantine the records of a batch that broke validation rules and release those that now pass."""
+        keys = set()
+        entries = []
+        for item in quarantined:
+            key = record_key(table_def["primary_key"], item["record"])
+            keys.add(key)
+            entries.append({
+                "sync_pair_id": job["sync_pair_id"],
+                "source_table": table_def["name"],
+                "target_table": target_def.get("target_table") or target_def["name"],
+                "record_key": key,
+                "job_id": job["job_id"],
+                "reasons": item["reasons"],
+                "record": item["record"],
+                "loaded": item["loaded"],
+            })
+        target.quarantine_records(quarantine_table, entries)
+
+        passed = [
+            key for key in (record_key(table_def["primary_key"], r) for r in source_records)
+            if key in quarantined_keys and key not in keys
+        ]
+        if passed:
+            released = target.release_quarantined(quarantine_table, job["sync_pair_id"], table_def["name"], passed)
+            result["records_released"] = result.get("records_released", 0) + released
+            quarantined_keys.difference_update(passed)
+        quarantined_keys.update(keys)
+
+    def _update_dead_letters(self, job: Dict[str, Any], table_def: Dict[str, Any],
+                             source_records: List[Dict[str, Any]], failed: List[Dict[str, Any]],
+                             pending_letters: Optional[Dict[str, str]]) -> None:
+        """Dead-letter the failed records of a batch and supersede pending letters of records that synced."""
+        if pending_letters is None:
+            return
+        failed_keys = set()
+        for item in failed:
+            letter = self.dead_letters.capture(
+                job["job_id"], job["sync_pair_id"], table_def, item["record"], item["errors"], item["stage"]
+            )
+            failed_keys.add(letter["record_key"])
+            pending_letters[letter["record_key"]] = letter["dead_letter_id"]
+        if len(pending_letters) > len(failed_keys):
+            synced = set()
+            if isinstance(source_records, ColumnBatch):
+                keys = source_records.keys(table_def["primary_key"])
+            else:
+                keys = (record_key(table_def["primary_key"], record) for record in source_records)
+            for key in keys:
+                if key in pending_letters and key not in failed_keys:
+                    synced.add(pending_letters.pop(key))
+            self.dead_letters.supersede(sorted(synced), job["job_id"])
+
+    @staticmethod
+    def _diff_batch(batch: List[Dict[str, Any]], table_def: Dict[str, Any], target,
+                    result: Dict[str, Any], table: SyncTableConfig) -> None:
+        """Add a batch to the table's dry-run diff report."""
+        keys = [[record.get(column) for column in table_def["primary_key"]] for record in batch]
+        existing = target.fetch_records(table_def, keys)
+        volatile_columns = [c for c in (table.target_change_column,) if c]
+        diff_batch(table_def, batch, existing, result.setdefault("diff", new_table_diff()), exclude=volatile_columns)
+
+    def _checkpoint(self, job: Dict[str, Any], table: SyncTableConfig, result: Dict[str, Any],
+                    last_record: Dict[str, Any]) -> None:
+        """
+        Persist the position reached in a table after a committed batch.
+
+        Also picks up pause and cancel requests stored by another process and
+        preemption requests from the job queue while the job runs.
+
+        Raises:
+            SyncJobCancelled: If the job has been cancelled
+            SyncJobPaused: If the job has been paused
+            SyncJobPreempted: If the job queue asked the job to yield its worker
+        """
+        with self._job_lock:
+            job.setdefault("checkpoints", {})[table.name] = {
+                "result": dict(result),
+                "last_key": [last_record.get(column) for column in table.primary_key],
+                "last_version": last_record.get(VERSION_FIELD),
+                "updated_at": datetime.utcnow().isoformat()
+            }
+            stored = self._merge_stored_control(job)
+            if stored.get("preempt_requested_by"):
+                # Keep the request visible to the job's other workers
+                job["preempt_requested_by"] = stored["preempt_requested_by"]
+            self._save_job(job)
+            progress = self._due_progress(job, table)
+        if progress:
+            self._announce(job, "progress", progress)
+        control = self._control(job)
+        if control and job.get("control_request"):
+            control.signal(job["control_request"])
+            control.check()
+        if stored.get("preempt_requested_by"):
+            raise SyncJobPreempted(f"Sync job {job['job_id']} was preempted by "
+                                   f"{_preempted_by(stored['preempt_requested_by'])}")
+
+    def _control(self, job: Dict[str, Any]) -> Optional[JobControl]:
+        """The control of a job running in this process."""
+        running = self._running.get(job["job_id"])
+        return running[1] if running else None
+
+    def _live_job(self, job_id: str) -> Dict[str, Any]:
+        """The record of a job, using the in-memory one while it runs in this process."""
+        running = self._running.get(job_id)
+        return running[0] if running else self._load_job(job_id)
+
+    def _request_control(self, job: Dict[str, Any], action: str, requested_by: Optional[str]) -> None:
+        """Ask a running job to pause or cancel; the caller saves the job."""
+        job["control_request"] = control_request(action, requested_by)
+        control = self._control(job)
+        if control:
+            control.signal(job["control_request"])
+
+    def _announce_control_change(self, job: Dict[str, Any]) -> None:
+        """Broadcast a pause or cancel request, or announce a job stopped before it ran."""
+        if job["status"] in ("PAUSED", "CANCELLED"):
+            self._announce(job, JOB_STATUS_EVENTS[job["status"]])
+            return
+        try:
+            self.bus.publish(SUBJECT_SYNC_CONTROL.format(job_id=job["job_id"]), {
+                "job_id": job["job_id"], "status": job["status"], "control_request": job["control_request"],
+            })
+        except EventBusError as e:
+            logger.warning(f"Cannot broadcast control request for sync job {job['job_id']}: {e}")
+
+    def _on_control_request(self, envelope: Dict[str, Any]) -> None:
+        """Apply a control request broadcast by another process to a job running in this one."""
+        data = envelope.get("data") or {}
+        requested = data.get("control_request")
+        with self._job_lock:
+            running = self._running.get(data.get("job_id"))
+            if running is None or not requested:
+                return
+            job, control = running
+            current = job.get("control_request")
+            if current is None or (requested["action"] == "cancel" and current["action"] != "cancel"):
+                job["control_request"] = requested
+                job["status"] = data.get("status", job["status"])
+        control.signal(requested)
+
+    def _estimate_records(self, job: Dict[str, Any]) -> Optional[int]:
+        """Records the job is expected to read: those of the last completed run of the same pair, mode and tables."""
+        try:
+            for previous in self.list_jobs(sync_pair_id=job["sync_pair_id"], status="COMPLETED", limit=50):
+                if (previous["job_id"] != job["job_id"] and previous.get("mode") == job["mode"]
+                        and sorted(previous.get("tables") or []) == sorted(job["tables"])):
+                    return previous.get("stats", {}).get("records_processed") or None
+        except Exception as e:
+            logger.warning(f"Cannot estimate the size of sync job {job['job_id']}: {e}")
+        return None
+
+    def _due_progress(self, job: Dict[str, Any], table: SyncTableConfig) -> Optional[Dict[str, Any]]:
+        """The job's progress if it is time to announce it again; the caller holds the job lock."""
+        now = time.monotonic()
+        last = self._progress_announced.get(job["job_id"])
+        if last is not None and now - last < PROGRESS_EVENT_SECONDS:
+            return None
+        self._progress_announced[job["job_id"]] = now
+        return progress_summary(job, table.name)
+
+    def _announce(self, job: Dict[str, Any], event: str, progress: Optional[Dict[str, Any]] = None) -> None:
+        """Publish a job lifecycle or progress event; the bus being down never affects the job."""
+        data = {
+            "job_id": job["job_id"],
+            "sync_pair_id": job["sync_pair_id"],
+            "county_id": job.get("county_id"),
+            "status": job["status"],
+            "mode": job["mode"],
+            "dry_run": job.get("dry_run", False),
+            "tables": job["tables"],
+            "stats": job.get("stats"),
+            "message": job.get("message"),
+        }
+        if progress is not None:
+            data["progress"] = progress
+        try:
+            self.bus.publish(SUBJECT_SYNC_JOB.format(job_id=job["job_id"], event=event), data)
+        except EventBusError as e:
+            logger.warning(f"Cannot announce sync job {job['job_id']} {event}: {e}")
+
+    def _merge_stored_control(self, job: Dict[str, Any]) -> Dict[str, Any]:
+        """
+        Copy a pause or cancel request stored by another process onto a running job's record.
+
+        Returns:
+            The stored job record
+        """
+        with self._job_lock:
+            stored = self._load_job(job["job_id"])
+            requested, current = stored.get("control_request"), job.get("control_request")
+            if requested and (current is None or (requested["action"] == "cancel" and current["action"] != "cancel")):
+                job["control_request"] = requested
+                job["status"] = stored["status"]
+        return stored
+
+    def _save_job(self, job: Dict[str, Any]) -> None:
+        """Persist a job record."""
+        job["terminal"] = job["status"] in TERMINAL_STATUSES
+        self.store.save(JOBS_COLLECTION, job["job_id"], job)
+
+    def _load_job(self, job_id: str) -> Dict[str, Any]:
+        """
+        Load a job record.
+
+        Raises:
+            FileNotFoundError: If job with the given ID does not exist
+        """
+        try:
+            return self.store.load(JOBS_COLLECTION, job_id)
+        except FileNotFoundError:
+            raise FileNotFoundError(f"Sync job {job_id} not found")
+
+
+# Create a singleton instance
+sync_engine = SyncEngine()
+
+
+def main():
+    """Command-line entry point for running a sync job."""
+    configure_structured_logging()
+    parser = argparse.ArgumentParser(description="TerraFusion SyncService Sync Engine")
+    parser.add_argument('sync_pair_id', help="Sync pair to run")
+    parser.add_argument('--mode', choices=SYNC_MODES, help="Sync mode (defaults to the sync pair's default_mode)")
+    parser.add_argument('--table', action='append', dest='tables', help="Table to sync (repeatable)")
+    parser.add_argument('--username', default=os.environ.get('USER', 'cli'), help="Username recorded on the job")
+    parser.add_argument('--dry-run', action='store_true', help="Report the changes a sync would make without writing")
+    parser.add_argument('--force-write', action='store_true',
+                        help="Rewrite every record, even source changes the target has already applied")
+
+    args = parser.parse_args()
+
+    parameters = {"force_write": True} if args.force_write else None
+    job = sync_engine.create_sync_job(args.sync_pair_id, args.username, args.mode, args.tables,
+                                      parameters, dry_run=args.dry_run)
+    job = sync_engine.process_job(job["job_id"])
+
+    if args.dry_run:
+        report = {
+            "job_id": job["job_id"],
+            "sync_pair_id": job["sync_pair_id"],
+            "status": job["status"],
+            "message": job["message"],
+            "summary": job.get("diff_summary"),
+            "tables": {name: result.get("diff") for name, result in job["table_results"].items()}
+        }
+        print(json.dumps(report, indent=2, default=str))
+    else:
+        print(job["message"])
+
+    return 0 if job["status"] == "COMPLETED" else 1
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,1106 @@
+"""
+TerraFusion SyncService - Entity Modules
+
+This module provides entity modules: the staging layout of an assessment
+record kind that syncs alongside parcels (exemptions, sales, ...), with
+mapping templates for the source systems counties run and the validation
+rules the records must pass. A sync pair enables a module with a block
+under "entities", named by the module:
+
+    "entities": {
+        "exemptions": {
+            "template": "pacs",
+            "parcels": {"table": "dbo.property", "fields": ["prop_id"]},
+            "type_codes": {"SNR/DSBL": "senior", "DV100": "disability"}
+        }
+    }
+
+The module generates the sync pair's tables for the entity: each of the
+template's source tables, loaded into one of the module's staging tables
+(exemptions; sales and sale_parcels), with a field mapping hook from the
+template and the module's validation rules ahead of any the pair lists for
+the table. "tables" adjusts a generated table definition (its name,
+target_table, primary_key or change tracking), by staging table. With
+"template": null nothing is mapped, for pairs whose field_mapping file maps
+the tables to the staging columns instead.
+
+Each record is linked to its parcel by a reference rule: the module's
+parcel columns (prop_id) must match the "fields" of a synced record of the
+parcels "table", which the entity tables depend on so it syncs first. The
+tables of a module are linked to each other the same way. Records that
+break a rule go to the quarantine table (see sync_validation).
+"""
+
+import copy
+import logging
+from typing import Callable, Dict, List, Any, Optional
+
+from sync_mapping import FieldMapping
+from sync_valuation import parse_tolerances
+from sync_appeals import APPEAL_STATUSES, APPEAL_STATUS_HOOK
+from sync_districts import DISTRICT_ASSIGNMENT_HOOK
+from sync_permits import (PERMIT_MATCH_HOOK, PERMIT_WORK_CLASSES, DEFAULT_WORKLIST_CLASSES, DEFAULT_MIN_CONFIDENCE,
+                          MATCH_COLUMNS)
+from sync_exemption_audit import parse_audit
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Exemption types the exemptions module accepts by default
+EXEMPTION_TYPES = ["senior", "disability", "religious", "government"]
+
+# Statuses of a personal property account
+ACCOUNT_STATUSES = ["active", "inactive", "closed"]
+
+# Depreciation methods of personal property categories
+DEPRECIATION_METHODS = ["straight_line", "declining_balance", "schedule"]
+
+# Kinds of taxing district the tax_districts module accepts by default
+DISTRICT_TYPES = ["county", "city", "school", "fire", "hospital", "library", "port", "cemetery", "park", "water"]
+
+
+class EntityTable:
+    """A staging table of an entity module."""
+
+    def __init__(self, name: str, columns: Dict[str, str], label: str, parcel_link: bool = True,
+                 references: Optional[Dict[str, Dict[str, str]]] = None, push_only: bool = False):
+        """
+        Args:
+            name: Staging table, and the table's name in templates and the block's tables
+            columns: Staging columns and their sync_mapping field types (None for values kept
+                as they are, such as geometries)
+            label: What a record is called in messages
+            parcel_link: Whether records link to a parcel by the module's parcel columns
+            references: Columns linking records to another table of the module,
+                {table: {column: referenced column}}
+            push_only: Whether records are pushed (see sync_ingest) rather than read from the source
+        """
+        self.name = name
+        self.columns = columns
+        self.label = label
+        self.parcel_link = parcel_link
+        self.references = references or {}
+        self.push_only = push_only
+
+
+class EntityModule:
+    """
+    Base class of entity modules.
+
+    Subclasses set the staging tables, the columns linking a record to its
+    parcel and the mapping templates. A template gives, per staging table,
+    the source table with its primary key and the source of each staging
+    column (a column name, or a field mapping entry without its target and
+    type), and the lookups of its mapping.
+    """
+
+    entity: str = ""  # Set by register_entity
+    entity_tables: List[EntityTable] = []
+    parcel_columns: List[str] = []
+    templates: Dict[str, Dict[str, Any]] = {}
+    default_template: str = "generic"
+    # Settings of the module's block
+    settings = ("template", "tables", "parcels", "unmapped_columns")
+
+    def __init__(self, sync_pair_id: str, definition: Any, tables: List[Dict[str, Any]]):
+        """
+        Validate a module block.
+
+        Args:
+            sync_pair_id: Sync pair the block belongs to
+            definition: The block
+            tables: The sync pair's table definitions, vendor tables included
+
+        Raises:
+            ValueError: If the block is invalid
+        """
+        self.label = f"Sync pair {sync_pair_id}: entities.{self.entity}"
+        if not isinstance(definition, dict):
+            raise ValueError(f"{self.label} must be an object")
+        unknown = [name for name in definition if name not in self.settings]
+        if unknown:
+            raise ValueError(f"{self.label}: unknown settings {', '.join(unknown)}")
+        self.options = definition
+
+        self.template = definition.get("template", self.default_template)
+        if self.template is not None and self.template not in self.templates:
+            raise ValueError(f"{self.label}: unknown template {self.template}. "
+                             f"Templates: {', '.join(sorted(self.templates))}")
+        overrides = definition.get("tables") or {}
+        if not isinstance(overrides, dict) or not all(isinstance(o, dict) for o in overrides.values()):
+            raise ValueError(f"{self.label}.tables must be an object of staging table: table settings")
+        unknown = [name for name in overrides if name not in [t.name for t in self.entity_tables]]
+        if unknown:
+            raise ValueError(f"{self.label}.tables names unknown tables {', '.join(unknown)}. "
+                             f"Tables: {', '.join(t.name for t in self.entity_tables)}")
+        self.unmapped_columns = definition.get("unmapped_columns", "drop")
+
+        parcels = definition.get("parcels")
+        if not isinstance(parcels, dict) or not parcels.get("table"):
+            raise ValueError(f"{self.label}.parcels must name the sync pair's parcel table")
+        names = [table.get("name") for table in tables]
+        if parcels["table"] not in names:
+            raise ValueError(f"{self.label}.parcels names unknown table {parcels['table']}")
+        fields = parcels.get("fields") or list(self.parcel_columns)
+        if isinstance(fields, str):
+            fields = [fields]
+        if len(fields) != len(self.parcel_columns):
+            raise ValueError(f"{self.label}.parcels.fields must list {len(self.parcel_columns)} parcel "
+                             f"column(s), matching {', '.join(self.parcel_columns)}")
+        self.parcels = {"table": parcels["table"], "fields": list(fields)}
+
+        # Generated table definitions, by staging table
+        self.tables: Dict[str, Dict[str, Any]] = {}
+        for entity_table in self.entity_tables:
+            template = self.templates[self.template]["tables"][entity_table.name] if self.template else {}
+            table = {name: copy.deepcopy(value) for name, value in template.items() if name != "fields"}
+            table.setdefault("target_table", entity_table.name)
+            if entity_table.push_only:
+                table["push_only"] = True
+            table.update(copy.deepcopy(overrides.get(entity_table.name, {})))
+            if not table.get("name") or not table.get("primary_key"):
+                raise ValueError(f"{self.label}.tables.{entity_table.name} must set name and primary_key "
+                                 f"when there is no template")
+            if table["name"] in names or table["name"] in [t["name"] for t in self.tables.values()]:
+                raise ValueError(f"Table {table['name']} is generated by the {self.entity} module; "
+                                 f"change it with the module's tables setting")
+            depends_on = list(table.get("depends_on", []))
+            linked = ([self.parcels["table"]] if entity_table.parcel_link else []) + \
+                [self.tables[name]["name"] for name in entity_table.references]
+            depends_on.extend(name for name in linked if name not in depends_on)
+            table["depends_on"] = depends_on
+            self.tables[entity_table.name] = table
+
+    def lookups(self) -> Dict[str, Dict[str, Any]]:
+        """Lookups of the template's field mapping."""
+        return copy.deepcopy(self.templates[self.template].get("lookups", {}))
+
+    def table_definitions(self) -> List[Dict[str, Any]]:
+        """Sync pair table definitions of the entity tables, in dependency order."""
+        return [copy.deepcopy(self.tables[t.name]) for t in self.entity_tables]
+
+    def mapping_definition(self) -> Optional[Dict[str, Any]]:
+        """Field mapping document of the entity tables; None without a template."""
+        if self.template is None:
+            return None
+        tables = {}
+        for entity_table in self.entity_tables:
+            fields = []
+            for column, source in self.templates[self.template]["tables"][entity_table.name]["fields"].items():
+                field_def = {"source": source} if isinstance(source, str) else dict(source)
+                field_def.update(target=column, type=entity_table.columns[column])
+                fields.append(field_def)
+            tables[self.tables[entity_table.name]["name"]] = {"unmapped_columns": self.unmapped_columns,
+                                                              "fields": fields}
+        return {"lookups": self.lookups(), "tables": tables}
+
+    def table_rules(self, entity_table: EntityTable) -> List[Dict[str, Any]]:
+        """The module's own validation rules of a staging table; none by default."""
+        return []
+
+    def hooks(self) -> List[Dict[str, Any]]:
+        """Hook definitions the module adds after its field mapping; none by default."""
+        return []
+
+    def dependents(self) -> Dict[str, List[str]]:
+        """The sync pair's own tables that sync after some of the module's tables, by table; none by default."""
+        return {}
+
+    def validation_rules(self) -> Dict[str, List[Dict[str, Any]]]:
+        """Validation rules of the entity tables, by generated table: the module's own, then the links."""
+        rules = {}
+        for entity_table in self.entity_tables:
+            table_rules = self.table_rules(entity_table)
+            for name, columns in entity_table.references.items():
+                referenced = next(t for t in self.entity_tables if t.name == name)
+                table_rules.append({
+                    "id": f"{entity_table.name}_{name}",
+                    "type": "reference",
+                    "fields": list(columns),
+                    "references": {"table": self.tables[name]["name"], "fields": list(columns.values())},
+                    "message": f"{entity_table.label} must reference a synced {referenced.label.lower()}",
+                })
+            if entity_table.parcel_link:
+                table_rules.append({
+                    "id": f"{entity_table.name}_parcel",
+                    "type": "reference",
+                    "fields": list(self.parcel_columns),
+                    "references": {"table": self.parcels["table"], "fields": list(self.parcels["fields"])},
+                    "message": f"{entity_table.label} must reference a synced parcel",
+                })
+            rules[self.tables[entity_table.name]["name"]] = table_rules
+        return rules
+
+    def summary(self) -> Dict[str, Any]:
+        """The module's settings as the sync pair API shows them."""
+        return {
+            "tables": {name: {"table": table["name"], "target_table": table["target_table"]}
+                       for name, table in self.tables.items()},
+            "template": self.template,
+            "parcel_table": self.parcels["table"],
+        }
+
+
+# Registered entity modules
+ENTITY_MODULES: Dict[str, type] = {}
+
+
+def register_entity(entity: str) -> Callable[[type], type]:
+    """Class decorator that registers an EntityModule subclass under an entity name."""
+    def decorator(cls: type) -> type:
+        if not issubclass(cls, EntityModule):
+            raise TypeError(f"{cls.__name__} must subclass EntityModule")
+        cls.entity = entity
+        ENTITY_MODULES[entity] = cls
+        return cls
+    return decorator
+
+
+@register_entity("exemptions")
+class ExemptionsModule(EntityModule):
+    """
+    Property tax exemptions: senior citizen, disability, religious and
+    government, per parcel, owner and tax year.
+
+    An exemption reduces value by a percentage or by a flat amount, never
+    both; it takes effect on effective_date and ends on expiration_date,
+    when it has one. Source exemption codes are kept in exemption_code and
+    translated to exemption_type by the exemption_type lookup: the
+    template's codes, the types themselves and the block's type_codes.
+    "types" replaces the accepted types, for states with others (veteran,
+    nonprofit). Codes without a type are quarantined so they can be mapped.
+    An "audit" block scores the exemptions against risk rules for the
+    auditors' worklist (see sync_exemption_audit).
+    """
+
+    entity_tables = [
+        EntityTable("exemptions", {
+            "prop_id": "integer",
+            "owner_id": "integer",
+            "tax_year": "integer",
+            "exemption_code": "string",
+            "exemption_type": "string",
+            "effective_date": "date",
+            "expiration_date": "date",
+            "exemption_percent": "decimal",
+            "exemption_amount": "decimal",
+        }, "Exemption"),
+    ]
+    parcel_columns = ["prop_id"]
+    templates = {
+        # Stock PACS property_exemption columns; map customized schemas with a field_mapping file
+        "pacs": {
+            "tables": {"exemptions": {
+                "name": "dbo.property_exemption",
+                "primary_key": ["prop_id", "owner_id", "exmpt_tax_yr", "exmpt_type_cd"],
+                "fields": {
+                    "prop_id": "prop_id",
+                    "owner_id": "owner_id",
+                    "tax_year": "exmpt_tax_yr",
+                    "exemption_code": "exmpt_type_cd",
+                    "exemption_type": {"source": "exmpt_type_cd", "lookup": "exemption_type", "default": None},
+                    "effective_date": "effective_dt",
+                    "expiration_date": "termination_dt",
+                    "exemption_percent": "sp_pct",
+                    "exemption_amount": "sp_amt",
+                },
+            }},
+            "lookups": {"exemption_type": {
+                "SNR/DSBL": "senior", "SNR": "senior", "DSBL": "disability", "DV": "disability",
+                "REL": "religious", "RELIG": "religious", "EX": "government", "GOV": "government",
+            }},
+        },
+        # Files and feeds already in the staging layout
+        "generic": {
+            "tables": {"exemptions": {
+                "name": "exemptions",
+                "primary_key": ["prop_id", "tax_year", "exemption_code"],
+                "fields": dict(
+                    {column: column for column in entity_tables[0].columns},
+                    exemption_type={"source": "exemption_type", "lookup": "exemption_type", "default": None},
+                ),
+            }},
+        },
+    }
+    settings = EntityModule.settings + ("types", "type_codes", "audit")
+
+    def __init__(self, sync_pair_id: str, definition: Any, tables: List[Dict[str, Any]]):
+        super().__init__(sync_pair_id, definition, tables)
+        self.types = definition.get("types") or list(EXEMPTION_TYPES)
+        if not isinstance(self.types, list) or not all(isinstance(t, str) and t for t in self.types):
+            raise ValueError(f"{self.label}.types must be a list of exemption types")
+        self.type_codes = definition.get("type_codes") or {}
+        if not isinstance(self.type_codes, dict):
+            raise ValueError(f"{self.label}.type_codes must be an object of code: exemption type pairs")
+        for code, exemption_type in self.type_codes.items():
+            if exemption_type not in self.types:
+                raise ValueError(f"{self.label}.type_codes maps {code} to {exemption_type!r}, "
+                                 f"which is not one of {', '.join(self.types)}")
+        self.audit = parse_audit(self.label, definition["audit"], tables, self.tables["exemptions"]["name"],
+                                 self.types) if definition.get("audit") is not None else None
+
+    def lookups(self) -> Dict[str, Dict[str, Any]]:
+        codes = {code: t for code, t in self.templates[self.template].get("lookups", {})
+                 .get("exemption_type", {}).items() if t in self.types}
+        codes.update({t: t for t in self.types})
+        codes.update({str(code): t for code, t in self.type_codes.items()})
+        return {"exemption_type": codes}
+
+    def table_rules(self, entity_table: EntityTable) -> List[Dict[str, Any]]:
+        return [
+            {"id": "exemption_required", "type": "required", "fields": ["prop_id", "effective_date"]},
+            {"id": "exemption_type", "type": "required", "fields": ["exemption_type"],
+             "message": "Exemption code has no exemption type; add it to the module's type_codes"},
+            {"id": "exemption_type_allowed", "type": "allowed_values", "fields": ["exemption_type"],
+             "values": list(self.types)},
+            {"id": "exemption_dates", "type": "expression",
+             "expression": "expiration_date is null or expiration_date >= effective_date",
+             "message": "Exemption expires before it takes effect"},
+            {"id": "exemption_percent_or_amount", "type": "expression",
+             "expression": "(exemption_percent is not null and exemption_amount is null) "
+                           "or (exemption_percent is null and exemption_amount is not null)",
+             "message": "Exemption must have either a percentage or a flat amount, not both or neither"},
+            {"id": "exemption_percent_range", "type": "range", "fields": ["exemption_percent"], "min": 0, "max": 100},
+            {"id": "exemption_amount_range", "type": "range", "fields": ["exemption_amount"], "min": 0},
+        ]
+
+    def summary(self) -> Dict[str, Any]:
+        return dict(super().summary(), types=list(self.types), audit=copy.deepcopy(self.audit))
+
+
+@register_entity("sales")
+class SalesModule(EntityModule):
+    """
+    Sales and transfers of ownership: a record per deed in sales, with its
+    grantor and grantee, price, instrument and validity code, and a record
+    per parcel it conveyed in sale_parcels, so a sale of several parcels is
+    one sale with several parcels.
+
+    Validity codes tell arm's-length market sales, which ratio studies use
+    (see gis_ratio_study), from the rest. Coding differs from state to
+    state, so the block lists the county's valid_codes; valid_sale is true
+    for them. A valid sale needs a price.
+    """
+
+    entity_tables = [
+        EntityTable("sales", {
+            "sale_id": "string",
+            "sale_date": "date",
+            "recorded_date": "date",
+            "sale_price": "decimal",
+            "instrument_type": "string",
+            "instrument_number": "string",
+            "validity_code": "string",
+            "valid_sale": "boolean",
+            "grantor": "string",
+            "grantee": "string",
+        }, "Sale", parcel_link=False),
+        EntityTable("sale_parcels", {
+            "sale_id": "string",
+            "prop_id": "integer",
+            "parcel_sequence": "integer",
+        }, "Sale parcel", references={"sales": {"sale_id": "sale_id"}}),
+    ]
+    parcel_columns = ["prop_id"]
+    templates = {
+        # PACS change of ownership tables
+        "pacs": {
+            "tables": {
+                "sales": {
+                    "name": "dbo.chg_of_owner",
+                    "primary_key": ["chg_of_owner_id"],
+                    "fields": {
+                        "sale_id": "chg_of_owner_id",
+                        "sale_date": "sl_dt",
+                        "recorded_date": "deed_dt",
+                        "sale_price": "sl_price",
+                        "instrument_type": "deed_type_cd",
+                        "instrument_number": "deed_num",
+                        "validity_code": "sl_ratio_type_cd",
+                        "valid_sale": {"source": "sl_ratio_type_cd", "lookup": "sale_validity", "default": False},
+                        "grantor": "grantor_cv",
+                        "grantee": "grantee_cv",
+                    },
+                },
+                "sale_parcels": {
+                    "name": "dbo.chg_of_owner_prop_assoc",
+                    "primary_key": ["chg_of_owner_id", "prop_id"],
+                    "fields": {"sale_id": "chg_of_owner_id", "prop_id": "prop_id", "parcel_sequence": "seq_num"},
+                },
+            },
+        },
+        # Files and feeds already in the staging layout
+        "generic": {
+            "tables": {
+                "sales": {
+                    "name": "sales",
+                    "primary_key": ["sale_id"],
+                    "fields": dict(
+                        {column: column for column in entity_tables[0].columns},
+                        valid_sale={"source": "validity_code", "lookup": "sale_validity", "default": False},
+                    ),
+                },
+                "sale_parcels": {
+                    "name": "sale_parcels",
+                    "primary_key": ["sale_id", "prop_id"],
+                    "fields": {column: column for column in entity_tables[1].columns},
+                },
+            },
+        },
+    }
+    settings = EntityModule.settings + ("valid_codes",)
+
+    def __init__(self, sync_pair_id: str, definition: Any, tables: List[Dict[str, Any]]):
+        super().__init__(sync_pair_id, definition, tables)
+        self.valid_codes = definition.get("valid_codes")
+        if not isinstance(self.valid_codes, list) or not self.valid_codes \
+                or not all(isinstance(code, (str, int)) for code in self.valid_codes):
+            raise ValueError(f"{self.label}.valid_codes must list the validity codes of arm's-length sales")
+
+    def lookups(self) -> Dict[str, Dict[str, Any]]:
+        return {"sale_validity": {str(code): True for code in self.valid_codes}}
+
+    def table_rules(self, entity_table: EntityTable) -> List[Dict[str, Any]]:
+        if entity_table.name == "sale_parcels":
+            return [{"id": "sale_parcel_required", "type": "required", "fields": ["sale_id", "prop_id"]}]
+        return [
+            {"id": "sale_required", "type": "required", "fields": ["sale_id", "sale_date", "instrument_type"]},
+            {"id": "sale_price_range", "type": "range", "fields": ["sale_price"], "min": 0},
+            {"id": "valid_sale_price", "type": "expression",
+             "expression": "valid_sale = false or sale_price > 0",
+             "message": "A valid sale needs a sale price"},
+            {"id": "sale_recorded_date", "type": "expression",
+             "expression": "recorded_date is null or sale_date is null or recorded_date >= sale_date",
+             "message": "Sale is recorded before it took place"},
+        ]
+
+    def summary(self) -> Dict[str, Any]:
+        return dict(super().summary(), valid_codes=list(self.valid_codes))
+
+
+@register_entity("valuation_models")
+class ValuationModelsModule(EntityModule):
+    """
+    Valuation model outputs: a record per model run in model_runs, with the
+    model's name and version, the tax year it values and when it ran, and a
+    record per parcel in model_values with the predicted value and, where
+    the model gives one, its prediction interval.
+
+    Model outputs do not come from the sync pair's source: both tables are
+    push_only, loaded through the ingestion API (see sync_ingest), runs
+    before their values. "assessed_values" names the table the comparison
+    API reads current values from and "tolerances" the flags it raises (see
+    sync_valuation).
+    """
+
+    entity_tables = [
+        EntityTable("model_runs", {
+            "run_id": "string",
+            "model_name": "string",
+            "model_version": "string",
+            "tax_year": "integer",
+            "valuation_date": "date",
+            "run_at": "datetime",
+            "description": "string",
+        }, "Model run", parcel_link=False, push_only=True),
+        EntityTable("model_values", {
+            "run_id": "string",
+            "prop_id": "integer",
+            "predicted_value": "decimal",
+            "prediction_low": "decimal",
+            "prediction_high": "decimal",
+        }, "Model value", references={"model_runs": {"run_id": "run_id"}}, push_only=True),
+    ]
+    parcel_columns = ["prop_id"]
+    templates = {
+        # Model outputs are pushed in the staging layout
+        "generic": {
+            "tables": {
+                "model_runs": {
+                    "name": "model_runs",
+                    "primary_key": ["run_id"],
+                    "fields": {column: column for column in entity_tables[0].columns},
+                },
+                "model_values": {
+                    "name": "model_values",
+                    "primary_key": ["run_id", "prop_id"],
+                    "fields": {column: column for column in entity_tables[1].columns},
+                },
+            },
+        },
+    }
+    settings = EntityModule.settings + ("assessed_values", "tolerances")
+
+    def __init__(self, sync_pair_id: str, definition: Any, tables: List[Dict[str, Any]]):
+        super().__init__(sync_pair_id, definition, tables)
+        assessed_values = definition.get("assessed_values")
+        if not isinstance(assessed_values, dict) or not assessed_values.get("table"):
+            raise ValueError(f"{self.label}.assessed_values must name the sync pair's table of assessed values")
+        if assessed_values["table"] not in [table.get("name") for table in tables]:
+            raise ValueError(f"{self.label}.assessed_values names unknown table {assessed_values['table']}")
+        unknown = [name for name in assessed_values if name not in ("table", "key_field", "year_field", "value_field")]
+        if unknown:
+            raise ValueError(f"{self.label}.assessed_values: unknown settings {', '.join(unknown)}")
+        self.assessed_values = {
+            "table": assessed_values["table"],
+            "key_field": assessed_values.get("key_field", self.parcels["fields"][0]),
+            # null for a table that holds only the current year's values
+            "year_field": assessed_values.get("year_field", "tax_year"),
+            "value_field": assessed_values.get("value_field", "assessed_value"),
+        }
+        self.tolerances = parse_tolerances(self.label, definition.get("tolerances"))
+
+    def table_rules(self, entity_table: EntityTable) -> List[Dict[str, Any]]:
+        if entity_table.name == "model_runs":
+            return [{"id": "model_run_required", "type": "required", "fields": ["run_id", "model_name", "tax_year"]}]
+        return [
+            {"id": "model_value_required", "type": "required", "fields": ["run_id", "prop_id", "predicted_value"]},
+            {"id": "model_value_range", "type": "range", "fields": ["predicted_value", "prediction_low",
+                                                                    "prediction_high"], "min": 0},
+            {"id": "model_value_interval", "type": "expression",
+             "expression": "(prediction_low is null or prediction_low <= predicted_value) "
+                           "and (prediction_high is null or predicted_value <= prediction_high)",
+             "message": "Predicted value is outside its prediction interval"},
+        ]
+
+    def summary(self) -> Dict[str, Any]:
+        return dict(super().summary(), assessed_values=dict(self.assessed_values),
+                    tolerances=[dict(t) for t in self.tolerances])
+
+
+@register_entity("appeals")
+class AppealsModule(EntityModule):
+    """
+    Value appeals to the board of equalization: a record per petition in
+    appeals, with its petitioner, reason, status, the board's decision and
+    the value before and after it, and a record per hearing in
+    appeal_hearings.
+
+    Source status codes are kept in status_code and translated to one of
+    APPEAL_STATUSES by the appeal_status lookup: the statuses themselves and
+    the block's status_codes. Codes without a status are quarantined so they
+    can be mapped. A decided appeal needs its decision date and the board's
+    value. The status changes of synced appeals are announced to webhooks
+    (see sync_appeals).
+    """
+
+    entity_tables = [
+        EntityTable("appeals", {
+            "appeal_id": "string",
+            "prop_id": "integer",
+            "tax_year": "integer",
+            "petitioner": "string",
+            "filed_date": "date",
+            "reason": "string",
+            "status_code": "string",
+            "status": "string",
+            "decision": "string",
+            "decision_date": "date",
+            "value_before": "decimal",
+            "value_requested": "decimal",
+            "value_after": "decimal",
+        }, "Appeal"),
+        EntityTable("appeal_hearings", {
+            "appeal_id": "string",
+            "hearing_sequence": "integer",
+            "hearing_date": "date",
+            "hearing_type": "string",
+            "board": "string",
+            "outcome": "string",
+        }, "Appeal hearing", parcel_link=False, references={"appeals": {"appeal_id": "appeal_id"}}),
+    ]
+    parcel_columns = ["prop_id"]
+    templates = {
+        # Clerk's system exports in the staging layout
+        "generic": {
+            "tables": {
+                "appeals": {
+                    "name": "appeals",
+                    "primary_key": ["appeal_id"],
+                    "fields": dict(
+                        {column: column for column in entity_tables[0].columns},
+                        status={"source": "status_code", "lookup": "appeal_status", "default": None},
+                    ),
+                },
+                "appeal_hearings": {
+                    "name": "appeal_hearings",
+                    "primary_key": ["appeal_id", "hearing_sequence"],
+                    "fields": {column: column for column in entity_tables[1].columns},
+                },
+            },
+        },
+    }
+    settings = EntityModule.settings + ("status_codes",)
+
+    def __init__(self, sync_pair_id: str, definition: Any, tables: List[Dict[str, Any]]):
+        super().__init__(sync_pair_id, definition, tables)
+        self.status_codes = definition.get("status_codes") or {}
+        if not isinstance(self.status_codes, dict):
+            raise ValueError(f"{self.label}.status_codes must be an object of code: appeal status pairs")
+        for code, status in self.status_codes.items():
+            if status not in APPEAL_STATUSES:
+                raise ValueError(f"{self.label}.status_codes maps {code} to {status!r}, "
+                                 f"which is not one of {', '.join(APPEAL_STATUSES)}")
+
+    def lookups(self) -> Dict[str, Dict[str, Any]]:
+        codes = {status: status for status in APPEAL_STATUSES}
+        codes.update({str(code): status for code, status in self.status_codes.items()})
+        return {"appeal_status": codes}
+
+    def hooks(self) -> List[Dict[str, Any]]:
+        return [{"type": APPEAL_STATUS_HOOK, "tables": [self.tables["appeals"]["name"]]}]
+
+    def table_rules(self, entity_table: EntityTable) -> List[Dict[str, Any]]:
+        if entity_table.name == "appeal_hearings":
+            return [{"id": "appeal_hearing_required", "type": "required", "fields": ["appeal_id", "hearing_date"]}]
+        return [
+            {"id": "appeal_required", "type": "required", "fields": ["appeal_id", "prop_id", "tax_year", "filed_date"]},
+            {"id": "appeal_status", "type": "required", "fields": ["status"],
+             "message": "Appeal status code has no status; add it to the module's status_codes"},
+            {"id": "appeal_status_allowed", "type": "allowed_values", "fields": ["status"],
+             "values": list(APPEAL_STATUSES)},
+            {"id": "appeal_decision", "type": "expression",
+             "expression": "status is null or status <> 'decided' "
+                           "or (decision_date is not null and value_after is not null)",
+             "message": "A decided appeal needs a decision date and the board's value"},
+            {"id": "appeal_decision_date", "type": "expression",
+             "expression": "decision_date is null or decision_date >= filed_date",
+             "message": "Appeal is decided before it was filed"},
+            {"id": "appeal_value_range", "type": "range", "fields": ["value_before", "value_requested", "value_after"],
+             "min": 0},
+        ]
+
+    def summary(self) -> Dict[str, Any]:
+        return dict(super().summary(), statuses=list(APPEAL_STATUSES))
+
+
+@register_entity("tax_districts")
+class TaxDistrictsModule(EntityModule):
+    """
+    Taxing districts and their levies: a record per district in
+    tax_districts, with its kind (school, fire, city, ...) and boundary, and
+    a record per levy of a district and tax year in levy_rates, with its
+    rate per $1,000 of assessed value and the amount levied.
+
+    The module assigns parcels to the districts containing them (see
+    sync_districts): "assignment" names the sync pair's table of parcel
+    shapes (the parcels table by default), its key field and the target
+    column of each parcel's shape, and that table syncs after the district
+    tables. "types" replaces the accepted district kinds.
+    """
+
+    entity_tables = [
+        EntityTable("tax_districts", {
+            "district_id": "string",
+            "district_name": "string",
+            "district_type": "string",
+            "effective_date": "date",
+            "boundary": None,
+        }, "Tax district", parcel_link=False),
+        EntityTable("levy_rates", {
+            "district_id": "string",
+            "tax_year": "integer",
+            "levy_code": "string",
+            "levy_rate": "decimal",
+            "levy_amount": "decimal",
+        }, "Levy rate", parcel_link=False, references={"tax_districts": {"district_id": "district_id"}}),
+    ]
+    parcel_columns = ["prop_id"]
+    templates = {
+        # GIS district layers and levy files in the staging layout
+        "generic": {
+            "tables": {
+                "tax_districts": {
+                    "name": "tax_districts",
+                    "primary_key": ["district_id"],
+                    "fields": {column: column for column in entity_tables[0].columns},
+                },
+                "levy_rates": {
+                    "name": "levy_rates",
+                    "primary_key": ["district_id", "tax_year", "levy_code"],
+                    "fields": {column: column for column in entity_tables[1].columns},
+                },
+            },
+        },
+    }
+    settings = EntityModule.settings + ("assignment", "types")
+
+    def __init__(self, sync_pair_id: str, definition: Any, tables: List[Dict[str, Any]]):
+        super().__init__(sync_pair_id, definition, tables)
+        self.types = definition.get("types") or list(DISTRICT_TYPES)
+        if not isinstance(self.types, list) or not all(isinstance(t, str) and t for t in self.types):
+            raise ValueError(f"{self.label}.types must be a list of district types")
+        assignment = definition.get("assignment")
+        if not isinstance(assignment, dict):
+            raise ValueError(f"{self.label}.assignment must name the geometry_column of the parcels' shapes")
+        unknown = [name for name in assignment if name not in ("table", "key_field", "geometry_column")]
+        if unknown:
+            raise ValueError(f"{self.label}.assignment: unknown settings {', '.join(unknown)}")
+        self.assignment = {
+            "table": assignment.get("table") or self.parcels["table"],
+            "key_field": assignment.get("key_field") or self.parcels["fields"][0],
+            "geometry_column": assignment.get("geometry_column"),
+        }
+        if self.assignment["table"] not in [table.get("name") for table in tables]:
+            raise ValueError(f"{self.label}.assignment names unknown table {self.assignment['table']}")
+        for name in ("key_field", "geometry_column"):
+            if not isinstance(self.assignment[name], str) or not self.assignment[name]:
+                raise ValueError(f"{self.label}.assignment.{name} must be a column name")
+
+    def hooks(self) -> List[Dict[str, Any]]:
+        return [{"type": DISTRICT_ASSIGNMENT_HOOK, "tables": [self.assignment["table"]], "options": {
+            "districts": copy.deepcopy(self.tables["tax_districts"]),
+            "key_field": self.assignment["key_field"],
+            "geometry_column": self.assignment["geometry_column"],
+        }}]
+
+    def dependents(self) -> Dict[str, List[str]]:
+        return {self.assignment["table"]: [self.tables["tax_districts"]["name"]]}
+
+    def table_rules(self, entity_table: EntityTable) -> List[Dict[str, Any]]:
+        if entity_table.name == "levy_rates":
+            return [
+                {"id": "levy_rate_required", "type": "required",
+                 "fields": ["district_id", "tax_year", "levy_code", "levy_rate"]},
+                {"id": "levy_rate_range", "type": "range", "fields": ["levy_rate", "levy_amount"], "min": 0},
+            ]
+        return [
+            {"id": "tax_district_required", "type": "required",
+             "fields": ["district_id", "district_name", "district_type", "boundary"]},
+            {"id": "tax_district_type_allowed", "type": "allowed_values", "fields": ["district_type"],
+             "values": list(self.types)},
+        ]
+
+    def summary(self) -> Dict[str, Any]:
+        return dict(super().summary(), assignment=dict(self.assignment), types=list(self.types))
+
+
+@register_entity("personal_property")
+class PersonalPropertyModule(EntityModule):
+    """
+    Business personal property: a record per account and tax year in
+    business_accounts, with the business, its owner and the parcel its
+    assets sit on (when they sit on one), a record per line of the account's
+    asset schedule in business_assets, and the depreciation categories the
+    assets are valued by in depreciation_categories.
+
+    Source account status codes are kept in status_code and translated to
+    one of ACCOUNT_STATUSES by the account_status lookup: the statuses
+    themselves and the block's status_codes. A category depreciates by one
+    of DEPRECIATION_METHODS over its useful life, down to its floor percent.
+    Assets link to their account and category; they cannot be acquired after
+    the year they are reported in.
+    """
+
+    entity_tables = [
+        EntityTable("depreciation_categories", {
+            "category_code": "string",
+            "description": "string",
+            "depreciation_method": "string",
+            "useful_life_years": "integer",
+            "floor_percent": "decimal",
+        }, "Depreciation category", parcel_link=False),
+        EntityTable("business_accounts", {
+            "account_id": "string",
+            "tax_year": "integer",
+            "prop_id": "integer",
+            "business_name": "string",
+            "owner_name": "string",
+            "naics_code": "string",
+            "situs_address": "string",
+            "status_code": "string",
+            "status": "string",
+            "opened_date": "date",
+            "closed_date": "date",
+        }, "Business account"),
+        EntityTable("business_assets", {
+            "account_id": "string",
+            "tax_year": "integer",
+            "asset_id": "string",
+            "category_code": "string",
+            "description": "string",
+            "acquisition_year": "integer",
+            "original_cost": "decimal",
+            "quantity": "integer",
+        }, "Business asset", parcel_link=False, references={
+            "business_accounts": {"account_id": "account_id", "tax_year": "tax_year"},
+            "depreciation_categories": {"category_code": "category_code"},
+        }),
+    ]
+    parcel_columns = ["prop_id"]
+    templates = {
+        # Listing files and assessor exports in the staging layout
+        "generic": {
+            "tables": {
+                "depreciation_categories": {
+                    "name": "depreciation_categories",
+                    "primary_key": ["category_code"],
+                    "fields": {column: column for column in entity_tables[0].columns},
+                },
+                "business_accounts": {
+                    "name": "business_accounts",
+                    "primary_key": ["account_id", "tax_year"],
+                    "fields": dict(
+                        {column: column for column in entity_tables[1].columns},
+                        status={"source": "status_code", "lookup": "account_status", "default": None},
+                    ),
+                },
+                "business_assets": {
+                    "name": "business_assets",
+                    "primary_key": ["account_id", "tax_year", "asset_id"],
+                    "fields": {column: column for column in entity_tables[2].columns},
+                },
+            },
+        },
+    }
+    settings = EntityModule.settings + ("status_codes",)
+
+    def __init__(self, sync_pair_id: str, definition: Any, tables: List[Dict[str, Any]]):
+        super().__init__(sync_pair_id, definition, tables)
+        self.status_codes = definition.get("status_codes") or {}
+        if not isinstance(self.status_codes, dict):
+            raise ValueError(f"{self.label}.status_codes must be an object of code: account status pairs")
+        for code, status in self.status_codes.items():
+            if status not in ACCOUNT_STATUSES:
+                raise ValueError(f"{self.label}.status_codes maps {code} to {status!r}, "
+                                 f"which is not one of {', '.join(ACCOUNT_STATUSES)}")
+
+    def lookups(self) -> Dict[str, Dict[str, Any]]:
+        codes = {status: status for status in ACCOUNT_STATUSES}
+        codes.update({str(code): status for code, status in self.status_codes.items()})
+        return {"account_status": codes}
+
+    def table_rules(self, entity_table: EntityTable) -> List[Dict[str, Any]]:
+        if entity_table.name == "depreciation_categories":
+            return [
+                {"id": "depreciation_category_required", "type": "required",
+                 "fields": ["category_code", "depreciation_method", "useful_life_years"]},
+                {"id": "depreciation_method_allowed", "type": "allowed_values", "fields": ["depreciation_method"],
+                 "values": list(DEPRECIATION_METHODS)},
+                {"id": "useful_life_range", "type": "range", "fields": ["useful_life_years"], "min": 1},
+                {"id": "floor_percent_range", "type": "range", "fields": ["floor_percent"], "min": 0, "max": 100},
+            ]
+        if entity_table.name == "business_assets":
+            return [
+                {"id": "business_asset_required", "type": "required",
+                 "fields": ["account_id", "tax_year", "asset_id", "category_code", "acquisition_year", "original_cost"]},
+                {"id": "business_asset_cost_range", "type": "range", "fields": ["original_cost"], "min": 0},
+                {"id": "business_asset_quantity_range", "type": "range", "fields": ["quantity"], "min": 1},
+                {"id": "business_asset_acquired", "type": "expression",
+                 "expression": "acquisition_year is null or tax_year is null or acquisition_year <= tax_year",
+                 "message": "Asset is acquired after the year it is reported in"},
+            ]
+        return [
+            {"id": "business_account_required", "type": "required", "fields": ["account_id", "tax_year", "business_name"]},
+            {"id": "business_account_status", "type": "required", "fields": ["status"],
+             "message": "Account status code has no status; add it to the module's status_codes"},
+            {"id": "business_account_status_allowed", "type": "allowed_values", "fields": ["status"],
+             "values": list(ACCOUNT_STATUSES)},
+            {"id": "business_account_dates", "type": "expression",
+             "expression": "closed_date is null or opened_date is null or closed_date >= opened_date",
+             "message": "Account is closed before it was opened"},
+            {"id": "business_account_closed", "type": "expression",
+             "expression": "status is null or status <> 'closed' or closed_date is not null",
+             "message": "A closed account needs its closed date"},
+        ]
+
+    def summary(self) -> Dict[str, Any]:
+        return dict(super().summary(), statuses=list(ACCOUNT_STATUSES), methods=list(DEPRECIATION_METHODS))
+
+
+@register_entity("building_permits")
+class BuildingPermitsModule(EntityModule):
+    """
+    Building permits of the municipal permit feeds: a record per permit in
+    building_permits, with its type, work, dates, valuation and the parcel
+    number and situs address the permit names.
+
+    Source permit type codes are kept in permit_type_code and translated to
+    one of PERMIT_WORK_CLASSES by the permit_work_class lookup: the classes
+    themselves and the block's type_codes, "other" for codes it does not
+    list. Permit feeds rarely carry the assessor's parcel key, so the module
+    matches each permit to its parcel (see sync_permits): "matching" names
+    the parcels table's parcel_number_field, the sync pair's table of situs
+    "addresses" (its table, key_field and the columns of the street line)
+    and the min_confidence a match needs, and the permits table syncs after
+    the addresses. "worklist_classes" lists the work classes that put a
+    parcel on the appraisers' worklist.
+    """
+
+    entity_tables = [
+        EntityTable("building_permits", {
+            "permit_id": "string",
+            "jurisdiction": "string",
+            "permit_type_code": "string",
+            "work_class": "string",
+            "description": "string",
+            "status": "string",
+            "applied_date": "date",
+            "issued_date": "date",
+            "finaled_date": "date",
+            "valuation": "decimal",
+            "square_feet": "integer",
+            "parcel_number": "string",
+            "situs_address": "string",
+            "prop_id": "integer",
+            "candidate_prop_id": "integer",
+            "match_method": "string",
+            "match_confidence": "float",
+        }, "Building permit"),
+    ]
+    parcel_columns = ["prop_id"]
+    templates = {
+        # Permit API responses and drop files in the staging layout
+        "generic": {
+            "tables": {
+                "building_permits": {
+                    "name": "building_permits",
+                    "primary_key": ["permit_id"],
+                    "fields": dict(
+                        {column: column for column in entity_tables[0].columns if column not in MATCH_COLUMNS},
+                        work_class={"source": "permit_type_code", "lookup": "permit_work_class",
+                                    "default": "other"},
+                    ),
+                },
+            },
+        },
+    }
+    settings = EntityModule.settings + ("type_codes", "matching", "worklist_classes")
+
+    def __init__(self, sync_pair_id: str, definition: Any, tables: List[Dict[str, Any]]):
+        super().__init__(sync_pair_id, definition, tables)
+        self.type_codes = definition.get("type_codes") or {}
+        if not isinstance(self.type_codes, dict):
+            raise ValueError(f"{self.label}.type_codes must be an object of code: work class pairs")
+        for code, work_class in self.type_codes.items():
+            if work_class not in PERMIT_WORK_CLASSES:
+                raise ValueError(f"{self.label}.type_codes maps {code} to {work_class!r}, "
+                                 f"which is not one of {', '.join(PERMIT_WORK_CLASSES)}")
+        self.worklist_classes = definition.get("worklist_classes") or list(DEFAULT_WORKLIST_CLASSES)
+        if not isinstance(self.worklist_classes, list) or any(c not in PERMIT_WORK_CLASSES
+                                                              for c in self.worklist_classes):
+            raise ValueError(f"{self.label}.worklist_classes must list work classes of "
+                             f"{', '.join(PERMIT_WORK_CLASSES)}")
+
+        matching = definition.get("matching")
+        if not isinstance(matching, dict):
+            raise ValueError(f"{self.label}.matching must name the parcel_number_field or addresses of the parcels")
+        unknown = [name for name in matching if name not in ("parcel_number_field", "addresses", "min_confidence")]
+        if unknown:
+            raise ValueError(f"{self.label}.matching: unknown settings {', '.join(unknown)}")
+        if not matching.get("parcel_number_field") and not matching.get("addresses"):
+            raise ValueError(f"{self.label}.matching must name the parcel_number_field or addresses of the parcels")
+        definitions = {table.get("name"): table for table in tables}
+        key_field = self.parcels["fields"][0]
+        self.matching = {
+            "parcels": {"table": definitions[self.parcels["table"]]["name"], "key_field": key_field},
+            "parcel_number_field": matching.get("parcel_number_field"),
+            "addresses": None,
+            "min_confidence": matching.get("min_confidence", DEFAULT_MIN_CONFIDENCE),
+        }
+        if not isinstance(self.matching["min_confidence"], (int, float)) or \
+                not 0 <= self.matching["min_confidence"] <= 1:
+            raise ValueError(f"{self.label}.matching.min_confidence must be a number from 0 to 1")
+        addresses = matching.get("addresses")
+        if addresses:
+            if not isinstance(addresses, dict) or addresses.get("table") not in definitions:
+                raise ValueError(f"{self.label}.matching.addresses must name a table of the sync pair")
+            columns = addresses.get("columns")
+            if isinstance(columns, str):
+                columns = [columns]
+            if not isinstance(columns, list) or not columns or not all(isinstance(c, str) and c for c in columns):
+                raise ValueError(f"{self.label}.matching.addresses.columns must list the columns of the street line")
+            self.matching["addresses"] = {"table": addresses["table"],
+                                          "key_field": addresses.get("key_field") or key_field,
+                                          "columns": columns}
+            depends_on = self.tables["building_permits"]["depends_on"]
+            if addresses["table"] not in depends_on:
+                depends_on.append(addresses["table"])
+        self._definitions = {name: copy.deepcopy(definitions[name])
+                             for name in [self.parcels["table"]] + ([addresses["table"]] if addresses else [])}
+
+    def lookups(self) -> Dict[str, Dict[str, Any]]:
+        codes = {work_class: work_class for work_class in PERMIT_WORK_CLASSES}
+        codes.update({str(code): work_class for code, work_class in self.type_codes.items()})
+        return {"permit_work_class": codes}
+
+    def hooks(self) -> List[Dict[str, Any]]:
+        options = copy.deepcopy(self.matching)
+        options["parcels"]["table"] = copy.deepcopy(self._definitions[self.parcels["table"]])
+        if options["addresses"]:
+            options["addresses"]["table"] = copy.deepcopy(self._definitions[self.matching["addresses"]["table"]])
+        options["worklist_classes"] = list(self.worklist_classes)
+        return [{"type": PERMIT_MATCH_HOOK, "tables": [self.tables["building_permits"]["name"]], "options": options}]
+
+    def table_rules(self, entity_table: EntityTable) -> List[Dict[str, Any]]:
+        return [
+            {"id": "building_permit_required", "type": "required", "fields": ["permit_id", "permit_type_code"]},
+            {"id": "building_permit_work_class_allowed", "type": "allowed_values", "fields": ["work_class"],
+             "values": list(PERMIT_WORK_CLASSES)},
+            {"id": "building_permit_range", "type": "range", "fields": ["valuation", "square_feet"], "min": 0},
+            {"id": "building_permit_dates", "type": "expression",
+             "expression": "finaled_date is null or issued_date is null or finaled_date >= issued_date",
+             "message": "Permit is finaled before it was issued"},
+        ]
+
+    def summary(self) -> Dict[str, Any]:
+        matching = dict(self.matching, parcels=dict(self.matching["parcels"]))
+        return dict(super().summary(), matching=matching, worklist_classes=list(self.worklist_classes),
+                    work_classes=list(PERMIT_WORK_CLASSES))
+
+
+def expand_entities(definition: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Return a copy of a sync pair definition with its entities block expanded
+    into tables, field mapping hooks and validation rules.
+
+    Entity tables come after the pair's own tables (they depend on the
+    parcel table), mapping hooks after its hooks, and the modules' rules
+    before its rules for the table. Tables of the pair's own that a module
+    reads its tables from during a sync depend on them.
+
+    Raises:
+        ValueError: If a module is unknown or its block is invalid
+    """
+    blocks = definition["entities"]
+    if not isinstance(blocks, dict):
+        raise ValueError(f"Sync pair {definition.get('sync_pair_id')}: entities must be an object")
+    if definition.get("direction") == "bidirectional":
+        raise ValueError("Entity modules are not supported on bidirectional sync pairs")
+    expanded = copy.deepcopy(definition)
+    expanded.setdefault("tables", [])
+    summaries = {}
+    for entity, block in blocks.items():
+        module_class = ENTITY_MODULES.get(entity)
+        if module_class is None:
+            raise ValueError(f"Unsupported entity module: {entity}. Supported modules: {', '.join(sorted(ENTITY_MODULES))}")
+        module = module_class(definition.get("sync_pair_id"), block, expanded["tables"])
+        tables = module.table_definitions()
+        mapping = module.mapping_definition()
+        if mapping:
+            # Fail at load time on templates that drop a key
+            checked = FieldMapping(mapping, f"{entity} {module.template} template")
+            for table in tables:
+                primary_key = table["primary_key"]
+                checked.for_table(table["name"]).validate_key([primary_key] if isinstance(primary_key, str)
+                                                              else primary_key)
+            expanded.setdefault("hooks", []).append(
+                {"type": "field_mapping", "tables": [t["name"] for t in tables], "options": {"mapping": mapping}})
+        expanded.setdefault("hooks", []).extend(module.hooks())
+        dependents = module.dependents()
+        for table in expanded["tables"]:
+            if table.get("name") in dependents:
+                depends_on = table.setdefault("depends_on", [])
+                depends_on.extend(name for name in dependents[table["name"]] if name not in depends_on)
+        expanded["tables"].extend(tables)
+        pushed = [t["name"] for t in tables if t.get("push_only")]
+        if pushed and (expanded.get("ingestion") or {}).get("tables"):
+            expanded["ingestion"]["tables"].extend(name for name in pushed if name not in expanded["ingestion"]["tables"])
+        rules = expanded.setdefault("validation", {}).setdefault("rules", {})
+        for name, table_rules in module.validation_rules().items():
+            rules[name] = table_rules + list(rules.get(name, []))
+        summaries[entity] = module.summary()
+    expanded["entities"] = summaries
+    logger.info(f"Expanded entity modules {', '.join(summaries)} of sync pair {definition.get('sync_pair_id')}")
+    return expanded
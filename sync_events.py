@@ -0,0 +1,404 @@
+"""
+TerraFusion SyncService - Change Events
+
+This module provides the change event publisher that streams the changes a
+sync writes to downstream systems, so they can subscribe instead of polling
+the API. A sync pair opts in with an "events" block:
+
+    "events": {
+        "type": "kafka",
+        "bootstrap_servers_env_var": "KAFKA_BOOTSTRAP_SERVERS",
+        "topic": "terrafusion.{county_id}.{entity}",
+        "entities": {"dbo.property": "parcel", "dbo.owner": "owner"}
+    }
+
+Every record a committed batch inserts, updates or deletes becomes one event
+on its entity's topic, keyed by the record's primary key so the changes of a
+record stay in order on one partition:
+
+    {"event_id": "...", "event_type": "update", "entity": "parcel",
+     "key": {"prop_id": 1001}, "before": {...}, "after": {...}, ...}
+
+"before" is the staging row as it was before the batch was written, looked up
+from the target; upserts that leave a row as it was emit nothing. Events are
+staged in the state store's outbox before their batch is written and removed
+once the broker has acknowledged them, so a broker outage fails the job
+without losing events: the outbox is sent again when the table next syncs.
+Delivery is at least once; consumers deduplicate on event_id, which is the
+same each time the same source change is written.
+"""
+
+import json
+import uuid
+import logging
+import threading
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+from sync_connectors import (
+    ConnectorError, record_key, _env_setting, OPERATION_FIELD, VERSION_FIELD, IDEMPOTENCY_FIELD, RESERVED_FIELDS
+)
+from sync_store import DocumentStore
+
+try:
+    from confluent_kafka import Producer, KafkaException
+    CONFLUENT_KAFKA_AVAILABLE = True
+except ImportError:
+    # Kafka publishing requires confluent-kafka
+    CONFLUENT_KAFKA_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+EVENT_TYPES = ["insert", "update", "delete"]
+
+# Event type of upserts to targets that cannot look up the previous row
+EVENT_TYPE_UPSERT = "upsert"
+
+DEFAULT_TOPIC = "terrafusion.{county_id}.{entity}"
+
+# Seconds to wait for the broker to acknowledge a batch's events
+DEFAULT_FLUSH_TIMEOUT = 30
+
+# State store collection of events staged but not yet acknowledged
+OUTBOX_COLLECTION = "event_outbox"
+
+# Namespace of the deterministic event IDs
+EVENT_ID_NAMESPACE = uuid.UUID("4b3f0c52-8d1e-4c4a-9a53-2f7d8e1c6b90")
+
+
+class EventPublishError(ConnectorError):
+    """Raised when the broker does not acknowledge a batch's change events."""
+
+
+class EventPublisher:
+    """
+    Base class for change event brokers.
+
+    Subclasses set publisher_type and implement send and flush.
+    """
+
+    publisher_type = "base"
+
+    def __init__(self, config: Dict[str, Any]):
+        self.config = config
+
+    def send(self, topic: str, key: str, event: Dict[str, Any]) -> None:
+        """Queue an event for a topic."""
+        raise NotImplementedError
+
+    def flush(self) -> None:
+        """
+        Wait until every queued event is acknowledged.
+
+        Raises:
+            EventPublishError: If any event was not acknowledged
+        """
+        raise NotImplementedError
+
+    def close(self) -> None:
+        """Release the broker connection."""
+
+    def health_check(self) -> Dict[str, Any]:
+        return {"publisher_type": self.publisher_type, "status": "healthy"}
+
+
+class KafkaEventPublisher(EventPublisher):
+    """
+    Publishes change events to Kafka with an idempotent producer (acks=all).
+
+    Settings: bootstrap_servers (or bootstrap_servers_env_var),
+    security_protocol, sasl_mechanism, sasl_username / sasl_password (each also
+    as *_env_var), ssl_ca_location, compression_type (default "zstd"),
+    flush_timeout_seconds, and "producer_config" for any other librdkafka
+    setting.
+    """
+
+    publisher_type = "kafka"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        if not CONFLUENT_KAFKA_AVAILABLE:
+            raise ConnectorError("Kafka change events require the confluent-kafka package")
+        bootstrap_servers = _env_setting(config, "bootstrap_servers")
+        if not bootstrap_servers:
+            raise ConnectorError("Kafka change events require bootstrap_servers or bootstrap_servers_env_var")
+        settings = {
+            "bootstrap.servers": bootstrap_servers,
+            "enable.idempotence": True,
+            "acks": "all",
+            "compression.type": config.get("compression_type", "zstd"),
+            "client.id": config.get("client_id", "terrafusion-sync"),
+        }
+        for key, setting in (("security_protocol", "security.protocol"), ("sasl_mechanism", "sasl.mechanism"),
+                             ("sasl_username", "sasl.username"), ("sasl_password", "sasl.password"),
+                             ("ssl_ca_location", "ssl.ca.location")):
+            value = _env_setting(config, key)
+            if value:
+                settings[setting] = value
+        settings.update(config.get("producer_config", {}))
+        self.flush_timeout = float(config.get("flush_timeout_seconds", DEFAULT_FLUSH_TIMEOUT))
+        self.producer = Producer(settings)
+        self._errors: List[str] = []
+        self._lock = threading.Lock()
+
+    def send(self, topic: str, key: str, event: Dict[str, Any]) -> None:
+        while True:
+            try:
+                self.producer.produce(topic, key=key.encode(), value=json.dumps(event, default=str).encode(),
+                                      on_delivery=self._delivered)
+                break
+            except BufferError:
+                # Local queue full; wait for the broker to drain it
+                self.producer.poll(1)
+        self.producer.poll(0)
+
+    def flush(self) -> None:
+        remaining = self.producer.flush(self.flush_timeout)
+        with self._lock:
+            errors, self._errors = self._errors, []
+        if remaining:
+            errors.append(f"{remaining} events not acknowledged within {self.flush_timeout:.0f}s")
+        if errors:
+            raise EventPublishError(f"Kafka did not accept change events: {'; '.join(errors[:5])}")
+
+    def close(self) -> None:
+        self.producer.flush(self.flush_timeout)
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            metadata = self.producer.list_topics(timeout=10)
+            return {"publisher_type": self.publisher_type, "status": "healthy", "brokers": len(metadata.brokers)}
+        except Exception as e:
+            return {"publisher_type": self.publisher_type, "status": "unavailable", "error": str(e)}
+
+    def _delivered(self, error, message) -> None:
+        if error is not None:
+            with self._lock:
+                self._errors.append(f"{message.topic()}: {error}")
+
+
+# Registry of change event publishers by type
+PUBLISHER_TYPES = {
+    KafkaEventPublisher.publisher_type: KafkaEventPublisher,
+}
+
+# Publishers are shared by every job of a sync pair, since producers are thread-safe and costly to open
+_publishers: Dict[str, EventPublisher] = {}
+_publishers_lock = threading.Lock()
+
+
+def parse_events(sync_pair_id: str, definition: Optional[Dict[str, Any]], table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the "events" block of a sync pair.
+
+    Returns:
+        The events settings, empty when publishing is not configured
+    """
+    if not definition:
+        return {}
+    events = dict(definition)
+    if events.get("type") not in PUBLISHER_TYPES:
+        raise ValueError(f"Sync pair {sync_pair_id}: unsupported change event publisher {events.get('type')}. "
+                         f"Supported publishers: {', '.join(PUBLISHER_TYPES)}")
+    for name in list(events.get("tables", [])) + list(events.get("entities", {})):
+        if name not in table_names:
+            raise ValueError(f"Sync pair {sync_pair_id}: change events name unknown table {name}")
+    events.setdefault("topic", DEFAULT_TOPIC)
+    try:
+        events["topic"].format(county_id="", entity="", sync_pair_id="")
+    except KeyError as e:
+        raise ValueError(f"Sync pair {sync_pair_id}: unknown change event topic field {e.args[0]}")
+    return events
+
+
+def publisher_for(sync_pair_id: str, config: Dict[str, Any]) -> EventPublisher:
+    """The shared publisher of a sync pair, created on first use."""
+    with _publishers_lock:
+        publisher = _publishers.get(sync_pair_id)
+        if publisher is None or publisher.config != config:
+            if publisher is not None:
+                publisher.close()
+            publisher = PUBLISHER_TYPES[config["type"]](config)
+            _publishers[sync_pair_id] = publisher
+        return publisher
+
+
+class ChangeEventEmitter:
+    """Turns the batches written to one table into change events and publishes them through the outbox."""
+
+    def __init__(self, sync_pair_id: str, county_id: str, table: Dict[str, Any], target_table: Dict[str, Any],
+                 config: Dict[str, Any], publisher: EventPublisher, store: DocumentStore, job_id: str):
+        """
+        Initialize the emitter.
+
+        Args:
+            sync_pair_id: Sync pair writing the table
+            county_id: County of the sync pair
+            table: Source table definition
+            target_table: Target table definition (after hooks), whose primary key the events use
+            config: The sync pair's events settings
+            publisher: Broker to publish to
+            store: State store holding the outbox
+            job_id: Sync job writing the batches
+        """
+        self.sync_pair_id = sync_pair_id
+        self.table = table
+        self.target_table = target_table
+        self.publisher = publisher
+        self.store = store
+        self.job_id = job_id
+        self.include_before = config.get("include_before", True)
+        target_name = target_table.get("target_table") or target_table["name"]
+        self.entity = config.get("entities", {}).get(table["name"]) or target_name.split(".")[-1]
+        self.topic = config["topic"].format(county_id=county_id, entity=self.entity, sync_pair_id=sync_pair_id)
+        self._before: Dict[str, Dict[str, Any]] = {}
+        self._lookup = True
+
+    def stage(self, target, records: List[Dict[str, Any]]) -> Optional[str]:
+        """
+        Look up the current rows of a batch about to be written and stage its events.
+
+        Returns:
+            Outbox key of the staged events, or None when the batch changes nothing
+        """
+        self._before = self._current_rows(target, records)
+        return self._save(self._events(records), None)
+
+    def restage(self, outbox_key: Optional[str], records: List[Dict[str, Any]]) -> Optional[str]:
+        """Replace the staged events with those of the records actually written (after a per-record retry)."""
+        return self._save(self._events(records), outbox_key)
+
+    def publish(self, outbox_key: Optional[str]) -> int:
+        """
+        Send staged events and remove them from the outbox once acknowledged.
+
+        Returns:
+            Number of events published
+
+        Raises:
+            EventPublishError: If the broker did not acknowledge them; they stay in the outbox
+        """
+        if outbox_key is None:
+            return 0
+        entry = self.store.load(OUTBOX_COLLECTION, outbox_key)
+        for event in entry["events"]:
+            self.publisher.send(entry["topic"], event["_message_key"], self._message(event))
+        self.publisher.flush()
+        self.store.delete(OUTBOX_COLLECTION, outbox_key)
+        return len(entry["events"])
+
+    def discard(self, outbox_key: Optional[str]) -> None:
+        """Drop staged events of a batch that was not written."""
+        if outbox_key is not None:
+            self.store.delete(OUTBOX_COLLECTION, outbox_key)
+
+    def drain(self) -> int:
+        """
+        Send the events an earlier run staged for this table but could not publish.
+
+        Returns:
+            Number of events published
+        """
+        published = 0
+        for entry in sorted(self.store.list(OUTBOX_COLLECTION), key=lambda e: e["staged_at"]):
+            if entry["sync_pair_id"] != self.sync_pair_id or entry["table"] != self.table["name"]:
+                continue
+            published += self.publish(entry["outbox_key"])
+        if published:
+            logger.info(f"Published {published} outstanding change events for {self.table['name']}")
+        return published
+
+    def _current_rows(self, target, records: List[Dict[str, Any]]) -> Dict[str, Dict[str, Any]]:
+        """Target rows of a batch by record key, or nothing when the target cannot look rows up."""
+        if not self.include_before or not self._lookup:
+            return {}
+        primary_key = self.target_table["primary_key"]
+        keys = [[record.get(column) for column in primary_key] for record in records]
+        try:
+            rows = target.fetch_records(self.target_table, keys)
+        except NotImplementedError:
+            logger.warning(f"Target of {self.table['name']} cannot look up rows; change events carry no before image")
+            self._lookup = False
+            return {}
+        return {record_key(primary_key, row): row for row in rows}
+
+    def _events(self, records: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        """Change events of the records of a batch, leaving out writes that change nothing."""
+        primary_key = self.target_table["primary_key"]
+        events = []
+        for record in records:
+            key = record_key(primary_key, record)
+            before = self._before.get(key)
+            if record.get(OPERATION_FIELD) == "delete":
+                if before is None and self._lookup and self.include_before:
+                    continue
+                event_type, after = "delete", None
+            else:
+                after = {k: v for k, v in record.items() if k not in RESERVED_FIELDS}
+                if before is not None and all(before.get(k) == v for k, v in after.items()):
+                    continue
+                if not self.include_before or not self._lookup:
+                    event_type = EVENT_TYPE_UPSERT
+                else:
+                    event_type = "update" if before is not None else "insert"
+            change = record.get(IDEMPOTENCY_FIELD) or f"{self.job_id}/{record.get(VERSION_FIELD)}"
+            events.append({
+                "_message_key": key,
+                "event_id": str(uuid.uuid5(EVENT_ID_NAMESPACE, f"{self.sync_pair_id}/{self.table['name']}/{key}/"
+                                                               f"{change}/{event_type}")),
+                "event_type": event_type,
+                "entity": self.entity,
+                "key": {column: record.get(column) for column in primary_key},
+                "before": before,
+                "after": after,
+                "source_version": None if record.get(VERSION_FIELD) is None else str(record.get(VERSION_FIELD)),
+            })
+        return events
+
+    def _save(self, events: List[Dict[str, Any]], outbox_key: Optional[str]) -> Optional[str]:
+        """Write (or replace) a batch's outbox entry; returns its key, or None when there are no events."""
+        if not events:
+            self.discard(outbox_key)
+            return None
+        outbox_key = outbox_key or uuid.uuid4().hex
+        self.store.save(OUTBOX_COLLECTION, outbox_key, {
+            "outbox_key": outbox_key,
+            "sync_pair_id": self.sync_pair_id,
+            "table": self.table["name"],
+            "target_table": self.target_table.get("target_table") or self.target_table["name"],
+            "topic": self.topic,
+            "job_id": self.job_id,
+            "staged_at": datetime.utcnow().isoformat(),
+            "events": events,
+        })
+        return outbox_key
+
+    def _message(self, event: Dict[str, Any]) -> Dict[str, Any]:
+        """The published form of a staged event."""
+        message = {k: v for k, v in event.items() if k != "_message_key"}
+        message.update({
+            "sync_pair_id": self.sync_pair_id,
+            "source_table": self.table["name"],
+            "target_table": self.target_table.get("target_table") or self.target_table["name"],
+            "job_id": self.job_id,
+            "published_at": datetime.utcnow().isoformat(),
+        })
+        return message
+
+
+def build_emitter(sync_pair_id: str, county_id: str, config: Dict[str, Any], table: Dict[str, Any],
+                  target_table: Dict[str, Any], store: DocumentStore, job_id: str) -> Optional[ChangeEventEmitter]:
+    """
+    Build the change event emitter of a table, publishing any events left in its outbox.
+
+    Returns:
+        The emitter, or None when the sync pair does not publish events for the table
+    """
+    if not config or (config.get("tables") and table["name"] not in config["tables"]):
+        return None
+    emitter = ChangeEventEmitter(sync_pair_id, county_id, table, target_table, config,
+                                 publisher_for(sync_pair_id, config), store, job_id)
+    emitter.drain()
+    return emitter
@@ -0,0 +1,565 @@
+"""
+TerraFusion SyncService - Exemption Audit Scoring
+
+This module scores the exemptions synced by the exemptions entity module
+(see sync_entities) against risk rules and keeps a ranked worklist of the
+ones worth an auditor's look, each with the reasons it scored. The module's
+"audit" block names the owners table and the rules:
+
+    "exemptions": {
+        "template": "pacs",
+        "parcels": {"table": "dbo.property"},
+        "audit": {
+            "owners": {"table": "dbo.owner_account", "key_field": "owner_id", "name_columns": ["file_as_name"],
+                       "state_column": "addr_state"},
+            "rules": {
+                "deceased_owner": {"table": "death_records", "name_columns": ["decedent_name"],
+                                   "date_column": "date_of_death", "weight": 60},
+                "multiple_homesteads": {"weight": 40},
+                "out_of_state_mailing": {"home_state": "WA", "weight": 20}
+            },
+            "min_score": 20
+        }
+    }
+
+Tables are tables of the sync pair, read from the target as loaded; the
+owners table (often a view joining accounts and their mailing addresses)
+gives each exemption's owner_id a name and mailing state. Owner names are
+compared by their words, upper-cased, without punctuation, initials or
+suffixes (JR, SR, ETUX, ...) and in any order, so "SMITH, JOHN A" and
+"John Smith" are the same owner; names of fewer than two words are not
+compared. The rules:
+
+- deceased_owner: the owner's name matches a record of the death records
+  table, a vital records feed synced by the pair. With date_column, an
+  exemption that expired before the death is left alone.
+- multiple_homesteads: the owner claims a residence exemption (the rule's
+  "types", senior and disability by default) on another parcel, of this
+  county or of any other sync pair with an audit block, for the same tax
+  year. Each scoring run records the pair's claims for the others to check.
+- out_of_state_mailing: the owner of a residence exemption has a mailing
+  state other than home_state (a state or a list of them).
+
+An exemption's score is the sum of the weights of the rules it breaks, at
+most 100; those reaching min_score go on the worklist, highest first. Only
+exemptions in effect (not expired) in the latest tax year synced are
+scored. Scoring runs after each sync job that changes the exemptions, owners
+or death records, and on demand through the API.
+
+A reviewer marks an item CLEARED (the exemption stands) or DISQUALIFIED
+(to be removed). A reviewed item that breaks a rule it did not when
+reviewed is reopened. Open items that no longer score are taken off the
+worklist; reviewed ones are kept as the record of the review.
+"""
+
+import re
+import hashlib
+import logging
+import threading
+from datetime import date, datetime
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Tuple
+
+from sync_connectors import create_connector
+from sync_hooks import build_pipeline
+from sync_store import DocumentStore, sync_state_store
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Risk rules an exemption is scored against
+AUDIT_RULES = ["deceased_owner", "multiple_homesteads", "out_of_state_mailing"]
+
+# Weight of each rule, by default
+DEFAULT_RULE_WEIGHTS = {"deceased_owner": 60, "multiple_homesteads": 40, "out_of_state_mailing": 20}
+
+# Exemption types that require the parcel to be the owner's residence, by default
+DEFAULT_RESIDENCE_TYPES = ["senior", "disability"]
+
+# Score an exemption needs to go on the worklist, by default
+DEFAULT_MIN_SCORE = 20
+
+# Highest score of an exemption
+MAX_SCORE = 100
+
+# State store collection of worklist items
+EXEMPTION_AUDIT_COLLECTION = "exemption_audit"
+
+# State store collection of each sync pair's residence exemption claims, by owner
+EXEMPTION_CLAIMS_COLLECTION = "exemption_claims"
+
+# Statuses of a worklist item
+AUDIT_STATUSES = ["OPEN", "CLEARED", "DISQUALIFIED"]
+
+# Other claims an explanation names before summing up the rest
+MAX_NAMED_CLAIMS = 3
+
+# Words left out when comparing owner names
+NAME_SUFFIXES = {"JR", "SR", "II", "III", "IV", "ETAL", "ETUX", "ETVIR", "ET", "AL", "UX", "VIR"}
+
+# Staging columns of an exemption read for scoring
+EXEMPTION_COLUMNS = ["prop_id", "owner_id", "tax_year", "exemption_code", "exemption_type", "effective_date",
+                     "expiration_date"]
+
+_lock = threading.Lock()
+
+
+def name_key(name: Any) -> Optional[str]:
+    """An owner name's words for comparing, in order; None for names of fewer than two words."""
+    if name is None:
+        return None
+    words = [w for w in re.sub(r"[^A-Z ]", " ", str(name).upper().replace("'", "")).split()
+             if len(w) > 1 and w not in NAME_SUFFIXES]
+    return " ".join(sorted(words)) if len(words) >= 2 else None
+
+
+def _key(value: Any) -> str:
+    if isinstance(value, float) and value.is_integer():
+        value = int(value)
+    return str(value).strip()
+
+
+def _date(value: Any) -> Optional[date]:
+    if isinstance(value, datetime):
+        return value.date()
+    if isinstance(value, date):
+        return value
+    if value in (None, ""):
+        return None
+    try:
+        return date.fromisoformat(str(value)[:10])
+    except ValueError:
+        return None
+
+
+def _json_value(value: Any) -> Any:
+    if isinstance(value, (date, datetime)):
+        return value.isoformat()
+    if isinstance(value, Decimal):
+        return float(value)
+    return value
+
+
+def _columns(value: Any, label: str) -> List[str]:
+    if isinstance(value, str):
+        value = [value]
+    if not isinstance(value, list) or not value or not all(isinstance(c, str) and c for c in value):
+        raise ValueError(f"{label} must list columns")
+    return list(value)
+
+
+def parse_audit(label: str, definition: Any, tables: List[Dict[str, Any]], exemptions_table: str,
+                types: List[str]) -> Dict[str, Any]:
+    """
+    Validate the audit block of an exemptions module.
+
+    Args:
+        label: The module's label in messages
+        definition: The block
+        tables: The sync pair's table definitions
+        exemptions_table: Table the module generates for the exemptions
+        types: Exemption types the module accepts
+
+    Returns:
+        The audit settings, with defaults filled in
+
+    Raises:
+        ValueError: If the block is invalid
+    """
+    label = f"{label}.audit"
+    if not isinstance(definition, dict):
+        raise ValueError(f"{label} must be an object")
+    unknown = [name for name in definition if name not in ("owners", "rules", "min_score")]
+    if unknown:
+        raise ValueError(f"{label}: unknown settings {', '.join(unknown)}")
+    names = [table.get("name") for table in tables]
+
+    owners = definition.get("owners")
+    if not isinstance(owners, dict) or owners.get("table") not in names:
+        raise ValueError(f"{label}.owners must name a table of the sync pair")
+    unknown = [name for name in owners if name not in ("table", "key_field", "name_columns", "state_column")]
+    if unknown:
+        raise ValueError(f"{label}.owners: unknown settings {', '.join(unknown)}")
+    settings = {
+        "exemptions_table": exemptions_table,
+        "owners": {"table": owners["table"], "key_field": owners.get("key_field") or "owner_id",
+                   "name_columns": _columns(owners.get("name_columns"), f"{label}.owners.name_columns"),
+                   "state_column": owners.get("state_column")},
+        "rules": {},
+        "min_score": definition.get("min_score", DEFAULT_MIN_SCORE),
+    }
+    if not isinstance(settings["min_score"], (int, float)) or not 0 < settings["min_score"] <= MAX_SCORE:
+        raise ValueError(f"{label}.min_score must be a number from 1 to {MAX_SCORE}")
+
+    rules = definition.get("rules")
+    if not isinstance(rules, dict) or not rules:
+        raise ValueError(f"{label}.rules must configure any of {', '.join(AUDIT_RULES)}")
+    for rule, options in rules.items():
+        rule_label = f"{label}.rules.{rule}"
+        if rule not in AUDIT_RULES:
+            raise ValueError(f"{label}.rules: unknown rule {rule}. Rules: {', '.join(AUDIT_RULES)}")
+        if not isinstance(options, dict):
+            raise ValueError(f"{rule_label} must be an object")
+        allowed = {"deceased_owner": ("weight", "table", "name_columns", "date_column"),
+                   "multiple_homesteads": ("weight", "types"),
+                   "out_of_state_mailing": ("weight", "types", "home_state")}[rule]
+        unknown = [name for name in options if name not in allowed]
+        if unknown:
+            raise ValueError(f"{rule_label}: unknown settings {', '.join(unknown)}")
+        parsed = {"weight": options.get("weight", DEFAULT_RULE_WEIGHTS[rule])}
+        if not isinstance(parsed["weight"], (int, float)) or not 0 < parsed["weight"] <= MAX_SCORE:
+            raise ValueError(f"{rule_label}.weight must be a number from 1 to {MAX_SCORE}")
+
+        if rule == "deceased_owner":
+            if options.get("table") not in names:
+                raise ValueError(f"{rule_label}.table must name the sync pair's table of death records")
+            parsed.update(table=options["table"],
+                          name_columns=_columns(options.get("name_columns"), f"{rule_label}.name_columns"),
+                          date_column=options.get("date_column"))
+        else:
+            residence = options.get("types") or [t for t in DEFAULT_RESIDENCE_TYPES if t in types]
+            if not isinstance(residence, list) or not residence or any(t not in types for t in residence):
+                raise ValueError(f"{rule_label}.types must list residence exemption types of {', '.join(types)}")
+            parsed["types"] = list(residence)
+        if rule == "out_of_state_mailing":
+            home = options.get("home_state")
+            home = [home] if isinstance(home, str) else home
+            if not isinstance(home, list) or not home or not all(isinstance(s, str) and s.strip() for s in home):
+                raise ValueError(f"{rule_label}.home_state must name the county's state")
+            if not settings["owners"]["state_column"]:
+                raise ValueError(f"{rule_label} needs the owners table's state_column")
+            parsed["home_state"] = [s.strip().upper() for s in home]
+        settings["rules"][rule] = parsed
+
+    settings["tables"] = [exemptions_table, owners["table"]] + \
+        ([settings["rules"]["deceased_owner"]["table"]] if "deceased_owner" in settings["rules"] else [])
+    return settings
+
+
+class ExemptionAuditWorklist:
+    """Keeps the exemption audit worklist and the residence exemption claims of each sync pair."""
+
+    def __init__(self, store: Optional[DocumentStore] = None):
+        self.store = store or sync_state_store
+
+    @staticmethod
+    def item_id(sync_pair_id: str, exemption: Dict[str, Any]) -> str:
+        identity = "/".join(_key(exemption.get(c)) for c in ("prop_id", "owner_id", "tax_year", "exemption_code"))
+        return f"{sync_pair_id}__{hashlib.sha1(identity.encode('utf-8')).hexdigest()[:20]}"
+
+    def record_claims(self, sync_pair_id: str, county_id: Optional[str], tax_year: Any,
+                      claims: Dict[str, List[Dict[str, Any]]]) -> List[Dict[str, Any]]:
+        """
+        Replace the residence exemption claims of a sync pair.
+
+        Returns:
+            The claims of the other sync pairs
+        """
+        with _lock:
+            self.store.save(EXEMPTION_CLAIMS_COLLECTION, sync_pair_id, {
+                "sync_pair_id": sync_pair_id,
+                "county_id": county_id,
+                "tax_year": _json_value(tax_year),
+                "claims": claims,
+                "recorded_at": datetime.utcnow().isoformat(),
+            })
+            return [document for document in self.store.list(EXEMPTION_CLAIMS_COLLECTION)
+                    if document.get("sync_pair_id") != sync_pair_id]
+
+    def record(self, sync_pair_id: str, scored: List[Dict[str, Any]], job_id: Optional[str] = None) -> Dict[str, int]:
+        """
+        Replace the scored exemptions of a sync pair on the worklist.
+
+        Returns:
+            Counts of the items added, updated, reopened and removed
+        """
+        now = datetime.utcnow().isoformat()
+        counts = {"added": 0, "updated": 0, "reopened": 0, "removed": 0}
+        with _lock:
+            existing = {item["item_id"]: item for item in self.store.list(EXEMPTION_AUDIT_COLLECTION)
+                        if item.get("sync_pair_id") == sync_pair_id}
+            for entry in scored:
+                item = existing.pop(entry["item_id"], None)
+                if item is None:
+                    item = dict(entry, status="OPEN", first_flagged_at=now)
+                    counts["added"] += 1
+                else:
+                    reviewed = item.get("reviewed_rules")
+                    item.update(entry)
+                    if item["status"] != "OPEN" and reviewed is not None \
+                            and any(rule not in reviewed for rule in entry["rules"]):
+                        item.update(status="OPEN", reopened_at=now)
+                        counts["reopened"] += 1
+                    else:
+                        counts["updated"] += 1
+                item.update(job_id=job_id, scored_at=now)
+                self.store.save(EXEMPTION_AUDIT_COLLECTION, item["item_id"], item)
+            for item_id, item in existing.items():
+                if item["status"] == "OPEN":
+                    self.store.delete(EXEMPTION_AUDIT_COLLECTION, item_id)
+                    counts["removed"] += 1
+        return counts
+
+    def list(self, sync_pair_id: str, rule: Optional[str] = None, status: Optional[str] = None,
+             min_score: Optional[float] = None) -> List[Dict[str, Any]]:
+        """
+        The worklist items of a sync pair, highest score first.
+
+        Raises:
+            ValueError: If the rule or status is not supported
+        """
+        if rule is not None and rule not in AUDIT_RULES:
+            raise ValueError(f"Unsupported audit rule: {rule}. Supported rules: {', '.join(AUDIT_RULES)}")
+        if status is not None and status not in AUDIT_STATUSES:
+            raise ValueError(f"Unsupported audit status: {status}. Supported statuses: {', '.join(AUDIT_STATUSES)}")
+        items = [
+            item for item in self.store.list(EXEMPTION_AUDIT_COLLECTION)
+            if item.get("sync_pair_id") == sync_pair_id
+            and (rule is None or rule in item["rules"])
+            and (status is None or item["status"] == status)
+            and (min_score is None or item["score"] >= min_score)
+        ]
+        return sorted(items, key=lambda item: (-item["score"], item["item_id"]))
+
+    def get(self, sync_pair_id: str, item_id: str) -> Dict[str, Any]:
+        """
+        Raises:
+            KeyError: If the sync pair has no such worklist item
+        """
+        try:
+            item = self.store.load(EXEMPTION_AUDIT_COLLECTION, item_id)
+        except FileNotFoundError:
+            item = None
+        if item is None or item.get("sync_pair_id") != sync_pair_id:
+            raise KeyError(f"Exemption audit item {item_id} not found in sync pair {sync_pair_id}")
+        return item
+
+    def review(self, sync_pair_id: str, item_id: str, status: str, username: str,
+               note: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Mark a worklist item CLEARED or DISQUALIFIED, or put it back OPEN.
+
+        Raises:
+            KeyError: If the item does not exist
+            ValueError: If the status is not supported
+        """
+        if status not in AUDIT_STATUSES:
+            raise ValueError(f"Unsupported review status: {status}. Reviewers can set {', '.join(AUDIT_STATUSES)}")
+        with _lock:
+            item = self.get(sync_pair_id, item_id)
+            item.update({"status": status, "reviewed_by": username, "reviewed_at": datetime.utcnow().isoformat(),
+                         "reviewed_rules": list(item["rules"]) if status != "OPEN" else None})
+            if note:
+                item["note"] = note
+            self.store.save(EXEMPTION_AUDIT_COLLECTION, item_id, item)
+        return item
+
+
+class ExemptionAuditor:
+    """Scores the exemptions of one sync pair's target against its audit rules."""
+
+    def __init__(self, sync_pair_id: str, county_id: Optional[str], settings: Dict[str, Any],
+                 store: Optional[DocumentStore] = None):
+        self.sync_pair_id = sync_pair_id
+        self.county_id = county_id
+        self.settings = settings
+        self.rules = settings["rules"]
+        self.worklist = ExemptionAuditWorklist(store)
+
+    def run(self, target, tables: Dict[str, Dict[str, Any]], job_id: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Score the exemptions in effect and replace the sync pair's worklist.
+
+        Args:
+            target: Target connector
+            tables: Target table definitions of the audit's tables, by name
+            job_id: Sync job the run follows
+
+        Raises:
+            ConnectorError: If a table cannot be read
+        """
+        owners = self._owners(target, tables[self.settings["owners"]["table"]])
+        deaths = self._deaths(target, tables[self.rules["deceased_owner"]["table"]]) \
+            if "deceased_owner" in self.rules else {}
+        exemptions, tax_year = self._exemptions(target, tables[self.settings["exemptions_table"]])
+
+        residence = set(self.rules.get("multiple_homesteads", {}).get("types", []))
+        claims: Dict[str, List[Dict[str, Any]]] = {}
+        for exemption in exemptions:
+            owner = owners.get(_key(exemption.get("owner_id")), {})
+            if exemption.get("exemption_type") in residence and owner.get("key"):
+                claims.setdefault(owner["key"], []).append({
+                    "prop_id": _json_value(exemption.get("prop_id")),
+                    "exemption_type": exemption.get("exemption_type"),
+                    "owner_name": owner.get("name"),
+                })
+        others = self.worklist.record_claims(self.sync_pair_id, self.county_id, tax_year, claims) \
+            if "multiple_homesteads" in self.rules else []
+        others = [doc for doc in others if doc.get("tax_year") in (None, _json_value(tax_year))]
+
+        scored = []
+        by_rule = {rule: 0 for rule in self.rules}
+        for exemption in exemptions:
+            owner = owners.get(_key(exemption.get("owner_id")), {})
+            findings = [f for f in (self._deceased(exemption, owner, deaths),
+                                    self._homesteads(exemption, owner, claims, others),
+                                    self._out_of_state(exemption, owner)) if f]
+            score = min(MAX_SCORE, sum(f["weight"] for f in findings))
+            if not findings or score < self.settings["min_score"]:
+                continue
+            for finding in findings:
+                by_rule[finding["rule"]] += 1
+            scored.append({
+                "item_id": self.worklist.item_id(self.sync_pair_id, exemption),
+                "sync_pair_id": self.sync_pair_id,
+                "county_id": self.county_id,
+                **{column: _json_value(exemption.get(column)) for column in EXEMPTION_COLUMNS},
+                "owner_name": owner.get("name"),
+                "mailing_state": owner.get("state"),
+                "score": score,
+                "rules": [f["rule"] for f in findings],
+                "findings": findings,
+            })
+        counts = self.worklist.record(self.sync_pair_id, scored, job_id)
+        logger.info(f"Exemption audit of {self.sync_pair_id}: {len(scored)} of {len(exemptions)} exemptions "
+                    f"scored at least {self.settings['min_score']}")
+        return dict(counts, sync_pair_id=self.sync_pair_id, tax_year=_json_value(tax_year), scored=len(exemptions),
+                    flagged=len(scored), by_rule=by_rule)
+
+    def _owners(self, target, table: Dict[str, Any]) -> Dict[str, Dict[str, Any]]:
+        settings = self.settings["owners"]
+        columns = [settings["key_field"]] + settings["name_columns"] + \
+            ([settings["state_column"]] if settings["state_column"] else [])
+        owners = {}
+        for row in target.query_records(table, None, columns):
+            name = " ".join(str(row[c]).strip() for c in settings["name_columns"] if row.get(c) not in (None, ""))
+            state = row.get(settings["state_column"]) if settings["state_column"] else None
+            owners[_key(row.get(settings["key_field"]))] = {
+                "name": name or None,
+                "key": name_key(name),
+                "state": str(state).strip().upper() if state not in (None, "") else None,
+            }
+        return owners
+
+    def _deaths(self, target, table: Dict[str, Any]) -> Dict[str, Dict[str, Any]]:
+        rule = self.rules["deceased_owner"]
+        columns = rule["name_columns"] + ([rule["date_column"]] if rule["date_column"] else [])
+        deaths: Dict[str, Dict[str, Any]] = {}
+        for row in target.query_records(table, None, columns):
+            name = " ".join(str(row[c]).strip() for c in rule["name_columns"] if row.get(c) not in (None, ""))
+            key = name_key(name)
+            if key is None:
+                continue
+            died = _date(row.get(rule["date_column"])) if rule["date_column"] else None
+            known = deaths.get(key)
+            # The earliest death of a name, so a common name is not cleared by a later record
+            if known is None or (died is not None and (known["died"] is None or died < known["died"])):
+                deaths[key] = {"name": name, "died": died}
+        return deaths
+
+    def _exemptions(self, target, table: Dict[str, Any]) -> Tuple[List[Dict[str, Any]], Any]:
+        today = date.today()
+        rows = [row for row in target.query_records(table, None, EXEMPTION_COLUMNS)
+                if _date(row.get("expiration_date")) is None or _date(row.get("expiration_date")) >= today]
+        years = [row["tax_year"] for row in rows if row.get("tax_year") is not None]
+        tax_year = max(years) if years else None
+        if tax_year is not None:
+            rows = [row for row in rows if row.get("tax_year") == tax_year]
+        return rows, tax_year
+
+    def _deceased(self, exemption: Dict[str, Any], owner: Dict[str, Any],
+                  deaths: Dict[str, Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        if "deceased_owner" not in self.rules or owner.get("key") not in deaths:
+            return None
+        death = deaths[owner["key"]]
+        expires = _date(exemption.get("expiration_date"))
+        if death["died"] is not None and expires is not None and expires <= death["died"]:
+            return None
+        explanation = f"Owner {owner['name']} matches the death record of {death['name']}"
+        if death["died"] is not None:
+            explanation += f", who died {death['died'].isoformat()}"
+        return {"rule": "deceased_owner", "weight": self.rules["deceased_owner"]["weight"],
+                "explanation": explanation + "; the exemption is still in effect"}
+
+    def _homesteads(self, exemption: Dict[str, Any], owner: Dict[str, Any], claims: Dict[str, List[Dict[str, Any]]],
+                    others: List[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        rule = self.rules.get("multiple_homesteads")
+        if rule is None or exemption.get("exemption_type") not in rule["types"] or not owner.get("key"):
+            return None
+        parcel = _key(exemption.get("prop_id"))
+        elsewhere = [f"parcel {claim['prop_id']}" for claim in claims.get(owner["key"], [])
+                     if _key(claim["prop_id"]) != parcel]
+        for document in others:
+            where = f"county {document['county_id']}" if document.get("county_id") \
+                else f"sync pair {document['sync_pair_id']}"
+            elsewhere.extend(f"parcel {claim['prop_id']} in {where}"
+                             for claim in document["claims"].get(owner["key"], []))
+        if not elsewhere:
+            return None
+        named = ", ".join(elsewhere[:MAX_NAMED_CLAIMS])
+        if len(elsewhere) > MAX_NAMED_CLAIMS:
+            named += f" and {len(elsewhere) - MAX_NAMED_CLAIMS} more"
+        return {"rule": "multiple_homesteads", "weight": rule["weight"], "claims": len(elsewhere),
+                "explanation": f"Owner {owner['name']} also claims a residence exemption on {named}"}
+
+    def _out_of_state(self, exemption: Dict[str, Any], owner: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+        rule = self.rules.get("out_of_state_mailing")
+        if rule is None or exemption.get("exemption_type") not in rule["types"] or not owner.get("state"):
+            return None
+        if owner["state"] in rule["home_state"]:
+            return None
+        return {"rule": "out_of_state_mailing", "weight": rule["weight"],
+                "explanation": f"Owner's mailing address is in {owner['state']}, outside "
+                               f"{'/'.join(rule['home_state'])}, but a {exemption.get('exemption_type')} "
+                               f"exemption needs the parcel to be the owner's residence"}
+
+
+class ExemptionAuditService:
+    """The exemption audit worklists of the sync pairs with an audited exemptions module, for the API."""
+
+    def __init__(self, registry, store: Optional[DocumentStore] = None):
+        self.registry = registry
+        self.store = store
+        self.worklist = ExemptionAuditWorklist(store)
+
+    def score(self, sync_pair_id: str, job_id: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Score a sync pair's exemptions and replace its worklist.
+
+        Raises:
+            KeyError: If the sync pair is unknown or has no exemption audit
+            ConnectorError: If the target cannot be read
+        """
+        pair, settings = self._settings(sync_pair_id)
+        tables = {name: build_pipeline(pair.hooks, name).target_table(pair.get_table(name).to_dict())
+                  for name in settings["tables"]}
+        auditor = ExemptionAuditor(sync_pair_id, pair.county_id, settings, self.store)
+        with create_connector(pair.target) as target:
+            return auditor.run(target, tables, job_id)
+
+    def list_items(self, sync_pair_id: str, rule: Optional[str] = None, status: Optional[str] = None,
+                   min_score: Optional[float] = None) -> List[Dict[str, Any]]:
+        """
+        Raises:
+            KeyError: If the sync pair is unknown or has no exemption audit
+            ValueError: If a filter is not supported
+        """
+        self._settings(sync_pair_id)
+        return self.worklist.list(sync_pair_id, rule, status, min_score)
+
+    def get_item(self, sync_pair_id: str, item_id: str) -> Dict[str, Any]:
+        self._settings(sync_pair_id)
+        return self.worklist.get(sync_pair_id, item_id)
+
+    def review_item(self, sync_pair_id: str, item_id: str, status: str, username: str,
+                    note: Optional[str] = None) -> Dict[str, Any]:
+        self._settings(sync_pair_id)
+        return self.worklist.review(sync_pair_id, item_id, status, username, note)
+
+    def _settings(self, sync_pair_id: str):
+        pair = self.registry.get(sync_pair_id)
+        settings = (pair.entities.get("exemptions") or {}).get("audit")
+        if not settings:
+            raise KeyError(f"Sync pair {sync_pair_id} has no exemption audit")
+        return pair, settings
@@ -0,0 +1,385 @@
+"""
+TerraFusion SyncService - Record Filters
+
+This module provides the filter expressions that limit which source records a
+sync pair moves. Filters are evaluated in the extract phase, before hooks and
+field mappings, so expressions refer to source column names:
+
+    "filters": [
+        {"tables": ["dbo.property"],
+         "expression": "tax_district in ('R1', 'R2') and not (owner_type = 'GOV' and exempt = true)"},
+        {"tables": ["dbo.property"], "expression": "geo_id is not null", "on_exclude": "delete"}
+    ]
+
+The predicate language supports and/or/not, parentheses, the comparisons
+= != <> < <= > >=, in (...), not in (...), like (SQL wildcards % and _, case
+insensitive), is null and is not null. Literals are 'strings', numbers, true,
+false and null. A record is synced when every filter that applies to its table
+matches. With "on_exclude": "delete", excluded records are sent as deletes so
+rows that stop matching are removed from the target as well.
+
+A sync job can also be limited to an area with parameters.spatial_filter (see
+gis_spatial); records whose geometry falls outside it are skipped.
+"""
+
+import re
+import logging
+from decimal import Decimal, InvalidOperation
+from typing import Dict, List, Any, Optional, Tuple
+
+from sync_connectors import OPERATION_FIELD
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# What happens to records a filter excludes
+EXCLUDE_ACTIONS = ["skip", "delete"]
+
+KEYWORDS = {"and", "or", "not", "in", "like", "is", "null", "true", "false"}
+
+TOKEN_PATTERN = re.compile(r"""
+    \s*(?:
+        (?P<number>-?\d+(?:\.\d+)?)
+      | '(?P<string>(?:[^']|'')*)'
+      | "(?P<quoted>[^"]+)"
+      | (?P<name>[A-Za-z_][A-Za-z0-9_.]*)
+      | (?P<op><=|>=|<>|!=|==|=|<|>)
+      | (?P<punct>[(),])
+    )""", re.VERBOSE)
+
+
+class FilterSyntaxError(ValueError):
+    """Raised when a filter expression cannot be parsed."""
+
+
+def _tokenize(text: str) -> List[Tuple[str, Any]]:
+    tokens = []
+    position = 0
+    text = text.rstrip()
+    while position < len(text):
+        match = TOKEN_PATTERN.match(text, position)
+        if not match or match.end() == position:
+            raise FilterSyntaxError(f"Unexpected character at position {position} in filter: {text[position:position + 20]!r}")
+        position = match.end()
+        kind = match.lastgroup
+        value = match.group(kind)
+        if kind == "number":
+            tokens.append(("literal", Decimal(value)))
+        elif kind == "string":
+            tokens.append(("literal", value.replace("''", "'")))
+        elif kind == "quoted":
+            tokens.append(("field", value))
+        elif kind == "name":
+            lowered = value.lower()
+            if lowered in ("true", "false"):
+                tokens.append(("literal", lowered == "true"))
+            elif lowered in KEYWORDS:
+                tokens.append(("keyword", lowered))
+            else:
+                tokens.append(("field", value))
+        else:
+            tokens.append((kind, value))
+    return tokens
+
+
+def _as_number(value: Any) -> Optional[Decimal]:
+    if isinstance(value, bool) or value is None:
+        return None
+    if isinstance(value, (int, float, Decimal)):
+        return Decimal(str(value))
+    try:
+        return Decimal(str(value).strip())
+    except InvalidOperation:
+        return None
+
+
+def _normalize(left: Any, right: Any) -> Tuple[Any, Any]:
+    """Bring a record value and a literal to comparable types."""
+    if isinstance(right, bool) or isinstance(left, bool):
+        if isinstance(left, str):
+            left = left.strip().lower() in ("true", "t", "yes", "y", "1")
+        elif left is not None and not isinstance(left, bool):
+            left = bool(left)
+        return left, right
+    if isinstance(right, Decimal) or isinstance(left, Decimal):
+        left_number, right_number = _as_number(left), _as_number(right)
+        if left_number is not None and right_number is not None:
+            return left_number, right_number
+    if isinstance(left, str) or isinstance(right, str):
+        return str(left).strip(), str(right).strip()
+    return left, right
+
+
+def _compare(operator: str, left: Any, right: Any) -> bool:
+    if left is None or right is None:
+        # As in SQL, comparisons with NULL never match; use "is null"
+        return False
+    left, right = _normalize(left, right)
+    try:
+        if operator in ("=", "=="):
+            return left == right
+        if operator in ("!=", "<>"):
+            return left != right
+        if operator == "<":
+            return left < right
+        if operator == "<=":
+            return left <= right
+        if operator == ">":
+            return left > right
+        if operator == ">=":
+            return left >= right
+    except TypeError:
+        return False
+    raise FilterSyntaxError(f"Unsupported operator: {operator}")
+
+
+def _like_pattern(pattern: str) -> re.Pattern:
+    regex = "".join(
+        ".*" if char == "%" else "." if char == "_" else re.escape(char)
+        for char in pattern
+    )
+    return re.compile(f"^{regex}$", re.IGNORECASE | re.DOTALL)
+
+
+class FilterExpression:
+    """A parsed filter expression that can be evaluated against records."""
+
+    def __init__(self, text: str):
+        """
+        Parse a filter expression.
+
+        Raises:
+            FilterSyntaxError: If the expression is invalid
+        """
+        self.text = text
+        self._tokens = _tokenize(text)
+        self._position = 0
+        if not self._tokens:
+            raise FilterSyntaxError("Filter expression is empty")
+        self.tree = self._parse_or()
+        if self._position != len(self._tokens):
+            raise FilterSyntaxError(f"Unexpected {str(self._tokens[self._position][1])!r} in filter: {text}")
+        self.fields = sorted(self._collect_fields(self.tree))
+
+    def matches(self, record: Dict[str, Any]) -> bool:
+        """Evaluate the expression for a record."""
+        return bool(self._evaluate(self.tree, record))
+
+    # Parser -----------------------------------------------------------------
+
+    def _peek(self) -> Tuple[Optional[str], Any]:
+        if self._position < len(self._tokens):
+            return self._tokens[self._position]
+        return None, None
+
+    def _take(self, kind: Optional[str] = None, value: Any = None) -> Tuple[str, Any]:
+        token = self._peek()
+        if token[0] is None:
+            raise FilterSyntaxError(f"Filter ends unexpectedly: {self.text}")
+        if (kind and token[0] != kind) or (value is not None and token[1] != value):
+            raise FilterSyntaxError(f"Expected {value or kind} but found {str(token[1])!r} in filter: {self.text}")
+        self._position += 1
+        return token
+
+    def _accept(self, kind: str, value: Any = None) -> bool:
+        token = self._peek()
+        if token[0] == kind and (value is None or token[1] == value):
+            self._position += 1
+            return True
+        return False
+
+    def _parse_or(self):
+        node = self._parse_and()
+        while self._accept("keyword", "or"):
+            node = ("or", node, self._parse_and())
+        return node
+
+    def _parse_and(self):
+        node = self._parse_not()
+        while self._accept("keyword", "and"):
+            node = ("and", node, self._parse_not())
+        return node
+
+    def _parse_not(self):
+        if self._accept("keyword", "not"):
+            return ("not", self._parse_not())
+        return self._parse_comparison()
+
+    def _parse_comparison(self):
+        if self._accept("punct", "("):
+            node = self._parse_or()
+            self._take("punct", ")")
+            return node
+
+        left = self._parse_operand()
+        kind, value = self._peek()
+        if kind == "op":
+            self._take()
+            return ("compare", value, left, self._parse_operand())
+        if kind == "keyword" and value == "is":
+            self._take()
+            negate = self._accept("keyword", "not")
+            self._take("keyword", "null")
+            return ("not", ("is_null", left)) if negate else ("is_null", left)
+        negate = False
+        if kind == "keyword" and value == "not":
+            self._take()
+            negate = True
+            kind, value = self._peek()
+        if kind == "keyword" and value == "in":
+            self._take()
+            node = ("in", left, self._parse_list())
+            return ("not", node) if negate else node
+        if kind == "keyword" and value == "like":
+            self._take()
+            pattern = self._take("literal")[1]
+            if not isinstance(pattern, str):
+                raise FilterSyntaxError(f"like needs a string pattern in filter: {self.text}")
+            node = ("like", left, _like_pattern(pattern))
+            return ("not", node) if negate else node
+        if negate:
+            raise FilterSyntaxError(f"Expected in or like after not in filter: {self.text}")
+        if left[0] == "field":
+            raise FilterSyntaxError(f"Field {left[1]} needs a comparison in filter: {self.text}")
+        return left
+
+    def _parse_operand(self):
+        kind, value = self._peek()
+        if kind == "field":
+            self._take()
+            return ("field", value)
+        if kind == "literal":
+            self._take()
+            return ("literal", value)
+        if kind == "keyword" and value == "null":
+            self._take()
+            return ("literal", None)
+        if kind is None:
+            raise FilterSyntaxError(f"Filter ends unexpectedly: {self.text}")
+        raise FilterSyntaxError(f"Expected a field or value but found {str(value)!r} in filter: {self.text}")
+
+    def _parse_list(self):
+        self._take("punct", "(")
+        values = [self._take("literal")[1]]
+        while self._accept("punct", ","):
+            values.append(self._take("literal")[1])
+        self._take("punct", ")")
+        return values
+
+    @classmethod
+    def _collect_fields(cls, node) -> set:
+        if node[0] == "field":
+            return {node[1]}
+        fields = set()
+        for part in node[1:]:
+            if isinstance(part, tuple):
+                fields |= cls._collect_fields(part)
+        return fields
+
+    # Evaluation -------------------------------------------------------------
+
+    def _value(self, node, record: Dict[str, Any]) -> Any:
+        return record.get(node[1]) if node[0] == "field" else node[1]
+
+    def _evaluate(self, node, record: Dict[str, Any]) -> Any:
+        op = node[0]
+        if op == "or":
+            return self._evaluate(node[1], record) or self._evaluate(node[2], record)
+        if op == "and":
+            return self._evaluate(node[1], record) and self._evaluate(node[2], record)
+        if op == "not":
+            return not self._evaluate(node[1], record)
+        if op == "compare":
+            return _compare(node[1], self._value(node[2], record), self._value(node[3], record))
+        if op == "is_null":
+            return self._value(node[1], record) is None
+        if op == "in":
+            value = self._value(node[1], record)
+            return any(_compare("=", value, option) for option in node[2])
+        if op == "like":
+            value = self._value(node[1], record)
+            return value is not None and bool(node[2].match(str(value)))
+        # Bare literal, e.g. "true"
+        return self._value(node, record)
+
+
+class RecordFilter:
+    """The filters that apply to one table of a sync pair."""
+
+    def __init__(self, table: Dict[str, Any], filters: List[Tuple[FilterExpression, str]], spatial=None):
+        self.table = table
+        self.filters = filters
+        # A job's spatial filter (see gis_spatial), tested after the expressions
+        self.spatial = spatial
+        # Records the spatial filter excluded in the last batch
+        self.outside = 0
+
+    def apply(self, batch: List[Dict[str, Any]]) -> Tuple[List[Dict[str, Any]], int]:
+        """
+        Filter a batch of extracted records.
+
+        Deleted records carry only their keys and always pass, so deletes in the
+        source still reach the target. Records outside the spatial filter's
+        area are skipped, whatever the filters' on_exclude action.
+
+        Returns:
+            Tuple of (records to load, number excluded)
+        """
+        records, excluded = [], 0
+        self.outside = 0
+        for record in batch:
+            if record.get(OPERATION_FIELD) == "delete":
+                records.append(record)
+                continue
+            action = None
+            for expression, on_exclude in self.filters:
+                if not expression.matches(record):
+                    action = on_exclude
+                    if on_exclude == "delete":
+                        break
+            if action is None and self.spatial is not None and not self.spatial.matches_record(record):
+                self.outside += 1
+                excluded += 1
+                continue
+            if action is None:
+                records.append(record)
+                continue
+            excluded += 1
+            if action == "delete":
+                delete = {column: record.get(column) for column in self.table["primary_key"]}
+                delete[OPERATION_FIELD] = "delete"
+                records.append(delete)
+        return records, excluded
+
+
+def parse_filters(definitions: List[Dict[str, Any]]) -> None:
+    """
+    Check filter definitions from the configuration.
+
+    Raises:
+        ValueError: If a filter is missing its expression, has an invalid
+            on_exclude action or does not parse
+    """
+    for definition in definitions:
+        if not definition.get("expression"):
+            raise ValueError("Filter definition missing required field: expression")
+        on_exclude = definition.get("on_exclude", "skip")
+        if on_exclude not in EXCLUDE_ACTIONS:
+            raise ValueError(f"Unsupported on_exclude action: {on_exclude}. Supported actions: {', '.join(EXCLUDE_ACTIONS)}")
+        FilterExpression(definition["expression"])
+
+
+def build_filter(definitions: List[Dict[str, Any]], table: Dict[str, Any], spatial=None) -> Optional[RecordFilter]:
+    """
+    Build the record filter for a table, or None when no filter applies.
+
+    A filter without a "tables" list applies to every table of the sync pair.
+    A spatial filter given for the job is applied with them.
+    """
+    filters = [
+        (FilterExpression(definition["expression"]), definition.get("on_exclude", "skip"))
+        for definition in definitions
+        if not definition.get("tables") or table["name"] in definition["tables"]
+    ]
+    return RecordFilter(table, filters, spatial) if filters or spatial is not None else None
@@ -0,0 +1,356 @@
+"""
+TerraFusion SyncService - Data Freshness SLOs
+
+This module tracks how stale each dataset (a sync pair's tables) is against
+the freshness service level objective it promises, so a county can show
+that its parcel data is never more than a day old. A sync pair sets its
+objective with a "freshness_slo" block:
+
+    "freshness_slo": {
+        "max_age_hours": 24,
+        "tables": {"dbo.sales": 72}
+    }
+
+("tables" overrides the objective of single tables.) Pairs without the
+block are held to FRESHNESS_SLO_DEFAULT_HOURS when it is set and are not
+tracked otherwise. A table's age is the time since the last successful sync
+of its stalest source (see SyncEngine.source_freshness); a table never
+synced is in breach.
+
+The freshness monitor (FRESHNESS_MONITOR_ENABLED on one instance) checks
+every tracked table each FRESHNESS_CHECK_SECONDS. Each breach is kept in the
+state store from the moment the data went stale until the sync that brought
+it back, announced on the event bus as a freshness_slo system event when it
+starts and ends (which the freshness_slo alert rule and the system event
+feed pick up), and counted in the metrics with the current age and
+objective of every table. GET /api/v1/freshness reports each dataset's
+status and how much of a window it met its objective; the breaches
+themselves are listed at GET /api/v1/freshness/breaches.
+"""
+
+import os
+import uuid
+import logging
+import threading
+from datetime import datetime, timedelta
+from typing import Dict, List, Any, Optional
+
+from sync_store import DocumentStore, sync_state_store
+from event_bus import EventBus, EventBusError, event_bus, SUBJECT_SYSTEM
+from metrics import DATASET_FRESHNESS, DATASET_FRESHNESS_SLO, DATASET_FRESHNESS_BREACHED, FRESHNESS_SLO_BREACHES
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collections: breach periods, and the last checked status of each table
+BREACHES_COLLECTION = "freshness_breaches"
+STATUS_COLLECTION = "freshness_status"
+
+# Objective of sync pairs without a freshness_slo block; they are not tracked when unset
+DEFAULT_SLO_HOURS = float(os.environ["FRESHNESS_SLO_DEFAULT_HOURS"]) \
+    if os.environ.get("FRESHNESS_SLO_DEFAULT_HOURS") else None
+
+# Seconds between freshness checks
+CHECK_SECONDS = int(os.environ.get("FRESHNESS_CHECK_SECONDS", "60"))
+
+# Days reported when a report names no window
+DEFAULT_REPORT_DAYS = int(os.environ.get("FRESHNESS_REPORT_DAYS", "30"))
+
+FRESHNESS_STATUSES = ["met", "breached"]
+
+
+def _hours(value: Any, label: str) -> float:
+    try:
+        hours = float(value)
+    except (TypeError, ValueError):
+        hours = 0
+    if hours <= 0:
+        raise ValueError(f"{label} must be a positive number of hours")
+    return hours
+
+
+def parse_freshness_slo(sync_pair_id: str, definition: Any, table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the "freshness_slo" block of a sync pair.
+
+    Returns:
+        The objective and its table overrides, empty when the block is absent
+    """
+    if not definition:
+        return {}
+    if not isinstance(definition, dict):
+        raise ValueError(f"Sync pair {sync_pair_id}: freshness_slo must be an object")
+    slo = {"max_age_hours": _hours(definition.get("max_age_hours"), f"Sync pair {sync_pair_id}: freshness_slo "
+                                                                    f"max_age_hours"),
+           "tables": {}}
+    for name, hours in (definition.get("tables") or {}).items():
+        if name not in table_names:
+            raise ValueError(f"Sync pair {sync_pair_id}: freshness_slo names unknown table {name}")
+        slo["tables"][name] = _hours(hours, f"Sync pair {sync_pair_id}: freshness_slo of {name}")
+    return slo
+
+
+def table_objectives(pair) -> Dict[str, float]:
+    """The freshness objective of each table of a sync pair in seconds; empty when the pair is not tracked."""
+    hours = pair.freshness_slo.get("max_age_hours") or DEFAULT_SLO_HOURS
+    if not hours:
+        return {}
+    overrides = pair.freshness_slo.get("tables", {})
+    return {table.name: overrides.get(table.name, hours) * 3600 for table in pair.tables}
+
+
+def _overlap(breach: Dict[str, Any], since: datetime, until: datetime) -> float:
+    """Seconds of a breach between since and until; an open breach lasts until then."""
+    started = datetime.fromisoformat(breach["started_at"])
+    ended = datetime.fromisoformat(breach["ended_at"]) if breach.get("ended_at") else until
+    return max(0.0, (min(ended, until) - max(started, since)).total_seconds())
+
+
+class FreshnessMonitor:
+    """
+    Service class that checks the freshness of every tracked table, records
+    its breaches and reports how well each dataset met its objective.
+    """
+
+    def __init__(self, engine, store: Optional[DocumentStore] = None, bus: Optional[EventBus] = None,
+                 interval_seconds: float = CHECK_SECONDS):
+        """
+        Initialize the monitor.
+
+        Args:
+            engine: Sync engine whose sync pairs and watermarks are checked
+            store: Document store breaches are kept in
+            bus: Event bus breaches are announced on
+            interval_seconds: Seconds between checks
+        """
+        self.engine = engine
+        self.store = store or sync_state_store
+        self.bus = bus or event_bus
+        self.interval_seconds = interval_seconds
+        self._lock = threading.Lock()
+        self._stop_event = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+
+    # Checks -----------------------------------------------------------------
+
+    def _pairs(self, county_id: Optional[str] = None, sync_pair_id: Optional[str] = None) -> List[Any]:
+        if sync_pair_id:
+            pairs = [self.engine.registry.get(sync_pair_id)]
+            return [pair for pair in pairs if county_id in (None, pair.county_id)]
+        return self.engine.registry.list(county_id)
+
+    def current(self, pair, now: Optional[datetime] = None) -> List[Dict[str, Any]]:
+        """The age, objective and status of each tracked table of a sync pair."""
+        objectives = table_objectives(pair)
+        if not objectives:
+            return []
+        now = now or datetime.utcnow()
+        tables = []
+        for table in self.engine.source_freshness(pair.sync_pair_id)["tables"]:
+            slo_seconds = objectives[table["table"]]
+            age = table["age_seconds"]
+            synced = [source["synced_at"] for source in table["sources"] if source["synced_at"]]
+            tables.append({
+                "sync_pair_id": pair.sync_pair_id,
+                "county_id": pair.county_id,
+                "table": table["table"],
+                "status": "breached" if age is None or age > slo_seconds else "met",
+                "age_seconds": age,
+                "slo_seconds": int(slo_seconds),
+                # The stalest source dates the table; the newest sync is the one that last refreshed it
+                "synced_at": min(synced) if age is not None else None,
+                "refreshed_at": max(synced) if synced else None,
+                "checked_at": now.isoformat(),
+            })
+        return tables
+
+    def check(self, now: Optional[datetime] = None) -> List[Dict[str, Any]]:
+        """
+        Check every tracked table once, start and end breaches and announce them.
+
+        Returns:
+            The announced transitions
+        """
+        now = now or datetime.utcnow()
+        transitions = []
+        tracked = set()
+        for pair in self.engine.registry.list():
+            try:
+                tables = self.current(pair, now)
+            except Exception as e:
+                logger.warning(f"Cannot check the freshness of {pair.sync_pair_id}: {e}")
+                continue
+            for table in tables:
+                tracked.add((pair.sync_pair_id, table["table"]))
+                labels = {"sync_pair": pair.sync_pair_id, "table": table["table"]}
+                if table["age_seconds"] is not None:
+                    DATASET_FRESHNESS.set(table["age_seconds"], **labels)
+                DATASET_FRESHNESS_SLO.set(table["slo_seconds"], **labels)
+                DATASET_FRESHNESS_BREACHED.set(1 if table["status"] == "breached" else 0, **labels)
+                transition = self._record(table, now)
+                if transition is not None:
+                    transitions.append(transition)
+                    self._announce(transition)
+        for key in self.store.keys(STATUS_COLLECTION):
+            status = self.store.load(STATUS_COLLECTION, key)
+            if (status["sync_pair_id"], status["table"]) not in tracked:
+                # The pair, table or objective is gone; an open breach ends with it
+                self._end_breach(status, now.isoformat())
+                self.store.delete(STATUS_COLLECTION, key)
+        return transitions
+
+    def _record(self, table: Dict[str, Any], now: datetime) -> Optional[Dict[str, Any]]:
+        """Save a table's status; returns its transition when it started or ended a breach."""
+        key = f"{table['sync_pair_id']}/{table['table']}"
+        with self._lock:
+            try:
+                previous = self.store.load(STATUS_COLLECTION, key)
+            except FileNotFoundError:
+                previous = None
+            current = dict(table, breach_id=previous.get("breach_id") if previous else None)
+            open_breach = current["breach_id"]
+            if table["status"] == "breached" and not current["breach_id"]:
+                if table["age_seconds"] is None:
+                    started_at = now
+                else:
+                    # The data went stale when it passed its objective, not when this check noticed
+                    started_at = now - timedelta(seconds=table["age_seconds"] - table["slo_seconds"])
+                current["breach_id"] = str(uuid.uuid4())
+                breach = {
+                    "breach_id": current["breach_id"],
+                    "sync_pair_id": table["sync_pair_id"],
+                    "county_id": table["county_id"],
+                    "table": table["table"],
+                    "slo_seconds": table["slo_seconds"],
+                    "synced_at": table["synced_at"],
+                    "started_at": started_at.isoformat(),
+                    "ended_at": None,
+                    "duration_seconds": None,
+                    "detected_at": now.isoformat(),
+                }
+                self.store.save(BREACHES_COLLECTION, breach["breach_id"], breach)
+                FRESHNESS_SLO_BREACHES.inc(sync_pair=table["sync_pair_id"], table=table["table"])
+                logger.warning(f"{table['table']} of {table['sync_pair_id']} breached its freshness objective "
+                               f"of {table['slo_seconds'] / 3600:g} hours")
+            elif table["status"] == "met" and current["breach_id"]:
+                self._end_breach(current, table["refreshed_at"] or now.isoformat())
+                current["breach_id"] = None
+                logger.info(f"{table['table']} of {table['sync_pair_id']} meets its freshness objective again")
+            self.store.save(STATUS_COLLECTION, key, current)
+        previous_status = previous["status"] if previous else None
+        if previous_status == table["status"] or (previous is None and table["status"] == "met"):
+            return None
+        return dict(table, previous_status=previous_status, breach_id=current["breach_id"] or open_breach)
+
+    def _end_breach(self, status: Dict[str, Any], ended_at: str) -> None:
+        if not status.get("breach_id"):
+            return
+        try:
+            breach = self.store.load(BREACHES_COLLECTION, status["breach_id"])
+        except FileNotFoundError:
+            return
+        # A sync that finished before the breach was detected still ends it no earlier than it began
+        ended_at = max(ended_at, breach["started_at"])
+        breach["ended_at"] = ended_at
+        breach["duration_seconds"] = int((datetime.fromisoformat(ended_at)
+                                          - datetime.fromisoformat(breach["started_at"])).total_seconds())
+        self.store.save(BREACHES_COLLECTION, breach["breach_id"], breach)
+
+    def _announce(self, transition: Dict[str, Any]) -> None:
+        try:
+            self.bus.publish(SUBJECT_SYSTEM.format(event="freshness_slo"), transition)
+        except EventBusError as e:
+            logger.warning(f"Cannot announce the freshness of {transition['sync_pair_id']} "
+                           f"{transition['table']}: {e}")
+
+    # Reports ----------------------------------------------------------------
+
+    def breaches(self, county_id: Optional[str] = None, sync_pair_id: Optional[str] = None,
+                 since: Optional[datetime] = None, until: Optional[datetime] = None) -> List[Dict[str, Any]]:
+        """Breaches of a county or sync pair overlapping a window, newest first."""
+        until = until or datetime.utcnow()
+        found = []
+        for breach in self.store.list(BREACHES_COLLECTION):
+            if county_id and breach["county_id"] != county_id:
+                continue
+            if sync_pair_id and breach["sync_pair_id"] != sync_pair_id:
+                continue
+            if breach["started_at"] > until.isoformat():
+                continue
+            if since and breach.get("ended_at") and breach["ended_at"] < since.isoformat():
+                continue
+            found.append(breach)
+        return sorted(found, key=lambda b: (b["started_at"], b["breach_id"]), reverse=True)
+
+    def report(self, county_id: Optional[str] = None, sync_pair_id: Optional[str] = None,
+               days: Optional[float] = None, now: Optional[datetime] = None) -> Dict[str, Any]:
+        """
+        Each tracked dataset's current freshness and how much of the last days it met its objective.
+
+        Raises:
+            KeyError: If the sync pair is not configured
+            ValueError: If days is not positive
+        """
+        days = DEFAULT_REPORT_DAYS if days is None else days
+        if days <= 0:
+            raise ValueError("days must be positive")
+        now = now or datetime.utcnow()
+        since = now - timedelta(days=days)
+        window_seconds = (now - since).total_seconds()
+        breaches = self.breaches(county_id, sync_pair_id, since, now)
+        datasets = []
+        for pair in self._pairs(county_id, sync_pair_id):
+            tables = self.current(pair, now)
+            if not tables:
+                continue
+            for table in tables:
+                own = [b for b in breaches if b["sync_pair_id"] == pair.sync_pair_id and b["table"] == table["table"]]
+                breach_seconds = sum(_overlap(b, since, now) for b in own)
+                table.update(breaches=len(own), breach_seconds=int(breach_seconds),
+                             attainment=round(max(0.0, 1 - breach_seconds / window_seconds), 6))
+            datasets.append({
+                "sync_pair_id": pair.sync_pair_id,
+                "county_id": pair.county_id,
+                "status": "breached" if any(t["status"] == "breached" for t in tables) else "met",
+                "attainment": min(t["attainment"] for t in tables),
+                "breaches": sum(t["breaches"] for t in tables),
+                "tables": tables,
+            })
+        return {"since": since.isoformat(), "until": now.isoformat(), "days": days, "datasets": datasets,
+                "worker": self.status()}
+
+    # Worker -----------------------------------------------------------------
+
+    def is_running(self) -> bool:
+        return self._thread is not None and self._thread.is_alive()
+
+    def start(self) -> None:
+        """Start checking on a background thread."""
+        if self.is_running():
+            return
+        self._stop_event.clear()
+        self._thread = threading.Thread(target=self._loop, name="freshness-monitor", daemon=True)
+        self._thread.start()
+        logger.info(f"Freshness monitor started, checking every {self.interval_seconds}s")
+
+    def stop(self) -> None:
+        self._stop_event.set()
+        if self._thread is not None:
+            self._thread.join(timeout=5)
+            self._thread = None
+        logger.info("Freshness monitor stopped")
+
+    def status(self) -> Dict[str, Any]:
+        """Whether the monitor runs here, and the breaches still open."""
+        open_breaches = sum(1 for breach in self.store.list(BREACHES_COLLECTION) if not breach.get("ended_at"))
+        return {"running": self.is_running(), "interval_seconds": self.interval_seconds,
+                "open_breaches": open_breaches}
+
+    def _loop(self) -> None:
+        while not self._stop_event.is_set():
+            try:
+                self.check()
+            except Exception as e:
+                logger.error(f"Freshness check failed: {e}", exc_info=True)
+            self._stop_event.wait(self.interval_seconds)
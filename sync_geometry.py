@@ -0,0 +1,485 @@
+"""
+TerraFusion SyncService - Geometry Validation and Repair
+
+This module checks the geometry columns of synced tables as records are
+loaded and repairs what it can, so self-intersecting parcels and unclosed
+rings from the source don't break the map, the exports or PostGIS
+constraints downstream. It runs after hooks and field mappings (so columns
+are target names) and before the validation rules:
+
+    "geometry_repair": {
+        "tables": {
+            "gis.parcels": {"columns": ["shape"], "min_area": 0.5, "orientation": "ccw", "invalid": "reject"}
+        }
+    }
+
+Repairs are made in this order: repeated points are removed, unclosed rings
+closed, self-intersecting rings split at their crossings into simple rings
+(loops inside other loops become holes, by the even-odd rule), rings whose
+area is at most min_area (in the units of the column's CRS, squared; 0
+removes only zero-area slivers and spikes) dropped, and rings oriented with
+exteriors counterclockwise and holes clockwise ("orientation": "cw" for the
+reverse). A polygon split in two becomes a MultiPolygon.
+
+Geometries that can't be repaired this way, such as a hole crossing its
+exterior, overlapping parts of a MultiPolygon or a polygon with no area
+left, are repaired with shapely's make_valid when shapely is installed.
+Otherwise, and for lines or points with too few or non-finite coordinates,
+the record is rejected to the dead-letter store ("invalid": "reject", the
+default) or loaded with the geometry set to null ("invalid": "null").
+
+Each table result counts the geometries checked, valid, repaired, rejected
+and nulled, with the repairs made by kind; the job totals the repaired and
+rejected ones.
+"""
+
+import json
+import math
+import logging
+from typing import Dict, List, Any, Optional, Tuple
+
+from sync_connectors import OPERATION_FIELD, ewkb_with_srid
+from gis_features import BOUNDARY, INSIDE, decode_geometry, encode_wkb, locate_point, ring_edges
+
+try:
+    from shapely.geometry import shape as shapely_shape, mapping as shapely_mapping
+    from shapely.validation import make_valid
+    SHAPELY_AVAILABLE = True
+except ImportError:
+    SHAPELY_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# What happens to a record whose geometry can't be repaired
+INVALID_ACTIONS = ["reject", "null"]
+
+# Winding of exterior rings; holes wind the other way
+RING_ORIENTATIONS = ["ccw", "cw"]
+
+Point = Tuple[float, ...]
+
+
+class GeometryInvalid(Exception):
+    """Raised when a geometry cannot be repaired."""
+
+
+def parse_geometry_repair(sync_pair_id: str, definition: Optional[Dict[str, Any]],
+                          table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the geometry_repair block of a sync pair and fill in defaults.
+
+    Raises:
+        ValueError: If a setting is invalid or names an unknown table
+    """
+    if not definition:
+        return {}
+    tables = {}
+    for table_name, settings in (definition.get("tables") or {}).items():
+        if table_name not in table_names:
+            raise ValueError(f"Geometry repair of sync pair {sync_pair_id} names unknown table {table_name}")
+        if not isinstance(settings, dict):
+            raise ValueError(f"Geometry repair settings of {table_name} must be an object")
+        columns = settings.get("columns") or settings.get("column")
+        columns = [columns] if isinstance(columns, str) else columns
+        if not columns or not isinstance(columns, list) or not all(isinstance(c, str) for c in columns):
+            raise ValueError(f"Geometry repair of {table_name} requires 'columns', the geometry columns to check")
+        min_area = settings.get("min_area", 0)
+        if isinstance(min_area, bool) or not isinstance(min_area, (int, float)) or min_area < 0:
+            raise ValueError(f"Geometry repair min_area of {table_name} must be a non-negative number")
+        orientation = settings.get("orientation", "ccw")
+        if orientation not in RING_ORIENTATIONS:
+            raise ValueError(f"Unsupported ring orientation: {orientation}. Supported: {', '.join(RING_ORIENTATIONS)}")
+        invalid = settings.get("invalid", "reject")
+        if invalid not in INVALID_ACTIONS:
+            raise ValueError(f"Unsupported invalid geometry action: {invalid}. Supported: {', '.join(INVALID_ACTIONS)}")
+        tables[table_name] = {"columns": list(columns), "min_area": float(min_area),
+                              "orientation": orientation, "invalid": invalid}
+    return {"tables": tables}
+
+
+def _area(ring: List[Point]) -> float:
+    """Signed area of an open ring; positive when counterclockwise."""
+    return sum(ring[i - 1][0] * ring[i][1] - ring[i][0] * ring[i - 1][1] for i in range(len(ring))) / 2
+
+
+def _cross(o: Point, a: Point, b: Point) -> float:
+    return (a[0] - o[0]) * (b[1] - o[1]) - (a[1] - o[1]) * (b[0] - o[0])
+
+
+def _on_segment(p: Point, a: Point, b: Point) -> bool:
+    """Whether a point collinear with a segment lies within it."""
+    return min(a[0], b[0]) <= p[0] <= max(a[0], b[0]) and min(a[1], b[1]) <= p[1] <= max(a[1], b[1])
+
+
+def _at(a: Point, b: Point, t: float) -> Point:
+    """The point a fraction of the way along a segment, with any Z interpolated."""
+    return tuple(a[k] + (b[k] - a[k]) * t for k in range(len(a)))
+
+
+def _meeting_points(a: Point, b: Point, c: Point, d: Point) -> Tuple[List[Point], List[Point]]:
+    """
+    Where two segments meet, as the points to insert inside ab and inside cd:
+    their crossing (the same point for both), an end of one lying on the
+    other, or the ends of an overlap.
+    """
+    d1, d2 = _cross(a, b, c), _cross(a, b, d)
+    d3, d4 = _cross(c, d, a), _cross(c, d, b)
+    if ((d1 > 0 > d2) or (d1 < 0 < d2)) and ((d3 > 0 > d4) or (d3 < 0 < d4)):
+        crossing = _at(a, b, d3 / (d3 - d4))
+        return [crossing], [crossing]
+    on_ab = [p for p, side in ((c, d1), (d, d2))
+             if side == 0 and _on_segment(p, a, b) and p[:2] != a[:2] and p[:2] != b[:2]]
+    on_cd = [p for p, side in ((a, d3), (b, d4))
+             if side == 0 and _on_segment(p, c, d) and p[:2] != c[:2] and p[:2] != d[:2]]
+    return on_ab, on_cd
+
+
+def _crossing(a: Point, b: Point, c: Point, d: Point) -> bool:
+    """Whether two segments cross at a point inside both."""
+    d1, d2 = _cross(a, b, c), _cross(a, b, d)
+    d3, d4 = _cross(c, d, a), _cross(c, d, b)
+    return ((d1 > 0 > d2) or (d1 < 0 < d2)) and ((d3 > 0 > d4) or (d3 < 0 < d4))
+
+
+def _segments(rings: List[List[Point]]) -> List[Tuple[int, int, Point, Point]]:
+    """The segments of open rings as (ring, index, start, end)."""
+    return [(r, i, ring[i], ring[(i + 1) % len(ring)]) for r, ring in enumerate(rings) for i in range(len(ring))]
+
+
+def _pairs(segments: List[Tuple[int, int, Point, Point]]):
+    """Pairs of segments whose bounding boxes meet, found by sweeping along x."""
+    ordered = sorted(segments, key=lambda s: min(s[2][0], s[3][0]))
+    active: List[Tuple[int, int, Point, Point]] = []
+    for segment in ordered:
+        low = min(segment[2][0], segment[3][0])
+        active = [s for s in active if max(s[2][0], s[3][0]) >= low]
+        bottom, top = min(segment[2][1], segment[3][1]), max(segment[2][1], segment[3][1])
+        for other in active:
+            if min(other[2][1], other[3][1]) <= top and max(other[2][1], other[3][1]) >= bottom:
+                yield other, segment
+        active.append(segment)
+
+
+def _split_ring(ring: List[Point]) -> List[List[Point]]:
+    """
+    A ring noded at its self-intersections and split into simple loops
+    wherever it comes back to a point it has passed.
+    """
+    inserted: Dict[int, List[Point]] = {}
+    count = len(ring)
+    for (_, i, a, b), (_, j, c, d) in _pairs(_segments([ring])):
+        if i == j:
+            continue
+        on_ab, on_cd = _meeting_points(a, b, c, d)
+        inserted.setdefault(i, []).extend(on_ab)
+        inserted.setdefault(j, []).extend(on_cd)
+    noded: List[Point] = []
+    for i in range(count):
+        a, b = ring[i], ring[(i + 1) % count]
+        noded.append(a)
+        length = (b[0] - a[0]) ** 2 + (b[1] - a[1]) ** 2
+        for p in sorted(set(inserted.get(i, [])), key=lambda p: ((p[0] - a[0]) ** 2 + (p[1] - a[1]) ** 2) / length):
+            if p[:2] != noded[-1][:2]:
+                noded.append(p)
+
+    loops, stack, seen = [], [], {}
+    for p in noded + [noded[0]]:
+        key = p[:2]
+        if key in seen:
+            start = seen[key]
+            loop = stack[start:]
+            for q in loop[1:]:
+                seen.pop(q[:2], None)
+            del stack[start + 1:]
+            loops.append(loop)
+        else:
+            seen[key] = len(stack)
+            stack.append(p)
+    return loops
+
+
+def _contains(outer: List[Point], inner: List[Point]) -> bool:
+    """Whether a simple ring lies inside another that it does not cross."""
+    vertices = {p[:2] for p in outer}
+    # Points on the outer ring's edges touch it and tell nothing; the first point off them decides
+    candidates = [p for p in inner if p[:2] not in vertices]
+    # Every vertex is shared or touching; test the middles of the edges too
+    candidates += [_at(inner[i - 1], inner[i], 0.5) for i in range(len(inner))]
+    for p in candidates:
+        if p[:2] in vertices:
+            continue
+        location = locate_point(p, ring_edges([outer]))
+        if location != BOUNDARY:
+            return location == INSIDE
+    return False
+
+
+def _rings_cross(rings: List[List[Point]], groups: List[int]) -> bool:
+    """Whether rings of different groups (the loops of different input rings) cross each other."""
+    for (r, _, a, b), (s, _, c, d) in _pairs(_segments(rings)):
+        if groups[r] != groups[s] and _crossing(a, b, c, d):
+            return True
+    return False
+
+
+class GeometryRepair:
+    """Repairs one geometry value, counting what was done."""
+
+    def __init__(self, min_area: float = 0.0, orientation: str = "ccw"):
+        self.min_area = min_area
+        self.counterclockwise = orientation == "ccw"
+        self.repairs: Dict[str, int] = {}
+
+    def repair(self, geometry: Dict[str, Any]) -> Dict[str, Any]:
+        """
+        A GeoJSON-style geometry repaired; the repairs made are counted in
+        self.repairs.
+
+        Raises:
+            GeometryInvalid: If the geometry cannot be repaired
+        """
+        kind, coordinates = geometry.get("type"), geometry.get("coordinates")
+        if coordinates is None:
+            raise GeometryInvalid(f"{kind} has no coordinates")
+        if kind == "Point":
+            if len(coordinates) < 2:
+                raise GeometryInvalid("Point has fewer than two coordinates")
+            if all(isinstance(v, float) and math.isnan(v) for v in coordinates):
+                # POINT EMPTY in WKB
+                return geometry
+        self._check_finite(coordinates)
+        if kind == "Point":
+            return geometry
+        if kind == "MultiPoint":
+            return geometry
+        if kind == "LineString":
+            return {"type": kind, "coordinates": self._line(coordinates)}
+        if kind == "MultiLineString":
+            lines = []
+            for line in coordinates:
+                try:
+                    lines.append(self._line(line))
+                except GeometryInvalid:
+                    self._count("degenerate_part")
+            if not lines:
+                raise GeometryInvalid("MultiLineString has no line with two distinct points")
+            return {"type": kind, "coordinates": lines}
+        if kind == "Polygon":
+            polygons = self._polygons([coordinates])
+            if len(polygons) == 1:
+                return {"type": "Polygon", "coordinates": polygons[0]}
+            return {"type": "MultiPolygon", "coordinates": polygons}
+        if kind == "MultiPolygon":
+            return {"type": "MultiPolygon", "coordinates": self._polygons(coordinates)}
+        raise GeometryInvalid(f"Unsupported geometry type: {kind}")
+
+    def _count(self, repair: str) -> None:
+        self.repairs[repair] = self.repairs.get(repair, 0) + 1
+
+    @staticmethod
+    def _check_finite(coordinates: Any) -> None:
+        if coordinates and isinstance(coordinates[0], (int, float)):
+            if not all(isinstance(v, (int, float)) and math.isfinite(v) for v in coordinates):
+                raise GeometryInvalid("Geometry has non-finite coordinates")
+            return
+        for part in coordinates:
+            GeometryRepair._check_finite(part)
+
+    def _deduplicated(self, points: List[Any]) -> List[Point]:
+        result: List[Point] = []
+        for p in points:
+            point = tuple(float(v) for v in p)
+            if result and result[-1][:2] == point[:2]:
+                self._count("repeated_point")
+                continue
+            result.append(point)
+        return result
+
+    def _line(self, points: List[Any]) -> List[List[float]]:
+        line = self._deduplicated(points)
+        if len(line) < 2:
+            raise GeometryInvalid("LineString has fewer than two distinct points")
+        return [list(p) for p in line]
+
+    def _polygons(self, polygons: List[List[List[Any]]]) -> List[List[List[List[float]]]]:
+        """Polygons repaired; the result may hold more or fewer polygons than went in."""
+        # Loops found, with the input polygon and ring each came from
+        rings: List[List[Point]] = []
+        groups: List[int] = []
+        origins: List[int] = []
+        inputs = [(group, ring) for group, polygon in enumerate(polygons) for ring in polygon]
+        for origin, (group, ring) in enumerate(inputs):
+            points = self._deduplicated(ring)
+            if len(points) > 1 and points[0][:2] == points[-1][:2]:
+                points.pop()
+            elif len(points) > 1:
+                self._count("closed_ring")
+            if len({p[:2] for p in points}) < 3:
+                self._count("zero_area_ring")
+                continue
+            loops = _split_ring(points)
+            kept = [loop for loop in loops if abs(_area(loop)) > self.min_area]
+            if len(kept) < len(loops):
+                self._count("zero_area_ring")
+            if len(kept) > 1:
+                self._count("self_intersection")
+            for loop in kept:
+                rings.append(loop)
+                groups.append(group)
+                origins.append(origin)
+        if not rings:
+            raise GeometryInvalid("Polygon has no area left after removing zero-area rings")
+        if _rings_cross(rings, origins):
+            raise GeometryInvalid("Polygon rings cross each other")
+
+        # Even-odd rule within each input polygon: a loop inside an odd number of loops is a hole
+        depth = [sum(1 for j in range(len(rings)) if j != i and groups[j] == groups[i] and _contains(rings[j], rings[i]))
+                 for i in range(len(rings))]
+        shells = [i for i in range(len(rings)) if depth[i] % 2 == 0]
+        holes: Dict[int, List[int]] = {i: [] for i in shells}
+        for i in range(len(rings)):
+            if depth[i] % 2:
+                owners = [s for s in shells if groups[s] == groups[i] and depth[s] == depth[i] - 1
+                          and _contains(rings[s], rings[i])]
+                if owners:
+                    holes[owners[0]].append(i)
+                else:
+                    shells.append(i)
+                    holes[i] = []
+
+        # Parts of different polygons may touch, but not overlap
+        for s in shells:
+            for t in shells:
+                if groups[s] != groups[t] and _contains(rings[t], rings[s]) and \
+                        not any(_contains(rings[h], rings[s]) for h in holes[t]):
+                    raise GeometryInvalid("MultiPolygon parts overlap")
+
+        result = []
+        for s in shells:
+            result.append([self._oriented(rings[s], self.counterclockwise)] +
+                          [self._oriented(rings[h], not self.counterclockwise) for h in holes[s]])
+        return result
+
+    def _oriented(self, ring: List[Point], counterclockwise: bool) -> List[List[float]]:
+        if (_area(ring) > 0) != counterclockwise:
+            self._count("orientation")
+            ring = ring[::-1]
+        return [list(p) for p in ring] + [list(ring[0])]
+
+
+def _make_valid(geometry: Dict[str, Any]) -> Dict[str, Any]:
+    """A geometry made valid by shapely, keeping only its polygonal or linear parts."""
+    valid = shapely_mapping(make_valid(shapely_shape(geometry)))
+    if valid["type"] == "GeometryCollection":
+        wanted = "Polygon" if "Polygon" in geometry["type"] else "LineString"
+        parts = [g for g in valid["geometries"] if wanted in g["type"]]
+        coordinates = []
+        for part in parts:
+            coordinates.extend([part["coordinates"]] if not part["type"].startswith("Multi") else part["coordinates"])
+        if not coordinates:
+            raise GeometryInvalid(f"No {wanted.lower()} left after make_valid")
+        valid = {"type": f"Multi{wanted}", "coordinates": coordinates}
+    return json.loads(json.dumps(valid))
+
+
+class GeometryRepairer:
+    """Checks and repairs the geometry columns of one table's records, batch by batch."""
+
+    def __init__(self, table_name: str, settings: Dict[str, Any]):
+        """
+        Initialize the repairer.
+
+        Args:
+            table_name: Source table name
+            settings: The table's settings from parse_geometry_repair
+        """
+        self.table_name = table_name
+        self.columns = settings["columns"]
+        self.min_area = settings["min_area"]
+        self.orientation = settings["orientation"]
+        self.invalid = settings["invalid"]
+
+    def repair(self, records: List[Dict[str, Any]], result: Optional[Dict[str, Any]] = None) -> Dict[int, List[str]]:
+        """
+        Repair the geometries of a batch in place.
+
+        Counts go to result["geometry"]: checked, valid, repaired, rejected,
+        nulled and repairs by kind.
+
+        Returns:
+            Errors of the records to reject, by position
+        """
+        counts = None
+        if result is not None:
+            counts = result.setdefault("geometry", {"checked": 0, "valid": 0, "repaired": 0, "rejected": 0,
+                                                    "nulled": 0, "repairs": {}})
+        failures: Dict[int, List[str]] = {}
+        for position, record in enumerate(records):
+            if record.get(OPERATION_FIELD) == "delete":
+                continue
+            for column in self.columns:
+                value = record.get(column)
+                if value is None or value == "":
+                    continue
+                outcome = "valid"
+                try:
+                    repaired, repairs = self._repair_value(value)
+                    if repairs:
+                        record[column] = repaired
+                        outcome = "repaired"
+                except (ValueError, GeometryInvalid) as e:
+                    repairs = {}
+                    if self.invalid == "null":
+                        record[column] = None
+                        outcome = "nulled"
+                    else:
+                        failures.setdefault(position, []).append(f"Invalid geometry in {column}: {e}")
+                        outcome = "rejected"
+                if counts is not None:
+                    counts["checked"] += 1
+                    counts[outcome] += 1
+                    for kind, count in repairs.items():
+                        counts["repairs"][kind] = counts["repairs"].get(kind, 0) + count
+        return failures
+
+    def _repair_value(self, value: Any) -> Tuple[Any, Dict[str, int]]:
+        """
+        A stored geometry value repaired, in the form it came in (EWKB bytes
+        or hex, GeoJSON object or text), and the repairs made; an unchanged
+        value is returned as it was.
+
+        Raises:
+            GeometryInvalid: If the geometry cannot be repaired
+            ValueError: If the value is not a geometry
+        """
+        geometry, srid = decode_geometry(value)
+        repair = GeometryRepair(self.min_area, self.orientation)
+        try:
+            repaired = repair.repair(geometry)
+        except GeometryInvalid:
+            if not SHAPELY_AVAILABLE or geometry["type"] in ("Point", "MultiPoint"):
+                raise
+            # make_valid returns its own orientation; run the built-in repairs over its output
+            repair = GeometryRepair(self.min_area, self.orientation)
+            repaired = repair.repair(_make_valid(geometry))
+            repair.repairs = {"make_valid": 1}
+        if not repair.repairs:
+            return value, {}
+        if isinstance(value, dict):
+            encoded = repaired
+        elif isinstance(value, str) and value.lstrip().startswith("{"):
+            encoded = json.dumps(repaired)
+        else:
+            data = encode_wkb(repaired)
+            if srid:
+                data = ewkb_with_srid(data, srid)
+            encoded = data.hex().upper() if isinstance(value, str) else data
+        return encoded, repair.repairs
+
+
+def build_geometry_repairer(geometry_repair: Dict[str, Any], table_name: str) -> Optional[GeometryRepairer]:
+    """The geometry repairer of a table, or None when its geometry is not checked."""
+    settings = (geometry_repair.get("tables") or {}).get(table_name)
+    return GeometryRepairer(table_name, settings) if settings else None
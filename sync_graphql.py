@@ -0,0 +1,983 @@
+"""
+TerraFusion SyncService - GraphQL API
+
+This module provides a read-only GraphQL endpoint over the tables a sync
+pair keeps in its target, for front ends that want parcels, their owners and
+their values in one request instead of several OData calls stitched
+together. A sync pair publishes its tables with a "graphql" block that also
+declares how they join:
+
+    "graphql": {
+        "tables": ["dbo.property", "dbo.owner", "dbo.property_val"],
+        "relations": [
+            {"name": "owners", "from": "dbo.property", "to": "dbo.owner", "on": {"prop_id": "prop_id"}},
+            {"name": "values", "from": "dbo.property", "to": "dbo.property_val", "on": {"prop_id": "prop_id"}},
+            {"name": "parcel", "from": "dbo.owner", "to": "dbo.property", "on": {"prop_id": "prop_id"}, "many": false}
+        ],
+        "access": {
+            "dbo.owner": {"roles": ["manager", "auditor"], "fields": {"owner_ssn": ["auditor"]}}
+        },
+        "hidden_columns": ["confidential_flag"]
+    }
+
+("graphql": true publishes every table, without relations.) Each target
+table is a type named like its OData entity set. The Query type has a field
+per table returning a page of rows, and <table>_by_key for a single row:
+
+    {
+      parcels(filter: "tax_district eq 'R1'", orderBy: "market_value desc", first: 50) {
+        totalCount
+        pageInfo { hasNextPage endCursor }
+        nodes { prop_id situs_address owners { owner_name } values(filter: "prop_val_yr eq 2025") { market_value } }
+      }
+    }
+
+filter and orderBy take OData $filter and $orderby syntax (see sync_odata).
+Pages are ordered with the primary key appended and continue with
+after: <endCursor>; a page holds at most "max_page_size" rows
+(GRAPHQL_MAX_PAGE_SIZE). Related rows are read in one query per relation
+and page, not once per row.
+
+Queries are checked before anything is read: operations other than query,
+unknown fields and arguments, selections nested deeper than "max_depth"
+(GRAPHQL_MAX_DEPTH) and fields the caller's role may not read are rejected
+with the usual GraphQL {"errors": [...]} response. "access" ties tables and
+relation or column fields to the platform's RBAC roles (admin may read
+everything); a role sees only what it may read in the schema it gets from
+schema(). A query may read at most GRAPHQL_MAX_ROWS rows in all. Fragments,
+variables, aliases, @skip/@include and __typename are supported;
+introspection queries are not, the SDL from schema() takes their place.
+"""
+
+import os
+import re
+import json
+import base64
+import logging
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Tuple
+
+from sync_connectors import ConnectorError, create_connector
+from sync_hooks import build_pipeline
+from sync_odata import ODataError, ODataService, FilterParser, check_literal, edm_type, entity_set_name, _json_value
+
+try:
+    from rbac_manager import RBAC_ROLES
+    RBAC_ROLES_AVAILABLE = True
+except ImportError:
+    RBAC_ROLES_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Deepest field nesting a query may have, unless the sync pair sets "max_depth"
+GRAPHQL_MAX_DEPTH = int(os.environ.get("GRAPHQL_MAX_DEPTH", "8"))
+
+# Rows per page when a query gives no "first", and the most it may ask for
+DEFAULT_PAGE_SIZE = 100
+GRAPHQL_MAX_PAGE_SIZE = int(os.environ.get("GRAPHQL_MAX_PAGE_SIZE", "500"))
+
+# Rows one query may read across all its fields
+GRAPHQL_MAX_ROWS = int(os.environ.get("GRAPHQL_MAX_ROWS", "10000"))
+
+# Parent keys looked up per query of a relation
+RELATION_BATCH_SIZE = 500
+
+# Roles that may read every table and field
+ALWAYS_ALLOWED_ROLES = {"admin"}
+
+# EDM types to GraphQL scalars (unlisted types are strings)
+GRAPHQL_SCALARS = {"Edm.Boolean": "Boolean", "Edm.Int64": "Int", "Edm.Decimal": "Float", "Edm.Double": "Float"}
+
+# Arguments of the fields returning pages of rows, and of relations
+PAGE_ARGUMENTS = {"filter": "String", "orderBy": "String", "first": "Int", "after": "String"}
+RELATION_ARGUMENTS = {"filter": "String", "orderBy": "String", "first": "Int"}
+
+NAME_PATTERN = re.compile(r"^[_A-Za-z][_0-9A-Za-z]*$")
+
+TOKEN_PATTERN = re.compile(r'''
+    (?P<ignored>[\s,\ufeff]+|\#[^\n]*)
+  | (?P<spread>\.\.\.)
+  | (?P<punct>[!$&():=@\[\]{}|])
+  | (?P<float>-?(?:0|[1-9]\d*)(?:\.\d+(?:[eE][+-]?\d+)?|[eE][+-]?\d+))
+  | (?P<int>-?(?:0|[1-9]\d*))
+  | (?P<block>"""(?:[^"\\]|\\.|"(?!""))*""")
+  | (?P<string>"(?:[^"\\\n]|\\.)*")
+  | (?P<name>[_A-Za-z][_0-9A-Za-z]*)
+''', re.VERBOSE)
+
+
+class GraphQLError(ValueError):
+    """Raised when a GraphQL query is invalid or cannot be answered; carries the response's errors."""
+
+    def __init__(self, message: str, location: Optional[Dict[str, int]] = None,
+                 errors: Optional[List[Dict[str, Any]]] = None):
+        super().__init__(message)
+        self.errors = errors or [dict({"message": message}, **({"locations": [location]} if location else {}))]
+
+
+def parse_graphql(sync_pair_id: str, definition: Any, table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the "graphql" block of a sync pair.
+
+    Returns:
+        The GraphQL settings, empty when the sync pair is not published
+    """
+    if not definition:
+        return {}
+    graphql = dict(definition) if isinstance(definition, dict) else {}
+    for name in graphql.get("tables", []):
+        if name not in table_names:
+            raise ValueError(f"Sync pair {sync_pair_id}: GraphQL names unknown table {name}")
+    published = graphql.get("tables") or table_names
+
+    relations, seen = [], set()
+    for relation in graphql.get("relations", []):
+        for key in ("name", "from", "to", "on"):
+            if not relation.get(key):
+                raise ValueError(f"Sync pair {sync_pair_id}: GraphQL relation needs {key}")
+        if not NAME_PATTERN.match(relation["name"]) or relation["name"].startswith("__"):
+            raise ValueError(f"Sync pair {sync_pair_id}: GraphQL relation name {relation['name']} is not a GraphQL name")
+        for key in ("from", "to"):
+            if relation[key] not in published:
+                raise ValueError(f"Sync pair {sync_pair_id}: GraphQL relation {relation['name']} names "
+                                 f"unpublished table {relation[key]}")
+        if not isinstance(relation["on"], dict):
+            raise ValueError(f"Sync pair {sync_pair_id}: GraphQL relation {relation['name']} \"on\" must map "
+                             f"columns of {relation['from']} to columns of {relation['to']}")
+        if (relation["from"], relation["name"]) in seen:
+            raise ValueError(f"Sync pair {sync_pair_id}: {relation['from']} has two GraphQL relations named {relation['name']}")
+        seen.add((relation["from"], relation["name"]))
+        relations.append(dict(relation, many=bool(relation.get("many", True))))
+    graphql["relations"] = relations
+
+    for table_name, rules in graphql.get("access", {}).items():
+        if table_name not in published:
+            raise ValueError(f"Sync pair {sync_pair_id}: GraphQL access names unpublished table {table_name}")
+        role_lists = [rules.get("roles") or []] + list((rules.get("fields") or {}).values())
+        for roles in role_lists:
+            if not isinstance(roles, list):
+                raise ValueError(f"Sync pair {sync_pair_id}: GraphQL access of {table_name} must list roles")
+            unknown = [role for role in roles if RBAC_ROLES_AVAILABLE and role not in RBAC_ROLES]
+            if unknown:
+                raise ValueError(f"Sync pair {sync_pair_id}: GraphQL access of {table_name} names unknown role {unknown[0]}")
+    graphql.setdefault("access", {})
+
+    for key in ("max_depth", "max_page_size"):
+        if key in graphql and int(graphql[key]) < 1:
+            raise ValueError(f"Sync pair {sync_pair_id}: GraphQL {key} must be positive")
+    graphql.setdefault("hidden_columns", [])
+    return graphql
+
+
+# Query language -------------------------------------------------------------
+
+def _tokenize(text: str) -> List[Tuple[str, Any, int]]:
+    """(kind, value, position) of each token of a query."""
+    tokens = []
+    position = 0
+    while position < len(text):
+        match = TOKEN_PATTERN.match(text, position)
+        if not match:
+            raise GraphQLError(f"Syntax error: unexpected character {text[position]!r}", _location(text, position))
+        kind = match.lastgroup
+        value = match.group(kind)
+        if kind == "string":
+            tokens.append(("string", json.loads(value), position))
+        elif kind == "block":
+            tokens.append(("string", value[3:-3].replace('\\"""', '"""'), position))
+        elif kind == "int":
+            tokens.append(("int", int(value), position))
+        elif kind == "float":
+            tokens.append(("float", float(value), position))
+        elif kind != "ignored":
+            tokens.append((kind, value, position))
+        position = match.end()
+    return tokens
+
+
+def _location(text: str, position: int) -> Dict[str, int]:
+    return {"line": text.count("\n", 0, position) + 1, "column": position - text.rfind("\n", 0, position)}
+
+
+class QueryParser:
+    """
+    Parses a GraphQL document into its operations and fragments.
+
+    Fields are {"kind": "field", "alias", "name", "arguments", "directives",
+    "selections", "location"}; fragment spreads and inline fragments have
+    kind "spread" and "inline". Argument values are ("literal", value),
+    ("variable", name), ("enum", name), ("list", [...]) or ("object", {...}).
+    """
+
+    def __init__(self, text: str):
+        """
+        Initialize the parser.
+
+        Args:
+            text: The GraphQL document
+        """
+        self.text = text
+        self._tokens = _tokenize(text)
+        self._position = 0
+
+    def parse(self) -> Dict[str, Any]:
+        """
+        Parse the document.
+
+        Returns:
+            {"operations": [...], "fragments": {name: fragment}}
+
+        Raises:
+            GraphQLError: If the document is not valid GraphQL
+        """
+        if not self._tokens:
+            raise GraphQLError("The query is empty")
+        operations, fragments = [], {}
+        while self._position < len(self._tokens):
+            kind, value, _ = self._peek()
+            if (kind, value) == ("punct", "{"):
+                operations.append({"operation": "query", "name": None, "variables": {}, "directives": [],
+                                   "selections": self._selection_set(), "location": self._here()})
+            elif kind == "name" and value in ("query", "mutation", "subscription"):
+                operations.append(self._operation())
+            elif kind == "name" and value == "fragment":
+                fragment = self._fragment()
+                if fragment["name"] in fragments:
+                    raise GraphQLError(f"There are two fragments named {fragment['name']}", fragment["location"])
+                fragments[fragment["name"]] = fragment
+            else:
+                self._unexpected("an operation or fragment")
+        return {"operations": operations, "fragments": fragments}
+
+    def _peek(self) -> Tuple[Optional[str], Any, int]:
+        if self._position < len(self._tokens):
+            return self._tokens[self._position]
+        return None, None, len(self.text)
+
+    def _here(self) -> Dict[str, int]:
+        return _location(self.text, self._peek()[2])
+
+    def _unexpected(self, expected: str):
+        kind, value, position = self._peek()
+        found = "the end of the query" if kind is None else repr(value)
+        raise GraphQLError(f"Syntax error: expected {expected}, found {found}", _location(self.text, position))
+
+    def _take(self, kind: str, value: Any = None) -> Any:
+        token = self._peek()
+        if token[0] != kind or (value is not None and token[1] != value):
+            self._unexpected(repr(value) if value is not None else kind)
+        self._position += 1
+        return token[1]
+
+    def _accept(self, kind: str, value: Any = None) -> bool:
+        token = self._peek()
+        if token[0] == kind and (value is None or token[1] == value):
+            self._position += 1
+            return True
+        return False
+
+    def _operation(self) -> Dict[str, Any]:
+        location = self._here()
+        operation = self._take("name")
+        name = self._take("name") if self._peek()[0] == "name" else None
+        variables = {}
+        if self._accept("punct", "("):
+            while not self._accept("punct", ")"):
+                self._take("punct", "$")
+                variable = self._take("name")
+                self._take("punct", ":")
+                definition = {"type": self._type()}
+                if self._accept("punct", "="):
+                    definition["default"] = self._value(const=True)
+                self._directives()
+                variables[variable] = definition
+        return {"operation": operation, "name": name, "variables": variables, "directives": self._directives(),
+                "selections": self._selection_set(), "location": location}
+
+    def _fragment(self) -> Dict[str, Any]:
+        location = self._here()
+        self._take("name", "fragment")
+        name = self._take("name")
+        if name == "on":
+            self._unexpected("a fragment name")
+        self._take("name", "on")
+        type_condition = self._take("name")
+        return {"name": name, "type_condition": type_condition, "directives": self._directives(),
+                "selections": self._selection_set(), "location": location}
+
+    def _type(self) -> str:
+        if self._accept("punct", "["):
+            text = f"[{self._type()}]"
+            self._take("punct", "]")
+        else:
+            text = self._take("name")
+        if self._accept("punct", "!"):
+            text += "!"
+        return text
+
+    def _selection_set(self) -> List[Dict[str, Any]]:
+        self._take("punct", "{")
+        selections = [self._selection()]
+        while not self._accept("punct", "}"):
+            selections.append(self._selection())
+        return selections
+
+    def _selection(self) -> Dict[str, Any]:
+        location = self._here()
+        if self._accept("spread"):
+            kind, value, _ = self._peek()
+            if kind == "name" and value != "on":
+                return {"kind": "spread", "name": self._take("name"), "directives": self._directives(),
+                        "location": location}
+            type_condition = self._take("name") if self._accept("name", "on") else None
+            return {"kind": "inline", "type_condition": type_condition, "directives": self._directives(),
+                    "selections": self._selection_set(), "location": location}
+        name = self._take("name")
+        alias = None
+        if self._accept("punct", ":"):
+            alias, name = name, self._take("name")
+        arguments = self._arguments()
+        directives = self._directives()
+        selections = self._selection_set() if self._peek()[:2] == ("punct", "{") else None
+        return {"kind": "field", "alias": alias, "name": name, "arguments": arguments, "directives": directives,
+                "selections": selections, "location": location}
+
+    def _arguments(self, const: bool = False) -> Dict[str, Tuple]:
+        arguments = {}
+        if self._accept("punct", "("):
+            while not self._accept("punct", ")"):
+                name = self._take("name")
+                self._take("punct", ":")
+                arguments[name] = self._value(const)
+        return arguments
+
+    def _directives(self) -> List[Tuple[str, Dict[str, Tuple]]]:
+        directives = []
+        while self._accept("punct", "@"):
+            directives.append((self._take("name"), self._arguments()))
+        return directives
+
+    def _value(self, const: bool = False) -> Tuple:
+        kind, value, _ = self._peek()
+        if (kind, value) == ("punct", "$") and not const:
+            self._position += 1
+            return ("variable", self._take("name"))
+        if kind in ("int", "float", "string"):
+            self._position += 1
+            return ("literal", value)
+        if kind == "name":
+            self._position += 1
+            if value in ("true", "false"):
+                return ("literal", value == "true")
+            return ("literal", None) if value == "null" else ("enum", value)
+        if (kind, value) == ("punct", "["):
+            self._position += 1
+            items = []
+            while not self._accept("punct", "]"):
+                items.append(self._value(const))
+            return ("list", items)
+        if (kind, value) == ("punct", "{"):
+            self._position += 1
+            fields = {}
+            while not self._accept("punct", "}"):
+                name = self._take("name")
+                self._take("punct", ":")
+                fields[name] = self._value(const)
+            return ("object", fields)
+        self._unexpected("a value")
+
+
+# Schema ---------------------------------------------------------------------
+
+class GraphQLSchema:
+    """The GraphQL types of a sync pair's published tables, as one role may read them."""
+
+    def __init__(self, pair, target, role: Optional[str]):
+        """
+        Build the schema from the target tables.
+
+        Tables that have not been created in the target yet are left out.
+
+        Args:
+            pair: Sync pair published over GraphQL
+            target: Open connector of the sync pair's target
+            role: RBAC role of the caller
+        """
+        settings = pair.graphql
+        self.role = role
+        self.max_depth = int(settings.get("max_depth", GRAPHQL_MAX_DEPTH))
+        self.max_page_size = int(settings.get("max_page_size", GRAPHQL_MAX_PAGE_SIZE))
+        published = settings.get("tables") or [t.name for t in pair.tables]
+        hidden = set(settings.get("hidden_columns", []))
+        access = settings.get("access", {})
+
+        self.entities: Dict[str, Dict[str, Any]] = {}
+        names = {}
+        for table in pair.tables:
+            if table.name not in published:
+                continue
+            table_def = build_pipeline(pair.hooks, table.name).target_table(table.to_dict())
+            name = entity_set_name(table_def.get("target_table") or table.name)
+            names[table.name] = name
+            if name in self.entities:
+                # Merged tables share a target table; the first one names it
+                continue
+            try:
+                description = target.describe_table(table_def)
+            except NotImplementedError as e:
+                raise GraphQLError(str(e))
+            except ConnectorError as e:
+                logger.info(f"Leaving {name} out of the GraphQL schema of {pair.sync_pair_id}: {str(e)}")
+                continue
+            rules = access.get(table.name, {})
+            columns = [c for c in description["columns"]
+                       if c["name"] not in hidden and NAME_PATTERN.match(c["name"]) and not c["name"].startswith("__")]
+            self.entities[name] = {
+                "name": name,
+                "table_def": table_def,
+                "columns": {c["name"]: edm_type(c["type"]) for c in columns},
+                "nullable": {c["name"]: c["nullable"] and c["name"] not in table_def["primary_key"] for c in columns},
+                "roles": rules.get("roles") or None,
+                "field_roles": rules.get("fields") or {},
+                "relations": {},
+            }
+
+        for relation in settings.get("relations", []):
+            source, other = self.entities.get(names.get(relation["from"])), self.entities.get(names.get(relation["to"]))
+            if source is None or other is None:
+                continue
+            on = list(relation["on"].items())
+            missing = ([c for c, _ in on if c not in source["columns"]] + [c for _, c in on if c not in other["columns"]])
+            if missing or relation["name"] in source["columns"]:
+                logger.warning(f"Leaving relation {relation['name']} of {source['name']} out of the GraphQL schema of "
+                               f"{pair.sync_pair_id}: " + (f"unpublished column {missing[0]}" if missing
+                                                          else "a column has the same name"))
+                continue
+            source["relations"][relation["name"]] = {"name": relation["name"], "to": other["name"], "on": on,
+                                                     "many": relation["many"]}
+
+        self.types = self._types()
+
+    def allowed(self, *role_lists: Optional[List[str]]) -> bool:
+        """Whether the caller's role may read something restricted to these roles."""
+        return all(not roles or self.role in roles or self.role in ALWAYS_ALLOWED_ROLES for roles in role_lists)
+
+    def readable_columns(self, entity: Dict[str, Any]) -> Dict[str, str]:
+        """EDM type of each column of a type the caller may read, filter and order by."""
+        return {name: edm for name, edm in entity["columns"].items() if self.allowed(entity["field_roles"].get(name))}
+
+    def field(self, type_name: str, name: str) -> Optional[Dict[str, Any]]:
+        return self.types.get(type_name, {}).get("fields", {}).get(name)
+
+    def sdl(self) -> str:
+        """The schema in GraphQL schema definition language, without what the caller may not read."""
+        blocks = ["schema {\n  query: Query\n}"]
+        for type_name, definition in self.types.items():
+            if not self.allowed(definition.get("roles")):
+                continue
+            lines = [f"type {type_name} {{"]
+            for name, field in definition["fields"].items():
+                if not self.allowed(field.get("roles"), self._target_roles(field)):
+                    continue
+                arguments = ", ".join(f"{argument}: {kind}" for argument, kind in field.get("args", {}).items())
+                lines.append(f"  {name}{f'({arguments})' if arguments else ''}: {self._render(field)}")
+            blocks.append("\n".join(lines) + "\n}")
+        return "\n\n".join(blocks) + "\n"
+
+    def _target_roles(self, field: Dict[str, Any]) -> Optional[List[str]]:
+        target = self.types.get(field["type"])
+        return target.get("roles") if target else None
+
+    @staticmethod
+    def _render(field: Dict[str, Any]) -> str:
+        text = f"[{field['type']}!]" if field.get("list") else field["type"]
+        return text + "!" if field.get("non_null") else text
+
+    def _types(self) -> Dict[str, Dict[str, Any]]:
+        query: Dict[str, Dict[str, Any]] = {}
+        types = {"Query": {"fields": query}}
+        for name, entity in self.entities.items():
+            query[name] = {"type": f"{name}_connection", "non_null": True, "args": dict(PAGE_ARGUMENTS),
+                           "kind": "connection", "entity": name}
+            key_columns = entity["table_def"]["primary_key"]
+            if all(column in entity["columns"] for column in key_columns):
+                query[f"{name}_by_key"] = {
+                    "type": name, "kind": "by_key", "entity": name, "required": list(key_columns),
+                    "args": {c: f"{GRAPHQL_SCALARS.get(entity['columns'][c], 'String')}!" for c in key_columns},
+                }
+            types[f"{name}_connection"] = {"roles": entity["roles"], "fields": {
+                "totalCount": {"type": "Int", "non_null": True},
+                "nodes": {"type": name, "list": True, "non_null": True},
+                "pageInfo": {"type": "PageInfo", "non_null": True},
+            }}
+            fields = {column: {"type": GRAPHQL_SCALARS.get(edm, "String"), "non_null": not entity["nullable"][column],
+                               "roles": entity["field_roles"].get(column)}
+                      for column, edm in entity["columns"].items()}
+            for relation in entity["relations"].values():
+                arguments = dict(RELATION_ARGUMENTS) if relation["many"] else {}
+                fields[relation["name"]] = {"type": relation["to"], "list": relation["many"], "non_null": relation["many"],
+                                            "args": arguments, "roles": entity["field_roles"].get(relation["name"]),
+                                            "relation": relation}
+            types[name] = {"roles": entity["roles"], "fields": fields}
+        types["PageInfo"] = {"fields": {"hasNextPage": {"type": "Boolean", "non_null": True},
+                                        "endCursor": {"type": "String"}}}
+        return types
+
+
+# Execution ------------------------------------------------------------------
+
+class GraphQLExecution:
+    """Checks and runs one query operation against a sync pair's target."""
+
+    def __init__(self, schema: GraphQLSchema, target, document: Dict[str, Any], variables: Optional[Dict[str, Any]],
+                 max_rows: int = GRAPHQL_MAX_ROWS):
+        self.schema = schema
+        self.target = target
+        self.fragments = document["fragments"]
+        self.variables = dict(variables or {})
+        self.max_rows = max_rows
+        self.rows = 0
+
+    def validate(self, operation: Dict[str, Any]) -> None:
+        """
+        Check an operation against the schema before anything is read.
+
+        Raises:
+            GraphQLError: With every problem found
+        """
+        errors: List[Dict[str, Any]] = []
+        for name, definition in operation["variables"].items():
+            if name in self.variables:
+                continue
+            if "default" in definition:
+                self.variables[name] = self._value(definition["default"])
+            elif definition["type"].endswith("!"):
+                errors.append({"message": f"Variable ${name} of type {definition['type']} is required",
+                               "locations": [operation["location"]]})
+        self._check(operation["selections"], "Query", 1, operation["variables"], set(), errors)
+        if errors:
+            unique = list({json.dumps(error, sort_keys=True): error for error in errors}.values())
+            raise GraphQLError(unique[0]["message"], errors=unique)
+
+    def run(self, operation: Dict[str, Any]) -> Dict[str, Any]:
+        """Answer a validated operation."""
+        data = {}
+        for key, fields in self._collect(operation["selections"], "Query").items():
+            field = fields[0]
+            if field["name"] == "__typename":
+                data[key] = "Query"
+                continue
+            definition = self.schema.field("Query", field["name"])
+            entity = self.schema.entities[definition["entity"]]
+            if definition["kind"] == "by_key":
+                data[key] = self._by_key(entity, field, self._subselections(fields))
+            else:
+                data[key] = self._connection(entity, field, self._subselections(fields))
+        return data
+
+    # Checks -----------------------------------------------------------------
+
+    def _check(self, selections: List[Dict[str, Any]], type_name: str, depth: int,
+               variables: Dict[str, Any], spreading: set, errors: List[Dict[str, Any]]) -> None:
+        for selection in selections:
+            location = selection["location"]
+            for directive, arguments in selection["directives"]:
+                if directive not in ("skip", "include") or "if" not in arguments:
+                    errors.append({"message": f"Unsupported directive @{directive}" if directive not in ("skip", "include")
+                                   else f"@{directive} needs an if argument", "locations": [location]})
+                self._check_variables(arguments, variables, location, errors)
+            if selection["kind"] == "spread":
+                fragment = self.fragments.get(selection["name"])
+                if fragment is None:
+                    errors.append({"message": f"Unknown fragment {selection['name']}", "locations": [location]})
+                elif selection["name"] in spreading:
+                    errors.append({"message": f"Fragment {selection['name']} spreads itself", "locations": [location]})
+                elif self._applies(fragment["type_condition"], type_name, location, errors):
+                    self._check(fragment["selections"], type_name, depth, variables, spreading | {selection["name"]}, errors)
+                continue
+            if selection["kind"] == "inline":
+                if self._applies(selection["type_condition"], type_name, location, errors):
+                    self._check(selection["selections"], type_name, depth, variables, spreading, errors)
+                continue
+
+            name = selection["name"]
+            if name == "__typename":
+                if selection["selections"]:
+                    errors.append({"message": "__typename has no subfields", "locations": [location]})
+                continue
+            field = self.schema.field(type_name, name)
+            if field is None:
+                errors.append({"message": f"Cannot query field {name} on type {type_name}", "locations": [location]})
+                continue
+            if not self.schema.allowed(field.get("roles"), self.schema._target_roles(field)):
+                errors.append({"message": f"Role {self.schema.role or 'anonymous'} may not read {type_name}.{name}",
+                               "locations": [location]})
+                continue
+            for argument in selection["arguments"]:
+                if argument not in field.get("args", {}):
+                    errors.append({"message": f"Unknown argument {argument} on field {type_name}.{name}",
+                                   "locations": [location]})
+            for argument in field.get("required", []):
+                if argument not in selection["arguments"]:
+                    errors.append({"message": f"Field {type_name}.{name} needs argument {argument}",
+                                   "locations": [location]})
+            self._check_variables(selection["arguments"], variables, location, errors)
+            if depth > self.schema.max_depth:
+                errors.append({"message": f"The query is nested deeper than {self.schema.max_depth} levels",
+                               "locations": [location]})
+                continue
+            if field["type"] in self.schema.types:
+                if not selection["selections"]:
+                    errors.append({"message": f"Field {type_name}.{name} of type {field['type']} needs a selection of "
+                                              f"subfields", "locations": [location]})
+                else:
+                    self._check(selection["selections"], field["type"], depth + 1, variables, spreading, errors)
+            elif selection["selections"]:
+                errors.append({"message": f"Field {type_name}.{name} of type {field['type']} has no subfields",
+                               "locations": [location]})
+
+    def _applies(self, type_condition: Optional[str], type_name: str, location: Dict[str, int],
+                 errors: List[Dict[str, Any]]) -> bool:
+        if type_condition is None or type_condition == type_name:
+            return True
+        errors.append({"message": f"Fragment on {type_condition} cannot be spread on type {type_name}"
+                      if type_condition in self.schema.types else f"Unknown type {type_condition}",
+                       "locations": [location]})
+        return False
+
+    @staticmethod
+    def _check_variables(arguments: Dict[str, Tuple], variables: Dict[str, Any], location: Dict[str, int],
+                         errors: List[Dict[str, Any]]) -> None:
+        def visit(node: Tuple):
+            if node[0] == "variable" and node[1] not in variables:
+                errors.append({"message": f"Variable ${node[1]} is not defined", "locations": [location]})
+            elif node[0] == "list":
+                for item in node[1]:
+                    visit(item)
+            elif node[0] == "object":
+                for item in node[1].values():
+                    visit(item)
+        for node in arguments.values():
+            visit(node)
+
+    # Selections -------------------------------------------------------------
+
+    def _collect(self, selections: List[Dict[str, Any]], type_name: str,
+                 fields: Optional[Dict[str, List[Dict[str, Any]]]] = None) -> Dict[str, List[Dict[str, Any]]]:
+        """The fields selected on a type by response key, with fragments expanded and @skip/@include applied."""
+        fields = {} if fields is None else fields
+        for selection in selections:
+            if not self._included(selection):
+                continue
+            if selection["kind"] == "spread":
+                self._collect(self.fragments[selection["name"]]["selections"], type_name, fields)
+            elif selection["kind"] == "inline":
+                self._collect(selection["selections"], type_name, fields)
+            else:
+                fields.setdefault(selection["alias"] or selection["name"], []).append(selection)
+        return fields
+
+    @staticmethod
+    def _subselections(fields: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        return [selection for field in fields for selection in (field["selections"] or [])]
+
+    def _included(self, selection: Dict[str, Any]) -> bool:
+        for directive, arguments in selection["directives"]:
+            condition = self._value(arguments["if"])
+            if (directive == "skip" and condition) or (directive == "include" and not condition):
+                return False
+        return True
+
+    def _value(self, node: Tuple) -> Any:
+        kind, value = node
+        if kind == "variable":
+            return self.variables.get(value)
+        if kind == "list":
+            return [self._value(item) for item in value]
+        if kind == "object":
+            return {name: self._value(item) for name, item in value.items()}
+        return value
+
+    def _argument(self, field: Dict[str, Any], name: str, kind: str) -> Any:
+        """An argument's value, checked against its GraphQL type; None when it was not given."""
+        if name not in field["arguments"]:
+            return None
+        value = self._value(field["arguments"][name])
+        if value is None:
+            return None
+        if kind == "Int" and (isinstance(value, bool) or not isinstance(value, int)):
+            raise GraphQLError(f"Argument {name} of {field['name']} must be an Int", field["location"])
+        if kind == "String" and not isinstance(value, str):
+            raise GraphQLError(f"Argument {name} of {field['name']} must be a String", field["location"])
+        return value
+
+    # Reads ------------------------------------------------------------------
+
+    def _connection(self, entity: Dict[str, Any], field: Dict[str, Any],
+                    selections: List[Dict[str, Any]]) -> Dict[str, Any]:
+        type_name = f"{entity['name']}_connection"
+        collected = self._collect(selections, type_name)
+        where = self._where(entity, field)
+        first = self._first(field)
+        offset = self._cursor(field)
+        names = {fields[0]["name"] for fields in collected.values()}
+
+        rows, has_next = [], False
+        if names & {"nodes", "pageInfo"}:
+            node_fields = self._collect(self._subselections(
+                [f for fields in collected.values() for f in fields if f["name"] == "nodes"]), entity["name"])
+            rows = self._query(entity, where, self._columns(entity, node_fields), self._order_by(entity, field),
+                               limit=first + 1, offset=offset)
+            has_next = len(rows) > first
+            rows = rows[:first]
+
+        result: Dict[str, Any] = {}
+        for key, fields in collected.items():
+            name = fields[0]["name"]
+            if name == "__typename":
+                result[key] = type_name
+            elif name == "totalCount":
+                result[key] = self.target.count_records(entity["table_def"], where)
+            elif name == "nodes":
+                result[key] = self._objects(entity, rows, self._collect(self._subselections(fields), entity["name"]))
+            elif name == "pageInfo":
+                info = {}
+                for info_key, info_fields in self._collect(self._subselections(fields), "PageInfo").items():
+                    info_name = info_fields[0]["name"]
+                    if info_name == "__typename":
+                        info[info_key] = "PageInfo"
+                    elif info_name == "hasNextPage":
+                        info[info_key] = has_next
+                    else:
+                        info[info_key] = self._encode_cursor(offset + len(rows)) if rows else None
+                result[key] = info
+        return result
+
+    def _by_key(self, entity: Dict[str, Any], field: Dict[str, Any],
+                selections: List[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+        where = None
+        for column in entity["table_def"]["primary_key"]:
+            value = self._value(field["arguments"][column])
+            if isinstance(value, float):
+                value = Decimal(repr(value))
+            try:
+                value = check_literal(column, entity["columns"][column], value)
+            except ODataError as e:
+                raise GraphQLError(str(e), field["location"])
+            node = ("compare", "=", ("field", column), ("literal", value))
+            where = node if where is None else ("and", where, node)
+        collected = self._collect(selections, entity["name"])
+        rows = self._query(entity, where, self._columns(entity, collected), limit=1)
+        return self._objects(entity, rows, collected)[0] if rows else None
+
+    def _objects(self, entity: Dict[str, Any], rows: List[Dict[str, Any]],
+                 collected: Dict[str, List[Dict[str, Any]]]) -> List[Dict[str, Any]]:
+        objects: List[Dict[str, Any]] = [{} for _ in rows]
+        for key, fields in collected.items():
+            name = fields[0]["name"]
+            if name == "__typename":
+                values = [entity["name"]] * len(rows)
+            elif name in entity["columns"]:
+                values = [_json_value(row.get(name), entity["columns"][name]) for row in rows]
+            else:
+                values = self._related(entity["relations"][name], rows, fields)
+            for obj, value in zip(objects, values):
+                obj[key] = value
+        return objects
+
+    def _related(self, relation: Dict[str, Any], rows: List[Dict[str, Any]],
+                 fields: List[Dict[str, Any]]) -> List[Any]:
+        """The related rows of each parent row, read for all of them at once."""
+        other = self.schema.entities[relation["to"]]
+        field = fields[0]
+        collected = self._collect(self._subselections(fields), other["name"])
+        to_columns = [column for _, column in relation["on"]]
+        columns = list(dict.fromkeys(self._columns(other, collected) + to_columns))
+        condition = self._where(other, field)
+        order_by = self._order_by(other, field)
+        first = self._first(field) if relation["many"] else 1
+
+        parent_keys = [self._match_key(row.get(column) for column, _ in relation["on"]) for row in rows]
+        distinct = list(dict.fromkeys(key for key in parent_keys if None not in key))
+        children: Dict[Tuple, List[Dict[str, Any]]] = {}
+        for start in range(0, len(distinct), RELATION_BATCH_SIZE):
+            where = self._keys_where(to_columns, distinct[start:start + RELATION_BATCH_SIZE])
+            if condition is not None:
+                where = ("and", where, condition)
+            for row in self._query(other, where, columns, order_by, limit=self.max_rows - self.rows + 1):
+                children.setdefault(self._match_key(row.get(column) for column in to_columns), []).append(row)
+
+        groups = [children.get(key, [])[:first] for key in parent_keys]
+        objects = iter(self._objects(other, [row for group in groups for row in group], collected))
+        values = []
+        for group in groups:
+            items = [next(objects) for _ in group]
+            values.append(items if relation["many"] else (items[0] if items else None))
+        return values
+
+    @staticmethod
+    def _keys_where(columns: List[str], keys: List[Tuple]) -> Tuple:
+        if len(columns) == 1:
+            return ("in", ("field", columns[0]), [key[0] for key in keys])
+        where = None
+        for key in keys:
+            node = None
+            for column, value in zip(columns, key):
+                compare = ("compare", "=", ("field", column), ("literal", value))
+                node = compare if node is None else ("and", node, compare)
+            where = node if where is None else ("or", where, node)
+        return where
+
+    @staticmethod
+    def _match_key(values) -> Tuple:
+        """A join key that matches whether the database returned a column as int or Decimal."""
+        return tuple(int(v) if isinstance(v, Decimal) and v == v.to_integral_value() else v for v in values)
+
+    def _query(self, entity: Dict[str, Any], where: Optional[Tuple], columns: List[str],
+               order_by: Optional[List[Tuple[str, bool]]] = None, limit: Optional[int] = None,
+               offset: int = 0) -> List[Dict[str, Any]]:
+        rows = self.target.query_records(entity["table_def"], where, columns, order_by, limit=limit, offset=offset)
+        self.rows += len(rows)
+        if self.rows > self.max_rows:
+            raise GraphQLError(f"The query reads more than {self.max_rows} rows; ask for fewer rows or related rows")
+        return rows
+
+    @staticmethod
+    def _columns(entity: Dict[str, Any], collected: Dict[str, List[Dict[str, Any]]]) -> List[str]:
+        """Columns to read for the selected fields: the key, the selected columns and the join columns of relations."""
+        columns = list(entity["table_def"]["primary_key"])
+        for fields in collected.values():
+            name = fields[0]["name"]
+            if name in entity["columns"]:
+                columns.append(name)
+            elif name in entity["relations"]:
+                columns.extend(column for column, _ in entity["relations"][name]["on"])
+        return list(dict.fromkeys(columns))
+
+    def _where(self, entity: Dict[str, Any], field: Dict[str, Any]) -> Optional[Tuple]:
+        text = self._argument(field, "filter", "String")
+        if not text:
+            return None
+        try:
+            return FilterParser(text, self.schema.readable_columns(entity)).parse()
+        except ODataError as e:
+            raise GraphQLError(f"Invalid filter of {field['name']}: {str(e)}", field["location"])
+
+    def _order_by(self, entity: Dict[str, Any], field: Dict[str, Any]) -> List[Tuple[str, bool]]:
+        try:
+            return ODataService._order_by(self._argument(field, "orderBy", "String"),
+                                          self.schema.readable_columns(entity), entity["table_def"])
+        except ODataError as e:
+            raise GraphQLError(f"Invalid orderBy of {field['name']}: {str(e)}", field["location"])
+
+    def _first(self, field: Dict[str, Any]) -> int:
+        first = self._argument(field, "first", "Int")
+        if first is None:
+            return min(DEFAULT_PAGE_SIZE, self.schema.max_page_size)
+        if first < 0 or first > self.schema.max_page_size:
+            raise GraphQLError(f"first of {field['name']} must be between 0 and {self.schema.max_page_size}",
+                               field["location"])
+        return first
+
+    def _cursor(self, field: Dict[str, Any]) -> int:
+        cursor = self._argument(field, "after", "String")
+        if not cursor:
+            return 0
+        try:
+            offset = json.loads(base64.urlsafe_b64decode(cursor.encode("ascii")))["offset"]
+            if isinstance(offset, int) and offset >= 0:
+                return offset
+        except (ValueError, TypeError, KeyError):
+            pass
+        raise GraphQLError(f"Invalid cursor {cursor} for {field['name']}", field["location"])
+
+    @staticmethod
+    def _encode_cursor(offset: int) -> str:
+        return base64.urlsafe_b64encode(json.dumps({"offset": offset}).encode("ascii")).decode("ascii")
+
+
+class GraphQLService:
+    """Answers GraphQL queries from the target tables of published sync pairs."""
+
+    def __init__(self, registry, max_rows: int = GRAPHQL_MAX_ROWS):
+        """
+        Initialize the service.
+
+        Args:
+            registry: Sync pair registry the tables come from
+            max_rows: Rows one query may read
+        """
+        self.registry = registry
+        self.max_rows = max_rows
+
+    def schema(self, sync_pair_id: str, user: Dict[str, Any]) -> str:
+        """
+        The SDL of a sync pair's schema, as the user's role may read it.
+
+        Raises:
+            KeyError: If the sync pair is not configured or not published
+            PermissionError: If the user belongs to another county
+        """
+        pair = self._pair(sync_pair_id, user)
+        with create_connector(pair.target) as target:
+            return GraphQLSchema(pair, target, user.get("role")).sdl()
+
+    def execute(self, sync_pair_id: str, query: str, user: Dict[str, Any],
+                variables: Optional[Dict[str, Any]] = None, operation_name: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Answer a GraphQL query.
+
+        Args:
+            sync_pair_id: Published sync pair
+            query: GraphQL document
+            user: The authenticated user, with "role" and "county_id"
+            variables: Values of the operation's variables
+            operation_name: Operation to run when the document has several
+
+        Returns:
+            The response, {"data": {...}}
+
+        Raises:
+            KeyError: If the sync pair is not configured or not published
+            PermissionError: If the user belongs to another county
+            GraphQLError: If the query is invalid or cannot be answered
+        """
+        pair = self._pair(sync_pair_id, user)
+        if variables is not None and not isinstance(variables, dict):
+            raise GraphQLError("variables must be an object")
+        document = QueryParser(query).parse()
+        operation = self._operation(document, operation_name)
+        if operation["operation"] != "query":
+            raise GraphQLError(f"{operation['operation'].capitalize()} operations are not supported; "
+                               f"the GraphQL API is read-only", operation["location"])
+        with create_connector(pair.target) as target:
+            schema = GraphQLSchema(pair, target, user.get("role"))
+            execution = GraphQLExecution(schema, target, document, variables, self.max_rows)
+            execution.validate(operation)
+            data = execution.run(operation)
+        logger.info(f"Answered GraphQL query of {user.get('username')} on {sync_pair_id} ({execution.rows} rows)")
+        return {"data": data}
+
+    def _pair(self, sync_pair_id: str, user: Dict[str, Any]):
+        pair = self.registry.get(sync_pair_id)
+        if not pair.graphql:
+            raise KeyError(f"Sync pair {sync_pair_id} is not published over GraphQL")
+        if user.get("county_id") and user["county_id"] != pair.county_id and user.get("role") not in ALWAYS_ALLOWED_ROLES:
+            raise PermissionError(f"Sync pair {sync_pair_id} belongs to another county")
+        return pair
+
+    @staticmethod
+    def _operation(document: Dict[str, Any], operation_name: Optional[str]) -> Dict[str, Any]:
+        operations = document["operations"]
+        if not operations:
+            raise GraphQLError("The document has no operation")
+        if operation_name:
+            for operation in operations:
+                if operation["name"] == operation_name:
+                    return operation
+            raise GraphQLError(f"Unknown operation {operation_name}")
+        if len(operations) > 1:
+            raise GraphQLError("The document has several operations; give operationName")
+        return operations[0]
@@ -0,0 +1,809 @@
+"""
+TerraFusion SyncService - gRPC API
+
+This module serves the gRPC API defined in
+protos/terrafusion/sync/v1/sync.proto next to the REST gateway, for
+services that want typed calls instead of JSON: sync jobs (including a
+server stream of a job's progress), sync pairs, GIS exports, and the rows
+of the tables sync pairs publish over OData. It is started with the rest
+of the web application when GRPC_ENABLED=true and listens on GRPC_PORT:
+
+    grpcurl -plaintext -import-path protos -proto terrafusion/sync/v1/sync.proto \\
+        -d '{"job_id": "..."}' localhost:50051 terrafusion.sync.v1.SyncJobs/WatchJob
+
+The calls do what their REST counterparts do, with the same validation:
+CreateJob queues the job when a job queue runs (or hands it to another
+node's queue) and otherwise runs it before it returns, StreamEntities
+serves the record streams of sync_streams. Errors map onto gRPC status
+codes: NOT_FOUND for a missing job, sync pair or entity set,
+INVALID_ARGUMENT for a bad request, RESOURCE_EXHAUSTED when too many record
+streams are open or a job is refused under load (see load_shedding; the
+seconds to wait are in the "retry-after" trailing metadata) and UNAVAILABLE
+when a job cannot be handed to the event bus. Reply fields the proto has no typed field for are carried in each
+message's "details" Struct.
+
+Messages are encoded with the small proto3 codec below, driven by MESSAGES,
+so the server needs grpcio but no generated code; clients generate theirs
+from the .proto (see its header for the Go command). Setting
+GRPC_TLS_CERT_FILE and GRPC_TLS_KEY_FILE serves TLS instead of plaintext,
+and GRPC_TLS_CLIENT_CA_FILE requires client certificates signed by that CA.
+Without them the server uses the service certificate (SERVICE_TLS_*, see
+service_tls) when one is configured, and calls from clients whose
+certificate has none of SERVICE_TLS_PEER_SANS are refused with
+PERMISSION_DENIED. Rotated certificate files are served without a restart.
+Replies, record streams above all, are gzipped for clients that accept it
+(GRPC_COMPRESSION), and compressed requests are read whatever the setting.
+"""
+
+import os
+import json
+import struct
+import logging
+import threading
+from concurrent import futures
+from contextlib import nullcontext
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Iterator, Tuple
+
+from sync_control import TERMINAL_STATUSES
+from sync_streams import StreamLimitError
+from load_shedding import LoadShedder, OverloadedError, load_shedder
+from event_bus import EventBus, EventBusError, event_bus, SUBJECT_SYNC_JOB
+from service_tls import PeerVerificationError, ServiceTls, service_tls
+
+try:
+    import grpc
+    GRPC_AVAILABLE = True
+except ImportError:
+    GRPC_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Port and address the gRPC server listens on
+GRPC_PORT = int(os.environ.get("GRPC_PORT", "50051"))
+GRPC_BIND_ADDRESS = os.environ.get("GRPC_BIND_ADDRESS", "[::]")
+
+# Calls served at once; every open WatchJob or StreamEntities stream holds one
+GRPC_MAX_WORKERS = int(os.environ.get("GRPC_MAX_WORKERS", "16"))
+
+# Seconds running calls get to finish when the server stops
+GRPC_STOP_GRACE_SECONDS = 5
+
+# Compression of replies to clients that accept it: gzip, deflate or none; requests are decompressed either way
+GRPC_COMPRESSION = os.environ.get("GRPC_COMPRESSION", "gzip").lower()
+GRPC_COMPRESSION_TYPES = ["gzip", "deflate", "none"]
+
+# Proto package the services are declared in
+PROTO_PACKAGE = "terrafusion.sync.v1"
+
+# Seconds between reads of a watched job, by default and at the least and most
+WATCH_POLL_SECONDS = 1.0
+WATCH_MIN_POLL_SECONDS = 0.2
+WATCH_MAX_POLL_SECONDS = 60.0
+
+# Statuses that end a WatchJob stream; a paused job is watched again once resumed
+WATCH_FINAL_STATUSES = TERMINAL_STATUSES + ["PAUSED"]
+
+# Jobs returned by ListJobs and ListExports when no limit is given
+DEFAULT_LIST_LIMIT = 100
+
+# Message schemas, as in sync.proto: (field number, name, type, label) with
+# label None, "repeated" or "map" (map<string, type>)
+MESSAGES: Dict[str, List[Tuple[int, str, str, Optional[str]]]] = {
+    "Job": [
+        (1, "job_id", "string", None), (2, "sync_pair_id", "string", None), (3, "county_id", "string", None),
+        (4, "username", "string", None), (5, "mode", "string", None), (6, "dry_run", "bool", None),
+        (7, "priority", "string", None), (8, "tables", "string", "repeated"), (9, "status", "string", None),
+        (10, "message", "string", None), (11, "created_at", "string", None), (12, "started_at", "string", None),
+        (13, "completed_at", "string", None), (14, "stats", "int64", "map"),
+        (15, "parameters", "Struct", None), (16, "table_results", "Struct", None), (17, "details", "Struct", None),
+    ],
+    "CreateJobRequest": [
+        (1, "sync_pair_id", "string", None), (2, "username", "string", None), (3, "mode", "string", None),
+        (4, "tables", "string", "repeated"), (5, "parameters", "Struct", None), (6, "dry_run", "bool", None),
+        (7, "priority", "string", None), (8, "express", "bool", None),
+    ],
+    "GetJobRequest": [(1, "job_id", "string", None)],
+    "ListJobsRequest": [
+        (1, "county_id", "string", None), (2, "sync_pair_id", "string", None), (3, "status", "string", None),
+        (4, "limit", "int32", None),
+    ],
+    "ListJobsResponse": [(1, "jobs", "Job", "repeated")],
+    "CancelJobRequest": [(1, "job_id", "string", None), (2, "requested_by", "string", None)],
+    "WatchJobRequest": [(1, "job_id", "string", None), (2, "poll_interval_seconds", "double", None)],
+    "JobProgress": [
+        (1, "job_id", "string", None), (2, "status", "string", None), (3, "message", "string", None),
+        (4, "stats", "int64", "map"), (5, "tables", "TableProgress", "repeated"), (6, "updated_at", "string", None),
+        (7, "done", "bool", None),
+    ],
+    "TableProgress": [
+        (1, "table", "string", None), (2, "state", "string", None), (3, "records_read", "int64", None),
+        (4, "records_written", "int64", None),
+    ],
+    "SyncTable": [(1, "name", "string", None), (2, "target_table", "string", None), (3, "primary_key", "string", "repeated")],
+    "SyncPair": [
+        (1, "sync_pair_id", "string", None), (2, "county_id", "string", None), (3, "name", "string", None),
+        (4, "source_system", "string", None), (5, "target_system", "string", None), (6, "direction", "string", None),
+        (7, "default_mode", "string", None), (8, "batch_size", "int32", None), (9, "tables", "SyncTable", "repeated"),
+        (10, "details", "Struct", None),
+    ],
+    "ListSyncPairsRequest": [(1, "county_id", "string", None)],
+    "ListSyncPairsResponse": [(1, "sync_pairs", "SyncPair", "repeated")],
+    "GetSyncPairRequest": [(1, "sync_pair_id", "string", None)],
+    "ExportJob": [
+        (1, "job_id", "string", None), (2, "county_id", "string", None), (3, "username", "string", None),
+        (4, "export_format", "string", None), (5, "layers", "string", "repeated"), (6, "status", "string", None),
+        (7, "message", "string", None), (8, "created_at", "string", None), (9, "started_at", "string", None),
+        (10, "completed_at", "string", None), (11, "download_url", "string", None),
+        (12, "area_of_interest", "Struct", None), (13, "parameters", "Struct", None), (14, "details", "Struct", None),
+    ],
+    "CreateExportRequest": [
+        (1, "county_id", "string", None), (2, "username", "string", None), (3, "export_format", "string", None),
+        (4, "area_of_interest", "Struct", None), (5, "layers", "string", "repeated"), (6, "parameters", "Struct", None),
+    ],
+    "GetExportRequest": [(1, "job_id", "string", None)],
+    "ListExportsRequest": [
+        (1, "county_id", "string", None), (2, "status", "string", None), (3, "username", "string", None),
+        (4, "limit", "int32", None),
+    ],
+    "ListExportsResponse": [(1, "jobs", "ExportJob", "repeated")],
+    "CancelExportRequest": [(1, "job_id", "string", None)],
+    "ListEntitySetsRequest": [(1, "sync_pair_id", "string", None)],
+    "EntitySet": [(1, "name", "string", None), (2, "target_table", "string", None), (3, "primary_key", "string", "repeated")],
+    "ListEntitySetsResponse": [(1, "entity_sets", "EntitySet", "repeated")],
+    "StreamEntitiesRequest": [
+        (1, "sync_pair_id", "string", None), (2, "entity_set", "string", None), (3, "filter", "string", None),
+        (4, "select", "string", None), (5, "after", "string", None),
+    ],
+    "Entity": [(1, "record", "Struct", None)],
+}
+
+# Methods of each service: name -> (request message, response message, server streaming)
+SERVICES: Dict[str, Dict[str, Tuple[str, str, bool]]] = {
+    "SyncJobs": {
+        "CreateJob": ("CreateJobRequest", "Job", False),
+        "GetJob": ("GetJobRequest", "Job", False),
+        "ListJobs": ("ListJobsRequest", "ListJobsResponse", False),
+        "CancelJob": ("CancelJobRequest", "Job", False),
+        "WatchJob": ("WatchJobRequest", "JobProgress", True),
+    },
+    "SyncPairs": {
+        "ListSyncPairs": ("ListSyncPairsRequest", "ListSyncPairsResponse", False),
+        "GetSyncPair": ("GetSyncPairRequest", "SyncPair", False),
+    },
+    "Exports": {
+        "CreateExport": ("CreateExportRequest", "ExportJob", False),
+        "GetExport": ("GetExportRequest", "ExportJob", False),
+        "ListExports": ("ListExportsRequest", "ListExportsResponse", False),
+        "CancelExport": ("CancelExportRequest", "ExportJob", False),
+    },
+    "Entities": {
+        "ListEntitySets": ("ListEntitySetsRequest", "ListEntitySetsResponse", False),
+        "StreamEntities": ("StreamEntitiesRequest", "Entity", True),
+    },
+}
+
+_VARINT_TYPES = {"bool", "int32", "int64"}
+
+_DEFAULTS = {"string": "", "bool": False, "int32": 0, "int64": 0, "double": 0.0}
+
+# google.protobuf.Value fields
+_VALUE_NULL, _VALUE_NUMBER, _VALUE_STRING, _VALUE_BOOL, _VALUE_STRUCT, _VALUE_LIST = 1, 2, 3, 4, 5, 6
+
+
+class RpcError(Exception):
+    """Raised by a handler to end the call with a given gRPC status code name."""
+
+    def __init__(self, code: str, message: str):
+        super().__init__(message)
+        self.code = code
+
+
+# Codec ----------------------------------------------------------------------
+
+def _varint(value: int) -> bytes:
+    value &= 0xFFFFFFFFFFFFFFFF
+    out = bytearray()
+    while True:
+        byte = value & 0x7F
+        value >>= 7
+        if value:
+            out.append(byte | 0x80)
+        else:
+            out.append(byte)
+            return bytes(out)
+
+
+def _read_varint(data: bytes, pos: int) -> Tuple[int, int]:
+    value = shift = 0
+    while True:
+        if pos >= len(data):
+            raise ValueError("Truncated varint")
+        byte = data[pos]
+        pos += 1
+        value |= (byte & 0x7F) << shift
+        if not byte & 0x80:
+            return value, pos
+        shift += 7
+
+
+def _key(number: int, wire_type: int) -> bytes:
+    return _varint(number << 3 | wire_type)
+
+
+def _length_delimited(number: int, payload: bytes) -> bytes:
+    return _key(number, 2) + _varint(len(payload)) + payload
+
+
+def _fields(data: bytes) -> Iterator[Tuple[int, int, Any]]:
+    """(field number, wire type, value) of each field of an encoded message."""
+    pos = 0
+    while pos < len(data):
+        key, pos = _read_varint(data, pos)
+        number, wire_type = key >> 3, key & 7
+        if wire_type == 0:
+            value, pos = _read_varint(data, pos)
+        elif wire_type == 1:
+            value, pos = data[pos:pos + 8], pos + 8
+        elif wire_type == 2:
+            length, pos = _read_varint(data, pos)
+            value, pos = data[pos:pos + length], pos + length
+        elif wire_type == 5:
+            value, pos = data[pos:pos + 4], pos + 4
+        else:
+            raise ValueError(f"Unsupported wire type {wire_type}")
+        if pos > len(data):
+            raise ValueError("Truncated message")
+        yield number, wire_type, value
+
+
+def _encode_scalar(number: int, kind: str, value: Any) -> bytes:
+    if kind == "string":
+        return _length_delimited(number, str(value).encode("utf-8"))
+    if kind == "bool":
+        return _key(number, 0) + _varint(1 if value else 0)
+    if kind in ("int32", "int64"):
+        return _key(number, 0) + _varint(int(value))
+    if kind == "double":
+        return _key(number, 1) + struct.pack("<d", float(value))
+    raise ValueError(f"Unsupported field type {kind}")
+
+
+def _decode_scalar(kind: str, wire_type: int, value: Any) -> Any:
+    if kind == "string" and wire_type == 2:
+        return value.decode("utf-8")
+    if kind == "bool" and wire_type == 0:
+        return bool(value)
+    if kind == "int64" and wire_type == 0:
+        return value - (1 << 64) if value >= 1 << 63 else value
+    if kind == "int32" and wire_type == 0:
+        value &= 0xFFFFFFFF
+        return value - (1 << 32) if value >= 1 << 31 else value
+    if kind == "double" and wire_type == 1:
+        return struct.unpack("<d", value)[0]
+    raise ValueError(f"Field of type {kind} has wire type {wire_type}")
+
+
+def encode_value(value: Any) -> bytes:
+    """Encode a JSON value as a google.protobuf.Value."""
+    if value is None:
+        return _key(_VALUE_NULL, 0) + _varint(0)
+    if isinstance(value, bool):
+        return _key(_VALUE_BOOL, 0) + _varint(1 if value else 0)
+    if isinstance(value, (int, float)):
+        return _key(_VALUE_NUMBER, 1) + struct.pack("<d", float(value))
+    if isinstance(value, dict):
+        return _length_delimited(_VALUE_STRUCT, encode_struct(value))
+    if isinstance(value, (list, tuple)):
+        return _length_delimited(_VALUE_LIST, b"".join(_length_delimited(1, encode_value(v)) for v in value))
+    return _length_delimited(_VALUE_STRING, str(value).encode("utf-8"))
+
+
+def decode_value(data: bytes) -> Any:
+    """Decode a google.protobuf.Value; whole numbers come back as ints."""
+    value = None
+    for number, wire_type, raw in _fields(data):
+        if number == _VALUE_NULL:
+            value = None
+        elif number == _VALUE_NUMBER:
+            value = _decode_scalar("double", wire_type, raw)
+            if value.is_integer() and abs(value) < 2 ** 53:
+                value = int(value)
+        elif number == _VALUE_STRING:
+            value = _decode_scalar("string", wire_type, raw)
+        elif number == _VALUE_BOOL:
+            value = _decode_scalar("bool", wire_type, raw)
+        elif number == _VALUE_STRUCT:
+            value = decode_struct(raw)
+        elif number == _VALUE_LIST:
+            value = [decode_value(item) for n, _, item in _fields(raw) if n == 1]
+    return value
+
+
+def encode_struct(value: Dict[str, Any]) -> bytes:
+    """Encode a JSON object as a google.protobuf.Struct."""
+    return b"".join(
+        _length_delimited(1, _length_delimited(1, str(k).encode("utf-8")) + _length_delimited(2, encode_value(v)))
+        for k, v in value.items()
+    )
+
+
+def decode_struct(data: bytes) -> Dict[str, Any]:
+    """Decode a google.protobuf.Struct."""
+    decoded = {}
+    for number, _, entry in _fields(data):
+        if number != 1:
+            continue
+        key, value = "", None
+        for entry_number, wire_type, raw in _fields(entry):
+            if entry_number == 1:
+                key = _decode_scalar("string", wire_type, raw)
+            elif entry_number == 2:
+                value = decode_value(raw)
+        decoded[key] = value
+    return decoded
+
+
+def encode_message(name: str, message: Dict[str, Any]) -> bytes:
+    """
+    Encode a message of MESSAGES from a dictionary.
+
+    Missing and None fields, and fields at their proto3 default, are left out.
+    """
+    out = bytearray()
+    for number, field_name, kind, label in MESSAGES[name]:
+        value = message.get(field_name)
+        if value is None:
+            continue
+        if label == "map":
+            for k, v in value.items():
+                out += _length_delimited(number, _length_delimited(1, str(k).encode("utf-8")) + _encode_scalar(2, kind, v))
+        elif label == "repeated":
+            for item in value:
+                out += _encode_field(number, kind, item)
+        elif kind in MESSAGES or kind == "Struct" or value != _DEFAULTS[kind]:
+            out += _encode_field(number, kind, value)
+    return bytes(out)
+
+
+def _encode_field(number: int, kind: str, value: Any) -> bytes:
+    if kind == "Struct":
+        return _length_delimited(number, encode_struct(value))
+    if kind in MESSAGES:
+        return _length_delimited(number, encode_message(kind, value))
+    return _encode_scalar(number, kind, value)
+
+
+def decode_message(name: str, data: bytes) -> Dict[str, Any]:
+    """
+    Decode a message of MESSAGES into a dictionary.
+
+    Every field is present: scalars at their default when not sent, repeated
+    fields as lists, maps as dictionaries and absent messages as None.
+    Unknown fields are skipped.
+    """
+    schema = {number: (field_name, kind, label) for number, field_name, kind, label in MESSAGES[name]}
+    decoded: Dict[str, Any] = {}
+    for field_name, kind, label in schema.values():
+        if label == "repeated":
+            decoded[field_name] = []
+        elif label == "map":
+            decoded[field_name] = {}
+        else:
+            decoded[field_name] = _DEFAULTS.get(kind)
+    for number, wire_type, raw in _fields(data):
+        if number not in schema:
+            continue
+        field_name, kind, label = schema[number]
+        if label == "map":
+            key, value = "", _DEFAULTS[kind]
+            for entry_number, entry_wire_type, entry_raw in _fields(raw):
+                if entry_number == 1:
+                    key = _decode_scalar("string", entry_wire_type, entry_raw)
+                elif entry_number == 2:
+                    value = _decode_scalar(kind, entry_wire_type, entry_raw)
+            decoded[field_name][key] = value
+        elif label == "repeated":
+            decoded[field_name].append(_decode_field(kind, wire_type, raw))
+        else:
+            decoded[field_name] = _decode_field(kind, wire_type, raw)
+    return decoded
+
+
+def _decode_field(kind: str, wire_type: int, raw: Any) -> Any:
+    if kind == "Struct":
+        return decode_struct(raw)
+    if kind in MESSAGES:
+        return decode_message(kind, raw)
+    return _decode_scalar(kind, wire_type, raw)
+
+
+# Conversions ----------------------------------------------------------------
+
+def _typed(name: str, record: Dict[str, Any], details: bool = True) -> Dict[str, Any]:
+    """A message of the typed fields of a record, with the rest under "details"."""
+    names = {field_name for _, field_name, _, _ in MESSAGES[name]}
+    message = {key: value for key, value in record.items() if key in names}
+    if details:
+        message["details"] = {key: value for key, value in record.items() if key not in names}
+    return message
+
+
+def _counts(stats: Optional[Dict[str, Any]]) -> Dict[str, int]:
+    """The numeric entries of a stats dictionary, as int64 map values."""
+    return {key: int(value) for key, value in (stats or {}).items()
+            if isinstance(value, (int, float)) and not isinstance(value, bool)}
+
+
+def job_message(job: Dict[str, Any]) -> Dict[str, Any]:
+    """A sync job as a Job message."""
+    message = _typed("Job", job)
+    message["stats"] = _counts(job.get("stats"))
+    return message
+
+
+def job_progress(job: Dict[str, Any]) -> Dict[str, Any]:
+    """A sync job's progress as a JobProgress message (without updated_at and done)."""
+    tables = []
+    for name in job.get("tables") or []:
+        if name in job.get("table_results", {}):
+            state, result = "completed", job["table_results"][name]
+        elif name in job.get("checkpoints", {}):
+            state, result = "running", job["checkpoints"][name].get("result", {})
+        else:
+            state, result = "pending", {}
+        tables.append({"table": name, "state": state, "records_read": result.get("records_read", 0),
+                       "records_written": result.get("records_written", 0)})
+    return {"job_id": job["job_id"], "status": job["status"], "message": job.get("message"),
+            "stats": _counts(job.get("stats")), "tables": tables}
+
+
+def sync_pair_message(pair) -> Dict[str, Any]:
+    """A sync pair as a SyncPair message."""
+    message = _typed("SyncPair", pair.to_dict())
+    message["tables"] = [{"name": t.name, "target_table": t.target_table or t.name, "primary_key": list(t.primary_key)}
+                         for t in pair.tables]
+    return message
+
+
+def export_message(job: Dict[str, Any]) -> Dict[str, Any]:
+    """A GIS export job as an ExportJob message."""
+    return _typed("ExportJob", job)
+
+
+def _status_code(name: str):
+    return grpc.StatusCode[name] if GRPC_AVAILABLE else name
+
+
+def _required(request: Dict[str, Any], *fields: str) -> None:
+    for field_name in fields:
+        if not request.get(field_name):
+            raise ValueError(f"Missing required field: {field_name}")
+
+
+# Server ---------------------------------------------------------------------
+
+class GrpcGateway:
+    """Serves the gRPC API over the services the REST gateway uses."""
+
+    def __init__(self, engine, registry, export_service, record_streams, job_queue,
+                 bus: EventBus = event_bus, port: int = GRPC_PORT, max_workers: int = GRPC_MAX_WORKERS,
+                 tls: Optional[ServiceTls] = None, shedder: LoadShedder = load_shedder):
+        """
+        Initialize the gateway.
+
+        Args:
+            engine: Sync engine running the jobs
+            registry: Sync pair registry
+            export_service: GIS export service
+            record_streams: Record stream service behind StreamEntities
+            job_queue: Sync job queue new jobs are submitted to when it runs
+            bus: Event bus announcing job changes to WatchJob streams
+            port: Port to listen on
+            max_workers: Calls served at once
+            tls: Certificate served (GRPC_TLS_*, else the service certificate, by default)
+            shedder: Load shedder that admits jobs run within their call
+        """
+        self.engine = engine
+        self.registry = registry
+        self.export_service = export_service
+        self.record_streams = record_streams
+        self.job_queue = job_queue
+        self.shedder = shedder
+        self.bus = bus
+        self.port = port
+        self.max_workers = max_workers
+        grpc_tls = ServiceTls.from_env("GRPC_TLS", ca_variable="GRPC_TLS_CLIENT_CA_FILE")
+        self.tls = tls or (grpc_tls if grpc_tls.enabled else service_tls)
+        self._server = None
+        self._handlers = {
+            "CreateJob": self.create_job, "GetJob": self.get_job, "ListJobs": self.list_jobs,
+            "CancelJob": self.cancel_job, "WatchJob": self.watch_job,
+            "ListSyncPairs": self.list_sync_pairs, "GetSyncPair": self.get_sync_pair,
+            "CreateExport": self.create_export, "GetExport": self.get_export, "ListExports": self.list_exports,
+            "CancelExport": self.cancel_export,
+            "ListEntitySets": self.list_entity_sets, "StreamEntities": self.stream_entities,
+        }
+
+    def start(self) -> None:
+        """
+        Start serving on the configured port.
+
+        Raises:
+            RuntimeError: If grpcio is not installed
+            ValueError: If GRPC_COMPRESSION is not a supported compression
+        """
+        if not GRPC_AVAILABLE:
+            raise RuntimeError("The gRPC API requires the grpcio package")
+        if self._server is not None:
+            return
+        if GRPC_COMPRESSION not in GRPC_COMPRESSION_TYPES:
+            raise ValueError(f"Unsupported GRPC_COMPRESSION {GRPC_COMPRESSION}; "
+                             f"supported: {', '.join(GRPC_COMPRESSION_TYPES)}")
+        compression = {"gzip": grpc.Compression.Gzip, "deflate": grpc.Compression.Deflate,
+                       "none": grpc.Compression.NoCompression}[GRPC_COMPRESSION]
+        server = grpc.server(futures.ThreadPoolExecutor(max_workers=self.max_workers, thread_name_prefix="grpc"),
+                             compression=compression)
+        server.add_generic_rpc_handlers(tuple(self._service_handler(service) for service in SERVICES))
+        address = f"{GRPC_BIND_ADDRESS}:{self.port}"
+        if self.tls.enabled:
+            server.add_secure_port(address, self._server_credentials())
+        else:
+            server.add_insecure_port(address)
+        server.start()
+        self._server = server
+        security = " with mutual TLS" if self.tls.mutual else " with TLS" if self.tls.enabled else ""
+        logger.info(f"gRPC API listening on {address}{security}")
+
+    def stop(self) -> None:
+        """Stop serving, giving running calls GRPC_STOP_GRACE_SECONDS to finish."""
+        if self._server is not None:
+            self._server.stop(GRPC_STOP_GRACE_SECONDS).wait()
+            self._server = None
+            logger.info("gRPC API stopped")
+
+    def _server_credentials(self):
+        """Credentials that serve the current certificate files, re-read when they change."""
+
+        def configuration():
+            files = self.tls.files()
+            return grpc.ssl_server_certificate_configuration([(files["key"], files["cert"])],
+                                                             root_certificates=files.get("ca"))
+
+        served = {"version": None}
+
+        def fetch():
+            # Called by gRPC before each handshake; None keeps the configuration it has
+            try:
+                self.tls.reload()
+            except Exception as e:
+                logger.warning(f"Cannot reload gRPC TLS certificate: {e}")
+                return None
+            if served["version"] == self.tls.version:
+                return None
+            served["version"] = self.tls.version
+            return configuration()
+
+        self.tls.reload(force=True)
+        served["version"] = self.tls.version
+        return grpc.dynamic_ssl_server_credentials(configuration(), fetch,
+                                                   require_client_authentication=self.tls.mutual)
+
+    def _check_peer(self, context) -> None:
+        """Refuse callers whose client certificate has none of the accepted SANs."""
+        if self.tls.mutual:
+            try:
+                self.tls.verify_grpc_peer(context.auth_context())
+            except PeerVerificationError as e:
+                raise RpcError("PERMISSION_DENIED", str(e))
+
+    def _service_handler(self, service: str):
+        methods = {}
+        for method, (request_name, response_name, streaming) in SERVICES[service].items():
+            deserializer = lambda data, name=request_name: decode_message(name, data)
+            serializer = lambda message, name=response_name: encode_message(name, message)
+            if streaming:
+                methods[method] = grpc.unary_stream_rpc_method_handler(
+                    self._streaming(method), request_deserializer=deserializer, response_serializer=serializer)
+            else:
+                methods[method] = grpc.unary_unary_rpc_method_handler(
+                    self._unary(method), request_deserializer=deserializer, response_serializer=serializer)
+        return grpc.method_handlers_generic_handler(f"{PROTO_PACKAGE}.{service}", methods)
+
+    def _unary(self, method: str):
+        handler = self._handlers[method]
+
+        def call(request, context):
+            try:
+                self._check_peer(context)
+                return handler(request, context)
+            except Exception as e:
+                self._abort(method, context, e)
+        return call
+
+    def _streaming(self, method: str):
+        handler = self._handlers[method]
+
+        def call(request, context):
+            try:
+                self._check_peer(context)
+                yield from handler(request, context)
+            except Exception as e:
+                self._abort(method, context, e)
+        return call
+
+    @staticmethod
+    def _abort(method: str, context, error: Exception) -> None:
+        """End a call with the status code matching the error the handler raised."""
+        if isinstance(error, RpcError):
+            code = error.code
+        elif isinstance(error, (KeyError, FileNotFoundError)):
+            code = "NOT_FOUND"
+        elif isinstance(error, ValueError):
+            code = "INVALID_ARGUMENT"
+        elif isinstance(error, StreamLimitError):
+            code = "RESOURCE_EXHAUSTED"
+        elif isinstance(error, OverloadedError):
+            code = "RESOURCE_EXHAUSTED"
+            context.set_trailing_metadata((("retry-after", str(error.retry_after)),))
+        elif isinstance(error, EventBusError):
+            code = "UNAVAILABLE"
+        else:
+            code = "INTERNAL"
+            logger.error(f"Error in gRPC call {method}: {str(error)}", exc_info=True)
+        message = error.args[0] if isinstance(error, KeyError) and error.args else str(error)
+        context.abort(_status_code(code), str(message))
+
+    # Sync jobs --------------------------------------------------------------
+
+    def create_job(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        _required(request, "sync_pair_id", "username")
+        priority = request["priority"] or "normal"
+        queued = self.job_queue.is_running() or self.job_queue.can_dispatch()
+        if self.job_queue.is_running():
+            self.job_queue.check_capacity(priority)
+        with nullcontext() if queued else self.shedder.slot("sync", priority):
+            job = self.engine.create_sync_job(
+                sync_pair_id=request["sync_pair_id"],
+                username=request["username"],
+                mode=request["mode"] or None,
+                tables=request["tables"] or None,
+                parameters=request["parameters"],
+                dry_run=request["dry_run"],
+                priority=priority,
+            )
+            if self.job_queue.is_running():
+                return job_message(self.job_queue.submit(job["job_id"], express=request["express"]))
+            if self.job_queue.can_dispatch():
+                return job_message(self.job_queue.dispatch(job["job_id"], express=request["express"]))
+            return job_message(self.engine.process_job(job["job_id"]))
+
+    def get_job(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        _required(request, "job_id")
+        return job_message(self.engine.get_job_status(request["job_id"]))
+
+    def list_jobs(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        jobs = self.engine.list_jobs(
+            county_id=request["county_id"] or None,
+            sync_pair_id=request["sync_pair_id"] or None,
+            status=request["status"] or None,
+            limit=request["limit"] or DEFAULT_LIST_LIMIT,
+        )
+        return {"jobs": [job_message(job) for job in jobs]}
+
+    def cancel_job(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        _required(request, "job_id")
+        return job_message(self.engine.cancel_job(request["job_id"], request["requested_by"] or None))
+
+    def watch_job(self, request: Dict[str, Any], context) -> Iterator[Dict[str, Any]]:
+        """
+        Stream a job's progress until it reaches one of WATCH_FINAL_STATUSES.
+
+        The job is re-read when the event bus announces a change to it, and
+        every poll interval in between to pick up the counts of its batches.
+        """
+        _required(request, "job_id")
+        job_id = request["job_id"]
+        interval = min(max(request["poll_interval_seconds"] or WATCH_POLL_SECONDS, WATCH_MIN_POLL_SECONDS),
+                       WATCH_MAX_POLL_SECONDS)
+        job = self.engine.get_job_status(job_id)
+        changed = threading.Event()
+        try:
+            subscription = self.bus.subscribe(SUBJECT_SYNC_JOB.format(job_id=job_id, event="*"),
+                                              lambda envelope: changed.set())
+        except EventBusError as e:
+            logger.warning(f"Watching sync job {job_id} without job events: {str(e)}")
+            subscription = None
+        try:
+            last = None
+            while True:
+                progress = job_progress(job)
+                done = job["status"] in WATCH_FINAL_STATUSES
+                if progress != last or done:
+                    last = progress
+                    yield dict(progress, updated_at=datetime.utcnow().isoformat(), done=done)
+                if done or not context.is_active():
+                    return
+                changed.wait(interval)
+                changed.clear()
+                job = self.engine.get_job_status(job_id)
+        finally:
+            if subscription is not None:
+                subscription.unsubscribe()
+
+    # Sync pairs -------------------------------------------------------------
+
+    def list_sync_pairs(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        return {"sync_pairs": [sync_pair_message(pair) for pair in self.registry.list(request["county_id"] or None)]}
+
+    def get_sync_pair(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        _required(request, "sync_pair_id")
+        return sync_pair_message(self.registry.get(request["sync_pair_id"]))
+
+    # Exports ----------------------------------------------------------------
+
+    def create_export(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        _required(request, "county_id", "username", "export_format", "area_of_interest", "layers")
+        with self.shedder.slot("export"):
+            job = self.export_service.create_export_job(
+                county_id=request["county_id"],
+                username=request["username"],
+                export_format=request["export_format"],
+                area_of_interest=request["area_of_interest"],
+                layers=request["layers"],
+                parameters=request["parameters"],
+            )
+            return export_message(self.export_service.process_job(job["job_id"]))
+
+    def get_export(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        _required(request, "job_id")
+        return export_message(self.export_service.get_job_status(request["job_id"]))
+
+    def list_exports(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        jobs = self.export_service.list_jobs(
+            county_id=request["county_id"] or None,
+            status=request["status"] or None,
+            username=request["username"] or None,
+            limit=request["limit"] or DEFAULT_LIST_LIMIT,
+        )
+        return {"jobs": [export_message(job) for job in jobs]}
+
+    def cancel_export(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        _required(request, "job_id")
+        return export_message(self.export_service.cancel_job(request["job_id"]))
+
+    # Entities ---------------------------------------------------------------
+
+    def list_entity_sets(self, request: Dict[str, Any], context) -> Dict[str, Any]:
+        _required(request, "sync_pair_id")
+        odata = self.record_streams.odata
+        entity_sets = odata._entity_sets(odata._pair(request["sync_pair_id"]))
+        return {"entity_sets": [
+            {"name": name, "target_table": table_def.get("target_table"), "primary_key": list(table_def["primary_key"])}
+            for name, table_def in entity_sets.items()
+        ]}
+
+    def stream_entities(self, request: Dict[str, Any], context) -> Iterator[Dict[str, Any]]:
+        """Stream the rows of an entity set from its record stream, one Entity per NDJSON line."""
+        _required(request, "sync_pair_id", "entity_set")
+        options = {name: request[field_name] for name, field_name in
+                   (("$filter", "filter"), ("$select", "select"), ("after", "after")) if request[field_name]}
+        stream = self.record_streams.open(request["sync_pair_id"], request["entity_set"], options)
+        try:
+            pending = b""
+            for chunk in stream:
+                *lines, pending = (pending + chunk).split(b"\n")
+                for line in lines:
+                    if not line:
+                        continue
+                    record = json.loads(line)
+                    if "@error" in record:
+                        # The client resumes after the last key it received
+                        raise RpcError("ABORTED", record["@error"])
+                    yield {"record": record}
+                if not context.is_active():
+                    return
+        finally:
+            stream.close()
@@ -0,0 +1,389 @@
+"""
+TerraFusion SyncService - Transform Hooks
+
+This module provides the hook interface for custom record transformations and
+validations between extract and load. Hooks are registered per sync pair in
+the county configuration:
+
+    "hooks": [
+        {"type": "normalize_parcel_id", "tables": ["dbo.property"],
+         "options": {"column": "geo_id", "remove": "-. "}},
+        {"type": "drop_records", "options": {"column": "geo_id", "prefixes": ["TEST"]}},
+        {"type": "county_plugins.benton:LegacyOwnerFix"}
+    ]
+
+Built-in hook types are listed in HOOK_TYPES. Any other type of the form
+"package.module:ClassName" is imported as a plugin, so counties can add their
+own hooks without changing this codebase. Plugin modules may also use the
+register_hook decorator to add named types.
+"""
+
+import logging
+import importlib
+from dataclasses import dataclass
+from typing import Dict, List, Any, Optional, Callable, Tuple
+
+from sync_connectors import record_key, OPERATION_FIELD
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Number of rejected records kept as samples in each table result
+REJECTION_SAMPLE_LIMIT = 20
+
+
+class RecordRejected(Exception):
+    """Raised by a transform to reject a record with validation errors."""
+
+    def __init__(self, errors: List[str]):
+        super().__init__("; ".join(errors))
+        self.errors = errors
+
+
+@dataclass
+class HookContext:
+    """Information about the batch a hook is processing."""
+    job_id: str
+    sync_pair_id: str
+    table: Dict[str, Any]
+    mode: str
+    dry_run: bool = False
+    # JobControl of the running job; long-running hooks may call control.check()
+    control: Optional[Any] = None
+
+
+class TransformHook:
+    """
+    Base class for transform hooks.
+
+    Subclasses override any of the three stages. Hooks run in the order they
+    are configured; each receives the output of the previous one.
+    """
+
+    hook_type = "base"
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None):
+        """
+        Initialize the hook.
+
+        Args:
+            options: Hook options from the sync pair configuration
+
+        Raises:
+            ValueError: If the options are invalid
+        """
+        self.options = options or {}
+
+    def transform(self, record: Dict[str, Any], context: HookContext) -> Optional[Dict[str, Any]]:
+        """
+        Return the transformed record, or None to drop it from the sync.
+
+        Raises:
+            RecordRejected: To reject the record instead of loading it
+        """
+        return record
+
+    def map_columns(self, table_name: str, columns: List[str]) -> List[str]:
+        """Return the target names of source columns (hooks that rename columns override this)."""
+        return columns
+
+    def validate(self, record: Dict[str, Any], context: HookContext) -> List[str]:
+        """Return validation errors; records with errors are rejected and not loaded."""
+        return []
+
+    def after_load(self, records: List[Dict[str, Any]], counts: Dict[str, int], context: HookContext) -> None:
+        """Called after a batch has been written to the target."""
+
+    def bind(self, target) -> "TransformHook":
+        """Give the hook the target connector of the run (hooks that read reference data from it override this)."""
+        return self
+
+
+# Registered hook types
+HOOK_TYPES: Dict[str, type] = {}
+
+
+def register_hook(hook_type: str) -> Callable[[type], type]:
+    """Class decorator that registers a TransformHook subclass under a type name."""
+    def decorator(cls: type) -> type:
+        if not issubclass(cls, TransformHook):
+            raise TypeError(f"{cls.__name__} must subclass TransformHook")
+        cls.hook_type = hook_type
+        HOOK_TYPES[hook_type] = cls
+        return cls
+    return decorator
+
+
+@register_hook("normalize_parcel_id")
+class NormalizeParcelIdHook(TransformHook):
+    """
+    Normalize legacy parcel identifiers.
+
+    Options:
+        column: Column holding the parcel ID (required)
+        remove: Characters to strip, default "-. "
+        uppercase: Upper-case the result, default true
+        pad_to: Left-pad with zeros to this width
+    """
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None):
+        super().__init__(options)
+        if not self.options.get("column"):
+            raise ValueError("normalize_parcel_id hook requires a 'column' option")
+        self.column = self.options["column"]
+        self.remove = self.options.get("remove", "-. ")
+        self.uppercase = self.options.get("uppercase", True)
+        self.pad_to = self.options.get("pad_to")
+
+    def transform(self, record: Dict[str, Any], context: HookContext) -> Optional[Dict[str, Any]]:
+        value = record.get(self.column)
+        if value is None:
+            return record
+        text = str(value).strip()
+        for char in self.remove:
+            text = text.replace(char, "")
+        if self.uppercase:
+            text = text.upper()
+        if self.pad_to:
+            text = text.zfill(int(self.pad_to))
+        record[self.column] = text
+        return record
+
+
+@register_hook("drop_records")
+class DropRecordsHook(TransformHook):
+    """
+    Drop records such as test or training parcels.
+
+    Options:
+        column: Column to test (required)
+        values: Exact values to drop
+        prefixes: String prefixes to drop
+    """
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None):
+        super().__init__(options)
+        if not self.options.get("column"):
+            raise ValueError("drop_records hook requires a 'column' option")
+        self.column = self.options["column"]
+        self.values = set(str(v) for v in self.options.get("values", []))
+        self.prefixes = tuple(str(p) for p in self.options.get("prefixes", []))
+
+    def transform(self, record: Dict[str, Any], context: HookContext) -> Optional[Dict[str, Any]]:
+        value = record.get(self.column)
+        if value is None:
+            return record
+        text = str(value)
+        if text in self.values or (self.prefixes and text.startswith(self.prefixes)):
+            return None
+        return record
+
+
+@register_hook("require_fields")
+class RequireFieldsHook(TransformHook):
+    """
+    Reject records missing required values.
+
+    Options:
+        fields: Column names that must be present and non-empty
+    """
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None):
+        super().__init__(options)
+        self.fields = list(self.options.get("fields", []))
+        if not self.fields:
+            raise ValueError("require_fields hook requires a 'fields' option")
+
+    def validate(self, record: Dict[str, Any], context: HookContext) -> List[str]:
+        if record.get(OPERATION_FIELD) == "delete":
+            return []
+        return [f"Missing required field: {f}" for f in self.fields if record.get(f) in (None, "")]
+
+
+@register_hook("set_values")
+class SetValuesHook(TransformHook):
+    """
+    Set constant column values, such as the tax year of a per-year source table.
+
+    Options:
+        values: Column names and the values to set (required)
+        key: Add the columns to the target primary key, default false (needed
+            when several source tables load one target table)
+    """
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None):
+        super().__init__(options)
+        self.values = dict(self.options.get("values") or {})
+        if not self.values:
+            raise ValueError("set_values hook requires a 'values' option")
+        self.key = bool(self.options.get("key", False))
+
+    def transform(self, record: Dict[str, Any], context: HookContext) -> Optional[Dict[str, Any]]:
+        record.update(self.values)
+        return record
+
+    def map_columns(self, table_name: str, columns: List[str]) -> List[str]:
+        if not self.key:
+            return columns
+        return columns + [c for c in self.values if c not in columns]
+
+
+def load_hook(definition: Dict[str, Any]) -> TransformHook:
+    """
+    Create a hook from its configuration.
+
+    Raises:
+        ValueError: If the hook type is unknown or cannot be imported
+    """
+    hook_type = definition.get("type")
+    if not hook_type:
+        raise ValueError("Hook definition missing required field: type")
+
+    hook_class = HOOK_TYPES.get(hook_type)
+    if hook_class is None and ":" in hook_type:
+        module_name, class_name = hook_type.split(":", 1)
+        try:
+            module = importlib.import_module(module_name)
+            hook_class = getattr(module, class_name)
+        except (ImportError, AttributeError) as e:
+            raise ValueError(f"Cannot load hook plugin {hook_type}: {e}")
+        if not isinstance(hook_class, type) or not issubclass(hook_class, TransformHook):
+            raise ValueError(f"Hook plugin {hook_type} is not a TransformHook")
+    if hook_class is None:
+        raise ValueError(f"Unsupported hook type: {hook_type}. Supported types: {', '.join(sorted(HOOK_TYPES))}")
+
+    return hook_class(definition.get("options"))
+
+
+class HookPipeline:
+    """The ordered hooks that apply to one table of a sync pair."""
+
+    def __init__(self, hooks: List[TransformHook], validator=None, geometry=None, address=None):
+        self.hooks = hooks
+        # Validation rules checked after the hooks (see sync_validation)
+        self.validator = validator
+        # Geometry columns repaired after the hooks, before the rules (see sync_geometry)
+        self.geometry = geometry
+        # Addresses standardized after the geometry, before the rules (see sync_address)
+        self.address = address
+
+    def __bool__(self) -> bool:
+        return (bool(self.hooks) or self.validator is not None or self.geometry is not None
+                or self.address is not None)
+
+    def apply(self, batch: List[Dict[str, Any]], context: HookContext,
+              result: Optional[Dict[str, Any]] = None) -> Tuple[List[Dict[str, Any]], int, List[Dict[str, Any]]]:
+        """
+        Run transforms and validations over a batch.
+
+        Rejected records are returned as extracted, before any transform, with
+        their errors and the stage ("transform" or "validate") that rejected them.
+        The pipeline's geometry repairer then repairs the geometry columns of
+        the transformed records, rejecting those it cannot repair at the
+        "geometry" stage and counting repairs in result. Its address
+        standardizer writes the standardized addresses, rejecting records
+        matched below the table's min_confidence at the "address" stage when
+        so configured. The pipeline's validator checks its rules on the transformed records
+        last; records failing them are rejected at the "quarantine" stage and
+        also carry the failed rules as "reasons" and the transformed record as
+        "loaded". Rule warnings are counted in result.
+
+        Returns:
+            Tuple of (records to load, number dropped, rejected records with their errors)
+        """
+        records, dropped, rejected = [], 0, []
+        originals = []
+        for original in batch:
+            record: Optional[Dict[str, Any]] = dict(original)
+            try:
+                for hook in self.hooks:
+                    record = hook.transform(record, context)
+                    if record is None:
+                        break
+            except RecordRejected as e:
+                rejected.append({"record": dict(original), "errors": e.errors, "stage": "transform"})
+                continue
+            if record is None:
+                dropped += 1
+                continue
+
+            errors = []
+            for hook in self.hooks:
+                errors.extend(hook.validate(record, context))
+            if errors:
+                rejected.append({"record": dict(original), "errors": errors, "stage": "validate"})
+                continue
+            records.append(record)
+            originals.append(original)
+
+        if self.geometry and records:
+            failures = self.geometry.repair(records, result)
+            if failures:
+                for position, errors in sorted(failures.items()):
+                    rejected.append({"record": dict(originals[position]), "errors": errors, "stage": "geometry"})
+                records = [r for i, r in enumerate(records) if i not in failures]
+                originals = [o for i, o in enumerate(originals) if i not in failures]
+
+        if self.address and records:
+            failures = self.address.standardize(records, result)
+            if failures:
+                for position, errors in sorted(failures.items()):
+                    rejected.append({"record": dict(originals[position]), "errors": errors, "stage": "address"})
+                records = [r for i, r in enumerate(records) if i not in failures]
+                originals = [o for i, o in enumerate(originals) if i not in failures]
+
+        if self.validator and records:
+            failures = self.validator.check(records, result)
+            if failures:
+                for position, reasons in sorted(failures.items()):
+                    rejected.append({
+                        "record": dict(originals[position]),
+                        "errors": [reason["message"] for reason in reasons],
+                        "stage": "quarantine",
+                        "reasons": reasons,
+                        "loaded": records[position],
+                    })
+                records = [r for i, r in enumerate(records) if i not in failures]
+        return records, dropped, rejected
+
+    def bind(self, target) -> "HookPipeline":
+        for hook in self.hooks:
+            hook.bind(target)
+        return self
+
+    def after_load(self, records: List[Dict[str, Any]], counts: Dict[str, int], context: HookContext) -> None:
+        for hook in self.hooks:
+            hook.after_load(records, counts, context)
+
+    def target_table(self, table: Dict[str, Any]) -> Dict[str, Any]:
+        """Table definition for target writes, with primary key columns under their target names."""
+        primary_key = list(table["primary_key"])
+        for hook in self.hooks:
+            primary_key = hook.map_columns(table["name"], primary_key)
+        if primary_key == list(table["primary_key"]):
+            return table
+        return dict(table, primary_key=primary_key)
+
+
+def build_pipeline(definitions: List[Dict[str, Any]], table_name: str) -> HookPipeline:
+    """
+    Build the hook pipeline for a table.
+
+    A hook without a "tables" list applies to every table of the sync pair.
+    """
+    hooks = [
+        load_hook(definition) for definition in definitions
+        if not definition.get("tables") or table_name in definition["tables"]
+    ]
+    return HookPipeline(hooks)
+
+
+def record_rejections(result: Dict[str, Any], table: Dict[str, Any], rejected: List[Dict[str, Any]]) -> None:
+    """Count rejected records on a table result and keep a sample of them."""
+    result["records_rejected"] = result.get("records_rejected", 0) + len(rejected)
+    samples = result.setdefault("rejections", [])
+    for item in rejected:
+        if len(samples) >= REJECTION_SAMPLE_LIMIT:
+            break
+        samples.append({"key": record_key(table["primary_key"], item["record"]), "errors": item["errors"]})
@@ -0,0 +1,121 @@
+"""
+TerraFusion SyncService - Idempotency Keys
+
+This module provides the idempotency keys that make sync writes safe to retry.
+Every upserted record is stamped with a key derived from its source system,
+table, natural (primary) key and change version. Full reads carry no change
+version, so a hash of the record's data is used instead.
+
+Target connectors store the key with the row and skip a write when the row
+already carries the same key, so re-running a partially completed job, or
+replaying batches after a resume, applies each source change exactly once.
+
+The key also covers the table's hook and field mapping configuration: after
+a mapping change the same source version produces a new key, so a re-run
+rewrites rows with the corrected output instead of suppressing them.
+"""
+
+import os
+import json
+import hashlib
+import logging
+from typing import Dict, List, Any
+
+from sync_connectors import IDEMPOTENCY_FIELD, OPERATION_FIELD, VERSION_FIELD, RESERVED_FIELDS
+from sync_conflicts import record_fingerprint
+from sync_columnar import ColumnBatch
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+
+def idempotency_key(source_system: str, table_name: str, natural_key: List[Any], version: Any,
+                    pipeline_version: str = "") -> str:
+    """Derive the idempotency key for one version of a source record."""
+    material = json.dumps([source_system, table_name, natural_key, version, pipeline_version], default=str)
+    return hashlib.sha256(material.encode("utf-8")).hexdigest()
+
+
+def pipeline_version(hook_definitions: List[Dict[str, Any]]) -> str:
+    """
+    Hash the hook configuration that applies to a table.
+
+    Field mapping files are hashed by content: the digest of the document a
+    sync pair loaded, or else the file as it is now.
+    """
+    parts = []
+    for definition in hook_definitions:
+        options = definition.get("options") or {}
+        path, digest = options.get("file"), options.get("digest")
+        if path:
+            # The loaded document and its digest stand in for the file they were read from
+            options = {name: value for name, value in options.items() if name not in ("mapping", "digest")}
+            definition = dict(definition, options=options)
+        parts.append(json.dumps(definition, sort_keys=True, default=str))
+        if path and digest:
+            parts.append(digest)
+        elif path and os.path.exists(path):
+            with open(path, "rb") as f:
+                parts.append(hashlib.sha256(f.read()).hexdigest())
+    return hashlib.sha256("\n".join(parts).encode("utf-8")).hexdigest()[:16]
+
+
+class IdempotencyKeys:
+    """Stamps the records of one table with their idempotency keys."""
+
+    def __init__(self, source_system: str, table: Dict[str, Any], hook_definitions: List[Dict[str, Any]],
+                 include_content: bool = False):
+        """
+        Initialize the key stamper.
+
+        Args:
+            source_system: Identifier of the source system
+            table: Source table definition
+            hook_definitions: Hooks that apply to the table
+            include_content: Key on the record's data as well as its change version
+                (merged records can change without a new primary version)
+        """
+        self.source_system = source_system
+        self.table = table
+        self.pipeline_version = pipeline_version(hook_definitions)
+        self.include_content = include_content
+
+    def stamp(self, records: List[Dict[str, Any]]) -> None:
+        """Set IDEMPOTENCY_FIELD on every upsert in a batch of source records."""
+        for record in records:
+            if record.get(OPERATION_FIELD) == "delete":
+                # Deletes are idempotent already
+                continue
+            record[IDEMPOTENCY_FIELD] = self._key(
+                [record.get(column) for column in self.table["primary_key"]], record.get(VERSION_FIELD), record
+            )
+
+    def stamp_columns(self, batch: ColumnBatch) -> None:
+        """Set the IDEMPOTENCY_FIELD column of a column batch, with the keys stamp gives its records."""
+        data_columns = [column for column in batch.columns if column not in RESERVED_FIELDS]
+        keys = []
+        for operation, version, existing, natural_key, values in zip(
+                batch.column(OPERATION_FIELD), batch.column(VERSION_FIELD), batch.column(IDEMPOTENCY_FIELD),
+                batch.rows(self.table["primary_key"]), batch.rows(data_columns)):
+            if operation == "delete":
+                keys.append(existing)
+                continue
+            keys.append(self._key(list(natural_key), version, dict(zip(data_columns, values))))
+        batch.set_column(IDEMPOTENCY_FIELD, keys)
+
+    def _key(self, natural_key: List[Any], version: Any, data: Dict[str, Any]) -> str:
+        """The key of an upsert; full reads and merged records are keyed on their data (see __init__)."""
+        if version is None:
+            version = record_fingerprint(data)
+        elif self.include_content:
+            version = [version, record_fingerprint(data)]
+        return idempotency_key(self.source_system, self.table["name"], natural_key, version, self.pipeline_version)
+
+
+def build_idempotency(source_system: str, hooks: List[Dict[str, Any]], table: Dict[str, Any],
+                      include_content: bool = False) -> IdempotencyKeys:
+    """Build the key stamper for a table from its sync pair's hooks."""
+    definitions = [h for h in hooks if not h.get("tables") or table["name"] in h["tables"]]
+    return IdempotencyKeys(source_system, table, definitions, include_content)
+
@@ -0,0 +1,681 @@
+"""
+TerraFusion SyncService - Spreadsheet Import
+
+This module loads one-off spreadsheets that assessor staff receive, such as
+annexation corrections or a consultant's land value updates, into one table
+of a sync pair. An import is uploaded, previewed and only then committed:
+
+    terrafusion import corrections.xlsx --sync-pair benton_wa_pacs_staging --table dbo.property
+
+    POST /api/v1/sync/pairs/benton_wa_pacs_staging/tables/dbo.property/imports   (multipart: file, sheet, mapping)
+    POST /api/v1/sync/imports/IMPORT_ID/preview    {"mapping": {"Parcel No": "geo_id", "Notes": null}}
+    POST /api/v1/sync/imports/IMPORT_ID/commit     {"allow_errors": false}
+
+The file is a CSV (UTF-8 or Windows-1252, comma, semicolon, tab or pipe
+delimited) or an Excel workbook (.xlsx; the first sheet unless one is named).
+Its first non-empty row names the columns. The upload suggests a mapping
+from each header to a source column of the table: the columns of the table's
+field mapping and primary key, matched when their names agree ignoring case
+and punctuation ("Parcel No" to parcel_no), when the header is the staging
+field a column maps to, or when the names are close. Headers that match
+nothing are left out; change the mapping with a new preview.
+
+Every preview runs the mapped rows through the sync pair's filters, merge
+sources, hooks, field mappings and validation rules as a dry run of the
+push pipeline (see SyncEngine.ingest_records), so it reports each row that
+would be filtered, rejected or quarantined by its row number, with the
+inserts and updates it would make and the first rows as they would be sent.
+Commit loads the rows with the mapping of the latest preview through the
+same pipeline, as a push job; it is refused while the preview found rows
+that would not load, unless allow_errors is set (those rows are then
+dead-lettered or quarantined as in a sync). Imports are kept for
+SYNC_IMPORT_RETENTION_HOURS; the uploaded file is deleted once the import is
+committed, discarded or expires. Upload, preview and commit go to gateways
+that share SYNC_IMPORT_DIR.
+"""
+
+import io
+import os
+import re
+import csv
+import uuid
+import difflib
+import logging
+import zipfile
+import threading
+import xml.etree.ElementTree as ElementTree
+from datetime import datetime, timedelta
+from typing import Dict, List, Any, Optional, Iterator, Tuple
+
+from audit_log import AuditLog, audit_log
+from sync_connectors import RESERVED_FIELDS
+from sync_ingest import IngestReport, PushedRecord
+from sync_mapping import FieldMapping
+from sync_store import DocumentStore, sync_state_store, DEFAULT_STATE_PATH
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection for imports
+IMPORTS_COLLECTION = "spreadsheet_imports"
+
+# Directory uploaded files are kept in until their import is committed, discarded or expires
+IMPORT_DIR = os.environ.get("SYNC_IMPORT_DIR", os.path.join(DEFAULT_STATE_PATH, "imports"))
+
+# Hours an import is kept after its upload
+RETENTION_HOURS = float(os.environ.get("SYNC_IMPORT_RETENTION_HOURS", "24"))
+
+# Largest file and most rows one import may have
+MAX_IMPORT_BYTES = int(os.environ.get("SYNC_IMPORT_MAX_BYTES", str(50 * 1024 * 1024)))
+MAX_IMPORT_ROWS = int(os.environ.get("SYNC_IMPORT_MAX_ROWS", "100000"))
+
+# File formats, by extension
+IMPORT_FORMATS = {".csv": "csv", ".txt": "csv", ".xlsx": "xlsx"}
+
+# Import statuses
+IMPORT_STATUSES = ["PREVIEWED", "COMMITTED", "FAILED"]
+
+# Rows of a preview shown as they would be sent, and row reports it lists
+PREVIEW_ROWS = 10
+PREVIEW_MAX_REPORTS = 200
+
+# Delimiters a CSV may use, and the encodings it is read in, in order
+CSV_DELIMITERS = ",;\t|"
+CSV_ENCODINGS = ["utf-8-sig", "cp1252"]
+
+# How good a suggested match is, best first
+MATCH_KINDS = ["exact", "target", "similar"]
+
+# Closeness (0 to 1) a header's name needs to a column's for a "similar" match
+SIMILAR_CUTOFF = 0.75
+
+MAIN_NAMESPACE = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+RELATIONSHIP_NAMESPACE = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+PACKAGE_NAMESPACE = "http://schemas.openxmlformats.org/package/2006/relationships"
+
+# Built-in Excel number formats that show dates and times
+EXCEL_DATE_FORMATS = set(range(14, 23)) | {45, 46, 47}
+
+# Day 0 of Excel's 1900 date system, as Excel counts it
+EXCEL_EPOCH = datetime(1899, 12, 30)
+
+
+class ImportStateError(ValueError):
+    """Raised when an import cannot be previewed or committed in its current state."""
+
+
+def file_format(filename: str) -> str:
+    """
+    The format of an uploaded file from its name.
+
+    Raises:
+        ValueError: If the extension is not one of IMPORT_FORMATS
+    """
+    extension = os.path.splitext(filename or "")[1].lower()
+    if extension not in IMPORT_FORMATS:
+        raise ValueError(f"Unsupported file {filename or '(unnamed)'}; upload one of {', '.join(IMPORT_FORMATS)}")
+    return IMPORT_FORMATS[extension]
+
+
+def read_spreadsheet(filename: str, data: bytes, sheet: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Read the header and rows of a CSV or Excel file.
+
+    Args:
+        filename: Name of the file, for its format
+        data: Contents of the file
+        sheet: Worksheet of a workbook (the first otherwise); not used for CSV
+
+    Returns:
+        Dictionary with the header, the rows as (row number, values), the
+        sheets of a workbook and the encoding and delimiter of a CSV
+
+    Raises:
+        ValueError: If the file cannot be read or has no usable header row
+    """
+    fmt = file_format(filename)
+    result = _read_xlsx(data, sheet) if fmt == "xlsx" else _read_csv(data)
+    rows = iter(result.pop("rows"))
+    header = None
+    for number, values in rows:
+        if any(_trimmed(value) is not None for value in values):
+            header = [str(value).strip() if value is not None else "" for value in values]
+            break
+    if header is None:
+        raise ValueError(f"{filename} has no header row")
+    while header and not header[-1]:
+        header.pop()
+    if "" in header or len(set(header)) != len(header):
+        raise ValueError(f"The header row of {filename} has an empty or repeated column name")
+    result.update(format=fmt, header=header, rows=[(number, values) for number, values in rows
+                                                   if any(_trimmed(value) is not None for value in values)])
+    return result
+
+
+def _trimmed(value: Any) -> Any:
+    """A cell value with surrounding spaces trimmed; None for empty cells."""
+    if isinstance(value, str):
+        value = value.strip()
+        return value or None
+    return value
+
+
+def _read_csv(data: bytes) -> Dict[str, Any]:
+    for encoding in CSV_ENCODINGS:
+        try:
+            text = data.decode(encoding)
+            break
+        except UnicodeDecodeError:
+            continue
+    else:
+        raise ValueError("The CSV file is neither UTF-8 nor Windows-1252 text")
+    try:
+        delimiter = csv.Sniffer().sniff(text[:4096], delimiters=CSV_DELIMITERS).delimiter
+    except csv.Error:
+        delimiter = ","
+    reader = csv.reader(io.StringIO(text, newline=""), delimiter=delimiter)
+    rows = []
+    try:
+        while True:
+            first = reader.line_num + 1
+            row = next(reader, None)
+            if row is None:
+                break
+            rows.append((first, row))
+    except csv.Error as e:
+        raise ValueError(f"Invalid CSV at line {reader.line_num}: {e}")
+    return {"encoding": encoding.replace("-sig", ""), "delimiter": delimiter, "rows": rows}
+
+
+def _read_xlsx(data: bytes, sheet: Optional[str]) -> Dict[str, Any]:
+    try:
+        workbook = zipfile.ZipFile(io.BytesIO(data))
+        sheets = _workbook_sheets(workbook)
+        if not sheets:
+            raise ValueError("The workbook has no sheets")
+        if sheet is not None and sheet not in sheets:
+            raise ValueError(f"The workbook has no sheet {sheet}; its sheets are {', '.join(sheets)}")
+        name = sheet or next(iter(sheets))
+        strings = _shared_strings(workbook)
+        date_styles = _date_styles(workbook)
+        with workbook.open(sheets[name]) as part:
+            rows = list(_sheet_rows(part, strings, date_styles))
+    except (zipfile.BadZipFile, KeyError, ElementTree.ParseError) as e:
+        raise ValueError(f"The file is not a readable Excel workbook: {e}")
+    return {"sheet": name, "sheets": list(sheets), "rows": rows}
+
+
+def _workbook_sheets(workbook: zipfile.ZipFile) -> Dict[str, str]:
+    """The worksheets of a workbook, in order, with the paths of their parts."""
+    relationships = ElementTree.fromstring(workbook.read("xl/_rels/workbook.xml.rels"))
+    targets = {}
+    for relationship in relationships.iter(f"{{{PACKAGE_NAMESPACE}}}Relationship"):
+        target = relationship.get("Target", "")
+        targets[relationship.get("Id")] = target.lstrip("/") if target.startswith("/") else f"xl/{target}"
+    root = ElementTree.fromstring(workbook.read("xl/workbook.xml"))
+    sheets = {}
+    for element in root.iter(f"{{{MAIN_NAMESPACE}}}sheet"):
+        target = targets.get(element.get(f"{{{RELATIONSHIP_NAMESPACE}}}id"))
+        if target:
+            sheets[element.get("name")] = target
+    return sheets
+
+
+def _shared_strings(workbook: zipfile.ZipFile) -> List[str]:
+    if "xl/sharedStrings.xml" not in workbook.namelist():
+        return []
+    root = ElementTree.fromstring(workbook.read("xl/sharedStrings.xml"))
+    return [_text(item) for item in root.iter(f"{{{MAIN_NAMESPACE}}}si")]
+
+
+def _text(element) -> str:
+    """The text of a string item or inline string, without its phonetic runs."""
+    phonetic = {id(t) for run in element.iter(f"{{{MAIN_NAMESPACE}}}rPh") for t in run.iter()}
+    return "".join(t.text or "" for t in element.iter(f"{{{MAIN_NAMESPACE}}}t") if id(t) not in phonetic)
+
+
+def _date_styles(workbook: zipfile.ZipFile) -> set:
+    """Indexes of the cell styles whose number format shows a date or time."""
+    if "xl/styles.xml" not in workbook.namelist():
+        return set()
+    root = ElementTree.fromstring(workbook.read("xl/styles.xml"))
+    date_formats = set(EXCEL_DATE_FORMATS)
+    for number_format in root.iter(f"{{{MAIN_NAMESPACE}}}numFmt"):
+        # Quoted text, [colors] and escaped characters are not date parts
+        code = re.sub(r'"[^"]*"|\[[^\]]*\]|\\.', "", number_format.get("formatCode", "")).lower()
+        if re.search(r"[dmyhs]", code):
+            date_formats.add(int(number_format.get("numFmtId", "-1")))
+    cell_formats = root.find(f"{{{MAIN_NAMESPACE}}}cellXfs")
+    if cell_formats is None:
+        return set()
+    return {index for index, style in enumerate(cell_formats.findall(f"{{{MAIN_NAMESPACE}}}xf"))
+            if int(style.get("numFmtId", "0")) in date_formats}
+
+
+def _column_index(reference: str) -> int:
+    """The 0-based column of a cell reference (B7 -> 1)."""
+    index = 0
+    for char in re.match(r"[A-Z]*", reference).group(0):
+        index = index * 26 + ord(char) - ord("A") + 1
+    return index - 1
+
+
+def _sheet_rows(part, strings: List[str], date_styles: set) -> Iterator[Tuple[int, List[Any]]]:
+    """The rows of a worksheet part as (row number, values), read as they are parsed."""
+    row_tag, cell_tag = f"{{{MAIN_NAMESPACE}}}row", f"{{{MAIN_NAMESPACE}}}c"
+    number = 0
+    for _, element in ElementTree.iterparse(part):
+        if element.tag != row_tag:
+            continue
+        number = int(element.get("r") or number + 1)
+        values: List[Any] = []
+        for position, cell in enumerate(element.iter(cell_tag)):
+            column = _column_index(cell.get("r")) if cell.get("r") else position
+            values.extend([None] * (column + 1 - len(values)))
+            values[column] = _cell_value(cell, strings, date_styles)
+        element.clear()
+        yield number, values
+
+
+def _cell_value(cell, strings: List[str], date_styles: set) -> Any:
+    cell_type = cell.get("t", "n")
+    if cell_type == "inlineStr":
+        inline = cell.find(f"{{{MAIN_NAMESPACE}}}is")
+        return _text(inline) if inline is not None else None
+    value = cell.findtext(f"{{{MAIN_NAMESPACE}}}v")
+    if value is None or cell_type == "e":
+        return None
+    if cell_type == "s":
+        return strings[int(value)]
+    if cell_type == "b":
+        return value == "1"
+    if cell_type in ("str", "d"):
+        return value
+    number = float(value)
+    if int(cell.get("s", "0")) in date_styles:
+        moment = EXCEL_EPOCH + timedelta(days=number)
+        return moment.date().isoformat() if number == int(number) else moment.isoformat()
+    return int(number) if number.is_integer() else number
+
+
+def _normalized(name: str) -> str:
+    return re.sub(r"[^0-9a-z]", "", str(name).lower())
+
+
+def table_columns(pair, table) -> List[Dict[str, Any]]:
+    """
+    The source columns of a table an import can fill: its primary key and
+    the columns of its field mapping, with the staging field and type they
+    map to.
+    """
+    columns = {name: {"column": name, "target": None, "type": None, "primary_key": True}
+               for name in table.primary_key}
+    for hook in pair.hooks:
+        if hook.get("type") != "field_mapping":
+            continue
+        options = hook.get("options") or {}
+        mapping = FieldMapping(options["mapping"], options.get("file") or "inline") if options.get("mapping") \
+            else FieldMapping.load(options["file"])
+        table_mapping = mapping.for_table(table.name)
+        for field_def in (table_mapping.fields if table_mapping else []):
+            if not field_def.get("source"):
+                continue
+            entry = columns.setdefault(field_def["source"], {"column": field_def["source"], "primary_key": False})
+            entry.update(target=field_def["target"], type=field_def.get("type"))
+    return list(columns.values())
+
+
+def suggest_mapping(header: List[str], columns: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+    """
+    Suggest the source column of each header of a spreadsheet.
+
+    Returns:
+        One suggestion per header: its column (None when nothing matches) and
+        how it matched (see MATCH_KINDS). A table without known columns keeps
+        the headers as they are.
+    """
+    if not columns:
+        return [{"header": name, "column": name, "match": "exact"} for name in header]
+    by_name = {_normalized(c["column"]): c["column"] for c in columns}
+    by_target = {_normalized(c["target"]): c["column"] for c in columns if c.get("target")}
+    candidates = dict(by_target, **by_name)
+
+    suggestions = []
+    for name in header:
+        key = _normalized(name)
+        if key in by_name:
+            suggestions.append({"header": name, "column": by_name[key], "match": "exact"})
+        elif key in by_target:
+            suggestions.append({"header": name, "column": by_target[key], "match": "target"})
+        else:
+            close = difflib.get_close_matches(key, list(candidates), n=1, cutoff=SIMILAR_CUTOFF) if key else []
+            suggestions.append({"header": name, "column": candidates[close[0]] if close else None,
+                                "match": "similar" if close else None})
+    # A column goes to its best-matching header; the others are left out
+    taken = {}
+    for suggestion in sorted((s for s in suggestions if s["column"]), key=lambda s: MATCH_KINDS.index(s["match"])):
+        if suggestion["column"] in taken:
+            suggestion.update(column=None, match=None)
+        else:
+            taken[suggestion["column"]] = suggestion["header"]
+    return suggestions
+
+
+def check_mapping(mapping: Any, header: List[str]) -> Dict[str, Optional[str]]:
+    """
+    Validate a mapping from headers to source columns; headers it leaves out are not loaded.
+
+    Raises:
+        ValueError: If the mapping names unknown headers, maps two headers to one column or fills a reserved field
+    """
+    if not isinstance(mapping, dict):
+        raise ValueError("mapping must be an object of header to source column (null leaves the header out)")
+    unknown = [name for name in mapping if name not in header]
+    if unknown:
+        raise ValueError(f"mapping names header {unknown[0]}, which the file does not have")
+    columns = [column for column in mapping.values() if column is not None]
+    if not all(isinstance(column, str) and column for column in columns):
+        raise ValueError("mapping values must be column names or null")
+    if len(set(columns)) != len(columns):
+        raise ValueError("mapping maps two headers to the same column")
+    reserved = [column for column in columns if column in RESERVED_FIELDS]
+    if reserved:
+        raise ValueError(f"Reserved field {reserved[0]} cannot be imported")
+    return {name: mapping.get(name) for name in header}
+
+
+def mapped_records(header: List[str], rows: List[Tuple[int, List[Any]]], mapping: Dict[str, Optional[str]],
+                   primary_key: List[str]) -> Iterator[PushedRecord]:
+    """The rows of a spreadsheet as records of the source columns they map to, by row number."""
+    positions = [(index, mapping[name]) for index, name in enumerate(header) if mapping.get(name)]
+    for number, values in rows:
+        record = {column: _trimmed(values[index]) if index < len(values) else None for index, column in positions}
+        errors = [f"Missing primary key column {column}" for column in primary_key if record.get(column) is None]
+        yield PushedRecord(number, record, errors)
+
+
+class SpreadsheetImportService:
+    """Uploads, previews and commits spreadsheet imports into the tables of sync pairs."""
+
+    def __init__(self, engine, registry, store: Optional[DocumentStore] = None, import_dir: str = IMPORT_DIR,
+                 audit: Optional[AuditLog] = None):
+        """
+        Initialize the service.
+
+        Args:
+            engine: Sync engine that previews and loads the rows
+            registry: Sync pair registry
+            store: Document store for import records; defaults to the shared sync state store
+            import_dir: Directory uploaded files are kept in
+            audit: Audit log commits and discards are recorded in
+        """
+        self.engine = engine
+        self.registry = registry
+        self.store = store or sync_state_store
+        self.import_dir = import_dir
+        self.audit_log = audit or audit_log
+        self._lock = threading.Lock()
+
+    def create(self, sync_pair_id: str, table_name: str, filename: str, data: bytes, username: str,
+               sheet: Optional[str] = None, mapping: Optional[Dict[str, Optional[str]]] = None) -> Dict[str, Any]:
+        """
+        Upload a spreadsheet and preview it with the suggested mapping (or the one given).
+
+        Returns:
+            The import record, with its preview
+
+        Raises:
+            KeyError: If the sync pair or table is not configured
+            ValueError: If the file is too large, unreadable or has too many rows, or the mapping is invalid
+        """
+        self.purge_expired()
+        pair = self.registry.get(sync_pair_id)
+        table = pair.get_table(table_name)
+        if len(data) > MAX_IMPORT_BYTES:
+            raise ValueError(f"The file is larger than {MAX_IMPORT_BYTES} bytes (SYNC_IMPORT_MAX_BYTES)")
+        sheet_data = self._parse(filename, data, sheet)
+        suggestions = suggest_mapping(sheet_data["header"], table_columns(pair, table))
+        if mapping is None:
+            mapping = {s["header"]: s["column"] for s in suggestions}
+        mapping = check_mapping(mapping, sheet_data["header"])
+
+        import_id = str(uuid.uuid4())
+        path = os.path.join(self.import_dir, f"{import_id}.{sheet_data['format']}")
+        os.makedirs(self.import_dir, exist_ok=True)
+        with open(os.open(path, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600), "wb") as f:
+            f.write(data)
+        now = datetime.utcnow()
+        record = {
+            "import_id": import_id,
+            "sync_pair_id": sync_pair_id,
+            "county_id": pair.county_id,
+            "table": table_name,
+            "filename": os.path.basename(filename),
+            "format": sheet_data["format"],
+            "sheet": sheet_data.get("sheet"),
+            "sheets": sheet_data.get("sheets"),
+            "encoding": sheet_data.get("encoding"),
+            "header": sheet_data["header"],
+            "rows": len(sheet_data["rows"]),
+            "suggestions": suggestions,
+            "path": path,
+            "status": "PREVIEWED",
+            "created_by": username,
+            "created_at": now.isoformat(),
+            "expires_at": (now + timedelta(hours=RETENTION_HOURS)).isoformat(),
+        }
+        self._preview(record, pair, table, sheet_data, mapping, username)
+        logger.info(f"Spreadsheet {record['filename']} uploaded by {username} for {table_name} of {sync_pair_id} "
+                    f"as import {import_id}")
+        return self._public(record)
+
+    def preview(self, import_id: str, username: str, mapping: Optional[Dict[str, Optional[str]]] = None,
+                sheet: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Preview an import again, with a new mapping or sheet.
+
+        Raises:
+            KeyError: If the import or its sync pair is not found
+            ImportStateError: If the import was already committed
+            ValueError: If the mapping or sheet is invalid
+        """
+        with self._lock:
+            record = self._load(import_id)
+            if record["status"] == "COMMITTED":
+                raise ImportStateError(f"Import {import_id} was already committed")
+            pair = self.registry.get(record["sync_pair_id"])
+            table = pair.get_table(record["table"])
+            sheet_data = self._read(record, sheet if sheet is not None else record.get("sheet"))
+            if sheet_data["header"] != record["header"]:
+                # Another sheet has other headers, and suggestions of its own
+                record["header"] = sheet_data["header"]
+                record["suggestions"] = suggest_mapping(sheet_data["header"], table_columns(pair, table))
+                if mapping is None:
+                    mapping = {s["header"]: s["column"] for s in record["suggestions"]}
+            mapping = check_mapping(record["preview"]["mapping"] if mapping is None else mapping, sheet_data["header"])
+            record.update(sheet=sheet_data.get("sheet"), rows=len(sheet_data["rows"]), status="PREVIEWED")
+            self._preview(record, pair, table, sheet_data, mapping, username)
+            return self._public(record)
+
+    def commit(self, import_id: str, username: str, allow_errors: bool = False) -> Dict[str, Any]:
+        """
+        Load the rows of an import with the mapping of its latest preview.
+
+        Args:
+            import_id: Import to commit
+            username: Who committed it, recorded as the push job's username
+            allow_errors: Commit although the preview found rows that would not load
+
+        Returns:
+            The import record, with the push job and its per-row report
+
+        Raises:
+            KeyError: If the import or its sync pair is not found
+            ImportStateError: If the import was committed, or its preview found errors and allow_errors is not set
+        """
+        with self._lock:
+            record = self._load(import_id)
+            if record["status"] == "COMMITTED":
+                raise ImportStateError(f"Import {import_id} was already committed")
+            preview = record["preview"]
+            if preview["errors"]:
+                raise ImportStateError(f"Import {import_id} cannot be committed: {'; '.join(preview['errors'])}")
+            failing = sum(preview["counts"][status] for status in ("rejected", "quarantined", "invalid"))
+            if failing and not allow_errors:
+                raise ImportStateError(f"The preview of import {import_id} found {failing} rows that would not load; "
+                                   f"correct the file or mapping, or commit with allow_errors")
+            pair = self.registry.get(record["sync_pair_id"])
+            table = pair.get_table(record["table"])
+            sheet_data = self._read(record, record.get("sheet"))
+            report = IngestReport(table.primary_key, errors_only=True)
+            job = self.engine.ingest_records(
+                pair.sync_pair_id, table.name,
+                report.batches(mapped_records(sheet_data["header"], sheet_data["rows"], preview["mapping"],
+                                              table.primary_key), pair.batch_size, MAX_IMPORT_ROWS),
+                username, on_batch=report.batch_done,
+            )
+            record.update(status="FAILED" if job["status"] == "FAILED" else "COMMITTED", job_id=job["job_id"],
+                          committed_by=username, committed_at=datetime.utcnow().isoformat(),
+                          result=self._report(report), message=job.get("message"))
+            if record["status"] == "COMMITTED":
+                self._remove_file(record)
+            self.store.save(IMPORTS_COLLECTION, import_id, record)
+        self.audit_log.record(f"sync_import.{record['status'].lower()}", username, "sync_import", import_id,
+                              {"sync_pair_id": record["sync_pair_id"], "table": record["table"],
+                               "filename": record["filename"], "job_id": job["job_id"],
+                               "counts": record["result"]["counts"]}, county_id=record["county_id"])
+        logger.info(f"Import {import_id} committed by {username} as job {job['job_id']}: {job['status']}")
+        return self._public(record)
+
+    def get(self, import_id: str) -> Dict[str, Any]:
+        """
+        Get an import.
+
+        Raises:
+            KeyError: If the import is not found
+        """
+        return self._public(self._load(import_id))
+
+    def list(self, sync_pair_id: Optional[str] = None, status: Optional[str] = None) -> List[Dict[str, Any]]:
+        """The imports kept, newest first, without their previews' row reports."""
+        self.purge_expired()
+        imports = [record for record in self.store.list(IMPORTS_COLLECTION)
+                   if (sync_pair_id is None or record.get("sync_pair_id") == sync_pair_id)
+                   and (status is None or record.get("status") == status)]
+        imports.sort(key=lambda record: record.get("created_at", ""), reverse=True)
+        return [self._summary(record) for record in imports]
+
+    def discard(self, import_id: str, username: str) -> Dict[str, Any]:
+        """
+        Delete an import and its uploaded file; committed rows stay loaded.
+
+        Raises:
+            KeyError: If the import is not found
+        """
+        with self._lock:
+            record = self._load(import_id)
+            self._remove_file(record)
+            self.store.delete(IMPORTS_COLLECTION, import_id)
+        self.audit_log.record("sync_import.discarded", username, "sync_import", import_id,
+                              {"sync_pair_id": record["sync_pair_id"], "table": record["table"],
+                               "status": record["status"]}, county_id=record.get("county_id"))
+        return {"import_id": import_id, "discarded": True}
+
+    def purge_expired(self) -> int:
+        """Delete the imports past their retention; returns how many were deleted."""
+        now = datetime.utcnow().isoformat()
+        expired = [record for record in self.store.list(IMPORTS_COLLECTION) if record.get("expires_at", now) < now]
+        for record in expired:
+            self._remove_file(record)
+            self.store.delete(IMPORTS_COLLECTION, record["import_id"])
+        if expired:
+            logger.info(f"Deleted {len(expired)} expired spreadsheet imports")
+        return len(expired)
+
+    def _preview(self, record: Dict[str, Any], pair, table, sheet_data: Dict[str, Any],
+                 mapping: Dict[str, Optional[str]], username: str) -> None:
+        """Dry-run the mapped rows through the pipeline and store the preview on the record."""
+        mapped = {column for column in mapping.values() if column}
+        preview = {
+            "mapping": mapping,
+            "unmapped_headers": [name for name in sheet_data["header"] if not mapping.get(name)],
+            "errors": [f"No header is mapped to primary key column {column}"
+                       for column in table.primary_key if column not in mapped],
+            "counts": None,
+            "diff_summary": None,
+            "records": [],
+            "sample": [],
+            "previewed_by": username,
+            "previewed_at": datetime.utcnow().isoformat(),
+        }
+        if not sheet_data["rows"]:
+            preview["errors"].append("The file has no rows below its header")
+        if not preview["errors"]:
+            preview["sample"] = [{"row": pushed.line, "record": pushed.record} for pushed in mapped_records(
+                sheet_data["header"], sheet_data["rows"][:PREVIEW_ROWS], mapping, table.primary_key)]
+            report = IngestReport(table.primary_key, errors_only=True)
+            job = self.engine.ingest_records(
+                pair.sync_pair_id, table.name,
+                report.batches(mapped_records(sheet_data["header"], sheet_data["rows"], mapping, table.primary_key),
+                               pair.batch_size, MAX_IMPORT_ROWS),
+                username, dry_run=True, on_batch=report.batch_done,
+            )
+            preview.update(self._report(report), job_id=job["job_id"], diff_summary=job.get("diff_summary"))
+            if job["status"] == "FAILED":
+                preview["errors"].append(job["message"])
+        record["preview"] = preview
+        self.store.save(IMPORTS_COLLECTION, record["import_id"], record)
+
+    def _read(self, record: Dict[str, Any], sheet: Optional[str]) -> Dict[str, Any]:
+        if not os.path.exists(record["path"]):
+            raise KeyError(f"The file of import {record['import_id']} is no longer kept")
+        with open(record["path"], "rb") as f:
+            return self._parse(record["filename"], f.read(), sheet)
+
+    @staticmethod
+    def _parse(filename: str, data: bytes, sheet: Optional[str]) -> Dict[str, Any]:
+        """Read a spreadsheet, refusing one with more than MAX_IMPORT_ROWS rows."""
+        sheet_data = read_spreadsheet(filename, data, sheet)
+        if len(sheet_data["rows"]) > MAX_IMPORT_ROWS:
+            raise ValueError(f"The file has {len(sheet_data['rows'])} rows; imports hold at most {MAX_IMPORT_ROWS} "
+                             f"(SYNC_IMPORT_MAX_ROWS)")
+        return sheet_data
+
+    def _load(self, import_id: str) -> Dict[str, Any]:
+        try:
+            return self.store.load(IMPORTS_COLLECTION, import_id)
+        except (KeyError, FileNotFoundError):
+            raise KeyError(f"Import {import_id} not found")
+
+    @staticmethod
+    def _report(report: IngestReport) -> Dict[str, Any]:
+        """An import's row report, its listed rows capped at PREVIEW_MAX_REPORTS."""
+        result = report.to_dict()
+        result["records_truncated"] = len(result["records"]) > PREVIEW_MAX_REPORTS
+        result["records"] = result["records"][:PREVIEW_MAX_REPORTS]
+        result.pop("limit_exceeded", None)
+        return result
+
+    @staticmethod
+    def _remove_file(record: Dict[str, Any]) -> None:
+        try:
+            os.remove(record["path"])
+        except FileNotFoundError:
+            pass
+
+    @staticmethod
+    def _public(record: Dict[str, Any]) -> Dict[str, Any]:
+        """An import record as the API returns it, without the gateway's file path."""
+        return {name: value for name, value in record.items() if name != "path"}
+
+    @classmethod
+    def _summary(cls, record: Dict[str, Any]) -> Dict[str, Any]:
+        summary = cls._public(record)
+        summary.pop("suggestions", None)
+        if summary.get("preview"):
+            summary["preview"] = {name: value for name, value in summary["preview"].items()
+                                  if name not in ("records", "sample")}
+        if summary.get("result"):
+            summary["result"] = {"counts": summary["result"]["counts"]}
+        return summary
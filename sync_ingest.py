@@ -0,0 +1,401 @@
+"""
+TerraFusion SyncService - Push Ingestion
+
+This module lets county systems push records to a sync pair instead of
+waiting to be polled. The records of one table are sent as NDJSON (one JSON
+object per line) or CSV (a header row, then one row per record):
+
+    POST /api/v1/sync/pairs/benton_wa_pacs_staging/tables/dbo.property/records
+    Content-Type: application/x-ndjson
+
+    {"prop_id": 1001, "geo_id": "10394-0001", "legal_acreage": 0.25}
+    {"prop_id": 1002, "_sync_operation": "delete"}
+
+The body is parsed as it arrives and loaded in batches of the sync pair's
+batch_size through the same filters, merge sources, hooks, field mappings,
+validation rules, quarantine and dead-letter store as a pull-based sync
+(see SyncEngine.ingest_records); each push is recorded as a sync job in
+"push" mode. The response reports every record by its line number:
+
+- loaded: passed every check and was written (or was already up to date, or
+  was dropped by a hook)
+- filtered: left out by the sync pair's filters
+- rejected: refused by a hook, merge or the target, and dead-lettered
+- quarantined: broke a validation rule
+- invalid: not parseable, missing a primary key column, or carrying a
+  reserved field
+
+A sync pair accepts pushes only when it has an "ingestion" block:
+
+    "ingestion": {
+        "tables": ["dbo.property", "dbo.owner"],
+        "services": ["benton-cama-export"],
+        "max_records": 1000000
+    }
+
+Callers authenticate with an RBAC bearer token whose role has the write
+permission, or with the API key (X-API-Key) of one of the listed services:
+a scoped key (see api_keys) with the jobs:submit scope, or a key configured
+in security_config.API_KEY_CONFIG.
+CSV values arrive as strings, with empty fields as null; give the columns
+types in the sync pair's field mapping to coerce them.
+"""
+
+import csv
+import json
+import logging
+from typing import Dict, List, Any, Optional, Iterator, NamedTuple
+
+from sync_connectors import OPERATION_FIELD, RESERVED_FIELDS, record_key
+from sync_validation import STAGE_QUARANTINE
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Body formats, by content type
+INGEST_FORMATS = {
+    "application/x-ndjson": "ndjson",
+    "application/jsonl": "ndjson",
+    "text/csv": "csv",
+}
+
+# Records one push may carry when the ingestion block sets no max_records
+DEFAULT_MAX_RECORDS = 1000000
+
+# Statuses of pushed records in the report
+RECORD_STATUSES = ["loaded", "filtered", "rejected", "quarantined", "invalid"]
+
+# Values a pushed record's OPERATION_FIELD may take; records without it are upserted
+PUSH_OPERATIONS = ["insert", "update", "delete"]
+
+# RBAC permission a user needs to push records
+PUSH_PERMISSION = "write"
+
+
+class IngestLimitError(ValueError):
+    """Raised when a push carries more records than its sync pair accepts."""
+
+
+class PushedRecord(NamedTuple):
+    """A record parsed from a push body, or the errors that kept it from parsing."""
+    line: int
+    record: Optional[Dict[str, Any]]
+    errors: List[str]
+
+
+def parse_ingestion(sync_pair_id: str, definition: Any, table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the "ingestion" block of a sync pair.
+
+    Returns:
+        The ingestion settings, empty when the sync pair accepts no pushes
+    """
+    if not definition:
+        return {}
+    if not isinstance(definition, dict):
+        raise ValueError(f"Sync pair {sync_pair_id}: ingestion must be an object")
+    ingestion = dict(definition)
+    for name in ingestion.get("tables", []):
+        if name not in table_names:
+            raise ValueError(f"Sync pair {sync_pair_id}: ingestion names unknown table {name}")
+    services = ingestion.get("services", [])
+    if not isinstance(services, list) or not all(isinstance(s, str) and s for s in services):
+        raise ValueError(f"Sync pair {sync_pair_id}: ingestion services must be a list of API key service names")
+    max_records = ingestion.get("max_records", DEFAULT_MAX_RECORDS)
+    if not isinstance(max_records, int) or isinstance(max_records, bool) or max_records < 1:
+        raise ValueError(f"Sync pair {sync_pair_id}: ingestion max_records must be a positive integer")
+    ingestion.update({"services": services, "max_records": max_records})
+    return ingestion
+
+
+def body_format(content_type: Optional[str]) -> str:
+    """
+    The format of a push body from its Content-Type.
+
+    Raises:
+        ValueError: If the content type is not one of INGEST_FORMATS
+    """
+    media_type = (content_type or "").split(";", 1)[0].strip().lower()
+    if media_type not in INGEST_FORMATS:
+        raise ValueError(f"Unsupported Content-Type {media_type or '(none)'}; send one of {', '.join(INGEST_FORMATS)}")
+    return INGEST_FORMATS[media_type]
+
+
+def _check_record(record: Dict[str, Any], primary_key: List[str]) -> List[str]:
+    """Why a parsed record cannot be loaded; empty when it can."""
+    errors = [f"Missing primary key column {column}" for column in primary_key if record.get(column) is None]
+    reserved = [name for name in RESERVED_FIELDS if name != OPERATION_FIELD and name in record]
+    if reserved:
+        errors.append(f"Reserved field {reserved[0]} cannot be pushed")
+    operation = record.get(OPERATION_FIELD)
+    if operation is not None and operation not in PUSH_OPERATIONS:
+        errors.append(f"{OPERATION_FIELD} must be one of {', '.join(PUSH_OPERATIONS)}")
+    return errors
+
+
+def _lines(stream) -> Iterator[bytes]:
+    """The lines of a binary stream, read as they arrive."""
+    while True:
+        line = stream.readline()
+        if not line:
+            return
+        yield line
+
+
+def read_ndjson(stream, primary_key: List[str]) -> Iterator[PushedRecord]:
+    """Parse an NDJSON body line by line; blank lines are skipped."""
+    for number, raw in enumerate(_lines(stream), 1):
+        try:
+            text = raw.decode("utf-8-sig" if number == 1 else "utf-8")
+        except UnicodeDecodeError:
+            yield PushedRecord(number, None, ["Line is not valid UTF-8"])
+            continue
+        if not text.strip():
+            continue
+        try:
+            record = json.loads(text)
+        except ValueError as e:
+            yield PushedRecord(number, None, [f"Invalid JSON: {e}"])
+            continue
+        if not isinstance(record, dict):
+            yield PushedRecord(number, None, ["Line is not a JSON object"])
+            continue
+        yield PushedRecord(number, record, _check_record(record, primary_key))
+
+
+def read_csv(stream, primary_key: List[str]) -> Iterator[PushedRecord]:
+    """
+    Parse a CSV body row by row; the first row names the columns.
+
+    Raises:
+        ValueError: If the body has no header row, or the header repeats or omits a column
+    """
+    undecodable = set()
+
+    def decoded() -> Iterator[str]:
+        for number, raw in enumerate(_lines(stream), 1):
+            try:
+                yield raw.decode("utf-8-sig" if number == 1 else "utf-8")
+            except UnicodeDecodeError:
+                undecodable.add(number)
+                yield raw.decode("utf-8", errors="replace")
+
+    reader = csv.reader(decoded())
+    header = next(reader, None)
+    if not header:
+        raise ValueError("The CSV body has no header row")
+    header = [name.strip() for name in header]
+    if len(set(header)) != len(header) or "" in header:
+        raise ValueError("The CSV header row has an empty or repeated column name")
+    missing = [column for column in primary_key if column not in header]
+    if missing:
+        raise ValueError(f"The CSV header row lacks primary key column {missing[0]}")
+
+    while True:
+        first = reader.line_num + 1
+        try:
+            row = next(reader)
+        except StopIteration:
+            return
+        except csv.Error as e:
+            yield PushedRecord(first, None, [f"Invalid CSV: {e}"])
+            continue
+        if not row or row == [""]:
+            continue
+        if any(number in undecodable for number in range(first, reader.line_num + 1)):
+            yield PushedRecord(first, None, ["Row is not valid UTF-8"])
+            continue
+        if len(row) != len(header):
+            yield PushedRecord(first, None, [f"Row has {len(row)} fields; the header has {len(header)}"])
+            continue
+        record = {name: (value if value != "" else None) for name, value in zip(header, row)}
+        yield PushedRecord(first, record, _check_record(record, primary_key))
+
+
+class IngestReport:
+    """The per-record results of one push, by line number."""
+
+    def __init__(self, primary_key: List[str], errors_only: bool = False):
+        """
+        Initialize the report.
+
+        Args:
+            primary_key: Source primary key columns of the table
+            errors_only: List only records that were not loaded or filtered
+        """
+        self.primary_key = primary_key
+        self.errors_only = errors_only
+        self.counts = {status: 0 for status in RECORD_STATUSES}
+        self.records: List[Dict[str, Any]] = []
+        # Whether the push held more records than its sync pair accepts
+        self.limit_exceeded = False
+        # Line numbers of the records of each batch in flight, by id of the batch
+        self._lines: Dict[int, List[int]] = {}
+
+    def add(self, line: int, status: str, key: Optional[str] = None,
+            errors: Optional[List[str]] = None, stage: Optional[str] = None) -> None:
+        self.counts[status] += 1
+        if self.errors_only and status in ("loaded", "filtered"):
+            return
+        entry = {"line": line, "status": status, "key": json.loads(key) if key else None}
+        if errors:
+            entry["errors"] = errors
+        if stage:
+            entry["stage"] = stage
+        self.records.append(entry)
+
+    def batches(self, records: Iterator[PushedRecord], batch_size: int, max_records: int) -> Iterator[List[Dict[str, Any]]]:
+        """
+        Batches of the valid records of a push; invalid ones go straight into the report.
+
+        Raises:
+            IngestLimitError: Once the push holds more than max_records records
+        """
+        batch, lines, seen = [], [], 0
+        for pushed in records:
+            seen += 1
+            if seen > max_records:
+                self.limit_exceeded = True
+                if batch:
+                    # The records before the limit are loaded and reported
+                    self._lines[id(batch)] = lines
+                    yield batch
+                raise IngestLimitError(f"The push holds more than {max_records} records; split it into smaller pushes")
+            if pushed.errors:
+                keyed = pushed.record is not None and all(pushed.record.get(c) is not None for c in self.primary_key)
+                self.add(pushed.line, "invalid", record_key(self.primary_key, pushed.record) if keyed else None,
+                         pushed.errors)
+                continue
+            batch.append(pushed.record)
+            lines.append(pushed.line)
+            if len(batch) >= batch_size:
+                self._lines[id(batch)] = lines
+                yield batch
+                batch, lines = [], []
+        if batch:
+            self._lines[id(batch)] = lines
+            yield batch
+
+    def batch_done(self, batch: List[Dict[str, Any]], passed: List[Dict[str, Any]], failed: List[Dict[str, Any]]) -> None:
+        """Report the records of a written batch (SyncEngine.ingest_records' on_batch)."""
+        lines = self._lines.pop(id(batch), [])
+        failures = {record_key(self.primary_key, item["record"]): item for item in failed}
+        passed = {id(record) for record in passed}
+        for line, record in zip(lines, batch):
+            key = record_key(self.primary_key, record)
+            failure = failures.get(key)
+            if failure:
+                quarantined = failure["stage"] == STAGE_QUARANTINE
+                self.add(line, "quarantined" if quarantined else "rejected", key,
+                         failure.get("reasons") if quarantined and failure.get("reasons") else failure["errors"],
+                         failure["stage"])
+            elif id(record) not in passed:
+                self.add(line, "filtered", key)
+            else:
+                self.add(line, "loaded", key)
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {"counts": dict(self.counts), "records": sorted(self.records, key=lambda entry: entry["line"]),
+                "limit_exceeded": self.limit_exceeded}
+
+
+class IngestionService:
+    """Loads records pushed by county systems into the sync pairs that accept them."""
+
+    def __init__(self, engine, registry):
+        """
+        Initialize the service.
+
+        Args:
+            engine: Sync engine that loads the records
+            registry: Sync pair registry
+        """
+        self.engine = engine
+        self.registry = registry
+
+    def authorize(self, sync_pair_id: str, table_name: str, user: Optional[Dict[str, Any]],
+                  service: Optional[str]) -> str:
+        """
+        Check that a caller may push records to a table of a sync pair.
+
+        Args:
+            sync_pair_id: Sync pair receiving the records
+            table_name: Table the records belong to
+            user: The RBAC user of a bearer token, if any
+            service: The service of a valid API key, if any
+
+        Returns:
+            The name recorded as the push job's username
+
+        Raises:
+            KeyError: If the sync pair or table is not configured or does not accept pushes
+            PermissionError: If the caller may not push to it
+        """
+        pair = self.registry.get(sync_pair_id)
+        if not pair.ingestion:
+            raise KeyError(f"Sync pair {sync_pair_id} does not accept pushed records")
+        pair.get_table(table_name)
+        if table_name not in (pair.ingestion.get("tables") or [t.name for t in pair.tables]):
+            raise KeyError(f"Table {table_name} of sync pair {sync_pair_id} does not accept pushed records")
+        if service is not None:
+            if service not in pair.ingestion["services"]:
+                raise PermissionError(f"Service {service} may not push records to sync pair {sync_pair_id}")
+            return f"service:{service}"
+        if user is None:
+            raise PermissionError("Authentication required")
+        if PUSH_PERMISSION not in (user.get("permissions") or []):
+            raise PermissionError(f"Pushing records needs the {PUSH_PERMISSION} permission")
+        if user.get("county_id") and user["county_id"] != pair.county_id and user.get("role") != "admin":
+            raise PermissionError(f"Sync pair {sync_pair_id} belongs to another county")
+        return user.get("username") or "unknown"
+
+    def ingest(self, sync_pair_id: str, table_name: str, stream, content_type: Optional[str], username: str,
+               dry_run: bool = False, errors_only: bool = False) -> Dict[str, Any]:
+        """
+        Parse a push body and load its records.
+
+        Args:
+            sync_pair_id: Sync pair receiving the records
+            table_name: Table the records belong to
+            stream: Binary stream of the body, read as it arrives
+            content_type: Content-Type of the body (see INGEST_FORMATS)
+            username: Who pushed the records (see authorize)
+            dry_run: Check and diff the records without writing them
+            errors_only: Report only records that were not loaded or filtered
+
+        Returns:
+            Dictionary with the push job and the per-record report
+
+        Raises:
+            KeyError: If the sync pair or table is not configured
+            ValueError: If the body's format is unsupported or its CSV header unusable
+        """
+        pair = self.registry.get(sync_pair_id)
+        table = pair.get_table(table_name)
+        fmt = body_format(content_type)
+        records = read_csv(stream, table.primary_key) if fmt == "csv" else read_ndjson(stream, table.primary_key)
+        if fmt == "csv":
+            # Reads the header now, so a bad one is refused before a job is created
+            records = _primed(records)
+        report = IngestReport(table.primary_key, errors_only)
+        job = self.engine.ingest_records(
+            sync_pair_id, table_name,
+            report.batches(records, pair.batch_size, pair.ingestion.get("max_records", DEFAULT_MAX_RECORDS)),
+            username, dry_run=dry_run, on_batch=report.batch_done,
+        )
+        logger.info(f"Push to {table_name} of {sync_pair_id} by {username}: {report.counts}")
+        return {"job": job, "report": report.to_dict()}
+
+
+def _primed(records: Iterator[PushedRecord]) -> Iterator[PushedRecord]:
+    """Start a generator, running it up to its first record, and return an iterator over all of them."""
+    try:
+        first = next(records)
+    except StopIteration:
+        return iter(())
+
+    def chained() -> Iterator[PushedRecord]:
+        yield first
+        yield from records
+    return chained()
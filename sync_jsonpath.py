@@ -0,0 +1,113 @@
+"""
+TerraFusion SyncService - JSONPath Expressions
+
+This module provides the JSONPath subset used to pull values out of nested
+JSON documents: by the REST source connector to find the records and the
+next-page cursor in an API response, and by field mappings ("path" instead of
+"source") to extract nested values into target fields.
+
+Supported syntax:
+
+    $                  the document itself
+    .name  ['name']    a member of an object
+    [0]  [-1]          an array element (negative counts from the end)
+    [*]  .*            every element of an array or value of an object
+
+Paths may leave out the leading "$." ("owner.name" is "$.owner.name").
+"""
+
+import re
+import logging
+from typing import Any, List, Tuple
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# One step of a path: .name, .*, [n], [*] or ['name']
+PATH_STEP = re.compile(r"""\.(?P<name>[A-Za-z_$@][\w$@-]*)|\.(?P<dot_star>\*)|\[(?P<index>-?\d+)\]|\[(?P<star>\*)\]"""
+                       r"""|\[\s*(?P<quote>['"])(?P<key>(?:\\.|(?!(?P=quote)).)*)(?P=quote)\s*\]""")
+
+WILDCARD = ("*", None)
+
+
+class JsonPath:
+    """A compiled JSONPath expression."""
+
+    def __init__(self, expression: str):
+        """
+        Compile an expression.
+
+        Raises:
+            ValueError: If the expression is not valid
+        """
+        self.expression = expression
+        self.steps = self._parse(expression)
+
+    @property
+    def is_single(self) -> bool:
+        """Whether the path selects at most one value (it has no wildcards)."""
+        return all(step != WILDCARD for step in self.steps)
+
+    def find(self, document: Any) -> List[Any]:
+        """All values the path selects in a document."""
+        current = [document]
+        for kind, value in self.steps:
+            selected = []
+            for item in current:
+                if (kind, value) == WILDCARD:
+                    if isinstance(item, list):
+                        selected.extend(item)
+                    elif isinstance(item, dict):
+                        selected.extend(item.values())
+                elif kind == "index":
+                    if isinstance(item, list) and -len(item) <= value < len(item):
+                        selected.append(item[value])
+                elif isinstance(item, dict) and value in item:
+                    selected.append(item[value])
+            current = selected
+        return current
+
+    def first(self, document: Any, default: Any = None) -> Any:
+        """
+        The value a single-valued path selects, or the list a wildcard path
+        selects; default when nothing matches.
+        """
+        values = self.find(document)
+        if not self.is_single:
+            return values
+        return values[0] if values else default
+
+    @staticmethod
+    def _parse(expression: str) -> List[Tuple[str, Any]]:
+        text = expression.strip()
+        if not text:
+            raise ValueError("JSONPath expression is empty")
+        if text.startswith("$"):
+            text = text[1:]
+        elif not text.startswith("["):
+            text = "." + text
+        steps = []
+        position = 0
+        while position < len(text):
+            match = PATH_STEP.match(text, position)
+            if match is None:
+                raise ValueError(f"Invalid JSONPath {expression!r} at {text[position:] !r}")
+            if match.group("name") is not None:
+                steps.append(("key", match.group("name")))
+            elif match.group("index") is not None:
+                steps.append(("index", int(match.group("index"))))
+            elif match.group("key") is not None:
+                steps.append(("key", re.sub(r"\\(.)", r"\1", match.group("key"))))
+            else:
+                steps.append(WILDCARD)
+            position = match.end()
+        return steps
+
+    def __repr__(self) -> str:
+        return f"JsonPath({self.expression!r})"
+
+
+def compile_path(expression: str) -> JsonPath:
+    """Compile a JSONPath expression (see JsonPath)."""
+    return JsonPath(expression)
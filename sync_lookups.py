@@ -0,0 +1,170 @@
+"""
+TerraFusion SyncService - Reference Lookup Cache
+
+This module keeps the reference tables field mappings look codes up in
+(land use, neighborhood, property type codes) in memory, so a mapping reads
+each table once instead of on every record. A mapping file lists them beside
+its inline lookups:
+
+    "reference_lookups": {
+      "land_use": {"table": "staging.land_use_codes", "key": "land_use_cd",
+                   "value": "land_use_desc", "ttl_seconds": 900}
+    }
+
+The table is read from the target of the sync pair applying the mapping, as
+one key: value map, and shared by every job and worker of the process that
+maps with the same table and columns. A cached table is read again once it
+is older than ttl_seconds, or as soon as a sync job of this process writes
+to it (a sync pair loading the code table itself, say), so a run picks up
+codes loaded by the run before it. Only small tables are cached: a table with
+more than max_rows rows fails the job instead of filling the memory.
+"""
+
+import os
+import time
+import logging
+import threading
+from dataclasses import dataclass
+from typing import Dict, Any, Optional
+
+from sync_connectors import database_name
+from metrics import LOOKUP_CACHE_REQUESTS, LOOKUP_CACHE_INVALIDATIONS, LOOKUP_CACHE_ROWS
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Seconds a cached reference table is used before it is read again
+LOOKUP_CACHE_TTL_SECONDS = float(os.environ.get("SYNC_LOOKUP_CACHE_TTL_SECONDS", "900"))
+
+# Rows a reference table may have to be cached
+LOOKUP_CACHE_MAX_ROWS = int(os.environ.get("SYNC_LOOKUP_CACHE_MAX_ROWS", "50000"))
+
+REFERENCE_LOOKUP_FIELDS = ["table", "key", "value", "ttl_seconds", "max_rows"]
+
+
+def parse_reference_lookup(name: str, definition: Any) -> Dict[str, Any]:
+    """
+    Validate a reference lookup of a mapping file and fill in defaults.
+
+    Raises:
+        ValueError: If the lookup is incomplete or a setting is invalid
+    """
+    if not isinstance(definition, dict):
+        raise ValueError(f"Reference lookup {name} must be an object with table, key and value")
+    unknown = [field for field in definition if field not in REFERENCE_LOOKUP_FIELDS]
+    if unknown:
+        raise ValueError(f"Unknown reference lookup setting {unknown[0]} in {name}; "
+                         f"settings: {', '.join(REFERENCE_LOOKUP_FIELDS)}")
+    missing = [field for field in ("table", "key", "value") if not definition.get(field)]
+    if missing:
+        raise ValueError(f"Reference lookup {name} requires {', '.join(missing)}")
+    lookup = {"name": name, "table": str(definition["table"]), "key": str(definition["key"]),
+              "value": str(definition["value"])}
+    for field, default, minimum in (("ttl_seconds", LOOKUP_CACHE_TTL_SECONDS, 0),
+                                    ("max_rows", LOOKUP_CACHE_MAX_ROWS, 1)):
+        value = definition.get(field, default)
+        if isinstance(value, bool) or not isinstance(value, (int, float)) or value < minimum:
+            raise ValueError(f"Reference lookup {name}: {field} must be a number of at least {minimum}")
+        lookup[field] = value
+    lookup["max_rows"] = int(lookup["max_rows"])
+    return lookup
+
+
+@dataclass
+class _Cached:
+    """A reference table in the cache."""
+    name: str
+    values: Dict[str, Any]
+    loaded_at: float
+    # Writes to the table seen when it was read; a later write makes it stale
+    generation: int
+
+
+class LookupCache:
+    """Reference tables of the process, by database, table and columns."""
+
+    def __init__(self):
+        self._tables: Dict[tuple, _Cached] = {}
+        self._generations: Dict[tuple, int] = {}
+        self._loading: Dict[tuple, threading.Lock] = {}
+        self._lock = threading.Lock()
+
+    def get(self, target, lookup: Dict[str, Any]) -> Dict[str, Any]:
+        """
+        The codes and values of a reference lookup, read from the target when not cached.
+
+        Args:
+            target: Target connector the table is read from
+            lookup: Settings from parse_reference_lookup
+
+        Raises:
+            ValueError: If the table has more rows than the lookup's max_rows
+        """
+        database = database_name(target.config)
+        key = (database, lookup["table"], lookup["key"], lookup["value"])
+        cached = self._fresh(key, lookup)
+        if cached is None:
+            with self._lock:
+                loading = self._loading.setdefault(key, threading.Lock())
+            with loading:
+                # Another worker may have read it while this one waited
+                cached = self._fresh(key, lookup)
+                if cached is None:
+                    LOOKUP_CACHE_REQUESTS.inc(lookup=lookup["name"], result="miss")
+                    with self._lock:
+                        generation = self._generations.get((database, lookup["table"]), 0)
+                    cached = _Cached(lookup["name"], self._read(target, lookup), time.monotonic(), generation)
+                    with self._lock:
+                        self._tables[key] = cached
+                    return cached.values
+        LOOKUP_CACHE_REQUESTS.inc(lookup=lookup["name"], result="hit")
+        return cached.values
+
+    def invalidate(self, target, table_name: str) -> int:
+        """
+        Drop the cached reference tables read from a table a sync wrote to.
+
+        Returns:
+            Number of cached lookups dropped
+        """
+        database = database_name(target.config)
+        with self._lock:
+            self._generations[(database, table_name)] = self._generations.get((database, table_name), 0) + 1
+            dropped = [key for key in self._tables if key[:2] == (database, table_name)]
+            entries = [self._tables.pop(key) for key in dropped]
+        for cached in entries:
+            LOOKUP_CACHE_INVALIDATIONS.inc(lookup=cached.name)
+            LOOKUP_CACHE_ROWS.set(0, lookup=cached.name)
+        if entries:
+            logger.info(f"Dropped {len(entries)} cached reference lookups of {table_name} after a sync wrote to it")
+        return len(entries)
+
+    def _fresh(self, key: tuple, lookup: Dict[str, Any]) -> Optional[_Cached]:
+        with self._lock:
+            cached = self._tables.get(key)
+            if cached is None:
+                return None
+            if (cached.generation != self._generations.get(key[:2], 0)
+                    or time.monotonic() - cached.loaded_at >= lookup["ttl_seconds"]):
+                del self._tables[key]
+                return None
+            return cached
+
+    @staticmethod
+    def _read(target, lookup: Dict[str, Any]) -> Dict[str, Any]:
+        table = {"name": lookup["table"], "target_table": lookup["table"], "primary_key": [lookup["key"]]}
+        rows = target.query_records(table, columns=[lookup["key"], lookup["value"]], limit=lookup["max_rows"] + 1)
+        if len(rows) > lookup["max_rows"]:
+            raise ValueError(f"Reference lookup {lookup['name']}: {lookup['table']} has more than "
+                             f"{lookup['max_rows']} rows, too many to cache (raise max_rows or use inline lookups)")
+        values = {str(row.get(lookup["key"])).strip(): row.get(lookup["value"])
+                  for row in rows if row.get(lookup["key"]) is not None}
+        LOOKUP_CACHE_ROWS.set(len(values), lookup=lookup["name"])
+        logger.info(f"Cached {len(values)} codes of reference lookup {lookup['name']} from {lookup['table']}")
+        return values
+
+
+# Create a singleton instance
+lookup_cache = LookupCache()
+
@@ -0,0 +1,354 @@
+"""
+TerraFusion SyncService - Field Mapping
+
+This module provides declarative field mappings between a source schema (such
+as PACS) and the TerraFusion staging schema. A mapping file (JSON, or YAML when
+PyYAML is installed) lists, per source table, how each target field is filled:
+
+    {
+      "lookups": {"property_type": {"R": "residential", "C": "commercial"}},
+      "tables": {
+        "dbo.property": {
+          "unmapped_columns": "drop",
+          "fields": [
+            {"source": "prop_id", "target": "prop_id", "type": "integer"},
+            {"source": "geo_id", "target": "parcel_number", "type": "string"},
+            {"source": "prop_type_cd", "target": "property_type",
+             "lookup": "property_type", "default": "unknown"},
+            {"path": "$.owner.mailing.city", "target": "owner_city"},
+            {"target": "county_id", "default": "benton_wa"}
+          ]
+        }
+      }
+    }
+
+A field's "lookup" may also name a reference table of the target database,
+listed under "reference_lookups" and read through the lookup cache (see
+sync_lookups) instead of inlined in the file.
+
+A field reads either a source column ("source") or, for nested records such as
+REST API items, a JSONPath expression ("path", see sync_jsonpath); a wildcard
+path yields the list of matching values.
+
+Sync pairs reference a mapping file with "field_mapping" (relative to the
+county configuration folder). Mappings are loaded and validated when sync
+pairs are loaded, and applied as the last transform hook of each table. The
+hook carries the document read at load time, so a job keeps the mapping its
+sync pair was loaded with when the file is edited under it (see
+config_reload).
+"""
+
+import os
+import json
+import hashlib
+import logging
+from decimal import Decimal, InvalidOperation
+from datetime import datetime, date
+from typing import Dict, List, Any, Optional
+
+from sync_connectors import RESERVED_FIELDS, OPERATION_FIELD
+from sync_jsonpath import compile_path
+from sync_hooks import TransformHook, HookContext, RecordRejected, register_hook
+from sync_lookups import parse_reference_lookup, lookup_cache
+
+try:
+    import yaml
+    YAML_AVAILABLE = True
+except ImportError:
+    # YAML mapping files require PyYAML; JSON files always work
+    YAML_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Supported target field types
+FIELD_TYPES = ["string", "integer", "decimal", "float", "boolean", "date", "datetime"]
+
+TRUE_VALUES = {"true", "t", "yes", "y", "1"}
+FALSE_VALUES = {"false", "f", "no", "n", "0"}
+
+
+def coerce_value(value: Any, field_type: str, date_format: Optional[str] = None) -> Any:
+    """
+    Convert a source value to a target field type.
+
+    Raises:
+        ValueError: If the value cannot be converted
+    """
+    if value is None:
+        return None
+    if isinstance(value, str):
+        value = value.strip()
+        if value == "" and field_type != "string":
+            return None
+
+    if field_type == "string":
+        return str(value)
+    if field_type == "integer":
+        if isinstance(value, bool):
+            return int(value)
+        number = Decimal(str(value))
+        if number != number.to_integral_value():
+            raise ValueError(f"{value!r} is not a whole number")
+        return int(number)
+    if field_type == "decimal":
+        try:
+            return Decimal(str(value))
+        except InvalidOperation:
+            raise ValueError(f"{value!r} is not a number")
+    if field_type == "float":
+        return float(value)
+    if field_type == "boolean":
+        if isinstance(value, bool):
+            return value
+        text = str(value).lower()
+        if text in TRUE_VALUES:
+            return True
+        if text in FALSE_VALUES:
+            return False
+        raise ValueError(f"{value!r} is not a boolean")
+    if field_type in ("date", "datetime"):
+        if isinstance(value, datetime):
+            parsed = value
+        elif isinstance(value, date):
+            parsed = datetime(value.year, value.month, value.day)
+        elif date_format:
+            parsed = datetime.strptime(str(value), date_format)
+        else:
+            parsed = datetime.fromisoformat(str(value))
+        return parsed.date() if field_type == "date" else parsed
+    raise ValueError(f"Unsupported field type: {field_type}")
+
+
+class TableMapping:
+    """The field mapping for one source table."""
+
+    def __init__(self, table_name: str, definition: Dict[str, Any], lookups: Dict[str, Dict[str, Any]],
+                 reference_lookups: Optional[Dict[str, Dict[str, Any]]] = None):
+        """
+        Build and validate a table mapping.
+
+        Raises:
+            ValueError: If the mapping is invalid
+        """
+        self.table_name = table_name
+        self.lookups = lookups
+        self.reference_lookups = reference_lookups or {}
+        self.unmapped_columns = definition.get("unmapped_columns", "drop")
+        if self.unmapped_columns not in ("drop", "keep"):
+            raise ValueError(f"Mapping for {table_name}: unmapped_columns must be 'drop' or 'keep'")
+
+        self.fields = []
+        self.paths = {}
+        targets = set()
+        for field_def in definition.get("fields", []):
+            target = field_def.get("target")
+            if not target:
+                raise ValueError(f"Mapping for {table_name}: every field needs a target")
+            if target in targets:
+                raise ValueError(f"Mapping for {table_name}: target field {target} is mapped twice")
+            targets.add(target)
+            if "source" in field_def and "path" in field_def:
+                raise ValueError(f"Mapping for {table_name}: field {target} has both a source and a path")
+            if "source" not in field_def and "path" not in field_def and "default" not in field_def:
+                raise ValueError(f"Mapping for {table_name}: field {target} needs a source, a path or a default")
+            if field_def.get("path"):
+                try:
+                    self.paths[target] = compile_path(field_def["path"])
+                except ValueError as e:
+                    raise ValueError(f"Mapping for {table_name}: field {target}: {e}")
+            field_type = field_def.get("type")
+            if field_type and field_type not in FIELD_TYPES:
+                raise ValueError(
+                    f"Mapping for {table_name}: unsupported type {field_type} for {target}. "
+                    f"Supported types: {', '.join(FIELD_TYPES)}"
+                )
+            lookup = field_def.get("lookup")
+            if lookup and lookup not in lookups and lookup not in self.reference_lookups:
+                raise ValueError(f"Mapping for {table_name}: field {target} uses unknown lookup {lookup}")
+            self.fields.append(field_def)
+
+        self.column_map = {f["source"]: f["target"] for f in self.fields if f.get("source")}
+        for target, path in self.paths.items():
+            # A path naming a top-level member maps that column like a source does
+            if len(path.steps) == 1 and path.steps[0][0] == "key":
+                self.column_map.setdefault(path.steps[0][1], target)
+
+    def map_columns(self, columns: List[str]) -> List[str]:
+        """Target names of source columns."""
+        return [self.column_map.get(c, c) for c in columns]
+
+    def validate_key(self, primary_key: List[str]) -> None:
+        """Check that a table's primary key survives the mapping."""
+        if self.unmapped_columns == "drop":
+            missing = [c for c in primary_key if c not in self.column_map]
+            if missing:
+                raise ValueError(f"Mapping for {self.table_name} drops primary key columns: {', '.join(missing)}")
+
+    def apply(self, record: Dict[str, Any], connector=None) -> Dict[str, Any]:
+        """
+        Map one source record to target fields.
+
+        Args:
+            record: Source record
+            connector: Target connector reference lookups are read from
+
+        Raises:
+            RecordRejected: If values cannot be converted or a lookup has no match
+            ValueError: If a reference lookup is used without a target, or is too large to cache
+        """
+        output = {k: v for k, v in record.items() if k in RESERVED_FIELDS}
+        if self.unmapped_columns == "keep":
+            output.update({k: v for k, v in record.items() if k not in self.column_map and k not in RESERVED_FIELDS})
+
+        if record.get(OPERATION_FIELD) == "delete":
+            # Deleted rows carry only their keys
+            for source, target in self.column_map.items():
+                if source in record:
+                    output[target] = record[source]
+            return output
+
+        errors = []
+        for field_def in self.fields:
+            target = field_def["target"]
+            label = field_def.get("source") or field_def.get("path") or target
+            if target in self.paths:
+                value = self.paths[target].first(record)
+            else:
+                value = record.get(field_def["source"]) if field_def.get("source") else None
+
+            if value is not None and field_def.get("lookup"):
+                table = self._lookup(field_def["lookup"], connector)
+                key = str(value).strip()
+                if key in table:
+                    value = table[key]
+                elif "default" in field_def:
+                    value = None
+                else:
+                    errors.append(f"No {field_def['lookup']} lookup entry for {label}={value!r}")
+                    continue
+
+            if value is None or value == "":
+                value = field_def.get("default", value)
+
+            if field_def.get("type") and value is not None:
+                try:
+                    value = coerce_value(value, field_def["type"], field_def.get("format"))
+                except (ValueError, TypeError) as e:
+                    errors.append(f"Cannot convert {label} to {field_def['type']}: {e}")
+                    continue
+            output[target] = value
+
+        if errors:
+            raise RecordRejected(errors)
+        return output
+
+    def _lookup(self, name: str, connector) -> Dict[str, Any]:
+        if name in self.lookups:
+            return self.lookups[name]
+        if connector is None:
+            raise ValueError(f"Mapping for {self.table_name}: reference lookup {name} needs the sync pair's target")
+        return lookup_cache.get(connector, self.reference_lookups[name])
+
+
+class FieldMapping:
+    """A mapping file: lookup tables, reference lookups and per-table field mappings."""
+
+    def __init__(self, definition: Dict[str, Any], source: str = "inline", digest: Optional[str] = None):
+        """
+        Build and validate a mapping.
+
+        Args:
+            definition: Parsed mapping document
+            source: Where the mapping came from, for error messages
+            digest: SHA-256 of the file the document was read from
+
+        Raises:
+            ValueError: If the mapping is invalid
+        """
+        self.source = source
+        self.definition = definition
+        self.digest = digest
+        self.lookups = definition.get("lookups", {})
+        for name, lookup in self.lookups.items():
+            if not isinstance(lookup, dict):
+                raise ValueError(f"Lookup {name} in {source} must be an object of code: value pairs")
+        self.lookups = {name: {str(k): v for k, v in lookup.items()} for name, lookup in self.lookups.items()}
+        self.reference_lookups = {}
+        for name, lookup in (definition.get("reference_lookups") or {}).items():
+            if name in self.lookups:
+                raise ValueError(f"Lookup {name} in {source} is both inline and a reference lookup")
+            try:
+                self.reference_lookups[name] = parse_reference_lookup(name, lookup)
+            except ValueError as e:
+                raise ValueError(f"{e} (in {source})")
+        self.tables = {
+            name: TableMapping(name, table_def, self.lookups, self.reference_lookups)
+            for name, table_def in definition.get("tables", {}).items()
+        }
+
+    @classmethod
+    def load(cls, path: str) -> "FieldMapping":
+        """
+        Load a mapping file.
+
+        Raises:
+            FileNotFoundError: If the file does not exist
+            ValueError: If the file cannot be parsed or is invalid
+        """
+        if not os.path.exists(path):
+            raise FileNotFoundError(f"Field mapping file not found: {path}")
+        with open(path, 'rb') as f:
+            content = f.read()
+        if path.endswith((".yaml", ".yml")):
+            if not YAML_AVAILABLE:
+                raise ValueError(f"PyYAML is required to read {path}")
+            definition = yaml.safe_load(content)
+        else:
+            try:
+                definition = json.loads(content)
+            except (json.JSONDecodeError, UnicodeDecodeError) as e:
+                raise ValueError(f"Invalid JSON in field mapping {path}: {e}")
+        return cls(definition or {}, path, hashlib.sha256(content).hexdigest())
+
+    def for_table(self, table_name: str) -> Optional[TableMapping]:
+        return self.tables.get(table_name)
+
+
+@register_hook("field_mapping")
+class FieldMappingHook(TransformHook):
+    """
+    Apply a declarative field mapping.
+
+    Options:
+        file: Path to the mapping file
+        mapping: Inline mapping document (instead of file), or the document
+            read from file when the sync pair was loaded
+        digest: SHA-256 of the file that mapping was read from
+    """
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None):
+        super().__init__(options)
+        if self.options.get("mapping") is not None:
+            self.mapping = FieldMapping(self.options["mapping"], self.options.get("file") or "inline",
+                                        self.options.get("digest"))
+        elif self.options.get("file"):
+            self.mapping = FieldMapping.load(self.options["file"])
+        else:
+            raise ValueError("field_mapping hook requires a 'file' or 'mapping' option")
+        self.target = None
+
+    def bind(self, target) -> "FieldMappingHook":
+        self.target = target
+        return self
+
+    def transform(self, record: Dict[str, Any], context: HookContext) -> Optional[Dict[str, Any]]:
+        table_mapping = self.mapping.for_table(context.table["name"])
+        if table_mapping is None:
+            return record
+        return table_mapping.apply(record, self.target)
+
+    def map_columns(self, table_name: str, columns: List[str]) -> List[str]:
+        table_mapping = self.mapping.for_table(table_name)
+        return table_mapping.map_columns(columns) if table_mapping else columns
@@ -0,0 +1,259 @@
+"""
+TerraFusion SyncService - Merge Sync
+
+This module provides merge sync, which loads one unified record per row of
+the sync pair's primary source (usually the CAMA system) with columns joined
+in from other sources, such as parcel geometries from the GIS department's
+PostGIS database:
+
+    "merge": {
+        "sources": [
+            {"name": "gis",
+             "connector": {"type": "postgis", "dsn_env_var": "GIS_DATABASE_URL", "schema": "gis"},
+             "tables": [
+                 {"table": "dbo.property", "source_table": "parcel_polygons",
+                  "join": {"geo_id": "parcel_number"},
+                  "columns": {"shape": "geometry", "shape_area": "gis_area"},
+                  "change_column": "last_edited_date"}
+             ]}
+        ]
+    }
+
+"join" maps primary columns to the merge source's columns (values are
+compared as trimmed text). "columns" lists the merge source columns to copy,
+optionally renamed; by default every non-join column is copied. Primary
+records without a match get the columns as nulls, or are rejected when the
+table entry sets "required": true.
+
+Each merge source keeps its own watermark (on "change_column"), so an edit
+made only in the merge source, such as a redrawn parcel boundary, re-syncs the
+affected records on the next incremental run. Those watermarks are the
+per-source freshness reported for the sync pair.
+"""
+
+import logging
+from typing import Dict, List, Any, Optional, Iterator, Tuple
+
+from sync_connectors import create_connector, record_key, OPERATION_FIELD, RESERVED_FIELDS
+from sync_throttle import parse_throttle, source_throttle, throttled
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Name of the sync pair's own source in merge results and freshness reports
+PRIMARY_SOURCE_NAME = "primary"
+
+# Change detection method recorded on merge source watermarks
+MERGE_WATERMARK_METHOD = "change_column"
+
+
+def _join_key(values: List[Any]) -> str:
+    """Normalize join values so 1001 and ' 1001' match."""
+    return record_key(list(range(len(values))), {i: None if v is None else str(v).strip() for i, v in enumerate(values)})
+
+
+def parse_merge(sync_pair_id: str, definition: Optional[Dict[str, Any]], table_names: List[str],
+                default_timezone: str = "UTC") -> Dict[str, Any]:
+    """
+    Validate the merge block of a sync pair.
+
+    Raises:
+        ValueError: If a source or table entry is incomplete or names an unknown table
+    """
+    if not definition:
+        return {}
+    merge = {"sources": []}
+    names = set()
+    for source in definition.get("sources", []):
+        source = dict(source)
+        for required in ("name", "connector", "tables"):
+            if required not in source:
+                raise ValueError(f"Merge source of sync pair {sync_pair_id} missing required field: {required}")
+        if source["name"] in names or source["name"] == PRIMARY_SOURCE_NAME:
+            raise ValueError(f"Duplicate or reserved merge source name: {source['name']}")
+        names.add(source["name"])
+        if not source["connector"].get("type"):
+            raise ValueError(f"Merge source {source['name']} connector missing required field: type")
+        if source["connector"].get("throttle"):
+            source["connector"] = dict(source["connector"],
+                                       throttle=parse_throttle(source["connector"]["throttle"], default_timezone))
+
+        entries = []
+        for entry in source["tables"]:
+            entry = dict(entry)
+            for required in ("table", "source_table", "join"):
+                if required not in entry:
+                    raise ValueError(f"Merge source {source['name']} table entry missing required field: {required}")
+            if entry["table"] not in table_names:
+                raise ValueError(f"Merge source {source['name']} names unknown table {entry['table']}")
+            if not isinstance(entry["join"], dict) or not entry["join"]:
+                raise ValueError(f"Merge source {source['name']} join for {entry['table']} must map primary columns to source columns")
+            if isinstance(entry.get("columns"), list):
+                entry["columns"] = {column: column for column in entry["columns"]}
+            entries.append(entry)
+        source["tables"] = entries
+        merge["sources"].append(source)
+    return merge
+
+
+class MergeLookup:
+    """Joins one merge source's rows into the records of one table."""
+
+    def __init__(self, sync_pair_id: str, source: Dict[str, Any], entry: Dict[str, Any],
+                 table_def: Dict[str, Any], batch_size: int):
+        """
+        Initialize the lookup.
+
+        Args:
+            sync_pair_id: Sync pair the lookup belongs to
+            source: Merge source definition
+            entry: The source's entry for this table
+            table_def: Primary table definition
+            batch_size: Batch size for change reads
+        """
+        self.name = source["name"]
+        self.connector_config = source["connector"]
+        self.entry = entry
+        self.batch_size = batch_size
+        self.primary_columns = list(entry["join"].keys())
+        self.source_columns = list(entry["join"].values())
+        self.columns: Optional[Dict[str, str]] = entry.get("columns")
+        self.required = bool(entry.get("required", False))
+        # Definition of the merge source table, keyed by its join columns
+        self.source_def = {
+            "name": entry["source_table"],
+            "primary_key": self.source_columns,
+            "change_column": entry.get("change_column"),
+        }
+        # Primary table keyed by its join columns, for re-reading records a merge source changed
+        self.primary_lookup_def = dict(table_def, primary_key=self.primary_columns)
+        self.watermark_name = f"{table_def['name']}@{self.name}"
+        self.throttle = source_throttle(self.connector_config.get("throttle"), f"{sync_pair_id}@{self.name}")
+        self.connector = None
+
+    def open(self) -> None:
+        self.connector = create_connector(self.connector_config)
+        self.connector.connect()
+
+    def close(self) -> None:
+        if self.connector is not None:
+            self.connector.close()
+            self.connector = None
+
+    def current_version(self) -> Any:
+        """Change version of the merge source table, or None when it has no change_column."""
+        if not self.source_def["change_column"]:
+            return None
+        return self.connector.get_current_version(self.source_def)
+
+    def merge(self, records: List[Dict[str, Any]], stats: Dict[str, Any]) -> List[Tuple[Dict[str, Any], str]]:
+        """
+        Copy the merge source's columns into a batch of primary records in place.
+
+        Returns:
+            (record, error) for required matches that are missing
+        """
+        upserts = [r for r in records if r.get(OPERATION_FIELD) != "delete"]
+        if not upserts:
+            return []
+        keys, seen = [], set()
+        for record in upserts:
+            values = [record.get(column) for column in self.primary_columns]
+            if any(v is None for v in values):
+                continue
+            normalized = _join_key(values)
+            if normalized not in seen:
+                seen.add(normalized)
+                keys.append(values)
+        lookups = []
+        if keys:
+            for batch in throttled(iter([keys]), self.throttle, stats):
+                lookups = self.connector.fetch_records(self.source_def, batch)
+        rows = {_join_key([row.get(c) for c in self.source_columns]): row for row in lookups}
+
+        missing = []
+        for record in upserts:
+            row = rows.get(_join_key([record.get(column) for column in self.primary_columns]))
+            if row is None:
+                stats["missing"] = stats.get("missing", 0) + 1
+                if self.required:
+                    missing.append((record, f"No {self.name} record for {self._describe(record)}"))
+            else:
+                stats["matched"] = stats.get("matched", 0) + 1
+            for source_column, column in self._column_map(row).items():
+                record[column] = row.get(source_column) if row else None
+        return missing
+
+    def changed_keys(self, since_version: Any, until_version: Any, stats: Dict[str, Any]) -> Iterator[List[List[Any]]]:
+        """Yield primary join values of merge source rows changed in the version window."""
+        batches = self.connector.read_changes(self.source_def, since_version, until_version, self.batch_size)
+        for batch in throttled(batches, self.throttle, stats):
+            stats["changes_read"] = stats.get("changes_read", 0) + len(batch)
+            yield [[row.get(c) for c in self.source_columns] for row in batch]
+
+    def _column_map(self, row: Optional[Dict[str, Any]]) -> Dict[str, str]:
+        if self.columns is not None:
+            return self.columns
+        if row is None:
+            return {}
+        skip = set(self.source_columns) | set(RESERVED_FIELDS)
+        return {column: column for column in row if column not in skip}
+
+    def _describe(self, record: Dict[str, Any]) -> str:
+        return ", ".join(f"{column}={record.get(column)!r}" for column in self.primary_columns)
+
+
+class MergePlan:
+    """The merge lookups of one table."""
+
+    def __init__(self, lookups: List[MergeLookup]):
+        self.lookups = lookups
+
+    def open(self) -> None:
+        """Connect to every merge source of the table."""
+        try:
+            for lookup in self.lookups:
+                lookup.open()
+        except Exception:
+            self.close()
+            raise
+
+    def close(self) -> None:
+        for lookup in self.lookups:
+            lookup.close()
+
+    def merge(self, batch: List[Dict[str, Any]], result: Dict[str, Any]) -> List[Tuple[Dict[str, Any], List[str]]]:
+        """
+        Merge every lookup into one batch of primary records.
+
+        Returns:
+            (record, errors) for each record missing a required match
+        """
+        missing: Dict[int, Tuple[Dict[str, Any], List[str]]] = {}
+        for lookup in self.lookups:
+            for record, error in lookup.merge(batch, self.stats(result, lookup)):
+                missing.setdefault(id(record), (record, []))[1].append(error)
+        return list(missing.values())
+
+    @staticmethod
+    def stats(result: Dict[str, Any], lookup: MergeLookup) -> Dict[str, Any]:
+        """The merge source's entry in a table result."""
+        return result.setdefault("merge_sources", {}).setdefault(lookup.name, {"matched": 0, "missing": 0})
+
+
+def merges_table(merge: Dict[str, Any], table_name: str) -> bool:
+    """Whether any merge source joins into a table."""
+    return any(entry["table"] == table_name for source in merge.get("sources", []) for entry in source["tables"])
+
+
+def build_merge_plan(sync_pair_id: str, merge: Dict[str, Any], table_def: Dict[str, Any],
+                     batch_size: int) -> Optional[MergePlan]:
+    """Build the merge plan for a table, or None when no merge source covers it."""
+    lookups = [
+        MergeLookup(sync_pair_id, source, entry, table_def, batch_size)
+        for source in merge.get("sources", [])
+        for entry in source["tables"]
+        if entry["table"] == table_def["name"]
+    ]
+    return MergePlan(lookups) if lookups else None
@@ -0,0 +1,653 @@
+"""
+TerraFusion SyncService - OData Service
+
+This module provides a read-only OData v4 endpoint over the tables a sync
+pair keeps in its target, so Excel and Power BI can connect with their
+built-in OData feed connectors instead of a custom integration. A sync pair
+publishes its tables with an "odata" block:
+
+    "odata": {
+        "tables": ["dbo.property", "dbo.sales"],
+        "hidden_columns": ["owner_ssn", "owner_phone"],
+        "max_page_size": 5000
+    }
+
+("odata": true publishes every table.) Each target table is an entity set
+under /odata/v4/<sync_pair_id>/, described by $metadata, and supports
+$filter, $select, $orderby, $top, $skip and $count. $filter understands
+eq ne gt ge lt le, and/or/not, parentheses, in (...), and the contains,
+startswith and endswith functions; literals are 'strings', numbers, true,
+false, null, dates and date-times. Single rows are addressed by key, e.g.
+parcels(12345) or parcels(county='R1',prop_id=12345).
+
+Results are paged by the server: a page holds at most ODATA_MAX_PAGE_SIZE
+rows (or fewer when the client sends Prefer: odata.maxpagesize), and
+@odata.nextLink points at the next page. Pages are ordered by the requested
+$orderby with the primary key appended, and the link's $skiptoken is an
+opaque cursor holding the sort values of the page's last row, so the next
+page starts after that row: rows written while a client pages neither repeat
+nor shift the pages that follow, and deep pages cost no OFFSET scan. (Pages
+ordered by a column outside the primary key, which may hold nulls, or by a
+hidden key column, continue by offset from the last row that anchored one.)
+Numeric $skiptoken values from older nextLinks are still honored as offsets
+while PAGINATION_OFFSET_ENABLED is true (see pagination).
+"""
+
+import os
+import re
+import json
+import base64
+import logging
+from decimal import Decimal
+from datetime import date, datetime, time
+from urllib.parse import quote
+from xml.sax.saxutils import quoteattr
+from typing import Dict, List, Any, Optional, Tuple
+
+from sync_connectors import ConnectorError, create_connector, keyset_after
+from pagination import CursorError, encode_cursor, decode_cursor, scope_of, OFFSET_PAGING_ENABLED
+from sync_hooks import build_pipeline
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Rows per page when neither the sync pair nor the client asks for fewer
+DEFAULT_MAX_PAGE_SIZE = int(os.environ.get("ODATA_MAX_PAGE_SIZE", "1000"))
+
+# OData protocol version sent with every response
+ODATA_VERSION = "4.0"
+
+# Target column types to EDM types, first match wins (unmatched types are strings)
+EDM_TYPES = [
+    (r"^bool", "Edm.Boolean"),
+    (r"^interval", "Edm.String"),
+    (r"int|^serial|^bigserial", "Edm.Int64"),
+    (r"^numeric|^decimal|^money", "Edm.Decimal"),
+    (r"^real|^double|^float", "Edm.Double"),
+    (r"^timestamp|^datetime", "Edm.DateTimeOffset"),
+    (r"^date$", "Edm.Date"),
+    (r"^time", "Edm.TimeOfDay"),
+    (r"^uuid$", "Edm.Guid"),
+    (r"^bytea$|^blob$|^geometry$|^geography$", "Edm.Binary"),
+]
+
+# EDM types whose $filter literals are numbers
+NUMERIC_TYPES = {"Edm.Int64", "Edm.Decimal", "Edm.Double"}
+
+COMPARISONS = {"eq": "=", "ne": "!=", "gt": ">", "ge": ">=", "lt": "<", "le": "<="}
+
+STRING_FUNCTIONS = {"contains": "%{}%", "startswith": "{}%", "endswith": "%{}"}
+
+KEYWORDS = {"and", "or", "not", "in", "null", "true", "false"} | set(COMPARISONS)
+
+# System query options the service understands; other $ options are rejected
+QUERY_OPTIONS = {"$filter", "$select", "$orderby", "$top", "$skip", "$count", "$skiptoken", "$format"}
+
+TOKEN_PATTERN = re.compile(r"""
+    \s*(?:
+        (?P<datetime>\d{4}-\d{2}-\d{2}T\d{2}:\d{2}(?::\d{2}(?:\.\d+)?)?(?:Z|[+-]\d{2}:\d{2})?)
+      | (?P<date>\d{4}-\d{2}-\d{2})
+      | (?P<number>-?\d+(?:\.\d+)?(?:[eE][+-]?\d+)?)
+      | '(?P<string>(?:[^']|'')*)'
+      | (?P<name>[A-Za-z_][A-Za-z0-9_]*)
+      | (?P<punct>[(),=])
+    )""", re.VERBOSE)
+
+KEY_PREDICATE = re.compile(r"^([A-Za-z_][A-Za-z0-9_]*)\((.*)\)$", re.DOTALL)
+
+
+class ODataError(ValueError):
+    """Raised when an OData request is invalid."""
+
+
+def parse_odata(sync_pair_id: str, definition: Any, table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the "odata" block of a sync pair.
+
+    Returns:
+        The OData settings, empty when the sync pair is not published
+    """
+    if not definition:
+        return {}
+    odata = dict(definition) if isinstance(definition, dict) else {}
+    for name in odata.get("tables", []):
+        if name not in table_names:
+            raise ValueError(f"Sync pair {sync_pair_id}: OData names unknown table {name}")
+    if "max_page_size" in odata and int(odata["max_page_size"]) < 1:
+        raise ValueError(f"Sync pair {sync_pair_id}: OData max_page_size must be positive")
+    odata.setdefault("hidden_columns", [])
+    return odata
+
+
+def entity_set_name(table_name: str) -> str:
+    """The OData name of a target table (an identifier, so schema dots become underscores)."""
+    name = re.sub(r"\W", "_", table_name)
+    return f"_{name}" if name[:1].isdigit() else name
+
+
+def edm_type(column_type: str) -> str:
+    """The EDM type of a target column type."""
+    column_type = (column_type or "").lower()
+    for pattern, edm in EDM_TYPES:
+        if re.search(pattern, column_type):
+            return edm
+    return "Edm.String"
+
+
+def _tokenize(text: str) -> List[Tuple[str, Any]]:
+    tokens = []
+    position = 0
+    text = text.rstrip()
+    while position < len(text):
+        match = TOKEN_PATTERN.match(text, position)
+        if not match or match.end() == position:
+            raise ODataError(f"Unexpected character at position {position} in $filter: {text[position:position + 20]!r}")
+        position = match.end()
+        kind = match.lastgroup
+        value = match.group(kind)
+        if kind == "datetime":
+            tokens.append(("literal", datetime.fromisoformat(value.replace("Z", "+00:00"))))
+        elif kind == "date":
+            tokens.append(("literal", date.fromisoformat(value)))
+        elif kind == "number":
+            tokens.append(("literal", int(value) if re.fullmatch(r"-?\d+", value) else Decimal(value)))
+        elif kind == "string":
+            tokens.append(("literal", value.replace("''", "'")))
+        elif kind == "name" and value in KEYWORDS:
+            if value in ("true", "false"):
+                tokens.append(("literal", value == "true"))
+            elif value == "null":
+                tokens.append(("literal", None))
+            else:
+                tokens.append(("keyword", value))
+        elif kind == "name":
+            tokens.append(("field", value))
+        else:
+            tokens.append(("punct", value))
+    return tokens
+
+
+def _like_literal(text: str) -> str:
+    """Escape SQL LIKE wildcards in a string function argument."""
+    return text.replace("\\", "\\\\").replace("%", "\\%").replace("_", "\\_")
+
+
+class FilterParser:
+    """Parses a $filter expression into a query expression (see sync_connectors.compile_where)."""
+
+    def __init__(self, text: str, columns: Dict[str, str]):
+        """
+        Initialize the parser.
+
+        Args:
+            text: The $filter expression
+            columns: EDM type of each column the expression may name
+        """
+        self.text = text
+        self.columns = columns
+        self._tokens = _tokenize(text)
+        self._position = 0
+
+    def parse(self) -> Tuple:
+        """
+        Parse the expression.
+
+        Raises:
+            ODataError: If the expression is invalid or names an unknown property
+        """
+        if not self._tokens:
+            raise ODataError("$filter is empty")
+        tree = self._parse_or()
+        if self._position != len(self._tokens):
+            raise ODataError(f"Unexpected {str(self._tokens[self._position][1])!r} in $filter: {self.text}")
+        return tree
+
+    def _peek(self) -> Tuple[Optional[str], Any]:
+        if self._position < len(self._tokens):
+            return self._tokens[self._position]
+        return None, None
+
+    def _take(self, kind: Optional[str] = None, value: Any = None) -> Tuple[str, Any]:
+        token = self._peek()
+        if token[0] is None:
+            raise ODataError(f"$filter ends unexpectedly: {self.text}")
+        if (kind and token[0] != kind) or (value is not None and token[1] != value):
+            raise ODataError(f"Expected {value or kind} but found {str(token[1])!r} in $filter: {self.text}")
+        self._position += 1
+        return token
+
+    def _accept(self, kind: str, value: Any = None) -> bool:
+        token = self._peek()
+        if token[0] == kind and (value is None or token[1] == value):
+            self._position += 1
+            return True
+        return False
+
+    def _parse_or(self):
+        node = self._parse_and()
+        while self._accept("keyword", "or"):
+            node = ("or", node, self._parse_and())
+        return node
+
+    def _parse_and(self):
+        node = self._parse_not()
+        while self._accept("keyword", "and"):
+            node = ("and", node, self._parse_not())
+        return node
+
+    def _parse_not(self):
+        if self._accept("keyword", "not"):
+            return ("not", self._parse_not())
+        return self._parse_comparison()
+
+    def _parse_comparison(self):
+        if self._accept("punct", "("):
+            node = self._parse_or()
+            self._take("punct", ")")
+            return node
+
+        kind, value = self._peek()
+        if kind == "field" and value in STRING_FUNCTIONS:
+            return self._parse_function()
+
+        left = self._parse_operand()
+        kind, value = self._peek()
+        if kind == "keyword" and value in COMPARISONS:
+            self._take()
+            right = self._parse_operand()
+            if left[0] == "field" and right[0] == "literal":
+                right = ("literal", self._literal(left[1], right[1]))
+            elif right[0] == "field" and left[0] == "literal":
+                left = ("literal", self._literal(right[1], left[1]))
+            elif left[0] != "field":
+                raise ODataError(f"Comparison {value} needs a property in $filter: {self.text}")
+            return ("compare", COMPARISONS[value], left, right)
+        if kind == "keyword" and value == "in":
+            self._take()
+            if left[0] != "field":
+                raise ODataError(f"in needs a property in $filter: {self.text}")
+            self._take("punct", "(")
+            values = [self._literal(left[1], self._take("literal")[1])]
+            while self._accept("punct", ","):
+                values.append(self._literal(left[1], self._take("literal")[1]))
+            self._take("punct", ")")
+            return ("in", left, values)
+        if left[0] == "field" and self.columns[left[1]] == "Edm.Boolean":
+            return ("compare", "=", left, ("literal", True))
+        raise ODataError(f"Expected a comparison after {str(left[1])!r} in $filter: {self.text}")
+
+    def _parse_function(self):
+        name = self._take("field")[1]
+        self._take("punct", "(")
+        field = self._parse_operand()
+        self._take("punct", ",")
+        argument = self._take("literal")[1]
+        self._take("punct", ")")
+        if field[0] != "field" or not isinstance(argument, str):
+            raise ODataError(f"{name} takes a property and a string in $filter: {self.text}")
+        return ("like", field, STRING_FUNCTIONS[name].format(_like_literal(argument)))
+
+    def _parse_operand(self):
+        kind, value = self._peek()
+        if kind == "field":
+            self._take()
+            if value not in self.columns:
+                raise ODataError(f"Unknown property {value} in $filter")
+            return ("field", value)
+        if kind == "literal":
+            self._take()
+            return ("literal", value)
+        if kind is None:
+            raise ODataError(f"$filter ends unexpectedly: {self.text}")
+        raise ODataError(f"Expected a property or value but found {str(value)!r} in $filter: {self.text}")
+
+    def _literal(self, column: str, value: Any) -> Any:
+        return check_literal(column, self.columns[column], value)
+
+
+def check_literal(column: str, column_type: str, value: Any) -> Any:
+    """
+    Check that a literal suits the property it is compared with.
+
+    Raises:
+        ODataError: If a string property meets a number or a numeric property a string
+    """
+    if value is None:
+        return value
+    if column_type == "Edm.String" and not isinstance(value, str):
+        raise ODataError(f"Property {column} is a string; compare it with a quoted value")
+    if column_type in NUMERIC_TYPES and (isinstance(value, bool) or not isinstance(value, (int, Decimal))):
+        raise ODataError(f"Property {column} is numeric; compare it with a number")
+    return value
+
+
+def _json_value(value: Any, column_type: str) -> Any:
+    """A row value in its OData JSON representation."""
+    if value is None or isinstance(value, (bool, str)):
+        return value
+    if isinstance(value, Decimal):
+        return int(value) if column_type == "Edm.Int64" else float(value)
+    if isinstance(value, datetime):
+        text = value.isoformat()
+        return text + "Z" if value.tzinfo is None and column_type == "Edm.DateTimeOffset" else text
+    if isinstance(value, (date, time)):
+        return value.isoformat()
+    if isinstance(value, (bytes, bytearray, memoryview)):
+        return base64.b64encode(bytes(value)).decode("ascii")
+    if isinstance(value, (int, float)):
+        return value
+    if isinstance(value, (dict, list)):
+        return json.dumps(value, default=str)
+    return str(value)
+
+
+class ODataService:
+    """Answers OData requests from the target tables of published sync pairs."""
+
+    def __init__(self, registry):
+        """
+        Initialize the service.
+
+        Args:
+            registry: Sync pair registry the entity sets come from
+        """
+        self.registry = registry
+
+    def service_document(self, sync_pair_id: str, service_root: str) -> Dict[str, Any]:
+        """
+        The service document listing a sync pair's entity sets.
+
+        Raises:
+            KeyError: If the sync pair is not configured or not published
+        """
+        pair = self._pair(sync_pair_id)
+        entity_sets = self._entity_sets(pair)
+        with create_connector(pair.target) as target:
+            described = self._described(pair, target, entity_sets)
+        return {
+            "@odata.context": f"{service_root}$metadata",
+            "value": [{"name": name, "kind": "EntitySet", "url": name} for name in described],
+        }
+
+    def metadata(self, sync_pair_id: str) -> str:
+        """
+        The CSDL $metadata document of a sync pair.
+
+        Tables that have not been created in the target yet are left out.
+
+        Raises:
+            KeyError: If the sync pair is not configured or not published
+        """
+        pair = self._pair(sync_pair_id)
+        entity_sets = self._entity_sets(pair)
+        namespace = f"TerraFusion.{entity_set_name(sync_pair_id)}"
+        types, sets = [], []
+        with create_connector(pair.target) as target:
+            described = self._described(pair, target, entity_sets)
+        for name, columns in described.items():
+            table_def = entity_sets[name]
+            key_xml = "".join(f"<PropertyRef Name={quoteattr(c)}/>" for c in table_def["primary_key"])
+            properties = "".join(
+                f"<Property Name={quoteattr(c['name'])} Type={quoteattr(c['edm_type'])}"
+                f"{self._nullable(c, table_def)}/>"
+                for c in columns
+            )
+            types.append(f"<EntityType Name={quoteattr(name)}><Key>{key_xml}</Key>{properties}</EntityType>")
+            sets.append(f"<EntitySet Name={quoteattr(name)} EntityType={quoteattr(f'{namespace}.{name}')}/>")
+        return (
+            '<?xml version="1.0" encoding="utf-8"?>'
+            '<edmx:Edmx Version="4.0" xmlns:edmx="http://docs.oasis-open.org/odata/ns/edmx">'
+            '<edmx:DataServices>'
+            f'<Schema Namespace={quoteattr(namespace)} xmlns="http://docs.oasis-open.org/odata/ns/edm">'
+            f'{"".join(types)}<EntityContainer Name="Container">{"".join(sets)}</EntityContainer>'
+            '</Schema></edmx:DataServices></edmx:Edmx>'
+        )
+
+    def read(self, sync_pair_id: str, resource: str, options: Dict[str, str], service_root: str,
+             prefer: Optional[str] = None) -> Tuple[Any, Dict[str, str]]:
+        """
+        Read an entity set, one entity or an entity set's $count.
+
+        Args:
+            sync_pair_id: Published sync pair
+            resource: Path below the service root, e.g. "parcels", "parcels(12345)" or "parcels/$count"
+            options: Query string parameters
+            service_root: Absolute URL of the sync pair's service root (ending in /)
+            prefer: The request's Prefer header
+
+        Returns:
+            The response payload (a row count for $count) and extra response headers
+
+        Raises:
+            KeyError: If the sync pair, entity set or entity does not exist
+            ODataError: If the request is invalid
+        """
+        unknown = [name for name in options if name.startswith("$") and name not in QUERY_OPTIONS]
+        if unknown:
+            raise ODataError(f"Unsupported query option {unknown[0]}")
+        if options.get("$format", "json").split(";")[0] not in ("json", "application/json"):
+            raise ODataError("Only the JSON format is supported")
+
+        pair = self._pair(sync_pair_id)
+        entity_sets = self._entity_sets(pair)
+        count_only = resource.endswith("/$count")
+        name = resource[:-len("/$count")] if count_only else resource
+        key_text = None
+        match = KEY_PREDICATE.match(name)
+        if match:
+            name, key_text = match.group(1), match.group(2)
+        if name not in entity_sets:
+            raise KeyError(f"Entity set {name} not found")
+        table_def = entity_sets[name]
+
+        with create_connector(pair.target) as target:
+            try:
+                columns = {c["name"]: c["edm_type"] for c in self._columns(pair, target, table_def)}
+            except ConnectorError:
+                # Not created in the target yet, and so not in $metadata either
+                raise KeyError(f"Entity set {name} not found")
+            where = FilterParser(options["$filter"], columns).parse() if options.get("$filter") else None
+
+            if count_only:
+                return target.count_records(table_def, where), {}
+
+            selected = self._select(options.get("$select"), columns)
+            context = f"{service_root}$metadata#{name}"
+            if selected:
+                context += f"({','.join(selected)})"
+            if key_text is not None:
+                key_where = self._key(key_text, columns, table_def)
+                rows = target.query_records(table_def, key_where, selected or list(columns), limit=1)
+                if not rows:
+                    raise KeyError(f"Entity {name}({key_text}) not found")
+                entity = {"@odata.context": f"{context}/$entity"}
+                entity.update(self._row(rows[0], columns))
+                return entity, {}
+
+            order_by = self._order_by(options.get("$orderby"), columns, table_def)
+            top = self._integer(options, "$top")
+            skip = self._integer(options, "$skip") or 0
+            scope = scope_of(f"odata:{sync_pair_id}:{name}", {k: v for k, v in options.items() if k != "$skiptoken"})
+            position = self._position(options.get("$skiptoken"), scope, skip)
+            returned = position["n"]
+            page_size, headers = self._page_size(pair, prefer)
+            if position.get("legacy"):
+                headers["Deprecation"] = "true"
+            remaining = None if top is None else max(0, top - returned)
+            wanted = page_size if remaining is None else min(page_size, remaining)
+
+            order_columns = [column for column, _ in order_by]
+            page_where = where
+            if position.get("after") is not None:
+                after = keyset_after(order_columns, position["after"], [desc for _, desc in order_by])
+                page_where = after if where is None else ("and", where, after)
+            # Sort columns are read even when not selected, to anchor the next page
+            query_columns = list(dict.fromkeys(selected + [c for c in order_columns if c in columns])) if selected else list(columns)
+            rows = target.query_records(table_def, page_where, query_columns, order_by,
+                                        limit=wanted + 1, offset=position["offset"]) if wanted else []
+            payload = {"@odata.context": context}
+            if options.get("$count", "false").lower() == "true":
+                payload["@odata.count"] = target.count_records(table_def, where)
+            payload["value"] = [self._row({c: v for c, v in row.items() if not selected or c in selected}, columns)
+                                for row in rows[:wanted]]
+            if len(rows) > wanted and (remaining is None or remaining > wanted):
+                last = [rows[wanted - 1].get(column) for column in order_columns]
+                # Only key columns anchor a page: a null sort value has no place
+                # the databases agree on, so other orders continue by offset
+                if set(order_columns) <= set(table_def["primary_key"]) & set(columns) and None not in last:
+                    following = {"n": returned + wanted, "after": last, "offset": 0}
+                else:
+                    following = {"n": returned + wanted, "after": position.get("after"),
+                                 "offset": position["offset"] + wanted}
+                next_options = {k: v for k, v in options.items() if k != "$skiptoken"}
+                next_options["$skiptoken"] = encode_cursor(following, scope)
+                query = "&".join(f"{quote(k, safe='$')}={quote(v, safe='')}" for k, v in next_options.items())
+                payload["@odata.nextLink"] = f"{service_root}{name}?{query}"
+            return payload, headers
+
+    # Helpers ----------------------------------------------------------------
+
+    def _pair(self, sync_pair_id: str):
+        pair = self.registry.get(sync_pair_id)
+        if not pair.odata:
+            raise KeyError(f"Sync pair {sync_pair_id} is not published over OData")
+        return pair
+
+    @staticmethod
+    def _entity_sets(pair) -> Dict[str, Dict[str, Any]]:
+        """Target table definitions of the published tables, by entity set name."""
+        published = pair.odata.get("tables") or [t.name for t in pair.tables]
+        entity_sets = {}
+        for table in pair.tables:
+            if table.name not in published:
+                continue
+            table_def = build_pipeline(pair.hooks, table.name).target_table(table.to_dict())
+            # Merged tables share a target table; the first one names it
+            entity_sets.setdefault(entity_set_name(table_def.get("target_table") or table.name), table_def)
+        return entity_sets
+
+    def _described(self, pair, target, entity_sets: Dict[str, Dict[str, Any]]) -> Dict[str, List[Dict[str, Any]]]:
+        """Published columns of the entity sets whose tables exist in the target."""
+        described = {}
+        for name, table_def in entity_sets.items():
+            try:
+                described[name] = self._columns(pair, target, table_def)
+            except ConnectorError as e:
+                logger.info(f"Leaving {name} out of the OData service of {pair.sync_pair_id}: {str(e)}")
+        return described
+
+    @staticmethod
+    def _columns(pair, target, table_def: Dict[str, Any]) -> List[Dict[str, Any]]:
+        """The published columns of a target table with their EDM types."""
+        try:
+            description = target.describe_table(table_def)
+        except NotImplementedError as e:
+            raise ODataError(str(e))
+        hidden = set(pair.odata.get("hidden_columns", []))
+        return [dict(c, edm_type=edm_type(c["type"])) for c in description["columns"] if c["name"] not in hidden]
+
+    @staticmethod
+    def _nullable(column: Dict[str, Any], table_def: Dict[str, Any]) -> str:
+        if column["nullable"] and column["name"] not in table_def["primary_key"]:
+            return ""
+        return ' Nullable="false"'
+
+    @staticmethod
+    def _row(row: Dict[str, Any], columns: Dict[str, str]) -> Dict[str, Any]:
+        return {name: _json_value(value, columns.get(name, "Edm.String")) for name, value in row.items()}
+
+    @staticmethod
+    def _select(text: Optional[str], columns: Dict[str, str]) -> List[str]:
+        if not text or text.strip() == "*":
+            return []
+        selected = [name.strip() for name in text.split(",") if name.strip()]
+        for name in selected:
+            if name not in columns:
+                raise ODataError(f"Unknown property {name} in $select")
+        return selected
+
+    @staticmethod
+    def _order_by(text: Optional[str], columns: Dict[str, str], table_def: Dict[str, Any]) -> List[Tuple[str, bool]]:
+        order_by = []
+        for part in (text or "").split(","):
+            words = part.split()
+            if not words:
+                continue
+            if len(words) > 2 or (len(words) == 2 and words[1] not in ("asc", "desc")):
+                raise ODataError(f"Invalid $orderby item: {part.strip()}")
+            if words[0] not in columns:
+                raise ODataError(f"Unknown property {words[0]} in $orderby")
+            order_by.append((words[0], len(words) == 2 and words[1] == "desc"))
+        ordered = {column for column, _ in order_by}
+        # The primary key makes the order total, so pages neither repeat nor skip rows
+        order_by.extend((column, False) for column in table_def["primary_key"] if column not in ordered)
+        return order_by
+
+    @staticmethod
+    def _key(text: str, columns: Dict[str, str], table_def: Dict[str, Any]) -> Tuple:
+        """The query expression of a key predicate: (value) or (column=value,...)."""
+        tokens = _tokenize(text)
+        key_columns = list(table_def["primary_key"])
+        values = {}
+        if len(tokens) == 1 and tokens[0][0] == "literal" and len(key_columns) == 1:
+            values[key_columns[0]] = tokens[0][1]
+        else:
+            for position in range(0, len(tokens), 4):
+                part = tokens[position:position + 4]
+                if (len(part) < 3 or part[0][0] != "field" or part[1] != ("punct", "=") or part[2][0] != "literal"
+                        or (len(part) == 4 and part[3] != ("punct", ","))):
+                    raise ODataError(f"Invalid key predicate ({text})")
+                values[part[0][1]] = part[2][1]
+        if sorted(values) != sorted(key_columns):
+            raise ODataError(f"Key predicate must name {', '.join(key_columns)}")
+        tree = None
+        for column in key_columns:
+            value = check_literal(column, columns.get(column, "Edm.String"), values[column])
+            node = ("compare", "=", ("field", column), ("literal", value))
+            tree = node if tree is None else ("and", tree, node)
+        return tree
+
+    @staticmethod
+    def _position(token: Optional[str], scope: str, skip: int) -> Dict[str, Any]:
+        """
+        Where a page starts: rows returned before it, the sort values it
+        follows (if any) and the rows to skip after them.
+        """
+        if token is None:
+            return {"n": 0, "after": None, "offset": skip}
+        if token.isdigit():
+            # A nextLink issued before cursors: the rows already returned
+            if not OFFSET_PAGING_ENABLED:
+                raise ODataError("Numeric $skiptoken values are no longer accepted; follow @odata.nextLink")
+            return {"n": int(token), "after": None, "offset": skip + int(token), "legacy": True}
+        try:
+            position = decode_cursor(token, scope)
+        except CursorError as e:
+            raise ODataError(f"Invalid $skiptoken: {e}")
+        if (not isinstance(position.get("n"), int) or not isinstance(position.get("offset"), int)
+                or not isinstance(position.get("after"), (list, type(None)))):
+            raise ODataError("Invalid $skiptoken")
+        return position
+
+    @staticmethod
+    def _integer(options: Dict[str, str], name: str) -> Optional[int]:
+        if name not in options:
+            return None
+        try:
+            value = int(options[name])
+        except ValueError:
+            raise ODataError(f"{name} must be a non-negative integer")
+        if value < 0:
+            raise ODataError(f"{name} must be a non-negative integer")
+        return value
+
+    @staticmethod
+    def _page_size(pair, prefer: Optional[str]) -> Tuple[int, Dict[str, str]]:
+        """The page size for a request and the Preference-Applied header when the client asked for one."""
+        page_size = int(pair.odata.get("max_page_size", DEFAULT_MAX_PAGE_SIZE))
+        match = re.search(r"odata\.maxpagesize\s*=\s*(\d+)", prefer or "")
+        if match and int(match.group(1)) > 0:
+            page_size = min(page_size, int(match.group(1)))
+            return page_size, {"Preference-Applied": f"odata.maxpagesize={page_size}"}
+        return page_size, {}
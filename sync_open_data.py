@@ -0,0 +1,737 @@
+"""
+TerraFusion SyncService - Open Data Publishing
+
+This module keeps datasets on the county's open data portal (Socrata or
+CKAN) current with the synced tables. A sync pair lists the datasets it
+publishes in an "open_data" block:
+
+    "open_data": {
+        "portal": {"type": "socrata", "domain": "data.co.benton.wa.us",
+                   "app_token_env_var": "SOCRATA_APP_TOKEN",
+                   "username_env_var": "SOCRATA_USER", "password_env_var": "SOCRATA_PASSWORD"},
+        "datasets": [
+            {"name": "parcels", "table": "dbo.property", "dataset_id": "abcd-1234",
+             "columns": {"prop_id": {"name": "parcel_id", "title": "Parcel ID"},
+                         "situs_address": "site_address", "market_value": "market_value"},
+             "where": "confidential = false",
+             "schedule": "0 4 * * *", "timezone": "America/Los_Angeles"}
+        ]
+    }
+
+Datasets are sanitized by construction: only the listed target columns are
+published (under their portal field names), and "where" (the sync_filters
+expression language, over target column names) drops rows that must not
+be public. A dataset with "redaction" also gets that redaction policy of
+the county (see redaction): its fields are published masked or hashed, or
+empty when the policy removes them. In "upsert" mode (the default) each run sends only rows that
+changed since the last run and deletes rows that were removed or stopped
+matching; "replace" mode replaces the dataset's rows whenever anything
+changed. Every run that changes the dataset is a new version: the version
+number is written to the portal (a custom metadata field on Socrata, the
+package version on CKAN) and kept in the publishing history.
+
+Runs are started by the dataset's cron schedule (when publishing is enabled
+with OPEN_DATA_PUBLISHING_ENABLED) or through the API.
+"""
+
+import os
+import json
+import uuid
+import hashlib
+import logging
+import threading
+from decimal import Decimal
+from datetime import datetime, timezone
+from typing import Dict, List, Any, Optional, Tuple
+
+import requests
+
+from sync_store import DocumentStore, sync_state_store
+from sync_connectors import create_connector, record_key, _env_setting
+from sync_filters import FilterExpression
+from sync_hooks import build_pipeline
+from sync_odata import edm_type
+from audit_log import AuditLog
+from redaction import RedactionPolicies, Redactor, redaction_policies
+from tracing import tracer
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collections: publishing state and history per dataset, and the
+# hash of every published row (to find the rows that changed)
+DATASETS_COLLECTION = "open_data_datasets"
+ROWS_COLLECTION = "open_data_rows"
+
+PUBLISH_MODES = ["upsert", "replace"]
+
+# Rows per portal request and per target read
+DEFAULT_PUBLISH_BATCH_SIZE = 5000
+
+# Publishing history entries kept per dataset
+VERSIONS_KEPT = 20
+
+# Seconds between checks for due datasets
+POLL_SECONDS = int(os.environ.get("OPEN_DATA_POLL_SECONDS", "60"))
+
+DEFAULT_PORTAL_TIMEOUT = 120
+
+# Username recorded for scheduled runs
+PUBLISHER_USERNAME = "open-data-publisher"
+
+# EDM types (see sync_odata) to portal column types; others are text
+SOCRATA_TYPES = {"Edm.Boolean": "checkbox", "Edm.Int64": "number", "Edm.Decimal": "number",
+                 "Edm.Double": "number", "Edm.Date": "calendar_date", "Edm.DateTimeOffset": "calendar_date"}
+CKAN_TYPES = {"Edm.Boolean": "bool", "Edm.Int64": "int", "Edm.Decimal": "numeric", "Edm.Double": "float",
+              "Edm.Date": "date", "Edm.DateTimeOffset": "timestamp"}
+
+
+class OpenDataError(Exception):
+    """Raised when the portal rejects a request."""
+
+
+def _portal_value(value: Any) -> Any:
+    """A row value as the portals accept it in JSON."""
+    if value is None or isinstance(value, (bool, str, int, float)):
+        return value
+    if isinstance(value, Decimal):
+        return str(value)
+    if hasattr(value, "isoformat"):
+        return value.isoformat()
+    if isinstance(value, (bytes, bytearray, memoryview)):
+        return bytes(value).hex()
+    return json.dumps(value, default=str)
+
+
+def _digest(value: Any) -> str:
+    return hashlib.sha256(json.dumps(value, sort_keys=True, default=str).encode("utf-8")).hexdigest()[:32]
+
+
+class OpenDataPortal:
+    """Base class for open data portals."""
+
+    portal_type = "base"
+
+    def __init__(self, config: Dict[str, Any]):
+        """
+        Initialize the portal client.
+
+        Args:
+            config: The "portal" block of the sync pair's open_data settings
+        """
+        self.config = config
+        self.timeout = float(config.get("timeout_seconds", DEFAULT_PORTAL_TIMEOUT))
+        self.session = None
+
+    def connect(self) -> None:
+        if self.session is None:
+            self.session = tracer.traced_session(requests.Session())
+            self.session.verify = self.config.get("verify_ssl", True)
+
+    def close(self) -> None:
+        if self.session is not None:
+            self.session.close()
+            self.session = None
+
+    def __enter__(self):
+        self.connect()
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        self.close()
+
+    def prepare(self, dataset: Dict[str, Any], fields: List[Dict[str, Any]]) -> None:
+        """
+        Make sure the dataset exists with the published fields and their metadata.
+
+        Args:
+            dataset: Dataset settings
+            fields: Published fields, each with "name", "title", "description" and "type" (EDM)
+
+        Raises:
+            OpenDataError: If the dataset cannot be used
+        """
+        raise NotImplementedError
+
+    def upsert(self, dataset: Dict[str, Any], rows: List[Dict[str, Any]]) -> None:
+        """Insert or update rows by the dataset's key fields."""
+        raise NotImplementedError
+
+    def delete(self, dataset: Dict[str, Any], keys: List[Dict[str, Any]]) -> None:
+        """Delete rows by their key field values."""
+        raise NotImplementedError
+
+    def replace(self, dataset: Dict[str, Any], rows: List[Dict[str, Any]]) -> None:
+        """Replace all rows of the dataset."""
+        raise NotImplementedError
+
+    def set_version(self, dataset: Dict[str, Any], version: int, published_at: str) -> None:
+        """Record the published version on the dataset."""
+        raise NotImplementedError
+
+    def health_check(self) -> Dict[str, Any]:
+        return {"portal_type": self.portal_type, "status": "unknown"}
+
+    def _request(self, method: str, url: str, **kwargs) -> Any:
+        """Send a request and return the decoded JSON body."""
+        self.connect()
+        try:
+            response = self.session.request(method, url, timeout=self.timeout, **kwargs)
+        except requests.RequestException as e:
+            raise OpenDataError(f"{self.portal_type} request to {url} failed: {e}")
+        try:
+            body = response.json() if response.content else None
+        except ValueError:
+            body = None
+        if response.status_code >= 400:
+            message = (body or {}).get("message") if isinstance(body, dict) else None
+            if isinstance(body, dict) and isinstance(body.get("error"), dict):
+                message = body["error"].get("message") or json.dumps(body["error"])
+            raise OpenDataError(f"{self.portal_type} request to {url} failed with {response.status_code}: "
+                                f"{message or response.text[:500]}")
+        return body
+
+
+class SocrataPortal(OpenDataPortal):
+    """
+    Publishes to a Socrata (Tyler Data & Insights) domain through the SODA API.
+
+    Configuration:
+        domain: The portal domain, e.g. data.co.benton.wa.us
+        app_token: Application token (sent as X-App-Token)
+        username / password: Account, or API key ID and secret, allowed to edit the datasets
+
+    The datasets must exist, with a column for every published field and the
+    key field set as the row identifier; publishing updates column names and
+    descriptions, upserts and deletes rows, and writes the version to the
+    "TerraFusion" custom metadata fields.
+    """
+
+    portal_type = "socrata"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        domain = _env_setting(config, "domain") or ""
+        self.url = (domain if domain.startswith(("http://", "https://")) else f"https://{domain}").rstrip("/")
+        self._views: Dict[str, Dict[str, Any]] = {}
+
+    def connect(self) -> None:
+        if self.session is None:
+            super().connect()
+            token = _env_setting(self.config, "app_token")
+            if token:
+                self.session.headers["X-App-Token"] = token
+            username = _env_setting(self.config, "username")
+            if username:
+                self.session.auth = (username, _env_setting(self.config, "password") or "")
+
+    def prepare(self, dataset: Dict[str, Any], fields: List[Dict[str, Any]]) -> None:
+        dataset_id = dataset["dataset_id"]
+        view = self._request("GET", f"{self.url}/api/views/{dataset_id}.json")
+        columns = {c.get("fieldName"): c for c in view.get("columns", [])}
+        missing = [f["name"] for f in fields if f["name"] not in columns]
+        if missing:
+            raise OpenDataError(f"Socrata dataset {dataset_id} has no column for {', '.join(missing)}")
+        for field in fields:
+            column = columns[field["name"]]
+            update = {"name": field["title"], "description": field.get("description") or ""}
+            if column.get("name") != update["name"] or (column.get("description") or "") != update["description"]:
+                self._request("PUT", f"{self.url}/api/views/{dataset_id}/columns/{column['id']}.json", json=update)
+            expected = SOCRATA_TYPES.get(field["type"], "text")
+            if column.get("dataTypeName") not in (expected, None):
+                logger.warning(f"Socrata column {dataset_id}.{field['name']} is {column.get('dataTypeName')}, "
+                               f"published values are {expected}")
+        self._views[dataset_id] = view
+
+    def upsert(self, dataset: Dict[str, Any], rows: List[Dict[str, Any]]) -> None:
+        self._send(dataset, rows)
+
+    def delete(self, dataset: Dict[str, Any], keys: List[Dict[str, Any]]) -> None:
+        self._send(dataset, [dict(key, **{":deleted": True}) for key in keys])
+
+    def replace(self, dataset: Dict[str, Any], rows: List[Dict[str, Any]]) -> None:
+        batch_size = int(dataset["batch_size"])
+        # PUT replaces every row with the first batch; the rest are appended
+        self._check(self._request("PUT", self._resource_url(dataset), json=rows[:batch_size]))
+        self._send(dataset, rows[batch_size:])
+
+    def set_version(self, dataset: Dict[str, Any], version: int, published_at: str) -> None:
+        dataset_id = dataset["dataset_id"]
+        view = self._views.get(dataset_id) or self._request("GET", f"{self.url}/api/views/{dataset_id}.json")
+        metadata = dict(view.get("metadata") or {})
+        custom_fields = dict(metadata.get("custom_fields") or {})
+        custom_fields["TerraFusion"] = {"Version": str(version), "Published": published_at}
+        metadata["custom_fields"] = custom_fields
+        self._request("PUT", f"{self.url}/api/views/{dataset_id}.json", json={"metadata": metadata})
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self._request("GET", f"{self.url}/api/views.json", params={"limit": 1})
+            return {"portal_type": self.portal_type, "status": "healthy", "url": self.url}
+        except Exception as e:
+            return {"portal_type": self.portal_type, "status": "unavailable", "error": str(e)}
+
+    def _resource_url(self, dataset: Dict[str, Any]) -> str:
+        return f"{self.url}/resource/{dataset['dataset_id']}.json"
+
+    def _send(self, dataset: Dict[str, Any], rows: List[Dict[str, Any]]) -> None:
+        batch_size = int(dataset["batch_size"])
+        for start in range(0, len(rows), batch_size):
+            self._check(self._request("POST", self._resource_url(dataset), json=rows[start:start + batch_size]))
+
+    @staticmethod
+    def _check(result: Any) -> None:
+        """SODA reports rows it could not apply in an otherwise successful response."""
+        errors = (result or {}).get("Errors", 0) if isinstance(result, dict) else 0
+        if errors:
+            raise OpenDataError(f"Socrata rejected {errors} row(s)")
+
+
+class CkanPortal(OpenDataPortal):
+    """
+    Publishes to a CKAN portal through the action API and the DataStore.
+
+    Configuration:
+        url: The CKAN site URL
+        api_key: API token of a user allowed to edit the organization's datasets
+        organization: Owner organization of datasets the publisher creates
+
+    A dataset is a CKAN package (dataset_id is its name) holding one
+    DataStore resource (resource_name, the dataset name by default). Both are
+    created on the first run; field labels and descriptions are kept in the
+    DataStore data dictionary and the key fields are its primary key.
+    """
+
+    portal_type = "ckan"
+
+    def __init__(self, config: Dict[str, Any]):
+        super().__init__(config)
+        self.url = (_env_setting(config, "url") or "").rstrip("/")
+        self._resources: Dict[str, str] = {}
+
+    def connect(self) -> None:
+        if self.session is None:
+            super().connect()
+            api_key = _env_setting(self.config, "api_key")
+            if api_key:
+                self.session.headers["Authorization"] = api_key
+
+    def action(self, name: str, data: Dict[str, Any]) -> Any:
+        """
+        Call an action of the CKAN API.
+
+        Raises:
+            OpenDataError: If the action fails
+        """
+        body = self._request("POST", f"{self.url}/api/3/action/{name}", json=data)
+        if not body or not body.get("success"):
+            raise OpenDataError(f"CKAN {name} failed: {json.dumps((body or {}).get('error'))}")
+        return body["result"]
+
+    def prepare(self, dataset: Dict[str, Any], fields: List[Dict[str, Any]]) -> None:
+        try:
+            package = self.action("package_show", {"id": dataset["dataset_id"]})
+        except OpenDataError as e:
+            if "404" not in str(e) and "Not found" not in str(e):
+                raise
+            package = self.action("package_create", {
+                "name": dataset["dataset_id"],
+                "title": dataset.get("title") or dataset["name"],
+                "notes": dataset.get("description") or "",
+                "owner_org": self.config.get("organization"),
+            })
+            logger.info(f"Created CKAN dataset {dataset['dataset_id']}")
+        resource_name = dataset.get("resource_name") or dataset["name"]
+        resource = next((r for r in package.get("resources", []) if r.get("name") == resource_name), None)
+        spec = {
+            "fields": [{"id": f["name"], "type": CKAN_TYPES.get(f["type"], "text"),
+                        "info": {"label": f["title"], "notes": f.get("description") or ""}} for f in fields],
+            "primary_key": dataset["key_fields"],
+            "force": True,
+        }
+        if resource:
+            spec["resource_id"] = resource["id"]
+        else:
+            spec["resource"] = {"package_id": package["id"], "name": resource_name}
+        result = self.action("datastore_create", spec)
+        self._resources[dataset["dataset_id"]] = result["resource_id"]
+
+    def upsert(self, dataset: Dict[str, Any], rows: List[Dict[str, Any]], method: str = "upsert") -> None:
+        batch_size = int(dataset["batch_size"])
+        for start in range(0, len(rows), batch_size):
+            self.action("datastore_upsert", {"resource_id": self._resource_id(dataset), "method": method,
+                                             "records": rows[start:start + batch_size], "force": True})
+
+    def delete(self, dataset: Dict[str, Any], keys: List[Dict[str, Any]]) -> None:
+        resource_id = self._resource_id(dataset)
+        if len(dataset["key_fields"]) == 1:
+            field = dataset["key_fields"][0]
+            batch_size = int(dataset["batch_size"])
+            for start in range(0, len(keys), batch_size):
+                values = [key[field] for key in keys[start:start + batch_size]]
+                self.action("datastore_delete", {"resource_id": resource_id, "filters": {field: values}, "force": True})
+            return
+        for key in keys:
+            self.action("datastore_delete", {"resource_id": resource_id, "filters": key, "force": True})
+
+    def replace(self, dataset: Dict[str, Any], rows: List[Dict[str, Any]]) -> None:
+        # Empty filters delete the rows but keep the table and its data dictionary
+        self.action("datastore_delete", {"resource_id": self._resource_id(dataset), "filters": {}, "force": True})
+        self.upsert(dataset, rows, method="insert")
+
+    def set_version(self, dataset: Dict[str, Any], version: int, published_at: str) -> None:
+        self.action("package_patch", {"id": dataset["dataset_id"], "version": str(version)})
+
+    def health_check(self) -> Dict[str, Any]:
+        try:
+            self.action("status_show", {})
+            return {"portal_type": self.portal_type, "status": "healthy", "url": self.url}
+        except Exception as e:
+            return {"portal_type": self.portal_type, "status": "unavailable", "error": str(e)}
+
+    def _resource_id(self, dataset: Dict[str, Any]) -> str:
+        if dataset["dataset_id"] not in self._resources:
+            raise OpenDataError(f"CKAN dataset {dataset['dataset_id']} has not been prepared")
+        return self._resources[dataset["dataset_id"]]
+
+
+PORTAL_TYPES = {
+    "socrata": SocrataPortal,
+    "ckan": CkanPortal,
+}
+
+
+def _normalize_columns(columns: Dict[str, Any]) -> Dict[str, Dict[str, Any]]:
+    """Column settings as {"name", "title", "description"}; a string is the published field name."""
+    normalized = {}
+    for column, settings in columns.items():
+        settings = {"name": settings} if isinstance(settings, str) else dict(settings or {})
+        settings.setdefault("name", column)
+        settings.setdefault("title", settings["name"])
+        normalized[column] = settings
+    return normalized
+
+
+def parse_open_data(sync_pair_id: str, definition: Optional[Dict[str, Any]],
+                    table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the "open_data" block of a sync pair.
+
+    Returns:
+        The open data settings, empty when the sync pair publishes nothing
+    """
+    if not definition:
+        return {}
+    open_data = dict(definition)
+    portal = open_data.get("portal") or {}
+    if portal.get("type") not in PORTAL_TYPES:
+        raise ValueError(f"Sync pair {sync_pair_id}: unsupported open data portal {portal.get('type')}. "
+                         f"Supported portals: {', '.join(PORTAL_TYPES)}")
+    datasets = []
+    for entry in open_data.get("datasets") or []:
+        dataset = dict(entry)
+        name = dataset.get("name")
+        if not name or any(d["name"] == name for d in datasets):
+            raise ValueError(f"Sync pair {sync_pair_id}: open data datasets need unique names")
+        for required in ("table", "dataset_id", "columns"):
+            if not dataset.get(required):
+                raise ValueError(f"Sync pair {sync_pair_id}: open data dataset {name} needs {required}")
+        if dataset["table"] not in table_names:
+            raise ValueError(f"Sync pair {sync_pair_id}: open data dataset {name} names unknown table {dataset['table']}")
+        dataset["columns"] = _normalize_columns(dataset["columns"])
+        dataset.setdefault("mode", "upsert")
+        if dataset["mode"] not in PUBLISH_MODES:
+            raise ValueError(f"Sync pair {sync_pair_id}: unsupported open data mode {dataset['mode']}. "
+                             f"Supported modes: {', '.join(PUBLISH_MODES)}")
+        for column in dataset.get("key") or []:
+            if column not in dataset["columns"]:
+                raise ValueError(f"Sync pair {sync_pair_id}: open data dataset {name} key column {column} is not published")
+        if dataset.get("where"):
+            # Raises FilterSyntaxError (a ValueError) for a bad expression
+            FilterExpression(dataset["where"])
+        dataset.setdefault("timezone", "UTC")
+        dataset.setdefault("batch_size", DEFAULT_PUBLISH_BATCH_SIZE)
+        datasets.append(dataset)
+    if not datasets:
+        raise ValueError(f"Sync pair {sync_pair_id}: open data needs at least one dataset")
+    open_data["datasets"] = datasets
+    return open_data
+
+
+def _utcnow() -> datetime:
+    return datetime.now(timezone.utc)
+
+
+class OpenDataPublisher:
+    """
+    Service class that publishes sync pairs' open data datasets.
+
+    Publishing state lives in the sync state store. A background thread
+    (start/stop) publishes datasets whose schedule is due every POLL_SECONDS;
+    publish can also be called directly.
+    """
+
+    def __init__(self, registry, store: Optional[DocumentStore] = None, audit: Optional[AuditLog] = None,
+                 redaction: Optional[RedactionPolicies] = None):
+        """
+        Initialize the publisher.
+
+        Args:
+            registry: Sync pair registry the datasets come from
+            store: Document store for publishing state
+            audit: Audit log for publishing runs
+            redaction: Redaction policies of the counties
+        """
+        self.registry = registry
+        self.store = store or sync_state_store
+        self.audit = audit or AuditLog(self.store)
+        self.redaction = redaction or redaction_policies
+        self._locks: Dict[str, threading.Lock] = {}
+        self._locks_lock = threading.Lock()
+        self._stop_event = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+
+    def list_datasets(self, sync_pair_id: Optional[str] = None) -> List[Dict[str, Any]]:
+        """Publishing state of every dataset, optionally of one sync pair."""
+        pairs = [self.registry.get(sync_pair_id)] if sync_pair_id else self.registry.list()
+        return [self._load_state(pair, dataset) for pair in pairs for dataset in pair.open_data.get("datasets", [])]
+
+    def get_dataset(self, sync_pair_id: str, name: str) -> Dict[str, Any]:
+        """
+        Publishing state and history of a dataset.
+
+        Raises:
+            KeyError: If the sync pair or dataset is not configured
+        """
+        pair = self.registry.get(sync_pair_id)
+        return self._load_state(pair, self._dataset(pair, name))
+
+    def publish(self, sync_pair_id: str, name: str, username: str, force: bool = False) -> Dict[str, Any]:
+        """
+        Publish a dataset: send the rows that changed since the last run and delete removed rows.
+
+        Args:
+            sync_pair_id: Sync pair of the dataset
+            name: Dataset name
+            username: User recorded on the run
+            force: Send every row and refresh the metadata even when nothing changed
+
+        Returns:
+            The dataset state, with the run in "last_run"
+
+        Raises:
+            KeyError: If the sync pair or dataset is not configured
+            ValueError: If a run of the dataset is already in progress
+            OpenDataError: If the portal rejects the data
+        """
+        pair = self.registry.get(sync_pair_id)
+        dataset = self._dataset(pair, name)
+        lock = self._lock(sync_pair_id, name)
+        if not lock.acquire(blocking=False):
+            raise ValueError(f"Dataset {name} of {sync_pair_id} is already being published")
+        try:
+            return self._publish(pair, dataset, username, force)
+        finally:
+            lock.release()
+
+    def run_due(self, now: Optional[datetime] = None) -> List[Dict[str, Any]]:
+        """
+        Publish every scheduled dataset whose next run time has passed.
+
+        Returns:
+            The runs that were started
+        """
+        from sync_scheduler import CronExpression, _timezone
+
+        now = now or _utcnow()
+        runs = []
+        for pair in self.registry.list():
+            for dataset in pair.open_data.get("datasets", []):
+                if not dataset.get("schedule"):
+                    continue
+                state = self._load_state(pair, dataset)
+                try:
+                    expression = CronExpression(dataset["schedule"])
+                    tz = _timezone(dataset["timezone"])
+                    if not state.get("next_run_at"):
+                        state["next_run_at"] = expression.next_after(now, tz).isoformat()
+                        self._save_state(state)
+                        continue
+                    if datetime.fromisoformat(state["next_run_at"]) > now:
+                        continue
+                    state["next_run_at"] = expression.next_after(now, tz).isoformat()
+                    self._save_state(state)
+                    runs.append(self.publish(pair.sync_pair_id, dataset["name"], PUBLISHER_USERNAME)["last_run"])
+                except Exception as e:
+                    logger.error(f"Error publishing open data dataset {dataset['name']} of {pair.sync_pair_id}: {e}",
+                                 exc_info=True)
+        return runs
+
+    def start(self) -> None:
+        """Start the background publishing thread."""
+        if self._thread is not None and self._thread.is_alive():
+            return
+        self._stop_event.clear()
+        self._thread = threading.Thread(target=self._loop, name="open-data-publisher", daemon=True)
+        self._thread.start()
+        logger.info(f"Open data publisher started (checking every {POLL_SECONDS}s)")
+
+    def stop(self) -> None:
+        """Stop the background publishing thread."""
+        self._stop_event.set()
+        if self._thread is not None:
+            self._thread.join(timeout=POLL_SECONDS)
+            self._thread = None
+        logger.info("Open data publisher stopped")
+
+    def _loop(self) -> None:
+        while not self._stop_event.is_set():
+            self.run_due()
+            self._stop_event.wait(POLL_SECONDS)
+
+    # Publishing -------------------------------------------------------------
+
+    def _publish(self, pair, dataset: Dict[str, Any], username: str, force: bool) -> Dict[str, Any]:
+        state = self._load_state(pair, dataset)
+        rows_key = self._state_key(pair, dataset)
+        try:
+            published_hashes = self.store.load(ROWS_COLLECTION, rows_key).get("rows", {})
+        except FileNotFoundError:
+            published_hashes = {}
+
+        run = {"run_id": str(uuid.uuid4()), "username": username, "started_at": datetime.utcnow().isoformat(),
+               "status": "RUNNING", "upserted": 0, "deleted": 0, "row_count": 0}
+        try:
+            fields, rows, hashes = self._read_rows(pair, dataset)
+            changed = [row for row in rows if force or published_hashes.get(row[0]) != row[1]]
+            removed = [key for key in published_hashes if key not in hashes]
+            metadata_hash = _digest([fields, dataset.get("title"), dataset.get("description")])
+            metadata_changed = metadata_hash != state.get("metadata_hash")
+            run["row_count"] = len(rows)
+
+            if changed or removed or metadata_changed or force:
+                key_fields = dataset["key_fields"]
+                with PORTAL_TYPES[pair.open_data["portal"]["type"]](pair.open_data["portal"]) as portal:
+                    portal.prepare(dataset, fields)
+                    if dataset["mode"] == "replace":
+                        if changed or removed or force:
+                            portal.replace(dataset, [row[2] for row in rows])
+                            run["upserted"], run["deleted"] = len(rows), len(removed)
+                    else:
+                        portal.upsert(dataset, [row[2] for row in changed])
+                        portal.delete(dataset, [dict(zip(key_fields, json.loads(key))) for key in removed])
+                        run["upserted"], run["deleted"] = len(changed), len(removed)
+                    version = state.get("version", 0) + 1
+                    portal.set_version(dataset, version, run["started_at"])
+                self.store.save(ROWS_COLLECTION, rows_key, {"rows": hashes})
+                state.update({"version": version, "metadata_hash": metadata_hash,
+                              "published_at": run["started_at"], "row_count": len(rows)})
+                run["version"] = version
+                run["status"] = "PUBLISHED"
+            else:
+                run["status"] = "UNCHANGED"
+        except Exception as e:
+            run["status"] = "FAILED"
+            run["error"] = str(e)
+            raise
+        finally:
+            run["completed_at"] = datetime.utcnow().isoformat()
+            state["last_run"] = run
+            if run["status"] == "PUBLISHED":
+                state["versions"] = ([run] + state.get("versions", []))[:VERSIONS_KEPT]
+            self._save_state(state)
+            if run["status"] != "UNCHANGED":
+                self.audit.record(f"open_data.{run['status'].lower()}", username, "open_data_dataset", rows_key,
+                                  {k: run.get(k) for k in ("version", "upserted", "deleted", "row_count", "error")},
+                                  county_id=pair.county_id)
+        logger.info(f"Open data dataset {dataset['name']} of {pair.sync_pair_id}: {run['status']} "
+                    f"({run['upserted']} upserted, {run['deleted']} deleted)")
+        return state
+
+    def _read_rows(self, pair, dataset: Dict[str, Any]) -> Tuple[List[Dict[str, Any]], List[Tuple], Dict[str, str]]:
+        """
+        Read and sanitize the dataset's rows from the sync pair's target.
+
+        Returns:
+            The published fields, a (key, hash, row) tuple per published row,
+            and the hash of every row by key
+        """
+        table = pair.get_table(dataset["table"])
+        table_def = build_pipeline(pair.hooks, table.name).target_table(table.to_dict())
+        columns = dataset["columns"]
+        key_columns = list(dataset.get("key") or table_def["primary_key"])
+        missing = [c for c in key_columns if c not in columns]
+        if missing:
+            raise ValueError(f"Dataset {dataset['name']} must publish its key columns: {', '.join(missing)}")
+        dataset["key_fields"] = [columns[c]["name"] for c in key_columns]
+        if pair.open_data["portal"]["type"] == "socrata" and dataset["mode"] == "upsert" and len(key_columns) > 1:
+            # The SODA row identifier is a single column
+            raise ValueError(f"Dataset {dataset['name']} needs a single key column to upsert to Socrata")
+        expression = FilterExpression(dataset["where"]) if dataset.get("where") else None
+        redactor = self.redaction.named(pair.county_id, [dataset["redaction"]]) if dataset.get("redaction") \
+            else Redactor()
+        redacted_keys = [c for c in key_columns if redactor.redacts(c)]
+        if redacted_keys:
+            raise ValueError(f"Dataset {dataset['name']} key columns are redacted: {', '.join(redacted_keys)}")
+        batch_size = int(dataset["batch_size"])
+
+        rows, hashes = [], {}
+        with create_connector(pair.target) as target:
+            types = {c["name"]: edm_type(c["type"]) for c in target.describe_table(table_def)["columns"]}
+            unknown = [c for c in columns if c not in types]
+            if unknown:
+                raise ValueError(f"Dataset {dataset['name']} publishes unknown columns: {', '.join(unknown)}")
+            order_by = [(c, False) for c in table_def["primary_key"]]
+            offset = 0
+            while True:
+                batch = target.query_records(table_def, order_by=order_by, limit=batch_size, offset=offset)
+                for record in batch:
+                    if expression and not expression.matches(record):
+                        continue
+                    record = redactor.record(record)
+                    row = {settings["name"]: _portal_value(record.get(column)) for column, settings in columns.items()}
+                    key = record_key(dataset["key_fields"], row)
+                    hashes[key] = _digest(row)
+                    rows.append((key, hashes[key], row))
+                if len(batch) < batch_size:
+                    break
+                offset += batch_size
+
+        fields = [{"name": settings["name"], "title": settings["title"], "description": settings.get("description"),
+                   "type": types[column]} for column, settings in columns.items()]
+        return fields, rows, hashes
+
+    # State ------------------------------------------------------------------
+
+    def _dataset(self, pair, name: str) -> Dict[str, Any]:
+        for dataset in pair.open_data.get("datasets", []):
+            if dataset["name"] == name:
+                return dict(dataset)
+        raise KeyError(f"Sync pair {pair.sync_pair_id} has no open data dataset {name}")
+
+    def _lock(self, sync_pair_id: str, name: str) -> threading.Lock:
+        with self._locks_lock:
+            return self._locks.setdefault(f"{sync_pair_id}.{name}", threading.Lock())
+
+    @staticmethod
+    def _state_key(pair, dataset: Dict[str, Any]) -> str:
+        return f"{pair.sync_pair_id}.{dataset['name']}"
+
+    def _load_state(self, pair, dataset: Dict[str, Any]) -> Dict[str, Any]:
+        try:
+            state = self.store.load(DATASETS_COLLECTION, self._state_key(pair, dataset))
+        except FileNotFoundError:
+            state = {"sync_pair_id": pair.sync_pair_id, "county_id": pair.county_id, "dataset": dataset["name"],
+                     "version": 0, "published_at": None, "next_run_at": None, "last_run": None, "versions": []}
+        if state.get("schedule") != dataset.get("schedule"):
+            # A changed schedule starts from its next fire time
+            state["next_run_at"] = None
+        # Settings come from the configuration, which may have changed since the last run
+        state.update({"portal": pair.open_data["portal"]["type"], "dataset_id": dataset["dataset_id"],
+                      "schedule": dataset.get("schedule"), "mode": dataset["mode"]})
+        return state
+
+    def _save_state(self, state: Dict[str, Any]) -> None:
+        state["updated_at"] = datetime.utcnow().isoformat()
+        self.store.save(DATASETS_COLLECTION, f"{state['sync_pair_id']}.{state['dataset']}", state)
@@ -0,0 +1,680 @@
+"""
+TerraFusion SyncService - Sync Pair Configuration
+
+This module loads sync pair definitions (a source system, a target store and
+the tables that move between them) from the county configuration files.
+
+A sync pair may also declare the schedules it runs on ("schedules", cron
+entries as the scheduler API takes them); the scheduler keeps the stored
+schedules in line with them (see SyncScheduler.sync_configured).
+"""
+
+import os
+import json
+import copy
+import hashlib
+import logging
+import threading
+from typing import Dict, List, Any, Optional, Tuple
+from dataclasses import dataclass, field
+
+from sync_connectors import CHANGE_TRACKING_METHODS, CONNECTOR_TYPES, TargetConnector
+from sync_conflicts import CONFLICT_STRATEGIES
+from sync_hooks import load_hook
+from sync_mapping import FieldMapping
+from sync_snapshots import validate_rule, DEFAULT_SNAPSHOTS_KEPT
+from sync_filters import parse_filters
+from sync_throttle import parse_throttle
+from sync_merge import parse_merge
+from sync_validation import parse_validation
+from sync_geometry import parse_geometry_repair
+from sync_address import parse_address_standardization
+from sync_topology import parse_topology_qa
+from sync_anomalies import parse_anomalies
+from sync_vendors import expand_vendor
+from sync_entities import expand_entities
+from sync_events import parse_events
+from sync_odata import parse_odata
+from sync_graphql import parse_graphql
+from sync_open_data import parse_open_data
+from sync_ingest import parse_ingestion
+from sync_freshness import parse_freshness_slo
+from sync_resilience import parse_resilience
+from sync_pools import parse_pool
+from sync_bulk import parse_bulk_load
+from roll_years import parse_roll_years
+from county_overrides import load_county_config
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Default rows per batch when a sync pair does not specify one
+DEFAULT_BATCH_SIZE = 5000
+
+# Default seconds between change listener polls
+DEFAULT_CDC_POLL_SECONDS = 30
+
+# Supported sync directions
+SYNC_DIRECTIONS = ["source_to_target", "bidirectional"]
+
+# Modes a configured schedule may run in
+SCHEDULE_MODES = ["full", "incremental"]
+
+# Mapping from SQL Server connector settings to county data_ingestion_settings keys
+PACS_ENV_SETTINGS = {
+    "host_env_var": "pacs_db_host_env_var",
+    "port_env_var": "pacs_db_port_env_var",
+    "database_env_var": "pacs_db_name_env_var",
+    "user_env_var": "pacs_db_user_env_var",
+    "password_env_var": "pacs_db_password_env_var",
+}
+
+
+@dataclass
+class SyncTableConfig:
+    """A table moved by a sync pair."""
+    name: str
+    primary_key: List[str]
+    target_table: Optional[str] = None
+    change_tracking: Optional[str] = None  # One of CHANGE_TRACKING_METHODS, or None (full reads only)
+    rowversion_column: Optional[str] = None
+    change_column: Optional[str] = None  # Last-modified column ("change_column" tracking)
+    capture_instance: Optional[str] = None  # CDC capture instance, default schema_table
+    timestamp_column: Optional[str] = None  # Source last-modified column (newest_timestamp strategy)
+    target_change_column: Optional[str] = None  # Staging last-modified column (bidirectional pairs)
+    depends_on: List[str] = field(default_factory=list)  # Tables that must be committed first
+    bulk_load: Optional[bool] = None  # False always upserts, True bulk loads batches of any size (see sync_bulk)
+    push_only: bool = False  # Loaded by pushes only (see sync_ingest); sync jobs do not read it from the source
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {
+            "name": self.name,
+            "primary_key": list(self.primary_key),
+            "target_table": self.target_table or self.name,
+            "change_tracking": self.change_tracking,
+            "rowversion_column": self.rowversion_column,
+            "change_column": self.change_column,
+            "capture_instance": self.capture_instance,
+            "timestamp_column": self.timestamp_column,
+            "target_change_column": self.target_change_column,
+            "depends_on": list(self.depends_on),
+            "bulk_load": self.bulk_load,
+            "push_only": self.push_only,
+        }
+
+
+@dataclass
+class SyncPairConfig:
+    """A configured source/target pairing for one county."""
+    sync_pair_id: str
+    county_id: str
+    name: str
+    source: Dict[str, Any]
+    target: Dict[str, Any]
+    tables: List[SyncTableConfig] = field(default_factory=list)
+    batch_size: int = DEFAULT_BATCH_SIZE
+    default_mode: str = "incremental"
+    direction: str = "source_to_target"
+    conflict_strategy: str = "source_wins"
+    hooks: List[Dict[str, Any]] = field(default_factory=list)
+    cdc: Dict[str, Any] = field(default_factory=dict)  # Continuous change listener settings
+    snapshot: Dict[str, Any] = field(default_factory=dict)  # Pre-sync snapshot and validation settings
+    filters: List[Dict[str, Any]] = field(default_factory=list)  # Record filter expressions
+    merge: Dict[str, Any] = field(default_factory=dict)  # Secondary sources joined into each record
+    validation: Dict[str, Any] = field(default_factory=dict)  # Per-table validation rules and quarantine table
+    geometry_repair: Dict[str, Any] = field(default_factory=dict)  # Geometry columns checked and repaired (see sync_geometry)
+    address_standardization: Dict[str, Any] = field(default_factory=dict)  # Addresses standardized and geocoded (see sync_address)
+    topology_qa: Dict[str, Any] = field(default_factory=dict)  # Parcel topology checks run after each sync (see sync_topology)
+    anomalies: Dict[str, Any] = field(default_factory=dict)  # Unusual changes flagged as each sync writes (see sync_anomalies)
+    events: Dict[str, Any] = field(default_factory=dict)  # Change event publishing (see sync_events)
+    odata: Dict[str, Any] = field(default_factory=dict)  # Tables published over OData (see sync_odata)
+    graphql: Dict[str, Any] = field(default_factory=dict)  # Tables and relations published over GraphQL (see sync_graphql)
+    open_data: Dict[str, Any] = field(default_factory=dict)  # Open data portal datasets (see sync_open_data)
+    ingestion: Dict[str, Any] = field(default_factory=dict)  # Tables accepting pushed records (see sync_ingest)
+    freshness_slo: Dict[str, Any] = field(default_factory=dict)  # Freshness objective of the tables (see sync_freshness)
+    roll_years: Dict[str, Any] = field(default_factory=dict)  # Tables versioned by assessment roll year (see roll_years)
+    schedules: List[Dict[str, Any]] = field(default_factory=list)  # Configured schedules (see sync_scheduler)
+    vendor: Optional[str] = None  # CAMA vendor adapter that generated the tables (see sync_vendors)
+    entities: Dict[str, Any] = field(default_factory=dict)  # Entity modules that generated tables (see sync_entities)
+    fingerprint: str = ""  # Digest of the definition, inherited settings and mapping the pair was built from
+
+    @property
+    def source_system_id(self) -> str:
+        """Identifier of the source system used in idempotency keys ("system_id" in the source block)."""
+        if self.source.get("system_id"):
+            return str(self.source["system_id"])
+        return "/".join(str(part) for part in (self.county_id, self.source.get("type"), self.source.get("database")) if part)
+
+    def get_table(self, name: str) -> SyncTableConfig:
+        for table in self.tables:
+            if table.name == name:
+                return table
+        raise KeyError(f"Table {name} is not part of sync pair {self.sync_pair_id}")
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {
+            "sync_pair_id": self.sync_pair_id,
+            "county_id": self.county_id,
+            "name": self.name,
+            "source_system": self.source.get("type"),
+            "target_system": self.target.get("type"),
+            "source_throttle": self.source.get("throttle") or None,
+            "vendor": self.vendor,
+            "entities": {name: dict(summary) for name, summary in self.entities.items()} or None,
+            "batch_size": self.batch_size,
+            "default_mode": self.default_mode,
+            "direction": self.direction,
+            "conflict_strategy": self.conflict_strategy,
+            "hooks": [h.get("type") for h in self.hooks],
+            "cdc": dict(self.cdc),
+            "snapshot": dict(self.snapshot),
+            "filters": [dict(f) for f in self.filters],
+            "merge_sources": [
+                {"name": source["name"], "source_system": source["connector"].get("type"),
+                 "tables": [entry["table"] for entry in source["tables"]]}
+                for source in self.merge.get("sources", [])
+            ],
+            "validation": {
+                "quarantine_table": self.validation["quarantine_table"],
+                "rules": {name: [rule["id"] for rule in rules] for name, rules in self.validation["rules"].items()},
+            } if self.validation else None,
+            "geometry_repair": {
+                name: settings["columns"] for name, settings in self.geometry_repair["tables"].items()
+            } if self.geometry_repair else None,
+            "address_standardization": {
+                name: {"columns": settings["columns"], "parser": settings["parser"],
+                       "geocoder": (settings["geocoder"] or {}).get("type")}
+                for name, settings in self.address_standardization["tables"].items()
+            } if self.address_standardization else None,
+            "topology_qa": {
+                name: settings["checks"] for name, settings in self.topology_qa["tables"].items()
+            } if self.topology_qa else None,
+            "anomalies": {
+                name: [check for check in ("value_bands", "ownership", "reclassification") if settings[check]]
+                for name, settings in self.anomalies["tables"].items()
+            } if self.anomalies else None,
+            "events": {
+                "publisher": self.events["type"],
+                "topic": self.events["topic"],
+                "tables": self.events.get("tables") or [t.name for t in self.tables],
+            } if self.events else None,
+            "odata": {
+                "tables": self.odata.get("tables") or [t.name for t in self.tables],
+            } if self.odata else None,
+            "graphql": {
+                "tables": self.graphql.get("tables") or [t.name for t in self.tables],
+                "relations": [f"{r['from']}.{r['name']}" for r in self.graphql["relations"]],
+            } if self.graphql else None,
+            "open_data": {
+                "portal": self.open_data["portal"]["type"],
+                "datasets": [d["name"] for d in self.open_data["datasets"]],
+            } if self.open_data else None,
+            "ingestion": {
+                "tables": self.ingestion.get("tables") or [t.name for t in self.tables],
+                "services": list(self.ingestion["services"]),
+                "max_records": self.ingestion["max_records"],
+            } if self.ingestion else None,
+            "freshness_slo": dict(self.freshness_slo) if self.freshness_slo else None,
+            "roll_years": {
+                "tables": list(self.roll_years["tables"]),
+                "year_table": self.roll_years["year_table"],
+            } if self.roll_years else None,
+            "schedules": [dict(s) for s in self.schedules],
+            "tables": [t.to_dict() for t in self.tables],
+        }
+
+
+class SyncPairRegistry:
+    """
+    Registry of sync pairs declared in county configuration files.
+
+    Each county_configs/<county>/<county>_config.json may contain a
+    "sync_pairs" list, read with the county's overrides (see
+    county_overrides). SQL Server sources without explicit connection
+    settings inherit the PACS environment variable names from the county's
+    data_ingestion_settings block. A "field_mapping" file path is resolved
+    relative to the county folder and validated here, at load time.
+    """
+
+    def __init__(self, config_dir: str = "county_configs"):
+        """
+        Initialize the registry.
+
+        Args:
+            config_dir: Directory containing county configuration folders
+        """
+        self.config_dir = config_dir
+        self.sync_pairs: Dict[str, SyncPairConfig] = {}
+        # Why each county configuration file that failed to load was skipped, by path
+        self.load_errors: Dict[str, str] = {}
+        self._lock = threading.Lock()
+        self.load()
+
+    def load(self) -> None:
+        """(Re)load sync pairs from every county configuration file."""
+        sync_pairs, load_errors = self.read()
+        self.replace(sync_pairs, load_errors)
+        logger.info(f"Loaded {len(sync_pairs)} sync pairs from {self.config_dir}")
+
+    def read(self) -> Tuple[Dict[str, SyncPairConfig], Dict[str, str]]:
+        """The sync pairs the county files declare now, and why files failed to load; registers nothing."""
+        sync_pairs, load_errors = {}, {}
+        if not os.path.isdir(self.config_dir):
+            logger.warning(f"County config directory not found: {self.config_dir}")
+            return sync_pairs, load_errors
+
+        for county_dir in sorted(os.listdir(self.config_dir)):
+            config_path = os.path.join(self.config_dir, county_dir, f"{county_dir}_config.json")
+            if not os.path.exists(config_path):
+                continue
+            try:
+                county_config = load_county_config(config_path)
+                for definition in county_config.get("sync_pairs", []):
+                    pair = self._parse_sync_pair(county_config, definition, os.path.join(self.config_dir, county_dir))
+                    sync_pairs[pair.sync_pair_id] = pair
+            except Exception as e:
+                logger.error(f"Error loading sync pairs from {config_path}: {e}")
+                load_errors[config_path] = str(e)
+        return sync_pairs, load_errors
+
+    def replace(self, sync_pairs: Dict[str, SyncPairConfig], load_errors: Dict[str, str]) -> None:
+        """Register a whole set of sync pairs at once; readers see either the old set or the new one."""
+        with self._lock:
+            self.sync_pairs, self.load_errors = sync_pairs, load_errors
+
+    def get(self, sync_pair_id: str) -> SyncPairConfig:
+        """
+        Get a sync pair by ID.
+
+        Raises:
+            KeyError: If the sync pair is not configured
+        """
+        if sync_pair_id not in self.sync_pairs:
+            raise KeyError(f"Sync pair {sync_pair_id} not found")
+        return self.sync_pairs[sync_pair_id]
+
+    def list(self, county_id: Optional[str] = None) -> List[SyncPairConfig]:
+        """List sync pairs, optionally filtered by county."""
+        return [
+            pair for pair in self.sync_pairs.values()
+            if county_id is None or pair.county_id == county_id
+        ]
+
+    def parse_sync_pair(self, county_config: Dict[str, Any], definition: Dict[str, Any],
+                        county_dir: str) -> SyncPairConfig:
+        """
+        Build a sync pair from its definition without registering it, as a
+        county file loads it (config_schema checks definitions one by one).
+
+        Raises:
+            ValueError: If the definition is invalid
+        """
+        return self._parse_sync_pair(county_config, definition, county_dir)
+
+    def _parse_sync_pair(self, county_config: Dict[str, Any], definition: Dict[str, Any],
+                         county_dir: str) -> SyncPairConfig:
+        """Build a SyncPairConfig from its JSON definition."""
+        county_id = county_config["county_id"]
+        original = definition
+        if definition.get("vendor"):
+            # Vendor conventions become ordinary tables, filters and hooks
+            definition = expand_vendor(definition)
+        if definition.get("entities"):
+            # Entity modules add their tables, mappings and rules, after vendor tables they may link to
+            definition = expand_entities(definition)
+        for required in ("sync_pair_id", "source", "target", "tables"):
+            if required not in definition:
+                raise ValueError(f"Sync pair definition missing required field: {required}")
+
+        source = copy.deepcopy(definition["source"])
+        if source.get("type") == "sqlserver":
+            ingestion = county_config.get("data_ingestion_settings", {})
+            for setting, county_key in PACS_ENV_SETTINGS.items():
+                if setting not in source and setting.replace("_env_var", "") not in source and county_key in ingestion:
+                    source[setting] = ingestion[county_key]
+        if source.get("throttle"):
+            # Business-hours windows default to the county's local time
+            source["throttle"] = parse_throttle(source["throttle"], county_config.get("timezone", "UTC"))
+
+        for side in ("source", "target"):
+            # Fail at load time rather than at the first connection
+            try:
+                if definition[side].get("resilience") is not None:
+                    parse_resilience(definition[side]["resilience"])
+                if definition[side].get("pool") is not None:
+                    parse_pool(definition[side]["pool"])
+                if definition[side].get("bulk_load") is not None:
+                    parse_bulk_load(definition[side]["bulk_load"])
+            except ValueError as e:
+                raise ValueError(f"Sync pair {definition['sync_pair_id']} {side}: {e}")
+
+        direction = definition.get("direction", "source_to_target")
+        if direction not in SYNC_DIRECTIONS:
+            raise ValueError(f"Unsupported sync direction: {direction}. Supported directions: {', '.join(SYNC_DIRECTIONS)}")
+        conflict_strategy = definition.get("conflict_strategy", "source_wins")
+        if conflict_strategy not in CONFLICT_STRATEGIES:
+            raise ValueError(
+                f"Unsupported conflict strategy: {conflict_strategy}. "
+                f"Supported strategies: {', '.join(CONFLICT_STRATEGIES)}"
+            )
+
+        tables = []
+        for table_def in definition["tables"]:
+            primary_key = table_def.get("primary_key")
+            if isinstance(primary_key, str):
+                primary_key = [primary_key]
+            if not primary_key:
+                raise ValueError(f"Table {table_def.get('name')} must declare a primary_key")
+
+            change_tracking = table_def.get("change_tracking")
+            if change_tracking and change_tracking not in CHANGE_TRACKING_METHODS:
+                raise ValueError(
+                    f"Unsupported change tracking method for {table_def['name']}: {change_tracking}. "
+                    f"Supported methods: {', '.join(CHANGE_TRACKING_METHODS)}"
+                )
+            if change_tracking == "rowversion" and not table_def.get("rowversion_column"):
+                raise ValueError(f"Table {table_def['name']} uses rowversion but has no rowversion_column")
+            if change_tracking == "change_column" and not table_def.get("change_column"):
+                raise ValueError(f"Table {table_def['name']} uses change_column but has no change_column")
+            if table_def.get("bulk_load") not in (None, True, False):
+                raise ValueError(f"Table {table_def['name']} bulk_load must be true or false")
+            if table_def.get("push_only") not in (None, True, False):
+                raise ValueError(f"Table {table_def['name']} push_only must be true or false")
+            if table_def.get("push_only") and change_tracking:
+                raise ValueError(f"Table {table_def['name']} is push_only and cannot track source changes")
+            if direction == "bidirectional" and change_tracking and not table_def.get("target_change_column"):
+                raise ValueError(
+                    f"Table {table_def['name']} in bidirectional sync pair needs a target_change_column"
+                )
+
+            tables.append(SyncTableConfig(
+                name=table_def["name"],
+                primary_key=primary_key,
+                target_table=table_def.get("target_table"),
+                change_tracking=change_tracking,
+                rowversion_column=table_def.get("rowversion_column"),
+                change_column=table_def.get("change_column"),
+                capture_instance=table_def.get("capture_instance"),
+                timestamp_column=table_def.get("timestamp_column"),
+                target_change_column=table_def.get("target_change_column"),
+                depends_on=list(table_def.get("depends_on", [])),
+                bulk_load=table_def.get("bulk_load"),
+                push_only=bool(table_def.get("push_only")),
+            ))
+
+        self._validate_dependencies(definition["sync_pair_id"], tables)
+
+        hooks = copy.deepcopy(definition.get("hooks", []))
+        mapping = None
+        if definition.get("field_mapping"):
+            if direction == "bidirectional":
+                raise ValueError("Field mappings are not supported on bidirectional sync pairs")
+            mapping_path = os.path.join(county_dir, definition["field_mapping"])
+            mapping = FieldMapping.load(mapping_path)
+            table_names = {t.name for t in tables}
+            entity_mapped = {name for hook in hooks if hook.get("type") == "field_mapping"
+                             for name in (hook.get("options", {}).get("mapping") or {}).get("tables", {})}
+            for table_name, table_mapping in mapping.tables.items():
+                if table_name in entity_mapped:
+                    raise ValueError(f"Field mapping {mapping_path} maps {table_name}, which its entity module's "
+                                     f"template maps; set the module's template to null to map it here")
+                if table_name not in table_names:
+                    logger.warning(f"Field mapping {mapping_path} maps {table_name}, which is not in sync pair {definition['sync_pair_id']}")
+            for table in tables:
+                if mapping.for_table(table.name):
+                    mapping.for_table(table.name).validate_key(table.primary_key)
+            # The mapping runs after any custom hooks, with the document read now
+            hooks.append({"type": "field_mapping", "options": {"file": mapping_path, "mapping": mapping.definition,
+                                                               "digest": mapping.digest}})
+
+        filters = copy.deepcopy(definition.get("filters", []))
+        if filters:
+            if direction == "bidirectional":
+                raise ValueError("Record filters are not supported on bidirectional sync pairs")
+            parse_filters(filters)
+            table_names = {t.name for t in tables}
+            for definition_filter in filters:
+                for name in definition_filter.get("tables", []):
+                    if name not in table_names:
+                        raise ValueError(f"Filter {definition_filter['expression']!r} names unknown table {name}")
+
+        merge = {}
+        if definition.get("merge"):
+            if direction == "bidirectional":
+                raise ValueError("Merge sources are not supported on bidirectional sync pairs")
+            merge = parse_merge(definition["sync_pair_id"], copy.deepcopy(definition["merge"]),
+                                [t.name for t in tables], county_config.get("timezone", "UTC"))
+
+        validation = {}
+        if definition.get("validation"):
+            if direction == "bidirectional":
+                raise ValueError("Validation rules are not supported on bidirectional sync pairs")
+            target_class = CONNECTOR_TYPES.get(definition["target"].get("type"))
+            if target_class is not None and target_class.quarantine_records is TargetConnector.quarantine_records:
+                raise ValueError(f"Target type {definition['target'].get('type')} does not support a quarantine table")
+            validation = parse_validation(definition["sync_pair_id"], definition["validation"], [t.name for t in tables])
+            for table_name, rules in validation["rules"].items():
+                depends_on = next(t.depends_on for t in tables if t.name == table_name)
+                for rule in rules:
+                    referenced = rule.get("references", {}).get("table")
+                    if referenced and referenced != table_name and referenced not in depends_on:
+                        logger.warning(
+                            f"Validation rule {rule['id']} of {table_name} references {referenced}, "
+                            f"which {table_name} does not depend_on; it may not be loaded yet"
+                        )
+
+        geometry_repair = {}
+        if definition.get("geometry_repair"):
+            if direction == "bidirectional":
+                raise ValueError("Geometry repair is not supported on bidirectional sync pairs")
+            geometry_repair = parse_geometry_repair(definition["sync_pair_id"], definition["geometry_repair"],
+                                                    [t.name for t in tables])
+
+        address_standardization = {}
+        if definition.get("address_standardization"):
+            if direction == "bidirectional":
+                raise ValueError("Address standardization is not supported on bidirectional sync pairs")
+            address_standardization = parse_address_standardization(
+                definition["sync_pair_id"], definition["address_standardization"], [t.name for t in tables])
+
+        topology_qa = {}
+        if definition.get("topology_qa"):
+            if direction == "bidirectional":
+                raise ValueError("Topology QA is not supported on bidirectional sync pairs")
+            topology_qa = parse_topology_qa(definition["sync_pair_id"], definition["topology_qa"],
+                                            [t.name for t in tables])
+
+        anomalies = parse_anomalies(definition["sync_pair_id"], definition.get("anomalies"),
+                                    [t.name for t in tables])
+
+        events = parse_events(definition["sync_pair_id"], copy.deepcopy(definition.get("events")),
+                              [t.name for t in tables])
+        odata = parse_odata(definition["sync_pair_id"], copy.deepcopy(definition.get("odata")),
+                            [t.name for t in tables])
+        graphql = parse_graphql(definition["sync_pair_id"], copy.deepcopy(definition.get("graphql")),
+                                [t.name for t in tables])
+        open_data = parse_open_data(definition["sync_pair_id"], copy.deepcopy(definition.get("open_data")),
+                                    [t.name for t in tables])
+        ingestion = parse_ingestion(definition["sync_pair_id"], copy.deepcopy(definition.get("ingestion")),
+                                    [t.name for t in tables])
+        accepted = (ingestion.get("tables") or [t.name for t in tables]) if ingestion else []
+        for table in tables:
+            if table.push_only and table.name not in accepted:
+                raise ValueError(f"Table {table.name} of sync pair {definition['sync_pair_id']} is push_only, "
+                                 f"so the sync pair's ingestion block must accept pushes to it")
+        freshness_slo = parse_freshness_slo(definition["sync_pair_id"], definition.get("freshness_slo"),
+                                            [t.name for t in tables])
+        roll_years = {}
+        if definition.get("roll_years"):
+            if direction == "bidirectional":
+                # Certified rolls are frozen, so their edits could not be pushed back
+                raise ValueError("Roll years are not supported on bidirectional sync pairs")
+            roll_years = parse_roll_years(definition["sync_pair_id"], definition["roll_years"], tables)
+
+        cdc = self._parse_cdc(definition["sync_pair_id"], definition.get("cdc"), tables)
+        schedules = self._parse_schedules(definition["sync_pair_id"], definition.get("schedules"), tables,
+                                          county_config.get("timezone", "UTC"))
+
+        snapshot = copy.deepcopy(definition.get("snapshot") or {})
+        if snapshot.get("enabled"):
+            if direction == "bidirectional":
+                # Restoring staging alone would undo edits already pushed to the source
+                raise ValueError("Snapshots are not supported on bidirectional sync pairs")
+            snapshot.setdefault("keep", DEFAULT_SNAPSHOTS_KEPT)
+            snapshot.setdefault("validations", [])
+            table_names = {t.name for t in tables}
+            for rule in snapshot["validations"]:
+                validate_rule(rule)
+                for name in rule.get("tables", []):
+                    if name not in table_names:
+                        raise ValueError(f"Validation rule {rule['type']} names unknown table {name}")
+
+        for hook in hooks:
+            # Fail at load time on unknown types, missing plugins or bad options
+            load_hook(hook)
+
+        return SyncPairConfig(
+            sync_pair_id=definition["sync_pair_id"],
+            county_id=county_id,
+            name=definition.get("name", definition["sync_pair_id"]),
+            source=source,
+            target=copy.deepcopy(definition["target"]),
+            tables=tables,
+            batch_size=int(definition.get("batch_size", DEFAULT_BATCH_SIZE)),
+            default_mode=definition.get("default_mode", "incremental"),
+            direction=direction,
+            conflict_strategy=conflict_strategy,
+            hooks=hooks,
+            cdc=cdc,
+            snapshot=snapshot,
+            filters=filters,
+            merge=merge,
+            validation=validation,
+            geometry_repair=geometry_repair,
+            address_standardization=address_standardization,
+            topology_qa=topology_qa,
+            anomalies=anomalies,
+            events=events,
+            odata=odata,
+            graphql=graphql,
+            open_data=open_data,
+            ingestion=ingestion,
+            freshness_slo=freshness_slo,
+            roll_years=roll_years,
+            schedules=schedules,
+            vendor=(definition.get("vendor") or {}).get("type"),
+            entities=definition.get("entities") or {},
+            fingerprint=self._fingerprint(county_config, original, mapping),
+        )
+
+    @staticmethod
+    def _fingerprint(county_config: Dict[str, Any], definition: Dict[str, Any],
+                     mapping: Optional[FieldMapping]) -> str:
+        """Digest of what a sync pair is built from, so a reload can tell which pairs changed."""
+        material = json.dumps({
+            "county_id": county_config.get("county_id"),
+            "timezone": county_config.get("timezone"),
+            "data_ingestion_settings": county_config.get("data_ingestion_settings"),
+            "definition": definition,
+            "mapping": mapping.digest if mapping is not None else None,
+        }, sort_keys=True, default=str)
+        return hashlib.sha256(material.encode("utf-8")).hexdigest()
+
+    @staticmethod
+    def _parse_schedules(sync_pair_id: str, definitions: Optional[List[Dict[str, Any]]],
+                         tables: List[SyncTableConfig], county_timezone: str) -> List[Dict[str, Any]]:
+        """
+        Validate the configured schedules of a sync pair and fill in their
+        defaults; cron expressions are parsed by the scheduler.
+        """
+        if not definitions:
+            return []
+        if not isinstance(definitions, list):
+            raise ValueError(f"Schedules of sync pair {sync_pair_id} must be a list")
+        table_names = {t.name for t in tables}
+        schedules, names = [], set()
+        for definition in definitions:
+            if not isinstance(definition, dict) or not isinstance(definition.get("cron"), str):
+                raise ValueError(f"Each schedule of sync pair {sync_pair_id} needs a cron expression")
+            # A schedule is known by its name across reloads; unnamed schedules by their cron expression
+            name = str(definition.get("name") or definition["cron"].strip())
+            if name in names:
+                raise ValueError(f"Sync pair {sync_pair_id} has two schedules named {name}")
+            names.add(name)
+            for table_name in definition.get("tables") or []:
+                if table_name not in table_names:
+                    raise ValueError(f"Schedule {name} of sync pair {sync_pair_id} names unknown table {table_name}")
+            mode = definition.get("mode")
+            if mode is not None and mode not in SCHEDULE_MODES:
+                raise ValueError(f"Schedule {name} of sync pair {sync_pair_id} has unsupported mode {mode}. "
+                                 f"Supported modes: {', '.join(SCHEDULE_MODES)}")
+            schedules.append({
+                "name": name,
+                "cron": definition["cron"].strip(),
+                "timezone": definition.get("timezone") or county_timezone,
+                "mode": mode,
+                "tables": list(definition["tables"]) if definition.get("tables") else None,
+                "catch_up": definition.get("catch_up", "latest"),
+                "parameters": copy.deepcopy(definition.get("parameters") or {}),
+            })
+        return schedules
+
+    @staticmethod
+    def _parse_cdc(sync_pair_id: str, definition: Optional[Dict[str, Any]],
+                   tables: List[SyncTableConfig]) -> Dict[str, Any]:
+        """Validate the change listener settings of a sync pair."""
+        if not definition:
+            return {}
+        tracked = [t.name for t in tables if t.change_tracking]
+        listened = list(definition.get("tables") or tracked)
+        for name in listened:
+            table = next((t for t in tables if t.name == name), None)
+            if table is None:
+                raise ValueError(f"CDC listener for sync pair {sync_pair_id} names unknown table {name}")
+            if not table.change_tracking:
+                raise ValueError(
+                    f"CDC listener for sync pair {sync_pair_id} needs change tracking on table {name}"
+                )
+        if not listened:
+            raise ValueError(f"CDC listener for sync pair {sync_pair_id} has no change-tracked tables")
+        poll_seconds = float(definition.get("poll_seconds", DEFAULT_CDC_POLL_SECONDS))
+        if poll_seconds <= 0:
+            raise ValueError(f"CDC poll_seconds for sync pair {sync_pair_id} must be positive")
+        return {
+            "enabled": bool(definition.get("enabled", True)),
+            "poll_seconds": poll_seconds,
+            "tables": listened,
+        }
+
+    @staticmethod
+    def _validate_dependencies(sync_pair_id: str, tables: List[SyncTableConfig]) -> None:
+        """Check that depends_on names tables of the pair and contains no cycles."""
+        names = {t.name for t in tables}
+        graph = {t.name: t.depends_on for t in tables}
+        for table in tables:
+            for dependency in table.depends_on:
+                if dependency not in names:
+                    raise ValueError(
+                        f"Table {table.name} in sync pair {sync_pair_id} depends on unknown table {dependency}"
+                    )
+
+        visiting, visited = set(), set()
+
+        def visit(name: str) -> None:
+            if name in visited:
+                return
+            if name in visiting:
+                raise ValueError(f"Sync pair {sync_pair_id} has a table dependency cycle involving {name}")
+            visiting.add(name)
+            for dependency in graph[name]:
+                visit(dependency)
+            visiting.discard(name)
+            visited.add(name)
+
+        for name in graph:
+            visit(name)
+
+
+# Create a singleton instance
+sync_pair_registry = SyncPairRegistry()
@@ -0,0 +1,480 @@
+"""
+TerraFusion SyncService - Building Permit Matching and Worklist
+
+This module matches the building permits of municipal permit feeds to
+parcels and keeps a worklist of the parcels with new construction activity,
+so appraisers visit the parcels whose value is changing. Permits sync into
+the staging table of the building_permits entity module (see sync_entities)
+from the city's permit API (a "rest" source) or the files it drops in a
+folder (a "file_drop" source, see sync_connectors). The module adds a
+permit_match hook to its table:
+
+    "building_permits": {
+        "parcels": {"table": "dbo.property"},
+        "matching": {
+            "parcel_number_field": "parcel_number",
+            "addresses": {"table": "dbo.situs", "key_field": "prop_id",
+                          "columns": ["situs_num", "situs_street_prefx", "situs_street", "situs_street_sufix"]},
+            "min_confidence": 0.8
+        },
+        "type_codes": {"RES-NEW": "new_construction", "RES-ADD": "addition", "DEMO": "demolition"}
+    }
+
+Each permit is matched by the parcel number it gives, normalized (upper
+case, letters and digits only) and compared with the parcels table's
+parcel_number_field, and by its situs address, parsed (see sync_address) and
+compared with the parcels' situs addresses read from the addresses table
+(its columns joined make the street line). The best candidate wins, with a
+match confidence from 0 to 1:
+
+- parcel number, exact: 1.0; close (a mistyped or transposed character):
+  0.9 times the similarity
+- address, exact: 0.95, or 0.9 when the directional or street type is
+  missing on one side; same house number and a similar street name: 0.85
+  times the similarity
+- an address several parcels share loses AMBIGUOUS_PENALTY; a parcel
+  number and address naming the same parcel gain AGREEMENT_BONUS
+
+The permit's prop_id is set when the confidence reaches min_confidence;
+otherwise it stays null, with the best candidate in candidate_prop_id.
+match_method names what matched ("parcel_number", "parcel_number_fuzzy",
+"address", "address_fuzzy" or "unmatched") and match_confidence how well.
+
+After each batch, permits whose work class is in the block's
+worklist_classes (new construction, additions and demolitions by default)
+are put on the worklist of their parcel, and unmatched ones on the worklist
+of their own to be matched by hand. A reviewer marks an item REVIEWED; a
+new permit on a reviewed parcel reopens it. Dry runs change no worklist.
+"""
+
+import re
+import hashlib
+import logging
+import threading
+from datetime import date, datetime
+from decimal import Decimal
+from difflib import SequenceMatcher
+from typing import Dict, List, Any, Optional, Tuple
+
+from sync_connectors import OPERATION_FIELD
+from sync_hooks import TransformHook, HookContext, register_hook
+from sync_store import DocumentStore, sync_state_store
+from sync_address import LocalAddressParser
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Hook type the building_permits module adds to its permit table
+PERMIT_MATCH_HOOK = "permit_match"
+
+# Work classes of a permit
+PERMIT_WORK_CLASSES = ["new_construction", "addition", "alteration", "demolition", "mechanical", "other"]
+
+# Work classes that put a parcel on the worklist by default
+DEFAULT_WORKLIST_CLASSES = ["new_construction", "addition", "demolition"]
+
+# Permit columns the permit_match hook sets
+MATCH_COLUMNS = ["prop_id", "candidate_prop_id", "match_method", "match_confidence"]
+
+# Confidence a match needs for the permit's prop_id to be set, by default
+DEFAULT_MIN_CONFIDENCE = 0.8
+
+# Similarity a close parcel number or street name needs to be a candidate
+MIN_SIMILARITY = 0.8
+
+# Confidence lost when an address matches several parcels
+AMBIGUOUS_PENALTY = 0.2
+
+# Confidence gained when the parcel number and address name the same parcel
+AGREEMENT_BONUS = 0.05
+
+# State store collection of worklist items
+PERMIT_WORKLIST_COLLECTION = "permit_worklist"
+
+# Kinds of worklist item: a parcel with construction activity, or a permit without a parcel
+WORKLIST_KINDS = ["construction", "unmatched"]
+
+# Statuses of a worklist item
+WORKLIST_STATUSES = ["OPEN", "REVIEWED"]
+
+# Permit columns kept on a worklist item
+WORKLIST_PERMIT_COLUMNS = ["permit_id", "permit_type_code", "work_class", "description", "status", "issued_date",
+                           "valuation", "square_feet", "situs_address", "parcel_number", "match_method",
+                           "match_confidence", "candidate_prop_id"]
+
+# Address components compared when matching a permit's address
+_STREET_COMPONENTS = ["predirectional", "street_name", "street_type", "postdirectional"]
+
+_lock = threading.Lock()
+
+
+def normalize_parcel_number(value: Any) -> Optional[str]:
+    """A parcel number upper-cased with everything but letters and digits removed."""
+    if value is None:
+        return None
+    text = re.sub(r"[^A-Z0-9]", "", str(value).upper())
+    return text or None
+
+
+def _key(value: Any) -> str:
+    if isinstance(value, float) and value.is_integer():
+        value = int(value)
+    return str(value).strip()
+
+
+def _json_value(value: Any) -> Any:
+    if isinstance(value, (date, datetime)):
+        return value.isoformat()
+    if isinstance(value, Decimal):
+        return float(value)
+    return value
+
+
+class ParcelMatcher:
+    """The parcel numbers and situs addresses of a sync pair's parcels, indexed for matching permits."""
+
+    def __init__(self, min_confidence: float = DEFAULT_MIN_CONFIDENCE):
+        self.min_confidence = min_confidence
+        self.parser = LocalAddressParser()
+        self.numbers: Dict[str, Any] = {}
+        # Parcel numbers by their first and last halves, for finding close ones
+        self._halves: Dict[Tuple[int, str], List[str]] = {}
+        self.addresses: Dict[str, List[Tuple[Dict[str, Any], Any]]] = {}
+
+    def add_parcel_number(self, parcel_number: Any, prop_id: Any) -> None:
+        number = normalize_parcel_number(parcel_number)
+        if number is None or prop_id is None:
+            return
+        self.numbers[number] = prop_id
+        half = len(number) // 2
+        self._halves.setdefault((0, number[:half]), []).append(number)
+        self._halves.setdefault((1, number[half:]), []).append(number)
+
+    def add_address(self, street_line: str, prop_id: Any) -> None:
+        address = self._street(street_line)
+        if address is None or prop_id is None:
+            return
+        entries = self.addresses.setdefault(address["house_number"], [])
+        if not any(a == address and p == prop_id for a, p in entries):
+            entries.append((address, prop_id))
+
+    def match(self, parcel_number: Any = None, address: Any = None) -> Dict[str, Any]:
+        """
+        The best parcel for a permit.
+
+        Returns:
+            prop_id (None below min_confidence), candidate_prop_id,
+            match_method and match_confidence
+        """
+        by_number = self._match_number(parcel_number)
+        by_address = self._match_address(address)
+        candidates = [c for c in (by_number, by_address) if c is not None]
+        if not candidates:
+            return {"prop_id": None, "candidate_prop_id": None, "match_method": "unmatched", "match_confidence": 0.0}
+        best = max(candidates, key=lambda c: c[2])
+        prop_id, method, confidence = best
+        if by_number and by_address and _key(by_number[0]) == _key(by_address[0]):
+            confidence = min(1.0, confidence + AGREEMENT_BONUS)
+        confidence = round(confidence, 2)
+        matched = confidence >= self.min_confidence
+        return {
+            "prop_id": prop_id if matched else None,
+            "candidate_prop_id": prop_id,
+            "match_method": method if matched else "unmatched",
+            "match_confidence": confidence,
+        }
+
+    def _match_number(self, parcel_number: Any) -> Optional[Tuple[Any, str, float]]:
+        number = normalize_parcel_number(parcel_number)
+        if number is None:
+            return None
+        if number in self.numbers:
+            return self.numbers[number], "parcel_number", 1.0
+        half = len(number) // 2
+        candidates = set(self._halves.get((0, number[:half]), [])) | set(self._halves.get((1, number[half:]), []))
+        best = None
+        for candidate in candidates:
+            similarity = SequenceMatcher(None, number, candidate).ratio()
+            if similarity >= MIN_SIMILARITY and (best is None or similarity > best[1]):
+                best = (candidate, similarity)
+        if best is None:
+            return None
+        return self.numbers[best[0]], "parcel_number_fuzzy", 0.9 * best[1]
+
+    def _match_address(self, text: Any) -> Optional[Tuple[Any, str, float]]:
+        address = self._street(text)
+        if address is None:
+            return None
+        scored: List[Tuple[float, str, Any]] = []
+        for candidate, prop_id in self.addresses.get(address["house_number"], []):
+            if candidate == address:
+                scored.append((0.95, "address", prop_id))
+            elif candidate["street_name"] == address["street_name"] and all(
+                    candidate[c] == address[c] or not candidate[c] or not address[c] for c in _STREET_COMPONENTS):
+                scored.append((0.9, "address", prop_id))
+            else:
+                similarity = SequenceMatcher(None, address["street_name"], candidate["street_name"]).ratio()
+                if similarity >= MIN_SIMILARITY:
+                    scored.append((0.85 * similarity, "address_fuzzy", prop_id))
+        if not scored:
+            return None
+        confidence, method, prop_id = max(scored, key=lambda s: s[0])
+        if len({_key(p) for c, _, p in scored if c == confidence}) > 1:
+            confidence -= AMBIGUOUS_PENALTY
+        return prop_id, method, confidence
+
+    def _street(self, text: Any) -> Optional[Dict[str, Any]]:
+        """The house number and street of an address, or None without either."""
+        if text is None or not str(text).strip():
+            return None
+        parsed = self.parser.parse(str(text))
+        if not parsed.get("house_number") or not parsed.get("street_name"):
+            return None
+        return {name: parsed.get(name) for name in ["house_number"] + _STREET_COMPONENTS}
+
+    @classmethod
+    def load(cls, target, options: Dict[str, Any]) -> "ParcelMatcher":
+        """
+        Index the parcels of a sync pair's target.
+
+        Args:
+            target: Target connector
+            options: The permit_match hook's options
+
+        Raises:
+            ConnectorError: If a table cannot be read
+        """
+        matcher = cls(options.get("min_confidence", DEFAULT_MIN_CONFIDENCE))
+        parcels = options["parcels"]
+        if options.get("parcel_number_field"):
+            field = options["parcel_number_field"]
+            for row in target.query_records(parcels["table"], None, [parcels["key_field"], field]):
+                matcher.add_parcel_number(row.get(field), row.get(parcels["key_field"]))
+        addresses = options.get("addresses")
+        if addresses:
+            columns = addresses["columns"]
+            for row in target.query_records(addresses["table"], None, [addresses["key_field"]] + columns):
+                line = " ".join(str(row[c]).strip() for c in columns if row.get(c) not in (None, ""))
+                matcher.add_address(line, row.get(addresses["key_field"]))
+        logger.info(f"Indexed {len(matcher.numbers)} parcel numbers and "
+                    f"{sum(len(a) for a in matcher.addresses.values())} situs addresses for permit matching")
+        return matcher
+
+
+class PermitWorklist:
+    """Keeps the worklist of parcels with construction activity and of unmatched permits."""
+
+    def __init__(self, store: Optional[DocumentStore] = None):
+        self.store = store or sync_state_store
+
+    @staticmethod
+    def item_id(sync_pair_id: str, kind: str, key: str) -> str:
+        digest = hashlib.sha1(f"{kind}/{key}".encode("utf-8")).hexdigest()[:20]
+        return f"{sync_pair_id}__{digest}"
+
+    def record_permits(self, sync_pair_id: str, permits: List[Dict[str, Any]], deleted: List[str],
+                       worklist_classes: List[str], job_id: Optional[str] = None) -> Dict[str, int]:
+        """
+        Put the permits of a batch on the worklist, and take deleted or
+        rematched ones off.
+
+        Returns:
+            Counts of the items added, updated and reopened
+        """
+        now = datetime.utcnow().isoformat()
+        counts = {"added": 0, "updated": 0, "reopened": 0}
+        with _lock:
+            items = [item for item in self.store.list(PERMIT_WORKLIST_COLLECTION)
+                     if item.get("sync_pair_id") == sync_pair_id]
+            # Where each permit is listed, so a permit matched to another parcel moves
+            listed = {permit_id: item["item_id"] for item in items for permit_id in item["permits"]}
+            by_id = {item["item_id"]: item for item in items}
+            changed = set()
+            gone = set(deleted) | {_key(p["permit_id"]) for p in permits}
+            for permit_id in gone:
+                item_id = listed.get(permit_id)
+                if item_id is not None:
+                    by_id[item_id]["permits"].pop(permit_id, None)
+                    changed.add(item_id)
+
+            for permit in permits:
+                if permit.get("work_class") not in worklist_classes:
+                    continue
+                permit_id = _key(permit["permit_id"])
+                if permit.get("prop_id") is not None:
+                    kind, key = "construction", _key(permit["prop_id"])
+                else:
+                    kind, key = "unmatched", permit_id
+                item_id = self.item_id(sync_pair_id, kind, key)
+                item = by_id.get(item_id)
+                if item is None:
+                    item = by_id[item_id] = {
+                        "item_id": item_id, "sync_pair_id": sync_pair_id, "kind": kind,
+                        "prop_id": permit.get("prop_id") if kind == "construction" else None,
+                        "status": "OPEN", "permits": {}, "first_added_at": now,
+                    }
+                    counts["added"] += 1
+                elif listed.get(permit_id) != item_id and item["status"] == "REVIEWED":
+                    # A new permit on a parcel already reviewed
+                    item.update(status="OPEN", reopened_at=now)
+                    counts["reopened"] += 1
+                else:
+                    counts["updated"] += 1
+                item["permits"][permit_id] = {column: _json_value(permit.get(column))
+                                              for column in WORKLIST_PERMIT_COLUMNS}
+                changed.add(item_id)
+
+            for item_id in changed:
+                item = by_id[item_id]
+                if not item["permits"]:
+                    self.store.delete(PERMIT_WORKLIST_COLLECTION, item_id)
+                    continue
+                issued = [p["issued_date"] for p in item["permits"].values() if p.get("issued_date")]
+                item.update({
+                    "permit_count": len(item["permits"]),
+                    "total_valuation": sum(p["valuation"] or 0 for p in item["permits"].values()),
+                    "work_classes": sorted({p["work_class"] for p in item["permits"].values() if p.get("work_class")}),
+                    "latest_issued_date": max(issued) if issued else None,
+                    "job_id": job_id,
+                    "updated_at": now,
+                })
+                self.store.save(PERMIT_WORKLIST_COLLECTION, item_id, item)
+        return counts
+
+    def list(self, sync_pair_id: str, kind: Optional[str] = None, status: Optional[str] = None,
+             work_class: Optional[str] = None) -> List[Dict[str, Any]]:
+        """
+        The worklist items of a sync pair.
+
+        Raises:
+            ValueError: If the kind or status is not supported
+        """
+        if kind is not None and kind not in WORKLIST_KINDS:
+            raise ValueError(f"Unsupported worklist kind: {kind}. Supported kinds: {', '.join(WORKLIST_KINDS)}")
+        if status is not None and status not in WORKLIST_STATUSES:
+            raise ValueError(f"Unsupported worklist status: {status}. "
+                             f"Supported statuses: {', '.join(WORKLIST_STATUSES)}")
+        return [
+            item for item in self.store.list(PERMIT_WORKLIST_COLLECTION)
+            if item.get("sync_pair_id") == sync_pair_id
+            and (kind is None or item["kind"] == kind)
+            and (status is None or item["status"] == status)
+            and (work_class is None or work_class in item.get("work_classes", []))
+        ]
+
+    def get(self, sync_pair_id: str, item_id: str) -> Dict[str, Any]:
+        """
+        Raises:
+            KeyError: If the sync pair has no such worklist item
+        """
+        try:
+            item = self.store.load(PERMIT_WORKLIST_COLLECTION, item_id)
+        except FileNotFoundError:
+            item = None
+        if item is None or item.get("sync_pair_id") != sync_pair_id:
+            raise KeyError(f"Worklist item {item_id} not found in sync pair {sync_pair_id}")
+        return item
+
+    def review(self, sync_pair_id: str, item_id: str, status: str, username: str,
+               note: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Mark a worklist item REVIEWED, or put it back OPEN.
+
+        Raises:
+            KeyError: If the item does not exist
+            ValueError: If the status is not supported
+        """
+        if status not in WORKLIST_STATUSES:
+            raise ValueError(f"Unsupported review status: {status}. Reviewers can set {' or '.join(WORKLIST_STATUSES)}")
+        with _lock:
+            item = self.get(sync_pair_id, item_id)
+            item.update({"status": status, "reviewed_by": username, "reviewed_at": datetime.utcnow().isoformat()})
+            if note:
+                item["note"] = note
+            self.store.save(PERMIT_WORKLIST_COLLECTION, item_id, item)
+        return item
+
+
+class PermitWorklistService:
+    """The permit worklists of the sync pairs with a building_permits module, for the API."""
+
+    def __init__(self, registry, store: Optional[DocumentStore] = None):
+        self.registry = registry
+        self.worklist = PermitWorklist(store)
+
+    def list_items(self, sync_pair_id: str, kind: Optional[str] = None, status: Optional[str] = None,
+                   work_class: Optional[str] = None) -> List[Dict[str, Any]]:
+        """
+        Raises:
+            KeyError: If the sync pair is unknown or has no building_permits module
+            ValueError: If a filter is not supported
+        """
+        self._check(sync_pair_id)
+        if work_class is not None and work_class not in PERMIT_WORK_CLASSES:
+            raise ValueError(f"Unsupported work class: {work_class}. "
+                             f"Supported classes: {', '.join(PERMIT_WORK_CLASSES)}")
+        return self.worklist.list(sync_pair_id, kind, status, work_class)
+
+    def get_item(self, sync_pair_id: str, item_id: str) -> Dict[str, Any]:
+        self._check(sync_pair_id)
+        return self.worklist.get(sync_pair_id, item_id)
+
+    def review_item(self, sync_pair_id: str, item_id: str, status: str, username: str,
+                    note: Optional[str] = None) -> Dict[str, Any]:
+        self._check(sync_pair_id)
+        return self.worklist.review(sync_pair_id, item_id, status, username, note)
+
+    def _check(self, sync_pair_id: str) -> None:
+        pair = self.registry.get(sync_pair_id)
+        if not pair.entities.get("building_permits"):
+            raise KeyError(f"Sync pair {sync_pair_id} has no building_permits entity module")
+
+
+@register_hook(PERMIT_MATCH_HOOK)
+class PermitMatchHook(TransformHook):
+    """
+    Matches permits to parcels and puts them on the appraisers' worklist.
+
+    Options:
+        parcels: {"table": table definition, "key_field"} of the parcels (required)
+        parcel_number_field: Parcels column of the parcel number
+        addresses: {"table": table definition, "key_field", "columns"} of the situs addresses
+        min_confidence: Confidence a match needs, default DEFAULT_MIN_CONFIDENCE
+        worklist_classes: Work classes put on the worklist
+    """
+
+    def __init__(self, options: Optional[Dict[str, Any]] = None, store: Optional[DocumentStore] = None):
+        super().__init__(options)
+        if not self.options.get("parcels"):
+            raise ValueError("permit_match hook requires a 'parcels' option")
+        self.worklist = PermitWorklist(store)
+        self.worklist_classes = list(self.options.get("worklist_classes") or DEFAULT_WORKLIST_CLASSES)
+        self.target = None
+        self.matcher: Optional[ParcelMatcher] = None
+
+    def bind(self, target) -> "PermitMatchHook":
+        self.target = target
+        self.matcher = None
+        return self
+
+    def transform(self, record: Dict[str, Any], context: HookContext) -> Optional[Dict[str, Any]]:
+        if record.get(OPERATION_FIELD) == "delete" or self.target is None:
+            return record
+        if self.matcher is None:
+            # Indexed once per run of the table, after the parcel tables it depends on have loaded
+            self.matcher = ParcelMatcher.load(self.target, self.options)
+        record.update(self.matcher.match(record.get("parcel_number"), record.get("situs_address")))
+        return record
+
+    def after_load(self, records: List[Dict[str, Any]], counts: Dict[str, int], context: HookContext) -> None:
+        if context.dry_run or not records:
+            return
+        permits = [r for r in records if r.get(OPERATION_FIELD) != "delete" and r.get("permit_id") is not None]
+        deleted = [_key(r["permit_id"]) for r in records
+                   if r.get(OPERATION_FIELD) == "delete" and r.get("permit_id") is not None]
+        listed = self.worklist.record_permits(context.sync_pair_id, permits, deleted, self.worklist_classes,
+                                              context.job_id)
+        if listed["added"] or listed["reopened"]:
+            logger.info(f"Permit worklist of sync pair {context.sync_pair_id}: {listed['added']} items added, "
+                        f"{listed['reopened']} reopened")
@@ -0,0 +1,341 @@
+"""
+TerraFusion SyncService - Connection Pools
+
+This module provides the connection pools of the database connectors
+(SQL Server, Oracle, PostgreSQL and PostGIS). Every connector reaching the
+same database with the same credentials draws from one pool per process,
+so sync workers, jobs and exports reuse connections instead of each
+opening its own, and a county database shared with other systems never
+sees more than max_open connections from the service. A connector may tune
+its pool, or opt out with "pool": false:
+
+    "pool": {
+        "name": "benton-pacs",
+        "max_open": 8,
+        "max_idle": 2,
+        "max_lifetime_seconds": 1800,
+        "max_idle_seconds": 300,
+        "wait_seconds": 30,
+        "statement_timeout_seconds": 600
+    }
+
+A connector waits up to wait_seconds for a connection once max_open are in
+use, then fails with a ConnectorError. Returned connections are rolled back
+and kept for reuse, at most max_idle of them; connections older than
+max_lifetime_seconds, or idle for longer than max_idle_seconds, are closed
+rather than reused (checked as connections come and go, and at each
+metrics scrape), so the service lets go of a database it no longer needs
+and never hands out a connection a firewall has silently dropped.
+statement_timeout_seconds cancels any statement running longer (the query
+timeout of SQL Server, the call timeout of Oracle, statement_timeout of
+PostgreSQL).
+
+Pool connections, waits, timeouts and closed connections are exported in
+the metrics by pool name ("<type>:<host>/<database>" unless "name" is set).
+"""
+
+import os
+import time
+import hashlib
+import logging
+import threading
+from typing import Dict, List, Any, Optional, Callable
+
+from metrics import metrics_registry, DB_POOL_CONNECTIONS, DB_POOL_SIZE, DB_POOL_WAIT, DB_POOL_TIMEOUTS, \
+    DB_POOL_CLOSED
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Connections a pool opens at most, and keeps idle for reuse
+DEFAULT_MAX_OPEN = int(os.environ.get("DB_POOL_MAX_OPEN", "10"))
+DEFAULT_MAX_IDLE = int(os.environ.get("DB_POOL_MAX_IDLE", "2"))
+
+# Seconds a connection is used for at most, and kept idle at most; 0 for no limit
+DEFAULT_MAX_LIFETIME_SECONDS = float(os.environ.get("DB_POOL_MAX_LIFETIME_SECONDS", "1800"))
+DEFAULT_MAX_IDLE_SECONDS = float(os.environ.get("DB_POOL_MAX_IDLE_SECONDS", "300"))
+
+# Seconds to wait for a connection while every one is in use
+DEFAULT_WAIT_SECONDS = float(os.environ.get("DB_POOL_WAIT_SECONDS", "30"))
+
+# Seconds a statement may run before it is cancelled; unset for no limit
+DEFAULT_STATEMENT_TIMEOUT_SECONDS = float(os.environ["DB_STATEMENT_TIMEOUT_SECONDS"]) \
+    if os.environ.get("DB_STATEMENT_TIMEOUT_SECONDS") else None
+
+POOL_FIELDS = ["max_open", "max_idle", "max_lifetime_seconds", "max_idle_seconds", "wait_seconds",
+               "statement_timeout_seconds"]
+
+
+class PoolTimeoutError(Exception):
+    """Raised when no pooled connection frees up within a pool's wait_seconds."""
+
+
+def _number(settings: Dict[str, Any], name: str, default: Optional[float], minimum: float = 0) -> Optional[float]:
+    value = settings.get(name, default)
+    if value is None:
+        return None
+    try:
+        value = float(value)
+    except (TypeError, ValueError):
+        raise ValueError(f"pool {name} must be a number")
+    if value < minimum:
+        raise ValueError(f"pool {name} must be at least {minimum:g}")
+    return value
+
+
+def parse_pool(definition: Any, defaults: Optional[Dict[str, Any]] = None) -> Dict[str, Any]:
+    """
+    Validate the "pool" block of a connector.
+
+    Args:
+        definition: The block; false turns pooling off
+        defaults: Settings used where the block has none, over this module's defaults
+
+    Returns:
+        The pool name (None for the default) and every setting of POOL_FIELDS;
+        {"enabled": False} when the block is false
+
+    Raises:
+        ValueError: If a setting is invalid
+    """
+    if definition is False:
+        return {"enabled": False}
+    definition = definition if isinstance(definition, dict) else {}
+    if definition.get("enabled") is False:
+        return {"enabled": False}
+    unknown = [name for name in definition if name not in POOL_FIELDS + ["name", "enabled"]]
+    if unknown:
+        raise ValueError(f"Unknown pool setting {unknown[0]}; settings: {', '.join(POOL_FIELDS)}")
+    base = {
+        "max_open": DEFAULT_MAX_OPEN,
+        "max_idle": DEFAULT_MAX_IDLE,
+        "max_lifetime_seconds": DEFAULT_MAX_LIFETIME_SECONDS,
+        "max_idle_seconds": DEFAULT_MAX_IDLE_SECONDS,
+        "wait_seconds": DEFAULT_WAIT_SECONDS,
+        "statement_timeout_seconds": DEFAULT_STATEMENT_TIMEOUT_SECONDS,
+    }
+    base.update({name: value for name, value in (defaults or {}).items() if value is not None})
+    parsed = {"enabled": True, "name": definition.get("name")}
+    for name in POOL_FIELDS:
+        parsed[name] = _number(definition, name, base[name], 1 if name == "max_open" else 0)
+    parsed["max_open"] = int(parsed["max_open"])
+    parsed["max_idle"] = min(int(parsed["max_idle"]), parsed["max_open"])
+    if parsed["statement_timeout_seconds"] == 0:
+        parsed["statement_timeout_seconds"] = None
+    return parsed
+
+
+class _Pooled:
+    """A connection a pool opened, and when."""
+
+    __slots__ = ("connection", "opened_at", "idle_since")
+
+    def __init__(self, connection):
+        self.connection = connection
+        self.opened_at = time.monotonic()
+        self.idle_since = self.opened_at
+
+
+class ConnectionPool:
+    """The pooled connections of one database and set of credentials."""
+
+    def __init__(self, name: str, open_connection: Callable[[], Any], settings: Dict[str, Any]):
+        """
+        Initialize the pool; connections are opened when first needed.
+
+        Args:
+            name: Pool name for metrics and messages
+            open_connection: Opens a new database connection
+            settings: Parsed pool settings (see parse_pool)
+        """
+        self.name = name
+        self.open_connection = open_connection
+        self.configure(settings)
+        self.opened_count = 0
+        self.timeouts = 0
+        self._idle: List[_Pooled] = []
+        self._in_use: Dict[int, _Pooled] = {}
+        self._opening = 0
+        self._condition = threading.Condition()
+
+    def configure(self, settings: Dict[str, Any]) -> None:
+        self.max_open = settings["max_open"]
+        self.max_idle = settings["max_idle"]
+        self.max_lifetime_seconds = settings["max_lifetime_seconds"]
+        self.max_idle_seconds = settings["max_idle_seconds"]
+        self.wait_seconds = settings["wait_seconds"]
+        self.statement_timeout_seconds = settings["statement_timeout_seconds"]
+
+    def acquire(self):
+        """
+        A connection for the caller's use until release.
+
+        Raises:
+            PoolTimeoutError: If every connection stays in use for wait_seconds
+        """
+        started = time.monotonic()
+        deadline = started + self.wait_seconds
+        stale: List[_Pooled] = []
+        try:
+            with self._condition:
+                while True:
+                    pooled = self._take_idle(stale)
+                    if pooled is not None:
+                        self._in_use[id(pooled.connection)] = pooled
+                        return pooled.connection
+                    if len(self._in_use) + self._opening < self.max_open:
+                        self._opening += 1
+                        break
+                    remaining = deadline - time.monotonic()
+                    if remaining <= 0:
+                        self.timeouts += 1
+                        DB_POOL_TIMEOUTS.inc(pool=self.name)
+                        raise PoolTimeoutError(f"No connection of pool {self.name} became free within "
+                                               f"{self.wait_seconds:g} seconds (max_open {self.max_open})")
+                    self._condition.wait(remaining)
+        finally:
+            DB_POOL_WAIT.observe(time.monotonic() - started, pool=self.name)
+            self._close(stale)
+        try:
+            connection = self.open_connection()
+        except Exception:
+            with self._condition:
+                self._opening -= 1
+                self._condition.notify()
+            raise
+        with self._condition:
+            self._opening -= 1
+            self.opened_count += 1
+            self._in_use[id(connection)] = _Pooled(connection)
+        return connection
+
+    def release(self, connection, broken: bool = False) -> None:
+        """Hand a connection back: rolled back and kept for reuse, or closed."""
+        with self._condition:
+            pooled = self._in_use.pop(id(connection), None)
+        if pooled is None:
+            # Not one of ours (the pool was replaced while it was out)
+            self._close_connection(connection)
+            return
+        reason = "broken" if broken or getattr(connection, "closed", False) else None
+        if reason is None:
+            try:
+                connection.rollback()
+            except Exception:
+                reason = "broken"
+        if reason is None and self._expired(pooled.opened_at, self.max_lifetime_seconds):
+            reason = "lifetime"
+        with self._condition:
+            if reason is None and len(self._idle) >= self.max_idle:
+                reason = "surplus"
+            if reason is None:
+                pooled.idle_since = time.monotonic()
+                self._idle.append(pooled)
+            self._condition.notify()
+        if reason is not None:
+            self._close([pooled], reason)
+        self._reap()
+
+    def status(self) -> Dict[str, Any]:
+        with self._condition:
+            return {"name": self.name, "in_use": len(self._in_use), "idle": len(self._idle),
+                    "max_open": self.max_open, "max_idle": self.max_idle,
+                    "max_lifetime_seconds": self.max_lifetime_seconds, "max_idle_seconds": self.max_idle_seconds,
+                    "wait_seconds": self.wait_seconds, "statement_timeout_seconds": self.statement_timeout_seconds,
+                    "opened": self.opened_count, "timeouts": self.timeouts}
+
+    def _take_idle(self, stale: List[_Pooled]) -> Optional[_Pooled]:
+        """The most recently returned usable idle connection; expired ones go to stale."""
+        while self._idle:
+            pooled = self._idle.pop()
+            if self._expired(pooled.opened_at, self.max_lifetime_seconds) or \
+                    self._expired(pooled.idle_since, self.max_idle_seconds):
+                stale.append(pooled)
+                continue
+            return pooled
+        return None
+
+    def _reap(self) -> None:
+        """Close idle connections past their lifetime or idle time."""
+        stale: List[_Pooled] = []
+        with self._condition:
+            for pooled in list(self._idle):
+                if self._expired(pooled.opened_at, self.max_lifetime_seconds) or \
+                        self._expired(pooled.idle_since, self.max_idle_seconds):
+                    self._idle.remove(pooled)
+                    stale.append(pooled)
+        self._close(stale)
+
+    @staticmethod
+    def _expired(since: float, seconds: Optional[float]) -> bool:
+        return bool(seconds) and time.monotonic() - since >= seconds
+
+    def _close(self, connections: List[_Pooled], reason: Optional[str] = None) -> None:
+        for pooled in connections:
+            closing = reason or ("lifetime" if self._expired(pooled.opened_at, self.max_lifetime_seconds)
+                                 else "idle")
+            DB_POOL_CLOSED.inc(pool=self.name, reason=closing)
+            self._close_connection(pooled.connection)
+
+    @staticmethod
+    def _close_connection(connection) -> None:
+        try:
+            connection.close()
+        except Exception as e:
+            logger.debug(f"Closing a pooled connection failed: {e}")
+
+
+# Pools of this process, by name and a digest of what they connect to
+_pools: Dict[tuple, ConnectionPool] = {}
+_pools_lock = threading.Lock()
+
+
+def connection_pool(name: str, identity: str, open_connection: Callable[[], Any],
+                    settings: Dict[str, Any]) -> ConnectionPool:
+    """
+    The process's pool of a name and identity, created on first use and kept
+    up to date with settings.
+
+    Args:
+        name: Pool name
+        identity: What the connections reach, credentials included; connectors
+            with different credentials never share connections
+        open_connection: Opens a connection for a new pool
+        settings: Parsed pool settings (see parse_pool)
+    """
+    key = (name, hashlib.sha256(identity.encode("utf-8")).hexdigest())
+    with _pools_lock:
+        pool = _pools.get(key)
+        if pool is None:
+            pool = _pools[key] = ConnectionPool(name, open_connection, settings)
+        else:
+            pool.configure(settings)
+            pool.open_connection = open_connection
+        return pool
+
+
+def connection_pools() -> List[Dict[str, Any]]:
+    """The status of every connection pool of this process, by name."""
+    with _pools_lock:
+        pools = sorted(_pools.items(), key=lambda item: item[0])
+    return [pool.status() for _, pool in pools]
+
+
+@metrics_registry.collector
+def _collect_pools() -> None:
+    """Connections of the connector pools, closing expired idle ones on the way."""
+    totals: Dict[str, List[int]] = {}
+    with _pools_lock:
+        pools = list(_pools.values())
+    for pool in pools:
+        pool._reap()
+        status = pool.status()
+        counts = totals.setdefault(pool.name, [0, 0, 0])
+        counts[0] += status["in_use"]
+        counts[1] += status["idle"]
+        counts[2] += status["max_open"]
+    for name, (in_use, idle, size) in totals.items():
+        DB_POOL_CONNECTIONS.set(in_use, pool=name, state="in_use")
+        DB_POOL_CONNECTIONS.set(idle, pool=name, state="idle")
+        DB_POOL_SIZE.set(size, pool=name)
@@ -0,0 +1,323 @@
+"""
+TerraFusion SyncService - Job Progress Streams
+
+This module provides server-sent event (SSE) streams of sync job lifecycle
+events and batch-level progress, so the dashboard can draw live progress
+bars instead of polling the job status endpoint:
+
+    GET /api/v1/sync/jobs/<job_id>/events
+    GET /api/v1/sync/jobs/events?county_id=benton_wa&events=started,progress,completed
+
+The sync engine announces every lifecycle change on the event bus (see
+event_bus), and a "progress" event after committed batches, at most once per
+PROGRESS_EVENT_SECONDS per job. A progress event carries the table being
+synced, the tables done so far, the rows read and written, the rate, and an
+ETA estimated from the previous completed run of the same sync pair, mode
+and tables (see progress_summary).
+
+A stream of one job starts with a "snapshot" event holding the job's current
+progress and ends after the job completes, fails, is cancelled or is paused.
+A stream of all jobs, optionally narrowed to a county, sync pair or event
+types, runs until the client disconnects. Frames carry the bus event ID; a
+reader that falls behind loses progress events before lifecycle ones.
+"""
+
+import os
+import json
+import queue
+import logging
+import threading
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Iterator
+
+from sync_control import TERMINAL_STATUSES
+from event_bus import EventBusError, SUBJECT_SYNC_JOB
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Event streams this process serves at once; further requests are turned away
+MAX_PROGRESS_STREAMS = int(os.environ.get("JOB_EVENT_STREAM_MAX_CONCURRENT", "50"))
+
+# Seconds without events before a stream sends a keep-alive comment
+HEARTBEAT_SECONDS = int(os.environ.get("JOB_EVENT_STREAM_HEARTBEAT_SECONDS", "15"))
+
+# Milliseconds a disconnected EventSource waits before reconnecting
+RECONNECT_MILLISECONDS = 3000
+
+# Events held for a slow reader before progress events are dropped
+STREAM_QUEUE_SIZE = 256
+
+# Lifecycle and progress events a stream can be narrowed to
+JOB_EVENTS = ["created", "started", "progress", "completed", "failed", "paused", "cancelled", "preempted"]
+
+# Statuses after which a stream of one job ends
+FINAL_STATUSES = TERMINAL_STATUSES + ["PAUSED"]
+
+EVENT_STREAM_CONTENT_TYPE = "text/event-stream"
+
+
+class ProgressStreamLimitError(Exception):
+    """Raised when the process is already serving MAX_PROGRESS_STREAMS event streams."""
+
+
+def progress_summary(job: Dict[str, Any], current_table: Optional[str] = None) -> Dict[str, Any]:
+    """
+    The progress of a sync job, from its stats and the checkpoints of the tables in flight.
+
+    Percent and ETA come from job["estimated_records"] when the engine could
+    estimate the job's size; otherwise percent counts completed tables and
+    the ETA is None.
+
+    Args:
+        job: Sync job record
+        current_table: Table whose batch was just committed
+
+    Returns:
+        Dictionary with the job's progress
+    """
+    tables = job.get("tables") or []
+    results = job.get("table_results") or {}
+    in_flight = [(job.get("checkpoints") or {})[name].get("result", {})
+                 for name in tables if name in (job.get("checkpoints") or {}) and name not in results]
+    stats = job.get("stats") or {}
+    processed = stats.get("records_processed", 0) + sum(r.get("records_read", 0) for r in in_flight)
+    written = stats.get("records_written", 0) + sum(r.get("records_written", 0) for r in in_flight)
+
+    elapsed = None
+    if job.get("started_at"):
+        end = datetime.fromisoformat(job["completed_at"]) if job.get("completed_at") else datetime.utcnow()
+        elapsed = max((end - datetime.fromisoformat(job["started_at"])).total_seconds(), 0.0)
+    rate = processed / elapsed if elapsed else None
+
+    estimate = job.get("estimated_records")
+    completed = len([name for name in tables if name in results])
+    eta = None
+    if job.get("status") == "COMPLETED":
+        percent = 100.0
+    elif estimate and processed < estimate:
+        percent = processed * 100.0 / estimate
+        if rate:
+            eta = round((estimate - processed) / rate, 1)
+    else:
+        # No estimate, or this run is larger than the last one
+        percent = completed * 100.0 / len(tables) if tables else 0.0
+
+    return {
+        "current_table": current_table,
+        "tables_completed": completed,
+        "tables_total": len(tables),
+        "records_processed": processed,
+        "records_written": written,
+        "estimated_records": estimate,
+        "percent": round(percent, 1),
+        "elapsed_seconds": round(elapsed, 1) if elapsed is not None else None,
+        "rows_per_second": round(rate, 1) if rate is not None else None,
+        "eta_seconds": eta,
+        "updated_at": datetime.utcnow().isoformat(),
+    }
+
+
+def event_frame(event: str, data: Dict[str, Any], event_id: Optional[str] = None) -> bytes:
+    """One server-sent event."""
+    lines = [f"id: {event_id}"] if event_id else []
+    lines.append(f"event: {event}")
+    lines.append(f"data: {json.dumps(data, default=str)}")
+    return ("\n".join(lines) + "\n\n").encode("utf-8")
+
+
+class JobProgressStream:
+    """
+    The events of one stream, as an iterable of SSE frames for a streaming
+    response. close() ends the stream, unsubscribes it and frees its slot,
+    whether or not it was read to the end.
+    """
+
+    def __init__(self, service: "JobProgressService", job_id: Optional[str], county_id: Optional[str],
+                 sync_pair_id: Optional[str], events: Optional[List[str]], heartbeat_seconds: float):
+        self.service = service
+        self.job_id = job_id
+        self.county_id = county_id
+        self.sync_pair_id = sync_pair_id
+        self.events = events
+        self.heartbeat_seconds = heartbeat_seconds
+        self.sent = 0
+        self.dropped = 0
+        self._queue: "queue.Queue[Dict[str, Any]]" = queue.Queue(maxsize=STREAM_QUEUE_SIZE)
+        self._subscription = None
+        self._closed = False
+        self._frames = self._generate()
+
+    def __iter__(self):
+        return self._frames
+
+    def subscribe(self) -> None:
+        subject = SUBJECT_SYNC_JOB.format(job_id=self.job_id or "*", event="*")
+        self._subscription = self.service.bus.subscribe(subject, self._on_event)
+
+    def close(self) -> None:
+        if self._closed:
+            return
+        self._closed = True
+        self._frames.close()
+        self._release()
+
+    def _on_event(self, envelope: Dict[str, Any]) -> None:
+        """Hand a bus event to the stream; runs on the bus's dispatcher thread."""
+        data = envelope.get("data") or {}
+        event = envelope.get("subject", "").rsplit(".", 1)[-1]
+        if self.events and event not in self.events:
+            return
+        if self.county_id and data.get("county_id") != self.county_id:
+            return
+        if self.sync_pair_id and data.get("sync_pair_id") != self.sync_pair_id:
+            return
+        item = {"id": envelope.get("event_id"), "event": event, "data": data}
+        try:
+            self._queue.put_nowait(item)
+        except queue.Full:
+            if event == "progress":
+                self.dropped += 1
+                return
+            # Make room for a lifecycle event by dropping the oldest queued one
+            try:
+                self._queue.get_nowait()
+                self.dropped += 1
+            except queue.Empty:
+                pass
+            try:
+                self._queue.put_nowait(item)
+            except queue.Full:
+                self.dropped += 1
+
+    def _generate(self) -> Iterator[bytes]:
+        try:
+            yield f"retry: {RECONNECT_MILLISECONDS}\n\n".encode("utf-8")
+            if self.job_id:
+                job = self.service.engine.get_job_status(self.job_id)
+                yield self._snapshot(job)
+                if job["status"] in FINAL_STATUSES:
+                    return
+            while True:
+                try:
+                    item = self._queue.get(timeout=self.heartbeat_seconds)
+                except queue.Empty:
+                    if self.job_id:
+                        # Catch a final status whose event this stream missed
+                        job = self.service.engine.get_job_status(self.job_id)
+                        if job["status"] in FINAL_STATUSES:
+                            yield self._snapshot(job)
+                            return
+                    yield b": keep-alive\n\n"
+                    continue
+                self.sent += 1
+                yield event_frame(item["event"], item["data"], item["id"])
+                if self.job_id and item["event"] != "progress" and item["data"].get("status") in FINAL_STATUSES:
+                    return
+        except GeneratorExit:
+            logger.info(f"Job event stream {self._describe()} closed by the client after {self.sent} events")
+            raise
+        except Exception as e:
+            logger.error(f"Job event stream {self._describe()} failed: {e}", exc_info=True)
+            yield event_frame("error", {"error": str(e)})
+        finally:
+            self._release()
+
+    def _snapshot(self, job: Dict[str, Any]) -> bytes:
+        self.sent += 1
+        return event_frame("snapshot", {
+            "job_id": job["job_id"], "sync_pair_id": job["sync_pair_id"], "county_id": job.get("county_id"),
+            "status": job["status"], "mode": job.get("mode"), "dry_run": job.get("dry_run", False),
+            "tables": job.get("tables"), "stats": job.get("stats"), "message": job.get("message"),
+            "progress": progress_summary(job),
+        })
+
+    def _release(self) -> None:
+        if self._subscription is not None:
+            subscription, self._subscription = self._subscription, None
+            subscription.unsubscribe()
+        self.service._finished(self)
+
+    def _describe(self) -> str:
+        if self.job_id:
+            return f"for job {self.job_id}"
+        return f"for county {self.county_id or 'all'}, sync pair {self.sync_pair_id or 'all'}"
+
+
+class JobProgressService:
+    """Opens SSE streams of sync job events."""
+
+    def __init__(self, engine, bus, max_streams: int = MAX_PROGRESS_STREAMS,
+                 heartbeat_seconds: float = HEARTBEAT_SECONDS):
+        """
+        Initialize the service.
+
+        Args:
+            engine: Sync engine the jobs are read from
+            bus: Event bus the job events are announced on
+            max_streams: Streams served at once
+            heartbeat_seconds: Seconds without events before a keep-alive comment
+        """
+        self.engine = engine
+        self.bus = bus
+        self.max_streams = max_streams
+        self.heartbeat_seconds = heartbeat_seconds
+        self._lock = threading.Lock()
+        self._open: List[JobProgressStream] = []
+
+    def open(self, job_id: Optional[str] = None, county_id: Optional[str] = None,
+             sync_pair_id: Optional[str] = None, events: Optional[List[str]] = None) -> JobProgressStream:
+        """
+        Check a stream request and open the stream.
+
+        The stream subscribes before it reads the job's snapshot, so no event
+        falls between the two.
+
+        Args:
+            job_id: Stream the events of this job only, ending when it finishes
+            county_id: Stream the events of this county's jobs only
+            sync_pair_id: Stream the events of this sync pair's jobs only
+            events: Stream these event types only (see JOB_EVENTS)
+
+        Returns:
+            The stream, to be returned as the response body
+
+        Raises:
+            FileNotFoundError: If the job does not exist
+            ValueError: If an event type is unknown
+            ProgressStreamLimitError: If too many streams are open
+            EventBusError: If the stream cannot subscribe to the event bus
+        """
+        unknown = [event for event in events or [] if event not in JOB_EVENTS]
+        if unknown:
+            raise ValueError(f"Unknown job event {unknown[0]}; choose from {', '.join(JOB_EVENTS)}")
+        if job_id:
+            self.engine.get_job_status(job_id)
+
+        with self._lock:
+            if len(self._open) >= self.max_streams:
+                raise ProgressStreamLimitError(f"{len(self._open)} job event streams are already open; try again shortly")
+            stream = JobProgressStream(self, job_id, county_id, sync_pair_id, events or None, self.heartbeat_seconds)
+            self._open.append(stream)
+        try:
+            stream.subscribe()
+        except EventBusError:
+            stream.close()
+            raise
+        logger.info(f"Opened job event stream {stream._describe()}")
+        return stream
+
+    def status(self) -> Dict[str, Any]:
+        """The streams being served."""
+        with self._lock:
+            return {
+                "max_streams": self.max_streams,
+                "open": [{"job_id": s.job_id, "county_id": s.county_id, "sync_pair_id": s.sync_pair_id,
+                          "events": s.events, "sent": s.sent, "dropped": s.dropped} for s in self._open],
+            }
+
+    def _finished(self, stream: JobProgressStream) -> None:
+        with self._lock:
+            if stream in self._open:
+                self._open.remove(stream)
@@ -0,0 +1,465 @@
+"""
+TerraFusion SyncService - Sync Job Queue
+
+This module provides the priority queue that runs submitted sync jobs on a
+fixed set of worker threads. Waiting jobs start in priority order (urgent,
+high, normal, low) and first-come first-served within a priority.
+
+Small on-demand jobs (incremental, and at most EXPRESS_MAX_TABLES tables) can
+be submitted to the express lane, which has its own workers so a single-parcel
+correction never waits behind a long full sync. When an urgent job arrives
+and every regular worker is busy, the lowest-priority running job is
+preempted: it stops after its next committed batch, keeps its checkpoints and
+goes back to the queue, so no work is lost or repeated.
+
+Queued jobs are PENDING job records with a queued_at time, so the queue is
+rebuilt from the state store when the service restarts.
+
+With a distributed event bus (see event_bus), API nodes that do not run the
+queue hand jobs to the node that does: dispatch marks the job queued and
+announces it on the bus, and the running queue picks it up. A job announced
+while no queue is listening is still recovered when the queue next starts.
+The queue also announces its depth (waiting and running jobs) on the bus
+whenever it changes, for the system event feed (see system_events).
+
+The queue holds at most SYNC_QUEUE_MAX_WAITING jobs. A job counts only the
+waiting jobs of its priority or higher, so it can take the place of the
+newest waiting job of the lowest priority, which is cancelled; a job the
+queue has no room for, or that load_shedding sheds at the queue's pressure,
+is cancelled and refused with OverloadedError. Counties hosted on a shared
+instance run at most their max_running_sync_jobs at once (see
+tenant_quotas); their other jobs wait while the workers take other
+counties' jobs.
+
+When the service stops (see service_host), the queue is drained: running
+jobs are preempted as they are for urgent jobs, and resume from their
+checkpoints when the service starts again.
+"""
+
+import os
+import time
+import logging
+import threading
+from typing import Dict, List, Any, Optional, Tuple
+
+from sync_engine import SyncEngine, sync_engine, JOB_PRIORITIES, SHUTDOWN_PREEMPTION
+from event_bus import EventBus, EventBusError, Subscription, event_bus, SUBJECT_SYNC_QUEUE_SUBMIT, SUBJECT_SYSTEM
+from metrics import metrics_registry, SYNC_QUEUE_DEPTH, JOBS_SHED
+from load_shedding import LoadShedder, OverloadedError, load_shedder, check_priority
+from tenant_quotas import TenantQuotas, tenant_quotas
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Worker threads for regular and express jobs
+QUEUE_WORKERS = int(os.environ.get("SYNC_QUEUE_WORKERS", "2"))
+EXPRESS_WORKERS = int(os.environ.get("SYNC_EXPRESS_WORKERS", "1"))
+
+# Largest job (in tables) accepted in the express lane
+EXPRESS_MAX_TABLES = int(os.environ.get("SYNC_EXPRESS_MAX_TABLES", "2"))
+
+# Most jobs waiting in the queue at once
+MAX_WAITING = int(os.environ.get("SYNC_QUEUE_MAX_WAITING", "100"))
+
+# Jobs at this priority may preempt lower-priority running jobs
+PREEMPTING_PRIORITY = "urgent"
+
+LANE_REGULAR = "regular"
+LANE_EXPRESS = "express"
+
+# Event bus queue group of the job queues, so each dispatched job is queued once
+QUEUE_GROUP = "sync-queue"
+
+
+class SyncJobQueue:
+    """
+    Service class for queueing sync jobs by priority and running them on worker threads.
+    """
+
+    def __init__(self, engine: Optional[SyncEngine] = None,
+                 workers: int = QUEUE_WORKERS, express_workers: int = EXPRESS_WORKERS,
+                 bus: Optional[EventBus] = None, max_waiting: int = MAX_WAITING,
+                 shedder: Optional[LoadShedder] = None, quotas: Optional[TenantQuotas] = None):
+        """
+        Initialize the job queue.
+
+        Args:
+            engine: Sync engine that runs the jobs; defaults to the sync_engine singleton
+            workers: Number of regular worker threads
+            express_workers: Number of express lane worker threads
+            bus: Event bus that dispatched jobs arrive on
+            max_waiting: Most jobs waiting at once
+            shedder: Load shedder that decides what to refuse; defaults to the load_shedder singleton
+            quotas: County quotas that cap each county's running jobs; defaults to the tenant_quotas singleton
+        """
+        self.engine = engine or sync_engine
+        self.bus = bus or event_bus
+        self.shedder = shedder or load_shedder
+        self.quotas = quotas or tenant_quotas
+        self.max_waiting = max(1, max_waiting)
+        self._subscription: Optional[Subscription] = None
+        self.workers = max(1, workers)
+        self.express_workers = max(0, express_workers)
+        self._condition = threading.Condition()
+        self._waiting: Dict[str, Tuple[int, int, bool]] = {}  # job_id -> (priority rank, sequence, express)
+        self._running: Dict[str, Tuple[int, int, str]] = {}  # job_id -> (priority rank, sequence, lane)
+        self._counties: Dict[str, Optional[str]] = {}  # job_id -> county, of waiting and running jobs
+        self._preempting: set = set()
+        self._sequence = 0
+        self._stop_event = threading.Event()
+        self._threads: List[threading.Thread] = []
+        self._announced_depth: Optional[Dict[str, Any]] = None
+        logger.info("Sync job queue initialized")
+
+    def is_running(self) -> bool:
+        """Whether the worker threads have been started."""
+        return any(thread.is_alive() for thread in self._threads)
+
+    def submit(self, job_id: str, express: bool = False) -> Dict[str, Any]:
+        """
+        Queue a pending job.
+
+        Args:
+            job_id: ID of a PENDING sync job
+            express: Run the job in the express lane
+
+        Returns:
+            The queued job record
+
+        Raises:
+            FileNotFoundError: If the job does not exist
+            ValueError: If the job is not pending or too large for the express lane
+            OverloadedError: If the queue has no room for the job, which is cancelled
+        """
+        job = self.engine.get_job_status(job_id)
+        if express:
+            self._check_express(job)
+        priority = job.get("priority", "normal")
+        rank = JOB_PRIORITIES.index(priority)
+
+        try:
+            with self._condition:
+                victim = self._make_room(priority, rank)
+                job = self.engine.mark_queued(job_id, express)
+                if victim is not None:
+                    self._waiting.pop(victim)
+                    self._counties.pop(victim, None)
+                self._sequence += 1
+                self._waiting[job_id] = (rank, self._sequence, express)
+                self._counties[job_id] = job.get("county_id")
+                self._condition.notify_all()
+                self._maybe_preempt(job_id, rank, express)
+        except OverloadedError as e:
+            self._shed(job_id, f"Sync job refused by the job queue: {e}.")
+            raise
+        if victim is not None:
+            self._shed(victim, f"Sync job shed from the full job queue for {priority}-priority job {job_id}.",
+                       displaced=True)
+        self._announce_depth()
+        logger.info(f"Queued sync job {job_id} ({priority}{', express' if express else ''})")
+        return job
+
+    def check_capacity(self, priority: str = "normal") -> None:
+        """
+        Refuse a job of a priority before it is created if the queue would refuse it now.
+
+        Raises:
+            ValueError: If the priority is not supported
+            OverloadedError: If the queue has no room for the job
+        """
+        rank = check_priority(priority)
+        with self._condition:
+            self._make_room(priority, rank)
+
+    def can_dispatch(self) -> bool:
+        """Whether jobs can be handed to a queue running in another process."""
+        return self.bus.distributed
+
+    def dispatch(self, job_id: str, express: bool = False) -> Dict[str, Any]:
+        """
+        Hand a pending job to the queue of another node.
+
+        Returns:
+            The job record, marked queued
+
+        Raises:
+            FileNotFoundError: If the job does not exist
+            ValueError: If the job is not pending or too large for the express lane
+            EventBusError: If the job could not be announced
+        """
+        job = self.engine.get_job_status(job_id)
+        if express:
+            self._check_express(job)
+        # Marked first, so the queue recovers the job even if no node hears the announcement
+        job = self.engine.mark_queued(job_id, express)
+        self.bus.publish(SUBJECT_SYNC_QUEUE_SUBMIT, {"job_id": job_id, "express": express})
+        logger.info(f"Dispatched sync job {job_id} to the job queue")
+        return job
+
+    def list_waiting(self) -> List[Dict[str, Any]]:
+        """Waiting jobs in the order they will start."""
+        with self._condition:
+            ordered = sorted(self._waiting.items(), key=lambda item: (-item[1][0], item[1][1]))
+        return [
+            {"position": position, "job_id": job_id, "priority": JOB_PRIORITIES[rank], "express": express}
+            for position, (job_id, (rank, _, express)) in enumerate(ordered, start=1)
+        ]
+
+    def status(self) -> Dict[str, Any]:
+        """Worker and queue summary."""
+        with self._condition:
+            running = [
+                {"job_id": job_id, "priority": JOB_PRIORITIES[rank], "lane": lane,
+                 "preempting": job_id in self._preempting}
+                for job_id, (rank, _, lane) in self._running.items()
+            ]
+        return {
+            "running": self.is_running(),
+            "workers": self.workers,
+            "express_workers": self.express_workers,
+            "express_max_tables": EXPRESS_MAX_TABLES,
+            "max_waiting": self.max_waiting,
+            "active_jobs": running,
+            "waiting": self.list_waiting(),
+        }
+
+    def depth(self) -> Dict[str, Any]:
+        """Waiting and running job counts."""
+        with self._condition:
+            waiting = [(JOB_PRIORITIES[rank], express) for rank, _, express in self._waiting.values()]
+            return {
+                "waiting": len(waiting),
+                "running": len(self._running),
+                "express_waiting": sum(1 for _, express in waiting if express),
+                "waiting_by_priority": {p: sum(1 for priority, _ in waiting if priority == p)
+                                        for p in reversed(JOB_PRIORITIES)},
+            }
+
+    def start(self) -> None:
+        """Recover queued jobs from the state store and start the worker threads."""
+        if self.is_running():
+            return
+        self._stop_event.clear()
+        self._recover()
+        lanes = [LANE_REGULAR] * self.workers + [LANE_EXPRESS] * self.express_workers
+        self._threads = []
+        for index, lane in enumerate(lanes):
+            thread = threading.Thread(target=self._work, args=(lane,), name=f"sync-queue-{lane}-{index + 1}", daemon=True)
+            self._threads.append(thread)
+            thread.start()
+        try:
+            self._subscription = self.bus.subscribe(SUBJECT_SYNC_QUEUE_SUBMIT, self._on_dispatched, queue_group=QUEUE_GROUP)
+        except EventBusError as e:
+            logger.warning(f"Cannot receive dispatched sync jobs: {e}")
+        logger.info(f"Sync job queue started with {self.workers} regular and {self.express_workers} express workers")
+
+    def stop(self) -> None:
+        """Stop the worker threads after their current jobs."""
+        if self._subscription is not None:
+            self._subscription.unsubscribe()
+            self._subscription = None
+        self._stop_event.set()
+        with self._condition:
+            self._condition.notify_all()
+        for thread in self._threads:
+            thread.join(timeout=5)
+        self._threads = []
+        logger.info("Sync job queue stopped")
+
+    def drain(self, timeout: float) -> List[str]:
+        """
+        Stop the queue for a service shutdown: workers take no more jobs, and
+        running jobs are asked to yield after their next committed batch, so
+        they go back to PENDING with their checkpoints and are recovered when
+        the queue next starts.
+
+        Args:
+            timeout: Seconds to wait for the running jobs to yield
+
+        Returns:
+            IDs of the jobs still running when the timeout passed
+        """
+        self._stop_event.set()
+        with self._condition:
+            running = list(self._running)
+        for job_id in running:
+            try:
+                self.engine.request_preemption(job_id, SHUTDOWN_PREEMPTION)
+            except FileNotFoundError:
+                pass
+        deadline = time.monotonic() + timeout
+        with self._condition:
+            while self._running and time.monotonic() < deadline:
+                self._condition.wait(timeout=min(1.0, max(0.0, deadline - time.monotonic())))
+            remaining = list(self._running)
+        if remaining:
+            logger.warning(f"Sync jobs still running after {timeout:g} seconds: {', '.join(remaining)}")
+        self.stop()
+        return remaining
+
+    def _on_dispatched(self, envelope: Dict[str, Any]) -> None:
+        data = envelope.get("data") or {}
+        job_id = data.get("job_id")
+        with self._condition:
+            if job_id in self._waiting or job_id in self._running:
+                return
+        try:
+            self.submit(job_id, express=bool(data.get("express")))
+        except (FileNotFoundError, ValueError, OverloadedError) as e:
+            logger.warning(f"Ignoring dispatched sync job {job_id}: {e}")
+
+    def _check_express(self, job: Dict[str, Any]) -> None:
+        if job["mode"] != "incremental" and not job.get("dry_run"):
+            raise ValueError("Only incremental or dry-run jobs can use the express lane")
+        if len(job["tables"]) > EXPRESS_MAX_TABLES:
+            raise ValueError(
+                f"Express lane jobs can cover at most {EXPRESS_MAX_TABLES} tables; this job has {len(job['tables'])}"
+            )
+
+    def _recover(self) -> None:
+        """Re-queue PENDING jobs that were waiting when the service stopped."""
+        pending = [j for j in self.engine.list_jobs(status="PENDING", limit=1_000_000) if j.get("queued_at")]
+        pending.sort(key=lambda j: j["queued_at"])
+        with self._condition:
+            for job in pending:
+                self._sequence += 1
+                rank = JOB_PRIORITIES.index(job.get("priority", "normal"))
+                self._waiting[job["job_id"]] = (rank, self._sequence, bool(job.get("express")))
+                self._counties[job["job_id"]] = job.get("county_id")
+        if pending:
+            logger.info(f"Recovered {len(pending)} queued sync jobs")
+        self._announce_depth()
+
+    def _make_room(self, priority: str, rank: int) -> Optional[str]:
+        """
+        The waiting job to shed to make room for a job of a priority, or None
+        when there is room; refuses the job when it is shed. Holds _condition.
+        """
+        ahead = sum(1 for waiting_rank, _, _ in self._waiting.values() if waiting_rank >= rank)
+        pressure = max(ahead / self.max_waiting, self.shedder.memory_pressure())
+        retry_after = self.shedder.retry_after("sync", backlog=ahead, slots=self.workers)
+        self.shedder.check("sync", priority, pressure, ahead >= self.max_waiting, retry_after)
+        if len(self._waiting) < self.max_waiting:
+            return None
+        # The newest of the lowest-priority jobs, which has waited least
+        _, _, victim = min((waiting_rank, -sequence, job_id)
+                           for job_id, (waiting_rank, sequence, _) in self._waiting.items() if waiting_rank < rank)
+        return victim
+
+    def _shed(self, job_id: str, reason: str, displaced: bool = False) -> None:
+        """Cancel a refused job, or a waiting one that gave up its place."""
+        try:
+            job = self.engine.cancel_job(job_id, reason=reason)
+        except (FileNotFoundError, ValueError) as e:
+            logger.warning(f"Cannot cancel shed sync job {job_id}: {e}")
+            return
+        if displaced:
+            JOBS_SHED.inc(job_type="sync", priority=job.get("priority", "normal"), reason="displaced")
+            logger.warning(f"Shed sync job {job_id}: {reason}")
+
+    def _maybe_preempt(self, job_id: str, rank: int, express: bool) -> None:
+        """Preempt the lowest-priority running job for an urgent job that would otherwise wait. Holds _condition."""
+        if rank < JOB_PRIORITIES.index(PREEMPTING_PRIORITY):
+            return
+        if express and self._lane_has_capacity(LANE_EXPRESS):
+            return
+        if self._lane_has_capacity(LANE_REGULAR):
+            return
+        candidates = [
+            (running_rank, running_id) for running_id, (running_rank, _, lane) in self._running.items()
+            if lane == LANE_REGULAR and running_rank < rank and running_id not in self._preempting
+        ]
+        if not candidates or self._preempting:
+            # One preemption at a time; the freed worker takes the most urgent job
+            return
+        _, victim = min(candidates)
+        self._preempting.add(victim)
+        self.engine.request_preemption(victim, job_id)
+
+    def _lane_has_capacity(self, lane: str) -> bool:
+        size = self.workers if lane == LANE_REGULAR else self.express_workers
+        return sum(1 for _, _, running_lane in self._running.values() if running_lane == lane) < size
+
+    def _county_has_room(self, county_id: Optional[str], running: Dict[Optional[str], int]) -> bool:
+        """Whether a county is below its max_running_sync_jobs (see tenant_quotas). Holds _condition."""
+        try:
+            return self.quotas.allows(county_id, "max_running_sync_jobs", running.get(county_id, 0))
+        except ValueError as e:
+            # An invalid block caps nothing; config validation reports it
+            logger.warning(f"Cannot read the quotas of county {county_id}: {e}")
+            return True
+
+    def _next_job(self, lane: str) -> Optional[Tuple[str, int, int]]:
+        """Take the next job for a lane, passing over counties at their running quota. Holds _condition."""
+        running: Dict[Optional[str], int] = {}
+        for job_id in self._running:
+            county_id = self._counties.get(job_id)
+            running[county_id] = running.get(county_id, 0) + 1
+        candidates = [
+            (-rank, sequence, job_id) for job_id, (rank, sequence, express) in self._waiting.items()
+            if (lane == LANE_REGULAR or express) and self._county_has_room(self._counties.get(job_id), running)
+        ]
+        if not candidates:
+            return None
+        negative_rank, sequence, job_id = min(candidates)
+        self._waiting.pop(job_id)
+        return job_id, -negative_rank, sequence
+
+    def _work(self, lane: str) -> None:
+        while not self._stop_event.is_set():
+            with self._condition:
+                entry = self._next_job(lane)
+                if entry is None:
+                    self._condition.wait(timeout=1)
+                    continue
+                job_id, rank, sequence = entry
+                self._running[job_id] = (rank, sequence, lane)
+            self._announce_depth()
+
+            job = None
+            started = time.monotonic()
+            try:
+                job = self.engine.process_job(job_id)
+                self.shedder.record_duration("sync", time.monotonic() - started)
+            except (FileNotFoundError, ValueError) as e:
+                # Cancelled or removed while waiting
+                logger.info(f"Skipped queued sync job {job_id}: {e}")
+            except Exception as e:
+                logger.error(f"Error running queued sync job {job_id}: {e}", exc_info=True)
+            finally:
+                with self._condition:
+                    self._running.pop(job_id, None)
+                    self._preempting.discard(job_id)
+                    if job is not None and job["status"] == "PENDING":
+                        # Preempted: back in line ahead of later jobs of the same priority
+                        self._waiting[job_id] = (rank, sequence, bool(job.get("express")))
+                    else:
+                        self._counties.pop(job_id, None)
+                    self._condition.notify_all()
+                self._announce_depth()
+
+    def _announce_depth(self) -> None:
+        """Publish the queue depth if it changed; the bus being down never affects the queue."""
+        depth = self.depth()
+        with self._condition:
+            if depth == self._announced_depth:
+                return
+            self._announced_depth = depth
+        try:
+            self.bus.publish(SUBJECT_SYSTEM.format(event="queue_depth"), depth)
+        except EventBusError as e:
+            logger.debug(f"Cannot announce sync job queue depth: {e}")
+
+
+# Create a singleton instance
+sync_job_queue = SyncJobQueue()
+
+
+@metrics_registry.collector
+def _collect_queue_depth() -> None:
+    """Waiting and running jobs of this gateway's queue by priority, for the metrics."""
+    status = sync_job_queue.status()
+    for state, jobs in (("waiting", status["waiting"]), ("running", status["active_jobs"])):
+        for priority in JOB_PRIORITIES:
+            SYNC_QUEUE_DEPTH.set(sum(1 for job in jobs if job["priority"] == priority), state=state, priority=priority)
@@ -0,0 +1,284 @@
+"""
+TerraFusion SyncService - Connector Resilience
+
+This module provides the circuit breakers and retry policies that keep a
+transient outage of a county database from turning into a retry storm
+against it. Every connector gets both unless its block opts out with
+"resilience": false, and may tune them:
+
+    "resilience": {
+        "name": "benton-pacs",
+        "circuit_breaker": {"failure_threshold": 5, "reset_seconds": 30, "max_reset_seconds": 300},
+        "retries": {"connection": {"max_attempts": 6, "base_seconds": 2, "max_seconds": 60},
+                    "deadlock": {"max_attempts": 1}}
+    }
+
+Failures are sorted into error classes (connection, timeout, deadlock,
+throttled and permanent, see classify_error). Each class has a retry policy
+of attempts with exponential backoff and full jitter, so workers that failed
+together do not come back together; permanent errors (a missing table,
+refused credentials) are never retried.
+
+A circuit breaker covers each database or service, shared by every
+connector in the process that reaches it (named after the connector type
+and host, or by "name"). After failure_threshold transient failures in a
+row it opens: calls fail at once (CircuitOpenError, see sync_connectors)
+instead of reaching the database. Once reset_seconds pass it is half open
+and lets half_open_probes calls through; a success closes it, a failure
+opens it again for twice as long, up to max_reset_seconds. Breaker states
+and retries are exported in the metrics and reported in connector health
+checks.
+"""
+
+import os
+import time
+import random
+import logging
+import threading
+from typing import Dict, List, Any, Optional
+
+from metrics import CONNECTOR_CIRCUIT_STATE, CONNECTOR_RETRIES, CONNECTOR_CIRCUIT_REJECTIONS
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Transient failures in a row that open a circuit
+FAILURE_THRESHOLD = int(os.environ.get("CIRCUIT_FAILURE_THRESHOLD", "5"))
+
+# Seconds an opened circuit waits before letting a probe through, and the most it backs off to
+RESET_SECONDS = float(os.environ.get("CIRCUIT_RESET_SECONDS", "30"))
+MAX_RESET_SECONDS = float(os.environ.get("CIRCUIT_MAX_RESET_SECONDS", "300"))
+
+# Calls a half-open circuit lets through at once
+HALF_OPEN_PROBES = 1
+
+CIRCUIT_STATES = ["closed", "open", "half_open"]
+
+ERROR_CLASSES = ["connection", "timeout", "deadlock", "throttled", "permanent"]
+
+# Retry policy of each error class; max_attempts counts the first try
+DEFAULT_RETRY_POLICIES = {
+    "connection": {"max_attempts": 4, "base_seconds": 1.0, "max_seconds": 30.0},
+    "timeout": {"max_attempts": 3, "base_seconds": 2.0, "max_seconds": 30.0},
+    "deadlock": {"max_attempts": 5, "base_seconds": 0.2, "max_seconds": 5.0},
+    "throttled": {"max_attempts": 4, "base_seconds": 5.0, "max_seconds": 60.0},
+    "permanent": {"max_attempts": 1, "base_seconds": 0.0, "max_seconds": 0.0},
+}
+
+# Lowercase message fragments of each transient class (SQLSTATEs, ORA- codes, driver wording)
+ERROR_MARKERS = {
+    "deadlock": ["deadlock", "40001", "40p01", "ora-00060"],
+    "timeout": ["timed out", "timeout expired", "hyt00", "ora-12170", "statement timeout", "lock wait timeout"],
+    "throttled": ["too many requests", "throttl", "rate limit"],
+    "connection": ["08s01", "08001", "08003", "08006", "communication link failure", "connection refused",
+                   "connection reset", "server closed the connection", "could not connect", "connection is closed",
+                   "terminating connection", "broken pipe", "ora-03113", "ora-03114", "ora-12541", "ora-12514",
+                   "name or service not known", "network is unreachable", "service unavailable"],
+}
+
+POLICY_FIELDS = ["max_attempts", "base_seconds", "max_seconds"]
+
+
+def _chain(error: BaseException) -> List[BaseException]:
+    """An error and the errors it was raised from or while handling."""
+    errors = []
+    while error is not None and error not in errors and len(errors) < 10:
+        errors.append(error)
+        error = error.__cause__ or error.__context__
+    return errors
+
+
+def classify_error(error: BaseException) -> str:
+    """The error class of a failure: one of ERROR_CLASSES."""
+    for cause in _chain(error):
+        name = type(cause).__name__.lower()
+        text = str(cause).lower()
+        for error_class in ("deadlock", "timeout", "throttled", "connection"):
+            if any(marker in text for marker in ERROR_MARKERS[error_class]):
+                return error_class
+        if isinstance(cause, TimeoutError) or "timeout" in name:
+            return "timeout"
+        if isinstance(cause, ConnectionError) or name.endswith("connectionerror"):
+            return "connection"
+    return "permanent"
+
+
+def backoff_seconds(policy: Dict[str, Any], attempt: int) -> float:
+    """Seconds to wait before retry number attempt (1 for the first): exponential with full jitter."""
+    ceiling = min(policy["max_seconds"], policy["base_seconds"] * 2 ** (attempt - 1))
+    return random.uniform(0, ceiling)
+
+
+def _number(settings: Dict[str, Any], name: str, default: float, label: str, minimum: float = 0) -> float:
+    value = settings.get(name, default)
+    try:
+        value = float(value)
+    except (TypeError, ValueError):
+        raise ValueError(f"{label} {name} must be a number")
+    if value < minimum:
+        raise ValueError(f"{label} {name} must be at least {minimum:g}")
+    return value
+
+
+def parse_resilience(definition: Any) -> Dict[str, Any]:
+    """
+    Validate the "resilience" block of a connector.
+
+    Returns:
+        The breaker name (None for the default), breaker settings and the retry
+        policy of every error class; {"enabled": False} when the block is false
+    """
+    if definition is False:
+        return {"enabled": False}
+    definition = definition if isinstance(definition, dict) else {}
+    if definition.get("enabled") is False:
+        return {"enabled": False}
+    breaker = definition.get("circuit_breaker") or {}
+    if not isinstance(breaker, dict):
+        raise ValueError("resilience circuit_breaker must be an object")
+    label = "resilience circuit_breaker"
+    parsed = {
+        "enabled": True,
+        "name": definition.get("name"),
+        "circuit_breaker": {
+            "failure_threshold": int(_number(breaker, "failure_threshold", FAILURE_THRESHOLD, label, 1)),
+            "reset_seconds": _number(breaker, "reset_seconds", RESET_SECONDS, label),
+            "max_reset_seconds": _number(breaker, "max_reset_seconds", MAX_RESET_SECONDS, label),
+            "half_open_probes": int(_number(breaker, "half_open_probes", HALF_OPEN_PROBES, label, 1)),
+        },
+        "retries": {},
+    }
+    retries = definition.get("retries") or {}
+    if not isinstance(retries, dict):
+        raise ValueError("resilience retries must be an object of error classes")
+    unknown = [name for name in retries if name not in ERROR_CLASSES]
+    if unknown:
+        raise ValueError(f"Unknown resilience error class {unknown[0]}; classes: {', '.join(ERROR_CLASSES)}")
+    for error_class, default in DEFAULT_RETRY_POLICIES.items():
+        settings = retries.get(error_class) or {}
+        if not isinstance(settings, dict):
+            raise ValueError(f"resilience retries.{error_class} must be an object")
+        label = f"resilience retries.{error_class}"
+        policy = {name: _number(settings, name, default[name], label, 1 if name == "max_attempts" else 0)
+                  for name in POLICY_FIELDS}
+        policy["max_attempts"] = int(policy["max_attempts"])
+        parsed["retries"][error_class] = policy
+    if parsed["retries"]["permanent"]["max_attempts"] != 1:
+        raise ValueError("resilience retries.permanent cannot retry; permanent errors fail at once")
+    return parsed
+
+
+class CircuitBreaker:
+    """The circuit breaker of one database or service."""
+
+    def __init__(self, name: str, failure_threshold: int = FAILURE_THRESHOLD, reset_seconds: float = RESET_SECONDS,
+                 max_reset_seconds: float = MAX_RESET_SECONDS, half_open_probes: int = HALF_OPEN_PROBES):
+        self.name = name
+        self.configure(failure_threshold, reset_seconds, max_reset_seconds, half_open_probes)
+        self.state = "closed"
+        self.failures = 0
+        self.opened_count = 0
+        self.last_error: Optional[str] = None
+        self._open_seconds = reset_seconds
+        self._retry_at = 0.0
+        self._probes = 0
+        self._lock = threading.Lock()
+        self._export()
+
+    def configure(self, failure_threshold: int, reset_seconds: float, max_reset_seconds: float,
+                  half_open_probes: int) -> None:
+        self.failure_threshold = failure_threshold
+        self.reset_seconds = reset_seconds
+        self.max_reset_seconds = max(max_reset_seconds, reset_seconds)
+        self.half_open_probes = half_open_probes
+
+    def allow(self) -> bool:
+        """Whether a call may go through now; a half-open circuit counts it as a probe."""
+        with self._lock:
+            if self.state == "open":
+                if time.monotonic() < self._retry_at:
+                    CONNECTOR_CIRCUIT_REJECTIONS.inc(connector=self.name)
+                    return False
+                self._transition("half_open")
+                self._probes = 0
+            if self.state == "half_open":
+                if self._probes >= self.half_open_probes:
+                    CONNECTOR_CIRCUIT_REJECTIONS.inc(connector=self.name)
+                    return False
+                self._probes += 1
+            return True
+
+    def record_success(self) -> None:
+        """A call the circuit let through reached the database (permanent errors count: it answered)."""
+        with self._lock:
+            self.failures = 0
+            self._probes = max(0, self._probes - 1)
+            if self.state != "closed":
+                logger.info(f"Circuit {self.name} closed")
+                self._open_seconds = self.reset_seconds
+                self._transition("closed")
+
+    def record_failure(self, error: Optional[BaseException] = None) -> None:
+        """A call the circuit let through failed with a transient error."""
+        with self._lock:
+            self.failures += 1
+            self.last_error = str(error) if error is not None else self.last_error
+            self._probes = max(0, self._probes - 1)
+            if self.state == "half_open":
+                # The probe failed: stay away twice as long this time
+                self._open_seconds = min(self._open_seconds * 2, self.max_reset_seconds)
+                self._open()
+            elif self.state == "closed" and self.failures >= self.failure_threshold:
+                self._open_seconds = self.reset_seconds
+                self._open()
+
+    def retry_in(self) -> float:
+        """Seconds until an open circuit lets a probe through."""
+        return max(0.0, self._retry_at - time.monotonic()) if self.state == "open" else 0.0
+
+    def status(self) -> Dict[str, Any]:
+        return {"name": self.name, "state": self.state, "failures": self.failures,
+                "opened_count": self.opened_count, "retry_in_seconds": round(self.retry_in(), 1),
+                "last_error": self.last_error}
+
+    def _open(self) -> None:
+        self._retry_at = time.monotonic() + self._open_seconds
+        self.opened_count += 1
+        logger.warning(f"Circuit {self.name} opened for {self._open_seconds:g}s after {self.failures} failures: "
+                       f"{self.last_error}")
+        self._transition("open")
+
+    def _transition(self, state: str) -> None:
+        self.state = state
+        self._export()
+
+    def _export(self) -> None:
+        for state in CIRCUIT_STATES:
+            CONNECTOR_CIRCUIT_STATE.set(1 if state == self.state else 0, connector=self.name, state=state)
+
+
+_breakers: Dict[str, CircuitBreaker] = {}
+_breakers_lock = threading.Lock()
+
+
+def circuit_breaker(name: str, settings: Optional[Dict[str, Any]] = None) -> CircuitBreaker:
+    """The process's circuit breaker of a name, created on first use and kept up to date with settings."""
+    settings = settings or parse_resilience({})["circuit_breaker"]
+    with _breakers_lock:
+        breaker = _breakers.get(name)
+        if breaker is None:
+            breaker = _breakers[name] = CircuitBreaker(name, **settings)
+        else:
+            breaker.configure(**settings)
+        return breaker
+
+
+def circuit_breakers() -> List[Dict[str, Any]]:
+    """The status of every circuit breaker of this process."""
+    with _breakers_lock:
+        return [breaker.status() for _, breaker in sorted(_breakers.items())]
+
+
+def record_retry(name: str, error_class: str) -> None:
+    CONNECTOR_RETRIES.inc(connector=name, error_class=error_class)
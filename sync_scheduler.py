@@ -0,0 +1,562 @@
+"""
+TerraFusion SyncService - Sync Scheduler
+
+This module provides the built-in scheduler that runs sync jobs on cron
+schedules, replacing external task schedulers. Each schedule belongs to a sync
+pair and has a standard five-field cron expression evaluated in its own time
+zone, so "0 2 * * *" means 2 AM county time across daylight saving changes.
+
+When the service was down at a scheduled time, the schedule's catch_up policy
+decides what happens on the next check:
+- latest: run once for all missed times (default)
+- all: run once per missed time, up to MAX_CATCH_UP_RUNS
+- skip: do not run missed times; wait for the next scheduled time
+
+Schedules are created through the API, or declared on a sync pair in its
+county configuration file ("schedules"). Configured schedules are stored
+like the others under an ID derived from the sync pair and the schedule's
+name, and are brought in line with the configuration when the scheduler
+starts and on each configuration reload (see config_reload): new ones are
+created, changed ones updated (a paused schedule stays paused) and ones the
+configuration no longer declares deleted. Schedules of a county with the
+scheduled_sync feature turned off (see county_overrides) skip their runs.
+"""
+
+import os
+import uuid
+import logging
+import threading
+from datetime import datetime, timedelta, timezone
+from typing import Dict, List, Any, Optional, Set
+from zoneinfo import ZoneInfo, ZoneInfoNotFoundError
+
+from sync_store import DocumentStore, sync_state_store
+from sync_engine import SyncEngine, sync_engine
+from sync_control import TERMINAL_STATUSES
+from county_overrides import county_overrides
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection
+SCHEDULES_COLLECTION = "sync_schedules"
+
+# Missed-run handling policies
+CATCH_UP_POLICIES = ["latest", "all", "skip"]
+
+# Upper bound on runs started for one schedule after downtime
+MAX_CATCH_UP_RUNS = 24
+
+# Username recorded on configured schedules and their jobs
+CONFIGURED_BY = "configuration"
+
+# Fields of a stored schedule that a configured schedule sets
+CONFIGURED_FIELDS = ["sync_pair_id", "county_id", "name", "cron", "timezone", "mode", "tables", "catch_up",
+                     "parameters"]
+
+# Seconds between scheduler checks
+POLL_SECONDS = int(os.environ.get("SYNC_SCHEDULER_POLL_SECONDS", "30"))
+
+MONTH_NAMES = {name: i for i, name in enumerate(
+    ["jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"], start=1)}
+DAY_NAMES = {name: i for i, name in enumerate(["sun", "mon", "tue", "wed", "thu", "fri", "sat"])}
+
+
+class CronExpression:
+    """
+    A five-field cron expression: minute hour day-of-month month day-of-week.
+
+    Fields accept "*", numbers, ranges ("1-5"), lists ("1,15"), steps ("*/15",
+    "0-30/10") and month/day names ("jan", "mon"). Day-of-week 0 and 7 are
+    Sunday. As in standard cron, when both day-of-month and day-of-week are
+    restricted a day matching either one fires.
+    """
+
+    def __init__(self, expression: str):
+        """
+        Parse a cron expression.
+
+        Raises:
+            ValueError: If the expression is invalid
+        """
+        self.expression = expression.strip()
+        fields = self.expression.split()
+        if len(fields) != 5:
+            raise ValueError(f"Cron expression must have 5 fields, got {len(fields)}: {expression}")
+
+        self.minutes = self._parse_field(fields[0], 0, 59)
+        self.hours = self._parse_field(fields[1], 0, 23)
+        self.days = self._parse_field(fields[2], 1, 31)
+        self.months = self._parse_field(fields[3], 1, 12, MONTH_NAMES)
+        weekdays = self._parse_field(fields[4], 0, 7, DAY_NAMES)
+        self.weekdays = {0 if d == 7 else d for d in weekdays}
+        # Standard cron treats a field starting with "*" (such as "*/2") as unrestricted
+        self.days_restricted = not fields[2].startswith("*")
+        self.weekdays_restricted = not fields[4].startswith("*")
+
+    @staticmethod
+    def _parse_field(field: str, low: int, high: int, names: Optional[Dict[str, int]] = None) -> Set[int]:
+        values: Set[int] = set()
+        for part in field.lower().split(","):
+            step = 1
+            if "/" in part:
+                part, step_text = part.split("/", 1)
+                if not step_text.isdigit() or int(step_text) == 0:
+                    raise ValueError(f"Invalid cron step: {step_text}")
+                step = int(step_text)
+
+            if part == "*":
+                start, end = low, high
+            elif "-" in part:
+                start_text, end_text = part.split("-", 1)
+                start = CronExpression._parse_value(start_text, names)
+                end = CronExpression._parse_value(end_text, names)
+            else:
+                start = CronExpression._parse_value(part, names)
+                end = high if step > 1 else start
+
+            if start < low or end > high or start > end:
+                raise ValueError(f"Cron field value out of range {low}-{high}: {field}")
+            values.update(range(start, end + 1, step))
+        return values
+
+    @staticmethod
+    def _parse_value(text: str, names: Optional[Dict[str, int]]) -> int:
+        if names and text[:3] in names:
+            return names[text[:3]]
+        if not text.isdigit():
+            raise ValueError(f"Invalid cron value: {text}")
+        return int(text)
+
+    def _day_matches(self, day: datetime) -> bool:
+        # Python: Monday=0..Sunday=6; cron: Sunday=0..Saturday=6
+        weekday = (day.weekday() + 1) % 7
+        day_match = day.day in self.days
+        weekday_match = weekday in self.weekdays
+        if self.days_restricted and self.weekdays_restricted:
+            return day_match or weekday_match
+        return day_match and weekday_match
+
+    def next_after(self, moment: datetime, tz: ZoneInfo) -> datetime:
+        """
+        Return the first fire time strictly after moment.
+
+        Matching is done on wall-clock time in tz; the result is timezone-aware UTC.
+
+        Raises:
+            ValueError: If the expression never fires (for example "0 0 31 2 *")
+        """
+        local = moment.astimezone(tz).replace(tzinfo=None, second=0, microsecond=0) + timedelta(minutes=1)
+        limit = local + timedelta(days=366 * 5)
+
+        while local < limit:
+            if local.month not in self.months:
+                year, month = (local.year + 1, 1) if local.month == 12 else (local.year, local.month + 1)
+                local = local.replace(year=year, month=month, day=1, hour=0, minute=0)
+                continue
+            if not self._day_matches(local):
+                local = (local + timedelta(days=1)).replace(hour=0, minute=0)
+                continue
+            if local.hour not in self.hours:
+                local = (local + timedelta(hours=1)).replace(minute=0)
+                continue
+            if local.minute not in self.minutes:
+                local += timedelta(minutes=1)
+                continue
+
+            fire = local.replace(tzinfo=tz)
+            result = fire.astimezone(timezone.utc)
+            if result > moment:
+                return result
+            # Repeated wall-clock time after a DST fall-back that was already passed
+            local += timedelta(minutes=1)
+
+        raise ValueError(f"Cron expression never fires: {self.expression}")
+
+
+def _timezone(name: str) -> ZoneInfo:
+    try:
+        return ZoneInfo(name)
+    except (ZoneInfoNotFoundError, ValueError):
+        raise ValueError(f"Unknown time zone: {name}")
+
+
+def _utcnow() -> datetime:
+    return datetime.now(timezone.utc)
+
+
+def configured_schedule_id(sync_pair_id: str, name: str) -> str:
+    """The stored ID of a schedule a sync pair's configuration declares; the same on every reload."""
+    return str(uuid.uuid5(uuid.NAMESPACE_URL, f"terrafusion:schedule:{sync_pair_id}:{name}"))
+
+
+def check_configured(pair) -> List[str]:
+    """Why the configured schedules of a sync pair cannot be stored; empty when they can."""
+    problems = []
+    for schedule in pair.schedules:
+        try:
+            CronExpression(schedule["cron"])
+            _timezone(schedule["timezone"])
+            if schedule["catch_up"] not in CATCH_UP_POLICIES:
+                raise ValueError(f"Unsupported catch_up policy: {schedule['catch_up']}. "
+                                 f"Supported policies: {', '.join(CATCH_UP_POLICIES)}")
+        except ValueError as e:
+            problems.append(f"Schedule {schedule['name']} of sync pair {pair.sync_pair_id}: {e}")
+    return problems
+
+
+class SyncScheduler:
+    """
+    Service class for managing sync schedules and starting due sync jobs.
+
+    Schedules are persisted in the sync state store. A background thread
+    (start/stop) checks for due schedules every POLL_SECONDS; run_due can also
+    be called directly.
+    """
+
+    def __init__(self, store: Optional[DocumentStore] = None, engine: Optional[SyncEngine] = None):
+        """
+        Initialize the scheduler.
+
+        Args:
+            store: Document store for schedules
+            engine: Sync engine used to run jobs; defaults to the sync_engine singleton
+        """
+        self.store = store or sync_state_store
+        self.engine = engine or sync_engine
+        self._lock = threading.RLock()
+        self._run_lock = threading.Lock()
+        self._stop_event = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+        logger.info("Sync scheduler initialized")
+
+    def create_schedule(self,
+                        sync_pair_id: str,
+                        cron: str,
+                        username: str,
+                        timezone_name: str = "UTC",
+                        mode: Optional[str] = None,
+                        tables: Optional[List[str]] = None,
+                        catch_up: str = "latest",
+                        parameters: Optional[Dict[str, Any]] = None) -> Dict[str, Any]:
+        """
+        Create a schedule for a sync pair.
+
+        Args:
+            sync_pair_id: Sync pair to run
+            cron: Five-field cron expression
+            username: Username recorded on the schedule and its jobs
+            timezone_name: IANA time zone the cron expression is evaluated in
+            mode: Sync mode for scheduled jobs; defaults to the pair's default_mode
+            tables: Subset of tables to sync
+            catch_up: Missed-run policy, one of CATCH_UP_POLICIES
+            parameters: Additional job parameters
+
+        Returns:
+            The schedule
+
+        Raises:
+            KeyError: If the sync pair or a table is not configured
+            ValueError: If the cron expression, time zone or policy is invalid
+        """
+        pair = self.engine.registry.get(sync_pair_id)
+        for name in tables or []:
+            pair.get_table(name)
+        if catch_up not in CATCH_UP_POLICIES:
+            raise ValueError(f"Unsupported catch_up policy: {catch_up}. Supported policies: {', '.join(CATCH_UP_POLICIES)}")
+
+        expression = CronExpression(cron)
+        tz = _timezone(timezone_name)
+        now = _utcnow()
+
+        schedule = {
+            "schedule_id": str(uuid.uuid4()),
+            "sync_pair_id": sync_pair_id,
+            "county_id": pair.county_id,
+            "cron": expression.expression,
+            "timezone": timezone_name,
+            "mode": mode,
+            "tables": tables,
+            "parameters": parameters or {},
+            "catch_up": catch_up,
+            "username": username,
+            "status": "ACTIVE",
+            "created_at": datetime.utcnow().isoformat(),
+            "updated_at": datetime.utcnow().isoformat(),
+            "next_run_at": expression.next_after(now, tz).isoformat(),
+            "last_run_at": None,
+            "last_job_id": None,
+            "last_job_status": None,
+            "missed_runs": 0
+        }
+        self.store.save(SCHEDULES_COLLECTION, schedule["schedule_id"], schedule)
+        logger.info(f"Created schedule {schedule['schedule_id']} for {sync_pair_id}: {cron} ({timezone_name})")
+        return schedule
+
+    def get_schedule(self, schedule_id: str) -> Dict[str, Any]:
+        """
+        Get a schedule.
+
+        Raises:
+            FileNotFoundError: If the schedule does not exist
+        """
+        try:
+            return self.store.load(SCHEDULES_COLLECTION, schedule_id)
+        except FileNotFoundError:
+            raise FileNotFoundError(f"Schedule {schedule_id} not found")
+
+    def list_schedules(self, sync_pair_id: Optional[str] = None, status: Optional[str] = None) -> List[Dict[str, Any]]:
+        """List schedules with optional filtering, ordered by next run time."""
+        schedules = [
+            s for s in self.store.list(SCHEDULES_COLLECTION)
+            if (not sync_pair_id or s.get("sync_pair_id") == sync_pair_id)
+            and (not status or s.get("status") == status)
+        ]
+        schedules.sort(key=lambda s: s.get("next_run_at") or "")
+        return schedules
+
+    def pause_schedule(self, schedule_id: str) -> Dict[str, Any]:
+        """
+        Pause a schedule; no runs are started or caught up while paused.
+
+        Raises:
+            FileNotFoundError: If the schedule does not exist
+            ValueError: If the schedule is already paused
+        """
+        with self._lock:
+            schedule = self.get_schedule(schedule_id)
+            if schedule["status"] == "PAUSED":
+                raise ValueError(f"Schedule {schedule_id} is already paused")
+            schedule["status"] = "PAUSED"
+            schedule["updated_at"] = datetime.utcnow().isoformat()
+            self.store.save(SCHEDULES_COLLECTION, schedule_id, schedule)
+        logger.info(f"Paused schedule {schedule_id}")
+        return schedule
+
+    def resume_schedule(self, schedule_id: str) -> Dict[str, Any]:
+        """
+        Resume a paused schedule from the next fire time after now.
+
+        Times that passed while the schedule was paused are not caught up.
+
+        Raises:
+            FileNotFoundError: If the schedule does not exist
+            ValueError: If the schedule is not paused
+        """
+        with self._lock:
+            schedule = self.get_schedule(schedule_id)
+            if schedule["status"] != "PAUSED":
+                raise ValueError(f"Schedule {schedule_id} is not paused")
+            expression = CronExpression(schedule["cron"])
+            schedule["status"] = "ACTIVE"
+            schedule["next_run_at"] = expression.next_after(_utcnow(), _timezone(schedule["timezone"])).isoformat()
+            schedule["updated_at"] = datetime.utcnow().isoformat()
+            self.store.save(SCHEDULES_COLLECTION, schedule_id, schedule)
+        logger.info(f"Resumed schedule {schedule_id}")
+        return schedule
+
+    def delete_schedule(self, schedule_id: str) -> None:
+        """
+        Delete a schedule.
+
+        Raises:
+            FileNotFoundError: If the schedule does not exist
+        """
+        with self._lock:
+            self.get_schedule(schedule_id)
+            self.store.delete(SCHEDULES_COLLECTION, schedule_id)
+        logger.info(f"Deleted schedule {schedule_id}")
+
+    def sync_configured(self, pairs: List[Any]) -> Dict[str, List[str]]:
+        """
+        Bring the stored configured schedules in line with the schedules the
+        sync pairs declare. Pairs whose schedules do not hold (see
+        check_configured) keep the schedules they have.
+
+        Args:
+            pairs: Every registered sync pair
+
+        Returns:
+            IDs of the schedules created, updated and deleted
+        """
+        result = {"created": [], "updated": [], "deleted": []}
+        wanted, kept = {}, set()
+        for pair in pairs:
+            if check_configured(pair):
+                kept.add(pair.sync_pair_id)
+                continue
+            for schedule in pair.schedules:
+                wanted[configured_schedule_id(pair.sync_pair_id, schedule["name"])] = dict(
+                    schedule, sync_pair_id=pair.sync_pair_id, county_id=pair.county_id)
+        now = _utcnow()
+        with self._lock:
+            stored = {s["schedule_id"]: s for s in self.store.list(SCHEDULES_COLLECTION) if s.get("configured")}
+            for schedule_id, schedule in stored.items():
+                if schedule_id not in wanted and schedule["sync_pair_id"] not in kept:
+                    self.store.delete(SCHEDULES_COLLECTION, schedule_id)
+                    result["deleted"].append(schedule_id)
+            for schedule_id, definition in wanted.items():
+                current = stored.get(schedule_id)
+                if current is not None and all(current.get(name) == definition[name] for name in CONFIGURED_FIELDS):
+                    continue
+                schedule = current or {
+                    "schedule_id": schedule_id,
+                    "username": CONFIGURED_BY,
+                    "configured": True,
+                    "status": "ACTIVE",
+                    "created_at": datetime.utcnow().isoformat(),
+                    "next_run_at": None,
+                    "last_run_at": None,
+                    "last_job_id": None,
+                    "last_job_status": None,
+                    "missed_runs": 0
+                }
+                timing_changed = current is None or (current["cron"], current["timezone"]) != (
+                    definition["cron"], definition["timezone"])
+                schedule.update({name: definition[name] for name in CONFIGURED_FIELDS})
+                if timing_changed:
+                    schedule["next_run_at"] = CronExpression(definition["cron"]).next_after(
+                        now, _timezone(definition["timezone"])).isoformat()
+                schedule["updated_at"] = datetime.utcnow().isoformat()
+                self.store.save(SCHEDULES_COLLECTION, schedule_id, schedule)
+                result["created" if current is None else "updated"].append(schedule_id)
+        if any(result.values()):
+            logger.info(f"Configured schedules: {len(result['created'])} created, {len(result['updated'])} updated, "
+                        f"{len(result['deleted'])} deleted")
+        return result
+
+    def run_due(self, now: Optional[datetime] = None) -> List[Dict[str, Any]]:
+        """
+        Start jobs for every active schedule whose next run time has passed.
+
+        Args:
+            now: Current time (timezone-aware); defaults to the current UTC time
+
+        Returns:
+            List of jobs started
+        """
+        now = now or _utcnow()
+        started = []
+        if not self._run_lock.acquire(blocking=False):
+            # Another check is still running jobs
+            return started
+        try:
+            for schedule in self.list_schedules(status="ACTIVE"):
+                next_run = datetime.fromisoformat(schedule["next_run_at"])
+                if next_run > now:
+                    continue
+                try:
+                    started.extend(self._run_schedule(schedule, now))
+                except Exception as e:
+                    logger.error(f"Error running schedule {schedule['schedule_id']}: {e}", exc_info=True)
+        finally:
+            self._run_lock.release()
+        return started
+
+    def _run_schedule(self, schedule: Dict[str, Any], now: datetime) -> List[Dict[str, Any]]:
+        """Start the runs a due schedule owes and advance its next run time."""
+        expression = CronExpression(schedule["cron"])
+        tz = _timezone(schedule["timezone"])
+
+        # Every fire time from the stored next run up to now was owed
+        fire_times = [datetime.fromisoformat(schedule["next_run_at"])]
+        while len(fire_times) <= MAX_CATCH_UP_RUNS:
+            following = expression.next_after(fire_times[-1], tz)
+            if following > now:
+                break
+            fire_times.append(following)
+        missed = len(fire_times) - 1
+
+        if schedule["catch_up"] == "all":
+            runs = fire_times[:MAX_CATCH_UP_RUNS]
+        elif schedule["catch_up"] == "skip" and missed:
+            runs = []
+        else:
+            runs = fire_times[-1:]
+        if missed:
+            logger.warning(
+                f"Schedule {schedule['schedule_id']} missed {missed} run(s) while the service was down; "
+                f"catch_up={schedule['catch_up']} starts {len(runs)}"
+            )
+
+        jobs = []
+        last_run = {}
+        if runs and not county_overrides.enabled(schedule.get("county_id"), "scheduled_sync"):
+            logger.info(f"Schedule {schedule['schedule_id']} skipped: county {schedule['county_id']} has "
+                        f"scheduled_sync turned off")
+            runs = []
+        if runs and self._previous_job_running(schedule):
+            logger.warning(f"Schedule {schedule['schedule_id']} skipped: previous job {schedule['last_job_id']} is still running")
+            runs = []
+
+        for fire_time in runs:
+            job = self.engine.create_sync_job(
+                schedule["sync_pair_id"],
+                schedule["username"],
+                schedule.get("mode"),
+                schedule.get("tables"),
+                dict(schedule.get("parameters") or {}, schedule_id=schedule["schedule_id"],
+                     scheduled_for=fire_time.isoformat())
+            )
+            job = self.engine.process_job(job["job_id"])
+            jobs.append(job)
+            last_run = {
+                "last_job_id": job["job_id"],
+                "last_job_status": job["status"],
+                "last_run_at": datetime.utcnow().isoformat()
+            }
+
+        # Reload so a pause or edit made while jobs were running is kept
+        with self._lock:
+            try:
+                current = self.get_schedule(schedule["schedule_id"])
+            except FileNotFoundError:
+                return jobs
+            current.update(last_run)
+            current["missed_runs"] = current.get("missed_runs", 0) + missed
+            current["next_run_at"] = expression.next_after(max(now, fire_times[-1]), tz).isoformat()
+            current["updated_at"] = datetime.utcnow().isoformat()
+            self.store.save(SCHEDULES_COLLECTION, current["schedule_id"], current)
+        return jobs
+
+    def _previous_job_running(self, schedule: Dict[str, Any]) -> bool:
+        if not schedule.get("last_job_id"):
+            return False
+        try:
+            job = self.engine.get_job_status(schedule["last_job_id"])
+        except FileNotFoundError:
+            return False
+        # A paused job still owns its change window
+        return job["status"] not in TERMINAL_STATUSES
+
+    def start(self) -> None:
+        """Start the background scheduling thread."""
+        if self._thread is not None and self._thread.is_alive():
+            return
+        try:
+            self.sync_configured(self.engine.registry.list())
+        except Exception as e:
+            logger.error(f"Error storing the configured schedules: {e}", exc_info=True)
+        self._stop_event.clear()
+        self._thread = threading.Thread(target=self._loop, name="sync-scheduler", daemon=True)
+        self._thread.start()
+        logger.info(f"Sync scheduler started (checking every {POLL_SECONDS}s)")
+
+    def stop(self) -> None:
+        """Stop the background scheduling thread."""
+        self._stop_event.set()
+        if self._thread is not None:
+            self._thread.join(timeout=POLL_SECONDS)
+            self._thread = None
+        logger.info("Sync scheduler stopped")
+
+    def _loop(self) -> None:
+        # The first check runs immediately so runs missed during downtime are caught up at startup
+        while not self._stop_event.is_set():
+            self.run_due()
+            self._stop_event.wait(POLL_SECONDS)
+
+
+# Create a singleton instance
+sync_scheduler = SyncScheduler()
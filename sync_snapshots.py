@@ -0,0 +1,372 @@
+"""
+TerraFusion SyncService - Sync Snapshots and Rollback
+
+This module provides snapshots of target staging tables taken before a sync
+job writes, post-sync validation rules, and rollback to a snapshot. Sync pairs
+opt in with a "snapshot" block in the county configuration:
+
+    "snapshot": {
+        "enabled": true,
+        "keep": 3,
+        "validations": [
+            {"type": "row_count_change", "tables": ["dbo.property"], "max_decrease_percent": 2},
+            {"type": "null_increase", "tables": ["dbo.property"], "columns": ["land_use"], "max_increase": 50},
+            {"type": "rejected_percent", "max_percent": 1}
+        ]
+    }
+
+When any rule fails after the job has written, every table of the job is
+restored from its snapshot and the table watermarks are put back, so the same
+changes are read again once the cause (for example a bad mapping) is fixed.
+Snapshots can also be restored manually through the API.
+"""
+
+import uuid
+import logging
+from datetime import datetime
+from typing import Dict, List, Any, Optional
+
+from sync_store import DocumentStore
+from sync_connectors import create_connector
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection for snapshot records
+SNAPSHOTS_COLLECTION = "sync_snapshots"
+
+# Snapshots kept per sync pair when "keep" is not configured
+DEFAULT_SNAPSHOTS_KEPT = 3
+
+# Post-sync validation rule types
+VALIDATION_TYPES = ["row_count_change", "null_increase", "rejected_percent", "min_rows"]
+
+# PostgreSQL truncates identifiers beyond this length
+MAX_IDENTIFIER_LENGTH = 63
+
+
+class SyncValidationFailed(Exception):
+    """Raised when post-sync validation fails and the target was rolled back."""
+
+    def __init__(self, errors: List[str], snapshot_id: str):
+        super().__init__("; ".join(errors))
+        self.errors = errors
+        self.snapshot_id = snapshot_id
+
+
+def validate_rule(rule: Dict[str, Any]) -> None:
+    """
+    Check a validation rule from the configuration.
+
+    Raises:
+        ValueError: If the rule is invalid
+    """
+    rule_type = rule.get("type")
+    if rule_type not in VALIDATION_TYPES:
+        raise ValueError(
+            f"Unsupported validation type: {rule_type}. Supported types: {', '.join(VALIDATION_TYPES)}"
+        )
+    if rule_type == "null_increase" and not rule.get("columns"):
+        raise ValueError("null_increase validation requires 'columns'")
+    if rule_type == "row_count_change" and "max_decrease_percent" not in rule and "max_increase_percent" not in rule:
+        raise ValueError("row_count_change validation requires max_decrease_percent or max_increase_percent")
+    if rule_type == "rejected_percent" and "max_percent" not in rule:
+        raise ValueError("rejected_percent validation requires 'max_percent'")
+    if rule_type == "min_rows" and "min" not in rule:
+        raise ValueError("min_rows validation requires 'min'")
+
+
+def _rule_applies(rule: Dict[str, Any], table_name: str) -> bool:
+    return not rule.get("tables") or table_name in rule["tables"]
+
+
+def check_rule(rule: Dict[str, Any], table_name: str, before: Dict[str, Any], after: Dict[str, Any],
+               table_result: Dict[str, Any]) -> List[str]:
+    """
+    Evaluate one validation rule for a table.
+
+    Args:
+        rule: Validation rule
+        table_name: Source table name
+        before: Target table statistics taken with the snapshot
+        after: Target table statistics after the sync
+        table_result: The job's result for the table
+
+    Returns:
+        Validation errors (empty when the rule passes)
+    """
+    rule_type = rule["type"]
+    if rule_type == "row_count_change":
+        errors = []
+        old, new = before["row_count"], after["row_count"]
+        if old:
+            change = (new - old) * 100.0 / old
+            if "max_decrease_percent" in rule and -change > float(rule["max_decrease_percent"]):
+                errors.append(
+                    f"{table_name}: row count fell {-change:.1f}% ({old} to {new}), "
+                    f"more than {rule['max_decrease_percent']}%"
+                )
+            if "max_increase_percent" in rule and change > float(rule["max_increase_percent"]):
+                errors.append(
+                    f"{table_name}: row count grew {change:.1f}% ({old} to {new}), "
+                    f"more than {rule['max_increase_percent']}%"
+                )
+        return errors
+    if rule_type == "null_increase":
+        errors = []
+        for column in rule["columns"]:
+            increase = after["null_counts"].get(column, 0) - before["null_counts"].get(column, 0)
+            if increase > int(rule.get("max_increase", 0)):
+                errors.append(f"{table_name}: {increase} more NULL values in {column} (allowed {rule.get('max_increase', 0)})")
+        return errors
+    if rule_type == "rejected_percent":
+        read = table_result.get("records_read", 0)
+        rejected = table_result.get("records_rejected", 0)
+        percent = rejected * 100.0 / read if read else 0.0
+        if percent > float(rule["max_percent"]):
+            return [f"{table_name}: {percent:.1f}% of records rejected ({rejected} of {read}), more than {rule['max_percent']}%"]
+        return []
+    if rule_type == "min_rows":
+        if after["row_count"] < int(rule["min"]):
+            return [f"{table_name}: {after['row_count']} rows, fewer than {rule['min']}"]
+        return []
+    return []
+
+
+def _dependency_order(pair, table_names: List[str]) -> List[str]:
+    """Order job tables so each comes after the tables it depends on."""
+    ordered: List[str] = []
+
+    def visit(name: str) -> None:
+        if name in ordered:
+            return
+        for dependency in pair.get_table(name).depends_on:
+            if dependency in table_names:
+                visit(dependency)
+        ordered.append(name)
+
+    for name in table_names:
+        visit(name)
+    return ordered
+
+
+class SnapshotManager:
+    """
+    Service class for creating, validating, restoring and pruning target snapshots.
+    """
+
+    def __init__(self, store: DocumentStore, registry, watermarks, audit_log):
+        """
+        Initialize the snapshot manager.
+
+        Args:
+            store: Document store for snapshot records
+            registry: Sync pair registry
+            watermarks: Watermark store, restored on rollback
+            audit_log: Audit log for manual and automatic rollbacks
+        """
+        self.store = store
+        self.registry = registry
+        self.watermarks = watermarks
+        self.audit_log = audit_log
+
+    def create(self, job: Dict[str, Any], pair) -> Dict[str, Any]:
+        """
+        Snapshot every target table of a job before it writes.
+
+        Returns:
+            The snapshot record
+        """
+        snapshot_id = str(uuid.uuid4())
+        rules = pair.snapshot.get("validations", [])
+        snapshot = {
+            "snapshot_id": snapshot_id,
+            "job_id": job["job_id"],
+            "sync_pair_id": pair.sync_pair_id,
+            "county_id": pair.county_id,
+            "status": "AVAILABLE",
+            "tables": {},
+            "created_at": datetime.utcnow().isoformat(),
+            "restored_at": None,
+            "restored_by": None,
+        }
+
+        target = create_connector(pair.target)
+        with target:
+            try:
+                for name in _dependency_order(pair, job["tables"]):
+                    table_def = pair.get_table(name).to_dict()
+                    snapshot_table = self._snapshot_table_name(table_def["target_table"], snapshot_id)
+                    columns = sorted({
+                        c for rule in rules
+                        if rule["type"] == "null_increase" and _rule_applies(rule, name)
+                        for c in rule["columns"]
+                    })
+                    stats = target.table_stats(table_def, columns)
+                    rows = target.create_snapshot(table_def, snapshot_table)
+                    snapshot["tables"][name] = {
+                        "target_table": table_def["target_table"],
+                        "snapshot_table": snapshot_table,
+                        "rows": rows,
+                        "stats": stats,
+                        "watermark": self.watermarks.get(pair.sync_pair_id, name),
+                    }
+            except Exception:
+                # Do not leave partial snapshots behind
+                for name, entry in snapshot["tables"].items():
+                    self._drop_quietly(target, pair.get_table(name).to_dict(), entry["snapshot_table"])
+                raise
+
+        self.store.save(SNAPSHOTS_COLLECTION, snapshot_id, snapshot)
+        logger.info(f"Created snapshot {snapshot_id} of {len(snapshot['tables'])} tables for job {job['job_id']}")
+        return snapshot
+
+    def validate(self, snapshot_id: str, pair, table_results: Dict[str, Dict[str, Any]]) -> List[str]:
+        """
+        Run the pair's validation rules against the target after a sync.
+
+        Returns:
+            Validation errors across every table (empty when all rules pass)
+        """
+        snapshot = self.get(snapshot_id)
+        rules = pair.snapshot.get("validations", [])
+        if not rules:
+            return []
+
+        errors = []
+        target = create_connector(pair.target)
+        with target:
+            for name, entry in snapshot["tables"].items():
+                table_rules = [r for r in rules if _rule_applies(r, name)]
+                if not table_rules:
+                    continue
+                after = target.table_stats(pair.get_table(name).to_dict(), list(entry["stats"]["null_counts"]))
+                for rule in table_rules:
+                    errors.extend(check_rule(rule, name, entry["stats"], after, table_results.get(name, {})))
+        return errors
+
+    def restore(self, snapshot_id: str, username: str, reason: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Roll the target tables and watermarks back to a snapshot.
+
+        Args:
+            snapshot_id: ID of the snapshot
+            username: User (or "system") performing the rollback
+            reason: Why the snapshot was restored
+
+        Returns:
+            The updated snapshot record
+
+        Raises:
+            FileNotFoundError: If the snapshot does not exist
+            ValueError: If the snapshot was already restored or discarded
+        """
+        snapshot = self.get(snapshot_id)
+        if snapshot["status"] != "AVAILABLE":
+            raise ValueError(f"Cannot restore snapshot {snapshot_id} with status {snapshot['status']}")
+
+        pair = self.registry.get(snapshot["sync_pair_id"])
+        snapshot_tables = [
+            (pair.get_table(name).to_dict(), entry["snapshot_table"])
+            for name, entry in snapshot["tables"].items()
+        ]
+        target = create_connector(pair.target)
+        with target:
+            restored = target.restore_snapshot(snapshot_tables)
+
+        for name, entry in snapshot["tables"].items():
+            self.watermarks.restore(pair.sync_pair_id, name, entry["watermark"])
+
+        snapshot["status"] = "RESTORED"
+        snapshot["restored_at"] = datetime.utcnow().isoformat()
+        snapshot["restored_by"] = username
+        snapshot["restore_reason"] = reason
+        snapshot["rows_restored"] = restored
+        self.store.save(SNAPSHOTS_COLLECTION, snapshot_id, snapshot)
+
+        self.audit_log.record(
+            "sync_snapshot.restored",
+            username,
+            "sync_snapshot",
+            snapshot_id,
+            {"sync_pair_id": pair.sync_pair_id, "job_id": snapshot["job_id"], "reason": reason, "rows_restored": restored},
+            county_id=pair.county_id
+        )
+        logger.warning(f"Restored snapshot {snapshot_id} for sync pair {pair.sync_pair_id}: {reason or 'manual rollback'}")
+        return snapshot
+
+    def get(self, snapshot_id: str) -> Dict[str, Any]:
+        """
+        Get a snapshot record.
+
+        Raises:
+            FileNotFoundError: If the snapshot does not exist
+        """
+        try:
+            return self.store.load(SNAPSHOTS_COLLECTION, snapshot_id)
+        except FileNotFoundError:
+            raise FileNotFoundError(f"Snapshot {snapshot_id} not found")
+
+    def list(self, sync_pair_id: Optional[str] = None, status: Optional[str] = None,
+             limit: int = 100) -> List[Dict[str, Any]]:
+        """List snapshots with optional filtering, newest first."""
+        snapshots = []
+        for snapshot in self.store.list(SNAPSHOTS_COLLECTION):
+            if sync_pair_id and snapshot.get("sync_pair_id") != sync_pair_id:
+                continue
+            if status and snapshot.get("status") != status:
+                continue
+            snapshots.append(snapshot)
+        snapshots.sort(key=lambda s: s.get("created_at", ""), reverse=True)
+        return snapshots[:limit]
+
+    def discard(self, snapshot_id: str) -> Dict[str, Any]:
+        """
+        Drop a snapshot's tables; the record is kept with status DISCARDED.
+
+        Raises:
+            FileNotFoundError: If the snapshot does not exist
+        """
+        snapshot = self.get(snapshot_id)
+        if snapshot["status"] == "DISCARDED":
+            return snapshot
+        pair = self.registry.get(snapshot["sync_pair_id"])
+        target = create_connector(pair.target)
+        with target:
+            for name, entry in snapshot["tables"].items():
+                # The table may have left the sync pair since the snapshot was taken
+                target.drop_snapshot({"name": name, "target_table": entry["target_table"]}, entry["snapshot_table"])
+        snapshot["status"] = "DISCARDED"
+        snapshot["discarded_at"] = datetime.utcnow().isoformat()
+        self.store.save(SNAPSHOTS_COLLECTION, snapshot_id, snapshot)
+        logger.info(f"Discarded snapshot {snapshot_id}")
+        return snapshot
+
+    def prune(self, pair) -> None:
+        """Discard the pair's snapshots beyond the configured number to keep."""
+        keep = int(pair.snapshot.get("keep", DEFAULT_SNAPSHOTS_KEPT))
+        for snapshot in self.list(pair.sync_pair_id, limit=1_000_000):
+            if snapshot["status"] == "DISCARDED":
+                continue
+            if keep > 0:
+                keep -= 1
+                continue
+            try:
+                self.discard(snapshot["snapshot_id"])
+            except Exception as e:
+                logger.warning(f"Could not discard snapshot {snapshot['snapshot_id']}: {e}")
+
+    @staticmethod
+    def _snapshot_table_name(target_table: str, snapshot_id: str) -> str:
+        schema, _, name = target_table.rpartition(".")
+        suffix = f"__snap_{snapshot_id[:8]}"
+        name = name[:MAX_IDENTIFIER_LENGTH - len(suffix)] + suffix
+        return f"{schema}.{name}" if schema else name
+
+    @staticmethod
+    def _drop_quietly(target, table_def: Dict[str, Any], snapshot_table: str) -> None:
+        try:
+            target.drop_snapshot(table_def, snapshot_table)
+        except Exception as e:
+            logger.warning(f"Could not drop partial snapshot table {snapshot_table}: {e}")
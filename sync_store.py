@@ -0,0 +1,519 @@
+"""
+TerraFusion SyncService - State Store
+
+This module provides the document store used by the sync engine to persist
+job records, table watermarks and other sync state between runs.
+
+The backend is chosen with SYNC_STATE_BACKEND: "json" (one file per document
+under SYNC_STATE_PATH, the default) or "sqlite" (a single database file at
+SYNC_STATE_SQLITE_PATH, for offices that want one file to back up). State
+moves between backends with:
+
+    python sync_store.py migrate --from json --to sqlite
+
+When a master key is configured (ENCRYPTION_KEY_FILE or ENCRYPTION_KMS_KEY_ID,
+see encryption) documents are stored encrypted, since job records carry the
+records and settings of the jobs that wrote them. Documents stored before
+encryption was turned on are still read; "python sync_store.py encrypt"
+rewrites them encrypted, and after a key rotation under the new key.
+
+The service's store is wrapped in a TenantIsolatedStore, so a request scoped
+to some counties (see tenancy) reads and writes only their documents.
+"""
+
+import os
+import sys
+import json
+import sqlite3
+import logging
+import argparse
+import threading
+from contextlib import contextmanager
+from typing import Dict, List, Any, Optional, Iterator
+
+from encryption import EncryptionError, EnvelopeCipher, default_cipher, dumps_document, loads_document
+
+try:
+    import fcntl
+    FCNTL_AVAILABLE = True
+except ImportError:
+    # Without fcntl (Windows) store locks only hold within one process
+    FCNTL_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Default location for sync state on disk
+DEFAULT_STATE_PATH = os.environ.get("SYNC_STATE_PATH", "sync_state")
+
+# Default database file of the SQLite backend
+DEFAULT_SQLITE_STATE_PATH = os.environ.get("SYNC_STATE_SQLITE_PATH", os.path.join(DEFAULT_STATE_PATH, "sync_state.db"))
+
+STATE_BACKENDS = ["json", "sqlite"]
+
+# Thread locks of store locks, by lock file (or store and name)
+_thread_locks: Dict[str, threading.Lock] = {}
+_thread_locks_guard = threading.Lock()
+
+
+def document_key(key: Any) -> str:
+    """
+    The stored form of a document key, the same in every backend so state
+    migrates between them without renaming.
+    """
+    safe_key = "".join(c if c.isalnum() or c in "-_." else "_" for c in str(key))
+    if not safe_key or safe_key.startswith('.'):
+        raise ValueError(f"Invalid document key: {key}")
+    return safe_key
+
+
+class DocumentStore:
+    """
+    Base class for sync state storage backends.
+
+    Documents are JSON-serializable dictionaries grouped into named
+    collections (for example "sync_jobs" or "watermarks") and addressed
+    by a string key.
+    """
+
+    backend_name = "base"
+
+    # Encrypts documents when set (see encryption)
+    cipher: Optional[EnvelopeCipher] = None
+
+    def save(self, collection: str, key: str, document: Dict[str, Any]) -> None:
+        """Insert or replace a document."""
+        raise NotImplementedError
+
+    def load(self, collection: str, key: str) -> Dict[str, Any]:
+        """
+        Load a document.
+
+        Raises:
+            FileNotFoundError: If the document does not exist
+        """
+        raise NotImplementedError
+
+    def delete(self, collection: str, key: str) -> bool:
+        """Delete a document. Returns True if a document was removed."""
+        raise NotImplementedError
+
+    def list(self, collection: str) -> List[Dict[str, Any]]:
+        """Return every document in a collection."""
+        raise NotImplementedError
+
+    def collections(self) -> List[str]:
+        """Return the names of the collections holding documents."""
+        raise NotImplementedError
+
+    def keys(self, collection: str) -> List[str]:
+        """Return the keys of every document in a collection."""
+        raise NotImplementedError
+
+    def exists(self, collection: str, key: str) -> bool:
+        """Check whether a document exists."""
+        try:
+            self.load(collection, key)
+            return True
+        except FileNotFoundError:
+            return False
+
+    def lock_path(self, name: str) -> Optional[str]:
+        """The file a named lock is held on across processes; None when the backend has none."""
+        return None
+
+    def compact(self) -> Dict[str, Any]:
+        """Give the space of deleted documents back to the disk, where the backend holds on to it."""
+        return {"backend": self.backend_name, "compacted": False}
+
+    @contextmanager
+    def lock(self, name: str) -> Iterator[None]:
+        """
+        Hold a named lock around a read-modify-write of documents, such as
+        appending to the audit chain. It holds across threads and, for the file
+        backends, across the processes sharing the store.
+        """
+        path = self.lock_path(name)
+        with _thread_locks_guard:
+            thread_lock = _thread_locks.setdefault(path or f"{id(self)}:{name}", threading.Lock())
+        with thread_lock:
+            if path is None or not FCNTL_AVAILABLE:
+                yield
+                return
+            with open(path, "a") as handle:
+                fcntl.flock(handle, fcntl.LOCK_EX)
+                try:
+                    yield
+                finally:
+                    fcntl.flock(handle, fcntl.LOCK_UN)
+
+    def _dumps(self, collection: str, key: str, document: Dict[str, Any], **json_options) -> str:
+        """The stored text of a document, encrypted for its collection and key when there is a cipher."""
+        return dumps_document(document, self.cipher, f"{collection}/{document_key(key)}", **json_options)
+
+    def _loads(self, collection: str, key: str, text: str) -> Dict[str, Any]:
+        return loads_document(text, self.cipher, f"{collection}/{document_key(key)}")
+
+
+class JsonFileDocumentStore(DocumentStore):
+    """
+    Document store that keeps one JSON file per document.
+
+    Files are written atomically (write to a temporary file, then rename)
+    so a crash mid-write never leaves a truncated watermark or job record.
+    """
+
+    backend_name = "json"
+
+    def __init__(self, base_path: str = DEFAULT_STATE_PATH, cipher: Optional[EnvelopeCipher] = None):
+        """
+        Initialize the JSON file store.
+
+        Args:
+            base_path: Root directory for state files
+            cipher: Encrypts the files (optional)
+        """
+        self.base_path = base_path
+        self.cipher = cipher
+        self._lock = threading.RLock()
+        os.makedirs(self.base_path, exist_ok=True)
+        logger.info(f"Sync state store initialized with storage path: {self.base_path}")
+
+    def save(self, collection: str, key: str, document: Dict[str, Any]) -> None:
+        path = self._document_path(collection, key)
+        tmp_path = f"{path}.tmp"
+        with self._lock:
+            os.makedirs(os.path.dirname(path), exist_ok=True)
+            with open(tmp_path, 'w') as f:
+                f.write(self._dumps(collection, key, document, indent=2))
+            os.replace(tmp_path, path)
+
+    def load(self, collection: str, key: str) -> Dict[str, Any]:
+        path = self._document_path(collection, key)
+        with self._lock:
+            if not os.path.exists(path):
+                raise FileNotFoundError(f"{collection} document {key} not found")
+            with open(path, 'r') as f:
+                return self._loads(collection, key, f.read())
+
+    def delete(self, collection: str, key: str) -> bool:
+        path = self._document_path(collection, key)
+        with self._lock:
+            if os.path.exists(path):
+                os.remove(path)
+                return True
+            return False
+
+    def list(self, collection: str) -> List[Dict[str, Any]]:
+        collection_path = os.path.join(self.base_path, collection)
+        documents = []
+        with self._lock:
+            if not os.path.isdir(collection_path):
+                return documents
+            for filename in sorted(os.listdir(collection_path)):
+                if not filename.endswith('.json'):
+                    continue
+                try:
+                    with open(os.path.join(collection_path, filename), 'r') as f:
+                        documents.append(self._loads(collection, filename[:-len('.json')], f.read()))
+                except Exception as e:
+                    logger.error(f"Error reading state file {collection}/{filename}: {e}")
+        return documents
+
+    def collections(self) -> List[str]:
+        with self._lock:
+            return sorted(
+                name for name in os.listdir(self.base_path)
+                if os.path.isdir(os.path.join(self.base_path, name))
+            )
+
+    def keys(self, collection: str) -> List[str]:
+        collection_path = os.path.join(self.base_path, collection)
+        with self._lock:
+            if not os.path.isdir(collection_path):
+                return []
+            # File names are the stored keys (see document_key)
+            return [f[:-len('.json')] for f in sorted(os.listdir(collection_path)) if f.endswith('.json')]
+
+    def lock_path(self, name: str) -> Optional[str]:
+        return os.path.join(self.base_path, f".{document_key(name)}.lock")
+
+    def _document_path(self, collection: str, key: str) -> str:
+        """Build the file path for a document, rejecting path traversal."""
+        return os.path.join(self.base_path, collection, f"{document_key(key)}.json")
+
+
+class SqliteDocumentStore(DocumentStore):
+    """
+    Document store that keeps every document in one SQLite database file.
+
+    Meant for single-server installs: the database runs in WAL mode so
+    readers do not block the writer, and each thread uses its own connection.
+    """
+
+    backend_name = "sqlite"
+
+    # Seconds a writer waits for another connection's write to finish
+    BUSY_TIMEOUT = 30
+
+    def __init__(self, path: str = DEFAULT_SQLITE_STATE_PATH, cipher: Optional[EnvelopeCipher] = None):
+        """
+        Initialize the SQLite store, creating the database if needed.
+
+        Args:
+            path: Database file
+            cipher: Encrypts the documents (optional)
+        """
+        self.path = path
+        self.cipher = cipher
+        self._local = threading.local()
+        directory = os.path.dirname(os.path.abspath(path))
+        os.makedirs(directory, exist_ok=True)
+        connection = self._connection()
+        with connection:
+            connection.execute(
+                "CREATE TABLE IF NOT EXISTS documents ("
+                "collection TEXT NOT NULL, key TEXT NOT NULL, document TEXT NOT NULL, "
+                "updated_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%f', 'now')), "
+                "PRIMARY KEY (collection, key))"
+            )
+        logger.info(f"Sync state store initialized with SQLite database: {self.path}")
+
+    def save(self, collection: str, key: str, document: Dict[str, Any]) -> None:
+        data = self._dumps(collection, key, document)
+        connection = self._connection()
+        with connection:
+            connection.execute(
+                "INSERT INTO documents (collection, key, document) VALUES (?, ?, ?) "
+                "ON CONFLICT (collection, key) DO UPDATE SET document = excluded.document, "
+                "updated_at = strftime('%Y-%m-%dT%H:%M:%f', 'now')",
+                (collection, document_key(key), data)
+            )
+
+    def load(self, collection: str, key: str) -> Dict[str, Any]:
+        row = self._connection().execute(
+            "SELECT document FROM documents WHERE collection = ? AND key = ?", (collection, document_key(key))
+        ).fetchone()
+        if row is None:
+            raise FileNotFoundError(f"{collection} document {key} not found")
+        return self._loads(collection, key, row[0])
+
+    def delete(self, collection: str, key: str) -> bool:
+        connection = self._connection()
+        with connection:
+            cursor = connection.execute(
+                "DELETE FROM documents WHERE collection = ? AND key = ?", (collection, document_key(key))
+            )
+        return cursor.rowcount > 0
+
+    def list(self, collection: str) -> List[Dict[str, Any]]:
+        documents = []
+        rows = self._connection().execute(
+            "SELECT key, document FROM documents WHERE collection = ? ORDER BY key", (collection,)
+        ).fetchall()
+        for key, data in rows:
+            try:
+                documents.append(self._loads(collection, key, data))
+            except (ValueError, EncryptionError) as e:
+                logger.error(f"Error reading state document {collection}/{key}: {e}")
+        return documents
+
+    def collections(self) -> List[str]:
+        rows = self._connection().execute("SELECT DISTINCT collection FROM documents ORDER BY collection").fetchall()
+        return [row[0] for row in rows]
+
+    def keys(self, collection: str) -> List[str]:
+        rows = self._connection().execute(
+            "SELECT key FROM documents WHERE collection = ? ORDER BY key", (collection,)
+        ).fetchall()
+        return [row[0] for row in rows]
+
+    def exists(self, collection: str, key: str) -> bool:
+        row = self._connection().execute(
+            "SELECT 1 FROM documents WHERE collection = ? AND key = ?", (collection, document_key(key))
+        ).fetchone()
+        return row is not None
+
+    def lock_path(self, name: str) -> Optional[str]:
+        return f"{self.path}.{document_key(name)}.lock"
+
+    def compact(self) -> Dict[str, Any]:
+        # Deleted rows leave free pages in the file until it is vacuumed; the WAL is folded in around it
+        connection = self._connection()
+        connection.execute("PRAGMA wal_checkpoint(TRUNCATE)")
+        size = os.path.getsize(self.path)
+        connection.execute("VACUUM")
+        connection.execute("PRAGMA wal_checkpoint(TRUNCATE)")
+        return {"backend": self.backend_name, "compacted": True, "size_before": size,
+                "size_after": os.path.getsize(self.path)}
+
+    def _connection(self) -> sqlite3.Connection:
+        """The calling thread's connection to the database."""
+        connection = getattr(self._local, "connection", None)
+        if connection is None:
+            connection = sqlite3.connect(self.path, timeout=self.BUSY_TIMEOUT)
+            connection.execute("PRAGMA journal_mode=WAL")
+            connection.execute("PRAGMA synchronous=NORMAL")
+            self._local.connection = connection
+        return connection
+
+
+class TenantIsolatedStore(DocumentStore):
+    """
+    Document store that keeps a request to the documents of its counties
+    (see tenancy).
+
+    Unscoped callers, and collections of no county, see the wrapped store
+    as it is. Within a scope listings leave out other counties' documents,
+    loads of them fail as missing documents do, deletes leave them and
+    saves of them raise tenancy.TenantIsolationError.
+    """
+
+    def __init__(self, store: DocumentStore):
+        self.store = store
+        self.backend_name = store.backend_name
+
+    @property
+    def cipher(self) -> Optional[EnvelopeCipher]:
+        return self.store.cipher
+
+    @cipher.setter
+    def cipher(self, cipher: Optional[EnvelopeCipher]) -> None:
+        self.store.cipher = cipher
+
+    def save(self, collection: str, key: str, document: Dict[str, Any]) -> None:
+        from tenancy import check_document
+        check_document(collection, key, document)
+        self.store.save(collection, key, document)
+
+    def load(self, collection: str, key: str) -> Dict[str, Any]:
+        from tenancy import visible
+        document = self.store.load(collection, key)
+        if not visible(collection, document):
+            raise FileNotFoundError(f"{collection} document {key} not found")
+        return document
+
+    def delete(self, collection: str, key: str) -> bool:
+        from tenancy import current_tenants, TENANT_COLLECTIONS
+        if current_tenants() is not None and collection in TENANT_COLLECTIONS and not self.exists(collection, key):
+            return False
+        return self.store.delete(collection, key)
+
+    def list(self, collection: str) -> List[Dict[str, Any]]:
+        from tenancy import visible
+        return [document for document in self.store.list(collection) if visible(collection, document)]
+
+    def collections(self) -> List[str]:
+        return self.store.collections()
+
+    def keys(self, collection: str) -> List[str]:
+        from tenancy import current_tenants, TENANT_COLLECTIONS
+        if current_tenants() is None or collection not in TENANT_COLLECTIONS:
+            return self.store.keys(collection)
+        return [key for key in self.store.keys(collection) if self.exists(collection, key)]
+
+    def exists(self, collection: str, key: str) -> bool:
+        from tenancy import current_tenants, TENANT_COLLECTIONS
+        if current_tenants() is None or collection not in TENANT_COLLECTIONS:
+            return self.store.exists(collection, key)
+        return super().exists(collection, key)
+
+    def lock_path(self, name: str) -> Optional[str]:
+        return self.store.lock_path(name)
+
+    def compact(self) -> Dict[str, Any]:
+        return self.store.compact()
+
+    @contextmanager
+    def lock(self, name: str) -> Iterator[None]:
+        with self.store.lock(name):
+            yield
+
+    def __getattr__(self, name: str) -> Any:
+        # Backend attributes (base_path, path) of the wrapped store
+        if name == "store":
+            raise AttributeError(name)
+        return getattr(self.store, name)
+
+
+def copy_documents(source: DocumentStore, target: DocumentStore,
+                   collections: Optional[List[str]] = None) -> Dict[str, int]:
+    """
+    Copy documents from one store to another, replacing documents with the same key.
+
+    Args:
+        source: Store to copy from
+        target: Store to copy to
+        collections: Collections to copy (all by default)
+
+    Returns:
+        Number of documents copied per collection
+    """
+    copied = {}
+    for collection in collections or source.collections():
+        count = 0
+        for key in source.keys(collection):
+            target.save(collection, key, source.load(collection, key))
+            count += 1
+        copied[collection] = count
+        logger.info(f"Copied {count} {collection} documents from {source.backend_name} to {target.backend_name}")
+    return copied
+
+
+def create_document_store(backend: Optional[str] = None, **options) -> DocumentStore:
+    """
+    Create a document store for the configured backend.
+
+    Args:
+        backend: Backend name; defaults to the SYNC_STATE_BACKEND environment variable
+        **options: Backend-specific options, and "cipher" to encrypt documents
+            (the configured master key's by default)
+
+    Returns:
+        DocumentStore instance
+    """
+    backend = (backend or os.environ.get("SYNC_STATE_BACKEND", "json")).lower()
+    cipher = options["cipher"] if "cipher" in options else default_cipher()
+
+    if backend == "json":
+        return JsonFileDocumentStore(options.get("base_path", DEFAULT_STATE_PATH), cipher)
+    if backend == "sqlite":
+        return SqliteDocumentStore(options.get("path", DEFAULT_SQLITE_STATE_PATH), cipher)
+
+    raise ValueError(f"Unsupported sync state backend: {backend}")
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    """Command-line entry point for moving sync state between backends."""
+    parser = argparse.ArgumentParser(description="TerraFusion SyncService State Store")
+    commands = parser.add_subparsers(dest="command", required=True)
+    migrate = commands.add_parser("migrate", help="Copy every state document to another backend")
+    migrate.add_argument('--from', dest='source', required=True, choices=STATE_BACKENDS, help="Backend to copy from")
+    migrate.add_argument('--to', dest='target', required=True, choices=STATE_BACKENDS, help="Backend to copy to")
+    migrate.add_argument('--collection', action='append', dest='collections', help="Collection to copy (repeatable)")
+    encrypt = commands.add_parser("encrypt", help="Rewrite every state document under the configured master key")
+    encrypt.add_argument('--collection', action='append', dest='collections', help="Collection to rewrite (repeatable)")
+
+    args = parser.parse_args(argv)
+    if args.command == "encrypt":
+        store = create_document_store()
+        if store.cipher is None:
+            parser.error("Set ENCRYPTION_KEY_FILE or ENCRYPTION_KMS_KEY_ID to encrypt sync state")
+        print(json.dumps(copy_documents(store, store, args.collections), indent=2))
+        return 0
+    if args.source == args.target:
+        parser.error("--from and --to must name different backends")
+
+    copied = copy_documents(create_document_store(args.source), create_document_store(args.target), args.collections)
+    print(json.dumps(copied, indent=2))
+    print(f"Set SYNC_STATE_BACKEND={args.target} to use the copied state")
+    return 0
+
+
+# Create a singleton instance; requests see only their counties' documents in it (see tenancy)
+sync_state_store = TenantIsolatedStore(create_document_store())
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,258 @@
+"""
+TerraFusion SyncService - Record Streams
+
+This module provides newline-delimited JSON (NDJSON) streams of the tables a
+sync pair publishes over OData (see sync_odata), for integrators that pull a
+full county extract in one request instead of paging through the OData
+endpoint. A stream reads the target table in primary key order a page at a
+time and writes each row as one JSON line, with the same JSON values,
+hidden columns and $filter/$select syntax as the OData service:
+
+    GET /api/v1/sync/pairs/benton_wa_pacs_staging/streams/parcels?$filter=prop_val_yr eq 2025
+
+Backpressure comes from the response itself: the next page is read only once
+the server has written the previous lines to the client, so a slow reader
+slows the query instead of filling the service's memory, and a reader that
+disconnects ends it. A stream that waits on its reader for longer than
+STREAM_IDLE_RELEASE_SECONDS gives its database connection back and reconnects
+for the next page. Every line carries the row's published primary key; a client whose
+stream broke off resumes with ?after=<key as JSON>, e.g. after=[12345]. If
+reading fails partway, the stream ends with a line {"@error": "..."} so a
+truncated extract is never mistaken for a complete one.
+
+Tables of a sync pair versioned by assessment roll year (see roll_years)
+stream their open year, or a certified year's table with ?roll_year=2025.
+"""
+
+import os
+import json
+import time
+import logging
+import threading
+from decimal import Decimal
+from typing import Dict, List, Any, Optional, Iterator, Tuple
+
+from sync_connectors import ConnectorError, create_connector, keyset_after
+from sync_odata import ODataError, ODataService, FilterParser, check_literal
+from roll_years import roll_years
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Rows read per query
+STREAM_PAGE_SIZE = int(os.environ.get("RECORD_STREAM_PAGE_SIZE", "5000"))
+
+# Bytes of lines gathered before they are handed to the server
+STREAM_CHUNK_BYTES = 64 * 1024
+
+# Streams this process serves at once; further requests are turned away
+MAX_CONCURRENT_STREAMS = int(os.environ.get("RECORD_STREAM_MAX_CONCURRENT", "4"))
+
+# Seconds a stream may wait on its reader before releasing its database connection
+STREAM_IDLE_RELEASE_SECONDS = 10
+
+# Query options a stream understands
+STREAM_OPTIONS = {"$filter", "$select", "after", "roll_year"}
+
+NDJSON_CONTENT_TYPE = "application/x-ndjson"
+
+
+class StreamLimitError(Exception):
+    """Raised when the process is already serving MAX_CONCURRENT_STREAMS streams."""
+
+
+class RecordStream:
+    """
+    The lines of one stream, as an iterable of byte chunks for a streaming
+    response. close() ends the stream and frees its connection and slot,
+    whether or not it was read to the end.
+    """
+
+    def __init__(self, service: "RecordStreamService", pair, table_def: Dict[str, Any],
+                 columns: Dict[str, str], selected: List[str], where: Optional[Tuple],
+                 after: Optional[List[Any]], page_size: int):
+        self.service = service
+        self.pair = pair
+        self.table_def = table_def
+        self.columns = columns
+        self.selected = selected
+        self.where = where
+        self.after = after
+        self.page_size = page_size
+        self.rows = 0
+        self._target = None
+        self._closed = False
+        self._lines = self._generate()
+
+    def __iter__(self):
+        return self._lines
+
+    def close(self) -> None:
+        if self._closed:
+            return
+        self._closed = True
+        self._lines.close()
+        self._release()
+        self.service._finished(self)
+
+    def _generate(self) -> Iterator[bytes]:
+        key_columns = self.table_def["primary_key"]
+        query_columns = list(dict.fromkeys(key_columns + self.selected)) if self.selected else list(self.columns)
+        last_key = self.after
+        buffer: List[bytes] = []
+        size = 0
+        try:
+            while True:
+                where = keyset_after(key_columns, last_key) if last_key is not None else None
+                if self.where is not None:
+                    where = self.where if where is None else ("and", self.where, where)
+                rows = self._connect().query_records(self.table_def, where, query_columns,
+                                                     [(c, False) for c in key_columns], limit=self.page_size)
+                for row in rows:
+                    # Key columns are read for paging even when hidden; only published ones are written
+                    published = {name: value for name, value in row.items() if name in self.columns}
+                    line = json.dumps(ODataService._row(published, self.columns), default=str).encode("utf-8") + b"\n"
+                    buffer.append(line)
+                    size += len(line)
+                    self.rows += 1
+                    if size >= STREAM_CHUNK_BYTES:
+                        yield from self._flush(buffer)
+                        buffer, size = [], 0
+                if len(rows) < self.page_size:
+                    break
+                last_key = [rows[-1].get(c) for c in key_columns]
+            if buffer:
+                yield from self._flush(buffer)
+            logger.info(f"Streamed {self.rows} rows of {self.table_def.get('target_table')} "
+                        f"from sync pair {self.pair.sync_pair_id}")
+        except GeneratorExit:
+            logger.info(f"Stream of {self.table_def.get('target_table')} from sync pair {self.pair.sync_pair_id} "
+                        f"closed by the client after {self.rows} rows")
+            raise
+        except Exception as e:
+            logger.error(f"Stream of {self.table_def.get('target_table')} from sync pair {self.pair.sync_pair_id} "
+                         f"failed after {self.rows} rows: {e}", exc_info=True)
+            yield b"".join(buffer) + json.dumps({"@error": str(e)}).encode("utf-8") + b"\n"
+        finally:
+            self._release()
+            self.service._finished(self)
+
+    def _flush(self, buffer: List[bytes]) -> Iterator[bytes]:
+        """Hand lines to the server; the generator resumes only when the server wants more."""
+        handed = time.monotonic()
+        yield b"".join(buffer)
+        if time.monotonic() - handed > STREAM_IDLE_RELEASE_SECONDS:
+            # A slow reader; don't hold a database connection while waiting on it
+            self._release()
+
+    def _connect(self):
+        if self._target is None:
+            self._target = create_connector(self.pair.target)
+            self._target.connect()
+        return self._target
+
+    def _release(self) -> None:
+        if self._target is not None:
+            target, self._target = self._target, None
+            try:
+                target.close()
+            except Exception as e:
+                logger.warning(f"Error closing stream connection for sync pair {self.pair.sync_pair_id}: {e}")
+
+
+class RecordStreamService:
+    """Opens NDJSON streams of the tables sync pairs publish over OData."""
+
+    def __init__(self, registry, max_streams: int = MAX_CONCURRENT_STREAMS, page_size: int = STREAM_PAGE_SIZE):
+        """
+        Initialize the service.
+
+        Args:
+            registry: Sync pair registry the tables come from
+            max_streams: Streams served at once
+            page_size: Rows read per query
+        """
+        self.odata = ODataService(registry)
+        self.max_streams = max_streams
+        self.page_size = page_size
+        self._lock = threading.Lock()
+        self._open: List[RecordStream] = []
+
+    def open(self, sync_pair_id: str, entity_set: str, options: Dict[str, str]) -> RecordStream:
+        """
+        Check a stream request and open the stream.
+
+        Everything that can be wrong with the request is found here, before
+        the response starts, so it can still be answered with an error status.
+
+        Args:
+            sync_pair_id: Sync pair publishing the table over OData
+            entity_set: The table's OData entity set name
+            options: Query string parameters ($filter, $select, after, roll_year)
+
+        Returns:
+            The stream, to be returned as the response body
+
+        Raises:
+            KeyError: If the sync pair or entity set does not exist
+            ODataError: If an option is invalid
+            ValueError: If the table does not have the roll year asked for
+            StreamLimitError: If too many streams are open
+        """
+        unknown = [name for name in options if name not in STREAM_OPTIONS]
+        if unknown:
+            raise ODataError(f"Unsupported stream option {unknown[0]}; streams take {', '.join(sorted(STREAM_OPTIONS))}")
+        pair = self.odata._pair(sync_pair_id)
+        entity_sets = self.odata._entity_sets(pair)
+        if entity_set not in entity_sets:
+            raise KeyError(f"Entity set {entity_set} not found")
+        table_def = roll_years.table_def(pair, entity_sets[entity_set], options.get("roll_year"))
+
+        with create_connector(pair.target) as target:
+            try:
+                columns = {c["name"]: c["edm_type"] for c in self.odata._columns(pair, target, table_def)}
+            except ConnectorError:
+                # Not created in the target yet
+                raise KeyError(f"Entity set {entity_set} not found")
+        where = FilterParser(options["$filter"], columns).parse() if options.get("$filter") else None
+        selected = self.odata._select(options.get("$select"), columns)
+        after = self._after(options.get("after"), columns, table_def)
+
+        with self._lock:
+            if len(self._open) >= self.max_streams:
+                raise StreamLimitError(f"{len(self._open)} streams are already open; try again shortly")
+            stream = RecordStream(self, pair, table_def, columns, selected, where, after, self.page_size)
+            self._open.append(stream)
+        logger.info(f"Opened stream of {entity_set} from sync pair {sync_pair_id}")
+        return stream
+
+    def status(self) -> Dict[str, Any]:
+        """The streams being served."""
+        with self._lock:
+            return {
+                "max_streams": self.max_streams,
+                "open": [{"sync_pair_id": s.pair.sync_pair_id, "table": s.table_def.get("target_table"), "rows": s.rows}
+                         for s in self._open],
+            }
+
+    def _finished(self, stream: RecordStream) -> None:
+        with self._lock:
+            if stream in self._open:
+                self._open.remove(stream)
+
+    @staticmethod
+    def _after(text: Optional[str], columns: Dict[str, str], table_def: Dict[str, Any]) -> Optional[List[Any]]:
+        """The key a resumed stream starts after: a JSON array of the primary key values."""
+        if text is None:
+            return None
+        key_columns = table_def["primary_key"]
+        try:
+            values = json.loads(text, parse_float=Decimal)
+        except ValueError:
+            raise ODataError(f"after must be a JSON array of the key values ({', '.join(key_columns)})")
+        if not isinstance(values, list):
+            values = [values]
+        if len(values) != len(key_columns):
+            raise ODataError(f"after must give {len(key_columns)} key values ({', '.join(key_columns)})")
+        return [check_literal(c, columns.get(c, "Edm.String"), v) for c, v in zip(key_columns, values)]
@@ -0,0 +1,257 @@
+"""
+TerraFusion SyncService - Source Throttling
+
+This module provides the rate limits that keep sync extracts from degrading a
+county's production source database. A source connector block may declare:
+
+    "throttle": {
+        "rows_per_second": 5000,
+        "max_concurrent_queries": 3,
+        "schedule": [
+            {"days": ["mon", "tue", "wed", "thu", "fri"], "start": "07:30", "end": "17:30",
+             "rows_per_second": 500, "max_concurrent_queries": 1}
+        ]
+    }
+
+rows_per_second paces extract reads (with up to a second of burst) and
+max_concurrent_queries caps how many batch fetches run against the source at
+once across all workers and jobs of the sync pair. Schedule windows override
+either limit while they are active; the first matching window wins. Windows
+are evaluated in the throttle's "timezone", which defaults to the county's.
+Sync pairs that read the same database can share one set of limits by giving
+their throttles the same "group" name (and the same settings).
+"""
+
+import time
+import logging
+import threading
+from datetime import datetime, timedelta, timezone
+from typing import Dict, List, Any, Optional, Iterator
+from zoneinfo import ZoneInfo, ZoneInfoNotFoundError
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Limits a throttle or schedule window can set
+THROTTLE_LIMITS = ["rows_per_second", "max_concurrent_queries"]
+
+DAY_NAMES = ["mon", "tue", "wed", "thu", "fri", "sat", "sun"]
+
+# Rows a throttle lets through ahead of its rate, in seconds of throughput
+BURST_SECONDS = 1.0
+
+# How often a blocked query re-checks the limit (schedule windows can open or close meanwhile)
+SLOT_RECHECK_SECONDS = 5
+
+
+def _minutes(value: str, field_name: str) -> int:
+    try:
+        hours, minutes = str(value).split(":")
+        result = int(hours) * 60 + int(minutes)
+    except ValueError:
+        raise ValueError(f"Throttle window {field_name} must be HH:MM, got {value!r}")
+    if not 0 <= result <= 24 * 60:
+        raise ValueError(f"Throttle window {field_name} out of range: {value}")
+    return result
+
+
+def _check_limits(definition: Dict[str, Any], context: str) -> None:
+    rate = definition.get("rows_per_second")
+    if rate is not None and (not isinstance(rate, (int, float)) or rate <= 0):
+        raise ValueError(f"{context} rows_per_second must be a positive number")
+    queries = definition.get("max_concurrent_queries")
+    if queries is not None and (not isinstance(queries, int) or queries < 1):
+        raise ValueError(f"{context} max_concurrent_queries must be a positive integer")
+
+
+def parse_throttle(definition: Optional[Dict[str, Any]], default_timezone: str = "UTC") -> Dict[str, Any]:
+    """
+    Validate a connector's throttle settings and fill in defaults.
+
+    Returns:
+        The normalized settings, or an empty dict when there is no throttle
+
+    Raises:
+        ValueError: If a limit, time zone or schedule window is invalid
+    """
+    if not definition:
+        return {}
+    settings = dict(definition)
+    _check_limits(settings, "Throttle")
+    settings.setdefault("timezone", default_timezone)
+    try:
+        ZoneInfo(settings["timezone"])
+    except (ZoneInfoNotFoundError, ValueError):
+        raise ValueError(f"Unknown time zone: {settings['timezone']}")
+
+    windows = []
+    for window in settings.get("schedule", []):
+        window = dict(window)
+        for required in ("start", "end"):
+            if required not in window:
+                raise ValueError(f"Throttle window missing required field: {required}")
+        _minutes(window["start"], "start")
+        _minutes(window["end"], "end")
+        if not any(limit in window for limit in THROTTLE_LIMITS):
+            raise ValueError(f"Throttle window {window['start']}-{window['end']} sets no limit")
+        _check_limits(window, f"Throttle window {window['start']}-{window['end']}")
+        window["days"] = [str(day).lower()[:3] for day in window.get("days", DAY_NAMES[:5])]
+        unknown = [day for day in window["days"] if day not in DAY_NAMES]
+        if unknown:
+            raise ValueError(f"Unknown throttle window days: {', '.join(unknown)}")
+        windows.append(window)
+    settings["schedule"] = windows
+    return settings
+
+
+class SourceThrottle:
+    """Rate and concurrency limits shared by every reader of one source."""
+
+    def __init__(self, name: str, settings: Dict[str, Any]):
+        """
+        Initialize the throttle.
+
+        Args:
+            name: Throttle group name
+            settings: Settings from parse_throttle
+        """
+        self.name = name
+        self.settings = settings
+        self._tz = ZoneInfo(settings.get("timezone", "UTC"))
+        self._condition = threading.Condition()
+        self._active_queries = 0
+        self._next_free = 0.0
+        self.rows_read = 0
+        self.wait_seconds = 0.0
+
+    def limits(self, moment: Optional[datetime] = None) -> Dict[str, Any]:
+        """The limits in force at a moment (now by default) and the schedule window providing them."""
+        limits = {limit: self.settings.get(limit) for limit in THROTTLE_LIMITS}
+        window = self._active_window(moment or datetime.now(timezone.utc))
+        if window:
+            limits.update({limit: window[limit] for limit in THROTTLE_LIMITS if limit in window})
+        limits["window"] = f"{','.join(window['days'])} {window['start']}-{window['end']}" if window else None
+        return limits
+
+    def iterate(self, batches: Iterator[List[Dict[str, Any]]],
+                result: Optional[Dict[str, Any]] = None, control=None) -> Iterator[List[Dict[str, Any]]]:
+        """
+        Yield source batches within the throttle's limits.
+
+        Each fetch holds a query slot, and reading pauses as needed to keep to
+        the row rate. Time spent waiting is added to result["throttle_wait_seconds"].
+        When a JobControl is given, waits for the row rate end early if the job
+        is paused or cancelled.
+        """
+        iterator = iter(batches)
+        while True:
+            waited = self._acquire()
+            try:
+                batch = next(iterator)
+            except StopIteration:
+                return
+            finally:
+                self._release()
+            waited += self._pace(len(batch), control)
+            if result is not None and waited:
+                result["throttle_wait_seconds"] = round(result.get("throttle_wait_seconds", 0) + waited, 3)
+            yield batch
+
+    def status(self) -> Dict[str, Any]:
+        """Current limits and counters."""
+        with self._condition:
+            active = self._active_queries
+        return {
+            "group": self.name,
+            "limits": self.limits(),
+            "active_queries": active,
+            "rows_read": self.rows_read,
+            "wait_seconds": round(self.wait_seconds, 3),
+            "settings": self.settings,
+        }
+
+    def _acquire(self) -> float:
+        """Take a query slot and return the seconds spent waiting for it."""
+        started = None
+        with self._condition:
+            while True:
+                limit = self.limits()["max_concurrent_queries"]
+                if limit is None or self._active_queries < limit:
+                    break
+                started = started or time.monotonic()
+                self._condition.wait(timeout=SLOT_RECHECK_SECONDS)
+            self._active_queries += 1
+            waited = time.monotonic() - started if started else 0.0
+            self.wait_seconds += waited
+        return waited
+
+    def _release(self) -> None:
+        with self._condition:
+            self._active_queries -= 1
+            self._condition.notify_all()
+
+    def _pace(self, rows: int, control=None) -> float:
+        """Account for rows read and sleep while the reader is ahead of the row rate."""
+        rate = self.limits()["rows_per_second"]
+        with self._condition:
+            self.rows_read += rows
+            if rate is None:
+                return 0.0
+            now = time.monotonic()
+            self._next_free = max(self._next_free, now - BURST_SECONDS) + rows / rate
+            wait = self._next_free - now - BURST_SECONDS
+        if wait <= 0:
+            return 0.0
+        if control is not None:
+            control.sleep(wait)
+        else:
+            time.sleep(wait)
+        with self._condition:
+            self.wait_seconds += wait
+        return wait
+
+    def _active_window(self, moment: datetime) -> Optional[Dict[str, Any]]:
+        local = moment.astimezone(self._tz)
+        minute = local.hour * 60 + local.minute
+        today = DAY_NAMES[local.weekday()]
+        yesterday = DAY_NAMES[(local - timedelta(days=1)).weekday()]
+        for window in self.settings.get("schedule", []):
+            start, end = _minutes(window["start"], "start"), _minutes(window["end"], "end")
+            if start <= end:
+                if today in window["days"] and start <= minute < end:
+                    return window
+            elif (today in window["days"] and minute >= start) or (yesterday in window["days"] and minute < end):
+                # Window crosses midnight
+                return window
+        return None
+
+
+_throttles: Dict[str, SourceThrottle] = {}
+_throttles_lock = threading.Lock()
+
+
+def source_throttle(settings: Dict[str, Any], default_group: str) -> Optional[SourceThrottle]:
+    """
+    Get the shared throttle for a source's settings, or None when it has none.
+
+    Args:
+        settings: Settings from parse_throttle
+        default_group: Group name used when the settings do not name one (the sync pair ID)
+    """
+    if not settings:
+        return None
+    group = settings.get("group") or default_group
+    with _throttles_lock:
+        throttle = _throttles.get(group)
+        if throttle is None or throttle.settings != settings:
+            # New group, or settings changed on a configuration reload
+            throttle = SourceThrottle(group, settings)
+            _throttles[group] = throttle
+        return throttle
+
+
+def throttled(batches: Iterator[List[Dict[str, Any]]], throttle: Optional[SourceThrottle],
+              result: Optional[Dict[str, Any]] = None, control=None) -> Iterator[List[Dict[str, Any]]]:
+    """Wrap source batches in a throttle, or return them unchanged when there is none."""
+    return throttle.iterate(batches, result, control) if throttle else batches
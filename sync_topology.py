@@ -0,0 +1,677 @@
+"""
+TerraFusion SyncService - Parcel Topology QA
+
+This module checks the parcel fabric a sync loaded and keeps the problems it
+finds as a reviewable issue list. After each sync job that changed a table
+named in the sync pair's "topology_qa" block, the table is read back from the
+target and checked for:
+
+- gaps: a parcel's boundary passing within gap_tolerance of a neighbor's
+  without meeting it (slivers and undershoots between adjacent parcels)
+- overlaps: neighboring parcels sharing more than min_overlap_area
+- duplicates: parcels with the same geometry (whatever their ring start and
+  winding)
+- district crossings: parcels split by a boundary of the county's district
+  layer (plugin_settings.gis_export.districts, see gis_spatial), with more
+  than min_district_area on each side
+
+    "topology_qa": {
+        "tables": {
+            "gis.parcels": {"column": "shape", "gap_tolerance": 0.5, "min_overlap_area": 1.0,
+                            "min_district_area": 10.0, "checks": ["gap", "overlap", "duplicate", "district_crossing"]}
+        }
+    }
+
+The column is the target's geometry column; tolerances and areas are in the
+units of its CRS. Gaps are only looked for when gap_tolerance is set, and
+district crossings only when the county has a district layer.
+
+Each issue names the parcels involved, a measure (the gap width, overlap
+area or smallest split piece) and a location to review it at. Issues are
+keyed by kind and parcels, so a run that finds an issue again updates it:
+OPEN issues that are no longer found are RESOLVED, resolved ones found again
+are reopened, and issues a reviewer marked ACCEPTED (a condominium stack or
+a recorded overlap) stay accepted. Runs can also be started by hand:
+
+    python sync_topology.py check benton_wa_gis --table gis.parcels
+    python sync_topology.py list benton_wa_gis --kind overlap
+"""
+
+import sys
+import math
+import json
+import hashlib
+import logging
+import argparse
+from collections import OrderedDict
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Iterator, Tuple
+
+from sync_store import DocumentStore
+from gis_features import (BOUNDARY, INSIDE, OUTSIDE, ExportLayer, FeatureSpool, crosses_ray, on_edge,
+                          segment_distance)
+from gis_reproject import Reprojector
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collection for topology issues
+TOPOLOGY_ISSUES_COLLECTION = "topology_issues"
+
+# Kinds of issue the checks find
+ISSUE_KINDS = ["gap", "overlap", "duplicate", "district_crossing"]
+
+# Issue statuses; reviewers set OPEN or ACCEPTED, runs set OPEN and RESOLVED
+ISSUE_STATUSES = ["OPEN", "ACCEPTED", "RESOLVED"]
+
+# Coordinate distances below this fraction of the coordinates' magnitude count as touching
+EPSILON_SCALE = 1e-9
+
+# Areas below this fraction of a parcel's area count as none
+RELATIVE_AREA_EPSILON = 1e-6
+
+# Decimal places coordinates are compared to when looking for duplicates
+DUPLICATE_DECIMALS = 6
+
+# Parcel shapes kept decoded while neighboring pairs are compared
+SHAPE_CACHE_SIZE = 4096
+
+Point = Tuple[float, float]
+Edge = Tuple[float, float, float, float]
+
+
+def parse_topology_qa(sync_pair_id: str, definition: Optional[Dict[str, Any]],
+                      table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the topology_qa block of a sync pair and fill in defaults.
+
+    Raises:
+        ValueError: If a setting is invalid or names an unknown table
+    """
+    if not definition:
+        return {}
+    tables = {}
+    for table_name, settings in (definition.get("tables") or {}).items():
+        if table_name not in table_names:
+            raise ValueError(f"Topology QA of sync pair {sync_pair_id} names unknown table {table_name}")
+        if not isinstance(settings, dict):
+            raise ValueError(f"Topology QA settings of {table_name} must be an object")
+        if not isinstance(settings.get("column"), str) or not settings["column"]:
+            raise ValueError(f"Topology QA of {table_name} requires 'column', the geometry column to check")
+        values = {}
+        for name in ("gap_tolerance", "min_overlap_area", "min_district_area"):
+            value = settings.get(name, 0)
+            if isinstance(value, bool) or not isinstance(value, (int, float)) or not math.isfinite(value) or value < 0:
+                raise ValueError(f"Topology QA {name} of {table_name} must be a non-negative number")
+            values[name] = float(value)
+        checks = settings.get("checks")
+        if checks is None:
+            checks = [kind for kind in ISSUE_KINDS if kind != "gap" or values["gap_tolerance"] > 0]
+        if not isinstance(checks, list) or not checks or any(check not in ISSUE_KINDS for check in checks):
+            raise ValueError(f"Topology QA checks of {table_name} must be a list of: {', '.join(ISSUE_KINDS)}")
+        if "gap" in checks and not values["gap_tolerance"]:
+            raise ValueError(f"The gap check of {table_name} needs a gap_tolerance")
+        tables[table_name] = dict(values, column=settings["column"], checks=list(dict.fromkeys(checks)))
+    return {"tables": tables}
+
+
+def _oriented(polygons: List[Any]) -> List[List[List[Point]]]:
+    """Polygons as open rings, exteriors counterclockwise and holes clockwise."""
+    result = []
+    for polygon in polygons:
+        rings = []
+        for index, ring in enumerate(polygon):
+            points = [(float(p[0]), float(p[1])) for p in ring]
+            if len(points) > 1 and points[0] == points[-1]:
+                points.pop()
+            points = [p for i, p in enumerate(points) if p != points[i - 1]] if len(points) > 1 else points
+            if len(points) < 3:
+                continue
+            area = _ring_area(points)
+            if (area < 0) == (index == 0):
+                points.reverse()
+            rings.append(points)
+        if rings:
+            result.append(rings)
+    return result
+
+
+def _ring_area(ring: List[Point]) -> float:
+    """Signed area of an open ring; positive when counterclockwise."""
+    return sum(ring[i - 1][0] * ring[i][1] - ring[i][0] * ring[i - 1][1] for i in range(len(ring))) / 2
+
+
+def fingerprint(polygons: List[Any]) -> str:
+    """
+    A hash of a polygonal geometry that is the same for the same shape
+    whatever its ring starts, winding or part order.
+    """
+    parts = []
+    for rings in _oriented(polygons):
+        normalized = []
+        for ring in rings:
+            ring = [(round(x, DUPLICATE_DECIMALS), round(y, DUPLICATE_DECIMALS)) for x, y in ring]
+            start = ring.index(min(ring))
+            normalized.append(ring[start:] + ring[:start])
+        parts.append([normalized[0]] + sorted(normalized[1:]))
+    return hashlib.sha1(json.dumps(sorted(parts)).encode("utf-8")).hexdigest()
+
+
+class _Shape:
+    """
+    A polygonal geometry prepared for the checks: oriented edges bucketed
+    into horizontal bands, so a test looks only at the edges near its row.
+    """
+
+    def __init__(self, polygons: List[Any]):
+        self.rings = [ring for rings in _oriented(polygons) for ring in rings]
+        self.edges: List[Edge] = [
+            (ring[i][0], ring[i][1], ring[(i + 1) % len(ring)][0], ring[(i + 1) % len(ring)][1])
+            for ring in self.rings for i in range(len(ring))
+        ]
+        self.area = sum(_ring_area(ring) for ring in self.rings)
+        xs = [e[0] for e in self.edges]
+        ys = [e[1] for e in self.edges]
+        self.bounds = (min(xs), min(ys), max(xs), max(ys)) if xs else None
+        self.epsilon = EPSILON_SCALE * max([1.0] + [abs(v) for v in self.bounds or ()])
+        self._count = max(1, int(math.sqrt(len(self.edges))))
+        self._bands: List[List[Edge]] = [[] for _ in range(self._count)]
+        for edge in self.edges:
+            for band in range(self._band(min(edge[1], edge[3])), self._band(max(edge[1], edge[3])) + 1):
+                self._bands[band].append(edge)
+
+    @property
+    def vertices(self) -> Iterator[Point]:
+        for ring in self.rings:
+            yield from ring
+
+    def _band(self, y: float) -> int:
+        low, high = self.bounds[1], self.bounds[3]
+        if high <= low:
+            return 0
+        return min(self._count - 1, max(0, int((y - low) / (high - low) * self._count)))
+
+    def near(self, x1: float, y1: float, x2: float, y2: float) -> Iterator[Edge]:
+        """The edges whose bounding boxes meet a box."""
+        if self.bounds is None:
+            return
+        seen = set()
+        for band in range(self._band(y1), self._band(y2) + 1):
+            for edge in self._bands[band]:
+                if (min(edge[0], edge[2]) <= x2 and max(edge[0], edge[2]) >= x1
+                        and min(edge[1], edge[3]) <= y2 and max(edge[1], edge[3]) >= y1 and edge not in seen):
+                    seen.add(edge)
+                    yield edge
+
+    def locate(self, x: float, y: float, epsilon: float) -> Tuple[int, Optional[Edge]]:
+        """INSIDE, BOUNDARY (with the edge it lies on) or OUTSIDE, by the even-odd rule."""
+        b = self.bounds
+        if b is None or x < b[0] - epsilon or x > b[2] + epsilon or y < b[1] - epsilon or y > b[3] + epsilon:
+            return OUTSIDE, None
+        inside = False
+        for edge in self.near(-math.inf, y - epsilon, math.inf, y + epsilon):
+            x1, y1, x2, y2 = edge
+            if on_edge((x, y), (x1, y1), (x2, y2), epsilon):
+                return BOUNDARY, edge
+            if crosses_ray((x, y), (x1, y1), (x2, y2)):
+                inside = not inside
+        return (INSIDE if inside else OUTSIDE), None
+
+    def distance(self, p: Point, limit: float) -> Optional[Tuple[float, Point]]:
+        """The distance from a point to the boundary and the nearest boundary point, if within limit."""
+        best = None
+        for x1, y1, x2, y2 in self.near(p[0] - limit, p[1] - limit, p[0] + limit, p[1] + limit):
+            dx, dy = x2 - x1, y2 - y1
+            length = dx * dx + dy * dy
+            t = 0.0 if not length else max(0.0, min(1.0, ((p[0] - x1) * dx + (p[1] - y1) * dy) / length))
+            q = (x1 + t * dx, y1 + t * dy)
+            d = math.hypot(p[0] - q[0], p[1] - q[1])
+            if d <= limit and (best is None or d < best[0]):
+                best = (d, q)
+        return best
+
+    def meets_boundary(self, other: "_Shape", epsilon: float) -> bool:
+        """Whether any edge of this shape meets or comes within epsilon of the other's boundary."""
+        for ax, ay, bx, by in self.edges:
+            for cx, cy, dx, dy in other.near(min(ax, bx) - epsilon, min(ay, by) - epsilon,
+                                             max(ax, bx) + epsilon, max(ay, by) + epsilon):
+                if _crossing_params((ax, ay), (bx, by), (cx, cy), (dx, dy), epsilon) or \
+                        segment_distance((ax, ay), (cx, cy), (dx, dy)) <= epsilon:
+                    return True
+        return False
+
+
+def _crossing_params(a: Point, b: Point, c: Point, d: Point, epsilon: float) -> List[float]:
+    """Where segment cd meets ab, as fractions along ab (touches and collinear overlaps included)."""
+    params = []
+    rx, ry = b[0] - a[0], b[1] - a[1]
+    sx, sy = d[0] - c[0], d[1] - c[1]
+    length = math.hypot(rx, ry)
+    if not length:
+        return params
+    denominator = rx * sy - ry * sx
+    if abs(denominator) > epsilon * (length + math.hypot(sx, sy)):
+        t = ((c[0] - a[0]) * sy - (c[1] - a[1]) * sx) / denominator
+        u = ((c[0] - a[0]) * ry - (c[1] - a[1]) * rx) / denominator
+        if 0 <= t <= 1 and 0 <= u <= 1:
+            params.append(t)
+    for p in (c, d):
+        if segment_distance(p, a, b) <= epsilon:
+            params.append(((p[0] - a[0]) * rx + (p[1] - a[1]) * ry) / (length * length))
+    return [min(1.0, max(0.0, t)) for t in params]
+
+
+def intersection(a: _Shape, b: _Shape) -> Tuple[float, Optional[Point]]:
+    """
+    The area two shapes share and its centroid.
+
+    By Green's theorem the shared region's area is the sum, over its
+    boundary, of x dy: the pieces of a's edges inside b, and of b's edges
+    inside a. An edge piece lying on the other shape's boundary counts once
+    when the shapes are on the same side of it, and not at all when they meet
+    there as neighbors, so shared boundaries add nothing.
+    """
+    if a.bounds is None or b.bounds is None:
+        return 0.0, None
+    epsilon = max(a.epsilon, b.epsilon)
+    totals = [0.0, 0.0, 0.0]
+
+    def add(p: Point, q: Point) -> None:
+        cross = p[0] * q[1] - q[0] * p[1]
+        totals[0] += cross
+        totals[1] += (p[0] + q[0]) * cross
+        totals[2] += (p[1] + q[1]) * cross
+
+    for first, second, shared in ((a, b, True), (b, a, False)):
+        sb = second.bounds
+        for ax, ay, bx, by in first.near(sb[0] - epsilon, sb[1] - epsilon, sb[2] + epsilon, sb[3] + epsilon):
+            start, end = (ax, ay), (bx, by)
+            params = {0.0, 1.0}
+            for cx, cy, dx, dy in second.near(min(ax, bx) - epsilon, min(ay, by) - epsilon,
+                                              max(ax, bx) + epsilon, max(ay, by) + epsilon):
+                params.update(_crossing_params(start, end, (cx, cy), (dx, dy), epsilon))
+            params = sorted(params)
+            for t0, t1 in zip(params, params[1:]):
+                if t1 - t0 <= 0:
+                    continue
+                p = (ax + (bx - ax) * t0, ay + (by - ay) * t0)
+                q = (ax + (bx - ax) * t1, ay + (by - ay) * t1)
+                where, edge = second.locate((p[0] + q[0]) / 2, (p[1] + q[1]) / 2, epsilon)
+                if where == INSIDE:
+                    add(p, q)
+                elif where == BOUNDARY and shared and (edge[2] - edge[0]) * (bx - ax) + (edge[3] - edge[1]) * (by - ay) > 0:
+                    add(p, q)
+    area = totals[0] / 2
+    if area <= 0:
+        return 0.0, None
+    return area, (totals[1] / (6 * area), totals[2] / (6 * area))
+
+
+def _grid_pairs(boxes: List[Tuple[float, float, float, float]], pad: float) -> Iterator[Tuple[int, int]]:
+    """Index pairs whose boxes, grown by pad, meet; each pair once."""
+    if len(boxes) < 2:
+        return
+    width = sum(b[2] - b[0] for b in boxes) / len(boxes)
+    height = sum(b[3] - b[1] for b in boxes) / len(boxes)
+    cell = max(width, height, pad, 1e-12) * 2
+    grid: Dict[Tuple[int, int], List[int]] = {}
+    for index, (x1, y1, x2, y2) in enumerate(boxes):
+        for ix in range(int(math.floor((x1 - pad) / cell)), int(math.floor((x2 + pad) / cell)) + 1):
+            for iy in range(int(math.floor((y1 - pad) / cell)), int(math.floor((y2 + pad) / cell)) + 1):
+                grid.setdefault((ix, iy), []).append(index)
+    for (ix, iy), members in grid.items():
+        for n, i in enumerate(members):
+            for j in members[n + 1:]:
+                a, b = boxes[i], boxes[j]
+                if a[0] - pad > b[2] + pad or b[0] - pad > a[2] + pad or a[1] - pad > b[3] + pad or b[1] - pad > a[3] + pad:
+                    continue
+                # Report the pair only in the cell holding the corner where their boxes start to meet
+                corner = (max(a[0], b[0]) - pad, max(a[1], b[1]) - pad)
+                if (int(math.floor(corner[0] / cell)), int(math.floor(corner[1] / cell))) == (ix, iy):
+                    yield (i, j) if i < j else (j, i)
+
+
+class TopologyChecker:
+    """Runs the topology checks of one table over the features read back from its target."""
+
+    def __init__(self, settings: Dict[str, Any], districts: Optional[Dict[str, Tuple[List[Any], Optional[int]]]] = None):
+        """
+        Initialize the checker.
+
+        Args:
+            settings: The table's topology_qa settings
+            districts: District polygons and SRIDs by name, for the district_crossing check
+        """
+        self.settings = settings
+        self.checks = [c for c in settings["checks"] if c != "district_crossing" or districts]
+        self.districts = districts or {}
+        self.stats = {"parcels": 0, "skipped": 0, "pairs_compared": 0}
+        # SRID of the features checked, from the first that has one
+        self.srid: Optional[int] = None
+        self._spool: Optional[FeatureSpool] = None
+        self._offsets: List[int] = []
+        self._cache: "OrderedDict[int, _Shape]" = OrderedDict()
+
+    def run(self, features: Iterator[Dict[str, Any]]) -> List[Dict[str, Any]]:
+        """
+        Check the features of a layer.
+
+        Returns:
+            The issues found, each with kind, record_keys, measure and location
+        """
+        issues = []
+        with FeatureSpool() as spool:
+            self._spool = spool
+            keys, boxes, prints = [], [], []
+            for feature in features:
+                geometry = feature.get("geometry")
+                if not geometry or geometry["type"] not in ("Polygon", "MultiPolygon"):
+                    self.stats["skipped"] += 1
+                    continue
+                polygons = [geometry["coordinates"]] if geometry["type"] == "Polygon" else geometry["coordinates"]
+                shape = _Shape(polygons)
+                if shape.bounds is None or shape.area <= 0:
+                    self.stats["skipped"] += 1
+                    continue
+                self._offsets.append(spool.append(polygons))
+                keys.append(feature["id"])
+                boxes.append(shape.bounds)
+                prints.append(fingerprint(polygons) if "duplicate" in self.checks else None)
+                self.srid = self.srid or feature.get("srid")
+            self.stats["parcels"] = len(keys)
+
+            if "duplicate" in self.checks:
+                groups: Dict[str, List[int]] = {}
+                for index, value in enumerate(prints):
+                    groups.setdefault(value, []).append(index)
+                for members in groups.values():
+                    if len(members) > 1:
+                        shape = self._shape(members[0])
+                        issues.append(self._issue("duplicate", [keys[i] for i in members], shape.area,
+                                                  self._center(shape.bounds)))
+
+            if "gap" in self.checks or "overlap" in self.checks:
+                tolerance = self.settings["gap_tolerance"] if "gap" in self.checks else 0.0
+                for i, j in _grid_pairs(boxes, tolerance / 2):
+                    if prints[i] is not None and prints[i] == prints[j]:
+                        continue
+                    self.stats["pairs_compared"] += 1
+                    a, b = self._shape(i), self._shape(j)
+                    if "overlap" in self.checks:
+                        area, center = intersection(a, b)
+                        if area > max(self.settings["min_overlap_area"], RELATIVE_AREA_EPSILON * min(a.area, b.area)):
+                            issues.append(self._issue("overlap", [keys[i], keys[j]], area, center))
+                    if "gap" in self.checks:
+                        gap = self._gap(a, b, tolerance)
+                        if gap:
+                            issues.append(self._issue("gap", [keys[i], keys[j]], gap[0], gap[1]))
+
+            if "district_crossing" in self.checks:
+                issues.extend(self._district_crossings(keys, boxes, self.srid))
+        self._spool = None
+        self._cache.clear()
+        return sorted(issues, key=lambda issue: (ISSUE_KINDS.index(issue["kind"]), issue["record_keys"]))
+
+    def _shape(self, index: int) -> _Shape:
+        shape = self._cache.get(index)
+        if shape is None:
+            shape = _Shape(self._spool.read(self._offsets[index]))
+            self._cache[index] = shape
+            if len(self._cache) > SHAPE_CACHE_SIZE:
+                self._cache.popitem(last=False)
+        else:
+            self._cache.move_to_end(index)
+        return shape
+
+    @staticmethod
+    def _gap(a: _Shape, b: _Shape, tolerance: float) -> Optional[Tuple[float, Point]]:
+        """
+        The widest point, within tolerance, where either boundary passes near
+        the other without meeting it and the space between is in neither
+        parcel (an edge running on past a neighbor's corner is no gap).
+        """
+        epsilon = max(a.epsilon, b.epsilon)
+        widest = None
+        for first, second in ((a, b), (b, a)):
+            sb = second.bounds
+            for p in first.vertices:
+                if not (sb[0] - tolerance <= p[0] <= sb[2] + tolerance and sb[1] - tolerance <= p[1] <= sb[3] + tolerance):
+                    continue
+                nearest = second.distance(p, tolerance)
+                if nearest is None or nearest[0] <= epsilon or (widest is not None and nearest[0] <= widest[0]):
+                    continue
+                middle = ((p[0] + nearest[1][0]) / 2, (p[1] + nearest[1][1]) / 2)
+                if second.locate(p[0], p[1], epsilon)[0] != OUTSIDE or \
+                        first.locate(middle[0], middle[1], epsilon)[0] != OUTSIDE or \
+                        second.locate(middle[0], middle[1], epsilon)[0] != OUTSIDE:
+                    continue
+                widest = (nearest[0], middle)
+        return widest
+
+    def _district_crossings(self, keys: List[str], boxes: List[Tuple[float, float, float, float]],
+                            srid: Optional[int]) -> List[Dict[str, Any]]:
+        shapes = {}
+        for name, (polygons, district_srid) in self.districts.items():
+            if srid and district_srid and district_srid != srid:
+                reprojected = Reprojector(srid).feature({"geometry": {"type": "MultiPolygon", "coordinates": polygons},
+                                                         "srid": district_srid})
+                polygons = reprojected["geometry"]["coordinates"]
+            shape = _Shape(polygons)
+            if shape.bounds is not None:
+                shapes[name] = shape
+        minimum = self.settings["min_district_area"]
+        issues = []
+        for index, box in enumerate(boxes):
+            parcel = None
+            pieces = []
+            for name, district in shapes.items():
+                db = district.bounds
+                if box[0] > db[2] or db[0] > box[2] or box[1] > db[3] or db[1] > box[3]:
+                    continue
+                parcel = parcel or self._shape(index)
+                epsilon = max(parcel.epsilon, district.epsilon)
+                if not parcel.meets_boundary(district, epsilon):
+                    continue
+                area, center = intersection(parcel, district)
+                floor = max(minimum, RELATIVE_AREA_EPSILON * parcel.area)
+                if area > floor and parcel.area - area > floor:
+                    pieces.append((name, area, center))
+            if not pieces:
+                continue
+            # Review at the smallest piece: the part inside a district, or the part left outside it
+            name, area, center = min(pieces, key=lambda piece: min(piece[1], parcel.area - piece[1]))
+            if parcel.area - area < area:
+                _, whole = intersection(parcel, parcel)
+                rest = parcel.area - area
+                center = ((whole[0] * parcel.area - center[0] * area) / rest, (whole[1] * parcel.area - center[1] * area) / rest)
+            issue = self._issue("district_crossing", [keys[index]], min(area, parcel.area - area), center)
+            issue["districts"] = [{"name": n, "area": round(a, 6), "share": round(a / parcel.area, 6)}
+                                  for n, a, _ in sorted(pieces)]
+            issues.append(issue)
+        return issues
+
+    @staticmethod
+    def _center(bounds: Tuple[float, float, float, float]) -> Point:
+        return (bounds[0] + bounds[2]) / 2, (bounds[1] + bounds[3]) / 2
+
+    @staticmethod
+    def _issue(kind: str, keys: List[str], measure: float, location: Optional[Point]) -> Dict[str, Any]:
+        return {
+            "kind": kind,
+            "record_keys": sorted(keys),
+            "measure": round(measure, 6),
+            "location": [round(location[0], 6), round(location[1], 6)] if location else None,
+        }
+
+
+class TopologyIssueStore:
+    """Persists the issues topology QA finds and their review status."""
+
+    def __init__(self, store: DocumentStore):
+        """
+        Initialize the issue store.
+
+        Args:
+            store: Document store for persistence
+        """
+        self.store = store
+
+    def record_run(self, sync_pair_id: str, table_name: str, issues: List[Dict[str, Any]],
+                   job_id: Optional[str] = None, srid: Optional[int] = None) -> Dict[str, Any]:
+        """
+        Save the issues of a QA run over a table, reopening or resolving earlier ones.
+
+        Returns:
+            Summary with the issues found by kind and the new, reopened,
+            resolved, open and accepted counts
+        """
+        now = datetime.utcnow().isoformat()
+        existing = {issue["issue_id"]: issue for issue in self.list(sync_pair_id, table_name, limit=1_000_000)}
+        summary = {"found": {kind: 0 for kind in ISSUE_KINDS}, "new": 0, "reopened": 0, "resolved": 0}
+        found = set()
+        for issue in issues:
+            issue_id = self._issue_id(sync_pair_id, table_name, issue)
+            found.add(issue_id)
+            summary["found"][issue["kind"]] += 1
+            document = existing.get(issue_id)
+            if document is None:
+                document = {
+                    "issue_id": issue_id,
+                    "sync_pair_id": sync_pair_id,
+                    "table": table_name,
+                    "status": "OPEN",
+                    "first_found_at": now,
+                }
+                summary["new"] += 1
+            elif document["status"] == "RESOLVED":
+                document["status"] = "OPEN"
+                document.pop("resolved_at", None)
+                summary["reopened"] += 1
+            document.update(issue)
+            document.update({"srid": srid, "job_id": job_id, "last_found_at": now})
+            self.store.save(TOPOLOGY_ISSUES_COLLECTION, issue_id, document)
+        for issue_id, document in existing.items():
+            if issue_id in found or document["status"] == "RESOLVED":
+                continue
+            document.update({"status": "RESOLVED", "resolved_at": now, "note": f"No longer found by job {job_id}" if job_id else "No longer found"})
+            self.store.save(TOPOLOGY_ISSUES_COLLECTION, issue_id, document)
+            summary["resolved"] += 1
+        current = self.list(sync_pair_id, table_name, limit=1_000_000)
+        summary["open"] = sum(1 for issue in current if issue["status"] == "OPEN")
+        summary["accepted"] = sum(1 for issue in current if issue["status"] == "ACCEPTED")
+        return summary
+
+    def get(self, issue_id: str) -> Dict[str, Any]:
+        """
+        Get an issue.
+
+        Raises:
+            FileNotFoundError: If the issue does not exist
+        """
+        try:
+            return self.store.load(TOPOLOGY_ISSUES_COLLECTION, issue_id)
+        except FileNotFoundError:
+            raise FileNotFoundError(f"Topology issue {issue_id} not found")
+
+    def list(self,
+             sync_pair_id: Optional[str] = None,
+             table_name: Optional[str] = None,
+             kind: Optional[str] = None,
+             status: Optional[str] = None,
+             limit: int = 100) -> List[Dict[str, Any]]:
+        """List issues with optional filtering, largest measure first within each kind."""
+        issues = []
+        for issue in self.store.list(TOPOLOGY_ISSUES_COLLECTION):
+            if sync_pair_id and issue.get("sync_pair_id") != sync_pair_id:
+                continue
+            if table_name and issue.get("table") != table_name:
+                continue
+            if kind and issue.get("kind") != kind:
+                continue
+            if status and issue.get("status") != status:
+                continue
+            issues.append(issue)
+        issues.sort(key=lambda i: (ISSUE_KINDS.index(i["kind"]) if i.get("kind") in ISSUE_KINDS else len(ISSUE_KINDS),
+                                   -(i.get("measure") or 0)))
+        return issues[:limit]
+
+    def review(self, issue_id: str, status: str, username: str, note: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Set the review status of an issue: ACCEPTED to keep it off the open
+        list, or OPEN to put it back.
+
+        Raises:
+            FileNotFoundError: If the issue does not exist
+            ValueError: If the status is not one a reviewer can set
+        """
+        if status not in ("OPEN", "ACCEPTED"):
+            raise ValueError(f"Unsupported review status: {status}. Reviewers can set OPEN or ACCEPTED")
+        issue = self.get(issue_id)
+        issue.update({"status": status, "reviewed_by": username, "reviewed_at": datetime.utcnow().isoformat()})
+        if note:
+            issue["note"] = note
+        self.store.save(TOPOLOGY_ISSUES_COLLECTION, issue_id, issue)
+        return issue
+
+    @staticmethod
+    def geojson(issues: List[Dict[str, Any]]) -> Dict[str, Any]:
+        """Issues as a GeoJSON FeatureCollection of review points, for loading into a GIS."""
+        return {
+            "type": "FeatureCollection",
+            "features": [
+                {
+                    "type": "Feature",
+                    "id": issue["issue_id"],
+                    "geometry": {"type": "Point", "coordinates": issue["location"]} if issue.get("location") else None,
+                    "properties": {k: v for k, v in issue.items() if k != "location"},
+                }
+                for issue in issues
+            ],
+        }
+
+    @staticmethod
+    def _issue_id(sync_pair_id: str, table_name: str, issue: Dict[str, Any]) -> str:
+        identity = [issue["kind"], issue["record_keys"]]
+        digest = hashlib.sha1(json.dumps(identity).encode("utf-8")).hexdigest()[:20]
+        return f"{sync_pair_id}__{table_name}__{digest}"
+
+
+def qa_layer(sync_pair_id: str, table_name: str, settings: Dict[str, Any]) -> ExportLayer:
+    """The layer a table's topology QA reads back from the sync pair's target."""
+    return ExportLayer(f"{table_name} topology", {
+        "sync_pair_id": sync_pair_id,
+        "table": table_name,
+        "geometry_field": settings["column"],
+    })
+
+
+def main():
+    """Command-line entry point for running topology QA and listing its issues."""
+    parser = argparse.ArgumentParser(description="TerraFusion SyncService Parcel Topology QA")
+    subparsers = parser.add_subparsers(dest="command", required=True)
+    for command in ("check", "list"):
+        sub = subparsers.add_parser(command)
+        sub.add_argument('sync_pair_id', help="Sync pair")
+        sub.add_argument('--table', help="Limit to one table")
+        if command == "list":
+            sub.add_argument('--kind', choices=ISSUE_KINDS, help="Issue kind")
+            sub.add_argument('--status', default="OPEN", help="Issue status")
+
+    args = parser.parse_args()
+
+    # Imported here because the engine itself uses this module
+    from sync_engine import sync_engine
+
+    if args.command == "list":
+        for issue in sync_engine.topology_issues.list(args.sync_pair_id, args.table, args.kind, args.status, limit=1_000_000):
+            print(f"{issue['issue_id']}  {issue['kind']}  {', '.join(issue['record_keys'])}  "
+                  f"measure={issue['measure']}  at={issue.get('location')}")
+        return 0
+
+    print(json.dumps(sync_engine.run_topology_qa(args.sync_pair_id, args.table), indent=2))
+    return 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,282 @@
+"""
+TerraFusion SyncService - Validation Rules and Quarantine
+
+This module provides per-table data validation for sync pairs. Rules are
+checked against each record as it would be loaded (after hooks and field
+mappings, so rules use target column names); records that break a rule are
+written to a quarantine table in the target database with the reasons,
+instead of to the target table:
+
+    "validation": {
+        "quarantine_table": "sync_quarantine",
+        "rules": {
+            "dbo.property": [
+                {"type": "required", "fields": ["parcel_number", "property_type"]},
+                {"type": "range", "field": "acres", "min": 0, "max": 50000},
+                {"type": "pattern", "field": "parcel_number", "pattern": "[0-9]{15}"},
+                {"type": "allowed_values", "field": "property_type", "values": ["R", "P", "MH", "MN"]},
+                {"type": "expression", "expression": "land_value >= 0 or land_value is null",
+                 "message": "Negative land value"}
+            ],
+            "dbo.situs": [
+                {"id": "situs_street_segment", "type": "reference", "fields": ["street_segment_id"],
+                 "references": {"table": "dbo.street_segment", "fields": ["segment_id"]},
+                 "message": "Situs address must reference a valid street segment"}
+            ]
+        }
+    }
+
+Reference rules look the values up in the target table of another table of
+the same sync pair (list it in depends_on so it syncs first). Null values
+pass every rule except "required". A rule with "severity": "warning" only
+counts its failures in the table result.
+
+A quarantined record leaves quarantine when a later sync loads it; records
+that failed because of something else, such as a street segment that had not
+been loaded yet, can be re-checked without waiting for a source change.
+"""
+
+import re
+import json
+import logging
+from decimal import Decimal, InvalidOperation
+from typing import Dict, List, Any, Optional, Tuple
+
+from sync_connectors import OPERATION_FIELD
+from sync_filters import FilterExpression
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Supported rule types
+RULE_TYPES = ["required", "range", "pattern", "allowed_values", "expression", "reference"]
+
+RULE_SEVERITIES = ["error", "warning"]
+
+# Quarantine table created in the target schema when none is configured
+DEFAULT_QUARANTINE_TABLE = "sync_quarantine"
+
+# Stage recorded on records rejected by a validation rule
+STAGE_QUARANTINE = "quarantine"
+
+# Referenced values remembered per reference rule during a run
+REFERENCE_CACHE_LIMIT = 100_000
+
+
+def _number(value: Any) -> Optional[Decimal]:
+    if isinstance(value, bool):
+        return None
+    try:
+        return Decimal(str(value).strip())
+    except InvalidOperation:
+        return None
+
+
+def _values_key(values: List[Any]) -> str:
+    """Compare referenced values as text, so 12 matches a numeric(10) 12."""
+    return json.dumps([str(v).strip() for v in values])
+
+
+def _rule_fields(rule: Dict[str, Any]) -> List[str]:
+    fields = rule.get("fields") or ([rule["field"]] if rule.get("field") else [])
+    return [fields] if isinstance(fields, str) else list(fields)
+
+
+def parse_validation(sync_pair_id: str, definition: Optional[Dict[str, Any]],
+                     table_names: List[str]) -> Dict[str, Any]:
+    """
+    Validate the validation block of a sync pair and fill in defaults.
+
+    Raises:
+        ValueError: If a rule is incomplete, has an unknown type or names an unknown table
+    """
+    if not definition:
+        return {}
+    validation = {
+        "quarantine_table": definition.get("quarantine_table") or DEFAULT_QUARANTINE_TABLE,
+        "rules": {},
+    }
+    for table_name, rules in (definition.get("rules") or {}).items():
+        if table_name not in table_names:
+            raise ValueError(f"Validation rules of sync pair {sync_pair_id} name unknown table {table_name}")
+        parsed = []
+        for rule in rules:
+            rule = dict(rule)
+            rule_type = rule.get("type")
+            if rule_type not in RULE_TYPES:
+                raise ValueError(f"Unsupported validation rule type: {rule_type}. Supported types: {', '.join(RULE_TYPES)}")
+            rule.setdefault("severity", "error")
+            if rule["severity"] not in RULE_SEVERITIES:
+                raise ValueError(f"Unsupported rule severity: {rule['severity']}. Supported severities: {', '.join(RULE_SEVERITIES)}")
+            fields = _rule_fields(rule)
+            if rule_type != "expression" and not fields:
+                raise ValueError(f"{rule_type} rule for {table_name} requires 'field' or 'fields'")
+            if rule_type == "range" and rule.get("min") is None and rule.get("max") is None:
+                raise ValueError(f"range rule for {table_name} requires 'min' or 'max'")
+            if rule_type == "pattern":
+                if not rule.get("pattern"):
+                    raise ValueError(f"pattern rule for {table_name} requires 'pattern'")
+                try:
+                    re.compile(rule["pattern"])
+                except re.error as e:
+                    raise ValueError(f"Invalid pattern in rule for {table_name}: {e}")
+            if rule_type == "allowed_values" and not isinstance(rule.get("values"), list):
+                raise ValueError(f"allowed_values rule for {table_name} requires a 'values' list")
+            if rule_type == "expression":
+                if not rule.get("expression"):
+                    raise ValueError(f"expression rule for {table_name} requires 'expression'")
+                FilterExpression(rule["expression"])
+            if rule_type == "reference":
+                references = rule.get("references") or {}
+                if references.get("table") not in table_names:
+                    raise ValueError(f"reference rule for {table_name} must reference a table of the sync pair")
+                referenced_fields = references.get("fields") or references.get("field")
+                referenced_fields = [referenced_fields] if isinstance(referenced_fields, str) else list(referenced_fields or [])
+                if len(referenced_fields) != len(fields):
+                    raise ValueError(f"reference rule for {table_name} needs one referenced field per field")
+                rule["references"] = {"table": references["table"], "fields": referenced_fields}
+            rule["fields"] = fields
+            rule.pop("field", None)
+            rule.setdefault("id", f"{rule_type}:{','.join(fields) if fields else len(parsed) + 1}")
+            parsed.append(rule)
+        validation["rules"][table_name] = parsed
+    return validation
+
+
+class RecordValidator:
+    """Checks the validation rules of one table against batches of records."""
+
+    def __init__(self, table_name: str, rules: List[Dict[str, Any]], quarantine_table: str,
+                 reference_tables: Optional[Dict[str, Dict[str, Any]]] = None):
+        """
+        Initialize the validator.
+
+        Args:
+            table_name: Source table name
+            rules: Rules from parse_validation
+            quarantine_table: Quarantine table in the target database
+            reference_tables: Target table definitions of referenced tables, by source table name
+        """
+        self.table_name = table_name
+        self.rules = rules
+        self.quarantine_table = quarantine_table
+        self.reference_tables = reference_tables or {}
+        self.target = None
+        self._expressions = {
+            rule["id"]: FilterExpression(rule["expression"]) for rule in rules if rule["type"] == "expression"
+        }
+        self._known_references: Dict[str, set] = {}
+
+    def bind(self, target) -> "RecordValidator":
+        """Use a target connection for reference lookups."""
+        self.target = target
+        return self
+
+    def check(self, records: List[Dict[str, Any]], result: Optional[Dict[str, Any]] = None) -> Dict[int, List[Dict[str, Any]]]:
+        """
+        Check a batch of records.
+
+        Warnings are counted in result["validation_warnings"] by rule.
+
+        Returns:
+            Failed error-severity rules by record position, as {"rule", "field", "message"}
+        """
+        failures: Dict[int, List[Dict[str, Any]]] = {}
+        upserts = [(i, r) for i, r in enumerate(records) if r.get(OPERATION_FIELD) != "delete"]
+        for rule in self.rules:
+            if rule["type"] == "reference":
+                failed = self._check_references(rule, upserts)
+            else:
+                failed = [(i, message) for i, record in upserts for message in self._check(rule, record)]
+            for position, message in failed:
+                if rule["severity"] == "warning":
+                    if result is not None:
+                        warnings = result.setdefault("validation_warnings", {})
+                        warnings[rule["id"]] = warnings.get(rule["id"], 0) + 1
+                    continue
+                failures.setdefault(position, []).append({
+                    "rule": rule["id"],
+                    "field": ", ".join(rule["fields"]) or None,
+                    "message": rule.get("message") or message,
+                })
+        return failures
+
+    def _check(self, rule: Dict[str, Any], record: Dict[str, Any]) -> List[str]:
+        rule_type = rule["type"]
+        if rule_type == "required":
+            return [f"Missing required field: {f}" for f in rule["fields"] if record.get(f) in (None, "")]
+        if rule_type == "expression":
+            if self._expressions[rule["id"]].matches(record):
+                return []
+            return [f"Record does not satisfy: {rule['expression']}"]
+
+        messages = []
+        for field_name in rule["fields"]:
+            value = record.get(field_name)
+            if value is None:
+                continue
+            if rule_type == "range":
+                number = _number(value)
+                if number is None:
+                    messages.append(f"{field_name} is not a number: {value!r}")
+                elif rule.get("min") is not None and number < Decimal(str(rule["min"])):
+                    messages.append(f"{field_name} {value} is below the minimum {rule['min']}")
+                elif rule.get("max") is not None and number > Decimal(str(rule["max"])):
+                    messages.append(f"{field_name} {value} is above the maximum {rule['max']}")
+            elif rule_type == "pattern":
+                if not re.fullmatch(rule["pattern"], str(value)):
+                    messages.append(f"{field_name} {value!r} does not match {rule['pattern']}")
+            elif rule_type == "allowed_values":
+                if value not in rule["values"] and str(value) not in [str(v) for v in rule["values"]]:
+                    messages.append(f"{field_name} {value!r} is not an allowed value")
+        return messages
+
+    def _check_references(self, rule: Dict[str, Any], upserts: List[Tuple[int, Dict[str, Any]]]) -> List[Tuple[int, str]]:
+        """Look up referenced values in the target, remembering the ones found."""
+        referenced = rule["references"]
+        known = self._known_references.setdefault(rule["id"], set())
+        wanted, missing_keys = {}, set()
+        for position, record in upserts:
+            values = [record.get(f) for f in rule["fields"]]
+            if any(v is None for v in values):
+                continue
+            key = _values_key(values)
+            wanted.setdefault(key, (values, []))[1].append(position)
+
+        lookup = [values for key, (values, _) in wanted.items() if key not in known]
+        if lookup:
+            table = dict(self.reference_tables[referenced["table"]], primary_key=referenced["fields"])
+            rows = self.target.fetch_records(table, lookup)
+            found = {_values_key([row.get(f) for f in referenced["fields"]]) for row in rows}
+            if len(known) + len(found) > REFERENCE_CACHE_LIMIT:
+                known.clear()
+            known.update(found)
+            missing_keys = {key for key, (values, _) in wanted.items() if key not in known}
+
+        failed = []
+        for key in missing_keys:
+            values, positions = wanted[key]
+            description = ", ".join(f"{f}={v!r}" for f, v in zip(rule["fields"], values))
+            failed.extend((position, f"{description} has no match in {referenced['table']}") for position in positions)
+        return failed
+
+
+def build_validator(validation: Dict[str, Any], table_name: str,
+                    target_tables: Dict[str, Dict[str, Any]]) -> Optional[RecordValidator]:
+    """
+    Build the validator for a table, or None when it has no rules.
+
+    Args:
+        validation: Settings from parse_validation
+        table_name: Source table name
+        target_tables: Target table definitions of the sync pair's tables, by source table name
+    """
+    rules = (validation.get("rules") or {}).get(table_name)
+    if not rules:
+        return None
+    references = {
+        rule["references"]["table"]: target_tables[rule["references"]["table"]]
+        for rule in rules if rule["type"] == "reference"
+    }
+    return RecordValidator(table_name, rules, validation["quarantine_table"], references)
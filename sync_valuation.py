@@ -0,0 +1,314 @@
+"""
+TerraFusion SyncService - Valuation Model Comparison
+
+This module compares the values valuation models predict for parcels with
+the parcels' current assessed values, so appraisers can review the parcels
+a model run disagrees with. Model outputs are pushed (see sync_ingest) into
+the staging tables of the valuation_models entity module (see
+sync_entities): a record per run in model_runs, with the model, its
+version, the tax year it values and when it ran, and a record per parcel
+in model_values:
+
+    POST /api/v1/sync/pairs/benton_wa_pacs_staging/tables/model_runs/records
+    {"run_id": "avm-2026-03", "model_name": "residential_avm", "model_version": "4.2", "tax_year": 2026}
+
+    POST /api/v1/sync/pairs/benton_wa_pacs_staging/tables/model_values/records
+    {"run_id": "avm-2026-03", "prop_id": 1001, "predicted_value": 412000}
+
+The module's block names the table of assessed values and the tolerances
+differences are flagged by:
+
+    "valuation_models": {
+        "parcels": {"table": "dbo.property", "fields": ["prop_id"]},
+        "assessed_values": {"table": "dbo.property_val", "key_field": "prop_id",
+                            "year_field": "prop_val_yr", "value_field": "assessed_val"},
+        "tolerances": [
+            {"flag": "review", "percent": 10},
+            {"flag": "priority_review", "percent": 25, "amount": 50000}
+        ]
+    }
+
+A tolerance is exceeded by a predicted value that differs from the assessed
+value of the run's tax year by more than its percent of the assessed value
+and by more than its amount (each where given). Tolerances go from least
+to most severe, and a parcel takes the flag of the last one it exceeds;
+parcels without an assessed value in the year are flagged
+no_assessed_value. A values table versioned by roll year (see roll_years)
+is read as it stood in the run's year.
+"""
+
+import logging
+from datetime import date, datetime
+from decimal import Decimal, InvalidOperation
+from statistics import median
+from typing import Dict, List, Any, Optional, Iterator, Tuple
+
+from sync_connectors import keyset_after, create_connector
+from sync_hooks import build_pipeline
+from pagination import Page, CursorError, encode_cursor, decode_cursor, scope_of, DEFAULT_PAGE_SIZE, MAX_PAGE_SIZE
+from roll_years import RollYearManager, roll_years
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Flag of parcels that have no assessed value in the run's tax year
+NO_ASSESSED_VALUE = "no_assessed_value"
+
+# Flag filter matching every flagged parcel
+ANY_FLAG = "any"
+
+# Tolerances of a module block that lists none
+DEFAULT_TOLERANCES = [{"flag": "review", "percent": 10}]
+
+# Model values whose assessed values are looked up at a time
+VALUES_PER_LOOKUP = 500
+
+
+def parse_tolerances(label: str, definition: Any) -> List[Dict[str, Any]]:
+    """
+    Validate the tolerances of a valuation_models block.
+
+    Raises:
+        ValueError: If a tolerance is invalid
+    """
+    if definition is None:
+        return [dict(t) for t in DEFAULT_TOLERANCES]
+    if not isinstance(definition, list) or not definition:
+        raise ValueError(f"{label}.tolerances must be a list of tolerances")
+    tolerances = []
+    for tolerance in definition:
+        if not isinstance(tolerance, dict) or not isinstance(tolerance.get("flag"), str) or not tolerance["flag"]:
+            raise ValueError(f"{label}.tolerances must each name a flag")
+        flag = tolerance["flag"]
+        if flag in (NO_ASSESSED_VALUE, ANY_FLAG) or flag in [t["flag"] for t in tolerances]:
+            raise ValueError(f"{label}.tolerances: flag {flag} is reserved or used twice")
+        unknown = [name for name in tolerance if name not in ("flag", "percent", "amount")]
+        if unknown:
+            raise ValueError(f"{label}.tolerances.{flag}: unknown settings {', '.join(unknown)}")
+        if tolerance.get("percent") is None and tolerance.get("amount") is None:
+            raise ValueError(f"{label}.tolerances.{flag} needs a percent, an amount or both")
+        for name in ("percent", "amount"):
+            value = tolerance.get(name)
+            if value is not None and (isinstance(value, bool) or not isinstance(value, (int, float)) or value < 0):
+                raise ValueError(f"{label}.tolerances.{flag}.{name} must be a non-negative number")
+        tolerances.append({"flag": flag, "percent": tolerance.get("percent"), "amount": tolerance.get("amount")})
+    return tolerances
+
+
+def _decimal(value: Any) -> Optional[Decimal]:
+    if isinstance(value, bool) or value is None:
+        return None
+    try:
+        return Decimal(str(value).strip().replace(",", ""))
+    except InvalidOperation:
+        return None
+
+
+def _key(value: Any) -> str:
+    """A parcel key as text, so keys of numeric and text columns match."""
+    if isinstance(value, float) and value.is_integer():
+        value = int(value)
+    return str(value).strip()
+
+
+def _number(value: Optional[Decimal], places: int = 2) -> Optional[float]:
+    return float(round(value, places)) if value is not None else None
+
+
+def _json_row(row: Dict[str, Any]) -> Dict[str, Any]:
+    """A stored row with its dates as ISO text and decimals as numbers."""
+    converted = {}
+    for column, value in row.items():
+        if isinstance(value, (date, datetime)):
+            value = value.isoformat()
+        elif isinstance(value, Decimal):
+            value = float(value)
+        converted[column] = value
+    return converted
+
+
+def tolerance_flag(predicted: Optional[Decimal], assessed: Optional[Decimal],
+                   tolerances: List[Dict[str, Any]]) -> Optional[str]:
+    """The flag of a parcel's difference: the last tolerance it exceeds, or None within them all."""
+    if assessed is None:
+        return NO_ASSESSED_VALUE
+    difference = abs(predicted - assessed)
+    flag = None
+    for tolerance in tolerances:
+        if tolerance["amount"] is not None and difference <= Decimal(str(tolerance["amount"])):
+            continue
+        if tolerance["percent"] is not None and difference <= abs(assessed) * Decimal(str(tolerance["percent"])) / 100:
+            continue
+        flag = tolerance["flag"]
+    return flag
+
+
+def compare_value(row: Dict[str, Any], assessed: Optional[Decimal], tolerances: List[Dict[str, Any]]) -> Dict[str, Any]:
+    """The comparison of one model value with its parcel's assessed value."""
+    predicted = _decimal(row.get("predicted_value"))
+    difference = predicted - assessed if predicted is not None and assessed is not None else None
+    return {
+        "prop_id": row.get("prop_id"),
+        "predicted_value": _number(predicted),
+        "prediction_low": _number(_decimal(row.get("prediction_low"))),
+        "prediction_high": _number(_decimal(row.get("prediction_high"))),
+        "assessed_value": _number(assessed),
+        "difference": _number(difference),
+        "difference_percent": _number(difference / assessed * 100) if difference is not None and assessed else None,
+        "ratio": _number(predicted / assessed, 4) if difference is not None and assessed else None,
+        "flag": tolerance_flag(predicted, assessed, tolerances) if predicted is not None else None,
+    }
+
+
+class ValuationComparisonService:
+    """Lists valuation model runs and compares their values with assessed values."""
+
+    def __init__(self, registry, years: RollYearManager = roll_years):
+        self.registry = registry
+        self.years = years
+
+    def list_runs(self, sync_pair_id: str) -> List[Dict[str, Any]]:
+        """
+        The model runs pushed to a sync pair.
+
+        Raises:
+            KeyError: If the sync pair is not configured or has no valuation_models module
+            ConnectorError: If the target cannot be read
+        """
+        pair, settings = self._settings(sync_pair_id)
+        with create_connector(pair.target) as target:
+            rows = target.query_records(self._table_def(pair, settings["tables"]["model_runs"]["table"]))
+        return [dict(_json_row(row), sync_pair_id=sync_pair_id) for row in rows]
+
+    def get_run(self, sync_pair_id: str, run_id: str) -> Dict[str, Any]:
+        """
+        A model run with a summary of its comparison: the parcels it values,
+        how many take each flag and the median ratio of predicted to assessed value.
+
+        Raises:
+            KeyError: If the sync pair, its valuation_models module or the run is not found
+            ValueError: If the values table has no roll for the run's tax year
+            ConnectorError: If the target cannot be read
+        """
+        pair, settings = self._settings(sync_pair_id)
+        flags = {t["flag"]: 0 for t in settings["tolerances"]}
+        flags[NO_ASSESSED_VALUE] = 0
+        summary = {"parcels": 0, "within_tolerance": 0, "flags": flags}
+        ratios = []
+        with create_connector(pair.target) as target:
+            run = self._run(pair, settings, target, run_id)
+            for compared in self._compared(pair, settings, target, run):
+                summary["parcels"] += 1
+                if compared["flag"] is None:
+                    summary["within_tolerance"] += 1
+                else:
+                    flags[compared["flag"]] += 1
+                if compared["ratio"] is not None:
+                    ratios.append(compared["ratio"])
+        summary["median_ratio"] = round(median(ratios), 4) if ratios else None
+        return dict(_json_row(run), sync_pair_id=sync_pair_id, tolerances=settings["tolerances"], summary=summary)
+
+    def compare(self, sync_pair_id: str, run_id: str, flag: Optional[str] = None,
+                limit: int = DEFAULT_PAGE_SIZE, cursor: Optional[str] = None) -> Tuple[Dict[str, Any], Page]:
+        """
+        A page of a model run's comparison, in parcel order.
+
+        Args:
+            sync_pair_id: Sync pair the run was pushed to
+            run_id: Model run
+            flag: Only parcels with this flag ("any" for every flagged parcel)
+            limit: Page size
+            cursor: Cursor of the previous page
+
+        Returns:
+            The run, and the page of parcel comparisons
+
+        Raises:
+            KeyError: If the sync pair, its valuation_models module or the run is not found
+            ValueError: If the flag or cursor is invalid, or the values table has no roll for the run's tax year
+            ConnectorError: If the target cannot be read
+        """
+        pair, settings = self._settings(sync_pair_id)
+        flags = [t["flag"] for t in settings["tolerances"]] + [NO_ASSESSED_VALUE, ANY_FLAG]
+        if flag is not None and flag not in flags:
+            raise ValueError(f"Unknown flag {flag}. Flags: {', '.join(flags)}")
+        limit = min(limit, MAX_PAGE_SIZE)
+        scope = scope_of("valuation_comparison", {"sync_pair_id": sync_pair_id, "run_id": run_id, "flag": flag or ""})
+        after = None
+        if cursor:
+            after = decode_cursor(cursor, scope).get("after")
+            if after is None:
+                raise CursorError("Invalid cursor")
+
+        items = []
+        with create_connector(pair.target) as target:
+            run = self._run(pair, settings, target, run_id)
+            for compared in self._compared(pair, settings, target, run, after):
+                if not self._selects(flag, compared):
+                    continue
+                items.append(compared)
+                if len(items) > limit:
+                    break
+        more = len(items) > limit
+        items = items[:limit]
+        next_cursor = encode_cursor({"after": items[-1]["prop_id"]}, scope) if more else None
+        return dict(_json_row(run), sync_pair_id=sync_pair_id, tolerances=settings["tolerances"]), Page(items, next_cursor)
+
+    # Helpers ----------------------------------------------------------------
+
+    def _settings(self, sync_pair_id: str):
+        pair = self.registry.get(sync_pair_id)
+        settings = pair.entities.get("valuation_models")
+        if not settings:
+            raise KeyError(f"Sync pair {sync_pair_id} has no valuation_models entity module")
+        return pair, settings
+
+    @staticmethod
+    def _table_def(pair, name: str) -> Dict[str, Any]:
+        return build_pipeline(pair.hooks, name).target_table(pair.get_table(name).to_dict())
+
+    @staticmethod
+    def _selects(flag: Optional[str], compared: Dict[str, Any]) -> bool:
+        if flag is None:
+            return True
+        return compared["flag"] is not None if flag == ANY_FLAG else compared["flag"] == flag
+
+    def _run(self, pair, settings: Dict[str, Any], target, run_id: str) -> Dict[str, Any]:
+        runs = self._table_def(pair, settings["tables"]["model_runs"]["table"])
+        rows = target.query_records(runs, ("compare", "=", ("field", "run_id"), ("literal", run_id)), limit=1)
+        if not rows:
+            raise KeyError(f"Model run {run_id} not found in sync pair {pair.sync_pair_id}")
+        return rows[0]
+
+    def _compared(self, pair, settings: Dict[str, Any], target, run: Dict[str, Any],
+                  after: Any = None) -> Iterator[Dict[str, Any]]:
+        """The comparisons of a run's model values after a parcel, read VALUES_PER_LOOKUP at a time."""
+        values = self._table_def(pair, settings["tables"]["model_values"]["table"])
+        assessed_values = settings["assessed_values"]
+        assessed_def = self._table_def(pair, assessed_values["table"])
+        if pair.roll_years and assessed_values["table"] in pair.roll_years["tables"]:
+            assessed_def = self.years.table_def(pair, assessed_def, run.get("tax_year"))
+        key_field, value_field, year_field = (assessed_values["key_field"], assessed_values["value_field"],
+                                              assessed_values["year_field"])
+        in_run = ("compare", "=", ("field", "run_id"), ("literal", run["run_id"]))
+        while True:
+            where = in_run if after is None else ("and", in_run, keyset_after(["prop_id"], [after]))
+            rows = target.query_records(values, where, order_by=[("prop_id", False)], limit=VALUES_PER_LOOKUP)
+            if not rows:
+                return
+            # Looked up by the stored values, so the values table's database compares like types
+            lookup = ("in", ("field", key_field), list(dict.fromkeys(row["prop_id"] for row in rows)))
+            if year_field:
+                lookup = ("and", lookup, ("compare", "=", ("field", year_field), ("literal", run.get("tax_year"))))
+            assessed = {}
+            columns = [key_field, value_field] + ([year_field] if year_field else [])
+            for row in target.query_records(assessed_def, lookup, columns):
+                value = _decimal(row.get(value_field))
+                if value is not None:
+                    assessed[_key(row.get(key_field))] = value
+            for row in rows:
+                yield compare_value(row, assessed.get(_key(row["prop_id"])), settings["tolerances"])
+            if len(rows) < VALUES_PER_LOOKUP:
+                return
+            after = rows[-1]["prop_id"]
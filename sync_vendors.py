@@ -0,0 +1,315 @@
+"""
+TerraFusion SyncService - CAMA Vendor Adapters
+
+This module provides adapters for the schema conventions of CAMA vendor
+systems, so a sync pair for a known system only says which data it wants:
+
+    "source": {"type": "oracle", "dsn_env_var": "IASW_DSN", "schema": "IASW"},
+    "vendor": {
+        "type": "tyler_iasworld",
+        "tables": ["parcels", "owners", "assessments"],
+        "tax_years": [2025, 2026],
+        "overrides": {"owners": {"target_table": "iasw_owners"}}
+    }
+
+The adapter expands the block into the sync pair's tables (source table
+names, composite primary keys, change tracking and dependencies), record
+filters (history rows, soft deletes and tax years) and hooks (the tax year
+of per-year tables). Generated tables are named by their source table, as
+hand-written ones are, so hooks, filters and validation rules refer to them
+the same way; "overrides" replaces settings of a generated table by its
+logical name, and "tables" entries of the sync pair are added unchanged.
+
+Block settings shared by every adapter:
+
+- tables: Logical tables to sync (the adapter's default set when omitted)
+- tax_years: Tax years to sync; required for per-year tables
+- schema: Schema to qualify source table names with
+- change_tracking: Change tracking method for every table, replacing the
+  adapter's default (null for full reads only)
+- overrides: Table settings by logical table name
+
+Built-in adapters are listed in VENDOR_ADAPTERS. Any other type of the form
+"package.module:ClassName" is imported as a plugin, as for hooks.
+"""
+
+import copy
+import logging
+import importlib
+from dataclasses import dataclass, field
+from typing import Dict, List, Any, Optional, Callable
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Target column holding the tax year of rows read from per-year tables
+TAX_YEAR_COLUMN = "tax_year"
+
+
+@dataclass
+class VendorTable:
+    """The conventions of one logical table in a vendor schema."""
+    name: str  # Logical name, also the default target table
+    source: str  # Source table; per-year tables use a {year} placeholder
+    primary_key: List[str]
+    change_column: Optional[str] = None  # Last-modified column
+    year_column: Optional[str] = None  # Tax year column, filtered by tax_years
+    depends_on: List[str] = field(default_factory=list)  # Logical tables loaded first
+
+    @property
+    def per_year(self) -> bool:
+        return "{year}" in self.source
+
+
+class VendorAdapter:
+    """
+    Base class for CAMA vendor adapters.
+
+    Subclasses declare their tables and the columns that mark history rows
+    and soft-deleted rows; most adapters need no code beyond that.
+    """
+
+    vendor = "base"
+
+    # Logical tables the vendor schema provides, and those synced by default
+    tables: List[VendorTable] = []
+    default_tables: List[str] = []
+
+    # Schema qualifying source table names when the block sets none
+    default_schema: Optional[str] = None
+
+    # Change tracking of tables with a change_column when the block sets none
+    default_change_tracking = "change_column"
+
+    # (column, values) of rows kept only as history, skipped by the filters
+    history_rows: Optional[tuple] = None
+
+    # (column, values) of soft-deleted rows, sent to the target as deletes
+    deleted_rows: Optional[tuple] = None
+
+    def __init__(self, options: Dict[str, Any], source: Dict[str, Any]):
+        """
+        Initialize the adapter.
+
+        Args:
+            options: The sync pair's vendor block
+            source: The sync pair's source connector configuration
+
+        Raises:
+            ValueError: If the block names unknown tables or lacks tax years a table needs
+        """
+        self.options = options
+        self.source = source
+        self.schema = options.get("schema", self.default_schema)
+        self.tax_years = [int(year) for year in options.get("tax_years") or []]
+        self.by_name = {table.name: table for table in self.tables}
+        names = list(options.get("tables") or self.default_tables or self.by_name)
+        unknown = [name for name in names if name not in self.by_name]
+        if unknown:
+            raise ValueError(
+                f"Unknown {self.vendor} tables: {', '.join(unknown)}. Known tables: {', '.join(self.by_name)}"
+            )
+        self.selected = [self.by_name[name] for name in names]
+        for table in self.selected:
+            if table.per_year and not self.tax_years:
+                raise ValueError(f"{self.vendor} table {table.name} is kept per year and needs tax_years")
+        overrides = options.get("overrides") or {}
+        unknown = [name for name in overrides if name not in names]
+        if unknown:
+            raise ValueError(f"Overrides name {self.vendor} tables that are not synced: {', '.join(unknown)}")
+        self.overrides = overrides
+
+    def column(self, name: str) -> str:
+        """A vendor column name as records carry it (Oracle sources lower-case names by default)."""
+        if self.source.get("type") == "oracle" and self.source.get("lowercase_columns", True):
+            return name.lower()
+        return name
+
+    def source_names(self, table: VendorTable) -> List[str]:
+        """Source table names of a logical table, one per tax year for per-year tables."""
+        name = f"{self.schema}.{table.source}" if self.schema else table.source
+        if table.per_year:
+            return [name.format(year=year) for year in self.tax_years]
+        return [name]
+
+    def table_definitions(self) -> List[Dict[str, Any]]:
+        """Sync pair table definitions of the selected tables, in dependency order."""
+        definitions = []
+        selected = {table.name for table in self.selected}
+        for table in self.selected:
+            change_tracking = self.options.get(
+                "change_tracking", self.default_change_tracking if table.change_column else None
+            )
+            depends_on = [
+                name for dependency in table.depends_on if dependency in selected
+                for name in self.source_names(self.by_name[dependency])
+            ]
+            for source_name in self.source_names(table):
+                definition = {
+                    "name": source_name,
+                    "target_table": table.name,
+                    "primary_key": [self.column(c) for c in table.primary_key],
+                    "depends_on": depends_on,
+                }
+                if change_tracking:
+                    definition["change_tracking"] = change_tracking
+                if change_tracking == "change_column":
+                    definition["change_column"] = self.column(table.change_column)
+                definition.update(copy.deepcopy(self.overrides.get(table.name, {})))
+                definitions.append(definition)
+        return definitions
+
+    def filter_definitions(self) -> List[Dict[str, Any]]:
+        """Record filters for history rows, soft deletes and tax years."""
+        all_tables = [name for table in self.selected for name in self.source_names(table)]
+        filters = []
+        if self.history_rows:
+            filters.append({"tables": all_tables, "expression": self._excluding(*self.history_rows)})
+        if self.deleted_rows:
+            filters.append({"tables": all_tables, "expression": self._excluding(*self.deleted_rows),
+                            "on_exclude": "delete"})
+        if self.tax_years:
+            for table in self.selected:
+                if table.year_column and not table.per_year:
+                    years = ", ".join(str(year) for year in self.tax_years)
+                    filters.append({"tables": self.source_names(table),
+                                    "expression": f"{self.column(table.year_column)} in ({years})"})
+        return filters
+
+    def hook_definitions(self) -> List[Dict[str, Any]]:
+        """Hooks stamping the tax year on rows of per-year tables."""
+        hooks = []
+        for table in self.selected:
+            if table.per_year:
+                for year, source_name in zip(self.tax_years, self.source_names(table)):
+                    hooks.append({"type": "set_values", "tables": [source_name],
+                                  "options": {"values": {TAX_YEAR_COLUMN: year}, "key": True}})
+        return hooks
+
+    def _excluding(self, column: str, values: List[Any]) -> str:
+        literals = ", ".join(repr(v) if isinstance(v, str) else str(v) for v in values)
+        return f"{self.column(column)} is null or {self.column(column)} not in ({literals})"
+
+
+# Registered vendor adapters
+VENDOR_ADAPTERS: Dict[str, type] = {}
+
+
+def register_vendor(vendor: str) -> Callable[[type], type]:
+    """Class decorator that registers a VendorAdapter subclass under a type name."""
+    def decorator(cls: type) -> type:
+        if not issubclass(cls, VendorAdapter):
+            raise TypeError(f"{cls.__name__} must subclass VendorAdapter")
+        cls.vendor = vendor
+        VENDOR_ADAPTERS[vendor] = cls
+        return cls
+    return decorator
+
+
+@register_vendor("tyler_iasworld")
+class TylerIasWorldAdapter(VendorAdapter):
+    """
+    Tyler iasWorld (Oracle or SQL Server).
+
+    Tables are keyed by jurisdiction, parcel ID and tax year, with a card or
+    line number for sub-records. Every row carries CUR ('Y' for the current
+    row, 'N' for history, 'D' for deleted) and the WEN last-modified
+    timestamp, which incremental reads track.
+    """
+
+    tables = [
+        VendorTable("parcels", "PARDAT", ["JUR", "PARID", "TAXYR"], "WEN", "TAXYR"),
+        VendorTable("legal", "LEGDAT", ["JUR", "PARID", "TAXYR"], "WEN", "TAXYR", ["parcels"]),
+        VendorTable("owners", "OWNDAT", ["JUR", "PARID", "TAXYR", "OWNSEQ"], "WEN", "TAXYR", ["parcels"]),
+        VendorTable("assessments", "ASMT", ["JUR", "PARID", "TAXYR", "CARD"], "WEN", "TAXYR", ["parcels"]),
+        VendorTable("dwellings", "DWELDAT", ["JUR", "PARID", "TAXYR", "CARD"], "WEN", "TAXYR", ["parcels"]),
+        VendorTable("commercial", "COMDAT", ["JUR", "PARID", "TAXYR", "CARD"], "WEN", "TAXYR", ["parcels"]),
+        VendorTable("land", "LAND", ["JUR", "PARID", "TAXYR", "LLINE"], "WEN", "TAXYR", ["parcels"]),
+        VendorTable("sales", "SALES", ["JUR", "SALEKEY"], "WEN", None, ["parcels"]),
+    ]
+    default_tables = ["parcels", "legal", "owners", "assessments"]
+    history_rows = ("CUR", ["N"])
+    deleted_rows = ("CUR", ["D"])
+
+
+@register_vendor("patriot_assesspro")
+class PatriotAssessProAdapter(VendorAdapter):
+    """
+    Patriot Properties AssessPro (SQL Server).
+
+    Parcel data is keyed by PID, with a line number for sub-records.
+    Valuations are kept in one table per fiscal year (Value2025, Value2026,
+    ...); their rows load into a single valuations table keyed by PID and
+    tax_year. Deleted parcels are flagged with Deleted = 1. The schema has
+    no last-modified columns, so tables are read in full unless the block
+    sets a change_tracking method (SQL Server Change Tracking works well).
+    """
+
+    tables = [
+        VendorTable("parcels", "Parcel", ["PID"]),
+        VendorTable("owners", "Owner", ["PID", "OwnerNum"], depends_on=["parcels"]),
+        VendorTable("buildings", "Building", ["PID", "BldgNum"], depends_on=["parcels"]),
+        VendorTable("land", "Land", ["PID", "LineNum"], depends_on=["parcels"]),
+        VendorTable("sales", "Sale", ["PID", "SaleNum"], depends_on=["parcels"]),
+        VendorTable("valuations", "Value{year}", ["PID"], depends_on=["parcels"]),
+    ]
+    default_tables = ["parcels", "owners", "buildings", "land", "sales"]
+    default_schema = "dbo"
+    deleted_rows = ("Deleted", [1])
+
+
+def load_adapter(definition: Dict[str, Any], source: Dict[str, Any]) -> VendorAdapter:
+    """
+    Create the adapter of a vendor block.
+
+    Raises:
+        ValueError: If the vendor type is unknown or cannot be imported
+    """
+    vendor = definition.get("type")
+    if not vendor:
+        raise ValueError("Vendor definition missing required field: type")
+
+    adapter_class = VENDOR_ADAPTERS.get(vendor)
+    if adapter_class is None and ":" in vendor:
+        module_name, class_name = vendor.split(":", 1)
+        try:
+            module = importlib.import_module(module_name)
+            adapter_class = getattr(module, class_name)
+        except (ImportError, AttributeError) as e:
+            raise ValueError(f"Cannot load vendor adapter plugin {vendor}: {e}")
+        if not isinstance(adapter_class, type) or not issubclass(adapter_class, VendorAdapter):
+            raise ValueError(f"Vendor adapter plugin {vendor} is not a VendorAdapter")
+    if adapter_class is None:
+        raise ValueError(f"Unsupported vendor: {vendor}. Supported vendors: {', '.join(sorted(VENDOR_ADAPTERS))}")
+
+    return adapter_class(definition, source)
+
+
+def expand_vendor(definition: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Return a copy of a sync pair definition with its vendor block expanded
+    into tables, filters and hooks.
+
+    Generated tables come before the pair's own tables, and generated filters
+    and hooks before its own, so hand-written hooks see vendor rows as loaded.
+
+    Raises:
+        ValueError: If the vendor block is invalid or a generated table is also configured by hand
+    """
+    adapter = load_adapter(definition["vendor"], definition.get("source") or {})
+    expanded = copy.deepcopy(definition)
+    tables = adapter.table_definitions()
+    generated = {t["name"] for t in tables}
+    for table in expanded.get("tables", []):
+        if table.get("name") in generated:
+            raise ValueError(
+                f"Table {table['name']} is generated by the {adapter.vendor} adapter; "
+                f"change it with the vendor block's overrides"
+            )
+    expanded["tables"] = tables + expanded.get("tables", [])
+    expanded["filters"] = adapter.filter_definitions() + expanded.get("filters", [])
+    expanded["hooks"] = adapter.hook_definitions() + expanded.get("hooks", [])
+    logger.info(f"Expanded {adapter.vendor} vendor block of sync pair {definition.get('sync_pair_id')} "
+                f"into {len(tables)} tables")
+    return expanded
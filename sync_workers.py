@@ -0,0 +1,195 @@
+"""
+TerraFusion SyncService - Sync Worker Pool
+
+This module provides the worker pool that runs the tables of a sync job
+concurrently. Each worker opens its own source and target connections (driver
+connections are not shared between threads) and takes the next table whose
+dependencies have completed, so dependent tables are only committed after the
+tables they reference.
+"""
+
+import time
+import logging
+import threading
+import contextvars
+from dataclasses import dataclass, asdict
+from typing import Dict, List, Any, Optional, Callable, Tuple
+
+from sync_control import SyncJobCancelled, SyncJobPaused, SyncJobPreempted
+from tracing import tracer
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Worker count used when a connector does not set max_workers
+DEFAULT_MAX_WORKERS = 1
+
+# Requests to stop the job, which end a task without counting as a worker error
+JOB_STOPS = (SyncJobCancelled, SyncJobPaused, SyncJobPreempted)
+
+
+def worker_count(source_config: Dict[str, Any], target_config: Dict[str, Any]) -> int:
+    """
+    Resolve the pool size for a sync pair.
+
+    Each connector configuration may set "max_workers" (the number of
+    concurrent connections it accepts); the pool uses the smaller of the two.
+    """
+    source_workers = int(source_config.get("max_workers", DEFAULT_MAX_WORKERS))
+    target_workers = int(target_config.get("max_workers", DEFAULT_MAX_WORKERS))
+    return max(1, min(source_workers, target_workers))
+
+
+@dataclass
+class WorkerMetrics:
+    """Throughput counters for one worker."""
+    worker: str
+    tables: int = 0
+    batches: int = 0
+    records_read: int = 0
+    records_written: int = 0
+    errors: int = 0
+    busy_seconds: float = 0.0
+
+    def to_dict(self) -> Dict[str, Any]:
+        metrics = asdict(self)
+        metrics["busy_seconds"] = round(self.busy_seconds, 3)
+        metrics["records_per_second"] = (
+            round(self.records_read / self.busy_seconds, 1) if self.busy_seconds > 0 else 0.0
+        )
+        return metrics
+
+
+class SyncWorkerPool:
+    """
+    Runs sync tasks (one per table) on a fixed number of worker threads.
+
+    Tasks are started in the order given once all of their dependencies have
+    completed. After the first failure no new tasks are started; running tasks
+    finish and the error is re-raised from run().
+    """
+
+    def __init__(self, max_workers: int, open_connectors: Callable[[], Tuple[Any, Any]]):
+        """
+        Initialize the worker pool.
+
+        Args:
+            max_workers: Number of worker threads
+            open_connectors: Factory returning a new (source, target) connector pair
+        """
+        self.max_workers = max(1, max_workers)
+        self.open_connectors = open_connectors
+        self.metrics: Dict[str, WorkerMetrics] = {}
+        self._condition = threading.Condition()
+        self._pending: List[str] = []
+        self._running: set = set()
+        self._done: set = set()
+        self._dependencies: Dict[str, List[str]] = {}
+        self._error: Optional[BaseException] = None
+
+    def run(self,
+            tasks: List[str],
+            dependencies: Dict[str, List[str]],
+            sync_task: Callable[[str, Any, Any], Dict[str, Any]]) -> None:
+        """
+        Run every task and wait for completion.
+
+        Args:
+            tasks: Table names in preferred start order
+            dependencies: Table name to the table names it depends on; dependencies
+                outside this run are treated as already satisfied
+            sync_task: Callable(table_name, source, target) returning the table result
+
+        Raises:
+            Exception: The first error raised by a task
+        """
+        self._pending = list(tasks)
+        self._dependencies = {
+            name: [d for d in dependencies.get(name, []) if d in tasks] for name in tasks
+        }
+
+        workers = min(self.max_workers, len(tasks)) or 1
+        threads = []
+        for index in range(workers):
+            name = f"sync-worker-{index + 1}"
+            self.metrics[name] = WorkerMetrics(worker=name)
+            # Each worker runs in a copy of the caller's context, so its spans and log lines are the job's
+            thread = threading.Thread(target=contextvars.copy_context().run, args=(self._work, name, sync_task),
+                                      name=name, daemon=True)
+            threads.append(thread)
+            thread.start()
+        for thread in threads:
+            thread.join()
+
+        if self._error is not None:
+            raise self._error
+        if self._pending:
+            raise RuntimeError(f"Tables could not be scheduled: {', '.join(self._pending)}")
+
+    def metrics_summary(self) -> List[Dict[str, Any]]:
+        """Per-worker metrics for the job record."""
+        return [metrics.to_dict() for metrics in self.metrics.values()]
+
+    def _next_task(self) -> Optional[str]:
+        """Block until a task is ready; None when the worker should exit."""
+        with self._condition:
+            while True:
+                if self._error is not None or not self._pending:
+                    return None
+                for name in self._pending:
+                    if all(d in self._done for d in self._dependencies[name]):
+                        self._pending.remove(name)
+                        self._running.add(name)
+                        return name
+                if not self._running:
+                    # Remaining tasks wait on dependencies that can no longer complete
+                    return None
+                self._condition.wait()
+
+    def _finish_task(self, name: str, error: Optional[BaseException] = None) -> None:
+        with self._condition:
+            self._running.discard(name)
+            if error is None:
+                self._done.add(name)
+            elif self._error is None:
+                self._error = error
+            self._condition.notify_all()
+
+    def _work(self, worker_name: str, sync_task: Callable[[str, Any, Any], Dict[str, Any]]) -> None:
+        """Worker loop: open connectors on first use and run tasks until none remain."""
+        metrics = self.metrics[worker_name]
+        connectors = None
+        try:
+            while True:
+                name = self._next_task()
+                if name is None:
+                    break
+                started = time.monotonic()
+                try:
+                    if connectors is None:
+                        connectors = self.open_connectors()
+                        for connector in connectors:
+                            with tracer.span("connector.connect", {"sync.connector": connector.connector_type}):
+                                connector.connect()
+                    result = sync_task(name, *connectors)
+                    metrics.tables += 1
+                    metrics.batches += result.get("batches", 0)
+                    metrics.records_read += result.get("records_read", 0)
+                    metrics.records_written += result.get("records_written", 0)
+                    self._finish_task(name)
+                except JOB_STOPS as e:
+                    logger.info(f"{worker_name} stopped {name}: {e}")
+                    self._finish_task(name, e)
+                except BaseException as e:
+                    metrics.errors += 1
+                    logger.error(f"{worker_name} failed on {name}: {e}")
+                    self._finish_task(name, e)
+                finally:
+                    metrics.busy_seconds += time.monotonic() - started
+        finally:
+            for connector in connectors or ():
+                try:
+                    connector.close()
+                except Exception as e:
+                    logger.warning(f"{worker_name} could not close {connector.connector_type} connector: {e}")
@@ -0,0 +1,422 @@
+"""
+TerraFusion Platform - System Events
+
+This module provides the server-sent event (SSE) feed of lightweight
+platform events the operations dashboard's widgets update from, instead of
+polling the job, queue and connector endpoints:
+
+    GET /api/v1/events/system
+    GET /api/v1/events/system?types=sync_job,queue_depth&sync_job.status=FAILED,COMPLETED
+
+Event types (the SSE event name):
+
+- sync_job: a sync job changed state (created, started, completed, failed,
+  paused, cancelled, preempted). Batch progress is left to the job progress
+  streams (see sync_progress).
+- export_job: a GIS export job changed state (created, completed, failed,
+  cancelled)
+- connector_health: a sync pair's source or target connector became healthy,
+  unavailable or unknown, as seen by the connector health monitor
+- freshness_slo: a sync pair's table breached its freshness objective or
+  met it again, as seen by the freshness monitor (see sync_freshness)
+- queue_depth: the number of waiting or running sync jobs changed
+
+Every event's data is a small flat object with its type, the bus event ID
+and time, and the fields below (see SYSTEM_EVENT_FIELDS). A stream is
+narrowed with types=, and each type with filters named type.field whose
+value is a comma-separated list of accepted values (sync_job.status=FAILED,
+connector_health.sync_pair_id=benton_wa_pacs_staging). county_id= narrows
+every type that carries a county. Events come from the event bus, so
+connector health and queue depth reach gateways on other nodes; the feed
+has no history, so a dashboard loads its widgets once and applies events
+from then on.
+"""
+
+import os
+import queue
+import logging
+import threading
+from datetime import datetime
+from typing import Dict, List, Any, Optional, Iterator, Mapping, Tuple
+
+from sync_connectors import create_connector
+from sync_progress import event_frame, RECONNECT_MILLISECONDS
+from event_bus import EventBusError, subject_matches, SUBJECT_SYNC_JOB, SUBJECT_EXPORT_JOB, SUBJECT_SYSTEM
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Event types and the bus subjects they come from
+SYSTEM_EVENT_SUBJECTS = {
+    "sync_job": SUBJECT_SYNC_JOB.format(job_id="*", event="*"),
+    "export_job": SUBJECT_EXPORT_JOB.format(job_id="*", event="*"),
+    "connector_health": SUBJECT_SYSTEM.format(event="connector_health"),
+    "freshness_slo": SUBJECT_SYSTEM.format(event="freshness_slo"),
+    "queue_depth": SUBJECT_SYSTEM.format(event="queue_depth"),
+}
+
+SYSTEM_EVENT_TYPES = list(SYSTEM_EVENT_SUBJECTS)
+
+# Fields each event type carries besides type, event_id and published_at
+SYSTEM_EVENT_FIELDS = {
+    "sync_job": ["event", "job_id", "sync_pair_id", "county_id", "status", "mode", "dry_run", "message"],
+    "export_job": ["event", "job_id", "county_id", "status", "export_format", "download_url", "message"],
+    "connector_health": ["sync_pair_id", "county_id", "side", "connector_type", "status", "previous_status",
+                         "error", "circuit", "checked_at"],
+    "freshness_slo": ["sync_pair_id", "county_id", "table", "status", "previous_status", "age_seconds",
+                      "slo_seconds", "synced_at", "breach_id", "checked_at"],
+    "queue_depth": ["waiting", "running", "express_waiting", "waiting_by_priority"],
+}
+
+# Sync job events left out of the feed; the job progress streams carry them
+EXCLUDED_SYNC_JOB_EVENTS = ["progress"]
+
+# Event streams this process serves at once; further requests are turned away
+MAX_SYSTEM_STREAMS = int(os.environ.get("SYSTEM_EVENT_STREAM_MAX_CONCURRENT", "100"))
+
+# Seconds without events before a stream sends a keep-alive comment
+HEARTBEAT_SECONDS = int(os.environ.get("SYSTEM_EVENT_STREAM_HEARTBEAT_SECONDS", "15"))
+
+# Events held for a slow reader before the oldest are dropped
+STREAM_QUEUE_SIZE = 256
+
+# Seconds between connector health checks
+CONNECTOR_HEALTH_SECONDS = int(os.environ.get("CONNECTOR_HEALTH_CHECK_SECONDS", "60"))
+
+CONNECTOR_SIDES = ["source", "target"]
+
+
+class SystemEventLimitError(Exception):
+    """Raised when the process is already serving MAX_SYSTEM_STREAMS system event streams."""
+
+
+def system_event(envelope: Dict[str, Any]) -> Optional[Tuple[str, Dict[str, Any]]]:
+    """
+    The feed event of a bus message: its type and data, or None for messages the feed leaves out.
+    """
+    subject = envelope.get("subject", "")
+    source = envelope.get("data") or {}
+    for event_type, pattern in SYSTEM_EVENT_SUBJECTS.items():
+        if subject_matches(pattern, subject):
+            break
+    else:
+        return None
+    data = {"type": event_type, "event_id": envelope.get("event_id"), "published_at": envelope.get("published_at")}
+    if event_type in ("sync_job", "export_job"):
+        data["event"] = subject.rsplit(".", 1)[-1]
+        if event_type == "sync_job" and data["event"] in EXCLUDED_SYNC_JOB_EVENTS:
+            return None
+    for name in SYSTEM_EVENT_FIELDS[event_type]:
+        if name not in data:
+            data[name] = source.get(name)
+    return event_type, data
+
+
+def parse_subscription(types: Optional[List[str]], county_id: Optional[str] = None,
+                       filters: Optional[Mapping[str, str]] = None) -> Tuple[List[str], Dict[str, Dict[str, List[str]]]]:
+    """
+    The event types and per-type filters of a stream request.
+
+    Args:
+        types: Event types to stream; every type when empty
+        county_id: Stream events of this county only, for types that carry a county
+        filters: Comma-separated accepted values by type.field (sync_job.status: "FAILED,COMPLETED")
+
+    Returns:
+        (types, {type: {field: accepted values}})
+
+    Raises:
+        ValueError: If a type or a filtered field is unknown
+    """
+    types = list(types or []) or list(SYSTEM_EVENT_TYPES)
+    unknown = [t for t in types if t not in SYSTEM_EVENT_TYPES]
+    if unknown:
+        raise ValueError(f"Unknown system event type {unknown[0]}; choose from {', '.join(SYSTEM_EVENT_TYPES)}")
+    parsed: Dict[str, Dict[str, List[str]]] = {}
+    for key, value in (filters or {}).items():
+        event_type, _, field_name = key.partition(".")
+        if event_type not in SYSTEM_EVENT_TYPES:
+            raise ValueError(f"Unknown system event type {event_type} in filter {key}")
+        if field_name not in SYSTEM_EVENT_FIELDS[event_type]:
+            raise ValueError(f"{event_type} events have no field {field_name}; "
+                             f"filter on {', '.join(SYSTEM_EVENT_FIELDS[event_type])}")
+        values = [v.strip() for v in (value or "").split(",") if v.strip()]
+        if values:
+            parsed.setdefault(event_type, {})[field_name] = values
+    filters = parsed
+    if county_id:
+        for event_type in types:
+            if "county_id" in SYSTEM_EVENT_FIELDS[event_type]:
+                filters.setdefault(event_type, {}).setdefault("county_id", [county_id])
+    return types, filters
+
+
+class SystemEventStream:
+    """
+    The events of one stream, as an iterable of SSE frames for a streaming
+    response. close() ends the stream, unsubscribes it and frees its slot,
+    whether or not it was read to the end.
+    """
+
+    def __init__(self, service: "SystemEventService", types: List[str],
+                 filters: Dict[str, Dict[str, List[str]]], heartbeat_seconds: float):
+        self.service = service
+        self.types = types
+        self.filters = filters
+        self.heartbeat_seconds = heartbeat_seconds
+        self.sent = 0
+        self.dropped = 0
+        self._queue: "queue.Queue[Tuple[str, Dict[str, Any]]]" = queue.Queue(maxsize=STREAM_QUEUE_SIZE)
+        self._subscriptions = []
+        self._closed = False
+        self._frames = self._generate()
+
+    def __iter__(self):
+        return self._frames
+
+    def subscribe(self) -> None:
+        for event_type in self.types:
+            self._subscriptions.append(self.service.bus.subscribe(SYSTEM_EVENT_SUBJECTS[event_type], self._on_event))
+
+    def close(self) -> None:
+        if self._closed:
+            return
+        self._closed = True
+        self._frames.close()
+        self._release()
+
+    def wants(self, event_type: str, data: Dict[str, Any]) -> bool:
+        """Whether an event passes the stream's type and field filters."""
+        if event_type not in self.types:
+            return False
+        for field_name, values in self.filters.get(event_type, {}).items():
+            value = data.get(field_name)
+            if value is None or str(value) not in values:
+                return False
+        return True
+
+    def _on_event(self, envelope: Dict[str, Any]) -> None:
+        """Hand a bus event to the stream; runs on the bus's dispatcher thread."""
+        event = system_event(envelope)
+        if event is None or not self.wants(*event):
+            return
+        try:
+            self._queue.put_nowait(event)
+        except queue.Full:
+            # Dashboards care about the latest state; drop the oldest queued event
+            try:
+                self._queue.get_nowait()
+            except queue.Empty:
+                pass
+            self.dropped += 1
+            try:
+                self._queue.put_nowait(event)
+            except queue.Full:
+                pass
+
+    def _generate(self) -> Iterator[bytes]:
+        try:
+            yield f"retry: {RECONNECT_MILLISECONDS}\n\n".encode("utf-8")
+            while True:
+                try:
+                    event_type, data = self._queue.get(timeout=self.heartbeat_seconds)
+                except queue.Empty:
+                    yield b": keep-alive\n\n"
+                    continue
+                self.sent += 1
+                yield event_frame(event_type, data, data.get("event_id"))
+        except GeneratorExit:
+            logger.info(f"System event stream of {', '.join(self.types)} closed by the client after {self.sent} events")
+            raise
+        except Exception as e:
+            logger.error(f"System event stream failed: {e}", exc_info=True)
+            yield event_frame("error", {"error": str(e)})
+        finally:
+            self._release()
+
+    def _release(self) -> None:
+        subscriptions, self._subscriptions = self._subscriptions, []
+        for subscription in subscriptions:
+            subscription.unsubscribe()
+        self.service._finished(self)
+
+
+class SystemEventService:
+    """Opens SSE streams of system events."""
+
+    def __init__(self, bus, max_streams: int = MAX_SYSTEM_STREAMS, heartbeat_seconds: float = HEARTBEAT_SECONDS):
+        """
+        Initialize the service.
+
+        Args:
+            bus: Event bus the events are announced on
+            max_streams: Streams served at once
+            heartbeat_seconds: Seconds without events before a keep-alive comment
+        """
+        self.bus = bus
+        self.max_streams = max_streams
+        self.heartbeat_seconds = heartbeat_seconds
+        self._lock = threading.Lock()
+        self._open: List[SystemEventStream] = []
+
+    def open(self, types: Optional[List[str]] = None, county_id: Optional[str] = None,
+             filters: Optional[Mapping[str, str]] = None) -> SystemEventStream:
+        """
+        Check a stream request and open the stream.
+
+        Args:
+            types: Event types to stream (see SYSTEM_EVENT_TYPES); every type when empty
+            county_id: Stream events of this county only, for types that carry a county
+            filters: Comma-separated accepted values by type.field (see parse_subscription)
+
+        Returns:
+            The stream, to be returned as the response body
+
+        Raises:
+            ValueError: If an event type or filter is unknown
+            SystemEventLimitError: If too many streams are open
+            EventBusError: If the stream cannot subscribe to the event bus
+        """
+        types, filters = parse_subscription(types, county_id, filters)
+        with self._lock:
+            if len(self._open) >= self.max_streams:
+                raise SystemEventLimitError(f"{len(self._open)} system event streams are already open; try again shortly")
+            stream = SystemEventStream(self, types, filters, self.heartbeat_seconds)
+            self._open.append(stream)
+        try:
+            stream.subscribe()
+        except EventBusError:
+            stream.close()
+            raise
+        logger.info(f"Opened system event stream of {', '.join(types)}")
+        return stream
+
+    def status(self) -> Dict[str, Any]:
+        """The streams being served."""
+        with self._lock:
+            return {
+                "max_streams": self.max_streams,
+                "open": [{"types": s.types, "filters": s.filters, "sent": s.sent, "dropped": s.dropped}
+                         for s in self._open],
+            }
+
+    def _finished(self, stream: SystemEventStream) -> None:
+        with self._lock:
+            if stream in self._open:
+                self._open.remove(stream)
+
+
+def check_connector(config: Dict[str, Any]) -> Dict[str, Any]:
+    """Connect with a connector configuration and return its health_check(), closing it after."""
+    try:
+        connector = create_connector(config)
+    except Exception as e:
+        return {"status": "unavailable", "error": str(e)}
+    try:
+        return connector.health_check()
+    except Exception as e:
+        return {"connector_type": config.get("type"), "status": "unavailable", "error": str(e)}
+    finally:
+        close = getattr(connector, "close", None)
+        if close is not None:
+            try:
+                close()
+            except Exception:
+                pass
+
+
+class ConnectorHealthMonitor:
+    """
+    Checks the source and target connectors of every sync pair on an interval
+    and announces each change of a connector's status on the event bus.
+    """
+
+    def __init__(self, registry, bus, interval_seconds: float = CONNECTOR_HEALTH_SECONDS):
+        """
+        Initialize the monitor.
+
+        Args:
+            registry: Sync pair registry whose connectors are checked
+            bus: Event bus the transitions are announced on
+            interval_seconds: Seconds between rounds of checks
+        """
+        self.registry = registry
+        self.bus = bus
+        self.interval_seconds = interval_seconds
+        self._statuses: Dict[Tuple[str, str], Dict[str, Any]] = {}
+        self._lock = threading.Lock()
+        self._stop_event = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+
+    def is_running(self) -> bool:
+        return self._thread is not None and self._thread.is_alive()
+
+    def start(self) -> None:
+        """Start checking on a background thread."""
+        if self.is_running():
+            return
+        self._stop_event.clear()
+        self._thread = threading.Thread(target=self._run, name="connector-health-monitor", daemon=True)
+        self._thread.start()
+        logger.info(f"Connector health monitor started, checking every {self.interval_seconds}s")
+
+    def stop(self) -> None:
+        self._stop_event.set()
+        if self._thread is not None:
+            self._thread.join(timeout=5)
+            self._thread = None
+        logger.info("Connector health monitor stopped")
+
+    def check_all(self) -> List[Dict[str, Any]]:
+        """
+        Check every connector once and announce the ones whose status changed.
+
+        Returns:
+            The announced transitions
+        """
+        transitions = []
+        for pair in self.registry.list():
+            for side in CONNECTOR_SIDES:
+                result = check_connector(getattr(pair, side))
+                current = {
+                    "sync_pair_id": pair.sync_pair_id,
+                    "county_id": pair.county_id,
+                    "side": side,
+                    "connector_type": result.get("connector_type") or getattr(pair, side).get("type"),
+                    "status": result.get("status", "unknown"),
+                    "error": result.get("error"),
+                    "circuit": (result.get("circuit") or {}).get("state"),
+                    "checked_at": datetime.utcnow().isoformat(),
+                }
+                with self._lock:
+                    previous = self._statuses.get((pair.sync_pair_id, side))
+                    self._statuses[(pair.sync_pair_id, side)] = current
+                if previous is not None and previous["status"] == current["status"]:
+                    continue
+                transition = dict(current, previous_status=previous["status"] if previous else None)
+                transitions.append(transition)
+                self._announce(transition)
+        return transitions
+
+    def statuses(self) -> List[Dict[str, Any]]:
+        """The last checked status of each connector."""
+        with self._lock:
+            return [dict(status) for _, status in sorted(self._statuses.items())]
+
+    def _announce(self, transition: Dict[str, Any]) -> None:
+        if transition["previous_status"] is not None:
+            logger.info(f"Connector {transition['sync_pair_id']} {transition['side']} is now {transition['status']} "
+                        f"(was {transition['previous_status']})")
+        try:
+            self.bus.publish(SUBJECT_SYSTEM.format(event="connector_health"), transition)
+        except EventBusError as e:
+            logger.warning(f"Cannot announce connector health of {transition['sync_pair_id']} {transition['side']}: {e}")
+
+    def _run(self) -> None:
+        while not self._stop_event.is_set():
+            try:
+                self.check_all()
+            except Exception as e:
+                logger.error(f"Connector health check round failed: {e}", exc_info=True)
+            self._stop_event.wait(self.interval_seconds)
@@ -0,0 +1,147 @@
+"""
+TerraFusion Platform - County Tenancy
+
+This module keeps the counties hosted on one instance apart. Each county is
+a tenant: its sync jobs, snapshots, conflicts, dead letters, schedules,
+exports and audit events belong to it, by their county_id or, for records
+that only name a sync pair, the sync pair's county.
+
+The gateway middleware (see app.authorize_request) scopes every request to
+the counties its caller is bound to (see access_control) once the request
+is authorized. Within a scope the state store (see
+sync_store.TenantIsolatedStore) lists only the scope's documents, reads of
+another county's document fail as if it did not exist, and writes to one
+are refused with TenantIsolationError; export jobs, their files and their
+bundles are kept in a directory per county under the export storage path
+(see gis_export). This holds whatever a handler forgets to filter, so a
+bug in one listing cannot show one county another's parcels.
+
+Platform admins (a binding in every county, "*"), anonymous callers and
+the service's own threads (the queue, the scheduler, retention) run
+unscoped and see every county:
+
+    with tenant_scope(["benton_wa"]):
+        sync_state_store.list("sync_jobs")    # Benton's jobs only
+    with unrestricted():
+        audit_log.verify()                    # the whole chain
+
+Records that belong to no county (system audit events, job batches, role
+bindings and API keys) are not scoped; access_control decides who sees
+them. Per-tenant resource quotas are in tenant_quotas.
+"""
+
+import logging
+from contextlib import contextmanager
+from contextvars import ContextVar
+from typing import Dict, List, Any, Optional, Iterable, Iterator
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Binding county of a platform-wide binding (access_control.ALL)
+ALL = "*"
+
+# State store collections whose documents each belong to a county
+TENANT_COLLECTIONS = {
+    "sync_jobs", "sync_snapshots", "conflicts", "dead_letters", "topology_issues", "sync_schedules",
+    "audit_events", "spreadsheet_imports", "alerts", "webhooks", "freshness_breaches", "cdc_listeners",
+    "open_data_datasets", "roll_years",
+}
+
+# Counties the current request may reach; None when it is unscoped
+_tenants: ContextVar[Optional[frozenset]] = ContextVar("tenants", default=None)
+
+
+class TenantIsolationError(PermissionError):
+    """Raised when a scoped request writes a document of a county outside its scope."""
+
+
+def current_tenants() -> Optional[frozenset]:
+    """The counties the current request is scoped to; None when it is unscoped."""
+    return _tenants.get()
+
+
+def tenants_for(principal) -> Optional[List[str]]:
+    """
+    The counties an access_control Principal is scoped to; None for
+    anonymous callers and platform-wide bindings.
+    """
+    if principal is None:
+        return None
+    counties = [binding["county_id"] for binding in principal.bindings]
+    if ALL in counties:
+        return None
+    return sorted(set(counties))
+
+
+def enter_scope(counties: Optional[Iterable[str]]):
+    """Scopes the current context to counties (None for unscoped); the token resets it."""
+    return _tenants.set(None if counties is None else frozenset(counties))
+
+
+def exit_scope(token) -> None:
+    _tenants.reset(token)
+
+
+@contextmanager
+def tenant_scope(counties: Optional[Iterable[str]]) -> Iterator[None]:
+    """Runs a block scoped to counties (None for unscoped)."""
+    token = enter_scope(counties)
+    try:
+        yield
+    finally:
+        exit_scope(token)
+
+
+@contextmanager
+def unrestricted() -> Iterator[None]:
+    """Runs a block unscoped, for work that spans counties by design (the audit chain)."""
+    with tenant_scope(None):
+        yield
+
+
+def tenant_of(document: Optional[Dict[str, Any]]) -> Optional[str]:
+    """
+    The county a document belongs to: its sync pair's configured county,
+    else its county_id, looked for in its details too (audit events). None
+    when it names no county and its sync pair is not configured.
+    """
+    if not isinstance(document, dict):
+        return None
+    details = document.get("details") if isinstance(document.get("details"), dict) else {}
+    county_id = document.get("county_id") or details.get("county_id")
+    sync_pair_id = document.get("sync_pair_id") or details.get("sync_pair_id")
+    if not sync_pair_id:
+        return county_id
+    from sync_pairs import sync_pair_registry
+    try:
+        return sync_pair_registry.get(sync_pair_id).county_id
+    except KeyError:
+        return county_id
+
+
+def allows(county_id: Optional[str]) -> bool:
+    """Whether the current scope reaches a county; records of no county are reachable from any scope."""
+    tenants = current_tenants()
+    return tenants is None or not county_id or county_id in tenants
+
+
+def visible(collection: str, document: Optional[Dict[str, Any]]) -> bool:
+    """Whether a document of a state store collection is in the current scope."""
+    if current_tenants() is None or collection not in TENANT_COLLECTIONS:
+        return True
+    return allows(tenant_of(document))
+
+
+def check_document(collection: str, key: str, document: Dict[str, Any]) -> None:
+    """
+    Refuse a write outside the current scope.
+
+    Raises:
+        TenantIsolationError: If the document belongs to a county the scope does not reach
+    """
+    if not visible(collection, document):
+        logger.warning(f"Refused a write of {collection} document {key} of county {tenant_of(document)} "
+                       f"from a request scoped to {', '.join(sorted(current_tenants()))}")
+        raise TenantIsolationError(f"{collection} document {key} belongs to another county")
@@ -0,0 +1,206 @@
+"""
+TerraFusion Platform - Tenant Resource Quotas
+
+This module keeps one county from using up an instance it shares with
+others (see tenancy). A county sets its quotas in the "tenant_quotas"
+block of its configuration:
+
+    "tenant_quotas": {
+        "max_queued_sync_jobs": 20,
+        "max_running_sync_jobs": 2,
+        "max_running_exports": 2,
+        "export_storage_mb": 5120,
+        "requests_per_minute": 600
+    }
+
+Counties without a block, or without one of its quotas, get the instance's
+default from TENANT_MAX_QUEUED_SYNC_JOBS, TENANT_MAX_RUNNING_SYNC_JOBS,
+TENANT_MAX_RUNNING_EXPORTS, TENANT_EXPORT_STORAGE_MB and
+TENANT_REQUESTS_PER_MINUTE; 0 (the default of each) is unlimited.
+
+- max_queued_sync_jobs: sync jobs pending or running at once; more are
+  refused when they are created (see sync_engine)
+- max_running_sync_jobs: queued sync jobs run at once; the job queue (see
+  sync_queue) passes over the county's waiting jobs while it has as many
+  running, so they do not take every worker
+- max_running_exports: export jobs processing at once
+- export_storage_mb: size of the county's export directory (see
+  gis_export); exports are refused while it is over, until retention (see
+  job_retention) or deletes free space
+- requests_per_minute: API requests naming the county, per process
+
+A refused request raises QuotaExceeded, an OverloadedError the API answers
+with 429 Too Many Requests and a Retry-After header. The limits and current
+use of a county are at GET /api/v1/tenants/<county_id>.
+"""
+
+import os
+import time
+import logging
+import threading
+from collections import deque
+from typing import Dict, Any, Optional, Iterable
+
+from load_shedding import OverloadedError
+from county_overrides import load_county_config, config_version, county_config_path
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Quotas of a tenant_quotas block and their instance defaults (0 for unlimited)
+DEFAULT_QUOTAS = {
+    "max_queued_sync_jobs": int(os.environ.get("TENANT_MAX_QUEUED_SYNC_JOBS", "0")),
+    "max_running_sync_jobs": int(os.environ.get("TENANT_MAX_RUNNING_SYNC_JOBS", "0")),
+    "max_running_exports": int(os.environ.get("TENANT_MAX_RUNNING_EXPORTS", "0")),
+    "export_storage_mb": int(os.environ.get("TENANT_EXPORT_STORAGE_MB", "0")),
+    "requests_per_minute": int(os.environ.get("TENANT_REQUESTS_PER_MINUTE", "0")),
+}
+
+# Retry-After of a refusal that waits on other work finishing rather than on the clock
+RETRY_AFTER_SECONDS = int(os.environ.get("TENANT_QUOTA_RETRY_AFTER_SECONDS", "60"))
+
+# Length of the requests_per_minute window
+REQUEST_WINDOW_SECONDS = 60
+
+# What each quota counts, for messages
+QUOTA_UNITS = {
+    "max_queued_sync_jobs": "sync jobs pending or running",
+    "max_running_sync_jobs": "sync jobs running",
+    "max_running_exports": "export jobs running",
+    "export_storage_mb": "MB of exports stored",
+    "requests_per_minute": "requests in the last minute",
+}
+
+
+class QuotaExceeded(OverloadedError):
+    """Raised when a county is at one of its quotas."""
+
+    def __init__(self, county_id: str, quota: str, limit: int, retry_after: int = RETRY_AFTER_SECONDS):
+        super().__init__(f"County {county_id} is at its {quota} quota of {limit} {QUOTA_UNITS[quota]}",
+                         retry_after)
+        self.county_id = county_id
+        self.quota = quota
+        self.limit = limit
+
+
+def parse_quotas(county_id: str, definition: Optional[Dict[str, Any]]) -> Dict[str, int]:
+    """
+    The quotas of a county's tenant_quotas block over the defaults.
+
+    Raises:
+        ValueError: If the block is invalid
+    """
+    label = f"County {county_id} tenant_quotas"
+    definition = definition or {}
+    if not isinstance(definition, dict):
+        raise ValueError(f"{label} must be an object")
+    unknown = [name for name in definition if name not in DEFAULT_QUOTAS]
+    if unknown:
+        raise ValueError(f"{label}: unknown quotas {', '.join(unknown)}. Quotas: {', '.join(DEFAULT_QUOTAS)}")
+    quotas = dict(DEFAULT_QUOTAS)
+    for name, value in definition.items():
+        if not isinstance(value, int) or isinstance(value, bool) or value < 0:
+            raise ValueError(f"{label}.{name} must be a whole number of at least 0 (0 for unlimited)")
+        quotas[name] = value
+    return quotas
+
+
+class TenantQuotas:
+    """
+    Service class for the per-county quotas.
+
+    Quotas are read from the county configuration files and reloaded when
+    a file changes.
+    """
+
+    def __init__(self, config_dir: str = "county_configs"):
+        self.config_dir = config_dir
+        self._quotas: Dict[str, Any] = {}
+        # Times of each county's recent requests, for requests_per_minute
+        self._requests: Dict[str, deque] = {}
+        self._lock = threading.Lock()
+
+    def quotas(self, county_id: str) -> Dict[str, int]:
+        """
+        The quotas of a county; the defaults when it has no block.
+
+        Raises:
+            ValueError: If its tenant_quotas block is invalid
+        """
+        path = county_config_path(self.config_dir, county_id)
+        if path is None:
+            return dict(DEFAULT_QUOTAS)
+        version = config_version(path)
+        with self._lock:
+            cached = self._quotas.get(path)
+        if cached is not None and cached[0] == version:
+            return cached[1]
+        quotas = parse_quotas(county_id, load_county_config(path).get("tenant_quotas"))
+        with self._lock:
+            self._quotas[path] = (version, quotas)
+        return quotas
+
+    def allows(self, county_id: Optional[str], quota: str, used: float) -> bool:
+        """Whether a county at a level of use may take one more of a quota."""
+        if not county_id:
+            return True
+        limit = self.quotas(county_id)[quota]
+        return not limit or used < limit
+
+    def check(self, county_id: Optional[str], quota: str, used: float) -> None:
+        """
+        Refuse work of a county at a level of use of a quota.
+
+        Raises:
+            QuotaExceeded: If the county is at the quota
+            ValueError: If its tenant_quotas block is invalid
+        """
+        if not self.allows(county_id, quota, used):
+            limit = self.quotas(county_id)[quota]
+            logger.warning(f"County {county_id} is at its {quota} quota of {limit}")
+            raise QuotaExceeded(county_id, quota, limit)
+
+    def check_request(self, county_ids: Iterable[Optional[str]], now: Optional[float] = None) -> None:
+        """
+        Count an API request against the requests_per_minute of the counties it names.
+
+        Raises:
+            QuotaExceeded: If a county is at its quota; the request is not counted
+            ValueError: If a tenant_quotas block is invalid
+        """
+        now = time.monotonic() if now is None else now
+        counties = [(c, self.quotas(c)["requests_per_minute"]) for c in dict.fromkeys(c for c in county_ids if c)]
+        with self._lock:
+            windows = {}
+            for county_id, limit in counties:
+                if not limit:
+                    continue
+                window = self._requests.setdefault(county_id, deque())
+                while window and window[0] <= now - REQUEST_WINDOW_SECONDS:
+                    window.popleft()
+                if len(window) >= limit:
+                    retry_after = max(1, int(window[0] + REQUEST_WINDOW_SECONDS - now) + 1)
+                    raise QuotaExceeded(county_id, "requests_per_minute", limit, retry_after)
+                windows[county_id] = window
+            for window in windows.values():
+                window.append(now)
+
+    def recent_requests(self, county_id: str, now: Optional[float] = None) -> int:
+        """The county's requests in the current requests_per_minute window."""
+        now = time.monotonic() if now is None else now
+        with self._lock:
+            return sum(1 for moment in self._requests.get(county_id, ()) if moment > now - REQUEST_WINDOW_SECONDS)
+
+    def report(self, county_id: str, usage: Dict[str, float]) -> Dict[str, Any]:
+        """A county's quotas with their current use, for GET /api/v1/tenants/<county_id>."""
+        usage = dict(usage, requests_per_minute=self.recent_requests(county_id))
+        return {
+            "county_id": county_id,
+            "quotas": {name: {"limit": limit or None, "used": usage.get(name)}
+                       for name, limit in self.quotas(county_id).items()},
+        }
+
+
+# Create a singleton instance
+tenant_quotas = TenantQuotas()
@@ -0,0 +1,828 @@
+"""
+TerraFusion Platform - Command Line
+
+This module provides the `terrafusion` command for county administrators
+and operators. Installed images run it as `terrafusion`; from a checkout,
+run `python terrafusion.py`:
+
+    terrafusion doctor                          # every check
+    terrafusion doctor --county benton_wa       # one county's sync pairs
+    terrafusion doctor --sync-pair benton_wa_pacs_staging --output json
+    terrafusion compact --dry-run               # job history past its retention
+    terrafusion config validate                 # unknown keys and type errors, by file and line
+    terrafusion config explain --sync-pair benton_wa_pacs_staging
+    terrafusion config diff staging prod        # settings two profiles give differently (see config_profiles)
+    terrafusion --profile prod --set LOG_LEVEL=DEBUG doctor
+    terrafusion init                            # set up a sync pair: connect, pick tables, map, test
+    terrafusion migrate status                  # staging store schema migrations (see staging_migrations)
+    terrafusion backup state.tfbak              # sync state and configuration, encrypted (see state_backup)
+    terrafusion restore state.tfbak --dry-run
+    terrafusion service install --env-file terrafusion.env   # Windows service or systemd unit
+    terrafusion service run                     # the gateway in the foreground
+    terrafusion completion bash                 # tab completion script (see cli_completion)
+
+The operations commands call a running service's API with the credentials
+`terrafusion login` stores (see terrafusion_client), so they work from any
+workstation:
+
+    terrafusion login --url https://terrafusion.co.benton.wa.us --api-key tfk_...
+    terrafusion sync run benton_wa_pacs_staging --mode incremental --wait
+    terrafusion sync status JOB_ID
+    terrafusion sync list --status FAILED --output json
+    terrafusion export create --county benton_wa --format geojson --layer parcels --area aoi.geojson
+    terrafusion job cancel JOB_ID
+    terrafusion conflict list --sync-pair benton_wa_pacs_staging
+    terrafusion import corrections.xlsx --sync-pair benton_wa_pacs_staging --table dbo.property
+
+They exit 1 when the service refuses a request (or a job waited for fails).
+
+Every command takes --output table (the default, for people), json (the
+full result) or csv (one row per item, under a header of the same field
+names the JSON uses), so scripts can parse any command's output. Field
+names are part of the interface and only ever added to. Only `completion`
+and `service run`, which print a script and the service's log, have no
+--output, and `service install --print-unit` prints the unit file itself.
+Prompts and progress go to stderr.
+"""
+
+import io
+import os
+import sys
+import csv
+import json
+import time
+import getpass
+import logging
+import argparse
+from typing import Dict, List, Any, Optional
+
+from cli_completion import SHELLS
+
+# Columns the operations commands print for each kind of item
+SYNC_JOB_COLUMNS = ["job_id", "sync_pair_id", "mode", "status", "created_at", "completed_at"]
+EXPORT_JOB_COLUMNS = ["job_id", "county_id", "export_format", "status", "created_at", "completed_at"]
+CONFLICT_COLUMNS = ["conflict_id", "sync_pair_id", "table", "record_key", "status", "detected_at"]
+IMPORT_PROBLEM_COLUMNS = ["line", "status", "key", "errors"]
+TABLE_RESULT_COLUMNS = ["table", "mode", "records_read", "records_written", "records_deleted"]
+
+# Fields of the rows the local commands print with --output csv
+DOCTOR_COLUMNS = ["check", "subject", "status", "message"]
+COMPACT_COLUMNS = ["county_id", "kind", "jobs", "expired", "deleted", "archive"]
+VALIDATION_COLUMNS = ["file", "line", "column", "level", "path", "message"]
+SETTING_COLUMNS = ["setting", "value"]
+INIT_COLUMNS = ["table", "records_read", "records_written", "records_rejected", "error"]
+MIGRATION_COLUMNS = ["version", "status", "applied_at", "description"]
+BACKUP_COLUMNS = ["collection", "documents"]
+RESTORE_COLUMNS = ["collection", "restored", "deleted"]
+SERVICE_COLUMNS = ["action", "message"]
+LOGIN_COLUMNS = ["url", "username", "credentials"]
+LOGOUT_COLUMNS = ["removed"]
+PROFILE_COLUMNS = ["profile", "extends", "path", "settings", "error"]
+PROFILE_DIFF_COLUMNS = ["setting", "left", "right", "left_source", "right_source"]
+
+# Formats of --output; text is the name table had before csv was added
+OUTPUT_FORMATS = ["table", "json", "csv"]
+
+# Seconds between status checks of `sync run --wait`
+WAIT_INTERVAL_SECONDS = 5
+
+
+def _doctor(args: argparse.Namespace) -> int:
+    from doctor import Doctor, format_report, FAIL, NTP_SERVER
+    ntp_server = None if args.skip_clock else args.ntp_server or NTP_SERVER
+    report = Doctor(args.config_dir, ntp_server=ntp_server).run(args.county, args.sync_pair)
+    _emit(args, report, report["checks"], DOCTOR_COLUMNS, format_report(report))
+    return 1 if report["status"] == FAIL else 0
+
+
+def _compact(args: argparse.Namespace) -> int:
+    from sync_engine import sync_engine
+    from gis_export import gis_export_service
+    from job_retention import JobRetention, format_report, JOB_KINDS
+    report = JobRetention(sync_engine, gis_export_service, args.config_dir).run(args.county, args.dry_run)
+    rows = [dict(result[kind], county_id=county_id, kind=kind,
+                 archive=result[kind]["archive"] and result[kind]["archive"]["key"])
+            for county_id, result in report["counties"].items() for kind in JOB_KINDS]
+    _emit(args, report, rows, COMPACT_COLUMNS, format_report(report))
+    return 1 if report["errors"] else 0
+
+
+def _config_validate(args: argparse.Namespace) -> int:
+    from config_schema import validate_configuration, format_report
+    report = validate_configuration(args.config_dir, args.county, schedules=not args.skip_schedules)
+    _emit(args, report, report["issues"], VALIDATION_COLUMNS, format_report(report))
+    return 0 if report["valid"] else 1
+
+
+def _config_explain(args: argparse.Namespace) -> int:
+    from config_schema import explain_configuration
+    try:
+        configuration = explain_configuration(args.config_dir, args.county, args.sync_pair)
+    except KeyError as e:
+        print(f"terrafusion config explain: {e.args[0]}", file=sys.stderr)
+        return 1
+    settings = _settings(configuration)
+    _emit(args, configuration, settings, SETTING_COLUMNS, format_table(settings, SETTING_COLUMNS))
+    return 0
+
+
+def _settings(value: Any, path: str = "") -> List[Dict[str, Any]]:
+    """A configuration as one row per setting, named by its path: sync_pairs[0].source.host."""
+    if isinstance(value, dict) and value:
+        return [row for name, item in value.items() for row in _settings(item, f"{path}.{name}" if path else name)]
+    if isinstance(value, list) and value and any(isinstance(item, (dict, list)) for item in value):
+        return [row for index, item in enumerate(value) for row in _settings(item, f"{path}[{index}]")]
+    return [{"setting": path, "value": json.dumps(value, default=str) if isinstance(value, (dict, list)) else value}]
+
+
+def _config_profiles(args: argparse.Namespace) -> int:
+    from config_profiles import list_profiles, PROFILE_DIR
+    profiles = list_profiles()
+    text = format_table(profiles, PROFILE_COLUMNS) if profiles else f"No profiles in {PROFILE_DIR}"
+    _emit(args, {"profiles": profiles}, profiles, PROFILE_COLUMNS, text)
+    return 1 if any(profile["error"] for profile in profiles) else 0
+
+
+def _config_diff(args: argparse.Namespace) -> int:
+    from config_profiles import diff_profiles, format_diff, ProfileError
+    try:
+        diff = diff_profiles(args.left, args.right)
+    except ProfileError as e:
+        print(f"terrafusion config diff: {e}", file=sys.stderr)
+        return 1
+    _emit(args, diff, diff["differences"], PROFILE_DIFF_COLUMNS, format_diff(diff))
+    return 0
+
+
+def _init(args: argparse.Namespace) -> int:
+    from county_setup import InitWizard
+    answers = {"county": args.county, "county_name": args.county_name, "timezone": args.timezone,
+               "sync_pair_id": args.sync_pair, "source_type": args.source_type, "schema": args.schema,
+               "tables": args.table, "target_type": args.target_type, "sqlite_path": args.sqlite_path,
+               "env_file": args.env_file, "replace": args.replace, "skip_test_sync": args.skip_test_sync,
+               "test_records": args.test_records}
+    # Parsed output leaves stdout to the result; the wizard's lines go to stderr
+    out = print if args.output == "table" else lambda line: print(line, file=sys.stderr)
+    wizard = InitWizard(args.config_dir, answers, assume_defaults=args.yes, ask=_ask, out=out)
+    try:
+        status = wizard.run()
+    except Exception as e:
+        # Invalid answers, and the drivers' errors of an unreachable source, a refused login or an unknown table
+        print(f"terrafusion init: {e}", file=sys.stderr)
+        return 1
+    _emit(args, wizard.result, wizard.result.get("test_sync", []), INIT_COLUMNS)
+    return status
+
+
+def _migrate(args: argparse.Namespace) -> int:
+    from staging_migrations import StagingMigrator, MigrationError, format_status, DEFAULT_SCHEMA
+    try:
+        migrator = StagingMigrator(args.database_url, args.schema or DEFAULT_SCHEMA)
+        if args.action == "status":
+            status = migrator.status()
+        elif args.action == "up":
+            status = migrator.up(args.to)
+        else:
+            if not args.yes:
+                answer = _ask("Reverting migrations can drop tables and the records in them. Continue? [y/N] ") \
+                    if sys.stdin.isatty() else ""
+                if answer.strip().lower() not in ("y", "yes"):
+                    print("terrafusion migrate down: not confirmed; pass --yes", file=sys.stderr)
+                    return 1
+            status = migrator.down(args.to)
+    except MigrationError as e:
+        print(f"terrafusion migrate {args.action}: {e}", file=sys.stderr)
+        return 1
+    rows = status["migrations"] + [{"version": version, "status": "unknown"} for version in status["unknown"]]
+    _emit(args, status, rows, MIGRATION_COLUMNS, format_status(status))
+    return 0
+
+
+def _backup(args: argparse.Namespace) -> int:
+    from state_backup import StateBackup, BackupError, read_passphrase, format_backup
+    try:
+        passphrase = read_passphrase(args.passphrase_file, confirm=True)
+        manifest = StateBackup(config_dir=args.config_dir).backup(args.archive, passphrase, args.collection)
+    except (BackupError, OSError) as e:
+        print(f"terrafusion backup: {e}", file=sys.stderr)
+        return 1
+    rows = [{"collection": name, "documents": count} for name, count in manifest["collections"].items()]
+    _emit(args, manifest, rows, BACKUP_COLUMNS, format_backup(manifest))
+    return 0
+
+
+def _restore(args: argparse.Namespace) -> int:
+    from state_backup import StateBackup, BackupError, read_passphrase, format_restore
+    try:
+        passphrase = read_passphrase(args.passphrase_file)
+        result = StateBackup(config_dir=args.config_dir).restore(
+            args.archive, passphrase, args.collection, clean=args.clean, overwrite_config=args.overwrite_config,
+            skip_config=args.skip_config, dry_run=args.dry_run)
+    except (BackupError, OSError) as e:
+        print(f"terrafusion restore: {e}", file=sys.stderr)
+        return 1
+    rows = [dict(counts, collection=name) for name, counts in result["collections"].items()]
+    _emit(args, result, rows, RESTORE_COLUMNS, format_restore(result))
+    return 0
+
+
+def _service(args: argparse.Namespace) -> int:
+    import service_host
+    if args.action == "run":
+        return service_host.run_service(args.env_file)
+    if args.action == "install" and args.print_unit:
+        print(service_host.render_systemd_unit(os.path.abspath(args.directory or os.getcwd()),
+                                               args.env_file and os.path.abspath(args.env_file), args.user), end="")
+        return 0
+    try:
+        message = service_host.manage_service(args.action, getattr(args, "directory", None),
+                                              getattr(args, "env_file", None), getattr(args, "user", None),
+                                              args.unit_dir, getattr(args, "manual", False))
+    except (RuntimeError, OSError) as e:
+        print(f"terrafusion service {args.action}: {e}", file=sys.stderr)
+        return 1
+    result = {"action": args.action, "message": message}
+    _emit(args, result, [result], SERVICE_COLUMNS, message)
+    return 0
+
+
+def _completion(args: argparse.Namespace, parser: argparse.ArgumentParser) -> int:
+    from cli_completion import render
+    print(render(args.shell, parser), end="")
+    return 0
+
+
+def _client(args: argparse.Namespace):
+    from terrafusion_client import ApiClient
+    return ApiClient.from_settings(args.url, args.api_key)
+
+
+def _ask(prompt: str) -> str:
+    """Read an answer, prompting on stderr so stdout carries only the command's output."""
+    print(prompt, end="", file=sys.stderr, flush=True)
+    return input()
+
+
+def _emit(args: argparse.Namespace, result: Any, rows: List[Dict[str, Any]], columns: List[str],
+          text: Optional[str] = None) -> None:
+    """Print a command's result as JSON, its rows as CSV, or for table output the text given."""
+    if args.output == "json":
+        print(json.dumps(result, indent=2, default=str))
+    elif args.output == "csv":
+        print(format_csv(rows, columns), end="")
+    elif text is not None:
+        print(text)
+
+
+def _print(args: argparse.Namespace, result: Any, columns: List[str], items: Optional[str] = None) -> None:
+    """Print an API result as JSON, or its item or list of items as CSV or a table."""
+    rows = result.get(items, []) if items else [result]
+    if args.output != "table":
+        _emit(args, result, rows, columns)
+        return
+    print(format_table(rows, columns))
+    if items and result.get("next_cursor"):
+        print(f"\nMore with --cursor {result['next_cursor']}")
+    if not items:
+        for name in ("message", "error"):
+            if result.get(name):
+                print(f"\n{result[name]}")
+
+
+def format_table(rows: List[Dict[str, Any]], columns: List[str]) -> str:
+    """Rows as aligned text columns under a header."""
+    cells = [[str(column).upper() for column in columns]]
+    cells += [["" if row.get(column) is None else str(row.get(column)) for column in columns] for row in rows]
+    widths = [max(len(line[i]) for line in cells) for i in range(len(columns))]
+    return "\n".join("  ".join(cell.ljust(width) for cell, width in zip(line, widths)).rstrip() for line in cells)
+
+
+def format_csv(rows: List[Dict[str, Any]], columns: List[str]) -> str:
+    """Rows as CSV under a header of their field names; nested values as compact JSON."""
+    buffer = io.StringIO()
+    writer = csv.writer(buffer, lineterminator="\n")
+    writer.writerow(columns)
+    writer.writerows([_csv_value(row.get(column)) for column in columns] for row in rows)
+    return buffer.getvalue()
+
+
+def _csv_value(value: Any) -> str:
+    if value is None:
+        return ""
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, (dict, list)):
+        return json.dumps(value, separators=(",", ":"), default=str)
+    return str(value)
+
+
+def _output_format(value: str) -> str:
+    return "table" if value == "text" else value
+
+
+def _json_argument(value: str) -> Any:
+    """A JSON document given inline or as the path of a file holding it."""
+    if os.path.exists(value):
+        with open(value, "r") as f:
+            return json.load(f)
+    return json.loads(value)
+
+
+def _parameters(pairs: List[str]) -> Optional[Dict[str, Any]]:
+    """key=value arguments as a parameters object; values that parse as JSON are taken as JSON."""
+    parameters = {}
+    for pair in pairs or []:
+        name, separator, value = pair.partition("=")
+        if not separator or not name:
+            raise ValueError(f"--param {pair} must be key=value")
+        try:
+            parameters[name] = json.loads(value)
+        except ValueError:
+            parameters[name] = value
+    return parameters or None
+
+
+def _login(args: argparse.Namespace) -> int:
+    from terrafusion_client import ApiClient, ApiError, save_credentials, CREDENTIALS_PATH
+    url = args.url or os.environ.get("TERRAFUSION_URL")
+    if not url:
+        raise ApiError("terrafusion login needs --url (or TERRAFUSION_URL)")
+    client = ApiClient(url, api_key=args.api_key)
+    if args.api_key:
+        try:
+            client.get("/api/v1/sync/jobs", {"limit": 1})
+        except ApiError as e:
+            # A key without the jobs scope is still a valid key
+            if e.status != 403:
+                raise
+        client.username = args.username
+    elif args.username:
+        password = os.environ.get("TERRAFUSION_PASSWORD") or getpass.getpass(f"Password for {args.username}: ")
+        client.login(args.username, password, code=lambda: _ask("Authenticator code: ").strip())
+    else:
+        raise ApiError("terrafusion login needs --api-key or --username")
+    save_credentials(client.credentials())
+    who = f" as {client.username}" if client.username else " with an API key"
+    result = {"url": client.url, "username": client.username, "credentials": CREDENTIALS_PATH}
+    _emit(args, result, [result], LOGIN_COLUMNS,
+          f"Signed in to {client.url}{who}; credentials stored in {CREDENTIALS_PATH}")
+    return 0
+
+
+def _logout(args: argparse.Namespace) -> int:
+    from terrafusion_client import ApiClient, ApiError, delete_credentials, load_credentials
+    if load_credentials().get("token"):
+        try:
+            ApiClient.from_settings().logout()
+        except ApiError as e:
+            # The credentials are removed either way
+            print(f"Could not end the session on the service: {e}", file=sys.stderr)
+    result = {"removed": delete_credentials()}
+    _emit(args, result, [result], LOGOUT_COLUMNS,
+          "Removed the stored credentials" if result["removed"] else "No credentials were stored")
+    return 0
+
+
+def _sync_run(args: argparse.Namespace) -> int:
+    from sync_control import TERMINAL_STATUSES
+    client = _client(args)
+    body = {
+        "sync_pair_id": args.sync_pair_id,
+        "username": client.username or getpass.getuser(),
+        "mode": args.mode,
+        "tables": args.table,
+        "parameters": _parameters(args.param),
+        "dry_run": args.dry_run,
+        "priority": args.priority,
+        "express": args.express,
+    }
+    job = client.post("/api/v1/sync/jobs", {name: value for name, value in body.items() if value is not None})
+    while args.wait and job["status"] not in TERMINAL_STATUSES:
+        if args.output == "table":
+            print(f"{job['job_id']} {job['status']}", file=sys.stderr)
+        time.sleep(args.interval)
+        job = client.get(f"/api/v1/sync/jobs/{job['job_id']}")
+    _print(args, job, SYNC_JOB_COLUMNS)
+    return 1 if job["status"] == "FAILED" else 0
+
+
+def _sync_status(args: argparse.Namespace) -> int:
+    job = _client(args).get(f"/api/v1/sync/jobs/{args.job_id}")
+    _print(args, job, SYNC_JOB_COLUMNS)
+    if args.output == "table" and job.get("table_results"):
+        tables = [dict(result, table=name) for name, result in job["table_results"].items()]
+        print("\n" + format_table(tables, TABLE_RESULT_COLUMNS))
+    return 1 if job["status"] == "FAILED" else 0
+
+
+def _sync_list(args: argparse.Namespace) -> int:
+    result = _client(args).get("/api/v1/sync/jobs", {"county_id": args.county, "sync_pair_id": args.sync_pair,
+                                                     "status": args.status, "q": args.search, "limit": args.limit,
+                                                     "cursor": args.cursor})
+    _print(args, result, SYNC_JOB_COLUMNS, "jobs")
+    return 0
+
+
+def _export_create(args: argparse.Namespace) -> int:
+    client = _client(args)
+    body = {
+        "county_id": args.county,
+        "username": client.username or getpass.getuser(),
+        "export_format": args.format,
+        "area_of_interest": _json_argument(args.area) if args.area else {},
+        "layers": args.layer,
+        "parameters": _parameters(args.param),
+        "priority": args.priority,
+    }
+    job = client.post("/api/v1/gis-export/jobs", {name: value for name, value in body.items() if value is not None})
+    _print(args, job, EXPORT_JOB_COLUMNS)
+    return 1 if job["status"] == "FAILED" else 0
+
+
+def _job_cancel(args: argparse.Namespace) -> int:
+    from terrafusion_client import ApiError
+    client = _client(args)
+    if args.kind in ("sync", None):
+        try:
+            job = client.post(f"/api/v1/sync/jobs/{args.job_id}/cancel", {"username": client.username})
+            _print(args, job, SYNC_JOB_COLUMNS)
+            return 0
+        except ApiError as e:
+            # Without --kind, an ID that is no sync job may be an export job
+            if e.status != 404 or args.kind == "sync":
+                raise
+    job = client.post(f"/api/v1/gis-export/jobs/{args.job_id}/cancel")
+    _print(args, job, EXPORT_JOB_COLUMNS)
+    return 0
+
+
+def _conflict_list(args: argparse.Namespace) -> int:
+    result = _client(args).get("/api/v1/sync/conflicts", {"sync_pair_id": args.sync_pair, "table": args.table,
+                                                          "record_key": args.record_key, "status": args.status,
+                                                          "limit": args.limit, "cursor": args.cursor})
+    _print(args, result, CONFLICT_COLUMNS, "conflicts")
+    return 0
+
+
+def _import(args: argparse.Namespace) -> int:
+    if not os.path.isfile(args.file):
+        raise ValueError(f"No file {args.file}")
+    client = _client(args)
+    username = client.username or getpass.getuser()
+    record = client.upload(f"/api/v1/sync/pairs/{args.sync_pair}/tables/{args.table}/imports", args.file,
+                           {"username": username, "sheet": args.sheet})
+    interactive = sys.stdin.isatty() and not args.yes and args.output == "table"
+    mapping = dict(record["preview"]["mapping"], **_import_mapping(args.map, record["header"]))
+    if interactive:
+        print(format_table(record["suggestions"], ["header", "column", "match"]))
+        print("\nPress Enter to keep a header's column, type another column, or - to leave the header out.")
+        for header in record["header"]:
+            answer = input(f"  {header} [{mapping.get(header) or '-'}]: ").strip()
+            if answer:
+                mapping[header] = None if answer == "-" else answer
+    if mapping != record["preview"]["mapping"]:
+        record = client.post(f"/api/v1/sync/imports/{record['import_id']}/preview",
+                             {"username": username, "mapping": mapping})
+    if args.output == "table":
+        print(format_import_preview(record))
+    preview = record["preview"]
+    if args.preview or (not args.yes and not interactive):
+        if args.output == "table":
+            print(f"\nImport {record['import_id']} previewed; nothing was loaded (commit with --yes).")
+        else:
+            _emit(args, record, [_import_problem(entry) for entry in preview["records"]], IMPORT_PROBLEM_COLUMNS)
+        return 1 if preview["errors"] else 0
+    if interactive and input(f"\nLoad {record['rows']} rows into {args.table} of {args.sync_pair}? [y/N] "
+                             ).strip().lower() not in ("y", "yes"):
+        print(f"Import {record['import_id']} not committed; it is kept until {record['expires_at']}.")
+        return 0
+    record = client.post(f"/api/v1/sync/imports/{record['import_id']}/commit",
+                         {"username": username, "allow_errors": args.allow_errors})
+    failed = [_import_problem(entry) for entry in record["result"]["records"]]
+    if args.output != "table":
+        _emit(args, record, failed, IMPORT_PROBLEM_COLUMNS)
+    else:
+        print(f"\n{record.get('message') or record['status']} (job {record['job_id']})")
+        if failed:
+            print("\n" + format_table(failed, IMPORT_PROBLEM_COLUMNS))
+    return 1 if record["status"] == "FAILED" else 0
+
+
+def _import_mapping(pairs: List[str], header: List[str]) -> Dict[str, Optional[str]]:
+    """--map HEADER=COLUMN arguments as mapping overrides; an empty column leaves the header out."""
+    mapping = {}
+    for pair in pairs or []:
+        name, separator, column = pair.partition("=")
+        if not separator or name not in header:
+            raise ValueError(f"--map {pair} must be HEADER=COLUMN, with a header of the file")
+        mapping[name] = column.strip() or None
+    return mapping
+
+
+def _import_problem(entry: Dict[str, Any]) -> Dict[str, Any]:
+    return dict(entry, key=json.dumps(entry.get("key")) if entry.get("key") else None,
+                errors="; ".join(entry.get("errors") or []))
+
+
+def format_import_preview(record: Dict[str, Any]) -> str:
+    """The preview of a spreadsheet import: mapping, row counts, changes, problem rows and the first rows."""
+    preview = record["preview"]
+    sheet = f" (sheet {record['sheet']})" if record.get("sheet") else ""
+    lines = [f"{record['filename']}{sheet}: {record['rows']} rows for {record['table']} of {record['sync_pair_id']}",
+             "", format_table([{"header": header, "column": column or "-"}
+                               for header, column in preview["mapping"].items()], ["header", "column"])]
+    if preview.get("counts"):
+        counts = ", ".join(f"{count} {status}" for status, count in preview["counts"].items() if count)
+        lines += ["", f"Preview: {counts or 'no rows'}"]
+    if preview.get("diff_summary"):
+        diff = preview["diff_summary"]
+        lines.append(f"Changes: {diff['inserts']} inserts, {diff['updates']} updates, {diff['unchanged']} unchanged")
+    if preview.get("records"):
+        lines += ["", format_table([_import_problem(entry) for entry in preview["records"]], IMPORT_PROBLEM_COLUMNS)]
+        if preview.get("records_truncated"):
+            lines.append("(more problem rows in --output json)")
+    if preview.get("sample"):
+        columns = ["row"] + [column for column in preview["mapping"].values() if column]
+        lines += ["", "First rows as they will be sent:",
+                  format_table([dict(sample["record"], row=sample["row"]) for sample in preview["sample"]], columns)]
+    for error in preview["errors"]:
+        lines.append(f"\nError: {error}")
+    return "\n".join(lines)
+
+
+def _api_parser(commands, name: str, help_text: str, description: Optional[str] = None) -> argparse.ArgumentParser:
+    """A subcommand calling the service's API, with the connection and output options."""
+    parser = commands.add_parser(name, help=help_text, description=description or help_text)
+    parser.add_argument('--url', help="Service URL (TERRAFUSION_URL; stored by login otherwise)")
+    parser.add_argument('--api-key', help="API key (TERRAFUSION_API_KEY; stored by login otherwise)")
+    _output_arguments(parser)
+    return parser
+
+
+def _output_arguments(parser: argparse.ArgumentParser) -> None:
+    parser.add_argument('--output', type=_output_format, choices=OUTPUT_FORMATS, default="table",
+                        help="Print a table, the full result as JSON, or its rows as CSV")
+    # --json from before --output took csv
+    parser.add_argument('--json', dest="output", action='store_const', const="json", help=argparse.SUPPRESS)
+
+
+def _list_arguments(parser: argparse.ArgumentParser) -> None:
+    parser.add_argument('--limit', type=int, default=20, help="Items per page")
+    parser.add_argument('--cursor', help="Next page, from the previous page's cursor")
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    """Command-line entry point; returns the exit status."""
+    parser = argparse.ArgumentParser(prog="terrafusion", description="TerraFusion Platform")
+    parser.add_argument('--verbose', action='store_true', help="Log INFO messages to stderr")
+    parser.add_argument('--profile', help="Configuration profile to apply (TERRAFUSION_PROFILE; see config_profiles)")
+    parser.add_argument('--set', action='append', metavar="KEY=VALUE",
+                        help="Setting that takes precedence over every other layer (repeatable)")
+    commands = parser.add_subparsers(dest="command", required=True)
+    doctor = commands.add_parser("doctor", help="Check configuration, connectivity, schemas, disk space and clock",
+                                 description="Check configuration, connectivity, permissions, schemas, disk space "
+                                             "and clock skew. Exits 1 when a check fails.")
+    doctor.add_argument('--county', help="Only check this county's configuration and sync pairs")
+    doctor.add_argument('--sync-pair', help="Only check this sync pair")
+    doctor.add_argument('--config-dir', default="county_configs", help="County configuration directory")
+    doctor.add_argument('--ntp-server', help="NTP server the clock is compared with (DOCTOR_NTP_SERVER)")
+    doctor.add_argument('--skip-clock', action='store_true', help="Do not check the clock (no NTP access)")
+    _output_arguments(doctor)
+    compact = commands.add_parser("compact", help="Archive and delete job history past its retention",
+                                  description="Archive finished sync and export jobs past their county's "
+                                              "job_retention, delete them and compact the job store. "
+                                              "Exits 1 when a job cannot be archived or deleted.")
+    compact.add_argument('--county', help="Only this county's jobs")
+    compact.add_argument('--dry-run', action='store_true', help="Report what would be deleted; change nothing")
+    compact.add_argument('--config-dir', default="county_configs", help="County configuration directory")
+    _output_arguments(compact)
+    config = commands.add_parser("config", help="Validate, explain or compare the configuration").add_subparsers(
+        dest="action", required=True)
+    validate = config.add_parser("validate", help="Check the configuration against its schema",
+                                 description="Check the environment, authentication settings, county configuration "
+                                             "files, their field mappings and the stored schedules; unknown keys "
+                                             "and type errors are reported with their file, line and column. "
+                                             "Exits 1 when there are errors.")
+    validate.add_argument('--county', help="Only check this county's configuration file")
+    validate.add_argument('--config-dir', default="county_configs", help="County configuration directory")
+    validate.add_argument('--skip-schedules', action='store_true', help="Do not check the stored schedules")
+    _output_arguments(validate)
+    explain = config.add_parser("explain", help="Print the effective configuration",
+                                description="Print the configuration as the services load it, with defaults, "
+                                            "inherited settings and vendor tables filled in and secrets masked.")
+    explain.add_argument('--county', help="Only this county")
+    explain.add_argument('--sync-pair', help="Only this sync pair")
+    explain.add_argument('--config-dir', default="county_configs", help="County configuration directory")
+    _output_arguments(explain)
+    _output_arguments(config.add_parser("profiles", help="List the configuration profiles",
+                                        description="List the configuration profiles, the profile each extends "
+                                                    "and its number of settings. Exits 1 when a profile's chain "
+                                                    "is broken."))
+    diff = config.add_parser("diff", help="Compare the settings of two configuration profiles",
+                             description="Print the settings two profiles give differently, with the layer each "
+                                         "value comes from; sensitive values are masked with a fingerprint.")
+    diff.add_argument('left', help="Profile compared")
+    diff.add_argument('right', help="Profile compared with")
+    _output_arguments(diff)
+
+    init = commands.add_parser("init", help="Set up a sync pair: connect, select tables, map fields and test",
+                               description="Connect to a source database, select its tables, generate a field "
+                                           "mapping from their catalog definitions, write and validate the "
+                                           "county configuration, and sync up to 100 records of each table as "
+                                           "a test. Exits 1 when the configuration is invalid or the test "
+                                           "sync fails.")
+    init.add_argument('--county', help="County ID, such as benton_wa (a new county is created)")
+    init.add_argument('--county-name', help="Friendly name of a new county")
+    init.add_argument('--timezone', help="Time zone of a new county")
+    init.add_argument('--sync-pair', help="ID of the new sync pair")
+    init.add_argument('--source-type', choices=["sqlserver", "oracle", "postgres"], help="Source database type")
+    init.add_argument('--schema', help="Source schema (postgres and oracle)")
+    init.add_argument('--table', action='append', help="Source table to sync (repeatable; chosen from a list otherwise)")
+    init.add_argument('--target-type', choices=["postgres_staging", "sqlite_staging"], help="Staging target")
+    init.add_argument('--sqlite-path', help="SQLite staging database of a sqlite_staging target")
+    init.add_argument('--env-file', help="Environment file the source connection settings are written to")
+    init.add_argument('--replace', action='store_true', help="Replace a sync pair and mapping file of the same name")
+    init.add_argument('--skip-test-sync', action='store_true', help="Write the configuration without a test sync")
+    init.add_argument('--test-records', type=int, help="Records of each table the test sync writes (100)")
+    init.add_argument('--yes', action='store_true', help="Take the default answers instead of asking")
+    init.add_argument('--config-dir', default="county_configs", help="County configuration directory")
+    _output_arguments(init)
+
+    migrate = commands.add_parser("migrate", help="Apply or revert the staging store's schema migrations"
+                                  ).add_subparsers(dest="action", required=True)
+    migrations = [migrate.add_parser("status", help="List the migrations and which are applied"),
+                  migrate.add_parser("up", help="Apply the pending migrations"),
+                  migrate.add_parser("down", help="Revert the newest applied migration (or down to --to)")]
+    for command in migrations:
+        command.add_argument('--database-url', help="Staging store (STAGING_DATABASE_URL or DATABASE_URL)")
+        command.add_argument('--schema', help="Schema migrated (STAGING_SCHEMA, staging by default)")
+        _output_arguments(command)
+    migrations[1].add_argument('--to', type=int, help="Apply migrations up to this version only")
+    migrations[2].add_argument('--to', type=int, help="Revert migrations newer than this version")
+    migrations[2].add_argument('--yes', action='store_true', help="Do not ask for confirmation")
+
+    backup = commands.add_parser("backup", help="Write an encrypted archive of the sync state and configuration",
+                                 description="Archive the sync state store (job history, watermarks, schedules "
+                                             "and the rest), the county configuration files with their mappings, "
+                                             "and the names of the secrets they reference, encrypted with a "
+                                             "passphrase.")
+    backup.add_argument('archive', help="Archive to write")
+    restore = commands.add_parser("restore", help="Restore an archive written by backup",
+                                  description="Restore the sync state and configuration files of an archive; run "
+                                              "it with the service stopped.")
+    restore.add_argument('archive', help="Archive to restore")
+    restore.add_argument('--clean', action='store_true',
+                         help="Delete documents of the restored collections that the archive does not have")
+    restore.add_argument('--overwrite-config', action='store_true',
+                         help="Replace configuration files that differ from the archive's")
+    restore.add_argument('--skip-config', action='store_true', help="Restore the sync state only")
+    restore.add_argument('--dry-run', action='store_true', help="Report what would change; change nothing")
+    for command in (backup, restore):
+        command.add_argument('--passphrase-file', help="File holding the passphrase (TERRAFUSION_BACKUP_PASSPHRASE "
+                                                       "or a prompt otherwise)")
+        command.add_argument('--collection', action='append', help="Only this state collection (repeatable)")
+        command.add_argument('--config-dir', default="county_configs", help="County configuration directory")
+        _output_arguments(command)
+
+    service = commands.add_parser("service", help="Run the gateway as a Windows service or systemd unit"
+                                  ).add_subparsers(dest="action", required=True)
+    service_run = service.add_parser("run", help="Serve the API and background services until stopped",
+                                     description="Serve the API and the enabled background services in the "
+                                                 "foreground, as the installed service does; SIGTERM or Ctrl+C "
+                                                 "drains the sync job queue and stops gracefully.")
+    service_run.add_argument('--env-file', help="Environment file to load first")
+    service_install = service.add_parser("install", help="Install the service",
+                                         description="Register a Windows service, or write and enable a systemd "
+                                                     "unit of Type=notify, that runs `terrafusion service run`.")
+    service_install.add_argument('--directory', help="Working directory of the service (the current directory)")
+    service_install.add_argument('--env-file', help="Environment file the service loads")
+    service_install.add_argument('--user', help="User the systemd unit runs as (the current user)")
+    service_install.add_argument('--manual', action='store_true', help="Do not start the Windows service at boot")
+    service_install.add_argument('--print-unit', action='store_true', help="Print the systemd unit; install nothing")
+    controls = [service.add_parser("uninstall", help="Stop and remove the service"),
+                service.add_parser("start", help="Start the service"),
+                service.add_parser("stop", help="Stop the service gracefully"),
+                service.add_parser("status", help="Print the service's state")]
+    for control in [service_install] + controls:
+        control.add_argument('--unit-dir', default="/etc/systemd/system", help="Directory of the systemd unit")
+        _output_arguments(control)
+
+    login = commands.add_parser("login", help="Store the service URL and credentials the API commands use",
+                                description="Check and store the service URL with an API key, or sign in as a "
+                                            "user and store the session's tokens.")
+    login.add_argument('--url', help="Service URL (TERRAFUSION_URL)")
+    login.add_argument('--api-key', help="API key to store")
+    login.add_argument('--username', help="User to sign in as; the password is prompted for (TERRAFUSION_PASSWORD)")
+    _output_arguments(login)
+    _output_arguments(commands.add_parser("logout", help="End the stored session and remove the stored credentials"))
+
+    sync = commands.add_parser("sync", help="Run and follow sync jobs").add_subparsers(dest="action", required=True)
+    run = _api_parser(sync, "run", "Start a sync job of a sync pair")
+    run.add_argument('sync_pair_id', help="Sync pair to sync")
+    run.add_argument('--mode', choices=["full", "incremental"], help="Sync mode (the sync pair's default otherwise)")
+    run.add_argument('--table', action='append', help="Only sync this table (repeatable)")
+    run.add_argument('--param', action='append', help="Job parameter as key=value (repeatable)")
+    run.add_argument('--dry-run', action='store_true', help="Compare without writing")
+    run.add_argument('--priority', help="Queue priority: urgent, high, normal or low")
+    run.add_argument('--express', action='store_true', default=None, help="Use the queue's express lane")
+    run.add_argument('--wait', action='store_true', help="Wait until the job finishes; exits 1 when it fails")
+    run.add_argument('--interval', type=float, default=WAIT_INTERVAL_SECONDS, help="Seconds between status checks")
+    status = _api_parser(sync, "status", "Show a sync job and its table results")
+    status.add_argument('job_id', help="Sync job")
+    listing = _api_parser(sync, "list", "List sync jobs, newest first")
+    listing.add_argument('--county', help="Only this county's jobs")
+    listing.add_argument('--sync-pair', help="Only this sync pair's jobs")
+    listing.add_argument('--status', help="Only jobs in this status")
+    listing.add_argument('--search', help="Only jobs matching this text")
+    _list_arguments(listing)
+
+    export = commands.add_parser("export", help="Create GIS exports").add_subparsers(dest="action", required=True)
+    create = _api_parser(export, "create", "Create and run a GIS export job")
+    create.add_argument('--county', required=True, help="County to export from")
+    create.add_argument('--format', required=True, help="Export format, such as geojson, shapefile or geopackage")
+    create.add_argument('--layer', action='append', required=True, help="Layer to export (repeatable)")
+    create.add_argument('--area', help="Area of interest as GeoJSON, inline or a file (the whole county otherwise)")
+    create.add_argument('--param', action='append', help="Export parameter as key=value (repeatable)")
+    create.add_argument('--priority', help="Load shedding priority: urgent, high, normal or low")
+
+    job = commands.add_parser("job", help="Control sync and export jobs").add_subparsers(dest="action", required=True)
+    cancel = _api_parser(job, "cancel", "Cancel a sync or export job")
+    cancel.add_argument('job_id', help="Sync or export job")
+    cancel.add_argument('--kind', choices=["sync", "export"], help="Kind of job (tried as a sync job first otherwise)")
+
+    conflict = commands.add_parser("conflict", help="Review sync conflicts").add_subparsers(dest="action",
+                                                                                          required=True)
+    conflicts = _api_parser(conflict, "list", "List the conflicts of bidirectional syncs, newest first")
+    conflicts.add_argument('--sync-pair', help="Only this sync pair's conflicts")
+    conflicts.add_argument('--table', help="Only this table's conflicts")
+    conflicts.add_argument('--record-key', help="Only this record's conflicts")
+    conflicts.add_argument('--status', choices=["PENDING", "RESOLVED"], help="Only conflicts in this status")
+    _list_arguments(conflicts)
+
+    spreadsheet = _api_parser(commands, "import", "Load a CSV or Excel file into a sync pair's table",
+                              "Upload a CSV or Excel file, confirm the suggested column mapping, preview the "
+                              "rows through the sync pair's pipeline and commit them. Without a terminal it "
+                              "only previews, unless --yes is given.")
+    spreadsheet.add_argument('file', help="CSV (.csv, .txt) or Excel (.xlsx) file")
+    spreadsheet.add_argument('--sync-pair', required=True, help="Sync pair to load into")
+    spreadsheet.add_argument('--table', required=True, help="Source table of the sync pair the rows belong to")
+    spreadsheet.add_argument('--sheet', help="Worksheet of an Excel file (the first otherwise)")
+    spreadsheet.add_argument('--map', action='append', help="Map a header to a column as HEADER=COLUMN, or "
+                                                            "HEADER= to leave it out (repeatable)")
+    spreadsheet.add_argument('--preview', action='store_true', help="Preview only; nothing is loaded")
+    spreadsheet.add_argument('--yes', action='store_true', help="Commit after the preview without asking")
+    spreadsheet.add_argument('--allow-errors', action='store_true',
+                             help="Commit although the preview found rows that would not load")
+
+    completion = commands.add_parser("completion", help="Print a shell's tab completion script",
+                                     description="Print the tab completion script of the terrafusion command for "
+                                                 "bash, zsh or PowerShell (see cli_completion for installing it).")
+    completion.add_argument('shell', choices=SHELLS, help="Shell to complete in")
+
+    args = parser.parse_args(argv)
+    from config_profiles import apply_profile, parse_overrides, ProfileError
+    try:
+        # Before the service modules read their settings as they load
+        env_file = args.env_file if args.command == "service" and args.action == "run" else None
+        apply_profile(args.profile, env_file, parse_overrides(args.set))
+    except ProfileError as e:
+        print(f"terrafusion: {e}", file=sys.stderr)
+        return 1
+    from logging_config import configure_structured_logging
+    # Progress logs would drown the report; configured before the service modules log as they load
+    configure_structured_logging(logging.INFO if args.verbose else logging.WARNING)
+    if args.command == "doctor":
+        return _doctor(args)
+    if args.command == "compact":
+        return _compact(args)
+    if args.command == "config":
+        return {"validate": _config_validate, "explain": _config_explain, "profiles": _config_profiles,
+                "diff": _config_diff}[args.action](args)
+    if args.command == "init":
+        return _init(args)
+    if args.command == "migrate":
+        return _migrate(args)
+    if args.command == "backup":
+        return _backup(args)
+    if args.command == "restore":
+        return _restore(args)
+    if args.command == "service":
+        return _service(args)
+    if args.command == "completion":
+        return _completion(args, parser)
+    handlers = {("login", None): _login, ("logout", None): _logout, ("sync", "run"): _sync_run,
+                ("sync", "status"): _sync_status, ("sync", "list"): _sync_list, ("export", "create"): _export_create,
+                ("job", "cancel"): _job_cancel, ("conflict", "list"): _conflict_list, ("import", None): _import}
+    handler = handlers.get((args.command, getattr(args, "action", None)))
+    if handler is None:
+        return 2
+    from terrafusion_client import ApiError
+    try:
+        return handler(args)
+    except (ApiError, ValueError) as e:
+        print(f"terrafusion {args.command}: {e}", file=sys.stderr)
+        return 1
+
+
+if __name__ == "__main__":
+    sys.exit(main())
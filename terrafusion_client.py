@@ -0,0 +1,236 @@
+"""
+TerraFusion Platform - API Client
+
+This module provides the REST client the `terrafusion` command's operations
+commands (sync, export, job, conflict) call the service with, and the
+credentials they sign in with. `terrafusion login` stores them once:
+
+    terrafusion login --url https://terrafusion.co.benton.wa.us --api-key tfk_...
+    terrafusion login --url https://terrafusion.co.benton.wa.us --username jsmith
+
+An API key is sent in its X-API-Key header (see api_keys). A username signs
+in with its password (prompted for, or TERRAFUSION_PASSWORD) and, when its
+role requires one, an authenticator code, and stores the access and refresh
+tokens instead of the password; an access token that has expired is
+refreshed once and saved again. Credentials are kept in
+TERRAFUSION_CREDENTIALS (~/.config/terrafusion/credentials.json by default),
+readable by the operator only. TERRAFUSION_URL and TERRAFUSION_API_KEY, and
+the commands' --url and --api-key, take precedence over the file, so jobs
+and CI can run without one.
+"""
+
+import os
+import json
+import logging
+from typing import Dict, Any, Optional, Callable
+
+import requests
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# File the stored credentials are kept in
+CREDENTIALS_PATH = os.environ.get("TERRAFUSION_CREDENTIALS",
+                                  os.path.join(os.path.expanduser("~"), ".config", "terrafusion", "credentials.json"))
+
+# Seconds a request may take
+REQUEST_TIMEOUT_SECONDS = float(os.environ.get("TERRAFUSION_TIMEOUT_SECONDS", "60"))
+
+API_KEY_HEADER = "X-API-Key"
+
+LOGIN_PATH = "/api/v1/rbac/login"
+MFA_VERIFY_PATH = "/api/v1/rbac/mfa/verify"
+REFRESH_PATH = "/api/v1/rbac/token/refresh"
+LOGOUT_PATH = "/api/v1/rbac/logout"
+
+
+class ApiError(Exception):
+    """A request the service refused or could not be sent."""
+
+    def __init__(self, message: str, status: Optional[int] = None):
+        super().__init__(message)
+        self.status = status
+
+
+def load_credentials(path: str = CREDENTIALS_PATH) -> Dict[str, Any]:
+    """The stored credentials, empty when none were stored."""
+    if not os.path.exists(path):
+        return {}
+    try:
+        with open(path, "r") as f:
+            return json.load(f)
+    except (OSError, ValueError) as e:
+        raise ApiError(f"Cannot read the stored credentials in {path}: {e}")
+
+
+def save_credentials(credentials: Dict[str, Any], path: str = CREDENTIALS_PATH) -> None:
+    """Store credentials, readable by the current user only."""
+    os.makedirs(os.path.dirname(os.path.abspath(path)), exist_ok=True)
+    descriptor = os.open(f"{path}.partial", os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+    with os.fdopen(descriptor, "w") as f:
+        json.dump(credentials, f, indent=2)
+    os.replace(f"{path}.partial", path)
+
+
+def delete_credentials(path: str = CREDENTIALS_PATH) -> bool:
+    """Remove the stored credentials; returns whether there were any."""
+    if not os.path.exists(path):
+        return False
+    os.remove(path)
+    return True
+
+
+class ApiClient:
+    """Calls the service's REST API with an API key or the tokens of a signed-in user."""
+
+    def __init__(self, url: str, api_key: Optional[str] = None, token: Optional[str] = None,
+                 refresh_token: Optional[str] = None, username: Optional[str] = None,
+                 credentials_path: Optional[str] = None):
+        """
+        Initialize the client.
+
+        Args:
+            url: Base URL of the service, without /api/v1
+            api_key: API key to send, instead of a token
+            token: Access token of a signed-in user
+            refresh_token: Refresh token exchanged for a new access token when it expires
+            username: User the credentials belong to, recorded on the jobs it submits
+            credentials_path: File refreshed tokens are saved to, when they came from one
+        """
+        self.url = url.rstrip("/")
+        self.api_key = api_key
+        self.token = token
+        self.refresh_token = refresh_token
+        self.username = username
+        self.credentials_path = credentials_path
+        self.session = requests.Session()
+
+    @classmethod
+    def from_settings(cls, url: Optional[str] = None, api_key: Optional[str] = None,
+                      path: str = CREDENTIALS_PATH) -> "ApiClient":
+        """
+        A client from command-line settings, the environment and the stored credentials, in that order.
+
+        Raises:
+            ApiError: If no service URL is known
+        """
+        stored = load_credentials(path)
+        url = url or os.environ.get("TERRAFUSION_URL") or stored.get("url")
+        if not url:
+            raise ApiError("No TerraFusion service URL; run `terrafusion login --url ...` or set TERRAFUSION_URL")
+        api_key = api_key or os.environ.get("TERRAFUSION_API_KEY")
+        if api_key or url.rstrip("/") != (stored.get("url") or "").rstrip("/"):
+            # Stored credentials belong to the service they were stored for
+            return cls(url, api_key=api_key)
+        return cls(url, api_key=stored.get("api_key"), token=stored.get("token"),
+                   refresh_token=stored.get("refresh_token"), username=stored.get("username"), credentials_path=path)
+
+    def get(self, path: str, params: Optional[Dict[str, Any]] = None) -> Any:
+        return self.request("GET", path, params=params)
+
+    def post(self, path: str, body: Optional[Dict[str, Any]] = None) -> Any:
+        return self.request("POST", path, body=body)
+
+    def upload(self, path: str, file_path: str, fields: Optional[Dict[str, Any]] = None) -> Any:
+        """POST a file as multipart form data, with form fields (None values left out)."""
+        with open(file_path, "rb") as f:
+            files = {"file": (os.path.basename(file_path), f.read())}
+        form = {name: value for name, value in (fields or {}).items() if value is not None}
+        return self.request("POST", path, files=files, form=form)
+
+    def request(self, method: str, path: str, params: Optional[Dict[str, Any]] = None,
+                body: Optional[Dict[str, Any]] = None, files: Optional[Dict[str, Any]] = None,
+                form: Optional[Dict[str, Any]] = None) -> Any:
+        """
+        Send a request and return its decoded JSON body.
+
+        Raises:
+            ApiError: If the service answers with an error status or cannot be reached
+        """
+        params = {name: value for name, value in (params or {}).items() if value is not None}
+        response = self._send(method, path, params, body, files, form)
+        if response.status_code == 401 and self.refresh_token and not self.api_key:
+            self._refresh()
+            response = self._send(method, path, params, body, files, form)
+        if response.status_code >= 400:
+            raise ApiError(self._error_message(response), response.status_code)
+        if not response.content:
+            return None
+        try:
+            return response.json()
+        except ValueError:
+            raise ApiError(f"{method} {path} answered with {response.headers.get('Content-Type')}, not JSON",
+                           response.status_code)
+
+    def login(self, username: str, password: str, code: Optional[Callable[[], str]] = None) -> Dict[str, Any]:
+        """
+        Sign in as a user, keeping the tokens on the client.
+
+        Args:
+            username: User to sign in as
+            password: The user's password
+            code: Asks for the authenticator code when the user's role requires one
+
+        Raises:
+            ApiError: If the service refuses the credentials
+        """
+        result = self.post(LOGIN_PATH, {"username": username, "password": password})
+        if result and result.get("mfa_required") and not result.get("enrollment_required") and code:
+            result = self.post(MFA_VERIFY_PATH, {"mfa_token": result["mfa_token"], "code": code()})
+        if not result or not result.get("success", True) or not result.get("token"):
+            raise ApiError((result or {}).get("error") or "Sign-in failed", 401)
+        self.token = result["token"]
+        self.refresh_token = result.get("refresh_token")
+        self.username = username
+        return result
+
+    def logout(self) -> None:
+        """End the signed-in user's session on the service."""
+        if self.token:
+            self.post(LOGOUT_PATH)
+
+    def credentials(self) -> Dict[str, Any]:
+        """The client's credentials as they are stored."""
+        stored = {"url": self.url, "username": self.username}
+        if self.api_key:
+            stored["api_key"] = self.api_key
+        else:
+            stored.update(token=self.token, refresh_token=self.refresh_token)
+        return {name: value for name, value in stored.items() if value is not None}
+
+    def _send(self, method: str, path: str, params: Dict[str, Any], body: Optional[Dict[str, Any]],
+              files: Optional[Dict[str, Any]] = None, form: Optional[Dict[str, Any]] = None):
+        headers = {"Accept": "application/json"}
+        if self.api_key:
+            headers[API_KEY_HEADER] = self.api_key
+        elif self.token:
+            headers["Authorization"] = f"Bearer {self.token}"
+        try:
+            return self.session.request(method, f"{self.url}{path}", params=params, json=body, files=files,
+                                        data=form, headers=headers, timeout=REQUEST_TIMEOUT_SECONDS)
+        except requests.RequestException as e:
+            raise ApiError(f"Cannot reach {self.url}: {e}")
+
+    def _refresh(self) -> None:
+        """Exchange the refresh token for new tokens, saving them where they were stored."""
+        response = self._send("POST", REFRESH_PATH, {}, {"refresh_token": self.refresh_token})
+        try:
+            result = response.json() if response.content else {}
+        except ValueError:
+            result = {}
+        if response.status_code >= 400 or not isinstance(result, dict) or not result.get("token"):
+            raise ApiError("The stored session has expired; run `terrafusion login` again", 401)
+        self.token = result["token"]
+        self.refresh_token = result.get("refresh_token", self.refresh_token)
+        if self.credentials_path:
+            save_credentials(self.credentials(), self.credentials_path)
+        logger.info("Refreshed the stored access token")
+
+    @staticmethod
+    def _error_message(response) -> str:
+        try:
+            error = response.json().get("error")
+        except (ValueError, AttributeError):
+            error = None
+        return f"{response.status_code}: {error or response.reason or 'request failed'}"
@@ -0,0 +1,385 @@
+"""
+TerraFusion Platform - Tracing
+
+This module provides the OpenTelemetry tracing that follows a sync from the
+API request that started it through the job queue, the sync pipeline and
+the connectors, so the phase responsible for a slow nightly sync can be
+seen in the trace:
+
+    POST /api/v1/sync/jobs            gateway request
+      sync.queue.wait                 time the job waited in the job queue before its first run
+      sync.job                        the job run
+        sync.snapshot / sync.validate / sync.topology
+        sync.table                    one per table, on its worker
+          sync.read                   a batch read from the source
+          sync.merge / sync.transform
+          sync.write                  the batch written to the target
+          sync.checkpoint
+
+A job keeps the trace context of the request that created it, so it joins
+that trace even when another node's queue runs it. Requests carrying a W3C
+traceparent header continue the caller's trace, and responses name their
+trace in X-Trace-Id. Outbound HTTP requests of connectors, geocoders and
+webhooks send traceparent, and SQL statements of connectors and the gateway
+carry it as a sqlcommenter comment (/*traceparent='00-...'*/), so a slow
+query in pg_stat_activity or a SQL Server trace leads back to its span.
+
+Tracing is off unless the OpenTelemetry SDK is installed and an exporter is
+configured with the standard variables: OTEL_EXPORTER_OTLP_ENDPOINT (or
+OTEL_TRACES_EXPORTER=console), OTEL_SERVICE_NAME and OTEL_TRACES_SAMPLER.
+Databases that cache plans by statement text (SQL Server, Oracle) see a new
+text per batch with comments; set TRACING_SQL_COMMENTS=false to leave them out.
+"""
+
+import os
+import logging
+import threading
+from contextlib import contextmanager
+from datetime import datetime, timezone
+from typing import Dict, Any, Optional, Iterable, Iterator
+from urllib.parse import urlsplit, urlunsplit
+
+try:
+    from opentelemetry import trace, propagate, context as otel_context
+    from opentelemetry.trace import SpanKind, Status, StatusCode
+    OTEL_AVAILABLE = True
+except ImportError:
+    # Tracing requires opentelemetry-api
+    OTEL_AVAILABLE = False
+
+try:
+    from opentelemetry.sdk.resources import Resource
+    from opentelemetry.sdk.trace import TracerProvider
+    from opentelemetry.sdk.trace.export import BatchSpanProcessor, ConsoleSpanExporter
+    OTEL_SDK_AVAILABLE = True
+except ImportError:
+    # Exporting spans requires opentelemetry-sdk
+    OTEL_SDK_AVAILABLE = False
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Span exporter: "otlp", "console" or "none"; OTLP when an endpoint is configured
+EXPORTER = os.environ.get("OTEL_TRACES_EXPORTER") or (
+    "otlp" if os.environ.get("OTEL_EXPORTER_OTLP_ENDPOINT") or os.environ.get("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+    else "none"
+)
+
+# OTLP transport: "http/protobuf" or "grpc"
+OTLP_PROTOCOL = os.environ.get("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf")
+
+# Service name of the spans of this process
+SERVICE_NAME = os.environ.get("OTEL_SERVICE_NAME", "terrafusion-sync")
+
+# Whether SQL statements carry their trace context as a comment
+SQL_COMMENTS = os.environ.get("TRACING_SQL_COMMENTS", "true").lower() == "true"
+
+# Instrumentation name of the spans
+TRACER_NAME = "terrafusion"
+
+# Header naming the trace of a response
+TRACE_ID_HEADER = "X-Trace-Id"
+
+
+class _NoopSpan:
+    """Stands in for a span while tracing is off."""
+
+    def set_attribute(self, key: str, value: Any) -> None:
+        pass
+
+
+_NOOP_SPAN = _NoopSpan()
+
+
+def _attributes(values: Optional[Dict[str, Any]]) -> Dict[str, Any]:
+    # Span attributes cannot be None
+    return {key: value for key, value in (values or {}).items() if value is not None}
+
+
+def _timestamp(value: Any) -> Optional[int]:
+    """Nanoseconds since the epoch of a UTC ISO timestamp as stored on job records."""
+    if not value:
+        return None
+    moment = datetime.fromisoformat(str(value))
+    if moment.tzinfo is None:
+        moment = moment.replace(tzinfo=timezone.utc)
+    return int(moment.timestamp() * 1_000_000_000)
+
+
+def _safe_url(url: str) -> str:
+    # Query strings and user info can hold tokens and API keys
+    parts = urlsplit(str(url))
+    return urlunsplit((parts.scheme, parts.netloc.rpartition("@")[2], parts.path, "", ""))
+
+
+class TracedCursor:
+    """A DB-API cursor whose statements carry the current trace context."""
+
+    def __init__(self, cursor, tracing: "Tracing"):
+        object.__setattr__(self, "wrapped", cursor)
+        object.__setattr__(self, "_tracing", tracing)
+
+    def execute(self, sql, *args, **kwargs):
+        return self.wrapped.execute(self._tracing.comment_sql(sql), *args, **kwargs)
+
+    def executemany(self, sql, *args, **kwargs):
+        return self.wrapped.executemany(self._tracing.comment_sql(sql), *args, **kwargs)
+
+    def __getattr__(self, name: str) -> Any:
+        return getattr(self.wrapped, name)
+
+    def __setattr__(self, name: str, value: Any) -> None:
+        setattr(self.wrapped, name, value)
+
+    def __iter__(self):
+        return iter(self.wrapped)
+
+    def __enter__(self):
+        self.wrapped.__enter__()
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        return self.wrapped.__exit__(exc_type, exc, tb)
+
+
+class TracedConnection:
+    """A DB-API connection whose cursors (and, for sqlite3, execute) carry the current trace context."""
+
+    def __init__(self, connection, tracing: "Tracing"):
+        object.__setattr__(self, "wrapped", connection)
+        object.__setattr__(self, "_tracing", tracing)
+
+    def cursor(self, *args, **kwargs):
+        return TracedCursor(self.wrapped.cursor(*args, **kwargs), self._tracing)
+
+    def execute(self, sql, *args, **kwargs):
+        return self.wrapped.execute(self._tracing.comment_sql(sql), *args, **kwargs)
+
+    def executemany(self, sql, *args, **kwargs):
+        return self.wrapped.executemany(self._tracing.comment_sql(sql), *args, **kwargs)
+
+    def __getattr__(self, name: str) -> Any:
+        return getattr(self.wrapped, name)
+
+    def __setattr__(self, name: str, value: Any) -> None:
+        setattr(self.wrapped, name, value)
+
+    def __enter__(self):
+        self.wrapped.__enter__()
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        return self.wrapped.__exit__(exc_type, exc, tb)
+
+
+class Tracing:
+    """
+    Service class for the spans of this process.
+
+    The tracer provider is set up on first use, so worker processes forked
+    after import each export their own spans.
+    """
+
+    def __init__(self, exporter: str = EXPORTER, service_name: str = SERVICE_NAME,
+                 sql_comments: bool = SQL_COMMENTS):
+        self.exporter = exporter.lower()
+        self.service_name = service_name
+        self.sql_comments = sql_comments
+        self._tracer = None
+        self._lock = threading.Lock()
+
+    @property
+    def enabled(self) -> bool:
+        return OTEL_AVAILABLE and OTEL_SDK_AVAILABLE and self.exporter != "none"
+
+    def _span_exporter(self):
+        if self.exporter == "console":
+            return ConsoleSpanExporter()
+        if self.exporter != "otlp":
+            raise ValueError(f"Unsupported OTEL_TRACES_EXPORTER: {self.exporter}. "
+                             f"Supported exporters: otlp, console, none")
+        if OTLP_PROTOCOL == "grpc":
+            from opentelemetry.exporter.otlp.proto.grpc.trace_exporter import OTLPSpanExporter
+        else:
+            from opentelemetry.exporter.otlp.proto.http.trace_exporter import OTLPSpanExporter
+        return OTLPSpanExporter()
+
+    def tracer(self):
+        """The tracer of this process, setting up the provider on first use; None while tracing is off."""
+        if self._tracer is not None or not self.enabled:
+            return self._tracer
+        with self._lock:
+            if self._tracer is None:
+                provider = trace.get_tracer_provider()
+                if not isinstance(provider, TracerProvider):
+                    # Not already set up by opentelemetry-instrument or the hosting application
+                    try:
+                        exporter = self._span_exporter()
+                    except (ValueError, ImportError) as e:
+                        logger.error(f"Tracing is off: {e}")
+                        self.exporter = "none"
+                        return None
+                    provider = TracerProvider(resource=Resource.create({"service.name": self.service_name}))
+                    provider.add_span_processor(BatchSpanProcessor(exporter))
+                    trace.set_tracer_provider(provider)
+                    logger.info(f"Exporting traces of {self.service_name} with the {self.exporter} exporter")
+                self._tracer = provider.get_tracer(TRACER_NAME)
+            return self._tracer
+
+    @contextmanager
+    def span(self, name: str, attributes: Optional[Dict[str, Any]] = None,
+             parent: Optional[Dict[str, str]] = None, kind: str = "internal",
+             start_time: Any = None) -> Iterator[Any]:
+        """
+        Run a block in a span, current for the block's duration.
+
+        Args:
+            name: Span name
+            attributes: Span attributes; None values are left out
+            parent: Trace context carrier (see carrier) to continue; the current span by default
+            kind: "internal", "server", "client", "producer" or "consumer"
+            start_time: When the span started (UTC ISO timestamp), if before the block
+
+        Errors raised by the block are recorded on the span and re-raised.
+        """
+        tracer = self.tracer()
+        if tracer is None:
+            yield _NOOP_SPAN
+            return
+        with tracer.start_as_current_span(name, context=propagate.extract(parent) if parent else None,
+                                          kind=getattr(SpanKind, kind.upper()), attributes=_attributes(attributes),
+                                          start_time=_timestamp(start_time)) as current:
+            yield current
+
+    def record(self, name: str, start_time: Any, attributes: Optional[Dict[str, Any]] = None,
+               parent: Optional[Dict[str, str]] = None) -> None:
+        """Record a span that started at start_time (UTC ISO timestamp) and ends now."""
+        tracer = self.tracer()
+        if tracer is None or not start_time:
+            return
+        tracer.start_span(name, context=propagate.extract(parent) if parent else None,
+                          attributes=_attributes(attributes), start_time=_timestamp(start_time)).end()
+
+    def iterate(self, name: str, items: Iterable[Any], attributes: Optional[Dict[str, Any]] = None) -> Iterator[Any]:
+        """Yield from items, producing each in its own span (a source read per batch)."""
+        if self.tracer() is None:
+            yield from items
+            return
+        iterator = iter(items)
+        while True:
+            with self.span(name, attributes) as current:
+                try:
+                    item = next(iterator)
+                except StopIteration:
+                    return
+                if hasattr(item, "__len__"):
+                    current.set_attribute("sync.records", len(item))
+            yield item
+
+    def fail(self, span: Any, message: str) -> None:
+        """Mark a span as failed without an exception (a job that ended FAILED)."""
+        if isinstance(span, _NoopSpan):
+            return
+        span.set_status(Status(StatusCode.ERROR, message))
+
+    def carrier(self) -> Dict[str, str]:
+        """The current trace context as headers (traceparent), to store or send; empty while tracing is off."""
+        if self.tracer() is None:
+            return {}
+        headers: Dict[str, str] = {}
+        propagate.inject(headers)
+        return headers
+
+    def trace_id(self) -> Optional[str]:
+        """The current trace's ID in hex, or None outside a span."""
+        if self.tracer() is None:
+            return None
+        span_context = trace.get_current_span().get_span_context()
+        return trace.format_trace_id(span_context.trace_id) if span_context.is_valid else None
+
+    def start_request(self, name: str, headers: Any, attributes: Optional[Dict[str, Any]] = None) -> Any:
+        """
+        Start the server span of an API request, continuing the caller's traceparent.
+
+        Returns:
+            Handle for finish_request, or None while tracing is off
+        """
+        tracer = self.tracer()
+        if tracer is None:
+            return None
+        parent = propagate.extract({key.lower(): value for key, value in dict(headers).items()})
+        span = tracer.start_span(name, context=parent, kind=SpanKind.SERVER, attributes=_attributes(attributes))
+        return span, otel_context.attach(trace.set_span_in_context(span, parent))
+
+    def finish_request(self, handle: Any, status_code: Optional[int], error: Optional[BaseException] = None) -> None:
+        """End a request's server span (see start_request)."""
+        if handle is None:
+            return
+        span, token = handle
+        try:
+            if status_code is not None:
+                span.set_attribute("http.status_code", status_code)
+            if error is not None:
+                span.record_exception(error)
+                span.set_status(Status(StatusCode.ERROR, str(error)))
+            elif status_code is not None and status_code >= 500:
+                span.set_status(Status(StatusCode.ERROR))
+            span.end()
+        finally:
+            otel_context.detach(token)
+
+    def comment_sql(self, sql: Any) -> Any:
+        """A SQL statement with the current traceparent appended as a sqlcommenter comment."""
+        if not self.sql_comments or not isinstance(sql, (str, bytes)):
+            return sql
+        # Only traceparent: other values could hold % or ? and be taken for parameters
+        traceparent = self.carrier().get("traceparent")
+        if not traceparent:
+            return sql
+        comment = f" /*traceparent='{traceparent}'*/"
+        end = ";"
+        if isinstance(sql, bytes):
+            comment, end = comment.encode("ascii"), b";"
+        statement = sql.rstrip()
+        if statement.endswith(end):
+            return statement[:-1] + comment + end
+        return statement + comment
+
+    def traced_connection(self, connection):
+        """Wrap a DB-API connection so its statements carry the trace context; unchanged while tracing is off."""
+        if connection is None or not self.sql_comments or self.tracer() is None:
+            return connection
+        return TracedConnection(connection, self)
+
+    @staticmethod
+    def unwrap(connection):
+        """The driver connection of a traced_connection, to hand back to its pool."""
+        return connection.wrapped if isinstance(connection, TracedConnection) else connection
+
+    def traced_session(self, session):
+        """
+        Make a requests session send traceparent and record a client span per
+        request; returned unchanged while tracing is off.
+        """
+        if self.tracer() is None:
+            return session
+        send = session.request
+
+        def request(method, url, *args, **kwargs):
+            attributes = {"http.method": str(method).upper(), "http.url": _safe_url(url)}
+            with self.span(f"HTTP {str(method).upper()}", attributes, kind="client") as current:
+                headers = dict(kwargs.pop("headers", None) or {})
+                propagate.inject(headers)
+                response = send(method, url, *args, headers=headers, **kwargs)
+                current.set_attribute("http.status_code", response.status_code)
+                if response.status_code >= 500:
+                    self.fail(current, f"HTTP {response.status_code}")
+                return response
+
+        session.request = request
+        return session
+
+
+# Create a singleton instance
+tracer = Tracing()
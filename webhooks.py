@@ -0,0 +1,566 @@
+"""
+TerraFusion Platform - Webhooks
+
+This module provides outbound webhooks: subscribers register a URL for the
+events they care about and receive a signed JSON POST whenever one happens,
+instead of polling the API. Events:
+
+- sync.completed / sync.failed: a sync job finished
+- export.ready / export.failed: a GIS export job finished
+- validation.failures: a sync job quarantined at least the webhook's
+  min_validation_failures records for breaking validation rules
+  (see sync_validation)
+- appeal.status_changed: a sync changed the status of an appeal (see
+  sync_appeals); a webhook's appeal_statuses narrows it to appeals that
+  reached one of those statuses
+
+A webhook can be narrowed to one county or sync pair. Every request carries
+the headers
+
+    X-TerraFusion-Event: sync.completed
+    X-TerraFusion-Delivery: <delivery ID, the same on every retry>
+    X-TerraFusion-Timestamp: <Unix seconds>
+    X-TerraFusion-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook's secret>
+
+so receivers can check that a payload came from TerraFusion and reject
+replays. The secret is returned once, when the webhook is created.
+
+Deliveries are queued in the state store and sent by a background worker
+(WEBHOOKS_ENABLED; run it on exactly one instance). A delivery that times
+out, cannot connect or gets a 408, 429 or 5xx response is retried with
+exponential backoff; after WEBHOOK_MAX_ATTEMPTS attempts, or at once for
+any other 4xx response, it is marked DEAD. Dead deliveries stay listed for
+review and can be redelivered once the receiver is fixed.
+"""
+
+import os
+import hmac
+import json
+import time
+import uuid
+import hashlib
+import logging
+import secrets
+import threading
+from datetime import datetime, timedelta
+from typing import Dict, List, Any, Optional
+from urllib.parse import urlparse
+
+import requests
+
+from sync_store import DocumentStore, sync_state_store
+from event_bus import EventBus, EventBusError, event_bus, SUBJECT_SYNC_JOB, SUBJECT_EXPORT_JOB, SUBJECT_ENTITY
+from sync_appeals import APPEAL_STATUSES
+from audit_log import AuditLog
+from tracing import tracer
+
+# Configure logging
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# State store collections
+WEBHOOKS_COLLECTION = "webhooks"
+DELIVERIES_COLLECTION = "webhook_deliveries"
+
+WEBHOOK_EVENTS = ["sync.completed", "sync.failed", "export.ready", "export.failed", "validation.failures",
+                  "appeal.status_changed"]
+
+DELIVERY_STATUSES = ["PENDING", "DELIVERED", "DEAD"]
+
+# Attempts before a delivery is marked DEAD
+MAX_ATTEMPTS = int(os.environ.get("WEBHOOK_MAX_ATTEMPTS", "8"))
+
+# Wait before the first retry; doubled after each failed attempt up to MAX_BACKOFF_SECONDS
+BACKOFF_SECONDS = float(os.environ.get("WEBHOOK_BACKOFF_SECONDS", "30"))
+MAX_BACKOFF_SECONDS = 3600.0
+
+# Seconds a receiver has to answer
+REQUEST_TIMEOUT = 10
+
+# How often the worker looks for due deliveries
+POLL_SECONDS = 5
+
+# Response statuses worth retrying; other non-2xx statuses are permanent failures
+RETRY_STATUS_CODES = {408, 429}
+
+# Delivered and dead deliveries kept per webhook; older ones are removed
+DELIVERY_HISTORY = 500
+
+# Plain http:// URLs are refused unless allowed, so payloads and signatures are not sent in clear
+ALLOW_HTTP = os.environ.get("WEBHOOK_ALLOW_HTTP", "false").lower() == "true"
+
+# Queue group of the bus subscriptions, so each event is queued once across instances
+QUEUE_GROUP = "webhooks"
+
+USER_AGENT = "TerraFusion-Webhooks/1.0"
+
+
+def sign(secret: str, timestamp: str, body: bytes) -> str:
+    """The X-TerraFusion-Signature value of a request body."""
+    digest = hmac.new(secret.encode("utf-8"), timestamp.encode("utf-8") + b"." + body, hashlib.sha256).hexdigest()
+    return f"sha256={digest}"
+
+
+def verify(secret: str, timestamp: str, body: bytes, signature: str) -> bool:
+    """Check a signature the way a receiver should, in constant time."""
+    return hmac.compare_digest(sign(secret, timestamp, body), signature or "")
+
+
+def _check_url(url: Any) -> str:
+    if not isinstance(url, str) or not url:
+        raise ValueError("url is required")
+    parsed = urlparse(url)
+    if parsed.scheme not in ("https", "http") or not parsed.netloc:
+        raise ValueError(f"Invalid webhook URL {url}")
+    if parsed.scheme == "http" and not ALLOW_HTTP:
+        raise ValueError("Webhook URLs must use https (set WEBHOOK_ALLOW_HTTP=true to allow http)")
+    return url
+
+
+def _check_events(events: Any) -> List[str]:
+    if not isinstance(events, list) or not events:
+        raise ValueError(f"events must be a non-empty list of: {', '.join(WEBHOOK_EVENTS)}")
+    unknown = [e for e in events if e not in WEBHOOK_EVENTS]
+    if unknown:
+        raise ValueError(f"Unknown webhook event {unknown[0]}; choose from {', '.join(WEBHOOK_EVENTS)}")
+    return list(dict.fromkeys(events))
+
+
+def _check_threshold(value: Any) -> int:
+    if isinstance(value, bool) or not isinstance(value, int) or value < 1:
+        raise ValueError("min_validation_failures must be a positive integer")
+    return value
+
+
+def _check_appeal_statuses(value: Any) -> Optional[List[str]]:
+    if value is None:
+        return None
+    if not isinstance(value, list) or not value or any(status not in APPEAL_STATUSES for status in value):
+        raise ValueError(f"appeal_statuses must be a non-empty list of: {', '.join(APPEAL_STATUSES)}")
+    return list(dict.fromkeys(value))
+
+
+def _public(webhook: Dict[str, Any]) -> Dict[str, Any]:
+    """A webhook without its secret."""
+    return {k: v for k, v in webhook.items() if k != "secret"}
+
+
+class WebhookService:
+    """Registers webhooks, queues their deliveries and sends them."""
+
+    def __init__(self, engine=None, store: Optional[DocumentStore] = None, bus: Optional[EventBus] = None,
+                 audit: Optional[AuditLog] = None, session: Optional[requests.Session] = None):
+        """
+        Initialize the service.
+
+        Args:
+            engine: Sync engine, to read the validation results of finished jobs
+            store: Document store for webhooks and deliveries
+            bus: Event bus the job events are announced on
+            audit: Audit log for webhook changes
+            session: HTTP session deliveries are sent with
+        """
+        self.engine = engine
+        self.store = store or sync_state_store
+        self.bus = bus or event_bus
+        self.audit = audit or AuditLog(self.store)
+        self.session = session or tracer.traced_session(requests.Session())
+        self._lock = threading.Lock()
+        self._subscriptions = []
+        self._stop_event = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+
+    # Webhooks ---------------------------------------------------------------
+
+    def create(self, url: str, events: List[str], username: str, county_id: Optional[str] = None,
+               sync_pair_id: Optional[str] = None, secret: Optional[str] = None,
+               min_validation_failures: int = 1, description: Optional[str] = None,
+               appeal_statuses: Optional[List[str]] = None) -> Dict[str, Any]:
+        """
+        Register a webhook.
+
+        Args:
+            url: https URL the events are POSTed to
+            events: Events to send (see WEBHOOK_EVENTS)
+            username: User registering the webhook
+            county_id: Only send events of this county
+            sync_pair_id: Only send events of this sync pair's jobs
+            secret: Signing secret; one is generated when omitted
+            min_validation_failures: Quarantined records that trigger validation.failures
+            description: Free text
+            appeal_statuses: Only send appeal.status_changed for appeals reaching these statuses
+
+        Returns:
+            The webhook, including its secret
+
+        Raises:
+            ValueError: If a setting is invalid
+        """
+        if secret is not None and (not isinstance(secret, str) or len(secret) < 16):
+            raise ValueError("secret must be at least 16 characters")
+        webhook = {
+            "webhook_id": str(uuid.uuid4()),
+            "url": _check_url(url),
+            "events": _check_events(events),
+            "county_id": county_id,
+            "sync_pair_id": sync_pair_id,
+            "min_validation_failures": _check_threshold(min_validation_failures),
+            "appeal_statuses": _check_appeal_statuses(appeal_statuses),
+            "description": description,
+            "active": True,
+            "secret": secret or secrets.token_hex(32),
+            "created_by": username,
+            "created_at": datetime.utcnow().isoformat(),
+            "updated_at": None,
+        }
+        self.store.save(WEBHOOKS_COLLECTION, webhook["webhook_id"], webhook)
+        self.audit.record("webhook.created", username, "webhook", webhook["webhook_id"],
+                          {"url": webhook["url"], "events": webhook["events"]}, county_id)
+        logger.info(f"Registered webhook {webhook['webhook_id']} for {', '.join(webhook['events'])}")
+        return dict(webhook)
+
+    def get(self, webhook_id: str) -> Dict[str, Any]:
+        """
+        A webhook, without its secret.
+
+        Raises:
+            FileNotFoundError: If the webhook does not exist
+        """
+        return _public(self.store.load(WEBHOOKS_COLLECTION, webhook_id))
+
+    def list(self, county_id: Optional[str] = None) -> List[Dict[str, Any]]:
+        """Webhooks, optionally of one county, newest first."""
+        webhooks = [_public(w) for w in self.store.list(WEBHOOKS_COLLECTION)
+                    if not county_id or w.get("county_id") == county_id]
+        webhooks.sort(key=lambda w: w.get("created_at", ""), reverse=True)
+        return webhooks
+
+    def update(self, webhook_id: str, changes: Dict[str, Any], username: str) -> Dict[str, Any]:
+        """
+        Change a webhook's url, events, filters, threshold, appeal statuses, description or active flag.
+
+        Raises:
+            FileNotFoundError: If the webhook does not exist
+            ValueError: If a change is invalid
+        """
+        webhook = self.store.load(WEBHOOKS_COLLECTION, webhook_id)
+        checks = {
+            "url": _check_url,
+            "events": _check_events,
+            "min_validation_failures": _check_threshold,
+            "appeal_statuses": _check_appeal_statuses,
+            "county_id": lambda v: v,
+            "sync_pair_id": lambda v: v,
+            "description": lambda v: v,
+            "active": lambda v: bool(v),
+        }
+        unknown = [name for name in changes if name not in checks]
+        if unknown:
+            raise ValueError(f"Cannot change {unknown[0]}; webhooks take {', '.join(checks)}")
+        for name, value in changes.items():
+            webhook[name] = checks[name](value)
+        webhook["updated_at"] = datetime.utcnow().isoformat()
+        self.store.save(WEBHOOKS_COLLECTION, webhook_id, webhook)
+        self.audit.record("webhook.updated", username, "webhook", webhook_id, {"changes": sorted(changes)},
+                          webhook.get("county_id"))
+        return _public(webhook)
+
+    def rotate_secret(self, webhook_id: str, username: str) -> Dict[str, Any]:
+        """
+        Replace a webhook's signing secret.
+
+        Returns:
+            The webhook, including its new secret
+
+        Raises:
+            FileNotFoundError: If the webhook does not exist
+        """
+        webhook = self.store.load(WEBHOOKS_COLLECTION, webhook_id)
+        webhook["secret"] = secrets.token_hex(32)
+        webhook["updated_at"] = datetime.utcnow().isoformat()
+        self.store.save(WEBHOOKS_COLLECTION, webhook_id, webhook)
+        self.audit.record("webhook.secret_rotated", username, "webhook", webhook_id, county_id=webhook.get("county_id"))
+        return dict(webhook)
+
+    def delete(self, webhook_id: str, username: str) -> None:
+        """
+        Remove a webhook; its queued deliveries are dropped.
+
+        Raises:
+            FileNotFoundError: If the webhook does not exist
+        """
+        webhook = self.store.load(WEBHOOKS_COLLECTION, webhook_id)
+        self.store.delete(WEBHOOKS_COLLECTION, webhook_id)
+        for delivery in self.store.list(DELIVERIES_COLLECTION):
+            if delivery["webhook_id"] == webhook_id and delivery["status"] == "PENDING":
+                self.store.delete(DELIVERIES_COLLECTION, delivery["delivery_id"])
+        self.audit.record("webhook.deleted", username, "webhook", webhook_id, {"url": webhook["url"]},
+                          webhook.get("county_id"))
+
+    # Deliveries -------------------------------------------------------------
+
+    def list_deliveries(self, webhook_id: Optional[str] = None, status: Optional[str] = None,
+                        limit: int = 100) -> List[Dict[str, Any]]:
+        """Deliveries, newest first; status=DEAD is the dead-letter view."""
+        if status and status not in DELIVERY_STATUSES:
+            raise ValueError(f"Invalid delivery status {status}; choose from {', '.join(DELIVERY_STATUSES)}")
+        deliveries = [d for d in self.store.list(DELIVERIES_COLLECTION)
+                      if (not webhook_id or d["webhook_id"] == webhook_id) and (not status or d["status"] == status)]
+        deliveries.sort(key=lambda d: d.get("created_at", ""), reverse=True)
+        return deliveries[:limit]
+
+    def get_delivery(self, delivery_id: str) -> Dict[str, Any]:
+        """
+        A delivery and its attempts.
+
+        Raises:
+            FileNotFoundError: If the delivery does not exist
+        """
+        return self.store.load(DELIVERIES_COLLECTION, delivery_id)
+
+    def redeliver(self, delivery_id: str, username: str) -> Dict[str, Any]:
+        """
+        Queue a dead (or delivered) delivery again, with a fresh set of attempts.
+
+        Raises:
+            FileNotFoundError: If the delivery or its webhook does not exist
+            ValueError: If the delivery is still pending
+        """
+        with self._lock:
+            delivery = self.store.load(DELIVERIES_COLLECTION, delivery_id)
+            if delivery["status"] == "PENDING":
+                raise ValueError(f"Delivery {delivery_id} is already pending")
+            self.store.load(WEBHOOKS_COLLECTION, delivery["webhook_id"])
+            delivery.update({"status": "PENDING", "attempt_count": 0,
+                             "next_attempt_at": datetime.utcnow().isoformat(), "redelivered_by": username})
+            self.store.save(DELIVERIES_COLLECTION, delivery_id, delivery)
+        logger.info(f"Webhook delivery {delivery_id} queued again by {username}")
+        return delivery
+
+    def enqueue(self, event: str, event_id: str, data: Dict[str, Any], county_id: Optional[str] = None,
+                sync_pair_id: Optional[str] = None, validation_failures: int = 0,
+                appeal_status: Optional[str] = None) -> List[Dict[str, Any]]:
+        """
+        Queue an event for every active webhook that wants it.
+
+        A delivery's ID comes from the webhook and event IDs, so an event
+        handled twice is still delivered once.
+
+        Returns:
+            The deliveries queued
+        """
+        queued = []
+        for webhook in self.store.list(WEBHOOKS_COLLECTION):
+            if not webhook.get("active") or event not in webhook["events"]:
+                continue
+            if webhook.get("county_id") and webhook["county_id"] != county_id:
+                continue
+            if webhook.get("sync_pair_id") and webhook["sync_pair_id"] != sync_pair_id:
+                continue
+            if event == "validation.failures" and validation_failures < webhook.get("min_validation_failures", 1):
+                continue
+            if event == "appeal.status_changed" and webhook.get("appeal_statuses") \
+                    and appeal_status not in webhook["appeal_statuses"]:
+                continue
+            delivery_id = str(uuid.uuid5(uuid.NAMESPACE_URL, f"{webhook['webhook_id']}/{event_id}"))
+            now = datetime.utcnow().isoformat()
+            delivery = {
+                "delivery_id": delivery_id,
+                "webhook_id": webhook["webhook_id"],
+                "event": event,
+                "event_id": event_id,
+                "payload": {"event_id": event_id, "event": event, "created_at": now, "data": data},
+                "status": "PENDING",
+                "attempt_count": 0,
+                "attempts": [],
+                "next_attempt_at": now,
+                "created_at": now,
+                "delivered_at": None,
+            }
+            with self._lock:
+                if self.store.exists(DELIVERIES_COLLECTION, delivery_id):
+                    continue
+                self.store.save(DELIVERIES_COLLECTION, delivery_id, delivery)
+            queued.append(delivery)
+        if queued:
+            logger.info(f"Queued {len(queued)} webhook deliveries of {event} {event_id}")
+        return queued
+
+    def deliver_due(self) -> int:
+        """
+        Send every pending delivery whose next attempt is due.
+
+        Returns:
+            Number of deliveries attempted
+        """
+        now = datetime.utcnow().isoformat()
+        due = [d for d in self.store.list(DELIVERIES_COLLECTION)
+               if d["status"] == "PENDING" and d.get("next_attempt_at", "") <= now]
+        due.sort(key=lambda d: d["next_attempt_at"])
+        for delivery in due:
+            self._attempt(delivery)
+        if due:
+            self._prune()
+        return len(due)
+
+    def _attempt(self, delivery: Dict[str, Any]) -> None:
+        try:
+            webhook = self.store.load(WEBHOOKS_COLLECTION, delivery["webhook_id"])
+        except FileNotFoundError:
+            self.store.delete(DELIVERIES_COLLECTION, delivery["delivery_id"])
+            return
+
+        body = json.dumps(delivery["payload"], default=str).encode("utf-8")
+        timestamp = str(int(time.time()))
+        headers = {
+            "Content-Type": "application/json",
+            "User-Agent": USER_AGENT,
+            "X-TerraFusion-Event": delivery["event"],
+            "X-TerraFusion-Delivery": delivery["delivery_id"],
+            "X-TerraFusion-Timestamp": timestamp,
+            "X-TerraFusion-Signature": sign(webhook["secret"], timestamp, body),
+        }
+        attempt = {"attempted_at": datetime.utcnow().isoformat(), "status_code": None, "error": None}
+        delivered, retry = False, True
+        started = time.monotonic()
+        try:
+            response = self.session.post(webhook["url"], data=body, headers=headers, timeout=REQUEST_TIMEOUT,
+                                         allow_redirects=False)
+            attempt["status_code"] = response.status_code
+            if 200 <= response.status_code < 300:
+                delivered = True
+            else:
+                attempt["error"] = f"HTTP {response.status_code}: {response.text[:200]}"
+                retry = response.status_code >= 500 or response.status_code in RETRY_STATUS_CODES
+        except requests.RequestException as e:
+            attempt["error"] = str(e)
+        attempt["duration_ms"] = round((time.monotonic() - started) * 1000)
+
+        delivery["attempt_count"] += 1
+        delivery["attempts"] = (delivery.get("attempts") or [])[-(MAX_ATTEMPTS - 1):] + [attempt]
+        if delivered:
+            delivery["status"] = "DELIVERED"
+            delivery["delivered_at"] = attempt["attempted_at"]
+            logger.info(f"Delivered {delivery['event']} to webhook {webhook['webhook_id']}")
+        elif not retry or delivery["attempt_count"] >= MAX_ATTEMPTS:
+            delivery["status"] = "DEAD"
+            logger.error(f"Webhook delivery {delivery['delivery_id']} to {webhook['url']} failed after "
+                         f"{delivery['attempt_count']} attempts: {attempt['error']}")
+        else:
+            delay = min(BACKOFF_SECONDS * 2 ** (delivery["attempt_count"] - 1), MAX_BACKOFF_SECONDS)
+            delivery["next_attempt_at"] = (datetime.utcnow() + timedelta(seconds=delay)).isoformat()
+            logger.warning(f"Webhook delivery {delivery['delivery_id']} to {webhook['url']} failed "
+                           f"(attempt {delivery['attempt_count']} of {MAX_ATTEMPTS}), retrying in {delay:.0f}s: "
+                           f"{attempt['error']}")
+        with self._lock:
+            if self.store.exists(DELIVERIES_COLLECTION, delivery["delivery_id"]):
+                self.store.save(DELIVERIES_COLLECTION, delivery["delivery_id"], delivery)
+
+    def _prune(self) -> None:
+        """Keep the latest DELIVERY_HISTORY finished deliveries of each webhook."""
+        finished: Dict[str, List[Dict[str, Any]]] = {}
+        for delivery in self.store.list(DELIVERIES_COLLECTION):
+            if delivery["status"] != "PENDING":
+                finished.setdefault(delivery["webhook_id"], []).append(delivery)
+        for deliveries in finished.values():
+            deliveries.sort(key=lambda d: d.get("created_at", ""), reverse=True)
+            for delivery in deliveries[DELIVERY_HISTORY:]:
+                self.store.delete(DELIVERIES_COLLECTION, delivery["delivery_id"])
+
+    # Events -----------------------------------------------------------------
+
+    def _on_sync_event(self, envelope: Dict[str, Any]) -> None:
+        event = envelope.get("subject", "").rsplit(".", 1)[-1]
+        if event not in ("completed", "failed"):
+            return
+        data = envelope.get("data") or {}
+        county_id, sync_pair_id = data.get("county_id"), data.get("sync_pair_id")
+        self.enqueue(f"sync.{event}", envelope["event_id"], data, county_id, sync_pair_id)
+
+        job = None
+        if self.engine is not None:
+            try:
+                job = self.engine.get_job_status(data["job_id"])
+            except FileNotFoundError:
+                pass
+        quarantined = {name: result.get("records_quarantined", 0)
+                       for name, result in ((job or {}).get("table_results") or {}).items()
+                       if result.get("records_quarantined")}
+        if quarantined:
+            self.enqueue("validation.failures", f"{envelope['event_id']}.validation",
+                         dict(data, validation_failures=sum(quarantined.values()), quarantined_by_table=quarantined),
+                         county_id, sync_pair_id, sum(quarantined.values()))
+
+    def _on_export_event(self, envelope: Dict[str, Any]) -> None:
+        event = envelope.get("subject", "").rsplit(".", 1)[-1]
+        names = {"completed": "export.ready", "failed": "export.failed"}
+        if event in names:
+            data = envelope.get("data") or {}
+            self.enqueue(names[event], envelope["event_id"], data, data.get("county_id"))
+
+    def _on_appeal_event(self, envelope: Dict[str, Any]) -> None:
+        data = envelope.get("data") or {}
+        county_id = data.get("county_id")
+        if county_id is None and self.engine is not None:
+            try:
+                county_id = self.engine.registry.get(data.get("sync_pair_id")).county_id
+            except KeyError:
+                pass
+        self.enqueue("appeal.status_changed", data.get("change_id") or envelope["event_id"], data, county_id,
+                     data.get("sync_pair_id"), appeal_status=data.get("status"))
+
+    def _safely(self, handler):
+        def handle(envelope: Dict[str, Any]) -> None:
+            try:
+                handler(envelope)
+            except Exception as e:
+                logger.error(f"Cannot queue webhook deliveries of {envelope.get('subject')}: {e}", exc_info=True)
+        return handle
+
+    # Worker -----------------------------------------------------------------
+
+    def start(self) -> None:
+        """Subscribe to job events and start the delivery thread."""
+        if self._thread is not None and self._thread.is_alive():
+            return
+        try:
+            self._subscriptions = [
+                self.bus.subscribe(SUBJECT_SYNC_JOB.format(job_id="*", event="*"),
+                                   self._safely(self._on_sync_event), QUEUE_GROUP),
+                self.bus.subscribe(SUBJECT_EXPORT_JOB.format(job_id="*", event="*"),
+                                   self._safely(self._on_export_event), QUEUE_GROUP),
+                self.bus.subscribe(SUBJECT_ENTITY.format(entity="appeals", event="status_changed"),
+                                   self._safely(self._on_appeal_event), QUEUE_GROUP),
+            ]
+        except EventBusError as e:
+            logger.error(f"Cannot subscribe webhooks to job events: {e}")
+        self._stop_event.clear()
+        self._thread = threading.Thread(target=self._loop, name="webhook-delivery", daemon=True)
+        self._thread.start()
+        logger.info(f"Webhook delivery started (checking every {POLL_SECONDS}s)")
+
+    def stop(self) -> None:
+        """Unsubscribe and stop the delivery thread."""
+        for subscription in self._subscriptions:
+            subscription.unsubscribe()
+        self._subscriptions = []
+        self._stop_event.set()
+        if self._thread is not None:
+            self._thread.join(timeout=POLL_SECONDS + REQUEST_TIMEOUT)
+            self._thread = None
+        logger.info("Webhook delivery stopped")
+
+    def status(self) -> Dict[str, Any]:
+        """Whether the worker runs, and the deliveries by status."""
+        counts = {status: 0 for status in DELIVERY_STATUSES}
+        for delivery in self.store.list(DELIVERIES_COLLECTION):
+            counts[delivery["status"]] = counts.get(delivery["status"], 0) + 1
+        return {"running": self._thread is not None and self._thread.is_alive(), "deliveries": counts}
+
+    def _loop(self) -> None:
+        while not self._stop_event.is_set():
+            try:
+                self.deliver_due()
+            except Exception as e:
+                logger.error(f"Error sending webhook deliveries: {e}", exc_info=True)
+            self._stop_event.wait(POLL_SECONDS)